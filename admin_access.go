@@ -0,0 +1,189 @@
+package nebula
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/slackhq/nebula/config"
+)
+
+// adminLevel is what an administrator may do through the sshd or the control api, each level includes the ones below
+type adminLevel int
+
+const (
+	adminLevelNone   adminLevel = iota // nothing beyond help
+	adminLevelRead                     // listing and printing state
+	adminLevelTunnel                   // managing tunnels, creating, closing, probing and handshaking
+	adminLevelReload                   // everything, reloading the config, profiling, packet captures and logging
+)
+
+var adminLevelNames = []string{"none", "read", "tunnel", "reload"}
+
+func parseAdminLevel(s string) (adminLevel, error) {
+	for i, name := range adminLevelNames {
+		if strings.EqualFold(s, name) {
+			return adminLevel(i), nil
+		}
+	}
+	return adminLevelNone, fmt.Errorf("unknown level `%s`. possible levels: %s", s, adminLevelNames)
+}
+
+func (al adminLevel) String() string {
+	if al < 0 || int(al) >= len(adminLevelNames) {
+		return fmt.Sprintf("adminLevel(%d)", int(al))
+	}
+	return adminLevelNames[al]
+}
+
+// sshCommandLevels is the level needed to run an ssh command, commands that are not listed need adminLevelReload
+var sshCommandLevels = map[string]adminLevel{
+	"help":                    adminLevelNone,
+	"logout":                  adminLevelNone,
+	"version":                 adminLevelRead,
+	"list-hostmap":            adminLevelRead,
+	"list-pending-hostmap":    adminLevelRead,
+	"list-lighthouse-addrmap": adminLevelRead,
+	"device-info":             adminLevelRead,
+	"perf":                    adminLevelRead,
+	"print-cert":              adminLevelRead,
+	"print-tunnel":            adminLevelRead,
+	"print-relays":            adminLevelRead,
+	"print-relay-usage":       adminLevelRead,
+	"print-firewall-stats":    adminLevelRead,
+	"print-cidr-sets":         adminLevelRead,
+	"print-unsafe-routes":     adminLevelRead,
+	"lighthouse-info":         adminLevelRead,
+	"change-remote":           adminLevelTunnel,
+	"close-tunnel":            adminLevelTunnel,
+	"create-tunnel":           adminLevelTunnel,
+	"query-lighthouse":        adminLevelTunnel,
+	"diag":                    adminLevelTunnel,
+	"test-handshake":          adminLevelTunnel,
+}
+
+// sshCommandLevel returns the level needed to run the ssh command name
+func sshCommandLevel(name string) adminLevel {
+	if level, ok := sshCommandLevels[name]; ok {
+		return level
+	}
+	return adminLevelReload
+}
+
+// adminAuditEntry is a record of an ssh command or control api request
+type adminAuditEntry struct {
+	Time        time.Time `json:"time"`
+	Interface   string    `json:"interface"`
+	User        string    `json:"user"`
+	Fingerprint string    `json:"fingerprint,omitempty"`
+	Remote      string    `json:"remote,omitempty"`
+	Action      string    `json:"action"`
+	Args        []string  `json:"args,omitempty"`
+	Allowed     bool      `json:"allowed"`
+	Error       string    `json:"error,omitempty"`
+}
+
+// adminAudit records everything asked of the sshd and the control api. Records are appended to audit.path as json
+// lines, or logged when it is not set. A nil adminAudit records nothing.
+type adminAudit struct {
+	l *logrus.Logger
+
+	lock sync.Mutex
+	out  *os.File
+}
+
+func newAdminAuditFromConfig(l *logrus.Logger, c *config.C) (*adminAudit, error) {
+	a := &adminAudit{l: l}
+	if err := a.reload(c, true); err != nil {
+		return nil, err
+	}
+
+	c.RegisterReloadCallback(func(c *config.C) {
+		if err := a.reload(c, false); err != nil {
+			a.l.WithError(err).Error("Failed to reload the audit log")
+		}
+	})
+
+	return a, nil
+}
+
+// reload opens audit.path again, which also picks up a file that was rotated away
+func (a *adminAudit) reload(c *config.C, initial bool) error {
+	path := c.GetString("audit.path", "")
+
+	var out *os.File
+	if path != "" {
+		var err error
+		out, err = os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+		if err != nil {
+			return fmt.Errorf("failed to open audit.path: %w", err)
+		}
+	}
+
+	a.lock.Lock()
+	old := a.out
+	a.out = out
+	a.lock.Unlock()
+
+	if old != nil {
+		old.Close()
+	}
+
+	if !initial {
+		a.l.WithField("path", path).Info("Reloaded the audit log")
+	}
+	return nil
+}
+
+func (a *adminAudit) record(e adminAuditEntry) {
+	if a == nil {
+		return
+	}
+
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if a.out == nil {
+		a.l.WithField("audit", e.logFields()).Info("Administrative action")
+		return
+	}
+
+	b, err := json.Marshal(e)
+	if err == nil {
+		_, err = a.out.Write(append(b, '\n'))
+	}
+	if err != nil {
+		a.l.WithError(err).WithField("audit", e.logFields()).Error("Failed to write to the audit log")
+	}
+}
+
+// logFields are the fields of e as a map so logging.redact can reach the remote address
+func (e adminAuditEntry) logFields() m {
+	f := m{
+		"interface": e.Interface,
+		"user":      e.User,
+		"action":    e.Action,
+		"allowed":   e.Allowed,
+	}
+	if e.Fingerprint != "" {
+		f["fingerprint"] = e.Fingerprint
+	}
+	if e.Remote != "" {
+		f["remote"] = e.Remote
+	}
+	if len(e.Args) > 0 {
+		f["args"] = e.Args
+	}
+	if e.Error != "" {
+		f["error"] = e.Error
+	}
+	return f
+}
@@ -0,0 +1,103 @@
+package nebula
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/slackhq/nebula/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func readTestAuditLog(t *testing.T, path string) []adminAuditEntry {
+	f, err := os.Open(path)
+	require.NoError(t, err)
+	defer f.Close()
+
+	var entries []adminAuditEntry
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		var e adminAuditEntry
+		require.NoError(t, json.Unmarshal(s.Bytes(), &e))
+		entries = append(entries, e)
+	}
+	require.NoError(t, s.Err())
+	return entries
+}
+
+func TestParseAdminLevel(t *testing.T) {
+	for i, name := range adminLevelNames {
+		level, err := parseAdminLevel(name)
+		require.NoError(t, err)
+		assert.Equal(t, adminLevel(i), level)
+		assert.Equal(t, name, level.String())
+	}
+
+	level, err := parseAdminLevel("Tunnel")
+	require.NoError(t, err)
+	assert.Equal(t, adminLevelTunnel, level)
+
+	_, err = parseAdminLevel("admin")
+	assert.EqualError(t, err, "unknown level `admin`. possible levels: [none read tunnel reload]")
+
+	assert.Equal(t, adminLevelRead, sshCommandLevel("list-hostmap"))
+	assert.Equal(t, adminLevelTunnel, sshCommandLevel("close-tunnel"))
+	assert.Equal(t, adminLevelReload, sshCommandLevel("reload"))
+	assert.Equal(t, adminLevelReload, sshCommandLevel("tcpdump"))
+}
+
+func TestAdminAudit(t *testing.T) {
+	b := &bytes.Buffer{}
+	l := logrus.New()
+	l.SetOutput(b)
+	ls := newLoggers(l)
+
+	c := config.NewC(l)
+	require.NoError(t, c.LoadString("logging: {format: json, redact: true}"))
+	require.NoError(t, configLogger(ls, c))
+
+	// Without audit.path the records are logged
+	a, err := newAdminAuditFromConfig(l, c)
+	require.NoError(t, err)
+	a.record(adminAuditEntry{Interface: "ssh", User: "steeeeve", Remote: "10.1.0.2:50000", Action: "reload", Allowed: true})
+
+	var e map[string]interface{}
+	require.NoError(t, json.Unmarshal(b.Bytes(), &e))
+	assert.Equal(t, "Administrative action", e["msg"])
+	assert.Equal(t, map[string]interface{}{
+		"interface": "ssh",
+		"user":      "steeeeve",
+		"remote":    redactedLogValue,
+		"action":    "reload",
+		"allowed":   true,
+	}, e["audit"])
+
+	// A reload opens audit.path, and opens it again on every reload so a rotated file is replaced
+	path := filepath.Join(t.TempDir(), "audit.log")
+	require.NoError(t, c.ReloadConfigString("audit: {path: "+path+"}"))
+	a.record(adminAuditEntry{Interface: "control_api", User: "anonymous", Action: "POST /v1/reload", Allowed: true})
+	require.NoError(t, os.Rename(path, path+".1"))
+	require.NoError(t, c.ReloadConfigString("audit: {path: "+path+"}"))
+	a.record(adminAuditEntry{Interface: "control_api", User: "monitoring", Action: "GET /v1/cert"})
+
+	entries := readTestAuditLog(t, path+".1")
+	require.Len(t, entries, 1)
+	assert.Equal(t, "POST /v1/reload", entries[0].Action)
+	assert.False(t, entries[0].Time.IsZero())
+
+	entries = readTestAuditLog(t, path)
+	require.Len(t, entries, 1)
+	assert.Equal(t, "monitoring", entries[0].User)
+
+	require.NoError(t, c.LoadString("audit: {path: "+filepath.Join(path, "nope")+"}"))
+	_, err = newAdminAuditFromConfig(l, c)
+	assert.ErrorContains(t, err, "failed to open audit.path")
+
+	var nilAudit *adminAudit
+	nilAudit.record(adminAuditEntry{})
+}
@@ -0,0 +1,164 @@
+package aesgcm
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"fmt"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExpandKey(t *testing.T) {
+	// FIPS-197 appendix A.3
+	key := []byte{
+		0x60, 0x3d, 0xeb, 0x10, 0x15, 0xca, 0x71, 0xbe, 0x2b, 0x73, 0xae, 0xf0, 0x85, 0x7d, 0x77, 0x81,
+		0x1f, 0x35, 0x2c, 0x07, 0x3b, 0x61, 0x08, 0xd7, 0x2d, 0x98, 0x10, 0xa3, 0x09, 0x14, 0xdf, 0xf4,
+	}
+	rk := expandKey(key)
+	assert.Equal(t, key[:16], rk[0][:])
+	assert.Equal(t, key[16:], rk[1][:])
+	assert.Equal(t, []byte{0x9b, 0xa3, 0x54, 0x11, 0x8e, 0x69, 0x25, 0xaf, 0xa5, 0x1a, 0x8b, 0x5f, 0x20, 0x67, 0xfc, 0xde}, rk[2][:])
+	assert.Equal(t, []byte{0xfe, 0x48, 0x90, 0xd1, 0xe6, 0x18, 0x8d, 0x0b, 0x04, 0x6d, 0xf3, 0x44, 0x70, 0x6c, 0x63, 0x1e}, rk[14][:])
+}
+
+// newJobs returns jobs with random keys, nonces, additional data and text along with what crypto/cipher seals them to
+func newJobs(t *testing.T, r *rand.Rand, keys []*Key, aeads []cipher.AEAD, n int) ([]Job, [][]byte) {
+	jobs := make([]Job, n)
+	want := make([][]byte, n)
+	for i := range jobs {
+		k := r.Intn(len(keys))
+		j := &jobs[i]
+		j.Key = keys[k]
+		r.Read(j.Nonce[:])
+
+		j.AD = make([]byte, r.Intn(40))
+		r.Read(j.AD)
+
+		size := r.Intn(300)
+		if r.Intn(4) == 0 {
+			size = r.Intn(2000)
+		}
+		j.Text = make([]byte, size, size+TagSize)
+		r.Read(j.Text)
+
+		want[i] = aeads[k].Seal(nil, j.Nonce[:], j.Text, j.AD)
+	}
+	return jobs, want
+}
+
+func TestSealOpen(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+
+	var keys []*Key
+	var aeads []cipher.AEAD
+	for i := 0; i < 3; i++ {
+		key := make([]byte, KeySize)
+		r.Read(key)
+		k, err := NewKey(key)
+		require.NoError(t, err)
+		keys = append(keys, k)
+
+		block, err := aes.NewCipher(key)
+		require.NoError(t, err)
+		aead, err := cipher.NewGCM(block)
+		require.NoError(t, err)
+		aeads = append(aeads, aead)
+	}
+
+	for _, n := range []int{1, 2, 3, 4, 5, 8, 13, 64} {
+		for _, shared := range []bool{true, false} {
+			ks, as := keys, aeads
+			if shared {
+				ks, as = keys[:1], aeads[:1]
+			}
+
+			for round := 0; round < 20; round++ {
+				jobs, want := newJobs(t, r, ks, as, n)
+				Seal(jobs)
+				for i := range jobs {
+					require.NoError(t, jobs[i].Err)
+					require.Equal(t, want[i], jobs[i].Out, "seal %d of %d", i, n)
+					assert.Same(t, &jobs[i].Text[:1][0], &jobs[i].Out[:1][0])
+					jobs[i].Text = jobs[i].Out
+				}
+
+				// Break every third job, the others must still open
+				for i := 0; i < n; i += 3 {
+					jobs[i].Text[r.Intn(len(jobs[i].Text))] ^= 1
+				}
+				Open(jobs)
+				for i := range jobs {
+					if i%3 == 0 {
+						assert.ErrorIs(t, jobs[i].Err, ErrOpen)
+						assert.Nil(t, jobs[i].Out)
+						continue
+					}
+					require.NoError(t, jobs[i].Err, "open %d of %d", i, n)
+					plain, err := as[0].Open(nil, jobs[i].Nonce[:], want[i], jobs[i].AD)
+					if !shared {
+						plain, err = jobs[i].Key.AEAD().Open(nil, jobs[i].Nonce[:], want[i], jobs[i].AD)
+					}
+					require.NoError(t, err)
+					assert.Equal(t, string(plain), string(jobs[i].Out))
+				}
+			}
+		}
+	}
+}
+
+func TestOpen_short(t *testing.T) {
+	k, err := NewKey(make([]byte, KeySize))
+	require.NoError(t, err)
+
+	jobs := []Job{{Key: k, Text: []byte{1, 2, 3}}, {Key: k, Text: make([]byte, 0, TagSize)}}
+	Seal(jobs[1:])
+	jobs[1].Text = jobs[1].Out
+	Open(jobs)
+	assert.ErrorIs(t, jobs[0].Err, ErrOpen)
+	assert.NoError(t, jobs[1].Err)
+	assert.Empty(t, jobs[1].Out)
+}
+
+func TestNewKey(t *testing.T) {
+	_, err := NewKey(make([]byte, 16))
+	assert.Error(t, err)
+}
+
+func BenchmarkSeal(b *testing.B) {
+	key := make([]byte, KeySize)
+	k, err := NewKey(key)
+	require.NoError(b, err)
+
+	for _, size := range []int{64, 256, 512, 1300} {
+		ad := make([]byte, 16)
+		jobs := make([]Job, 64)
+		texts := make([][]byte, len(jobs))
+		for i := range jobs {
+			texts[i] = make([]byte, size, size+TagSize)
+		}
+
+		b.Run(fmt.Sprintf("batch/%d", size), func(b *testing.B) {
+			b.SetBytes(int64(size))
+			b.ReportAllocs()
+			for i := 0; i < b.N; i += len(jobs) {
+				for j := range jobs {
+					jobs[j] = Job{Key: k, AD: ad, Text: texts[j][:size]}
+				}
+				Seal(jobs)
+			}
+		})
+
+		b.Run(fmt.Sprintf("crypto/%d", size), func(b *testing.B) {
+			b.SetBytes(int64(size))
+			b.ReportAllocs()
+			var nonce [NonceSize]byte
+			for i := 0; i < b.N; i++ {
+				t := texts[i%len(texts)]
+				k.AEAD().Seal(t[:0], nonce[:], t[:size], ad)
+			}
+		})
+	}
+}
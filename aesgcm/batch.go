@@ -0,0 +1,283 @@
+package aesgcm
+
+import (
+	"encoding/binary"
+	"unsafe"
+)
+
+// lanes is the state the kernels keep between calls, the asm reads it at fixed offsets so the layout must not change
+type lanes struct {
+	rk *[15][64]byte
+	h  *[4][64]byte
+
+	// ctr is the counter block of each lane with its last word little endian so the kernels can add to it
+	ctr [64]byte
+	y   [64]byte
+}
+
+// batch runs up to four jobs through the kernels, one per lane
+type batch struct {
+	l lanes
+
+	// rk and h hold the key tables when the jobs of a group do not share a key
+	rk [15][64]byte
+	h  [4][64]byte
+
+	tagMask [64]byte
+	tail    [64]byte
+	lens    [64]byte
+	zero    [16]byte
+
+	saved [4]struct{ ctr, y [16]byte }
+
+	// sink stands in for the buffers of lanes that have run out of blocks while others still have some
+	sink []byte
+}
+
+// setup points the lanes at the keys of jobs and loads the first counter block, J0, of every nonce
+func (b *batch) setup(jobs []Job) {
+	shared := true
+	for i := range jobs {
+		shared = shared && jobs[i].Key == jobs[0].Key
+	}
+
+	if shared {
+		b.l.rk = &jobs[0].Key.rk
+		b.l.h = &jobs[0].Key.h
+	} else {
+		for i := 0; i < 4; i++ {
+			k := jobs[min(i, len(jobs)-1)].Key
+			for r := range b.rk {
+				copy(b.rk[r][i*16:i*16+16], k.rk[r][i*16:])
+			}
+			for p := range b.h {
+				copy(b.h[p][i*16:i*16+16], k.h[p][i*16:])
+			}
+		}
+		b.l.rk = &b.rk
+		b.l.h = &b.h
+	}
+
+	b.l.y = [64]byte{}
+	for i := range jobs {
+		copy(b.l.ctr[i*16:], jobs[i].Nonce[:])
+		binary.LittleEndian.PutUint32(b.l.ctr[i*16+12:], 1)
+	}
+
+	// E(J0) masks the tag, the counters are left at J0+1 for the text
+	var src, dst [4]*byte
+	var blocks [4]int
+	for i := range jobs {
+		src[i], dst[i], blocks[i] = &b.zero[0], &b.tagMask[i*16], 1
+	}
+	b.run(false, src, dst, blocks)
+}
+
+// hash folds the whole blocks of every lane's text into its accumulator, then the partial block left over, zero
+// padded
+func (b *batch) hash(texts *[4][]byte) {
+	var src [4]*byte
+	var blocks [4]int
+	for i, t := range texts {
+		if blocks[i] = len(t) / 16; blocks[i] > 0 {
+			src[i] = &t[0]
+		}
+	}
+	b.run(true, src, src, blocks)
+
+	for i, t := range texts {
+		blocks[i] = 0
+		if r := len(t) % 16; r > 0 {
+			tail := b.tail[i*16 : i*16+16]
+			copy(tail, t[len(t)-r:])
+			clear(tail[r:])
+			src[i], blocks[i] = &tail[0], 1
+		}
+	}
+	b.run(true, src, src, blocks)
+}
+
+// crypt xors the keystream into the text of every lane with ok set
+func (b *batch) crypt(texts *[4][]byte, ok *[4]bool) {
+	var src [4]*byte
+	var blocks [4]int
+	for i, t := range texts {
+		if blocks[i] = len(t) / 16; ok[i] && blocks[i] > 0 {
+			src[i] = &t[0]
+		} else {
+			blocks[i] = 0
+		}
+	}
+	b.run(false, src, src, blocks)
+
+	for i, t := range texts {
+		blocks[i] = 0
+		if r := len(t) % 16; ok[i] && r > 0 {
+			tail := b.tail[i*16 : i*16+16]
+			copy(tail, t[len(t)-r:])
+			src[i], blocks[i] = &tail[0], 1
+		}
+	}
+	b.run(false, src, src, blocks)
+
+	for i, t := range texts {
+		if blocks[i] > 0 {
+			r := len(t) % 16
+			copy(t[len(t)-r:], b.tail[i*16:])
+		}
+	}
+}
+
+// tag finishes the hash of every lane and returns its tag in b.tail
+func (b *batch) tag(ads, texts *[4][]byte, n int) {
+	var src [4]*byte
+	var blocks [4]int
+	for i := 0; i < n; i++ {
+		binary.BigEndian.PutUint64(b.lens[i*16:], uint64(len(ads[i]))*8)
+		binary.BigEndian.PutUint64(b.lens[i*16+8:], uint64(len(texts[i]))*8)
+		src[i], blocks[i] = &b.lens[i*16], 1
+	}
+	b.run(true, src, src, blocks)
+
+	for i := 0; i < n; i++ {
+		y, m := b.l.y[i*16:], b.tagMask[i*16:]
+		binary.BigEndian.PutUint64(b.tail[i*16:], binary.LittleEndian.Uint64(y[8:])^binary.BigEndian.Uint64(m))
+		binary.BigEndian.PutUint64(b.tail[i*16+8:], binary.LittleEndian.Uint64(y)^binary.BigEndian.Uint64(m[8:]))
+	}
+}
+
+func (b *batch) seal(jobs []Job) {
+	b.setup(jobs)
+
+	var ads, texts [4][]byte
+	ok := [4]bool{}
+	for i := range jobs {
+		ads[i], texts[i], ok[i] = jobs[i].AD, jobs[i].Text, true
+	}
+
+	b.hash(&ads)
+	b.crypt(&texts, &ok)
+	b.hash(&texts)
+	b.tag(&ads, &texts, len(jobs))
+
+	for i := range jobs {
+		j := &jobs[i]
+		j.Out = append(j.Text, b.tail[i*16:i*16+16]...)
+		j.Err = nil
+	}
+}
+
+func (b *batch) open(jobs []Job) {
+	var ads, texts [4][]byte
+	var ok [4]bool
+	for i := range jobs {
+		j := &jobs[i]
+		if len(j.Text) < TagSize {
+			// Hash nothing for it, it fails whatever the tag comes out as
+			continue
+		}
+		ads[i], texts[i] = j.AD, j.Text[:len(j.Text)-TagSize]
+	}
+
+	b.setup(jobs)
+	b.hash(&ads)
+	b.hash(&texts)
+	b.tag(&ads, &texts, len(jobs))
+
+	for i := range jobs {
+		j := &jobs[i]
+		ok[i] = len(j.Text) >= TagSize && tagMatch(b.tail[i*16:i*16+16], j.Text[len(texts[i]):])
+	}
+
+	b.crypt(&texts, &ok)
+
+	for i := range jobs {
+		j := &jobs[i]
+		if ok[i] {
+			j.Out, j.Err = texts[i], nil
+		} else {
+			j.Out, j.Err = nil, ErrOpen
+		}
+	}
+}
+
+// run calls a kernel until every lane has been through its blocks. Lanes run together for as many blocks as the
+// shortest has left, a lane that is done then runs on the sink and gets its state back at the end.
+func (b *batch) run(hash bool, src, dst [4]*byte, blocks [4]int) {
+	most := max(blocks[0], blocks[1], blocks[2], blocks[3])
+	if most == 0 {
+		return
+	}
+	if len(b.sink) < most*16 {
+		b.sink = make([]byte, most*16)
+	}
+	sink := &b.sink[0]
+
+	var parked [4]bool
+	for i := range blocks {
+		if blocks[i] == 0 {
+			b.park(i, &src, &dst, sink)
+			parked[i] = true
+		}
+	}
+
+	for {
+		n := most
+		for i := range blocks {
+			if !parked[i] {
+				n = min(n, blocks[i])
+			}
+		}
+
+		if hash {
+			ghash4(&b.l, &src, n)
+		} else {
+			ctr4(&b.l, &src, &dst, n)
+		}
+
+		left := false
+		for i := range blocks {
+			if !parked[i] {
+				blocks[i] -= n
+				left = left || blocks[i] > 0
+			}
+		}
+		if !left {
+			break
+		}
+
+		// Everything that finished waits on the sink for the rest
+		for i := range blocks {
+			if parked[i] {
+				continue
+			}
+			if blocks[i] == 0 {
+				b.park(i, &src, &dst, sink)
+				parked[i] = true
+				continue
+			}
+			src[i] = (*byte)(unsafe.Add(unsafe.Pointer(src[i]), n*16))
+			dst[i] = (*byte)(unsafe.Add(unsafe.Pointer(dst[i]), n*16))
+		}
+	}
+
+	for i := range parked {
+		if parked[i] {
+			b.unpark(i)
+		}
+	}
+}
+
+// park saves the state of lane i and points it at the sink
+func (b *batch) park(i int, src, dst *[4]*byte, sink *byte) {
+	s := &b.saved[i]
+	s.ctr = [16]byte(b.l.ctr[i*16:])
+	s.y = [16]byte(b.l.y[i*16:])
+	src[i], dst[i] = sink, sink
+}
+
+func (b *batch) unpark(i int) {
+	s := &b.saved[i]
+	*(*[16]byte)(b.l.ctr[i*16:]) = s.ctr
+	*(*[16]byte)(b.l.y[i*16:]) = s.y
+}
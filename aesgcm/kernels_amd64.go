@@ -0,0 +1,19 @@
+//go:build amd64 && !purego
+
+package aesgcm
+
+import "golang.org/x/sys/cpu"
+
+// available is true when the cpu has the 512 bit aes and carryless multiply instructions the kernels are written in
+var available = cpu.X86.HasAVX512F && cpu.X86.HasAVX512BW && cpu.X86.HasAVX512VL &&
+	cpu.X86.HasAVX512VAES && cpu.X86.HasAVX512VPCLMULQDQ
+
+// ctr4 xors n blocks of every src lane with the aes ctr keystream of its lane into dst and advances the lane counters
+//
+//go:noescape
+func ctr4(l *lanes, src *[4]*byte, dst *[4]*byte, n int)
+
+// ghash4 folds n blocks of every src lane into the ghash accumulator of its lane
+//
+//go:noescape
+func ghash4(l *lanes, src *[4]*byte, n int)
@@ -0,0 +1,281 @@
+//go:build amd64 && !purego
+
+#include "textflag.h"
+
+// Every kernel works on the four 128 bit lanes of a zmm register as four independent streams, one packet per lane.
+// VAESENC and VPCLMULQDQ work on each lane by itself so a lane can have its own key.
+
+// bswapMask reverses the bytes of a lane, ghash works on byte reflected blocks
+DATA bswapMask<>+0(SB)/8, $0x08090a0b0c0d0e0f
+DATA bswapMask<>+8(SB)/8, $0x0001020304050607
+GLOBL bswapMask<>(SB), RODATA|NOPTR, $16
+
+// ctrMask turns a counter with its last word little endian into the big endian counter block
+DATA ctrMask<>+0(SB)/8, $0x0706050403020100
+DATA ctrMask<>+8(SB)/8, $0x0c0d0e0f0b0a0908
+GLOBL ctrMask<>(SB), RODATA|NOPTR, $16
+
+DATA ctrOne<>+0(SB)/8, $0x0000000000000000
+DATA ctrOne<>+8(SB)/8, $0x0000000100000000
+GLOBL ctrOne<>(SB), RODATA|NOPTR, $16
+
+DATA gcmPoly<>+0(SB)/8, $0x0000000000000001
+DATA gcmPoly<>+8(SB)/8, $0xc200000000000000
+GLOBL gcmPoly<>(SB), RODATA|NOPTR, $16
+
+// lanes offsets
+#define LANES_RK 0
+#define LANES_H 8
+#define LANES_CTR 16
+#define LANES_Y 80
+
+#define AES_ROUND(k) \
+	VAESENC k, Z1, Z1 \
+	VAESENC k, Z2, Z2 \
+	VAESENC k, Z3, Z3 \
+	VAESENC k, Z4, Z4
+
+// XOR_BLOCK xors the keystream in z with the block at off of every src lane and stores it at off of every dst lane
+#define XOR_BLOCK(off, z, x) \
+	VMOVDQU      off(R8), X5 \
+	VINSERTI32X4 $1, off(R9), Z5, Z5 \
+	VINSERTI32X4 $2, off(R10), Z5, Z5 \
+	VINSERTI32X4 $3, off(R11), Z5, Z5 \
+	VPXORQ       Z5, z, z \
+	VMOVDQU      x, off(R12) \
+	VEXTRACTI32X4 $1, z, off(R13) \
+	VEXTRACTI32X4 $2, z, off(SI) \
+	VEXTRACTI32X4 $3, z, off(BX)
+
+// func ctr4(l *lanes, src *[4]*byte, dst *[4]*byte, n int)
+TEXT ·ctr4(SB), NOSPLIT, $0-32
+	MOVQ l+0(FP), DI
+	MOVQ src+8(FP), AX
+	MOVQ dst+16(FP), DX
+	MOVQ n+24(FP), CX
+
+	MOVQ 0(AX), R8
+	MOVQ 8(AX), R9
+	MOVQ 16(AX), R10
+	MOVQ 24(AX), R11
+	MOVQ 0(DX), R12
+	MOVQ 8(DX), R13
+	MOVQ 16(DX), SI
+	MOVQ 24(DX), BX
+
+	MOVQ      LANES_RK(DI), AX
+	VMOVDQU64 0(AX), Z16
+	VMOVDQU64 64(AX), Z17
+	VMOVDQU64 128(AX), Z18
+	VMOVDQU64 192(AX), Z19
+	VMOVDQU64 256(AX), Z20
+	VMOVDQU64 320(AX), Z21
+	VMOVDQU64 384(AX), Z22
+	VMOVDQU64 448(AX), Z23
+	VMOVDQU64 512(AX), Z24
+	VMOVDQU64 576(AX), Z25
+	VMOVDQU64 640(AX), Z26
+	VMOVDQU64 704(AX), Z27
+	VMOVDQU64 768(AX), Z28
+	VMOVDQU64 832(AX), Z29
+	VMOVDQU64 896(AX), Z30
+
+	VMOVDQU64       LANES_CTR(DI), Z0
+	VBROADCASTI32X4 ctrMask<>(SB), Z14
+	VBROADCASTI32X4 ctrOne<>(SB), Z15
+
+ctr4Loop4:
+	CMPQ CX, $4
+	JB   ctr4Loop1
+
+	VPSHUFB Z14, Z0, Z1
+	VPADDD  Z15, Z0, Z0
+	VPSHUFB Z14, Z0, Z2
+	VPADDD  Z15, Z0, Z0
+	VPSHUFB Z14, Z0, Z3
+	VPADDD  Z15, Z0, Z0
+	VPSHUFB Z14, Z0, Z4
+	VPADDD  Z15, Z0, Z0
+
+	VPXORQ Z16, Z1, Z1
+	VPXORQ Z16, Z2, Z2
+	VPXORQ Z16, Z3, Z3
+	VPXORQ Z16, Z4, Z4
+	AES_ROUND(Z17)
+	AES_ROUND(Z18)
+	AES_ROUND(Z19)
+	AES_ROUND(Z20)
+	AES_ROUND(Z21)
+	AES_ROUND(Z22)
+	AES_ROUND(Z23)
+	AES_ROUND(Z24)
+	AES_ROUND(Z25)
+	AES_ROUND(Z26)
+	AES_ROUND(Z27)
+	AES_ROUND(Z28)
+	AES_ROUND(Z29)
+	VAESENCLAST Z30, Z1, Z1
+	VAESENCLAST Z30, Z2, Z2
+	VAESENCLAST Z30, Z3, Z3
+	VAESENCLAST Z30, Z4, Z4
+
+	XOR_BLOCK(0, Z1, X1)
+	XOR_BLOCK(16, Z2, X2)
+	XOR_BLOCK(32, Z3, X3)
+	XOR_BLOCK(48, Z4, X4)
+
+	ADDQ $64, R8
+	ADDQ $64, R9
+	ADDQ $64, R10
+	ADDQ $64, R11
+	ADDQ $64, R12
+	ADDQ $64, R13
+	ADDQ $64, SI
+	ADDQ $64, BX
+	SUBQ $4, CX
+	JMP  ctr4Loop4
+
+ctr4Loop1:
+	TESTQ CX, CX
+	JZ    ctr4Done
+
+	VPSHUFB Z14, Z0, Z1
+	VPADDD  Z15, Z0, Z0
+
+	VPXORQ      Z16, Z1, Z1
+	VAESENC     Z17, Z1, Z1
+	VAESENC     Z18, Z1, Z1
+	VAESENC     Z19, Z1, Z1
+	VAESENC     Z20, Z1, Z1
+	VAESENC     Z21, Z1, Z1
+	VAESENC     Z22, Z1, Z1
+	VAESENC     Z23, Z1, Z1
+	VAESENC     Z24, Z1, Z1
+	VAESENC     Z25, Z1, Z1
+	VAESENC     Z26, Z1, Z1
+	VAESENC     Z27, Z1, Z1
+	VAESENC     Z28, Z1, Z1
+	VAESENC     Z29, Z1, Z1
+	VAESENCLAST Z30, Z1, Z1
+
+	XOR_BLOCK(0, Z1, X1)
+
+	ADDQ $16, R8
+	ADDQ $16, R9
+	ADDQ $16, R10
+	ADDQ $16, R11
+	ADDQ $16, R12
+	ADDQ $16, R13
+	ADDQ $16, SI
+	ADDQ $16, BX
+	DECQ CX
+	JMP  ctr4Loop1
+
+ctr4Done:
+	VMOVDQU64 Z0, LANES_CTR(DI)
+	VZEROUPPER
+	RET
+
+// LOAD_BLOCK loads the block at off of every src lane into z, byte reflected
+#define LOAD_BLOCK(off, z, x) \
+	VMOVDQU      off(R8), x \
+	VINSERTI32X4 $1, off(R9), z, z \
+	VINSERTI32X4 $2, off(R10), z, z \
+	VINSERTI32X4 $3, off(R11), z, z \
+	VPSHUFB      Z6, z, z
+
+// MUL_ACC adds the unreduced product of z and h to the lo, hi and mid sums in Z11, Z12 and Z13
+#define MUL_ACC(z, h) \
+	VPCLMULQDQ $0x00, h, z, Z14 \
+	VPCLMULQDQ $0x11, h, z, Z15 \
+	VPCLMULQDQ $0x01, h, z, Z16 \
+	VPCLMULQDQ $0x10, h, z, Z17 \
+	VPXORQ     Z14, Z11, Z11 \
+	VPXORQ     Z15, Z12, Z12 \
+	VPTERNLOGQ $0x96, Z16, Z17, Z13
+
+// REDUCE folds the sums into Z0
+#define REDUCE \
+	VPSLLDQ    $8, Z13, Z14 \
+	VPSRLDQ    $8, Z13, Z13 \
+	VPXORQ     Z14, Z11, Z11 \
+	VPXORQ     Z13, Z12, Z12 \
+	VPCLMULQDQ $0x01, Z11, Z5, Z14 \
+	VPSHUFD    $0x4e, Z11, Z11 \
+	VPXORQ     Z14, Z11, Z11 \
+	VPCLMULQDQ $0x01, Z11, Z5, Z14 \
+	VPSHUFD    $0x4e, Z11, Z11 \
+	VPTERNLOGQ $0x96, Z14, Z12, Z11 \
+	VMOVDQA64  Z11, Z0
+
+// func ghash4(l *lanes, src *[4]*byte, n int)
+TEXT ·ghash4(SB), NOSPLIT, $0-24
+	MOVQ l+0(FP), DI
+	MOVQ src+8(FP), AX
+	MOVQ n+16(FP), CX
+
+	MOVQ 0(AX), R8
+	MOVQ 8(AX), R9
+	MOVQ 16(AX), R10
+	MOVQ 24(AX), R11
+
+	MOVQ      LANES_H(DI), AX
+	VMOVDQU64 0(AX), Z1
+	VMOVDQU64 64(AX), Z2
+	VMOVDQU64 128(AX), Z3
+	VMOVDQU64 192(AX), Z4
+
+	VMOVDQU64       LANES_Y(DI), Z0
+	VBROADCASTI32X4 gcmPoly<>(SB), Z5
+	VBROADCASTI32X4 bswapMask<>(SB), Z6
+
+ghash4Loop4:
+	CMPQ CX, $4
+	JB   ghash4Loop1
+
+	LOAD_BLOCK(0, Z7, X7)
+	LOAD_BLOCK(16, Z8, X8)
+	LOAD_BLOCK(32, Z9, X9)
+	LOAD_BLOCK(48, Z10, X10)
+	VPXORQ Z0, Z7, Z7
+
+	VPXORQ Z11, Z11, Z11
+	VPXORQ Z12, Z12, Z12
+	VPXORQ Z13, Z13, Z13
+	MUL_ACC(Z7, Z4)
+	MUL_ACC(Z8, Z3)
+	MUL_ACC(Z9, Z2)
+	MUL_ACC(Z10, Z1)
+	REDUCE
+
+	ADDQ $64, R8
+	ADDQ $64, R9
+	ADDQ $64, R10
+	ADDQ $64, R11
+	SUBQ $4, CX
+	JMP  ghash4Loop4
+
+ghash4Loop1:
+	TESTQ CX, CX
+	JZ    ghash4Done
+
+	LOAD_BLOCK(0, Z7, X7)
+	VPXORQ Z0, Z7, Z7
+
+	VPXORQ Z11, Z11, Z11
+	VPXORQ Z12, Z12, Z12
+	VPXORQ Z13, Z13, Z13
+	MUL_ACC(Z7, Z1)
+	REDUCE
+
+	ADDQ $16, R8
+	ADDQ $16, R9
+	ADDQ $16, R10
+	ADDQ $16, R11
+	DECQ CX
+	JMP  ghash4Loop1
+
+ghash4Done:
+	VMOVDQU64 Z0, LANES_Y(DI)
+	VZEROUPPER
+	RET
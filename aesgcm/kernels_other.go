@@ -0,0 +1,13 @@
+//go:build !amd64 || purego
+
+package aesgcm
+
+const available = false
+
+func ctr4(*lanes, *[4]*byte, *[4]*byte, int) {
+	panic("aesgcm: no multi-buffer kernels on this platform")
+}
+
+func ghash4(*lanes, *[4]*byte, int) {
+	panic("aesgcm: no multi-buffer kernels on this platform")
+}
@@ -0,0 +1,62 @@
+package aesgcm
+
+import "encoding/binary"
+
+// sbox is the aes s-box, it is only needed for the key schedule so it is built rather than spelled out
+var sbox = func() (s [256]byte) {
+	// p walks every non zero element by multiplying by 3, q by dividing by 3, so q is always the inverse of p
+	p, q := byte(1), byte(1)
+	for {
+		if p&0x80 != 0 {
+			p ^= p<<1 ^ 0x1b
+		} else {
+			p ^= p << 1
+		}
+		q ^= q << 1
+		q ^= q << 2
+		q ^= q << 4
+		if q&0x80 != 0 {
+			q ^= 0x09
+		}
+		s[p] = q ^ rotl(q, 1) ^ rotl(q, 2) ^ rotl(q, 3) ^ rotl(q, 4) ^ 0x63
+		if p == 1 {
+			break
+		}
+	}
+	s[0] = 0x63
+	return
+}()
+
+func rotl(b byte, n uint) byte {
+	return b<<n | b>>(8-n)
+}
+
+// expandKey returns the 15 round keys of an aes-256 key
+func expandKey(key []byte) (rk [15][16]byte) {
+	var w [60]uint32
+	for i := 0; i < 8; i++ {
+		w[i] = binary.BigEndian.Uint32(key[i*4:])
+	}
+
+	rcon := uint32(1)
+	for i := 8; i < len(w); i++ {
+		t := w[i-1]
+		switch i % 8 {
+		case 0:
+			t = subWord(t<<8|t>>24) ^ rcon<<24
+			rcon <<= 1
+		case 4:
+			t = subWord(t)
+		}
+		w[i] = w[i-8] ^ t
+	}
+
+	for i, v := range w {
+		binary.BigEndian.PutUint32(rk[i/4][(i%4)*4:], v)
+	}
+	return
+}
+
+func subWord(w uint32) uint32 {
+	return uint32(sbox[w>>24])<<24 | uint32(sbox[w>>16&0xff])<<16 | uint32(sbox[w>>8&0xff])<<8 | uint32(sbox[w&0xff])
+}
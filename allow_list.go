@@ -257,7 +257,7 @@ func (al *AllowList) Allow(ip net.IP) bool {
 		return true
 	}
 
-	_, result := al.cidrTree.MostSpecificContains(ip)
+	_, result := al.cidrTree.MostSpecificContains(iputil.Ip2VpnIp(ip))
 	return result
 }
 
@@ -266,7 +266,7 @@ func (al *AllowList) AllowIpV4(ip iputil.VpnIp) bool {
 		return true
 	}
 
-	_, result := al.cidrTree.MostSpecificContainsIpV4(ip)
+	_, result := al.cidrTree.MostSpecificContains(ip)
 	return result
 }
 
@@ -337,7 +337,7 @@ func (al *RemoteAllowList) AllowIpV6(vpnIp iputil.VpnIp, hi, lo uint64) bool {
 
 func (al *RemoteAllowList) getInsideAllowList(vpnIp iputil.VpnIp) *AllowList {
 	if al.insideAllowLists != nil {
-		ok, inside := al.insideAllowLists.MostSpecificContainsIpV4(vpnIp)
+		ok, inside := al.insideAllowLists.MostSpecificContains(vpnIp)
 		if ok {
 			return inside
 		}
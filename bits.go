@@ -13,6 +13,12 @@ type Bits struct {
 	lostCounter        metrics.Counter
 	dupeCounter        metrics.Counter
 	outOfWindowCounter metrics.Counter
+
+	// maxLength is how far the window may grow when authenticated packets arrive just behind it, the window is fixed
+	// when it is not larger than length
+	maxLength       uint64
+	rejectedCounter metrics.Counter
+	grownCounter    metrics.Counter
 }
 
 func NewBits(bits uint64) *Bits {
@@ -23,9 +29,18 @@ func NewBits(bits uint64) *Bits {
 		lostCounter:        metrics.GetOrRegisterCounter("network.packets.lost", nil),
 		dupeCounter:        metrics.GetOrRegisterCounter("network.packets.duplicate", nil),
 		outOfWindowCounter: metrics.GetOrRegisterCounter("network.packets.out_of_window", nil),
+		rejectedCounter:    metrics.GetOrRegisterCounter("network.packets.replay_window.rejected", nil),
+		grownCounter:       metrics.GetOrRegisterCounter("network.packets.replay_window.grown", nil),
 	}
 }
 
+// NewAdaptiveBits is a window of bits that doubles, up to maxBits, when packets are reordered further than it covers
+func NewAdaptiveBits(bits, maxBits uint64) *Bits {
+	b := NewBits(bits)
+	b.maxLength = maxBits
+	return b
+}
+
 func (b *Bits) Check(l logrus.FieldLogger, i uint64) bool {
 	// If i is the next number, return true.
 	if i > b.current || (i == 0 && b.firstSeen == false && b.current < b.length) {
@@ -42,7 +57,13 @@ func (b *Bits) Check(l logrus.FieldLogger, i uint64) bool {
 		return !b.bits[i%b.length]
 	}
 
+	// If i would be within a grown window let it be authenticated, Update drops it and grows the window
+	if b.canGrowTo(i) {
+		return true
+	}
+
 	// Not within the window
+	b.rejectedCounter.Inc(1)
 	l.Debugf("rejected a packet (top) %d %d\n", b.current, i)
 	return false
 }
@@ -138,6 +159,12 @@ func (b *Bits) Update(l *logrus.Logger, i uint64) bool {
 
 	// In all other cases, fail and don't change current.
 	b.outOfWindowCounter.Inc(1)
+	if b.canGrowTo(i) {
+		// We can not tell if i is a replay of a packet from before the window, it is dropped but the packets after it
+		// get a wider window
+		b.grow(b.current - i + 1)
+	}
+
 	if l.Level >= logrus.DebugLevel {
 		l.WithField("accepted", false).
 			WithField("currentCounter", b.current).
@@ -148,6 +175,36 @@ func (b *Bits) Update(l *logrus.Logger, i uint64) bool {
 	return false
 }
 
+// canGrowTo reports if growing the window would cover i, a packet behind the window
+func (b *Bits) canGrowTo(i uint64) bool {
+	return b.maxLength > b.length && b.current >= b.length && i <= b.current && b.current-i < b.maxLength
+}
+
+// grow doubles the window until it is at least length long, up to maxLength. Counters the old window no longer covered
+// are treated as seen since we can not know if they were.
+func (b *Bits) grow(length uint64) {
+	newLength := b.length
+	for newLength < length && newLength < b.maxLength {
+		newLength *= 2
+	}
+	if newLength > b.maxLength {
+		newLength = b.maxLength
+	}
+
+	bits := make([]bool, newLength)
+	for n := range bits {
+		bits[n] = true
+	}
+
+	for n := b.current - b.length + 1; n <= b.current; n++ {
+		bits[n%newLength] = b.bits[n%b.length]
+	}
+
+	b.bits = bits
+	b.length = newLength
+	b.grownCounter.Inc(1)
+}
+
 func maxInt64(a, b int64) int64 {
 	if a > b {
 		return a
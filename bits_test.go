@@ -130,6 +130,57 @@ func TestBitsOutOfWindowCounter(t *testing.T) {
 	assert.Equal(t, int64(1), b.outOfWindowCounter.Count())
 }
 
+func TestBitsAdaptive(t *testing.T) {
+	l := test.NewLogger()
+	b := NewAdaptiveBits(10, 40)
+	b.rejectedCounter.Clear()
+	b.grownCounter.Clear()
+
+	for i := uint64(1); i <= 30; i++ {
+		if i == 12 || i == 13 {
+			// Delayed past the window
+			continue
+		}
+		assert.True(t, b.Update(l, i))
+	}
+
+	// 12 would fit a grown window, it is let through to be authenticated but dropped since it could be a replay
+	assert.True(t, b.Check(l, 12))
+	assert.False(t, b.Update(l, 12))
+	assert.EqualValues(t, 20, b.length)
+	assert.EqualValues(t, 1, b.grownCounter.Count())
+
+	// The counters the old window covered keep their state, everything older is treated as seen
+	assert.False(t, b.Check(l, 25))
+	assert.False(t, b.Check(l, 13))
+
+	// Packets reordered this far are now accepted
+	assert.True(t, b.Update(l, 45))
+	assert.True(t, b.Check(l, 31))
+	assert.True(t, b.Update(l, 31))
+	assert.False(t, b.Update(l, 31))
+
+	// Nothing grows past the max
+	assert.True(t, b.Update(l, 100))
+	assert.False(t, b.Check(l, 50))
+	assert.EqualValues(t, 1, b.rejectedCounter.Count())
+	assert.True(t, b.Check(l, 65))
+	assert.False(t, b.Update(l, 65))
+	assert.EqualValues(t, 40, b.length)
+	assert.EqualValues(t, 2, b.grownCounter.Count())
+	assert.False(t, b.Update(l, 66))
+	assert.True(t, b.Update(l, 90))
+
+	// A fixed window never grows
+	b = NewBits(10)
+	for i := uint64(1); i <= 30; i++ {
+		b.Update(l, i)
+	}
+	assert.False(t, b.Check(l, 15))
+	assert.False(t, b.Update(l, 15))
+	assert.EqualValues(t, 10, b.length)
+}
+
 func TestBitsLostCounter(t *testing.T) {
 	l := test.NewLogger()
 	b := NewBits(10)
@@ -0,0 +1,307 @@
+package nebula
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	"github.com/sirupsen/logrus"
+	"github.com/slackhq/nebula/cert"
+	"github.com/slackhq/nebula/cidr"
+	"github.com/slackhq/nebula/firewall"
+	"github.com/slackhq/nebula/iputil"
+)
+
+const defaultBridgeTimeout = 10 * time.Minute
+
+// bridge forwards flows that arrive on one member of a Group into another member, for partner meshes that need to
+// reach each other through a gateway on both. Flows are not translated, the gateway certificate on each overlay must
+// carry the other overlay's networks as subnets and peers route them to the gateway with unsafe_routes, the same as
+// any other unsafe route.
+//
+// A configured bridge has two legs. The forward leg sits on the overlay the flow starts on and only lets through new
+// flows matched by the bridge policy. The return leg sits on the far overlay and only carries replies to flows the
+// forward leg allowed. The far overlay's outbound firewall still applies to everything a bridge sends into it.
+type bridge struct {
+	l    *logrus.Logger
+	from string
+	to   string
+	dst  *Interface
+
+	// networks are the destinations reached through this bridge, nil on the return leg
+	networks *cidr.Tree6[struct{}]
+	// policy holds the bridge rules in its InRules, matched against the certificate of the peer that sent the packet
+	policy *Firewall
+	link   *bridgeLink
+
+	forwarded metrics.Counter
+	dropped   metrics.Counter
+
+	// Guards the buffers used to send into dst
+	sync.Mutex
+	fwPacket *firewall.Packet
+	nb       []byte
+	out      []byte
+}
+
+// bridgeLink tracks the flows a bridge has allowed, shared by both legs. Flows are keyed as seen by the forward leg.
+type bridgeLink struct {
+	sync.Mutex
+	timeout   time.Duration
+	flows     map[firewall.Packet]time.Time
+	lastPurge time.Time
+}
+
+func newBridgeLink(timeout time.Duration) *bridgeLink {
+	return &bridgeLink{timeout: timeout, flows: make(map[firewall.Packet]time.Time)}
+}
+
+// add records the flow, expired flows are purged at most once per timeout
+func (bl *bridgeLink) add(fp firewall.Packet, now time.Time) {
+	bl.Lock()
+	defer bl.Unlock()
+
+	if now.Sub(bl.lastPurge) > bl.timeout {
+		for k, expires := range bl.flows {
+			if now.After(expires) {
+				delete(bl.flows, k)
+			}
+		}
+		bl.lastPurge = now
+	}
+
+	bl.flows[fp] = now.Add(bl.timeout)
+}
+
+// has reports if the flow is known and not expired, a known flow has its expiration pushed out
+func (bl *bridgeLink) has(fp firewall.Packet, now time.Time) bool {
+	bl.Lock()
+	defer bl.Unlock()
+
+	expires, ok := bl.flows[fp]
+	if !ok {
+		return false
+	}
+
+	if now.After(expires) {
+		delete(bl.flows, fp)
+		return false
+	}
+
+	bl.flows[fp] = now.Add(bl.timeout)
+	return true
+}
+
+func newBridgeLegs(l *logrus.Logger, from, to *groupMember, networks *cidr.Tree6[struct{}], policy *Firewall, timeout time.Duration) (*bridge, *bridge) {
+	link := newBridgeLink(timeout)
+	forward := newBridge(l, from.name, to.name, to.ctrl.f, link)
+	forward.networks = networks
+	forward.policy = policy
+
+	return forward, newBridge(l, to.name, from.name, from.ctrl.f, link)
+}
+
+func newBridge(l *logrus.Logger, from, to string, dst *Interface, link *bridgeLink) *bridge {
+	name := "bridge." + from + "." + to
+	return &bridge{
+		l:         l,
+		from:      from,
+		to:        to,
+		dst:       dst,
+		link:      link,
+		forwarded: metrics.GetOrRegisterCounter(name+".forwarded", nil),
+		dropped:   metrics.GetOrRegisterCounter(name+".dropped", nil),
+		fwPacket:  &firewall.Packet{},
+		nb:        make([]byte, 12, 12),
+		out:       make([]byte, mtu),
+	}
+}
+
+// allow decides if the bridge is responsible for the inbound packet and if so whether it may pass
+func (b *bridge) allow(h *HostInfo, fp firewall.Packet, caPool *cert.NebulaCAPool, now time.Time) (handled bool, allowed bool) {
+	if b.networks == nil {
+		// The return leg only carries replies
+		reply := firewall.Packet{
+			LocalIP:    fp.RemoteIP,
+			RemoteIP:   fp.LocalIP,
+			LocalPort:  fp.RemotePort,
+			RemotePort: fp.LocalPort,
+			Protocol:   fp.Protocol,
+			Fragment:   fp.Fragment,
+			ICMPType:   fp.ICMPType,
+			ICMPCode:   fp.ICMPCode,
+		}
+		if !b.link.has(reply.ConntrackKey(), now) {
+			return false, false
+		}
+		return true, bridgeRemoteValid(h, fp)
+	}
+
+	if ok, _ := b.networks.Contains(fp.LocalIP); !ok {
+		return false, false
+	}
+
+	if !bridgeRemoteValid(h, fp) {
+		return true, false
+	}
+
+	if b.link.has(fp.ConntrackKey(), now) {
+		return true, true
+	}
+
+	// A flow allowed by a scheduled rule lives until it idles out, the link does not track when the schedule closes
+	if ok, _, _ := b.policy.matchRules(fp, true, h, caPool); !ok {
+		return true, false
+	}
+
+	b.link.add(fp.ConntrackKey(), now)
+	b.l.WithField("bridge", b.from+"->"+b.to).
+		WithField("fwPacket", fp).
+		WithField("from", m{"instance": b.from, "vpnIp": h.vpnIp, "name": h.ConnectionState.peerCert.Details.Name}).
+		WithField("to", m{"instance": b.to, "vpnIp": fp.LocalIP, "name": b.peerName(fp.LocalIP)}).
+		Info("Bridge flow allowed")
+
+	return true, true
+}
+
+// peerName returns the certificate name of the far overlay host that handles ip, if there is a tunnel to it
+func (b *bridge) peerName(ip iputil.VpnIp) string {
+	h := b.dst.hostMap.QueryVpnIp(ip)
+	if h == nil {
+		h = b.dst.hostMap.QueryVpnIp(b.dst.inside.RouteFor(ip))
+	}
+
+	if h == nil || h.ConnectionState == nil || h.ConnectionState.peerCert == nil {
+		return ""
+	}
+	return h.ConnectionState.peerCert.Details.Name
+}
+
+// forward sends the packet into the far overlay as if it had been read from that overlay's tun device
+func (b *bridge) forward(packet []byte) {
+	b.forwarded.Inc(1)
+	b.Lock()
+	b.dst.consumeInsidePacket(packet, b.fwPacket, b.nb, b.out, 0, b.dst.writers[0], nil, nil)
+	b.Unlock()
+}
+
+// bridgeRemoteValid is the same source address check the firewall applies, a peer may only send from addresses in
+// its certificate
+func bridgeRemoteValid(h *HostInfo, fp firewall.Packet) bool {
+	if h.remoteCidr != nil {
+		ok, _ := h.remoteCidr.Contains(fp.RemoteIP)
+		return ok
+	}
+	return fp.RemoteIP == h.vpnIp
+}
+
+// bridge offers an inbound packet to the bridges on this interface, returns true if one of them was responsible for it
+func (f *Interface) bridge(h *HostInfo, fp firewall.Packet, packet []byte) bool {
+	now := time.Now()
+	caPool := f.pki.GetCAPool()
+	for _, b := range f.bridges {
+		handled, allowed := b.allow(h, fp, caPool, now)
+		if !handled {
+			continue
+		}
+
+		if !allowed {
+			b.dropped.Inc(1)
+			if f.l.Level >= logrus.DebugLevel {
+				h.logger(f.l).WithField("fwPacket", fp).WithField("bridge", b.from+"->"+b.to).
+					Debugln("dropping bridged packet")
+			}
+			return true
+		}
+
+		b.forward(packet)
+		return true
+	}
+
+	return false
+}
+
+// connectBridges builds the bridges configured by each member, this must happen before any member is started
+func (g *Group) connectBridges() error {
+	for _, gm := range g.members {
+		raw := gm.c.GetMap("bridges", nil)
+		for k, v := range raw {
+			name := fmt.Sprint(k)
+			key := "bridges." + name
+
+			to := g.member(name)
+			if to == nil || to == gm {
+				return fmt.Errorf("group member %s %s must name another group member", gm.name, key)
+			}
+
+			bc, ok := v.(map[interface{}]interface{})
+			if !ok {
+				return fmt.Errorf("group member %s %s must be a map", gm.name, key)
+			}
+
+			forward, back, err := g.newBridgeFromConfig(gm, to, key, bc)
+			if err != nil {
+				return fmt.Errorf("group member %s %s", gm.name, err)
+			}
+
+			gm.ctrl.f.bridges = append(gm.ctrl.f.bridges, forward)
+			to.ctrl.f.bridges = append(to.ctrl.f.bridges, back)
+			g.l.WithField("from", gm.name).WithField("to", to.name).Info("Bridge configured")
+		}
+	}
+
+	return nil
+}
+
+func (g *Group) newBridgeFromConfig(from, to *groupMember, key string, bc map[interface{}]interface{}) (*bridge, *bridge, error) {
+	networks := cidr.NewTree6[struct{}]()
+	if rv, ok := bc["networks"]; ok {
+		rs, ok := rv.([]interface{})
+		if !ok || len(rs) == 0 {
+			return nil, nil, fmt.Errorf("%s.networks must be a list of cidrs", key)
+		}
+
+		for _, r := range rs {
+			_, n, err := net.ParseCIDR(fmt.Sprint(r))
+			if err != nil {
+				return nil, nil, fmt.Errorf("%s.networks entry %v did not parse; %s", key, r, err)
+			}
+			networks.AddCIDR(n, struct{}{})
+		}
+	} else {
+		// Default to the far overlay's vpn network
+		ip := to.ctrl.f.pki.GetCertState().Certificate.Details.Ips[0]
+		networks.AddCIDR(&net.IPNet{IP: ip.IP.Mask(ip.Mask), Mask: ip.Mask}, struct{}{})
+	}
+
+	timeout := defaultBridgeTimeout
+	if tv, ok := bc["timeout"]; ok {
+		var err error
+		timeout, err = time.ParseDuration(fmt.Sprint(tv))
+		if err != nil || timeout <= 0 {
+			return nil, nil, fmt.Errorf("%s.timeout must be a positive duration", key)
+		}
+	}
+
+	if bc["rules"] == nil {
+		return nil, nil, fmt.Errorf("%s.rules must have at least one rule", key)
+	}
+
+	l := from.ctrl.l
+	policy := NewFirewall(l, timeout, timeout, timeout, from.ctrl.f.pki.GetCertState().Certificate)
+	// Bridged destinations are never our own addresses, a rule without local_cidr applies to all of them
+	policy.defaultLocalCIDRAny = true
+	services, err := firewallServicesFromConfig(from.c)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if err := addFirewallRules(l, true, key+".rules", bc["rules"], services, policy); err != nil {
+		return nil, nil, err
+	}
+
+	forward, back := newBridgeLegs(g.l, from, to, networks, policy, timeout)
+	return forward, back, nil
+}
@@ -0,0 +1,184 @@
+package nebula
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/slackhq/nebula/cert"
+	"github.com/slackhq/nebula/cidr"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/firewall"
+	"github.com/slackhq/nebula/iputil"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBridgeLink(t *testing.T) {
+	now := time.Now()
+	bl := newBridgeLink(time.Minute)
+	fp := firewall.Packet{LocalIP: iputil.VpnIpFrom4(1), RemoteIP: iputil.VpnIpFrom4(2), LocalPort: 3, RemotePort: 4, Protocol: firewall.ProtoTCP}
+
+	assert.False(t, bl.has(fp, now))
+	bl.add(fp, now)
+	assert.True(t, bl.has(fp, now.Add(50*time.Second)))
+
+	// Use pushes out the expiration
+	assert.True(t, bl.has(fp, now.Add(100*time.Second)))
+	assert.False(t, bl.has(fp, now.Add(200*time.Second)))
+	assert.Empty(t, bl.flows)
+
+	// Expired flows are purged when adding
+	bl.add(fp, now)
+	bl.add(firewall.Packet{LocalIP: iputil.VpnIpFrom4(5)}, now.Add(2*time.Minute))
+	assert.Len(t, bl.flows, 1)
+}
+
+func TestBridge_allow(t *testing.T) {
+	l := test.NewLogger()
+	_, partnerNet, _ := net.ParseCIDR("10.2.0.0/16")
+	networks := cidr.NewTree6[struct{}]()
+	networks.AddCIDR(partnerNet, struct{}{})
+
+	myCert := &cert.NebulaCertificate{Details: cert.NebulaCertificateDetails{
+		Ips: []*net.IPNet{{IP: net.IPv4(10, 1, 0, 1), Mask: net.IPv4Mask(255, 255, 0, 0)}},
+	}}
+	policy := NewFirewall(l, time.Minute, time.Minute, time.Minute, myCert)
+	policy.defaultLocalCIDRAny = true
+	require.NoError(t, policy.AddRule(true, firewall.ProtoTCP, 443, 443, []string{"partner"}, "", nil, nil, "", ""))
+
+	dst := &Interface{hostMap: newHostMap(l, partnerNet), inside: &test.NoopTun{}}
+	src := &Interface{hostMap: newHostMap(l, &net.IPNet{}), inside: &test.NoopTun{}}
+	link := newBridgeLink(time.Minute)
+	forward := newBridge(l, "a", "b", dst, link)
+	forward.networks = networks
+	forward.policy = policy
+	back := newBridge(l, "b", "a", src, link)
+
+	peer := func(name string, ip iputil.VpnIp, groups ...string) *HostInfo {
+		inverted := map[string]struct{}{}
+		for _, g := range groups {
+			inverted[g] = struct{}{}
+		}
+		return &HostInfo{
+			vpnIp: ip,
+			ConnectionState: &ConnectionState{
+				peerCert: &cert.NebulaCertificate{Details: cert.NebulaCertificateDetails{Name: name, Groups: groups, InvertedGroups: inverted}},
+			},
+		}
+	}
+
+	now := time.Now()
+	member := peer("member", iputil.Ip2VpnIp(net.IPv4(10, 1, 0, 5)), "partner")
+	outsider := peer("outsider", iputil.Ip2VpnIp(net.IPv4(10, 1, 0, 6)))
+	server := peer("server", iputil.Ip2VpnIp(net.IPv4(10, 2, 0, 9)))
+
+	fp := firewall.Packet{
+		LocalIP:    server.vpnIp,
+		RemoteIP:   member.vpnIp,
+		LocalPort:  443,
+		RemotePort: 40000,
+		Protocol:   firewall.ProtoTCP,
+	}
+	reply := firewall.Packet{
+		LocalIP:    member.vpnIp,
+		RemoteIP:   server.vpnIp,
+		LocalPort:  40000,
+		RemotePort: 443,
+		Protocol:   firewall.ProtoTCP,
+	}
+
+	// Replies are not carried before the flow is allowed
+	handled, _ := back.allow(server, reply, nil, now)
+	assert.False(t, handled)
+
+	// Destinations outside the bridged networks are left to the normal path
+	local := fp
+	local.LocalIP = iputil.Ip2VpnIp(net.IPv4(10, 1, 0, 1))
+	handled, _ = forward.allow(member, local, nil, now)
+	assert.False(t, handled)
+
+	// Peers without a matching rule are dropped
+	spoofed := fp
+	spoofed.RemoteIP = outsider.vpnIp
+	handled, allowed := forward.allow(outsider, spoofed, nil, now)
+	assert.True(t, handled)
+	assert.False(t, allowed)
+
+	// Peers can not send from addresses outside their certificate
+	handled, allowed = forward.allow(outsider, fp, nil, now)
+	assert.True(t, handled)
+	assert.False(t, allowed)
+
+	otherPort := fp
+	otherPort.LocalPort = 22
+	_, allowed = forward.allow(member, otherPort, nil, now)
+	assert.False(t, allowed)
+
+	handled, allowed = forward.allow(member, fp, nil, now)
+	assert.True(t, handled)
+	assert.True(t, allowed)
+
+	// Now the reply can return
+	handled, allowed = back.allow(server, reply, nil, now)
+	assert.True(t, handled)
+	assert.True(t, allowed)
+
+	// But not from a host that does not own the address
+	handled, allowed = back.allow(peer("other", iputil.Ip2VpnIp(net.IPv4(10, 2, 0, 10))), reply, nil, now)
+	assert.True(t, handled)
+	assert.False(t, allowed)
+
+	// And the return leg never starts flows of its own
+	handled, _ = back.allow(server, fp, nil, now)
+	assert.False(t, handled)
+
+	// Flows expire
+	handled, _ = back.allow(server, reply, nil, now.Add(time.Hour))
+	assert.False(t, handled)
+}
+
+func TestGroup_connectBridges(t *testing.T) {
+	l := test.NewLogger()
+	newMember := func(name, ip, bridges string) *groupMember {
+		c := config.NewC(l)
+		require.NoError(t, c.LoadString(bridges))
+
+		ipNet := &net.IPNet{IP: net.ParseIP(ip).To4(), Mask: net.IPv4Mask(255, 255, 0, 0)}
+		nc := &cert.NebulaCertificate{Details: cert.NebulaCertificateDetails{Name: name, Ips: []*net.IPNet{ipNet}}}
+		pki := &PKI{}
+		pki.cs.Store(&CertState{Certificate: nc})
+		f := &Interface{pki: pki, hostMap: newHostMap(l, ipNet), inside: &test.NoopTun{}}
+		return &groupMember{name: name, c: c, ctrl: &Control{f: f, l: l}}
+	}
+
+	g := NewGroup(l)
+	a := newMember("a", "10.1.0.1", "bridges:\n  b:\n    rules:\n      - port: 443\n        proto: tcp\n        group: partner\n")
+	b := newMember("b", "10.2.0.1", "bridges: {}\n")
+	g.members = []*groupMember{a, b}
+	require.NoError(t, g.connectBridges())
+
+	require.Len(t, a.ctrl.f.bridges, 1)
+	require.Len(t, b.ctrl.f.bridges, 1)
+	assert.Same(t, a.ctrl.f.bridges[0].link, b.ctrl.f.bridges[0].link)
+	assert.Nil(t, b.ctrl.f.bridges[0].networks)
+	ok, _ := a.ctrl.f.bridges[0].networks.Contains(iputil.Ip2VpnIp(net.IPv4(10, 2, 200, 1)))
+	assert.True(t, ok, "defaults to the far member's vpn network")
+	assert.Equal(t, defaultBridgeTimeout, a.ctrl.f.bridges[0].link.timeout)
+
+	tests := map[string]string{
+		"bridges:\n  c:\n    rules: []\n":                                     "group member a bridges.c must name another group member",
+		"bridges:\n  a:\n    rules: []\n":                                     "group member a bridges.a must name another group member",
+		"bridges:\n  b: true\n":                                               "group member a bridges.b must be a map",
+		"bridges:\n  b:\n    networks: [10.2.0.0/16]\n":                       "group member a bridges.b.rules must have at least one rule",
+		"bridges:\n  b:\n    networks: [nope]\n    rules: []\n":               "group member a bridges.b.networks entry nope did not parse; invalid CIDR address: nope",
+		"bridges:\n  b:\n    timeout: -1s\n    rules: []\n":                   "group member a bridges.b.timeout must be a positive duration",
+		"bridges:\n  b:\n    rules:\n      - port: 443\n        proto: tcp\n": "group member a bridges.b.rules rule #0; at least one of host, group, group_expr, cidr, cidr_set, local_cidr, ca_name, or ca_sha must be provided",
+	}
+	for cfg, expected := range tests {
+		a = newMember("a", "10.1.0.1", cfg)
+		g.members = []*groupMember{a, newMember("b", "10.2.0.1", "bridges: {}\n")}
+		assert.EqualError(t, g.connectBridges(), expected, cfg)
+	}
+}
@@ -1,6 +1,7 @@
 package nebula
 
 import (
+	"encoding/binary"
 	"fmt"
 	"math"
 	"net"
@@ -16,8 +17,8 @@ import (
 // example config file.
 type calculatedRemote struct {
 	ipNet  net.IPNet
-	maskIP iputil.VpnIp
-	mask   iputil.VpnIp
+	maskIP uint32
+	mask   uint32
 	port   uint32
 }
 
@@ -33,8 +34,8 @@ func newCalculatedRemote(ipNet *net.IPNet, port int) (*calculatedRemote, error)
 
 	return &calculatedRemote{
 		ipNet:  *ipNet,
-		maskIP: iputil.Ip2VpnIp(ipNet.IP),
-		mask:   iputil.Ip2VpnIp(ipNet.Mask),
+		maskIP: binary.BigEndian.Uint32(ipNet.IP.To4()),
+		mask:   binary.BigEndian.Uint32(ipNet.Mask),
 		port:   uint32(port),
 	}, nil
 }
@@ -45,19 +46,20 @@ func (c *calculatedRemote) String() string {
 
 func (c *calculatedRemote) Apply(ip iputil.VpnIp) *Ip4AndPort {
 	// Combine the masked bytes of the "mask" IP with the unmasked bytes
-	// of the overlay IP
-	masked := (c.maskIP & c.mask) | (ip & ^c.mask)
+	// of the overlay IP, the last 4 bytes of an ipv6 overlay IP
+	b := ip.As16()
+	masked := (c.maskIP & c.mask) | (binary.BigEndian.Uint32(b[12:]) & ^c.mask)
 
-	return &Ip4AndPort{Ip: uint32(masked), Port: c.port}
+	return &Ip4AndPort{Ip: masked, Port: c.port}
 }
 
-func NewCalculatedRemotesFromConfig(c *config.C, k string) (*cidr.Tree4[[]*calculatedRemote], error) {
+func NewCalculatedRemotesFromConfig(c *config.C, k string) (*cidr.Tree6[[]*calculatedRemote], error) {
 	value := c.Get(k)
 	if value == nil {
 		return nil, nil
 	}
 
-	calculatedRemotes := cidr.NewTree4[[]*calculatedRemote]()
+	calculatedRemotes := cidr.NewTree6[[]*calculatedRemote]()
 
 	rawMap, ok := value.(map[any]any)
 	if !ok {
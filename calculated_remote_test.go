@@ -19,7 +19,7 @@ func TestCalculatedRemoteApply(t *testing.T) {
 	input := iputil.Ip2VpnIp([]byte{10, 0, 10, 182})
 
 	expected := &Ip4AndPort{
-		Ip:   uint32(iputil.Ip2VpnIp([]byte{192, 168, 1, 182})),
+		Ip:   iputil.Ip2VpnIp([]byte{192, 168, 1, 182}).Uint32(),
 		Port: 4242,
 	}
 
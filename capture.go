@@ -0,0 +1,516 @@
+package nebula
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/slackhq/nebula/firewall"
+	"github.com/slackhq/nebula/header"
+	"github.com/slackhq/nebula/iputil"
+	"github.com/slackhq/nebula/udp"
+)
+
+// Packets can be captured as they pass through nebula with the tcpdump ssh command. Inner packets are captured as they
+// are read from or written to the tun device, outer packets as they are read from or written to the underlay. An outer
+// packet only has a udp payload, it is captured with an ip and udp header made up from the addresses so the usual
+// tools can read it. Each running capture gets a copy of the packets over a channel and drops them when it can not
+// keep up, nothing waits on a capture. Without a capture running the packet path only pays for an atomic load.
+
+const (
+	captureQueueLen       = 1024
+	captureMaxSnaplen     = 65535
+	captureMaxDuration    = time.Hour
+	pcapLinkTypeRaw       = 101
+	pcapMagicMicroseconds = 0xa1b2c3d4
+)
+
+type captureDirection uint8
+
+const (
+	captureIn captureDirection = iota
+	captureOut
+)
+
+func (d captureDirection) String() string {
+	if d == captureIn {
+		return "in"
+	}
+	return "out"
+}
+
+// captureMeta is what a capture filter matches on
+type captureMeta struct {
+	dir   captureDirection
+	src   netip.Addr
+	dst   netip.Addr
+	sport uint16
+	dport uint16
+	proto uint8
+}
+
+type capturedPacket struct {
+	meta   captureMeta
+	ts     time.Time
+	data   []byte
+	length int
+}
+
+type packetCapture struct {
+	outer   bool
+	filter  captureFilter
+	snaplen int
+	// local is the address of our underlay socket, the source or destination of outer packets
+	local   netip.AddrPort
+	packets chan capturedPacket
+	dropped atomic.Uint64
+}
+
+func newPacketCapture(outer bool, filter captureFilter, snaplen int, local netip.AddrPort) *packetCapture {
+	return &packetCapture{
+		outer:   outer,
+		filter:  filter,
+		snaplen: snaplen,
+		local:   local,
+		packets: make(chan capturedPacket, captureQueueLen),
+	}
+}
+
+// add queues a copy of b, at most snaplen bytes of it, if the filter matches m
+func (pc *packetCapture) add(m *captureMeta, now time.Time, b []byte, length int) {
+	if pc.filter != nil && !pc.filter(m) {
+		return
+	}
+
+	if len(b) > pc.snaplen {
+		b = b[:pc.snaplen]
+	}
+
+	select {
+	case pc.packets <- capturedPacket{meta: *m, ts: now, data: append([]byte(nil), b...), length: length}:
+	default:
+		pc.dropped.Add(1)
+	}
+}
+
+// packetCaptures are the captures running on an Interface. The list is replaced on every change so the packet path
+// reads it without a lock, it is nil when nothing is capturing.
+type packetCaptures struct {
+	lock   sync.Mutex
+	active atomic.Pointer[[]*packetCapture]
+}
+
+// start adds pc to the running captures, it runs until the returned func is called
+func (cs *packetCaptures) start(pc *packetCapture) func() {
+	cs.lock.Lock()
+	defer cs.lock.Unlock()
+
+	var active []*packetCapture
+	if old := cs.active.Load(); old != nil {
+		active = append(active, *old...)
+	}
+	active = append(active, pc)
+	cs.active.Store(&active)
+
+	return func() { cs.stop(pc) }
+}
+
+func (cs *packetCaptures) stop(pc *packetCapture) {
+	cs.lock.Lock()
+	defer cs.lock.Unlock()
+
+	old := cs.active.Load()
+	if old == nil {
+		return
+	}
+
+	var active []*packetCapture
+	for _, v := range *old {
+		if v != pc {
+			active = append(active, v)
+		}
+	}
+
+	if len(active) == 0 {
+		cs.active.Store(nil)
+	} else {
+		cs.active.Store(&active)
+	}
+}
+
+// inner captures a packet read from or written to the tun device, fp must already be parsed from it
+func (cs *packetCaptures) inner(dir captureDirection, packet []byte, fp *firewall.Packet) {
+	if cs == nil {
+		return
+	}
+	active := cs.active.Load()
+	if active == nil {
+		return
+	}
+
+	m := captureMeta{dir: dir, proto: fp.Protocol}
+	if dir == captureIn {
+		m.src, m.dst, m.sport, m.dport = fp.RemoteIP.ToNetIpAddr(), fp.LocalIP.ToNetIpAddr(), fp.RemotePort, fp.LocalPort
+	} else {
+		m.src, m.dst, m.sport, m.dport = fp.LocalIP.ToNetIpAddr(), fp.RemoteIP.ToNetIpAddr(), fp.LocalPort, fp.RemotePort
+	}
+
+	now := time.Now()
+	for _, pc := range *active {
+		if !pc.outer {
+			pc.add(&m, now, packet, len(packet))
+		}
+	}
+}
+
+// outer captures a packet read from or written to the underlay for remote
+func (cs *packetCaptures) outer(dir captureDirection, packet []byte, remote *udp.Addr) {
+	if cs == nil {
+		return
+	}
+	active := cs.active.Load()
+	if active == nil {
+		return
+	}
+
+	if remote == nil {
+		return
+	}
+	ip, ok := netip.AddrFromSlice(remote.IP)
+	if !ok {
+		return
+	}
+	rap := netip.AddrPortFrom(ip.Unmap(), remote.Port)
+
+	now := time.Now()
+	for _, pc := range *active {
+		if !pc.outer {
+			continue
+		}
+
+		lap := pc.local
+		if rap.Addr().Is4() != lap.Addr().Is4() {
+			// A socket on :: talks to ipv4 peers as well, their packets are made up as if it was on 0.0.0.0
+			if rap.Addr().Is4() {
+				lap = netip.AddrPortFrom(netip.IPv4Unspecified(), lap.Port())
+			} else {
+				lap = netip.AddrPortFrom(netip.IPv6Unspecified(), lap.Port())
+			}
+		}
+
+		m := captureMeta{dir: dir, proto: firewall.ProtoUDP}
+		if dir == captureIn {
+			m.src, m.dst, m.sport, m.dport = rap.Addr(), lap.Addr(), rap.Port(), lap.Port()
+		} else {
+			m.src, m.dst, m.sport, m.dport = lap.Addr(), rap.Addr(), lap.Port(), rap.Port()
+		}
+
+		if pc.filter != nil && !pc.filter(&m) {
+			continue
+		}
+		b := iputil.CreateUDPPacket(netip.AddrPortFrom(m.src, m.sport), netip.AddrPortFrom(m.dst, m.dport), packet)
+		pc.add(&m, now, b, len(b))
+	}
+}
+
+// writePcapHeader starts a pcap stream of raw ip packets
+func writePcapHeader(w io.Writer, snaplen int) error {
+	b := make([]byte, 24)
+	binary.LittleEndian.PutUint32(b[0:], pcapMagicMicroseconds)
+	binary.LittleEndian.PutUint16(b[4:], 2)
+	binary.LittleEndian.PutUint16(b[6:], 4)
+	binary.LittleEndian.PutUint32(b[16:], uint32(snaplen))
+	binary.LittleEndian.PutUint32(b[20:], pcapLinkTypeRaw)
+	_, err := w.Write(b)
+	return err
+}
+
+func writePcapRecord(w io.Writer, p capturedPacket) error {
+	b := make([]byte, 16+len(p.data))
+	binary.LittleEndian.PutUint32(b[0:], uint32(p.ts.Unix()))
+	binary.LittleEndian.PutUint32(b[4:], uint32(p.ts.Nanosecond()/1000))
+	binary.LittleEndian.PutUint32(b[8:], uint32(len(p.data)))
+	binary.LittleEndian.PutUint32(b[12:], uint32(p.length))
+	copy(b[16:], p.data)
+	_, err := w.Write(b)
+	return err
+}
+
+// String is a one line summary of the packet, like tcpdump prints without -w
+func (p capturedPacket) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s %-3s ", p.ts.Format("15:04:05.000000"), p.meta.dir)
+
+	switch p.meta.proto {
+	case firewall.ProtoTCP, firewall.ProtoUDP:
+		fmt.Fprintf(&b, "%s > %s %s", netip.AddrPortFrom(p.meta.src, p.meta.sport), netip.AddrPortFrom(p.meta.dst, p.meta.dport), captureProtoName(p.meta.proto))
+	default:
+		fmt.Fprintf(&b, "%s > %s %s", p.meta.src, p.meta.dst, captureProtoName(p.meta.proto))
+	}
+
+	fmt.Fprintf(&b, " length %d", p.length)
+
+	// Outer packets also say what nebula sent
+	if p.meta.proto == firewall.ProtoUDP && len(p.data) >= 28 {
+		off := 28
+		if p.data[0]>>4 == 6 {
+			off = 48
+		}
+		h := &header.H{}
+		if len(p.data) >= off && h.Parse(p.data[off:]) == nil && h.Version == header.Version {
+			fmt.Fprintf(&b, " nebula %s %s", h.TypeName(), h.SubTypeName())
+		}
+	}
+	return b.String()
+}
+
+func captureProtoName(proto uint8) string {
+	switch proto {
+	case firewall.ProtoTCP:
+		return "tcp"
+	case firewall.ProtoUDP:
+		return "udp"
+	case firewall.ProtoICMP:
+		return "icmp"
+	case firewall.ProtoICMPv6:
+		return "icmp6"
+	default:
+		return "proto " + strconv.Itoa(int(proto))
+	}
+}
+
+// captureFilter matches packets to capture, a nil filter matches everything
+type captureFilter func(m *captureMeta) bool
+
+// parseCaptureFilter parses a filter in a subset of the tcpdump syntax:
+//
+//	[src|dst] host <ip>, [src|dst] net <cidr>, [src|dst] port <port>, tcp, udp, icmp, icmp6, proto <number>, inbound, outbound
+//
+// combined with and, or, not and parentheses. src or dst followed by an ip or cidr is short for host or net. An empty
+// filter matches everything.
+func parseCaptureFilter(s string) (captureFilter, error) {
+	tokens := strings.Fields(strings.NewReplacer("(", " ( ", ")", " ) ", "!", " ! ").Replace(s))
+	if len(tokens) == 0 {
+		return nil, nil
+	}
+
+	p := &captureFilterParser{tokens: tokens}
+	f, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, fmt.Errorf("unexpected %q in filter", p.tokens[p.pos])
+	}
+	return f, nil
+}
+
+type captureFilterParser struct {
+	tokens []string
+	pos    int
+}
+
+func (p *captureFilterParser) peek() string {
+	if p.pos >= len(p.tokens) {
+		return ""
+	}
+	return strings.ToLower(p.tokens[p.pos])
+}
+
+func (p *captureFilterParser) next() (string, error) {
+	if p.pos >= len(p.tokens) {
+		return "", fmt.Errorf("filter ended early")
+	}
+	p.pos++
+	return p.tokens[p.pos-1], nil
+}
+
+func (p *captureFilterParser) or() (captureFilter, error) {
+	l, err := p.and()
+	if err != nil {
+		return nil, err
+	}
+
+	for t := p.peek(); t == "or" || t == "||"; t = p.peek() {
+		p.pos++
+		r, err := p.and()
+		if err != nil {
+			return nil, err
+		}
+		l = func(a, b captureFilter) captureFilter {
+			return func(m *captureMeta) bool { return a(m) || b(m) }
+		}(l, r)
+	}
+	return l, nil
+}
+
+func (p *captureFilterParser) and() (captureFilter, error) {
+	l, err := p.unary()
+	if err != nil {
+		return nil, err
+	}
+
+	for t := p.peek(); t == "and" || t == "&&"; t = p.peek() {
+		p.pos++
+		r, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		l = func(a, b captureFilter) captureFilter {
+			return func(m *captureMeta) bool { return a(m) && b(m) }
+		}(l, r)
+	}
+	return l, nil
+}
+
+func (p *captureFilterParser) unary() (captureFilter, error) {
+	switch p.peek() {
+	case "not", "!":
+		p.pos++
+		f, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return func(m *captureMeta) bool { return !f(m) }, nil
+
+	case "(":
+		p.pos++
+		f, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		if t, err := p.next(); err != nil || t != ")" {
+			return nil, fmt.Errorf("missing ) in filter")
+		}
+		return f, nil
+	}
+
+	return p.primitive()
+}
+
+func (p *captureFilterParser) primitive() (captureFilter, error) {
+	t, err := p.next()
+	if err != nil {
+		return nil, err
+	}
+
+	switch strings.ToLower(t) {
+	case "tcp":
+		return captureProto(firewall.ProtoTCP), nil
+	case "udp":
+		return captureProto(firewall.ProtoUDP), nil
+	case "icmp":
+		return captureProto(firewall.ProtoICMP), nil
+	case "icmp6":
+		return captureProto(firewall.ProtoICMPv6), nil
+	case "proto":
+		v, err := p.next()
+		if err != nil {
+			return nil, err
+		}
+		proto, err := strconv.ParseUint(v, 10, 8)
+		if err != nil {
+			return nil, fmt.Errorf("proto %q is not a protocol number", v)
+		}
+		return captureProto(uint8(proto)), nil
+	case "inbound":
+		return func(m *captureMeta) bool { return m.dir == captureIn }, nil
+	case "outbound":
+		return func(m *captureMeta) bool { return m.dir == captureOut }, nil
+	case "src", "dst":
+		return p.addr(strings.ToLower(t))
+	case "host", "net", "port":
+		p.pos--
+		return p.addr("")
+	}
+
+	return nil, fmt.Errorf("unexpected %q in filter", t)
+}
+
+// addr parses host, net and port with the src or dst qualifier dir, empty matches either
+func (p *captureFilterParser) addr(dir string) (captureFilter, error) {
+	kind := p.peek()
+	switch kind {
+	case "host", "net", "port":
+		p.pos++
+	default:
+		// src 10.0.0.1 and dst 10.0.0.0/8 are short for host and net
+		kind = "host"
+		if strings.Contains(p.peek(), "/") {
+			kind = "net"
+		}
+	}
+
+	v, err := p.next()
+	if err != nil {
+		return nil, err
+	}
+
+	var match func(a netip.Addr, port uint16) bool
+	switch kind {
+	case "host":
+		ip, err := netip.ParseAddr(v)
+		if err != nil {
+			return nil, fmt.Errorf("host %q is not an ip", v)
+		}
+		ip = ip.Unmap()
+		match = func(a netip.Addr, _ uint16) bool { return a == ip }
+	case "net":
+		n, err := netip.ParsePrefix(v)
+		if err != nil {
+			return nil, fmt.Errorf("net %q is not a cidr", v)
+		}
+		n = n.Masked()
+		match = func(a netip.Addr, _ uint16) bool { return n.Contains(a) }
+	case "port":
+		port, err := strconv.ParseUint(v, 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("port %q is not a port", v)
+		}
+		match = func(_ netip.Addr, p uint16) bool { return p == uint16(port) }
+	}
+
+	switch dir {
+	case "src":
+		return func(m *captureMeta) bool { return match(m.src, m.sport) }, nil
+	case "dst":
+		return func(m *captureMeta) bool { return match(m.dst, m.dport) }, nil
+	default:
+		return func(m *captureMeta) bool { return match(m.src, m.sport) || match(m.dst, m.dport) }, nil
+	}
+}
+
+func captureProto(proto uint8) captureFilter {
+	return func(m *captureMeta) bool { return m.proto == proto }
+}
+
+// captureConn captures the outer packets written through it
+type captureConn struct {
+	udp.Conn
+	captures *packetCaptures
+}
+
+func (cs *packetCaptures) wrap(c udp.Conn) udp.Conn {
+	return &captureConn{Conn: c, captures: cs}
+}
+
+func (c *captureConn) WriteTo(b []byte, addr *udp.Addr) error {
+	c.captures.outer(captureOut, b, addr)
+	return c.Conn.WriteTo(b, addr)
+}
+
+// WriteBatch captures every packet and sends them as a batch through the wrapped conn
+func (c *captureConn) WriteBatch(bufs [][]byte, addrs []*udp.Addr, tos []byte) error {
+	if c.captures.active.Load() != nil {
+		for i := range bufs {
+			c.captures.outer(captureOut, bufs[i], addrs[i])
+		}
+	}
+	return writeBatchDiverted(c.Conn, bufs, addrs, tos, func(int) bool { return false })
+}
@@ -0,0 +1,228 @@
+package nebula
+
+import (
+	"encoding/binary"
+	"net"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+	"github.com/slackhq/nebula/firewall"
+	"github.com/slackhq/nebula/header"
+	"github.com/slackhq/nebula/iputil"
+	"github.com/slackhq/nebula/udp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseCaptureFilter(t *testing.T) {
+	m := &captureMeta{
+		dir:   captureOut,
+		src:   netip.MustParseAddr("10.1.0.1"),
+		dst:   netip.MustParseAddr("10.1.0.2"),
+		sport: 40000,
+		dport: 443,
+		proto: firewall.ProtoTCP,
+	}
+
+	for filter, expected := range map[string]bool{
+		"":                                     true,
+		"host 10.1.0.2":                        true,
+		"src host 10.1.0.2":                    false,
+		"dst 10.1.0.2":                         true,
+		"net 10.1.0.0/16":                      true,
+		"src 10.2.0.0/16":                      false,
+		"port 443":                             true,
+		"src port 443":                         false,
+		"tcp and dst port 443":                 true,
+		"udp or icmp":                          false,
+		"icmp6":                                false,
+		"not udp":                              true,
+		"proto 6":                              true,
+		"outbound":                             true,
+		"inbound":                              false,
+		"(udp or tcp) and not host 10.1.0.3":   true,
+		"host 10.1.0.3 or (tcp && port 40000)": true,
+		"udp || (!tcp)":                        false,
+		"TCP AND PORT 443":                     true,
+	} {
+		f, err := parseCaptureFilter(filter)
+		require.NoError(t, err, filter)
+		assert.Equal(t, expected, f == nil || f(m), filter)
+	}
+
+	for filter, expected := range map[string]string{
+		"host":              "filter ended early",
+		"host 10.1.0":       `host "10.1.0" is not an ip`,
+		"net 10.1.0.0":      `net "10.1.0.0" is not a cidr`,
+		"net 10.1.0.0/33":   `net "10.1.0.0/33" is not a cidr`,
+		"port https":        `port "https" is not a port`,
+		"proto tcp":         `proto "tcp" is not a protocol number`,
+		"(tcp or udp":       "missing ) in filter",
+		"tcp udp":           `unexpected "udp" in filter`,
+		"gateway 10.1.0.1":  `unexpected "gateway" in filter`,
+		"tcp and":           "filter ended early",
+		"not (port 1) port": `unexpected "port" in filter`,
+	} {
+		_, err := parseCaptureFilter(filter)
+		assert.EqualError(t, err, expected, filter)
+	}
+}
+
+func TestPacketCaptures(t *testing.T) {
+	cs := &packetCaptures{}
+	// Nothing is captured when no capture is running, a nil packetCaptures is fine too
+	var nilCaptures *packetCaptures
+	nilCaptures.inner(captureIn, nil, nil)
+	nilCaptures.outer(captureIn, nil, nil)
+
+	filter, err := parseCaptureFilter("udp and port 53")
+	require.NoError(t, err)
+	inner := newPacketCapture(false, filter, 30, netip.AddrPort{})
+	outer := newPacketCapture(true, nil, captureMaxSnaplen, netip.MustParseAddrPort("[::]:4242"))
+	stopInner := cs.start(inner)
+	stopOuter := cs.start(outer)
+
+	dns := iputil.CreateUDPPacket(netip.MustParseAddrPort("10.1.0.1:40000"), netip.MustParseAddrPort("10.1.0.2:53"), make([]byte, 40))
+	fp := &firewall.Packet{}
+	require.NoError(t, newPacket(dns, false, fp))
+	cs.inner(captureOut, dns, fp)
+
+	ntp := iputil.CreateUDPPacket(netip.MustParseAddrPort("10.1.0.1:40000"), netip.MustParseAddrPort("10.1.0.2:123"), nil)
+	require.NoError(t, newPacket(ntp, false, fp))
+	cs.inner(captureOut, ntp, fp)
+
+	require.Len(t, inner.packets, 1, "only the dns packet matches")
+	p := <-inner.packets
+	assert.Equal(t, dns[:30], p.data)
+	assert.Equal(t, len(dns), p.length)
+	assert.Equal(t, netip.MustParseAddr("10.1.0.1"), p.meta.src)
+	assert.Equal(t, uint16(53), p.meta.dport)
+	assert.True(t, strings.HasSuffix(p.String(), " out 10.1.0.1:40000 > 10.1.0.2:53 udp length 68"), p.String())
+
+	// Outer packets get an ip and udp header, an ipv4 peer of a socket on :: is made up as 0.0.0.0
+	h := header.Encode(make([]byte, header.Len), header.Version, header.Message, header.MessageNone, 1, 2)
+	cs.outer(captureIn, h, udp.NewAddr(net.ParseIP("1.2.3.4"), 4243))
+	require.Len(t, outer.packets, 1)
+	p = <-outer.packets
+	require.Len(t, p.data, 28+header.Len)
+	assert.Equal(t, []byte{1, 2, 3, 4}, p.data[12:16])
+	assert.Equal(t, []byte{0, 0, 0, 0}, p.data[16:20])
+	assert.Equal(t, uint16(4242), binary.BigEndian.Uint16(p.data[22:]))
+	assert.Equal(t, h, p.data[28:])
+	assert.True(t, strings.HasSuffix(p.String(), " in  1.2.3.4:4243 > 0.0.0.0:4242 udp length 44 nebula message none"), p.String())
+
+	stopInner()
+	stopOuter()
+	assert.Nil(t, cs.active.Load())
+	cs.inner(captureOut, dns, fp)
+	assert.Empty(t, inner.packets)
+}
+
+func TestPacketCapture_Dropped(t *testing.T) {
+	pc := newPacketCapture(false, nil, captureMaxSnaplen, netip.AddrPort{})
+	m := &captureMeta{}
+	for i := 0; i < captureQueueLen+3; i++ {
+		pc.add(m, time.Now(), []byte{1}, 1)
+	}
+	assert.Len(t, pc.packets, captureQueueLen)
+	assert.Equal(t, uint64(3), pc.dropped.Load())
+}
+
+func TestWritePcap(t *testing.T) {
+	w := &testStringWriter{}
+	require.NoError(t, writePcapHeader(w.GetWriter(), 100))
+	b := w.Bytes()
+	require.Len(t, b, 24)
+	assert.Equal(t, uint32(pcapMagicMicroseconds), binary.LittleEndian.Uint32(b[0:]))
+	assert.Equal(t, uint32(100), binary.LittleEndian.Uint32(b[16:]))
+	assert.Equal(t, uint32(pcapLinkTypeRaw), binary.LittleEndian.Uint32(b[20:]))
+
+	w.Reset()
+	ts := time.Unix(1700000000, 123456000)
+	require.NoError(t, writePcapRecord(w.GetWriter(), capturedPacket{ts: ts, data: []byte{1, 2, 3}, length: 10}))
+	b = w.Bytes()
+	require.Len(t, b, 19)
+	assert.Equal(t, uint32(1700000000), binary.LittleEndian.Uint32(b[0:]))
+	assert.Equal(t, uint32(123456), binary.LittleEndian.Uint32(b[4:]))
+	assert.Equal(t, uint32(3), binary.LittleEndian.Uint32(b[8:]))
+	assert.Equal(t, uint32(10), binary.LittleEndian.Uint32(b[12:]))
+	assert.Equal(t, []byte{1, 2, 3}, b[16:])
+
+	// The stream reads back as raw ip packets
+	w.Reset()
+	dns := iputil.CreateUDPPacket(netip.MustParseAddrPort("10.1.0.1:40000"), netip.MustParseAddrPort("10.1.0.2:53"), []byte("query"))
+	require.NoError(t, writePcapHeader(w.GetWriter(), captureMaxSnaplen))
+	require.NoError(t, writePcapRecord(w.GetWriter(), capturedPacket{ts: ts, data: dns, length: len(dns)}))
+
+	r, err := pcapgo.NewReader(&w.Buffer)
+	require.NoError(t, err)
+	assert.Equal(t, layers.LinkTypeRaw, r.LinkType())
+	data, ci, err := r.ReadPacketData()
+	require.NoError(t, err)
+	assert.True(t, ts.Equal(ci.Timestamp))
+	pkt := gopacket.NewPacket(data, layers.LayerTypeIPv4, gopacket.Default)
+	require.NotNil(t, pkt.Layer(layers.LayerTypeUDP))
+	u := pkt.Layer(layers.LayerTypeUDP).(*layers.UDP)
+	assert.Equal(t, layers.UDPPort(53), u.DstPort)
+	assert.Equal(t, []byte("query"), u.Payload)
+}
+
+func TestSSHTcpdump(t *testing.T) {
+	f := &Interface{captures: &packetCaptures{}, outside: &udp.NoopConn{}}
+	flags := &sshTcpdumpFlags{Count: 1, Duration: 5 * time.Second, Snaplen: captureMaxSnaplen, MaxBytes: 1 << 20}
+
+	w := &testStringWriter{}
+	done := make(chan error)
+	go func() {
+		done <- sshTcpdump(f, flags, []string{"dst", "port", "53"}, w)
+	}()
+
+	dns := iputil.CreateUDPPacket(netip.MustParseAddrPort("10.1.0.1:40000"), netip.MustParseAddrPort("10.1.0.2:53"), nil)
+	fp := &firewall.Packet{}
+	require.NoError(t, newPacket(dns, false, fp))
+
+	// Keep sending until the capture has started and seen the packet
+	for {
+		f.captures.inner(captureOut, dns, fp)
+		select {
+		case err := <-done:
+			require.NoError(t, err)
+			lines := strings.Split(strings.TrimSpace(w.String()), "\n")
+			require.Len(t, lines, 2)
+			assert.True(t, strings.HasSuffix(lines[0], "out 10.1.0.1:40000 > 10.1.0.2:53 udp length 28"), lines[0])
+			assert.Regexp(t, `^1 packets captured, \d+ dropped$`, lines[1])
+			assert.Nil(t, f.captures.active.Load())
+			return
+		case <-time.After(time.Millisecond):
+		}
+	}
+}
+
+func TestSSHTcpdump_Errors(t *testing.T) {
+	f := &Interface{captures: &packetCaptures{}, outside: &udp.NoopConn{}}
+	flags := func() *sshTcpdumpFlags {
+		return &sshTcpdumpFlags{Duration: time.Second, Snaplen: captureMaxSnaplen, MaxBytes: 1}
+	}
+
+	w := &testStringWriter{}
+	require.NoError(t, sshTcpdump(f, flags(), []string{"host"}, w))
+	assert.Equal(t, "filter ended early\n", w.String())
+
+	w.Reset()
+	fl := flags()
+	fl.Duration = 2 * time.Hour
+	require.NoError(t, sshTcpdump(f, fl, nil, w))
+	assert.Equal(t, "-t must be greater than 0 and at most 1h0m0s\n", w.String())
+
+	w.Reset()
+	fl = flags()
+	fl.Pcap = true
+	require.NoError(t, sshTcpdump(f, fl, nil, w))
+	assert.Equal(t, "-w writes a binary pcap stream and needs an ssh exec session, ex: `ssh -p 2222 host tcpdump -w > capture.pcap`\n", w.String())
+	assert.Nil(t, f.captures.active.Load())
+}
@@ -10,6 +10,10 @@ import (
 type NebulaCAPool struct {
 	CAs           map[string]*NebulaCertificate
 	certBlocklist map[string]struct{}
+
+	// logs are the trusted transparency logs by id
+	logs                  map[string]*LogPublicKey
+	requireInclusionProof bool
 }
 
 // NewCAPool creates a CAPool
@@ -17,6 +21,7 @@ func NewCAPool() *NebulaCAPool {
 	ca := NebulaCAPool{
 		CAs:           make(map[string]*NebulaCertificate),
 		certBlocklist: make(map[string]struct{}),
+		logs:          make(map[string]*LogPublicKey),
 	}
 
 	return &ca
@@ -68,9 +73,9 @@ func (ncp *NebulaCAPool) AddCACertificate(pemBytes []byte) ([]byte, error) {
 		return pemBytes, fmt.Errorf("%s: %w", c.Details.Name, ErrNotSelfSigned)
 	}
 
-	sum, err := c.Sha256Sum()
+	sum, err := c.Fingerprint()
 	if err != nil {
-		return pemBytes, fmt.Errorf("could not calculate shasum for provided CA; error: %s; %s", err, c.Details.Name)
+		return pemBytes, fmt.Errorf("could not calculate fingerprint for provided CA; error: %s; %s", err, c.Details.Name)
 	}
 
 	ncp.CAs[sum] = c
@@ -81,7 +86,8 @@ func (ncp *NebulaCAPool) AddCACertificate(pemBytes []byte) ([]byte, error) {
 	return pemBytes, nil
 }
 
-// BlocklistFingerprint adds a cert fingerprint to the blocklist
+// BlocklistFingerprint adds a cert fingerprint to the blocklist, either the Fingerprint or Sha256Sum of a certificate
+// may be used
 func (ncp *NebulaCAPool) BlocklistFingerprint(f string) {
 	ncp.certBlocklist[f] = struct{}{}
 }
@@ -91,7 +97,7 @@ func (ncp *NebulaCAPool) ResetCertBlocklist() {
 	ncp.certBlocklist = make(map[string]struct{})
 }
 
-// NOTE: This uses an internal cache for Sha256Sum() that will not be invalidated
+// NOTE: This uses an internal cache for Sha256Sum() and Fingerprint() that will not be invalidated
 // automatically if you manually change any fields in the NebulaCertificate.
 func (ncp *NebulaCAPool) IsBlocklisted(c *NebulaCertificate) bool {
 	return ncp.isBlocklistedWithCache(c, false)
@@ -108,7 +114,19 @@ func (ncp *NebulaCAPool) isBlocklistedWithCache(c *NebulaCertificate, useCache b
 		return true
 	}
 
-	return false
+	if c.Details.Hash == HashAlgorithm_SHA256 {
+		return false
+	}
+
+	// Blocklist entries written before hash algorithms were configurable are sha256 sums, newer ones may use the
+	// certificates own fingerprint
+	h, err = c.fingerprintWithCache(useCache)
+	if err != nil {
+		return true
+	}
+
+	_, ok := ncp.certBlocklist[h]
+	return ok
 }
 
 // GetCAForCert attempts to return the signing certificate for the provided certificate.
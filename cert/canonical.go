@@ -0,0 +1,240 @@
+package cert
+
+import (
+	"encoding/hex"
+	"fmt"
+	"net"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Field numbers from cert.proto, these must never change
+const (
+	rawCertDetailsField        = 1
+	rawCertSignatureField      = 2
+	rawCertInclusionProofField = 3
+
+	rawDetailsNameField      = 1
+	rawDetailsIpsField       = 2
+	rawDetailsSubnetsField   = 3
+	rawDetailsGroupsField    = 4
+	rawDetailsNotBeforeField = 5
+	rawDetailsNotAfterField  = 6
+	rawDetailsPublicKeyField = 7
+	rawDetailsIsCAField      = 8
+	rawDetailsIssuerField    = 9
+	rawDetailsIps6Field      = 10
+	rawDetailsSubnets6Field  = 11
+	rawDetailsVersionField   = 12
+	rawDetailsCurveField     = 100
+	rawDetailsHashField      = 101
+
+	rawProofLogIDField     = 1
+	rawProofLeafIndexField = 2
+	rawProofTreeSizeField  = 3
+	rawProofTimestampField = 4
+	rawProofAuditPathField = 5
+	rawProofSignatureField = 6
+)
+
+// Canonicalize returns the canonical wire encoding of the certificate, including the signature.
+// The output is stable across protobuf library versions so it is safe to hash or compare byte for byte.
+func (nc *NebulaCertificate) Canonicalize() ([]byte, error) {
+	return nc.canonicalize(true, true)
+}
+
+// MarshalForHandshakes returns the canonical encoding without the public key, which peers recover from the noise
+// handshake instead. The certificate is not modified so this is safe to call while it is in use elsewhere.
+func (nc *NebulaCertificate) MarshalForHandshakes() ([]byte, error) {
+	return nc.canonicalize(false, true)
+}
+
+func (nc *NebulaCertificate) canonicalize(withPublicKey bool, withInclusionProof bool) ([]byte, error) {
+	d, err := nc.marshalDetails(withPublicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	b := make([]byte, 0, len(d)+len(nc.Signature)+8)
+	b = protowire.AppendTag(b, rawCertDetailsField, protowire.BytesType)
+	b = protowire.AppendBytes(b, d)
+	if len(nc.Signature) > 0 {
+		b = protowire.AppendTag(b, rawCertSignatureField, protowire.BytesType)
+		b = protowire.AppendBytes(b, nc.Signature)
+	}
+
+	if withInclusionProof && nc.InclusionProof != nil {
+		p, err := marshalInclusionProof(nc.InclusionProof)
+		if err != nil {
+			return nil, err
+		}
+		b = protowire.AppendTag(b, rawCertInclusionProofField, protowire.BytesType)
+		b = protowire.AppendBytes(b, p)
+	}
+
+	return b, nil
+}
+
+// marshalInclusionProof writes the proof in field number order, the same as the certificate details
+func marshalInclusionProof(p *InclusionProof) ([]byte, error) {
+	logID, err := hex.DecodeString(p.LogID)
+	if err != nil {
+		return nil, fmt.Errorf("inclusion proof log id is not hex: %w", err)
+	}
+
+	var b []byte
+	if len(logID) > 0 {
+		b = protowire.AppendTag(b, rawProofLogIDField, protowire.BytesType)
+		b = protowire.AppendBytes(b, logID)
+	}
+	if p.LeafIndex != 0 {
+		b = protowire.AppendTag(b, rawProofLeafIndexField, protowire.VarintType)
+		b = protowire.AppendVarint(b, p.LeafIndex)
+	}
+	if p.TreeSize != 0 {
+		b = protowire.AppendTag(b, rawProofTreeSizeField, protowire.VarintType)
+		b = protowire.AppendVarint(b, p.TreeSize)
+	}
+	if ts := p.Timestamp.Unix(); ts != 0 {
+		b = protowire.AppendTag(b, rawProofTimestampField, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(ts))
+	}
+	for _, h := range p.AuditPath {
+		b = protowire.AppendTag(b, rawProofAuditPathField, protowire.BytesType)
+		b = protowire.AppendBytes(b, h)
+	}
+	if len(p.Signature) > 0 {
+		b = protowire.AppendTag(b, rawProofSignatureField, protowire.BytesType)
+		b = protowire.AppendBytes(b, p.Signature)
+	}
+
+	return b, nil
+}
+
+// marshalForSigning returns the canonical encoding of the certificate details, this is what the signature covers.
+// Fields are written in ascending field number order, repeated scalars are packed, and proto3 default values are
+// omitted. This matches the encoding every certificate has historically been signed with.
+func (nc *NebulaCertificate) marshalForSigning() ([]byte, error) {
+	return nc.marshalDetails(true)
+}
+
+// marshalDetails is marshalForSigning with the option to leave out the public key
+func (nc *NebulaCertificate) marshalDetails(withPublicKey bool) ([]byte, error) {
+	var b []byte
+
+	if nc.Details.Name != "" {
+		b = protowire.AppendTag(b, rawDetailsNameField, protowire.BytesType)
+		b = protowire.AppendString(b, nc.Details.Name)
+	}
+
+	var err error
+	b, err = appendCanonicalIPNets(b, rawDetailsIpsField, nc.Details.Ips)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ips: %w", err)
+	}
+
+	b, err = appendCanonicalIPNets(b, rawDetailsSubnetsField, nc.Details.Subnets)
+	if err != nil {
+		return nil, fmt.Errorf("invalid subnets: %w", err)
+	}
+
+	for _, g := range nc.Details.Groups {
+		b = protowire.AppendTag(b, rawDetailsGroupsField, protowire.BytesType)
+		b = protowire.AppendString(b, g)
+	}
+
+	if v := nc.Details.NotBefore.Unix(); v != 0 {
+		b = protowire.AppendTag(b, rawDetailsNotBeforeField, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(v))
+	}
+
+	if v := nc.Details.NotAfter.Unix(); v != 0 {
+		b = protowire.AppendTag(b, rawDetailsNotAfterField, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(v))
+	}
+
+	if withPublicKey && len(nc.Details.PublicKey) > 0 {
+		b = protowire.AppendTag(b, rawDetailsPublicKeyField, protowire.BytesType)
+		b = protowire.AppendBytes(b, nc.Details.PublicKey)
+	}
+
+	if nc.Details.IsCA {
+		b = protowire.AppendTag(b, rawDetailsIsCAField, protowire.VarintType)
+		b = protowire.AppendVarint(b, 1)
+	}
+
+	if nc.Details.Issuer != "" {
+		// Matches getRawDetails, only the leading valid hex of a malformed issuer is kept
+		issuer, _ := hex.DecodeString(nc.Details.Issuer)
+		if len(issuer) > 0 {
+			b = protowire.AppendTag(b, rawDetailsIssuerField, protowire.BytesType)
+			b = protowire.AppendBytes(b, issuer)
+		}
+	}
+
+	b, err = appendCanonicalIPv6Nets(b, rawDetailsIps6Field, nc.Details.Ips)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ips: %w", err)
+	}
+
+	b, err = appendCanonicalIPv6Nets(b, rawDetailsSubnets6Field, nc.Details.Subnets)
+	if err != nil {
+		return nil, fmt.Errorf("invalid subnets: %w", err)
+	}
+
+	if v := nc.Version(); v != Version1 {
+		b = protowire.AppendTag(b, rawDetailsVersionField, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(v))
+	}
+
+	if nc.Details.Curve != Curve_CURVE25519 {
+		b = protowire.AppendTag(b, rawDetailsCurveField, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(nc.Details.Curve))
+	}
+
+	if nc.Details.Hash != HashAlgorithm_SHA256 {
+		b = protowire.AppendTag(b, rawDetailsHashField, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(nc.Details.Hash))
+	}
+
+	return b, nil
+}
+
+// appendCanonicalIPNets writes the ipv4 ip/mask pairs as a packed repeated uint32 field
+func appendCanonicalIPNets(b []byte, field protowire.Number, nets []*net.IPNet) ([]byte, error) {
+	var packed []byte
+	for _, n := range nets {
+		if n == nil {
+			return nil, fmt.Errorf("nil network")
+		}
+		if isIPv6Net(n) {
+			continue
+		}
+		packed = protowire.AppendVarint(packed, uint64(ip2int(n.IP)))
+		packed = protowire.AppendVarint(packed, uint64(ip2int(n.Mask)))
+	}
+
+	if len(packed) == 0 {
+		return b, nil
+	}
+
+	b = protowire.AppendTag(b, field, protowire.BytesType)
+	return protowire.AppendBytes(b, packed), nil
+}
+
+// appendCanonicalIPv6Nets writes the ipv6 ip/mask pairs as a repeated bytes field, 1st the ip, 2nd the mask
+func appendCanonicalIPv6Nets(b []byte, field protowire.Number, nets []*net.IPNet) ([]byte, error) {
+	for _, n := range nets {
+		if !isIPv6Net(n) {
+			continue
+		}
+		if len(n.Mask) != net.IPv6len {
+			return nil, fmt.Errorf("ipv6 network %s does not have a 16 byte mask", n)
+		}
+		b = protowire.AppendTag(b, field, protowire.BytesType)
+		b = protowire.AppendBytes(b, n.IP.To16())
+		b = protowire.AppendTag(b, field, protowire.BytesType)
+		b = protowire.AppendBytes(b, n.Mask)
+	}
+	return b, nil
+}
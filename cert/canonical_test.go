@@ -0,0 +1,96 @@
+package cert
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestNebulaCertificate_Canonicalize(t *testing.T) {
+	before := time.Date(2009, time.November, 10, 23, 0, 0, 0, time.UTC)
+	after := time.Date(2017, time.January, 18, 28, 40, 0, 0, time.UTC)
+
+	certs := []*NebulaCertificate{
+		{},
+		{Details: NebulaCertificateDetails{Name: "only-name"}},
+		{
+			Details: NebulaCertificateDetails{
+				Name:      "ca",
+				Groups:    []string{"a", "b"},
+				NotBefore: before,
+				NotAfter:  after,
+				PublicKey: []byte("1234567890abcedfghij1234567890ab"),
+				IsCA:      true,
+				Curve:     Curve_P256,
+				Hash:      HashAlgorithm_SHA384,
+			},
+			Signature: []byte("sig"),
+		},
+		{
+			Details: NebulaCertificateDetails{
+				Name: "host",
+				Ips: []*net.IPNet{
+					{IP: net.ParseIP("10.1.1.1"), Mask: net.IPMask(net.ParseIP("255.255.255.0"))},
+					{IP: net.IPv4(10, 1, 1, 2).To4(), Mask: net.IPv4Mask(255, 255, 0, 0)},
+				},
+				Subnets: []*net.IPNet{
+					{IP: net.ParseIP("9.1.1.1"), Mask: net.IPMask(net.ParseIP("255.0.255.0"))},
+				},
+				NotBefore: before,
+				NotAfter:  after,
+				PublicKey: []byte("1234567890abcedfghij1234567890ab"),
+				Issuer:    "1234567890abcedfghij1234567890ab",
+			},
+			Signature: []byte("1234567890abcedfghij1234567890ab"),
+		},
+		{
+			Details: NebulaCertificateDetails{
+				Name: "dual-stack",
+				Ips: []*net.IPNet{
+					{IP: net.ParseIP("10.1.1.1"), Mask: net.IPMask(net.ParseIP("255.255.255.0"))},
+					{IP: net.ParseIP("fd00::1"), Mask: net.CIDRMask(64, 128)},
+				},
+				Subnets: []*net.IPNet{
+					{IP: net.ParseIP("fd01::"), Mask: net.CIDRMask(48, 128)},
+				},
+				NotBefore: before,
+				NotAfter:  after,
+				PublicKey: []byte("1234567890abcedfghij1234567890ab"),
+			},
+			Signature: []byte("1234567890abcedfghij1234567890ab"),
+		},
+	}
+
+	for _, nc := range certs {
+		// The canonical details must match what the protobuf library produces, otherwise old signatures break
+		expected, err := proto.Marshal(nc.getRawDetails())
+		assert.NoError(t, err)
+		b, err := nc.marshalForSigning()
+		assert.NoError(t, err)
+		assert.Equal(t, expected, b)
+
+		expected, err = proto.Marshal(&RawNebulaCertificate{Details: nc.getRawDetails(), Signature: nc.Signature})
+		assert.NoError(t, err)
+		b, err = nc.Canonicalize()
+		assert.NoError(t, err)
+		assert.Equal(t, expected, b)
+
+		if len(nc.Details.PublicKey) == 0 {
+			// Can't be unmarshaled
+			continue
+		}
+
+		// Re-marshaling a parsed cert must produce the same bytes
+		nc2, err := UnmarshalNebulaCertificate(b)
+		assert.NoError(t, err)
+		b2, err := nc2.Canonicalize()
+		assert.NoError(t, err)
+		assert.Equal(t, b, b2)
+	}
+
+	_, err := (&NebulaCertificate{Details: NebulaCertificateDetails{Ips: []*net.IPNet{nil}}}).Canonicalize()
+	assert.EqualError(t, err, "invalid ips: nil network")
+}
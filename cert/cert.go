@@ -17,6 +17,7 @@ import (
 	"math"
 	"math/big"
 	"net"
+	"strings"
 	"sync/atomic"
 	"time"
 
@@ -26,6 +27,12 @@ import (
 
 const publicKeyLen = 32
 
+// Version2 certificates may have ipv6 networks, certificates without any are version 1 and encode the version as unset
+const (
+	Version1 uint32 = 1
+	Version2 uint32 = 2
+)
+
 const (
 	CertBanner                       = "NEBULA CERTIFICATE"
 	X25519PrivateKeyBanner           = "NEBULA X25519 PRIVATE KEY"
@@ -44,17 +51,28 @@ type NebulaCertificate struct {
 	Details   NebulaCertificateDetails
 	Signature []byte
 
-	// the cached hex string of the calculated sha256sum
+	// InclusionProof is set once the certificate has been submitted to a transparency log, it is not covered by the
+	// signature or the fingerprint
+	InclusionProof *InclusionProof
+
+	// the cached hex string of the calculated sha256sum and fingerprint
 	// for VerifyWithCache
-	sha256sum atomic.Pointer[string]
+	sha256sum   atomic.Pointer[string]
+	fingerprint atomic.Pointer[string]
 
 	// the cached public key bytes if they were verified as the signer
 	// for VerifyWithCache
 	signatureVerified atomic.Pointer[[]byte]
+
+	// the cached id of the transparency log the inclusion proof was verified with
+	// for VerifyWithCache
+	inclusionVerified atomic.Pointer[string]
 }
 
 type NebulaCertificateDetails struct {
-	Name      string
+	Name string
+	// Ips are the vpn networks of the host, the first is its primary vpn ip. Once marshaled the ipv4 networks always
+	// come before the ipv6 networks.
 	Ips       []*net.IPNet
 	Subnets   []*net.IPNet
 	Groups    []string
@@ -68,6 +86,8 @@ type NebulaCertificateDetails struct {
 	InvertedGroups map[string]struct{}
 
 	Curve Curve
+	// Hash is used for the fingerprint and, with P256, the digest that is signed. The zero value is SHA256.
+	Hash HashAlgorithm
 }
 
 type NebulaEncryptedData struct {
@@ -96,6 +116,11 @@ func UnmarshalNebulaCertificate(b []byte) (*NebulaCertificate, error) {
 		return nil, err
 	}
 
+	return unmarshalRawNebulaCertificate(&rc)
+}
+
+// unmarshalRawNebulaCertificate converts the protobuf representation of a nebula cert
+func unmarshalRawNebulaCertificate(rc *RawNebulaCertificate) (*NebulaCertificate, error) {
 	if rc.Details == nil {
 		return nil, fmt.Errorf("encoded Details was nil")
 	}
@@ -108,20 +133,39 @@ func UnmarshalNebulaCertificate(b []byte) (*NebulaCertificate, error) {
 		return nil, fmt.Errorf("encoded Subnets should be in pairs, an odd number was found")
 	}
 
+	if len(rc.Details.Ips6)%2 != 0 {
+		return nil, fmt.Errorf("encoded Ips6 should be in pairs, an odd number was found")
+	}
+
+	if len(rc.Details.Subnets6)%2 != 0 {
+		return nil, fmt.Errorf("encoded Subnets6 should be in pairs, an odd number was found")
+	}
+
+	var err error
+	hasV6 := len(rc.Details.Ips6) > 0 || len(rc.Details.Subnets6) > 0
+	if rc.Details.Version > Version2 {
+		return nil, fmt.Errorf("unsupported certificate version %d", rc.Details.Version)
+	}
+	if hasV6 != (rc.Details.Version == Version2) {
+		return nil, fmt.Errorf("ipv6 networks are only valid in version %d certificates, have version %d", Version2, rc.Details.Version)
+	}
+
 	nc := NebulaCertificate{
 		Details: NebulaCertificateDetails{
 			Name:           rc.Details.Name,
 			Groups:         make([]string, len(rc.Details.Groups)),
-			Ips:            make([]*net.IPNet, len(rc.Details.Ips)/2),
-			Subnets:        make([]*net.IPNet, len(rc.Details.Subnets)/2),
+			Ips:            make([]*net.IPNet, len(rc.Details.Ips)/2, (len(rc.Details.Ips)+len(rc.Details.Ips6))/2),
+			Subnets:        make([]*net.IPNet, len(rc.Details.Subnets)/2, (len(rc.Details.Subnets)+len(rc.Details.Subnets6))/2),
 			NotBefore:      time.Unix(rc.Details.NotBefore, 0),
 			NotAfter:       time.Unix(rc.Details.NotAfter, 0),
 			PublicKey:      make([]byte, len(rc.Details.PublicKey)),
 			IsCA:           rc.Details.IsCA,
 			InvertedGroups: make(map[string]struct{}),
 			Curve:          rc.Details.Curve,
+			Hash:           rc.Details.Hash,
 		},
-		Signature: make([]byte, len(rc.Signature)),
+		Signature:      make([]byte, len(rc.Signature)),
+		InclusionProof: unmarshalRawInclusionProof(rc.InclusionProof),
 	}
 
 	copy(nc.Signature, rc.Signature)
@@ -149,6 +193,17 @@ func UnmarshalNebulaCertificate(b []byte) (*NebulaCertificate, error) {
 		}
 	}
 
+	// The ipv6 networks follow the ipv4 networks, a certificate with only ipv6 networks has one as its primary ip
+	nc.Details.Ips, err = appendIPv6Nets(nc.Details.Ips, rc.Details.Ips6)
+	if err != nil {
+		return nil, fmt.Errorf("encoded Ips6 %w", err)
+	}
+
+	nc.Details.Subnets, err = appendIPv6Nets(nc.Details.Subnets, rc.Details.Subnets6)
+	if err != nil {
+		return nil, fmt.Errorf("encoded Subnets6 %w", err)
+	}
+
 	for _, g := range rc.Details.Groups {
 		nc.Details.InvertedGroups[g] = struct{}{}
 	}
@@ -518,17 +573,26 @@ func (nc *NebulaCertificate) Sign(curve Curve, key []byte) error {
 		return fmt.Errorf("curve in cert and private key supplied don't match")
 	}
 
-	b, err := proto.Marshal(nc.getRawDetails())
+	b, err := nc.marshalForSigning()
+	if err != nil {
+		return err
+	}
+
+	sig, err := signBytes(curve, nc.Details.Hash, key, b)
 	if err != nil {
 		return err
 	}
 
-	var sig []byte
+	nc.Signature = sig
+	return nil
+}
 
+// signBytes signs b with the private key for curve, P256 signs the digest of b using hash and Ed25519 ignores it
+func signBytes(curve Curve, hash HashAlgorithm, key []byte, b []byte) ([]byte, error) {
 	switch curve {
 	case Curve_CURVE25519:
 		signer := ed25519.PrivateKey(key)
-		sig = ed25519.Sign(signer, b)
+		return ed25519.Sign(signer, b), nil
 	case Curve_P256:
 		signer := &ecdsa.PrivateKey{
 			PublicKey: ecdsa.PublicKey{
@@ -542,38 +606,43 @@ func (nc *NebulaCertificate) Sign(curve Curve, key []byte) error {
 
 		// We need to hash first for ECDSA
 		// - https://pkg.go.dev/crypto/ecdsa#SignASN1
-		hashed := sha256.Sum256(b)
-		sig, err = ecdsa.SignASN1(rand.Reader, signer, hashed[:])
+		hashed, err := hash.Sum(b)
 		if err != nil {
-			return err
+			return nil, err
 		}
+		return ecdsa.SignASN1(rand.Reader, signer, hashed)
 	default:
-		return fmt.Errorf("invalid curve: %s", nc.Details.Curve)
+		return nil, fmt.Errorf("invalid curve: %s", curve)
 	}
-
-	nc.Signature = sig
-	return nil
 }
 
-// CheckSignature verifies the signature against the provided public key
-func (nc *NebulaCertificate) CheckSignature(key []byte) bool {
-	b, err := proto.Marshal(nc.getRawDetails())
-	if err != nil {
-		return false
-	}
-	switch nc.Details.Curve {
+// checkBytesSignature verifies sig over b against the public key for curve, see signBytes for how hash is used
+func checkBytesSignature(curve Curve, hash HashAlgorithm, key []byte, b []byte, sig []byte) bool {
+	switch curve {
 	case Curve_CURVE25519:
-		return ed25519.Verify(ed25519.PublicKey(key), b, nc.Signature)
+		return ed25519.Verify(ed25519.PublicKey(key), b, sig)
 	case Curve_P256:
 		x, y := elliptic.Unmarshal(elliptic.P256(), key)
 		pubKey := &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}
-		hashed := sha256.Sum256(b)
-		return ecdsa.VerifyASN1(pubKey, hashed[:], nc.Signature)
+		hashed, err := hash.Sum(b)
+		if err != nil {
+			return false
+		}
+		return ecdsa.VerifyASN1(pubKey, hashed, sig)
 	default:
 		return false
 	}
 }
 
+// CheckSignature verifies the signature against the provided public key
+func (nc *NebulaCertificate) CheckSignature(key []byte) bool {
+	b, err := nc.marshalForSigning()
+	if err != nil {
+		return false
+	}
+	return checkBytesSignature(nc.Details.Curve, nc.Details.Hash, key, b, nc.Signature)
+}
+
 // NOTE: This uses an internal cache that will not be invalidated automatically
 // if you manually change any fields in the NebulaCertificate.
 func (nc *NebulaCertificate) checkSignatureWithCache(key []byte, useCache bool) bool {
@@ -616,7 +685,9 @@ func (nc *NebulaCertificate) VerifyWithCache(t time.Time, ncp *NebulaCAPool) (bo
 // ResetCache resets the cache used by VerifyWithCache.
 func (nc *NebulaCertificate) ResetCache() {
 	nc.sha256sum.Store(nil)
+	nc.fingerprint.Store(nil)
 	nc.signatureVerified.Store(nil)
+	nc.inclusionVerified.Store(nil)
 }
 
 // Verify will ensure a certificate is good in all respects (expiry, group membership, signature, cert blocklist, etc)
@@ -646,6 +717,12 @@ func (nc *NebulaCertificate) verify(t time.Time, ncp *NebulaCAPool, useCache boo
 		return false, err
 	}
 
+	if ncp.requireInclusionProof {
+		if err := ncp.verifyInclusionProof(nc, useCache); err != nil {
+			return false, err
+		}
+	}
+
 	return true, nil
 }
 
@@ -661,10 +738,11 @@ func (nc *NebulaCertificate) CheckRootConstrains(signer *NebulaCertificate) erro
 		return fmt.Errorf("certificate is valid before the signing certificate")
 	}
 
-	// If the signer has a limited set of groups make sure the cert only contains a subset
+	// If the signer has a limited set of groups make sure the cert only contains a subset, signer groups with a * are
+	// patterns that grant every group they match
 	if len(signer.Details.InvertedGroups) > 0 {
 		for _, g := range nc.Details.Groups {
-			if _, ok := signer.Details.InvertedGroups[g]; !ok {
+			if !groupMatch(g, signer) {
 				return fmt.Errorf("certificate contained a group not present on the signing ca: %s", g)
 			}
 		}
@@ -792,12 +870,21 @@ func (nc *NebulaCertificate) String() string {
 	s += fmt.Sprintf("\t\tIssuer: %s\n", nc.Details.Issuer)
 	s += fmt.Sprintf("\t\tPublic key: %x\n", nc.Details.PublicKey)
 	s += fmt.Sprintf("\t\tCurve: %s\n", nc.Details.Curve)
+	s += fmt.Sprintf("\t\tHash: %s\n", nc.Details.Hash)
 	s += "\t}\n"
-	fp, err := nc.Sha256Sum()
+	fp, err := nc.Fingerprint()
 	if err == nil {
 		s += fmt.Sprintf("\tFingerprint: %s\n", fp)
 	}
 	s += fmt.Sprintf("\tSignature: %x\n", nc.Signature)
+	if p := nc.InclusionProof; p != nil {
+		s += "\tInclusion proof {\n"
+		s += fmt.Sprintf("\t\tLog: %s\n", p.LogID)
+		s += fmt.Sprintf("\t\tLeaf index: %d\n", p.LeafIndex)
+		s += fmt.Sprintf("\t\tTree size: %d\n", p.TreeSize)
+		s += fmt.Sprintf("\t\tTimestamp: %v\n", p.Timestamp)
+		s += "\t}\n"
+	}
 	s += "}"
 
 	return s
@@ -813,14 +900,27 @@ func (nc *NebulaCertificate) getRawDetails() *RawNebulaCertificateDetails {
 		PublicKey: make([]byte, len(nc.Details.PublicKey)),
 		IsCA:      nc.Details.IsCA,
 		Curve:     nc.Details.Curve,
+		Hash:      nc.Details.Hash,
 	}
 
 	for _, ipNet := range nc.Details.Ips {
-		rd.Ips = append(rd.Ips, ip2int(ipNet.IP), ip2int(ipNet.Mask))
+		if isIPv6Net(ipNet) {
+			rd.Ips6 = append(rd.Ips6, ipNet.IP.To16(), ipNet.Mask)
+		} else {
+			rd.Ips = append(rd.Ips, ip2int(ipNet.IP), ip2int(ipNet.Mask))
+		}
 	}
 
 	for _, ipNet := range nc.Details.Subnets {
-		rd.Subnets = append(rd.Subnets, ip2int(ipNet.IP), ip2int(ipNet.Mask))
+		if isIPv6Net(ipNet) {
+			rd.Subnets6 = append(rd.Subnets6, ipNet.IP.To16(), ipNet.Mask)
+		} else {
+			rd.Subnets = append(rd.Subnets, ip2int(ipNet.IP), ip2int(ipNet.Mask))
+		}
+	}
+
+	if v := nc.Version(); v != Version1 {
+		rd.Version = v
 	}
 
 	copy(rd.PublicKey, nc.Details.PublicKey[:])
@@ -831,14 +931,9 @@ func (nc *NebulaCertificate) getRawDetails() *RawNebulaCertificateDetails {
 	return rd
 }
 
-// Marshal will marshal a nebula cert into a protobuf byte array
+// Marshal will marshal a nebula cert into a protobuf byte array, the output is always the canonical encoding
 func (nc *NebulaCertificate) Marshal() ([]byte, error) {
-	rc := RawNebulaCertificate{
-		Details:   nc.getRawDetails(),
-		Signature: nc.Signature,
-	}
-
-	return proto.Marshal(&rc)
+	return nc.Canonicalize()
 }
 
 // MarshalToPEM will marshal a nebula cert into a protobuf byte array and pem encode the result
@@ -850,9 +945,41 @@ func (nc *NebulaCertificate) MarshalToPEM() ([]byte, error) {
 	return pem.EncodeToMemory(&pem.Block{Type: CertBanner, Bytes: b}), nil
 }
 
-// Sha256Sum calculates a sha-256 sum of the marshaled certificate
+// Fingerprint calculates the hex encoded digest of the marshaled certificate with the hash named in the certificate.
+// This identifies the certificate as an issuer and is the same as Sha256Sum for SHA256 certificates. The inclusion
+// proof is left out so the fingerprint does not change when one is attached.
+func (nc *NebulaCertificate) Fingerprint() (string, error) {
+	b, err := nc.logLeaf()
+	if err != nil {
+		return "", err
+	}
+
+	return nc.Details.Hash.hexSum(b)
+}
+
+// NOTE: This uses an internal cache that will not be invalidated automatically
+// if you manually change any fields in the NebulaCertificate.
+func (nc *NebulaCertificate) fingerprintWithCache(useCache bool) (string, error) {
+	if !useCache {
+		return nc.Fingerprint()
+	}
+
+	if s := nc.fingerprint.Load(); s != nil {
+		return *s, nil
+	}
+	s, err := nc.Fingerprint()
+	if err != nil {
+		return s, err
+	}
+
+	nc.fingerprint.Store(&s)
+	return s, nil
+}
+
+// Sha256Sum calculates a sha-256 sum of the marshaled certificate regardless of the certificates hash. Fingerprints
+// pinned before hash algorithms were configurable, like a blocklist entry, are in this form.
 func (nc *NebulaCertificate) Sha256Sum() (string, error) {
-	b, err := nc.Marshal()
+	b, err := nc.logLeaf()
 	if err != nil {
 		return "", err
 	}
@@ -889,7 +1016,7 @@ func (nc *NebulaCertificate) MarshalJSON() ([]byte, error) {
 		return s
 	}
 
-	fp, _ := nc.Sha256Sum()
+	fp, _ := nc.Fingerprint()
 	jc := m{
 		"details": m{
 			"name":      nc.Details.Name,
@@ -902,10 +1029,19 @@ func (nc *NebulaCertificate) MarshalJSON() ([]byte, error) {
 			"isCa":      nc.Details.IsCA,
 			"issuer":    nc.Details.Issuer,
 			"curve":     nc.Details.Curve.String(),
+			"hash":      nc.Details.Hash.String(),
 		},
 		"fingerprint": fp,
 		"signature":   fmt.Sprintf("%x", nc.Signature),
 	}
+	if p := nc.InclusionProof; p != nil {
+		jc["inclusionProof"] = m{
+			"logId":     p.LogID,
+			"leafIndex": p.LeafIndex,
+			"treeSize":  p.TreeSize,
+			"timestamp": p.Timestamp,
+		}
+	}
 	return json.Marshal(jc)
 }
 
@@ -933,8 +1069,11 @@ func (nc *NebulaCertificate) Copy() *NebulaCertificate {
 			IsCA:           nc.Details.IsCA,
 			Issuer:         nc.Details.Issuer,
 			InvertedGroups: make(map[string]struct{}, len(nc.Details.InvertedGroups)),
+			Curve:          nc.Details.Curve,
+			Hash:           nc.Details.Hash,
 		},
-		Signature: make([]byte, len(nc.Signature)),
+		Signature:      make([]byte, len(nc.Signature)),
+		InclusionProof: nc.InclusionProof.copy(),
 	}
 
 	copy(c.Signature, nc.Signature)
@@ -966,6 +1105,86 @@ func (nc *NebulaCertificate) Copy() *NebulaCertificate {
 	return c
 }
 
+// groupMatch reports if the signer grants group g, either by name or with a pattern like team:*
+func groupMatch(g string, signer *NebulaCertificate) bool {
+	if _, ok := signer.Details.InvertedGroups[g]; ok {
+		return true
+	}
+
+	for _, p := range signer.Details.Groups {
+		if strings.Contains(p, "*") && matchGroupPattern(p, g) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// matchGroupPattern matches g against p where each * in p matches any run of characters, including none. A pattern on
+// a sub CA is matched as a literal group, so team:* on a root grants team:* and team:web:* to a sub CA but not *.
+func matchGroupPattern(p, g string) bool {
+	// px and gx are where to resume after the most recent *, classic backtracking glob
+	pi, gi, px, gx := 0, 0, -1, 0
+	for gi < len(g) {
+		switch {
+		case pi < len(p) && p[pi] == '*':
+			px, gx = pi, gi
+			pi++
+		case pi < len(p) && p[pi] == g[gi]:
+			pi++
+			gi++
+		case px >= 0:
+			pi = px + 1
+			gx++
+			gi = gx
+		default:
+			return false
+		}
+	}
+
+	for pi < len(p) && p[pi] == '*' {
+		pi++
+	}
+	return pi == len(p)
+}
+
+// Version returns Version2 if the certificate has any ipv6 networks, Version1 otherwise
+func (nc *NebulaCertificate) Version() uint32 {
+	for _, n := range nc.Details.Ips {
+		if isIPv6Net(n) {
+			return Version2
+		}
+	}
+	for _, n := range nc.Details.Subnets {
+		if isIPv6Net(n) {
+			return Version2
+		}
+	}
+	return Version1
+}
+
+func isIPv6Net(n *net.IPNet) bool {
+	return n != nil && n.IP.To4() == nil
+}
+
+// appendIPv6Nets appends the 16 byte ip and mask pairs in raw to nets
+func appendIPv6Nets(nets []*net.IPNet, raw [][]byte) ([]*net.IPNet, error) {
+	for i := 0; i < len(raw); i += 2 {
+		ip, mask := raw[i], raw[i+1]
+		if len(ip) != net.IPv6len || len(mask) != net.IPv6len {
+			return nil, fmt.Errorf("should be 16 bytes, have %d and %d", len(ip), len(mask))
+		}
+		n := &net.IPNet{IP: make(net.IP, net.IPv6len), Mask: make(net.IPMask, net.IPv6len)}
+		copy(n.IP, ip)
+		copy(n.Mask, mask)
+		if n.IP.To4() != nil {
+			return nil, fmt.Errorf("should be ipv6, have %s", n.IP)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
 func netMatch(certIp *net.IPNet, rootIps []*net.IPNet) bool {
 	for _, net := range rootIps {
 		if net.Contains(certIp.IP) && maskContains(net.Mask, certIp.Mask) {
@@ -977,6 +1196,13 @@ func netMatch(certIp *net.IPNet, rootIps []*net.IPNet) bool {
 }
 
 func maskContains(caMask, certMask net.IPMask) bool {
+	if len(caMask) == net.IPv6len && len(certMask) == net.IPv6len && maskTo4(caMask) == nil && maskTo4(certMask) == nil {
+		// Both are ipv6, the cert may not have a shorter prefix than the ca
+		caOnes, caBits := caMask.Size()
+		certOnes, certBits := certMask.Size()
+		return caBits != 0 && certBits != 0 && caOnes <= certOnes
+	}
+
 	caM := maskTo4(caMask)
 	cM := maskTo4(certMask)
 	// Make sure forcing to ipv4 didn't nuke us
@@ -13,6 +13,7 @@ import (
 
 	"github.com/slackhq/nebula/test"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"golang.org/x/crypto/curve25519"
 	"golang.org/x/crypto/ed25519"
 	"google.golang.org/protobuf/proto"
@@ -198,7 +199,7 @@ func TestNebulaCertificate_MarshalJSON(t *testing.T) {
 	assert.Nil(t, err)
 	assert.Equal(
 		t,
-		"{\"details\":{\"curve\":\"CURVE25519\",\"groups\":[\"test-group1\",\"test-group2\",\"test-group3\"],\"ips\":[\"10.1.1.1/24\",\"10.1.1.2/16\",\"10.1.1.3/ff00ff00\"],\"isCa\":false,\"issuer\":\"1234567890abcedfghij1234567890ab\",\"name\":\"testing\",\"notAfter\":\"0000-11-30T02:00:00Z\",\"notBefore\":\"0000-11-30T01:00:00Z\",\"publicKey\":\"313233343536373839306162636564666768696a313233343536373839306162\",\"subnets\":[\"9.1.1.1/ff00ff00\",\"9.1.1.2/24\",\"9.1.1.3/16\"]},\"fingerprint\":\"26cb1c30ad7872c804c166b5150fa372f437aa3856b04edb4334b4470ec728e4\",\"signature\":\"313233343536373839306162636564666768696a313233343536373839306162\"}",
+		"{\"details\":{\"curve\":\"CURVE25519\",\"groups\":[\"test-group1\",\"test-group2\",\"test-group3\"],\"hash\":\"SHA256\",\"ips\":[\"10.1.1.1/24\",\"10.1.1.2/16\",\"10.1.1.3/ff00ff00\"],\"isCa\":false,\"issuer\":\"1234567890abcedfghij1234567890ab\",\"name\":\"testing\",\"notAfter\":\"0000-11-30T02:00:00Z\",\"notBefore\":\"0000-11-30T01:00:00Z\",\"publicKey\":\"313233343536373839306162636564666768696a313233343536373839306162\",\"subnets\":[\"9.1.1.1/ff00ff00\",\"9.1.1.2/24\",\"9.1.1.3/16\"]},\"fingerprint\":\"26cb1c30ad7872c804c166b5150fa372f437aa3856b04edb4334b4470ec728e4\",\"signature\":\"313233343536373839306162636564666768696a313233343536373839306162\"}",
 		string(b),
 	)
 }
@@ -262,6 +263,56 @@ func TestNebulaCertificate_Verify(t *testing.T) {
 	assert.Nil(t, err)
 }
 
+func TestNebulaCertificate_CheckRootConstrainsGroupPatterns(t *testing.T) {
+	ca, _, caKey, err := newTestCaCert(time.Now(), time.Now().Add(10*time.Minute), []*net.IPNet{}, []*net.IPNet{}, []string{"team:*", "env:prod"})
+	require.NoError(t, err)
+	caPem, err := ca.MarshalToPEM()
+	require.NoError(t, err)
+	// Round trip so InvertedGroups is populated like a ca from the pool
+	ca, _, err = UnmarshalNebulaCertificateFromPEM(caPem)
+	require.NoError(t, err)
+
+	for _, tc := range []struct {
+		groups []string
+		err    string
+	}{
+		{groups: []string{"team:web", "team:db:admin", "env:prod"}},
+		{groups: []string{"team:*", "team:web:*"}},
+		{groups: []string{"env:dev"}, err: "certificate contained a group not present on the signing ca: env:dev"},
+		{groups: []string{"team"}, err: "certificate contained a group not present on the signing ca: team"},
+		{groups: []string{"*"}, err: "certificate contained a group not present on the signing ca: *"},
+	} {
+		c, _, _, err := newTestCert(ca, caKey, time.Now(), time.Now().Add(5*time.Minute), []*net.IPNet{}, []*net.IPNet{}, tc.groups)
+		require.NoError(t, err)
+		err = c.CheckRootConstrains(ca)
+		if tc.err == "" {
+			assert.NoError(t, err, tc.groups)
+		} else {
+			assert.EqualError(t, err, tc.err)
+		}
+	}
+}
+
+func TestMatchGroupPattern(t *testing.T) {
+	for _, tc := range []struct {
+		p, g  string
+		match bool
+	}{
+		{"team:*", "team:web", true},
+		{"team:*", "team:", true},
+		{"team:*", "team", false},
+		{"*:admin", "team:admin", true},
+		{"*:admin", "team:admins", false},
+		{"a*b*c", "axxbyyc", true},
+		{"a*b*c", "axxbyy", false},
+		{"a**", "a", true},
+		{"*", "", true},
+		{"abc", "abc", true},
+	} {
+		assert.Equal(t, tc.match, matchGroupPattern(tc.p, tc.g), "%s %s", tc.p, tc.g)
+	}
+}
+
 func TestNebulaCertificate_VerifyP256(t *testing.T) {
 	ca, _, caKey, err := newTestCaCertP256(time.Now(), time.Now().Add(10*time.Minute), []*net.IPNet{}, []*net.IPNet{}, []string{})
 	assert.Nil(t, err)
@@ -321,6 +372,58 @@ func TestNebulaCertificate_VerifyP256(t *testing.T) {
 	assert.Nil(t, err)
 }
 
+func TestNebulaCertificate_VerifySHA384(t *testing.T) {
+	ca, _, caKey, err := newTestCaCertP256(time.Time{}, time.Time{}, []*net.IPNet{}, []*net.IPNet{}, []string{})
+	assert.NoError(t, err)
+	ca.Details.Hash = HashAlgorithm_SHA384
+	assert.NoError(t, ca.Sign(Curve_P256, caKey))
+
+	caPem, err := ca.MarshalToPEM()
+	assert.NoError(t, err)
+	caPool := NewCAPool()
+	_, err = caPool.AddCACertificate(caPem)
+	assert.NoError(t, err)
+
+	fp, err := ca.Fingerprint()
+	assert.NoError(t, err)
+	assert.Len(t, fp, 96)
+	sum, err := ca.Sha256Sum()
+	assert.NoError(t, err)
+	assert.NotEqual(t, sum, fp)
+	assert.Equal(t, []string{fp}, caPool.GetFingerprints())
+
+	c, _, _, err := newTestCert(ca, caKey, time.Time{}, time.Time{}, []*net.IPNet{}, []*net.IPNet{}, []string{})
+	assert.NoError(t, err)
+	assert.Equal(t, fp, c.Details.Issuer)
+	v, err := c.Verify(time.Now(), caPool)
+	assert.True(t, v)
+	assert.NoError(t, err)
+
+	// The hash is part of what is signed
+	b, err := c.Marshal()
+	assert.NoError(t, err)
+	c2, err := UnmarshalNebulaCertificate(b)
+	assert.NoError(t, err)
+	assert.Equal(t, HashAlgorithm_SHA384, c2.Details.Hash)
+	c2.Details.Hash = HashAlgorithm_SHA256
+	v, err = c2.Verify(time.Now(), caPool)
+	assert.False(t, v)
+	assert.EqualError(t, err, "certificate signature did not match")
+
+	// Both the fingerprint and the sha256 sum can be blocklisted
+	cfp, err := c.Fingerprint()
+	assert.NoError(t, err)
+	csum, err := c.Sha256Sum()
+	assert.NoError(t, err)
+	for _, f := range []string{cfp, csum} {
+		caPool.ResetCertBlocklist()
+		caPool.BlocklistFingerprint(f)
+		v, err = c.Verify(time.Now(), caPool)
+		assert.False(t, v)
+		assert.EqualError(t, err, "certificate is in the block list")
+	}
+}
+
 func TestNebulaCertificate_Verify_IPs(t *testing.T) {
 	_, caIp1, _ := net.ParseCIDR("10.0.0.0/16")
 	_, caIp2, _ := net.ParseCIDR("192.168.0.0/24")
@@ -400,6 +503,106 @@ func TestNebulaCertificate_Verify_IPs(t *testing.T) {
 	assert.Nil(t, err)
 }
 
+func TestNebulaCertificate_Verify_IPv6(t *testing.T) {
+	_, caIp1, _ := net.ParseCIDR("10.0.0.0/16")
+	_, caIp2, _ := net.ParseCIDR("fd00::/48")
+	ca, _, caKey, err := newTestCaCert(time.Now(), time.Now().Add(10*time.Minute), []*net.IPNet{caIp1, caIp2}, []*net.IPNet{}, []string{"test"})
+	assert.Nil(t, err)
+	assert.Equal(t, Version2, ca.Version())
+
+	caPem, err := ca.MarshalToPEM()
+	assert.Nil(t, err)
+
+	caPool := NewCAPool()
+	caPool.AddCACertificate(caPem)
+
+	// ip is outside the network
+	cIp1 := &net.IPNet{IP: net.ParseIP("10.0.0.1"), Mask: net.CIDRMask(24, 32)}
+	cIp2 := &net.IPNet{IP: net.ParseIP("fd01::1"), Mask: net.CIDRMask(64, 128)}
+	c, _, _, err := newTestCert(ca, caKey, time.Now(), time.Now().Add(5*time.Minute), []*net.IPNet{cIp1, cIp2}, []*net.IPNet{}, []string{"test"})
+	assert.Nil(t, err)
+	v, err := c.Verify(time.Now(), caPool)
+	assert.False(t, v)
+	assert.EqualError(t, err, "certificate contained an ip assignment outside the limitations of the signing ca: fd01::1/64")
+
+	// ip is within the network but mask is outside
+	cIp2 = &net.IPNet{IP: net.ParseIP("fd00::1"), Mask: net.CIDRMask(32, 128)}
+	c, _, _, err = newTestCert(ca, caKey, time.Now(), time.Now().Add(5*time.Minute), []*net.IPNet{cIp1, cIp2}, []*net.IPNet{}, []string{"test"})
+	assert.Nil(t, err)
+	v, err = c.Verify(time.Now(), caPool)
+	assert.False(t, v)
+	assert.EqualError(t, err, "certificate contained an ip assignment outside the limitations of the signing ca: fd00::1/32")
+
+	// ip and mask are within the network, and survive a round trip with the ipv4 network first
+	cIp2 = &net.IPNet{IP: net.ParseIP("fd00::1"), Mask: net.CIDRMask(64, 128)}
+	c, _, _, err = newTestCert(ca, caKey, time.Now(), time.Now().Add(5*time.Minute), []*net.IPNet{cIp2, cIp1}, []*net.IPNet{}, []string{"test"})
+	assert.Nil(t, err)
+	b, err := c.Marshal()
+	assert.Nil(t, err)
+	c, err = UnmarshalNebulaCertificate(b)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"10.0.0.1/24", "fd00::1/64"}, []string{c.Details.Ips[0].String(), c.Details.Ips[1].String()})
+	v, err = c.Verify(time.Now(), caPool)
+	assert.True(t, v)
+	assert.Nil(t, err)
+
+	// an ipv4 only ca can not sign for ipv6 networks
+	ca4, _, caKey4, err := newTestCaCert(time.Now(), time.Now().Add(10*time.Minute), []*net.IPNet{caIp1}, []*net.IPNet{}, []string{"test"})
+	assert.Nil(t, err)
+	assert.Equal(t, Version1, ca4.Version())
+	caPem, err = ca4.MarshalToPEM()
+	assert.Nil(t, err)
+	caPool = NewCAPool()
+	caPool.AddCACertificate(caPem)
+
+	c, _, _, err = newTestCert(ca4, caKey4, time.Now(), time.Now().Add(5*time.Minute), []*net.IPNet{cIp1, cIp2}, []*net.IPNet{}, []string{"test"})
+	assert.Nil(t, err)
+	v, err = c.Verify(time.Now(), caPool)
+	assert.False(t, v)
+	assert.EqualError(t, err, "certificate contained an ip assignment outside the limitations of the signing ca: fd00::1/64")
+}
+
+func TestUnmarshalNebulaCertificate_Version(t *testing.T) {
+	ip6 := net.ParseIP("fd00::1")
+	mask6 := []byte(net.CIDRMask(64, 128))
+	rc := &RawNebulaCertificate{Details: &RawNebulaCertificateDetails{
+		Name:      "test",
+		PublicKey: []byte("1234567890abcedfghij1234567890ab"),
+		Ips6:      [][]byte{ip6, mask6},
+	}}
+
+	b, err := proto.Marshal(rc)
+	require.NoError(t, err)
+	_, err = UnmarshalNebulaCertificate(b)
+	assert.EqualError(t, err, "ipv6 networks are only valid in version 2 certificates, have version 0")
+
+	rc.Details.Version = 3
+	b, err = proto.Marshal(rc)
+	require.NoError(t, err)
+	_, err = UnmarshalNebulaCertificate(b)
+	assert.EqualError(t, err, "unsupported certificate version 3")
+
+	rc.Details.Version = Version2
+	rc.Details.Ips6 = [][]byte{ip6}
+	b, err = proto.Marshal(rc)
+	require.NoError(t, err)
+	_, err = UnmarshalNebulaCertificate(b)
+	assert.EqualError(t, err, "encoded Ips6 should be in pairs, an odd number was found")
+
+	rc.Details.Ips6 = [][]byte{ip6, mask6[:4]}
+	b, err = proto.Marshal(rc)
+	require.NoError(t, err)
+	_, err = UnmarshalNebulaCertificate(b)
+	assert.EqualError(t, err, "encoded Ips6 should be 16 bytes, have 16 and 4")
+
+	rc.Details.Ips6 = [][]byte{ip6, mask6}
+	b, err = proto.Marshal(rc)
+	require.NoError(t, err)
+	nc, err := UnmarshalNebulaCertificate(b)
+	require.NoError(t, err)
+	assert.Equal(t, "fd00::1/64", nc.Details.Ips[0].String())
+}
+
 func TestNebulaCertificate_Verify_Subnets(t *testing.T) {
 	_, caIp1, _ := net.ParseCIDR("10.0.0.0/16")
 	_, caIp2, _ := net.ParseCIDR("192.168.0.0/24")
@@ -1139,7 +1342,7 @@ func newTestCaCertP256(before, after time.Time, ips, subnets []*net.IPNet, group
 }
 
 func newTestCert(ca *NebulaCertificate, key []byte, before, after time.Time, ips, subnets []*net.IPNet, groups []string) (*NebulaCertificate, []byte, []byte, error) {
-	issuer, err := ca.Sha256Sum()
+	issuer, err := ca.Fingerprint()
 	if err != nil {
 		return nil, nil, nil, err
 	}
@@ -1193,6 +1396,7 @@ func newTestCert(ca *NebulaCertificate, key []byte, before, after time.Time, ips
 			PublicKey:      pub,
 			IsCA:           false,
 			Curve:          ca.Details.Curve,
+			Hash:           ca.Details.Hash,
 			Issuer:         issuer,
 			InvertedGroups: make(map[string]struct{}),
 		},
@@ -0,0 +1,162 @@
+package cert
+
+import (
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"encoding/asn1"
+	"fmt"
+	"hash"
+	"math/big"
+)
+
+// SignDeterministic signs the certificate like Sign, except that identical inputs always produce an identical
+// signature, so certificates kept in git only change when their details do. Ed25519 signatures are always
+// deterministic. P256 signatures use an RFC 6979 nonce with nonce mixed in as additional data, changing nonce gives a
+// different but equally reproducible signature.
+//
+// Combined with a fixed NotBefore and NotAfter, the output of MarshalToPEM is byte for byte reproducible.
+func (nc *NebulaCertificate) SignDeterministic(curve Curve, key []byte, nonce []byte) error {
+	if curve != nc.Details.Curve {
+		return fmt.Errorf("curve in cert and private key supplied don't match")
+	}
+
+	b, err := nc.marshalForSigning()
+	if err != nil {
+		return err
+	}
+
+	switch curve {
+	case Curve_CURVE25519:
+		nc.Signature = ed25519.Sign(ed25519.PrivateKey(key), b)
+	case Curve_P256:
+		nc.Signature, err = signP256Deterministic(nc.Details.Hash, key, b, nonce)
+		if err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("invalid curve: %s", curve)
+	}
+
+	return nil
+}
+
+// signP256Deterministic returns an ASN.1 encoded ECDSA signature over the digest of b, the signature verifies with
+// ecdsa.VerifyASN1 the same as one from ecdsa.SignASN1
+func signP256Deterministic(ha HashAlgorithm, key []byte, b []byte, extra []byte) ([]byte, error) {
+	c := elliptic.P256()
+	n := c.Params().N
+
+	d := new(big.Int).SetBytes(key)
+	if d.Sign() <= 0 || d.Cmp(n) >= 0 {
+		return nil, fmt.Errorf("invalid P256 private key")
+	}
+
+	h, err := ha.crypto()
+	if err != nil {
+		return nil, err
+	}
+	if h.Size() < 32 {
+		return nil, fmt.Errorf("hash algorithm %s is too short for P256", ha)
+	}
+
+	hashed, err := ha.Sum(b)
+	if err != nil {
+		return nil, err
+	}
+	e := hashToInt(hashed, n)
+
+	k := newRFC6979(h.New, d, e, n, extra)
+	for {
+		kInv := new(big.Int)
+		kk := k.next()
+		x, _ := c.ScalarBaseMult(kk.FillBytes(make([]byte, 32)))
+
+		r := new(big.Int).Mod(x, n)
+		if r.Sign() == 0 {
+			continue
+		}
+
+		kInv.ModInverse(kk, n)
+		s := new(big.Int).Mul(r, d)
+		s.Add(s, e)
+		s.Mul(s, kInv)
+		s.Mod(s, n)
+		if s.Sign() == 0 {
+			continue
+		}
+
+		return asn1.Marshal(struct{ R, S *big.Int }{r, s})
+	}
+}
+
+// hashToInt is bits2int from RFC 6979 reduced mod n, digests longer than n keep their leftmost bits the same as
+// crypto/ecdsa does
+func hashToInt(h []byte, n *big.Int) *big.Int {
+	if size := (n.BitLen() + 7) / 8; len(h) > size {
+		h = h[:size]
+	}
+	e := new(big.Int).SetBytes(h)
+	return e.Mod(e, n)
+}
+
+// rfc6979 generates ECDSA nonces as described in RFC 6979 section 3.2 using HMAC with the message hash, with the
+// additional data from section 3.6
+type rfc6979 struct {
+	hash func() hash.Hash
+	n    *big.Int
+	k    []byte
+	v    []byte
+	// started is set once the first candidate has been returned, later candidates must first update k and v
+	started bool
+}
+
+func newRFC6979(newHash func() hash.Hash, d, e, n *big.Int, extra []byte) *rfc6979 {
+	size := newHash().Size()
+	g := &rfc6979{
+		hash: newHash,
+		n:    n,
+		k:    make([]byte, size),
+		v:    make([]byte, size),
+	}
+
+	for i := range g.v {
+		g.v[i] = 0x01
+	}
+
+	x := d.FillBytes(make([]byte, 32))
+	h := e.FillBytes(make([]byte, 32))
+
+	g.k = g.mac(g.k, g.v, []byte{0x00}, x, h, extra)
+	g.v = g.mac(g.k, g.v)
+	g.k = g.mac(g.k, g.v, []byte{0x01}, x, h, extra)
+	g.v = g.mac(g.k, g.v)
+	return g
+}
+
+// next returns the next candidate k in [1, n-1]
+func (g *rfc6979) next() *big.Int {
+	for {
+		if g.started {
+			g.k = g.mac(g.k, g.v, []byte{0x00})
+			g.v = g.mac(g.k, g.v)
+		}
+		g.started = true
+
+		g.v = g.mac(g.k, g.v)
+		// P256 needs 256 bits, every supported hash produces at least that many in one round so bits2int is the
+		// leftmost 256 bits of v
+		k := new(big.Int).SetBytes(g.v[:32])
+		if k.Sign() > 0 && k.Cmp(g.n) < 0 {
+			return k
+		}
+	}
+}
+
+func (g *rfc6979) mac(key []byte, parts ...[]byte) []byte {
+	m := hmac.New(g.hash, key)
+	for _, p := range parts {
+		m.Write(p)
+	}
+	return m.Sum(nil)
+}
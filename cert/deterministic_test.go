@@ -0,0 +1,76 @@
+package cert
+
+import (
+	"encoding/asn1"
+	"encoding/hex"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSignP256Deterministic_RFC6979(t *testing.T) {
+	// RFC 6979 A.2.5, P-256 with SHA-256 over "sample"
+	key, _ := hex.DecodeString("c9afa9d845ba75166b5c215767b1d6934e50c3db36e89b127b8a622b120f6721")
+	sig, err := signP256Deterministic(HashAlgorithm_SHA256, key, []byte("sample"), nil)
+	require.NoError(t, err)
+
+	var rs struct{ R, S *big.Int }
+	_, err = asn1.Unmarshal(sig, &rs)
+	require.NoError(t, err)
+	assert.Equal(t, "efd48b2aacb6a8fd1140dd9cd45e81d69d2c877b56aaf991c34d0ea84eaf3716", hex.EncodeToString(rs.R.Bytes()))
+	assert.Equal(t, "f7cb1c942d657c41d436c7a1b6e29f65f3e900dbb9aff4064dc4ab2f843acda8", hex.EncodeToString(rs.S.Bytes()))
+
+	// A.2.5 again with SHA-384, the digest is longer than the curve order so bits2int truncates it
+	sig, err = signP256Deterministic(HashAlgorithm_SHA384, key, []byte("sample"), nil)
+	require.NoError(t, err)
+	_, err = asn1.Unmarshal(sig, &rs)
+	require.NoError(t, err)
+	assert.Equal(t, "0eafea039b20e9b42309fb1d89e213057cbf973dc0cfc8f129edddc800ef7719", hex.EncodeToString(rs.R.FillBytes(make([]byte, 32))))
+
+	_, err = signP256Deterministic(HashAlgorithm_SHA256, make([]byte, 32), []byte("sample"), nil)
+	assert.EqualError(t, err, "invalid P256 private key")
+}
+
+func TestNebulaCertificate_SignDeterministic(t *testing.T) {
+	before := time.Unix(1700000000, 0)
+	after := before.Add(time.Hour)
+
+	for _, tc := range []struct {
+		name  string
+		newCA func(before, after time.Time) (*NebulaCertificate, []byte, []byte, error)
+	}{
+		{"25519", func(b, a time.Time) (*NebulaCertificate, []byte, []byte, error) {
+			return newTestCaCert(b, a, nil, nil, nil)
+		}},
+		{"P256", func(b, a time.Time) (*NebulaCertificate, []byte, []byte, error) {
+			return newTestCaCertP256(b, a, nil, nil, nil)
+		}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ca, _, key, err := tc.newCA(before, after)
+			require.NoError(t, err)
+
+			sign := func(nonce string) []byte {
+				nc := ca.Copy()
+				nc.Details.Name = "host"
+				nc.Details.Curve = ca.Details.Curve
+				require.NoError(t, nc.SignDeterministic(ca.Details.Curve, key, []byte(nonce)))
+				assert.True(t, nc.CheckSignature(ca.Details.PublicKey))
+				b, err := nc.MarshalToPEM()
+				require.NoError(t, err)
+				return b
+			}
+
+			assert.Equal(t, sign("a"), sign("a"))
+			if ca.Details.Curve == Curve_P256 {
+				assert.NotEqual(t, sign("a"), sign("b"))
+			}
+
+			nc := ca.Copy()
+			assert.EqualError(t, nc.SignDeterministic(Curve_P256+1, key, nil), "curve in cert and private key supplied don't match")
+		})
+	}
+}
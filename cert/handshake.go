@@ -0,0 +1,85 @@
+package cert
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+)
+
+var (
+	ErrNoStaticKey       = errors.New("no peer static key was present")
+	ErrEmptyPayload      = errors.New("provided payload was empty")
+	ErrStaticKeyMismatch = errors.New("certificate public key does not match the handshake static key")
+)
+
+// HandshakeCertificate is the result of verifying the certificate a peer presented during a handshake
+type HandshakeCertificate struct {
+	// Certificate is the reassembled peer certificate, including the public key
+	Certificate *NebulaCertificate
+	// Fingerprint is the fingerprint of the reassembled certificate, see NebulaCertificate.Fingerprint
+	Fingerprint string
+	// Signer is the CA certificate from the pool that signed Certificate
+	Signer *NebulaCertificate
+}
+
+// VerifyHandshakeCertificate reassembles a certificate sent during a handshake, where the public key is stripped to
+// save space, with the static key the peer proved possession of in the noise handshake. The result is validated against
+// pool exactly as nebula does for tunnels.
+//
+// If the certificate could be reassembled but failed validation both a result and an error are returned, this allows
+// callers to log details about the rejected certificate.
+func VerifyHandshakeCertificate(payload []byte, staticKey []byte, pool *NebulaCAPool, now time.Time) (*HandshakeCertificate, error) {
+	if len(staticKey) == 0 {
+		return nil, ErrNoStaticKey
+	}
+
+	if len(payload) == 0 {
+		return nil, ErrEmptyPayload
+	}
+
+	rc := &RawNebulaCertificate{}
+	err := proto.Unmarshal(payload, rc)
+	if err != nil {
+		return nil, fmt.Errorf("error unmarshaling cert: %s", err)
+	}
+
+	// If the Details are nil, just exit to avoid crashing
+	if rc.Details == nil {
+		return nil, fmt.Errorf("certificate did not contain any details")
+	}
+
+	// A payload that still carries a public key must be bound to the key used in the handshake
+	if len(rc.Details.PublicKey) > 0 && !bytes.Equal(rc.Details.PublicKey, staticKey) {
+		return nil, ErrStaticKeyMismatch
+	}
+	rc.Details.PublicKey = staticKey
+
+	nc, err := unmarshalRawNebulaCertificate(rc)
+	if err != nil {
+		return nil, fmt.Errorf("error while recombining certificate: %s", err)
+	}
+
+	fp, err := nc.Fingerprint()
+	if err != nil {
+		return nil, err
+	}
+
+	hc := &HandshakeCertificate{Certificate: nc, Fingerprint: fp}
+	isValid, err := nc.Verify(now, pool)
+	if err != nil {
+		return hc, fmt.Errorf("certificate validation failed: %w", err)
+	} else if !isValid {
+		// This case should never happen but here's to defensive programming!
+		return hc, errors.New("certificate validation failed but did not return an error")
+	}
+
+	hc.Signer, err = pool.GetCAForCert(nc)
+	if err != nil {
+		return hc, err
+	}
+
+	return hc, nil
+}
@@ -0,0 +1,100 @@
+package cert
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVerifyHandshakeCertificate(t *testing.T) {
+	ca, _, caKey, err := newTestCaCert(time.Now().Add(-time.Hour), time.Now().Add(time.Hour), nil, nil, nil)
+	require.NoError(t, err)
+	c, pub, _, err := newTestCert(ca, caKey, time.Time{}, time.Time{}, nil, nil, nil)
+	require.NoError(t, err)
+
+	caPem, err := ca.MarshalToPEM()
+	require.NoError(t, err)
+	pool, err := NewCAPoolFromBytes(caPem)
+	require.NoError(t, err)
+
+	// Strip the public key the same way nebula does before sending
+	payload, err := c.MarshalForHandshakes()
+	require.NoError(t, err)
+
+	hc, err := VerifyHandshakeCertificate(payload, pub, pool, time.Now())
+	require.NoError(t, err)
+	expectedFp, err := c.Sha256Sum()
+	require.NoError(t, err)
+	assert.Equal(t, expectedFp, hc.Fingerprint)
+	assert.Equal(t, pub, hc.Certificate.Details.PublicKey)
+	assert.Equal(t, ca.Details.Name, hc.Signer.Details.Name)
+
+	// A payload carrying the public key must match the static key
+	full, err := c.Marshal()
+	require.NoError(t, err)
+	_, err = VerifyHandshakeCertificate(full, pub, pool, time.Now())
+	assert.NoError(t, err)
+
+	otherPub, _ := x25519Keypair()
+	_, err = VerifyHandshakeCertificate(full, otherPub, pool, time.Now())
+	assert.ErrorIs(t, err, ErrStaticKeyMismatch)
+
+	// Binding the wrong static key to a stripped cert breaks the signature, the cert is still returned
+	hc, err = VerifyHandshakeCertificate(payload, otherPub, pool, time.Now())
+	assert.ErrorIs(t, err, ErrSignatureMismatch)
+	require.NotNil(t, hc)
+	assert.Equal(t, c.Details.Name, hc.Certificate.Details.Name)
+
+	// Expired
+	_, err = VerifyHandshakeCertificate(payload, pub, pool, time.Now().Add(2*time.Hour))
+	assert.ErrorIs(t, err, ErrRootExpired)
+
+	_, err = VerifyHandshakeCertificate(payload, nil, pool, time.Now())
+	assert.ErrorIs(t, err, ErrNoStaticKey)
+
+	_, err = VerifyHandshakeCertificate(nil, pub, pool, time.Now())
+	assert.ErrorIs(t, err, ErrEmptyPayload)
+}
+
+func TestNebulaCertificate_MarshalForHandshakes(t *testing.T) {
+	ca, _, caKey, err := newTestCaCert(time.Now().Add(-time.Hour), time.Now().Add(time.Hour), nil, nil, nil)
+	require.NoError(t, err)
+	c, pub, _, err := newTestCert(ca, caKey, time.Time{}, time.Time{}, nil, nil, nil)
+	require.NoError(t, err)
+
+	// Matches the encoding of a copy with the public key removed
+	stripped := c.Copy()
+	stripped.Details.PublicKey = nil
+	expected, err := stripped.Marshal()
+	require.NoError(t, err)
+
+	b, err := c.MarshalForHandshakes()
+	require.NoError(t, err)
+	assert.Equal(t, expected, b)
+	assert.Equal(t, pub, c.Details.PublicKey)
+
+	// The handshake path marshals the same cert from many goroutines, run with -race to catch any mutation
+	full, err := c.Marshal()
+	require.NoError(t, err)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				b, err := c.MarshalForHandshakes()
+				assert.NoError(t, err)
+				assert.Equal(t, expected, b)
+
+				b, err = c.Marshal()
+				assert.NoError(t, err)
+				assert.Equal(t, full, b)
+			}
+		}()
+	}
+	wg.Wait()
+}
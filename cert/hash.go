@@ -0,0 +1,83 @@
+package cert
+
+import (
+	"crypto"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"strings"
+	"sync"
+)
+
+var (
+	hashAlgorithmsLock sync.RWMutex
+	hashAlgorithms     = map[HashAlgorithm]crypto.Hash{
+		HashAlgorithm_SHA256: crypto.SHA256,
+		HashAlgorithm_SHA384: crypto.SHA384,
+	}
+)
+
+// RegisterHashAlgorithm maps a HashAlgorithm value to the hash that implements it, replacing any existing mapping.
+// SHA256 and SHA384 are built in, this exists so a new value in cert.proto only needs a registration to be usable for
+// fingerprints and signatures. The hash must be linked into the binary, see crypto.Hash.Available.
+func RegisterHashAlgorithm(a HashAlgorithm, h crypto.Hash) {
+	hashAlgorithmsLock.Lock()
+	hashAlgorithms[a] = h
+	hashAlgorithmsLock.Unlock()
+}
+
+// ParseHashAlgorithm returns the registered HashAlgorithm with the name s, ie sha256 or sha384
+func ParseHashAlgorithm(s string) (HashAlgorithm, error) {
+	v, ok := HashAlgorithm_value[strings.ToUpper(s)]
+	if ok {
+		a := HashAlgorithm(v)
+		if _, err := a.crypto(); err == nil {
+			return a, nil
+		}
+	}
+
+	return 0, fmt.Errorf("unsupported hash algorithm: %s", s)
+}
+
+// crypto returns the hash registered for a
+func (a HashAlgorithm) crypto() (crypto.Hash, error) {
+	hashAlgorithmsLock.RLock()
+	h, ok := hashAlgorithms[a]
+	hashAlgorithmsLock.RUnlock()
+
+	if !ok || !h.Available() {
+		return 0, fmt.Errorf("unsupported hash algorithm: %s", a)
+	}
+
+	return h, nil
+}
+
+// New returns a new hash.Hash for the algorithm
+func (a HashAlgorithm) New() (hash.Hash, error) {
+	h, err := a.crypto()
+	if err != nil {
+		return nil, err
+	}
+	return h.New(), nil
+}
+
+// Sum returns the digest of b
+func (a HashAlgorithm) Sum(b []byte) ([]byte, error) {
+	h, err := a.New()
+	if err != nil {
+		return nil, err
+	}
+	h.Write(b)
+	return h.Sum(nil), nil
+}
+
+// hexSum returns the hex encoded digest of b, this is the form fingerprints take
+func (a HashAlgorithm) hexSum(b []byte) (string, error) {
+	sum, err := a.Sum(b)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(sum), nil
+}
@@ -0,0 +1,45 @@
+package cert
+
+import (
+	"crypto"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseHashAlgorithm(t *testing.T) {
+	a, err := ParseHashAlgorithm("sha256")
+	require.NoError(t, err)
+	assert.Equal(t, HashAlgorithm_SHA256, a)
+
+	a, err = ParseHashAlgorithm("SHA384")
+	require.NoError(t, err)
+	assert.Equal(t, HashAlgorithm_SHA384, a)
+
+	_, err = ParseHashAlgorithm("md5")
+	assert.EqualError(t, err, "unsupported hash algorithm: md5")
+}
+
+func TestRegisterHashAlgorithm(t *testing.T) {
+	defer RegisterHashAlgorithm(HashAlgorithm_SHA384, crypto.SHA384)
+
+	sum, err := HashAlgorithm_SHA384.Sum([]byte("nebula"))
+	require.NoError(t, err)
+	assert.Len(t, sum, 48)
+
+	RegisterHashAlgorithm(HashAlgorithm_SHA384, crypto.SHA512)
+	sum, err = HashAlgorithm_SHA384.Sum([]byte("nebula"))
+	require.NoError(t, err)
+	assert.Len(t, sum, 64)
+
+	// Hashes that are not linked in can't be used
+	RegisterHashAlgorithm(HashAlgorithm_SHA384, crypto.MD5SHA1)
+	_, err = HashAlgorithm_SHA384.Sum([]byte("nebula"))
+	assert.EqualError(t, err, "unsupported hash algorithm: SHA384")
+	_, err = ParseHashAlgorithm("sha384")
+	assert.EqualError(t, err, "unsupported hash algorithm: sha384")
+
+	_, err = HashAlgorithm(99).New()
+	assert.EqualError(t, err, "unsupported hash algorithm: 99")
+}
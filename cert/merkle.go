@@ -0,0 +1,181 @@
+package cert
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"math/bits"
+)
+
+// The transparency log is a merkle tree as described in RFC 9162, leaves are certificates encoded as they are for
+// fingerprints, without an inclusion proof.
+
+var errInvalidMerkleProof = errors.New("invalid merkle proof")
+
+func merkleLeafHash(b []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte{0})
+	h.Write(b)
+	return h.Sum(nil)
+}
+
+func merkleNodeHash(l, r []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte{1})
+	h.Write(l)
+	h.Write(r)
+	return h.Sum(nil)
+}
+
+// merkleSplit returns the largest power of 2 smaller than n, n must be greater than 1
+func merkleSplit(n uint64) uint64 {
+	return 1 << (bits.Len64(n-1) - 1)
+}
+
+// merkleRoot returns the root hash of the tree with the provided leaf hashes
+func merkleRoot(leaves [][]byte) []byte {
+	switch len(leaves) {
+	case 0:
+		return merkleEmptyRoot()
+	case 1:
+		return leaves[0]
+	}
+
+	k := merkleSplit(uint64(len(leaves)))
+	return merkleNodeHash(merkleRoot(leaves[:k]), merkleRoot(leaves[k:]))
+}
+
+func merkleEmptyRoot() []byte {
+	sum := sha256.Sum256(nil)
+	return sum[:]
+}
+
+// merkleInclusionPath returns the audit path for the leaf at index m in the tree made from leaves
+func merkleInclusionPath(m uint64, leaves [][]byte) [][]byte {
+	n := uint64(len(leaves))
+	if n <= 1 {
+		return nil
+	}
+
+	k := merkleSplit(n)
+	if m < k {
+		return append(merkleInclusionPath(m, leaves[:k]), merkleRoot(leaves[k:]))
+	}
+	return append(merkleInclusionPath(m-k, leaves[k:]), merkleRoot(leaves[:k]))
+}
+
+// merkleConsistencyPath returns the proof that the tree of the first m leaves is a prefix of the tree made from leaves
+func merkleConsistencyPath(m uint64, leaves [][]byte) [][]byte {
+	if m == 0 || m >= uint64(len(leaves)) {
+		return nil
+	}
+	return merkleSubproof(m, leaves, true)
+}
+
+func merkleSubproof(m uint64, leaves [][]byte, complete bool) [][]byte {
+	n := uint64(len(leaves))
+	if m == n {
+		if complete {
+			return nil
+		}
+		return [][]byte{merkleRoot(leaves)}
+	}
+
+	k := merkleSplit(n)
+	if m <= k {
+		return append(merkleSubproof(m, leaves[:k], complete), merkleRoot(leaves[k:]))
+	}
+	return append(merkleSubproof(m-k, leaves[k:], false), merkleRoot(leaves[:k]))
+}
+
+// merkleRootFromInclusionPath returns the root hash the audit path for the leaf at index leads to in a tree of size
+func merkleRootFromInclusionPath(index, size uint64, leaf []byte, path [][]byte) ([]byte, error) {
+	if index >= size {
+		return nil, errInvalidMerkleProof
+	}
+
+	fn, sn := index, size-1
+	r := leaf
+	for _, p := range path {
+		if sn == 0 {
+			return nil, errInvalidMerkleProof
+		}
+
+		if fn&1 == 1 || fn == sn {
+			r = merkleNodeHash(p, r)
+			for fn&1 == 0 && fn != 0 {
+				fn >>= 1
+				sn >>= 1
+			}
+		} else {
+			r = merkleNodeHash(r, p)
+		}
+		fn >>= 1
+		sn >>= 1
+	}
+
+	if sn != 0 {
+		return nil, errInvalidMerkleProof
+	}
+
+	return r, nil
+}
+
+// verifyMerkleConsistency checks that the tree of size first with root firstRoot is a prefix of the tree of size
+// second with root secondRoot
+func verifyMerkleConsistency(first, second uint64, firstRoot, secondRoot []byte, path [][]byte) error {
+	switch {
+	case first > second:
+		return errInvalidMerkleProof
+	case first == second:
+		if len(path) != 0 || !bytes.Equal(firstRoot, secondRoot) {
+			return errInvalidMerkleProof
+		}
+		return nil
+	case first == 0:
+		// Every tree extends the empty tree
+		if len(path) != 0 {
+			return errInvalidMerkleProof
+		}
+		return nil
+	}
+
+	if first&(first-1) == 0 {
+		path = append([][]byte{firstRoot}, path...)
+	}
+	if len(path) == 0 {
+		return errInvalidMerkleProof
+	}
+
+	fn, sn := first-1, second-1
+	for fn&1 == 1 {
+		fn >>= 1
+		sn >>= 1
+	}
+
+	fr, sr := path[0], path[0]
+	for _, c := range path[1:] {
+		if sn == 0 {
+			return errInvalidMerkleProof
+		}
+
+		if fn&1 == 1 || fn == sn {
+			fr = merkleNodeHash(c, fr)
+			sr = merkleNodeHash(c, sr)
+			for fn&1 == 0 && fn != 0 {
+				fn >>= 1
+				sn >>= 1
+			}
+		} else {
+			sr = merkleNodeHash(sr, c)
+		}
+		fn >>= 1
+		sn >>= 1
+	}
+
+	if sn != 0 || !bytes.Equal(fr, firstRoot) || !bytes.Equal(sr, secondRoot) {
+		return errInvalidMerkleProof
+	}
+
+	return nil
+}
@@ -0,0 +1,75 @@
+package cert
+
+import (
+	"encoding/hex"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testMerkleLeaves(n int) [][]byte {
+	leaves := make([][]byte, n)
+	for i := range leaves {
+		leaves[i] = merkleLeafHash([]byte(fmt.Sprintf("leaf %d", i)))
+	}
+	return leaves
+}
+
+func TestMerkleRoot(t *testing.T) {
+	// The empty tree and single leaf roots from RFC 9162
+	assert.Equal(t, "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855", hex.EncodeToString(merkleRoot(nil)))
+	assert.Equal(t, "6e340b9cffb37a989ca544e6bb780a2c78901d3fb33738768511a30617afa01d", hex.EncodeToString(merkleLeafHash([]byte{})))
+
+	leaves := testMerkleLeaves(3)
+	assert.Equal(t, merkleNodeHash(merkleNodeHash(leaves[0], leaves[1]), leaves[2]), merkleRoot(leaves))
+}
+
+func TestMerkleInclusion(t *testing.T) {
+	all := testMerkleLeaves(33)
+	for n := 1; n <= len(all); n++ {
+		leaves := all[:n]
+		root := merkleRoot(leaves)
+		for i := 0; i < n; i++ {
+			path := merkleInclusionPath(uint64(i), leaves)
+			r, err := merkleRootFromInclusionPath(uint64(i), uint64(n), leaves[i], path)
+			require.NoError(t, err, "size %d index %d", n, i)
+			assert.Equal(t, root, r, "size %d index %d", n, i)
+
+			// The wrong index fails or leads elsewhere
+			if n > 1 {
+				r, err = merkleRootFromInclusionPath(uint64((i+1)%n), uint64(n), leaves[i], path)
+				if err == nil {
+					assert.NotEqual(t, root, r)
+				}
+			}
+		}
+	}
+
+	_, err := merkleRootFromInclusionPath(1, 1, all[0], nil)
+	assert.Equal(t, errInvalidMerkleProof, err)
+	_, err = merkleRootFromInclusionPath(0, 2, all[0], nil)
+	assert.Equal(t, errInvalidMerkleProof, err)
+}
+
+func TestMerkleConsistency(t *testing.T) {
+	all := testMerkleLeaves(33)
+	for n := 1; n <= len(all); n++ {
+		root := merkleRoot(all[:n])
+		for m := 0; m <= n; m++ {
+			path := merkleConsistencyPath(uint64(m), all[:n])
+			assert.NoError(t, verifyMerkleConsistency(uint64(m), uint64(n), merkleRoot(all[:m]), root, path), "%d to %d", m, n)
+
+			if m > 0 && m < n {
+				// A different history is caught
+				other := append([][]byte{}, all[:n]...)
+				other[m-1] = merkleLeafHash([]byte("rewritten"))
+				assert.Error(t, verifyMerkleConsistency(uint64(m), uint64(n), merkleRoot(other[:m]), root, path), "%d to %d", m, n)
+			}
+		}
+	}
+
+	assert.Error(t, verifyMerkleConsistency(2, 1, nil, nil, nil))
+	assert.Error(t, verifyMerkleConsistency(3, 4, merkleRoot(all[:3]), merkleRoot(all[:4]), nil))
+}
@@ -0,0 +1,160 @@
+package cert
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+)
+
+// ProvisioningBundleMagic prefixes every provisioning bundle so it can be distinguished from PEM or other payloads
+var ProvisioningBundleMagic = []byte("NEBB")
+
+const provisioningBundleVersion = 1
+
+// ProvisioningBundle holds everything a node needs to join a network in a single compact blob, intended to be handed
+// to mobile clients via a qr code.
+//
+// The binary format is:
+//
+//	magic        4 bytes, "NEBB"
+//	version      1 byte, currently 1
+//	certificate  uvarint length followed by the protobuf encoded host certificate
+//	private key  uvarint length followed by the raw private key bytes, the curve is taken from the certificate
+//	ca count     uvarint number of ca certificates that follow
+//	ca           uvarint length followed by the protobuf encoded ca certificate, repeated ca count times
+//
+// When embedded in a qr code the bundle is base64 encoded with the standard alphabet and padding.
+type ProvisioningBundle struct {
+	Certificate *NebulaCertificate
+	PrivateKey  []byte
+	CAs         []*NebulaCertificate
+}
+
+// MarshalProvisioningBundle encodes the bundle into its compact binary form
+func MarshalProvisioningBundle(pb *ProvisioningBundle) ([]byte, error) {
+	if pb.Certificate == nil {
+		return nil, fmt.Errorf("provisioning bundle is missing a certificate")
+	}
+
+	if len(pb.PrivateKey) == 0 {
+		return nil, fmt.Errorf("provisioning bundle is missing a private key")
+	}
+
+	if err := pb.Certificate.VerifyPrivateKey(pb.Certificate.Details.Curve, pb.PrivateKey); err != nil {
+		return nil, fmt.Errorf("provisioning bundle private key does not match the certificate: %w", err)
+	}
+
+	cb, err := pb.Certificate.Marshal()
+	if err != nil {
+		return nil, fmt.Errorf("error while marshalling certificate: %w", err)
+	}
+
+	b := append([]byte{}, ProvisioningBundleMagic...)
+	b = append(b, provisioningBundleVersion)
+	b = appendBundleField(b, cb)
+	b = appendBundleField(b, pb.PrivateKey)
+	b = binary.AppendUvarint(b, uint64(len(pb.CAs)))
+
+	for _, ca := range pb.CAs {
+		cab, err := ca.Marshal()
+		if err != nil {
+			return nil, fmt.Errorf("error while marshalling ca certificate: %w", err)
+		}
+		b = appendBundleField(b, cab)
+	}
+
+	return b, nil
+}
+
+// UnmarshalProvisioningBundle decodes a bundle produced by MarshalProvisioningBundle. The private key is checked
+// against the certificate but the certificate is not verified against the included CAs.
+func UnmarshalProvisioningBundle(b []byte) (*ProvisioningBundle, error) {
+	if !bytes.HasPrefix(b, ProvisioningBundleMagic) {
+		return nil, fmt.Errorf("input is not a provisioning bundle")
+	}
+	b = b[len(ProvisioningBundleMagic):]
+
+	if len(b) == 0 {
+		return nil, fmt.Errorf("provisioning bundle is truncated")
+	}
+
+	if b[0] != provisioningBundleVersion {
+		return nil, fmt.Errorf("unsupported provisioning bundle version: %d", b[0])
+	}
+	b = b[1:]
+
+	cb, b, err := readBundleField(b, "certificate")
+	if err != nil {
+		return nil, err
+	}
+
+	nc, err := UnmarshalNebulaCertificate(cb)
+	if err != nil {
+		return nil, fmt.Errorf("error while unmarshaling certificate: %w", err)
+	}
+
+	key, b, err := readBundleField(b, "private key")
+	if err != nil {
+		return nil, err
+	}
+
+	if err := nc.VerifyPrivateKey(nc.Details.Curve, key); err != nil {
+		return nil, fmt.Errorf("provisioning bundle private key does not match the certificate: %w", err)
+	}
+
+	count, n := binary.Uvarint(b)
+	if n <= 0 {
+		return nil, fmt.Errorf("provisioning bundle has an invalid ca count")
+	}
+	b = b[n:]
+
+	// Every ca takes at least 2 bytes, guard against a huge count allocating before we fail
+	if count > uint64(len(b)/2) {
+		return nil, fmt.Errorf("provisioning bundle ca count %d exceeds the remaining data", count)
+	}
+
+	pb := &ProvisioningBundle{
+		Certificate: nc,
+		PrivateKey:  key,
+		CAs:         make([]*NebulaCertificate, 0, count),
+	}
+
+	for i := uint64(0); i < count; i++ {
+		var cab []byte
+		cab, b, err = readBundleField(b, "ca certificate")
+		if err != nil {
+			return nil, err
+		}
+
+		ca, err := UnmarshalNebulaCertificate(cab)
+		if err != nil {
+			return nil, fmt.Errorf("error while unmarshaling ca certificate %d: %w", i, err)
+		}
+		pb.CAs = append(pb.CAs, ca)
+	}
+
+	if len(b) != 0 {
+		return nil, fmt.Errorf("provisioning bundle has %d bytes of trailing data", len(b))
+	}
+
+	return pb, nil
+}
+
+func appendBundleField(b, f []byte) []byte {
+	b = binary.AppendUvarint(b, uint64(len(f)))
+	return append(b, f...)
+}
+
+func readBundleField(b []byte, name string) ([]byte, []byte, error) {
+	l, n := binary.Uvarint(b)
+	if n <= 0 {
+		return nil, nil, fmt.Errorf("provisioning bundle has an invalid %s length", name)
+	}
+	b = b[n:]
+
+	if l > uint64(len(b)) {
+		return nil, nil, fmt.Errorf("provisioning bundle %s is truncated", name)
+	}
+
+	return b[:l], b[l:], nil
+}
@@ -0,0 +1,53 @@
+package cert
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProvisioningBundle(t *testing.T) {
+	ca, _, caKey, err := newTestCaCert(time.Time{}, time.Time{}, nil, nil, nil)
+	assert.Nil(t, err)
+
+	nc, _, priv, err := newTestCert(ca, caKey, time.Time{}, time.Time{}, nil, nil, nil)
+	assert.Nil(t, err)
+
+	b, err := MarshalProvisioningBundle(&ProvisioningBundle{Certificate: nc, PrivateKey: priv, CAs: []*NebulaCertificate{ca}})
+	assert.Nil(t, err)
+	assert.Equal(t, ProvisioningBundleMagic, b[:4])
+
+	pb, err := UnmarshalProvisioningBundle(b)
+	assert.Nil(t, err)
+	assert.Equal(t, priv, pb.PrivateKey)
+	assert.Len(t, pb.CAs, 1)
+
+	ncb, _ := nc.Marshal()
+	pbcb, _ := pb.Certificate.Marshal()
+	assert.Equal(t, ncb, pbcb)
+
+	cab, _ := ca.Marshal()
+	pbcab, _ := pb.CAs[0].Marshal()
+	assert.Equal(t, cab, pbcab)
+
+	// Mismatched key
+	_, otherPriv := x25519Keypair()
+	_, err = MarshalProvisioningBundle(&ProvisioningBundle{Certificate: nc, PrivateKey: otherPriv})
+	assert.ErrorContains(t, err, "provisioning bundle private key does not match the certificate")
+
+	// Bad inputs
+	_, err = UnmarshalProvisioningBundle([]byte("-----BEGIN NEBULA CERTIFICATE-----"))
+	assert.EqualError(t, err, "input is not a provisioning bundle")
+
+	bad := append([]byte{}, b...)
+	bad[4] = 2
+	_, err = UnmarshalProvisioningBundle(bad)
+	assert.EqualError(t, err, "unsupported provisioning bundle version: 2")
+
+	_, err = UnmarshalProvisioningBundle(b[:len(b)-1])
+	assert.EqualError(t, err, "provisioning bundle ca certificate is truncated")
+
+	_, err = UnmarshalProvisioningBundle(append(b, 0))
+	assert.EqualError(t, err, "provisioning bundle has 1 bytes of trailing data")
+}
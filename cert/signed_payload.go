@@ -0,0 +1,150 @@
+package cert
+
+import (
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+const SignedPayloadBanner = "NEBULA SIGNED PAYLOAD"
+
+var (
+	ErrPayloadSignatureMismatch = errors.New("payload signature did not match")
+	ErrPayloadExpired           = errors.New("signed payload is expired")
+)
+
+// SignedPayload is arbitrary data signed by a CA so that it can be distributed over untrusted channels, like the ca
+// bundle and blocklist a node polls from pki.ca_url and pki.blocklist_url.
+//
+// It is encoded as a PEM block with the payload as the body and the Issuer, Timestamp, NotAfter, and Signature as
+// headers. The signature covers the banner, issuer, unix timestamp, unix not after and payload, each separated by a
+// newline, so a payload can not be replayed with a different issuer, timestamp or lifetime. Consumers should refuse
+// payloads older than the last they accepted to avoid being rolled back to a stale blocklist, NotAfter bounds how long
+// a payload can be served after it was replaced.
+type SignedPayload struct {
+	// Issuer is the fingerprint of the CA that signed the payload
+	Issuer    string
+	Timestamp time.Time
+	NotAfter  time.Time
+	Payload   []byte
+	Signature []byte
+}
+
+// SignPayload signs payload with the ca key, the curve is taken from the ca certificate
+func SignPayload(ca *NebulaCertificate, key []byte, payload []byte, timestamp, notAfter time.Time) (*SignedPayload, error) {
+	if !ca.Details.IsCA {
+		return nil, ErrNotCA
+	}
+
+	issuer, err := ca.Fingerprint()
+	if err != nil {
+		return nil, fmt.Errorf("error while getting ca fingerprint: %w", err)
+	}
+
+	if !notAfter.After(timestamp) {
+		return nil, fmt.Errorf("not after must be after the timestamp")
+	}
+
+	sp := &SignedPayload{
+		Issuer:    issuer,
+		Timestamp: time.Unix(timestamp.Unix(), 0),
+		NotAfter:  time.Unix(notAfter.Unix(), 0),
+		Payload:   payload,
+	}
+
+	sp.Signature, err = signBytes(ca.Details.Curve, ca.Details.Hash, key, sp.signedBytes())
+	if err != nil {
+		return nil, err
+	}
+
+	return sp, nil
+}
+
+// MarshalToPEM encodes the signed payload as a PEM block
+func (sp *SignedPayload) MarshalToPEM() []byte {
+	return pem.EncodeToMemory(&pem.Block{
+		Type: SignedPayloadBanner,
+		Headers: map[string]string{
+			"Issuer":    sp.Issuer,
+			"Timestamp": strconv.FormatInt(sp.Timestamp.Unix(), 10),
+			"NotAfter":  strconv.FormatInt(sp.NotAfter.Unix(), 10),
+			"Signature": base64.StdEncoding.EncodeToString(sp.Signature),
+		},
+		Bytes: sp.Payload,
+	})
+}
+
+// UnmarshalSignedPayloadFromPEM decodes a signed payload, the signature is not checked. Any remaining bytes are
+// returned.
+func UnmarshalSignedPayloadFromPEM(b []byte) (*SignedPayload, []byte, error) {
+	p, r := pem.Decode(b)
+	if p == nil {
+		return nil, r, fmt.Errorf("input did not contain a valid PEM encoded block")
+	}
+
+	if p.Type != SignedPayloadBanner {
+		return nil, r, fmt.Errorf("bytes did not contain a proper nebula signed payload banner")
+	}
+
+	ts, err := strconv.ParseInt(p.Headers["Timestamp"], 10, 64)
+	if err != nil {
+		return nil, r, fmt.Errorf("signed payload has an invalid timestamp: %w", err)
+	}
+
+	notAfter, err := strconv.ParseInt(p.Headers["NotAfter"], 10, 64)
+	if err != nil {
+		return nil, r, fmt.Errorf("signed payload has an invalid not after: %w", err)
+	}
+
+	sig, err := base64.StdEncoding.DecodeString(p.Headers["Signature"])
+	if err != nil {
+		return nil, r, fmt.Errorf("signed payload has an invalid signature: %w", err)
+	}
+
+	if p.Headers["Issuer"] == "" {
+		return nil, r, fmt.Errorf("signed payload has no issuer")
+	}
+
+	return &SignedPayload{
+		Issuer:    p.Headers["Issuer"],
+		Timestamp: time.Unix(ts, 0),
+		NotAfter:  time.Unix(notAfter, 0),
+		Payload:   p.Bytes,
+		Signature: sig,
+	}, r, nil
+}
+
+func (sp *SignedPayload) signedBytes() []byte {
+	b := []byte(SignedPayloadBanner + "\n" + sp.Issuer + "\n" + strconv.FormatInt(sp.Timestamp.Unix(), 10) + "\n" +
+		strconv.FormatInt(sp.NotAfter.Unix(), 10) + "\n")
+	return append(b, sp.Payload...)
+}
+
+// VerifySignedPayload checks that the payload was signed by a CA in the pool and that both are valid at t
+func (ncp *NebulaCAPool) VerifySignedPayload(t time.Time, sp *SignedPayload) error {
+	signer, ok := ncp.CAs[sp.Issuer]
+	if !ok {
+		return fmt.Errorf("could not find ca for the signed payload")
+	}
+
+	if signer.Expired(t) {
+		return ErrRootExpired
+	}
+
+	if ncp.IsBlocklisted(signer) {
+		return ErrBlockListed
+	}
+
+	if !checkBytesSignature(signer.Details.Curve, signer.Details.Hash, signer.Details.PublicKey, sp.signedBytes(), sp.Signature) {
+		return ErrPayloadSignatureMismatch
+	}
+
+	if t.After(sp.NotAfter) {
+		return ErrPayloadExpired
+	}
+
+	return nil
+}
@@ -0,0 +1,69 @@
+package cert
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSignedPayload(t *testing.T) {
+	for _, newCA := range []func(before, after time.Time) (*NebulaCertificate, []byte, error){
+		func(before, after time.Time) (*NebulaCertificate, []byte, error) {
+			ca, _, key, err := newTestCaCert(before, after, nil, nil, nil)
+			return ca, key, err
+		},
+		func(before, after time.Time) (*NebulaCertificate, []byte, error) {
+			ca, _, key, err := newTestCaCertP256(before, after, nil, nil, nil)
+			return ca, key, err
+		},
+	} {
+		ca, key, err := newCA(time.Time{}, time.Time{})
+		require.NoError(t, err)
+		caPEM, err := ca.MarshalToPEM()
+		require.NoError(t, err)
+		pool, err := NewCAPoolFromBytes(caPEM)
+		require.NoError(t, err)
+
+		now := time.Now()
+		sp, err := SignPayload(ca, key, []byte("hello"), now, now.Add(time.Second*10))
+		require.NoError(t, err)
+
+		b := append(sp.MarshalToPEM(), []byte("rest")...)
+		sp2, rest, err := UnmarshalSignedPayloadFromPEM(b)
+		require.NoError(t, err)
+		assert.Equal(t, []byte("rest"), rest)
+		assert.Equal(t, sp, sp2)
+		assert.Equal(t, now.Unix(), sp2.Timestamp.Unix())
+		assert.Equal(t, now.Add(time.Second*10).Unix(), sp2.NotAfter.Unix())
+		assert.NoError(t, pool.VerifySignedPayload(now, sp2))
+
+		// Changing any signed field breaks the signature
+		sp2.Payload = []byte("goodbye")
+		assert.ErrorIs(t, pool.VerifySignedPayload(now, sp2), ErrPayloadSignatureMismatch)
+		sp2.Payload = sp.Payload
+		sp2.Timestamp = sp.Timestamp.Add(time.Second)
+		assert.ErrorIs(t, pool.VerifySignedPayload(now, sp2), ErrPayloadSignatureMismatch)
+		sp2.Timestamp = sp.Timestamp
+		sp2.NotAfter = sp.NotAfter.Add(time.Hour)
+		assert.ErrorIs(t, pool.VerifySignedPayload(now, sp2), ErrPayloadSignatureMismatch)
+
+		// Payloads are refused once they expire
+		assert.ErrorIs(t, pool.VerifySignedPayload(now.Add(time.Second*30), sp), ErrPayloadExpired)
+		_, err = SignPayload(ca, key, []byte("hello"), now, now)
+		assert.EqualError(t, err, "not after must be after the timestamp")
+
+		// Unknown, expired and blocklisted signers are refused
+		assert.EqualError(t, NewCAPool().VerifySignedPayload(now, sp), "could not find ca for the signed payload")
+		assert.ErrorIs(t, pool.VerifySignedPayload(now.Add(time.Hour*24*365*100), sp), ErrRootExpired)
+		pool.BlocklistFingerprint(sp.Issuer)
+		assert.ErrorIs(t, pool.VerifySignedPayload(now, sp), ErrBlockListed)
+	}
+
+	nc, _, _, err := newTestCaCert(time.Time{}, time.Time{}, nil, nil, nil)
+	require.NoError(t, err)
+	ncPEM, _ := nc.MarshalToPEM()
+	_, _, err = UnmarshalSignedPayloadFromPEM(ncPEM)
+	assert.EqualError(t, err, "bytes did not contain a proper nebula signed payload banner")
+}
@@ -0,0 +1,208 @@
+package cert
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// StoreItem names one of the PEM encoded items a node needs
+type StoreItem string
+
+const (
+	StoreItemCA   StoreItem = "ca"
+	StoreItemCert StoreItem = "cert"
+	StoreItemKey  StoreItem = "key"
+)
+
+var ErrStoreItemNotFound = errors.New("item not found in store")
+
+// maxStoreItemSize bounds what is read for a single item, a large ca bundle is still well under this
+const maxStoreItemSize = 4 * 1024 * 1024
+
+// Store is where a node's certificate, private key, and ca bundle live. Get returns the PEM encoded item or
+// ErrStoreItemNotFound. Stores for secrets managers can be plugged in with RegisterStoreScheme.
+type Store interface {
+	Get(ctx context.Context, item StoreItem) ([]byte, error)
+}
+
+// StoreOpener builds a Store from the url given in config
+type StoreOpener func(u *url.URL) (Store, error)
+
+var (
+	storeSchemesLock sync.RWMutex
+	storeSchemes     = map[string]StoreOpener{
+		"file":  openFileStore,
+		"http":  openHTTPStore,
+		"https": openHTTPStore,
+	}
+)
+
+// RegisterStoreScheme makes a store available to OpenStore for urls with the scheme, replacing any existing one
+func RegisterStoreScheme(scheme string, opener StoreOpener) {
+	storeSchemesLock.Lock()
+	storeSchemes[strings.ToLower(scheme)] = opener
+	storeSchemesLock.Unlock()
+}
+
+// OpenStore returns a store for the url. file:///etc/nebula reads ca.crt, host.crt, and host.key from the directory
+// and http(s)://host/path requests path/ca, path/cert, and path/key.
+func OpenStore(rawURL string) (Store, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid store url: %w", err)
+	}
+
+	storeSchemesLock.RLock()
+	opener, ok := storeSchemes[strings.ToLower(u.Scheme)]
+	storeSchemesLock.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown store scheme: %s", u.Scheme)
+	}
+
+	return opener(u)
+}
+
+// FileStore reads each item from a file path
+type FileStore struct {
+	Paths map[StoreItem]string
+}
+
+// NewFileStore returns a store for ca.crt, host.crt, and host.key in dir
+func NewFileStore(dir string) *FileStore {
+	return &FileStore{Paths: map[StoreItem]string{
+		StoreItemCA:   filepath.Join(dir, "ca.crt"),
+		StoreItemCert: filepath.Join(dir, "host.crt"),
+		StoreItemKey:  filepath.Join(dir, "host.key"),
+	}}
+}
+
+func openFileStore(u *url.URL) (Store, error) {
+	if u.Path == "" {
+		return nil, fmt.Errorf("file store url must have a path")
+	}
+	return NewFileStore(u.Path), nil
+}
+
+func (s *FileStore) Get(_ context.Context, item StoreItem) ([]byte, error) {
+	path, ok := s.Paths[item]
+	if !ok || path == "" {
+		return nil, ErrStoreItemNotFound
+	}
+
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("%w: %s", ErrStoreItemNotFound, path)
+	}
+	return b, err
+}
+
+// Put replaces the item, the file is written next to its final path and renamed into place
+func (s *FileStore) Put(_ context.Context, item StoreItem, b []byte) error {
+	path, ok := s.Paths[item]
+	if !ok || path == "" {
+		return ErrStoreItemNotFound
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+
+	if _, err = f.Write(b); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+
+	if err = f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+
+	if err = os.Rename(f.Name(), path); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+
+	return nil
+}
+
+// MemoryStore holds items in memory, useful for tests and for embedding nebula where the identity is provisioned by
+// the host application.
+type MemoryStore struct {
+	sync.RWMutex
+	items map[StoreItem][]byte
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{items: make(map[StoreItem][]byte)}
+}
+
+func (s *MemoryStore) Get(_ context.Context, item StoreItem) ([]byte, error) {
+	s.RLock()
+	defer s.RUnlock()
+
+	b, ok := s.items[item]
+	if !ok {
+		return nil, ErrStoreItemNotFound
+	}
+	return append([]byte{}, b...), nil
+}
+
+func (s *MemoryStore) Put(_ context.Context, item StoreItem, b []byte) error {
+	s.Lock()
+	s.items[item] = append([]byte{}, b...)
+	s.Unlock()
+	return nil
+}
+
+// HTTPStore fetches each item from URL/<item>, Header is added to every request for stores that need a token
+type HTTPStore struct {
+	URL    string
+	Header http.Header
+	Client *http.Client
+}
+
+func openHTTPStore(u *url.URL) (Store, error) {
+	return &HTTPStore{URL: u.String(), Client: http.DefaultClient}, nil
+}
+
+func (s *HTTPStore) Get(ctx context.Context, item StoreItem) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(s.URL, "/")+"/"+string(item), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	for k, v := range s.Header {
+		req.Header[k] = v
+	}
+
+	client := s.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, fmt.Errorf("%w: %s", ErrStoreItemNotFound, req.URL)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected response for %s: %s", req.URL, resp.Status)
+	}
+
+	return io.ReadAll(io.LimitReader(resp.Body, maxStoreItemSize))
+}
@@ -0,0 +1,103 @@
+package cert
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFileStore(t *testing.T) {
+	dir := t.TempDir()
+	s, err := OpenStore("file://" + dir)
+	require.NoError(t, err)
+	fs := s.(*FileStore)
+	assert.Equal(t, filepath.Join(dir, "host.crt"), fs.Paths[StoreItemCert])
+
+	_, err = s.Get(context.Background(), StoreItemCA)
+	assert.ErrorIs(t, err, ErrStoreItemNotFound)
+
+	require.NoError(t, fs.Put(context.Background(), StoreItemCA, []byte("ca")))
+	b, err := s.Get(context.Background(), StoreItemCA)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("ca"), b)
+
+	// Nothing is left behind by the atomic write
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Len(t, entries, 1)
+
+	_, err = (&FileStore{}).Get(context.Background(), StoreItemKey)
+	assert.ErrorIs(t, err, ErrStoreItemNotFound)
+}
+
+func TestMemoryStore(t *testing.T) {
+	s := NewMemoryStore()
+	_, err := s.Get(context.Background(), StoreItemKey)
+	assert.ErrorIs(t, err, ErrStoreItemNotFound)
+
+	in := []byte("key")
+	require.NoError(t, s.Put(context.Background(), StoreItemKey, in))
+	in[0] = 'x'
+
+	b, err := s.Get(context.Background(), StoreItemKey)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("key"), b)
+}
+
+func TestHTTPStore(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Token") != "secret" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		switch r.URL.Path {
+		case "/nebula/host1/cert":
+			_, _ = w.Write([]byte("cert"))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer ts.Close()
+
+	s, err := OpenStore(ts.URL + "/nebula/host1/")
+	require.NoError(t, err)
+	hs := s.(*HTTPStore)
+
+	_, err = s.Get(context.Background(), StoreItemCert)
+	assert.EqualError(t, err, "unexpected response for "+ts.URL+"/nebula/host1/cert: 403 Forbidden")
+
+	hs.Header = http.Header{"X-Token": []string{"secret"}}
+	b, err := s.Get(context.Background(), StoreItemCert)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("cert"), b)
+
+	_, err = s.Get(context.Background(), StoreItemKey)
+	assert.ErrorIs(t, err, ErrStoreItemNotFound)
+}
+
+func TestOpenStore(t *testing.T) {
+	_, err := OpenStore("vault://secret/nebula")
+	assert.EqualError(t, err, "unknown store scheme: vault")
+
+	ms := NewMemoryStore()
+	RegisterStoreScheme("Vault", func(u *url.URL) (Store, error) {
+		assert.Equal(t, "secret", u.Host)
+		assert.Equal(t, "/nebula", u.Path)
+		return ms, nil
+	})
+
+	s, err := OpenStore("vault://secret/nebula")
+	require.NoError(t, err)
+	assert.Same(t, ms, s)
+
+	_, err = OpenStore("file://")
+	assert.EqualError(t, err, "file store url must have a path")
+}
@@ -0,0 +1,254 @@
+package cert
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+const TreeHeadBanner = "NEBULA TREE HEAD"
+
+var (
+	ErrNoInclusionProof       = errors.New("certificate has no inclusion proof")
+	ErrInclusionProofMismatch = errors.New("inclusion proof did not match")
+	ErrTreeHeadMismatch       = errors.New("tree head signature did not match")
+)
+
+// LogPublicKey identifies a transparency log. Certificates submitted to a log carry an inclusion proof signed with the
+// matching private key, nodes that require inclusion proofs only accept certificates logged to a key they know.
+type LogPublicKey struct {
+	Curve     Curve
+	PublicKey []byte
+}
+
+// ID is the hex encoded sha256 sum of the public key, inclusion proofs and tree heads name the log with it
+func (k *LogPublicKey) ID() string {
+	sum := sha256.Sum256(k.PublicKey)
+	return hex.EncodeToString(sum[:])
+}
+
+// MarshalToPEM encodes the log public key, the banner records the curve
+func (k *LogPublicKey) MarshalToPEM() []byte {
+	if k.Curve == Curve_P256 {
+		return MarshalPublicKey(Curve_P256, k.PublicKey)
+	}
+	return MarshalEd25519PublicKey(k.PublicKey)
+}
+
+// UnmarshalLogPublicKeyFromPEM decodes an ed25519 or P256 public key for a transparency log. Any remaining bytes are
+// returned.
+func UnmarshalLogPublicKeyFromPEM(b []byte) (*LogPublicKey, []byte, error) {
+	p, r := pem.Decode(b)
+	if p == nil {
+		return nil, r, fmt.Errorf("input did not contain a valid PEM encoded block")
+	}
+
+	switch p.Type {
+	case Ed25519PublicKeyBanner:
+		if len(p.Bytes) != 32 {
+			return nil, r, fmt.Errorf("key was not 32 bytes, is invalid ed25519 public key")
+		}
+		return &LogPublicKey{Curve: Curve_CURVE25519, PublicKey: p.Bytes}, r, nil
+	case P256PublicKeyBanner:
+		if len(p.Bytes) != 65 {
+			return nil, r, fmt.Errorf("key was not 65 bytes, is invalid P256 public key")
+		}
+		return &LogPublicKey{Curve: Curve_P256, PublicKey: p.Bytes}, r, nil
+	default:
+		return nil, r, fmt.Errorf("bytes did not contain a proper nebula ed25519 or P256 public key banner")
+	}
+}
+
+// TreeHead is a transparency log's signed statement of its size and root hash at a point in time
+type TreeHead struct {
+	LogID     string    `json:"logId"`
+	Size      uint64    `json:"size"`
+	Timestamp time.Time `json:"timestamp"`
+	RootHash  []byte    `json:"rootHash"`
+	Signature []byte    `json:"signature"`
+}
+
+// Sign signs the tree head with the log key
+func (th *TreeHead) Sign(curve Curve, key []byte) error {
+	var err error
+	th.Signature, err = signBytes(curve, HashAlgorithm_SHA256, key, th.signedBytes())
+	return err
+}
+
+// Verify checks the tree head was signed by the log
+func (th *TreeHead) Verify(k *LogPublicKey) error {
+	if th.LogID != k.ID() {
+		return fmt.Errorf("tree head is from log %s, not %s", th.LogID, k.ID())
+	}
+
+	if !checkBytesSignature(k.Curve, HashAlgorithm_SHA256, k.PublicKey, th.signedBytes(), th.Signature) {
+		return ErrTreeHeadMismatch
+	}
+
+	return nil
+}
+
+func (th *TreeHead) signedBytes() []byte {
+	return []byte(TreeHeadBanner + "\n" + th.LogID + "\n" + strconv.FormatUint(th.Size, 10) + "\n" +
+		strconv.FormatInt(th.Timestamp.Unix(), 10) + "\n" + hex.EncodeToString(th.RootHash))
+}
+
+// VerifyConsistency checks that the log only appended to older to get to newer, both tree heads must already be
+// verified. Monitors use this to detect a log that rewrites history to hide a certificate.
+func VerifyConsistency(older, newer *TreeHead, path [][]byte) error {
+	if older.LogID != newer.LogID {
+		return fmt.Errorf("tree heads are from different logs")
+	}
+
+	if err := verifyMerkleConsistency(older.Size, newer.Size, older.RootHash, newer.RootHash, path); err != nil {
+		return fmt.Errorf("tree head of size %d is not consistent with size %d", older.Size, newer.Size)
+	}
+
+	return nil
+}
+
+// InclusionProof shows a certificate was added to a transparency log. It holds the audit path from the certificate to
+// the root of the log when it was added, and the log's signature over that tree head.
+type InclusionProof struct {
+	LogID     string
+	LeafIndex uint64
+	TreeSize  uint64
+	Timestamp time.Time
+	AuditPath [][]byte
+	Signature []byte
+}
+
+// TreeHead rebuilds the tree head the proof commits to for nc, the signature is not checked
+func (p *InclusionProof) TreeHead(nc *NebulaCertificate) (*TreeHead, error) {
+	leaf, err := nc.logLeaf()
+	if err != nil {
+		return nil, err
+	}
+
+	root, err := merkleRootFromInclusionPath(p.LeafIndex, p.TreeSize, merkleLeafHash(leaf), p.AuditPath)
+	if err != nil {
+		return nil, ErrInclusionProofMismatch
+	}
+
+	return &TreeHead{
+		LogID:     p.LogID,
+		Size:      p.TreeSize,
+		Timestamp: p.Timestamp,
+		RootHash:  root,
+		Signature: p.Signature,
+	}, nil
+}
+
+// Verify checks the proof shows nc was included in the log with the public key k
+func (p *InclusionProof) Verify(nc *NebulaCertificate, k *LogPublicKey) error {
+	th, err := p.TreeHead(nc)
+	if err != nil {
+		return err
+	}
+
+	if err := th.Verify(k); err != nil {
+		if errors.Is(err, ErrTreeHeadMismatch) {
+			return ErrInclusionProofMismatch
+		}
+		return err
+	}
+
+	return nil
+}
+
+func (p *InclusionProof) copy() *InclusionProof {
+	if p == nil {
+		return nil
+	}
+
+	c := *p
+	c.AuditPath = make([][]byte, len(p.AuditPath))
+	for i, h := range p.AuditPath {
+		c.AuditPath[i] = append([]byte{}, h...)
+	}
+	c.Signature = append([]byte{}, p.Signature...)
+	return &c
+}
+
+func unmarshalRawInclusionProof(rp *RawNebulaInclusionProof) *InclusionProof {
+	if rp == nil {
+		return nil
+	}
+
+	return &InclusionProof{
+		LogID:     hex.EncodeToString(rp.LogID),
+		LeafIndex: rp.LeafIndex,
+		TreeSize:  rp.TreeSize,
+		Timestamp: time.Unix(rp.Timestamp, 0),
+		AuditPath: rp.AuditPath,
+		Signature: rp.Signature,
+	}
+}
+
+// logLeaf is what a transparency log records for nc, the certificate as it is fingerprinted
+func (nc *NebulaCertificate) logLeaf() ([]byte, error) {
+	return nc.canonicalize(true, false)
+}
+
+// AddTransparencyLog trusts inclusion proofs signed by the log public key. Only the first pem encoded object will be
+// consumed, any remaining bytes are returned.
+func (ncp *NebulaCAPool) AddTransparencyLog(pemBytes []byte) ([]byte, error) {
+	k, pemBytes, err := UnmarshalLogPublicKeyFromPEM(pemBytes)
+	if err != nil {
+		return pemBytes, err
+	}
+
+	ncp.logs[k.ID()] = k
+	return pemBytes, nil
+}
+
+// GetTransparencyLogs returns the ids of the trusted transparency logs
+func (ncp *NebulaCAPool) GetTransparencyLogs() []string {
+	ids := make([]string, 0, len(ncp.logs))
+	for id := range ncp.logs {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// RequireInclusionProof makes verification fail for certificates without an inclusion proof from a trusted log. CA
+// certificates are trusted directly and are not checked.
+func (ncp *NebulaCAPool) RequireInclusionProof(require bool) {
+	ncp.requireInclusionProof = require
+}
+
+// verifyInclusionProof checks nc carries a valid inclusion proof from a log in the pool
+//
+// NOTE: This uses an internal cache that will not be invalidated automatically
+// if you manually change any fields in the NebulaCertificate.
+func (ncp *NebulaCAPool) verifyInclusionProof(nc *NebulaCertificate, useCache bool) error {
+	p := nc.InclusionProof
+	if p == nil {
+		return ErrNoInclusionProof
+	}
+
+	k, ok := ncp.logs[p.LogID]
+	if !ok {
+		return fmt.Errorf("inclusion proof is from an unknown log: %s", p.LogID)
+	}
+
+	if useCache {
+		if v := nc.inclusionVerified.Load(); v != nil && *v == p.LogID {
+			return nil
+		}
+	}
+
+	if err := p.Verify(nc, k); err != nil {
+		return err
+	}
+
+	if useCache {
+		id := p.LogID
+		nc.inclusionVerified.Store(&id)
+	}
+	return nil
+}
@@ -0,0 +1,395 @@
+package cert
+
+import (
+	"bufio"
+	"context"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	fileLogKey     = "log.key"
+	fileLogPub     = "log.pub"
+	fileLogEntries = "entries"
+
+	// maxLogEntrySize bounds a single logged certificate, they are well under this
+	maxLogEntrySize = 64 * 1024
+	// maxLogEntriesPerRequest bounds how many entries are returned for one request to the entries endpoint
+	maxLogEntriesPerRequest = 1000
+)
+
+// FileLog is an append-only transparency log kept in a directory. Certificates are appended to the entries file and
+// the merkle tree is rebuilt from it when the log is opened.
+//
+// Only one process should write to a directory at a time, run a single log server and point signers at it when
+// certificates are issued from more than one place.
+type FileLog struct {
+	sync.Mutex
+	dir   string
+	curve Curve
+	key   []byte
+	pub   *LogPublicKey
+
+	// ca, if set, limits the log to certificates signed by a CA in the pool
+	ca *NebulaCAPool
+
+	entries [][]byte
+	leaves  [][]byte
+	index   map[string]uint64
+	now     func() time.Time
+}
+
+// OpenFileLog opens the log in dir. A new ed25519 log key is written to dir/log.key, with the public key in
+// dir/log.pub, if there is not one already. Nodes trust the log with the contents of log.pub.
+func OpenFileLog(dir string) (*FileLog, error) {
+	fl := &FileLog{dir: dir, index: map[string]uint64{}, now: time.Now}
+
+	if err := fl.loadKey(); err != nil {
+		return nil, err
+	}
+
+	if err := fl.loadEntries(); err != nil {
+		return nil, err
+	}
+
+	return fl, nil
+}
+
+func (fl *FileLog) loadKey() error {
+	keyPath := filepath.Join(fl.dir, fileLogKey)
+	b, err := os.ReadFile(keyPath)
+	if errors.Is(err, os.ErrNotExist) {
+		if err := os.MkdirAll(fl.dir, 0700); err != nil {
+			return err
+		}
+
+		_, priv, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return err
+		}
+
+		b = MarshalEd25519PrivateKey(priv)
+		if err := os.WriteFile(keyPath, b, 0600); err != nil {
+			return fmt.Errorf("error while writing log key: %w", err)
+		}
+	} else if err != nil {
+		return fmt.Errorf("error while reading log key: %w", err)
+	}
+
+	fl.key, _, fl.curve, err = UnmarshalSigningPrivateKey(b)
+	if err != nil {
+		return fmt.Errorf("error while parsing log key: %w", err)
+	}
+
+	fl.pub = &LogPublicKey{Curve: fl.curve}
+	switch fl.curve {
+	case Curve_CURVE25519:
+		fl.pub.PublicKey = ed25519.PrivateKey(fl.key).Public().(ed25519.PublicKey)
+	case Curve_P256:
+		k, err := ecdh.P256().NewPrivateKey(fl.key)
+		if err != nil {
+			return fmt.Errorf("error while parsing log key: %w", err)
+		}
+		fl.pub.PublicKey = k.PublicKey().Bytes()
+	}
+
+	pubPath := filepath.Join(fl.dir, fileLogPub)
+	if _, err := os.Stat(pubPath); errors.Is(err, os.ErrNotExist) {
+		if err := os.WriteFile(pubPath, fl.pub.MarshalToPEM(), 0644); err != nil {
+			return fmt.Errorf("error while writing log public key: %w", err)
+		}
+	}
+
+	return nil
+}
+
+func (fl *FileLog) loadEntries() error {
+	f, err := os.Open(filepath.Join(fl.dir, fileLogEntries))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("error while opening log entries: %w", err)
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	for {
+		n, err := binary.ReadUvarint(r)
+		if errors.Is(err, io.EOF) {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("error while reading log entry %d: %w", len(fl.entries), err)
+		}
+
+		if n > maxLogEntrySize {
+			return fmt.Errorf("log entry %d is too large: %d", len(fl.entries), n)
+		}
+
+		b := make([]byte, n)
+		if _, err := io.ReadFull(r, b); err != nil {
+			return fmt.Errorf("error while reading log entry %d: %w", len(fl.entries), err)
+		}
+
+		fl.add(b)
+	}
+}
+
+func (fl *FileLog) add(b []byte) uint64 {
+	h := merkleLeafHash(b)
+	i := uint64(len(fl.leaves))
+	fl.entries = append(fl.entries, b)
+	fl.leaves = append(fl.leaves, h)
+	fl.index[string(h)] = i
+	return i
+}
+
+// PublicKey returns the key nodes need to trust the log
+func (fl *FileLog) PublicKey() *LogPublicKey {
+	return fl.pub
+}
+
+// SetCAPool limits the log to certificates signed by a CA in pool, a public log should set this to avoid spam
+func (fl *FileLog) SetCAPool(pool *NebulaCAPool) {
+	fl.Lock()
+	fl.ca = pool
+	fl.Unlock()
+}
+
+// Submit appends nc to the log and returns the proof of its inclusion. A certificate that is already in the log is not
+// added again, a proof against the current tree head is returned.
+func (fl *FileLog) Submit(_ context.Context, nc *NebulaCertificate) (*InclusionProof, error) {
+	leaf, err := nc.logLeaf()
+	if err != nil {
+		return nil, err
+	}
+
+	fl.Lock()
+	defer fl.Unlock()
+
+	if fl.ca != nil {
+		signer, err := fl.ca.GetCAForCert(nc)
+		if err != nil {
+			return nil, err
+		}
+		if !nc.CheckSignature(signer.Details.PublicKey) {
+			return nil, ErrSignatureMismatch
+		}
+	}
+
+	i, ok := fl.index[string(merkleLeafHash(leaf))]
+	if !ok {
+		if err := fl.append(leaf); err != nil {
+			return nil, err
+		}
+		i = fl.add(leaf)
+	}
+
+	th, err := fl.treeHead()
+	if err != nil {
+		return nil, err
+	}
+
+	return &InclusionProof{
+		LogID:     th.LogID,
+		LeafIndex: i,
+		TreeSize:  th.Size,
+		Timestamp: th.Timestamp,
+		AuditPath: merkleInclusionPath(i, fl.leaves),
+		Signature: th.Signature,
+	}, nil
+}
+
+// append writes an entry to disk before it is added to the tree, a proof is never handed out for an entry that could
+// be lost
+func (fl *FileLog) append(b []byte) error {
+	f, err := os.OpenFile(filepath.Join(fl.dir, fileLogEntries), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return fmt.Errorf("error while opening log entries: %w", err)
+	}
+
+	rec := binary.AppendUvarint(nil, uint64(len(b)))
+	rec = append(rec, b...)
+	if _, err = f.Write(rec); err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("error while writing log entry: %w", err)
+	}
+
+	return nil
+}
+
+// TreeHead returns a freshly signed tree head for the current size of the log
+func (fl *FileLog) TreeHead() (*TreeHead, error) {
+	fl.Lock()
+	defer fl.Unlock()
+	return fl.treeHead()
+}
+
+func (fl *FileLog) treeHead() (*TreeHead, error) {
+	th := &TreeHead{
+		LogID:     fl.pub.ID(),
+		Size:      uint64(len(fl.leaves)),
+		Timestamp: time.Unix(fl.now().Unix(), 0),
+		RootHash:  merkleRoot(fl.leaves),
+	}
+
+	if err := th.Sign(fl.curve, fl.key); err != nil {
+		return nil, err
+	}
+
+	return th, nil
+}
+
+// Entries returns the certificates in the log from start up to but not including end
+func (fl *FileLog) Entries(start, end uint64) ([]*NebulaCertificate, error) {
+	fl.Lock()
+	defer fl.Unlock()
+
+	if end > uint64(len(fl.entries)) {
+		end = uint64(len(fl.entries))
+	}
+	if start > end {
+		return nil, fmt.Errorf("start %d is beyond end %d", start, end)
+	}
+
+	certs := make([]*NebulaCertificate, 0, end-start)
+	for _, b := range fl.entries[start:end] {
+		nc, err := UnmarshalNebulaCertificate(b)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, nc)
+	}
+
+	return certs, nil
+}
+
+// ConsistencyProof returns the proof that the log at size first is a prefix of the log at size second
+func (fl *FileLog) ConsistencyProof(first, second uint64) ([][]byte, error) {
+	fl.Lock()
+	defer fl.Unlock()
+
+	if first > second || second > uint64(len(fl.leaves)) {
+		return nil, fmt.Errorf("invalid tree sizes %d and %d for a log of size %d", first, second, len(fl.leaves))
+	}
+
+	return merkleConsistencyPath(first, fl.leaves[:second]), nil
+}
+
+// ServeHTTP exposes the log so certificates can be submitted from elsewhere and monitors can watch it. POST a PEM
+// certificate to /submit to get it back with an inclusion proof attached. GET /tree-head, /entries?start=&end=, and
+// /consistency?first=&second= let monitors follow the log.
+func (fl *FileLog) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/submit":
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		b, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxLogEntrySize))
+		if err != nil {
+			http.Error(w, "invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		nc, _, err := UnmarshalNebulaCertificateFromPEM(b)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		nc.InclusionProof, err = fl.Submit(r.Context(), nc)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		b, err = nc.MarshalToPEM()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/x-pem-file")
+		_, _ = w.Write(b)
+
+	case "/tree-head":
+		th, err := fl.TreeHead()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(th)
+
+	case "/entries":
+		start, err1 := strconv.ParseUint(r.URL.Query().Get("start"), 10, 64)
+		end, err2 := strconv.ParseUint(r.URL.Query().Get("end"), 10, 64)
+		if err1 != nil || err2 != nil {
+			http.Error(w, "start and end are required", http.StatusBadRequest)
+			return
+		}
+		if end-start > maxLogEntriesPerRequest {
+			end = start + maxLogEntriesPerRequest
+		}
+
+		certs, err := fl.Entries(start, end)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/x-pem-file")
+		for _, nc := range certs {
+			b, err := nc.MarshalToPEM()
+			if err != nil {
+				return
+			}
+			_, _ = w.Write(b)
+		}
+
+	case "/consistency":
+		first, err1 := strconv.ParseUint(r.URL.Query().Get("first"), 10, 64)
+		second, err2 := strconv.ParseUint(r.URL.Query().Get("second"), 10, 64)
+		if err1 != nil || err2 != nil {
+			http.Error(w, "first and second are required", http.StatusBadRequest)
+			return
+		}
+
+		path, err := fl.ConsistencyProof(first, second)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		hexPath := make([]string, len(path))
+		for i, h := range path {
+			hexPath[i] = hex.EncodeToString(h)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(m{"path": hexPath})
+
+	default:
+		http.Error(w, "not found", http.StatusNotFound)
+	}
+}
@@ -0,0 +1,96 @@
+package cert
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// LogSubmitter adds certificates to a transparency log, the returned proof should be attached to the certificate
+// before it is handed out
+type LogSubmitter interface {
+	Submit(ctx context.Context, nc *NebulaCertificate) (*InclusionProof, error)
+}
+
+// OpenLogSubmitter returns a submitter for a log server at an http(s) url or a FileLog for a local directory
+func OpenLogSubmitter(raw string) (LogSubmitter, error) {
+	u, err := url.Parse(raw)
+	if err == nil && (u.Scheme == "http" || u.Scheme == "https") {
+		return &HTTPLog{URL: raw, Client: http.DefaultClient}, nil
+	}
+
+	if err == nil && u.Scheme == "file" {
+		raw = u.Path
+	}
+
+	return OpenFileLog(raw)
+}
+
+// HTTPLog submits certificates to a log served by FileLog.ServeHTTP
+type HTTPLog struct {
+	URL    string
+	Header http.Header
+	Client *http.Client
+}
+
+func (hl *HTTPLog) Submit(ctx context.Context, nc *NebulaCertificate) (*InclusionProof, error) {
+	b, err := nc.MarshalToPEM()
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimSuffix(hl.URL, "/")+"/submit", bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Content-Type", "application/x-pem-file")
+	for k, v := range hl.Header {
+		req.Header[k] = v
+	}
+
+	client := hl.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxLogEntrySize))
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("log rejected the certificate: %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	logged, _, err := UnmarshalNebulaCertificateFromPEM(body)
+	if err != nil {
+		return nil, fmt.Errorf("invalid response from log: %w", err)
+	}
+
+	// The log must have logged this certificate, the proof is checked against it
+	want, err := nc.Fingerprint()
+	if err != nil {
+		return nil, err
+	}
+	got, err := logged.Fingerprint()
+	if err != nil || got != want || logged.InclusionProof == nil {
+		return nil, fmt.Errorf("log returned a different certificate")
+	}
+
+	if _, err := logged.InclusionProof.TreeHead(nc); err != nil {
+		return nil, err
+	}
+
+	return logged.InclusionProof, nil
+}
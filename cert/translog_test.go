@@ -0,0 +1,204 @@
+package cert
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFileLog(t *testing.T) {
+	dir := t.TempDir()
+	fl, err := OpenFileLog(dir)
+	require.NoError(t, err)
+
+	pub, err := os.ReadFile(filepath.Join(dir, "log.pub"))
+	require.NoError(t, err)
+	k, _, err := UnmarshalLogPublicKeyFromPEM(pub)
+	require.NoError(t, err)
+	assert.Equal(t, fl.PublicKey(), k)
+
+	ca, _, caKey, err := newTestCaCert(time.Time{}, time.Time{}, nil, nil, nil)
+	require.NoError(t, err)
+	caPem, err := ca.MarshalToPEM()
+	require.NoError(t, err)
+	pool, err := NewCAPoolFromBytes(caPem)
+	require.NoError(t, err)
+
+	var certs []*NebulaCertificate
+	for i := 0; i < 5; i++ {
+		c, _, _, err := newTestCert(ca, caKey, time.Time{}, time.Time{}, nil, nil, nil)
+		require.NoError(t, err)
+
+		c.InclusionProof, err = fl.Submit(context.Background(), c)
+		require.NoError(t, err)
+		assert.Equal(t, uint64(i), c.InclusionProof.LeafIndex)
+		assert.Equal(t, uint64(i+1), c.InclusionProof.TreeSize)
+		assert.NoError(t, c.InclusionProof.Verify(c, k))
+		certs = append(certs, c)
+	}
+
+	// Submitting again does not grow the log
+	p, err := fl.Submit(context.Background(), certs[1])
+	require.NoError(t, err)
+	assert.Equal(t, uint64(1), p.LeafIndex)
+	assert.Equal(t, uint64(5), p.TreeSize)
+
+	// The proof travels with the certificate without changing its fingerprint
+	fp, err := certs[0].Fingerprint()
+	require.NoError(t, err)
+	b, err := certs[0].MarshalToPEM()
+	require.NoError(t, err)
+	c, _, err := UnmarshalNebulaCertificateFromPEM(b)
+	require.NoError(t, err)
+	assert.Equal(t, certs[0].InclusionProof, c.InclusionProof)
+	cfp, err := c.Fingerprint()
+	require.NoError(t, err)
+	assert.Equal(t, fp, cfp)
+	assert.Contains(t, c.String(), "\tInclusion proof {\n\t\tLog: "+k.ID()+"\n\t\tLeaf index: 0\n\t\tTree size: 1\n")
+
+	// Reopening rebuilds the same tree
+	th, err := fl.TreeHead()
+	require.NoError(t, err)
+	fl2, err := OpenFileLog(dir)
+	require.NoError(t, err)
+	th2, err := fl2.TreeHead()
+	require.NoError(t, err)
+	assert.Equal(t, th.RootHash, th2.RootHash)
+	assert.NoError(t, th2.Verify(k))
+
+	entries, err := fl2.Entries(1, 3)
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+	assert.Equal(t, certs[1].Details.PublicKey, entries[0].Details.PublicKey)
+
+	// Every earlier tree head is consistent with the latest
+	for _, c := range certs {
+		older, err := c.InclusionProof.TreeHead(c)
+		require.NoError(t, err)
+		path, err := fl2.ConsistencyProof(older.Size, th2.Size)
+		require.NoError(t, err)
+		assert.NoError(t, VerifyConsistency(older, th2, path))
+	}
+
+	// Only certificates from the pool are accepted once it is set
+	other, _, otherKey, err := newTestCaCert(time.Time{}, time.Time{}, nil, nil, nil)
+	require.NoError(t, err)
+	oc, _, _, err := newTestCert(other, otherKey, time.Time{}, time.Time{}, nil, nil, nil)
+	require.NoError(t, err)
+	fl2.SetCAPool(pool)
+	_, err = fl2.Submit(context.Background(), oc)
+	assert.EqualError(t, err, "could not find ca for the certificate")
+}
+
+func TestNebulaCAPool_RequireInclusionProof(t *testing.T) {
+	fl, err := OpenFileLog(t.TempDir())
+	require.NoError(t, err)
+
+	ca, _, caKey, err := newTestCaCert(time.Time{}, time.Time{}, nil, nil, nil)
+	require.NoError(t, err)
+	caPem, err := ca.MarshalToPEM()
+	require.NoError(t, err)
+	pool, err := NewCAPoolFromBytes(caPem)
+	require.NoError(t, err)
+
+	c, pub, _, err := newTestCert(ca, caKey, time.Time{}, time.Time{}, nil, nil, nil)
+	require.NoError(t, err)
+
+	// Nothing is required by default
+	ok, err := c.Verify(time.Now(), pool)
+	assert.True(t, ok)
+	assert.NoError(t, err)
+
+	pool.RequireInclusionProof(true)
+	ok, err = c.Verify(time.Now(), pool)
+	assert.False(t, ok)
+	assert.Equal(t, ErrNoInclusionProof, err)
+
+	c.InclusionProof, err = fl.Submit(context.Background(), c)
+	require.NoError(t, err)
+	_, err = c.Verify(time.Now(), pool)
+	assert.EqualError(t, err, "inclusion proof is from an unknown log: "+fl.PublicKey().ID())
+
+	rest, err := pool.AddTransparencyLog(fl.PublicKey().MarshalToPEM())
+	require.NoError(t, err)
+	assert.Empty(t, rest)
+	assert.Equal(t, []string{fl.PublicKey().ID()}, pool.GetTransparencyLogs())
+	ok, err = c.VerifyWithCache(time.Now(), pool)
+	assert.True(t, ok)
+	assert.NoError(t, err)
+
+	// The proof is sent during handshakes
+	payload, err := c.MarshalForHandshakes()
+	require.NoError(t, err)
+	hc, err := VerifyHandshakeCertificate(payload, pub, pool, time.Now())
+	require.NoError(t, err)
+	assert.NotNil(t, hc.Certificate.InclusionProof)
+
+	// A proof for a different certificate does not verify
+	c2, _, _, err := newTestCert(ca, caKey, time.Time{}, time.Time{}, nil, nil, nil)
+	require.NoError(t, err)
+	_, err = fl.Submit(context.Background(), c2)
+	require.NoError(t, err)
+	c2.InclusionProof = c.InclusionProof.copy()
+	_, err = c2.Verify(time.Now(), pool)
+	assert.Equal(t, ErrInclusionProofMismatch, err)
+
+	// Neither does a tampered proof
+	c.ResetCache()
+	c.InclusionProof.Timestamp = c.InclusionProof.Timestamp.Add(time.Second)
+	_, err = c.Verify(time.Now(), pool)
+	assert.Equal(t, ErrInclusionProofMismatch, err)
+}
+
+func TestFileLog_ServeHTTP(t *testing.T) {
+	fl, err := OpenFileLog(t.TempDir())
+	require.NoError(t, err)
+	s := httptest.NewServer(fl)
+	defer s.Close()
+
+	ca, _, caKey, err := newTestCaCert(time.Time{}, time.Time{}, nil, nil, nil)
+	require.NoError(t, err)
+	c, _, _, err := newTestCert(ca, caKey, time.Time{}, time.Time{}, nil, nil, nil)
+	require.NoError(t, err)
+
+	ls, err := OpenLogSubmitter(s.URL)
+	require.NoError(t, err)
+	p, err := ls.Submit(context.Background(), c)
+	require.NoError(t, err)
+	assert.NoError(t, p.Verify(c, fl.PublicKey()))
+
+	resp, err := http.Get(s.URL + "/tree-head")
+	require.NoError(t, err)
+	var th TreeHead
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&th))
+	resp.Body.Close()
+	assert.Equal(t, uint64(1), th.Size)
+	assert.NoError(t, th.Verify(fl.PublicKey()))
+
+	resp, err = http.Get(s.URL + "/entries?start=0&end=10")
+	require.NoError(t, err)
+	b, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	resp.Body.Close()
+	logged, _, err := UnmarshalNebulaCertificateFromPEM(b)
+	require.NoError(t, err)
+	assert.Equal(t, c.Details.PublicKey, logged.Details.PublicKey)
+
+	resp, err = http.Get(s.URL + "/entries")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	// Garbage is refused
+	_, err = (&HTTPLog{URL: s.URL}).Submit(context.Background(), &NebulaCertificate{})
+	assert.ErrorContains(t, err, "log rejected the certificate: 400 Bad Request")
+}
@@ -0,0 +1,293 @@
+package cert
+
+import (
+	"bytes"
+	"context"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+
+	"filippo.io/age"
+	"github.com/anmitsu/go-shlex"
+)
+
+const WrappedPrivateKeyBanner = "NEBULA WRAPPED PRIVATE KEY"
+
+// wrapSchemeHeader is the PEM header naming the scheme a wrapped key must be unwrapped with
+const wrapSchemeHeader = "Scheme"
+
+// KeyWrapper encrypts a PEM encoded private key with a key kept outside of nebula, like a cloud KMS key or a set of age
+// recipients, so the key file is useless without access to it.
+type KeyWrapper interface {
+	WrapKey(ctx context.Context, plaintext []byte) ([]byte, error)
+}
+
+// KeyUnwrapper reverses a KeyWrapper, it is used to decrypt wrapped keys at startup
+type KeyUnwrapper interface {
+	UnwrapKey(ctx context.Context, ciphertext []byte) ([]byte, error)
+}
+
+// KeyWrapperOpener builds a KeyWrapper from everything after the scheme in a wrap spec
+type KeyWrapperOpener func(arg string) (KeyWrapper, error)
+
+// KeyUnwrapperOpener builds a KeyUnwrapper from everything after the scheme in an unwrap spec
+type KeyUnwrapperOpener func(arg string) (KeyUnwrapper, error)
+
+type keyWrapScheme struct {
+	wrap   KeyWrapperOpener
+	unwrap KeyUnwrapperOpener
+}
+
+var (
+	keyWrapSchemesLock sync.RWMutex
+	keyWrapSchemes     = map[string]keyWrapScheme{
+		"age":  {wrap: openAgeWrapper, unwrap: openAgeUnwrapper},
+		"exec": {wrap: openExecWrapper, unwrap: openExecUnwrapper},
+	}
+)
+
+// RegisterKeyWrapScheme makes a wrapper and unwrapper available for specs with the scheme, replacing any existing ones.
+// Either opener may be nil if the scheme only supports one direction. This is how a cloud KMS, such as AWS KMS or GCP
+// KMS, is plugged in without nebula depending on its SDK.
+func RegisterKeyWrapScheme(scheme string, wrap KeyWrapperOpener, unwrap KeyUnwrapperOpener) {
+	keyWrapSchemesLock.Lock()
+	keyWrapSchemes[strings.ToLower(scheme)] = keyWrapScheme{wrap: wrap, unwrap: unwrap}
+	keyWrapSchemesLock.Unlock()
+}
+
+// parseKeyWrapSpec splits a <scheme>:<arg> spec and returns the registered scheme
+func parseKeyWrapSpec(spec string) (string, string, keyWrapScheme, error) {
+	scheme, arg, ok := strings.Cut(spec, ":")
+	if !ok || scheme == "" {
+		return "", "", keyWrapScheme{}, fmt.Errorf("invalid key wrap spec, expected <scheme>:<arg>")
+	}
+
+	scheme = strings.ToLower(scheme)
+	keyWrapSchemesLock.RLock()
+	s, ok := keyWrapSchemes[scheme]
+	keyWrapSchemesLock.RUnlock()
+	if !ok {
+		return "", "", keyWrapScheme{}, fmt.Errorf("unknown key wrap scheme: %s", scheme)
+	}
+
+	return scheme, arg, s, nil
+}
+
+// WrapPrivateKey encrypts the PEM encoded key with the wrapper named by spec and returns it PEM encoded as a wrapped
+// key. Built in specs are age:<recipient>[,<recipient>...] and exec:<command>, where the command reads the key on
+// stdin and writes the ciphertext to stdout.
+func WrapPrivateKey(ctx context.Context, spec string, key []byte) ([]byte, error) {
+	scheme, arg, s, err := parseKeyWrapSpec(spec)
+	if err != nil {
+		return nil, err
+	}
+
+	if s.wrap == nil {
+		return nil, fmt.Errorf("key wrap scheme %s does not support wrapping", scheme)
+	}
+
+	w, err := s.wrap(arg)
+	if err != nil {
+		return nil, err
+	}
+
+	b, err := w.WrapKey(ctx, key)
+	if err != nil {
+		return nil, fmt.Errorf("unable to wrap key with %s: %w", scheme, err)
+	}
+
+	return pem.EncodeToMemory(&pem.Block{
+		Type:    WrappedPrivateKeyBanner,
+		Headers: map[string]string{wrapSchemeHeader: scheme},
+		Bytes:   b,
+	}), nil
+}
+
+// IsWrappedPrivateKey reports if b starts with a wrapped private key
+func IsWrappedPrivateKey(b []byte) bool {
+	k, _ := pem.Decode(b)
+	return k != nil && k.Type == WrappedPrivateKeyBanner
+}
+
+// UnwrapPrivateKey decrypts a wrapped key with the unwrapper named by spec and returns the original PEM encoded key.
+// Built in specs are age:<identity file> and exec:<command>, where the command reads the ciphertext on stdin and
+// writes the key to stdout. The scheme must match the one the key was wrapped with.
+func UnwrapPrivateKey(ctx context.Context, spec string, b []byte) ([]byte, error) {
+	k, _ := pem.Decode(b)
+	if k == nil || k.Type != WrappedPrivateKeyBanner {
+		return nil, fmt.Errorf("input did not contain a valid PEM encoded block")
+	}
+
+	keyScheme := strings.ToLower(k.Headers[wrapSchemeHeader])
+	if keyScheme == "" {
+		return nil, fmt.Errorf("wrapped key is missing the %s header", wrapSchemeHeader)
+	}
+
+	scheme, arg, s, err := parseKeyWrapSpec(spec)
+	if err != nil {
+		return nil, err
+	}
+
+	if scheme != keyScheme {
+		return nil, fmt.Errorf("key was wrapped with %s and can not be unwrapped with %s", keyScheme, scheme)
+	}
+
+	if s.unwrap == nil {
+		return nil, fmt.Errorf("key wrap scheme %s does not support unwrapping", scheme)
+	}
+
+	u, err := s.unwrap(arg)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := u.UnwrapKey(ctx, k.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("unable to unwrap key with %s: %w", scheme, err)
+	}
+
+	if p, _ := pem.Decode(key); p == nil {
+		return nil, fmt.Errorf("unwrapped key is not PEM encoded")
+	}
+
+	return key, nil
+}
+
+// ageWrapper encrypts to one or more age recipients
+type ageWrapper struct {
+	recipients []age.Recipient
+}
+
+func openAgeWrapper(arg string) (KeyWrapper, error) {
+	w := &ageWrapper{}
+	for _, r := range strings.Split(arg, ",") {
+		r = strings.TrimSpace(r)
+		if r == "" {
+			continue
+		}
+
+		recipient, err := age.ParseX25519Recipient(r)
+		if err != nil {
+			return nil, err
+		}
+		w.recipients = append(w.recipients, recipient)
+	}
+
+	if len(w.recipients) == 0 {
+		return nil, errors.New("age key wrap spec requires at least one recipient")
+	}
+
+	return w, nil
+}
+
+func (w *ageWrapper) WrapKey(_ context.Context, plaintext []byte) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	aw, err := age.Encrypt(buf, w.recipients...)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err = aw.Write(plaintext); err != nil {
+		return nil, err
+	}
+
+	if err = aw.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// ageUnwrapper decrypts with the identities in an age identity file
+type ageUnwrapper struct {
+	identities []age.Identity
+}
+
+func openAgeUnwrapper(arg string) (KeyUnwrapper, error) {
+	if arg == "" {
+		return nil, errors.New("age key unwrap spec requires an identity file")
+	}
+
+	f, err := os.Open(arg)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	identities, err := age.ParseIdentities(f)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse age identity file %s: %w", arg, err)
+	}
+
+	return &ageUnwrapper{identities: identities}, nil
+}
+
+func (u *ageUnwrapper) UnwrapKey(_ context.Context, ciphertext []byte) ([]byte, error) {
+	r, err := age.Decrypt(bytes.NewReader(ciphertext), u.identities...)
+	if err != nil {
+		return nil, err
+	}
+
+	buf := &bytes.Buffer{}
+	if _, err = buf.ReadFrom(r); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// execKeyWrapper runs a command with the input on stdin and takes stdout as the output. It works in both directions
+// and is the simplest way to use a KMS cli, `aws kms decrypt` for example, without a registered scheme.
+type execKeyWrapper struct {
+	args []string
+}
+
+func openExecWrapper(arg string) (KeyWrapper, error) {
+	return newExecKeyWrapper(arg)
+}
+
+func openExecUnwrapper(arg string) (KeyUnwrapper, error) {
+	return newExecKeyWrapper(arg)
+}
+
+func newExecKeyWrapper(arg string) (*execKeyWrapper, error) {
+	args, err := shlex.Split(arg, true)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse exec key wrap command: %w", err)
+	}
+
+	if len(args) == 0 {
+		return nil, errors.New("exec key wrap spec requires a command")
+	}
+
+	return &execKeyWrapper{args: args}, nil
+}
+
+func (w *execKeyWrapper) run(ctx context.Context, in []byte) ([]byte, error) {
+	cmd := exec.CommandContext(ctx, w.args[0], w.args[1:]...)
+	cmd.Stdin = bytes.NewReader(in)
+	stderr := &bytes.Buffer{}
+	cmd.Stderr = stderr
+
+	out, err := cmd.Output()
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return nil, fmt.Errorf("%w: %s", err, msg)
+		}
+		return nil, err
+	}
+
+	return out, nil
+}
+
+func (w *execKeyWrapper) WrapKey(ctx context.Context, plaintext []byte) ([]byte, error) {
+	return w.run(ctx, plaintext)
+}
+
+func (w *execKeyWrapper) UnwrapKey(ctx context.Context, ciphertext []byte) ([]byte, error) {
+	return w.run(ctx, ciphertext)
+}
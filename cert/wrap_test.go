@@ -0,0 +1,120 @@
+package cert
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"filippo.io/age"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type xorKeyWrapper byte
+
+func (w xorKeyWrapper) xor(b []byte) []byte {
+	out := make([]byte, len(b))
+	for i := range b {
+		out[i] = b[i] ^ byte(w)
+	}
+	return out
+}
+
+func (w xorKeyWrapper) WrapKey(_ context.Context, b []byte) ([]byte, error)   { return w.xor(b), nil }
+func (w xorKeyWrapper) UnwrapKey(_ context.Context, b []byte) ([]byte, error) { return w.xor(b), nil }
+
+func TestWrapPrivateKey(t *testing.T) {
+	RegisterKeyWrapScheme("XorTest",
+		func(string) (KeyWrapper, error) { return xorKeyWrapper(0x5a), nil },
+		func(string) (KeyUnwrapper, error) { return xorKeyWrapper(0x5a), nil },
+	)
+	RegisterKeyWrapScheme("wraponly", func(string) (KeyWrapper, error) { return xorKeyWrapper(0x5a), nil }, nil)
+
+	ctx := context.Background()
+	key := MarshalPrivateKey(Curve_CURVE25519, bytes.Repeat([]byte{1}, 32))
+
+	b, err := WrapPrivateKey(ctx, "xortest:", key)
+	require.NoError(t, err)
+	assert.True(t, IsWrappedPrivateKey(b))
+	assert.False(t, IsWrappedPrivateKey(key))
+	assert.Contains(t, string(b), "Scheme: xortest")
+
+	out, err := UnwrapPrivateKey(ctx, "xortest:", b)
+	require.NoError(t, err)
+	assert.Equal(t, key, out)
+
+	_, err = WrapPrivateKey(ctx, "nope", key)
+	assert.EqualError(t, err, "invalid key wrap spec, expected <scheme>:<arg>")
+
+	_, err = WrapPrivateKey(ctx, "nope:", key)
+	assert.EqualError(t, err, "unknown key wrap scheme: nope")
+
+	_, err = UnwrapPrivateKey(ctx, "age:/nope", b)
+	assert.EqualError(t, err, "key was wrapped with xortest and can not be unwrapped with age")
+
+	_, err = UnwrapPrivateKey(ctx, "xortest:", key)
+	assert.EqualError(t, err, "input did not contain a valid PEM encoded block")
+
+	b, err = WrapPrivateKey(ctx, "wraponly:", key)
+	require.NoError(t, err)
+	_, err = UnwrapPrivateKey(ctx, "wraponly:", b)
+	assert.EqualError(t, err, "key wrap scheme wraponly does not support unwrapping")
+}
+
+func TestWrapPrivateKey_age(t *testing.T) {
+	ctx := context.Background()
+	key := MarshalPrivateKey(Curve_CURVE25519, bytes.Repeat([]byte{1}, 32))
+
+	id, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+	other, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+
+	_, err = WrapPrivateKey(ctx, "age:", key)
+	assert.EqualError(t, err, "age key wrap spec requires at least one recipient")
+
+	b, err := WrapPrivateKey(ctx, "age:"+id.Recipient().String()+","+other.Recipient().String(), key)
+	require.NoError(t, err)
+	assert.NotContains(t, string(b), string(key))
+
+	dir := t.TempDir()
+	idPath := filepath.Join(dir, "id.txt")
+	require.NoError(t, os.WriteFile(idPath, []byte(id.String()+"\n"), 0600))
+
+	out, err := UnwrapPrivateKey(ctx, "age:"+idPath, b)
+	require.NoError(t, err)
+	assert.Equal(t, key, out)
+
+	wrongPath := filepath.Join(dir, "wrong.txt")
+	wrong, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(wrongPath, []byte(wrong.String()+"\n"), 0600))
+
+	_, err = UnwrapPrivateKey(ctx, "age:"+wrongPath, b)
+	assert.ErrorContains(t, err, "unable to unwrap key with age")
+}
+
+func TestWrapPrivateKey_exec(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("needs cat")
+	}
+
+	ctx := context.Background()
+	key := MarshalPrivateKey(Curve_CURVE25519, bytes.Repeat([]byte{1}, 32))
+
+	b, err := WrapPrivateKey(ctx, "exec:cat", key)
+	require.NoError(t, err)
+
+	out, err := UnwrapPrivateKey(ctx, "exec:cat", b)
+	require.NoError(t, err)
+	assert.Equal(t, key, out)
+
+	_, err = UnwrapPrivateKey(ctx, "exec:echo nope", b)
+	assert.EqualError(t, err, "unwrapped key is not PEM encoded")
+
+	_, err = UnwrapPrivateKey(ctx, "exec:sh -c 'echo broken >&2; exit 1'", b)
+	assert.EqualError(t, err, "unable to unwrap key with exec: exit status 1: broken")
+}
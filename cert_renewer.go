@@ -0,0 +1,238 @@
+package nebula
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/slackhq/nebula/cert"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/enroll"
+)
+
+const (
+	defaultRenewBefore   = 30 * 24 * time.Hour
+	defaultRenewInterval = time.Hour
+)
+
+// certRenewer requests a new certificate from the enrollment server, over the mesh, when the current certificate is
+// close to expiring. The new certificate is installed without restarting, the connection manager re-handshakes
+// existing tunnels once it notices the local certificate changed.
+type certRenewer struct {
+	l        *logrus.Logger
+	pki      *PKI
+	c        *config.C
+	url      string
+	before   time.Duration
+	interval time.Duration
+	timeout  time.Duration
+	client   *http.Client
+}
+
+func newCertRenewerFromConfig(l *logrus.Logger, pki *PKI, c *config.C) *certRenewer {
+	url := c.GetString("pki.renew.url", c.GetString("pki.enroll.url", ""))
+	if url == "" || !c.GetBool("pki.renew.enabled", true) {
+		return nil
+	}
+
+	before := c.GetDuration("pki.renew.before", defaultRenewBefore)
+	if before <= 0 {
+		before = defaultRenewBefore
+	}
+
+	interval := c.GetDuration("pki.renew.interval", defaultRenewInterval)
+	if interval <= 0 {
+		interval = defaultRenewInterval
+	}
+
+	return &certRenewer{
+		l:        l,
+		pki:      pki,
+		c:        c,
+		url:      url,
+		before:   before,
+		interval: interval,
+		timeout:  c.GetDuration("pki.enroll.timeout", defaultEnrollTimeout),
+		client:   http.DefaultClient,
+	}
+}
+
+// Start checks the certificate now and then every interval until ctx is done. This is a non blocking call.
+func (r *certRenewer) Start(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(r.interval)
+		defer ticker.Stop()
+
+		for {
+			if err := r.renewIfNeeded(ctx, time.Now()); err != nil {
+				r.l.WithError(err).WithField("url", r.url).Error("Failed to renew certificate")
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// due reports if the certificate expires within the renewal window
+func (r *certRenewer) due(nc *cert.NebulaCertificate, now time.Time) bool {
+	return !now.Add(r.before).Before(nc.Details.NotAfter)
+}
+
+func (r *certRenewer) renewIfNeeded(ctx context.Context, now time.Time) error {
+	cs := r.pki.GetCertState()
+	if !r.due(cs.Certificate, now) {
+		return nil
+	}
+
+	r.l.WithField("notAfter", cs.Certificate.Details.NotAfter).WithField("url", r.url).
+		Info("Certificate is close to expiring, requesting renewal")
+
+	var pub, priv []byte
+	if cs.tpmBacked {
+		// The key never leaves the TPM, renew the certificate for the same key
+		pub, priv = cs.PublicKey, cs.PrivateKey
+	} else {
+		var err error
+		pub, priv, err = enroll.NewKeypair(cs.Certificate.Details.Curve)
+		if err != nil {
+			return fmt.Errorf("error while generating keypair: %s", err)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+
+	res, err := enroll.Renew(ctx, r.client, r.url, cs.Certificate, pub, r.pki.GetCAPool())
+	if err != nil {
+		return err
+	}
+
+	ncs, err := newCertState(res.Certificate, priv)
+	if err != nil {
+		return err
+	}
+	ncs.tpmBacked = cs.tpmBacked
+	ncs.tpmDH = cs.tpmDH
+	ncs.alternates = cs.alternates
+
+	if err = r.persist(ncs); err != nil {
+		// The new certificate is still good for this process, a reload or restart will bring back the old one
+		r.l.WithError(err).Warn("Failed to save the renewed certificate, it will be lost on reload or restart")
+	}
+
+	r.pki.cs.Store(ncs)
+	r.l.WithField("cert", ncs.Certificate).Info("Client cert renewed")
+	return nil
+}
+
+// persist writes the renewed key and certificate over pki.key and pki.cert, a tpm key is left alone
+func (r *certRenewer) persist(cs *CertState) error {
+	keyPath := r.c.GetString("pki.key", "")
+	certPath := r.c.GetString("pki.cert", "")
+	if cs.tpmBacked {
+		keyPath = ""
+	} else if keyPath == "" || strings.Contains(keyPath, "-----BEGIN") {
+		return errors.New("pki.key and pki.cert must be file paths to save a renewed certificate")
+	}
+
+	if certPath == "" || strings.Contains(certPath, "-----BEGIN") {
+		return errors.New("pki.key and pki.cert must be file paths to save a renewed certificate")
+	}
+
+	b, err := cs.Certificate.MarshalToPEM()
+	if err != nil {
+		return fmt.Errorf("error while marshalling renewed certificate: %s", err)
+	}
+
+	if keyPath == "" {
+		certTmp, err := writeTempFile(certPath, b)
+		if err != nil {
+			return fmt.Errorf("unable to write pki.cert file %s: %s", certPath, err)
+		}
+
+		if err = os.Rename(certTmp, certPath); err != nil {
+			os.Remove(certTmp)
+			return fmt.Errorf("unable to replace pki.cert file %s: %s", certPath, err)
+		}
+		return nil
+	}
+
+	pemKey, err := r.marshalKey(keyPath, cs)
+	if err != nil {
+		return err
+	}
+
+	// Write both before replacing either so a failure does not leave a mismatched pair behind
+	keyTmp, err := writeTempFile(keyPath, pemKey)
+	if err != nil {
+		return fmt.Errorf("unable to write pki.key file %s: %s", keyPath, err)
+	}
+
+	certTmp, err := writeTempFile(certPath, b)
+	if err != nil {
+		os.Remove(keyTmp)
+		return fmt.Errorf("unable to write pki.cert file %s: %s", certPath, err)
+	}
+
+	if err = os.Rename(keyTmp, keyPath); err != nil {
+		os.Remove(keyTmp)
+		os.Remove(certTmp)
+		return fmt.Errorf("unable to replace pki.key file %s: %s", keyPath, err)
+	}
+
+	if err = os.Rename(certTmp, certPath); err != nil {
+		os.Remove(certTmp)
+		return fmt.Errorf("unable to replace pki.cert file %s: %s", certPath, err)
+	}
+
+	return nil
+}
+
+// marshalKey PEM encodes the renewed key, wrapping it with pki.key_wrap when set. A wrapped key on disk is never
+// replaced with a plaintext one.
+func (r *certRenewer) marshalKey(keyPath string, cs *CertState) ([]byte, error) {
+	b := cert.MarshalPrivateKey(cs.Certificate.Details.Curve, cs.PrivateKey)
+	if r.c.GetString("pki.key_wrap", "") == "" {
+		if old, err := os.ReadFile(keyPath); err == nil && cert.IsWrappedPrivateKey(old) {
+			return nil, errors.New("pki.key is wrapped, pki.key_wrap must be set to save a renewed key")
+		}
+		return b, nil
+	}
+
+	b, err := wrapPKIKey(r.c, b)
+	if err != nil {
+		return nil, fmt.Errorf("error while wrapping renewed key: %s", err)
+	}
+	return b, nil
+}
+
+// writeTempFile writes b to a new file next to path so it can be renamed over path
+func writeTempFile(path string, b []byte) (string, error) {
+	f, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return "", err
+	}
+
+	if _, err = f.Write(b); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return "", err
+	}
+
+	if err = f.Close(); err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+
+	return f.Name(), nil
+}
@@ -0,0 +1,107 @@
+package nebula
+
+import (
+	"context"
+	"crypto/rand"
+	"net"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/slackhq/nebula/cert"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/enroll"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ed25519"
+)
+
+func TestCertRenewer(t *testing.T) {
+	l := test.NewLogger()
+
+	caPub, caKey, _ := ed25519.GenerateKey(rand.Reader)
+	ca := &cert.NebulaCertificate{
+		Details: cert.NebulaCertificateDetails{
+			Name:      "ca",
+			NotBefore: time.Now().Add(-time.Minute),
+			NotAfter:  time.Now().Add(time.Hour * 24 * 365),
+			PublicKey: caPub,
+			IsCA:      true,
+		},
+	}
+	require.NoError(t, ca.Sign(cert.Curve_CURVE25519, caKey))
+	caPEM, _ := ca.MarshalToPEM()
+	caPool, err := cert.NewCAPoolFromBytes(caPEM)
+	require.NoError(t, err)
+
+	// httptest listens on loopback so our certificate address needs to be there to look like it came over the mesh
+	_, ipNet, _ := net.ParseCIDR("127.0.0.0/8")
+	ipNet.IP = net.ParseIP("127.0.0.1").To4()
+	s, err := enroll.NewServer(l, ca, caKey, enroll.NewTokenAuthorizer(map[string]*enroll.Grant{
+		"token": {Name: "node", Ips: []*net.IPNet{ipNet}, Duration: time.Hour * 24 * 7},
+	}))
+	require.NoError(t, err)
+	s.EnableRenewal()
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	pub, priv, err := enroll.NewKeypair(cert.Curve_CURVE25519)
+	require.NoError(t, err)
+	res, err := enroll.Enroll(context.Background(), ts.Client(), ts.URL, "token", cert.Curve_CURVE25519, pub, caPool)
+	require.NoError(t, err)
+	cs, err := newCertState(res.Certificate, priv)
+	require.NoError(t, err)
+
+	pki := &PKI{l: l}
+	pki.cs.Store(cs)
+	pki.caPool.Store(caPool)
+
+	dir := t.TempDir()
+	c := config.NewC(l)
+	c.Settings["pki"] = map[interface{}]interface{}{
+		"cert": filepath.Join(dir, "host.crt"),
+		"key":  filepath.Join(dir, "host.key"),
+	}
+
+	// Nothing to do without a url
+	assert.Nil(t, newCertRenewerFromConfig(l, pki, c))
+
+	c.Settings["pki"].(map[interface{}]interface{})["enroll"] = map[interface{}]interface{}{"url": ts.URL}
+	r := newCertRenewerFromConfig(l, pki, c)
+	require.NotNil(t, r)
+	assert.Equal(t, defaultRenewBefore, r.before)
+	assert.Equal(t, defaultRenewInterval, r.interval)
+
+	c.Settings["pki"].(map[interface{}]interface{})["renew"] = map[interface{}]interface{}{"enabled": false}
+	assert.Nil(t, newCertRenewerFromConfig(l, pki, c))
+	c.Settings["pki"].(map[interface{}]interface{})["renew"] = map[interface{}]interface{}{"before": "72h"}
+	r = newCertRenewerFromConfig(l, pki, c)
+	require.NotNil(t, r)
+	r.client = ts.Client()
+
+	// A week out is not within 72h
+	require.NoError(t, r.renewIfNeeded(context.Background(), time.Now()))
+	assert.Same(t, cs, pki.GetCertState())
+	_, err = os.Stat(filepath.Join(dir, "host.crt"))
+	assert.ErrorIs(t, err, os.ErrNotExist)
+
+	// 5 days later it is
+	require.NoError(t, r.renewIfNeeded(context.Background(), time.Now().Add(time.Hour*24*5)))
+	ncs := pki.GetCertState()
+	assert.NotSame(t, cs, ncs)
+	assert.Equal(t, "node", ncs.Certificate.Details.Name)
+	assert.NotEqual(t, cs.PrivateKey, ncs.PrivateKey)
+	assert.NoError(t, ncs.Certificate.VerifyPrivateKey(cert.Curve_CURVE25519, ncs.PrivateKey))
+
+	// The renewed pair was written out so a reload picks it up
+	fcs, err := newCertStateFromConfig(c)
+	require.NoError(t, err)
+	assert.Equal(t, ncs.Certificate.Signature, fcs.Certificate.Signature)
+	assert.Equal(t, ncs.PrivateKey, fcs.PrivateKey)
+
+	matches, _ := filepath.Glob(filepath.Join(dir, ".*"))
+	assert.Empty(t, matches)
+}
@@ -1,189 +1,222 @@
 package cidr
 
 import (
+	"encoding/binary"
 	"net"
 
 	"github.com/slackhq/nebula/iputil"
 )
 
-const startbit6 = uint64(1 << 63)
+type Node[T any] struct {
+	left     *Node[T]
+	right    *Node[T]
+	parent   *Node[T]
+	hasValue bool
+	value    T
+}
+
+type entry[T any] struct {
+	CIDR  *net.IPNet
+	Value T
+}
 
+// Tree6 holds values for ipv4 and ipv6 cidrs, an address only ever matches cidrs of its own family
 type Tree6[T any] struct {
 	root4 *Node[T]
 	root6 *Node[T]
+	list  []entry[T]
 }
 
 func NewTree6[T any]() *Tree6[T] {
 	tree := new(Tree6[T])
 	tree.root4 = &Node[T]{}
 	tree.root6 = &Node[T]{}
+	tree.list = []entry[T]{}
 	return tree
 }
 
-func (tree *Tree6[T]) AddCIDR(cidr *net.IPNet, val T) {
-	var node, next *Node[T]
+// key is an address as the tree walks it, the bits of its family from the most significant down
+type key struct {
+	w    [2]uint64
+	bits int
+}
 
-	cidrIP, ipv4 := isIPV4(cidr.IP)
-	if ipv4 {
-		node = tree.root4
-		next = tree.root4
+func (k *key) bit(i int) bool {
+	return k.w[i>>6]&(1<<(63-i&63)) != 0
+}
 
-	} else {
-		node = tree.root6
-		next = tree.root6
+func (tree *Tree6[T]) start(ip iputil.VpnIp) (*Node[T], key) {
+	if ip.Is4() {
+		return tree.root4, key{w: [2]uint64{uint64(ip.Uint32()) << 32}, bits: 32}
 	}
+	b := ip.As16()
+	return tree.root6, key{w: [2]uint64{binary.BigEndian.Uint64(b[:8]), binary.BigEndian.Uint64(b[8:])}, bits: 128}
+}
 
-	for i := 0; i < len(cidrIP); i += 4 {
-		ip := iputil.Ip2VpnIp(cidrIP[i : i+4])
-		mask := iputil.Ip2VpnIp(cidr.Mask[i : i+4])
-		bit := startbit
-
-		// Find our last ancestor in the tree
-		for bit&mask != 0 {
-			if ip&bit != 0 {
-				next = node.right
-			} else {
-				next = node.left
-			}
+// startCIDR returns where cidr starts in the tree and how many of the key bits it covers
+func (tree *Tree6[T]) startCIDR(cidr *net.IPNet) (*Node[T], key, int) {
+	ip := iputil.Ip2VpnIp(cidr.IP)
+	ones, bits := cidr.Mask.Size()
+	if ip.Is4() && bits == 8*net.IPv6len {
+		ones -= 8 * (net.IPv6len - net.IPv4len)
+	}
+	node, k := tree.start(ip)
+	return node, k, max(ones, 0)
+}
+
+func (tree *Tree6[T]) AddCIDR(cidr *net.IPNet, val T) {
+	node, k, ones := tree.startCIDR(cidr)
+
+	// Find our last ancestor in the tree
+	i := 0
+	for ; i < ones; i++ {
+		next := node.left
+		if k.bit(i) {
+			next = node.right
+		}
+		if next == nil {
+			break
+		}
+		node = next
+	}
 
-			if next == nil {
+	// We already have this range so update the value
+	if i == ones {
+		addCIDR := cidr.String()
+		for i, v := range tree.list {
+			if addCIDR == v.CIDR.String() {
+				tree.list = append(tree.list[:i], tree.list[i+1:]...)
 				break
 			}
-
-			bit = bit >> 1
-			node = next
 		}
 
-		// Build up the rest of the tree we don't already have
-		for bit&mask != 0 {
-			next = &Node[T]{}
-			next.parent = node
-
-			if ip&bit != 0 {
-				node.right = next
-			} else {
-				node.left = next
-			}
+		tree.list = append(tree.list, entry[T]{CIDR: cidr, Value: val})
+		node.value = val
+		node.hasValue = true
+		return
+	}
 
-			bit >>= 1
-			node = next
+	// Build up the rest of the tree we don't already have
+	for ; i < ones; i++ {
+		next := &Node[T]{parent: node}
+		if k.bit(i) {
+			node.right = next
+		} else {
+			node.left = next
 		}
+		node = next
 	}
 
 	// Final node marks our cidr, set the value
 	node.value = val
 	node.hasValue = true
+	tree.list = append(tree.list, entry[T]{CIDR: cidr, Value: val})
 }
 
-// Finds the most specific match
-func (tree *Tree6[T]) MostSpecificContains(ip net.IP) (ok bool, value T) {
-	var node *Node[T]
-
-	wholeIP, ipv4 := isIPV4(ip)
-	if ipv4 {
-		node = tree.root4
-	} else {
-		node = tree.root6
-	}
-
-	for i := 0; i < len(wholeIP); i += 4 {
-		ip := iputil.Ip2VpnIp(wholeIP[i : i+4])
-		bit := startbit
+// Contains finds the first match, which may be the least specific
+func (tree *Tree6[T]) Contains(ip iputil.VpnIp) (ok bool, value T) {
+	node, k := tree.start(ip)
 
-		for node != nil {
-			if node.hasValue {
-				value = node.value
-				ok = true
-			}
-
-			if bit == 0 {
-				break
-			}
-
-			if ip&bit != 0 {
-				node = node.right
-			} else {
-				node = node.left
-			}
+	for i := 0; node != nil; i++ {
+		if node.hasValue {
+			return true, node.value
+		}
+		if i == k.bits {
+			break
+		}
 
-			bit >>= 1
+		if k.bit(i) {
+			node = node.right
+		} else {
+			node = node.left
 		}
 	}
 
-	return ok, value
+	return false, value
 }
 
-func (tree *Tree6[T]) MostSpecificContainsIpV4(ip iputil.VpnIp) (ok bool, value T) {
-	bit := startbit
-	node := tree.root4
+// MostSpecificContains finds the most specific match
+func (tree *Tree6[T]) MostSpecificContains(ip iputil.VpnIp) (ok bool, value T) {
+	node, k := tree.start(ip)
 
-	for node != nil {
+	for i := 0; node != nil; i++ {
 		if node.hasValue {
 			value = node.value
 			ok = true
 		}
+		if i == k.bits {
+			break
+		}
 
-		if ip&bit != 0 {
+		if k.bit(i) {
 			node = node.right
 		} else {
 			node = node.left
 		}
-
-		bit >>= 1
 	}
 
 	return ok, value
 }
 
+// MostSpecificContainsIpV6 is MostSpecificContains for an ipv6 address in the two halves lighthouse messages carry
+// it in
 func (tree *Tree6[T]) MostSpecificContainsIpV6(hi, lo uint64) (ok bool, value T) {
-	ip := hi
-	node := tree.root6
+	var b [16]byte
+	binary.BigEndian.PutUint64(b[:8], hi)
+	binary.BigEndian.PutUint64(b[8:], lo)
+	return tree.MostSpecificContains(iputil.VpnIpFrom16(b))
+}
 
-	for i := 0; i < 2; i++ {
-		bit := startbit6
+type eachFunc[T any] func(T) bool
 
-		for node != nil {
-			if node.hasValue {
-				value = node.value
-				ok = true
-			}
+// EachContains will call a function, passing the value, for each entry until the function returns true or the search is complete
+// The final return value will be true if the provided function returned true
+func (tree *Tree6[T]) EachContains(ip iputil.VpnIp, each eachFunc[T]) bool {
+	node, k := tree.start(ip)
 
-			if bit == 0 {
-				break
-			}
-
-			if ip&bit != 0 {
-				node = node.right
-			} else {
-				node = node.left
+	for i := 0; node != nil; i++ {
+		if node.hasValue {
+			// If the each func returns true then we can exit the loop
+			if each(node.value) {
+				return true
 			}
-
-			bit >>= 1
+		}
+		if i == k.bits {
+			break
 		}
 
-		ip = lo
+		if k.bit(i) {
+			node = node.right
+		} else {
+			node = node.left
+		}
 	}
 
-	return ok, value
+	return false
 }
 
-func isIPV4(ip net.IP) (net.IP, bool) {
-	if len(ip) == net.IPv4len {
-		return ip, true
+// GetCIDR returns the entry added by the most recent matching AddCIDR call
+func (tree *Tree6[T]) GetCIDR(cidr *net.IPNet) (ok bool, value T) {
+	node, k, ones := tree.startCIDR(cidr)
+
+	// Find our last ancestor in the tree
+	for i := 0; node != nil && i < ones; i++ {
+		if k.bit(i) {
+			node = node.right
+		} else {
+			node = node.left
+		}
 	}
 
-	if len(ip) == net.IPv6len && isZeros(ip[0:10]) && ip[10] == 0xff && ip[11] == 0xff {
-		return ip[12:16], true
+	if node != nil {
+		value = node.value
+		ok = node.hasValue
 	}
 
-	return ip, false
+	return ok, value
 }
 
-func isZeros(p net.IP) bool {
-	for i := 0; i < len(p); i++ {
-		if p[i] != 0 {
-			return false
-		}
-	}
-	return true
+// List will return all CIDRs and their current values. Do not modify the contents!
+func (tree *Tree6[T]) List() []entry[T] {
+	return tree.list
 }
@@ -5,10 +5,11 @@ import (
 	"net"
 	"testing"
 
+	"github.com/slackhq/nebula/iputil"
 	"github.com/stretchr/testify/assert"
 )
 
-func TestCIDR6Tree_MostSpecificContains(t *testing.T) {
+func TestTree6_MostSpecificContains(t *testing.T) {
 	tree := NewTree6[string]()
 	tree.AddCIDR(Parse("1.0.0.0/8"), "1")
 	tree.AddCIDR(Parse("2.1.0.0/16"), "2")
@@ -45,7 +46,7 @@ func TestCIDR6Tree_MostSpecificContains(t *testing.T) {
 	}
 
 	for _, tt := range tests {
-		ok, r := tree.MostSpecificContains(net.ParseIP(tt.IP))
+		ok, r := tree.MostSpecificContains(iputil.Ip2VpnIp(net.ParseIP(tt.IP)))
 		assert.Equal(t, tt.Found, ok)
 		assert.Equal(t, tt.Result, r)
 	}
@@ -53,24 +54,24 @@ func TestCIDR6Tree_MostSpecificContains(t *testing.T) {
 	tree = NewTree6[string]()
 	tree.AddCIDR(Parse("1.1.1.1/0"), "cool")
 	tree.AddCIDR(Parse("::/0"), "cool6")
-	ok, r := tree.MostSpecificContains(net.ParseIP("0.0.0.0"))
+	ok, r := tree.MostSpecificContains(iputil.Ip2VpnIp(net.ParseIP("0.0.0.0")))
 	assert.True(t, ok)
 	assert.Equal(t, "cool", r)
 
-	ok, r = tree.MostSpecificContains(net.ParseIP("255.255.255.255"))
+	ok, r = tree.MostSpecificContains(iputil.Ip2VpnIp(net.ParseIP("255.255.255.255")))
 	assert.True(t, ok)
 	assert.Equal(t, "cool", r)
 
-	ok, r = tree.MostSpecificContains(net.ParseIP("::"))
+	ok, r = tree.MostSpecificContains(iputil.Ip2VpnIp(net.ParseIP("::")))
 	assert.True(t, ok)
 	assert.Equal(t, "cool6", r)
 
-	ok, r = tree.MostSpecificContains(net.ParseIP("1:2:3:4:5:6:7:8"))
+	ok, r = tree.MostSpecificContains(iputil.Ip2VpnIp(net.ParseIP("1:2:3:4:5:6:7:8")))
 	assert.True(t, ok)
 	assert.Equal(t, "cool6", r)
 }
 
-func TestCIDR6Tree_MostSpecificContainsIpV6(t *testing.T) {
+func TestTree6_MostSpecificContainsIpV6(t *testing.T) {
 	tree := NewTree6[string]()
 	tree.AddCIDR(Parse("1:2:0:4:5:0:0:0/64"), "6a")
 	tree.AddCIDR(Parse("1:2:0:4:5:0:0:0/80"), "6b")
@@ -96,3 +97,129 @@ func TestCIDR6Tree_MostSpecificContainsIpV6(t *testing.T) {
 		assert.Equal(t, tt.Result, r)
 	}
 }
+
+func TestTree6_List(t *testing.T) {
+	tree := NewTree6[string]()
+	tree.AddCIDR(Parse("1.0.0.0/16"), "1")
+	tree.AddCIDR(Parse("1.0.0.0/8"), "2")
+	tree.AddCIDR(Parse("1.0.0.0/16"), "3")
+	tree.AddCIDR(Parse("1.0.0.0/16"), "4")
+	list := tree.List()
+	assert.Len(t, list, 2)
+	assert.Equal(t, "1.0.0.0/8", list[0].CIDR.String())
+	assert.Equal(t, "2", list[0].Value)
+	assert.Equal(t, "1.0.0.0/16", list[1].CIDR.String())
+	assert.Equal(t, "4", list[1].Value)
+}
+
+func TestTree6_Contains(t *testing.T) {
+	tree := NewTree6[string]()
+	tree.AddCIDR(Parse("1.0.0.0/8"), "1")
+	tree.AddCIDR(Parse("2.1.0.0/16"), "2")
+	tree.AddCIDR(Parse("3.1.1.0/24"), "3")
+	tree.AddCIDR(Parse("4.1.1.0/24"), "4a")
+	tree.AddCIDR(Parse("4.1.1.1/32"), "4b")
+	tree.AddCIDR(Parse("4.1.2.1/32"), "4c")
+	tree.AddCIDR(Parse("254.0.0.0/4"), "5")
+	tree.AddCIDR(Parse("fd00::/8"), "6a")
+	tree.AddCIDR(Parse("fd00::/64"), "6b")
+
+	tests := []struct {
+		Found  bool
+		Result interface{}
+		IP     string
+	}{
+		{true, "6a", "fd00::1"},
+		{true, "6a", "fdff::1"},
+		{false, "", "fe00::1"},
+		// An ipv4 address never matches an ipv6 cidr and the other way around
+		{false, "", "::1.0.0.1"},
+		{true, "1", "::ffff:1.0.0.1"},
+		{true, "1", "1.0.0.0"},
+		{true, "1", "1.255.255.255"},
+		{true, "2", "2.1.0.0"},
+		{true, "2", "2.1.255.255"},
+		{true, "3", "3.1.1.0"},
+		{true, "3", "3.1.1.255"},
+		{true, "4a", "4.1.1.255"},
+		{true, "4a", "4.1.1.1"},
+		{true, "5", "240.0.0.0"},
+		{true, "5", "255.255.255.255"},
+		{false, "", "239.0.0.0"},
+		{false, "", "4.1.2.2"},
+	}
+
+	for _, tt := range tests {
+		ok, r := tree.Contains(iputil.Ip2VpnIp(net.ParseIP(tt.IP)))
+		assert.Equal(t, tt.Found, ok)
+		assert.Equal(t, tt.Result, r)
+	}
+
+	tree = NewTree6[string]()
+	tree.AddCIDR(Parse("1.1.1.1/0"), "cool")
+	ok, r := tree.Contains(iputil.Ip2VpnIp(net.ParseIP("0.0.0.0")))
+	assert.True(t, ok)
+	assert.Equal(t, "cool", r)
+
+	ok, r = tree.Contains(iputil.Ip2VpnIp(net.ParseIP("255.255.255.255")))
+	assert.True(t, ok)
+	assert.Equal(t, "cool", r)
+}
+
+func TestTree6_GetCIDR(t *testing.T) {
+	tree := NewTree6[string]()
+	tree.AddCIDR(Parse("1.0.0.0/8"), "1")
+	tree.AddCIDR(Parse("2.1.0.0/16"), "2")
+	tree.AddCIDR(Parse("3.1.1.0/24"), "3")
+	tree.AddCIDR(Parse("4.1.1.0/24"), "4a")
+	tree.AddCIDR(Parse("4.1.1.1/32"), "4b")
+	tree.AddCIDR(Parse("4.1.2.1/32"), "4c")
+	tree.AddCIDR(Parse("254.0.0.0/4"), "5")
+	tree.AddCIDR(Parse("fd00::/64"), "6")
+
+	tests := []struct {
+		Found  bool
+		Result interface{}
+		IPNet  *net.IPNet
+	}{
+		{true, "1", Parse("1.0.0.0/8")},
+		{true, "2", Parse("2.1.0.0/16")},
+		{true, "3", Parse("3.1.1.0/24")},
+		{true, "4a", Parse("4.1.1.0/24")},
+		{true, "4b", Parse("4.1.1.1/32")},
+		{true, "4c", Parse("4.1.2.1/32")},
+		{true, "5", Parse("254.0.0.0/4")},
+		{true, "6", Parse("fd00::/64")},
+		{false, "", Parse("2.0.0.0/8")},
+		{false, "", Parse("fd00::/8")},
+		{false, "", Parse("::ffff:0:0/96")},
+	}
+
+	for _, tt := range tests {
+		ok, r := tree.GetCIDR(tt.IPNet)
+		assert.Equal(t, tt.Found, ok)
+		assert.Equal(t, tt.Result, r)
+	}
+}
+
+func BenchmarkTree6_Contains(b *testing.B) {
+	tree := NewTree6[string]()
+	tree.AddCIDR(Parse("1.1.0.0/16"), "1")
+	tree.AddCIDR(Parse("1.2.1.1/32"), "1")
+	tree.AddCIDR(Parse("192.2.1.1/32"), "1")
+	tree.AddCIDR(Parse("172.2.1.1/32"), "1")
+
+	ip := iputil.Ip2VpnIp(net.ParseIP("1.2.1.1"))
+	b.Run("found", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			tree.Contains(ip)
+		}
+	})
+
+	ip = iputil.Ip2VpnIp(net.ParseIP("1.2.1.255"))
+	b.Run("not found", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			tree.Contains(ip)
+		}
+	})
+}
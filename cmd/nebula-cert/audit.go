@@ -0,0 +1,375 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/slackhq/nebula/cert"
+)
+
+type auditFlags struct {
+	set    *flag.FlagSet
+	dir    *string
+	caPath *string
+	within *string
+	json   *bool
+}
+
+func newAuditFlags() *auditFlags {
+	af := auditFlags{set: flag.NewFlagSet("audit", flag.ContinueOnError)}
+	af.set.Usage = func() {}
+	af.dir = af.set.String("dir", "", "Required: path to a directory to search for certificates, subdirectories are included")
+	af.caPath = af.set.String("ca", "", "Optional: path to a file containing one or more trusted ca certificates. The default is to trust any ca certificate found in dir")
+	af.within = af.set.String("within", "30d", "Optional: report certificates that expire within this long. Valid time units are days: \"d\", hours: \"h\", minutes: \"m\", seconds: \"s\"")
+	af.json = af.set.Bool("json", false, "Optional: outputs the report in json format")
+	return &af
+}
+
+// auditCert is a certificate found while walking the audit directory
+type auditCert struct {
+	Path string
+	Cert *cert.NebulaCertificate
+}
+
+type auditExpiring struct {
+	Path     string    `json:"path"`
+	Name     string    `json:"name"`
+	IsCA     bool      `json:"isCa"`
+	NotAfter time.Time `json:"notAfter"`
+	Expired  bool      `json:"expired"`
+}
+
+type auditUnknownCA struct {
+	Path   string `json:"path"`
+	Name   string `json:"name"`
+	Issuer string `json:"issuer"`
+	Reason string `json:"reason"`
+}
+
+type auditOverlap struct {
+	Paths   [2]string `json:"paths"`
+	Names   [2]string `json:"names"`
+	Network string    `json:"network"`
+}
+
+type auditReport struct {
+	Certificates int              `json:"certificates"`
+	Expiring     []auditExpiring  `json:"expiring"`
+	UnknownCA    []auditUnknownCA `json:"unknownCa"`
+	Overlapping  []auditOverlap   `json:"overlapping"`
+}
+
+func (r *auditReport) issues() int {
+	return len(r.Expiring) + len(r.UnknownCA) + len(r.Overlapping)
+}
+
+func audit(args []string, out io.Writer, errOut io.Writer) error {
+	af := newAuditFlags()
+	err := af.set.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	if err := mustFlagString("dir", af.dir); err != nil {
+		return err
+	}
+
+	within, err := parseAuditDuration(*af.within)
+	if err != nil {
+		return newHelpErrorf("invalid within: %s", err)
+	}
+
+	certs, err := readAuditCerts(*af.dir, errOut)
+	if err != nil {
+		return err
+	}
+
+	cas := map[string]*cert.NebulaCertificate{}
+	if *af.caPath != "" {
+		rawCA, err := os.ReadFile(*af.caPath)
+		if err != nil {
+			return fmt.Errorf("error while reading ca: %s", err)
+		}
+
+		for {
+			var c *cert.NebulaCertificate
+			c, rawCA, err = cert.UnmarshalNebulaCertificateFromPEM(rawCA)
+			if err != nil {
+				return fmt.Errorf("error while parsing ca: %s", err)
+			}
+
+			if err := addAuditCA(cas, c); err != nil {
+				return fmt.Errorf("error while parsing ca: %s", err)
+			}
+
+			if len(rawCA) == 0 || strings.TrimSpace(string(rawCA)) == "" {
+				break
+			}
+		}
+	} else {
+		for _, ac := range certs {
+			if ac.Cert.Details.IsCA {
+				// Failures here are reported below as a ca that can not be found
+				_ = addAuditCA(cas, ac.Cert)
+			}
+		}
+	}
+
+	report := buildAuditReport(certs, cas, time.Now(), within)
+
+	if *af.json {
+		b, _ := json.Marshal(report)
+		out.Write(b)
+		out.Write([]byte("\n"))
+	} else {
+		writeAuditReport(out, report)
+	}
+
+	if n := report.issues(); n > 0 {
+		return fmt.Errorf("audit found %d issues", n)
+	}
+
+	return nil
+}
+
+// parseAuditDuration accepts anything time.ParseDuration does as well as a whole number of days, ie: 30d
+func parseAuditDuration(s string) (time.Duration, error) {
+	if d, ok := strings.CutSuffix(s, "d"); ok {
+		days, err := strconv.Atoi(d)
+		if err != nil {
+			return 0, fmt.Errorf("invalid number of days: %s", s)
+		}
+		return time.Duration(days) * 24 * time.Hour, nil
+	}
+
+	return time.ParseDuration(s)
+}
+
+// readAuditCerts finds every nebula certificate in a PEM file under dir. Files that are not PEM, like private keys
+// in other formats, are skipped as are PEM blocks that are not certificates.
+func readAuditCerts(dir string, errOut io.Writer) ([]auditCert, error) {
+	var certs []auditCert
+
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if !d.Type().IsRegular() {
+			return nil
+		}
+
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+
+		for {
+			var p *pem.Block
+			p, b = pem.Decode(b)
+			if p == nil {
+				break
+			}
+
+			if p.Type != cert.CertBanner {
+				continue
+			}
+
+			c, err := cert.UnmarshalNebulaCertificate(p.Bytes)
+			if err != nil {
+				fmt.Fprintf(errOut, "Skipping invalid certificate in %s: %s\n", path, err)
+				continue
+			}
+
+			certs = append(certs, auditCert{Path: path, Cert: c})
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error while reading dir: %s", err)
+	}
+
+	return certs, nil
+}
+
+func addAuditCA(cas map[string]*cert.NebulaCertificate, c *cert.NebulaCertificate) error {
+	if !c.Details.IsCA {
+		return fmt.Errorf("%s is not a ca certificate", c.Details.Name)
+	}
+
+	fp, err := c.Fingerprint()
+	if err != nil {
+		return err
+	}
+
+	cas[fp] = c
+	return nil
+}
+
+func buildAuditReport(certs []auditCert, cas map[string]*cert.NebulaCertificate, now time.Time, within time.Duration) *auditReport {
+	report := &auditReport{
+		Certificates: len(certs),
+		Expiring:     []auditExpiring{},
+		UnknownCA:    []auditUnknownCA{},
+		Overlapping:  []auditOverlap{},
+	}
+
+	cutoff := now.Add(within)
+	for _, ac := range certs {
+		d := ac.Cert.Details
+		if d.NotAfter.Before(cutoff) {
+			report.Expiring = append(report.Expiring, auditExpiring{
+				Path:     ac.Path,
+				Name:     d.Name,
+				IsCA:     d.IsCA,
+				NotAfter: d.NotAfter,
+				Expired:  ac.Cert.Expired(now),
+			})
+		}
+
+		if d.IsCA {
+			continue
+		}
+
+		ca, ok := cas[d.Issuer]
+		if !ok {
+			report.UnknownCA = append(report.UnknownCA, auditUnknownCA{
+				Path:   ac.Path,
+				Name:   d.Name,
+				Issuer: d.Issuer,
+				Reason: "issuer not found",
+			})
+		} else if !ac.Cert.CheckSignature(ca.Details.PublicKey) {
+			report.UnknownCA = append(report.UnknownCA, auditUnknownCA{
+				Path:   ac.Path,
+				Name:   d.Name,
+				Issuer: d.Issuer,
+				Reason: "signature does not match issuer",
+			})
+		}
+	}
+
+	// Copies of the same host certs, like backups, would repeat the same overlap so only the first is reported
+	seen := map[[3]string]struct{}{}
+	for i := 0; i < len(certs); i++ {
+		a := certs[i].Cert
+		if a.Details.IsCA {
+			continue
+		}
+
+		for j := i + 1; j < len(certs); j++ {
+			b := certs[j].Cert
+			// The same name is treated as the same host, like a renewed cert sitting next to a backup of the old one
+			if b.Details.IsCA || a.Details.Name == b.Details.Name {
+				continue
+			}
+
+			for _, network := range findAuditOverlaps(a, b) {
+				k := [3]string{a.Details.Name, b.Details.Name, network}
+				if k[0] > k[1] {
+					k[0], k[1] = k[1], k[0]
+				}
+				if _, ok := seen[k]; ok {
+					continue
+				}
+				seen[k] = struct{}{}
+
+				report.Overlapping = append(report.Overlapping, auditOverlap{
+					Paths:   [2]string{certs[i].Path, certs[j].Path},
+					Names:   [2]string{a.Details.Name, b.Details.Name},
+					Network: network,
+				})
+			}
+		}
+	}
+
+	sort.SliceStable(report.Expiring, func(i, j int) bool {
+		return report.Expiring[i].NotAfter.Before(report.Expiring[j].NotAfter)
+	})
+
+	return report
+}
+
+// findAuditOverlaps returns the addresses assigned to both certificates and the subnets they both claim to route
+func findAuditOverlaps(a, b *cert.NebulaCertificate) []string {
+	var overlaps []string
+
+	for _, aip := range a.Details.Ips {
+		for _, bip := range b.Details.Ips {
+			if aip.IP.Equal(bip.IP) {
+				overlaps = append(overlaps, aip.IP.String())
+			}
+		}
+	}
+
+	for _, as := range a.Details.Subnets {
+		for _, bs := range b.Details.Subnets {
+			if as.Contains(bs.IP) || bs.Contains(as.IP) {
+				overlaps = append(overlaps, smallerNetwork(as, bs).String())
+			}
+		}
+	}
+
+	return overlaps
+}
+
+func smallerNetwork(a, b *net.IPNet) *net.IPNet {
+	aOnes, _ := a.Mask.Size()
+	bOnes, _ := b.Mask.Size()
+	if aOnes >= bOnes {
+		return a
+	}
+	return b
+}
+
+func writeAuditReport(out io.Writer, r *auditReport) {
+	fmt.Fprintf(out, "Checked %d certificates\n", r.Certificates)
+
+	if len(r.Expiring) > 0 {
+		fmt.Fprintln(out, "\nExpiring certificates:")
+		for _, e := range r.Expiring {
+			state := "expires"
+			if e.Expired {
+				state = "expired"
+			}
+			fmt.Fprintf(out, "  %s: %s %s %s\n", e.Path, e.Name, state, e.NotAfter.Format(time.RFC3339))
+		}
+	}
+
+	if len(r.UnknownCA) > 0 {
+		fmt.Fprintln(out, "\nUnknown CA:")
+		for _, u := range r.UnknownCA {
+			fmt.Fprintf(out, "  %s: %s issuer %s, %s\n", u.Path, u.Name, u.Issuer, u.Reason)
+		}
+	}
+
+	if len(r.Overlapping) > 0 {
+		fmt.Fprintln(out, "\nOverlapping networks:")
+		for _, o := range r.Overlapping {
+			fmt.Fprintf(out, "  %s: %s (%s) and %s (%s)\n", o.Network, o.Names[0], o.Paths[0], o.Names[1], o.Paths[1])
+		}
+	}
+}
+
+func auditSummary() string {
+	return "audit <flags>: reports certificates in a directory that are expiring, signed by an unknown authority, or have overlapping networks"
+}
+
+func auditHelp(out io.Writer) {
+	af := newAuditFlags()
+	out.Write([]byte("Usage of " + os.Args[0] + " " + auditSummary() + "\n"))
+	af.set.SetOutput(out)
+	af.set.PrintDefaults()
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/slackhq/nebula/cert"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ed25519"
+)
+
+func Test_auditSummary(t *testing.T) {
+	assert.Equal(t, "audit <flags>: reports certificates in a directory that are expiring, signed by an unknown authority, or have overlapping networks", auditSummary())
+}
+
+func Test_auditHelp(t *testing.T) {
+	ob := &bytes.Buffer{}
+	auditHelp(ob)
+	assert.Equal(
+		t,
+		"Usage of "+os.Args[0]+" audit <flags>: reports certificates in a directory that are expiring, signed by an unknown authority, or have overlapping networks\n"+
+			"  -ca string\n"+
+			"    \tOptional: path to a file containing one or more trusted ca certificates. The default is to trust any ca certificate found in dir\n"+
+			"  -dir string\n"+
+			"    \tRequired: path to a directory to search for certificates, subdirectories are included\n"+
+			"  -json\n"+
+			"    \tOptional: outputs the report in json format\n"+
+			"  -within string\n"+
+			"    \tOptional: report certificates that expire within this long. Valid time units are days: \"d\", hours: \"h\", minutes: \"m\", seconds: \"s\" (default \"30d\")\n",
+		ob.String(),
+	)
+}
+
+func Test_parseAuditDuration(t *testing.T) {
+	d, err := parseAuditDuration("30d")
+	assert.Nil(t, err)
+	assert.Equal(t, 30*24*time.Hour, d)
+
+	d, err = parseAuditDuration("90m")
+	assert.Nil(t, err)
+	assert.Equal(t, 90*time.Minute, d)
+
+	_, err = parseAuditDuration("xd")
+	assert.EqualError(t, err, "invalid number of days: xd")
+}
+
+func Test_audit(t *testing.T) {
+	ob := &bytes.Buffer{}
+	eb := &bytes.Buffer{}
+
+	// required args
+	assertHelpError(t, audit([]string{}, ob, eb), "-dir is required")
+	assertHelpError(t, audit([]string{"-dir", "./nope", "-within", "soon"}, ob, eb), "invalid within: time: invalid duration \"soon\"")
+
+	dir := t.TempDir()
+	writeCA := func(name string) (*cert.NebulaCertificate, ed25519.PrivateKey) {
+		pub, priv, _ := ed25519.GenerateKey(rand.Reader)
+		ca := cert.NebulaCertificate{
+			Details: cert.NebulaCertificateDetails{
+				Name:      name,
+				NotBefore: time.Now(),
+				NotAfter:  time.Now().Add(time.Hour * 24 * 365),
+				PublicKey: pub,
+				IsCA:      true,
+			},
+		}
+		require.NoError(t, ca.Sign(cert.Curve_CURVE25519, priv))
+		b, _ := ca.MarshalToPEM()
+		require.NoError(t, os.WriteFile(filepath.Join(dir, name+".crt"), b, 0600))
+		return &ca, priv
+	}
+
+	writeCert := func(path, name, ip, subnet string, ca *cert.NebulaCertificate, caKey ed25519.PrivateKey, lifetime time.Duration) {
+		issuer, _ := ca.Sha256Sum()
+		pub, _ := x25519Keypair()
+		ipAddr, ipNet, _ := net.ParseCIDR(ip)
+		ipNet.IP = ipAddr
+		nc := cert.NebulaCertificate{
+			Details: cert.NebulaCertificateDetails{
+				Name:      name,
+				Ips:       []*net.IPNet{ipNet},
+				NotBefore: time.Now().Add(-time.Hour),
+				NotAfter:  time.Now().Add(lifetime),
+				PublicKey: pub,
+				Issuer:    issuer,
+			},
+		}
+		if subnet != "" {
+			_, s, _ := net.ParseCIDR(subnet)
+			nc.Details.Subnets = []*net.IPNet{s}
+		}
+		require.NoError(t, nc.Sign(cert.Curve_CURVE25519, caKey))
+		b, _ := nc.MarshalToPEM()
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0700))
+		require.NoError(t, os.WriteFile(path, b, 0600))
+	}
+
+	ca, caKey := writeCA("ca")
+	writeCert(filepath.Join(dir, "a.crt"), "a", "10.0.0.1/24", "192.168.0.0/16", ca, caKey, time.Hour*24*90)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "a.key"), cert.MarshalX25519PrivateKey(make([]byte, 32)), 0600))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "notes.txt"), []byte("not a cert"), 0600))
+
+	// a clean directory
+	ob.Reset()
+	eb.Reset()
+	assert.Nil(t, audit([]string{"-dir", dir}, ob, eb))
+	assert.Equal(t, "Checked 2 certificates\n", ob.String())
+	assert.Empty(t, eb.String())
+
+	// expiring, overlapping, and a cert from a ca that is not in the directory
+	other, otherKey := writeCA("other")
+	require.NoError(t, os.Remove(filepath.Join(dir, "other.crt")))
+	writeCert(filepath.Join(dir, "sub", "b.crt"), "b", "10.0.0.1/24", "192.168.1.0/24", ca, caKey, time.Hour*24*10)
+	writeCert(filepath.Join(dir, "c.crt"), "c", "10.0.0.3/24", "", other, otherKey, time.Hour*24*90)
+
+	// renewed cert backups for the same host are not overlaps
+	writeCert(filepath.Join(dir, "a.crt.bak"), "a", "10.0.0.1/24", "192.168.0.0/16", ca, caKey, time.Hour*24*90)
+
+	ob.Reset()
+	eb.Reset()
+	assert.EqualError(t, audit([]string{"-dir", dir, "-json"}, ob, eb), "audit found 4 issues")
+	assert.Empty(t, eb.String())
+
+	var report auditReport
+	require.NoError(t, json.Unmarshal(ob.Bytes(), &report))
+	assert.Equal(t, 5, report.Certificates)
+
+	require.Len(t, report.Expiring, 1)
+	assert.Equal(t, "b", report.Expiring[0].Name)
+	assert.False(t, report.Expiring[0].Expired)
+
+	require.Len(t, report.UnknownCA, 1)
+	assert.Equal(t, "c", report.UnknownCA[0].Name)
+	assert.Equal(t, "issuer not found", report.UnknownCA[0].Reason)
+
+	require.Len(t, report.Overlapping, 2)
+	for _, o := range report.Overlapping {
+		assert.Contains(t, o.Names, "b")
+	}
+	assert.ElementsMatch(t, []string{"10.0.0.1", "192.168.1.0/24"}, []string{report.Overlapping[0].Network, report.Overlapping[1].Network})
+
+	// a shorter window and an explicit ca that trusts other
+	caPath := filepath.Join(t.TempDir(), "cas.crt")
+	b1, _ := ca.MarshalToPEM()
+	b2, _ := other.MarshalToPEM()
+	require.NoError(t, os.WriteFile(caPath, append(b1, b2...), 0600))
+
+	ob.Reset()
+	eb.Reset()
+	assert.EqualError(t, audit([]string{"-dir", dir, "-ca", caPath, "-within", "1d"}, ob, eb), "audit found 2 issues")
+	assert.Contains(t, ob.String(), "Checked 5 certificates\n\nOverlapping networks:\n")
+	assert.NotContains(t, ob.String(), "Expiring certificates:")
+	assert.NotContains(t, ob.String(), "Unknown CA:")
+	assert.Empty(t, eb.String())
+}
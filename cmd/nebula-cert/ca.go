@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"crypto/ecdsa"
 	"crypto/elliptic"
 	"crypto/rand"
@@ -13,7 +14,6 @@ import (
 	"strings"
 	"time"
 
-	"github.com/skip2/go-qrcode"
 	"github.com/slackhq/nebula/cert"
 	"golang.org/x/crypto/ed25519"
 )
@@ -25,6 +25,7 @@ type caFlags struct {
 	outKeyPath       *string
 	outCertPath      *string
 	outQRPath        *string
+	qrFormat         *string
 	groups           *string
 	ips              *string
 	subnets          *string
@@ -32,8 +33,10 @@ type caFlags struct {
 	argonIterations  *uint
 	argonParallelism *uint
 	encryption       *bool
+	wrap             *string
 
 	curve *string
+	hash  *string
 }
 
 func newCaFlags() *caFlags {
@@ -43,15 +46,18 @@ func newCaFlags() *caFlags {
 	cf.duration = cf.set.Duration("duration", time.Duration(time.Hour*8760), "Optional: amount of time the certificate should be valid for. Valid time units are seconds: \"s\", minutes: \"m\", hours: \"h\"")
 	cf.outKeyPath = cf.set.String("out-key", "ca.key", "Optional: path to write the private key to")
 	cf.outCertPath = cf.set.String("out-crt", "ca.crt", "Optional: path to write the certificate to")
-	cf.outQRPath = cf.set.String("out-qr", "", "Optional: output a qr code image (png) of the certificate")
-	cf.groups = cf.set.String("groups", "", "Optional: comma separated list of groups. This will limit which groups subordinate certs can use")
-	cf.ips = cf.set.String("ips", "", "Optional: comma separated list of ipv4 address and network in CIDR notation. This will limit which ipv4 addresses and networks subordinate certs can use for ip addresses")
-	cf.subnets = cf.set.String("subnets", "", "Optional: comma separated list of ipv4 address and network in CIDR notation. This will limit which ipv4 addresses and networks subordinate certs can use in subnets")
+	cf.outQRPath = cf.set.String("out-qr", "", "Optional: output a qr code of the certificate, see -qr-format")
+	cf.qrFormat = cf.set.String("qr-format", "png", "Optional: format of the qr code written to out-qr, png for an image or ansi for text that can be printed to a terminal")
+	cf.groups = cf.set.String("groups", "", "Optional: comma separated list of groups. This will limit which groups subordinate certs can use, a * matches any characters so team:* allows every team: group")
+	cf.ips = cf.set.String("ips", "", "Optional: comma separated list of ipv4 and ipv6 addresses and networks in CIDR notation. This will limit which addresses and networks subordinate certs can use for ip addresses")
+	cf.subnets = cf.set.String("subnets", "", "Optional: comma separated list of ipv4 and ipv6 addresses and networks in CIDR notation. This will limit which addresses and networks subordinate certs can use in subnets")
 	cf.argonMemory = cf.set.Uint("argon-memory", 2*1024*1024, "Optional: Argon2 memory parameter (in KiB) used for encrypted private key passphrase")
 	cf.argonParallelism = cf.set.Uint("argon-parallelism", 4, "Optional: Argon2 parallelism parameter used for encrypted private key passphrase")
 	cf.argonIterations = cf.set.Uint("argon-iterations", 1, "Optional: Argon2 iterations parameter used for encrypted private key passphrase")
 	cf.encryption = cf.set.Bool("encrypt", false, "Optional: prompt for passphrase and write out-key in an encrypted format")
 	cf.curve = cf.set.String("curve", "25519", "EdDSA/ECDSA Curve (25519, P256)")
+	cf.hash = cf.set.String("hash", "sha256", "Optional: hash used for the fingerprint and, with P256, the signature (sha256, sha384). Certs signed by this CA default to the same hash")
+	cf.wrap = cf.set.String("wrap", "", "Optional: wrap out-key with an external key, age:<recipient>[,<recipient>...] or exec:<command>. Set NEBULA_CA_KEY_UNWRAP to unwrap it when signing, for example age:<identity file>")
 	return &cf
 }
 
@@ -85,6 +91,9 @@ func ca(args []string, out io.Writer, errOut io.Writer, pr PasswordReader) error
 	if err := mustFlagString("out-crt", cf.outCertPath); err != nil {
 		return err
 	}
+	if err := checkQRFormat(*cf.qrFormat); err != nil {
+		return err
+	}
 	var kdfParams *cert.Argon2Parameters
 	if *cf.encryption {
 		if kdfParams, err = parseArgonParameters(*cf.argonMemory, *cf.argonParallelism, *cf.argonIterations); err != nil {
@@ -96,6 +105,11 @@ func ca(args []string, out io.Writer, errOut io.Writer, pr PasswordReader) error
 		return &helpError{"-duration must be greater than 0"}
 	}
 
+	hash, err := cert.ParseHashAlgorithm(*cf.hash)
+	if err != nil {
+		return newHelpErrorf("invalid hash: %s", err)
+	}
+
 	var groups []string
 	if *cf.groups != "" {
 		for _, rg := range strings.Split(*cf.groups, ",") {
@@ -115,10 +129,6 @@ func ca(args []string, out io.Writer, errOut io.Writer, pr PasswordReader) error
 				if err != nil {
 					return newHelpErrorf("invalid ip definition: %s", err)
 				}
-				if ip.To4() == nil {
-					return newHelpErrorf("invalid ip definition: can only be ipv4, have %s", rs)
-				}
-
 				ipNet.IP = ip
 				ips = append(ips, ipNet)
 			}
@@ -134,9 +144,6 @@ func ca(args []string, out io.Writer, errOut io.Writer, pr PasswordReader) error
 				if err != nil {
 					return newHelpErrorf("invalid subnet definition: %s", err)
 				}
-				if s.IP.To4() == nil {
-					return newHelpErrorf("invalid subnet definition: can only be ipv4, have %s", rs)
-				}
 				subnets = append(subnets, s)
 			}
 		}
@@ -202,6 +209,7 @@ func ca(args []string, out io.Writer, errOut io.Writer, pr PasswordReader) error
 			PublicKey: pub,
 			IsCA:      true,
 			Curve:     curve,
+			Hash:      hash,
 		},
 	}
 
@@ -228,6 +236,13 @@ func ca(args []string, out io.Writer, errOut io.Writer, pr PasswordReader) error
 		b = cert.MarshalSigningPrivateKey(curve, rawPriv)
 	}
 
+	if *cf.wrap != "" {
+		b, err = cert.WrapPrivateKey(context.Background(), *cf.wrap, b)
+		if err != nil {
+			return fmt.Errorf("error while wrapping out-key: %s", err)
+		}
+	}
+
 	err = os.WriteFile(*cf.outKeyPath, b, 0600)
 	if err != nil {
 		return fmt.Errorf("error while writing out-key: %s", err)
@@ -244,14 +259,8 @@ func ca(args []string, out io.Writer, errOut io.Writer, pr PasswordReader) error
 	}
 
 	if *cf.outQRPath != "" {
-		b, err = qrcode.Encode(string(b), qrcode.Medium, -5)
-		if err != nil {
-			return fmt.Errorf("error while generating qr code: %s", err)
-		}
-
-		err = os.WriteFile(*cf.outQRPath, b, 0600)
-		if err != nil {
-			return fmt.Errorf("error while writing out-qr: %s", err)
+		if err = writeQR(*cf.outQRPath, *cf.qrFormat, b); err != nil {
+			return err
 		}
 	}
 
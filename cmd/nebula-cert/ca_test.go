@@ -8,12 +8,15 @@ import (
 	"encoding/pem"
 	"errors"
 	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 	"time"
 
+	"filippo.io/age"
 	"github.com/slackhq/nebula/cert"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 //TODO: test file permissions
@@ -41,9 +44,11 @@ func Test_caHelp(t *testing.T) {
 			"  -encrypt\n"+
 			"    \tOptional: prompt for passphrase and write out-key in an encrypted format\n"+
 			"  -groups string\n"+
-			"    \tOptional: comma separated list of groups. This will limit which groups subordinate certs can use\n"+
+			"    \tOptional: comma separated list of groups. This will limit which groups subordinate certs can use, a * matches any characters so team:* allows every team: group\n"+
+			"  -hash string\n"+
+			"    \tOptional: hash used for the fingerprint and, with P256, the signature (sha256, sha384). Certs signed by this CA default to the same hash (default \"sha256\")\n"+
 			"  -ips string\n"+
-			"    \tOptional: comma separated list of ipv4 address and network in CIDR notation. This will limit which ipv4 addresses and networks subordinate certs can use for ip addresses\n"+
+			"    \tOptional: comma separated list of ipv4 and ipv6 addresses and networks in CIDR notation. This will limit which addresses and networks subordinate certs can use for ip addresses\n"+
 			"  -name string\n"+
 			"    \tRequired: name of the certificate authority\n"+
 			"  -out-crt string\n"+
@@ -51,9 +56,13 @@ func Test_caHelp(t *testing.T) {
 			"  -out-key string\n"+
 			"    \tOptional: path to write the private key to (default \"ca.key\")\n"+
 			"  -out-qr string\n"+
-			"    \tOptional: output a qr code image (png) of the certificate\n"+
+			"    \tOptional: output a qr code of the certificate, see -qr-format\n"+
+			"  -qr-format string\n"+
+			"    \tOptional: format of the qr code written to out-qr, png for an image or ansi for text that can be printed to a terminal (default \"png\")\n"+
 			"  -subnets string\n"+
-			"    \tOptional: comma separated list of ipv4 address and network in CIDR notation. This will limit which ipv4 addresses and networks subordinate certs can use in subnets\n",
+			"    \tOptional: comma separated list of ipv4 and ipv6 addresses and networks in CIDR notation. This will limit which addresses and networks subordinate certs can use in subnets\n"+
+			"  -wrap string\n"+
+			"    \tOptional: wrap out-key with an external key, age:<recipient>[,<recipient>...] or exec:<command>. Set NEBULA_CA_KEY_UNWRAP to unwrap it when signing, for example age:<identity file>\n",
 		ob.String(),
 	)
 }
@@ -87,16 +96,6 @@ func Test_ca(t *testing.T) {
 	assert.Equal(t, "", ob.String())
 	assert.Equal(t, "", eb.String())
 
-	// ipv4 only ips
-	assertHelpError(t, ca([]string{"-name", "ipv6", "-ips", "100::100/100"}, ob, eb, nopw), "invalid ip definition: can only be ipv4, have 100::100/100")
-	assert.Equal(t, "", ob.String())
-	assert.Equal(t, "", eb.String())
-
-	// ipv4 only subnets
-	assertHelpError(t, ca([]string{"-name", "ipv6", "-subnets", "100::100/100"}, ob, eb, nopw), "invalid subnet definition: can only be ipv4, have 100::100/100")
-	assert.Equal(t, "", ob.String())
-	assert.Equal(t, "", eb.String())
-
 	// failed key write
 	ob.Reset()
 	eb.Reset()
@@ -229,3 +228,37 @@ func Test_ca(t *testing.T) {
 	os.Remove(keyF.Name())
 
 }
+
+func Test_caWrap(t *testing.T) {
+	ob := &bytes.Buffer{}
+	eb := &bytes.Buffer{}
+	nopw := &StubPasswordReader{}
+	dir := t.TempDir()
+
+	id, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+	idPath := filepath.Join(dir, "id.txt")
+	require.NoError(t, os.WriteFile(idPath, []byte(id.String()+"\n"), 0600))
+
+	keyPath := filepath.Join(dir, "ca.key")
+	crtPath := filepath.Join(dir, "ca.crt")
+	args := []string{"-name", "test", "-out-crt", crtPath, "-out-key", keyPath, "-wrap", "nope:"}
+	assert.EqualError(t, ca(args, ob, eb, nopw), "error while wrapping out-key: unknown key wrap scheme: nope")
+
+	os.Remove(crtPath)
+	args = []string{"-name", "test", "-out-crt", crtPath, "-out-key", keyPath, "-wrap", "age:" + id.Recipient().String()}
+	require.NoError(t, ca(args, ob, eb, nopw))
+
+	rb, _ := os.ReadFile(keyPath)
+	assert.True(t, cert.IsWrappedPrivateKey(rb))
+
+	// Signing needs the unwrap spec
+	_, _, err = readCAKey(keyPath, ob, nopw)
+	assert.EqualError(t, err, "ca-key is wrapped, set NEBULA_CA_KEY_UNWRAP to unwrap it")
+
+	t.Setenv("NEBULA_CA_KEY_UNWRAP", "age:"+idPath)
+	curve, key, err := readCAKey(keyPath, ob, nopw)
+	require.NoError(t, err)
+	assert.Equal(t, cert.Curve_CURVE25519, curve)
+	assert.Len(t, key, 64)
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/slackhq/nebula/cert"
+	"github.com/slackhq/nebula/enroll"
+)
+
+type enrollServerFlags struct {
+	set        *flag.FlagSet
+	caKeyPath  *string
+	caCertPath *string
+	tokensPath *string
+	listen     *string
+	tlsCert    *string
+	tlsKey     *string
+	allowRenew *bool
+	log        *string
+}
+
+func newEnrollServerFlags() *enrollServerFlags {
+	ef := enrollServerFlags{set: flag.NewFlagSet("enroll-server", flag.ContinueOnError)}
+	ef.set.Usage = func() {}
+	ef.caKeyPath = ef.set.String("ca-key", "ca.key", "Optional: path to the signing CA key")
+	ef.caCertPath = ef.set.String("ca-crt", "ca.crt", "Optional: path to the signing CA cert")
+	ef.tokensPath = ef.set.String("tokens", "", "Required: path to a json file mapping each single use enrollment token to the identity it grants")
+	ef.listen = ef.set.String("listen", "0.0.0.0:8443", "Optional: address to listen on, this can be an overlay address")
+	ef.tlsCert = ef.set.String("tls-crt", "", "Optional: path to a tls certificate, strongly recommended when listening on an underlay address")
+	ef.tlsKey = ef.set.String("tls-key", "", "Optional: path to the tls private key, required with -tls-crt")
+	ef.allowRenew = ef.set.Bool("allow-renew", false, "Optional: allow nodes to renew their certificate without a token, only use when listening on an overlay address")
+	ef.log = ef.set.String("log", "", "Optional: transparency log to submit issued certs to, either a log directory or the url of a nebula-cert log-server")
+	return &ef
+}
+
+// enrollTokenGrant is an entry in the -tokens file
+type enrollTokenGrant struct {
+	Name     string   `json:"name"`
+	Ip       string   `json:"ip"`
+	Groups   []string `json:"groups"`
+	Subnets  []string `json:"subnets"`
+	Duration string   `json:"duration"`
+}
+
+func enrollServer(args []string, out io.Writer, errOut io.Writer, pr PasswordReader) error {
+	ef := newEnrollServerFlags()
+	err := ef.set.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	if err := mustFlagString("tokens", ef.tokensPath); err != nil {
+		return err
+	}
+	if (*ef.tlsCert == "") != (*ef.tlsKey == "") {
+		return newHelpErrorf("-tls-crt and -tls-key must be set together")
+	}
+
+	tokens, err := readEnrollTokens(*ef.tokensPath)
+	if err != nil {
+		return err
+	}
+
+	curve, caKey, err := readCAKey(*ef.caKeyPath, out, pr)
+	if err != nil {
+		return err
+	}
+
+	rawCACert, err := os.ReadFile(*ef.caCertPath)
+	if err != nil {
+		return fmt.Errorf("error while reading ca-crt: %s", err)
+	}
+
+	caCert, _, err := cert.UnmarshalNebulaCertificateFromPEM(rawCACert)
+	if err != nil {
+		return fmt.Errorf("error while parsing ca-crt: %s", err)
+	}
+
+	if caCert.Details.Curve != curve {
+		return fmt.Errorf("curve of ca-key does not match ca-crt")
+	}
+
+	l := logrus.New()
+	l.Out = errOut
+
+	s, err := enroll.NewServer(l, caCert, caKey, enroll.NewTokenAuthorizer(tokens))
+	if err != nil {
+		return fmt.Errorf("error while creating enrollment server: %s", err)
+	}
+
+	if *ef.allowRenew {
+		s.EnableRenewal()
+	}
+
+	if *ef.log != "" {
+		ls, err := cert.OpenLogSubmitter(*ef.log)
+		if err != nil {
+			return fmt.Errorf("error while opening log: %s", err)
+		}
+		s.SetLog(ls)
+	}
+
+	hs := &http.Server{Addr: *ef.listen, Handler: s, ReadHeaderTimeout: 10 * time.Second}
+	l.WithField("listen", *ef.listen).WithField("tokens", len(tokens)).Info("Enrollment server listening")
+
+	if *ef.tlsCert != "" {
+		return hs.ListenAndServeTLS(*ef.tlsCert, *ef.tlsKey)
+	}
+	return hs.ListenAndServe()
+}
+
+func readEnrollTokens(path string) (map[string]*enroll.Grant, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error while reading tokens: %s", err)
+	}
+
+	var raw map[string]enrollTokenGrant
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return nil, fmt.Errorf("error while parsing tokens: %s", err)
+	}
+
+	tokens := make(map[string]*enroll.Grant, len(raw))
+	for token, rg := range raw {
+		if rg.Name == "" {
+			return nil, fmt.Errorf("token %s is missing a name", token)
+		}
+
+		ip, ipNet, err := net.ParseCIDR(rg.Ip)
+		if err != nil || ip.To4() == nil {
+			return nil, fmt.Errorf("token %s has an invalid ip, must be an ipv4 address and network in CIDR notation: %s", token, rg.Ip)
+		}
+		ipNet.IP = ip.To4()
+
+		g := &enroll.Grant{Name: rg.Name, Ips: []*net.IPNet{ipNet}, Groups: rg.Groups}
+		for _, rs := range rg.Subnets {
+			_, s, err := net.ParseCIDR(rs)
+			if err != nil || s.IP.To4() == nil {
+				return nil, fmt.Errorf("token %s has an invalid subnet: %s", token, rs)
+			}
+			g.Subnets = append(g.Subnets, s)
+		}
+
+		if rg.Duration != "" {
+			g.Duration, err = time.ParseDuration(rg.Duration)
+			if err != nil {
+				return nil, fmt.Errorf("token %s has an invalid duration: %s", token, err)
+			}
+		}
+
+		tokens[token] = g
+	}
+
+	return tokens, nil
+}
+
+func enrollServerSummary() string {
+	return "enroll-server <flags>: run an enrollment server that signs certificates for nodes presenting a token"
+}
+
+func enrollServerHelp(out io.Writer) {
+	ef := newEnrollServerFlags()
+	out.Write([]byte("Usage of " + os.Args[0] + " " + enrollServerSummary() + "\n"))
+	ef.set.SetOutput(out)
+	ef.set.PrintDefaults()
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_enrollServerSummary(t *testing.T) {
+	assert.Equal(t, "enroll-server <flags>: run an enrollment server that signs certificates for nodes presenting a token", enrollServerSummary())
+}
+
+func Test_enrollServerHelp(t *testing.T) {
+	ob := &bytes.Buffer{}
+	enrollServerHelp(ob)
+	assert.Equal(
+		t,
+		"Usage of "+os.Args[0]+" enroll-server <flags>: run an enrollment server that signs certificates for nodes presenting a token\n"+
+			"  -allow-renew\n"+
+			"    \tOptional: allow nodes to renew their certificate without a token, only use when listening on an overlay address\n"+
+			"  -ca-crt string\n"+
+			"    \tOptional: path to the signing CA cert (default \"ca.crt\")\n"+
+			"  -ca-key string\n"+
+			"    \tOptional: path to the signing CA key (default \"ca.key\")\n"+
+			"  -listen string\n"+
+			"    \tOptional: address to listen on, this can be an overlay address (default \"0.0.0.0:8443\")\n"+
+			"  -log string\n"+
+			"    \tOptional: transparency log to submit issued certs to, either a log directory or the url of a nebula-cert log-server\n"+
+			"  -tls-crt string\n"+
+			"    \tOptional: path to a tls certificate, strongly recommended when listening on an underlay address\n"+
+			"  -tls-key string\n"+
+			"    \tOptional: path to the tls private key, required with -tls-crt\n"+
+			"  -tokens string\n"+
+			"    \tRequired: path to a json file mapping each single use enrollment token to the identity it grants\n",
+		ob.String(),
+	)
+}
+
+func Test_enrollServer(t *testing.T) {
+	ob := &bytes.Buffer{}
+	eb := &bytes.Buffer{}
+	nopw := &StubPasswordReader{}
+
+	assertHelpError(t, enrollServer([]string{}, ob, eb, nopw), "-tokens is required")
+	assertHelpError(t, enrollServer([]string{"-tokens", "nope", "-tls-crt", "nope"}, ob, eb, nopw), "-tls-crt and -tls-key must be set together")
+	assert.EqualError(t, enrollServer([]string{"-tokens", "./nope"}, ob, eb, nopw), "error while reading tokens: open ./nope: "+NoSuchFileError)
+}
+
+func Test_readEnrollTokens(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tokens.json")
+
+	require.NoError(t, os.WriteFile(path, []byte(`{"abc": {"name": "web-1", "ip": "10.1.0.5/16", "groups": ["web"], "subnets": ["192.168.1.0/24"], "duration": "24h"}}`), 0600))
+	tokens, err := readEnrollTokens(path)
+	require.NoError(t, err)
+	require.Contains(t, tokens, "abc")
+	g := tokens["abc"]
+	assert.Equal(t, "web-1", g.Name)
+	assert.Equal(t, "10.1.0.5/16", g.Ips[0].String())
+	assert.Equal(t, []string{"web"}, g.Groups)
+	assert.Equal(t, "192.168.1.0/24", g.Subnets[0].String())
+	assert.Equal(t, 24*time.Hour, g.Duration)
+
+	require.NoError(t, os.WriteFile(path, []byte(`{"abc": {"ip": "10.1.0.5/16"}}`), 0600))
+	_, err = readEnrollTokens(path)
+	assert.EqualError(t, err, "token abc is missing a name")
+
+	require.NoError(t, os.WriteFile(path, []byte(`{"abc": {"name": "web-1", "ip": "::1/128"}}`), 0600))
+	_, err = readEnrollTokens(path)
+	assert.EqualError(t, err, "token abc has an invalid ip, must be an ipv4 address and network in CIDR notation: ::1/128")
+
+	require.NoError(t, os.WriteFile(path, []byte(`[]`), 0600))
+	_, err = readEnrollTokens(path)
+	assert.ErrorContains(t, err, "error while parsing tokens:")
+}
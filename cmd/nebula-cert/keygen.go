@@ -1,18 +1,22 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"io"
 	"os"
 
 	"github.com/slackhq/nebula/cert"
+	"github.com/slackhq/nebula/tpmclient"
 )
 
 type keygenFlags struct {
 	set        *flag.FlagSet
 	outKeyPath *string
 	outPubPath *string
+	tpm        *string
+	wrap       *string
 
 	curve *string
 }
@@ -23,6 +27,8 @@ func newKeygenFlags() *keygenFlags {
 	cf.outPubPath = cf.set.String("out-pub", "", "Required: path to write the public key to")
 	cf.outKeyPath = cf.set.String("out-key", "", "Required: path to write the private key to")
 	cf.curve = cf.set.String("curve", "25519", "ECDH Curve (25519, P256)")
+	cf.tpm = cf.set.String("tpm", "", "Optional: create the key in the TPM instead of writing out-key, tpm keys are always P256. For example tpm:///dev/tpmrm0?handle=0x81000010. Use the same url for pki.key")
+	cf.wrap = cf.set.String("wrap", "", "Optional: wrap out-key with an external key, age:<recipient>[,<recipient>...] or exec:<command>. Set pki.key_unwrap so nebula can unwrap it, for example age:<identity file>")
 	return &cf
 }
 
@@ -33,13 +39,33 @@ func keygen(args []string, out io.Writer, errOut io.Writer) error {
 		return err
 	}
 
-	if err := mustFlagString("out-key", cf.outKeyPath); err != nil {
+	if *cf.tpm != "" {
+		if *cf.outKeyPath != "" {
+			return newHelpErrorf("cannot set both -tpm and -out-key")
+		}
+		if *cf.wrap != "" {
+			return newHelpErrorf("cannot set both -tpm and -wrap")
+		}
+	} else if err := mustFlagString("out-key", cf.outKeyPath); err != nil {
 		return err
 	}
 	if err := mustFlagString("out-pub", cf.outPubPath); err != nil {
 		return err
 	}
 
+	if *cf.tpm != "" {
+		pub, err := tpmclient.Generate(*cf.tpm)
+		if err != nil {
+			return fmt.Errorf("error while creating tpm key: %s", err)
+		}
+
+		err = os.WriteFile(*cf.outPubPath, cert.MarshalPublicKey(cert.Curve_P256, pub), 0600)
+		if err != nil {
+			return fmt.Errorf("error while writing out-pub: %s", err)
+		}
+		return nil
+	}
+
 	var pub, rawPriv []byte
 	var curve cert.Curve
 	switch *cf.curve {
@@ -53,7 +79,15 @@ func keygen(args []string, out io.Writer, errOut io.Writer) error {
 		return fmt.Errorf("invalid curve: %s", *cf.curve)
 	}
 
-	err = os.WriteFile(*cf.outKeyPath, cert.MarshalPrivateKey(curve, rawPriv), 0600)
+	b := cert.MarshalPrivateKey(curve, rawPriv)
+	if *cf.wrap != "" {
+		b, err = cert.WrapPrivateKey(context.Background(), *cf.wrap, b)
+		if err != nil {
+			return fmt.Errorf("error while wrapping out-key: %s", err)
+		}
+	}
+
+	err = os.WriteFile(*cf.outKeyPath, b, 0600)
 	if err != nil {
 		return fmt.Errorf("error while writing out-key: %s", err)
 	}
@@ -26,7 +26,11 @@ func Test_keygenHelp(t *testing.T) {
 			"  -out-key string\n"+
 			"    \tRequired: path to write the private key to\n"+
 			"  -out-pub string\n"+
-			"    \tRequired: path to write the public key to\n",
+			"    \tRequired: path to write the public key to\n"+
+			"  -tpm string\n"+
+			"    \tOptional: create the key in the TPM instead of writing out-key, tpm keys are always P256. For example tpm:///dev/tpmrm0?handle=0x81000010. Use the same url for pki.key\n"+
+			"  -wrap string\n"+
+			"    \tOptional: wrap out-key with an external key, age:<recipient>[,<recipient>...] or exec:<command>. Set pki.key_unwrap so nebula can unwrap it, for example age:<identity file>\n",
 		ob.String(),
 	)
 }
@@ -44,10 +48,16 @@ func Test_keygen(t *testing.T) {
 	assert.Equal(t, "", ob.String())
 	assert.Equal(t, "", eb.String())
 
+	assertHelpError(t, keygen([]string{"-out-key", "nope", "-out-pub", "nope", "-tpm", "tpm:?handle=0x81000010"}, ob, eb), "cannot set both -tpm and -out-key")
+	assertHelpError(t, keygen([]string{"-out-pub", "nope", "-tpm", "tpm:?handle=0x81000010", "-wrap", "age:x"}, ob, eb), "cannot set both -tpm and -wrap")
+
+	args := []string{"-out-pub", "nope", "-tpm", "tpm:?handle=0x10"}
+	assert.EqualError(t, keygen(args, ob, eb), "error while creating tpm key: invalid tpm url: handle 0x10 is not an owner persistent handle")
+
 	// failed key write
 	ob.Reset()
 	eb.Reset()
-	args := []string{"-out-pub", "/do/not/write/pleasepub", "-out-key", "/do/not/write/pleasekey"}
+	args = []string{"-out-pub", "/do/not/write/pleasepub", "-out-key", "/do/not/write/pleasekey"}
 	assert.EqualError(t, keygen(args, ob, eb), "error while writing out-key: open /do/not/write/pleasekey: "+NoSuchDirError)
 	assert.Equal(t, "", ob.String())
 	assert.Equal(t, "", eb.String())
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/slackhq/nebula/cert"
+)
+
+type logServerFlags struct {
+	set        *flag.FlagSet
+	dir        *string
+	caCertPath *string
+	listen     *string
+	tlsCert    *string
+	tlsKey     *string
+}
+
+func newLogServerFlags() *logServerFlags {
+	lf := logServerFlags{set: flag.NewFlagSet("log-server", flag.ContinueOnError)}
+	lf.set.Usage = func() {}
+	lf.dir = lf.set.String("dir", "", "Required: directory holding the log, a new log key is generated in it if there is not one")
+	lf.caCertPath = lf.set.String("ca-crt", "", "Optional: path to the CA certs the log accepts certificates from, any certificate is accepted if not set")
+	lf.listen = lf.set.String("listen", "0.0.0.0:8444", "Optional: address to listen on")
+	lf.tlsCert = lf.set.String("tls-crt", "", "Optional: path to a tls certificate")
+	lf.tlsKey = lf.set.String("tls-key", "", "Optional: path to the tls private key, required with -tls-crt")
+	return &lf
+}
+
+func logServer(args []string, out io.Writer, errOut io.Writer) error {
+	lf := newLogServerFlags()
+	err := lf.set.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	if err := mustFlagString("dir", lf.dir); err != nil {
+		return err
+	}
+	if (*lf.tlsCert == "") != (*lf.tlsKey == "") {
+		return newHelpErrorf("-tls-crt and -tls-key must be set together")
+	}
+
+	fl, err := cert.OpenFileLog(*lf.dir)
+	if err != nil {
+		return fmt.Errorf("error while opening log: %s", err)
+	}
+
+	if *lf.caCertPath != "" {
+		rawCACert, err := os.ReadFile(*lf.caCertPath)
+		if err != nil {
+			return fmt.Errorf("error while reading ca-crt: %s", err)
+		}
+
+		pool, err := cert.NewCAPoolFromBytes(rawCACert)
+		if err != nil {
+			return fmt.Errorf("error while parsing ca-crt: %s", err)
+		}
+		fl.SetCAPool(pool)
+	}
+
+	l := logrus.New()
+	l.Out = errOut
+
+	th, err := fl.TreeHead()
+	if err != nil {
+		return fmt.Errorf("error while signing tree head: %s", err)
+	}
+
+	hs := &http.Server{Addr: *lf.listen, Handler: fl, ReadHeaderTimeout: 10 * time.Second}
+	l.WithField("listen", *lf.listen).WithField("logId", th.LogID).WithField("size", th.Size).
+		Info("Transparency log listening")
+
+	if *lf.tlsCert != "" {
+		return hs.ListenAndServeTLS(*lf.tlsCert, *lf.tlsKey)
+	}
+	return hs.ListenAndServe()
+}
+
+func logServerSummary() string {
+	return "log-server <flags>: run a transparency log that records issued certificates and returns inclusion proofs"
+}
+
+func logServerHelp(out io.Writer) {
+	lf := newLogServerFlags()
+	out.Write([]byte("Usage of " + os.Args[0] + " " + logServerSummary() + "\n"))
+	lf.set.SetOutput(out)
+	lf.set.PrintDefaults()
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_logServerSummary(t *testing.T) {
+	assert.Equal(t, "log-server <flags>: run a transparency log that records issued certificates and returns inclusion proofs", logServerSummary())
+}
+
+func Test_logServerHelp(t *testing.T) {
+	ob := &bytes.Buffer{}
+	logServerHelp(ob)
+	assert.Equal(
+		t,
+		"Usage of "+os.Args[0]+" log-server <flags>: run a transparency log that records issued certificates and returns inclusion proofs\n"+
+			"  -ca-crt string\n"+
+			"    \tOptional: path to the CA certs the log accepts certificates from, any certificate is accepted if not set\n"+
+			"  -dir string\n"+
+			"    \tRequired: directory holding the log, a new log key is generated in it if there is not one\n"+
+			"  -listen string\n"+
+			"    \tOptional: address to listen on (default \"0.0.0.0:8444\")\n"+
+			"  -tls-crt string\n"+
+			"    \tOptional: path to a tls certificate\n"+
+			"  -tls-key string\n"+
+			"    \tOptional: path to the tls private key, required with -tls-crt\n",
+		ob.String(),
+	)
+}
+
+func Test_logServer(t *testing.T) {
+	ob := &bytes.Buffer{}
+	eb := &bytes.Buffer{}
+
+	assertHelpError(t, logServer([]string{}, ob, eb), "-dir is required")
+	assertHelpError(t, logServer([]string{"-dir", "nope", "-tls-crt", "nope"}, ob, eb), "-tls-crt and -tls-key must be set together")
+	assert.EqualError(t, logServer([]string{"-dir", t.TempDir(), "-ca-crt", "./nope"}, ob, eb), "error while reading ca-crt: open ./nope: "+NoSuchFileError)
+}
@@ -69,6 +69,18 @@ func main() {
 		err = signCert(args[1:], os.Stdout, os.Stderr, StdinPasswordReader{})
 	case "print":
 		err = printCert(args[1:], os.Stdout, os.Stderr)
+	case "renew":
+		err = renewCert(args[1:], os.Stdout, os.Stderr, StdinPasswordReader{})
+	case "audit":
+		err = audit(args[1:], os.Stdout, os.Stderr)
+	case "migrate-pki":
+		err = migratePKI(args[1:], os.Stdout, os.Stderr, StdinPasswordReader{})
+	case "enroll-server":
+		err = enrollServer(args[1:], os.Stdout, os.Stderr, StdinPasswordReader{})
+	case "log-server":
+		err = logServer(args[1:], os.Stdout, os.Stderr)
+	case "sign-payload":
+		err = signPayload(args[1:], os.Stdout, os.Stderr, StdinPasswordReader{})
 	case "verify":
 		err = verify(args[1:], os.Stdout, os.Stderr)
 	default:
@@ -102,6 +114,18 @@ func handleError(mode string, e error, out io.Writer) int {
 			signHelp(out)
 		case "print":
 			printHelp(out)
+		case "renew":
+			renewHelp(out)
+		case "audit":
+			auditHelp(out)
+		case "migrate-pki":
+			migratePKIHelp(out)
+		case "enroll-server":
+			enrollServerHelp(out)
+		case "log-server":
+			logServerHelp(out)
+		case "sign-payload":
+			signPayloadHelp(out)
 		case "verify":
 			verifyHelp(out)
 		}
@@ -126,6 +150,12 @@ func help(err string, out io.Writer) {
 	fmt.Fprintln(out, "    "+keygenSummary())
 	fmt.Fprintln(out, "    "+signSummary())
 	fmt.Fprintln(out, "    "+printSummary())
+	fmt.Fprintln(out, "    "+renewSummary())
+	fmt.Fprintln(out, "    "+auditSummary())
+	fmt.Fprintln(out, "    "+migratePKISummary())
+	fmt.Fprintln(out, "    "+enrollServerSummary())
+	fmt.Fprintln(out, "    "+logServerSummary())
+	fmt.Fprintln(out, "    "+signPayloadSummary())
 	fmt.Fprintln(out, "    "+verifySummary())
 	fmt.Fprintln(out, "")
 	fmt.Fprintf(out, "  To see usage for a given mode, use %s <mode> -h\n", os.Args[0])
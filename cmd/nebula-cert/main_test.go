@@ -22,6 +22,12 @@ func Test_help(t *testing.T) {
 		"    " + keygenSummary() + "\n" +
 		"    " + signSummary() + "\n" +
 		"    " + printSummary() + "\n" +
+		"    " + renewSummary() + "\n" +
+		"    " + auditSummary() + "\n" +
+		"    " + migratePKISummary() + "\n" +
+		"    " + enrollServerSummary() + "\n" +
+		"    " + logServerSummary() + "\n" +
+		"    " + signPayloadSummary() + "\n" +
 		"    " + verifySummary() + "\n" +
 		"\n" +
 		"  To see usage for a given mode, use " + os.Args[0] + " <mode> -h\n"
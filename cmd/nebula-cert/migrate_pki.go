@@ -0,0 +1,580 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/slackhq/nebula/cert"
+	"github.com/slackhq/nebula/config"
+	"gopkg.in/yaml.v3"
+)
+
+// migrate-pki moves a host to a new certificate, from a new CA, on a new curve or hash, or with ipv6 networks which
+// makes it a version 2 certificate. The identity of the host, its name, networks, groups and subnets, is kept. The
+// new files and an updated config are written to a directory along with a plan, so the rollout across the mesh can
+// be staged. When the curve stays the same the old certificate is kept in pki.additional_certs, so peers that only
+// trust the old CA still reach the host until every peer trusts the new one.
+
+type migratePKIFlags struct {
+	set         *flag.FlagSet
+	configPath  *string
+	caKeyPath   *string
+	caCertPath  *string
+	outDir      *string
+	peersDir    *string
+	hash        *string
+	addNetworks *string
+	duration    *time.Duration
+	newKey      *bool
+}
+
+func newMigratePKIFlags() *migratePKIFlags {
+	mf := migratePKIFlags{set: flag.NewFlagSet("migrate-pki", flag.ContinueOnError)}
+	mf.set.Usage = func() {}
+	mf.configPath = mf.set.String("config", "", "Required: path to the nebula config file of the host, pki.ca and pki.cert are read from it")
+	mf.caKeyPath = mf.set.String("ca-key", "ca.key", "Optional: path to the signing CA key")
+	mf.caCertPath = mf.set.String("ca-crt", "ca.crt", "Optional: path to the signing CA cert, the curve of the new cert is the curve of this CA")
+	mf.outDir = mf.set.String("out-dir", "", "Required: directory to write the new ca bundle, cert, key, config and plan.json to")
+	mf.peersDir = mf.set.String("peers", "", "Optional: directory of peer certificates, subdirectories are included. Peers from the config with a certificate here are checked against the new cert")
+	mf.hash = mf.set.String("hash", "", "Optional: hash used for the fingerprint and, with P256, the signature (sha256, sha384). The default is the hash of the signing cert")
+	mf.addNetworks = mf.set.String("add-networks", "", "Optional: comma separated list of ipv6 addresses in CIDR notation to add to the cert, which makes it a version 2 certificate")
+	mf.duration = mf.set.Duration("duration", 0, "Optional: how long the new cert should be valid for. The default is the lifetime of the existing cert, capped at 1 second before the signing cert expires. Valid time units are seconds: \"s\", minutes: \"m\", hours: \"h\"")
+	mf.newKey = mf.set.Bool("new-key", false, "Optional: generate a new keypair instead of reusing the existing public key. Always done when the curve changes")
+	return &mf
+}
+
+// migrateCert describes a certificate in the plan
+type migrateCert struct {
+	Fingerprint string    `json:"fingerprint"`
+	Issuer      string    `json:"issuer"`
+	Curve       string    `json:"curve"`
+	Hash        string    `json:"hash"`
+	Version     uint32    `json:"version"`
+	NotAfter    time.Time `json:"notAfter"`
+}
+
+// migratePeer is a row of the interop matrix, a peer named in the config and what is known about its certificate
+type migratePeer struct {
+	VpnIp       string   `json:"vpnIp"`
+	Sources     []string `json:"sources"`
+	Name        string   `json:"name,omitempty"`
+	Fingerprint string   `json:"fingerprint,omitempty"`
+	// Trusted is whether the host, with the new ca bundle, accepts the certificate of the peer: ok, untrusted or unknown
+	Trusted string `json:"trusted"`
+	// AcceptsNew is whether the peer accepts the new certificate: ok, needsCa when it has to trust the new CA first,
+	// curveMismatch when it has to move to the new curve too, or unknown
+	AcceptsNew string `json:"acceptsNew"`
+	// AcceptsOld is whether the peer still reaches the host with the old certificate kept in additional_certs: ok,
+	// no or unknown
+	AcceptsOld string `json:"acceptsOld"`
+}
+
+// migrateStage is a step of the rollout, Peers are the ones it has to be done on besides this host
+type migrateStage struct {
+	Name        string   `json:"name"`
+	Description string   `json:"description"`
+	Peers       []string `json:"peers,omitempty"`
+}
+
+type migratePlan struct {
+	Name   string         `json:"name"`
+	VpnIp  string         `json:"vpnIp"`
+	Old    migrateCert    `json:"old"`
+	New    migrateCert    `json:"new"`
+	Files  []string       `json:"files"`
+	Peers  []migratePeer  `json:"peers"`
+	Stages []migrateStage `json:"stages"`
+}
+
+func migratePKI(args []string, out io.Writer, errOut io.Writer, pr PasswordReader) error {
+	mf := newMigratePKIFlags()
+	err := mf.set.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	if err := mustFlagString("config", mf.configPath); err != nil {
+		return err
+	}
+	if err := mustFlagString("out-dir", mf.outDir); err != nil {
+		return err
+	}
+	if err := mustFlagString("ca-key", mf.caKeyPath); err != nil {
+		return err
+	}
+	if err := mustFlagString("ca-crt", mf.caCertPath); err != nil {
+		return err
+	}
+
+	addNetworks, err := parseMigrateNetworks(*mf.addNetworks)
+	if err != nil {
+		return err
+	}
+
+	rawConfig, err := os.ReadFile(*mf.configPath)
+	if err != nil {
+		return fmt.Errorf("error while reading config: %s", err)
+	}
+
+	var doc yaml.Node
+	if err := yaml.Unmarshal(rawConfig, &doc); err != nil {
+		return fmt.Errorf("error while parsing config: %s", err)
+	}
+	if len(doc.Content) == 0 || doc.Content[0].Kind != yaml.MappingNode {
+		return fmt.Errorf("error while parsing config: not a yaml mapping")
+	}
+	pkiNode := yamlMapValue(doc.Content[0], "pki")
+	if pkiNode == nil || pkiNode.Kind != yaml.MappingNode {
+		return fmt.Errorf("pki in the config must be a mapping, an !include has to be migrated by hand")
+	}
+
+	l := logrus.New()
+	l.Out = errOut
+	c := config.NewC(l)
+	if err := c.Load(*mf.configPath); err != nil {
+		return fmt.Errorf("error while loading config: %s", err)
+	}
+
+	rawOldCA, err := readPEMOrPath(c.GetString("pki.ca", ""))
+	if err != nil {
+		return fmt.Errorf("error while reading pki.ca: %s", err)
+	}
+	rawOldCert, err := readPEMOrPath(c.GetString("pki.cert", ""))
+	if err != nil {
+		return fmt.Errorf("error while reading pki.cert: %s", err)
+	}
+	oldCert, _, err := cert.UnmarshalNebulaCertificateFromPEM(rawOldCert)
+	if err != nil {
+		return fmt.Errorf("error while parsing pki.cert: %s", err)
+	}
+
+	curve, caKey, err := readCAKey(*mf.caKeyPath, out, pr)
+	if err != nil {
+		return err
+	}
+
+	rawCACert, err := os.ReadFile(*mf.caCertPath)
+	if err != nil {
+		return fmt.Errorf("error while reading ca-crt: %s", err)
+	}
+
+	caCert, _, err := cert.UnmarshalNebulaCertificateFromPEM(rawCACert)
+	if err != nil {
+		return fmt.Errorf("error while parsing ca-crt: %s", err)
+	}
+
+	if err := caCert.VerifyPrivateKey(curve, caKey); err != nil {
+		return fmt.Errorf("refusing to sign, root certificate does not match private key")
+	}
+
+	issuer, err := caCert.Fingerprint()
+	if err != nil {
+		return fmt.Errorf("error while getting -ca-crt fingerprint: %s", err)
+	}
+
+	hash := caCert.Details.Hash
+	if *mf.hash != "" {
+		hash, err = cert.ParseHashAlgorithm(*mf.hash)
+		if err != nil {
+			return newHelpErrorf("invalid hash: %s", err)
+		}
+	}
+
+	now := time.Now()
+	if caCert.Expired(now) {
+		return fmt.Errorf("ca certificate is expired")
+	}
+
+	// if no duration is given, keep the lifetime of the existing cert
+	if *mf.duration <= 0 {
+		*mf.duration = oldCert.Details.NotAfter.Sub(oldCert.Details.NotBefore)
+	}
+
+	notAfter := now.Add(*mf.duration)
+	if maxNotAfter := caCert.Details.NotAfter.Add(-time.Second); notAfter.After(maxNotAfter) {
+		notAfter = maxNotAfter
+	}
+
+	// The old key can not be used on another curve
+	pub := oldCert.Details.PublicKey
+	var rawPriv []byte
+	if *mf.newKey || oldCert.Details.Curve != curve {
+		pub, rawPriv = newKeypair(curve)
+	}
+
+	ips := append(append([]*net.IPNet{}, oldCert.Details.Ips...), addNetworks...)
+	// The certificate encodes the ipv4 networks before the ipv6 networks, keep that order so what we sign is what
+	// hosts read back
+	sort.SliceStable(ips, func(i, j int) bool { return ips[i].IP.To4() != nil && ips[j].IP.To4() == nil })
+
+	nc := cert.NebulaCertificate{
+		Details: cert.NebulaCertificateDetails{
+			Name:      oldCert.Details.Name,
+			Ips:       ips,
+			Groups:    oldCert.Details.Groups,
+			Subnets:   oldCert.Details.Subnets,
+			NotBefore: now,
+			NotAfter:  notAfter,
+			PublicKey: pub,
+			IsCA:      false,
+			Issuer:    issuer,
+			Curve:     curve,
+			Hash:      hash,
+		},
+	}
+
+	if err := nc.CheckRootConstrains(caCert); err != nil {
+		return fmt.Errorf("refusing to sign, root certificate constraints violated: %s", err)
+	}
+
+	if err = nc.Sign(curve, caKey); err != nil {
+		return fmt.Errorf("error while signing: %s", err)
+	}
+
+	// Trust the old CAs and the new one until the whole mesh has moved
+	caBundle := rawOldCA
+	oldPool, err := cert.NewCAPoolFromBytes(rawOldCA)
+	if err != nil {
+		return fmt.Errorf("error while parsing pki.ca: %s", err)
+	}
+	_, newCA := oldPool.CAs[issuer]
+	newCA = !newCA
+	if newCA {
+		caBundle = append(append(append([]byte{}, rawOldCA...), '\n'), rawCACert...)
+	}
+	pool, err := cert.NewCAPoolFromBytes(caBundle)
+	if err != nil {
+		return fmt.Errorf("error while parsing the new ca bundle: %s", err)
+	}
+	if _, err := nc.Verify(now, pool); err != nil {
+		return fmt.Errorf("the new certificate does not verify against the new ca bundle: %s", err)
+	}
+
+	// The old certificate keeps working for peers that only trust its CA, additional certs share the curve of cert
+	keepOld := newCA && oldCert.Details.Curve == curve && !oldCert.Expired(now)
+
+	outDir, err := filepath.Abs(*mf.outDir)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(outDir, 0700); err != nil {
+		return fmt.Errorf("error while creating out-dir: %s", err)
+	}
+
+	caPath := filepath.Join(outDir, "ca.crt")
+	certPath := filepath.Join(outDir, "host.crt")
+	keyPath := filepath.Join(outDir, "host.key")
+	configPath := filepath.Join(outDir, "config.yml")
+	planPath := filepath.Join(outDir, "plan.json")
+	files := []string{caPath, certPath, configPath, planPath}
+	if rawPriv != nil {
+		files = append(files, keyPath)
+	}
+	for _, p := range files {
+		if _, err := os.Stat(p); err == nil {
+			return fmt.Errorf("refusing to overwrite existing file: %s", p)
+		}
+	}
+
+	updateMigrateConfig(pkiNode, caPath, certPath, keyPath, rawPriv != nil, keepOld, curve)
+	newConfig, err := yaml.Marshal(&doc)
+	if err != nil {
+		return fmt.Errorf("error while marshalling config: %s", err)
+	}
+
+	var peerCerts []auditCert
+	if *mf.peersDir != "" {
+		peerCerts, err = readAuditCerts(*mf.peersDir, errOut)
+		if err != nil {
+			return err
+		}
+	}
+
+	plan := buildMigratePlan(c, oldCert, &nc, pool, peerCerts, keepOld, newCA, now)
+	plan.Files = files
+	b, err := json.MarshalIndent(plan, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error while marshalling plan: %s", err)
+	}
+
+	rawCert, err := nc.MarshalToPEM()
+	if err != nil {
+		return fmt.Errorf("error while marshalling certificate: %s", err)
+	}
+
+	writes := map[string][]byte{caPath: caBundle, certPath: rawCert, configPath: newConfig, planPath: append(b, '\n')}
+	if rawPriv != nil {
+		writes[keyPath] = cert.MarshalPrivateKey(curve, rawPriv)
+	}
+	for _, p := range files {
+		if err := writeFileSync(p, writes[p]); err != nil {
+			return fmt.Errorf("error while writing %s: %s", p, err)
+		}
+	}
+
+	for _, s := range plan.Stages {
+		fmt.Fprintf(out, "%s: %s\n", s.Name, s.Description)
+		if len(s.Peers) > 0 {
+			fmt.Fprintf(out, "  peers: %s\n", strings.Join(s.Peers, ", "))
+		}
+	}
+	fmt.Fprintf(out, "Wrote %s\n", planPath)
+	return nil
+}
+
+// parseMigrateNetworks parses -add-networks, only ipv6 networks can be added so the primary vpn ip stays the same
+func parseMigrateNetworks(s string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, rs := range strings.Split(s, ",") {
+		rs = strings.TrimSpace(rs)
+		if rs == "" {
+			continue
+		}
+
+		ip, ipNet, err := net.ParseCIDR(rs)
+		if err != nil {
+			return nil, newHelpErrorf("invalid add-networks definition: %s", err)
+		}
+		if ip.To4() != nil {
+			return nil, newHelpErrorf("invalid add-networks definition: %s is not an ipv6 network", rs)
+		}
+		ipNet.IP = ip
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
+
+// readPEMOrPath returns v if it is a PEM, like pki.ca and pki.cert may be, or the contents of the file it names
+func readPEMOrPath(v string) ([]byte, error) {
+	if v == "" {
+		return nil, fmt.Errorf("not set")
+	}
+	if strings.Contains(v, "-----BEGIN") {
+		return []byte(v), nil
+	}
+	return os.ReadFile(v)
+}
+
+// updateMigrateConfig points the pki section at the new files. The old cert and key are moved to additional_certs
+// when keepOld is set, the nodes are copied so PEMs and environment variables in them stay as they were.
+func updateMigrateConfig(pki *yaml.Node, caPath, certPath, keyPath string, newKey, keepOld bool, curve cert.Curve) {
+	if keepOld {
+		entry := &yaml.Node{Kind: yaml.MappingNode}
+		for _, k := range []string{"cert", "key"} {
+			if v := yamlMapValue(pki, k); v != nil {
+				copied := *v
+				entry.Content = append(entry.Content, &yaml.Node{Kind: yaml.ScalarNode, Value: k}, &copied)
+			}
+		}
+
+		additional := yamlMapValue(pki, "additional_certs")
+		if additional == nil || additional.Kind != yaml.SequenceNode {
+			additional = &yaml.Node{Kind: yaml.SequenceNode}
+			yamlSetValue(pki, "additional_certs", additional)
+		}
+		additional.Content = append(additional.Content, entry)
+	}
+
+	yamlSetValue(pki, "ca", &yaml.Node{Kind: yaml.ScalarNode, Value: caPath})
+	yamlSetValue(pki, "cert", &yaml.Node{Kind: yaml.ScalarNode, Value: certPath})
+	if newKey {
+		yamlSetValue(pki, "key", &yaml.Node{Kind: yaml.ScalarNode, Value: keyPath})
+	}
+
+	// A host that enrolls again must ask for the new curve
+	if enroll := yamlMapValue(pki, "enroll"); enroll != nil && enroll.Kind == yaml.MappingNode {
+		if yamlMapValue(enroll, "curve") != nil {
+			v := "25519"
+			if curve == cert.Curve_P256 {
+				v = "P256"
+			}
+			yamlSetValue(enroll, "curve", &yaml.Node{Kind: yaml.ScalarNode, Value: v})
+		}
+	}
+}
+
+// yamlMapValue returns the value of key in the mapping m, nil if it is not set
+func yamlMapValue(m *yaml.Node, key string) *yaml.Node {
+	for i := 0; i+1 < len(m.Content); i += 2 {
+		if m.Content[i].Value == key {
+			return m.Content[i+1]
+		}
+	}
+	return nil
+}
+
+// yamlSetValue replaces the value of key in the mapping m, adding it if it is not set
+func yamlSetValue(m *yaml.Node, key string, v *yaml.Node) {
+	for i := 0; i+1 < len(m.Content); i += 2 {
+		if m.Content[i].Value == key {
+			// Keep comments attached to the old value
+			v.HeadComment, v.LineComment, v.FootComment = m.Content[i+1].HeadComment, m.Content[i+1].LineComment, m.Content[i+1].FootComment
+			m.Content[i+1] = v
+			return
+		}
+	}
+	m.Content = append(m.Content, &yaml.Node{Kind: yaml.ScalarNode, Value: key}, v)
+}
+
+// migratePeers returns the vpn ips the config names as lighthouses, static hosts, relays, or pins with where each came
+// from
+func migratePeers(c *config.C) map[string][]string {
+	peers := map[string][]string{}
+	add := func(ip, source string) {
+		if net.ParseIP(ip) == nil {
+			return
+		}
+		for _, s := range peers[ip] {
+			if s == source {
+				return
+			}
+		}
+		peers[ip] = append(peers[ip], source)
+	}
+
+	for _, ip := range c.GetStringSlice("lighthouse.hosts", nil) {
+		add(ip, "lighthouse")
+	}
+	for ip := range c.GetMap("static_host_map", nil) {
+		add(fmt.Sprint(ip), "static_host_map")
+	}
+	for _, ip := range c.GetStringSlice("relay.relays", nil) {
+		add(ip, "relay")
+	}
+	for ip := range c.GetMap("pki.pins", nil) {
+		add(fmt.Sprint(ip), "pin")
+	}
+	return peers
+}
+
+func buildMigratePlan(c *config.C, oldCert, nc *cert.NebulaCertificate, pool *cert.NebulaCAPool, peerCerts []auditCert, keepOld, newCA bool, now time.Time) *migratePlan {
+	plan := &migratePlan{
+		Name:   nc.Details.Name,
+		Old:    newMigrateCert(oldCert),
+		New:    newMigrateCert(nc),
+		Peers:  []migratePeer{},
+		Stages: []migrateStage{},
+	}
+	if len(nc.Details.Ips) > 0 {
+		plan.VpnIp = nc.Details.Ips[0].IP.String()
+	}
+
+	byIp := map[string]*cert.NebulaCertificate{}
+	for _, pc := range peerCerts {
+		if pc.Cert.Details.IsCA || len(pc.Cert.Details.Ips) == 0 {
+			continue
+		}
+		ip := pc.Cert.Details.Ips[0].IP.String()
+		// The certificate that is valid the longest is the one the peer presents
+		if have, ok := byIp[ip]; !ok || pc.Cert.Details.NotAfter.After(have.Details.NotAfter) {
+			byIp[ip] = pc.Cert
+		}
+	}
+
+	var needsCA, curveMismatch []string
+	for ip, sources := range migratePeers(c) {
+		p := migratePeer{VpnIp: ip, Sources: sources, Trusted: "unknown", AcceptsNew: "unknown", AcceptsOld: "unknown"}
+		if pc := byIp[ip]; pc != nil {
+			p.Name = pc.Details.Name
+			p.Fingerprint, _ = pc.Fingerprint()
+
+			p.Trusted = "ok"
+			if _, err := pc.Verify(now, pool); err != nil {
+				p.Trusted = "untrusted"
+			}
+
+			// A peer is assumed to trust the CA of its own certificate, like handshakes assume
+			switch {
+			case pc.Details.Curve != nc.Details.Curve:
+				p.AcceptsNew = "curveMismatch"
+			case pc.Details.Issuer == nc.Details.Issuer:
+				p.AcceptsNew = "ok"
+			default:
+				p.AcceptsNew = "needsCa"
+			}
+
+			p.AcceptsOld = "no"
+			if keepOld && pc.Details.Curve == oldCert.Details.Curve && pc.Details.Issuer == oldCert.Details.Issuer {
+				p.AcceptsOld = "ok"
+			}
+		}
+
+		switch p.AcceptsNew {
+		case "needsCa", "unknown":
+			needsCA = append(needsCA, ip)
+		case "curveMismatch":
+			curveMismatch = append(curveMismatch, ip)
+		}
+		plan.Peers = append(plan.Peers, p)
+	}
+	sort.Slice(plan.Peers, func(i, j int) bool { return plan.Peers[i].VpnIp < plan.Peers[j].VpnIp })
+	sort.Strings(needsCA)
+	sort.Strings(curveMismatch)
+
+	if newCA {
+		plan.Stages = append(plan.Stages, migrateStage{
+			Name:        "trust-ca",
+			Description: "add ca.crt from the out-dir, or the new CA in it, to pki.ca of every peer and reload them",
+			Peers:       needsCA,
+		})
+	}
+	if len(curveMismatch) > 0 {
+		plan.Stages = append(plan.Stages, migrateStage{
+			Name:        "migrate-curve",
+			Description: fmt.Sprintf("move these peers to %s certificates too, they can not handshake across curves", nc.Details.Curve),
+			Peers:       curveMismatch,
+		})
+	}
+
+	install := "replace the config of this host with config.yml from the out-dir and reload nebula"
+	if keepOld {
+		install += ", the old certificate stays in pki.additional_certs for peers that only trust its CA"
+	}
+	plan.Stages = append(plan.Stages, migrateStage{Name: "install", Description: install})
+
+	plan.Stages = append(plan.Stages, migrateStage{
+		Name:        "update-pins",
+		Description: fmt.Sprintf("on peers that pin %s by fingerprint, add %s next to %s in pki.pins", plan.VpnIp, plan.New.Fingerprint, plan.Old.Fingerprint),
+	})
+
+	if keepOld {
+		plan.Stages = append(plan.Stages, migrateStage{
+			Name:        "cleanup",
+			Description: "once every peer presents a certificate from the new CA, remove the old certificate from pki.additional_certs and the old CA from pki.ca",
+		})
+	}
+
+	return plan
+}
+
+func newMigrateCert(nc *cert.NebulaCertificate) migrateCert {
+	fp, _ := nc.Fingerprint()
+	return migrateCert{
+		Fingerprint: fp,
+		Issuer:      nc.Details.Issuer,
+		Curve:       nc.Details.Curve.String(),
+		Hash:        nc.Details.Hash.String(),
+		Version:     nc.Version(),
+		NotAfter:    nc.Details.NotAfter,
+	}
+}
+
+func migratePKISummary() string {
+	return "migrate-pki <flags>: move a host to a certificate from a new CA, curve, hash, or version and plan the rollout"
+}
+
+func migratePKIHelp(out io.Writer) {
+	mf := newMigratePKIFlags()
+	out.Write([]byte("Usage of " + os.Args[0] + " " + migratePKISummary() + "\n"))
+	mf.set.SetOutput(out)
+	mf.set.PrintDefaults()
+}
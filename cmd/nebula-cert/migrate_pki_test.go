@@ -0,0 +1,170 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/slackhq/nebula/cert"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_migratePKISummary(t *testing.T) {
+	assert.Equal(t, "migrate-pki <flags>: move a host to a certificate from a new CA, curve, hash, or version and plan the rollout", migratePKISummary())
+}
+
+func Test_migratePKIHelp(t *testing.T) {
+	ob := &bytes.Buffer{}
+	migratePKIHelp(ob)
+	assert.Equal(
+		t,
+		"Usage of "+os.Args[0]+" migrate-pki <flags>: move a host to a certificate from a new CA, curve, hash, or version and plan the rollout\n"+
+			"  -add-networks string\n"+
+			"    \tOptional: comma separated list of ipv6 addresses in CIDR notation to add to the cert, which makes it a version 2 certificate\n"+
+			"  -ca-crt string\n"+
+			"    \tOptional: path to the signing CA cert, the curve of the new cert is the curve of this CA (default \"ca.crt\")\n"+
+			"  -ca-key string\n"+
+			"    \tOptional: path to the signing CA key (default \"ca.key\")\n"+
+			"  -config string\n"+
+			"    \tRequired: path to the nebula config file of the host, pki.ca and pki.cert are read from it\n"+
+			"  -duration duration\n"+
+			"    \tOptional: how long the new cert should be valid for. The default is the lifetime of the existing cert, capped at 1 second before the signing cert expires. Valid time units are seconds: \"s\", minutes: \"m\", hours: \"h\"\n"+
+			"  -hash string\n"+
+			"    \tOptional: hash used for the fingerprint and, with P256, the signature (sha256, sha384). The default is the hash of the signing cert\n"+
+			"  -new-key\n"+
+			"    \tOptional: generate a new keypair instead of reusing the existing public key. Always done when the curve changes\n"+
+			"  -out-dir string\n"+
+			"    \tRequired: directory to write the new ca bundle, cert, key, config and plan.json to\n"+
+			"  -peers string\n"+
+			"    \tOptional: directory of peer certificates, subdirectories are included. Peers from the config with a certificate here are checked against the new cert\n",
+		ob.String(),
+	)
+}
+
+func Test_migratePKI(t *testing.T) {
+	ob := &bytes.Buffer{}
+	eb := &bytes.Buffer{}
+	nopw := &StubPasswordReader{}
+
+	// required args
+	assertHelpError(t, migratePKI([]string{"-out-dir", "./nope"}, ob, eb, nopw), "-config is required")
+	assertHelpError(t, migratePKI([]string{"-config", "./nope"}, ob, eb, nopw), "-out-dir is required")
+	assertHelpError(t, migratePKI([]string{"-config", "./nope", "-out-dir", "./nope", "-add-networks", "10.0.0.1/24"}, ob, eb, nopw), "invalid add-networks definition: 10.0.0.1/24 is not an ipv6 network")
+
+	dir := t.TempDir()
+	path := func(name string) string { return filepath.Join(dir, name) }
+	require.NoError(t, os.Mkdir(path("peers"), 0700))
+
+	// the host and a peer on the old ca, the new ca on the same curve
+	require.NoError(t, ca([]string{"-name", "old", "-out-crt", path("old-ca.crt"), "-out-key", path("old-ca.key")}, ob, eb, nopw))
+	require.NoError(t, ca([]string{"-name", "new", "-out-crt", path("new-ca.crt"), "-out-key", path("new-ca.key")}, ob, eb, nopw))
+	require.NoError(t, ca([]string{"-name", "p256", "-curve", "P256", "-out-crt", path("p256-ca.crt"), "-out-key", path("p256-ca.key")}, ob, eb, nopw))
+	require.NoError(t, signCert([]string{"-ca-crt", path("old-ca.crt"), "-ca-key", path("old-ca.key"), "-name", "host", "-ip", "10.1.0.1/16", "-groups", "a,b", "-out-crt", path("host.crt"), "-out-key", path("host.key"), "-duration", "1h"}, ob, eb, nopw))
+	require.NoError(t, signCert([]string{"-ca-crt", path("old-ca.crt"), "-ca-key", path("old-ca.key"), "-name", "lh", "-ip", "10.1.0.2/16", "-out-crt", path("peers/lh.crt"), "-out-key", path("lh.key")}, ob, eb, nopw))
+
+	configPath := path("config.yml")
+	require.NoError(t, os.WriteFile(configPath, []byte(
+		"pki:\n"+
+			"  # the ca bundle\n"+
+			"  ca: "+path("old-ca.crt")+"\n"+
+			"  cert: "+path("host.crt")+"\n"+
+			"  key: "+path("host.key")+"\n"+
+			"static_host_map:\n"+
+			"  '10.1.0.2': ['192.0.2.1:4242']\n"+
+			"lighthouse:\n"+
+			"  hosts: ['10.1.0.2', '10.1.0.3']\n",
+	), 0600))
+
+	b, _ := os.ReadFile(path("host.crt"))
+	orig, _, err := cert.UnmarshalNebulaCertificateFromPEM(b)
+	require.NoError(t, err)
+
+	// the same curve, the key is kept and so is the old cert for peers that do not trust the new ca yet
+	ob.Reset()
+	outDir := path("out")
+	args := []string{"-config", configPath, "-ca-crt", path("new-ca.crt"), "-ca-key", path("new-ca.key"), "-out-dir", outDir, "-peers", path("peers"), "-add-networks", "fd00::1/64"}
+	require.NoError(t, migratePKI(args, ob, eb, nopw))
+	assert.Contains(t, ob.String(), "trust-ca: ")
+	assert.Contains(t, ob.String(), "  peers: 10.1.0.2, 10.1.0.3\n")
+
+	b, _ = os.ReadFile(filepath.Join(outDir, "host.crt"))
+	nc, _, err := cert.UnmarshalNebulaCertificateFromPEM(b)
+	require.NoError(t, err)
+	assert.Equal(t, orig.Details.Name, nc.Details.Name)
+	assert.Equal(t, orig.Details.Groups, nc.Details.Groups)
+	assert.Equal(t, orig.Details.PublicKey, nc.Details.PublicKey)
+	assert.Equal(t, "10.1.0.1/16", nc.Details.Ips[0].String())
+	assert.Equal(t, "fd00::1/64", nc.Details.Ips[1].String())
+	assert.Equal(t, uint32(2), nc.Version())
+	_, err = os.Stat(filepath.Join(outDir, "host.key"))
+	assert.True(t, os.IsNotExist(err))
+
+	// the new config loads and has both the new cert and the old one
+	c := config.NewC(test.NewLogger())
+	require.NoError(t, c.Load(filepath.Join(outDir, "config.yml")))
+	assert.Equal(t, filepath.Join(outDir, "ca.crt"), c.GetString("pki.ca", ""))
+	assert.Equal(t, filepath.Join(outDir, "host.crt"), c.GetString("pki.cert", ""))
+	assert.Equal(t, path("host.key"), c.GetString("pki.key", ""))
+	additional := c.Get("pki.additional_certs").([]interface{})
+	require.Len(t, additional, 1)
+	assert.Equal(t, path("host.crt"), additional[0].(map[interface{}]interface{})["cert"])
+	b, _ = os.ReadFile(filepath.Join(outDir, "config.yml"))
+	assert.Contains(t, string(b), "# the ca bundle")
+
+	b, _ = os.ReadFile(filepath.Join(outDir, "ca.crt"))
+	pool, err := cert.NewCAPoolFromBytes(b)
+	require.NoError(t, err)
+	assert.Len(t, pool.CAs, 2)
+
+	var plan migratePlan
+	b, _ = os.ReadFile(filepath.Join(outDir, "plan.json"))
+	require.NoError(t, json.Unmarshal(b, &plan))
+	assert.Equal(t, "host", plan.Name)
+	assert.Equal(t, orig.Details.Issuer, plan.Old.Issuer)
+	assert.Equal(t, uint32(1), plan.Old.Version)
+	assert.Equal(t, uint32(2), plan.New.Version)
+	require.Len(t, plan.Peers, 2)
+	assert.Equal(t, migratePeer{VpnIp: "10.1.0.2", Sources: []string{"lighthouse", "static_host_map"}, Name: "lh", Fingerprint: plan.Peers[0].Fingerprint, Trusted: "ok", AcceptsNew: "needsCa", AcceptsOld: "ok"}, plan.Peers[0])
+	assert.Equal(t, migratePeer{VpnIp: "10.1.0.3", Sources: []string{"lighthouse"}, Trusted: "unknown", AcceptsNew: "unknown", AcceptsOld: "unknown"}, plan.Peers[1])
+	var stages []string
+	for _, s := range plan.Stages {
+		stages = append(stages, s.Name)
+	}
+	assert.Equal(t, []string{"trust-ca", "install", "update-pins", "cleanup"}, stages)
+
+	// existing outputs are not replaced
+	assert.EqualError(t, migratePKI(args, ob, eb, nopw), "refusing to overwrite existing file: "+filepath.Join(outDir, "ca.crt"))
+
+	// a new curve needs a new key and the old cert can not be kept
+	outDir = path("out-p256")
+	args = []string{"-config", configPath, "-ca-crt", path("p256-ca.crt"), "-ca-key", path("p256-ca.key"), "-out-dir", outDir, "-peers", path("peers")}
+	require.NoError(t, migratePKI(args, ob, eb, nopw))
+
+	b, _ = os.ReadFile(filepath.Join(outDir, "host.crt"))
+	nc, _, err = cert.UnmarshalNebulaCertificateFromPEM(b)
+	require.NoError(t, err)
+	assert.Equal(t, cert.Curve_P256, nc.Details.Curve)
+	b, _ = os.ReadFile(filepath.Join(outDir, "host.key"))
+	key, _, curve, err := cert.UnmarshalPrivateKey(b)
+	require.NoError(t, err)
+	assert.NoError(t, nc.VerifyPrivateKey(curve, key))
+
+	c = config.NewC(test.NewLogger())
+	require.NoError(t, c.Load(filepath.Join(outDir, "config.yml")))
+	assert.Equal(t, filepath.Join(outDir, "host.key"), c.GetString("pki.key", ""))
+	assert.Nil(t, c.Get("pki.additional_certs"))
+
+	plan = migratePlan{}
+	b, _ = os.ReadFile(filepath.Join(outDir, "plan.json"))
+	require.NoError(t, json.Unmarshal(b, &plan))
+	assert.Equal(t, "curveMismatch", plan.Peers[0].AcceptsNew)
+	assert.Equal(t, "no", plan.Peers[0].AcceptsOld)
+}
@@ -8,7 +8,6 @@ import (
 	"os"
 	"strings"
 
-	"github.com/skip2/go-qrcode"
 	"github.com/slackhq/nebula/cert"
 )
 
@@ -16,6 +15,7 @@ type printFlags struct {
 	set       *flag.FlagSet
 	json      *bool
 	outQRPath *string
+	qrFormat  *string
 	path      *string
 }
 
@@ -23,7 +23,8 @@ func newPrintFlags() *printFlags {
 	pf := printFlags{set: flag.NewFlagSet("print", flag.ContinueOnError)}
 	pf.set.Usage = func() {}
 	pf.json = pf.set.Bool("json", false, "Optional: outputs certificates in json format")
-	pf.outQRPath = pf.set.String("out-qr", "", "Optional: output a qr code image (png) of the certificate")
+	pf.outQRPath = pf.set.String("out-qr", "", "Optional: output a qr code of the certificate, see -qr-format")
+	pf.qrFormat = pf.set.String("qr-format", "png", "Optional: format of the qr code written to out-qr, png for an image or ansi for text that can be printed to a terminal")
 	pf.path = pf.set.String("path", "", "Required: path to the certificate")
 
 	return &pf
@@ -39,6 +40,9 @@ func printCert(args []string, out io.Writer, errOut io.Writer) error {
 	if err := mustFlagString("path", pf.path); err != nil {
 		return err
 	}
+	if err := checkQRFormat(*pf.qrFormat); err != nil {
+		return err
+	}
 
 	rawCert, err := os.ReadFile(*pf.path)
 	if err != nil {
@@ -81,14 +85,8 @@ func printCert(args []string, out io.Writer, errOut io.Writer) error {
 	}
 
 	if *pf.outQRPath != "" {
-		b, err := qrcode.Encode(string(qrBytes), qrcode.Medium, -5)
-		if err != nil {
-			return fmt.Errorf("error while generating qr code: %s", err)
-		}
-
-		err = os.WriteFile(*pf.outQRPath, b, 0600)
-		if err != nil {
-			return fmt.Errorf("error while writing out-qr: %s", err)
+		if err := writeQR(*pf.outQRPath, *pf.qrFormat, qrBytes); err != nil {
+			return err
 		}
 	}
 
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/skip2/go-qrcode"
+)
+
+// checkQRFormat validates the -qr-format flag before any work is done
+func checkQRFormat(format string) error {
+	switch format {
+	case "png", "ansi":
+		return nil
+	default:
+		return newHelpErrorf("invalid qr-format: %s, must be png or ansi", format)
+	}
+}
+
+// writeQR encodes content as a qr code and writes it to path. The png format is an image, the ansi format is text
+// made of unicode block characters that can be printed directly to a terminal.
+func writeQR(path string, format string, content []byte) error {
+	q, err := qrcode.New(string(content), qrcode.Medium)
+	if err != nil {
+		return fmt.Errorf("error while generating qr code: %s", err)
+	}
+
+	var b []byte
+	switch format {
+	case "ansi":
+		b = []byte(q.ToSmallString(false))
+	default:
+		b, err = q.PNG(-5)
+		if err != nil {
+			return fmt.Errorf("error while generating qr code: %s", err)
+		}
+	}
+
+	err = os.WriteFile(path, b, 0600)
+	if err != nil {
+		return fmt.Errorf("error while writing out-qr: %s", err)
+	}
+
+	return nil
+}
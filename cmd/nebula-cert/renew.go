@@ -0,0 +1,241 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/slackhq/nebula/cert"
+)
+
+type renewFlags struct {
+	set        *flag.FlagSet
+	caKeyPath  *string
+	caCertPath *string
+	path       *string
+	keyPath    *string
+	duration   *time.Duration
+	newKey     *bool
+	noBackup   *bool
+	log        *string
+}
+
+func newRenewFlags() *renewFlags {
+	rf := renewFlags{set: flag.NewFlagSet("renew", flag.ContinueOnError)}
+	rf.set.Usage = func() {}
+	rf.caKeyPath = rf.set.String("ca-key", "ca.key", "Optional: path to the signing CA key")
+	rf.caCertPath = rf.set.String("ca-crt", "ca.crt", "Optional: path to the signing CA cert")
+	rf.path = rf.set.String("path", "", "Required: path to the certificate to renew, it is replaced in place")
+	rf.keyPath = rf.set.String("key", "", "Optional: path to the private key to replace when -new-key is set. The default is the cert path with a .key extension")
+	rf.duration = rf.set.Duration("duration", 0, "Optional: how long the renewed cert should be valid for. The default is the lifetime of the existing cert, capped at 1 second before the signing cert expires. Valid time units are seconds: \"s\", minutes: \"m\", hours: \"h\"")
+	rf.newKey = rf.set.Bool("new-key", false, "Optional: generate a new keypair instead of reusing the existing public key")
+	rf.noBackup = rf.set.Bool("no-backup", false, "Optional: do not keep a .bak copy of replaced files")
+	rf.log = rf.set.String("log", "", "Optional: transparency log to submit the cert to, either a log directory or the url of a nebula-cert log-server. The inclusion proof is stored in the cert")
+	return &rf
+}
+
+func renewCert(args []string, out io.Writer, errOut io.Writer, pr PasswordReader) error {
+	rf := newRenewFlags()
+	err := rf.set.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	if err := mustFlagString("path", rf.path); err != nil {
+		return err
+	}
+	if err := mustFlagString("ca-key", rf.caKeyPath); err != nil {
+		return err
+	}
+	if err := mustFlagString("ca-crt", rf.caCertPath); err != nil {
+		return err
+	}
+	if *rf.keyPath != "" && !*rf.newKey {
+		return newHelpErrorf("-key is only used with -new-key")
+	}
+
+	rawCert, err := os.ReadFile(*rf.path)
+	if err != nil {
+		return fmt.Errorf("error while reading path: %s", err)
+	}
+
+	oldCert, _, err := cert.UnmarshalNebulaCertificateFromPEM(rawCert)
+	if err != nil {
+		return fmt.Errorf("error while parsing path: %s", err)
+	}
+
+	if oldCert.Details.IsCA {
+		return fmt.Errorf("refusing to renew a CA certificate, use the ca mode instead")
+	}
+
+	curve, caKey, err := readCAKey(*rf.caKeyPath, out, pr)
+	if err != nil {
+		return err
+	}
+
+	rawCACert, err := os.ReadFile(*rf.caCertPath)
+	if err != nil {
+		return fmt.Errorf("error while reading ca-crt: %s", err)
+	}
+
+	caCert, _, err := cert.UnmarshalNebulaCertificateFromPEM(rawCACert)
+	if err != nil {
+		return fmt.Errorf("error while parsing ca-crt: %s", err)
+	}
+
+	if err := caCert.VerifyPrivateKey(curve, caKey); err != nil {
+		return fmt.Errorf("refusing to sign, root certificate does not match private key")
+	}
+
+	issuer, err := caCert.Fingerprint()
+	if err != nil {
+		return fmt.Errorf("error while getting -ca-crt fingerprint: %s", err)
+	}
+
+	now := time.Now()
+	if caCert.Expired(now) {
+		return fmt.Errorf("ca certificate is expired")
+	}
+
+	if oldCert.Details.Curve != curve {
+		return fmt.Errorf("curve of the certificate does not match ca")
+	}
+
+	// if no duration is given, keep the lifetime of the existing cert
+	if *rf.duration <= 0 {
+		*rf.duration = oldCert.Details.NotAfter.Sub(oldCert.Details.NotBefore)
+	}
+
+	notAfter := now.Add(*rf.duration)
+	if maxNotAfter := caCert.Details.NotAfter.Add(-time.Second); notAfter.After(maxNotAfter) {
+		notAfter = maxNotAfter
+	}
+
+	pub := oldCert.Details.PublicKey
+	var rawPriv []byte
+	if *rf.newKey {
+		pub, rawPriv = newKeypair(curve)
+	}
+
+	nc := cert.NebulaCertificate{
+		Details: cert.NebulaCertificateDetails{
+			Name:      oldCert.Details.Name,
+			Ips:       oldCert.Details.Ips,
+			Groups:    oldCert.Details.Groups,
+			Subnets:   oldCert.Details.Subnets,
+			NotBefore: now,
+			NotAfter:  notAfter,
+			PublicKey: pub,
+			IsCA:      false,
+			Issuer:    issuer,
+			Curve:     curve,
+			Hash:      oldCert.Details.Hash,
+		},
+	}
+
+	if err := nc.CheckRootConstrains(caCert); err != nil {
+		return fmt.Errorf("refusing to sign, root certificate constraints violated: %s", err)
+	}
+
+	err = nc.Sign(curve, caKey)
+	if err != nil {
+		return fmt.Errorf("error while signing: %s", err)
+	}
+
+	if *rf.log != "" {
+		if err = submitToLog(*rf.log, &nc); err != nil {
+			return err
+		}
+	}
+
+	b, err := nc.MarshalToPEM()
+	if err != nil {
+		return fmt.Errorf("error while marshalling certificate: %s", err)
+	}
+
+	if *rf.newKey {
+		if *rf.keyPath == "" {
+			*rf.keyPath = strings.TrimSuffix(*rf.path, filepath.Ext(*rf.path)) + ".key"
+		}
+
+		// Write the key first, if the cert can not be written afterwards the old key is still in the backup
+		err = replaceFile(*rf.keyPath, cert.MarshalPrivateKey(curve, rawPriv), !*rf.noBackup)
+		if err != nil {
+			return fmt.Errorf("error while writing key: %s", err)
+		}
+	}
+
+	err = replaceFile(*rf.path, b, !*rf.noBackup)
+	if err != nil {
+		return fmt.Errorf("error while writing path: %s", err)
+	}
+
+	fmt.Fprintf(out, "Renewed %s, valid until %s\n", *rf.path, notAfter.Round(time.Second))
+	return nil
+}
+
+// replaceFile atomically replaces path with b. If backup is true the existing file is first copied to path.bak
+func replaceFile(path string, b []byte, backup bool) error {
+	if backup {
+		old, err := os.ReadFile(path)
+		if err == nil {
+			err = writeFileSync(path+".bak", old)
+		}
+		if err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to backup %s: %s", path, err)
+		}
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(b)
+	if err == nil {
+		err = tmp.Chmod(0600)
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
+
+func writeFileSync(path string, b []byte) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	_, err = f.Write(b)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func renewSummary() string {
+	return "renew <flags>: re-sign an existing certificate with a new validity period"
+}
+
+func renewHelp(out io.Writer) {
+	rf := newRenewFlags()
+	out.Write([]byte("Usage of " + os.Args[0] + " " + renewSummary() + "\n"))
+	rf.set.SetOutput(out)
+	rf.set.PrintDefaults()
+}
@@ -0,0 +1,171 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/slackhq/nebula/cert"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ed25519"
+)
+
+func Test_renewSummary(t *testing.T) {
+	assert.Equal(t, "renew <flags>: re-sign an existing certificate with a new validity period", renewSummary())
+}
+
+func Test_renewHelp(t *testing.T) {
+	ob := &bytes.Buffer{}
+	renewHelp(ob)
+	assert.Equal(
+		t,
+		"Usage of "+os.Args[0]+" renew <flags>: re-sign an existing certificate with a new validity period\n"+
+			"  -ca-crt string\n"+
+			"    \tOptional: path to the signing CA cert (default \"ca.crt\")\n"+
+			"  -ca-key string\n"+
+			"    \tOptional: path to the signing CA key (default \"ca.key\")\n"+
+			"  -duration duration\n"+
+			"    \tOptional: how long the renewed cert should be valid for. The default is the lifetime of the existing cert, capped at 1 second before the signing cert expires. Valid time units are seconds: \"s\", minutes: \"m\", hours: \"h\"\n"+
+			"  -key string\n"+
+			"    \tOptional: path to the private key to replace when -new-key is set. The default is the cert path with a .key extension\n"+
+			"  -log string\n"+
+			"    \tOptional: transparency log to submit the cert to, either a log directory or the url of a nebula-cert log-server. The inclusion proof is stored in the cert\n"+
+			"  -new-key\n"+
+			"    \tOptional: generate a new keypair instead of reusing the existing public key\n"+
+			"  -no-backup\n"+
+			"    \tOptional: do not keep a .bak copy of replaced files\n"+
+			"  -path string\n"+
+			"    \tRequired: path to the certificate to renew, it is replaced in place\n",
+		ob.String(),
+	)
+}
+
+func Test_renewCert(t *testing.T) {
+	ob := &bytes.Buffer{}
+	eb := &bytes.Buffer{}
+
+	nopw := &StubPasswordReader{
+		password: []byte(""),
+		err:      nil,
+	}
+
+	// required args
+	assertHelpError(t, renewCert([]string{"-ca-crt", "./nope", "-ca-key", "./nope"}, ob, eb, nopw), "-path is required")
+	assertHelpError(t, renewCert([]string{"-path", "./nope", "-key", "./nope"}, ob, eb, nopw), "-key is only used with -new-key")
+
+	// failed to read cert
+	assert.EqualError(t, renewCert([]string{"-path", "./nope"}, ob, eb, nopw), "error while reading path: open ./nope: "+NoSuchFileError)
+	assert.Empty(t, ob.String())
+	assert.Empty(t, eb.String())
+
+	dir := t.TempDir()
+	caKeyPath := filepath.Join(dir, "ca.key")
+	caCrtPath := filepath.Join(dir, "ca.crt")
+	crtPath := filepath.Join(dir, "host.crt")
+	keyPath := filepath.Join(dir, "host.key")
+
+	caPub, caPriv, _ := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, os.WriteFile(caKeyPath, cert.MarshalEd25519PrivateKey(caPriv), 0600))
+
+	ca := cert.NebulaCertificate{
+		Details: cert.NebulaCertificateDetails{
+			Name:      "ca",
+			NotBefore: time.Now(),
+			NotAfter:  time.Now().Add(time.Minute * 200),
+			PublicKey: caPub,
+			IsCA:      true,
+		},
+	}
+	require.NoError(t, ca.Sign(cert.Curve_CURVE25519, caPriv))
+	b, _ := ca.MarshalToPEM()
+	require.NoError(t, os.WriteFile(caCrtPath, b, 0600))
+
+	// refuse to renew a ca cert
+	args := []string{"-ca-crt", caCrtPath, "-ca-key", caKeyPath, "-path", caCrtPath}
+	assert.EqualError(t, renewCert(args, ob, eb, nopw), "refusing to renew a CA certificate, use the ca mode instead")
+
+	args = []string{"-ca-crt", caCrtPath, "-ca-key", caKeyPath, "-name", "host", "-ip", "1.1.1.1/24", "-groups", "a,b", "-out-crt", crtPath, "-out-key", keyPath, "-duration", "10m"}
+	require.NoError(t, signCert(args, ob, eb, nopw))
+	origCrt, _ := os.ReadFile(crtPath)
+	origKey, _ := os.ReadFile(keyPath)
+	orig, _, err := cert.UnmarshalNebulaCertificateFromPEM(origCrt)
+	require.NoError(t, err)
+
+	// renew reusing the existing keypair
+	ob.Reset()
+	eb.Reset()
+	args = []string{"-ca-crt", caCrtPath, "-ca-key", caKeyPath, "-path", crtPath, "-duration", "1h"}
+	require.NoError(t, renewCert(args, ob, eb, nopw))
+	assert.Contains(t, ob.String(), "Renewed "+crtPath)
+	assert.Empty(t, eb.String())
+
+	b, _ = os.ReadFile(crtPath)
+	nc, _, err := cert.UnmarshalNebulaCertificateFromPEM(b)
+	require.NoError(t, err)
+	assert.Equal(t, orig.Details.Name, nc.Details.Name)
+	assert.Equal(t, orig.Details.Ips, nc.Details.Ips)
+	assert.Equal(t, orig.Details.Groups, nc.Details.Groups)
+	assert.Equal(t, orig.Details.PublicKey, nc.Details.PublicKey)
+	assert.True(t, nc.Details.NotAfter.After(orig.Details.NotAfter))
+	assert.True(t, nc.CheckSignature(caPub))
+
+	b, _ = os.ReadFile(crtPath + ".bak")
+	assert.Equal(t, origCrt, b)
+	b, _ = os.ReadFile(keyPath)
+	assert.Equal(t, origKey, b)
+
+	// the default duration is capped by the ca
+	args = []string{"-ca-crt", caCrtPath, "-ca-key", caKeyPath, "-path", crtPath, "-duration", "1000h"}
+	require.NoError(t, renewCert(args, ob, eb, nopw))
+	b, _ = os.ReadFile(crtPath)
+	nc, _, err = cert.UnmarshalNebulaCertificateFromPEM(b)
+	require.NoError(t, err)
+	assert.False(t, nc.Details.NotAfter.After(ca.Details.NotAfter))
+
+	// renew with a new keypair
+	renewedCrt, _ := os.ReadFile(crtPath)
+	args = []string{"-ca-crt", caCrtPath, "-ca-key", caKeyPath, "-path", crtPath, "-new-key"}
+	require.NoError(t, renewCert(args, ob, eb, nopw))
+
+	b, _ = os.ReadFile(crtPath)
+	nc, _, err = cert.UnmarshalNebulaCertificateFromPEM(b)
+	require.NoError(t, err)
+	assert.NotEqual(t, orig.Details.PublicKey, nc.Details.PublicKey)
+
+	b, _ = os.ReadFile(keyPath)
+	key, _, err := cert.UnmarshalX25519PrivateKey(b)
+	require.NoError(t, err)
+	assert.NoError(t, nc.VerifyPrivateKey(cert.Curve_CURVE25519, key))
+
+	b, _ = os.ReadFile(crtPath + ".bak")
+	assert.Equal(t, renewedCrt, b)
+	b, _ = os.ReadFile(keyPath + ".bak")
+	assert.Equal(t, origKey, b)
+
+	// no backups
+	require.NoError(t, os.Remove(crtPath+".bak"))
+	args = []string{"-ca-crt", caCrtPath, "-ca-key", caKeyPath, "-path", crtPath, "-no-backup"}
+	require.NoError(t, renewCert(args, ob, eb, nopw))
+	_, err = os.Stat(crtPath + ".bak")
+	assert.True(t, os.IsNotExist(err))
+
+	// an encrypted ca key can be decrypted non-interactively
+	passphrase := []byte("DO NOT USE THIS KEY")
+	kdfParams := cert.NewArgon2Parameters(64*1024, 4, 3)
+	b, err = cert.EncryptAndMarshalSigningPrivateKey(cert.Curve_CURVE25519, caPriv, passphrase, kdfParams)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(caKeyPath, b, 0600))
+
+	args = []string{"-ca-crt", caCrtPath, "-ca-key", caKeyPath, "-path", crtPath}
+	assert.EqualError(t, renewCert(args, ob, eb, &StubPasswordReader{err: ErrNoTerminal}), "ca-key is encrypted and must be decrypted interactively")
+
+	t.Setenv("NEBULA_CA_PASSPHRASE", string(passphrase))
+	require.NoError(t, renewCert(args, ob, eb, &StubPasswordReader{err: ErrNoTerminal}))
+}
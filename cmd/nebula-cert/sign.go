@@ -1,17 +1,20 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"crypto/ecdh"
 	"crypto/rand"
+	"encoding/base64"
 	"flag"
 	"fmt"
 	"io"
 	"net"
 	"os"
+	"sort"
 	"strings"
 	"time"
 
-	"github.com/skip2/go-qrcode"
 	"github.com/slackhq/nebula/cert"
 	"golang.org/x/crypto/curve25519"
 )
@@ -27,8 +30,16 @@ type signFlags struct {
 	outKeyPath  *string
 	outCertPath *string
 	outQRPath   *string
+	qrFormat    *string
+	outBundle   *string
+	qrBundle    *bool
 	groups      *string
 	subnets     *string
+	notBefore   *string
+	reproduce   *bool
+	nonce       *string
+	hash        *string
+	log         *string
 }
 
 func newSignFlags() *signFlags {
@@ -37,14 +48,22 @@ func newSignFlags() *signFlags {
 	sf.caKeyPath = sf.set.String("ca-key", "ca.key", "Optional: path to the signing CA key")
 	sf.caCertPath = sf.set.String("ca-crt", "ca.crt", "Optional: path to the signing CA cert")
 	sf.name = sf.set.String("name", "", "Required: name of the cert, usually a hostname")
-	sf.ip = sf.set.String("ip", "", "Required: ipv4 address and network in CIDR notation to assign the cert")
+	sf.ip = sf.set.String("ip", "", "Required: comma separated list of ipv4 and ipv6 addresses and networks in CIDR notation to assign the cert, the first ipv4 address is the primary vpn ip")
 	sf.duration = sf.set.Duration("duration", 0, "Optional: how long the cert should be valid for. The default is 1 second before the signing cert expires. Valid time units are seconds: \"s\", minutes: \"m\", hours: \"h\"")
 	sf.inPubPath = sf.set.String("in-pub", "", "Optional (if out-key not set): path to read a previously generated public key")
 	sf.outKeyPath = sf.set.String("out-key", "", "Optional (if in-pub not set): path to write the private key to")
 	sf.outCertPath = sf.set.String("out-crt", "", "Optional: path to write the certificate to")
-	sf.outQRPath = sf.set.String("out-qr", "", "Optional: output a qr code image (png) of the certificate")
+	sf.outQRPath = sf.set.String("out-qr", "", "Optional: output a qr code of the certificate, see -qr-format")
+	sf.qrFormat = sf.set.String("qr-format", "png", "Optional: format of the qr code written to out-qr, png for an image or ansi for text that can be printed to a terminal")
+	sf.outBundle = sf.set.String("out-bundle", "", "Optional (if in-pub not set): path to write a provisioning bundle containing the certificate, private key, and CA")
+	sf.qrBundle = sf.set.Bool("qr-bundle", false, "Optional (if in-pub not set): encode the provisioning bundle in the qr code instead of the certificate, for enrolling mobile clients")
 	sf.groups = sf.set.String("groups", "", "Optional: comma separated list of groups")
-	sf.subnets = sf.set.String("subnets", "", "Optional: comma separated list of ipv4 address and network in CIDR notation. Subnets this cert can serve for")
+	sf.subnets = sf.set.String("subnets", "", "Optional: comma separated list of ipv4 and ipv6 addresses and networks in CIDR notation. Subnets this cert can serve for")
+	sf.notBefore = sf.set.String("not-before", "", "Optional: RFC 3339 time the cert is valid from instead of now, duration is counted from it")
+	sf.reproduce = sf.set.Bool("reproducible", false, "Optional: write identical bytes for identical inputs so certs kept in git only change when their details do. Requires in-pub and not-before, an existing out-crt is replaced")
+	sf.nonce = sf.set.String("nonce", "", "Optional (if reproducible set): mixed into the signature, change it to get a new signature for otherwise identical inputs")
+	sf.hash = sf.set.String("hash", "", "Optional: hash used for the fingerprint and, with P256, the signature (sha256, sha384). The default is the hash of the signing cert")
+	sf.log = sf.set.String("log", "", "Optional: transparency log to submit the cert to, either a log directory or the url of a nebula-cert log-server. The inclusion proof is stored in the cert")
 	return &sf
 
 }
@@ -71,44 +90,36 @@ func signCert(args []string, out io.Writer, errOut io.Writer, pr PasswordReader)
 	if *sf.inPubPath != "" && *sf.outKeyPath != "" {
 		return newHelpErrorf("cannot set both -in-pub and -out-key")
 	}
-
-	rawCAKey, err := os.ReadFile(*sf.caKeyPath)
-	if err != nil {
-		return fmt.Errorf("error while reading ca-key: %s", err)
+	if *sf.inPubPath != "" && (*sf.outBundle != "" || *sf.qrBundle) {
+		return newHelpErrorf("cannot set -in-pub with -out-bundle or -qr-bundle, the bundle requires the private key")
+	}
+	if *sf.qrBundle && *sf.outQRPath == "" {
+		return newHelpErrorf("-qr-bundle requires -out-qr")
+	}
+	if err := checkQRFormat(*sf.qrFormat); err != nil {
+		return err
+	}
+	if *sf.reproduce && (*sf.inPubPath == "" || *sf.notBefore == "") {
+		return newHelpErrorf("-reproducible requires -in-pub and -not-before")
+	}
+	if *sf.nonce != "" && !*sf.reproduce {
+		return newHelpErrorf("-nonce requires -reproducible")
+	}
+	if *sf.log != "" && *sf.reproduce {
+		return newHelpErrorf("cannot set both -log and -reproducible, the inclusion proof changes every time the cert is logged")
 	}
 
-	var curve cert.Curve
-	var caKey []byte
-
-	// naively attempt to decode the private key as though it is not encrypted
-	caKey, _, curve, err = cert.UnmarshalSigningPrivateKey(rawCAKey)
-	if err == cert.ErrPrivateKeyEncrypted {
-		// ask for a passphrase until we get one
-		var passphrase []byte
-		for i := 0; i < 5; i++ {
-			out.Write([]byte("Enter passphrase: "))
-			passphrase, err = pr.ReadPassword()
-
-			if err == ErrNoTerminal {
-				return fmt.Errorf("ca-key is encrypted and must be decrypted interactively")
-			} else if err != nil {
-				return fmt.Errorf("error reading password: %s", err)
-			}
-
-			if len(passphrase) > 0 {
-				break
-			}
-		}
-		if len(passphrase) == 0 {
-			return fmt.Errorf("cannot open encrypted ca-key without passphrase")
-		}
-
-		curve, caKey, _, err = cert.DecryptAndUnmarshalSigningPrivateKey(passphrase, rawCAKey)
+	notBefore := time.Now()
+	if *sf.notBefore != "" {
+		notBefore, err = time.Parse(time.RFC3339, *sf.notBefore)
 		if err != nil {
-			return fmt.Errorf("error while parsing encrypted ca-key: %s", err)
+			return newHelpErrorf("invalid not-before: %s", err)
 		}
-	} else if err != nil {
-		return fmt.Errorf("error while parsing ca-key: %s", err)
+	}
+
+	curve, caKey, err := readCAKey(*sf.caKeyPath, out, pr)
+	if err != nil {
+		return err
 	}
 
 	rawCACert, err := os.ReadFile(*sf.caCertPath)
@@ -125,28 +136,46 @@ func signCert(args []string, out io.Writer, errOut io.Writer, pr PasswordReader)
 		return fmt.Errorf("refusing to sign, root certificate does not match private key")
 	}
 
-	issuer, err := caCert.Sha256Sum()
+	issuer, err := caCert.Fingerprint()
 	if err != nil {
 		return fmt.Errorf("error while getting -ca-crt fingerprint: %s", err)
 	}
 
+	hash := caCert.Details.Hash
+	if *sf.hash != "" {
+		hash, err = cert.ParseHashAlgorithm(*sf.hash)
+		if err != nil {
+			return newHelpErrorf("invalid hash: %s", err)
+		}
+	}
+
 	if caCert.Expired(time.Now()) {
 		return fmt.Errorf("ca certificate is expired")
 	}
 
 	// if no duration is given, expire one second before the root expires
 	if *sf.duration <= 0 {
-		*sf.duration = time.Until(caCert.Details.NotAfter) - time.Second*1
+		*sf.duration = caCert.Details.NotAfter.Sub(notBefore) - time.Second*1
 	}
 
-	ip, ipNet, err := net.ParseCIDR(*sf.ip)
-	if err != nil {
-		return newHelpErrorf("invalid ip definition: %s", err)
+	var ips []*net.IPNet
+	for _, rs := range strings.Split(*sf.ip, ",") {
+		rs := strings.Trim(rs, " ")
+		if rs != "" {
+			ip, ipNet, err := net.ParseCIDR(rs)
+			if err != nil {
+				return newHelpErrorf("invalid ip definition: %s", err)
+			}
+			ipNet.IP = ip
+			ips = append(ips, ipNet)
+		}
 	}
-	if ip.To4() == nil {
-		return newHelpErrorf("invalid ip definition: can only be ipv4, have %s", *sf.ip)
+	if len(ips) == 0 {
+		return newHelpErrorf("invalid ip definition: no ips, have %s", *sf.ip)
 	}
-	ipNet.IP = ip
+	// The certificate encodes the ipv4 networks before the ipv6 networks, keep that order so what we sign is what
+	// hosts read back
+	sort.SliceStable(ips, func(i, j int) bool { return ips[i].IP.To4() != nil && ips[j].IP.To4() == nil })
 
 	groups := []string{}
 	if *sf.groups != "" {
@@ -167,9 +196,6 @@ func signCert(args []string, out io.Writer, errOut io.Writer, pr PasswordReader)
 				if err != nil {
 					return newHelpErrorf("invalid subnet definition: %s", err)
 				}
-				if s.IP.To4() == nil {
-					return newHelpErrorf("invalid subnet definition: can only be ipv4, have %s", rs)
-				}
 				subnets = append(subnets, s)
 			}
 		}
@@ -196,15 +222,16 @@ func signCert(args []string, out io.Writer, errOut io.Writer, pr PasswordReader)
 	nc := cert.NebulaCertificate{
 		Details: cert.NebulaCertificateDetails{
 			Name:      *sf.name,
-			Ips:       []*net.IPNet{ipNet},
+			Ips:       ips,
 			Groups:    groups,
 			Subnets:   subnets,
-			NotBefore: time.Now(),
-			NotAfter:  time.Now().Add(*sf.duration),
+			NotBefore: notBefore,
+			NotAfter:  notBefore.Add(*sf.duration),
 			PublicKey: pub,
 			IsCA:      false,
 			Issuer:    issuer,
 			Curve:     curve,
+			Hash:      hash,
 		},
 	}
 
@@ -220,15 +247,25 @@ func signCert(args []string, out io.Writer, errOut io.Writer, pr PasswordReader)
 		*sf.outCertPath = *sf.name + ".crt"
 	}
 
-	if _, err := os.Stat(*sf.outCertPath); err == nil {
+	if _, err := os.Stat(*sf.outCertPath); err == nil && !*sf.reproduce {
 		return fmt.Errorf("refusing to overwrite existing cert: %s", *sf.outCertPath)
 	}
 
-	err = nc.Sign(curve, caKey)
+	if *sf.reproduce {
+		err = nc.SignDeterministic(curve, caKey, []byte(*sf.nonce))
+	} else {
+		err = nc.Sign(curve, caKey)
+	}
 	if err != nil {
 		return fmt.Errorf("error while signing: %s", err)
 	}
 
+	if *sf.log != "" {
+		if err = submitToLog(*sf.log, &nc); err != nil {
+			return err
+		}
+	}
+
 	if *sf.inPubPath == "" {
 		if _, err := os.Stat(*sf.outKeyPath); err == nil {
 			return fmt.Errorf("refusing to overwrite existing key: %s", *sf.outKeyPath)
@@ -245,21 +282,111 @@ func signCert(args []string, out io.Writer, errOut io.Writer, pr PasswordReader)
 		return fmt.Errorf("error while marshalling certificate: %s", err)
 	}
 
-	err = os.WriteFile(*sf.outCertPath, b, 0600)
-	if err != nil {
-		return fmt.Errorf("error while writing out-crt: %s", err)
+	// Leave an identical cert alone so regenerating does not touch its modification time
+	if existing, err := os.ReadFile(*sf.outCertPath); err != nil || !bytes.Equal(existing, b) {
+		err = os.WriteFile(*sf.outCertPath, b, 0600)
+		if err != nil {
+			return fmt.Errorf("error while writing out-crt: %s", err)
+		}
+	}
+
+	if *sf.outBundle != "" || *sf.qrBundle {
+		bundle, err := cert.MarshalProvisioningBundle(&cert.ProvisioningBundle{
+			Certificate: &nc,
+			PrivateKey:  rawPriv,
+			CAs:         []*cert.NebulaCertificate{caCert},
+		})
+		if err != nil {
+			return fmt.Errorf("error while marshalling provisioning bundle: %s", err)
+		}
+
+		if *sf.outBundle != "" {
+			err = os.WriteFile(*sf.outBundle, bundle, 0600)
+			if err != nil {
+				return fmt.Errorf("error while writing out-bundle: %s", err)
+			}
+		}
+
+		if *sf.qrBundle {
+			// qr scanners do not reliably return binary content, so the bundle is base64 encoded
+			b = []byte(base64.StdEncoding.EncodeToString(bundle))
+		}
 	}
 
 	if *sf.outQRPath != "" {
-		b, err = qrcode.Encode(string(b), qrcode.Medium, -5)
+		if err = writeQR(*sf.outQRPath, *sf.qrFormat, b); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// readCAKey loads the ca signing key, prompting for a passphrase if it is encrypted. If NEBULA_CA_PASSPHRASE is set it
+// is used instead of prompting so the key can be decrypted non-interactively. A key written with ca -wrap is unwrapped
+// with the spec in NEBULA_CA_KEY_UNWRAP first.
+func readCAKey(path string, out io.Writer, pr PasswordReader) (cert.Curve, []byte, error) {
+	rawCAKey, err := os.ReadFile(path)
+	if err != nil {
+		return 0, nil, fmt.Errorf("error while reading ca-key: %s", err)
+	}
+
+	if cert.IsWrappedPrivateKey(rawCAKey) {
+		spec := os.Getenv("NEBULA_CA_KEY_UNWRAP")
+		if spec == "" {
+			return 0, nil, fmt.Errorf("ca-key is wrapped, set NEBULA_CA_KEY_UNWRAP to unwrap it")
+		}
+
+		rawCAKey, err = cert.UnwrapPrivateKey(context.Background(), spec, rawCAKey)
 		if err != nil {
-			return fmt.Errorf("error while generating qr code: %s", err)
+			return 0, nil, fmt.Errorf("error while unwrapping ca-key: %s", err)
+		}
+	}
+
+	// naively attempt to decode the private key as though it is not encrypted
+	caKey, _, curve, err := cert.UnmarshalSigningPrivateKey(rawCAKey)
+	if err == cert.ErrPrivateKeyEncrypted {
+		passphrase := []byte(os.Getenv("NEBULA_CA_PASSPHRASE"))
+
+		// ask for a passphrase until we get one
+		for i := 0; len(passphrase) == 0 && i < 5; i++ {
+			out.Write([]byte("Enter passphrase: "))
+			passphrase, err = pr.ReadPassword()
+
+			if err == ErrNoTerminal {
+				return 0, nil, fmt.Errorf("ca-key is encrypted and must be decrypted interactively")
+			} else if err != nil {
+				return 0, nil, fmt.Errorf("error reading password: %s", err)
+			}
+		}
+		if len(passphrase) == 0 {
+			return 0, nil, fmt.Errorf("cannot open encrypted ca-key without passphrase")
 		}
 
-		err = os.WriteFile(*sf.outQRPath, b, 0600)
+		curve, caKey, _, err = cert.DecryptAndUnmarshalSigningPrivateKey(passphrase, rawCAKey)
 		if err != nil {
-			return fmt.Errorf("error while writing out-qr: %s", err)
+			return 0, nil, fmt.Errorf("error while parsing encrypted ca-key: %s", err)
 		}
+	} else if err != nil {
+		return 0, nil, fmt.Errorf("error while parsing ca-key: %s", err)
+	}
+
+	return curve, caKey, nil
+}
+
+// submitToLog adds nc to the transparency log at raw and attaches the inclusion proof
+func submitToLog(raw string, nc *cert.NebulaCertificate) error {
+	ls, err := cert.OpenLogSubmitter(raw)
+	if err != nil {
+		return fmt.Errorf("error while opening log: %s", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	nc.InclusionProof, err = ls.Submit(ctx, nc)
+	if err != nil {
+		return fmt.Errorf("error while submitting to log: %s", err)
 	}
 
 	return nil
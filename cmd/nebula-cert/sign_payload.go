@@ -0,0 +1,97 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/slackhq/nebula/cert"
+)
+
+type signPayloadFlags struct {
+	set        *flag.FlagSet
+	caKeyPath  *string
+	caCertPath *string
+	inPath     *string
+	outPath    *string
+	duration   *time.Duration
+}
+
+func newSignPayloadFlags() *signPayloadFlags {
+	sf := signPayloadFlags{set: flag.NewFlagSet("sign-payload", flag.ContinueOnError)}
+	sf.set.Usage = func() {}
+	sf.caKeyPath = sf.set.String("ca-key", "ca.key", "Optional: path to the signing CA key")
+	sf.caCertPath = sf.set.String("ca-crt", "ca.crt", "Optional: path to the signing CA cert")
+	sf.inPath = sf.set.String("in", "", "Required: path to the file to sign, a ca bundle for pki.ca_url or a list of fingerprints for pki.blocklist_url")
+	sf.outPath = sf.set.String("out", "", "Required: path to write the signed payload to")
+	sf.duration = sf.set.Duration("duration", time.Hour*24*7, "Optional: how long nodes accept the payload for, sign it again before then. Valid time units are seconds: \"s\", minutes: \"m\", hours: \"h\"")
+	return &sf
+}
+
+func signPayload(args []string, out io.Writer, errOut io.Writer, pr PasswordReader) error {
+	sf := newSignPayloadFlags()
+	err := sf.set.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	if err := mustFlagString("in", sf.inPath); err != nil {
+		return err
+	}
+	if err := mustFlagString("out", sf.outPath); err != nil {
+		return err
+	}
+	if *sf.duration <= 0 {
+		return newHelpErrorf("-duration must be greater than 0")
+	}
+
+	curve, caKey, err := readCAKey(*sf.caKeyPath, out, pr)
+	if err != nil {
+		return err
+	}
+
+	rawCACert, err := os.ReadFile(*sf.caCertPath)
+	if err != nil {
+		return fmt.Errorf("error while reading ca-crt: %s", err)
+	}
+
+	caCert, _, err := cert.UnmarshalNebulaCertificateFromPEM(rawCACert)
+	if err != nil {
+		return fmt.Errorf("error while parsing ca-crt: %s", err)
+	}
+
+	if err := caCert.VerifyPrivateKey(curve, caKey); err != nil {
+		return fmt.Errorf("refusing to sign, root certificate does not match private key")
+	}
+
+	payload, err := os.ReadFile(*sf.inPath)
+	if err != nil {
+		return fmt.Errorf("error while reading in: %s", err)
+	}
+
+	now := time.Now()
+	sp, err := cert.SignPayload(caCert, caKey, payload, now, now.Add(*sf.duration))
+	if err != nil {
+		return fmt.Errorf("error while signing: %s", err)
+	}
+
+	err = os.WriteFile(*sf.outPath, sp.MarshalToPEM(), 0644)
+	if err != nil {
+		return fmt.Errorf("error while writing out: %s", err)
+	}
+
+	return nil
+}
+
+func signPayloadSummary() string {
+	return "sign-payload <flags>: sign a ca bundle or blocklist for nodes to fetch from pki.ca_url or pki.blocklist_url"
+}
+
+func signPayloadHelp(out io.Writer) {
+	sf := newSignPayloadFlags()
+	out.Write([]byte("Usage of " + os.Args[0] + " " + signPayloadSummary() + "\n"))
+	sf.set.SetOutput(out)
+	sf.set.PrintDefaults()
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/slackhq/nebula/cert"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ed25519"
+)
+
+func Test_signPayloadSummary(t *testing.T) {
+	assert.Equal(t, "sign-payload <flags>: sign a ca bundle or blocklist for nodes to fetch from pki.ca_url or pki.blocklist_url", signPayloadSummary())
+}
+
+func Test_signPayloadHelp(t *testing.T) {
+	ob := &bytes.Buffer{}
+	signPayloadHelp(ob)
+	assert.Equal(
+		t,
+		"Usage of "+os.Args[0]+" sign-payload <flags>: sign a ca bundle or blocklist for nodes to fetch from pki.ca_url or pki.blocklist_url\n"+
+			"  -ca-crt string\n"+
+			"    \tOptional: path to the signing CA cert (default \"ca.crt\")\n"+
+			"  -ca-key string\n"+
+			"    \tOptional: path to the signing CA key (default \"ca.key\")\n"+
+			"  -duration duration\n"+
+			"    \tOptional: how long nodes accept the payload for, sign it again before then. Valid time units are seconds: \"s\", minutes: \"m\", hours: \"h\" (default 168h0m0s)\n"+
+			"  -in string\n"+
+			"    \tRequired: path to the file to sign, a ca bundle for pki.ca_url or a list of fingerprints for pki.blocklist_url\n"+
+			"  -out string\n"+
+			"    \tRequired: path to write the signed payload to\n",
+		ob.String(),
+	)
+}
+
+func Test_signPayload(t *testing.T) {
+	ob := &bytes.Buffer{}
+	eb := &bytes.Buffer{}
+	nopw := &StubPasswordReader{}
+
+	assertHelpError(t, signPayload([]string{}, ob, eb, nopw), "-in is required")
+	assertHelpError(t, signPayload([]string{"-in", "nope"}, ob, eb, nopw), "-out is required")
+	assertHelpError(t, signPayload([]string{"-in", "nope", "-out", "nope", "-duration", "0s"}, ob, eb, nopw), "-duration must be greater than 0")
+
+	dir := t.TempDir()
+	caKeyPath := filepath.Join(dir, "ca.key")
+	caCrtPath := filepath.Join(dir, "ca.crt")
+	inPath := filepath.Join(dir, "blocklist")
+	outPath := filepath.Join(dir, "blocklist.signed")
+
+	caPub, caPriv, _ := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, os.WriteFile(caKeyPath, cert.MarshalEd25519PrivateKey(caPriv), 0600))
+
+	ca := cert.NebulaCertificate{
+		Details: cert.NebulaCertificateDetails{
+			Name:      "ca",
+			NotBefore: time.Now(),
+			NotAfter:  time.Now().Add(time.Minute * 200),
+			PublicKey: caPub,
+			IsCA:      true,
+		},
+	}
+	require.NoError(t, ca.Sign(cert.Curve_CURVE25519, caPriv))
+	b, _ := ca.MarshalToPEM()
+	require.NoError(t, os.WriteFile(caCrtPath, b, 0600))
+
+	args := []string{"-ca-crt", caCrtPath, "-ca-key", caKeyPath, "-in", inPath, "-out", outPath}
+	assert.EqualError(t, signPayload(args, ob, eb, nopw), "error while reading in: open "+inPath+": "+NoSuchFileError)
+
+	require.NoError(t, os.WriteFile(inPath, []byte("abc123\n"), 0600))
+	require.NoError(t, signPayload(args, ob, eb, nopw))
+	assert.Empty(t, ob.String())
+	assert.Empty(t, eb.String())
+
+	rb, err := os.ReadFile(outPath)
+	require.NoError(t, err)
+	sp, _, err := cert.UnmarshalSignedPayloadFromPEM(rb)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("abc123\n"), sp.Payload)
+	assert.WithinDuration(t, time.Now().Add(time.Hour*24*7), sp.NotAfter, time.Minute)
+
+	pool, err := cert.NewCAPoolFromBytes(b)
+	require.NoError(t, err)
+	assert.NoError(t, pool.VerifySignedPayload(time.Now(), sp))
+
+	// A key that does not match the ca is refused
+	_, otherPriv, _ := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, os.WriteFile(caKeyPath, cert.MarshalEd25519PrivateKey(otherPriv), 0600))
+	assert.EqualError(t, signPayload(args, ob, eb, nopw), "refusing to sign, root certificate does not match private key")
+}
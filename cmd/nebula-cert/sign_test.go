@@ -8,11 +8,13 @@ import (
 	"crypto/rand"
 	"errors"
 	"os"
+	"path/filepath"
 	"testing"
 	"time"
 
 	"github.com/slackhq/nebula/cert"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"golang.org/x/crypto/ed25519"
 )
 
@@ -36,20 +38,36 @@ func Test_signHelp(t *testing.T) {
 			"    \tOptional: how long the cert should be valid for. The default is 1 second before the signing cert expires. Valid time units are seconds: \"s\", minutes: \"m\", hours: \"h\"\n"+
 			"  -groups string\n"+
 			"    \tOptional: comma separated list of groups\n"+
+			"  -hash string\n"+
+			"    \tOptional: hash used for the fingerprint and, with P256, the signature (sha256, sha384). The default is the hash of the signing cert\n"+
 			"  -in-pub string\n"+
 			"    \tOptional (if out-key not set): path to read a previously generated public key\n"+
 			"  -ip string\n"+
-			"    \tRequired: ipv4 address and network in CIDR notation to assign the cert\n"+
+			"    \tRequired: comma separated list of ipv4 and ipv6 addresses and networks in CIDR notation to assign the cert, the first ipv4 address is the primary vpn ip\n"+
+			"  -log string\n"+
+			"    \tOptional: transparency log to submit the cert to, either a log directory or the url of a nebula-cert log-server. The inclusion proof is stored in the cert\n"+
 			"  -name string\n"+
 			"    \tRequired: name of the cert, usually a hostname\n"+
+			"  -nonce string\n"+
+			"    \tOptional (if reproducible set): mixed into the signature, change it to get a new signature for otherwise identical inputs\n"+
+			"  -not-before string\n"+
+			"    \tOptional: RFC 3339 time the cert is valid from instead of now, duration is counted from it\n"+
+			"  -out-bundle string\n"+
+			"    \tOptional (if in-pub not set): path to write a provisioning bundle containing the certificate, private key, and CA\n"+
 			"  -out-crt string\n"+
 			"    \tOptional: path to write the certificate to\n"+
 			"  -out-key string\n"+
 			"    \tOptional (if in-pub not set): path to write the private key to\n"+
 			"  -out-qr string\n"+
-			"    \tOptional: output a qr code image (png) of the certificate\n"+
+			"    \tOptional: output a qr code of the certificate, see -qr-format\n"+
+			"  -qr-bundle\n"+
+			"    \tOptional (if in-pub not set): encode the provisioning bundle in the qr code instead of the certificate, for enrolling mobile clients\n"+
+			"  -qr-format string\n"+
+			"    \tOptional: format of the qr code written to out-qr, png for an image or ansi for text that can be printed to a terminal (default \"png\")\n"+
+			"  -reproducible\n"+
+			"    \tOptional: write identical bytes for identical inputs so certs kept in git only change when their details do. Requires in-pub and not-before, an existing out-crt is replaced\n"+
 			"  -subnets string\n"+
-			"    \tOptional: comma separated list of ipv4 address and network in CIDR notation. Subnets this cert can serve for\n",
+			"    \tOptional: comma separated list of ipv4 and ipv6 addresses and networks in CIDR notation. Subnets this cert can serve for\n",
 		ob.String(),
 	)
 }
@@ -94,6 +112,23 @@ func Test_signCert(t *testing.T) {
 	assert.Empty(t, ob.String())
 	assert.Empty(t, eb.String())
 
+	// cannot set -in-pub and -out-bundle
+	assertHelpError(t, signCert(
+		[]string{"-ca-crt", "./nope", "-ca-key", "./nope", "-name", "test", "-in-pub", "nope", "-ip", "1.1.1.1/24", "-out-crt", "nope", "-out-bundle", "nope"}, ob, eb, nopw,
+	), "cannot set -in-pub with -out-bundle or -qr-bundle, the bundle requires the private key")
+
+	// -qr-bundle needs somewhere to write the qr code
+	assertHelpError(t, signCert(
+		[]string{"-ca-crt", "./nope", "-ca-key", "./nope", "-name", "test", "-ip", "1.1.1.1/24", "-qr-bundle"}, ob, eb, nopw,
+	), "-qr-bundle requires -out-qr")
+
+	// bad qr format
+	assertHelpError(t, signCert(
+		[]string{"-ca-crt", "./nope", "-ca-key", "./nope", "-name", "test", "-ip", "1.1.1.1/24", "-out-qr", "nope", "-qr-format", "jpg"}, ob, eb, nopw,
+	), "invalid qr-format: jpg, must be png or ansi")
+	assert.Empty(t, ob.String())
+	assert.Empty(t, eb.String())
+
 	// failed to read key
 	ob.Reset()
 	eb.Reset()
@@ -183,8 +218,8 @@ func Test_signCert(t *testing.T) {
 
 	ob.Reset()
 	eb.Reset()
-	args = []string{"-ca-crt", caCrtF.Name(), "-ca-key", caKeyF.Name(), "-name", "test", "-ip", "100::100/100", "-out-crt", "nope", "-out-key", "nope", "-duration", "100m"}
-	assertHelpError(t, signCert(args, ob, eb, nopw), "invalid ip definition: can only be ipv4, have 100::100/100")
+	args = []string{"-ca-crt", caCrtF.Name(), "-ca-key", caKeyF.Name(), "-name", "test", "-ip", " , ", "-out-crt", "nope", "-out-key", "nope", "-duration", "100m"}
+	assertHelpError(t, signCert(args, ob, eb, nopw), "invalid ip definition: no ips, have  , ")
 	assert.Empty(t, ob.String())
 	assert.Empty(t, eb.String())
 
@@ -196,13 +231,6 @@ func Test_signCert(t *testing.T) {
 	assert.Empty(t, ob.String())
 	assert.Empty(t, eb.String())
 
-	ob.Reset()
-	eb.Reset()
-	args = []string{"-ca-crt", caCrtF.Name(), "-ca-key", caKeyF.Name(), "-name", "test", "-ip", "1.1.1.1/24", "-out-crt", "nope", "-out-key", "nope", "-duration", "100m", "-subnets", "100::100/100"}
-	assertHelpError(t, signCert(args, ob, eb, nopw), "invalid subnet definition: can only be ipv4, have 100::100/100")
-	assert.Empty(t, ob.String())
-	assert.Empty(t, eb.String())
-
 	// mismatched ca key
 	_, caPriv2, _ := ed25519.GenerateKey(rand.Reader)
 	caKeyF2, err := os.CreateTemp("", "sign-cert-2.key")
@@ -301,6 +329,59 @@ func Test_signCert(t *testing.T) {
 	assert.Nil(t, err)
 	assert.Equal(t, lCrt.Details.PublicKey, inPub)
 
+	// test dual stack cert, the ipv4 network comes first no matter the order given
+	os.Remove(crtF.Name())
+	ob.Reset()
+	eb.Reset()
+	args = []string{"-ca-crt", caCrtF.Name(), "-ca-key", caKeyF.Name(), "-name", "test", "-ip", "fd00::1/64, 1.1.1.1/24", "-out-crt", crtF.Name(), "-in-pub", inPubF.Name(), "-duration", "100m", "-subnets", "fd01::/64"}
+	assert.Nil(t, signCert(args, ob, eb, nopw))
+	assert.Empty(t, ob.String())
+	assert.Empty(t, eb.String())
+
+	rb, _ = os.ReadFile(crtF.Name())
+	lCrt, b, err = cert.UnmarshalNebulaCertificateFromPEM(rb)
+	assert.Len(t, b, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, cert.Version2, lCrt.Version())
+	assert.Len(t, lCrt.Details.Ips, 2)
+	assert.Equal(t, "1.1.1.1/24", lCrt.Details.Ips[0].String())
+	assert.Equal(t, "fd00::1/64", lCrt.Details.Ips[1].String())
+	assert.Len(t, lCrt.Details.Subnets, 1)
+	assert.Equal(t, "fd01::/64", lCrt.Details.Subnets[0].String())
+	assert.True(t, lCrt.CheckSignature(caPub))
+
+	// test provisioning bundle and ansi qr code output
+	os.Remove(keyF.Name())
+	os.Remove(crtF.Name())
+	bundleF, err := os.CreateTemp("", "test.bundle")
+	assert.Nil(t, err)
+	defer os.Remove(bundleF.Name())
+	qrF, err := os.CreateTemp("", "test.qr")
+	assert.Nil(t, err)
+	defer os.Remove(qrF.Name())
+
+	ob.Reset()
+	eb.Reset()
+	args = []string{"-ca-crt", caCrtF.Name(), "-ca-key", caKeyF.Name(), "-name", "test", "-ip", "1.1.1.1/24", "-out-crt", crtF.Name(), "-out-key", keyF.Name(), "-duration", "100m", "-out-bundle", bundleF.Name(), "-out-qr", qrF.Name(), "-qr-bundle", "-qr-format", "ansi"}
+	assert.Nil(t, signCert(args, ob, eb, nopw))
+	assert.Empty(t, ob.String())
+	assert.Empty(t, eb.String())
+
+	rb, _ = os.ReadFile(bundleF.Name())
+	pb, err := cert.UnmarshalProvisioningBundle(rb)
+	assert.Nil(t, err)
+	assert.Equal(t, "test", pb.Certificate.Details.Name)
+	assert.Len(t, pb.CAs, 1)
+	assert.Equal(t, ca.Details.Name, pb.CAs[0].Details.Name)
+
+	rb, _ = os.ReadFile(keyF.Name())
+	lKey, _, err = cert.UnmarshalX25519PrivateKey(rb)
+	assert.Nil(t, err)
+	assert.Equal(t, lKey, pb.PrivateKey)
+
+	rb, _ = os.ReadFile(qrF.Name())
+	assert.Contains(t, string(rb), "█")
+
 	// test refuse to sign cert with duration beyond root
 	ob.Reset()
 	eb.Reset()
@@ -408,3 +489,156 @@ func Test_signCert(t *testing.T) {
 	assert.Equal(t, "Enter passphrase: ", ob.String())
 	assert.Empty(t, eb.String())
 }
+
+func Test_signCertReproducible(t *testing.T) {
+	ob := &bytes.Buffer{}
+	eb := &bytes.Buffer{}
+	nopw := &StubPasswordReader{}
+	dir := t.TempDir()
+
+	assertHelpError(t, signCert(
+		[]string{"-name", "test", "-ip", "1.1.1.1/24", "-reproducible", "-not-before", "2024-01-01T00:00:00Z"}, ob, eb, nopw,
+	), "-reproducible requires -in-pub and -not-before")
+
+	assertHelpError(t, signCert(
+		[]string{"-name", "test", "-ip", "1.1.1.1/24", "-nonce", "1"}, ob, eb, nopw,
+	), "-nonce requires -reproducible")
+
+	assertHelpError(t, signCert(
+		[]string{"-name", "test", "-ip", "1.1.1.1/24", "-not-before", "yesterday"}, ob, eb, nopw,
+	), "invalid not-before: parsing time \"yesterday\" as \"2006-01-02T15:04:05Z07:00\": cannot parse \"yesterday\" as \"2006\"")
+
+	caPub, caPriv, _ := ed25519.GenerateKey(rand.Reader)
+	ca := cert.NebulaCertificate{
+		Details: cert.NebulaCertificateDetails{
+			Name:      "ca",
+			NotBefore: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+			NotAfter:  time.Now().Add(time.Hour),
+			PublicKey: caPub,
+			IsCA:      true,
+		},
+	}
+	assert.NoError(t, ca.Sign(cert.Curve_CURVE25519, caPriv))
+	b, _ := ca.MarshalToPEM()
+	assert.NoError(t, os.WriteFile(dir+"/ca.crt", b, 0600))
+	assert.NoError(t, os.WriteFile(dir+"/ca.key", cert.MarshalEd25519PrivateKey(caPriv), 0600))
+
+	inPub, _ := x25519Keypair()
+	assert.NoError(t, os.WriteFile(dir+"/host.pub", cert.MarshalX25519PublicKey(inPub), 0600))
+
+	args := []string{"-ca-crt", dir + "/ca.crt", "-ca-key", dir + "/ca.key", "-name", "test", "-ip", "1.1.1.1/24",
+		"-in-pub", dir + "/host.pub", "-out-crt", dir + "/host.crt", "-groups", "a,b", "-duration", "10m",
+		"-reproducible", "-not-before", "2024-01-02T00:00:00Z"}
+	assert.NoError(t, signCert(args, ob, eb, nopw))
+	first, err := os.ReadFile(dir + "/host.crt")
+	assert.NoError(t, err)
+
+	nc, _, err := cert.UnmarshalNebulaCertificateFromPEM(first)
+	assert.NoError(t, err)
+	assert.Equal(t, time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC), nc.Details.NotBefore.UTC())
+	assert.Equal(t, time.Date(2024, 1, 2, 0, 10, 0, 0, time.UTC), nc.Details.NotAfter.UTC())
+
+	// Running again over the existing cert gives the same bytes
+	assert.NoError(t, signCert(args, ob, eb, nopw))
+	again, err := os.ReadFile(dir + "/host.crt")
+	assert.NoError(t, err)
+	assert.Equal(t, first, again)
+
+	// Changed details are written over the existing cert
+	args = append(args, "-subnets", "10.0.0.0/24")
+	assert.NoError(t, signCert(args, ob, eb, nopw))
+	changed, err := os.ReadFile(dir + "/host.crt")
+	assert.NoError(t, err)
+	assert.NotEqual(t, first, changed)
+	assert.Empty(t, ob.String())
+	assert.Empty(t, eb.String())
+}
+
+func Test_signCertHash(t *testing.T) {
+	ob := &bytes.Buffer{}
+	eb := &bytes.Buffer{}
+	nopw := &StubPasswordReader{}
+	dir := t.TempDir()
+
+	assertHelpError(t, ca(
+		[]string{"-name", "ca", "-curve", "P256", "-hash", "md5", "-out-crt", dir + "/ca.crt", "-out-key", dir + "/ca.key"}, ob, eb, nopw,
+	), "invalid hash: unsupported hash algorithm: md5")
+
+	assert.NoError(t, ca([]string{"-name", "ca", "-curve", "P256", "-hash", "sha384", "-out-crt", dir + "/ca.crt", "-out-key", dir + "/ca.key"}, ob, eb, nopw))
+	b, err := os.ReadFile(dir + "/ca.crt")
+	assert.NoError(t, err)
+	caCert, _, err := cert.UnmarshalNebulaCertificateFromPEM(b)
+	assert.NoError(t, err)
+	assert.Equal(t, cert.HashAlgorithm_SHA384, caCert.Details.Hash)
+
+	pool := cert.NewCAPool()
+	_, err = pool.AddCACertificate(b)
+	assert.NoError(t, err)
+	fp, err := caCert.Fingerprint()
+	assert.NoError(t, err)
+	assert.Len(t, fp, 96)
+
+	// Certs default to the hash of the CA
+	args := []string{"-ca-crt", dir + "/ca.crt", "-ca-key", dir + "/ca.key", "-name", "a", "-ip", "1.1.1.1/24",
+		"-out-crt", dir + "/a.crt", "-out-key", dir + "/a.key"}
+	assert.NoError(t, signCert(args, ob, eb, nopw))
+	b, err = os.ReadFile(dir + "/a.crt")
+	assert.NoError(t, err)
+	nc, _, err := cert.UnmarshalNebulaCertificateFromPEM(b)
+	assert.NoError(t, err)
+	assert.Equal(t, cert.HashAlgorithm_SHA384, nc.Details.Hash)
+	assert.Equal(t, fp, nc.Details.Issuer)
+	ok, err := nc.Verify(time.Now(), pool)
+	assert.True(t, ok)
+	assert.NoError(t, err)
+
+	// Or can be picked
+	args = []string{"-ca-crt", dir + "/ca.crt", "-ca-key", dir + "/ca.key", "-name", "b", "-ip", "1.1.1.2/24",
+		"-out-crt", dir + "/b.crt", "-out-key", dir + "/b.key", "-hash", "SHA256"}
+	assert.NoError(t, signCert(args, ob, eb, nopw))
+	b, err = os.ReadFile(dir + "/b.crt")
+	assert.NoError(t, err)
+	nc, _, err = cert.UnmarshalNebulaCertificateFromPEM(b)
+	assert.NoError(t, err)
+	assert.Equal(t, cert.HashAlgorithm_SHA256, nc.Details.Hash)
+	ok, err = nc.Verify(time.Now(), pool)
+	assert.True(t, ok)
+	assert.NoError(t, err)
+}
+
+func Test_signCertLog(t *testing.T) {
+	ob := &bytes.Buffer{}
+	eb := &bytes.Buffer{}
+	nopw := &StubPasswordReader{}
+	dir := t.TempDir()
+	logDir := filepath.Join(dir, "log")
+
+	assertHelpError(t, signCert(
+		[]string{"-name", "test", "-ip", "1.1.1.1/24", "-log", logDir, "-reproducible", "-in-pub", "nope", "-not-before", "2024-01-01T00:00:00Z"}, ob, eb, nopw,
+	), "cannot set both -log and -reproducible, the inclusion proof changes every time the cert is logged")
+
+	assert.NoError(t, ca([]string{"-name", "ca", "-out-crt", dir + "/ca.crt", "-out-key", dir + "/ca.key"}, ob, eb, nopw))
+	args := []string{"-ca-crt", dir + "/ca.crt", "-ca-key", dir + "/ca.key", "-name", "a", "-ip", "1.1.1.1/24",
+		"-out-crt", dir + "/a.crt", "-out-key", dir + "/a.key", "-log", logDir}
+	assert.NoError(t, signCert(args, ob, eb, nopw))
+
+	b, err := os.ReadFile(dir + "/a.crt")
+	require.NoError(t, err)
+	nc, _, err := cert.UnmarshalNebulaCertificateFromPEM(b)
+	require.NoError(t, err)
+	require.NotNil(t, nc.InclusionProof)
+	assert.Equal(t, uint64(0), nc.InclusionProof.LeafIndex)
+
+	logPub, err := os.ReadFile(filepath.Join(logDir, "log.pub"))
+	require.NoError(t, err)
+	caPem, err := os.ReadFile(dir + "/ca.crt")
+	require.NoError(t, err)
+	pool, err := cert.NewCAPoolFromBytes(caPem)
+	require.NoError(t, err)
+	_, err = pool.AddTransparencyLog(logPub)
+	require.NoError(t, err)
+	pool.RequireInclusionProof(true)
+	ok, err := nc.Verify(time.Now(), pool)
+	assert.True(t, ok)
+	assert.NoError(t, err)
+}
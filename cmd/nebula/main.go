@@ -1,14 +1,19 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"os"
+	"strings"
+	"time"
 
 	"github.com/sirupsen/logrus"
 	"github.com/slackhq/nebula"
 	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/controlapi"
 	"github.com/slackhq/nebula/util"
+	"gopkg.in/yaml.v2"
 )
 
 // A version string that can be set with
@@ -18,13 +23,29 @@ import (
 // at compile-time.
 var Build string
 
+// configPaths collects every -config flag, each one is run as its own overlay
+type configPaths []string
+
+func (p *configPaths) String() string {
+	return strings.Join(*p, ",")
+}
+
+func (p *configPaths) Set(v string) error {
+	*p = append(*p, v)
+	return nil
+}
+
 func main() {
-	configPath := flag.String("config", "", "Path to either a file or directory to load configuration from")
+	var configPath configPaths
+	flag.Var(&configPath, "config", "Path to either a file or directory to load configuration from, repeat to run multiple overlays in one process")
 	configTest := flag.Bool("test", false, "Test the config and print the end result. Non zero exit indicates a faulty config")
+	testConfig := flag.Bool("test-config", false, "Same as -test")
+	againstRunning := flag.Bool("against-running", false, "With -test, also ask the nebula listening on the control_api.listen of the config which changed settings would need a restart. A control api token is read from "+controlAPITokenEnv)
 	printVersion := flag.Bool("version", false, "Print version")
 	printUsage := flag.Bool("help", false, "Print command line usage")
 
 	flag.Parse()
+	*configTest = *configTest || *testConfig
 
 	if *printVersion {
 		fmt.Printf("Version: %s\n", Build)
@@ -36,7 +57,7 @@ func main() {
 		os.Exit(0)
 	}
 
-	if *configPath == "" {
+	if len(configPath) == 0 {
 		fmt.Println("-config flag must be set")
 		flag.Usage()
 		os.Exit(1)
@@ -45,8 +66,21 @@ func main() {
 	l := logrus.New()
 	l.Out = os.Stdout
 
+	if *againstRunning && !*configTest {
+		fmt.Println("-against-running needs -test or -test-config")
+		os.Exit(1)
+	}
+
+	if len(configPath) > 1 {
+		if *againstRunning {
+			fmt.Println("-against-running can only be used with a single -config")
+			os.Exit(1)
+		}
+		os.Exit(runGroup(l, configPath, *configTest))
+	}
+
 	c := config.NewC(l)
-	err := c.Load(*configPath)
+	err := c.Load(configPath[0])
 	if err != nil {
 		fmt.Printf("failed to load config: %s", err)
 		os.Exit(1)
@@ -64,5 +98,79 @@ func main() {
 		ctrl.ShutdownBlock()
 	}
 
+	if *againstRunning {
+		os.Exit(checkAgainstRunning(c))
+	}
+
 	os.Exit(0)
 }
+
+// controlAPITokenEnv holds the control api token -against-running presents, it needs the reload level
+const controlAPITokenEnv = "NEBULA_CONTROL_API_TOKEN"
+
+// checkAgainstRunning prints what would change if the nebula running with the control api of c loaded c
+func checkAgainstRunning(c *config.C) int {
+	listen := c.GetString("control_api.listen", "")
+	if listen == "" {
+		fmt.Println("-against-running needs control_api.listen to reach the running nebula")
+		return 1
+	}
+
+	b, err := yaml.Marshal(c.Settings)
+	if err != nil {
+		fmt.Printf("failed to marshal the config: %s\n", err)
+		return 1
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	client := controlapi.NewClientWithToken(listen, os.Getenv(controlAPITokenEnv))
+	cc, err := client.CheckConfig(ctx, b)
+	if err != nil {
+		fmt.Printf("failed to check the config against the running nebula: %s\n", err)
+		return 1
+	}
+
+	printSettings := func(title string, settings []string) {
+		fmt.Println(title)
+		if len(settings) == 0 {
+			fmt.Println("  none")
+		}
+		for _, s := range settings {
+			fmt.Printf("  %s\n", s)
+		}
+	}
+	printSettings("Changed settings a reload applies:", cc.Reloadable)
+	printSettings("Changed settings that need a restart:", cc.RestartRequired)
+	return 0
+}
+
+// runGroup runs an overlay for each config path in this process, members are named after their config path
+func runGroup(l *logrus.Logger, paths []string, configTest bool) int {
+	g := nebula.NewGroup(l)
+	for _, path := range paths {
+		c := config.NewC(g.MemberLogger(path))
+		if err := c.Load(path); err != nil {
+			fmt.Printf("failed to load config %s: %s", path, err)
+			return 1
+		}
+
+		if _, err := g.Add(path, c, configTest, Build); err != nil {
+			util.LogWithContextIfNeeded("Failed to start", err, g.MemberLogger(path))
+			return 1
+		}
+	}
+
+	if !configTest {
+		if err := g.Start(); err != nil {
+			l.WithError(err).Error("Failed to start")
+			g.Stop()
+			return 1
+		}
+		notifyReady(l)
+		g.ShutdownBlock()
+	}
+
+	return 0
+}
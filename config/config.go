@@ -21,13 +21,14 @@ import (
 )
 
 type C struct {
-	path        string
-	files       []string
-	Settings    map[interface{}]interface{}
-	oldSettings map[interface{}]interface{}
-	callbacks   []func(*C)
-	l           *logrus.Logger
-	reloadLock  sync.Mutex
+	path         string
+	files        []string
+	Settings     map[interface{}]interface{}
+	oldSettings  map[interface{}]interface{}
+	callbacks    []func(*C)
+	transactions []ReloadPrepareFunc
+	l            *logrus.Logger
+	reloadLock   sync.Mutex
 }
 
 func NewC(l *logrus.Logger) *C {
@@ -144,6 +145,11 @@ func (c *C) CatchHUP(ctx context.Context) {
 }
 
 func (c *C) ReloadConfig() {
+	_ = c.Reload()
+}
+
+// Reload is ReloadConfig for callers that want to know if the reload failed, the failure is logged either way
+func (c *C) Reload() error {
 	c.reloadLock.Lock()
 	defer c.reloadLock.Unlock()
 
@@ -155,12 +161,14 @@ func (c *C) ReloadConfig() {
 	err := c.Load(c.path)
 	if err != nil {
 		c.l.WithField("config_path", c.path).WithError(err).Error("Error occurred while reloading config")
-		return
+		return err
 	}
 
-	for _, v := range c.callbacks {
-		v(c)
+	err = c.applyReload()
+	if err != nil {
+		c.l.WithField("config_path", c.path).WithError(err).Error("Config reload failed, rolled back to the previous config")
 	}
+	return err
 }
 
 func (c *C) ReloadConfigString(raw string) error {
@@ -177,6 +185,21 @@ func (c *C) ReloadConfigString(raw string) error {
 		return err
 	}
 
+	return c.applyReload()
+}
+
+// applyReload runs the reload transaction and, if it succeeds, the reload callbacks. If the transaction fails the
+// previous settings are restored and the callbacks are not called.
+func (c *C) applyReload() error {
+	err := c.runTransactions()
+	if err != nil {
+		c.Settings = make(map[interface{}]interface{})
+		for k, v := range c.oldSettings {
+			c.Settings[k] = v
+		}
+		return err
+	}
+
 	for _, v := range c.callbacks {
 		v(c)
 	}
@@ -249,6 +272,17 @@ func (c *C) GetUint32(k string, d uint32) uint32 {
 	return uint32(r)
 }
 
+// GetFloat will get the float64 for k or return the default d if not found or invalid
+func (c *C) GetFloat(k string, d float64) float64 {
+	r := c.GetString(k, strconv.FormatFloat(d, 'g', -1, 64))
+	v, err := strconv.ParseFloat(r, 64)
+	if err != nil {
+		return d
+	}
+
+	return v
+}
+
 // GetBool will get the bool for k or return the default d if not found or invalid
 func (c *C) GetBool(k string, d bool) bool {
 	r := strings.ToLower(c.GetString(k, fmt.Sprintf("%v", d)))
@@ -301,6 +335,44 @@ func (c *C) get(k string, v interface{}) interface{} {
 	return v
 }
 
+// Diff returns the keys whose values differ between c and o, sorted. Maps are compared key by key, a key only set on one
+// side is reported as every value under it. Everything else, lists included, is compared as a whole.
+func (c *C) Diff(o *C) []string {
+	var keys []string
+	diff("", c.Settings, o.Settings, &keys)
+	sort.Strings(keys)
+	return keys
+}
+
+func diff(prefix string, a, b interface{}, keys *[]string) {
+	am, aok := a.(map[interface{}]interface{})
+	bm, bok := b.(map[interface{}]interface{})
+	if (aok || bok) && (aok || a == nil) && (bok || b == nil) {
+		seen := map[interface{}]struct{}{}
+		for _, m := range []map[interface{}]interface{}{am, bm} {
+			for k := range m {
+				if _, ok := seen[k]; ok {
+					continue
+				}
+				seen[k] = struct{}{}
+
+				key := fmt.Sprint(k)
+				if prefix != "" {
+					key = prefix + "." + key
+				}
+				diff(key, am[k], bm[k], keys)
+			}
+		}
+		return
+	}
+
+	av, _ := yaml.Marshal(a)
+	bv, _ := yaml.Marshal(b)
+	if string(av) != string(bv) {
+		*keys = append(*keys, prefix)
+	}
+}
+
 // direct signifies if this is the config path directly specified by the user,
 // versus a file/dir found by recursing into that path
 func (c *C) resolve(path string, direct bool) error {
@@ -348,7 +420,12 @@ func (c *C) addFile(path string, direct bool) error {
 func (c *C) parseRaw(b []byte) error {
 	var m map[interface{}]interface{}
 
-	err := yaml.Unmarshal(b, &m)
+	b, err := preprocess(b, "")
+	if err != nil {
+		return err
+	}
+
+	err = yaml.Unmarshal(b, &m)
 	if err != nil {
 		return err
 	}
@@ -366,6 +443,11 @@ func (c *C) parse() error {
 			return err
 		}
 
+		b, err = preprocess(b, path)
+		if err != nil {
+			return err
+		}
+
 		var nm map[interface{}]interface{}
 		err = yaml.Unmarshal(b, &nm)
 		if err != nil {
@@ -1,6 +1,7 @@
 package config
 
 import (
+	"errors"
 	"os"
 	"path/filepath"
 	"testing"
@@ -11,6 +12,7 @@ import (
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"gopkg.in/yaml.v2"
+	yamlv3 "gopkg.in/yaml.v3"
 )
 
 func TestConfig_Load(t *testing.T) {
@@ -66,6 +68,23 @@ func TestConfig_GetStringSlice(t *testing.T) {
 	assert.Equal(t, []string{"one", "two"}, c.GetStringSlice("slice", []string{}))
 }
 
+func TestConfig_GetFloat(t *testing.T) {
+	l := test.NewLogger()
+	c := NewC(l)
+	c.Settings["float"] = 0.25
+	assert.Equal(t, 0.25, c.GetFloat("float", 1))
+
+	c.Settings["float"] = 1
+	assert.Equal(t, 1.0, c.GetFloat("float", 0))
+
+	c.Settings["float"] = "1e-05"
+	assert.Equal(t, 0.00001, c.GetFloat("float", 0))
+
+	c.Settings["float"] = "nope"
+	assert.Equal(t, 0.5, c.GetFloat("float", 0.5))
+	assert.Equal(t, 0.5, c.GetFloat("missing", 0.5))
+}
+
 func TestConfig_GetBool(t *testing.T) {
 	l := test.NewLogger()
 	c := NewC(l)
@@ -116,6 +135,41 @@ func TestConfig_HasChanged(t *testing.T) {
 	assert.False(t, c.HasChanged(""))
 }
 
+func TestConfig_Diff(t *testing.T) {
+	l := test.NewLogger()
+	a := NewC(l)
+	require.NoError(t, a.LoadString(`
+listen:
+  host: 0.0.0.0
+  port: 4242
+tun:
+  mtu: 1300
+  routes:
+    - {route: 10.0.0.0/8, mtu: 1200}
+punchy:
+  punch: true
+`))
+
+	b := NewC(l)
+	require.NoError(t, b.LoadString(`
+listen:
+  host: 0.0.0.0
+  port: 4243
+tun:
+  mtu: 1300
+  routes:
+    - {route: 10.0.0.0/8, mtu: 1300}
+stats:
+  type: prometheus
+  listen: 127.0.0.1:8080
+`))
+
+	assert.Equal(t, []string{"listen.port", "punchy.punch", "stats.listen", "stats.type", "tun.routes"}, a.Diff(b))
+	assert.Equal(t, a.Diff(b), b.Diff(a))
+	assert.Empty(t, a.Diff(a))
+	assert.Empty(t, NewC(l).Diff(NewC(l)))
+}
+
 func TestConfig_ReloadConfig(t *testing.T) {
 	l := test.NewLogger()
 	done := make(chan bool, 1)
@@ -150,6 +204,83 @@ func TestConfig_ReloadConfig(t *testing.T) {
 
 }
 
+func TestConfig_ReloadTransaction(t *testing.T) {
+	l := test.NewLogger()
+	c := NewC(l)
+	require.NoError(t, c.LoadString("value: 1"))
+
+	var events []string
+	called := 0
+	c.RegisterReloadCallback(func(c *C) {
+		called++
+	})
+
+	stage := func(name string, prepareErr, commitErr error) ReloadPrepareFunc {
+		return func(c *C) (*ReloadStage, error) {
+			if prepareErr != nil {
+				return nil, prepareErr
+			}
+			events = append(events, "prepare "+name)
+			return &ReloadStage{
+				Commit: func() error {
+					events = append(events, "commit "+name)
+					return commitErr
+				},
+				Rollback: func() {
+					events = append(events, "rollback "+name)
+				},
+			}, nil
+		}
+	}
+
+	var failPrepare, failCommit error
+	c.RegisterReloadTransaction(stage("a", nil, nil))
+	c.RegisterReloadTransaction(func(c *C) (*ReloadStage, error) {
+		// Nothing changed for this subsystem
+		return nil, nil
+	})
+	c.RegisterReloadTransaction(func(c *C) (*ReloadStage, error) {
+		return stage("b", failPrepare, failCommit)(c)
+	})
+
+	// A failed prepare rolls back what was already prepared and restores the old settings
+	failPrepare = errors.New("bad config")
+	err := c.ReloadConfigString("value: 2")
+	require.ErrorIs(t, err, failPrepare)
+	assert.Equal(t, []string{"prepare a", "rollback a"}, events)
+	assert.Equal(t, 1, c.GetInt("value", 0))
+	assert.Equal(t, 0, called)
+
+	// A failed commit rolls back every stage in reverse order
+	events = nil
+	failPrepare = nil
+	failCommit = errors.New("commit failed")
+	err = c.ReloadConfigString("value: 3")
+	require.ErrorIs(t, err, failCommit)
+	assert.Equal(t, []string{"prepare a", "prepare b", "commit a", "commit b", "rollback b", "rollback a"}, events)
+	assert.Equal(t, 1, c.GetInt("value", 0))
+	assert.Equal(t, 0, called)
+
+	// A successful transaction runs the callbacks
+	events = nil
+	failCommit = nil
+	require.NoError(t, c.ReloadConfigString("value: 4"))
+	assert.Equal(t, []string{"prepare a", "prepare b", "commit a", "commit b"}, events)
+	assert.Equal(t, 4, c.GetInt("value", 0))
+	assert.Equal(t, 1, called)
+
+	// A stage run on its own does not run the reload stages or callbacks
+	events = nil
+	require.NoError(t, c.Transact(stage("c", nil, nil)))
+	assert.Equal(t, []string{"prepare c", "commit c"}, events)
+	assert.Equal(t, 1, called)
+
+	events = nil
+	failCommit = errors.New("commit failed")
+	require.ErrorIs(t, c.Transact(stage("c", nil, failCommit)), failCommit)
+	assert.Equal(t, []string{"prepare c", "commit c", "rollback c"}, events)
+}
+
 // Ensure mergo merges are done the way we expect.
 // This is needed to test for potential regressions, like:
 // - https://github.com/imdario/mergo/issues/187
@@ -223,3 +354,161 @@ firewall:
 	}
 	assert.Equal(t, expected, m)
 }
+
+func TestConfig_Include(t *testing.T) {
+	l := test.NewLogger()
+	dir := t.TempDir()
+	require.NoError(t, os.Mkdir(filepath.Join(dir, "conf.d"), 0755))
+	require.NoError(t, os.Mkdir(filepath.Join(dir, "shared"), 0755))
+
+	os.WriteFile(filepath.Join(dir, "shared", "firewall.yml"), []byte(`
+outbound:
+  - port: any
+    proto: any
+    host: any
+inbound: !include rules.yml
+`), 0644)
+	os.WriteFile(filepath.Join(dir, "shared", "rules.yml"), []byte("- port: 443\n  proto: tcp\n  group: web\n"), 0644)
+	os.WriteFile(filepath.Join(dir, "shared", "empty.yml"), nil, 0644)
+	os.WriteFile(filepath.Join(dir, "conf.d", "config.yml"), []byte(`
+firewall: !include ../shared/firewall.yml
+nothing: !include ../shared/empty.yml
+listen:
+  port: 4242
+`), 0644)
+
+	c := NewC(l)
+	require.NoError(t, c.Load(filepath.Join(dir, "conf.d")))
+	assert.Equal(t, map[interface{}]interface{}{
+		"firewall": map[interface{}]interface{}{
+			"outbound": []interface{}{map[interface{}]interface{}{"port": "any", "proto": "any", "host": "any"}},
+			"inbound":  []interface{}{map[interface{}]interface{}{"port": 443, "proto": "tcp", "group": "web"}},
+		},
+		"nothing": nil,
+		"listen":  map[interface{}]interface{}{"port": 4242},
+	}, c.Settings)
+
+	// Included files are read again on reload
+	os.WriteFile(filepath.Join(dir, "shared", "rules.yml"), []byte("- port: 22\n  proto: tcp\n  group: ops\n"), 0644)
+	require.NoError(t, c.Reload())
+	assert.Equal(t, []interface{}{map[interface{}]interface{}{"port": 22, "proto": "tcp", "group": "ops"}},
+		c.Get("firewall.inbound"))
+	assert.True(t, c.HasChanged("firewall.inbound"))
+
+	// A file including itself
+	cycle := filepath.Join(dir, "shared", "cycle.yml")
+	os.WriteFile(cycle, []byte("a: !include cycle2.yml\n"), 0644)
+	os.WriteFile(filepath.Join(dir, "shared", "cycle2.yml"), []byte("b:\n  c: !include cycle.yml\n"), 0644)
+	assert.EqualError(t, NewC(l).Load(cycle), filepath.Join(dir, "shared", "cycle2.yml")+":2: !include cycle.yml includes itself: "+
+		cycle+" -> "+filepath.Join(dir, "shared", "cycle2.yml")+" -> "+cycle)
+
+	missing := filepath.Join(dir, "missing.yml")
+	os.WriteFile(missing, []byte("a: 1\nb: !include nope.yml\n"), 0644)
+	assert.EqualError(t, NewC(l).Load(missing), missing+":2: !include nope.yml: open "+filepath.Join(dir, "nope.yml")+
+		": no such file or directory")
+
+	broken := filepath.Join(dir, "broken.yml")
+	os.WriteFile(broken, []byte("a: !include shared/bad.yml\n"), 0644)
+	os.WriteFile(filepath.Join(dir, "shared", "bad.yml"), []byte("a: [\n"), 0644)
+	assert.ErrorContains(t, NewC(l).Load(broken), filepath.Join(dir, "shared", "bad.yml")+": yaml: line 1:")
+
+	assert.EqualError(t, NewC(l).LoadString("a: !include\n"), "line 1: !include needs the path of a file")
+}
+
+func TestConfig_Env(t *testing.T) {
+	t.Setenv("NEBULA_TEST_PSK", "s3cret")
+	t.Setenv("NEBULA_TEST_PORT", "4242")
+	t.Setenv("NEBULA_TEST_EMPTY", "")
+
+	c := NewC(test.NewLogger())
+	require.NoError(t, c.LoadString(`
+pki:
+  key: /etc/nebula/${NEBULA_TEST_PSK}.key
+listen:
+  port: ${NEBULA_TEST_PORT}
+  quoted: "${NEBULA_TEST_PORT}"
+  host: ${NEBULA_TEST_HOST:-0.0.0.0}
+  empty: ${NEBULA_TEST_EMPTY:-default}
+  literal: $${NEBULA_TEST_PSK} costs $5
+  keys:
+    ${NEBULA_TEST_PSK}: 1
+`))
+	assert.Equal(t, "/etc/nebula/s3cret.key", c.GetString("pki.key", ""))
+	assert.Equal(t, 4242, c.Get("listen.port"))
+	assert.Equal(t, "4242", c.Get("listen.quoted"))
+	assert.Equal(t, "0.0.0.0", c.Get("listen.host"))
+	assert.Equal(t, "default", c.Get("listen.empty"))
+	assert.Equal(t, "${NEBULA_TEST_PSK} costs $5", c.Get("listen.literal"))
+	assert.Equal(t, map[interface{}]interface{}{"${NEBULA_TEST_PSK}": 1}, c.Get("listen.keys"), "keys are not expanded")
+
+	assert.EqualError(t, c.LoadString("a:\n  b: ${NEBULA_TEST_UNSET}\n"), "line 2: environment variable NEBULA_TEST_UNSET is not set")
+	assert.EqualError(t, c.LoadString("a: ${NEBULA_TEST_PSK\n"), "line 1: unterminated ${ in `${NEBULA_TEST_PSK`")
+	assert.EqualError(t, c.LoadString("a: ${1NOPE}\n"), "line 1: invalid environment variable name `1NOPE`")
+
+	// Includes can be found through the environment too
+	dir := t.TempDir()
+	t.Setenv("NEBULA_TEST_DIR", dir)
+	os.WriteFile(filepath.Join(dir, "psk.yml"), []byte("psk: ${NEBULA_TEST_PSK}\n"), 0644)
+	require.NoError(t, c.LoadString("a: !include ${NEBULA_TEST_DIR}/psk.yml\n"))
+	assert.Equal(t, "s3cret", c.GetString("a.psk", ""))
+}
+
+// TestPreprocess_RoundTrip makes sure a config is parsed the same whether or not it had to be preprocessed
+func TestPreprocess_RoundTrip(t *testing.T) {
+	raw := []byte(`
+mode: 0644
+octal: 0o17
+hex: 0x1F
+float: 1.5e3
+bools: [yes, no, on, off, true, False, y, n]
+nothing: ~
+empty:
+date: 2001-12-14
+quoted: "123"
+single: 'true'
+tagged: !!str 42
+"10.0.0.1": ["1.2.3.4:4242"]
+1: one
+base: &base
+  a: 1
+  b: [x, y]
+merged:
+  <<: *base
+  c: 3
+alias: *base
+literal: |
+  line one
+  line two
+folded: >
+  folded
+  text
+colon: "a: b"
+hash: a #comment
+`)
+
+	var expected map[interface{}]interface{}
+	require.NoError(t, yaml.Unmarshal(raw, &expected))
+
+	// Force preprocessing, there is nothing to expand
+	n, err := (&preprocessor{}).parse(raw, "")
+	require.NoError(t, err)
+	b, err := yamlv3.Marshal(n)
+	require.NoError(t, err)
+
+	var actual map[interface{}]interface{}
+	require.NoError(t, yaml.Unmarshal(b, &actual))
+	assert.Equal(t, expected, actual)
+
+	// And so is the example config
+	raw, err = os.ReadFile("../examples/config.yml")
+	require.NoError(t, err)
+	expected = nil
+	require.NoError(t, yaml.Unmarshal(raw, &expected))
+	n, err = (&preprocessor{}).parse(raw, "")
+	require.NoError(t, err)
+	b, err = yamlv3.Marshal(n)
+	require.NoError(t, err)
+	actual = nil
+	require.NoError(t, yaml.Unmarshal(b, &actual))
+	assert.Equal(t, expected, actual)
+}
@@ -0,0 +1,224 @@
+package config
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	yamlv3 "gopkg.in/yaml.v3"
+)
+
+// includeTag replaces the value it is on with the contents of the yaml file it names, relative paths are relative to
+// the directory of the file including it
+const includeTag = "!include"
+
+// preprocess expands the !include tags and the ${NAME} references to environment variables in the yaml b read from
+// file. file is empty for a config that did not come from a file, relative includes are then relative to the working
+// directory. The result is yaml again so it is parsed exactly like a config without either.
+func preprocess(b []byte, file string) ([]byte, error) {
+	if !bytes.Contains(b, []byte(includeTag)) && !bytes.Contains(b, []byte("${")) {
+		return b, nil
+	}
+
+	p := &preprocessor{}
+	if file != "" {
+		p.stack = []string{file}
+	}
+
+	n, err := p.parse(b, file)
+	if err != nil {
+		return nil, err
+	}
+	if n == nil {
+		return b, nil
+	}
+
+	return yamlv3.Marshal(n)
+}
+
+type preprocessor struct {
+	// stack is the chain of files being included, to catch a file that includes itself
+	stack []string
+}
+
+// parse returns the expanded root of the yaml b from file, nil if it is empty
+func (p *preprocessor) parse(b []byte, file string) (*yamlv3.Node, error) {
+	var doc yamlv3.Node
+	if err := yamlv3.Unmarshal(b, &doc); err != nil {
+		if file == "" {
+			return nil, err
+		}
+		return nil, fmt.Errorf("%s: %w", file, err)
+	}
+
+	if doc.Kind != yamlv3.DocumentNode || len(doc.Content) == 0 {
+		return nil, nil
+	}
+
+	n := doc.Content[0]
+	if err := p.walk(n, file, false); err != nil {
+		return nil, err
+	}
+	return n, nil
+}
+
+// walk expands every node under n, key is true when n is the key of a mapping. Keys are not expanded.
+func (p *preprocessor) walk(n *yamlv3.Node, file string, key bool) error {
+	switch n.Kind {
+	case yamlv3.MappingNode:
+		for i, c := range n.Content {
+			if err := p.walk(c, file, i%2 == 0); err != nil {
+				return err
+			}
+		}
+
+	case yamlv3.SequenceNode:
+		for _, c := range n.Content {
+			if err := p.walk(c, file, false); err != nil {
+				return err
+			}
+		}
+
+	case yamlv3.ScalarNode:
+		if key {
+			break
+		}
+
+		if n.Tag == includeTag {
+			return p.include(n, file)
+		}
+
+		v, err := expandEnv(n.Value)
+		if err != nil {
+			return fmt.Errorf("%s: %s", position(file, n), err)
+		}
+		n.Value = v
+	}
+
+	// Let the yaml.v2 parser decide the type of a value again unless it was given explicitly
+	if n.Kind == yamlv3.ScalarNode && n.Style&yamlv3.TaggedStyle == 0 {
+		n.Tag = ""
+	}
+
+	return nil
+}
+
+// include replaces n with the root of the file it names
+func (p *preprocessor) include(n *yamlv3.Node, file string) error {
+	name, err := expandEnv(n.Value)
+	if err != nil {
+		return fmt.Errorf("%s: %s", position(file, n), err)
+	}
+	if name == "" {
+		return fmt.Errorf("%s: %s needs the path of a file", position(file, n), includeTag)
+	}
+
+	path := name
+	if !filepath.IsAbs(path) && file != "" {
+		path = filepath.Join(filepath.Dir(file), path)
+	}
+	path, err = filepath.Abs(path)
+	if err != nil {
+		return fmt.Errorf("%s: %s %s: %s", position(file, n), includeTag, name, err)
+	}
+
+	for _, f := range p.stack {
+		if f == path {
+			return fmt.Errorf("%s: %s %s includes itself: %s", position(file, n), includeTag, name,
+				strings.Join(append(p.stack, path), " -> "))
+		}
+	}
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("%s: %s %s: %s", position(file, n), includeTag, name, err)
+	}
+
+	p.stack = append(p.stack, path)
+	in, err := p.parse(b, path)
+	p.stack = p.stack[:len(p.stack)-1]
+	if err != nil {
+		return err
+	}
+
+	if in == nil {
+		// An empty file includes nothing
+		*n = yamlv3.Node{Kind: yamlv3.ScalarNode}
+		return nil
+	}
+
+	*n = *in
+	return nil
+}
+
+func position(file string, n *yamlv3.Node) string {
+	if file == "" {
+		return fmt.Sprintf("line %d", n.Line)
+	}
+	return fmt.Sprintf("%s:%d", file, n.Line)
+}
+
+// expandEnv replaces ${NAME} in s with the value of the environment variable NAME, which must be set, and
+// ${NAME:-default} with its value or default when it is empty or not set. $${ is a literal ${.
+func expandEnv(s string) (string, error) {
+	if !strings.Contains(s, "${") {
+		return s, nil
+	}
+
+	var r strings.Builder
+	for {
+		i := strings.Index(s, "${")
+		if i < 0 {
+			r.WriteString(s)
+			return r.String(), nil
+		}
+
+		if i > 0 && s[i-1] == '$' {
+			r.WriteString(s[:i])
+			r.WriteString("{")
+			s = s[i+2:]
+			continue
+		}
+
+		r.WriteString(s[:i])
+		end := strings.IndexByte(s[i:], '}')
+		if end < 0 {
+			return "", fmt.Errorf("unterminated ${ in `%s`", s[i:])
+		}
+
+		ref := s[i+2 : i+end]
+		s = s[i+end+1:]
+
+		name, def, hasDef := strings.Cut(ref, ":-")
+		if !validEnvName(name) {
+			return "", fmt.Errorf("invalid environment variable name `%s`", name)
+		}
+
+		v, ok := os.LookupEnv(name)
+		switch {
+		case hasDef && v == "":
+			v = def
+		case !ok:
+			return "", fmt.Errorf("environment variable %s is not set", name)
+		}
+		r.WriteString(v)
+	}
+}
+
+func validEnvName(name string) bool {
+	if name == "" {
+		return false
+	}
+
+	for i, c := range name {
+		switch {
+		case c == '_', c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z':
+		case c >= '0' && c <= '9' && i > 0:
+		default:
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,101 @@
+package config
+
+import (
+	"fmt"
+)
+
+// ReloadStage is returned by a ReloadPrepareFunc once it has successfully built its new state from the config.
+type ReloadStage struct {
+	// Commit installs the prepared state. If it fails the whole reload is rolled back.
+	Commit func() error
+
+	// Rollback is called when the reload is aborted. It must discard anything prepared and, if Commit has already
+	// run, restore the state that was active before the reload. It may be nil if there is nothing to undo.
+	Rollback func()
+}
+
+// ReloadPrepareFunc builds new state from the config without modifying anything in the running process. Returning
+// a nil stage with a nil error means there was nothing to change.
+type ReloadPrepareFunc func(*C) (*ReloadStage, error)
+
+// RegisterReloadTransaction registers a subsystem that takes part in the reload transaction. During a reload every
+// prepare func is run first, if any fail nothing is committed. Then every stage is committed in registration order,
+// if any commit fails all stages are rolled back. The regular reload callbacks only run if the transaction succeeds.
+func (c *C) RegisterReloadTransaction(f ReloadPrepareFunc) {
+	c.transactions = append(c.transactions, f)
+}
+
+// Transact runs f as a transaction of its own, outside of a reload, for subsystems that change state a reload also
+// builds, like a ca pool fetched from a url. It holds the reload lock so it never interleaves with a reload, f sees the
+// current settings and its stage is rolled back if the commit fails.
+func (c *C) Transact(f ReloadPrepareFunc) error {
+	c.reloadLock.Lock()
+	defer c.reloadLock.Unlock()
+
+	s, err := f(c)
+	if err != nil {
+		return err
+	}
+
+	if s == nil || s.Commit == nil {
+		return nil
+	}
+
+	if err := s.Commit(); err != nil {
+		if s.Rollback != nil {
+			s.Rollback()
+		}
+		return err
+	}
+
+	return nil
+}
+
+type reloadStageError struct {
+	stage int
+	phase string
+	err   error
+}
+
+func (e *reloadStageError) Error() string {
+	return fmt.Sprintf("reload %s failed for stage %d: %s", e.phase, e.stage, e.err)
+}
+
+func (e *reloadStageError) Unwrap() error {
+	return e.err
+}
+
+// runTransactions prepares and commits every registered stage, rolling everything back on failure
+func (c *C) runTransactions() error {
+	stages := make([]*ReloadStage, 0, len(c.transactions))
+
+	rollback := func() {
+		for i := len(stages) - 1; i >= 0; i-- {
+			if stages[i] != nil && stages[i].Rollback != nil {
+				stages[i].Rollback()
+			}
+		}
+	}
+
+	for i, prepare := range c.transactions {
+		s, err := prepare(c)
+		if err != nil {
+			rollback()
+			return &reloadStageError{stage: i, phase: "prepare", err: err}
+		}
+		stages = append(stages, s)
+	}
+
+	for i, s := range stages {
+		if s == nil || s.Commit == nil {
+			continue
+		}
+
+		if err := s.Commit(); err != nil {
+			rollback()
+			return &reloadStageError{stage: i, phase: "commit", err: err}
+		}
+	}
+
+	return nil
+}
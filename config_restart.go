@@ -0,0 +1,183 @@
+package nebula
+
+import (
+	"sort"
+	"strings"
+	"sync/atomic"
+
+	"github.com/sirupsen/logrus"
+	"github.com/slackhq/nebula/config"
+	"gopkg.in/yaml.v2"
+)
+
+// restartRequiredSettings are read once when nebula starts, a change to them or anything under them only applies after
+// a restart. Everything else is applied by a reload.
+var restartRequiredSettings = sortedSettings(commonRestartRequiredSettings, platformRestartRequiredSettings)
+
+// commonRestartRequiredSettings need a restart on every platform, platformRestartRequiredSettings are the ones that
+// only do on this one. Keep this sorted.
+var commonRestartRequiredSettings = []string{
+	"bridges",
+	"cipher",
+	"cipher_psk",
+	"ciphers",
+	"control_api",
+	"firewall.conntrack.routine_cache_timeout",
+	"handshakes.cookie_threshold",
+	"handshakes.hybrid_kem",
+	"handshakes.query_buffer",
+	"handshakes.rate_limit",
+	"handshakes.retries",
+	"handshakes.trigger_buffer",
+	"handshakes.try_interval",
+	"lighthouse.am_lighthouse",
+	"lighthouse.serve_dns",
+	"listen.batch",
+	"listen.bpf.cpu_steering",
+	"listen.gro",
+	"listen.gso",
+	"listen.io_uring",
+	"listen.port_hop_interval",
+	"listen.ports",
+	"listen.routines",
+	"listen.send_batch",
+	"listen.watch_debounce",
+	"listen.watch_interfaces",
+	"listen.watch_interval",
+	"local_discovery",
+	"multipath",
+	"pin_routines",
+	"pki.blocklist_url",
+	"pki.ca_url",
+	"pki.enroll",
+	"pki.renew",
+	"pki.url_interval",
+	"pmtud",
+	"port_mapping",
+	"proxy",
+	"quic_transport",
+	"relay.discover",
+	"relay.max_hops",
+	"relay.selection",
+	"relay.use_relays",
+	"routines",
+	"routing.learn",
+	"stats",
+	"stun",
+	"tcp_transport",
+	"timers.connection_alive_interval",
+	"timers.keepalive_interval",
+	"timers.keepalive_misses",
+	"timers.pending_deletion_adaptive",
+	"timers.pending_deletion_interval",
+	"timers.pending_deletion_max",
+	"timers.pending_deletion_min",
+	"tracing",
+	"tun.dev",
+	"tun.disabled",
+	"tun.drop_local_broadcast",
+	"tun.drop_multicast",
+	"tun.io_uring",
+	"tun.routines",
+	"tun.tx_queue",
+	"tun.use_system_route_table",
+}
+
+// ConfigCheck is what changes when a candidate config is loaded instead of the running one
+type ConfigCheck struct {
+	// Reloadable are the changed settings a reload applies
+	Reloadable []string `json:"reloadable"`
+	// RestartRequired are the settings that differ from what nebula started with and only apply after a restart
+	RestartRequired []string `json:"restart_required"`
+}
+
+// restartTracker remembers the settings in restartRequiredSettings that nebula started with, so a reload can tell which
+// of its changes are not applied yet
+type restartTracker struct {
+	l       *logrus.Logger
+	c       *config.C
+	started map[string]string
+	pending atomic.Pointer[[]string]
+}
+
+func newRestartTracker(l *logrus.Logger, c *config.C) *restartTracker {
+	t := &restartTracker{l: l, c: c, started: make(map[string]string, len(restartRequiredSettings))}
+	for _, k := range restartRequiredSettings {
+		t.started[k] = marshalSetting(c, k)
+	}
+	t.pending.Store(&[]string{})
+
+	c.RegisterReloadCallback(t.reload)
+	return t
+}
+
+func (t *restartTracker) reload(c *config.C) {
+	var changed []string
+	for _, k := range restartRequiredSettings {
+		if c.HasChanged(k) {
+			changed = append(changed, k)
+		}
+	}
+
+	pending := t.changed(c)
+	t.pending.Store(&pending)
+
+	if len(changed) > 0 {
+		t.l.WithField("settings", changed).WithField("pendingRestart", pending).
+			Warn("Some changed settings need a restart to take effect")
+	}
+}
+
+// Pending returns the loaded settings that differ from what nebula started with and wait for a restart
+func (t *restartTracker) Pending() []string {
+	if t == nil {
+		return nil
+	}
+	return *t.pending.Load()
+}
+
+// changed returns the settings in restartRequiredSettings that differ between c and what nebula started with
+func (t *restartTracker) changed(c *config.C) []string {
+	changed := []string{}
+	for _, k := range restartRequiredSettings {
+		if marshalSetting(c, k) != t.started[k] {
+			changed = append(changed, k)
+		}
+	}
+	return changed
+}
+
+// Check compares candidate to the running config
+func (t *restartTracker) Check(candidate *config.C) *ConfigCheck {
+	cc := &ConfigCheck{Reloadable: []string{}, RestartRequired: t.changed(candidate)}
+	for _, k := range t.c.Diff(candidate) {
+		if !restartRequired(k) {
+			cc.Reloadable = append(cc.Reloadable, k)
+		}
+	}
+	return cc
+}
+
+// restartRequired reports if a change to the setting k only applies after a restart
+func restartRequired(k string) bool {
+	for _, r := range restartRequiredSettings {
+		if k == r || strings.HasPrefix(k, r+".") || strings.HasPrefix(r, k+".") {
+			return true
+		}
+	}
+	return false
+}
+
+func sortedSettings(lists ...[]string) []string {
+	var all []string
+	for _, l := range lists {
+		all = append(all, l...)
+	}
+	sort.Strings(all)
+	return all
+}
+
+func marshalSetting(c *config.C, k string) string {
+	b, _ := yaml.Marshal(c.Get(k))
+	return string(b)
+}
@@ -0,0 +1,7 @@
+//go:build (linux && !android) || freebsd || openbsd || windows
+// +build linux,!android freebsd openbsd windows
+
+package nebula
+
+// The tun devices here apply tun.mtu on a reload. On windows only wintun does, the fallback device keeps its mtu.
+var platformRestartRequiredSettings = []string{}
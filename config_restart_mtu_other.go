@@ -0,0 +1,10 @@
+//go:build !((linux && !android) || freebsd || openbsd || windows)
+// +build !linux android
+// +build !freebsd
+// +build !openbsd
+// +build !windows
+
+package nebula
+
+// The tun devices here set their mtu once when they are created
+var platformRestartRequiredSettings = []string{"tun.mtu"}
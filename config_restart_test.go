@@ -0,0 +1,77 @@
+package nebula
+
+import (
+	"sort"
+	"testing"
+
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRestartRequiredSettings(t *testing.T) {
+	assert.True(t, sort.StringsAreSorted(restartRequiredSettings))
+
+	assert.True(t, restartRequired("listen.batch"))
+	assert.True(t, restartRequired("tcp_transport.listen_port"))
+	assert.True(t, restartRequired("listen"), "a section replaced by a value")
+	assert.False(t, restartRequired("listen.dscp"))
+	assert.False(t, restartRequired("listen.port"))
+	assert.False(t, restartRequired("listen.host"))
+	assert.False(t, restartRequired("listen.portal"))
+	assert.False(t, restartRequired("punchy.punch"))
+	assert.Equal(t, len(commonRestartRequiredSettings)+len(platformRestartRequiredSettings), len(restartRequiredSettings))
+}
+
+func TestRestartTracker(t *testing.T) {
+	l := test.NewLogger()
+	c := config.NewC(l)
+	require.NoError(t, c.LoadString(`
+listen:
+  port: 4242
+  batch: 64
+tun:
+  mtu: 1300
+`))
+	r := newRestartTracker(l, c)
+	assert.Empty(t, r.Pending())
+
+	require.NoError(t, c.ReloadConfigString(`
+listen:
+  port: 4243
+  batch: 32
+tun:
+  mtu: 1300
+  tx_queue: 1000
+`))
+	assert.Equal(t, []string{"listen.batch", "tun.tx_queue"}, r.Pending())
+
+	// Going back to what nebula started with needs no restart
+	require.NoError(t, c.ReloadConfigString(`
+listen:
+  port: 4243
+  batch: 64
+tun:
+  mtu: 1300
+`))
+	assert.Empty(t, r.Pending())
+
+	candidate := config.NewC(l)
+	require.NoError(t, candidate.LoadString(`
+listen:
+  port: 4242
+  batch: 64
+  dscp: 46
+tun:
+  mtu: 1300
+  dev: nebula9
+`))
+	assert.Equal(t, &ConfigCheck{
+		Reloadable:      []string{"listen.dscp", "listen.port"},
+		RestartRequired: []string{"tun.dev"},
+	}, r.Check(candidate))
+
+	var nilTracker *restartTracker
+	assert.Nil(t, nilTracker.Pending())
+}
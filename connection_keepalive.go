@@ -0,0 +1,174 @@
+package nebula
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/header"
+	"github.com/slackhq/nebula/udp"
+)
+
+// The connection manager only notices a dead remote after connection_alive_interval plus pending_deletion_interval,
+// seconds at best, and then tears the tunnel down and handshakes again. Keepalives look at every tunnel each
+// keepalive_interval instead. A tunnel we sent on that has not heard back since the last check gets a test packet, once
+// keepalive_misses checks in a row go unanswered the tunnel sprays path probes to every remote it knows for the host and
+// locks onto the first one to answer, the tunnel and its keys are kept.
+//
+// Idle tunnels are not probed, the connection manager still decides when a tunnel is dead.
+
+const minKeepaliveInterval = 50 * time.Millisecond
+
+type keepalive struct {
+	interval time.Duration
+	misses   int
+
+	metricSpray metrics.Counter
+}
+
+// keepaliveState is what the last check saw of a tunnel, only the keepalive goroutine touches it
+type keepaliveState struct {
+	hostinfo   *HostInfo
+	messageOut uint64
+	messageIn  uint64
+	missed     int
+}
+
+func newKeepaliveFromConfig(c *config.C) (*keepalive, error) {
+	interval := c.GetDuration("timers.keepalive_interval", 0)
+	if interval == 0 {
+		return nil, nil
+	}
+
+	k := &keepalive{
+		interval:    interval,
+		misses:      c.GetInt("timers.keepalive_misses", 3),
+		metricSpray: metrics.GetOrRegisterCounter("connection_manager.keepalive.spray", nil),
+	}
+
+	if k.interval < minKeepaliveInterval {
+		return nil, errors.New("timers.keepalive_interval must be at least 50ms")
+	}
+	if k.misses < 1 {
+		return nil, errors.New("timers.keepalive_misses must be at least 1")
+	}
+
+	return k, nil
+}
+
+func (n *connectionManager) runKeepalive(ctx context.Context) {
+	ticker := time.NewTicker(n.keepalive.interval)
+	defer ticker.Stop()
+
+	state := map[uint32]*keepaliveState{}
+	nb := make([]byte, 12, 12)
+	out := make([]byte, mtu)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			n.checkKeepalives(state, nb, out)
+		}
+	}
+}
+
+// checkKeepalives looks at every tunnel once, probing the ones that have gone quiet
+func (n *connectionManager) checkKeepalives(state map[uint32]*keepaliveState, nb, out []byte) {
+	seen := map[uint32]struct{}{}
+	n.hostMap.ForEachVpnIp(func(h *HostInfo) {
+		if h.ConnectionState == nil || h.remote == nil {
+			// Relayed tunnels have a single path, through the relay
+			return
+		}
+
+		seen[h.localIndexId] = struct{}{}
+		s := state[h.localIndexId]
+		if s == nil || s.hostinfo != h {
+			s = &keepaliveState{hostinfo: h}
+			state[h.localIndexId] = s
+		}
+	})
+
+	for localIndex, s := range state {
+		if _, ok := seen[localIndex]; !ok {
+			delete(state, localIndex)
+			continue
+		}
+		n.checkKeepalive(s, nb, out)
+	}
+}
+
+type keepaliveDecision int
+
+const (
+	keepaliveNone keepaliveDecision = iota
+	keepaliveProbe
+	keepaliveSpray
+)
+
+// check updates what we know of a tunnel from its message counters and decides how to probe it
+func (s *keepaliveState) check(misses int) keepaliveDecision {
+	messageOut := s.hostinfo.ConnectionState.messageCounter.Load()
+	messageIn := s.hostinfo.ConnectionState.messagesIn.Load()
+	sent := messageOut != s.messageOut
+	s.messageOut = messageOut
+
+	if messageIn != s.messageIn {
+		s.messageIn = messageIn
+		s.missed = 0
+		return keepaliveNone
+	}
+
+	if !sent && s.missed == 0 {
+		// Idle, there is nothing to hear back about
+		return keepaliveNone
+	}
+
+	s.missed++
+	if s.missed < misses {
+		return keepaliveProbe
+	}
+	return keepaliveSpray
+}
+
+func (n *connectionManager) checkKeepalive(s *keepaliveState, nb, out []byte) {
+	h := s.hostinfo
+	switch s.check(n.keepalive.misses) {
+	case keepaliveNone:
+		h.spraying.Store(false)
+
+	case keepaliveProbe:
+		n.intf.sendTo(header.Test, header.TestRequest, h.ConnectionState, h, h.remote, []byte(""), nb, out)
+
+	case keepaliveSpray:
+		if !h.spraying.Swap(true) {
+			h.logger(n.l).WithField("udpAddr", h.remote).WithField("missed", s.missed).
+				Info("Tunnel stopped answering keepalives, spraying its remotes")
+			n.keepalive.metricSpray.Inc(1)
+			n.intf.lightHouse.QueryServer(h.vpnIp)
+		}
+
+		for _, addr := range n.keepaliveRemotes(h) {
+			n.intf.sendTo(header.Test, header.TestRequest, h.ConnectionState, h, addr, marshalPathProbe(addr), nb, out)
+		}
+	}
+}
+
+// keepaliveRemotes are the current remote and every other remote we know for the host
+func (n *connectionManager) keepaliveRemotes(h *HostInfo) []*udp.Addr {
+	addrs := []*udp.Addr{h.remote}
+	if h.remotes == nil {
+		return addrs
+	}
+
+	for _, addr := range h.remotes.CopyAddrs(n.hostMap.GetPreferredRangesFor(h)) {
+		if !addr.Equals(h.remote) {
+			addrs = append(addrs, addr)
+		}
+	}
+	return addrs
+}
@@ -0,0 +1,87 @@
+package nebula
+
+import (
+	"net"
+	"testing"
+
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/iputil"
+	"github.com/slackhq/nebula/test"
+	"github.com/slackhq/nebula/udp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewKeepaliveFromConfig(t *testing.T) {
+	l := test.NewLogger()
+	c := config.NewC(l)
+
+	k, err := newKeepaliveFromConfig(c)
+	require.NoError(t, err)
+	assert.Nil(t, k)
+
+	c.Settings["timers"] = map[interface{}]interface{}{"keepalive_interval": "200ms"}
+	k, err = newKeepaliveFromConfig(c)
+	require.NoError(t, err)
+	assert.Equal(t, 3, k.misses)
+
+	for _, v := range []map[interface{}]interface{}{
+		{"keepalive_interval": "10ms"},
+		{"keepalive_interval": "200ms", "keepalive_misses": 0},
+	} {
+		c.Settings["timers"] = v
+		_, err = newKeepaliveFromConfig(c)
+		assert.Error(t, err, v)
+	}
+}
+
+func TestKeepaliveState_check(t *testing.T) {
+	h := &HostInfo{ConnectionState: &ConnectionState{}}
+	s := &keepaliveState{hostinfo: h}
+
+	// Idle tunnels are left alone
+	assert.Equal(t, keepaliveNone, s.check(3))
+	assert.Equal(t, keepaliveNone, s.check(3))
+
+	// We sent and heard back
+	h.ConnectionState.messageCounter.Add(1)
+	h.ConnectionState.messagesIn.Add(1)
+	assert.Equal(t, keepaliveNone, s.check(3))
+
+	// We sent and did not hear back, probe until misses then spray
+	h.ConnectionState.messageCounter.Add(1)
+	assert.Equal(t, keepaliveProbe, s.check(3))
+	assert.Equal(t, keepaliveProbe, s.check(3))
+	assert.Equal(t, keepaliveSpray, s.check(3))
+	assert.Equal(t, keepaliveSpray, s.check(3))
+
+	// Any reply resets it
+	h.ConnectionState.messagesIn.Add(1)
+	assert.Equal(t, keepaliveNone, s.check(3))
+	assert.Equal(t, 0, s.missed)
+	assert.Equal(t, keepaliveNone, s.check(3))
+}
+
+func TestHandlePathProbeReply_lock(t *testing.T) {
+	l := test.NewLogger()
+	a := udp.NewAddr(net.IP{1, 0, 0, 1}, 4242)
+	b := udp.NewAddr(net.IP{2, 0, 0, 1}, 4242)
+	c := udp.NewAddr(net.IP{3, 0, 0, 1}, 4242)
+
+	h := &HostInfo{vpnIp: iputil.Ip2VpnIp(net.IP{10, 128, 0, 2}), remote: a, remotes: NewRemoteList(nil), ConnectionState: &ConnectionState{}}
+	f := &Interface{l: l}
+
+	// Not spraying, replies do not move the tunnel
+	assert.True(t, f.handlePathProbeReply(h, marshalPathProbe(b)))
+	assert.Equal(t, a, h.remote)
+
+	// The first reply to a spray wins
+	h.spraying.Store(true)
+	assert.True(t, f.handlePathProbeReply(h, marshalPathProbe(b)))
+	assert.Equal(t, b, h.remote)
+	assert.Equal(t, a, h.lastRoamRemote)
+	assert.False(t, h.spraying.Load())
+
+	assert.True(t, f.handlePathProbeReply(h, marshalPathProbe(c)))
+	assert.Equal(t, b, h.remote)
+}
@@ -1,7 +1,6 @@
 package nebula
 
 import (
-	"bytes"
 	"context"
 	"sync"
 	"time"
@@ -44,12 +43,16 @@ type connectionManager struct {
 	punchy                  *Punchy
 	checkInterval           time.Duration
 	pendingDeletionInterval time.Duration
-	metricsTxPunchy         metrics.Counter
+	// adaptive derives the pending deletion wait from each tunnel's round trip time when set
+	adaptive *adaptiveTimeout
+	// keepalive probes tunnels that have gone quiet every few hundred milliseconds when set
+	keepalive       *keepalive
+	metricsTxPunchy metrics.Counter
 
 	l *logrus.Logger
 }
 
-func newConnectionManager(ctx context.Context, l *logrus.Logger, intf *Interface, checkInterval, pendingDeletionInterval time.Duration, punchy *Punchy) *connectionManager {
+func newConnectionManager(ctx context.Context, l *logrus.Logger, intf *Interface, checkInterval, pendingDeletionInterval time.Duration, adaptive *adaptiveTimeout, keepalive *keepalive, punchy *Punchy) *connectionManager {
 	var max time.Duration
 	if checkInterval < pendingDeletionInterval {
 		max = pendingDeletionInterval
@@ -57,6 +60,10 @@ func newConnectionManager(ctx context.Context, l *logrus.Logger, intf *Interface
 		max = checkInterval
 	}
 
+	if adaptive != nil && adaptive.max > max {
+		max = adaptive.max
+	}
+
 	nc := &connectionManager{
 		hostMap:                 intf.hostMap,
 		in:                      make(map[uint32]struct{}),
@@ -70,6 +77,8 @@ func newConnectionManager(ctx context.Context, l *logrus.Logger, intf *Interface
 		pendingDeletion:         make(map[uint32]struct{}),
 		checkInterval:           checkInterval,
 		pendingDeletionInterval: pendingDeletionInterval,
+		adaptive:                adaptive,
+		keepalive:               keepalive,
 		punchy:                  punchy,
 		metricsTxPunchy:         metrics.GetOrRegisterCounter("messages.tx.punchy", nil),
 		l:                       l,
@@ -146,6 +155,9 @@ func (n *connectionManager) AddTrafficWatch(localIndex uint32) {
 
 func (n *connectionManager) Start(ctx context.Context) {
 	go n.Run(ctx)
+	if n.keepalive != nil {
+		go n.runKeepalive(ctx)
+	}
 }
 
 func (n *connectionManager) Run(ctx context.Context) {
@@ -181,6 +193,7 @@ func (n *connectionManager) doTrafficCheck(localIndex uint32, p, nb, out []byte,
 
 	switch decision {
 	case deleteTunnel:
+		n.intf.events.emit(hostEvent(TunnelEventTunnelClosed, hostinfo, "no response from the remote"))
 		if n.hostMap.DeleteHostInfo(hostinfo) {
 			// Only clearing the lighthouse cache if this is the last hostinfo for this vpn ip in the hostmap
 			n.intf.lightHouse.DeleteVpnIp(hostinfo.vpnIp)
@@ -188,7 +201,7 @@ func (n *connectionManager) doTrafficCheck(localIndex uint32, p, nb, out []byte,
 
 	case closeTunnel:
 		n.intf.sendCloseTunnel(hostinfo)
-		n.intf.closeTunnel(hostinfo)
+		n.intf.closeTunnel(hostinfo, "remote certificate is no longer acceptable")
 
 	case swapPrimary:
 		n.swapPrimary(hostinfo, primary)
@@ -197,9 +210,10 @@ func (n *connectionManager) doTrafficCheck(localIndex uint32, p, nb, out []byte,
 		n.migrateRelayUsed(hostinfo, primary)
 
 	case tryRehandshake:
-		n.tryRehandshake(hostinfo)
+		n.tryRehandshake(hostinfo, now)
 
 	case sendTestPacket:
+		hostinfo.rtt.sent(now)
 		n.intf.SendMessageToHostInfo(header.Test, header.TestRequest, hostinfo, p, nb, out)
 	}
 
@@ -274,17 +288,16 @@ func (n *connectionManager) migrateRelayUsed(oldhostinfo, newhostinfo *HostInfo)
 		req := NebulaControl{
 			Type:                NebulaControl_CreateRelayRequest,
 			InitiatorRelayIndex: index,
-			RelayFromIp:         uint32(relayFrom),
-			RelayToIp:           uint32(relayTo),
 		}
+		req.setRelay(relayFrom, relayTo)
 		msg, err := req.Marshal()
 		if err != nil {
 			n.l.WithError(err).Error("failed to marshal Control message to migrate relay")
 		} else {
 			n.intf.SendMessageToHostInfo(header.Control, 0, newhostinfo, msg, make([]byte, 12), make([]byte, mtu))
 			n.l.WithFields(logrus.Fields{
-				"relayFrom":           iputil.VpnIp(req.RelayFromIp),
-				"relayTo":             iputil.VpnIp(req.RelayToIp),
+				"relayFrom":           req.relayFrom(),
+				"relayTo":             req.relayTo(),
 				"initiatorRelayIndex": req.InitiatorRelayIndex,
 				"responderRelayIndex": req.ResponderRelayIndex,
 				"vpnIp":               newhostinfo.vpnIp}).
@@ -304,7 +317,8 @@ func (n *connectionManager) makeTrafficDecision(localIndex uint32, now time.Time
 		return doNothing, nil, nil
 	}
 
-	if n.isInvalidCertificate(now, hostinfo) {
+	if n.isInvalidCertificate(now, hostinfo) || n.isMissingRequiredGroup(hostinfo) || n.isUnpinned(hostinfo) ||
+		n.isPSKMismatch(hostinfo) {
 		delete(n.pendingDeletion, hostinfo.localIndexId)
 		return closeTunnel, hostinfo, nil
 	}
@@ -379,8 +393,9 @@ func (n *connectionManager) makeTrafficDecision(localIndex uint32, now time.Time
 		}
 
 		if n.l.Level >= logrus.DebugLevel {
+			srtt, rttvar, _ := hostinfo.rtt.get()
 			hostinfo.logger(n.l).
-				WithField("tunnelCheck", m{"state": "testing", "method": "active"}).
+				WithField("tunnelCheck", m{"state": "testing", "method": "active", "srtt": srtt, "rttvar": rttvar}).
 				Debug("Tunnel status")
 		}
 
@@ -394,7 +409,7 @@ func (n *connectionManager) makeTrafficDecision(localIndex uint32, now time.Time
 	}
 
 	n.pendingDeletion[hostinfo.localIndexId] = struct{}{}
-	n.trafficTimer.Add(hostinfo.localIndexId, n.pendingDeletionInterval)
+	n.trafficTimer.Add(hostinfo.localIndexId, hostinfo.rtt.timeout(n.adaptive, n.pendingDeletionInterval))
 	return decision, hostinfo, nil
 }
 
@@ -403,15 +418,14 @@ func (n *connectionManager) shouldSwapPrimary(current, primary *HostInfo) bool {
 	// If we are here then we have multiple tunnels for a host pair and neither side believes the same tunnel is primary.
 	// Let's sort this out.
 
-	if current.vpnIp < n.intf.myVpnIp {
+	if current.vpnIp.Compare(n.intf.myVpnIp) < 0 {
 		// Only one side should flip primary because if both flip then we may never resolve to a single tunnel.
 		// vpn ip is static across all tunnels for this host pair so lets use that to determine who is flipping.
 		// The remotes vpn ip is lower than mine. I will not flip.
 		return false
 	}
 
-	certState := n.intf.pki.GetCertState()
-	return bytes.Equal(current.ConnectionState.myCert.Signature, certState.Certificate.Signature)
+	return n.intf.pki.GetCertState().owns(current.ConnectionState.myCert)
 }
 
 func (n *connectionManager) swapPrimary(current, primary *HostInfo) {
@@ -442,11 +456,80 @@ func (n *connectionManager) isInvalidCertificate(now time.Time, hostinfo *HostIn
 		return false
 	}
 
-	fingerprint, _ := remoteCert.Sha256Sum()
+	fingerprint, _ := remoteCert.Fingerprint()
 	hostinfo.logger(n.l).WithError(err).
 		WithField("fingerprint", fingerprint).
 		Info("Remote certificate is no longer valid, tearing down the tunnel")
 
+	n.intf.events.emit(hostEvent(TunnelEventCertRejected, hostinfo, err.Error()))
+
+	return true
+}
+
+// isMissingRequiredGroup will check if we should destroy a tunnel because handshakes.require_groups changed and the
+// remote certificate no longer satisfies it
+func (n *connectionManager) isMissingRequiredGroup(hostinfo *HostInfo) bool {
+	remoteCert := hostinfo.GetCert()
+	if remoteCert == nil {
+		return false
+	}
+
+	group := n.intf.requireGroups.Load().missing(remoteCert)
+	if group == "" {
+		return false
+	}
+
+	fingerprint, _ := remoteCert.Fingerprint()
+	hostinfo.logger(n.l).WithError(ErrMissingRequiredGroup).
+		WithField("fingerprint", fingerprint).
+		WithField("group", group).
+		Info("Remote certificate is missing a required group, tearing down the tunnel")
+
+	n.intf.events.emit(hostEvent(TunnelEventCertRejected, hostinfo, ErrMissingRequiredGroup.Error()+": "+group))
+
+	return true
+}
+
+// isUnpinned will check if we should destroy a tunnel because pki.pins changed and the remote certificate no longer
+// matches the pins for its vpn ip
+func (n *connectionManager) isUnpinned(hostinfo *HostInfo) bool {
+	remoteCert := hostinfo.GetCert()
+	if remoteCert == nil {
+		return false
+	}
+
+	if n.intf.pins.Load().allow(hostinfo.vpnIp, remoteCert) {
+		return false
+	}
+
+	fingerprint, _ := remoteCert.Fingerprint()
+	hostinfo.logger(n.l).WithError(ErrPinMismatch).
+		WithField("fingerprint", fingerprint).
+		Info("Remote certificate does not match its pins, tearing down the tunnel")
+
+	n.intf.events.emit(hostEvent(TunnelEventCertRejected, hostinfo, ErrPinMismatch.Error()))
+	return true
+}
+
+// isPSKMismatch will check if we should destroy a tunnel because handshakes.psk changed and the tunnel was not
+// established with the keys of the groups we now share with the remote
+func (n *connectionManager) isPSKMismatch(hostinfo *HostInfo) bool {
+	remoteCert := hostinfo.GetCert()
+	if remoteCert == nil {
+		return false
+	}
+
+	ci := hostinfo.ConnectionState
+	expected := n.intf.psks.Load().groupsFor(ci.myCert, remoteCert)
+	if equalStrings(expected, ci.pskGroups) {
+		return false
+	}
+
+	hostinfo.logger(n.l).WithError(ErrHandshakePSKMismatch).
+		WithField("expectedGroups", expected).
+		WithField("pskGroups", ci.pskGroups).
+		Info("Tunnel does not use the pre-shared keys we require, tearing down the tunnel")
+
 	return true
 }
 
@@ -457,7 +540,7 @@ func (n *connectionManager) sendPunch(hostinfo *HostInfo) {
 	}
 
 	if n.punchy.GetTargetEverything() {
-		hostinfo.remotes.ForEach(n.hostMap.GetPreferredRanges(), func(addr *udp.Addr, preferred bool) {
+		hostinfo.remotes.ForEach(n.hostMap.GetPreferredRangesFor(hostinfo), func(addr *udp.Addr, preferred bool) {
 			n.metricsTxPunchy.Inc(1)
 			n.intf.outside.WriteTo([]byte{1}, addr)
 		})
@@ -468,14 +551,21 @@ func (n *connectionManager) sendPunch(hostinfo *HostInfo) {
 	}
 }
 
-func (n *connectionManager) tryRehandshake(hostinfo *HostInfo) {
+func (n *connectionManager) tryRehandshake(hostinfo *HostInfo, now time.Time) {
+	var reason string
 	certState := n.intf.pki.GetCertState()
-	if bytes.Equal(hostinfo.ConnectionState.myCert.Signature, certState.Certificate.Signature) {
+	if !certState.owns(hostinfo.ConnectionState.myCert) {
+		reason = "local certificate is not current"
+	} else if p := n.intf.rekey.Load(); p != nil {
+		reason = p.due(hostinfo.ConnectionState, now, 2*n.checkInterval)
+	}
+
+	if reason == "" {
 		return
 	}
 
 	n.l.WithField("vpnIp", hostinfo.vpnIp).
-		WithField("reason", "local certificate is not current").
+		WithField("reason", reason).
 		Info("Re-handshaking with remote")
 
 	n.intf.handshakeManager.StartHandshake(hostinfo.vpnIp, nil)
@@ -70,7 +70,7 @@ func Test_NewConnectionManagerTest(t *testing.T) {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 	punchy := NewPunchyFromConfig(l, config.NewC(l))
-	nc := newConnectionManager(ctx, l, ifce, 5, 10, punchy)
+	nc := newConnectionManager(ctx, l, ifce, 5, 10, nil, nil, punchy)
 	p := []byte("")
 	nb := make([]byte, 12, 12)
 	out := make([]byte, mtu)
@@ -152,7 +152,7 @@ func Test_NewConnectionManagerTest2(t *testing.T) {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 	punchy := NewPunchyFromConfig(l, config.NewC(l))
-	nc := newConnectionManager(ctx, l, ifce, 5, 10, punchy)
+	nc := newConnectionManager(ctx, l, ifce, 5, 10, nil, nil, punchy)
 	p := []byte("")
 	nb := make([]byte, 12, 12)
 	out := make([]byte, mtu)
@@ -276,7 +276,7 @@ func Test_NewConnectionManagerTest_DisconnectInvalid(t *testing.T) {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 	punchy := NewPunchyFromConfig(l, config.NewC(l))
-	nc := newConnectionManager(ctx, l, ifce, 5, 10, punchy)
+	nc := newConnectionManager(ctx, l, ifce, 5, 10, nil, nil, punchy)
 	ifce.connectionManager = nc
 
 	hostinfo := &HostInfo{
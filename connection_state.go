@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/flynn/noise"
 	"github.com/sirupsen/logrus"
@@ -24,17 +25,37 @@ type ConnectionState struct {
 	messageCounter atomic.Uint64
 	window         *Bits
 	writeLock      sync.Mutex
+
+	// sentCapabilities is what we advertised in our handshake message, capabilities is what was negotiated
+	sentCapabilities capabilitySet
+	capabilities     capabilitySet
+
+	// cipher is the negotiated tunnel cipher, see handshake_ciphers.go
+	cipher string
+	// kemKey is the initiators half of a hybrid key exchange while the handshake is in flight, kem is what was used
+	kemKey kemKey
+	kem    string
+
+	// peerTrustedCAs is what the peer advertised it trusts, it picks our certificate for the next handshake with them
+	peerTrustedCAs []string
+
+	// pskGroups are the handshakes.psk groups whose keys were mixed into the handshake
+	pskGroups []string
+
+	// established is when the keys were set, bytesOut is what we have encrypted with them. Both feed the rekeyPolicy.
+	established time.Time
+	bytesOut    atomic.Uint64
+
+	// messagesIn counts the authenticated packets we accepted, keepalives compare it and messageCounter between checks
+	// to tell if the tunnel is in use and answering. bytesIn is the size of those packets.
+	messagesIn atomic.Uint64
+	bytesIn    atomic.Uint64
 }
 
 func NewConnectionState(l *logrus.Logger, cipher string, certState *CertState, initiator bool, pattern noise.HandshakePattern, psk []byte, pskStage int) *ConnectionState {
-	var dhFunc noise.DHFunc
-	switch certState.Certificate.Details.Curve {
-	case cert.Curve_CURVE25519:
-		dhFunc = noise.DH25519
-	case cert.Curve_P256:
-		dhFunc = noiseutil.DHP256
-	default:
-		l.Errorf("invalid curve: %s", certState.Certificate.Details.Curve)
+	dhFunc, err := certDHFunc(certState)
+	if err != nil {
+		l.Error(err)
 		return nil
 	}
 
@@ -83,5 +104,9 @@ func (cs *ConnectionState) MarshalJSON() ([]byte, error) {
 		"certificate":     cs.peerCert,
 		"initiator":       cs.initiator,
 		"message_counter": cs.messageCounter.Load(),
+		"capabilities":    cs.capabilities,
+		"cipher":          cs.cipher,
+		"kem":             cs.kem,
+		"psk_groups":      cs.pskGroups,
 	})
 }
@@ -2,6 +2,8 @@ package nebula
 
 import (
 	"context"
+	"fmt"
+	"io"
 	"net"
 	"os"
 	"os/signal"
@@ -9,6 +11,7 @@ import (
 
 	"github.com/sirupsen/logrus"
 	"github.com/slackhq/nebula/cert"
+	"github.com/slackhq/nebula/config"
 	"github.com/slackhq/nebula/header"
 	"github.com/slackhq/nebula/iputil"
 	"github.com/slackhq/nebula/overlay"
@@ -24,18 +27,36 @@ type controlHostLister interface {
 	QueryVpnIp(vpnIp iputil.VpnIp) *HostInfo
 	ForEachIndex(each controlEach)
 	ForEachVpnIp(each controlEach)
-	GetPreferredRanges() []*net.IPNet
+	GetPreferredRangesFor(h *HostInfo) []*net.IPNet
 }
 
 type Control struct {
-	f               *Interface
-	l               *logrus.Logger
-	ctx             context.Context
-	cancel          context.CancelFunc
-	sshStart        func()
-	statsStart      func()
-	dnsStart        func()
-	lighthouseStart func()
+	f                *Interface
+	l                *logrus.Logger
+	ctx              context.Context
+	cancel           context.CancelFunc
+	sshStart         func()
+	statsStart       func()
+	dnsStart         func()
+	lighthouseStart  func()
+	underlayStart    func()
+	renewStart       func()
+	remotePKIStart   func()
+	lhSyncStart      func()
+	discoveryStart   func()
+	lhEvictStart     func()
+	portMapStart     func()
+	stunStart        func()
+	pmtudStart       func()
+	multipathStart   func()
+	relaySelectStart func()
+	relayFindStart   func()
+	routeLearnStart  func()
+	tcpStart         func()
+	quicStart        func()
+	portHopStart     func()
+	proxyStart       func()
+	controlAPIStart  func()
 }
 
 type ControlHostInfo struct {
@@ -48,6 +69,8 @@ type ControlHostInfo struct {
 	CurrentRemote          *udp.Addr               `json:"currentRemote"`
 	CurrentRelaysToMe      []iputil.VpnIp          `json:"currentRelaysToMe"`
 	CurrentRelaysThroughMe []iputil.VpnIp          `json:"currentRelaysThroughMe"`
+	// PathMTU is the largest inner packet the path carries, 0 if pmtud has not probed it
+	PathMTU int `json:"pathMtu"`
 }
 
 // Start actually runs nebula, this is a nonblocking call. To block use Control.ShutdownBlock()
@@ -55,6 +78,11 @@ func (c *Control) Start() {
 	// Activate the interface
 	c.f.activate()
 
+	// Nothing reaches the underlay until the proxy relay is up
+	if c.proxyStart != nil {
+		c.proxyStart()
+	}
+
 	// Call all the delayed funcs that waited patiently for the interface to be created.
 	if c.sshStart != nil {
 		go c.sshStart()
@@ -68,6 +96,57 @@ func (c *Control) Start() {
 	if c.lighthouseStart != nil {
 		c.lighthouseStart()
 	}
+	if c.underlayStart != nil {
+		c.underlayStart()
+	}
+	if c.renewStart != nil {
+		c.renewStart()
+	}
+	if c.remotePKIStart != nil {
+		c.remotePKIStart()
+	}
+	if c.lhSyncStart != nil {
+		c.lhSyncStart()
+	}
+	if c.discoveryStart != nil {
+		c.discoveryStart()
+	}
+	if c.lhEvictStart != nil {
+		c.lhEvictStart()
+	}
+	if c.portMapStart != nil {
+		c.portMapStart()
+	}
+	if c.stunStart != nil {
+		c.stunStart()
+	}
+	if c.pmtudStart != nil {
+		c.pmtudStart()
+	}
+	if c.multipathStart != nil {
+		c.multipathStart()
+	}
+	if c.relaySelectStart != nil {
+		c.relaySelectStart()
+	}
+	if c.relayFindStart != nil {
+		c.relayFindStart()
+	}
+	if c.routeLearnStart != nil {
+		c.routeLearnStart()
+	}
+	if c.tcpStart != nil {
+		c.tcpStart()
+	}
+	if c.quicStart != nil {
+		c.quicStart()
+	}
+	if c.portHopStart != nil {
+		go c.portHopStart()
+	}
+	if c.controlAPIStart != nil {
+		c.controlAPIStart()
+	}
 
 	// Start reading packets.
 	c.f.run()
@@ -104,13 +183,14 @@ func (c *Control) ShutdownBlock() {
 
 // RebindUDPServer asks the UDP listener to rebind it's listener. Mainly used on mobile clients when interfaces change
 func (c *Control) RebindUDPServer() {
-	_ = c.f.outside.Rebind()
-
-	// Trigger a lighthouse update, useful for mobile clients that should have an update interval of 0
-	c.f.lightHouse.SendUpdate()
+	c.f.rebindUnderlay()
+}
 
-	// Let the main interface know that we rebound so that underlying tunnels know to trigger punches from their remotes
-	c.f.rebindCount++
+// OnTunnelEvent registers fn to be called for handshake and tunnel lifecycle events. Events are delivered in order on a
+// single goroutine, fn must not block for long or events will be dropped and counted in tunnel_events.dropped.
+// Delivery stops once Stop is called.
+func (c *Control) OnTunnelEvent(fn func(TunnelEvent)) {
+	c.f.events.register(c.ctx, fn)
 }
 
 // ListHostmapHosts returns details about the actual or pending (handshaking) hostmap by vpn ip
@@ -131,6 +211,21 @@ func (c *Control) ListHostmapIndexes(pendingMap bool) []ControlHostInfo {
 	}
 }
 
+// QueryHostmap returns a filtered, sorted, and paged listing of the hostmap, prefer this to ListHostmapHosts on nodes
+// with many tunnels
+func (c *Control) QueryHostmap(q HostmapQuery) (*HostmapPage, error) {
+	return queryHostmap(q, c.f.hostMap, c.f.handshakeManager)
+}
+
+// StreamHostmap writes the hosts matching the query to w as newline delimited json
+func (c *Control) StreamHostmap(w io.Writer, q HostmapQuery) error {
+	page, err := c.QueryHostmap(q)
+	if err != nil {
+		return err
+	}
+	return writeHostmapStream(w, page)
+}
+
 // GetHostInfoByVpnIp returns a single tunnels hostInfo, or nil if not found
 func (c *Control) GetHostInfoByVpnIp(vpnIp iputil.VpnIp, pending bool) *ControlHostInfo {
 	var hl controlHostLister
@@ -145,10 +240,27 @@ func (c *Control) GetHostInfoByVpnIp(vpnIp iputil.VpnIp, pending bool) *ControlH
 		return nil
 	}
 
-	ch := copyHostInfo(h, c.f.hostMap.GetPreferredRanges())
+	ch := copyHostInfo(h, c.f.hostMap.GetPreferredRangesFor(h))
 	return &ch
 }
 
+// GetLighthouseInfo returns what we know about reaching vpnIp from the lighthouses, our config, and the host itself,
+// or nil if we know nothing. It does not query the lighthouses, see LighthouseInfo.
+func (c *Control) GetLighthouseInfo(vpnIp iputil.VpnIp) *LighthouseInfo {
+	return c.f.lighthouseInfo(vpnIp)
+}
+
+// Diag probes the tunnel to vpnIp with diag messages, see DiagReport for what is measured. This blocks for at least a
+// round trip per probe and up to the probe timeout for every size that does not get through.
+func (c *Control) Diag(vpnIp iputil.VpnIp, o DiagOptions) (*DiagReport, error) {
+	hostInfo := c.f.hostMap.QueryVpnIp(vpnIp)
+	if hostInfo == nil {
+		return nil, fmt.Errorf("could not find tunnel for vpn ip: %v", vpnIp)
+	}
+
+	return c.f.diagnose(hostInfo, o)
+}
+
 // SetRemoteForTunnel forces a tunnel to use a specific remote
 func (c *Control) SetRemoteForTunnel(vpnIp iputil.VpnIp, addr udp.Addr) *ControlHostInfo {
 	hostInfo := c.f.hostMap.QueryVpnIp(vpnIp)
@@ -157,7 +269,7 @@ func (c *Control) SetRemoteForTunnel(vpnIp iputil.VpnIp, addr udp.Addr) *Control
 	}
 
 	hostInfo.SetRemote(addr.Copy())
-	ch := copyHostInfo(hostInfo, c.f.hostMap.GetPreferredRanges())
+	ch := copyHostInfo(hostInfo, c.f.hostMap.GetPreferredRangesFor(hostInfo))
 	return &ch
 }
 
@@ -180,7 +292,7 @@ func (c *Control) CloseTunnel(vpnIp iputil.VpnIp, localOnly bool) bool {
 		)
 	}
 
-	c.f.closeTunnel(hostInfo)
+	c.f.closeTunnel(hostInfo, "closed by control")
 	return true
 }
 
@@ -197,7 +309,7 @@ func (c *Control) CloseAllTunnels(excludeLighthouses bool) (closed int) {
 			}
 		}
 		c.f.send(header.CloseTunnel, 0, h.ConnectionState, h, []byte{}, make([]byte, 12, 12), make([]byte, mtu))
-		c.f.closeTunnel(h)
+		c.f.closeTunnel(h, "closed by control")
 
 		c.l.WithField("vpnIp", h.vpnIp).WithField("udpAddr", h.remote).
 			Debug("Sending close tunnel message")
@@ -232,10 +344,83 @@ func (c *Control) CloseAllTunnels(excludeLighthouses bool) (closed int) {
 	return
 }
 
+// ListFirewallCIDRSets returns the entries of every firewall cidr set
+func (c *Control) ListFirewallCIDRSets() []FirewallCIDRSet {
+	return c.f.firewall.CIDRSets()
+}
+
+// AddFirewallCIDRSetEntries adds ipv4 cidrs or ips to a firewall cidr set. The change lasts until nebula is restarted, a
+// config reload keeps it.
+func (c *Control) AddFirewallCIDRSetEntries(name string, entries []string) error {
+	cidrs, err := parseCIDRSetEntries(entries)
+	if err != nil {
+		return err
+	}
+	return c.f.firewall.AddToCIDRSet(name, cidrs)
+}
+
+// RemoveFirewallCIDRSetEntries removes ipv4 cidrs or ips from a firewall cidr set
+func (c *Control) RemoveFirewallCIDRSetEntries(name string, entries []string) error {
+	cidrs, err := parseCIDRSetEntries(entries)
+	if err != nil {
+		return err
+	}
+	return c.f.firewall.RemoveFromCIDRSet(name, cidrs)
+}
+
+// ReplaceFirewallCIDRSet makes entries the only ipv4 cidrs or ips in a firewall cidr set, useful to sync a whole list
+func (c *Control) ReplaceFirewallCIDRSet(name string, entries []string) error {
+	cidrs, err := parseCIDRSetEntries(entries)
+	if err != nil {
+		return err
+	}
+	return c.f.firewall.ReplaceCIDRSet(name, cidrs)
+}
+
+// ListUnsafeRoutes returns the unsafe routes in use, from tun.unsafe_routes and added at runtime
+func (c *Control) ListUnsafeRoutes() ([]overlay.Route, error) {
+	rm, err := c.f.unsafeRouteManager()
+	if err != nil {
+		return nil, err
+	}
+	return rm.UnsafeRoutes(), nil
+}
+
+// AddUnsafeRoutes installs unsafe routes without a config reload, replacing any unsafe route for the same cidr. The
+// change lasts until nebula is restarted, a config reload keeps it. Install must be set for a route to be put in the
+// system route table.
+func (c *Control) AddUnsafeRoutes(routes []overlay.Route) error {
+	rm, err := c.f.unsafeRouteManager()
+	if err != nil {
+		return err
+	}
+	return rm.AddUnsafeRoutes(routes)
+}
+
+// RemoveUnsafeRoutes removes the unsafe routes for cidrs, whether they came from tun.unsafe_routes or were added at
+// runtime
+func (c *Control) RemoveUnsafeRoutes(cidrs []*net.IPNet) error {
+	rm, err := c.f.unsafeRouteManager()
+	if err != nil {
+		return err
+	}
+	return rm.RemoveUnsafeRoutes(cidrs)
+}
+
 func (c *Control) Device() overlay.Device {
 	return c.f.inside
 }
 
+// PendingRestart returns the settings changed by a reload that only apply after nebula is restarted
+func (c *Control) PendingRestart() []string {
+	return c.f.restarts.Pending()
+}
+
+// CheckConfig returns what would change if candidate was loaded instead of the running config, without loading it
+func (c *Control) CheckConfig(candidate *config.C) *ConfigCheck {
+	return c.f.restarts.Check(candidate)
+}
+
 func copyHostInfo(h *HostInfo, preferredRanges []*net.IPNet) ControlHostInfo {
 
 	chi := ControlHostInfo{
@@ -245,6 +430,7 @@ func copyHostInfo(h *HostInfo, preferredRanges []*net.IPNet) ControlHostInfo {
 		RemoteAddrs:            h.remotes.CopyAddrs(preferredRanges),
 		CurrentRelaysToMe:      h.relayState.CopyRelayIps(),
 		CurrentRelaysThroughMe: h.relayState.CopyRelayForIps(),
+		PathMTU:                int(h.pmtu.Load()),
 	}
 
 	if h.ConnectionState != nil {
@@ -264,18 +450,16 @@ func copyHostInfo(h *HostInfo, preferredRanges []*net.IPNet) ControlHostInfo {
 
 func listHostMapHosts(hl controlHostLister) []ControlHostInfo {
 	hosts := make([]ControlHostInfo, 0)
-	pr := hl.GetPreferredRanges()
 	hl.ForEachVpnIp(func(hostinfo *HostInfo) {
-		hosts = append(hosts, copyHostInfo(hostinfo, pr))
+		hosts = append(hosts, copyHostInfo(hostinfo, hl.GetPreferredRangesFor(hostinfo)))
 	})
 	return hosts
 }
 
 func listHostMapIndexes(hl controlHostLister) []ControlHostInfo {
 	hosts := make([]ControlHostInfo, 0)
-	pr := hl.GetPreferredRanges()
 	hl.ForEachIndex(func(hostinfo *HostInfo) {
-		hosts = append(hosts, copyHostInfo(hostinfo, pr))
+		hosts = append(hosts, copyHostInfo(hostinfo, hl.GetPreferredRangesFor(hostinfo)))
 	})
 	return hosts
 }
@@ -0,0 +1,431 @@
+package nebula
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/iputil"
+	"gopkg.in/yaml.v2"
+)
+
+// The control api is a local json over http api on a unix socket for the operations orchestration tools would
+// otherwise script over ssh: listing the hostmap, closing tunnels, reloading the config, asking the lighthouses about a
+// host and reading our certificate. Access is controlled with the file mode of the socket, and with the level of the
+// bearer token a request presents, see control_api.tokens. Every request is recorded in the audit log. See the
+// controlapi package for a client.
+//
+//	GET    /v1/hostmap                    read    hostmap page, takes the HostmapQuery fields as query parameters
+//	GET    /v1/hosts/{vpnIp}              read    the tunnel for vpnIp, ?pending=true for the handshaking one
+//	DELETE /v1/hosts/{vpnIp}              tunnel  closes the tunnel for vpnIp, ?local_only=true does not tell the remote
+//	GET    /v1/lighthouse/{vpnIp}         read    what we know about reaching vpnIp, see LighthouseInfo
+//	POST   /v1/lighthouse/{vpnIp}/query   tunnel  queries the lighthouses for vpnIp and returns what is already cached
+//	GET    /v1/cert                       read    our certificate
+//	POST   /v1/reload                     reload  reloads the config from disk
+//	POST   /v1/config/check               reload  what would change with the yaml config in the body, see ConfigCheck
+//
+// The config posted to /v1/config/check is used as is, its includes and environment variables must already be expanded
+// like -test prints it. It is compared and never loaded.
+//
+// Errors are returned as {"error": "..."} with a matching status code.
+
+const defaultControlAPIMode = 0600
+
+// maxControlAPIConfigSize is the largest config /v1/config/check accepts
+const maxControlAPIConfigSize = 4 << 20
+
+type controlAPI struct {
+	l      *logrus.Logger
+	c      *config.C
+	listen string
+	mode   os.FileMode
+
+	tokens       []controlAPIToken
+	defaultLevel adminLevel
+}
+
+// controlAPIToken is a bearer token from control_api.tokens
+type controlAPIToken struct {
+	name  string
+	token string
+	level adminLevel
+}
+
+func newControlAPIFromConfig(l *logrus.Logger, c *config.C) (*controlAPI, error) {
+	listen := c.GetString("control_api.listen", "")
+	if listen == "" {
+		return nil, nil
+	}
+
+	mode := c.GetInt("control_api.mode", defaultControlAPIMode)
+	if mode <= 0 || mode > 0777 {
+		return nil, fmt.Errorf("control_api.mode must be a file mode between 0001 and 0777, got %o", mode)
+	}
+
+	tokens, err := newControlAPITokensFromConfig(c)
+	if err != nil {
+		return nil, err
+	}
+
+	// Without tokens everyone who can connect to the socket can do everything, like before tokens existed
+	defaultLevel := adminLevelReload
+	if len(tokens) > 0 {
+		defaultLevel = adminLevelNone
+	}
+	if dl := c.GetString("control_api.default_level", ""); dl != "" {
+		defaultLevel, err = parseAdminLevel(dl)
+		if err != nil {
+			return nil, fmt.Errorf("control_api.default_level: %s", err)
+		}
+	}
+
+	return &controlAPI{
+		l:            l,
+		c:            c,
+		listen:       listen,
+		mode:         os.FileMode(mode),
+		tokens:       tokens,
+		defaultLevel: defaultLevel,
+	}, nil
+}
+
+func newControlAPITokensFromConfig(c *config.C) ([]controlAPIToken, error) {
+	raw := c.Get("control_api.tokens")
+	if raw == nil {
+		return nil, nil
+	}
+
+	rawTokens, ok := raw.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("control_api.tokens must be a list, got %T", raw)
+	}
+
+	tokens := make([]controlAPIToken, 0, len(rawTokens))
+	seen := map[string]struct{}{}
+	for i, rt := range rawTokens {
+		m, ok := rt.(map[interface{}]interface{})
+		if !ok {
+			return nil, fmt.Errorf("control_api.tokens[%d] must be a map, got %T", i, rt)
+		}
+
+		t := controlAPIToken{}
+		t.name, _ = m["name"].(string)
+		if t.name == "" {
+			return nil, fmt.Errorf("control_api.tokens[%d].name must be provided", i)
+		}
+
+		t.token, _ = m["token"].(string)
+		if t.token == "" {
+			return nil, fmt.Errorf("control_api.tokens[%d].token must be provided", i)
+		}
+		if _, ok := seen[t.token]; ok {
+			return nil, fmt.Errorf("control_api.tokens[%d].token is used by another token", i)
+		}
+		seen[t.token] = struct{}{}
+
+		var err error
+		t.level, err = parseAdminLevel(fmt.Sprint(m["level"]))
+		if err != nil {
+			return nil, fmt.Errorf("control_api.tokens[%d].level: %s", i, err)
+		}
+
+		tokens = append(tokens, t)
+	}
+
+	return tokens, nil
+}
+
+// authorize returns who made r and their level, an error is returned for a token we do not know
+func (api *controlAPI) authorize(r *http.Request) (string, adminLevel, error) {
+	auth := r.Header.Get("Authorization")
+	if auth == "" {
+		return "anonymous", api.defaultLevel, nil
+	}
+
+	token, ok := strings.CutPrefix(auth, "Bearer ")
+	if !ok {
+		return "", adminLevelNone, errors.New("the authorization header must be a bearer token")
+	}
+
+	for _, t := range api.tokens {
+		if subtle.ConstantTimeCompare([]byte(t.token), []byte(token)) == 1 {
+			return t.name, t.level, nil
+		}
+	}
+	return "", adminLevelNone, errors.New("unknown token")
+}
+
+// Start serves the api for ctl on the unix socket until ctx is done, recording every request in audit. This is a non
+// blocking call.
+func (api *controlAPI) Start(ctx context.Context, ctl *Control, audit *adminAudit) {
+	// A socket left behind by a nebula that did not shut down cleanly would fail the listen
+	if err := os.Remove(api.listen); err != nil && !errors.Is(err, os.ErrNotExist) {
+		api.l.WithError(err).WithField("listen", api.listen).Error("Failed to remove the old control api socket")
+		return
+	}
+
+	ln, err := api.listenPrivate()
+	if err != nil {
+		api.l.WithError(err).WithField("listen", api.listen).Error("Failed to listen for the control api")
+		return
+	}
+
+	hs := &http.Server{Handler: api.handler(ctl, audit), ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		<-ctx.Done()
+		hs.Close()
+		os.Remove(api.listen)
+	}()
+
+	go func() {
+		api.l.WithField("listen", api.listen).Info("Control api listening")
+		if err := hs.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			api.l.WithError(err).Error("Control api stopped")
+		}
+	}()
+}
+
+// listenPrivate creates the socket in a directory only we can enter and moves it to api.listen once it has its mode,
+// so nobody can connect to it in between
+func (api *controlAPI) listenPrivate() (net.Listener, error) {
+	dir, err := os.MkdirTemp(filepath.Dir(api.listen), ".nebula-control-api-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	tmp := filepath.Join(dir, "sock")
+	ln, err := net.Listen("unix", tmp)
+	if err != nil {
+		return nil, err
+	}
+	// The socket is moved out from under the listener, Start removes it instead
+	ln.(*net.UnixListener).SetUnlinkOnClose(false)
+
+	if err := os.Chmod(tmp, api.mode); err != nil {
+		ln.Close()
+		return nil, fmt.Errorf("failed to set the mode of the socket: %w", err)
+	}
+
+	if err := os.Rename(tmp, api.listen); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return ln, nil
+}
+
+func (api *controlAPI) handler(ctl *Control, audit *adminAudit) http.Handler {
+	mux := http.NewServeMux()
+
+	// handle serves pattern for requests with at least level and records every request in the audit log
+	handle := func(pattern string, level adminLevel, h http.HandlerFunc) {
+		mux.HandleFunc(pattern, func(w http.ResponseWriter, r *http.Request) {
+			user, granted, err := api.authorize(r)
+			e := adminAuditEntry{
+				Interface: "control_api",
+				User:      user,
+				Action:    r.Method + " " + r.URL.Path,
+			}
+			if r.URL.RawQuery != "" {
+				e.Args = []string{r.URL.RawQuery}
+			}
+
+			switch {
+			case err != nil:
+				writeControlAPIError(w, http.StatusUnauthorized, err)
+				e.Error = err.Error()
+			case granted < level:
+				err = fmt.Errorf("permission denied: needs the %s level", level)
+				writeControlAPIError(w, http.StatusForbidden, err)
+				e.Error = err.Error()
+			default:
+				sw := &controlAPIStatusWriter{ResponseWriter: w, status: http.StatusOK}
+				h(sw, r)
+				e.Allowed = true
+				if sw.status >= http.StatusBadRequest {
+					e.Error = http.StatusText(sw.status)
+				}
+			}
+
+			audit.record(e)
+		})
+	}
+
+	handle("GET /v1/hostmap", adminLevelRead, func(w http.ResponseWriter, r *http.Request) {
+		q, err := hostmapQueryFromValues(r)
+		if err != nil {
+			writeControlAPIError(w, http.StatusBadRequest, err)
+			return
+		}
+
+		page, err := ctl.QueryHostmap(q)
+		if err != nil {
+			writeControlAPIError(w, http.StatusBadRequest, err)
+			return
+		}
+		writeControlAPI(w, http.StatusOK, page)
+	})
+
+	handle("GET /v1/hosts/{vpnIp}", adminLevelRead, func(w http.ResponseWriter, r *http.Request) {
+		vpnIp, ok := controlAPIVpnIp(w, r)
+		if !ok {
+			return
+		}
+
+		h := ctl.GetHostInfoByVpnIp(vpnIp, r.URL.Query().Get("pending") == "true")
+		if h == nil {
+			writeControlAPIError(w, http.StatusNotFound, fmt.Errorf("could not find tunnel for vpn ip: %v", vpnIp))
+			return
+		}
+		writeControlAPI(w, http.StatusOK, h)
+	})
+
+	handle("DELETE /v1/hosts/{vpnIp}", adminLevelTunnel, func(w http.ResponseWriter, r *http.Request) {
+		vpnIp, ok := controlAPIVpnIp(w, r)
+		if !ok {
+			return
+		}
+
+		if !ctl.CloseTunnel(vpnIp, r.URL.Query().Get("local_only") == "true") {
+			writeControlAPIError(w, http.StatusNotFound, fmt.Errorf("could not find tunnel for vpn ip: %v", vpnIp))
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	handle("GET /v1/lighthouse/{vpnIp}", adminLevelRead, func(w http.ResponseWriter, r *http.Request) {
+		vpnIp, ok := controlAPIVpnIp(w, r)
+		if !ok {
+			return
+		}
+
+		info := ctl.GetLighthouseInfo(vpnIp)
+		if info == nil {
+			writeControlAPIError(w, http.StatusNotFound, fmt.Errorf("nothing is known about vpn ip: %v", vpnIp))
+			return
+		}
+		writeControlAPI(w, http.StatusOK, info)
+	})
+
+	handle("POST /v1/lighthouse/{vpnIp}/query", adminLevelTunnel, func(w http.ResponseWriter, r *http.Request) {
+		vpnIp, ok := controlAPIVpnIp(w, r)
+		if !ok {
+			return
+		}
+
+		cm := &CacheMap{}
+		if rl := ctl.f.lightHouse.Query(vpnIp); rl != nil {
+			cm = rl.CopyCache()
+		}
+		writeControlAPI(w, http.StatusOK, cm)
+	})
+
+	handle("GET /v1/cert", adminLevelRead, func(w http.ResponseWriter, r *http.Request) {
+		writeControlAPI(w, http.StatusOK, ctl.f.pki.GetCertState().Certificate)
+	})
+
+	handle("POST /v1/reload", adminLevelReload, func(w http.ResponseWriter, r *http.Request) {
+		if err := api.c.Reload(); err != nil {
+			writeControlAPIError(w, http.StatusInternalServerError, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	handle("POST /v1/config/check", adminLevelReload, func(w http.ResponseWriter, r *http.Request) {
+		b, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxControlAPIConfigSize))
+		if err != nil {
+			writeControlAPIError(w, http.StatusBadRequest, err)
+			return
+		}
+
+		candidate := config.NewC(api.l)
+		if err := yaml.Unmarshal(b, &candidate.Settings); err != nil {
+			writeControlAPIError(w, http.StatusBadRequest, fmt.Errorf("the config is not valid yaml: %s", err))
+			return
+		}
+		if len(candidate.Settings) == 0 {
+			writeControlAPIError(w, http.StatusBadRequest, errors.New("the config is empty"))
+			return
+		}
+		writeControlAPI(w, http.StatusOK, ctl.CheckConfig(candidate))
+	})
+
+	return mux
+}
+
+// hostmapQueryFromValues reads a HostmapQuery from the query parameters of r
+func hostmapQueryFromValues(r *http.Request) (HostmapQuery, error) {
+	v := r.URL.Query()
+	q := HostmapQuery{
+		State:   v.Get("state"),
+		ByIndex: v.Get("by_index") == "true",
+		Group:   v.Get("group"),
+		Name:    v.Get("name"),
+		Relay:   v.Get("relay"),
+		Sort:    v.Get("sort"),
+	}
+
+	var err error
+	if s := v.Get("offset"); s != "" {
+		if q.Offset, err = strconv.Atoi(s); err != nil {
+			return q, fmt.Errorf("offset is not a number: %s", s)
+		}
+	}
+	if s := v.Get("limit"); s != "" {
+		if q.Limit, err = strconv.Atoi(s); err != nil {
+			return q, fmt.Errorf("limit is not a number: %s", s)
+		}
+	}
+	return q, nil
+}
+
+// controlAPIVpnIp parses the vpnIp path value of r, a bad one has already been answered when ok is false
+func controlAPIVpnIp(w http.ResponseWriter, r *http.Request) (iputil.VpnIp, bool) {
+	raw := r.PathValue("vpnIp")
+	ip := net.ParseIP(raw)
+	if ip == nil {
+		writeControlAPIError(w, http.StatusBadRequest, fmt.Errorf("the provided vpn ip could not be parsed: %s", raw))
+		return iputil.VpnIp{}, false
+	}
+
+	vpnIp := iputil.Ip2VpnIp(ip)
+	if !vpnIp.IsValid() {
+		writeControlAPIError(w, http.StatusBadRequest, fmt.Errorf("the provided vpn ip could not be parsed: %s", raw))
+		return iputil.VpnIp{}, false
+	}
+	return vpnIp, true
+}
+
+// controlAPIStatusWriter remembers the status code of a response for the audit log
+type controlAPIStatusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *controlAPIStatusWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func writeControlAPI(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func writeControlAPIError(w http.ResponseWriter, status int, err error) {
+	writeControlAPI(w, status, map[string]string{"error": err.Error()})
+}
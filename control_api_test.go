@@ -0,0 +1,288 @@
+package nebula
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/slackhq/nebula/cert"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/controlapi"
+	"github.com/slackhq/nebula/iputil"
+	"github.com/slackhq/nebula/test"
+	"github.com/slackhq/nebula/udp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewControlAPIFromConfig(t *testing.T) {
+	l := test.NewLogger()
+	c := config.NewC(l)
+
+	api, err := newControlAPIFromConfig(l, c)
+	require.NoError(t, err)
+	assert.Nil(t, api)
+
+	c.Settings["control_api"] = map[interface{}]interface{}{"listen": "/tmp/nebula.sock"}
+	api, err = newControlAPIFromConfig(l, c)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), api.mode)
+
+	assert.Equal(t, adminLevelReload, api.defaultLevel)
+
+	c.Settings["control_api"] = map[interface{}]interface{}{"listen": "/tmp/nebula.sock", "mode": 01777}
+	_, err = newControlAPIFromConfig(l, c)
+	assert.EqualError(t, err, "control_api.mode must be a file mode between 0001 and 0777, got 1777")
+
+	// With tokens a request without one may do nothing, unless default_level says otherwise
+	require.NoError(t, c.LoadString(`
+control_api:
+  listen: /tmp/nebula.sock
+  tokens:
+    - name: monitoring
+      token: abc
+      level: read
+`))
+	api, err = newControlAPIFromConfig(l, c)
+	require.NoError(t, err)
+	assert.Equal(t, []controlAPIToken{{name: "monitoring", token: "abc", level: adminLevelRead}}, api.tokens)
+	assert.Equal(t, adminLevelNone, api.defaultLevel)
+
+	require.NoError(t, c.LoadString("control_api: {listen: /tmp/nebula.sock, tokens: [{name: a, token: b, level: read}], default_level: read}"))
+	api, err = newControlAPIFromConfig(l, c)
+	require.NoError(t, err)
+	assert.Equal(t, adminLevelRead, api.defaultLevel)
+
+	for raw, expected := range map[string]string{
+		"control_api: {listen: s, default_level: all}":                                                           "control_api.default_level: unknown level `all`. possible levels: [none read tunnel reload]",
+		"control_api: {listen: s, tokens: abc}":                                                                  "control_api.tokens must be a list, got string",
+		"control_api: {listen: s, tokens: [abc]}":                                                                "control_api.tokens[0] must be a map, got string",
+		"control_api: {listen: s, tokens: [{token: abc, level: read}]}":                                          "control_api.tokens[0].name must be provided",
+		"control_api: {listen: s, tokens: [{name: a, level: read}]}":                                             "control_api.tokens[0].token must be provided",
+		"control_api: {listen: s, tokens: [{name: a, token: abc}]}":                                              "control_api.tokens[0].level: unknown level `<nil>`. possible levels: [none read tunnel reload]",
+		"control_api: {listen: s, tokens: [{name: a, token: b, level: read}, {name: c, token: b, level: read}]}": "control_api.tokens[1].token is used by another token",
+	} {
+		require.NoError(t, c.LoadString(raw))
+		_, err = newControlAPIFromConfig(l, c)
+		assert.EqualError(t, err, expected, raw)
+	}
+}
+
+func TestControlAPI_Tokens(t *testing.T) {
+	l := test.NewLogger()
+	dir := t.TempDir()
+	sock := filepath.Join(dir, "nebula.sock")
+	auditPath := filepath.Join(dir, "audit.log")
+
+	c := config.NewC(l)
+	require.NoError(t, c.LoadString(`
+audit:
+  path: `+auditPath+`
+control_api:
+  listen: `+sock+`
+  tokens:
+    - name: monitoring
+      token: read-token
+      level: read
+    - name: orchestrator
+      token: tunnel-token
+      level: tunnel
+`))
+	api, err := newControlAPIFromConfig(l, c)
+	require.NoError(t, err)
+	audit, err := newAdminAuditFromConfig(l, c)
+	require.NoError(t, err)
+
+	established, _ := newQueryTestHostMap(t)
+	lh := newTestLighthouse()
+	f := &Interface{
+		hostMap:          established,
+		handshakeManager: NewHandshakeManager(l, established, lh, &udp.NoopConn{}, defaultHandshakeConfig),
+		lightHouse:       lh,
+		pki:              &PKI{},
+		l:                l,
+	}
+	f.pki.cs.Store(&CertState{Certificate: &cert.NebulaCertificate{Details: cert.NebulaCertificateDetails{Name: "me"}}})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	api.Start(ctx, &Control{f: f, l: l}, audit)
+
+	monitoring := controlapi.NewClientWithToken(sock, "read-token")
+	require.Eventually(t, func() bool {
+		_, err := monitoring.Cert(ctx)
+		return err == nil
+	}, time.Second, 10*time.Millisecond)
+
+	var apiErr *controlapi.Error
+	_, err = monitoring.CloseTunnel(ctx, net.IPv4(10, 0, 0, 5), true)
+	require.True(t, errors.As(err, &apiErr))
+	assert.Equal(t, http.StatusForbidden, apiErr.StatusCode)
+	assert.Equal(t, "permission denied: needs the tunnel level", apiErr.Message)
+
+	closed, err := controlapi.NewClientWithToken(sock, "tunnel-token").CloseTunnel(ctx, net.IPv4(10, 0, 0, 5), true)
+	require.NoError(t, err)
+	assert.True(t, closed)
+
+	_, err = controlapi.NewClient(sock).Cert(ctx)
+	require.True(t, errors.As(err, &apiErr))
+	assert.Equal(t, http.StatusForbidden, apiErr.StatusCode)
+	assert.Equal(t, "permission denied: needs the read level", apiErr.Message)
+
+	_, err = controlapi.NewClientWithToken(sock, "nope").Cert(ctx)
+	require.True(t, errors.As(err, &apiErr))
+	assert.Equal(t, http.StatusUnauthorized, apiErr.StatusCode)
+	assert.Equal(t, "unknown token", apiErr.Message)
+
+	_, err = monitoring.Host(ctx, net.IPv4(10, 0, 0, 99), false)
+	require.NoError(t, err)
+
+	var got []string
+	for _, e := range readTestAuditLog(t, auditPath) {
+		assert.Equal(t, "control_api", e.Interface)
+		got = append(got, fmt.Sprintf("%s %s %v %s %v", e.User, e.Action, e.Allowed, e.Error, e.Args))
+	}
+	assert.Equal(t, []string{
+		"monitoring GET /v1/cert true  []",
+		"monitoring DELETE /v1/hosts/10.0.0.5 false permission denied: needs the tunnel level [local_only=true]",
+		"orchestrator DELETE /v1/hosts/10.0.0.5 true  [local_only=true]",
+		"anonymous GET /v1/cert false permission denied: needs the read level []",
+		" GET /v1/cert false unknown token []",
+		"monitoring GET /v1/hosts/10.0.0.99 true Not Found []",
+	}, got)
+}
+
+func TestControlAPI(t *testing.T) {
+	l := test.NewLogger()
+	dir := t.TempDir()
+	sock := filepath.Join(dir, "nebula.sock")
+	confPath := filepath.Join(dir, "config.yml")
+	require.NoError(t, os.WriteFile(confPath, []byte("control_api:\n  listen: "+sock+"\n  mode: 0640\n"), 0600))
+
+	c := config.NewC(l)
+	require.NoError(t, c.Load(confPath))
+	api, err := newControlAPIFromConfig(l, c)
+	require.NoError(t, err)
+
+	established, _ := newQueryTestHostMap(t)
+	lh := newTestLighthouse()
+	f := &Interface{
+		hostMap:          established,
+		handshakeManager: NewHandshakeManager(l, established, lh, &udp.NoopConn{}, defaultHandshakeConfig),
+		lightHouse:       lh,
+		pki:              &PKI{},
+		l:                l,
+	}
+	f.pki.cs.Store(&CertState{Certificate: &cert.NebulaCertificate{
+		Details: cert.NebulaCertificateDetails{Name: "me", Groups: []string{"ops"}},
+	}})
+	f.restarts = newRestartTracker(l, c)
+
+	// A socket left behind by an earlier run is replaced
+	require.NoError(t, os.WriteFile(sock, nil, 0600))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	ctl := &Control{f: f, l: l}
+	api.Start(ctx, ctl, nil)
+
+	client := controlapi.NewClient(sock)
+	require.Eventually(t, func() bool {
+		_, err := client.Cert(ctx)
+		return err == nil
+	}, time.Second, 10*time.Millisecond)
+
+	fi, err := os.Stat(sock)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0640), fi.Mode().Perm())
+
+	// The socket was created in a private directory that is gone once it is moved into place
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+
+	page, err := client.Hostmap(ctx, controlapi.HostmapQuery{Group: "team:db", Limit: 2})
+	require.NoError(t, err)
+	assert.Equal(t, 10, page.Total)
+	require.Len(t, page.Hosts, 2)
+	assert.Equal(t, "10.0.0.2", page.Hosts[0].VpnIp.String())
+	assert.Equal(t, "host-19", page.Hosts[0].Cert.Details.Name)
+
+	_, err = client.Hostmap(ctx, controlapi.HostmapQuery{Sort: "nope"})
+	var apiErr *controlapi.Error
+	require.True(t, errors.As(err, &apiErr))
+	assert.Equal(t, http.StatusBadRequest, apiErr.StatusCode)
+	assert.Equal(t, `invalid sort "nope", must be vpnip, name, or index`, apiErr.Message)
+
+	h, err := client.Host(ctx, net.IPv4(10, 0, 0, 3), false)
+	require.NoError(t, err)
+	require.NotNil(t, h)
+	assert.Equal(t, uint32(997), h.LocalIndex)
+	assert.Equal(t, []string{"10.0.0.250"}, ipStrings(h.CurrentRelaysToMe))
+
+	h, err = client.Host(ctx, net.IPv4(10, 0, 0, 99), false)
+	require.NoError(t, err)
+	assert.Nil(t, h)
+
+	closed, err := client.CloseTunnel(ctx, net.IPv4(10, 0, 0, 5), true)
+	require.NoError(t, err)
+	assert.True(t, closed)
+	assert.Nil(t, established.QueryVpnIp(iputil.Ip2VpnIp(net.IPv4(10, 0, 0, 5))))
+
+	closed, err = client.CloseTunnel(ctx, net.IPv4(10, 0, 0, 5), true)
+	require.NoError(t, err)
+	assert.False(t, closed)
+
+	info, err := client.LighthouseInfo(ctx, net.IPv4(10, 0, 0, 1))
+	require.NoError(t, err)
+	assert.Nil(t, info)
+
+	crt, err := client.Cert(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, "me", crt.Details.Name)
+	assert.Equal(t, []string{"ops"}, crt.Details.Groups)
+
+	// Checking a config compares it to the running one without loading it
+	cc, err := client.CheckConfig(ctx, []byte("control_api:\n  listen: "+sock+"\n  mode: 0640\npunchy:\n  punch: true\nlisten:\n  batch: 32\n"))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"punchy.punch"}, cc.Reloadable)
+	assert.Equal(t, []string{"listen.batch"}, cc.RestartRequired)
+	assert.False(t, c.IsSet("punchy"))
+
+	_, err = client.CheckConfig(ctx, nil)
+	require.True(t, errors.As(err, &apiErr))
+	assert.Equal(t, http.StatusBadRequest, apiErr.StatusCode)
+	assert.Equal(t, "the config is empty", apiErr.Message)
+
+	// Reload reads the file again, a broken file keeps the old config and is reported
+	require.NoError(t, os.WriteFile(confPath, []byte("control_api:\n  listen: "+sock+"\n  mode: 0600\n"), 0600))
+	require.NoError(t, client.Reload(ctx))
+	assert.Equal(t, 0600, c.GetInt("control_api.mode", 0))
+	assert.Equal(t, []string{"control_api"}, ctl.PendingRestart())
+
+	require.NoError(t, os.WriteFile(confPath, []byte("control_api: [\n"), 0600))
+	err = client.Reload(ctx)
+	require.True(t, errors.As(err, &apiErr))
+	assert.Equal(t, http.StatusInternalServerError, apiErr.StatusCode)
+	assert.Equal(t, 0600, c.GetInt("control_api.mode", 0))
+
+	// Shutting down removes the socket
+	cancel()
+	assert.Eventually(t, func() bool {
+		_, err := os.Stat(sock)
+		return errors.Is(err, os.ErrNotExist)
+	}, time.Second, 10*time.Millisecond)
+}
+
+func ipStrings(ips []net.IP) []string {
+	var s []string
+	for _, ip := range ips {
+		s = append(s, ip.String())
+	}
+	return s
+}
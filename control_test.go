@@ -50,8 +50,8 @@ func TestControl_GetHostInfoByVpnIp(t *testing.T) {
 	}
 
 	remotes := NewRemoteList(nil)
-	remotes.unlockedPrependV4(0, NewIp4AndPort(remote1.IP, uint32(remote1.Port)))
-	remotes.unlockedPrependV6(0, NewIp6AndPort(remote2.IP, uint32(remote2.Port)))
+	remotes.unlockedPrependV4(iputil.VpnIpFrom4(0), NewIp4AndPort(remote1.IP, uint32(remote1.Port)))
+	remotes.unlockedPrependV6(iputil.VpnIpFrom4(0), NewIp6AndPort(remote2.IP, uint32(remote2.Port)))
 	hm.unlockedAddHostInfo(&HostInfo{
 		remote:  remote1,
 		remotes: remotes,
@@ -91,6 +91,7 @@ func TestControl_GetHostInfoByVpnIp(t *testing.T) {
 		l: logrus.New(),
 	}
 
+	hm.Hosts[iputil.Ip2VpnIp(ipNet.IP)].pmtu.Store(1400)
 	thi := c.GetHostInfoByVpnIp(iputil.Ip2VpnIp(ipNet.IP), false)
 
 	expectedInfo := ControlHostInfo{
@@ -103,10 +104,11 @@ func TestControl_GetHostInfoByVpnIp(t *testing.T) {
 		CurrentRemote:          udp.NewAddr(net.ParseIP("0.0.0.100"), 4444),
 		CurrentRelaysToMe:      []iputil.VpnIp{},
 		CurrentRelaysThroughMe: []iputil.VpnIp{},
+		PathMTU:                1400,
 	}
 
 	// Make sure we don't have any unexpected fields
-	assertFields(t, []string{"VpnIp", "LocalIndex", "RemoteIndex", "RemoteAddrs", "Cert", "MessageCounter", "CurrentRemote", "CurrentRelaysToMe", "CurrentRelaysThroughMe"}, thi)
+	assertFields(t, []string{"VpnIp", "LocalIndex", "RemoteIndex", "RemoteAddrs", "Cert", "MessageCounter", "CurrentRemote", "CurrentRelaysToMe", "CurrentRelaysThroughMe", "PathMTU"}, thi)
 	test.AssertDeepCopyEqual(t, &expectedInfo, thi)
 
 	// Make sure we don't panic if the host info doesn't have a cert yet
@@ -115,6 +117,16 @@ func TestControl_GetHostInfoByVpnIp(t *testing.T) {
 	})
 }
 
+func TestControl_UnsafeRoutes_Unsupported(t *testing.T) {
+	c := Control{f: &Interface{inside: &test.NoopTun{}}, l: test.NewLogger()}
+
+	_, err := c.ListUnsafeRoutes()
+	assert.EqualError(t, err, "the tun device does not support changing unsafe routes at runtime")
+
+	_, n, _ := net.ParseCIDR("1.0.0.0/24")
+	assert.EqualError(t, c.RemoveUnsafeRoutes([]*net.IPNet{n}), "the tun device does not support changing unsafe routes at runtime")
+}
+
 func assertFields(t *testing.T, expected []string, actualStruct interface{}) {
 	val := reflect.ValueOf(actualStruct).Elem()
 	fields := make([]string, val.NumField())
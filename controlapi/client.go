@@ -0,0 +1,204 @@
+// Package controlapi is a client for the local control api of a nebula node, enabled with control_api.listen. It only
+// depends on the standard library so orchestration tools can use it without building nebula itself.
+package controlapi
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+// Error is a failure reported by the control api
+type Error struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("control api: %s (%d)", e.Message, e.StatusCode)
+}
+
+// Client talks to the control api over its unix socket, it is safe for concurrent use
+type Client struct {
+	hc    *http.Client
+	token string
+}
+
+// NewClient returns a client for the control api listening on the unix socket at path
+func NewClient(path string) *Client {
+	return NewClientWithToken(path, "")
+}
+
+// NewClientWithToken returns a client that presents token, one of control_api.tokens, with every request
+func NewClientWithToken(path, token string) *Client {
+	return &Client{
+		token: token,
+		hc: &http.Client{
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					var d net.Dialer
+					return d.DialContext(ctx, "unix", path)
+				},
+			},
+		},
+	}
+}
+
+// Hostmap returns the page of the hostmap matching q
+func (c *Client) Hostmap(ctx context.Context, q HostmapQuery) (*HostmapPage, error) {
+	v := url.Values{}
+	set := func(k, s string) {
+		if s != "" {
+			v.Set(k, s)
+		}
+	}
+	set("state", q.State)
+	set("group", q.Group)
+	set("name", q.Name)
+	set("relay", q.Relay)
+	set("sort", q.Sort)
+	if q.ByIndex {
+		v.Set("by_index", "true")
+	}
+	if q.Offset != 0 {
+		v.Set("offset", strconv.Itoa(q.Offset))
+	}
+	if q.Limit != 0 {
+		v.Set("limit", strconv.Itoa(q.Limit))
+	}
+
+	var page HostmapPage
+	if err := c.do(ctx, http.MethodGet, "/v1/hostmap", v, &page); err != nil {
+		return nil, err
+	}
+	return &page, nil
+}
+
+// Host returns the tunnel for vpnIp, or the handshake in progress when pending is true. It is nil if there is none.
+func (c *Client) Host(ctx context.Context, vpnIp net.IP, pending bool) (*Host, error) {
+	v := url.Values{}
+	if pending {
+		v.Set("pending", "true")
+	}
+
+	var h Host
+	if err := c.do(ctx, http.MethodGet, "/v1/hosts/"+vpnIp.String(), v, &h); err != nil {
+		return nil, notFoundIsNil(err)
+	}
+	return &h, nil
+}
+
+// CloseTunnel closes the tunnel for vpnIp, if localOnly is false the remote is told as well. It returns false if there
+// was no tunnel.
+func (c *Client) CloseTunnel(ctx context.Context, vpnIp net.IP, localOnly bool) (bool, error) {
+	v := url.Values{}
+	if localOnly {
+		v.Set("local_only", "true")
+	}
+
+	if err := c.do(ctx, http.MethodDelete, "/v1/hosts/"+vpnIp.String(), v, nil); err != nil {
+		return false, notFoundIsNil(err)
+	}
+	return true, nil
+}
+
+// LighthouseInfo returns what the node knows about reaching vpnIp, it is nil if the node knows nothing
+func (c *Client) LighthouseInfo(ctx context.Context, vpnIp net.IP) (*LighthouseInfo, error) {
+	var info LighthouseInfo
+	if err := c.do(ctx, http.MethodGet, "/v1/lighthouse/"+vpnIp.String(), nil, &info); err != nil {
+		return nil, notFoundIsNil(err)
+	}
+	return &info, nil
+}
+
+// QueryLighthouse asks the lighthouses about vpnIp, the answer arrives later so only what is already cached is
+// returned, keyed by the vpn ip that reported the addresses
+func (c *Client) QueryLighthouse(ctx context.Context, vpnIp net.IP) (map[string]LighthouseCache, error) {
+	cm := map[string]LighthouseCache{}
+	if err := c.do(ctx, http.MethodPost, "/v1/lighthouse/"+vpnIp.String()+"/query", nil, &cm); err != nil {
+		return nil, err
+	}
+	return cm, nil
+}
+
+// Cert returns the certificate of the node
+func (c *Client) Cert(ctx context.Context) (*Cert, error) {
+	var crt Cert
+	if err := c.do(ctx, http.MethodGet, "/v1/cert", nil, &crt); err != nil {
+		return nil, err
+	}
+	return &crt, nil
+}
+
+// Reload makes the node reload its config from disk, an error means the node kept its previous config
+func (c *Client) Reload(ctx context.Context) error {
+	return c.do(ctx, http.MethodPost, "/v1/reload", nil, nil)
+}
+
+// CheckConfig returns what would change if the node loaded the yaml config instead of the one it runs, the config is
+// not loaded. Its includes and environment variables must already be expanded, as nebula -test prints it.
+func (c *Client) CheckConfig(ctx context.Context, config []byte) (*ConfigCheck, error) {
+	var cc ConfigCheck
+	if err := c.doBody(ctx, http.MethodPost, "/v1/config/check", nil, bytes.NewReader(config), &cc); err != nil {
+		return nil, err
+	}
+	return &cc, nil
+}
+
+// do makes a request and decodes the json response into out, if out is not nil
+func (c *Client) do(ctx context.Context, method, path string, v url.Values, out interface{}) error {
+	return c.doBody(ctx, method, path, v, nil, out)
+}
+
+// doBody is do with a request body
+func (c *Client) doBody(ctx context.Context, method, path string, v url.Values, body io.Reader, out interface{}) error {
+	u := url.URL{Scheme: "http", Host: "nebula", Path: path, RawQuery: v.Encode()}
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), body)
+	if err != nil {
+		return err
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+
+	res, err := c.hc.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode >= 300 {
+		apiErr := &Error{StatusCode: res.StatusCode}
+		var body struct {
+			Error string `json:"error"`
+		}
+		if err := json.NewDecoder(res.Body).Decode(&body); err == nil {
+			apiErr.Message = body.Error
+		} else {
+			apiErr.Message = res.Status
+		}
+		return apiErr
+	}
+
+	if out == nil {
+		_, err = io.Copy(io.Discard, res.Body)
+		return err
+	}
+	return json.NewDecoder(res.Body).Decode(out)
+}
+
+// notFoundIsNil drops the error for a missing host, the callers return nil for those
+func notFoundIsNil(err error) error {
+	var apiErr *Error
+	if errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusNotFound {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,139 @@
+package controlapi
+
+import (
+	"net"
+	"strconv"
+	"time"
+)
+
+// HostmapQuery filters, sorts and pages the hostmap, the zero value lists every established tunnel
+type HostmapQuery struct {
+	// State is established (the default), handshaking, or all
+	State string
+	// ByIndex lists every hostinfo by local index instead of only the primary hostinfo for each vpn ip
+	ByIndex bool
+	// Group only lists hosts with a certificate in this group
+	Group string
+	// Name only lists hosts with a certificate name matching this glob, see path.Match
+	Name string
+	// Relay is direct, relayed, or relaying, empty lists all
+	Relay string
+	// Sort is vpnip (the default), name, or index
+	Sort string
+	// Offset skips this many matching hosts
+	Offset int
+	// Limit is the most hosts to return, 0 for no limit
+	Limit int
+}
+
+// HostmapPage is a page of hosts matching a HostmapQuery
+type HostmapPage struct {
+	Hosts []Host `json:"hosts"`
+	// Total is the number of hosts that matched before paging
+	Total  int `json:"total"`
+	Offset int `json:"offset"`
+}
+
+// Addr is an underlay address
+type Addr struct {
+	IP   net.IP `json:"ip"`
+	Port uint16 `json:"port"`
+}
+
+func (a Addr) String() string {
+	return net.JoinHostPort(a.IP.String(), strconv.Itoa(int(a.Port)))
+}
+
+// Host is a tunnel, or a handshake in progress
+type Host struct {
+	VpnIp                  net.IP   `json:"vpnIp"`
+	LocalIndex             uint32   `json:"localIndex"`
+	RemoteIndex            uint32   `json:"remoteIndex"`
+	RemoteAddrs            []*Addr  `json:"remoteAddrs"`
+	Cert                   *Cert    `json:"cert"`
+	MessageCounter         uint64   `json:"messageCounter"`
+	CurrentRemote          *Addr    `json:"currentRemote"`
+	CurrentRelaysToMe      []net.IP `json:"currentRelaysToMe"`
+	CurrentRelaysThroughMe []net.IP `json:"currentRelaysThroughMe"`
+	// PathMTU is the largest inner packet the path carries, 0 if pmtud has not probed it
+	PathMTU int `json:"pathMtu"`
+}
+
+// Cert is a nebula certificate
+type Cert struct {
+	Details        CertDetails     `json:"details"`
+	Fingerprint    string          `json:"fingerprint"`
+	Signature      string          `json:"signature"`
+	InclusionProof *InclusionProof `json:"inclusionProof,omitempty"`
+}
+
+type CertDetails struct {
+	Name      string    `json:"name"`
+	Ips       []string  `json:"ips"`
+	Subnets   []string  `json:"subnets"`
+	Groups    []string  `json:"groups"`
+	NotBefore time.Time `json:"notBefore"`
+	NotAfter  time.Time `json:"notAfter"`
+	PublicKey string    `json:"publicKey"`
+	IsCA      bool      `json:"isCa"`
+	Issuer    string    `json:"issuer"`
+	Curve     string    `json:"curve"`
+	Hash      string    `json:"hash"`
+}
+
+// InclusionProof shows the certificate was logged to a transparency log
+type InclusionProof struct {
+	LogID     string    `json:"logId"`
+	LeafIndex uint64    `json:"leafIndex"`
+	TreeSize  uint64    `json:"treeSize"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// LighthouseInfo is everything the node knows about reaching a vpn ip
+type LighthouseInfo struct {
+	VpnIp net.IP `json:"vpnIp"`
+	// Static is set when the vpn ip has a static_host_map entry
+	Static bool `json:"static"`
+	// Addrs are the deduplicated addresses a handshake tries, in order
+	Addrs []*Addr `json:"addrs"`
+	// BlockedAddrs answered a handshake as a different vpn ip and are skipped
+	BlockedAddrs []*Addr `json:"blockedAddrs"`
+	// Relays are the relays that can reach the vpn ip
+	Relays []LighthouseRelay `json:"relays"`
+	// Sources is what each owner told the node, sorted by owner
+	Sources []LighthouseSource `json:"sources"`
+}
+
+type LighthouseRelay struct {
+	VpnIp net.IP `json:"vpnIp"`
+	// Tunnel is set when the node has a tunnel to the relay
+	Tunnel bool `json:"tunnel"`
+}
+
+// LighthouseSource is what one owner told the node about a vpn ip
+type LighthouseSource struct {
+	Owner net.IP `json:"owner"`
+	// Kind is static, host, lighthouse, sync or other
+	Kind    string    `json:"kind"`
+	Updated time.Time `json:"updated"`
+	// Stale is set when a lighthouse said the vpn ip had not updated it in a while
+	Stale    bool     `json:"stale"`
+	Learned  []*Addr  `json:"learned"`
+	Reported []*Addr  `json:"reported"`
+	Relays   []net.IP `json:"relays"`
+}
+
+// LighthouseCache is what one owner reported about a vpn ip in a lighthouse query
+type LighthouseCache struct {
+	Learned  []*Addr  `json:"learned"`
+	Reported []*Addr  `json:"reported"`
+	Relay    []net.IP `json:"relay"`
+}
+
+// ConfigCheck is what would change if a node loaded a candidate config instead of the one it runs
+type ConfigCheck struct {
+	// Reloadable are the changed settings a reload applies
+	Reloadable []string `json:"reloadable"`
+	// RestartRequired are the settings that differ from what the node started with and only apply after a restart
+	RestartRequired []string `json:"restart_required"`
+}
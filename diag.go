@@ -0,0 +1,373 @@
+package nebula
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/slackhq/nebula/header"
+)
+
+// capabilityDiagProbe is advertised by every node that answers diag probes
+const capabilityDiagProbe = "diag_probe"
+
+const (
+	// diagRequestLen is the probe id and send time at the front of every diag request, the rest is padding
+	diagRequestLen = 12
+	// diagReplyMinLen is the fixed portion of a diag reply, the version, capabilities and relay load follow
+	diagReplyMinLen = 24
+	// diagOverhead is what nebula adds to a probe payload on the underlay, the header and the aead tag
+	diagOverhead = header.Len + 16
+	// diagMaxPayload is the largest probe we can fit in an out buffer, leaving room for a relay
+	diagMaxPayload = mtu - 2*diagOverhead
+)
+
+var ErrDiagTimeout = errors.New("timed out waiting for a diag probe reply")
+
+// diagReply is what a peer sends back for a diag request
+type diagReply struct {
+	id uint32
+	// sent is our send time echoed back, peerTime is the peers clock when the request arrived
+	sent     time.Time
+	peerTime time.Time
+	// size is the payload length the peer received
+	size         int
+	version      string
+	capabilities capabilitySet
+	// relayLoad is how many relay indexes the peer has in use, -1 if it is too old to say
+	relayLoad int
+	// received is our clock when the reply arrived, it is not on the wire
+	received time.Time
+}
+
+func marshalDiagRequest(id uint32, sent time.Time, size int) []byte {
+	if size < diagRequestLen {
+		size = diagRequestLen
+	}
+
+	b := make([]byte, size)
+	binary.BigEndian.PutUint32(b[0:4], id)
+	binary.BigEndian.PutUint64(b[4:12], uint64(sent.UnixNano()))
+	return b
+}
+
+func unmarshalDiagRequest(b []byte) (uint32, time.Time, error) {
+	if len(b) < diagRequestLen {
+		return 0, time.Time{}, fmt.Errorf("diag request too short: %d", len(b))
+	}
+
+	return binary.BigEndian.Uint32(b[0:4]), time.Unix(0, int64(binary.BigEndian.Uint64(b[4:12]))), nil
+}
+
+func marshalDiagReply(r *diagReply) []byte {
+	b := make([]byte, diagReplyMinLen, diagReplyMinLen+1+len(r.version)+1)
+	binary.BigEndian.PutUint32(b[0:4], r.id)
+	binary.BigEndian.PutUint64(b[4:12], uint64(r.sent.UnixNano()))
+	binary.BigEndian.PutUint64(b[12:20], uint64(r.peerTime.UnixNano()))
+	binary.BigEndian.PutUint32(b[20:24], uint32(r.size))
+
+	appendString := func(s string) {
+		if len(s) > 255 {
+			s = s[:255]
+		}
+		b = append(b, byte(len(s)))
+		b = append(b, s...)
+	}
+
+	appendString(r.version)
+
+	caps := r.capabilities
+	if len(caps) > 255 {
+		caps = caps[:255]
+	}
+	b = append(b, byte(len(caps)))
+	for _, c := range caps {
+		appendString(c)
+	}
+
+	return binary.BigEndian.AppendUint32(b, uint32(max(r.relayLoad, 0)))
+}
+
+func unmarshalDiagReply(b []byte) (*diagReply, error) {
+	if len(b) < diagReplyMinLen {
+		return nil, fmt.Errorf("diag reply too short: %d", len(b))
+	}
+
+	r := &diagReply{
+		id:       binary.BigEndian.Uint32(b[0:4]),
+		sent:     time.Unix(0, int64(binary.BigEndian.Uint64(b[4:12]))),
+		peerTime: time.Unix(0, int64(binary.BigEndian.Uint64(b[12:20]))),
+		size:     int(binary.BigEndian.Uint32(b[20:24])),
+	}
+
+	b = b[diagReplyMinLen:]
+	readString := func() (string, error) {
+		if len(b) < 1 || len(b) < 1+int(b[0]) {
+			return "", errors.New("diag reply truncated")
+		}
+		s := string(b[1 : 1+int(b[0])])
+		b = b[1+int(b[0]):]
+		return s, nil
+	}
+
+	var err error
+	if r.version, err = readString(); err != nil {
+		return nil, err
+	}
+
+	if len(b) < 1 {
+		return nil, errors.New("diag reply truncated")
+	}
+	n := int(b[0])
+	b = b[1:]
+
+	caps := make([]string, n)
+	for i := range caps {
+		if caps[i], err = readString(); err != nil {
+			return nil, err
+		}
+	}
+	r.capabilities = newCapabilitySet(caps...)
+
+	// Older nodes end the reply at their capabilities
+	switch {
+	case len(b) == 0:
+		r.relayLoad = -1
+	case len(b) < 4:
+		return nil, errors.New("diag reply truncated")
+	default:
+		r.relayLoad = int(binary.BigEndian.Uint32(b[0:4]))
+	}
+
+	return r, nil
+}
+
+// diagProbeKey is a probe waiting on a reply, the id alone is not enough since any peer can echo any id back
+type diagProbeKey struct {
+	hostinfo *HostInfo
+	id       uint32
+}
+
+// diagProber matches diag replies with the probes waiting on them
+type diagProber struct {
+	sync.Mutex
+	nextId  uint32
+	pending map[diagProbeKey]chan *diagReply
+}
+
+func newDiagProber() *diagProber {
+	return &diagProber{pending: map[diagProbeKey]chan *diagReply{}}
+}
+
+// register reserves a probe id for a probe to hostinfo, the reply will be delivered on the returned channel
+func (p *diagProber) register(hostinfo *HostInfo) (diagProbeKey, chan *diagReply) {
+	p.Lock()
+	defer p.Unlock()
+	p.nextId++
+	k := diagProbeKey{hostinfo: hostinfo, id: p.nextId}
+	ch := make(chan *diagReply, 1)
+	p.pending[k] = ch
+	return k, ch
+}
+
+func (p *diagProber) cancel(k diagProbeKey) {
+	p.Lock()
+	delete(p.pending, k)
+	p.Unlock()
+}
+
+// deliver hands a reply from hostinfo to its waiting probe, replies nobody is waiting on are dropped
+func (p *diagProber) deliver(hostinfo *HostInfo, r *diagReply) {
+	k := diagProbeKey{hostinfo: hostinfo, id: r.id}
+	p.Lock()
+	ch, ok := p.pending[k]
+	delete(p.pending, k)
+	p.Unlock()
+
+	if ok {
+		ch <- r
+	}
+}
+
+// handleDiagRequest answers a diag request from an established tunnel, the reply is small so only the path towards us
+// is measured by the request size
+func (f *Interface) handleDiagRequest(hostinfo *HostInfo, ci *ConnectionState, d, nb, out []byte) {
+	id, sent, err := unmarshalDiagRequest(d)
+	if err != nil {
+		hostinfo.logger(f.l).WithError(err).Debug("Failed to unmarshal diag request")
+		return
+	}
+
+	reply := marshalDiagReply(&diagReply{
+		id:           id,
+		sent:         sent,
+		peerTime:     time.Now(),
+		size:         len(d),
+		version:      f.version,
+		capabilities: f.handshakeCapabilities,
+		relayLoad:    f.hostMap.relayIndexCount(),
+	})
+
+	f.send(header.Test, header.TestDiagReply, ci, hostinfo, reply, nb, out)
+}
+
+func (f *Interface) handleDiagReply(hostinfo *HostInfo, d []byte) {
+	r, err := unmarshalDiagReply(d)
+	if err != nil {
+		hostinfo.logger(f.l).WithError(err).Debug("Failed to unmarshal diag reply")
+		return
+	}
+
+	r.received = time.Now()
+	f.diag.deliver(hostinfo, r)
+}
+
+// sendDiagProbe sends a single probe with a payload of size bytes and waits for the reply
+func (f *Interface) sendDiagProbe(hostinfo *HostInfo, size int, timeout time.Duration) (*diagReply, error) {
+	k, ch := f.diag.register(hostinfo)
+	defer f.diag.cancel(k)
+
+	p := marshalDiagRequest(k.id, time.Now(), size)
+	f.send(header.Test, header.TestDiagRequest, hostinfo.ConnectionState, hostinfo, p, make([]byte, 12, 12), make([]byte, mtu))
+
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+
+	select {
+	case r := <-ch:
+		return r, nil
+	case <-t.C:
+		return nil, ErrDiagTimeout
+	}
+}
+
+// DiagOptions tune a diagnostic run against a peer
+type DiagOptions struct {
+	// MaxSize is the largest probe payload to try, 0 or anything above what fits in a packet buffer uses the largest
+	// that fits
+	MaxSize int
+	// Timeout is how long to wait for each probe reply, 0 uses one second
+	Timeout time.Duration
+	// Tries is how many probes of a size must go unanswered before the size is considered too large, 0 uses 2
+	Tries int
+	// SkipPathMTU only sends the smallest probe. A larger probe says nothing about the path when the underlay may
+	// fragment it, only pmtud stops that.
+	SkipPathMTU bool
+}
+
+// DiagReport is the result of probing a peer with diag messages
+type DiagReport struct {
+	PeerVersion            string   `json:"peerVersion"`
+	PeerCapabilities       []string `json:"peerCapabilities"`
+	LocalCapabilities      []string `json:"localCapabilities"`
+	NegotiatedCapabilities []string `json:"negotiatedCapabilities"`
+	// Rtt is the fastest round trip seen across all probes
+	Rtt time.Duration `json:"rtt"`
+	// ClockOffset estimates how far the peers clock is ahead of ours, negative if it is behind
+	ClockOffset time.Duration `json:"clockOffset"`
+	// MaxPayload is the largest probe payload that got a reply, tun.mtu on this node should be no larger. It is 0 if
+	// the path mtu was not probed.
+	MaxPayload int `json:"maxPayload"`
+	// MaxProbed is the largest payload that was tried, 0 if the path mtu was not probed
+	MaxProbed int `json:"maxProbed"`
+	// Probes is the number of probes sent
+	Probes int `json:"probes"`
+}
+
+// runDiag finds the largest probe that gets through with a binary search and fills in a report from the replies
+func runDiag(probe func(size int) (*diagReply, error), o DiagOptions) (*DiagReport, error) {
+	if o.MaxSize <= 0 || o.MaxSize > diagMaxPayload {
+		o.MaxSize = diagMaxPayload
+	}
+	if o.MaxSize < diagRequestLen {
+		o.MaxSize = diagRequestLen
+	}
+	if o.Tries <= 0 {
+		o.Tries = 2
+	}
+
+	rep := &DiagReport{}
+	try := func(size int) (bool, error) {
+		for i := 0; i < o.Tries; i++ {
+			rep.Probes++
+			r, err := probe(size)
+			if errors.Is(err, ErrDiagTimeout) {
+				continue
+			} else if err != nil {
+				return false, err
+			}
+
+			rtt := r.received.Sub(r.sent)
+			if rep.Rtt == 0 || rtt < rep.Rtt {
+				// Assume the request and reply took as long as each other, the fastest probe has the least jitter
+				rep.Rtt = rtt
+				rep.ClockOffset = r.peerTime.Sub(r.sent.Add(rtt / 2))
+			}
+			rep.PeerVersion = r.version
+			rep.PeerCapabilities = r.capabilities
+			return true, nil
+		}
+		return false, nil
+	}
+
+	ok, err := try(diagRequestLen)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, ErrDiagTimeout
+	}
+	if o.SkipPathMTU {
+		return rep, nil
+	}
+
+	rep.MaxProbed = o.MaxSize
+	lo, hi := diagRequestLen, o.MaxSize
+	if ok, err = try(hi); err != nil {
+		return nil, err
+	} else if ok {
+		lo = hi
+	}
+
+	// lo always got a reply, hi never did
+	for hi-lo > 1 {
+		mid := lo + (hi-lo)/2
+		ok, err = try(mid)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			lo = mid
+		} else {
+			hi = mid
+		}
+	}
+
+	rep.MaxPayload = lo
+	return rep, nil
+}
+
+// diagnose probes an established tunnel to report the effective path mtu, the peers version and capabilities, and how
+// far apart our clocks are. Peers without diag_probe support never reply and ErrDiagTimeout is returned. The path mtu
+// is only probed with pmtud enabled, otherwise the underlay sockets may fragment the probes.
+func (f *Interface) diagnose(hostinfo *HostInfo, o DiagOptions) (*DiagReport, error) {
+	if o.Timeout <= 0 {
+		o.Timeout = time.Second
+	}
+	if f.pmtud == nil {
+		o.SkipPathMTU = true
+	}
+
+	rep, err := runDiag(func(size int) (*diagReply, error) {
+		return f.sendDiagProbe(hostinfo, size, o.Timeout)
+	}, o)
+	if err != nil {
+		return nil, err
+	}
+
+	rep.LocalCapabilities = append([]string{}, f.handshakeCapabilities...)
+	rep.NegotiatedCapabilities = append([]string{}, hostinfo.ConnectionState.capabilities...)
+	return rep, nil
+}
@@ -0,0 +1,189 @@
+package nebula
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDiagRequest_marshal(t *testing.T) {
+	now := time.Unix(1700000000, 123456789)
+	b := marshalDiagRequest(7, now, 100)
+	assert.Len(t, b, 100)
+
+	id, sent, err := unmarshalDiagRequest(b)
+	require.NoError(t, err)
+	assert.Equal(t, uint32(7), id)
+	assert.True(t, now.Equal(sent))
+
+	// Anything smaller than the fixed portion is padded up
+	assert.Len(t, marshalDiagRequest(7, now, 1), diagRequestLen)
+
+	_, _, err = unmarshalDiagRequest(b[:diagRequestLen-1])
+	assert.EqualError(t, err, "diag request too short: 11")
+}
+
+func TestDiagReply_marshal(t *testing.T) {
+	r := &diagReply{
+		id:           9,
+		sent:         time.Unix(1700000000, 1),
+		peerTime:     time.Unix(1700000001, 2),
+		size:         1300,
+		version:      "1.9.0",
+		capabilities: newCapabilitySet("transcript_binding", "diag_probe"),
+		relayLoad:    7,
+	}
+
+	b := marshalDiagReply(r)
+	out, err := unmarshalDiagReply(b)
+	require.NoError(t, err)
+	assert.Equal(t, r.id, out.id)
+	assert.True(t, r.sent.Equal(out.sent))
+	assert.True(t, r.peerTime.Equal(out.peerTime))
+	assert.Equal(t, r.size, out.size)
+	assert.Equal(t, r.version, out.version)
+	assert.Equal(t, r.capabilities, out.capabilities)
+	assert.Equal(t, r.relayLoad, out.relayLoad)
+
+	// An empty version and no capabilities still round trips
+	out, err = unmarshalDiagReply(marshalDiagReply(&diagReply{id: 1}))
+	require.NoError(t, err)
+	assert.Equal(t, "", out.version)
+	assert.Empty(t, out.capabilities)
+
+	// Older nodes do not send a relay load
+	noLoad := len(b) - 4
+	out, err = unmarshalDiagReply(b[:noLoad])
+	require.NoError(t, err)
+	assert.Equal(t, r.capabilities, out.capabilities)
+	assert.Equal(t, -1, out.relayLoad)
+
+	for i := diagReplyMinLen; i < len(b); i++ {
+		if i == noLoad {
+			continue
+		}
+		_, err = unmarshalDiagReply(b[:i])
+		assert.EqualError(t, err, "diag reply truncated", "length %d", i)
+	}
+
+	_, err = unmarshalDiagReply(b[:diagReplyMinLen-1])
+	assert.EqualError(t, err, "diag reply too short: 23")
+}
+
+func TestDiagProber(t *testing.T) {
+	p := newDiagProber()
+
+	h1, h2 := &HostInfo{}, &HostInfo{}
+	k1, ch1 := p.register(h1)
+	k2, ch2 := p.register(h2)
+	assert.NotEqual(t, k1.id, k2.id)
+
+	// A reply from another tunnel does not answer the probe
+	p.deliver(h1, &diagReply{id: k2.id})
+	assert.Empty(t, ch2)
+
+	p.deliver(h2, &diagReply{id: k2.id, version: "b"})
+	assert.Equal(t, "b", (<-ch2).version)
+
+	// A second reply for the same probe, or one for a cancelled probe, is dropped
+	p.deliver(h2, &diagReply{id: k2.id})
+	p.cancel(k1)
+	p.deliver(h1, &diagReply{id: k1.id})
+	assert.Empty(t, ch1)
+	assert.Empty(t, ch2)
+	assert.Empty(t, p.pending)
+}
+
+func TestRunDiag(t *testing.T) {
+	base := time.Unix(1700000000, 0)
+	sizes := []int{}
+	probe := func(limit int) func(size int) (*diagReply, error) {
+		return func(size int) (*diagReply, error) {
+			sizes = append(sizes, size)
+			if size > limit {
+				return nil, ErrDiagTimeout
+			}
+
+			rtt := 10 * time.Millisecond
+			if size == diagRequestLen {
+				// The first probe is the fastest and should be used for the clock offset
+				rtt = 4 * time.Millisecond
+			}
+
+			return &diagReply{
+				sent:         base,
+				received:     base.Add(rtt),
+				peerTime:     base.Add(rtt/2 + time.Second),
+				size:         size,
+				version:      "1.9.0",
+				capabilities: newCapabilitySet(capabilityDiagProbe),
+			}, nil
+		}
+	}
+
+	rep, err := runDiag(probe(1300), DiagOptions{MaxSize: 1500, Tries: 1})
+	require.NoError(t, err)
+	assert.Equal(t, 1300, rep.MaxPayload)
+	assert.Equal(t, 1500, rep.MaxProbed)
+	assert.Equal(t, 4*time.Millisecond, rep.Rtt)
+	assert.Equal(t, time.Second, rep.ClockOffset)
+	assert.Equal(t, "1.9.0", rep.PeerVersion)
+	assert.Equal(t, []string{capabilityDiagProbe}, rep.PeerCapabilities)
+	assert.Equal(t, len(sizes), rep.Probes)
+	assert.Equal(t, []int{diagRequestLen, 1500}, sizes[:2])
+
+	// Every size gets through
+	sizes = sizes[:0]
+	rep, err = runDiag(probe(diagMaxPayload), DiagOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, diagMaxPayload, rep.MaxPayload)
+	assert.Equal(t, []int{diagRequestLen, diagMaxPayload}, sizes)
+
+	// Only the smallest probe when the path mtu is not probed
+	sizes = sizes[:0]
+	rep, err = runDiag(probe(diagMaxPayload), DiagOptions{SkipPathMTU: true})
+	require.NoError(t, err)
+	assert.Zero(t, rep.MaxPayload)
+	assert.Zero(t, rep.MaxProbed)
+	assert.Equal(t, 4*time.Millisecond, rep.Rtt)
+	assert.Equal(t, []int{diagRequestLen}, sizes)
+
+	// Failed sizes are retried
+	sizes = sizes[:0]
+	_, err = runDiag(probe(0), DiagOptions{Tries: 3})
+	assert.ErrorIs(t, err, ErrDiagTimeout)
+	assert.Equal(t, []int{diagRequestLen, diagRequestLen, diagRequestLen}, sizes)
+}
+
+func TestWriteDiagReport(t *testing.T) {
+	rep := &DiagReport{
+		PeerVersion:            "1.9.0",
+		PeerCapabilities:       []string{"diag_probe", "transcript_binding"},
+		LocalCapabilities:      []string{"diag_probe", "transcript_binding"},
+		NegotiatedCapabilities: []string{"diag_probe", "transcript_binding"},
+		Rtt:                    4 * time.Millisecond,
+		ClockOffset:            -time.Second,
+		MaxPayload:             1300,
+		MaxProbed:              1500,
+		Probes:                 12,
+	}
+
+	w := &testStringWriter{}
+	require.NoError(t, writeDiagReport(rep, &sshDiagFlags{}, w))
+	assert.Equal(t, `peer version: 1.9.0
+peer capabilities: diag_probe, transcript_binding
+local capabilities: diag_probe, transcript_binding
+negotiated capabilities: diag_probe, transcript_binding
+rtt: 4ms
+clock offset: -1s
+max payload: 1300 bytes (1332 byte udp payload), tun.mtu should be at most 1300
+probes sent: 12
+`, w.String())
+
+	rep.MaxPayload, rep.MaxProbed, rep.Probes = 0, 0, 1
+	w = &testStringWriter{}
+	require.NoError(t, writeDiagReport(rep, &sshDiagFlags{}, w))
+	assert.Contains(t, w.String(), "max payload: not probed, the underlay may fragment probes unless pmtud is enabled\nprobes sent: 1\n")
+}
@@ -0,0 +1,159 @@
+package nebula
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/slackhq/nebula/cert"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/iputil"
+)
+
+// dnsACLRule lets hosts with a certificate in any of groups query the dns listener and see the hosts in any of visible
+type dnsACLRule struct {
+	groups []string
+	// visible is nil when the rule sees every host
+	visible map[string]struct{}
+}
+
+// dnsView is the hosts a dns client may see, a nil view sees every host
+type dnsView struct {
+	groups map[string]struct{}
+}
+
+// sees reports if a host with the certificate nc is visible, hosts without a certificate are only visible to a nil view
+func (v *dnsView) sees(nc *cert.NebulaCertificate) bool {
+	if v == nil {
+		return true
+	}
+	if nc == nil {
+		return false
+	}
+
+	for _, g := range nc.Details.Groups {
+		if _, ok := v.groups[g]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// newDnsACLFromConfig reads lighthouse.dns.acl, an empty acl lets anyone query and see everything
+func newDnsACLFromConfig(c *config.C) ([]dnsACLRule, error) {
+	raw := c.Get("lighthouse.dns.acl")
+	if raw == nil {
+		return nil, nil
+	}
+
+	rawRules, ok := raw.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("lighthouse.dns.acl must be a list, got %T", raw)
+	}
+
+	var acl []dnsACLRule
+	for i, rr := range rawRules {
+		m, ok := rr.(map[interface{}]interface{})
+		if !ok {
+			return nil, fmt.Errorf("lighthouse.dns.acl[%d] must be a map, got %T", i, rr)
+		}
+
+		groups, err := dnsACLGroups(m["groups"])
+		if err != nil || len(groups) == 0 {
+			return nil, fmt.Errorf("lighthouse.dns.acl[%d].groups must be a list of groups", i)
+		}
+
+		rule := dnsACLRule{groups: groups}
+		if rv, ok := m["visible"]; ok {
+			visible, err := dnsACLGroups(rv)
+			if err != nil {
+				return nil, fmt.Errorf("lighthouse.dns.acl[%d].visible must be a list of groups", i)
+			}
+
+			rule.visible = map[string]struct{}{}
+			for _, g := range visible {
+				if g == "*" {
+					rule.visible = nil
+					break
+				}
+				rule.visible[g] = struct{}{}
+			}
+		}
+
+		acl = append(acl, rule)
+	}
+
+	return acl, nil
+}
+
+func dnsACLGroups(raw interface{}) ([]string, error) {
+	rgs, ok := raw.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("expected a list, got %T", raw)
+	}
+
+	groups := make([]string, 0, len(rgs))
+	for _, rg := range rgs {
+		g, ok := rg.(string)
+		if !ok || g == "" {
+			return nil, fmt.Errorf("invalid group %v", rg)
+		}
+		groups = append(groups, g)
+	}
+	return groups, nil
+}
+
+// viewFor returns what the dns client at ip may see, false if it may not query at all. Clients are identified by the
+// certificate of their tunnel, localhost sees everything.
+func (d *dnsRecords) viewFor(ip net.IP) (*dnsView, bool) {
+	d.RLock()
+	acl := d.acl
+	d.RUnlock()
+
+	if len(acl) == 0 || ip.IsLoopback() {
+		return nil, true
+	}
+
+	if !d.hostMap.vpnCIDR.Contains(ip) {
+		return nil, false
+	}
+
+	hostinfo := d.hostMap.QueryVpnIp(iputil.Ip2VpnIp(ip))
+	if hostinfo == nil {
+		return nil, false
+	}
+	nc := hostinfo.GetCert()
+	if nc == nil {
+		return nil, false
+	}
+
+	has := make(map[string]struct{}, len(nc.Details.Groups))
+	for _, g := range nc.Details.Groups {
+		has[g] = struct{}{}
+	}
+
+	allowed := false
+	view := &dnsView{groups: map[string]struct{}{}}
+	for _, rule := range acl {
+		matched := false
+		for _, g := range rule.groups {
+			if _, ok := has[g]; ok {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			continue
+		}
+
+		if rule.visible == nil {
+			return nil, true
+		}
+
+		allowed = true
+		for g := range rule.visible {
+			view.groups[g] = struct{}{}
+		}
+	}
+
+	return view, allowed
+}
@@ -0,0 +1,177 @@
+package nebula
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/slackhq/nebula/cert"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/iputil"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewDnsACLFromConfig(t *testing.T) {
+	c := config.NewC(nil)
+	acl, err := newDnsACLFromConfig(c)
+	require.NoError(t, err)
+	assert.Nil(t, acl)
+
+	c.Settings["lighthouse"] = map[interface{}]interface{}{
+		"dns": map[interface{}]interface{}{
+			"acl": []interface{}{
+				map[interface{}]interface{}{"groups": []interface{}{"ops"}},
+				map[interface{}]interface{}{"groups": []interface{}{"admin"}, "visible": []interface{}{"ops", "*"}},
+				map[interface{}]interface{}{"groups": []interface{}{"dev", "qa"}, "visible": []interface{}{"dev", "shared"}},
+			},
+		},
+	}
+	acl, err = newDnsACLFromConfig(c)
+	require.NoError(t, err)
+	assert.Equal(t, []dnsACLRule{
+		{groups: []string{"ops"}},
+		{groups: []string{"admin"}},
+		{groups: []string{"dev", "qa"}, visible: map[string]struct{}{"dev": {}, "shared": {}}},
+	}, acl)
+
+	expectErr := func(acl interface{}, msg string) {
+		c.Settings["lighthouse"] = map[interface{}]interface{}{
+			"dns": map[interface{}]interface{}{"acl": acl},
+		}
+		_, err := newDnsACLFromConfig(c)
+		assert.EqualError(t, err, msg)
+	}
+
+	expectErr("nope", "lighthouse.dns.acl must be a list, got string")
+	expectErr([]interface{}{"nope"}, "lighthouse.dns.acl[0] must be a map, got string")
+	expectErr([]interface{}{map[interface{}]interface{}{}}, "lighthouse.dns.acl[0].groups must be a list of groups")
+	expectErr([]interface{}{map[interface{}]interface{}{"groups": []interface{}{}}},
+		"lighthouse.dns.acl[0].groups must be a list of groups")
+	expectErr([]interface{}{map[interface{}]interface{}{"groups": []interface{}{"ops"}, "visible": "ops"}},
+		"lighthouse.dns.acl[0].visible must be a list of groups")
+}
+
+func TestDnsRecords_ViewFor(t *testing.T) {
+	l := test.NewLogger()
+	_, vpnCIDR, _ := net.ParseCIDR("10.1.0.0/16")
+	f := &Interface{hostMap: newHostMap(l, vpnCIDR), l: l}
+	addPeer := func(ip string, groups ...string) {
+		nc := &cert.NebulaCertificate{Details: cert.NebulaCertificateDetails{Name: ip, Groups: groups}}
+		f.hostMap.unlockedAddHostInfo(&HostInfo{vpnIp: iputil.Ip2VpnIp(net.ParseIP(ip)), ConnectionState: &ConnectionState{peerCert: nc}}, f)
+	}
+	addPeer("10.1.0.2", "ops")
+	addPeer("10.1.0.3", "dev")
+	addPeer("10.1.0.4", "dev", "shared")
+	addPeer("10.1.0.5", "qa")
+
+	d := newDnsRecords(f.hostMap)
+
+	// Without an acl everyone sees everything
+	view, ok := d.viewFor(net.ParseIP("192.168.0.1"))
+	assert.True(t, ok)
+	assert.Nil(t, view)
+
+	c := config.NewC(nil)
+	c.Settings["lighthouse"] = map[interface{}]interface{}{
+		"dns": map[interface{}]interface{}{
+			"acl": []interface{}{
+				map[interface{}]interface{}{"groups": []interface{}{"ops"}},
+				map[interface{}]interface{}{"groups": []interface{}{"dev"}, "visible": []interface{}{"dev"}},
+				map[interface{}]interface{}{"groups": []interface{}{"shared"}, "visible": []interface{}{"shared"}},
+			},
+		},
+	}
+	require.NoError(t, d.reload(c))
+
+	view, ok = d.viewFor(net.ParseIP("127.0.0.1"))
+	assert.True(t, ok)
+	assert.Nil(t, view)
+
+	view, ok = d.viewFor(net.ParseIP("10.1.0.2"))
+	assert.True(t, ok)
+	assert.Nil(t, view)
+
+	// Views of every matching rule add up
+	view, ok = d.viewFor(net.ParseIP("10.1.0.4"))
+	assert.True(t, ok)
+	assert.Equal(t, &dnsView{groups: map[string]struct{}{"dev": {}, "shared": {}}}, view)
+
+	_, ok = d.viewFor(net.ParseIP("10.1.0.5"))
+	assert.False(t, ok, "no rule for qa")
+	_, ok = d.viewFor(net.ParseIP("10.1.0.9"))
+	assert.False(t, ok, "no tunnel")
+	_, ok = d.viewFor(net.ParseIP("192.168.0.1"))
+	assert.False(t, ok, "not a nebula host")
+
+	// Split horizon, dev only sees dev hosts
+	view, _ = d.viewFor(net.ParseIP("10.1.0.3"))
+	d.AddCert(&cert.NebulaCertificate{Details: cert.NebulaCertificateDetails{Name: "a", Groups: []string{"dev"},
+		Ips: []*net.IPNet{{IP: net.ParseIP("10.1.0.3").To4(), Mask: net.CIDRMask(16, 32)}}}})
+	d.AddCert(&cert.NebulaCertificate{Details: cert.NebulaCertificateDetails{Name: "b", Groups: []string{"ops"}}})
+	d.Add("c", net.ParseIP("10.1.0.99"))
+	assert.True(t, d.Visible(view, "a."))
+	assert.False(t, d.Visible(view, "b."))
+	assert.False(t, d.Visible(view, "c."), "hosts without a certificate are only visible to everyone")
+	assert.False(t, d.Visible(view, "nope."))
+	assert.True(t, d.Visible(nil, "c."))
+
+	assert.NotEmpty(t, d.QueryCert(view, "10.1.0.4."))
+	assert.Empty(t, d.QueryCert(view, "10.1.0.2."))
+}
+
+func TestHandleDnsRequest_ACL(t *testing.T) {
+	_, vpnCIDR, _ := net.ParseCIDR("10.1.0.0/16")
+	dnsR = newDnsRecords(&HostMap{vpnCIDR: vpnCIDR})
+	defer func() { dnsR = nil }()
+	dnsR.Add("host1", net.ParseIP("10.1.0.2"))
+
+	c := config.NewC(nil)
+	c.Settings["lighthouse"] = map[interface{}]interface{}{
+		"dns": map[interface{}]interface{}{
+			"domain":     "nebula",
+			"axfr_allow": []interface{}{"192.168.0.0/24"},
+			"acl":        []interface{}{map[interface{}]interface{}{"groups": []interface{}{"ops"}}},
+		},
+	}
+	require.NoError(t, dnsR.reload(c))
+
+	l := test.NewLogger()
+	m := new(dns.Msg)
+	m.SetQuestion("host1.nebula.", dns.TypeA)
+
+	// Localhost is always allowed
+	w := &testDnsResponseWriter{remote: &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 1}}
+	handleDnsRequest(l, w, m)
+	require.NotNil(t, w.msg)
+	assert.Len(t, w.msg.Answer, 1)
+
+	w = &testDnsResponseWriter{remote: &net.UDPAddr{IP: net.ParseIP("192.168.0.1"), Port: 1}}
+	handleDnsRequest(l, w, m)
+	require.NotNil(t, w.msg)
+	assert.Equal(t, dns.RcodeRefused, w.msg.Rcode)
+	assert.Empty(t, w.msg.Answer)
+
+	// Zone transfers follow the acl as well, even from a client in axfr_allow
+	m.SetAxfr("nebula.")
+	w = &testDnsResponseWriter{remote: &net.TCPAddr{IP: net.ParseIP("192.168.0.1"), Port: 1}}
+	handleDnsRequest(l, w, m)
+	require.NotNil(t, w.msg)
+	assert.Equal(t, dns.RcodeRefused, w.msg.Rcode)
+	assert.Empty(t, w.msg.Answer)
+}
+
+// testDnsResponseWriter keeps the message written to a client at remote
+type testDnsResponseWriter struct {
+	dns.ResponseWriter
+	remote net.Addr
+	msg    *dns.Msg
+}
+
+func (w *testDnsResponseWriter) RemoteAddr() net.Addr { return w.remote }
+
+func (w *testDnsResponseWriter) WriteMsg(m *dns.Msg) error {
+	w.msg = m
+	return nil
+}
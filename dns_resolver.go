@@ -0,0 +1,153 @@
+package nebula
+
+import (
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/iputil"
+)
+
+var dnsResolve *dnsResolver
+
+const (
+	// dnsCacheSize is how many answers a resolver keeps, answers are not cached once it is full of unexpired ones
+	dnsCacheSize = 4096
+	// dnsNegativeTTL is how long a resolver remembers that a name does not exist
+	dnsNegativeTTL = 5 * time.Second
+	// dnsResolveTimeout is how long a resolver waits for each lighthouse
+	dnsResolveTimeout = time.Second
+)
+
+type dnsCacheKey struct {
+	name  string
+	qtype uint16
+}
+
+type dnsCacheEntry struct {
+	msg     *dns.Msg
+	expires time.Time
+}
+
+// dnsResolver lets a node that is not a lighthouse serve dns. What the node does not know from its own tunnels is asked
+// of the dns listener of the lighthouses over the overlay and the answers are cached for their ttl.
+type dnsResolver struct {
+	l      *logrus.Logger
+	lh     *LightHouse
+	client *dns.Client
+
+	lock  sync.Mutex
+	port  int
+	cache map[dnsCacheKey]dnsCacheEntry
+}
+
+func newDnsResolver(l *logrus.Logger, lh *LightHouse) *dnsResolver {
+	return &dnsResolver{
+		l:      l,
+		lh:     lh,
+		client: &dns.Client{Net: "udp", Timeout: dnsResolveTimeout},
+		cache:  make(map[dnsCacheKey]dnsCacheEntry),
+	}
+}
+
+// reload reads lighthouse.dns.lighthouse_port and forgets every cached answer
+func (r *dnsResolver) reload(c *config.C) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.port = c.GetInt("lighthouse.dns.lighthouse_port", 53)
+	r.cache = make(map[dnsCacheKey]dnsCacheEntry)
+}
+
+// Resolve answers a single question query from the cache or the first lighthouse that answers it, nil is returned
+// when no lighthouse did
+func (r *dnsResolver) Resolve(q *dns.Msg) *dns.Msg {
+	k := dnsCacheKey{name: strings.ToLower(q.Question[0].Name), qtype: q.Question[0].Qtype}
+	now := time.Now()
+
+	r.lock.Lock()
+	e, ok := r.cache[k]
+	port := r.port
+	r.lock.Unlock()
+
+	if ok && now.Before(e.expires) {
+		return e.msg.Copy()
+	}
+
+	lighthouses := r.lh.GetLighthouses()
+	ips := make([]iputil.VpnIp, 0, len(lighthouses))
+	for ip := range lighthouses {
+		ips = append(ips, ip)
+	}
+	sort.Slice(ips, func(i, j int) bool { return ips[i].Compare(ips[j]) < 0 })
+
+	out := new(dns.Msg)
+	out.SetQuestion(q.Question[0].Name, q.Question[0].Qtype)
+	for _, ip := range ips {
+		addr := net.JoinHostPort(ip.String(), strconv.Itoa(port))
+		a, _, err := r.client.Exchange(out, addr)
+		if err != nil {
+			r.l.WithError(err).WithField("lighthouse", addr).Debug("Failed to resolve with a lighthouse")
+			continue
+		}
+
+		if a.Rcode != dns.RcodeSuccess && a.Rcode != dns.RcodeNameError {
+			r.l.WithField("lighthouse", addr).WithField("rcode", dns.RcodeToString[a.Rcode]).
+				Debug("Lighthouse failed to resolve")
+			continue
+		}
+
+		r.store(k, a, now)
+		return a.Copy()
+	}
+
+	return nil
+}
+
+// store caches an answer for the lowest ttl of its records, or dnsNegativeTTL when there are none
+func (r *dnsResolver) store(k dnsCacheKey, a *dns.Msg, now time.Time) {
+	ttl := dnsNegativeTTL
+	for i, rr := range a.Answer {
+		if t := time.Duration(rr.Header().Ttl) * time.Second; i == 0 || t < ttl {
+			ttl = t
+		}
+	}
+	if ttl <= 0 {
+		return
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if len(r.cache) >= dnsCacheSize {
+		for ck, ce := range r.cache {
+			if !now.Before(ce.expires) {
+				delete(r.cache, ck)
+			}
+		}
+		if len(r.cache) >= dnsCacheSize {
+			return
+		}
+	}
+
+	r.cache[k] = dnsCacheEntry{msg: a, expires: now.Add(ttl)}
+}
+
+// resolveQuery fills in m with what the lighthouses answer to r, a server failure if none of them did
+func resolveQuery(l *logrus.Logger, m *dns.Msg, r *dns.Msg) {
+	l.Debugf("Resolving %s %s with the lighthouses", dns.TypeToString[r.Question[0].Qtype], r.Question[0].Name)
+	a := dnsResolve.Resolve(r)
+	if a == nil {
+		m.Rcode = dns.RcodeServerFailure
+		return
+	}
+
+	m.Answer = a.Answer
+	m.Ns = a.Ns
+	m.Rcode = a.Rcode
+}
@@ -0,0 +1,152 @@
+package nebula
+
+import (
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/iputil"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestDnsLighthouse starts a dns listener on localhost that knows host1.nebula. and counts the queries it answers
+func newTestDnsLighthouse(t *testing.T) (int, *atomic.Int32) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	queries := &atomic.Int32{}
+	server := &dns.Server{PacketConn: pc, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		queries.Add(1)
+		m := new(dns.Msg)
+		m.SetReply(r)
+		if strings.EqualFold(r.Question[0].Name, "host1.nebula.") && r.Question[0].Qtype == dns.TypeA {
+			m.Answer = append(m.Answer, &dns.A{Hdr: dnsHeader("host1.nebula.", dns.TypeA), A: net.ParseIP("10.1.0.5")})
+		} else {
+			m.Rcode = dns.RcodeNameError
+		}
+		w.WriteMsg(m)
+	})}
+	go server.ActivateAndServe()
+	t.Cleanup(func() { server.Shutdown() })
+
+	return pc.LocalAddr().(*net.UDPAddr).Port, queries
+}
+
+func newTestDnsResolver(t *testing.T, port int) *dnsResolver {
+	lh := newTestLighthouse()
+	lighthouses := map[iputil.VpnIp]struct{}{iputil.Ip2VpnIp(net.ParseIP("127.0.0.1")): {}}
+	lh.lighthouses.Store(&lighthouses)
+
+	c := config.NewC(nil)
+	c.Settings["lighthouse"] = map[interface{}]interface{}{
+		"dns": map[interface{}]interface{}{"lighthouse_port": port},
+	}
+
+	r := newDnsResolver(test.NewLogger(), lh)
+	r.client.Timeout = 100 * time.Millisecond
+	r.reload(c)
+	return r
+}
+
+func TestDnsResolver_Resolve(t *testing.T) {
+	port, queries := newTestDnsLighthouse(t)
+	r := newTestDnsResolver(t, port)
+
+	q := new(dns.Msg)
+	q.SetQuestion("Host1.nebula.", dns.TypeA)
+	a := r.Resolve(q)
+	require.NotNil(t, a)
+	require.Len(t, a.Answer, 1)
+	assert.Equal(t, "10.1.0.5", a.Answer[0].(*dns.A).A.String())
+	assert.Equal(t, int32(1), queries.Load())
+
+	// The answer is cached for its ttl, regardless of case
+	q.SetQuestion("host1.nebula.", dns.TypeA)
+	a = r.Resolve(q)
+	require.NotNil(t, a)
+	assert.Len(t, a.Answer, 1)
+	assert.Equal(t, int32(1), queries.Load())
+
+	// So is a name that does not exist, but only for dnsNegativeTTL
+	q.SetQuestion("nope.nebula.", dns.TypeA)
+	a = r.Resolve(q)
+	require.NotNil(t, a)
+	assert.Equal(t, dns.RcodeNameError, a.Rcode)
+	assert.Equal(t, int32(2), queries.Load())
+	r.Resolve(q)
+	assert.Equal(t, int32(2), queries.Load())
+
+	r.lock.Lock()
+	k := dnsCacheKey{name: "nope.nebula.", qtype: dns.TypeA}
+	e := r.cache[k]
+	assert.WithinDuration(t, time.Now().Add(dnsNegativeTTL), e.expires, time.Second)
+	e.expires = time.Now().Add(-time.Second)
+	r.cache[k] = e
+	r.lock.Unlock()
+
+	r.Resolve(q)
+	assert.Equal(t, int32(3), queries.Load())
+}
+
+func TestDnsResolver_NoLighthouse(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	port := pc.LocalAddr().(*net.UDPAddr).Port
+	pc.Close()
+
+	r := newTestDnsResolver(t, port)
+	q := new(dns.Msg)
+	q.SetQuestion("host1.nebula.", dns.TypeA)
+	assert.Nil(t, r.Resolve(q))
+}
+
+func TestHandleDnsRequest_Resolve(t *testing.T) {
+	port, queries := newTestDnsLighthouse(t)
+
+	_, vpnCIDR, _ := net.ParseCIDR("10.1.0.0/16")
+	dnsR = newDnsRecords(&HostMap{vpnCIDR: vpnCIDR})
+	dnsResolve = newTestDnsResolver(t, port)
+	defer func() {
+		dnsR = nil
+		dnsResolve = nil
+	}()
+	dnsR.Add("host2.nebula", net.ParseIP("10.1.0.6"))
+
+	l := test.NewLogger()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	server := &dns.Server{PacketConn: pc, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		handleDnsRequest(l, w, r)
+	})}
+	go server.ActivateAndServe()
+	defer server.Shutdown()
+
+	query := func(name string) *dns.Msg {
+		m := new(dns.Msg)
+		m.SetQuestion(name, dns.TypeA)
+		r, err := dns.Exchange(m, pc.LocalAddr().String())
+		require.NoError(t, err)
+		return r
+	}
+
+	// Hosts we have a tunnel with are answered locally
+	r := query("host2.nebula.")
+	require.Len(t, r.Answer, 1)
+	assert.Equal(t, "10.1.0.6", r.Answer[0].(*dns.A).A.String())
+	assert.Equal(t, int32(0), queries.Load())
+
+	r = query("host1.nebula.")
+	require.Len(t, r.Answer, 1)
+	assert.Equal(t, "10.1.0.5", r.Answer[0].(*dns.A).A.String())
+	assert.Equal(t, int32(1), queries.Load())
+
+	r = query("nope.nebula.")
+	assert.Equal(t, dns.RcodeNameError, r.Rcode)
+	assert.Equal(t, int32(2), queries.Load())
+}
@@ -3,12 +3,15 @@ package nebula
 import (
 	"fmt"
 	"net"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/miekg/dns"
 	"github.com/sirupsen/logrus"
+	"github.com/slackhq/nebula/cert"
 	"github.com/slackhq/nebula/config"
 	"github.com/slackhq/nebula/iputil"
 )
@@ -17,31 +20,181 @@ import (
 
 var dnsR *dnsRecords
 var dnsServer *dns.Server
+var dnsTCPServer *dns.Server
 var dnsAddr string
 
+// dnsTTL is the ttl of every record we serve
+const dnsTTL = 3600
+
+// dnsTransferChunk is how many records go in each message of a zone transfer
+const dnsTransferChunk = 256
+
+// dnsHost is everything we serve for a host, nc is nil for hosts added without a certificate
+type dnsHost struct {
+	name string
+	ips  []net.IP
+	nc   *cert.NebulaCertificate
+}
+
 type dnsRecords struct {
 	sync.RWMutex
-	dnsMap  map[string]string
+	// dnsMap is keyed by the lowercase name of the host without lighthouse.dns.domain
+	dnsMap map[string]*dnsHost
+	// ptrMap is the reverse name of every ip to the key of its host in dnsMap
+	ptrMap  map[string]string
 	hostMap *HostMap
+
+	domain    string
+	axfrAllow []*net.IPNet
+	acl       []dnsACLRule
+	serial    uint32
 }
 
 func newDnsRecords(hostMap *HostMap) *dnsRecords {
 	return &dnsRecords{
-		dnsMap:  make(map[string]string),
+		dnsMap:  make(map[string]*dnsHost),
+		ptrMap:  make(map[string]string),
 		hostMap: hostMap,
+		domain:  ".",
+		serial:  uint32(time.Now().Unix()),
+	}
+}
+
+// reload reads lighthouse.dns.domain, lighthouse.dns.axfr_allow and lighthouse.dns.acl
+func (d *dnsRecords) reload(c *config.C) error {
+	domain := strings.ToLower(dns.Fqdn(strings.TrimSpace(c.GetString("lighthouse.dns.domain", ""))))
+	if _, ok := dns.IsDomainName(domain); !ok {
+		return fmt.Errorf("lighthouse.dns.domain `%s` is not a valid domain name", domain)
+	}
+
+	var axfrAllow []*net.IPNet
+	for i, rc := range c.GetStringSlice("lighthouse.dns.axfr_allow", []string{}) {
+		_, n, err := net.ParseCIDR(rc)
+		if err != nil {
+			return fmt.Errorf("lighthouse.dns.axfr_allow[%d] `%s` is not a valid cidr: %s", i, rc, err)
+		}
+		axfrAllow = append(axfrAllow, n)
+	}
+
+	acl, err := newDnsACLFromConfig(c)
+	if err != nil {
+		return err
+	}
+
+	d.Lock()
+	defer d.Unlock()
+	if d.domain != domain {
+		d.serial++
+	}
+	d.domain = domain
+	d.axfrAllow = axfrAllow
+	d.acl = acl
+	return nil
+}
+
+// key returns the dnsMap key of a fully qualified name, false if the name is not within lighthouse.dns.domain.
+// Must be called with the lock held.
+func (d *dnsRecords) key(name string) (string, bool) {
+	name = strings.ToLower(name)
+	if d.domain == "." {
+		return strings.TrimSuffix(name, "."), true
+	}
+
+	if !strings.HasSuffix(name, "."+d.domain) {
+		return "", false
+	}
+	return strings.TrimSuffix(name, "."+d.domain), true
+}
+
+// fqdn returns the fully qualified name of a host, must be called with the lock held
+func (d *dnsRecords) fqdn(h *dnsHost) string {
+	if d.domain == "." {
+		return h.name + "."
+	}
+	return h.name + "." + d.domain
+}
+
+// lookup returns the host for a fully qualified name, must be called with the lock held
+func (d *dnsRecords) lookup(name string) *dnsHost {
+	k, ok := d.key(name)
+	if !ok {
+		return nil
+	}
+	return d.dnsMap[k]
+}
+
+// Query returns the ips for a host that match the address family of qtype, ipv4 for A and ipv6 for AAAA
+func (d *dnsRecords) Query(qtype uint16, data string) []net.IP {
+	d.RLock()
+	defer d.RUnlock()
+	h := d.lookup(data)
+	if h == nil {
+		return nil
+	}
+
+	var r []net.IP
+	for _, ip := range h.ips {
+		if (ip.To4() != nil) == (qtype == dns.TypeA) {
+			r = append(r, ip)
+		}
+	}
+	return r
+}
+
+// Visible reports if view may see the host with a fully qualified name
+func (d *dnsRecords) Visible(view *dnsView, name string) bool {
+	d.RLock()
+	defer d.RUnlock()
+	h := d.lookup(name)
+	return h != nil && view.sees(h.nc)
+}
+
+// QueryPtr returns the fully qualified name of the host with the ip of a reverse name like 1.0.0.10.in-addr.arpa.
+func (d *dnsRecords) QueryPtr(data string) string {
+	d.RLock()
+	defer d.RUnlock()
+	h, ok := d.dnsMap[d.ptrMap[strings.ToLower(data)]]
+	if !ok {
+		return ""
 	}
+	return d.fqdn(h)
 }
 
-func (d *dnsRecords) Query(data string) string {
+// QueryGroups returns the certificate of a host by name as key=value strings, one per ip, subnet and group
+func (d *dnsRecords) QueryGroups(data string) []string {
 	d.RLock()
 	defer d.RUnlock()
-	if r, ok := d.dnsMap[strings.ToLower(data)]; ok {
-		return r
+	h := d.lookup(data)
+	if h == nil {
+		return nil
+	}
+	return h.txt()
+}
+
+// txt returns the certificate of the host as key=value strings, nil if it has none
+func (h *dnsHost) txt() []string {
+	if h.nc == nil {
+		return nil
+	}
+
+	nc := h.nc
+	r := []string{"name=" + nc.Details.Name}
+	for _, ip := range nc.Details.Ips {
+		r = append(r, "ip="+ip.String())
 	}
-	return ""
+	for _, n := range nc.Details.Subnets {
+		r = append(r, "subnet="+n.String())
+	}
+	for _, g := range nc.Details.Groups {
+		r = append(r, "group="+g)
+	}
+	return append(r,
+		"not_after="+nc.Details.NotAfter.UTC().Format(time.RFC3339),
+		"issuer="+nc.Details.Issuer,
+	)
 }
 
-func (d *dnsRecords) QueryCert(data string) string {
+func (d *dnsRecords) QueryCert(view *dnsView, data string) string {
 	ip := net.ParseIP(data[:len(data)-1])
 	if ip == nil {
 		return ""
@@ -52,7 +205,7 @@ func (d *dnsRecords) QueryCert(data string) string {
 		return ""
 	}
 	q := hostinfo.GetCert()
-	if q == nil {
+	if q == nil || !view.sees(q) {
 		return ""
 	}
 	cert := q.Details
@@ -60,40 +213,171 @@ func (d *dnsRecords) QueryCert(data string) string {
 	return c
 }
 
-func (d *dnsRecords) Add(host, data string) {
+func (d *dnsRecords) Add(host string, ips ...net.IP) {
+	d.add(host, ips, nil)
+}
+
+// AddCert adds a host by the name, ips and groups of its certificate
+func (d *dnsRecords) AddCert(nc *cert.NebulaCertificate) {
+	ips := make([]net.IP, len(nc.Details.Ips))
+	for i, n := range nc.Details.Ips {
+		ips[i] = n.IP
+	}
+	d.add(nc.Details.Name, ips, nc)
+}
+
+func (d *dnsRecords) add(host string, ips []net.IP, nc *cert.NebulaCertificate) {
+	host = strings.TrimSuffix(host, ".")
+	k := strings.ToLower(host)
+	h := &dnsHost{name: host, ips: ips, nc: nc}
+
 	d.Lock()
 	defer d.Unlock()
-	d.dnsMap[strings.ToLower(host)] = data
+
+	if old, ok := d.dnsMap[k]; ok {
+		if old.name == h.name && fmt.Sprint(old.ips) == fmt.Sprint(h.ips) && fmt.Sprint(old.txt()) == fmt.Sprint(h.txt()) {
+			// Nothing a client could see changed, keep the serial so secondaries do not transfer again
+			d.dnsMap[k] = h
+			return
+		}
+
+		for _, ip := range old.ips {
+			if r, err := dns.ReverseAddr(ip.String()); err == nil && d.ptrMap[r] == k {
+				delete(d.ptrMap, r)
+			}
+		}
+	}
+
+	d.dnsMap[k] = h
+	for _, ip := range ips {
+		if r, err := dns.ReverseAddr(ip.String()); err == nil {
+			d.ptrMap[r] = k
+		}
+	}
+	d.serial++
+}
+
+// soa returns the start of authority for lighthouse.dns.domain, must be called with the lock held
+func (d *dnsRecords) soa() *dns.SOA {
+	return &dns.SOA{
+		Hdr:     dns.RR_Header{Name: d.domain, Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: dnsTTL},
+		Ns:      d.domain,
+		Mbox:    "hostmaster." + d.domain,
+		Serial:  d.serial,
+		Refresh: 3600,
+		Retry:   600,
+		Expire:  86400,
+		Minttl:  60,
+	}
+}
+
+// Zone returns every record of the hosts view may see within lighthouse.dns.domain, between two copies of its soa as a
+// zone transfer needs them
+func (d *dnsRecords) Zone(view *dnsView) []dns.RR {
+	d.RLock()
+	defer d.RUnlock()
+
+	keys := make([]string, 0, len(d.dnsMap))
+	for k := range d.dnsMap {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	soa := d.soa()
+	r := []dns.RR{soa}
+	for _, k := range keys {
+		h := d.dnsMap[k]
+		if !view.sees(h.nc) {
+			continue
+		}
+		name := d.fqdn(h)
+		for _, ip := range h.ips {
+			if ip.To4() != nil {
+				r = append(r, &dns.A{Hdr: dnsHeader(name, dns.TypeA), A: ip})
+			} else {
+				r = append(r, &dns.AAAA{Hdr: dnsHeader(name, dns.TypeAAAA), AAAA: ip})
+			}
+		}
+		if txt := h.txt(); txt != nil {
+			r = append(r, &dns.TXT{Hdr: dnsHeader(name, dns.TypeTXT), Txt: txt})
+		}
+	}
+	return append(r, soa)
+}
+
+// axfrAllowed reports if ip may transfer the zone, transfers are refused when lighthouse.dns.domain is not set
+func (d *dnsRecords) axfrAllowed(name string, ip net.IP) bool {
+	d.RLock()
+	defer d.RUnlock()
+	if d.domain == "." || !strings.EqualFold(name, d.domain) {
+		return false
+	}
+
+	for _, n := range d.axfrAllow {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func dnsHeader(name string, rrtype uint16) dns.RR_Header {
+	return dns.RR_Header{Name: name, Rrtype: rrtype, Class: dns.ClassINET, Ttl: dnsTTL}
+}
+
+func dnsClientIP(w dns.ResponseWriter) net.IP {
+	a, _, _ := net.SplitHostPort(w.RemoteAddr().String())
+	return net.ParseIP(a)
 }
 
-func parseQuery(l *logrus.Logger, m *dns.Msg, w dns.ResponseWriter) {
+// fromNebula reports if a dns client may see certificate details, only nebula nodes and localhost may
+func fromNebula(w dns.ResponseWriter) bool {
+	b := dnsClientIP(w)
+	return dnsR.hostMap.vpnCIDR.Contains(b) || b.IsLoopback()
+}
+
+// parseQuery answers the questions of m with the hosts view may see
+func parseQuery(l *logrus.Logger, m *dns.Msg, w dns.ResponseWriter, view *dnsView) {
 	for _, q := range m.Question {
 		switch q.Qtype {
-		case dns.TypeA:
-			l.Debugf("Query for A %s", q.Name)
-			ip := dnsR.Query(q.Name)
-			if ip != "" {
-				rr, err := dns.NewRR(fmt.Sprintf("%s A %s", q.Name, ip))
+		case dns.TypeA, dns.TypeAAAA:
+			qType := dns.TypeToString[q.Qtype]
+			l.Debugf("Query for %s %s", qType, q.Name)
+			if !dnsR.Visible(view, q.Name) {
+				continue
+			}
+			for _, ip := range dnsR.Query(q.Qtype, q.Name) {
+				rr, err := dns.NewRR(fmt.Sprintf("%s %s %s", q.Name, qType, ip))
 				if err == nil {
 					m.Answer = append(m.Answer, rr)
 				}
 			}
+		case dns.TypePTR:
+			l.Debugf("Query for PTR %s", q.Name)
+			if name := dnsR.QueryPtr(q.Name); name != "" && dnsR.Visible(view, name) {
+				m.Answer = append(m.Answer, &dns.PTR{Hdr: dnsHeader(q.Name, dns.TypePTR), Ptr: name})
+			}
 		case dns.TypeTXT:
-			a, _, _ := net.SplitHostPort(w.RemoteAddr().String())
-			b := net.ParseIP(a)
 			// We don't answer these queries from non nebula nodes or localhost
-			//l.Debugf("Does %s contain %s", b, dnsR.hostMap.vpnCIDR)
-			if !dnsR.hostMap.vpnCIDR.Contains(b) && a != "127.0.0.1" {
+			if !fromNebula(w) {
 				return
 			}
 			l.Debugf("Query for TXT %s", q.Name)
-			ip := dnsR.QueryCert(q.Name)
+			ip := dnsR.QueryCert(view, q.Name)
 			if ip != "" {
 				rr, err := dns.NewRR(fmt.Sprintf("%s TXT %s", q.Name, ip))
 				if err == nil {
 					m.Answer = append(m.Answer, rr)
 				}
+			} else if txt := dnsR.QueryGroups(q.Name); txt != nil && dnsR.Visible(view, q.Name) {
+				m.Answer = append(m.Answer, &dns.TXT{Hdr: dnsHeader(q.Name, dns.TypeTXT), Txt: txt})
+			}
+		case dns.TypeSOA:
+			dnsR.RLock()
+			if dnsR.domain != "." && strings.EqualFold(q.Name, dnsR.domain) {
+				m.Answer = append(m.Answer, dnsR.soa())
 			}
+			dnsR.RUnlock()
 		}
 	}
 
@@ -109,14 +393,84 @@ func handleDnsRequest(l *logrus.Logger, w dns.ResponseWriter, r *dns.Msg) {
 
 	switch r.Opcode {
 	case dns.OpcodeQuery:
-		parseQuery(l, m, w)
+		view, ok := dnsR.viewFor(dnsClientIP(w))
+		if !ok {
+			l.WithField("remote", w.RemoteAddr()).Debug("Refused a dns query not allowed by lighthouse.dns.acl")
+			m.Rcode = dns.RcodeRefused
+			break
+		}
+
+		if len(r.Question) == 1 && r.Question[0].Qtype == dns.TypeAXFR {
+			transferZone(l, w, r, m, view)
+			return
+		}
+
+		parseQuery(l, m, w, view)
+		// Nodes that are not lighthouses only know the hosts they have tunnels with, the lighthouses know the rest.
+		// The lighthouses answer with what this node may see, so only clients that may see everything are forwarded.
+		if len(m.Answer) == 0 && view == nil && dnsResolve != nil && len(r.Question) == 1 &&
+			(r.Question[0].Qtype != dns.TypeTXT || fromNebula(w)) {
+			resolveQuery(l, m, r)
+		}
 	}
 
 	w.WriteMsg(m)
 }
 
-func dnsMain(l *logrus.Logger, hostMap *HostMap, c *config.C) func() {
+// transferZone answers an AXFR for lighthouse.dns.domain over tcp from the clients in lighthouse.dns.axfr_allow, with
+// only the hosts view may see
+func transferZone(l *logrus.Logger, w dns.ResponseWriter, r *dns.Msg, m *dns.Msg, view *dnsView) {
+	q := r.Question[0]
+	remote, ok := w.RemoteAddr().(*net.TCPAddr)
+	if !ok || !dnsR.axfrAllowed(q.Name, remote.IP) {
+		l.WithField("remote", w.RemoteAddr()).WithField("zone", q.Name).Debug("Refused a zone transfer")
+		m.Rcode = dns.RcodeRefused
+		w.WriteMsg(m)
+		return
+	}
+
+	zone := dnsR.Zone(view)
+	l.WithField("remote", w.RemoteAddr()).WithField("zone", q.Name).WithField("records", len(zone)).
+		Info("Transferring the dns zone")
+
+	ch := make(chan *dns.Envelope)
+	errs := make(chan error, 1)
+	go func() {
+		errs <- new(dns.Transfer).Out(w, r, ch)
+	}()
+
+	// Out stops reading from ch once a write fails, so every send also waits on it returning
+	var err error
+	done := false
+	for len(zone) > 0 && !done {
+		n := min(len(zone), dnsTransferChunk)
+		select {
+		case ch <- &dns.Envelope{RR: zone[:n]}:
+			zone = zone[n:]
+		case err = <-errs:
+			done = true
+		}
+	}
+	close(ch)
+
+	if !done {
+		err = <-errs
+	}
+	if err != nil {
+		l.WithError(err).WithField("remote", w.RemoteAddr()).Error("Failed to transfer the dns zone")
+	}
+}
+
+func dnsMain(l *logrus.Logger, hostMap *HostMap, lightHouse *LightHouse, c *config.C) (func(), error) {
 	dnsR = newDnsRecords(hostMap)
+	if err := dnsR.reload(c); err != nil {
+		return nil, err
+	}
+
+	if !lightHouse.amLighthouse {
+		dnsResolve = newDnsResolver(l, lightHouse)
+		dnsResolve.reload(c)
+	}
 
 	// attach request handler func
 	dns.HandleFunc(".", func(w dns.ResponseWriter, r *dns.Msg) {
@@ -129,7 +483,7 @@ func dnsMain(l *logrus.Logger, hostMap *HostMap, c *config.C) func() {
 
 	return func() {
 		startDns(l, c)
-	}
+	}, nil
 }
 
 func getDnsServerAddr(c *config.C) string {
@@ -144,7 +498,15 @@ func getDnsServerAddr(c *config.C) string {
 func startDns(l *logrus.Logger, c *config.C) {
 	dnsAddr = getDnsServerAddr(c)
 	dnsServer = &dns.Server{Addr: dnsAddr, Net: "udp"}
+	// Zone transfers and answers too large for udp need tcp
+	tcpServer := &dns.Server{Addr: dnsAddr, Net: "tcp"}
+	dnsTCPServer = tcpServer
 	l.WithField("dnsListener", dnsAddr).Info("Starting DNS responder")
+	go func() {
+		if err := tcpServer.ListenAndServe(); err != nil {
+			l.Errorf("Failed to start tcp server: %s\n ", err.Error())
+		}
+	}()
 	err := dnsServer.ListenAndServe()
 	defer dnsServer.Shutdown()
 	if err != nil {
@@ -153,6 +515,13 @@ func startDns(l *logrus.Logger, c *config.C) {
 }
 
 func reloadDns(l *logrus.Logger, c *config.C) {
+	if err := dnsR.reload(c); err != nil {
+		l.WithError(err).Error("Failed to reload the DNS records config")
+	}
+	if dnsResolve != nil {
+		dnsResolve.reload(c)
+	}
+
 	if dnsAddr == getDnsServerAddr(c) {
 		l.Debug("No DNS server config change detected")
 		return
@@ -160,5 +529,6 @@ func reloadDns(l *logrus.Logger, c *config.C) {
 
 	l.Debug("Restarting DNS server")
 	dnsServer.Shutdown()
+	dnsTCPServer.Shutdown()
 	go startDns(l, c)
 }
@@ -1,18 +1,25 @@
 package nebula
 
 import (
+	"errors"
+	"fmt"
+	"net"
 	"testing"
+	"time"
 
 	"github.com/miekg/dns"
+	"github.com/slackhq/nebula/cert"
 	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/test"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestParsequery(t *testing.T) {
 	//TODO: This test is basically pointless
 	hostMap := &HostMap{}
 	ds := newDnsRecords(hostMap)
-	ds.Add("test.com.com", "1.2.3.4")
+	ds.Add("test.com.com", net.ParseIP("1.2.3.4"))
 
 	m := new(dns.Msg)
 	m.SetQuestion("test.com.com", dns.TypeA)
@@ -20,6 +27,18 @@ func TestParsequery(t *testing.T) {
 	//parseQuery(m)
 }
 
+func TestDnsRecords_Query(t *testing.T) {
+	ds := newDnsRecords(&HostMap{})
+	ds.Add("Test.com.", net.ParseIP("10.0.0.1"), net.ParseIP("fd00::1"))
+
+	assert.Equal(t, []net.IP{net.ParseIP("10.0.0.1")}, ds.Query(dns.TypeA, "test.com."))
+	assert.Equal(t, []net.IP{net.ParseIP("fd00::1")}, ds.Query(dns.TypeAAAA, "test.com."))
+	assert.Empty(t, ds.Query(dns.TypeA, "nope.com."))
+
+	ds.Add("v6.com.", net.ParseIP("fd00::2"))
+	assert.Empty(t, ds.Query(dns.TypeA, "v6.com."))
+}
+
 func Test_getDnsServerAddr(t *testing.T) {
 	c := config.NewC(nil)
 
@@ -56,3 +75,179 @@ func Test_getDnsServerAddr(t *testing.T) {
 	}
 	assert.Equal(t, "[::]:1", getDnsServerAddr(c))
 }
+
+func newTestDnsCert(name string, groups ...string) *cert.NebulaCertificate {
+	return &cert.NebulaCertificate{
+		Details: cert.NebulaCertificateDetails{
+			Name:     name,
+			Ips:      []*net.IPNet{{IP: net.ParseIP("10.1.0.2").To4(), Mask: net.CIDRMask(16, 32)}},
+			Groups:   groups,
+			NotAfter: time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC),
+			Issuer:   "deadbeef",
+		},
+	}
+}
+
+func TestDnsRecords_Domain(t *testing.T) {
+	ds := newDnsRecords(&HostMap{})
+	c := config.NewC(nil)
+	c.Settings["lighthouse"] = map[interface{}]interface{}{
+		"dns": map[interface{}]interface{}{"domain": "Mesh.Nebula"},
+	}
+	require.NoError(t, ds.reload(c))
+	assert.Equal(t, "mesh.nebula.", ds.domain)
+
+	ds.AddCert(newTestDnsCert("Host1", "ops", "web"))
+	assert.Equal(t, []net.IP{net.ParseIP("10.1.0.2").To4()}, ds.Query(dns.TypeA, "host1.mesh.nebula."))
+	assert.Empty(t, ds.Query(dns.TypeA, "host1."))
+	assert.Empty(t, ds.Query(dns.TypeA, "host1.other.nebula."))
+
+	assert.Equal(t, "Host1.mesh.nebula.", ds.QueryPtr("2.0.1.10.in-addr.arpa."))
+	assert.Empty(t, ds.QueryPtr("3.0.1.10.in-addr.arpa."))
+
+	assert.Equal(t, []string{"name=Host1", "ip=10.1.0.2/16", "group=ops", "group=web", "not_after=2030-01-02T03:04:05Z",
+		"issuer=deadbeef"}, ds.QueryGroups("HOST1.mesh.nebula."))
+	assert.Empty(t, ds.QueryGroups("nope.mesh.nebula."))
+
+	// A host that moved to a new ip loses its old reverse name
+	serial := ds.serial
+	ds.Add("host1", net.ParseIP("fd00::5"))
+	assert.Greater(t, ds.serial, serial)
+	assert.Empty(t, ds.QueryPtr("2.0.1.10.in-addr.arpa."))
+	r, err := dns.ReverseAddr("fd00::5")
+	require.NoError(t, err)
+	assert.Equal(t, "host1.mesh.nebula.", ds.QueryPtr(r))
+
+	// Adding the same host again does not change the zone
+	serial = ds.serial
+	ds.Add("host1", net.ParseIP("fd00::5"))
+	assert.Equal(t, serial, ds.serial)
+
+	c.Settings["lighthouse"] = map[interface{}]interface{}{
+		"dns": map[interface{}]interface{}{"domain": "bad..name"},
+	}
+	assert.EqualError(t, ds.reload(c), "lighthouse.dns.domain `bad..name.` is not a valid domain name")
+
+	c.Settings["lighthouse"] = map[interface{}]interface{}{
+		"dns": map[interface{}]interface{}{"axfr_allow": []interface{}{"nope"}},
+	}
+	assert.EqualError(t, ds.reload(c), "lighthouse.dns.axfr_allow[0] `nope` is not a valid cidr: invalid CIDR address: nope")
+}
+
+func TestDnsRecords_Zone(t *testing.T) {
+	ds := newDnsRecords(&HostMap{})
+	c := config.NewC(nil)
+	c.Settings["lighthouse"] = map[interface{}]interface{}{
+		"dns": map[interface{}]interface{}{"domain": "nebula", "axfr_allow": []interface{}{"192.168.0.0/24"}},
+	}
+	require.NoError(t, ds.reload(c))
+
+	// Transfers need a domain and a client in lighthouse.dns.axfr_allow
+	assert.True(t, ds.axfrAllowed("Nebula.", net.ParseIP("192.168.0.10")))
+	assert.False(t, ds.axfrAllowed("nebula.", net.ParseIP("192.168.1.10")))
+	assert.False(t, ds.axfrAllowed("other.", net.ParseIP("192.168.0.10")))
+
+	ds.AddCert(newTestDnsCert("b", "ops"))
+	ds.Add("a", net.ParseIP("10.1.0.1"), net.ParseIP("fd00::1"))
+
+	zone := ds.Zone(nil)
+	require.Len(t, zone, 6)
+	assert.IsType(t, &dns.SOA{}, zone[0])
+	assert.Equal(t, zone[0], zone[5])
+	assert.Equal(t, "nebula.", zone[0].Header().Name)
+	assert.Equal(t, "a.nebula.\t3600\tIN\tA\t10.1.0.1", zone[1].String())
+	assert.Equal(t, "a.nebula.\t3600\tIN\tAAAA\tfd00::1", zone[2].String())
+	assert.Equal(t, "b.nebula.\t3600\tIN\tA\t10.1.0.2", zone[3].String())
+	assert.Equal(t, dns.TypeTXT, zone[4].Header().Rrtype)
+
+	// A view only gets the hosts it may see
+	zone = ds.Zone(&dnsView{groups: map[string]struct{}{"ops": {}}})
+	require.Len(t, zone, 4)
+	assert.Equal(t, "b.nebula.\t3600\tIN\tA\t10.1.0.2", zone[1].String())
+	assert.Equal(t, dns.TypeTXT, zone[2].Header().Rrtype)
+}
+
+func TestHandleDnsRequest(t *testing.T) {
+	_, vpnCIDR, _ := net.ParseCIDR("10.1.0.0/16")
+	dnsR = newDnsRecords(&HostMap{vpnCIDR: vpnCIDR})
+	defer func() { dnsR = nil }()
+
+	c := config.NewC(nil)
+	c.Settings["lighthouse"] = map[interface{}]interface{}{
+		"dns": map[interface{}]interface{}{"domain": "nebula", "axfr_allow": []interface{}{"127.0.0.1/32"}},
+	}
+	require.NoError(t, dnsR.reload(c))
+	dnsR.AddCert(newTestDnsCert("host1", "ops"))
+
+	l := test.NewLogger()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	server := &dns.Server{Listener: ln, Net: "tcp", Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		handleDnsRequest(l, w, r)
+	})}
+	go server.ActivateAndServe()
+	defer server.Shutdown()
+
+	client := &dns.Client{Net: "tcp"}
+	query := func(name string, qtype uint16) *dns.Msg {
+		m := new(dns.Msg)
+		m.SetQuestion(name, qtype)
+		r, _, err := client.Exchange(m, ln.Addr().String())
+		require.NoError(t, err)
+		return r
+	}
+
+	r := query("2.0.1.10.in-addr.arpa.", dns.TypePTR)
+	require.Len(t, r.Answer, 1)
+	assert.Equal(t, "host1.nebula.", r.Answer[0].(*dns.PTR).Ptr)
+
+	r = query("host1.nebula.", dns.TypeTXT)
+	require.Len(t, r.Answer, 1)
+	assert.Contains(t, r.Answer[0].(*dns.TXT).Txt, "group=ops")
+
+	r = query("nebula.", dns.TypeSOA)
+	require.Len(t, r.Answer, 1)
+	assert.Equal(t, dnsR.serial, r.Answer[0].(*dns.SOA).Serial)
+
+	m := new(dns.Msg)
+	m.SetAxfr("nebula.")
+	env, err := new(dns.Transfer).In(m, ln.Addr().String())
+	require.NoError(t, err)
+	var records []dns.RR
+	for e := range env {
+		require.NoError(t, e.Error)
+		records = append(records, e.RR...)
+	}
+	assert.Len(t, records, 4)
+
+	r = query("other.", dns.TypeAXFR)
+	assert.Equal(t, dns.RcodeRefused, r.Rcode)
+
+	// A transfer that fails to write returns instead of waiting on the rest of the zone to be read
+	for i := 0; i < 2*dnsTransferChunk; i++ {
+		dnsR.Add(fmt.Sprintf("bulk%d", i), net.IPv4(10, 1, byte(i>>8), byte(i)))
+	}
+	w := &failingDnsResponseWriter{remote: &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 1}}
+	done := make(chan struct{})
+	go func() {
+		handleDnsRequest(l, w, m)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("the zone transfer did not return after a failed write")
+	}
+}
+
+// failingDnsResponseWriter fails every write to a client at remote
+type failingDnsResponseWriter struct {
+	dns.ResponseWriter
+	remote net.Addr
+}
+
+func (w *failingDnsResponseWriter) RemoteAddr() net.Addr { return w.remote }
+
+func (w *failingDnsResponseWriter) WriteMsg(*dns.Msg) error {
+	return errors.New("connection reset")
+}
@@ -0,0 +1,128 @@
+package nebula
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/udp"
+)
+
+// Enterprise networks queue traffic by the dscp in the ip header, voice ahead of bulk transfers, but everything nebula
+// sends looks the same from the outside. listen.dscp marks every udp packet we send, with listen.dscp_copy or
+// listen.dscp_map the packets that carry what we read from the tun device are instead marked after the dscp of the
+// packet inside. The marks only go on the packet, queueing is up to the network.
+
+// dscpMarking is the traffic class of the packets carrying each inner dscp, nil when only listen.dscp is used
+type dscpMarking struct {
+	tos [64]byte
+}
+
+func newDSCPMarkingFromConfig(c *config.C) (*dscpMarking, error) {
+	dscp := c.GetInt("listen.dscp", 0)
+	if dscp < 0 || dscp > 63 {
+		return nil, fmt.Errorf("listen.dscp must be between 0 and 63: %v", dscp)
+	}
+
+	copyInner := c.GetBool("listen.dscp_copy", false)
+	raw := c.Get("listen.dscp_map")
+	if !copyInner && raw == nil {
+		return nil, nil
+	}
+
+	m := &dscpMarking{}
+	for inner := range m.tos {
+		outer := dscp
+		if copyInner {
+			outer = inner
+		}
+		m.tos[inner] = byte(outer << 2)
+	}
+
+	if raw == nil {
+		return m, nil
+	}
+
+	rm, ok := raw.(map[interface{}]interface{})
+	if !ok {
+		return nil, fmt.Errorf("listen.dscp_map must be a map of inner to outer dscp")
+	}
+
+	for k, v := range rm {
+		inner, err := strconv.Atoi(fmt.Sprint(k))
+		if err != nil || inner < 0 || inner > 63 {
+			return nil, fmt.Errorf("listen.dscp_map key %v is not a dscp", k)
+		}
+		outer, err := strconv.Atoi(fmt.Sprint(v))
+		if err != nil || outer < 0 || outer > 63 {
+			return nil, fmt.Errorf("listen.dscp_map entry %v: %v is not a dscp", k, v)
+		}
+		m.tos[inner] = byte(outer << 2)
+	}
+
+	return m, nil
+}
+
+// outer returns the traffic class to send the ip packet inner with, the ecn bits are left for the network
+func (m *dscpMarking) outer(inner []byte) byte {
+	if len(inner) < 2 {
+		return m.tos[0]
+	}
+
+	switch inner[0] >> 4 {
+	case 4:
+		return m.tos[inner[1]>>2]
+	case 6:
+		return m.tos[(inner[0]&0x0f)<<2|inner[1]>>6]
+	}
+	return m.tos[0]
+}
+
+func (f *Interface) reloadDSCPMarking(c *config.C) {
+	if !c.InitialLoad() && !c.HasChanged("listen.dscp") && !c.HasChanged("listen.dscp_copy") &&
+		!c.HasChanged("listen.dscp_map") {
+		return
+	}
+
+	m, err := newDSCPMarkingFromConfig(c)
+	if err != nil {
+		f.l.WithError(err).Error("Failed to load listen.dscp, keeping the previous marking")
+		return
+	}
+
+	f.dscpMarking.Store(m)
+	if m != nil {
+		f.l.WithField("copy", c.GetBool("listen.dscp_copy", false)).Info("Marking tunnel packets after the inner dscp")
+	} else if !c.InitialLoad() {
+		f.l.Info("No longer marking tunnel packets after the inner dscp")
+	}
+}
+
+// dscpWriter is what a routine sends the packets carrying an inner packet through while listen.dscp_map or
+// listen.dscp_copy is set, everything it sends is marked with tos. It is not safe for concurrent use.
+type dscpWriter struct {
+	udp.Conn
+	tos byte
+
+	// batch queues the packets when the routine batches its sends, otherwise they go out one at a time through bc
+	batch *udp.SendBatch
+	// seal is set when the batch seals its aes packets together
+	seal  *sealQueue
+	bc    udp.BatchConn
+	bufs  [1][]byte
+	addrs [1]*udp.Addr
+	toss  [1]byte
+}
+
+func (w *dscpWriter) sealQueue() *sealQueue {
+	return w.seal
+}
+
+func (w *dscpWriter) WriteTo(b []byte, addr *udp.Addr) error {
+	if w.batch != nil {
+		return w.batch.WriteToTOS(b, addr, w.tos)
+	}
+
+	w.bufs[0], w.addrs[0], w.toss[0] = b, addr, w.tos
+	return w.bc.WriteBatch(w.bufs[:], w.addrs[:], w.toss[:])
+}
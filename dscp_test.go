@@ -0,0 +1,114 @@
+package nebula
+
+import (
+	"net"
+	"testing"
+
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/test"
+	"github.com/slackhq/nebula/udp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewDSCPMarkingFromConfig(t *testing.T) {
+	l := test.NewLogger()
+	c := config.NewC(l)
+
+	m, err := newDSCPMarkingFromConfig(c)
+	require.NoError(t, err)
+	assert.Nil(t, m)
+
+	// listen.dscp alone is set on the sockets
+	c.Settings["listen"] = map[interface{}]interface{}{"dscp": 8}
+	m, err = newDSCPMarkingFromConfig(c)
+	require.NoError(t, err)
+	assert.Nil(t, m)
+
+	c.Settings["listen"] = map[interface{}]interface{}{"dscp": 8, "dscp_map": map[interface{}]interface{}{46: 46, "26": 18}}
+	m, err = newDSCPMarkingFromConfig(c)
+	require.NoError(t, err)
+	assert.Equal(t, byte(46<<2), m.tos[46])
+	assert.Equal(t, byte(18<<2), m.tos[26])
+	assert.Equal(t, byte(8<<2), m.tos[0])
+	assert.Equal(t, byte(8<<2), m.tos[10])
+
+	c.Settings["listen"] = map[interface{}]interface{}{"dscp_copy": true, "dscp_map": map[interface{}]interface{}{10: 0}}
+	m, err = newDSCPMarkingFromConfig(c)
+	require.NoError(t, err)
+	assert.Equal(t, byte(46<<2), m.tos[46])
+	assert.Equal(t, byte(0), m.tos[10])
+
+	for name, listen := range map[string]map[interface{}]interface{}{
+		"dscp":      {"dscp": 64},
+		"map":       {"dscp_map": []interface{}{46}},
+		"map key":   {"dscp_map": map[interface{}]interface{}{"ef": 46}},
+		"map value": {"dscp_map": map[interface{}]interface{}{46: -1}},
+	} {
+		c.Settings["listen"] = listen
+		_, err = newDSCPMarkingFromConfig(c)
+		assert.Error(t, err, name)
+	}
+}
+
+func TestDSCPMarking_outer(t *testing.T) {
+	m := &dscpMarking{}
+	m.tos[0] = 1 << 2
+	m.tos[46] = 46 << 2
+	m.tos[10] = 10 << 2
+
+	// ef with ect(0) inside
+	assert.Equal(t, byte(46<<2), m.outer([]byte{0x45, 46<<2 | 2}))
+	// af11 inside ipv6, the traffic class straddles the first two bytes
+	assert.Equal(t, byte(10<<2), m.outer([]byte{0x60 | 10>>2, (10 & 3) << 6}))
+	assert.Equal(t, byte(1<<2), m.outer([]byte{0x45}))
+	assert.Equal(t, byte(1<<2), m.outer([]byte{0x00, 46 << 2}))
+}
+
+// tosConn records the traffic class of every packet written to it
+type tosConn struct {
+	recordConn
+	tos []byte
+}
+
+func (c *tosConn) WriteBatch(bufs [][]byte, addrs []*udp.Addr, tos []byte) error {
+	for i := range bufs {
+		c.sent = append(c.sent, addrs[i].String())
+		if tos != nil {
+			c.tos = append(c.tos, tos[i])
+		}
+	}
+	return nil
+}
+
+func TestDSCPWriter(t *testing.T) {
+	to := udp.NewAddr(net.IP{1, 2, 3, 4}, 4242)
+
+	tc := &tosConn{}
+	w := &dscpWriter{Conn: tc, bc: tc, tos: 46 << 2}
+	require.NoError(t, w.WriteTo([]byte{1}, to))
+	assert.Equal(t, []string{"1.2.3.4:4242"}, tc.sent)
+	assert.Equal(t, []byte{46 << 2}, tc.tos)
+
+	// A batch is sent whenever marking starts or stops so no packet goes out with the wrong traffic class
+	tc = &tosConn{}
+	batch := udp.NewSendBatch(tc, 8)
+	w = &dscpWriter{Conn: batch, batch: batch, bc: tc, tos: 10 << 2}
+	require.NoError(t, batch.WriteTo([]byte{1}, to))
+	require.NoError(t, w.WriteTo([]byte{2}, to))
+	assert.Equal(t, []string{"1.2.3.4:4242"}, tc.sent)
+	assert.Empty(t, tc.tos)
+	require.NoError(t, w.WriteTo([]byte{3}, to))
+	require.NoError(t, batch.Flush())
+	assert.Len(t, tc.sent, 3)
+	assert.Equal(t, []byte{10 << 2, 10 << 2}, tc.tos)
+}
+
+func TestWriteBatchDiverted_tos(t *testing.T) {
+	tc := &tosConn{}
+	bufs := [][]byte{{1}, {2}, {3}}
+	addrs := []*udp.Addr{udp.NewAddr(net.IP{1, 1, 1, 1}, 1), udp.NewAddr(net.IP{2, 2, 2, 2}, 2), udp.NewAddr(net.IP{3, 3, 3, 3}, 3)}
+	require.NoError(t, writeBatchDiverted(tc, bufs, addrs, []byte{4, 8, 12}, func(i int) bool { return i == 0 }))
+	assert.Equal(t, []string{"2.2.2.2:2", "3.3.3.3:3"}, tc.sent)
+	assert.Equal(t, []byte{8, 12}, tc.tos)
+}
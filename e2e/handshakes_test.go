@@ -16,6 +16,7 @@ import (
 	"github.com/slackhq/nebula/iputil"
 	"github.com/slackhq/nebula/udp"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"gopkg.in/yaml.v2"
 )
 
@@ -94,6 +95,127 @@ func TestGoodHandshake(t *testing.T) {
 	//TODO: assert hostmaps
 }
 
+func TestNegotiatedCipherHandshake(t *testing.T) {
+	// The two sides handshake with different ciphers, agree on a psk cipher, and mix in a hybrid kem secret
+	ca, _, caKey, _ := NewTestCaCert(time.Now(), time.Now().Add(10*time.Minute), []*net.IPNet{}, []*net.IPNet{}, []string{})
+	psk := "AQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQE="
+	myControl, myVpnIpNet, myUdpAddr, _ := newSimpleServer(ca, caKey, "me", net.IP{10, 0, 0, 1}, m{
+		"cipher":     "chachapoly",
+		"ciphers":    []string{"chachapoly_psk", "aes"},
+		"cipher_psk": psk,
+		"handshakes": m{"hybrid_kem": true},
+	})
+	theirControl, theirVpnIpNet, theirUdpAddr, _ := newSimpleServer(ca, caKey, "them", net.IP{10, 0, 0, 2}, m{
+		"ciphers":    []string{"chachapoly_psk", "aes"},
+		"cipher_psk": psk,
+		"handshakes": m{"hybrid_kem": true},
+	})
+
+	myControl.InjectLightHouseAddr(theirVpnIpNet.IP, theirUdpAddr)
+	theirControl.InjectLightHouseAddr(myVpnIpNet.IP, myUdpAddr)
+	myControl.Start()
+	theirControl.Start()
+
+	r := router.NewR(t, myControl, theirControl)
+	defer r.RenderFlow()
+
+	t.Log("Stand up the tunnel and make sure traffic flows both ways")
+	assertTunnel(t, myVpnIpNet.IP, theirVpnIpNet.IP, myControl, theirControl, r)
+	assertHostInfoPair(t, myUdpAddr, theirUdpAddr, myVpnIpNet.IP, theirVpnIpNet.IP, myControl, theirControl)
+
+	myControl.Stop()
+	theirControl.Stop()
+}
+
+func TestHandshakeCookie(t *testing.T) {
+	// They only take one handshake a second without a cookie, the other node uses it up so I have to prove my address
+	ca, _, caKey, _ := NewTestCaCert(time.Now(), time.Now().Add(10*time.Minute), []*net.IPNet{}, []*net.IPNet{}, []string{})
+	myControl, myVpnIpNet, myUdpAddr, _ := newSimpleServer(ca, caKey, "me", net.IP{10, 0, 0, 1}, nil)
+	otherControl, otherVpnIpNet, _, _ := newSimpleServer(ca, caKey, "other", net.IP{10, 0, 0, 3}, nil)
+	theirControl, theirVpnIpNet, theirUdpAddr, _ := newSimpleServer(ca, caKey, "them", net.IP{10, 0, 0, 2}, m{
+		"handshakes": m{"cookie_threshold": 1},
+	})
+
+	myControl.InjectLightHouseAddr(theirVpnIpNet.IP, theirUdpAddr)
+	otherControl.InjectLightHouseAddr(theirVpnIpNet.IP, theirUdpAddr)
+	myControl.Start()
+	otherControl.Start()
+	theirControl.Start()
+
+	t.Log("Other uses up the handshakes they take without a cookie")
+	otherControl.InjectTunUDPPacket(theirVpnIpNet.IP, 80, 80, []byte("Hi from other"))
+	theirControl.InjectUDPPacket(otherControl.GetFromUDP(true))
+	otherControl.InjectUDPPacket(theirControl.GetFromUDP(true))
+	otherControl.WaitForType(header.Message, header.MessageNone, theirControl)
+	assertUdpPacket(t, []byte("Hi from other"), theirControl.GetFromTun(true), otherVpnIpNet.IP, theirVpnIpNet.IP, 80, 80)
+
+	t.Log("My first handshake message gets a cookie reply")
+	myControl.InjectTunUDPPacket(theirVpnIpNet.IP, 80, 80, []byte("Hi from me"))
+	theirControl.InjectUDPPacket(myControl.GetFromUDP(true))
+	cookieReply := theirControl.GetFromUDP(true)
+	h := &header.H{}
+	require.NoError(t, h.Parse(cookieReply.Data))
+	assert.Equal(t, header.Handshake, h.Type)
+	assert.Equal(t, header.HandshakeCookieReply, h.Subtype)
+	assert.Nil(t, theirControl.GetHostInfoByVpnIp(iputil.Ip2VpnIp(myVpnIpNet.IP), false))
+
+	t.Log("I start over with the cookie and they answer")
+	myControl.InjectUDPPacket(cookieReply)
+	theirControl.InjectUDPPacket(myControl.GetFromUDP(true))
+	myControl.InjectUDPPacket(theirControl.GetFromUDP(true))
+	myControl.WaitForType(header.Message, header.MessageNone, theirControl)
+	assertUdpPacket(t, []byte("Hi from me"), theirControl.GetFromTun(true), myVpnIpNet.IP, theirVpnIpNet.IP, 80, 80)
+	assertHostInfoPair(t, myUdpAddr, theirUdpAddr, myVpnIpNet.IP, theirVpnIpNet.IP, myControl, theirControl)
+
+	myControl.Stop()
+	otherControl.Stop()
+	theirControl.Stop()
+}
+
+func TestAdditionalCerts(t *testing.T) {
+	// I hold certificates from two CAs, they only trust the second one
+	caA, _, caKeyA, caPEMA := NewTestCaCert(time.Now(), time.Now().Add(10*time.Minute), []*net.IPNet{}, []*net.IPNet{}, []string{})
+	caB, _, caKeyB, caPEMB := NewTestCaCert(time.Now(), time.Now().Add(10*time.Minute), []*net.IPNet{}, []*net.IPNet{}, []string{})
+
+	myVpnIpNet := &net.IPNet{IP: net.IP{10, 128, 0, 1}, Mask: net.IPMask{255, 255, 255, 0}}
+	_, _, myKeyB, myPEMB := NewTestCert(caB, caKeyB, "me", time.Now(), time.Now().Add(5*time.Minute), myVpnIpNet, nil, []string{})
+	myControl, _, myUdpAddr, _ := newSimpleServer(caA, caKeyA, "me", net.IP{10, 0, 0, 1}, m{
+		"pki": m{
+			"ca":               string(caPEMA) + string(caPEMB),
+			"additional_certs": []m{{"cert": string(myPEMB), "key": string(myKeyB)}},
+		},
+		"rekey": m{"packets": 5},
+	})
+	theirControl, theirVpnIpNet, theirUdpAddr, _ := newSimpleServer(caB, caKeyB, "them", net.IP{10, 0, 0, 2}, nil)
+
+	myControl.InjectLightHouseAddr(theirVpnIpNet.IP, theirUdpAddr)
+	theirControl.InjectLightHouseAddr(myVpnIpNet.IP, myUdpAddr)
+
+	r := router.NewR(t, myControl, theirControl)
+	defer r.RenderFlow()
+
+	myControl.Start()
+	theirControl.Start()
+
+	r.Log("They handshake with me and I answer with the certificate from the CA they trust")
+	theirControl.InjectTunUDPPacket(myVpnIpNet.IP, 80, 80, []byte("Hi from them"))
+	p := r.RouteForAllUntilTxTun(myControl)
+	assertUdpPacket(t, []byte("Hi from them"), p, theirVpnIpNet.IP, myVpnIpNet.IP, 80, 80)
+	assertTunnel(t, myVpnIpNet.IP, theirVpnIpNet.IP, myControl, theirControl, r)
+	first := myControl.GetHostInfoByVpnIp(iputil.Ip2VpnIp(theirVpnIpNet.IP), false).LocalIndex
+
+	r.Log("When I rekey I remember which certificate they trust")
+	for myControl.GetHostInfoByVpnIp(iputil.Ip2VpnIp(theirVpnIpNet.IP), false).LocalIndex == first {
+		assertTunnel(t, myVpnIpNet.IP, theirVpnIpNet.IP, myControl, theirControl, r)
+		time.Sleep(100 * time.Millisecond)
+	}
+	assertTunnel(t, myVpnIpNet.IP, theirVpnIpNet.IP, myControl, theirControl, r)
+
+	r.RenderHostmaps("Final hostmaps", myControl, theirControl)
+	myControl.Stop()
+	theirControl.Stop()
+}
+
 func TestWrongResponderHandshake(t *testing.T) {
 	ca, _, caKey, _ := NewTestCaCert(time.Now(), time.Now().Add(10*time.Minute), []*net.IPNet{}, []*net.IPNet{}, []string{})
 
@@ -370,6 +492,52 @@ func TestRelays(t *testing.T) {
 	//TODO: assert we actually used the relay even though it should be impossible for a tunnel to have occurred without it
 }
 
+func TestRelaysTwoHops(t *testing.T) {
+	ca, _, caKey, _ := NewTestCaCert(time.Now(), time.Now().Add(10*time.Minute), []*net.IPNet{}, []*net.IPNet{}, []string{})
+	myControl, myVpnIpNet, _, _ := newSimpleServer(ca, caKey, "me     ", net.IP{10, 0, 0, 1}, m{"relay": m{"use_relays": true}})
+	relay1Control, relay1VpnIpNet, relay1UdpAddr, _ := newSimpleServer(ca, caKey, "relay1 ", net.IP{10, 0, 0, 128}, m{"relay": m{"am_relay": true, "max_hops": 2}})
+	relay2Control, relay2VpnIpNet, relay2UdpAddr, _ := newSimpleServer(ca, caKey, "relay2 ", net.IP{10, 0, 0, 129}, m{"relay": m{"am_relay": true}})
+	theirControl, theirVpnIpNet, theirUdpAddr, _ := newSimpleServer(ca, caKey, "them   ", net.IP{10, 0, 0, 2}, m{"relay": m{"use_relays": true}})
+
+	// I can only reach relay1, relay1 can only reach relay2, and only relay2 can reach them
+	myControl.InjectLightHouseAddr(relay1VpnIpNet.IP, relay1UdpAddr)
+	myControl.InjectRelays(theirVpnIpNet.IP, []net.IP{relay1VpnIpNet.IP})
+	relay1Control.InjectLightHouseAddr(relay2VpnIpNet.IP, relay2UdpAddr)
+	relay1Control.InjectRelays(theirVpnIpNet.IP, []net.IP{relay2VpnIpNet.IP})
+	relay2Control.InjectLightHouseAddr(theirVpnIpNet.IP, theirUdpAddr)
+
+	// Build a router so we don't have to reason who gets which packet
+	r := router.NewR(t, myControl, relay1Control, relay2Control, theirControl)
+	defer r.RenderFlow()
+
+	// Start the servers
+	myControl.Start()
+	relay1Control.Start()
+	relay2Control.Start()
+	theirControl.Start()
+
+	t.Log("Trigger a handshake from me to them through both relays")
+	myControl.InjectTunUDPPacket(theirVpnIpNet.IP, 80, 80, []byte("Hi from me"))
+
+	p := r.RouteForAllUntilTxTun(theirControl)
+	r.Log("Assert the tunnel works")
+	assertUdpPacket(t, []byte("Hi from me"), p, myVpnIpNet.IP, theirVpnIpNet.IP, 80, 80)
+
+	r.Log("Assert them can answer through the chain")
+	theirControl.InjectTunUDPPacket(myVpnIpNet.IP, 80, 80, []byte("Hi from them"))
+	p = r.RouteForAllUntilTxTun(myControl)
+	assertUdpPacket(t, []byte("Hi from them"), p, theirVpnIpNet.IP, myVpnIpNet.IP, 80, 80)
+
+	assert.Nil(t, myControl.GetHostInfoByVpnIp(iputil.Ip2VpnIp(relay2VpnIpNet.IP), false))
+	assert.Nil(t, relay1Control.GetHostInfoByVpnIp(iputil.Ip2VpnIp(theirVpnIpNet.IP), false).CurrentRemote)
+	r.RenderHostmaps("Final hostmaps", myControl, relay1Control, relay2Control, theirControl)
+
+	myControl.Stop()
+	relay1Control.Stop()
+	relay2Control.Stop()
+	theirControl.Stop()
+}
+
 func TestStage1RaceRelays(t *testing.T) {
 	//NOTE: this is a race between me and relay resulting in a full tunnel from me to them via relay
 	ca, _, caKey, _ := NewTestCaCert(time.Now(), time.Now().Add(10*time.Minute), []*net.IPNet{}, []*net.IPNet{}, []string{})
@@ -808,6 +976,264 @@ func TestRehandshaking(t *testing.T) {
 	theirControl.Stop()
 }
 
+func TestRekey(t *testing.T) {
+	ca, _, caKey, _ := NewTestCaCert(time.Now(), time.Now().Add(10*time.Minute), []*net.IPNet{}, []*net.IPNet{}, []string{})
+	myControl, myVpnIpNet, myUdpAddr, myConfig := newSimpleServer(ca, caKey, "me  ", net.IP{10, 0, 0, 2}, m{
+		"rekey":  m{"packets": 10},
+		"timers": m{"connection_alive_interval": 1},
+	})
+	theirControl, theirVpnIpNet, theirUdpAddr, _ := newSimpleServer(ca, caKey, "them", net.IP{10, 0, 0, 1}, nil)
+
+	// Put their info in our lighthouse and vice versa
+	myControl.InjectLightHouseAddr(theirVpnIpNet.IP, theirUdpAddr)
+	theirControl.InjectLightHouseAddr(myVpnIpNet.IP, myUdpAddr)
+
+	// Build a router so we don't have to reason who gets which packet
+	r := router.NewR(t, myControl, theirControl)
+	defer r.RenderFlow()
+
+	// Start the servers
+	myControl.Start()
+	theirControl.Start()
+
+	t.Log("Stand up a tunnel between me and them")
+	assertTunnel(t, myVpnIpNet.IP, theirVpnIpNet.IP, myControl, theirControl, r)
+	first := myControl.GetHostInfoByVpnIp(iputil.Ip2VpnIp(theirVpnIpNet.IP), false).LocalIndex
+
+	r.Log("Send traffic until I have sent rekey.packets and the connection manager replaces the tunnel")
+	for myControl.GetHostInfoByVpnIp(iputil.Ip2VpnIp(theirVpnIpNet.IP), false).LocalIndex == first {
+		assertTunnel(t, myVpnIpNet.IP, theirVpnIpNet.IP, myControl, theirControl, r)
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	r.Log("Stop rekeying and spin until the old tunnel is gone")
+	rc, err := yaml.Marshal(myConfig.Settings)
+	assert.NoError(t, err)
+	var myNewConfig m
+	assert.NoError(t, yaml.Unmarshal(rc, &myNewConfig))
+	delete(myNewConfig, "rekey")
+	rc, err = yaml.Marshal(myNewConfig)
+	assert.NoError(t, err)
+	myConfig.ReloadConfigString(string(rc))
+
+	for len(myControl.GetHostmap().Indexes)+len(theirControl.GetHostmap().Indexes) > 2 {
+		assertTunnel(t, myVpnIpNet.IP, theirVpnIpNet.IP, myControl, theirControl, r)
+		t.Log("Connection manager hasn't ticked yet")
+		time.Sleep(time.Second)
+	}
+
+	assertTunnel(t, myVpnIpNet.IP, theirVpnIpNet.IP, myControl, theirControl, r)
+	assertHostInfoPair(t, myUdpAddr, theirUdpAddr, myVpnIpNet.IP, theirVpnIpNet.IP, myControl, theirControl)
+
+	r.RenderHostmaps("Final hostmaps", myControl, theirControl)
+	myControl.Stop()
+	theirControl.Stop()
+}
+
+func TestRequireGroups(t *testing.T) {
+	ca, _, caKey, _ := NewTestCaCert(time.Now(), time.Now().Add(10*time.Minute), []*net.IPNet{}, []*net.IPNet{}, []string{})
+	myControl, myVpnIpNet, myUdpAddr, _ := newSimpleServer(ca, caKey, "me  ", net.IP{10, 0, 0, 1}, nil)
+	theirControl, theirVpnIpNet, theirUdpAddr, theirConfig := newSimpleServer(ca, caKey, "them", net.IP{10, 0, 0, 2}, m{
+		"handshakes": m{"require_groups": []string{"admin"}},
+		"timers":     m{"connection_alive_interval": 1},
+	})
+
+	myControl.InjectLightHouseAddr(theirVpnIpNet.IP, theirUdpAddr)
+	theirControl.InjectLightHouseAddr(myVpnIpNet.IP, myUdpAddr)
+	myControl.Start()
+	theirControl.Start()
+
+	t.Log("They refuse my handshake since my certificate does not have the admin group")
+	myControl.InjectTunUDPPacket(theirVpnIpNet.IP, 80, 80, []byte("Hi from me"))
+	theirControl.InjectUDPPacket(myControl.GetFromUDP(true))
+	select {
+	case p := <-theirControl.GetUDPTxChan():
+		t.Fatalf("They answered a handshake they should have refused: %v", p)
+	case <-time.After(500 * time.Millisecond):
+	}
+	assert.Nil(t, theirControl.GetHostInfoByVpnIp(iputil.Ip2VpnIp(myVpnIpNet.IP), false))
+
+	reload := func(groups []string) {
+		rc, err := yaml.Marshal(theirConfig.Settings)
+		assert.NoError(t, err)
+		var theirNewConfig m
+		assert.NoError(t, yaml.Unmarshal(rc, &theirNewConfig))
+		theirNewConfig["handshakes"] = m{"require_groups": groups}
+		rc, err = yaml.Marshal(theirNewConfig)
+		assert.NoError(t, err)
+		theirConfig.ReloadConfigString(string(rc))
+	}
+
+	r := router.NewR(t, myControl, theirControl)
+	defer r.RenderFlow()
+
+	r.Log("Drop the requirement and my handshake goes through")
+	reload(nil)
+	p := r.RouteForAllUntilTxTun(theirControl)
+	assertUdpPacket(t, []byte("Hi from me"), p, myVpnIpNet.IP, theirVpnIpNet.IP, 80, 80)
+	assertTunnel(t, myVpnIpNet.IP, theirVpnIpNet.IP, myControl, theirControl, r)
+
+	r.Log("Require the group again and spin until they tear the tunnel down")
+	reload([]string{"admin"})
+	for theirControl.GetHostInfoByVpnIp(iputil.Ip2VpnIp(myVpnIpNet.IP), false) != nil {
+		t.Log("Connection manager hasn't ticked yet")
+		time.Sleep(time.Second)
+	}
+
+	r.RenderHostmaps("Final hostmaps", myControl, theirControl)
+	myControl.Stop()
+	theirControl.Stop()
+}
+
+func TestPins(t *testing.T) {
+	ca, _, caKey, _ := NewTestCaCert(time.Now(), time.Now().Add(10*time.Minute), []*net.IPNet{}, []*net.IPNet{}, []string{})
+	myControl, myVpnIpNet, myUdpAddr, _ := newSimpleServer(ca, caKey, "me  ", net.IP{10, 0, 0, 1}, nil)
+	theirControl, theirVpnIpNet, theirUdpAddr, theirConfig := newSimpleServer(ca, caKey, "them", net.IP{10, 0, 0, 2}, m{
+		"pki":    m{"pins": m{"10.128.0.1": "not me"}},
+		"timers": m{"connection_alive_interval": 1},
+	})
+
+	myControl.InjectLightHouseAddr(theirVpnIpNet.IP, theirUdpAddr)
+	theirControl.InjectLightHouseAddr(myVpnIpNet.IP, myUdpAddr)
+	myControl.Start()
+	theirControl.Start()
+
+	t.Log("They refuse my handshake since my certificate does not match their pin for me")
+	myControl.InjectTunUDPPacket(theirVpnIpNet.IP, 80, 80, []byte("Hi from me"))
+	theirControl.InjectUDPPacket(myControl.GetFromUDP(true))
+	select {
+	case p := <-theirControl.GetUDPTxChan():
+		t.Fatalf("They answered a handshake they should have refused: %v", p)
+	case <-time.After(500 * time.Millisecond):
+	}
+	assert.Nil(t, theirControl.GetHostInfoByVpnIp(iputil.Ip2VpnIp(myVpnIpNet.IP), false))
+
+	reload := func(pin string) {
+		rc, err := yaml.Marshal(theirConfig.Settings)
+		assert.NoError(t, err)
+		var theirNewConfig m
+		assert.NoError(t, yaml.Unmarshal(rc, &theirNewConfig))
+		pki := theirNewConfig["pki"].(map[interface{}]interface{})
+		pki["pins"] = m{myVpnIpNet.IP.String(): pin}
+		rc, err = yaml.Marshal(theirNewConfig)
+		assert.NoError(t, err)
+		theirConfig.ReloadConfigString(string(rc))
+	}
+
+	r := router.NewR(t, myControl, theirControl)
+	defer r.RenderFlow()
+
+	r.Log("Pin my certificate name and my handshake goes through")
+	reload("me  ")
+	p := r.RouteForAllUntilTxTun(theirControl)
+	assertUdpPacket(t, []byte("Hi from me"), p, myVpnIpNet.IP, theirVpnIpNet.IP, 80, 80)
+	assertTunnel(t, myVpnIpNet.IP, theirVpnIpNet.IP, myControl, theirControl, r)
+
+	r.Log("Pin a different fingerprint and spin until they tear the tunnel down")
+	reload("c99d4e650533b92061b09918e838a5a0a6aaee21eed1d12fd937682865936c72")
+	for theirControl.GetHostInfoByVpnIp(iputil.Ip2VpnIp(myVpnIpNet.IP), false) != nil {
+		t.Log("Connection manager hasn't ticked yet")
+		time.Sleep(time.Second)
+	}
+
+	r.RenderHostmaps("Final hostmaps", myControl, theirControl)
+	myControl.Stop()
+	theirControl.Stop()
+}
+
+func TestHandshakePSK(t *testing.T) {
+	ca, _, caKey, _ := NewTestCaCert(time.Now(), time.Now().Add(10*time.Minute), []*net.IPNet{}, []*net.IPNet{}, []string{})
+	psk := m{"secure": "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"}
+	member := func(name string, ip net.IP, overrides m) (*nebula.Control, *net.IPNet, *net.UDPAddr) {
+		vpnIpNet := &net.IPNet{IP: net.IP{ip[0], ip[1] + 128, ip[2], ip[3]}, Mask: net.IPMask{255, 255, 255, 0}}
+		_, _, key, pem := NewTestCert(ca, caKey, name, time.Now(), time.Now().Add(5*time.Minute), vpnIpNet, nil, []string{"secure"})
+		overrides["pki"] = m{"cert": string(pem), "key": string(key)}
+		control, _, udpAddr, _ := newSimpleServer(ca, caKey, name, ip, overrides)
+		return control, vpnIpNet, udpAddr
+	}
+
+	myControl, myVpnIpNet, myUdpAddr := member("me  ", net.IP{10, 0, 0, 1}, m{"handshakes": m{"psk": psk}})
+	theirControl, theirVpnIpNet, theirUdpAddr := member("them", net.IP{10, 0, 0, 2}, m{"handshakes": m{"psk": psk}})
+	evilControl, _, _ := member("evil", net.IP{10, 0, 0, 3}, m{})
+	otherControl, otherVpnIpNet, otherUdpAddr, _ := newSimpleServer(ca, caKey, "other", net.IP{10, 0, 0, 4}, nil)
+
+	myControl.InjectLightHouseAddr(theirVpnIpNet.IP, theirUdpAddr)
+	myControl.InjectLightHouseAddr(otherVpnIpNet.IP, otherUdpAddr)
+	evilControl.InjectLightHouseAddr(theirVpnIpNet.IP, theirUdpAddr)
+	theirControl.InjectLightHouseAddr(myVpnIpNet.IP, myUdpAddr)
+	myControl.Start()
+	theirControl.Start()
+	evilControl.Start()
+	otherControl.Start()
+
+	t.Log("They refuse a handshake from a certificate in the group without the pre-shared key")
+	evilControl.InjectTunUDPPacket(theirVpnIpNet.IP, 80, 80, []byte("Hi from evil"))
+	theirControl.InjectUDPPacket(evilControl.GetFromUDP(true))
+	select {
+	case p := <-theirControl.GetUDPTxChan():
+		t.Fatalf("They answered a handshake they should have refused: %v", p)
+	case <-time.After(500 * time.Millisecond):
+	}
+
+	r := router.NewR(t, myControl, theirControl, otherControl)
+	defer r.RenderFlow()
+
+	r.Log("We share the group and its key")
+	myControl.InjectTunUDPPacket(theirVpnIpNet.IP, 80, 80, []byte("Hi from me"))
+	p := r.RouteForAllUntilTxTun(theirControl)
+	assertUdpPacket(t, []byte("Hi from me"), p, myVpnIpNet.IP, theirVpnIpNet.IP, 80, 80)
+	assertTunnel(t, myVpnIpNet.IP, theirVpnIpNet.IP, myControl, theirControl, r)
+
+	r.Log("I guess other is in my group too, it is not and I retry without the key")
+	myControl.InjectTunUDPPacket(otherVpnIpNet.IP, 80, 80, []byte("Hi from me"))
+	p = r.RouteForAllUntilTxTun(otherControl)
+	assertUdpPacket(t, []byte("Hi from me"), p, myVpnIpNet.IP, otherVpnIpNet.IP, 80, 80)
+	assertTunnel(t, myVpnIpNet.IP, otherVpnIpNet.IP, myControl, otherControl, r)
+
+	r.RenderHostmaps("Final hostmaps", myControl, theirControl, otherControl)
+	myControl.Stop()
+	theirControl.Stop()
+	evilControl.Stop()
+	otherControl.Stop()
+}
+
+func TestHandshakePSKMixedCiphers(t *testing.T) {
+	// With a pre-shared key the first message is encrypted, the responder has to find the initiators cipher to read it
+	ca, _, caKey, _ := NewTestCaCert(time.Now(), time.Now().Add(10*time.Minute), []*net.IPNet{}, []*net.IPNet{}, []string{})
+	psk := m{"secure": "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"}
+	member := func(name string, ip net.IP, cipher string) (*nebula.Control, *net.IPNet, *net.UDPAddr) {
+		vpnIpNet := &net.IPNet{IP: net.IP{ip[0], ip[1] + 128, ip[2], ip[3]}, Mask: net.IPMask{255, 255, 255, 0}}
+		_, _, key, pem := NewTestCert(ca, caKey, name, time.Now(), time.Now().Add(5*time.Minute), vpnIpNet, nil, []string{"secure"})
+		control, _, udpAddr, _ := newSimpleServer(ca, caKey, name, ip, m{
+			"pki":        m{"cert": string(pem), "key": string(key)},
+			"cipher":     cipher,
+			"ciphers":    []string{"aes", "chachapoly"},
+			"handshakes": m{"psk": psk},
+		})
+		return control, vpnIpNet, udpAddr
+	}
+
+	myControl, myVpnIpNet, myUdpAddr := member("me  ", net.IP{10, 0, 0, 1}, "aes")
+	theirControl, theirVpnIpNet, theirUdpAddr := member("them", net.IP{10, 0, 0, 2}, "chachapoly")
+
+	myControl.InjectLightHouseAddr(theirVpnIpNet.IP, theirUdpAddr)
+	theirControl.InjectLightHouseAddr(myVpnIpNet.IP, myUdpAddr)
+	myControl.Start()
+	theirControl.Start()
+
+	r := router.NewR(t, myControl, theirControl)
+	defer r.RenderFlow()
+
+	r.Log("An aes initiator handshakes with a chachapoly responder")
+	myControl.InjectTunUDPPacket(theirVpnIpNet.IP, 80, 80, []byte("Hi from me"))
+	p := r.RouteForAllUntilTxTun(theirControl)
+	assertUdpPacket(t, []byte("Hi from me"), p, myVpnIpNet.IP, theirVpnIpNet.IP, 80, 80)
+	assertTunnel(t, myVpnIpNet.IP, theirVpnIpNet.IP, myControl, theirControl, r)
+
+	myControl.Stop()
+	theirControl.Stop()
+}
+
 func TestRehandshakingLoser(t *testing.T) {
 	// The purpose of this test is that the race loser renews their certificate and rehandshakes. The final tunnel
 	// Should be the one with the new certificate
@@ -974,3 +1400,69 @@ func TestRaceRegression(t *testing.T) {
 // Race loser renews and handshakes
 // Does race winner repin the cert to old?
 //TODO: add a test with many lies
+
+func TestTunnelEvents(t *testing.T) {
+	ca, _, caKey, _ := NewTestCaCert(time.Now(), time.Now().Add(10*time.Minute), []*net.IPNet{}, []*net.IPNet{}, []string{})
+	myControl, myVpnIpNet, myUdpAddr, _ := newSimpleServer(ca, caKey, "me  ", net.IP{10, 0, 0, 1}, nil)
+	theirControl, theirVpnIpNet, theirUdpAddr, _ := newSimpleServer(ca, caKey, "them", net.IP{10, 0, 0, 2}, nil)
+
+	myEvents := make(chan nebula.TunnelEvent, 10)
+	myControl.OnTunnelEvent(func(e nebula.TunnelEvent) { myEvents <- e })
+	theirEvents := make(chan nebula.TunnelEvent, 10)
+	theirControl.OnTunnelEvent(func(e nebula.TunnelEvent) { theirEvents <- e })
+
+	next := func(events chan nebula.TunnelEvent) nebula.TunnelEvent {
+		select {
+		case e := <-events:
+			return e
+		case <-time.After(time.Second):
+			t.Fatal("Timed out waiting for a tunnel event")
+		}
+		return nebula.TunnelEvent{}
+	}
+
+	myControl.InjectLightHouseAddr(theirVpnIpNet.IP, theirUdpAddr)
+	myControl.Start()
+	theirControl.Start()
+
+	r := router.NewR(t, myControl, theirControl)
+	defer r.RenderFlow()
+
+	r.Log("Complete a tunnel")
+	myControl.InjectTunUDPPacket(theirVpnIpNet.IP, 80, 80, []byte("Hi from me"))
+	p := r.RouteForAllUntilTxTun(theirControl)
+	assertUdpPacket(t, []byte("Hi from me"), p, myVpnIpNet.IP, theirVpnIpNet.IP, 80, 80)
+
+	e := next(myEvents)
+	assert.Equal(t, nebula.TunnelEventHandshakeStarted, e.Type)
+	assert.Equal(t, theirVpnIpNet.IP.To4(), e.VpnIp.To4())
+
+	e = next(myEvents)
+	assert.Equal(t, nebula.TunnelEventHandshakeCompleted, e.Type)
+	assert.True(t, e.Initiator)
+	assert.Equal(t, theirUdpAddr.String(), e.Remote.String())
+	assert.Equal(t, "them", e.Cert.Details.Name)
+
+	e = next(theirEvents)
+	assert.Equal(t, nebula.TunnelEventHandshakeCompleted, e.Type)
+	assert.False(t, e.Initiator)
+	assert.Equal(t, myUdpAddr.String(), e.Remote.String())
+	assert.Equal(t, "me  ", e.Cert.Details.Name)
+
+	r.Log("Close the tunnel from my side")
+	assert.True(t, myControl.CloseTunnel(iputil.Ip2VpnIp(theirVpnIpNet.IP), false))
+	theirControl.InjectUDPPacket(myControl.GetFromUDP(true))
+
+	e = next(myEvents)
+	assert.Equal(t, nebula.TunnelEventTunnelClosed, e.Type)
+	assert.Equal(t, "closed by control", e.Reason)
+
+	e = next(theirEvents)
+	assert.Equal(t, nebula.TunnelEventTunnelClosed, e.Type)
+	assert.Equal(t, "closed by the remote", e.Reason)
+	assert.Equal(t, myVpnIpNet.IP.To4(), e.VpnIp.To4())
+
+	r.RenderHostmaps("Final hostmaps", myControl, theirControl)
+	myControl.Stop()
+	theirControl.Stop()
+}
@@ -60,7 +60,7 @@ func NewTestCaCert(before, after time.Time, ips, subnets []*net.IPNet, groups []
 // NewTestCert will generate a signed certificate with the provided details.
 // Expiry times are defaulted if you do not pass them in
 func NewTestCert(ca *cert.NebulaCertificate, key []byte, name string, before, after time.Time, ip *net.IPNet, subnets []*net.IPNet, groups []string) (*cert.NebulaCertificate, []byte, []byte, []byte) {
-	issuer, err := ca.Sha256Sum()
+	issuer, err := ca.Fingerprint()
 	if err != nil {
 		panic(err)
 	}
@@ -0,0 +1,176 @@
+package nebula
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/slackhq/nebula/cert"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/enroll"
+	"github.com/slackhq/nebula/tpmclient"
+)
+
+const defaultEnrollTimeout = 30 * time.Second
+
+// enrollIfNeeded requests a certificate from pki.enroll.url when pki.cert does not exist yet. An existing pki.key is
+// reused, otherwise a new keypair is generated. The ca is written to pki.ca if it does not exist, when it does exist
+// the enrolled certificate must verify against it.
+func enrollIfNeeded(l *logrus.Logger, c *config.C, configTest bool) error {
+	url := c.GetString("pki.enroll.url", "")
+	if url == "" {
+		return nil
+	}
+
+	certPath := c.GetString("pki.cert", "")
+	keyPath := c.GetString("pki.key", "")
+	caPath := c.GetString("pki.ca", "")
+	for _, k := range []string{"pki.ca", "pki.cert", "pki.key"} {
+		if v := c.GetString(k, ""); v == "" || strings.Contains(v, "-----BEGIN") {
+			return fmt.Errorf("pki.enroll requires %s to be a file path", k)
+		}
+	}
+
+	if _, err := os.Stat(certPath); err == nil {
+		return nil
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("unable to stat pki.cert file %s: %s", certPath, err)
+	}
+
+	token := c.GetString("pki.enroll.token", "")
+	if tokenFile := c.GetString("pki.enroll.token_file", ""); tokenFile != "" {
+		b, err := os.ReadFile(tokenFile)
+		if err != nil {
+			return fmt.Errorf("unable to read pki.enroll.token_file %s: %s", tokenFile, err)
+		}
+		token = strings.TrimSpace(string(b))
+	}
+	if token == "" {
+		return errors.New("pki.enroll requires a token or token_file")
+	}
+
+	var curve cert.Curve
+	switch c.GetString("pki.enroll.curve", "25519") {
+	case "25519", "X25519", "Curve25519", "CURVE25519":
+		curve = cert.Curve_CURVE25519
+	case "P256":
+		curve = cert.Curve_P256
+	default:
+		return fmt.Errorf("invalid pki.enroll.curve: %s", c.GetString("pki.enroll.curve", ""))
+	}
+
+	// Testing the config must not write a key or use up the token
+	if configTest {
+		return fmt.Errorf("pki.cert %s does not exist, it is enrolled for when nebula starts", certPath)
+	}
+
+	var pub, priv []byte
+	rawKey, err := os.ReadFile(keyPath)
+	if tpmclient.IsURL(keyPath) {
+		// The key lives in a TPM, enroll its public key
+		pub, err = tpmPublicKey(keyPath, curve)
+		if err != nil {
+			return err
+		}
+
+	} else if err == nil {
+		rawKey, err = unwrapPKIKey(c, rawKey)
+		if err != nil {
+			return fmt.Errorf("error while unwrapping pki.key %s: %s", keyPath, err)
+		}
+
+		var keyCurve cert.Curve
+		priv, _, keyCurve, err = cert.UnmarshalPrivateKey(rawKey)
+		if err != nil {
+			return fmt.Errorf("error while unmarshaling pki.key %s: %s", keyPath, err)
+		}
+		if keyCurve != curve {
+			return fmt.Errorf("pki.key %s curve %s does not match pki.enroll.curve %s", keyPath, keyCurve, curve)
+		}
+		pub, err = enroll.PublicKey(curve, priv)
+		if err != nil {
+			return fmt.Errorf("error while deriving public key from pki.key %s: %s", keyPath, err)
+		}
+
+	} else if errors.Is(err, os.ErrNotExist) {
+		pub, priv, err = enroll.NewKeypair(curve)
+		if err != nil {
+			return fmt.Errorf("error while generating keypair: %s", err)
+		}
+		pemKey, err := wrapPKIKey(c, cert.MarshalPrivateKey(curve, priv))
+		if err != nil {
+			return fmt.Errorf("error while wrapping pki.key: %s", err)
+		}
+		if err = os.WriteFile(keyPath, pemKey, 0600); err != nil {
+			return fmt.Errorf("unable to write pki.key file %s: %s", keyPath, err)
+		}
+
+	} else {
+		return fmt.Errorf("unable to read pki.key file %s: %s", keyPath, err)
+	}
+
+	var caPool *cert.NebulaCAPool
+	writeCA := false
+	if rawCA, err := os.ReadFile(caPath); err == nil {
+		caPool, err = cert.NewCAPoolFromBytes(rawCA)
+		if err != nil && !errors.Is(err, cert.ErrExpired) {
+			return fmt.Errorf("error while adding CA certificate to CA trust store: %s", err)
+		}
+	} else if errors.Is(err, os.ErrNotExist) {
+		l.WithField("url", url).Warn("pki.ca does not exist, trusting the ca returned by the enrollment server")
+		writeCA = true
+	} else {
+		return fmt.Errorf("unable to read pki.ca file %s: %s", caPath, err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), c.GetDuration("pki.enroll.timeout", defaultEnrollTimeout))
+	defer cancel()
+
+	l.WithField("url", url).Info("Enrolling for a certificate")
+	res, err := enroll.Enroll(ctx, http.DefaultClient, url, token, curve, pub, caPool)
+	if err != nil {
+		return err
+	}
+
+	if writeCA {
+		if err = os.WriteFile(caPath, res.CAPEM, 0600); err != nil {
+			return fmt.Errorf("unable to write pki.ca file %s: %s", caPath, err)
+		}
+	}
+
+	b, err := res.Certificate.MarshalToPEM()
+	if err != nil {
+		return fmt.Errorf("error while marshalling enrolled certificate: %s", err)
+	}
+
+	if err = os.WriteFile(certPath, b, 0600); err != nil {
+		return fmt.Errorf("unable to write pki.cert file %s: %s", certPath, err)
+	}
+
+	l.WithField("cert", res.Certificate).Info("Enrolled certificate")
+	return nil
+}
+
+// tpmPublicKey returns the public key of the tpm key named by url, it must already exist, see nebula-cert keygen -tpm
+func tpmPublicKey(url string, curve cert.Curve) ([]byte, error) {
+	if curve != cert.Curve_P256 {
+		return nil, fmt.Errorf("pki.key is a tpm key which requires pki.enroll.curve P256")
+	}
+
+	client, err := openTPMKey(url)
+	if err != nil {
+		return nil, fmt.Errorf("error while opening pki.key %s: %s", url, err)
+	}
+	defer client.Close()
+
+	pub, err := client.GetPubKey()
+	if err != nil {
+		return nil, fmt.Errorf("error while reading pki.key %s: %s", url, err)
+	}
+	return pub, nil
+}
@@ -0,0 +1,120 @@
+package enroll
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/slackhq/nebula/cert"
+)
+
+// Result is what a node receives after a successful enrollment
+type Result struct {
+	Certificate *cert.NebulaCertificate
+	// CAPEM is the PEM encoded ca certificate the server signed with
+	CAPEM []byte
+}
+
+// Enroll requests a certificate for the public key from the server at url, which is the base address of the server.
+// If caPool is not nil the returned certificate must verify against it, otherwise it is verified against the ca the
+// server returns which is only as trustworthy as the connection to the server.
+func Enroll(ctx context.Context, client *http.Client, url string, token string, curve cert.Curve, pub []byte, caPool *cert.NebulaCAPool) (*Result, error) {
+	return do(ctx, client, url, Request{Token: token}, curve, pub, caPool)
+}
+
+// Renew requests a new certificate with the same identity as current for the public key, which may be the same key
+// current holds. url must be reachable over the mesh, see the package documentation.
+func Renew(ctx context.Context, client *http.Client, url string, current *cert.NebulaCertificate, pub []byte, caPool *cert.NebulaCAPool) (*Result, error) {
+	b, err := current.MarshalToPEM()
+	if err != nil {
+		return nil, fmt.Errorf("error while marshalling current certificate: %w", err)
+	}
+
+	res, err := do(ctx, client, url, Request{Renew: string(b)}, current.Details.Curve, pub, caPool)
+	if err != nil {
+		return nil, err
+	}
+
+	if res.Certificate.Details.Name != current.Details.Name {
+		return nil, fmt.Errorf("renewed certificate name %s does not match %s", res.Certificate.Details.Name, current.Details.Name)
+	}
+
+	return res, nil
+}
+
+func do(ctx context.Context, client *http.Client, url string, r Request, curve cert.Curve, pub []byte, caPool *cert.NebulaCAPool) (*Result, error) {
+	tbs := cert.NebulaCertificate{
+		Details: cert.NebulaCertificateDetails{
+			PublicKey: pub,
+			Curve:     curve,
+		},
+	}
+
+	tbsPEM, err := tbs.MarshalToPEM()
+	if err != nil {
+		return nil, fmt.Errorf("error while marshalling certificate request: %w", err)
+	}
+	r.Certificate = string(tbsPEM)
+
+	body, err := json.Marshal(r)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimSuffix(url, "/")+Path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("enrollment request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	rb, err := io.ReadAll(io.LimitReader(resp.Body, maxRequestSize))
+	if err != nil {
+		return nil, fmt.Errorf("error while reading enrollment response: %w", err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		var er errorResponse
+		if json.Unmarshal(rb, &er) == nil && er.Error != "" {
+			return nil, fmt.Errorf("enrollment rejected: %s", er.Error)
+		}
+		return nil, fmt.Errorf("enrollment rejected: %s", resp.Status)
+	}
+
+	var er Response
+	if err := json.Unmarshal(rb, &er); err != nil {
+		return nil, fmt.Errorf("invalid enrollment response: %w", err)
+	}
+
+	nc, _, err := cert.UnmarshalNebulaCertificateFromPEM([]byte(er.Certificate))
+	if err != nil {
+		return nil, fmt.Errorf("invalid certificate in enrollment response: %w", err)
+	}
+
+	if !bytes.Equal(nc.Details.PublicKey, pub) {
+		return nil, fmt.Errorf("enrolled certificate does not contain our public key")
+	}
+
+	if caPool == nil {
+		caPool, err = cert.NewCAPoolFromBytes([]byte(er.CA))
+		if err != nil {
+			return nil, fmt.Errorf("invalid ca in enrollment response: %w", err)
+		}
+	}
+
+	if ok, err := nc.Verify(time.Now(), caPool); !ok {
+		return nil, fmt.Errorf("enrolled certificate is not valid: %w", err)
+	}
+
+	return &Result{Certificate: nc, CAPEM: []byte(er.CA)}, nil
+}
@@ -0,0 +1,134 @@
+// Package enroll implements online enrollment of node certificates.
+//
+// A node generates its own keypair and sends an unsigned certificate, carrying only the public key and curve, along
+// with an enrollment token to an enrollment server. The server asks an Authorizer what identity the token grants,
+// signs a certificate for that identity with the CA key, and returns it with the CA certificate. The private key never
+// leaves the node.
+//
+// The protocol is a single JSON request over HTTP(S):
+//
+//	POST /v1/enroll
+//	{"token": "...", "certificate": "<PEM of the unsigned certificate>"}
+//
+//	200 OK
+//	{"certificate": "<PEM of the signed certificate>", "ca": "<PEM of the ca certificate>"}
+//
+// Any other status carries {"error": "..."}. The server can listen on the overlay address of an already enrolled
+// host as easily as on an underlay address, TLS should be used for the latter.
+//
+// A node renews by sending its current certificate in place of a token:
+//
+//	{"renew": "<PEM of the current certificate>", "certificate": "<PEM of the unsigned certificate>"}
+//
+// Renewals are authenticated by the mesh itself, the request must arrive over the overlay from an address in the
+// current certificate. Nebula has already proven the sender holds the key for that certificate during the handshake.
+// The renewed certificate carries the same identity and lifetime as the current one, optionally with a new key.
+package enroll
+
+import (
+	"context"
+	"crypto/ecdh"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"github.com/slackhq/nebula/cert"
+	"golang.org/x/crypto/curve25519"
+)
+
+// Path is where the enrollment server accepts requests
+const Path = "/v1/enroll"
+
+var (
+	ErrInvalidToken = errors.New("invalid enrollment token")
+	ErrTokenUsed    = errors.New("enrollment token has already been used")
+	ErrRenewDenied  = errors.New("renewal denied")
+)
+
+// Request is sent by a node to ask for a certificate
+type Request struct {
+	Token       string `json:"token,omitempty"`
+	Renew       string `json:"renew,omitempty"`
+	Certificate string `json:"certificate"`
+}
+
+// Response is returned by the server on success
+type Response struct {
+	Certificate string `json:"certificate"`
+	CA          string `json:"ca"`
+}
+
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+// Grant is the identity an Authorizer allows a token to enroll as. A zero Duration means the certificate is valid
+// until 1 second before the CA expires.
+type Grant struct {
+	Name     string
+	Ips      []*net.IPNet
+	Groups   []string
+	Subnets  []*net.IPNet
+	Duration time.Duration
+}
+
+// Authorizer validates an enrollment token. The requested certificate is passed along for authorizers that want to
+// inspect it, only its public key and curve are used when signing.
+type Authorizer interface {
+	Authorize(ctx context.Context, token string, req *cert.NebulaCertificate) (*Grant, error)
+}
+
+// TokenConsumer is implemented by authorizers whose tokens are single use. Authorize reserves the token, the server
+// calls Consume once the certificate has been issued or Release if issuing it failed so the token can be tried again.
+type TokenConsumer interface {
+	Consume(token string)
+	Release(token string)
+}
+
+// NewKeypair generates a nebula keypair for the curve, returning the public and private keys
+func NewKeypair(curve cert.Curve) ([]byte, []byte, error) {
+	switch curve {
+	case cert.Curve_CURVE25519:
+		priv := make([]byte, 32)
+		if _, err := io.ReadFull(rand.Reader, priv); err != nil {
+			return nil, nil, err
+		}
+
+		pub, err := curve25519.X25519(priv, curve25519.Basepoint)
+		if err != nil {
+			return nil, nil, err
+		}
+		return pub, priv, nil
+
+	case cert.Curve_P256:
+		key, err := ecdh.P256().GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, nil, err
+		}
+		return key.PublicKey().Bytes(), key.Bytes(), nil
+
+	default:
+		return nil, nil, fmt.Errorf("invalid curve: %s", curve)
+	}
+}
+
+// PublicKey derives the public key for an existing nebula private key
+func PublicKey(curve cert.Curve, priv []byte) ([]byte, error) {
+	switch curve {
+	case cert.Curve_CURVE25519:
+		return curve25519.X25519(priv, curve25519.Basepoint)
+
+	case cert.Curve_P256:
+		key, err := ecdh.P256().NewPrivateKey(priv)
+		if err != nil {
+			return nil, err
+		}
+		return key.PublicKey().Bytes(), nil
+
+	default:
+		return nil, fmt.Errorf("invalid curve: %s", curve)
+	}
+}
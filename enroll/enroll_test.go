@@ -0,0 +1,244 @@
+package enroll
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/slackhq/nebula/cert"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ed25519"
+)
+
+func newTestCA(t *testing.T) (*cert.NebulaCertificate, []byte) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	ca := &cert.NebulaCertificate{
+		Details: cert.NebulaCertificateDetails{
+			Name:      "ca",
+			NotBefore: time.Now().Add(-time.Minute),
+			NotAfter:  time.Now().Add(time.Hour),
+			PublicKey: pub,
+			IsCA:      true,
+		},
+	}
+	require.NoError(t, ca.Sign(cert.Curve_CURVE25519, priv))
+	return ca, priv
+}
+
+func TestEnroll(t *testing.T) {
+	l := test.NewLogger()
+	ca, caKey := newTestCA(t)
+
+	_, ipNet, _ := net.ParseCIDR("10.1.0.0/16")
+	ipNet.IP = net.ParseIP("10.1.0.5").To4()
+	authorizer := NewTokenAuthorizer(map[string]*Grant{
+		"good": {Name: "node-5", Ips: []*net.IPNet{ipNet}, Groups: []string{"web"}, Duration: time.Minute * 10},
+		"long": {Name: "node-6", Ips: []*net.IPNet{ipNet}, Duration: time.Hour * 24},
+	})
+
+	s, err := NewServer(l, ca, caKey, authorizer)
+	require.NoError(t, err)
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	caPool := cert.NewCAPool()
+	caPEM, _ := ca.MarshalToPEM()
+	_, err = caPool.AddCACertificate(caPEM)
+	require.NoError(t, err)
+
+	pub, priv, err := NewKeypair(cert.Curve_CURVE25519)
+	require.NoError(t, err)
+
+	res, err := Enroll(context.Background(), ts.Client(), ts.URL+"/", "good", cert.Curve_CURVE25519, pub, caPool)
+	require.NoError(t, err)
+	assert.Equal(t, "node-5", res.Certificate.Details.Name)
+	assert.Equal(t, "10.1.0.5/16", res.Certificate.Details.Ips[0].String())
+	assert.Equal(t, []string{"web"}, res.Certificate.Details.Groups)
+	assert.Equal(t, caPEM, res.CAPEM)
+	assert.NoError(t, res.Certificate.VerifyPrivateKey(cert.Curve_CURVE25519, priv))
+	assert.WithinDuration(t, time.Now().Add(time.Minute*10), res.Certificate.Details.NotAfter, time.Second*5)
+
+	// Tokens are single use
+	_, err = Enroll(context.Background(), ts.Client(), ts.URL, "good", cert.Curve_CURVE25519, pub, caPool)
+	assert.EqualError(t, err, "enrollment rejected: enrollment token has already been used")
+
+	_, err = Enroll(context.Background(), ts.Client(), ts.URL, "nope", cert.Curve_CURVE25519, pub, caPool)
+	assert.EqualError(t, err, "enrollment rejected: invalid enrollment token")
+
+	// Curve mismatch is rejected before the token is consumed
+	p256Pub, _, err := NewKeypair(cert.Curve_P256)
+	require.NoError(t, err)
+	_, err = Enroll(context.Background(), ts.Client(), ts.URL, "long", cert.Curve_P256, p256Pub, caPool)
+	assert.EqualError(t, err, "enrollment rejected: certificate curve P256 does not match ca curve CURVE25519")
+
+	// Without a ca pool the returned ca is trusted, the duration is capped by the ca
+	res, err = Enroll(context.Background(), ts.Client(), ts.URL, "long", cert.Curve_CURVE25519, pub, nil)
+	require.NoError(t, err)
+	assert.Equal(t, ca.Details.NotAfter.Add(-time.Second).Unix(), res.Certificate.Details.NotAfter.Unix())
+
+	// A pool that does not contain the signing ca is rejected
+	otherCA, _ := newTestCA(t)
+	otherPEM, _ := otherCA.MarshalToPEM()
+	otherPool, err := cert.NewCAPoolFromBytes(otherPEM)
+	require.NoError(t, err)
+	authorizer.tokens["other"] = &Grant{Name: "node-7", Ips: []*net.IPNet{ipNet}}
+	_, err = Enroll(context.Background(), ts.Client(), ts.URL, "other", cert.Curve_CURVE25519, pub, otherPool)
+	assert.EqualError(t, err, "enrolled certificate is not valid: could not find ca for the certificate")
+}
+
+func TestEnroll_transparencyLog(t *testing.T) {
+	l := test.NewLogger()
+	ca, caKey := newTestCA(t)
+
+	_, ipNet, _ := net.ParseCIDR("10.1.0.5/16")
+	s, err := NewServer(l, ca, caKey, NewTokenAuthorizer(map[string]*Grant{
+		"good": {Name: "node-5", Ips: []*net.IPNet{ipNet}},
+	}))
+	require.NoError(t, err)
+
+	fl, err := cert.OpenFileLog(t.TempDir())
+	require.NoError(t, err)
+	s.SetLog(fl)
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	caPEM, _ := ca.MarshalToPEM()
+	caPool, err := cert.NewCAPoolFromBytes(caPEM)
+	require.NoError(t, err)
+	_, err = caPool.AddTransparencyLog(fl.PublicKey().MarshalToPEM())
+	require.NoError(t, err)
+	caPool.RequireInclusionProof(true)
+
+	pub, _, err := NewKeypair(cert.Curve_CURVE25519)
+	require.NoError(t, err)
+
+	// A certificate that could not be logged is not handed out and does not use up the token
+	s.SetLog(failingLog{})
+	_, err = Enroll(context.Background(), ts.Client(), ts.URL, "good", cert.Curve_CURVE25519, pub, caPool)
+	assert.EqualError(t, err, "enrollment rejected: error while submitting to the transparency log: log is down")
+
+	s.SetLog(fl)
+	res, err := Enroll(context.Background(), ts.Client(), ts.URL, "good", cert.Curve_CURVE25519, pub, caPool)
+	require.NoError(t, err)
+	require.NotNil(t, res.Certificate.InclusionProof)
+	assert.Equal(t, fl.PublicKey().ID(), res.Certificate.InclusionProof.LogID)
+}
+
+type failingLog struct{}
+
+func (failingLog) Submit(context.Context, *cert.NebulaCertificate) (*cert.InclusionProof, error) {
+	return nil, errors.New("log is down")
+}
+
+func TestTokenAuthorizer(t *testing.T) {
+	a := NewTokenAuthorizer(map[string]*Grant{"good": {Name: "node"}})
+
+	_, err := a.Authorize(context.Background(), "good", nil)
+	require.NoError(t, err)
+
+	// A reserved token can not be used by another request
+	_, err = a.Authorize(context.Background(), "good", nil)
+	assert.EqualError(t, err, "enrollment token has already been used: by a request in progress")
+
+	a.Release("good")
+	_, err = a.Authorize(context.Background(), "good", nil)
+	require.NoError(t, err)
+
+	a.Consume("good")
+	_, err = a.Authorize(context.Background(), "good", nil)
+	assert.ErrorIs(t, err, ErrTokenUsed)
+}
+
+func TestServer_ServeHTTP(t *testing.T) {
+	l := test.NewLogger()
+	ca, caKey := newTestCA(t)
+	s, err := NewServer(l, ca, caKey, NewTokenAuthorizer(nil))
+	require.NoError(t, err)
+
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest(http.MethodGet, Path, nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, w.Code)
+
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/nope", nil))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest(http.MethodPost, Path, nil))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.JSONEq(t, `{"error":"invalid request body"}`, w.Body.String())
+}
+
+func TestRenew(t *testing.T) {
+	l := test.NewLogger()
+	ca, caKey := newTestCA(t)
+
+	// httptest listens on loopback so a certificate for 127.0.0.1 looks like it came over the mesh
+	_, ipNet, _ := net.ParseCIDR("127.0.0.0/8")
+	ipNet.IP = net.ParseIP("127.0.0.1").To4()
+	authorizer := NewTokenAuthorizer(map[string]*Grant{
+		"good": {Name: "node-1", Ips: []*net.IPNet{ipNet}, Groups: []string{"web"}, Duration: time.Minute * 10},
+	})
+
+	s, err := NewServer(l, ca, caKey, authorizer)
+	require.NoError(t, err)
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	caPEM, _ := ca.MarshalToPEM()
+	caPool, err := cert.NewCAPoolFromBytes(caPEM)
+	require.NoError(t, err)
+
+	pub, _, err := NewKeypair(cert.Curve_CURVE25519)
+	require.NoError(t, err)
+	res, err := Enroll(context.Background(), ts.Client(), ts.URL, "good", cert.Curve_CURVE25519, pub, caPool)
+	require.NoError(t, err)
+	current := res.Certificate
+
+	newPub, newPriv, err := NewKeypair(cert.Curve_CURVE25519)
+	require.NoError(t, err)
+
+	_, err = Renew(context.Background(), ts.Client(), ts.URL, current, newPub, caPool)
+	assert.EqualError(t, err, "enrollment rejected: renewal denied: renewals are not enabled")
+
+	s.EnableRenewal()
+	res, err = Renew(context.Background(), ts.Client(), ts.URL, current, newPub, caPool)
+	require.NoError(t, err)
+	assert.Equal(t, "node-1", res.Certificate.Details.Name)
+	assert.Equal(t, current.Details.Ips, res.Certificate.Details.Ips)
+	assert.Equal(t, []string{"web"}, res.Certificate.Details.Groups)
+	assert.NoError(t, res.Certificate.VerifyPrivateKey(cert.Curve_CURVE25519, newPriv))
+	assert.WithinDuration(t, time.Now().Add(time.Minute*10), res.Certificate.Details.NotAfter, time.Second*5)
+
+	// Requests that did not come from the certificate's address are refused
+	req := &Request{Renew: mustPEM(t, current), Certificate: mustPEM(t, &cert.NebulaCertificate{Details: cert.NebulaCertificateDetails{PublicKey: newPub}})}
+	_, err = s.Renew(context.Background(), req, net.ParseIP("127.0.0.2"), net.ParseIP("127.0.0.1"))
+	assert.ErrorIs(t, err, ErrRenewDenied)
+
+	// As are requests that arrived on an underlay address
+	_, err = s.Renew(context.Background(), req, net.ParseIP("127.0.0.1"), net.ParseIP("192.168.0.1"))
+	assert.ErrorIs(t, err, ErrRenewDenied)
+
+	// Certificates from another ca can not be renewed
+	otherCA, otherKey := newTestCA(t)
+	other, err := NewServer(l, otherCA, otherKey, NewTokenAuthorizer(nil))
+	require.NoError(t, err)
+	other.EnableRenewal()
+	_, err = other.Renew(context.Background(), req, net.ParseIP("127.0.0.1"), net.ParseIP("127.0.0.1"))
+	assert.EqualError(t, err, "renewal denied: certificate was not issued by this ca")
+}
+
+func mustPEM(t *testing.T, nc *cert.NebulaCertificate) string {
+	b, err := nc.MarshalToPEM()
+	require.NoError(t, err)
+	return string(b)
+}
@@ -0,0 +1,334 @@
+package enroll
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/slackhq/nebula/cert"
+)
+
+// maxRequestSize bounds the request body, an unsigned certificate is well under this
+const maxRequestSize = 64 * 1024
+
+// Server signs certificates for nodes that present a valid enrollment token
+type Server struct {
+	ca         *cert.NebulaCertificate
+	caPEM      []byte
+	caKey      []byte
+	issuer     string
+	authorizer Authorizer
+	allowRenew bool
+	log        cert.LogSubmitter
+	l          *logrus.Logger
+}
+
+// NewServer creates an enrollment server that signs with the provided CA
+func NewServer(l *logrus.Logger, ca *cert.NebulaCertificate, caKey []byte, authorizer Authorizer) (*Server, error) {
+	if !ca.Details.IsCA {
+		return nil, cert.ErrNotCA
+	}
+
+	if err := ca.VerifyPrivateKey(ca.Details.Curve, caKey); err != nil {
+		return nil, fmt.Errorf("ca certificate does not match private key: %w", err)
+	}
+
+	caPEM, err := ca.MarshalToPEM()
+	if err != nil {
+		return nil, fmt.Errorf("error while marshalling ca certificate: %w", err)
+	}
+
+	issuer, err := ca.Fingerprint()
+	if err != nil {
+		return nil, fmt.Errorf("error while getting ca fingerprint: %w", err)
+	}
+
+	return &Server{
+		ca:         ca,
+		caPEM:      caPEM,
+		caKey:      caKey,
+		issuer:     issuer,
+		authorizer: authorizer,
+		l:          l,
+	}, nil
+}
+
+// EnableRenewal allows nodes to renew their certificate without a token. Only enable this when the server listens on
+// an overlay address, renewals are authenticated by the request arriving over the mesh from the certificate's address.
+func (s *Server) EnableRenewal() {
+	s.allowRenew = true
+}
+
+// SetLog submits every issued certificate to a transparency log, the inclusion proof is returned with the certificate.
+// A certificate is not handed out if it could not be logged.
+func (s *Server) SetLog(log cert.LogSubmitter) {
+	s.log = log
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != Path {
+		writeError(w, http.StatusNotFound, "not found")
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	var req Request
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxRequestSize)).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+
+	var resp *Response
+	var err error
+	if req.Renew != "" {
+		var local net.Addr
+		if v, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+			local = v
+		}
+		resp, err = s.Renew(r.Context(), &req, addrIP(r.RemoteAddr), addrIP(local))
+	} else {
+		resp, err = s.Enroll(r.Context(), &req)
+	}
+
+	if err != nil {
+		status := http.StatusBadRequest
+		if errors.Is(err, ErrInvalidToken) || errors.Is(err, ErrTokenUsed) || errors.Is(err, ErrRenewDenied) {
+			status = http.StatusForbidden
+		}
+
+		s.l.WithError(err).WithField("remoteAddr", r.RemoteAddr).Warn("Rejected enrollment request")
+		writeError(w, status, err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(resp)
+}
+
+// Enroll validates the request and signs a certificate for the identity granted to its token
+func (s *Server) Enroll(ctx context.Context, req *Request) (*Response, error) {
+	tbs, err := s.parseRequest(req)
+	if err != nil {
+		return nil, err
+	}
+
+	grant, err := s.authorizer.Authorize(ctx, req.Token, tbs)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := s.issue(ctx, grant, tbs.Details.PublicKey)
+	if tc, ok := s.authorizer.(TokenConsumer); ok {
+		if err != nil {
+			tc.Release(req.Token)
+		} else {
+			tc.Consume(req.Token)
+		}
+	}
+	return resp, err
+}
+
+// Renew signs a new certificate with the same identity as the node's current certificate. remote is the address the
+// request came from and local is the address it arrived on, both must be within the current certificate's networks
+// which shows the request came over the mesh from the holder of the certificate.
+func (s *Server) Renew(ctx context.Context, req *Request, remote, local net.IP) (*Response, error) {
+	if !s.allowRenew {
+		return nil, fmt.Errorf("%w: renewals are not enabled", ErrRenewDenied)
+	}
+
+	tbs, err := s.parseRequest(req)
+	if err != nil {
+		return nil, err
+	}
+
+	current, _, err := cert.UnmarshalNebulaCertificateFromPEM([]byte(req.Renew))
+	if err != nil {
+		return nil, fmt.Errorf("invalid certificate to renew: %w", err)
+	}
+
+	if current.Details.IsCA || current.Details.Issuer != s.issuer || !current.CheckSignature(s.ca.Details.PublicKey) {
+		return nil, fmt.Errorf("%w: certificate was not issued by this ca", ErrRenewDenied)
+	}
+
+	if current.Expired(time.Now()) {
+		return nil, fmt.Errorf("%w: certificate is expired", ErrRenewDenied)
+	}
+
+	var fromHolder, overMesh bool
+	for _, ip := range current.Details.Ips {
+		if ip.IP.Equal(remote) {
+			fromHolder = true
+		}
+		if local != nil && ip.Contains(local) {
+			overMesh = true
+		}
+	}
+
+	if !fromHolder || !overMesh {
+		return nil, fmt.Errorf("%w: request for %s did not come over the mesh from its address, remote: %s local: %s", ErrRenewDenied, current.Details.Name, remote, local)
+	}
+
+	return s.issue(ctx, &Grant{
+		Name:     current.Details.Name,
+		Ips:      current.Details.Ips,
+		Groups:   current.Details.Groups,
+		Subnets:  current.Details.Subnets,
+		Duration: current.Details.NotAfter.Sub(current.Details.NotBefore),
+	}, tbs.Details.PublicKey)
+}
+
+// parseRequest returns the unsigned certificate carrying the node's public key
+func (s *Server) parseRequest(req *Request) (*cert.NebulaCertificate, error) {
+	tbs, _, err := cert.UnmarshalNebulaCertificateFromPEM([]byte(req.Certificate))
+	if err != nil {
+		return nil, fmt.Errorf("invalid certificate request: %w", err)
+	}
+
+	if tbs.Details.IsCA {
+		return nil, fmt.Errorf("refusing to sign a ca certificate")
+	}
+
+	if tbs.Details.Curve != s.ca.Details.Curve {
+		return nil, fmt.Errorf("certificate curve %s does not match ca curve %s", tbs.Details.Curve, s.ca.Details.Curve)
+	}
+
+	if len(tbs.Details.PublicKey) == 0 {
+		return nil, fmt.Errorf("certificate request is missing a public key")
+	}
+
+	return tbs, nil
+}
+
+func (s *Server) issue(ctx context.Context, grant *Grant, pub []byte) (*Response, error) {
+	now := time.Now()
+	notAfter := s.ca.Details.NotAfter.Add(-time.Second)
+	if grant.Duration > 0 && now.Add(grant.Duration).Before(notAfter) {
+		notAfter = now.Add(grant.Duration)
+	}
+
+	nc := cert.NebulaCertificate{
+		Details: cert.NebulaCertificateDetails{
+			Name:      grant.Name,
+			Ips:       grant.Ips,
+			Groups:    grant.Groups,
+			Subnets:   grant.Subnets,
+			NotBefore: now,
+			NotAfter:  notAfter,
+			PublicKey: pub,
+			IsCA:      false,
+			Issuer:    s.issuer,
+			Curve:     s.ca.Details.Curve,
+		},
+	}
+
+	if err := nc.CheckRootConstrains(s.ca); err != nil {
+		return nil, fmt.Errorf("refusing to sign, root certificate constraints violated: %w", err)
+	}
+
+	if err := nc.Sign(s.ca.Details.Curve, s.caKey); err != nil {
+		return nil, fmt.Errorf("error while signing: %w", err)
+	}
+
+	if s.log != nil {
+		p, err := s.log.Submit(ctx, &nc)
+		if err != nil {
+			return nil, fmt.Errorf("error while submitting to the transparency log: %w", err)
+		}
+		nc.InclusionProof = p
+	}
+
+	b, err := nc.MarshalToPEM()
+	if err != nil {
+		return nil, fmt.Errorf("error while marshalling certificate: %w", err)
+	}
+
+	s.l.WithField("cert", &nc).Info("Issued node certificate")
+	return &Response{Certificate: string(b), CA: string(s.caPEM)}, nil
+}
+
+// addrIP extracts the ip from a net.Addr or a host:port string
+func addrIP(addr any) net.IP {
+	var s string
+	switch a := addr.(type) {
+	case string:
+		s = a
+	case net.Addr:
+		s = a.String()
+	default:
+		return nil
+	}
+
+	host, _, err := net.SplitHostPort(s)
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
+
+func writeError(w http.ResponseWriter, status int, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(errorResponse{Error: msg})
+}
+
+// TokenAuthorizer grants identities from a fixed set of tokens, each token can only be used for one issued certificate
+type TokenAuthorizer struct {
+	sync.Mutex
+	tokens map[string]*Grant
+	// reserved are the tokens of requests that are being issued a certificate
+	reserved map[string]bool
+}
+
+func NewTokenAuthorizer(tokens map[string]*Grant) *TokenAuthorizer {
+	return &TokenAuthorizer{tokens: tokens, reserved: map[string]bool{}}
+}
+
+func (a *TokenAuthorizer) Authorize(_ context.Context, token string, _ *cert.NebulaCertificate) (*Grant, error) {
+	a.Lock()
+	defer a.Unlock()
+
+	grant, ok := a.tokens[token]
+	if !ok {
+		return nil, ErrInvalidToken
+	}
+
+	if grant == nil {
+		return nil, ErrTokenUsed
+	}
+
+	if a.reserved[token] {
+		return nil, fmt.Errorf("%w: by a request in progress", ErrTokenUsed)
+	}
+
+	a.reserved[token] = true
+	return grant, nil
+}
+
+// Consume uses up a token once a certificate has been issued for it
+func (a *TokenAuthorizer) Consume(token string) {
+	a.Lock()
+	defer a.Unlock()
+
+	delete(a.reserved, token)
+	// Keep the key around so a replay is reported as a used token
+	if _, ok := a.tokens[token]; ok {
+		a.tokens[token] = nil
+	}
+}
+
+// Release returns a token whose request failed to be issued a certificate
+func (a *TokenAuthorizer) Release(token string) {
+	a.Lock()
+	defer a.Unlock()
+	delete(a.reserved, token)
+}
@@ -0,0 +1,90 @@
+package nebula
+
+import (
+	"crypto/rand"
+	"net"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/slackhq/nebula/cert"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/enroll"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ed25519"
+)
+
+func TestEnrollIfNeeded(t *testing.T) {
+	l := test.NewLogger()
+
+	caPub, caKey, _ := ed25519.GenerateKey(rand.Reader)
+	ca := &cert.NebulaCertificate{
+		Details: cert.NebulaCertificateDetails{
+			Name:      "ca",
+			NotBefore: time.Now().Add(-time.Minute),
+			NotAfter:  time.Now().Add(time.Hour),
+			PublicKey: caPub,
+			IsCA:      true,
+		},
+	}
+	require.NoError(t, ca.Sign(cert.Curve_CURVE25519, caKey))
+
+	_, ipNet, _ := net.ParseCIDR("10.1.0.0/16")
+	ipNet.IP = net.ParseIP("10.1.0.5").To4()
+	s, err := enroll.NewServer(l, ca, caKey, enroll.NewTokenAuthorizer(map[string]*enroll.Grant{
+		"token": {Name: "node", Ips: []*net.IPNet{ipNet}},
+	}))
+	require.NoError(t, err)
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	dir := t.TempDir()
+	c := config.NewC(l)
+	c.Settings["pki"] = map[interface{}]interface{}{
+		"ca":   filepath.Join(dir, "ca.crt"),
+		"cert": filepath.Join(dir, "host.crt"),
+		"key":  filepath.Join(dir, "host.key"),
+	}
+
+	// Nothing happens without an enroll url
+	require.NoError(t, enrollIfNeeded(l, c, false))
+	_, err = os.Stat(filepath.Join(dir, "host.key"))
+	assert.ErrorIs(t, err, os.ErrNotExist)
+
+	c.Settings["pki"].(map[interface{}]interface{})["enroll"] = map[interface{}]interface{}{"url": ts.URL}
+	assert.EqualError(t, enrollIfNeeded(l, c, false), "pki.enroll requires a token or token_file")
+
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "token"), []byte("token\n"), 0600))
+	c.Settings["pki"].(map[interface{}]interface{})["enroll"] = map[interface{}]interface{}{
+		"url":        ts.URL,
+		"token_file": filepath.Join(dir, "token"),
+	}
+
+	// Testing the config does not enroll
+	assert.EqualError(t, enrollIfNeeded(l, c, true), "pki.cert "+filepath.Join(dir, "host.crt")+" does not exist, it is enrolled for when nebula starts")
+	_, err = os.Stat(filepath.Join(dir, "host.key"))
+	assert.ErrorIs(t, err, os.ErrNotExist)
+
+	require.NoError(t, enrollIfNeeded(l, c, false))
+
+	cs, err := newCertStateFromConfig(c)
+	require.NoError(t, err)
+	assert.Equal(t, "node", cs.Certificate.Details.Name)
+
+	caPool, err := loadCAPoolFromConfig(l, c)
+	require.NoError(t, err)
+	ok, err := cs.Certificate.Verify(time.Now(), caPool)
+	assert.True(t, ok)
+	assert.NoError(t, err)
+
+	// The cert exists now, the used token is not presented again
+	require.NoError(t, enrollIfNeeded(l, c, false))
+
+	// Inline PEM can not be written to
+	c.Settings["pki"].(map[interface{}]interface{})["ca"] = "-----BEGIN NEBULA CERTIFICATE-----"
+	assert.EqualError(t, enrollIfNeeded(l, c, false), "pki.enroll requires pki.ca to be a file path")
+}
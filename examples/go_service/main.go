@@ -5,7 +5,7 @@ import (
 	"fmt"
 	"log"
 
-	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula"
 	"github.com/slackhq/nebula/service"
 )
 
@@ -54,11 +54,11 @@ pki:
   cert: /home/rice/Developer/nebula-config/app.crt
   key: /home/rice/Developer/nebula-config/app.key
 `
-	var config config.C
-	if err := config.LoadString(configStr); err != nil {
-		return err
-	}
-	service, err := service.New(&config)
+	service, err := service.NewFromBytes([]byte(configStr), service.Options{
+		OnTunnelEvent: func(e nebula.TunnelEvent) {
+			log.Printf("tunnel event %v for %v", e.Type, e.VpnIp)
+		},
+	})
 	if err != nil {
 		return err
 	}
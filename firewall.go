@@ -1,6 +1,7 @@
 package nebula
 
 import (
+	"container/list"
 	"crypto/sha256"
 	"encoding/hex"
 	"errors"
@@ -11,6 +12,7 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/rcrowley/go-metrics"
@@ -25,6 +27,26 @@ type FirewallInterface interface {
 	AddRule(incoming bool, proto uint8, startPort int32, endPort int32, groups []string, host string, ip *net.IPNet, localIp *net.IPNet, caName string, caSha string) error
 }
 
+// firewallRuleOptions are the parts of a rule that AddRule does not take
+type firewallRuleOptions struct {
+	// schedule limits the rule to the times it is active, nil if it is always active
+	schedule *firewallSchedule
+	// cidrSet names a set from firewall.cidr_sets the remote address can be in
+	cidrSet string
+	// groupExpr is an expression the remote certificate groups can satisfy
+	groupExpr *groupExpr
+	// inspector limits an outbound rule to flows whose payload names a destination it allows
+	inspector *firewallInspector
+	// limit throttles the traffic the rule allows per remote host
+	limit *firewallRuleLimit
+}
+
+// firewallExtendedRules is implemented by firewalls that support rule options, like schedules, cidr sets, group
+// expressions, inspectors, and limits
+type firewallExtendedRules interface {
+	addRuleWithOptions(incoming bool, proto uint8, startPort int32, endPort int32, groups []string, host string, ip *net.IPNet, localIp *net.IPNet, caName string, caSha string, opts firewallRuleOptions) error
+}
+
 type conn struct {
 	Expires time.Time // Time when this conntrack entry will expire
 
@@ -33,43 +55,154 @@ type conn struct {
 	// fields pack for free after the uint32 above
 	incoming     bool
 	rulesVersion uint16
+
+	// activeUntil is when the schedule of the rule that allowed this connection closes, zero if it never does
+	activeUntil time.Time
+	// activeSince is when the schedule was last checked, a clock stepped back before it has the schedule checked again
+	activeSince time.Time
+
+	// counter belongs to the rule that allowed this connection, nil when rule stats are not enabled
+	counter *firewall.Counter
+
+	// inspection is set when only inspected rules allowed this connection, its payload decides if it can continue
+	inspection *flowInspection
+
+	// limit belongs to the rule that allowed this connection if the rule is limited
+	limit *firewallRuleLimit
+
+	// flow counts the packets on this connection and start is when it was added, both are only set when flows are
+	// exported
+	flow  *firewall.Counter
+	start time.Time
+
+	// lru is the place of this connection in the eviction order when the table has a maximum size
+	lru *list.Element
 }
 
-// TODO: need conntrack max tracked connections handling
 type Firewall struct {
 	Conntrack *FirewallConntrack
 
 	InRules  *FirewallTable
 	OutRules *FirewallTable
 
+	// scheduledIn and scheduledOut hold the rules that are limited to a schedule, one table per distinct schedule
+	scheduledIn  []*scheduledFirewallTable
+	scheduledOut []*scheduledFirewallTable
+	// now is the clock schedules are evaluated against
+	now func() time.Time
+
+	// inspectedOut holds the outbound rules that inspect the payload, one table per distinct inspector
+	inspectedOut []*inspectedFirewallTable
+
+	// limitedIn and limitedOut hold the rules with a limit, one table per rule
+	limitedIn  []*limitedFirewallTable
+	limitedOut []*limitedFirewallTable
+
 	InSendReject  bool
 	OutSendReject bool
 
+	// StrictOutbound refuses outbound rules that allow any remote host, so every egress flow has to be named by a rule
+	StrictOutbound bool
+
 	//TODO: we should have many more options for TCP, an option for ICMP, and mimic the kernel a bit better
 	// https://www.kernel.org/doc/Documentation/networking/nf_conntrack-sysctl.txt
 	TCPTimeout     time.Duration //linux: 5 days max
 	UDPTimeout     time.Duration //linux: 180s max
+	ICMPTimeout    time.Duration //linux: 30s
 	DefaultTimeout time.Duration //linux: 600s
 
+	// MaxConns is the most connections conntrack holds, 0 is unlimited. When it is full evictLRU decides if the least
+	// recently used connection makes way for a new one or the new one is dropped.
+	MaxConns         int
+	evictLRU         bool
+	conntrackFull    metrics.Counter
+	conntrackEvicted metrics.Counter
+
+	// flowExport, if set, exports a record of every connection that leaves conntrack
+	flowExport *flowExporter
+
 	// Used to ensure we don't emit local packets for ips we don't own
-	localIps     *cidr.Tree4[struct{}]
-	assignedCIDR *net.IPNet
-	hasSubnets   bool
+	localIps *cidr.Tree6[struct{}]
+	// assignedCIDRs are the vpn ips in our certificate
+	assignedCIDRs []*net.IPNet
+	hasSubnets    bool
 
 	rules        string
 	rulesVersion uint16
 
+	// reloadPolicy decides what happens to the connections tracked by the firewall this one replaces
+	reloadPolicy         conntrackReloadPolicy
+	conntrackInvalidated metrics.Counter
+
 	defaultLocalCIDRAny bool
 	incomingMetrics     firewallMetrics
 	outgoingMetrics     firewallMetrics
 
+	// log, if set, records dropped packets and new conntrack entries
+	log *firewallLog
+
+	// ruleStats holds a copy of each rule when rule stats or conntrack logging are enabled
+	ruleStats        []*firewallRuleStats
+	ruleStatsEnabled bool
+
+	// cidrSets are the named sets rules can match remote addresses against, blockedSets are dropped before any rule
+	cidrSets    map[string]*firewallCIDRSet
+	blockedSets []*firewallCIDRSet
+
 	l *logrus.Logger
 }
 
+type scheduledFirewallTable struct {
+	schedule *firewallSchedule
+	table    *FirewallTable
+	// lastLogged is the unix time a packet matching this table outside the schedule was last logged
+	lastLogged atomic.Int64
+}
+
+// conntrackReloadPolicy decides what happens to tracked connections when the firewall rules are reloaded
+type conntrackReloadPolicy uint8
+
+const (
+	// conntrackReloadRecheck checks each tracked connection against the new rules on its next packet
+	conntrackReloadRecheck conntrackReloadPolicy = iota
+	// conntrackReloadPreserve keeps every tracked connection, even if the new rules would not allow it
+	conntrackReloadPreserve
+	// conntrackReloadFlush drops every tracked connection, each has to be allowed by the new rules again
+	conntrackReloadFlush
+)
+
+func parseConntrackReloadPolicy(s string) (conntrackReloadPolicy, error) {
+	switch s {
+	case "recheck":
+		return conntrackReloadRecheck, nil
+	case "preserve":
+		return conntrackReloadPreserve, nil
+	case "flush":
+		return conntrackReloadFlush, nil
+	default:
+		return 0, fmt.Errorf("firewall.conntrack.on_reload must be one of recheck, preserve, or flush; `%s`", s)
+	}
+}
+
+func (p conntrackReloadPolicy) String() string {
+	switch p {
+	case conntrackReloadPreserve:
+		return "preserve"
+	case conntrackReloadFlush:
+		return "flush"
+	default:
+		return "recheck"
+	}
+}
+
 type firewallMetrics struct {
 	droppedLocalIP  metrics.Counter
 	droppedRemoteIP metrics.Counter
 	droppedNoRule   metrics.Counter
+	droppedBlocked  metrics.Counter
+
+	droppedInspection metrics.Counter
+	droppedRateLimit  metrics.Counter
 }
 
 type FirewallConntrack struct {
@@ -77,6 +210,10 @@ type FirewallConntrack struct {
 
 	Conns      map[firewall.Packet]*conn
 	TimerWheel *TimerWheel[firewall.Packet]
+
+	// lru orders the connections by when they last saw a packet, most recent first. It is nil when the table has no
+	// maximum size.
+	lru *list.List
 }
 
 // FirewallTable is the entry point for a rule, the evaluation order is:
@@ -85,6 +222,7 @@ type FirewallTable struct {
 	TCP      firewallPort
 	UDP      firewallPort
 	ICMP     firewallPort
+	ICMPv6   firewallPort
 	AnyProto firewallPort
 }
 
@@ -93,6 +231,7 @@ func newFirewallTable() *FirewallTable {
 		TCP:      firewallPort{},
 		UDP:      firewallPort{},
 		ICMP:     firewallPort{},
+		ICMPv6:   firewallPort{},
 		AnyProto: firewallPort{},
 	}
 }
@@ -108,7 +247,11 @@ type FirewallRule struct {
 	Any    *firewallLocalCIDR
 	Hosts  map[string]*firewallLocalCIDR
 	Groups []*firewallGroups
-	CIDR   *cidr.Tree4[*firewallLocalCIDR]
+	// GroupExprs are checked after Groups, an expression can say anything a list of groups can but is slower
+	GroupExprs []*firewallGroupExpr
+	CIDR       *cidr.Tree6[*firewallLocalCIDR]
+	// CIDRSets is keyed by set name, the entries of a set can change at runtime
+	CIDRSets map[string]*firewallCIDRSetRule
 }
 
 type firewallGroups struct {
@@ -116,44 +259,35 @@ type firewallGroups struct {
 	LocalCIDR *firewallLocalCIDR
 }
 
+type firewallGroupExpr struct {
+	Expr      *groupExpr
+	LocalCIDR *firewallLocalCIDR
+}
+
+type firewallCIDRSetRule struct {
+	Set       *firewallCIDRSet
+	LocalCIDR *firewallLocalCIDR
+}
+
 // Even though ports are uint16, int32 maps are faster for lookup
 // Plus we can use `-1` for fragment rules
 type firewallPort map[int32]*FirewallCA
 
 type firewallLocalCIDR struct {
 	Any       bool
-	LocalCIDR *cidr.Tree4[struct{}]
+	LocalCIDR *cidr.Tree6[struct{}]
 }
 
 // NewFirewall creates a new Firewall object. A TimerWheel is created for you from the provided timeouts.
 func NewFirewall(l *logrus.Logger, tcpTimeout, UDPTimeout, defaultTimeout time.Duration, c *cert.NebulaCertificate) *Firewall {
 	//TODO: error on 0 duration
-	var min, max time.Duration
-
-	if tcpTimeout < UDPTimeout {
-		min = tcpTimeout
-		max = UDPTimeout
-	} else {
-		min = UDPTimeout
-		max = tcpTimeout
-	}
 
-	if defaultTimeout < min {
-		min = defaultTimeout
-	} else if defaultTimeout > max {
-		max = defaultTimeout
-	}
-
-	localIps := cidr.NewTree4[struct{}]()
-	var assignedCIDR *net.IPNet
+	localIps := cidr.NewTree6[struct{}]()
+	var assignedCIDRs []*net.IPNet
 	for _, ip := range c.Details.Ips {
-		ipNet := &net.IPNet{IP: ip.IP, Mask: net.IPMask{255, 255, 255, 255}}
+		ipNet := hostIPNet(ip.IP)
 		localIps.AddCIDR(ipNet, struct{}{})
-
-		if assignedCIDR == nil {
-			// Only grabbing the first one in the cert since any more than that currently has undefined behavior
-			assignedCIDR = ipNet
-		}
+		assignedCIDRs = append(assignedCIDRs, ipNet)
 	}
 
 	for _, n := range c.Details.Subnets {
@@ -163,31 +297,59 @@ func NewFirewall(l *logrus.Logger, tcpTimeout, UDPTimeout, defaultTimeout time.D
 	return &Firewall{
 		Conntrack: &FirewallConntrack{
 			Conns:      make(map[firewall.Packet]*conn),
-			TimerWheel: NewTimerWheel[firewall.Packet](min, max),
+			TimerWheel: newConntrackTimerWheel(tcpTimeout, UDPTimeout, defaultTimeout),
 		},
 		InRules:        newFirewallTable(),
 		OutRules:       newFirewallTable(),
 		TCPTimeout:     tcpTimeout,
 		UDPTimeout:     UDPTimeout,
+		ICMPTimeout:    defaultTimeout,
 		DefaultTimeout: defaultTimeout,
 		localIps:       localIps,
-		assignedCIDR:   assignedCIDR,
+		assignedCIDRs:  assignedCIDRs,
 		hasSubnets:     len(c.Details.Subnets) > 0,
+		now:            wallClock,
 		l:              l,
 
+		conntrackInvalidated: metrics.GetOrRegisterCounter("firewall.conntrack.invalidated", nil),
+		conntrackFull:        metrics.GetOrRegisterCounter("firewall.conntrack.full", nil),
+		conntrackEvicted:     metrics.GetOrRegisterCounter("firewall.conntrack.evicted", nil),
+
 		incomingMetrics: firewallMetrics{
 			droppedLocalIP:  metrics.GetOrRegisterCounter("firewall.incoming.dropped.local_ip", nil),
 			droppedRemoteIP: metrics.GetOrRegisterCounter("firewall.incoming.dropped.remote_ip", nil),
 			droppedNoRule:   metrics.GetOrRegisterCounter("firewall.incoming.dropped.no_rule", nil),
+			droppedBlocked:  metrics.GetOrRegisterCounter("firewall.incoming.dropped.blocked", nil),
+
+			droppedInspection: metrics.GetOrRegisterCounter("firewall.incoming.dropped.inspection", nil),
+			droppedRateLimit:  metrics.GetOrRegisterCounter("firewall.incoming.dropped.rate_limit", nil),
 		},
 		outgoingMetrics: firewallMetrics{
 			droppedLocalIP:  metrics.GetOrRegisterCounter("firewall.outgoing.dropped.local_ip", nil),
 			droppedRemoteIP: metrics.GetOrRegisterCounter("firewall.outgoing.dropped.remote_ip", nil),
 			droppedNoRule:   metrics.GetOrRegisterCounter("firewall.outgoing.dropped.no_rule", nil),
+			droppedBlocked:  metrics.GetOrRegisterCounter("firewall.outgoing.dropped.blocked", nil),
+
+			droppedInspection: metrics.GetOrRegisterCounter("firewall.outgoing.dropped.inspection", nil),
+			droppedRateLimit:  metrics.GetOrRegisterCounter("firewall.outgoing.dropped.rate_limit", nil),
 		},
 	}
 }
 
+// newConntrackTimerWheel returns a wheel that covers all of the timeouts
+func newConntrackTimerWheel(timeouts ...time.Duration) *TimerWheel[firewall.Packet] {
+	min, max := timeouts[0], timeouts[0]
+	for _, t := range timeouts[1:] {
+		if t < min {
+			min = t
+		} else if t > max {
+			max = t
+		}
+	}
+
+	return NewTimerWheel[firewall.Packet](min, max)
+}
+
 func NewFirewallFromConfig(l *logrus.Logger, nc *cert.NebulaCertificate, c *config.C) (*Firewall, error) {
 	fw := NewFirewall(
 		l,
@@ -195,9 +357,31 @@ func NewFirewallFromConfig(l *logrus.Logger, nc *cert.NebulaCertificate, c *conf
 		c.GetDuration("firewall.conntrack.udp_timeout", time.Minute*3),
 		c.GetDuration("firewall.conntrack.default_timeout", time.Minute*10),
 		nc,
-		//TODO: max_connections
 	)
 
+	fw.ICMPTimeout = c.GetDuration("firewall.conntrack.icmp_timeout", fw.DefaultTimeout)
+	if fw.ICMPTimeout != fw.DefaultTimeout {
+		fw.Conntrack.TimerWheel = newConntrackTimerWheel(fw.TCPTimeout, fw.UDPTimeout, fw.ICMPTimeout, fw.DefaultTimeout)
+	}
+
+	fw.MaxConns = c.GetInt("firewall.conntrack.max_connections", 0)
+	if fw.MaxConns < 0 {
+		return nil, fmt.Errorf("firewall.conntrack.max_connections must not be negative")
+	}
+
+	switch eviction := c.GetString("firewall.conntrack.eviction", "lru"); eviction {
+	case "lru":
+		fw.evictLRU = true
+	case "drop_new":
+		fw.evictLRU = false
+	default:
+		return nil, fmt.Errorf("firewall.conntrack.eviction must be one of lru or drop_new; `%s`", eviction)
+	}
+
+	if fw.MaxConns > 0 {
+		fw.Conntrack.lru = list.New()
+	}
+
 	//TODO: Flip to false after v1.9 release
 	fw.defaultLocalCIDRAny = c.GetBool("firewall.default_local_cidr_any", true)
 
@@ -223,7 +407,37 @@ func NewFirewallFromConfig(l *logrus.Logger, nc *cert.NebulaCertificate, c *conf
 		fw.OutSendReject = false
 	}
 
-	err := AddFirewallRulesFromConfig(l, false, c, fw)
+	fw.StrictOutbound = c.GetBool("firewall.strict_outbound", false)
+	fw.ruleStatsEnabled = c.GetBool("firewall.rule_stats", false)
+
+	reloadPolicy, err := parseConntrackReloadPolicy(c.GetString("firewall.conntrack.on_reload", "recheck"))
+	if err != nil {
+		return nil, err
+	}
+	fw.reloadPolicy = reloadPolicy
+
+	fw.cidrSets, err = firewallCIDRSetsFromConfig(c)
+	if err != nil {
+		return nil, err
+	}
+
+	err = fw.blockedSetsFromConfig(c)
+	if err != nil {
+		return nil, err
+	}
+
+	// The log is set up before the rules so they are tracked if it needs them
+	fw.log, err = newFirewallLogFromConfig(l, c)
+	if err != nil {
+		return nil, err
+	}
+
+	fw.flowExport, err = newFlowExporterFromConfig(l, c)
+	if err != nil {
+		return nil, err
+	}
+
+	err = AddFirewallRulesFromConfig(l, false, c, fw)
 	if err != nil {
 		return nil, err
 	}
@@ -238,6 +452,15 @@ func NewFirewallFromConfig(l *logrus.Logger, nc *cert.NebulaCertificate, c *conf
 
 // AddRule properly creates the in memory rule structure for a firewall table.
 func (f *Firewall) AddRule(incoming bool, proto uint8, startPort int32, endPort int32, groups []string, host string, ip *net.IPNet, localIp *net.IPNet, caName string, caSha string) error {
+	return f.addRule(incoming, proto, startPort, endPort, groups, host, ip, localIp, caName, caSha, firewallRuleOptions{})
+}
+
+// addRuleWithOptions is AddRule for a rule with a schedule, cidr set, group expression, inspector, or limit
+func (f *Firewall) addRuleWithOptions(incoming bool, proto uint8, startPort int32, endPort int32, groups []string, host string, ip *net.IPNet, localIp *net.IPNet, caName string, caSha string, opts firewallRuleOptions) error {
+	return f.addRule(incoming, proto, startPort, endPort, groups, host, ip, localIp, caName, caSha, opts)
+}
+
+func (f *Firewall) addRule(incoming bool, proto uint8, startPort int32, endPort int32, groups []string, host string, ip *net.IPNet, localIp *net.IPNet, caName string, caSha string, opts firewallRuleOptions) error {
 	// Under gomobile, stringing a nil pointer with fmt causes an abort in debug mode for iOS
 	// https://github.com/golang/go/issues/14131
 	sIp := ""
@@ -254,40 +477,108 @@ func (f *Firewall) AddRule(incoming bool, proto uint8, startPort int32, endPort
 		"incoming: %v, proto: %v, startPort: %v, endPort: %v, groups: %v, host: %v, ip: %v, localIp: %v, caName: %v, caSha: %s",
 		incoming, proto, startPort, endPort, groups, host, sIp, lIp, caName, caSha,
 	)
+	fields := m{"proto": proto, "startPort": startPort, "endPort": endPort, "groups": groups, "host": host, "ip": sIp, "localIp": lIp, "caName": caName, "caSha": caSha}
+	schedule := opts.schedule
+	if schedule != nil {
+		// Only scheduled rules carry this so the hash of an unscheduled rule set does not change
+		ruleString += ", schedule: " + schedule.String()
+		fields["schedule"] = schedule.String()
+	}
+
+	var set *firewallCIDRSet
+	if opts.cidrSet != "" {
+		var err error
+		set, err = f.cidrSet(opts.cidrSet)
+		if err != nil {
+			return err
+		}
+		// The set is hashed by name, changing its entries is not a rule change
+		ruleString += ", cidrSet: " + opts.cidrSet
+		fields["cidrSet"] = opts.cidrSet
+	}
+
+	expr := opts.groupExpr
+	if expr != nil {
+		ruleString += ", groupExpr: " + expr.String()
+		fields["groupExpr"] = expr.String()
+	}
+
+	inspector := opts.inspector
+	if inspector != nil {
+		if incoming {
+			return fmt.Errorf("%s is only supported on outbound rules", inspector.key)
+		}
+		if schedule != nil {
+			return fmt.Errorf("%s can not be combined with a schedule", inspector.key)
+		}
+		ruleString += ", " + inspector.String()
+		fields[inspector.key] = inspector.patterns
+	}
+
+	limit := opts.limit
+	if limit != nil {
+		if schedule != nil || inspector != nil {
+			return fmt.Errorf("limit can not be combined with a schedule, sni, or dns_name")
+		}
+		ruleString += ", limit: " + limit.String()
+		fields["limit"] = limit.String()
+	}
+
+	if !incoming && f.StrictOutbound && isAnyRemote(groups, expr, host, ip, set) {
+		return fmt.Errorf("outbound rules must be limited to a host, group, or cidr when strict_outbound is set")
+	}
+
 	f.rules += ruleString + "\n"
 
 	direction := "incoming"
 	if !incoming {
 		direction = "outgoing"
 	}
-	f.l.WithField("firewallRule", m{"direction": direction, "proto": proto, "startPort": startPort, "endPort": endPort, "groups": groups, "host": host, "ip": sIp, "localIp": lIp, "caName": caName, "caSha": caSha}).
+	fields["direction"] = direction
+	f.l.WithField("firewallRule", fields).
 		Info("Firewall rule added")
 
-	var (
-		ft *FirewallTable
-		fp firewallPort
-	)
-
-	if incoming {
+	var ft *FirewallTable
+	if schedule != nil {
+		ft = f.scheduledTable(incoming, schedule)
+	} else if inspector != nil {
+		ft = f.inspectedTable(inspector)
+	} else if limit != nil {
+		ft = f.limitedTable(incoming, limit)
+	} else if incoming {
 		ft = f.InRules
 	} else {
 		ft = f.OutRules
 	}
 
-	switch proto {
-	case firewall.ProtoTCP:
-		fp = ft.TCP
-	case firewall.ProtoUDP:
-		fp = ft.UDP
-	case firewall.ProtoICMP:
-		fp = ft.ICMP
-	case firewall.ProtoAny:
-		fp = ft.AnyProto
-	default:
-		return fmt.Errorf("unknown protocol %v", proto)
+	fp, err := ft.protoPorts(proto)
+	if err != nil {
+		return err
+	}
+
+	if err := fp.addRule(f, startPort, endPort, groups, expr, host, ip, set, localIp, caName, caSha); err != nil {
+		return err
 	}
 
-	return fp.addRule(f, startPort, endPort, groups, host, ip, localIp, caName, caSha)
+	return f.trackRule(incoming, proto, startPort, endPort, groups, expr, host, ip, set, localIp, caName, caSha, schedule, fields)
+}
+
+// scheduledTable returns the table for rules with the same schedule, creating it if needed
+func (f *Firewall) scheduledTable(incoming bool, schedule *firewallSchedule) *FirewallTable {
+	tables := &f.scheduledOut
+	if incoming {
+		tables = &f.scheduledIn
+	}
+
+	for _, st := range *tables {
+		if st.schedule.String() == schedule.String() {
+			return st.table
+		}
+	}
+
+	st := &scheduledFirewallTable{schedule: schedule, table: newFirewallTable()}
+	*tables = append(*tables, st)
+	return st.table
 }
 
 // GetRuleHash returns a hash representation of all inbound and outbound rules
@@ -316,7 +607,43 @@ func AddFirewallRulesFromConfig(l *logrus.Logger, inbound bool, c *config.C, fw
 		table = "firewall.outbound"
 	}
 
-	r := c.Get(table)
+	services, err := firewallServicesFromConfig(c)
+	if err != nil {
+		return err
+	}
+
+	return addFirewallRules(l, inbound, table, c.Get(table), services, fw)
+}
+
+// firewallServicesFromConfig reads firewall.services, named lists of ports that rules can use in place of a port
+func firewallServicesFromConfig(c *config.C) (map[string][]string, error) {
+	services := map[string][]string{}
+	for k, v := range c.GetMap("firewall.services", map[interface{}]interface{}{}) {
+		name := fmt.Sprintf("%v", k)
+		if _, _, err := parsePort(name); err == nil {
+			return nil, fmt.Errorf("firewall.services.%s; name must not be a port", name)
+		}
+
+		ports := toStringSlice(v)
+		if len(ports) == 0 {
+			return nil, fmt.Errorf("firewall.services.%s; must have at least one port", name)
+		}
+
+		for _, p := range ports {
+			if _, _, err := parsePort(p); err != nil {
+				return nil, fmt.Errorf("firewall.services.%s; port %s", name, err)
+			}
+		}
+
+		services[name] = ports
+	}
+
+	return services, nil
+}
+
+// addFirewallRules adds rules in the firewall.inbound format to fw, table names the rules in errors and services are
+// the aliases from firewall.services
+func addFirewallRules(l *logrus.Logger, inbound bool, table string, r interface{}, services map[string][]string, fw FirewallInterface) error {
 	if r == nil {
 		return nil
 	}
@@ -333,12 +660,12 @@ func AddFirewallRulesFromConfig(l *logrus.Logger, inbound bool, c *config.C, fw
 			return fmt.Errorf("%s rule #%v; %s", table, i, err)
 		}
 
-		if r.Code != "" && r.Port != "" {
+		if r.Code != "" && len(r.Ports) > 0 {
 			return fmt.Errorf("%s rule #%v; only one of port or code should be provided", table, i)
 		}
 
-		if r.Host == "" && len(r.Groups) == 0 && r.Group == "" && r.Cidr == "" && r.LocalCidr == "" && r.CAName == "" && r.CASha == "" {
-			return fmt.Errorf("%s rule #%v; at least one of host, group, cidr, local_cidr, ca_name, or ca_sha must be provided", table, i)
+		if r.Host == "" && len(r.Groups) == 0 && r.Group == "" && r.GroupExpr == "" && r.Cidr == "" && r.CIDRSet == "" && r.LocalCidr == "" && r.CAName == "" && r.CASha == "" {
+			return fmt.Errorf("%s rule #%v; at least one of host, group, group_expr, cidr, cidr_set, local_cidr, ca_name, or ca_sha must be provided", table, i)
 		}
 
 		if len(r.Groups) > 0 {
@@ -354,18 +681,55 @@ func AddFirewallRulesFromConfig(l *logrus.Logger, inbound bool, c *config.C, fw
 			groups = []string{r.Group}
 		}
 
-		var sPort, errPort string
-		if r.Code != "" {
-			errPort = "code"
-			sPort = r.Code
-		} else {
-			errPort = "port"
-			sPort = r.Port
+		var expr *groupExpr
+		if r.GroupExpr != "" {
+			if len(groups) > 0 {
+				return fmt.Errorf("%s rule #%v; only one of group, groups, or group_expr should be defined", table, i)
+			}
+
+			expr, err = parseGroupExpr(r.GroupExpr)
+			if err != nil {
+				return fmt.Errorf("%s rule #%v; %s", table, i, err)
+			}
 		}
 
-		startPort, endPort, err := parsePort(sPort)
-		if err != nil {
-			return fmt.Errorf("%s rule #%v; %s %s", table, i, errPort, err)
+		var ports [][2]int32
+		if len(r.ICMPTypes) > 0 || r.ICMPCode != "" {
+			if r.Code != "" || len(r.Ports) > 0 {
+				return fmt.Errorf("%s rule #%v; only one of port or icmp_type should be provided", table, i)
+			}
+
+			names := firewall.ICMPTypes
+			switch r.Proto {
+			case "icmp":
+			case "icmpv6":
+				names = firewall.ICMPv6Types
+			default:
+				return fmt.Errorf("%s rule #%v; icmp_type and icmp_code require proto icmp or icmpv6", table, i)
+			}
+
+			ports, err = icmpRulePorts(r.ICMPTypes, r.ICMPCode, names)
+			if err != nil {
+				return fmt.Errorf("%s rule #%v; %s", table, i, err)
+			}
+		} else {
+			var sPorts []string
+			var errPort string
+			if r.Code != "" {
+				errPort = "code"
+				sPorts = []string{r.Code}
+			} else {
+				errPort = "port"
+				sPorts = expandFirewallPorts(r.Ports, services)
+			}
+
+			for _, sPort := range sPorts {
+				startPort, endPort, err := parsePort(sPort)
+				if err != nil {
+					return fmt.Errorf("%s rule #%v; %s %s", table, i, errPort, err)
+				}
+				ports = append(ports, [2]int32{startPort, endPort})
+			}
 		}
 
 		var proto uint8
@@ -378,6 +742,8 @@ func AddFirewallRulesFromConfig(l *logrus.Logger, inbound bool, c *config.C, fw
 			proto = firewall.ProtoUDP
 		case "icmp":
 			proto = firewall.ProtoICMP
+		case "icmpv6":
+			proto = firewall.ProtoICMPv6
 		default:
 			return fmt.Errorf("%s rule #%v; proto was not understood; `%s`", table, i, r.Proto)
 		}
@@ -398,9 +764,65 @@ func AddFirewallRulesFromConfig(l *logrus.Logger, inbound bool, c *config.C, fw
 			}
 		}
 
-		err = fw.AddRule(inbound, proto, startPort, endPort, groups, r.Host, cidr, localCidr, r.CAName, r.CASha)
+		schedule, err := parseFirewallSchedule(r.ActiveBetween, r.Schedule)
 		if err != nil {
-			return fmt.Errorf("%s rule #%v; `%s`", table, i, err)
+			return fmt.Errorf("%s rule #%v; schedule %s", table, i, err)
+		}
+
+		var inspector *firewallInspector
+		if len(r.SNI) > 0 || len(r.DNSNames) > 0 {
+			if len(r.SNI) > 0 && len(r.DNSNames) > 0 {
+				return fmt.Errorf("%s rule #%v; only one of sni or dns_name should be provided", table, i)
+			}
+
+			key, names := "sni", r.SNI
+			if len(r.DNSNames) > 0 {
+				key, names = "dns_name", r.DNSNames
+			}
+
+			inspector, err = newFirewallInspector(key, names)
+			if err != nil {
+				return fmt.Errorf("%s rule #%v; %s", table, i, err)
+			}
+
+			if inspector.pi.proto() != proto {
+				return fmt.Errorf("%s rule #%v; %s requires proto %s", table, i, key, inspectorProtoName(inspector.pi))
+			}
+		}
+
+		limit, err := parseFirewallRuleLimit(r.Limit)
+		if err != nil {
+			return fmt.Errorf("%s rule #%v; %s", table, i, err)
+		}
+
+		opts := firewallRuleOptions{schedule: schedule, cidrSet: r.CIDRSet, groupExpr: expr, inspector: inspector, limit: limit}
+		var extended firewallExtendedRules
+		if opts != (firewallRuleOptions{}) {
+			if extended, ok = fw.(firewallExtendedRules); !ok {
+				switch {
+				case schedule != nil:
+					return fmt.Errorf("%s rule #%v; schedules are not supported here", table, i)
+				case expr != nil:
+					return fmt.Errorf("%s rule #%v; group expressions are not supported here", table, i)
+				case inspector != nil:
+					return fmt.Errorf("%s rule #%v; %s is not supported here", table, i, inspector.key)
+				case limit != nil:
+					return fmt.Errorf("%s rule #%v; limits are not supported here", table, i)
+				default:
+					return fmt.Errorf("%s rule #%v; cidr sets are not supported here", table, i)
+				}
+			}
+		}
+
+		for _, p := range ports {
+			if opts != (firewallRuleOptions{}) {
+				err = extended.addRuleWithOptions(inbound, proto, p[0], p[1], groups, r.Host, cidr, localCidr, r.CAName, r.CASha, opts)
+			} else {
+				err = fw.AddRule(inbound, proto, p[0], p[1], groups, r.Host, cidr, localCidr, r.CAName, r.CASha)
+			}
+			if err != nil {
+				return fmt.Errorf("%s rule #%v; `%s`", table, i, err)
+			}
 		}
 	}
 
@@ -410,12 +832,34 @@ func AddFirewallRulesFromConfig(l *logrus.Logger, inbound bool, c *config.C, fw
 var ErrInvalidRemoteIP = errors.New("remote IP is not in remote certificate subnets")
 var ErrInvalidLocalIP = errors.New("local IP is not in list of handled local IPs")
 var ErrNoMatchingRule = errors.New("no matching rule in firewall table")
+var ErrBlockedRemoteIP = errors.New("remote IP is in a blocked cidr set")
+var ErrConntrackFull = errors.New("conntrack is full")
 
 // Drop returns an error if the packet should be dropped, explaining why. It
-// returns nil if the packet should not be dropped.
-func (f *Firewall) Drop(fp firewall.Packet, incoming bool, h *HostInfo, caPool *cert.NebulaCAPool, localCache firewall.ConntrackCache) error {
+// returns nil if the packet should not be dropped. packet is the whole ip packet, its
+// length is counted against the rule that allowed it when rule stats are enabled and
+// its payload is checked by inspected rules.
+func (f *Firewall) Drop(fp firewall.Packet, incoming bool, h *HostInfo, caPool *cert.NebulaCAPool, localCache firewall.ConntrackCache, packet []byte) error {
+	err := f.drop(fp, incoming, h, caPool, localCache, packet)
+	if err != nil && f.log != nil {
+		f.log.dropped(fp, incoming, h, err)
+	}
+	return err
+}
+
+func (f *Firewall) drop(fp firewall.Packet, incoming bool, h *HostInfo, caPool *cert.NebulaCAPool, localCache firewall.ConntrackCache, packet []byte) error {
+	// Blocked sets win over conntrack so adding to them cuts off connections that are already established
+	if len(f.blockedSets) > 0 && f.blocked(fp.RemoteIP) {
+		f.metrics(incoming).droppedBlocked.Inc(1)
+		return ErrBlockedRemoteIP
+	}
+
 	// Check if we spoke to this tuple, if we did then allow this packet
-	if f.inConns(fp, h, caPool, localCache) {
+	ok, err := f.inConns(fp, incoming, h, caPool, localCache, packet)
+	if err != nil {
+		return err
+	}
+	if ok {
 		return nil
 	}
 
@@ -435,29 +879,125 @@ func (f *Firewall) Drop(fp firewall.Packet, incoming bool, h *HostInfo, caPool *
 	}
 
 	// Make sure we are supposed to be handling this local ip address
-	ok, _ := f.localIps.Contains(fp.LocalIP)
+	ok, _ = f.localIps.Contains(fp.LocalIP)
 	if !ok {
 		f.metrics(incoming).droppedLocalIP.Inc(1)
 		return ErrInvalidLocalIP
 	}
 
-	table := f.OutRules
-	if incoming {
-		table = f.InRules
+	// Check the tables for this direction, scheduled rules included
+	ok, activeUntil, limit := f.matchRules(fp, incoming, h, caPool)
+
+	// Outbound flows only allowed by inspected rules are tracked with the state of their inspection
+	var inspection *flowInspection
+	if !ok && !incoming && len(f.inspectedOut) > 0 {
+		if inspectors := f.matchInspectors(fp, h, caPool); len(inspectors) > 0 {
+			ok = true
+			inspection = newFlowInspection(inspectors)
+			err = inspection.inspect(fp, incoming, packet)
+		}
 	}
 
-	// We now know which firewall table to check against
-	if !table.match(fp, incoming, h.ConnectionState.peerCert, caPool) {
+	if !ok {
 		f.metrics(incoming).droppedNoRule.Inc(1)
 		return ErrNoMatchingRule
 	}
 
-	// We always want to conntrack since it is a faster operation
-	f.addConn(fp, incoming)
+	var rs *firewallRuleStats
+	if len(f.ruleStats) > 0 {
+		rs = f.matchedRule(fp, incoming, h.ConnectionState.peerCert, caPool, f.now())
+		if rs != nil && f.ruleStatsEnabled {
+			rs.conns.Add(1)
+		}
+	}
+
+	// We always want to conntrack since it is a faster operation, a flow denied by inspection is tracked too so the
+	// rest of it is denied without another look at the rules
+	c, cerr := f.addConn(fp, incoming, activeUntil, f.ruleCounter(rs), inspection, limit)
+	if cerr != nil {
+		return cerr
+	}
 
+	if f.log != nil {
+		f.log.newConn(fp, incoming, h, rs)
+	}
+
+	if err != nil {
+		f.metrics(incoming).droppedInspection.Inc(1)
+		return err
+	}
+
+	if limit != nil && !limit.allow(h.vpnIp, len(packet), time.Now()) {
+		// The connection is still tracked, only this packet is over the limit
+		f.metrics(incoming).droppedRateLimit.Inc(1)
+		return ErrRateLimited
+	}
+
+	c.counter.Add(len(packet))
+	c.flow.Add(len(packet))
 	return nil
 }
 
+// matchRules checks the packet against the plain rules, then any scheduled rules that are active, then any limited
+// rules. If only a scheduled rule allowed the packet the time its schedule closes is returned as well, if only a
+// limited rule allowed it that rule's limit is returned.
+func (f *Firewall) matchRules(fp firewall.Packet, incoming bool, h *HostInfo, caPool *cert.NebulaCAPool) (bool, time.Time, *firewallRuleLimit) {
+	table, scheduled, limited := f.OutRules, f.scheduledOut, f.limitedOut
+	if incoming {
+		table, scheduled, limited = f.InRules, f.scheduledIn, f.limitedIn
+	}
+
+	c := h.ConnectionState.peerCert
+	if table.match(fp, incoming, c, caPool) {
+		return true, time.Time{}, nil
+	}
+
+	if ok, until := f.matchScheduled(scheduled, fp, incoming, h, caPool); ok {
+		return true, until, nil
+	}
+
+	for _, lt := range limited {
+		if lt.table.match(fp, incoming, c, caPool) {
+			return true, time.Time{}, lt.limit
+		}
+	}
+
+	return false, time.Time{}, nil
+}
+
+// matchScheduled checks the packet against scheduled rules, returning when the schedule of the one that allowed it
+// closes
+func (f *Firewall) matchScheduled(scheduled []*scheduledFirewallTable, fp firewall.Packet, incoming bool, h *HostInfo, caPool *cert.NebulaCAPool) (bool, time.Time) {
+	if len(scheduled) == 0 {
+		return false, time.Time{}
+	}
+
+	c := h.ConnectionState.peerCert
+	now := f.now()
+	for _, st := range scheduled {
+		if !st.table.match(fp, incoming, c, caPool) {
+			continue
+		}
+
+		active, until := st.schedule.active(now)
+		if active {
+			return true, until
+		}
+
+		// Log at most once a minute per schedule so a denied client retrying can not flood the logs
+		last := st.lastLogged.Load()
+		if now.Unix()-last >= 60 && st.lastLogged.CompareAndSwap(last, now.Unix()) {
+			h.logger(f.l).
+				WithField("fwPacket", fp).
+				WithField("incoming", incoming).
+				WithField("schedule", st.schedule.String()).
+				Info("Firewall rule matched outside of its schedule")
+		}
+	}
+
+	return false, time.Time{}
+}
+
 func (f *Firewall) metrics(incoming bool) firewallMetrics {
 	if incoming {
 		return f.incomingMetrics
@@ -470,22 +1010,35 @@ func (f *Firewall) metrics(incoming bool) firewallMetrics {
 // firewall object is created
 func (f *Firewall) Destroy() {
 	//TODO: clean references if/when needed
+	if f.log != nil {
+		f.log.close()
+	}
+	if f.flowExport != nil {
+		f.flowExport.close()
+	}
+	f.unregisterRuleStats()
 }
 
 func (f *Firewall) EmitStats() {
 	conntrack := f.Conntrack
 	conntrack.Lock()
 	conntrackCount := len(conntrack.Conns)
+	rulesVersion := f.rulesVersion
 	conntrack.Unlock()
 	metrics.GetOrRegisterGauge("firewall.conntrack.count", nil).Update(int64(conntrackCount))
-	metrics.GetOrRegisterGauge("firewall.rules.version", nil).Update(int64(f.rulesVersion))
+	metrics.GetOrRegisterGauge("firewall.rules.version", nil).Update(int64(rulesVersion))
 	metrics.GetOrRegisterGauge("firewall.rules.hash", nil).Update(int64(f.GetRuleHashFNV()))
+	f.emitRuleStats()
 }
 
-func (f *Firewall) inConns(fp firewall.Packet, h *HostInfo, caPool *cert.NebulaCAPool, localCache firewall.ConntrackCache) bool {
+// inConns reports whether the packet belongs to a tracked connection. An error is returned if it does but inspection
+// of its payload denies it.
+func (f *Firewall) inConns(fp firewall.Packet, incoming bool, h *HostInfo, caPool *cert.NebulaCAPool, localCache firewall.ConntrackCache, packet []byte) (bool, error) {
+	key := fp.ConntrackKey()
 	if localCache != nil {
-		if _, ok := localCache[fp]; ok {
-			return true
+		if cached, ok := localCache[key]; ok {
+			cached.Add(len(packet))
+			return true, nil
 		}
 	}
 	conntrack := f.Conntrack
@@ -497,23 +1050,35 @@ func (f *Firewall) inConns(fp firewall.Packet, h *HostInfo, caPool *cert.NebulaC
 		f.evict(ep)
 	}
 
-	c, ok := conntrack.Conns[fp]
+	c, ok := conntrack.Conns[key]
 
 	if !ok {
 		conntrack.Unlock()
-		return false
-	}
-
-	if c.rulesVersion != f.rulesVersion {
-		// This conntrack entry was for an older rule set, validate
-		// it still passes with the current rule set
-		table := f.OutRules
-		if c.incoming {
-			table = f.InRules
+		return false, nil
+	}
+
+	var now time.Time
+	if !c.activeUntil.IsZero() {
+		now = f.now()
+	}
+
+	if c.rulesVersion != f.rulesVersion || (!c.activeUntil.IsZero() && (!now.Before(c.activeUntil) || now.Before(c.activeSince))) {
+		// This conntrack entry was for an older rule set, the schedule that allowed it has closed, or the clock was
+		// stepped back since the schedule was checked. Validate it still passes with the current rule set. The key is
+		// checked so a reply is judged as the query that opened the connection.
+		ok, activeUntil, limit := f.matchRules(key, c.incoming, h, caPool)
+		if ok {
+			// An unrestricted rule allows the flow now, there is nothing left to inspect
+			c.inspection = nil
+		} else if c.inspection != nil {
+			// Still only allowed by inspected rules, a stream is decided again with the names it already sent
+			if inspectors := f.matchInspectors(key, h, caPool); len(inspectors) > 0 {
+				ok = true
+				c.inspection.setInspectors(inspectors)
+			}
 		}
 
-		// We now know which firewall table to check against
-		if !table.match(fp, c.incoming, h.ConnectionState.peerCert, caPool) {
+		if !ok {
 			if f.l.Level >= logrus.DebugLevel {
 				h.logger(f.l).
 					WithField("fwPacket", fp).
@@ -522,9 +1087,10 @@ func (f *Firewall) inConns(fp firewall.Packet, h *HostInfo, caPool *cert.NebulaC
 					WithField("oldRulesVersion", c.rulesVersion).
 					Debugln("dropping old conntrack entry, does not match new ruleset")
 			}
-			delete(conntrack.Conns, fp)
+			f.removeConn(key, c, flowEndForced)
 			conntrack.Unlock()
-			return false
+			f.conntrackInvalidated.Inc(1)
+			return false, nil
 		}
 
 		if f.l.Level >= logrus.DebugLevel {
@@ -537,53 +1103,218 @@ func (f *Firewall) inConns(fp firewall.Packet, h *HostInfo, caPool *cert.NebulaC
 		}
 
 		c.rulesVersion = f.rulesVersion
+		c.activeUntil = activeUntil
+		if !activeUntil.IsZero() {
+			c.activeSince = f.now()
+		}
+		c.limit = limit
+		if f.ruleStatsEnabled {
+			c.counter = f.ruleCounter(f.matchedRule(key, c.incoming, h.ConnectionState.peerCert, caPool, f.now()))
+		}
 	}
 
-	switch fp.Protocol {
-	case firewall.ProtoTCP:
-		c.Expires = time.Now().Add(f.TCPTimeout)
-	case firewall.ProtoUDP:
-		c.Expires = time.Now().Add(f.UDPTimeout)
-	default:
-		c.Expires = time.Now().Add(f.DefaultTimeout)
+	if c.inspection != nil {
+		if err := c.inspection.inspect(fp, incoming, packet); err != nil {
+			conntrack.Unlock()
+			f.metrics(incoming).droppedInspection.Inc(1)
+			return false, err
+		}
+	}
+
+	// Only packets travelling the way the rule allows are counted against its limit
+	if c.limit != nil && c.incoming == incoming && !c.limit.allow(h.vpnIp, len(packet), time.Now()) {
+		conntrack.Unlock()
+		f.metrics(incoming).droppedRateLimit.Inc(1)
+		return false, ErrRateLimited
 	}
 
+	c.counter.Add(len(packet))
+	c.flow.Add(len(packet))
+	c.Expires = time.Now().Add(f.timeout(fp.Protocol))
+	if c.lru != nil {
+		conntrack.lru.MoveToFront(c.lru)
+	}
+
+	// Limited and inspected connections have to see every packet
+	cacheable := c.inspection.cacheable() && c.limit == nil
 	conntrack.Unlock()
 
-	if localCache != nil {
-		localCache[fp] = struct{}{}
+	if localCache != nil && cacheable {
+		localCache[key] = firewall.CachedConn{Rule: c.counter, Flow: c.flow}
 	}
 
-	return true
+	return true, nil
 }
 
-func (f *Firewall) addConn(fp firewall.Packet, incoming bool) {
-	var timeout time.Duration
-	c := &conn{}
+// inheritConntrack takes over the connections tracked by the firewall this one replaces, following the reload
+// policy. It returns the number of connections that were flushed. The caller must hold the conntrack lock.
+func (f *Firewall) inheritConntrack(conntrack *FirewallConntrack) int {
+	switch f.reloadPolicy {
+	case conntrackReloadFlush:
+		// Keep our own empty conntrack, the old one goes away with the old firewall
+		n := len(conntrack.Conns)
+		for key, c := range conntrack.Conns {
+			f.exportConn(key, c, flowEndForced)
+		}
+		f.conntrackInvalidated.Inc(int64(n))
+		return n
+	case conntrackReloadPreserve:
+		// Mark every connection as allowed by the current rules so they are not rechecked. Their counters belong to
+		// rules of the old firewall, they are no longer counted.
+		for _, c := range conntrack.Conns {
+			c.rulesVersion = f.rulesVersion
+			c.counter = nil
+		}
+	}
 
-	switch fp.Protocol {
+	f.Conntrack = conntrack
+	f.resizeConntrack()
+	return 0
+}
+
+// resizeConntrack brings inherited connections in line with the maximum size of this firewall. Connections beyond
+// the maximum are evicted with the lru policy and kept until they expire with drop_new. The caller must hold the
+// conntrack lock.
+func (f *Firewall) resizeConntrack() {
+	conntrack := f.Conntrack
+	if f.MaxConns == 0 {
+		conntrack.lru = nil
+		for _, c := range conntrack.Conns {
+			c.lru = nil
+		}
+		return
+	}
+
+	if conntrack.lru == nil {
+		// The order connections were used in is unknown, start them all out as equals
+		conntrack.lru = list.New()
+		for key, c := range conntrack.Conns {
+			c.lru = conntrack.lru.PushFront(key)
+		}
+	}
+
+	if f.evictLRU {
+		for len(conntrack.Conns) > f.MaxConns {
+			f.evictOldest()
+		}
+	}
+}
+
+// timeout returns how long a connection of proto is tracked after its last packet
+func (f *Firewall) timeout(proto uint8) time.Duration {
+	switch proto {
 	case firewall.ProtoTCP:
-		timeout = f.TCPTimeout
+		return f.TCPTimeout
 	case firewall.ProtoUDP:
-		timeout = f.UDPTimeout
+		return f.UDPTimeout
+	case firewall.ProtoICMP, firewall.ProtoICMPv6:
+		return f.ICMPTimeout
 	default:
-		timeout = f.DefaultTimeout
+		return f.DefaultTimeout
 	}
+}
+
+// removeConn takes a connection out of conntrack and exports its flow. The caller must hold the conntrack lock.
+func (f *Firewall) removeConn(key firewall.Packet, c *conn, reason uint8) {
+	conntrack := f.Conntrack
+	delete(conntrack.Conns, key)
+	if c.lru != nil && conntrack.lru != nil {
+		conntrack.lru.Remove(c.lru)
+	}
+	f.exportConn(key, c, reason)
+}
+
+// exportConn sends the flow of a connection that is going away to the flow exporter, if there is one. Connections
+// tracked before flows were exported have nothing to send.
+func (f *Firewall) exportConn(key firewall.Packet, c *conn, reason uint8) {
+	if f.flowExport == nil || c.flow == nil {
+		return
+	}
+
+	f.flowExport.export(flowRecord{
+		key:      key,
+		incoming: c.incoming,
+		packets:  c.flow.Packets.Load(),
+		bytes:    c.flow.Bytes.Load(),
+		start:    c.start,
+		end:      time.Now(),
+		reason:   reason,
+	})
+}
+
+// evictOldest removes the least recently used connection. The caller must hold the conntrack lock.
+func (f *Firewall) evictOldest() {
+	conntrack := f.Conntrack
+	e := conntrack.lru.Back()
+	if e == nil {
+		return
+	}
+
+	key := e.Value.(firewall.Packet)
+	if c, ok := conntrack.Conns[key]; ok {
+		f.removeConn(key, c, flowEndLackOfResources)
+	} else {
+		conntrack.lru.Remove(e)
+	}
+	f.conntrackEvicted.Inc(1)
+}
+
+// addConn tracks a new connection. ErrConntrackFull is returned if the table is full and the eviction policy is
+// drop_new.
+func (f *Firewall) addConn(fp firewall.Packet, incoming bool, activeUntil time.Time, counter *firewall.Counter, inspection *flowInspection, limit *firewallRuleLimit) (*conn, error) {
+	c := &conn{}
+	fp = fp.ConntrackKey()
+	timeout := f.timeout(fp.Protocol)
 
 	conntrack := f.Conntrack
 	conntrack.Lock()
-	if _, ok := conntrack.Conns[fp]; !ok {
+	old, ok := conntrack.Conns[fp]
+	if !ok {
+		if f.MaxConns > 0 && len(conntrack.Conns) >= f.MaxConns {
+			if !f.evictLRU {
+				conntrack.Unlock()
+				f.conntrackFull.Inc(1)
+				return nil, ErrConntrackFull
+			}
+
+			for len(conntrack.Conns) >= f.MaxConns {
+				f.evictOldest()
+			}
+		}
+
 		conntrack.TimerWheel.Advance(time.Now())
 		conntrack.TimerWheel.Add(fp, timeout)
 	}
 
+	if conntrack.lru != nil {
+		if ok && old.lru != nil {
+			c.lru = old.lru
+			conntrack.lru.MoveToFront(c.lru)
+		} else {
+			c.lru = conntrack.lru.PushFront(fp)
+		}
+	}
+
+	if f.flowExport != nil {
+		c.flow = &firewall.Counter{}
+		c.start = time.Now()
+	}
+
 	// Record which rulesVersion allowed this connection, so we can retest after
 	// firewall reload
 	c.incoming = incoming
 	c.rulesVersion = f.rulesVersion
+	c.activeUntil = activeUntil
+	if !activeUntil.IsZero() {
+		c.activeSince = f.now()
+	}
+	c.counter = counter
+	c.inspection = inspection
+	c.limit = limit
 	c.Expires = time.Now().Add(timeout)
 	conntrack.Conns[fp] = c
 	conntrack.Unlock()
+	return c, nil
 }
 
 // Evict checks if a conntrack entry has expired, if so it is removed, if not it is re-added to the wheel
@@ -607,7 +1338,25 @@ func (f *Firewall) evict(p firewall.Packet) {
 	}
 
 	// This conn is done
-	delete(conntrack.Conns, p)
+	f.removeConn(p, t, flowEndIdleTimeout)
+}
+
+// protoPorts returns the ports of the table for proto
+func (ft *FirewallTable) protoPorts(proto uint8) (firewallPort, error) {
+	switch proto {
+	case firewall.ProtoTCP:
+		return ft.TCP, nil
+	case firewall.ProtoUDP:
+		return ft.UDP, nil
+	case firewall.ProtoICMP:
+		return ft.ICMP, nil
+	case firewall.ProtoICMPv6:
+		return ft.ICMPv6, nil
+	case firewall.ProtoAny:
+		return ft.AnyProto, nil
+	default:
+		return nil, fmt.Errorf("unknown protocol %v", proto)
+	}
 }
 
 func (ft *FirewallTable) match(p firewall.Packet, incoming bool, c *cert.NebulaCertificate, caPool *cert.NebulaCAPool) bool {
@@ -628,12 +1377,16 @@ func (ft *FirewallTable) match(p firewall.Packet, incoming bool, c *cert.NebulaC
 		if ft.ICMP.match(p, incoming, c, caPool) {
 			return true
 		}
+	case firewall.ProtoICMPv6:
+		if ft.ICMPv6.match(p, incoming, c, caPool) {
+			return true
+		}
 	}
 
 	return false
 }
 
-func (fp firewallPort) addRule(f *Firewall, startPort int32, endPort int32, groups []string, host string, ip *net.IPNet, localIp *net.IPNet, caName string, caSha string) error {
+func (fp firewallPort) addRule(f *Firewall, startPort int32, endPort int32, groups []string, expr *groupExpr, host string, ip *net.IPNet, set *firewallCIDRSet, localIp *net.IPNet, caName string, caSha string) error {
 	if startPort > endPort {
 		return fmt.Errorf("start port was lower than end port")
 	}
@@ -646,7 +1399,7 @@ func (fp firewallPort) addRule(f *Firewall, startPort int32, endPort int32, grou
 			}
 		}
 
-		if err := fp[i].addRule(f, groups, host, ip, localIp, caName, caSha); err != nil {
+		if err := fp[i].addRule(f, groups, expr, host, ip, set, localIp, caName, caSha); err != nil {
 			return err
 		}
 	}
@@ -660,29 +1413,19 @@ func (fp firewallPort) match(p firewall.Packet, incoming bool, c *cert.NebulaCer
 		return false
 	}
 
-	var port int32
-
-	if p.Fragment {
-		port = firewall.PortFragment
-	} else if incoming {
-		port = int32(p.LocalPort)
-	} else {
-		port = int32(p.RemotePort)
-	}
-
-	if fp[port].match(p, c, caPool) {
+	if fp[p.Port(incoming)].match(p, c, caPool) {
 		return true
 	}
 
 	return fp[firewall.PortAny].match(p, c, caPool)
 }
 
-func (fc *FirewallCA) addRule(f *Firewall, groups []string, host string, ip, localIp *net.IPNet, caName, caSha string) error {
+func (fc *FirewallCA) addRule(f *Firewall, groups []string, expr *groupExpr, host string, ip *net.IPNet, set *firewallCIDRSet, localIp *net.IPNet, caName, caSha string) error {
 	fr := func() *FirewallRule {
 		return &FirewallRule{
 			Hosts:  make(map[string]*firewallLocalCIDR),
 			Groups: make([]*firewallGroups, 0),
-			CIDR:   cidr.NewTree4[*firewallLocalCIDR](),
+			CIDR:   cidr.NewTree6[*firewallLocalCIDR](),
 		}
 	}
 
@@ -691,14 +1434,14 @@ func (fc *FirewallCA) addRule(f *Firewall, groups []string, host string, ip, loc
 			fc.Any = fr()
 		}
 
-		return fc.Any.addRule(f, groups, host, ip, localIp)
+		return fc.Any.addRule(f, groups, expr, host, ip, set, localIp)
 	}
 
 	if caSha != "" {
 		if _, ok := fc.CAShas[caSha]; !ok {
 			fc.CAShas[caSha] = fr()
 		}
-		err := fc.CAShas[caSha].addRule(f, groups, host, ip, localIp)
+		err := fc.CAShas[caSha].addRule(f, groups, expr, host, ip, set, localIp)
 		if err != nil {
 			return err
 		}
@@ -708,7 +1451,7 @@ func (fc *FirewallCA) addRule(f *Firewall, groups []string, host string, ip, loc
 		if _, ok := fc.CANames[caName]; !ok {
 			fc.CANames[caName] = fr()
 		}
-		err := fc.CANames[caName].addRule(f, groups, host, ip, localIp)
+		err := fc.CANames[caName].addRule(f, groups, expr, host, ip, set, localIp)
 		if err != nil {
 			return err
 		}
@@ -737,17 +1480,26 @@ func (fc *FirewallCA) match(p firewall.Packet, c *cert.NebulaCertificate, caPool
 		return false
 	}
 
+	// ca_sha pins written before the CA had a hash of its own are the sha256 sum, keep them working
+	if len(fc.CAShas) > 0 && s.Details.Hash != cert.HashAlgorithm_SHA256 {
+		if sum, err := s.Sha256Sum(); err == nil {
+			if t, ok := fc.CAShas[sum]; ok && t.match(p, c) {
+				return true
+			}
+		}
+	}
+
 	return fc.CANames[s.Details.Name].match(p, c)
 }
 
-func (fr *FirewallRule) addRule(f *Firewall, groups []string, host string, ip *net.IPNet, localCIDR *net.IPNet) error {
+func (fr *FirewallRule) addRule(f *Firewall, groups []string, expr *groupExpr, host string, ip *net.IPNet, set *firewallCIDRSet, localCIDR *net.IPNet) error {
 	flc := func() *firewallLocalCIDR {
 		return &firewallLocalCIDR{
-			LocalCIDR: cidr.NewTree4[struct{}](),
+			LocalCIDR: cidr.NewTree6[struct{}](),
 		}
 	}
 
-	if fr.isAny(groups, host, ip) {
+	if fr.isAny(groups, expr, host, ip, set) {
 		if fr.Any == nil {
 			fr.Any = flc()
 		}
@@ -768,6 +1520,19 @@ func (fr *FirewallRule) addRule(f *Firewall, groups []string, host string, ip *n
 		})
 	}
 
+	if expr != nil {
+		nlc := flc()
+		err := nlc.addRule(f, localCIDR)
+		if err != nil {
+			return err
+		}
+
+		fr.GroupExprs = append(fr.GroupExprs, &firewallGroupExpr{
+			Expr:      expr,
+			LocalCIDR: nlc,
+		})
+	}
+
 	if host != "" {
 		nlc := fr.Hosts[host]
 		if nlc == nil {
@@ -792,11 +1557,32 @@ func (fr *FirewallRule) addRule(f *Firewall, groups []string, host string, ip *n
 		fr.CIDR.AddCIDR(ip, nlc)
 	}
 
+	if set != nil {
+		if fr.CIDRSets == nil {
+			fr.CIDRSets = make(map[string]*firewallCIDRSetRule)
+		}
+
+		fs := fr.CIDRSets[set.name]
+		if fs == nil {
+			fs = &firewallCIDRSetRule{Set: set, LocalCIDR: flc()}
+		}
+		err := fs.LocalCIDR.addRule(f, localCIDR)
+		if err != nil {
+			return err
+		}
+		fr.CIDRSets[set.name] = fs
+	}
+
 	return nil
 }
 
-func (fr *FirewallRule) isAny(groups []string, host string, ip *net.IPNet) bool {
-	if len(groups) == 0 && host == "" && ip == nil {
+func (fr *FirewallRule) isAny(groups []string, expr *groupExpr, host string, ip *net.IPNet, set *firewallCIDRSet) bool {
+	return isAnyRemote(groups, expr, host, ip, set)
+}
+
+// isAnyRemote reports whether a rule with these remote conditions matches every remote host
+func isAnyRemote(groups []string, expr *groupExpr, host string, ip *net.IPNet, set *firewallCIDRSet) bool {
+	if len(groups) == 0 && expr == nil && host == "" && ip == nil && set == nil {
 		return true
 	}
 
@@ -810,13 +1596,18 @@ func (fr *FirewallRule) isAny(groups []string, host string, ip *net.IPNet) bool
 		return true
 	}
 
-	if ip != nil && ip.Contains(net.IPv4(0, 0, 0, 0)) {
+	if ip != nil && isAnyIPNet(ip) {
 		return true
 	}
 
 	return false
 }
 
+// isAnyIPNet is true for networks that contain the zero address of their family, like 0.0.0.0/0 and ::/0
+func isAnyIPNet(n *net.IPNet) bool {
+	return n.Contains(net.IPv4zero) || n.Contains(net.IPv6zero)
+}
+
 func (fr *FirewallRule) match(p firewall.Packet, c *cert.NebulaCertificate) bool {
 	if fr == nil {
 		return false
@@ -845,6 +1636,12 @@ func (fr *FirewallRule) match(p firewall.Packet, c *cert.NebulaCertificate) bool
 		}
 	}
 
+	for _, ge := range fr.GroupExprs {
+		if ge.Expr.match(c.Details.InvertedGroups) && ge.LocalCIDR.match(p, c) {
+			return true
+		}
+	}
+
 	if fr.Hosts != nil {
 		if flc, ok := fr.Hosts[c.Details.Name]; ok {
 			if flc.match(p, c) {
@@ -853,6 +1650,12 @@ func (fr *FirewallRule) match(p firewall.Packet, c *cert.NebulaCertificate) bool
 		}
 	}
 
+	for _, fs := range fr.CIDRSets {
+		if fs.Set.contains(p.RemoteIP) && fs.LocalCIDR.match(p, c) {
+			return true
+		}
+	}
+
 	return fr.CIDR.EachContains(p.RemoteIP, func(flc *firewallLocalCIDR) bool {
 		return flc.match(p, c)
 	})
@@ -865,8 +1668,12 @@ func (flc *firewallLocalCIDR) addRule(f *Firewall, localIp *net.IPNet) error {
 			return nil
 		}
 
-		localIp = f.assignedCIDR
-	} else if localIp.Contains(net.IPv4(0, 0, 0, 0)) {
+		// Our own vpn ips are the default, not the subnets we serve for
+		for _, n := range f.assignedCIDRs {
+			flc.LocalCIDR.AddCIDR(n, struct{}{})
+		}
+		return nil
+	} else if isAnyIPNet(localIp) {
 		flc.Any = true
 	}
 
@@ -888,16 +1695,29 @@ func (flc *firewallLocalCIDR) match(p firewall.Packet, c *cert.NebulaCertificate
 }
 
 type rule struct {
-	Port      string
+	Ports     []string
 	Code      string
 	Proto     string
 	Host      string
 	Group     string
 	Groups    []string
+	GroupExpr string
 	Cidr      string
+	CIDRSet   string
 	LocalCidr string
 	CAName    string
 	CASha     string
+
+	ICMPTypes []string
+	ICMPCode  string
+
+	SNI      []string
+	DNSNames []string
+
+	Limit interface{}
+
+	ActiveBetween string
+	Schedule      map[interface{}]interface{}
 }
 
 func convertRule(l *logrus.Logger, p interface{}, table string, i int) (rule, error) {
@@ -916,14 +1736,37 @@ func convertRule(l *logrus.Logger, p interface{}, table string, i int) (rule, er
 		return fmt.Sprintf("%v", v)
 	}
 
-	r.Port = toString("port", m)
+	// port and ports are the same, either can be a single port, range, or service or a list of them
+	if _, ok := m["port"]; ok {
+		if _, ok := m["ports"]; ok {
+			return r, errors.New("only one of port or ports should be provided")
+		}
+		r.Ports = toStringSlice(m["port"])
+	} else {
+		r.Ports = toStringSlice(m["ports"])
+	}
 	r.Code = toString("code", m)
 	r.Proto = toString("proto", m)
 	r.Host = toString("host", m)
 	r.Cidr = toString("cidr", m)
+	r.GroupExpr = toString("group_expr", m)
+	r.CIDRSet = toString("cidr_set", m)
 	r.LocalCidr = toString("local_cidr", m)
 	r.CAName = toString("ca_name", m)
 	r.CASha = toString("ca_sha", m)
+	r.ActiveBetween = toString("active_between", m)
+	r.ICMPTypes = toStringSlice(m["icmp_type"])
+	r.ICMPCode = toString("icmp_code", m)
+	r.SNI = toStringSlice(m["sni"])
+	r.DNSNames = toStringSlice(m["dns_name"])
+	r.Limit = m["limit"]
+
+	if v, ok := m["schedule"]; ok && v != nil {
+		r.Schedule, ok = v.(map[interface{}]interface{})
+		if !ok {
+			return r, errors.New("schedule should be a map")
+		}
+	}
 
 	// Make sure group isn't an array
 	if v, ok := m["group"].([]interface{}); ok {
@@ -954,6 +1797,75 @@ func convertRule(l *logrus.Logger, p interface{}, table string, i int) (rule, er
 	return r, nil
 }
 
+// toStringSlice returns a yaml list as strings, a single value is a list of one
+func toStringSlice(v interface{}) []string {
+	switch tv := v.(type) {
+	case nil:
+		return nil
+	case []string:
+		return tv
+	case []interface{}:
+		s := make([]string, len(tv))
+		for i := range tv {
+			s[i] = fmt.Sprintf("%v", tv[i])
+		}
+		return s
+	default:
+		return []string{fmt.Sprintf("%v", tv)}
+	}
+}
+
+// icmpRulePorts returns the ICMP port ranges, see firewall.ICMPPort, for a rule that matches ICMP types by name or
+// number and optionally a single code. names are the type names of the rules proto, icmp and icmpv6 have their own.
+func icmpRulePorts(types []string, code string, names map[string]uint8) ([][2]int32, error) {
+	if len(types) == 0 {
+		return nil, errors.New("icmp_code requires icmp_type")
+	}
+
+	startCode, endCode := uint8(0), uint8(255)
+	if code != "" && code != "any" {
+		c, err := strconv.ParseUint(code, 10, 8)
+		if err != nil {
+			return nil, fmt.Errorf("icmp_code was not a number from 0 to 255; `%s`", code)
+		}
+		startCode, endCode = uint8(c), uint8(c)
+	}
+
+	var ports [][2]int32
+	for _, t := range types {
+		icmpType, ok := names[t]
+		if !ok {
+			n, err := strconv.ParseUint(t, 10, 8)
+			if err != nil {
+				return nil, fmt.Errorf("icmp_type was not understood; `%s`", t)
+			}
+			icmpType = uint8(n)
+		}
+
+		ports = append(ports, [2]int32{firewall.ICMPPort(icmpType, startCode), firewall.ICMPPort(icmpType, endCode)})
+	}
+
+	return ports, nil
+}
+
+// expandFirewallPorts replaces any service names in ports with the ports they stand for
+func expandFirewallPorts(ports []string, services map[string][]string) []string {
+	if len(ports) == 0 {
+		// Let parsePort complain about the missing port
+		return []string{""}
+	}
+
+	var out []string
+	for _, p := range ports {
+		if sp, ok := services[p]; ok {
+			out = append(out, sp...)
+		} else {
+			out = append(out, p)
+		}
+	}
+	return out
+}
+
 func parsePort(s string) (startPort, endPort int32, err error) {
 	if s == "any" {
 		startPort = firewall.PortAny
@@ -8,8 +8,38 @@ import (
 )
 
 // ConntrackCache is used as a local routine cache to know if a given flow
-// has been seen in the conntrack table.
-type ConntrackCache map[Packet]struct{}
+// has been seen in the conntrack table. The value holds the counters packets
+// on the flow are added to.
+type ConntrackCache map[Packet]CachedConn
+
+// CachedConn is what the cache keeps of a tracked flow. Rule is the counter of
+// the rule that allowed the flow, nil when rule stats are not enabled. Flow
+// counts the flow itself, nil when flows are not exported.
+type CachedConn struct {
+	Rule *Counter
+	Flow *Counter
+}
+
+// Add counts a packet of size bytes against both counters
+func (c CachedConn) Add(size int) {
+	c.Rule.Add(size)
+	c.Flow.Add(size)
+}
+
+// Counter counts the packets and bytes allowed by a firewall rule
+type Counter struct {
+	Packets atomic.Uint64
+	Bytes   atomic.Uint64
+}
+
+// Add counts a packet of size bytes, it is safe to call on a nil Counter
+func (c *Counter) Add(size int) {
+	if c == nil {
+		return
+	}
+	c.Packets.Add(1)
+	c.Bytes.Add(uint64(size))
+}
 
 type ConntrackCacheTicker struct {
 	cacheV    uint64
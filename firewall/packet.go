@@ -14,11 +14,77 @@ const (
 	ProtoTCP  = 6
 	ProtoUDP  = 17
 	ProtoICMP = 1
+	// ProtoICMPv6 has its own rules and type names, see ICMPv6Types
+	ProtoICMPv6 = 58
 
 	PortAny      = 0  // Special value for matching `port: any`
 	PortFragment = -1 // Special value for matching `port: fragment`
+
+	// icmpPortBase puts ICMP type and code matches past the range of real ports, see ICMPPort
+	icmpPortBase = 1 << 16
+)
+
+const (
+	ICMPEchoReply              = 0
+	ICMPDestinationUnreachable = 3
+	ICMPRedirect               = 5
+	ICMPEchoRequest            = 8
+	ICMPRouterAdvertisement    = 9
+	ICMPRouterSolicitation     = 10
+	ICMPTimeExceeded           = 11
+	ICMPParameterProblem       = 12
+	ICMPTimestampRequest       = 13
+	ICMPTimestampReply         = 14
+)
+
+// ICMPTypes maps the names rules can use for an ICMP type to the type
+var ICMPTypes = map[string]uint8{
+	"echo-reply":              ICMPEchoReply,
+	"destination-unreachable": ICMPDestinationUnreachable,
+	"redirect":                ICMPRedirect,
+	"echo-request":            ICMPEchoRequest,
+	"router-advertisement":    ICMPRouterAdvertisement,
+	"router-solicitation":     ICMPRouterSolicitation,
+	"time-exceeded":           ICMPTimeExceeded,
+	"parameter-problem":       ICMPParameterProblem,
+	"timestamp-request":       ICMPTimestampRequest,
+	"timestamp-reply":         ICMPTimestampReply,
+}
+
+const (
+	ICMPv6DestinationUnreachable = 1
+	ICMPv6PacketTooBig           = 2
+	ICMPv6TimeExceeded           = 3
+	ICMPv6ParameterProblem       = 4
+	ICMPv6EchoRequest            = 128
+	ICMPv6EchoReply              = 129
+	ICMPv6RouterSolicitation     = 133
+	ICMPv6RouterAdvertisement    = 134
+	ICMPv6NeighborSolicitation   = 135
+	ICMPv6NeighborAdvertisement  = 136
+	ICMPv6Redirect               = 137
 )
 
+// ICMPv6Types maps the names rules can use for an ICMPv6 type to the type
+var ICMPv6Types = map[string]uint8{
+	"destination-unreachable": ICMPv6DestinationUnreachable,
+	"packet-too-big":          ICMPv6PacketTooBig,
+	"time-exceeded":           ICMPv6TimeExceeded,
+	"parameter-problem":       ICMPv6ParameterProblem,
+	"echo-request":            ICMPv6EchoRequest,
+	"echo-reply":              ICMPv6EchoReply,
+	"router-solicitation":     ICMPv6RouterSolicitation,
+	"router-advertisement":    ICMPv6RouterAdvertisement,
+	"neighbor-solicitation":   ICMPv6NeighborSolicitation,
+	"neighbor-advertisement":  ICMPv6NeighborAdvertisement,
+	"redirect":                ICMPv6Redirect,
+}
+
+// ICMPPort returns the key rules for an ICMP type and code are stored under in place of a port
+func ICMPPort(icmpType, icmpCode uint8) int32 {
+	return icmpPortBase + int32(icmpType)<<8 + int32(icmpCode)
+}
+
 type Packet struct {
 	LocalIP    iputil.VpnIp
 	RemoteIP   iputil.VpnIp
@@ -26,6 +92,10 @@ type Packet struct {
 	RemotePort uint16
 	Protocol   uint8
 	Fragment   bool
+
+	// ICMPType and ICMPCode are only set for ICMP and ICMPv6 packets that are not fragments
+	ICMPType uint8
+	ICMPCode uint8
 }
 
 func (fp *Packet) Copy() *Packet {
@@ -36,6 +106,47 @@ func (fp *Packet) Copy() *Packet {
 		RemotePort: fp.RemotePort,
 		Protocol:   fp.Protocol,
 		Fragment:   fp.Fragment,
+		ICMPType:   fp.ICMPType,
+		ICMPCode:   fp.ICMPCode,
+	}
+}
+
+// IsICMP is true for ICMP and ICMPv6 packets, they are matched by type and code instead of ports
+func (fp Packet) IsICMP() bool {
+	return fp.Protocol == ProtoICMP || fp.Protocol == ProtoICMPv6
+}
+
+// ConntrackKey returns the packet as conntrack knows it. A reply to an ICMP query is tracked as the query so the
+// two share an entry, the same way both directions of a tcp or udp flow do.
+func (fp Packet) ConntrackKey() Packet {
+	switch fp.Protocol {
+	case ProtoICMP:
+		switch fp.ICMPType {
+		case ICMPEchoReply:
+			fp.ICMPType = ICMPEchoRequest
+		case ICMPTimestampReply:
+			fp.ICMPType = ICMPTimestampRequest
+		}
+	case ProtoICMPv6:
+		if fp.ICMPType == ICMPv6EchoReply {
+			fp.ICMPType = ICMPv6EchoRequest
+		}
+	}
+	return fp
+}
+
+// Port returns the key the packet is matched against in a rule table. That is the local port for incoming packets and
+// the remote port for outgoing ones, or the type and code for ICMP.
+func (fp Packet) Port(incoming bool) int32 {
+	switch {
+	case fp.Fragment:
+		return PortFragment
+	case fp.IsICMP():
+		return ICMPPort(fp.ICMPType, fp.ICMPCode)
+	case incoming:
+		return int32(fp.LocalPort)
+	default:
+		return int32(fp.RemotePort)
 	}
 }
 
@@ -46,17 +157,24 @@ func (fp Packet) MarshalJSON() ([]byte, error) {
 		proto = "tcp"
 	case ProtoICMP:
 		proto = "icmp"
+	case ProtoICMPv6:
+		proto = "icmpv6"
 	case ProtoUDP:
 		proto = "udp"
 	default:
 		proto = fmt.Sprintf("unknown %v", fp.Protocol)
 	}
-	return json.Marshal(m{
+	out := m{
 		"LocalIP":    fp.LocalIP.String(),
 		"RemoteIP":   fp.RemoteIP.String(),
 		"LocalPort":  fp.LocalPort,
 		"RemotePort": fp.RemotePort,
 		"Protocol":   proto,
 		"Fragment":   fp.Fragment,
-	})
+	}
+	if fp.IsICMP() && !fp.Fragment {
+		out["ICMPType"] = fp.ICMPType
+		out["ICMPCode"] = fp.ICMPCode
+	}
+	return json.Marshal(out)
 }
@@ -0,0 +1,359 @@
+package nebula
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/slackhq/nebula/cidr"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/iputil"
+)
+
+// firewallCIDRSet is a named list of addresses that rules can match the remote address against, like an ipset. The
+// entries can be changed at runtime without reloading the config, which suits lists fed from elsewhere like a threat
+// intel blocklist.
+type firewallCIDRSet struct {
+	sync.Mutex
+	name string
+
+	// tree is rebuilt on every change so packets can match against it without taking the lock
+	tree atomic.Pointer[cidr.Tree6[struct{}]]
+
+	// config holds the entries from the config, added and removed the changes made to them at runtime. The changes are
+	// applied to the set that replaces this one on a reload so they are not lost.
+	config  map[string]*net.IPNet
+	added   map[string]*net.IPNet
+	removed map[string]struct{}
+}
+
+// FirewallCIDRSet is a snapshot of a cidr set
+type FirewallCIDRSet struct {
+	Name    string   `json:"name"`
+	Blocked bool     `json:"blocked"`
+	CIDRs   []string `json:"cidrs"`
+}
+
+func newFirewallCIDRSet(name string, cidrs []*net.IPNet) *firewallCIDRSet {
+	s := &firewallCIDRSet{
+		name:    name,
+		config:  make(map[string]*net.IPNet, len(cidrs)),
+		added:   make(map[string]*net.IPNet),
+		removed: make(map[string]struct{}),
+	}
+
+	for _, n := range cidrs {
+		s.config[n.String()] = n
+	}
+
+	s.rebuild()
+	return s
+}
+
+// firewallCIDRSetsFromConfig reads firewall.cidr_sets, a map of set names to lists of cidrs or ips
+func firewallCIDRSetsFromConfig(c *config.C) (map[string]*firewallCIDRSet, error) {
+	sets := map[string]*firewallCIDRSet{}
+	for k, v := range c.GetMap("firewall.cidr_sets", map[interface{}]interface{}{}) {
+		name := fmt.Sprintf("%v", k)
+		var cidrs []*net.IPNet
+		for _, e := range toStringSlice(v) {
+			n, err := parseCIDRSetEntry(e)
+			if err != nil {
+				return nil, fmt.Errorf("firewall.cidr_sets.%s; %s", name, err)
+			}
+			cidrs = append(cidrs, n)
+		}
+
+		sets[name] = newFirewallCIDRSet(name, cidrs)
+	}
+
+	return sets, nil
+}
+
+// parseCIDRSetEntry parses a cidr, a bare ip is treated as a /32 or /128
+func parseCIDRSetEntry(s string) (*net.IPNet, error) {
+	s = strings.TrimSpace(s)
+	if !strings.Contains(s, "/") {
+		if strings.Contains(s, ":") {
+			s += "/128"
+		} else {
+			s += "/32"
+		}
+	}
+
+	_, n, err := net.ParseCIDR(s)
+	if err != nil {
+		return nil, fmt.Errorf("cidr did not parse; %s", err)
+	}
+
+	return n, nil
+}
+
+// parseCIDRSetEntries parses a list of cidrs or ips, see parseCIDRSetEntry
+func parseCIDRSetEntries(entries []string) ([]*net.IPNet, error) {
+	cidrs := make([]*net.IPNet, 0, len(entries))
+	for _, e := range entries {
+		n, err := parseCIDRSetEntry(e)
+		if err != nil {
+			return nil, err
+		}
+		cidrs = append(cidrs, n)
+	}
+	return cidrs, nil
+}
+
+func (s *firewallCIDRSet) contains(ip iputil.VpnIp) bool {
+	ok, _ := s.tree.Load().Contains(ip)
+	return ok
+}
+
+// add puts cidrs in the set
+func (s *firewallCIDRSet) add(cidrs []*net.IPNet) {
+	s.Lock()
+	defer s.Unlock()
+
+	for _, n := range cidrs {
+		k := n.String()
+		delete(s.removed, k)
+		if _, ok := s.config[k]; !ok {
+			s.added[k] = n
+		}
+	}
+
+	s.rebuild()
+}
+
+// remove takes cidrs out of the set, it returns true if any of them were in it
+func (s *firewallCIDRSet) remove(cidrs []*net.IPNet) bool {
+	s.Lock()
+	defer s.Unlock()
+
+	changed := false
+	for _, n := range cidrs {
+		k := n.String()
+		if _, ok := s.added[k]; ok {
+			delete(s.added, k)
+			changed = true
+		}
+
+		if _, ok := s.config[k]; ok {
+			if _, ok := s.removed[k]; !ok {
+				s.removed[k] = struct{}{}
+				changed = true
+			}
+		}
+	}
+
+	if changed {
+		s.rebuild()
+	}
+	return changed
+}
+
+// replace makes cidrs the only entries in the set, it returns true if any entries were removed
+func (s *firewallCIDRSet) replace(cidrs []*net.IPNet) bool {
+	s.Lock()
+	defer s.Unlock()
+
+	want := make(map[string]*net.IPNet, len(cidrs))
+	for _, n := range cidrs {
+		want[n.String()] = n
+	}
+
+	changed := false
+	for k := range s.entriesLocked() {
+		if _, ok := want[k]; !ok {
+			changed = true
+		}
+	}
+
+	s.added = make(map[string]*net.IPNet)
+	s.removed = make(map[string]struct{})
+	for k := range s.config {
+		if _, ok := want[k]; !ok {
+			s.removed[k] = struct{}{}
+		}
+	}
+	for k, n := range want {
+		if _, ok := s.config[k]; !ok {
+			s.added[k] = n
+		}
+	}
+
+	s.rebuild()
+	return changed
+}
+
+// inherit applies the runtime changes made to old, the set this one replaces on a reload
+func (s *firewallCIDRSet) inherit(old *firewallCIDRSet) {
+	old.Lock()
+	added := make([]*net.IPNet, 0, len(old.added))
+	for _, n := range old.added {
+		added = append(added, n)
+	}
+	removed := make([]*net.IPNet, 0, len(old.removed))
+	for k := range old.removed {
+		removed = append(removed, old.config[k])
+	}
+	old.Unlock()
+
+	s.add(added)
+	s.remove(removed)
+}
+
+// entriesLocked returns the current entries, the caller must hold the lock
+func (s *firewallCIDRSet) entriesLocked() map[string]*net.IPNet {
+	entries := make(map[string]*net.IPNet, len(s.config)+len(s.added))
+	for k, n := range s.config {
+		if _, ok := s.removed[k]; !ok {
+			entries[k] = n
+		}
+	}
+	for k, n := range s.added {
+		entries[k] = n
+	}
+	return entries
+}
+
+// rebuild swaps in a new tree of the current entries, the caller must hold the lock
+func (s *firewallCIDRSet) rebuild() {
+	tree := cidr.NewTree6[struct{}]()
+	for _, n := range s.entriesLocked() {
+		tree.AddCIDR(n, struct{}{})
+	}
+	s.tree.Store(tree)
+}
+
+// cidrs returns the current entries, sorted
+func (s *firewallCIDRSet) cidrs() []string {
+	s.Lock()
+	entries := s.entriesLocked()
+	s.Unlock()
+
+	out := make([]string, 0, len(entries))
+	for k := range entries {
+		out = append(out, k)
+	}
+	sort.Strings(out)
+	return out
+}
+
+// cidrSet returns the set with name or an error if there is not one
+func (f *Firewall) cidrSet(name string) (*firewallCIDRSet, error) {
+	s, ok := f.cidrSets[name]
+	if !ok {
+		return nil, fmt.Errorf("cidr_set `%s` is not defined in firewall.cidr_sets", name)
+	}
+	return s, nil
+}
+
+// blockedSetsFromConfig reads firewall.blocked_cidr_sets, the sets whose addresses are dropped before any rule is checked
+func (f *Firewall) blockedSetsFromConfig(c *config.C) error {
+	for _, name := range c.GetStringSlice("firewall.blocked_cidr_sets", []string{}) {
+		s, err := f.cidrSet(name)
+		if err != nil {
+			return fmt.Errorf("firewall.blocked_cidr_sets; %s", err)
+		}
+		f.blockedSets = append(f.blockedSets, s)
+	}
+	return nil
+}
+
+// blocked reports whether ip is in one of the blocked sets
+func (f *Firewall) blocked(ip iputil.VpnIp) bool {
+	for _, s := range f.blockedSets {
+		if s.contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *Firewall) isBlockedSet(s *firewallCIDRSet) bool {
+	for _, b := range f.blockedSets {
+		if b == s {
+			return true
+		}
+	}
+	return false
+}
+
+// CIDRSets returns the entries of every cidr set, sorted by name
+func (f *Firewall) CIDRSets() []FirewallCIDRSet {
+	out := make([]FirewallCIDRSet, 0, len(f.cidrSets))
+	for name, s := range f.cidrSets {
+		out = append(out, FirewallCIDRSet{Name: name, Blocked: f.isBlockedSet(s), CIDRs: s.cidrs()})
+	}
+
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].Name < out[j].Name
+	})
+	return out
+}
+
+// AddToCIDRSet adds cidrs to the named set. Connections to or from the new entries are blocked or allowed from the
+// next packet.
+func (f *Firewall) AddToCIDRSet(name string, cidrs []*net.IPNet) error {
+	s, err := f.cidrSet(name)
+	if err != nil {
+		return err
+	}
+
+	s.add(cidrs)
+	return nil
+}
+
+// RemoveFromCIDRSet removes cidrs from the named set. Tracked connections are checked against the rules again so
+// those only allowed by a removed entry are dropped.
+func (f *Firewall) RemoveFromCIDRSet(name string, cidrs []*net.IPNet) error {
+	s, err := f.cidrSet(name)
+	if err != nil {
+		return err
+	}
+
+	if s.remove(cidrs) {
+		f.recheckConntrack()
+	}
+	return nil
+}
+
+// ReplaceCIDRSet makes cidrs the only entries of the named set, tracked connections are checked again as with
+// RemoveFromCIDRSet
+func (f *Firewall) ReplaceCIDRSet(name string, cidrs []*net.IPNet) error {
+	s, err := f.cidrSet(name)
+	if err != nil {
+		return err
+	}
+
+	if s.replace(cidrs) {
+		f.recheckConntrack()
+	}
+	return nil
+}
+
+// inheritCIDRSets keeps the runtime changes made to the sets of the firewall this one replaces
+func (f *Firewall) inheritCIDRSets(old *Firewall) {
+	for name, s := range f.cidrSets {
+		if prev, ok := old.cidrSets[name]; ok {
+			s.inherit(prev)
+		}
+	}
+}
+
+// recheckConntrack bumps rulesVersion so every tracked connection is checked against the rules on its next packet
+func (f *Firewall) recheckConntrack() {
+	conntrack := f.Conntrack
+	conntrack.Lock()
+	defer conntrack.Unlock()
+
+	f.rulesVersion++
+	if f.rulesVersion == 0 {
+		// Wrapped all the way around, old entries could look current so start over
+		for key, c := range conntrack.Conns {
+			f.removeConn(key, c, flowEndForced)
+		}
+	}
+}
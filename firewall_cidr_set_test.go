@@ -0,0 +1,169 @@
+package nebula
+
+import (
+	"net"
+	"testing"
+
+	"github.com/slackhq/nebula/cert"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/firewall"
+	"github.com/slackhq/nebula/iputil"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFirewall_CIDRSets(t *testing.T) {
+	l := test.NewLogger()
+
+	ipNet := net.IPNet{IP: net.IPv4(1, 2, 3, 4), Mask: net.IPMask{255, 255, 255, 0}}
+	c := cert.NebulaCertificate{
+		Details: cert.NebulaCertificateDetails{
+			Name:           "host1",
+			Ips:            []*net.IPNet{&ipNet},
+			Subnets:        []*net.IPNet{{IP: net.IPv4(10, 0, 0, 0), Mask: net.IPMask{255, 255, 255, 0}}},
+			InvertedGroups: map[string]struct{}{},
+		},
+	}
+	h := HostInfo{ConnectionState: &ConnectionState{peerCert: &c}, vpnIp: iputil.Ip2VpnIp(ipNet.IP)}
+	h.CreateRemoteCIDR(&c)
+
+	p := firewall.Packet{
+		LocalIP:    iputil.Ip2VpnIp(net.IPv4(1, 2, 3, 4)),
+		RemoteIP:   iputil.Ip2VpnIp(net.IPv4(10, 0, 0, 5)),
+		LocalPort:  443,
+		RemotePort: 5000,
+		Protocol:   firewall.ProtoTCP,
+	}
+
+	conf := config.NewC(l)
+	conf.Settings["firewall"] = map[interface{}]interface{}{
+		"cidr_sets": map[interface{}]interface{}{
+			"partners": []interface{}{"10.0.0.0/30", "10.0.0.5"},
+			"threats":  []interface{}{"10.0.0.200"},
+		},
+		"blocked_cidr_sets": []interface{}{"threats"},
+		"inbound": []interface{}{
+			map[interface{}]interface{}{"port": "443", "proto": "tcp", "cidr_set": "partners"},
+		},
+	}
+
+	fw, err := NewFirewallFromConfig(l, &c, conf)
+	require.NoError(t, err)
+	cp := cert.NewCAPool()
+
+	assert.Equal(t, []FirewallCIDRSet{
+		{Name: "partners", CIDRs: []string{"10.0.0.0/30", "10.0.0.5/32"}},
+		{Name: "threats", Blocked: true, CIDRs: []string{"10.0.0.200/32"}},
+	}, fw.CIDRSets())
+
+	// In the set
+	require.NoError(t, fw.Drop(p, true, &h, cp, nil, nil))
+
+	// Not in the set until it is added
+	p.RemoteIP = iputil.Ip2VpnIp(net.IPv4(10, 0, 0, 9))
+	assert.Equal(t, ErrNoMatchingRule, fw.Drop(p, true, &h, cp, nil, nil))
+	require.NoError(t, fw.AddToCIDRSet("partners", []*net.IPNet{{IP: net.IPv4(10, 0, 0, 8), Mask: net.IPMask{255, 255, 255, 248}}}))
+	require.NoError(t, fw.Drop(p, true, &h, cp, nil, nil))
+
+	// Removing an entry drops the connections it allowed
+	version := fw.rulesVersion
+	require.NoError(t, fw.RemoveFromCIDRSet("partners", []*net.IPNet{{IP: net.IPv4(10, 0, 0, 8), Mask: net.IPMask{255, 255, 255, 248}}}))
+	assert.Equal(t, version+1, fw.rulesVersion)
+	assert.Equal(t, ErrNoMatchingRule, fw.Drop(p, true, &h, cp, nil, nil))
+
+	// Removing something that is not in the set changes nothing
+	require.NoError(t, fw.RemoveFromCIDRSet("partners", []*net.IPNet{{IP: net.IPv4(10, 0, 0, 8), Mask: net.IPMask{255, 255, 255, 248}}}))
+	assert.Equal(t, version+1, fw.rulesVersion)
+
+	// Blocking a remote cuts off its established connection
+	p.RemoteIP = iputil.Ip2VpnIp(net.IPv4(10, 0, 0, 5))
+	require.NoError(t, fw.Drop(p, true, &h, cp, nil, nil))
+	require.NoError(t, fw.AddToCIDRSet("threats", []*net.IPNet{{IP: net.IPv4(10, 0, 0, 5), Mask: net.IPMask{255, 255, 255, 255}}}))
+	assert.Equal(t, ErrBlockedRemoteIP, fw.Drop(p, true, &h, cp, nil, nil))
+	assert.Equal(t, ErrBlockedRemoteIP, fw.Drop(p, false, &h, cp, nil, nil))
+
+	require.NoError(t, fw.ReplaceCIDRSet("threats", nil))
+	require.NoError(t, fw.Drop(p, true, &h, cp, nil, nil))
+
+	assert.EqualError(t, fw.AddToCIDRSet("nope", nil), "cidr_set `nope` is not defined in firewall.cidr_sets")
+
+	// The set entries are not part of the rule hash
+	conf.Settings["firewall"].(map[interface{}]interface{})["cidr_sets"] = map[interface{}]interface{}{
+		"partners": []interface{}{"10.0.0.0/30"},
+		"threats":  []interface{}{},
+	}
+	fw2, err := NewFirewallFromConfig(l, &c, conf)
+	require.NoError(t, err)
+	assert.Equal(t, fw.GetRuleHash(), fw2.GetRuleHash())
+
+	// Runtime changes carry over to the firewall that replaces this one, config entries come from the new config
+	require.NoError(t, fw.AddToCIDRSet("partners", []*net.IPNet{{IP: net.IPv4(10, 0, 9, 9), Mask: net.IPMask{255, 255, 255, 255}}}))
+	fw2.inheritCIDRSets(fw)
+	assert.Equal(t, []FirewallCIDRSet{
+		{Name: "partners", CIDRs: []string{"10.0.0.0/30", "10.0.9.9/32"}},
+		{Name: "threats", Blocked: true, CIDRs: []string{}},
+	}, fw2.CIDRSets())
+}
+
+func TestFirewallCIDRSet_replace(t *testing.T) {
+	cidrs, err := parseCIDRSetEntries([]string{"10.0.0.0/24", "10.0.1.1"})
+	require.NoError(t, err)
+	s := newFirewallCIDRSet("test", cidrs)
+
+	replaced, err := parseCIDRSetEntries([]string{"10.0.1.1", "10.0.2.0/24"})
+	require.NoError(t, err)
+	assert.True(t, s.replace(replaced))
+	assert.Equal(t, []string{"10.0.1.1/32", "10.0.2.0/24"}, s.cidrs())
+	assert.False(t, s.contains(iputil.Ip2VpnIp(net.IPv4(10, 0, 0, 1))))
+	assert.True(t, s.contains(iputil.Ip2VpnIp(net.IPv4(10, 0, 2, 1))))
+
+	// Only adding entries does not need conntrack to be rechecked
+	replaced = append(replaced, &net.IPNet{IP: net.IPv4(10, 0, 3, 0), Mask: net.IPMask{255, 255, 255, 0}})
+	assert.False(t, s.replace(replaced))
+
+	// Adding back a config entry undoes its removal
+	s.add(cidrs[:1])
+	assert.Equal(t, []string{"10.0.0.0/24", "10.0.1.1/32", "10.0.2.0/24", "10.0.3.0/24"}, s.cidrs())
+	assert.Empty(t, s.removed)
+}
+
+func TestNewFirewallFromConfig_CIDRSets(t *testing.T) {
+	l := test.NewLogger()
+	c := &cert.NebulaCertificate{}
+	conf := config.NewC(l)
+
+	conf.Settings["firewall"] = map[interface{}]interface{}{"cidr_sets": map[interface{}]interface{}{"bad": []interface{}{"nope"}}}
+	_, err := NewFirewallFromConfig(l, c, conf)
+	assert.EqualError(t, err, "firewall.cidr_sets.bad; cidr did not parse; invalid CIDR address: nope/32")
+
+	conf.Settings["firewall"] = map[interface{}]interface{}{"cidr_sets": map[interface{}]interface{}{"v6": []interface{}{"fd00::/64", "fd01::1"}}}
+	fw, err := NewFirewallFromConfig(l, c, conf)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"fd00::/64", "fd01::1/128"}, fw.cidrSets["v6"].cidrs())
+
+	conf.Settings["firewall"] = map[interface{}]interface{}{"blocked_cidr_sets": []interface{}{"nope"}}
+	_, err = NewFirewallFromConfig(l, c, conf)
+	assert.EqualError(t, err, "firewall.blocked_cidr_sets; cidr_set `nope` is not defined in firewall.cidr_sets")
+
+	conf.Settings["firewall"] = map[interface{}]interface{}{
+		"inbound": []interface{}{map[interface{}]interface{}{"port": "22", "proto": "tcp", "cidr_set": "nope"}},
+	}
+	_, err = NewFirewallFromConfig(l, c, conf)
+	assert.EqualError(t, err, "firewall.inbound rule #0; `cidr_set `nope` is not defined in firewall.cidr_sets`")
+
+	// A cidr set names the remote hosts well enough for strict_outbound
+	conf.Settings["firewall"] = map[interface{}]interface{}{
+		"strict_outbound": true,
+		"cidr_sets":       map[interface{}]interface{}{"dns": []interface{}{"10.0.0.53"}},
+		"outbound":        []interface{}{map[interface{}]interface{}{"port": "53", "proto": "udp", "cidr_set": "dns"}},
+	}
+	_, err = NewFirewallFromConfig(l, c, conf)
+	assert.NoError(t, err)
+
+	mf := &mockFirewall{}
+	conf.Settings["firewall"] = map[interface{}]interface{}{
+		"inbound": []interface{}{map[interface{}]interface{}{"port": "22", "proto": "tcp", "cidr_set": "dns"}},
+	}
+	assert.EqualError(t, AddFirewallRulesFromConfig(l, true, conf, mf), "firewall.inbound rule #0; cidr sets are not supported here")
+}
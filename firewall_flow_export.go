@@ -0,0 +1,295 @@
+package nebula
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	"github.com/sirupsen/logrus"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/firewall"
+)
+
+// IPFIX flowEndReason values, RFC 5102
+const (
+	flowEndIdleTimeout     uint8 = 0x01
+	flowEndForced          uint8 = 0x04
+	flowEndLackOfResources uint8 = 0x05
+)
+
+const (
+	ipfixVersion       = 10
+	ipfixTemplateSetID = 2
+	ipfixTemplateID    = 256
+	ipfixTemplate6ID   = 257
+	ipfixHeaderLen     = 16
+	ipfixSetHeaderLen  = 4
+	ipfixFieldCount    = 11
+	ipfixTemplateLen   = ipfixSetHeaderLen + 2*(4+ipfixFieldCount*4)
+	ipfixRecordLen     = 47
+	ipfixRecord6Len    = ipfixRecordLen + 2*(16-4)
+	ipfixMaxMessageLen = 1400
+
+	ipfixMaxRecordsPerMessage = (ipfixMaxMessageLen - ipfixHeaderLen - ipfixTemplateLen - 2*ipfixSetHeaderLen) / ipfixRecord6Len
+
+	flowExportQueueLen      = 1024
+	flowExportFlushInterval = time.Second
+)
+
+// ipfixTemplateSet describes the records in the data sets, ipv4 flows then ipv6 flows. It is sent with every message
+// so a collector that restarts can decode the next message it gets.
+var ipfixTemplateSet = func() []byte {
+	// Information element id and length of each field, in the order they are written by flowRecord.encode
+	fields := [][2]uint16{
+		{8, 4},   // sourceIPv4Address
+		{12, 4},  // destinationIPv4Address
+		{7, 2},   // sourceTransportPort
+		{11, 2},  // destinationTransportPort
+		{4, 1},   // protocolIdentifier
+		{2, 8},   // packetDeltaCount
+		{1, 8},   // octetDeltaCount
+		{152, 8}, // flowStartMilliseconds
+		{153, 8}, // flowEndMilliseconds
+		{136, 1}, // flowEndReason
+		{61, 1},  // flowDirection
+	}
+
+	b := make([]byte, ipfixTemplateLen)
+	binary.BigEndian.PutUint16(b[0:], ipfixTemplateSetID)
+	binary.BigEndian.PutUint16(b[2:], uint16(len(b)))
+
+	off := ipfixSetHeaderLen
+	for _, id := range []uint16{ipfixTemplateID, ipfixTemplate6ID} {
+		if id == ipfixTemplate6ID {
+			// sourceIPv6Address and destinationIPv6Address
+			fields[0], fields[1] = [2]uint16{27, 16}, [2]uint16{28, 16}
+		}
+
+		binary.BigEndian.PutUint16(b[off:], id)
+		binary.BigEndian.PutUint16(b[off+2:], uint16(len(fields)))
+		off += 4
+		for _, f := range fields {
+			binary.BigEndian.PutUint16(b[off:], f[0])
+			binary.BigEndian.PutUint16(b[off+2:], f[1])
+			off += 4
+		}
+	}
+	return b
+}()
+
+// flowRecord is a finished conntrack entry
+type flowRecord struct {
+	key      firewall.Packet
+	incoming bool
+	packets  uint64
+	bytes    uint64
+	start    time.Time
+	end      time.Time
+	reason   uint8
+}
+
+// encode writes the record in the order of ipfixTemplateSet, the remote end is the source of an incoming flow. It
+// returns the length of the record, which depends on the address family.
+func (r *flowRecord) encode(b []byte) int {
+	src, dst := r.key.LocalIP, r.key.RemoteIP
+	srcPort, dstPort := r.key.LocalPort, r.key.RemotePort
+	direction := uint8(1)
+	if r.incoming {
+		src, dst = dst, src
+		srcPort, dstPort = dstPort, srcPort
+		direction = 0
+	}
+
+	if r.key.Protocol != firewall.ProtoTCP && r.key.Protocol != firewall.ProtoUDP {
+		srcPort, dstPort = 0, 0
+	}
+
+	if src.Is4() {
+		binary.BigEndian.PutUint32(b[0:], src.Uint32())
+		binary.BigEndian.PutUint32(b[4:], dst.Uint32())
+	} else {
+		src, dst := src.As16(), dst.As16()
+		copy(b[0:], src[:])
+		copy(b[16:], dst[:])
+		b = b[2*(16-4):]
+	}
+
+	binary.BigEndian.PutUint16(b[8:], srcPort)
+	binary.BigEndian.PutUint16(b[10:], dstPort)
+	b[12] = r.key.Protocol
+	binary.BigEndian.PutUint64(b[13:], r.packets)
+	binary.BigEndian.PutUint64(b[21:], r.bytes)
+	binary.BigEndian.PutUint64(b[29:], uint64(r.start.UnixMilli()))
+	binary.BigEndian.PutUint64(b[37:], uint64(r.end.UnixMilli()))
+	b[45] = r.reason
+	b[46] = direction
+
+	if src.Is4() {
+		return ipfixRecordLen
+	}
+	return ipfixRecord6Len
+}
+
+// flowExporter sends a record of every conntrack entry to an IPFIX collector over udp when the entry goes away.
+// Records are queued so the packet path never waits on the network, records that do not fit in the queue are
+// dropped and counted.
+type flowExporter struct {
+	l        *logrus.Logger
+	conn     net.Conn
+	domain   uint32
+	records  chan flowRecord
+	dropped  metrics.Counter
+	sequence uint32
+
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+// newFlowExporterFromConfig returns nil when firewall.conntrack.flow_export.collector is not set
+func newFlowExporterFromConfig(l *logrus.Logger, c *config.C) (*flowExporter, error) {
+	collector := c.GetString("firewall.conntrack.flow_export.collector", "")
+	if collector == "" {
+		return nil, nil
+	}
+
+	domain := c.GetInt("firewall.conntrack.flow_export.observation_domain", 0)
+	if domain < 0 || int64(domain) > 0xffffffff {
+		return nil, fmt.Errorf("firewall.conntrack.flow_export.observation_domain must be from 0 to 4294967295")
+	}
+
+	conn, err := net.Dial("udp", collector)
+	if err != nil {
+		return nil, fmt.Errorf("firewall.conntrack.flow_export.collector could not be used: %s", err)
+	}
+
+	fe := &flowExporter{
+		l:       l,
+		conn:    conn,
+		domain:  uint32(domain),
+		records: make(chan flowRecord, flowExportQueueLen),
+		dropped: metrics.GetOrRegisterCounter("firewall.flow_export.dropped", nil),
+		done:    make(chan struct{}),
+	}
+
+	fe.wg.Add(1)
+	go fe.run()
+	return fe, nil
+}
+
+// export queues a record, it never blocks and is safe to call after close
+func (fe *flowExporter) export(r flowRecord) {
+	select {
+	case fe.records <- r:
+	default:
+		fe.dropped.Inc(1)
+	}
+}
+
+func (fe *flowExporter) run() {
+	defer fe.wg.Done()
+
+	ticker := time.NewTicker(flowExportFlushInterval)
+	defer ticker.Stop()
+
+	batch := make([]flowRecord, 0, ipfixMaxRecordsPerMessage)
+	for {
+		select {
+		case r := <-fe.records:
+			batch = append(batch, r)
+			if len(batch) == ipfixMaxRecordsPerMessage {
+				batch = fe.send(batch)
+			}
+		case <-ticker.C:
+			batch = fe.send(batch)
+		case <-fe.done:
+			// Send what is left so records are not lost on a reload
+			for {
+				select {
+				case r := <-fe.records:
+					batch = append(batch, r)
+					if len(batch) == ipfixMaxRecordsPerMessage {
+						batch = fe.send(batch)
+					}
+				default:
+					fe.send(batch)
+					return
+				}
+			}
+		}
+	}
+}
+
+// send writes the batch as one message and returns it emptied
+func (fe *flowExporter) send(batch []flowRecord) []flowRecord {
+	if len(batch) == 0 {
+		return batch
+	}
+
+	b := fe.message(batch, time.Now())
+	if _, err := fe.conn.Write(b); err != nil {
+		fe.l.WithError(err).WithField("records", len(batch)).Debug("Failed to export flows")
+		fe.dropped.Inc(int64(len(batch)))
+	}
+
+	fe.sequence += uint32(len(batch))
+	return batch[:0]
+}
+
+// message builds an IPFIX message of the template and a data set for each address family in batch
+func (fe *flowExporter) message(batch []flowRecord, now time.Time) []byte {
+	var n4, n6 int
+	for i := range batch {
+		if batch[i].key.LocalIP.Is4() {
+			n4++
+		} else {
+			n6++
+		}
+	}
+
+	dataLen := n4*ipfixRecordLen + n6*ipfixRecord6Len
+	for _, n := range []int{n4, n6} {
+		if n > 0 {
+			dataLen += ipfixSetHeaderLen
+		}
+	}
+	b := make([]byte, ipfixHeaderLen+len(ipfixTemplateSet)+dataLen)
+
+	binary.BigEndian.PutUint16(b[0:], ipfixVersion)
+	binary.BigEndian.PutUint16(b[2:], uint16(len(b)))
+	binary.BigEndian.PutUint32(b[4:], uint32(now.Unix()))
+	binary.BigEndian.PutUint32(b[8:], fe.sequence)
+	binary.BigEndian.PutUint32(b[12:], fe.domain)
+
+	off := ipfixHeaderLen + copy(b[ipfixHeaderLen:], ipfixTemplateSet)
+	for _, v4 := range []bool{true, false} {
+		id, n, recordLen := uint16(ipfixTemplateID), n4, ipfixRecordLen
+		if !v4 {
+			id, n, recordLen = ipfixTemplate6ID, n6, ipfixRecord6Len
+		}
+		if n == 0 {
+			continue
+		}
+
+		binary.BigEndian.PutUint16(b[off:], id)
+		binary.BigEndian.PutUint16(b[off+2:], uint16(ipfixSetHeaderLen+n*recordLen))
+		off += ipfixSetHeaderLen
+
+		for i := range batch {
+			if batch[i].key.LocalIP.Is4() == v4 {
+				off += batch[i].encode(b[off:])
+			}
+		}
+	}
+
+	return b
+}
+
+// close sends any queued records and stops the exporter
+func (fe *flowExporter) close() {
+	close(fe.done)
+	fe.wg.Wait()
+	fe.conn.Close()
+}
@@ -0,0 +1,187 @@
+package nebula
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/slackhq/nebula/cert"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/firewall"
+	"github.com/slackhq/nebula/iputil"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFlowExporter_message(t *testing.T) {
+	fe := &flowExporter{domain: 7, sequence: 3}
+	start := time.UnixMilli(1700000000000)
+	r := flowRecord{
+		key: firewall.Packet{
+			LocalIP:    iputil.Ip2VpnIp(net.IPv4(10, 0, 0, 1)),
+			RemoteIP:   iputil.Ip2VpnIp(net.IPv4(10, 0, 0, 2)),
+			LocalPort:  22,
+			RemotePort: 50000,
+			Protocol:   firewall.ProtoTCP,
+		},
+		incoming: true,
+		packets:  10,
+		bytes:    1000,
+		start:    start,
+		end:      start.Add(time.Minute),
+		reason:   flowEndIdleTimeout,
+	}
+
+	b := fe.message([]flowRecord{r, r}, start)
+	require.Len(t, b, ipfixHeaderLen+ipfixTemplateLen+ipfixSetHeaderLen+2*ipfixRecordLen)
+	assert.True(t, ipfixMaxRecordsPerMessage*ipfixRecordLen+ipfixHeaderLen+ipfixTemplateLen+ipfixSetHeaderLen <= ipfixMaxMessageLen)
+
+	// Header
+	assert.Equal(t, uint16(10), binary.BigEndian.Uint16(b[0:]))
+	assert.Equal(t, uint16(len(b)), binary.BigEndian.Uint16(b[2:]))
+	assert.Equal(t, uint32(3), binary.BigEndian.Uint32(b[8:]))
+	assert.Equal(t, uint32(7), binary.BigEndian.Uint32(b[12:]))
+
+	// Template set
+	tpl := b[ipfixHeaderLen:]
+	assert.Equal(t, uint16(ipfixTemplateSetID), binary.BigEndian.Uint16(tpl[0:]))
+	assert.Equal(t, uint16(ipfixTemplateLen), binary.BigEndian.Uint16(tpl[2:]))
+	assert.Equal(t, uint16(ipfixFieldCount), binary.BigEndian.Uint16(tpl[6:]))
+
+	// The template lengths add up to a record
+	sum := 0
+	for i := 0; i < ipfixFieldCount; i++ {
+		sum += int(binary.BigEndian.Uint16(tpl[10+i*4:]))
+	}
+	assert.Equal(t, ipfixRecordLen, sum)
+
+	// Data set, the remote end is the source of an incoming flow
+	data := b[ipfixHeaderLen+ipfixTemplateLen:]
+	assert.Equal(t, uint16(ipfixTemplateID), binary.BigEndian.Uint16(data[0:]))
+	rec := data[ipfixSetHeaderLen:]
+	assert.Equal(t, net.IPv4(10, 0, 0, 2).To4(), net.IP(rec[0:4]))
+	assert.Equal(t, net.IPv4(10, 0, 0, 1).To4(), net.IP(rec[4:8]))
+	assert.Equal(t, uint16(50000), binary.BigEndian.Uint16(rec[8:]))
+	assert.Equal(t, uint16(22), binary.BigEndian.Uint16(rec[10:]))
+	assert.Equal(t, uint8(firewall.ProtoTCP), rec[12])
+	assert.Equal(t, uint64(10), binary.BigEndian.Uint64(rec[13:]))
+	assert.Equal(t, uint64(1000), binary.BigEndian.Uint64(rec[21:]))
+	assert.Equal(t, uint64(1700000000000), binary.BigEndian.Uint64(rec[29:]))
+	assert.Equal(t, uint64(1700000060000), binary.BigEndian.Uint64(rec[37:]))
+	assert.Equal(t, flowEndIdleTimeout, rec[45])
+	assert.Equal(t, uint8(0), rec[46])
+}
+
+func TestFirewall_ConntrackLimits(t *testing.T) {
+	l := test.NewLogger()
+	ipNet := net.IPNet{IP: net.IPv4(1, 2, 3, 4), Mask: net.IPMask{255, 255, 255, 0}}
+	c := cert.NebulaCertificate{Details: cert.NebulaCertificateDetails{Name: "me", Ips: []*net.IPNet{&ipNet}, InvertedGroups: map[string]struct{}{}}}
+	h := HostInfo{ConnectionState: &ConnectionState{peerCert: &c}, vpnIp: iputil.Ip2VpnIp(ipNet.IP)}
+	h.CreateRemoteCIDR(&c)
+	cp := cert.NewCAPool()
+
+	collector, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.NoError(t, err)
+	defer collector.Close()
+
+	conf := config.NewC(l)
+	conf.Settings["firewall"] = map[interface{}]interface{}{
+		"conntrack": map[interface{}]interface{}{
+			"max_connections": 2,
+			"icmp_timeout":    "30s",
+			"flow_export":     map[interface{}]interface{}{"collector": collector.LocalAddr().String()},
+		},
+		"inbound": []interface{}{map[interface{}]interface{}{"port": "any", "proto": "any", "host": "any"}},
+	}
+	fw, err := NewFirewallFromConfig(l, &c, conf)
+	require.NoError(t, err)
+	assert.Equal(t, 30*time.Second, fw.timeout(firewall.ProtoICMP))
+	assert.Equal(t, 10*time.Minute, fw.timeout(firewall.ProtoAny))
+
+	p := firewall.Packet{
+		LocalIP:    iputil.Ip2VpnIp(net.IPv4(1, 2, 3, 4)),
+		RemoteIP:   iputil.Ip2VpnIp(net.IPv4(1, 2, 3, 4)),
+		LocalPort:  80,
+		RemotePort: 1,
+		Protocol:   firewall.ProtoTCP,
+	}
+	p2, p3 := p, p
+	p2.RemotePort = 2
+	p3.RemotePort = 3
+
+	require.NoError(t, fw.Drop(p, true, &h, cp, nil, make([]byte, 100)))
+	require.NoError(t, fw.Drop(p2, true, &h, cp, nil, nil))
+	// Using the first connection again makes the second the least recently used
+	require.NoError(t, fw.Drop(p, true, &h, cp, nil, make([]byte, 50)))
+	require.NoError(t, fw.Drop(p3, true, &h, cp, nil, nil))
+
+	assert.Len(t, fw.Conntrack.Conns, 2)
+	assert.Contains(t, fw.Conntrack.Conns, p)
+	assert.NotContains(t, fw.Conntrack.Conns, p2)
+	assert.Equal(t, 2, fw.Conntrack.lru.Len())
+
+	// Evicting the rest exports their flows when the exporter closes, p is older than p3
+	fw.Conntrack.Lock()
+	fw.evictOldest()
+	fw.evictOldest()
+	fw.Conntrack.Unlock()
+	fw.Destroy()
+
+	b := make([]byte, ipfixMaxMessageLen)
+	require.NoError(t, collector.SetReadDeadline(time.Now().Add(time.Second)))
+	n, err := collector.Read(b)
+	require.NoError(t, err)
+	require.Equal(t, ipfixHeaderLen+ipfixTemplateLen+ipfixSetHeaderLen+3*ipfixRecordLen, n)
+
+	// The records come in the order the connections were evicted
+	recs := b[ipfixHeaderLen+ipfixTemplateLen+ipfixSetHeaderLen:]
+	assert.Equal(t, uint16(2), binary.BigEndian.Uint16(recs[8:]))
+	assert.Equal(t, flowEndLackOfResources, recs[45])
+	rec := recs[ipfixRecordLen:]
+	assert.Equal(t, uint16(1), binary.BigEndian.Uint16(rec[8:]))
+	assert.Equal(t, uint64(2), binary.BigEndian.Uint64(rec[13:]))
+	assert.Equal(t, uint64(150), binary.BigEndian.Uint64(rec[21:]))
+
+	// drop_new refuses new connections once the table is full
+	conf.Settings["firewall"] = map[interface{}]interface{}{
+		"conntrack": map[interface{}]interface{}{"max_connections": 1, "eviction": "drop_new"},
+		"inbound":   []interface{}{map[interface{}]interface{}{"port": "any", "proto": "any", "host": "any"}},
+	}
+	fw, err = NewFirewallFromConfig(l, &c, conf)
+	require.NoError(t, err)
+	require.NoError(t, fw.Drop(p, true, &h, cp, nil, nil))
+	assert.Equal(t, ErrConntrackFull, fw.Drop(p2, true, &h, cp, nil, nil))
+	require.NoError(t, fw.Drop(p, true, &h, cp, nil, nil))
+
+	// A firewall with a smaller table evicts what does not fit when it takes over
+	conf.Settings["firewall"] = map[interface{}]interface{}{
+		"conntrack": map[interface{}]interface{}{"max_connections": 1},
+	}
+	fw2, err := NewFirewallFromConfig(l, &c, conf)
+	require.NoError(t, err)
+	fw.Conntrack.Conns[p2] = &conn{}
+	fw.Conntrack.Lock()
+	fw2.inheritConntrack(fw.Conntrack)
+	fw.Conntrack.Unlock()
+	assert.Len(t, fw2.Conntrack.Conns, 1)
+}
+
+func TestNewFirewallFromConfig_Conntrack(t *testing.T) {
+	l := test.NewLogger()
+	c := &cert.NebulaCertificate{}
+	conf := config.NewC(l)
+
+	conf.Settings["firewall"] = map[interface{}]interface{}{"conntrack": map[interface{}]interface{}{"max_connections": -1}}
+	_, err := NewFirewallFromConfig(l, c, conf)
+	assert.EqualError(t, err, "firewall.conntrack.max_connections must not be negative")
+
+	conf.Settings["firewall"] = map[interface{}]interface{}{"conntrack": map[interface{}]interface{}{"eviction": "random"}}
+	_, err = NewFirewallFromConfig(l, c, conf)
+	assert.EqualError(t, err, "firewall.conntrack.eviction must be one of lru or drop_new; `random`")
+
+	conf.Settings["firewall"] = map[interface{}]interface{}{"conntrack": map[interface{}]interface{}{"flow_export": map[interface{}]interface{}{"collector": "nope"}}}
+	_, err = NewFirewallFromConfig(l, c, conf)
+	assert.ErrorContains(t, err, "firewall.conntrack.flow_export.collector could not be used")
+}
@@ -0,0 +1,211 @@
+package nebula
+
+import (
+	"fmt"
+	"strings"
+)
+
+type groupExprOp uint8
+
+const (
+	groupExprGroup groupExprOp = iota
+	groupExprNot
+	groupExprAnd
+	groupExprOr
+)
+
+// groupExpr is a boolean expression over the groups in a certificate, like `(team:infra OR team:sre) AND NOT env:dev`.
+// It is parsed once when the rules are loaded, nested ANDs and ORs are flattened so matching walks as few nodes as
+// possible.
+type groupExpr struct {
+	op    groupExprOp
+	group string
+	args  []*groupExpr
+}
+
+// parseGroupExpr parses an expression of group names joined by AND, OR, and NOT with parentheses for grouping. NOT
+// binds tightest, then AND, then OR. The operators must be upper case, anything else that is not a parenthesis or
+// whitespace is a group name.
+func parseGroupExpr(s string) (*groupExpr, error) {
+	p := &groupExprParser{tokens: tokenizeGroupExpr(s)}
+	if len(p.tokens) == 0 {
+		return nil, fmt.Errorf("group_expr is empty")
+	}
+
+	e, err := p.or()
+	if err != nil {
+		return nil, fmt.Errorf("group_expr `%s`; %s", s, err)
+	}
+
+	if p.pos < len(p.tokens) {
+		return nil, fmt.Errorf("group_expr `%s`; unexpected `%s`", s, p.tokens[p.pos])
+	}
+
+	return e, nil
+}
+
+func tokenizeGroupExpr(s string) []string {
+	var tokens []string
+	start := -1
+	for i, r := range s {
+		switch {
+		case r == '(' || r == ')' || r == ' ' || r == '\t' || r == '\n':
+			if start >= 0 {
+				tokens = append(tokens, s[start:i])
+				start = -1
+			}
+			if r == '(' || r == ')' {
+				tokens = append(tokens, string(r))
+			}
+		case start < 0:
+			start = i
+		}
+	}
+
+	if start >= 0 {
+		tokens = append(tokens, s[start:])
+	}
+	return tokens
+}
+
+type groupExprParser struct {
+	tokens []string
+	pos    int
+}
+
+func (p *groupExprParser) peek() string {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
+	}
+	return ""
+}
+
+func (p *groupExprParser) or() (*groupExpr, error) {
+	return p.list(groupExprOr, "OR", p.and)
+}
+
+func (p *groupExprParser) and() (*groupExpr, error) {
+	return p.list(groupExprAnd, "AND", p.not)
+}
+
+// list parses operands joined by keyword, a single operand is returned as is
+func (p *groupExprParser) list(op groupExprOp, keyword string, operand func() (*groupExpr, error)) (*groupExpr, error) {
+	e, err := operand()
+	if err != nil {
+		return nil, err
+	}
+
+	if p.peek() != keyword {
+		return e, nil
+	}
+
+	out := &groupExpr{op: op}
+	out.add(e)
+	for p.peek() == keyword {
+		p.pos++
+		e, err = operand()
+		if err != nil {
+			return nil, err
+		}
+		out.add(e)
+	}
+
+	return out, nil
+}
+
+// add appends e to the operands, flattening it if it is the same operation
+func (e *groupExpr) add(arg *groupExpr) {
+	if arg.op == e.op {
+		e.args = append(e.args, arg.args...)
+	} else {
+		e.args = append(e.args, arg)
+	}
+}
+
+func (p *groupExprParser) not() (*groupExpr, error) {
+	if p.peek() == "NOT" {
+		p.pos++
+		e, err := p.not()
+		if err != nil {
+			return nil, err
+		}
+
+		if e.op == groupExprNot {
+			return e.args[0], nil
+		}
+		return &groupExpr{op: groupExprNot, args: []*groupExpr{e}}, nil
+	}
+
+	return p.primary()
+}
+
+func (p *groupExprParser) primary() (*groupExpr, error) {
+	t := p.peek()
+	switch t {
+	case "":
+		return nil, fmt.Errorf("expected a group at the end")
+	case "(":
+		p.pos++
+		e, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+
+		if p.peek() != ")" {
+			return nil, fmt.Errorf("missing `)`")
+		}
+		p.pos++
+		return e, nil
+	case ")", "AND", "OR", "NOT":
+		return nil, fmt.Errorf("expected a group but found `%s`", t)
+	}
+
+	p.pos++
+	return &groupExpr{op: groupExprGroup, group: t}, nil
+}
+
+// match reports whether the groups, a certificate's InvertedGroups, satisfy the expression
+func (e *groupExpr) match(groups map[string]struct{}) bool {
+	switch e.op {
+	case groupExprGroup:
+		_, ok := groups[e.group]
+		return ok
+	case groupExprNot:
+		return !e.args[0].match(groups)
+	case groupExprAnd:
+		for _, a := range e.args {
+			if !a.match(groups) {
+				return false
+			}
+		}
+		return true
+	default:
+		for _, a := range e.args {
+			if a.match(groups) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// String returns the expression with every AND and OR in parentheses, it is what the rule hash sees
+func (e *groupExpr) String() string {
+	switch e.op {
+	case groupExprGroup:
+		return e.group
+	case groupExprNot:
+		return "NOT " + e.args[0].String()
+	}
+
+	op := " OR "
+	if e.op == groupExprAnd {
+		op = " AND "
+	}
+
+	args := make([]string, len(e.args))
+	for i, a := range e.args {
+		args[i] = a.String()
+	}
+	return "(" + strings.Join(args, op) + ")"
+}
@@ -0,0 +1,159 @@
+package nebula
+
+import (
+	"net"
+	"testing"
+
+	"github.com/slackhq/nebula/cert"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/firewall"
+	"github.com/slackhq/nebula/iputil"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_parseGroupExpr(t *testing.T) {
+	tests := []struct {
+		in  string
+		out string
+	}{
+		{"a", "a"},
+		{"team:infra OR team:sre", "(team:infra OR team:sre)"},
+		{"(team:infra OR team:sre) AND NOT env:dev", "((team:infra OR team:sre) AND NOT env:dev)"},
+		// AND binds tighter than OR
+		{"a OR b AND c", "(a OR (b AND c))"},
+		// Nested operations of the same kind are flattened, double negatives cancel out
+		{"a AND (b AND (c AND d))", "(a AND b AND c AND d)"},
+		{"NOT NOT a", "a"},
+		{"NOT(a OR b)", "NOT (a OR b)"},
+		{"((a))", "a"},
+		// Operators are upper case only
+		{"a and b", ""},
+	}
+
+	for _, tt := range tests {
+		e, err := parseGroupExpr(tt.in)
+		if tt.out == "" {
+			assert.Error(t, err, tt.in)
+			continue
+		}
+
+		require.NoError(t, err, tt.in)
+		assert.Equal(t, tt.out, e.String(), tt.in)
+	}
+
+	_, err := parseGroupExpr(" ")
+	assert.EqualError(t, err, "group_expr is empty")
+
+	_, err = parseGroupExpr("a AND")
+	assert.EqualError(t, err, "group_expr `a AND`; expected a group at the end")
+
+	_, err = parseGroupExpr("(a OR b")
+	assert.EqualError(t, err, "group_expr `(a OR b`; missing `)`")
+
+	_, err = parseGroupExpr("a b")
+	assert.EqualError(t, err, "group_expr `a b`; unexpected `b`")
+
+	_, err = parseGroupExpr("a OR OR b")
+	assert.EqualError(t, err, "group_expr `a OR OR b`; expected a group but found `OR`")
+}
+
+func TestGroupExpr_match(t *testing.T) {
+	e, err := parseGroupExpr("(team:infra OR team:sre) AND NOT env:dev")
+	require.NoError(t, err)
+
+	groups := func(g ...string) map[string]struct{} {
+		m := map[string]struct{}{}
+		for _, v := range g {
+			m[v] = struct{}{}
+		}
+		return m
+	}
+
+	assert.True(t, e.match(groups("team:infra")))
+	assert.True(t, e.match(groups("team:sre", "env:prod")))
+	assert.False(t, e.match(groups("team:sre", "env:dev")))
+	assert.False(t, e.match(groups("team:web")))
+	assert.False(t, e.match(groups()))
+}
+
+func TestFirewall_GroupExpr(t *testing.T) {
+	l := test.NewLogger()
+	ipNet := net.IPNet{IP: net.IPv4(1, 2, 3, 4), Mask: net.IPMask{255, 255, 255, 0}}
+	me := cert.NebulaCertificate{Details: cert.NebulaCertificateDetails{Name: "me", Ips: []*net.IPNet{&ipNet}}}
+
+	conf := config.NewC(l)
+	conf.Settings["firewall"] = map[interface{}]interface{}{
+		"strict_outbound": true,
+		"inbound": []interface{}{
+			map[interface{}]interface{}{"port": "22", "proto": "tcp", "group_expr": "(team:infra OR team:sre) AND NOT env:dev"},
+		},
+	}
+	fw, err := NewFirewallFromConfig(l, &me, conf)
+	require.NoError(t, err)
+	assert.Len(t, fw.InRules.TCP[22].Any.GroupExprs, 1)
+	cp := cert.NewCAPool()
+
+	newHost := func(groups ...string) *HostInfo {
+		c := cert.NebulaCertificate{Details: cert.NebulaCertificateDetails{
+			Name:           "remote",
+			Ips:            []*net.IPNet{{IP: net.IPv4(1, 2, 3, 5), Mask: net.IPMask{255, 255, 255, 0}}},
+			Groups:         groups,
+			InvertedGroups: map[string]struct{}{},
+		}}
+		for _, g := range groups {
+			c.Details.InvertedGroups[g] = struct{}{}
+		}
+		h := &HostInfo{ConnectionState: &ConnectionState{peerCert: &c}, vpnIp: iputil.Ip2VpnIp(net.IPv4(1, 2, 3, 5))}
+		h.CreateRemoteCIDR(&c)
+		return h
+	}
+
+	p := firewall.Packet{
+		LocalIP:    iputil.Ip2VpnIp(net.IPv4(1, 2, 3, 4)),
+		RemoteIP:   iputil.Ip2VpnIp(net.IPv4(1, 2, 3, 5)),
+		LocalPort:  22,
+		RemotePort: 50000,
+		Protocol:   firewall.ProtoTCP,
+	}
+
+	assert.NoError(t, fw.Drop(p, true, newHost("team:sre", "env:prod"), cp, nil, nil))
+
+	p.RemotePort++
+	assert.Equal(t, ErrNoMatchingRule, fw.Drop(p, true, newHost("team:sre", "env:dev"), cp, nil, nil))
+	assert.Equal(t, ErrNoMatchingRule, fw.Drop(p, true, newHost("team:web"), cp, nil, nil))
+
+	// The hash only changes if the expression means something else
+	conf.Settings["firewall"].(map[interface{}]interface{})["inbound"] = []interface{}{
+		map[interface{}]interface{}{"port": "22", "proto": "tcp", "group_expr": "((team:infra) OR team:sre) AND NOT NOT NOT env:dev"},
+	}
+	fw2, err := NewFirewallFromConfig(l, &me, conf)
+	require.NoError(t, err)
+	assert.Equal(t, fw.GetRuleHash(), fw2.GetRuleHash())
+
+	// An expression limits outbound rules for strict_outbound
+	conf.Settings["firewall"].(map[interface{}]interface{})["outbound"] = []interface{}{
+		map[interface{}]interface{}{"port": "any", "proto": "any", "group_expr": "NOT env:dev"},
+	}
+	_, err = NewFirewallFromConfig(l, &me, conf)
+	assert.NoError(t, err)
+
+	// Errors
+	conf.Settings["firewall"] = map[interface{}]interface{}{
+		"inbound": []interface{}{map[interface{}]interface{}{"port": "22", "proto": "tcp", "group": "a", "group_expr": "b"}},
+	}
+	_, err = NewFirewallFromConfig(l, &me, conf)
+	assert.EqualError(t, err, "firewall.inbound rule #0; only one of group, groups, or group_expr should be defined")
+
+	conf.Settings["firewall"] = map[interface{}]interface{}{
+		"inbound": []interface{}{map[interface{}]interface{}{"port": "22", "proto": "tcp", "group_expr": "a AND"}},
+	}
+	_, err = NewFirewallFromConfig(l, &me, conf)
+	assert.EqualError(t, err, "firewall.inbound rule #0; group_expr `a AND`; expected a group at the end")
+
+	conf.Settings["firewall"] = map[interface{}]interface{}{
+		"inbound": []interface{}{map[interface{}]interface{}{"port": "22", "proto": "tcp", "group_expr": "a"}},
+	}
+	assert.EqualError(t, AddFirewallRulesFromConfig(l, true, conf, &mockFirewall{}), "firewall.inbound rule #0; group expressions are not supported here")
+}
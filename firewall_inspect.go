@@ -0,0 +1,473 @@
+package nebula
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/slackhq/nebula/cert"
+	"github.com/slackhq/nebula/firewall"
+	"golang.org/x/crypto/cryptobyte"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+var ErrInspectionDenied = errors.New("payload was not allowed by an inspected rule")
+var ErrInspectionOutOfOrder = errors.New("payload arrived out of order while it was being inspected")
+
+// errNeedMore is returned by a payloadInspector when the payload is the start of a message that is not complete yet
+var errNeedMore = errors.New("need more data")
+
+// maxInspectedStream is how much of a tcp stream is buffered looking for a name before the flow is denied
+const maxInspectedStream = 16 * 1024
+
+// payloadInspector finds the names a flow is going to in its payload. Rules pick an inspector by its key, see
+// payloadInspectors.
+type payloadInspector interface {
+	// proto is the protocol whose payload the inspector understands
+	proto() uint8
+	// stream is true when the names are read once from the start of a tcp stream and decide the whole flow, false
+	// when every packet carries names of its own and is checked on its own
+	stream() bool
+	// names returns the names in payload or errNeedMore if a stream has not sent enough of its first message yet
+	names(payload []byte) ([]string, error)
+}
+
+// inspectorProtoName returns the rule proto an inspector needs
+func inspectorProtoName(pi payloadInspector) string {
+	if pi.proto() == firewall.ProtoUDP {
+		return "udp"
+	}
+	return "tcp"
+}
+
+// payloadInspectors are the inspectors rules can use, keyed by the rule key that holds the names to allow
+var payloadInspectors = map[string]payloadInspector{
+	"sni":      tlsSNIInspector{},
+	"dns_name": dnsQueryInspector{},
+}
+
+// firewallInspector limits a rule to flows whose payload names only match its patterns. A pattern is a name or
+// `*.` followed by a suffix, which matches any name below the suffix but not the suffix itself.
+type firewallInspector struct {
+	key      string
+	pi       payloadInspector
+	patterns []string
+}
+
+func newFirewallInspector(key string, patterns []string) (*firewallInspector, error) {
+	pi, ok := payloadInspectors[key]
+	if !ok {
+		return nil, fmt.Errorf("%s is not a known inspector", key)
+	}
+
+	if len(patterns) == 0 {
+		return nil, fmt.Errorf("%s must have at least one name", key)
+	}
+
+	fi := &firewallInspector{key: key, pi: pi}
+	for _, p := range patterns {
+		p = normalizeInspectedName(p)
+		if p == "" || p == "*." || strings.Contains(strings.TrimPrefix(p, "*."), "*") {
+			return nil, fmt.Errorf("%s name was not understood; `%s`", key, p)
+		}
+		fi.patterns = append(fi.patterns, p)
+	}
+
+	sort.Strings(fi.patterns)
+	return fi, nil
+}
+
+// normalizeInspectedName lowercases a name and drops the trailing dot of a fully qualified name
+func normalizeInspectedName(s string) string {
+	return strings.TrimSuffix(strings.ToLower(strings.TrimSpace(s)), ".")
+}
+
+// allows reports whether name matches one of the patterns
+func (fi *firewallInspector) allows(name string) bool {
+	name = normalizeInspectedName(name)
+	for _, p := range fi.patterns {
+		if suffix, ok := strings.CutPrefix(p, "*"); ok {
+			if len(name) > len(suffix) && strings.HasSuffix(name, suffix) {
+				return true
+			}
+		} else if name == p {
+			return true
+		}
+	}
+	return false
+}
+
+// allowsAll reports whether every one of names matches, a payload without names is not allowed
+func (fi *firewallInspector) allowsAll(names []string) bool {
+	if len(names) == 0 {
+		return false
+	}
+
+	for _, n := range names {
+		if !fi.allows(n) {
+			return false
+		}
+	}
+	return true
+}
+
+func (fi *firewallInspector) String() string {
+	return fi.key + ": " + strings.Join(fi.patterns, ",")
+}
+
+type inspectedFirewallTable struct {
+	inspector *firewallInspector
+	table     *FirewallTable
+}
+
+// inspectedTable returns the table for outbound rules with the same inspector, creating it if needed
+func (f *Firewall) inspectedTable(inspector *firewallInspector) *FirewallTable {
+	for _, it := range f.inspectedOut {
+		if it.inspector.String() == inspector.String() {
+			return it.table
+		}
+	}
+
+	it := &inspectedFirewallTable{inspector: inspector, table: newFirewallTable()}
+	f.inspectedOut = append(f.inspectedOut, it)
+	return it.table
+}
+
+// matchInspectors returns the inspectors of the inspected rules that match an outbound packet
+func (f *Firewall) matchInspectors(fp firewall.Packet, h *HostInfo, caPool *cert.NebulaCAPool) []*firewallInspector {
+	var out []*firewallInspector
+	for _, it := range f.inspectedOut {
+		if it.table.match(fp, false, h.ConnectionState.peerCert, caPool) {
+			out = append(out, it.inspector)
+		}
+	}
+	return out
+}
+
+type inspectionVerdict uint8
+
+const (
+	inspectionPending inspectionVerdict = iota
+	inspectionAllow
+	inspectionDeny
+)
+
+// flowInspection is the state of an outbound flow only allowed by inspected rules. The flow is allowed if one of the
+// inspectors allows every name in its payload.
+type flowInspection struct {
+	inspectors []*firewallInspector
+	verdict    inspectionVerdict
+	// names are what decided a stream, kept so the verdict can be made again when the rules change
+	names []string
+
+	// buf holds the start of a tcp stream until it has a complete message, next is the sequence number expected
+	// after it and started is set once the SYN has given us that number
+	buf     []byte
+	next    uint32
+	started bool
+}
+
+func newFlowInspection(inspectors []*firewallInspector) *flowInspection {
+	return &flowInspection{inspectors: inspectors}
+}
+
+func (fi *flowInspection) stream() bool {
+	return fi.inspectors[0].pi.stream()
+}
+
+// cacheable reports whether packets on the flow can skip inspection, true once a stream has been allowed
+func (fi *flowInspection) cacheable() bool {
+	return fi == nil || (fi.stream() && fi.verdict == inspectionAllow)
+}
+
+// decide sets the verdict for names
+func (fi *flowInspection) decide(names []string) {
+	fi.names = names
+	fi.verdict = inspectionDeny
+	for _, i := range fi.inspectors {
+		if i.allowsAll(names) {
+			fi.verdict = inspectionAllow
+			return
+		}
+	}
+}
+
+// setInspectors swaps in the inspectors of the current rules and decides a stream again with the names it already
+// sent
+func (fi *flowInspection) setInspectors(inspectors []*firewallInspector) {
+	fi.inspectors = inspectors
+	if fi.stream() && fi.verdict != inspectionPending {
+		fi.decide(fi.names)
+	}
+}
+
+// inspect checks a packet on the flow, packet is the whole ip packet. Packets from the remote end are only dropped
+// once the flow has been denied.
+func (fi *flowInspection) inspect(fp firewall.Packet, incoming bool, packet []byte) error {
+	if incoming {
+		if fi.stream() && fi.verdict == inspectionDeny {
+			return ErrInspectionDenied
+		}
+		return nil
+	}
+
+	if !fi.stream() {
+		// Every packet is judged on its own, an empty or unparseable one is denied
+		names, err := fi.inspectors[0].pi.names(l4Payload(fp, packet))
+		if err != nil {
+			return ErrInspectionDenied
+		}
+
+		fi.decide(names)
+		if fi.verdict != inspectionAllow {
+			return ErrInspectionDenied
+		}
+		return nil
+	}
+
+	switch fi.verdict {
+	case inspectionAllow:
+		return nil
+	case inspectionDeny:
+		return ErrInspectionDenied
+	}
+
+	seq, syn, payload, ok := tcpSegment(packet)
+	if !ok {
+		return ErrInspectionDenied
+	}
+
+	if syn {
+		fi.next = seq + 1
+		fi.started = true
+		return nil
+	}
+
+	if len(payload) == 0 {
+		return nil
+	}
+
+	if !fi.started {
+		// We never saw the start of the stream so we can not know what the payload is
+		fi.verdict = inspectionDeny
+		return ErrInspectionDenied
+	}
+
+	switch d := int32(seq - fi.next); {
+	case d < 0:
+		// A retransmit of data we already have
+		if int32(seq+uint32(len(payload))-fi.next) <= 0 {
+			return nil
+		}
+		payload = payload[-d:]
+	case d > 0:
+		// Drop it, the sender will retransmit once the gap is filled
+		return ErrInspectionOutOfOrder
+	}
+
+	fi.buf = append(fi.buf, payload...)
+	fi.next += uint32(len(payload))
+
+	names, err := fi.inspectors[0].pi.names(fi.buf)
+	if err == errNeedMore && len(fi.buf) < maxInspectedStream {
+		// The server can not do anything with half a message, let it through
+		return nil
+	}
+
+	fi.buf = nil
+	if err != nil {
+		fi.verdict = inspectionDeny
+		return ErrInspectionDenied
+	}
+
+	fi.decide(names)
+	if fi.verdict != inspectionAllow {
+		return ErrInspectionDenied
+	}
+	return nil
+}
+
+// l4Offset returns where the udp or tcp header of an ipv4 or ipv6 packet starts, 0 if the packet is too short
+func l4Offset(packet []byte) int {
+	if len(packet) < 20 {
+		return 0
+	}
+
+	if packet[0]>>4 == 6 {
+		if len(packet) < 40 {
+			return 0
+		}
+		_, off, _, err := ipv6L4(packet)
+		if err != nil {
+			return 0
+		}
+		return off
+	}
+
+	return int(packet[0]&0x0f) << 2
+}
+
+// l4Payload returns the payload of the udp or tcp segment in an ip packet, nil if there is not one
+func l4Payload(fp firewall.Packet, packet []byte) []byte {
+	if fp.Fragment {
+		return nil
+	}
+
+	ihl := l4Offset(packet)
+	if ihl == 0 {
+		return nil
+	}
+	switch fp.Protocol {
+	case firewall.ProtoUDP:
+		if len(packet) < ihl+8 {
+			return nil
+		}
+		return packet[ihl+8:]
+	case firewall.ProtoTCP:
+		_, _, payload, _ := tcpSegment(packet)
+		return payload
+	}
+
+	return nil
+}
+
+// tcpSegment returns the sequence number, whether SYN is set, and the payload of the tcp segment in an ip packet
+func tcpSegment(packet []byte) (seq uint32, syn bool, payload []byte, ok bool) {
+	ihl := l4Offset(packet)
+	if ihl == 0 || len(packet) < ihl+20 {
+		return 0, false, nil, false
+	}
+
+	tcp := packet[ihl:]
+	off := int(tcp[12]>>4) << 2
+	if off < 20 || len(tcp) < off {
+		return 0, false, nil, false
+	}
+
+	return binary.BigEndian.Uint32(tcp[4:8]), tcp[13]&0x02 != 0, tcp[off:], true
+}
+
+// tlsSNIInspector reads the server name from the TLS ClientHello that starts a tcp stream
+type tlsSNIInspector struct{}
+
+func (tlsSNIInspector) proto() uint8 { return firewall.ProtoTCP }
+
+func (tlsSNIInspector) stream() bool { return true }
+
+func (tlsSNIInspector) names(payload []byte) ([]string, error) {
+	// The ClientHello can be split across several handshake records, gather it up first
+	var hs []byte
+	s := cryptobyte.String(payload)
+	for {
+		if len(hs) >= 4 {
+			n := int(hs[1])<<16 | int(hs[2])<<8 | int(hs[3])
+			if len(hs) >= 4+n {
+				return parseClientHelloSNI(hs[:4+n])
+			}
+		}
+
+		if len(s) < 5 {
+			return nil, errNeedMore
+		}
+
+		var typ uint8
+		var fragment cryptobyte.String
+		s.ReadUint8(&typ)
+		s.Skip(2)
+		if typ != 22 {
+			return nil, errors.New("not a tls handshake")
+		}
+
+		if !s.ReadUint16LengthPrefixed(&fragment) {
+			return nil, errNeedMore
+		}
+		hs = append(hs, fragment...)
+
+		if len(hs) > 0 && hs[0] != 1 {
+			return nil, errors.New("not a tls client hello")
+		}
+	}
+}
+
+// parseClientHelloSNI returns the host name from the server_name extension of a ClientHello handshake message
+func parseClientHelloSNI(hs []byte) ([]string, error) {
+	s := cryptobyte.String(hs)
+	var body, sessionID, suites, compression, exts cryptobyte.String
+	if !s.Skip(1) || !s.ReadUint24LengthPrefixed(&body) ||
+		!body.Skip(2+32) ||
+		!body.ReadUint8LengthPrefixed(&sessionID) ||
+		!body.ReadUint16LengthPrefixed(&suites) ||
+		!body.ReadUint8LengthPrefixed(&compression) {
+		return nil, errors.New("malformed tls client hello")
+	}
+
+	if body.Empty() {
+		return nil, nil
+	}
+
+	if !body.ReadUint16LengthPrefixed(&exts) {
+		return nil, errors.New("malformed tls client hello")
+	}
+
+	for !exts.Empty() {
+		var typ uint16
+		var ext cryptobyte.String
+		if !exts.ReadUint16(&typ) || !exts.ReadUint16LengthPrefixed(&ext) {
+			return nil, errors.New("malformed tls client hello")
+		}
+
+		if typ != 0 {
+			continue
+		}
+
+		var list cryptobyte.String
+		if !ext.ReadUint16LengthPrefixed(&list) {
+			return nil, errors.New("malformed tls server_name")
+		}
+
+		for !list.Empty() {
+			var nameType uint8
+			var name cryptobyte.String
+			if !list.ReadUint8(&nameType) || !list.ReadUint16LengthPrefixed(&name) {
+				return nil, errors.New("malformed tls server_name")
+			}
+			if nameType == 0 {
+				return []string{string(name)}, nil
+			}
+		}
+	}
+
+	return nil, nil
+}
+
+// dnsQueryInspector reads the names asked for by each dns query
+type dnsQueryInspector struct{}
+
+func (dnsQueryInspector) proto() uint8 { return firewall.ProtoUDP }
+
+func (dnsQueryInspector) stream() bool { return false }
+
+func (dnsQueryInspector) names(payload []byte) ([]string, error) {
+	var p dnsmessage.Parser
+	h, err := p.Start(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	if h.Response {
+		return nil, errors.New("not a dns query")
+	}
+
+	qs, err := p.AllQuestions()
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, len(qs))
+	for i, q := range qs {
+		names[i] = q.Name.String()
+	}
+	return names, nil
+}
@@ -0,0 +1,246 @@
+package nebula
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/slackhq/nebula/cert"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/firewall"
+	"github.com/slackhq/nebula/iputil"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestFirewallInspector_allows(t *testing.T) {
+	fi, err := newFirewallInspector("sni", []string{"*.Internal.Corp.", "example.com"})
+	require.NoError(t, err)
+	assert.Equal(t, "sni: *.internal.corp,example.com", fi.String())
+
+	assert.True(t, fi.allows("git.internal.corp"))
+	assert.True(t, fi.allows("a.b.INTERNAL.corp."))
+	assert.True(t, fi.allows("example.com"))
+	assert.False(t, fi.allows("internal.corp"))
+	assert.False(t, fi.allows("evilinternal.corp"))
+	assert.False(t, fi.allows("www.example.com"))
+
+	assert.True(t, fi.allowsAll([]string{"a.internal.corp", "example.com"}))
+	assert.False(t, fi.allowsAll([]string{"a.internal.corp", "evil.com"}))
+	assert.False(t, fi.allowsAll(nil))
+
+	_, err = newFirewallInspector("sni", []string{"a.*.corp"})
+	assert.EqualError(t, err, "sni name was not understood; `a.*.corp`")
+}
+
+func TestTLSSNIInspector_names(t *testing.T) {
+	hello := tlsClientHello(t, "git.internal.corp")
+	pi := tlsSNIInspector{}
+
+	names, err := pi.names(hello)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"git.internal.corp"}, names)
+
+	_, err = pi.names(hello[:len(hello)/2])
+	assert.Equal(t, errNeedMore, err)
+
+	_, err = pi.names([]byte("GET / HTTP/1.1\r\n"))
+	assert.Error(t, err)
+
+	// No server name at all
+	names, err = pi.names(tlsClientHello(t, ""))
+	require.NoError(t, err)
+	assert.Empty(t, names)
+}
+
+func TestDNSQueryInspector_names(t *testing.T) {
+	pi := dnsQueryInspector{}
+
+	names, err := pi.names(dnsQuery(t, false, "a.corp.", "b.corp."))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a.corp.", "b.corp."}, names)
+
+	_, err = pi.names(dnsQuery(t, true, "a.corp."))
+	assert.EqualError(t, err, "not a dns query")
+
+	_, err = pi.names([]byte{1, 2, 3})
+	assert.Error(t, err)
+}
+
+func TestFirewall_Inspection(t *testing.T) {
+	l := test.NewLogger()
+	ipNet := net.IPNet{IP: net.IPv4(1, 2, 3, 4), Mask: net.IPMask{255, 255, 255, 0}}
+	c := cert.NebulaCertificate{Details: cert.NebulaCertificateDetails{Name: "me", Ips: []*net.IPNet{&ipNet}, InvertedGroups: map[string]struct{}{}}}
+	h := HostInfo{ConnectionState: &ConnectionState{peerCert: &c}, vpnIp: iputil.Ip2VpnIp(ipNet.IP)}
+	h.CreateRemoteCIDR(&c)
+
+	conf := config.NewC(l)
+	conf.Settings["firewall"] = map[interface{}]interface{}{
+		"outbound": []interface{}{
+			map[interface{}]interface{}{"port": "443", "proto": "tcp", "host": "any", "sni": []interface{}{"*.internal.corp"}},
+			map[interface{}]interface{}{"port": "53", "proto": "udp", "host": "any", "dns_name": []interface{}{"corp", "*.corp"}},
+		},
+	}
+	fw, err := NewFirewallFromConfig(l, &c, conf)
+	require.NoError(t, err)
+	require.Len(t, fw.inspectedOut, 2)
+	cp := cert.NewCAPool()
+
+	p := firewall.Packet{
+		LocalIP:    iputil.Ip2VpnIp(net.IPv4(1, 2, 3, 4)),
+		RemoteIP:   iputil.Ip2VpnIp(net.IPv4(1, 2, 3, 4)),
+		LocalPort:  40000,
+		RemotePort: 443,
+		Protocol:   firewall.ProtoTCP,
+	}
+
+	// The handshake passes, the ClientHello is split over two segments
+	hello := tlsClientHello(t, "git.internal.corp")
+	localCache := firewall.ConntrackCache{}
+	require.NoError(t, fw.Drop(p, false, &h, cp, localCache, tcpPacket(1000, true, nil)))
+	require.NoError(t, fw.Drop(p, true, &h, cp, localCache, tcpPacket(5000, true, nil)))
+	require.NoError(t, fw.Drop(p, false, &h, cp, localCache, tcpPacket(1001, false, hello[:10])))
+	assert.Empty(t, localCache, "a flow is not cached while it is inspected")
+
+	// A retransmit of the first part is fine, a gap is not
+	require.NoError(t, fw.Drop(p, false, &h, cp, localCache, tcpPacket(1001, false, hello[:10])))
+	assert.Equal(t, ErrInspectionOutOfOrder, fw.Drop(p, false, &h, cp, localCache, tcpPacket(1021, false, hello[20:])))
+
+	require.NoError(t, fw.Drop(p, false, &h, cp, localCache, tcpPacket(1011, false, hello[10:])))
+	require.NoError(t, fw.Drop(p, false, &h, cp, localCache, tcpPacket(1011+uint32(len(hello)), false, []byte("data"))))
+	assert.Len(t, localCache, 1, "an allowed stream is cached")
+
+	// A server name that is not allowed denies the whole flow
+	p.LocalPort++
+	require.NoError(t, fw.Drop(p, false, &h, cp, nil, tcpPacket(1000, true, nil)))
+	assert.Equal(t, ErrInspectionDenied, fw.Drop(p, false, &h, cp, nil, tcpPacket(1001, false, tlsClientHello(t, "evil.com"))))
+	assert.Equal(t, ErrInspectionDenied, fw.Drop(p, true, &h, cp, nil, tcpPacket(5000, false, []byte("data"))))
+
+	// So does anything that is not TLS, or data when we never saw the stream start
+	p.LocalPort++
+	require.NoError(t, fw.Drop(p, false, &h, cp, nil, tcpPacket(1000, true, nil)))
+	assert.Equal(t, ErrInspectionDenied, fw.Drop(p, false, &h, cp, nil, tcpPacket(1001, false, []byte("GET / HTTP/1.1\r\n"))))
+
+	p.LocalPort++
+	assert.Equal(t, ErrInspectionDenied, fw.Drop(p, false, &h, cp, nil, tcpPacket(1001, false, hello)))
+
+	// Every dns query is checked on its own, replies come back on the tracked flow
+	d := firewall.Packet{
+		LocalIP:    iputil.Ip2VpnIp(net.IPv4(1, 2, 3, 4)),
+		RemoteIP:   iputil.Ip2VpnIp(net.IPv4(1, 2, 3, 4)),
+		LocalPort:  40000,
+		RemotePort: 53,
+		Protocol:   firewall.ProtoUDP,
+	}
+	require.NoError(t, fw.Drop(d, false, &h, cp, nil, udpPacket(dnsQuery(t, false, "git.corp."))))
+	require.NoError(t, fw.Drop(d, true, &h, cp, nil, udpPacket(dnsQuery(t, true, "git.corp."))))
+	assert.Equal(t, ErrInspectionDenied, fw.Drop(d, false, &h, cp, nil, udpPacket(dnsQuery(t, false, "git.corp.", "evil.com."))))
+	require.NoError(t, fw.Drop(d, false, &h, cp, nil, udpPacket(dnsQuery(t, false, "corp."))))
+
+	// Plain rules still apply to everything else
+	d.RemotePort = 54
+	assert.Equal(t, ErrNoMatchingRule, fw.Drop(d, false, &h, cp, nil, udpPacket(dnsQuery(t, false, "corp."))))
+
+	// Reloading with a wider rule allows the denied stream, its name is checked again
+	p.LocalPort = 40001
+	conf.Settings["firewall"].(map[interface{}]interface{})["outbound"] = []interface{}{
+		map[interface{}]interface{}{"port": "443", "proto": "tcp", "host": "any", "sni": []interface{}{"*.internal.corp", "evil.com"}},
+	}
+	fw2, err := NewFirewallFromConfig(l, &c, conf)
+	require.NoError(t, err)
+	assert.NotEqual(t, fw.GetRuleHash(), fw2.GetRuleHash())
+	fw2.rulesVersion = fw.rulesVersion + 1
+	fw2.Conntrack = fw.Conntrack
+	require.NoError(t, fw2.Drop(p, false, &h, cp, nil, tcpPacket(1001+uint32(len(hello)), false, []byte("data"))))
+}
+
+func TestNewFirewallFromConfig_Inspection(t *testing.T) {
+	l := test.NewLogger()
+	c := &cert.NebulaCertificate{}
+	conf := config.NewC(l)
+
+	conf.Settings["firewall"] = map[interface{}]interface{}{
+		"inbound": []interface{}{map[interface{}]interface{}{"port": "443", "proto": "tcp", "host": "any", "sni": "a.corp"}},
+	}
+	_, err := NewFirewallFromConfig(l, c, conf)
+	assert.EqualError(t, err, "firewall.inbound rule #0; `sni is only supported on outbound rules`")
+
+	conf.Settings["firewall"] = map[interface{}]interface{}{
+		"outbound": []interface{}{map[interface{}]interface{}{"port": "53", "proto": "tcp", "host": "any", "dns_name": "a.corp"}},
+	}
+	_, err = NewFirewallFromConfig(l, c, conf)
+	assert.EqualError(t, err, "firewall.outbound rule #0; dns_name requires proto udp")
+
+	conf.Settings["firewall"] = map[interface{}]interface{}{
+		"outbound": []interface{}{map[interface{}]interface{}{"port": "443", "proto": "tcp", "host": "any", "sni": "a.corp", "dns_name": "a.corp"}},
+	}
+	_, err = NewFirewallFromConfig(l, c, conf)
+	assert.EqualError(t, err, "firewall.outbound rule #0; only one of sni or dns_name should be provided")
+
+	conf.Settings["firewall"] = map[interface{}]interface{}{
+		"outbound": []interface{}{map[interface{}]interface{}{"port": "443", "proto": "tcp", "host": "any", "sni": "a.corp", "active_between": "09:00-17:00"}},
+	}
+	_, err = NewFirewallFromConfig(l, c, conf)
+	assert.EqualError(t, err, "firewall.outbound rule #0; `sni can not be combined with a schedule`")
+
+	conf.Settings["firewall"] = map[interface{}]interface{}{
+		"outbound": []interface{}{map[interface{}]interface{}{"port": "443", "proto": "tcp", "host": "any", "sni": "a.corp"}},
+	}
+	assert.EqualError(t, AddFirewallRulesFromConfig(l, false, conf, &mockFirewall{}), "firewall.outbound rule #0; sni is not supported here")
+}
+
+// tlsClientHello returns the first record a TLS client sends for serverName
+func tlsClientHello(t *testing.T, serverName string) []byte {
+	client, server := net.Pipe()
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	go func() {
+		defer client.Close()
+		_ = tls.Client(client, &tls.Config{ServerName: serverName, InsecureSkipVerify: true}).HandshakeContext(ctx)
+	}()
+
+	b := make([]byte, 16*1024)
+	n, err := server.Read(b)
+	require.NoError(t, err)
+	return b[:n]
+}
+
+func dnsQuery(t *testing.T, response bool, names ...string) []byte {
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: 1, Response: response})
+	require.NoError(t, b.StartQuestions())
+	for _, n := range names {
+		require.NoError(t, b.Question(dnsmessage.Question{Name: dnsmessage.MustNewName(n), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET}))
+	}
+	out, err := b.Finish()
+	require.NoError(t, err)
+	return out
+}
+
+// tcpPacket builds an ipv4 packet around a tcp segment, only the fields inspection looks at are filled in
+func tcpPacket(seq uint32, syn bool, payload []byte) []byte {
+	b := make([]byte, 40, 40+len(payload))
+	b[0] = 0x45
+	b[9] = firewall.ProtoTCP
+	binary.BigEndian.PutUint32(b[24:28], seq)
+	b[32] = 5 << 4
+	if syn {
+		b[33] = 0x02
+	}
+	return append(b, payload...)
+}
+
+// udpPacket builds an ipv4 packet around a udp datagram
+func udpPacket(payload []byte) []byte {
+	b := make([]byte, 28, 28+len(payload))
+	b[0] = 0x45
+	b[9] = firewall.ProtoUDP
+	return append(b, payload...)
+}
@@ -0,0 +1,151 @@
+package nebula
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/slackhq/nebula/iputil"
+	"golang.org/x/time/rate"
+)
+
+var ErrRateLimited = errors.New("over the limit of the rule that allowed it")
+
+// maxLimitedPacket is the least burst a byte limit gets so a packet of any size can get through eventually
+const maxLimitedPacket = 65535
+
+// firewallRuleLimit throttles the traffic a rule allows with a token bucket per remote host. Packets travelling in the
+// direction of the rule are counted, packets over the limit are dropped while the rest of the connection carries on.
+type firewallRuleLimit struct {
+	// packets and bytes are the rates allowed per second, zero when not limited
+	packets int
+	bytes   int
+
+	sync.Mutex
+	hosts map[iputil.VpnIp]*firewallHostLimit
+	// lastPrune is when idle hosts were last removed from hosts
+	lastPrune time.Time
+}
+
+type firewallHostLimit struct {
+	packets *rate.Limiter
+	bytes   *rate.Limiter
+}
+
+// parseFirewallRuleLimit reads the limit of a rule, a map of packets and bytes per second. Nil is returned for a rule
+// without one.
+func parseFirewallRuleLimit(v interface{}) (*firewallRuleLimit, error) {
+	if v == nil {
+		return nil, nil
+	}
+
+	m, ok := v.(map[interface{}]interface{})
+	if !ok {
+		return nil, errors.New("limit should be a map")
+	}
+
+	rl := &firewallRuleLimit{hosts: make(map[iputil.VpnIp]*firewallHostLimit)}
+	for k, v := range m {
+		n, err := strconv.Atoi(fmt.Sprintf("%v", v))
+		if err != nil || n <= 0 {
+			return nil, fmt.Errorf("limit %v was not a positive number; `%v`", k, v)
+		}
+
+		switch k {
+		case "packets":
+			rl.packets = n
+		case "bytes":
+			rl.bytes = n
+		default:
+			return nil, fmt.Errorf("limit %v was not understood, must be packets or bytes", k)
+		}
+	}
+
+	if rl.packets == 0 && rl.bytes == 0 {
+		return nil, errors.New("limit must set packets, bytes, or both")
+	}
+
+	return rl, nil
+}
+
+func (rl *firewallRuleLimit) String() string {
+	return fmt.Sprintf("packets=%d/s bytes=%d/s", rl.packets, rl.bytes)
+}
+
+// allow takes a packet of size bytes from the buckets of the remote host, it reports false if either is empty
+func (rl *firewallRuleLimit) allow(host iputil.VpnIp, size int, now time.Time) bool {
+	hl := rl.host(host, now)
+	if hl.packets != nil && !hl.packets.AllowN(now, 1) {
+		return false
+	}
+
+	return hl.bytes == nil || hl.bytes.AllowN(now, size)
+}
+
+// host returns the buckets for a remote host, creating them if needed. Idle hosts are pruned at most once a minute.
+func (rl *firewallRuleLimit) host(host iputil.VpnIp, now time.Time) *firewallHostLimit {
+	rl.Lock()
+	defer rl.Unlock()
+
+	if hl, ok := rl.hosts[host]; ok {
+		return hl
+	}
+
+	if now.Sub(rl.lastPrune) >= time.Minute {
+		rl.prune(now)
+	}
+
+	hl := &firewallHostLimit{}
+	if rl.packets > 0 {
+		hl.packets = rate.NewLimiter(rate.Limit(rl.packets), rl.packets)
+	}
+	if rl.bytes > 0 {
+		hl.bytes = rate.NewLimiter(rate.Limit(rl.bytes), max(rl.bytes, maxLimitedPacket))
+	}
+
+	rl.hosts[host] = hl
+	return hl
+}
+
+// prune removes hosts whose buckets have filled back up, a new full bucket is no different. The caller must hold the
+// lock.
+func (rl *firewallRuleLimit) prune(now time.Time) {
+	rl.lastPrune = now
+	for host, hl := range rl.hosts {
+		if hl.full(now) {
+			delete(rl.hosts, host)
+		}
+	}
+}
+
+func (hl *firewallHostLimit) full(now time.Time) bool {
+	if hl.packets != nil && hl.packets.TokensAt(now) < float64(hl.packets.Burst()) {
+		return false
+	}
+	return hl.bytes == nil || hl.bytes.TokensAt(now) >= float64(hl.bytes.Burst())
+}
+
+type limitedFirewallTable struct {
+	limit *firewallRuleLimit
+	table *FirewallTable
+}
+
+// limitedTable returns the table of a rule with a limit, every limited rule has a table and buckets of its own
+func (f *Firewall) limitedTable(incoming bool, limit *firewallRuleLimit) *FirewallTable {
+	tables := &f.limitedOut
+	if incoming {
+		tables = &f.limitedIn
+	}
+
+	for _, lt := range *tables {
+		if lt.limit == limit {
+			return lt.table
+		}
+	}
+
+	lt := &limitedFirewallTable{limit: limit, table: newFirewallTable()}
+	*tables = append(*tables, lt)
+	return lt.table
+}
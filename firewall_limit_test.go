@@ -0,0 +1,129 @@
+package nebula
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/slackhq/nebula/cert"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/firewall"
+	"github.com/slackhq/nebula/iputil"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFirewall_RuleLimit(t *testing.T) {
+	l := test.NewLogger()
+	ipNet := net.IPNet{IP: net.IPv4(1, 2, 3, 4), Mask: net.IPMask{255, 255, 255, 0}}
+	c := cert.NebulaCertificate{Details: cert.NebulaCertificateDetails{Name: "me", Ips: []*net.IPNet{&ipNet}, InvertedGroups: map[string]struct{}{}}}
+	h := HostInfo{ConnectionState: &ConnectionState{peerCert: &c}, vpnIp: iputil.Ip2VpnIp(ipNet.IP)}
+	h.CreateRemoteCIDR(&c)
+
+	conf := config.NewC(l)
+	conf.Settings["firewall"] = map[interface{}]interface{}{
+		"inbound": []interface{}{
+			map[interface{}]interface{}{"port": "53", "proto": "udp", "host": "any", "limit": map[interface{}]interface{}{"packets": 2}},
+			map[interface{}]interface{}{"port": "80", "proto": "tcp", "host": "any"},
+		},
+	}
+	fw, err := NewFirewallFromConfig(l, &c, conf)
+	require.NoError(t, err)
+	require.Len(t, fw.limitedIn, 1)
+	cp := cert.NewCAPool()
+
+	p := firewall.Packet{
+		LocalIP:    iputil.Ip2VpnIp(net.IPv4(1, 2, 3, 4)),
+		RemoteIP:   iputil.Ip2VpnIp(net.IPv4(1, 2, 3, 4)),
+		LocalPort:  53,
+		RemotePort: 40000,
+		Protocol:   firewall.ProtoUDP,
+	}
+
+	// The burst is one second of packets, the connection is still tracked after a packet is dropped. Limited
+	// connections are never put in the routine cache.
+	localCache := firewall.ConntrackCache{}
+	require.NoError(t, fw.Drop(p, true, &h, cp, localCache, nil))
+	require.NoError(t, fw.Drop(p, true, &h, cp, localCache, nil))
+	assert.Equal(t, ErrRateLimited, fw.Drop(p, true, &h, cp, localCache, nil))
+	assert.Empty(t, localCache)
+
+	// Replies are not counted
+	require.NoError(t, fw.Drop(p, false, &h, cp, nil, nil))
+
+	// Other connections from the same host share its bucket
+	p.RemotePort++
+	assert.Equal(t, ErrRateLimited, fw.Drop(p, true, &h, cp, nil, nil))
+
+	// Unlimited rules are not affected
+	p.Protocol = firewall.ProtoTCP
+	p.LocalPort = 80
+	require.NoError(t, fw.Drop(p, true, &h, cp, localCache, nil))
+	require.NoError(t, fw.Drop(p, true, &h, cp, localCache, nil))
+	assert.Len(t, localCache, 1)
+}
+
+func TestFirewallRuleLimit_allow(t *testing.T) {
+	rl, err := parseFirewallRuleLimit(map[interface{}]interface{}{"bytes": 100})
+	require.NoError(t, err)
+	assert.Equal(t, "packets=0/s bytes=100/s", rl.String())
+
+	now := time.Now()
+	a, b := iputil.VpnIpFrom4(1), iputil.VpnIpFrom4(2)
+
+	// A byte limit lets a full packet through even if it is over the rate
+	assert.True(t, rl.allow(a, 1400, now))
+	assert.True(t, rl.allow(a, maxLimitedPacket-1400, now))
+	assert.False(t, rl.allow(a, 1, now))
+	assert.True(t, rl.allow(b, 1400, now))
+	assert.True(t, rl.allow(a, 100, now.Add(time.Second)))
+
+	// Hosts are pruned once their bucket is full again
+	later := now.Add(time.Hour)
+	rl.allow(iputil.VpnIpFrom4(3), 1, later)
+	assert.Len(t, rl.hosts, 1)
+}
+
+func TestNewFirewallFromConfig_RuleLimit(t *testing.T) {
+	l := test.NewLogger()
+	c := &cert.NebulaCertificate{}
+	conf := config.NewC(l)
+
+	tests := map[string]interface{}{
+		"firewall.inbound rule #0; limit should be a map":                                  "10",
+		"firewall.inbound rule #0; limit must set packets, bytes, or both":                 map[interface{}]interface{}{},
+		"firewall.inbound rule #0; limit packets was not a positive number; `0`":           map[interface{}]interface{}{"packets": 0},
+		"firewall.inbound rule #0; limit bytes was not a positive number; `lots`":          map[interface{}]interface{}{"bytes": "lots"},
+		"firewall.inbound rule #0; limit pps was not understood, must be packets or bytes": map[interface{}]interface{}{"pps": 10},
+	}
+
+	for expected, limit := range tests {
+		conf.Settings["firewall"] = map[interface{}]interface{}{
+			"inbound": []interface{}{map[interface{}]interface{}{"port": "53", "proto": "udp", "host": "any", "limit": limit}},
+		}
+		_, err := NewFirewallFromConfig(l, c, conf)
+		assert.EqualError(t, err, expected)
+	}
+
+	conf.Settings["firewall"] = map[interface{}]interface{}{
+		"inbound": []interface{}{map[interface{}]interface{}{"port": "53", "proto": "udp", "host": "any", "active_between": "09:00-17:00", "limit": map[interface{}]interface{}{"packets": 10}}},
+	}
+	_, err := NewFirewallFromConfig(l, c, conf)
+	assert.EqualError(t, err, "firewall.inbound rule #0; `limit can not be combined with a schedule, sni, or dns_name`")
+
+	conf.Settings["firewall"] = map[interface{}]interface{}{
+		"inbound": []interface{}{map[interface{}]interface{}{"port": "53", "proto": "udp", "host": "any", "limit": map[interface{}]interface{}{"packets": 10}}},
+	}
+	assert.EqualError(t, AddFirewallRulesFromConfig(l, true, conf, &mockFirewall{}), "firewall.inbound rule #0; limits are not supported here")
+
+	// Limits are part of the rule hash
+	fw, err := NewFirewallFromConfig(l, c, conf)
+	require.NoError(t, err)
+	conf.Settings["firewall"].(map[interface{}]interface{})["inbound"] = []interface{}{
+		map[interface{}]interface{}{"port": "53", "proto": "udp", "host": "any", "limit": map[interface{}]interface{}{"packets": 20}},
+	}
+	fw2, err := NewFirewallFromConfig(l, c, conf)
+	require.NoError(t, err)
+	assert.NotEqual(t, fw.GetRuleHash(), fw2.GetRuleHash())
+}
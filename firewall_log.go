@@ -0,0 +1,184 @@
+package nebula
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/firewall"
+	"golang.org/x/time/rate"
+)
+
+// firewallLog writes a structured record for packets the firewall drops and connections it adds to conntrack, so an
+// operator can tell what dropped a packet and which rule let a connection through. Records are rate limited, those
+// over the limit are counted and the count is reported on the next record written.
+type firewallLog struct {
+	l       *logrus.Logger
+	drops   bool
+	conns   bool
+	limiter *rate.Limiter
+	skipped atomic.Uint64
+	file    *firewallLogFile
+}
+
+// newFirewallLogFromConfig returns nil when neither drops nor conntrack logging is enabled
+func newFirewallLogFromConfig(l *logrus.Logger, c *config.C) (*firewallLog, error) {
+	drops := c.GetBool("firewall.log.drops", false)
+	conns := c.GetBool("firewall.log.conntrack", false)
+	if !drops && !conns {
+		return nil, nil
+	}
+
+	r := c.GetInt("firewall.log.rate", 10)
+	if r <= 0 {
+		return nil, fmt.Errorf("firewall.log.rate must be greater than 0")
+	}
+
+	burst := c.GetInt("firewall.log.burst", r)
+	if burst < 1 {
+		return nil, fmt.Errorf("firewall.log.burst must be greater than 0")
+	}
+
+	fl := &firewallLog{
+		l:       logrus.New(),
+		drops:   drops,
+		conns:   conns,
+		limiter: rate.NewLimiter(rate.Limit(r), burst),
+	}
+	fl.l.Formatter = &logrus.JSONFormatter{TimestampFormat: time.RFC3339Nano}
+	fl.l.Out = l.Out
+
+	if path := c.GetString("firewall.log.file", ""); path != "" {
+		fl.file = &firewallLogFile{path: path}
+		if err := fl.file.open(); err != nil {
+			return nil, fmt.Errorf("firewall.log.file could not be opened: %s", err)
+		}
+		fl.l.Out = fl.file
+	}
+
+	return fl, nil
+}
+
+func (fl *firewallLog) dropped(fp firewall.Packet, incoming bool, h *HostInfo, reason error) {
+	if !fl.drops {
+		return
+	}
+
+	e := fl.entry(fp, incoming, h)
+	if e == nil {
+		return
+	}
+
+	e.WithField("event", "drop").WithField("reason", reason.Error()).Info("Firewall dropped packet")
+}
+
+// newConn logs a connection added to conntrack, rs is the rule that allowed it
+func (fl *firewallLog) newConn(fp firewall.Packet, incoming bool, h *HostInfo, rs *firewallRuleStats) {
+	if !fl.conns {
+		return
+	}
+
+	e := fl.entry(fp, incoming, h)
+	if e == nil {
+		return
+	}
+
+	var rule m
+	if rs != nil {
+		rule = rs.fields
+	}
+
+	e.WithField("event", "new_conn").WithField("rule", rule).Info("Firewall added connection")
+}
+
+// entry returns the fields shared by every record, or nil if the record is over the rate limit
+func (fl *firewallLog) entry(fp firewall.Packet, incoming bool, h *HostInfo) *logrus.Entry {
+	if !fl.limiter.Allow() {
+		fl.skipped.Add(1)
+		return nil
+	}
+
+	direction := "incoming"
+	if !incoming {
+		direction = "outgoing"
+	}
+
+	fields := logrus.Fields{
+		"fwPacket":  fp,
+		"direction": direction,
+		"vpnIp":     h.vpnIp,
+	}
+
+	if h.ConnectionState != nil && h.ConnectionState.peerCert != nil {
+		fields["certName"] = h.ConnectionState.peerCert.Details.Name
+		fields["groups"] = h.ConnectionState.peerCert.Details.Groups
+	}
+
+	if n := fl.skipped.Swap(0); n > 0 {
+		fields["suppressed"] = n
+	}
+
+	return fl.l.WithFields(fields)
+}
+
+func (fl *firewallLog) close() {
+	if fl.file != nil {
+		fl.file.Close()
+	}
+}
+
+// firewallLogFile appends records to a file. A closed file is reopened on the next write, a firewall is closed when
+// it is replaced but a failed reload can put it back.
+type firewallLogFile struct {
+	sync.Mutex
+	path string
+	f    *os.File
+}
+
+func (lf *firewallLogFile) open() error {
+	lf.Lock()
+	defer lf.Unlock()
+	return lf.openLocked()
+}
+
+func (lf *firewallLogFile) openLocked() error {
+	if lf.f != nil {
+		return nil
+	}
+
+	f, err := os.OpenFile(lf.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return err
+	}
+
+	lf.f = f
+	return nil
+}
+
+func (lf *firewallLogFile) Write(b []byte) (int, error) {
+	lf.Lock()
+	defer lf.Unlock()
+
+	if err := lf.openLocked(); err != nil {
+		return 0, err
+	}
+
+	return lf.f.Write(b)
+}
+
+func (lf *firewallLogFile) Close() error {
+	lf.Lock()
+	defer lf.Unlock()
+
+	if lf.f == nil {
+		return nil
+	}
+
+	err := lf.f.Close()
+	lf.f = nil
+	return err
+}
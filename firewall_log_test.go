@@ -0,0 +1,141 @@
+package nebula
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/slackhq/nebula/cert"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/firewall"
+	"github.com/slackhq/nebula/iputil"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/time/rate"
+)
+
+func TestFirewall_log(t *testing.T) {
+	l := test.NewLogger()
+	ob := &bytes.Buffer{}
+	l.SetOutput(ob)
+
+	ipNet := net.IPNet{IP: net.IPv4(1, 2, 3, 4), Mask: net.IPMask{255, 255, 255, 0}}
+	c := cert.NebulaCertificate{
+		Details: cert.NebulaCertificateDetails{
+			Name:           "host1",
+			Ips:            []*net.IPNet{&ipNet},
+			Groups:         []string{"web"},
+			InvertedGroups: map[string]struct{}{"web": {}},
+		},
+	}
+	h := HostInfo{ConnectionState: &ConnectionState{peerCert: &c}, vpnIp: iputil.Ip2VpnIp(ipNet.IP)}
+	h.CreateRemoteCIDR(&c)
+
+	p := firewall.Packet{
+		LocalIP:    iputil.Ip2VpnIp(net.IPv4(1, 2, 3, 4)),
+		RemoteIP:   iputil.Ip2VpnIp(net.IPv4(1, 2, 3, 4)),
+		LocalPort:  443,
+		RemotePort: 5000,
+		Protocol:   firewall.ProtoTCP,
+	}
+
+	path := filepath.Join(t.TempDir(), "firewall.log")
+	conf := config.NewC(l)
+	conf.Settings["firewall"] = map[interface{}]interface{}{
+		"log": map[interface{}]interface{}{"drops": true, "conntrack": true, "file": path, "rate": 2},
+		"inbound": []interface{}{
+			map[interface{}]interface{}{"port": "22", "proto": "tcp", "group": "ops"},
+			map[interface{}]interface{}{"port": "443", "proto": "tcp", "group": "web"},
+		},
+	}
+
+	fw, err := NewFirewallFromConfig(l, &c, conf)
+	require.NoError(t, err)
+	cp := cert.NewCAPool()
+
+	// A new connection names the rule that allowed it, packets on the tracked connection are not logged
+	require.NoError(t, fw.Drop(p, true, &h, cp, nil, nil))
+	require.NoError(t, fw.Drop(p, true, &h, cp, nil, nil))
+
+	p.LocalPort = 22
+	assert.Equal(t, ErrNoMatchingRule, fw.Drop(p, true, &h, cp, nil, nil))
+
+	// Over the rate limit, counted on the next record
+	assert.Equal(t, ErrNoMatchingRule, fw.Drop(p, true, &h, cp, nil, nil))
+	assert.Equal(t, ErrNoMatchingRule, fw.Drop(p, true, &h, cp, nil, nil))
+	fw.log.limiter.SetLimit(rate.Inf)
+	assert.Equal(t, ErrNoMatchingRule, fw.Drop(p, true, &h, cp, nil, nil))
+
+	records := readFirewallLog(t, path)
+	require.Len(t, records, 3)
+
+	assert.Equal(t, "new_conn", records[0]["event"])
+	assert.Equal(t, "incoming", records[0]["direction"])
+	assert.Equal(t, "host1", records[0]["certName"])
+	assert.Equal(t, []interface{}{"web"}, records[0]["groups"])
+	assert.Equal(t, "1.2.3.4", records[0]["vpnIp"])
+	assert.Equal(t, float64(443), records[0]["fwPacket"].(map[string]interface{})["LocalPort"])
+	assert.Equal(t, float64(443), records[0]["rule"].(map[string]interface{})["startPort"])
+	assert.Equal(t, []interface{}{"web"}, records[0]["rule"].(map[string]interface{})["groups"])
+
+	assert.Equal(t, "drop", records[1]["event"])
+	assert.Equal(t, ErrNoMatchingRule.Error(), records[1]["reason"])
+	assert.NotContains(t, records[1], "rule")
+	assert.NotContains(t, records[1], "suppressed")
+
+	assert.Equal(t, float64(2), records[2]["suppressed"])
+
+	// Nothing goes to the main log and the file is reopened if the firewall is put back after a reload
+	assert.NotContains(t, ob.String(), "Firewall dropped packet")
+	fw.Destroy()
+	assert.Equal(t, ErrNoMatchingRule, fw.Drop(p, true, &h, cp, nil, nil))
+	assert.Len(t, readFirewallLog(t, path), 4)
+}
+
+func TestNewFirewallFromConfig_log(t *testing.T) {
+	l := test.NewLogger()
+	c := &cert.NebulaCertificate{}
+	conf := config.NewC(l)
+
+	fw, err := NewFirewallFromConfig(l, c, conf)
+	require.NoError(t, err)
+	assert.Nil(t, fw.log)
+
+	conf.Settings["firewall"] = map[interface{}]interface{}{"log": map[interface{}]interface{}{"drops": true, "rate": 0}}
+	_, err = NewFirewallFromConfig(l, c, conf)
+	assert.EqualError(t, err, "firewall.log.rate must be greater than 0")
+
+	conf.Settings["firewall"] = map[interface{}]interface{}{"log": map[interface{}]interface{}{"drops": true, "file": t.TempDir()}}
+	_, err = NewFirewallFromConfig(l, c, conf)
+	assert.ErrorContains(t, err, "firewall.log.file could not be opened")
+
+	// Only conntrack logging keeps a copy of the rules
+	conf.Settings["firewall"] = map[interface{}]interface{}{
+		"log":     map[interface{}]interface{}{"drops": true},
+		"inbound": []interface{}{map[interface{}]interface{}{"port": "22", "proto": "tcp", "host": "any"}},
+	}
+	fw, err = NewFirewallFromConfig(l, c, conf)
+	require.NoError(t, err)
+	assert.Empty(t, fw.ruleStats)
+}
+
+func readFirewallLog(t *testing.T, path string) []map[string]interface{} {
+	f, err := os.Open(path)
+	require.NoError(t, err)
+	defer f.Close()
+
+	var records []map[string]interface{}
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		var r map[string]interface{}
+		require.NoError(t, json.Unmarshal(s.Bytes(), &r))
+		records = append(records, r)
+	}
+	require.NoError(t, s.Err())
+	return records
+}
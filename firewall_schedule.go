@@ -0,0 +1,231 @@
+package nebula
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// firewallSchedule limits a rule to windows of time, like business hours on weekdays. Every part is optional but at
+// least one must be set.
+type firewallSchedule struct {
+	// days the rule applies on, indexed by time.Weekday. A window that wraps midnight belongs to the day it starts on
+	days    [7]bool
+	anyDay  bool
+	between bool
+	// start and end are minutes after midnight, end may be before start to wrap midnight
+	start int
+	end   int
+	loc   *time.Location
+
+	notBefore time.Time
+	notAfter  time.Time
+
+	// desc is a canonical form of the schedule, used in the rule hash and logs
+	desc string
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+// parseFirewallSchedule builds a schedule from a rules active_between and schedule fields, nil is returned if neither
+// is set. active_between is shorthand for schedule.between.
+func parseFirewallSchedule(activeBetween string, m map[interface{}]interface{}) (*firewallSchedule, error) {
+	if activeBetween == "" && m == nil {
+		return nil, nil
+	}
+
+	s := &firewallSchedule{anyDay: true, loc: time.Local}
+	get := func(k string) string {
+		if v, ok := m[k]; ok && v != nil {
+			return fmt.Sprintf("%v", v)
+		}
+		return ""
+	}
+
+	for k := range m {
+		switch fmt.Sprintf("%v", k) {
+		case "days", "between", "timezone", "not_before", "not_after":
+		default:
+			return nil, fmt.Errorf("unknown schedule field `%v`", k)
+		}
+	}
+
+	between := get("between")
+	if activeBetween != "" {
+		if between != "" {
+			return nil, errors.New("only one of active_between or schedule.between should be provided")
+		}
+		between = activeBetween
+	}
+
+	if between != "" {
+		start, end, ok := strings.Cut(between, "-")
+		if !ok {
+			return nil, fmt.Errorf("between should be HH:MM-HH:MM; `%s`", between)
+		}
+
+		var err error
+		if s.start, err = parseClockTime(start); err != nil {
+			return nil, err
+		}
+		if s.end, err = parseClockTime(end); err != nil {
+			return nil, err
+		}
+		if s.start == s.end {
+			return nil, fmt.Errorf("between start and end must differ; `%s`", between)
+		}
+		s.between = true
+	}
+
+	if days := toStringSlice(m["days"]); len(days) > 0 {
+		s.anyDay = false
+		for _, d := range days {
+			wd, ok := weekdays[strings.ToLower(strings.TrimSpace(d))]
+			if !ok {
+				return nil, fmt.Errorf("days contains an unknown day `%s`, use sun, mon, tue, wed, thu, fri, or sat", d)
+			}
+			s.days[wd] = true
+		}
+	}
+
+	if tz := get("timezone"); tz != "" {
+		loc, err := time.LoadLocation(tz)
+		if err != nil {
+			return nil, fmt.Errorf("timezone could not be loaded; %s", err)
+		}
+		s.loc = loc
+	}
+
+	var err error
+	if v := get("not_before"); v != "" {
+		if s.notBefore, err = time.Parse(time.RFC3339, v); err != nil {
+			return nil, fmt.Errorf("not_before should be an RFC3339 time; %s", err)
+		}
+	}
+	if v := get("not_after"); v != "" {
+		if s.notAfter, err = time.Parse(time.RFC3339, v); err != nil {
+			return nil, fmt.Errorf("not_after should be an RFC3339 time; %s", err)
+		}
+	}
+	if !s.notBefore.IsZero() && !s.notAfter.IsZero() && !s.notBefore.Before(s.notAfter) {
+		return nil, errors.New("not_before must be before not_after")
+	}
+
+	if !s.between && s.anyDay && s.notBefore.IsZero() && s.notAfter.IsZero() {
+		return nil, errors.New("schedule must set at least one of between, days, not_before, or not_after")
+	}
+
+	s.desc = s.describe()
+	return s, nil
+}
+
+// parseClockTime returns the minutes after midnight for HH:MM, 24:00 is allowed to end a window at midnight
+func parseClockTime(s string) (int, error) {
+	s = strings.TrimSpace(s)
+	h, mm, ok := strings.Cut(s, ":")
+	if ok {
+		hour, herr := strconv.Atoi(h)
+		min, merr := strconv.Atoi(mm)
+		if herr == nil && merr == nil && len(mm) == 2 && hour >= 0 && min >= 0 && min < 60 &&
+			(hour < 24 || (hour == 24 && min == 0)) {
+			return hour*60 + min, nil
+		}
+	}
+
+	return 0, fmt.Errorf("time should be HH:MM; `%s`", s)
+}
+
+func (s *firewallSchedule) describe() string {
+	var parts []string
+	if !s.anyDay {
+		var days []string
+		for wd := time.Sunday; wd <= time.Saturday; wd++ {
+			if s.days[wd] {
+				days = append(days, strings.ToLower(wd.String()[:3]))
+			}
+		}
+		parts = append(parts, "days: "+strings.Join(days, ","))
+	}
+	if s.between {
+		parts = append(parts, fmt.Sprintf("between: %02d:%02d-%02d:%02d", s.start/60, s.start%60, s.end/60, s.end%60))
+	}
+	if s.between || !s.anyDay {
+		parts = append(parts, "timezone: "+s.loc.String())
+	}
+	if !s.notBefore.IsZero() {
+		parts = append(parts, "not_before: "+s.notBefore.Format(time.RFC3339))
+	}
+	if !s.notAfter.IsZero() {
+		parts = append(parts, "not_after: "+s.notAfter.Format(time.RFC3339))
+	}
+	return strings.Join(parts, ", ")
+}
+
+func (s *firewallSchedule) String() string {
+	return s.desc
+}
+
+// active reports if the schedule allows traffic at now and, if so, when that stops. A zero time means it never stops.
+func (s *firewallSchedule) active(now time.Time) (bool, time.Time) {
+	if !s.notBefore.IsZero() && now.Before(s.notBefore) {
+		return false, time.Time{}
+	}
+	if !s.notAfter.IsZero() && !now.Before(s.notAfter) {
+		return false, time.Time{}
+	}
+
+	var until time.Time
+	if s.between || !s.anyDay {
+		t := now.In(s.loc)
+		y, mo, d := t.Date()
+		at := func(dayOffset, minutes int) time.Time {
+			return time.Date(y, mo, d+dayOffset, 0, minutes, 0, 0, s.loc)
+		}
+		dayOk := func(dayOffset int) bool {
+			return s.anyDay || s.days[(int(t.Weekday())+7+dayOffset)%7]
+		}
+
+		switch {
+		case !s.between:
+			// Whole days
+			if !dayOk(0) {
+				return false, time.Time{}
+			}
+			until = at(1, 0)
+
+		case s.start < s.end:
+			if !dayOk(0) || t.Before(at(0, s.start)) || !t.Before(at(0, s.end)) {
+				return false, time.Time{}
+			}
+			until = at(0, s.end)
+
+		default:
+			// The window wraps midnight, we are either in the part that started today or the part that started yesterday
+			if dayOk(0) && !t.Before(at(0, s.start)) {
+				until = at(1, s.end)
+			} else if dayOk(-1) && t.Before(at(0, s.end)) {
+				until = at(0, s.end)
+			} else {
+				return false, time.Time{}
+			}
+		}
+	}
+
+	if !s.notAfter.IsZero() && (until.IsZero() || s.notAfter.Before(until)) {
+		until = s.notAfter
+	}
+
+	return true, until
+}
+
+// wallClock is the clock schedules are evaluated against. Schedules are in wall time, so it follows the system clock
+// through suspends and steps rather than the monotonic clock, which stops while the host is suspended. The monotonic
+// reading is stripped so comparing with when a connection was last checked sees the clock being stepped back.
+func wallClock() time.Time {
+	return time.Now().Round(0)
+}
@@ -0,0 +1,241 @@
+package nebula
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/slackhq/nebula/cert"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/firewall"
+	"github.com/slackhq/nebula/iputil"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_parseFirewallSchedule(t *testing.T) {
+	s, err := parseFirewallSchedule("", nil)
+	require.NoError(t, err)
+	assert.Nil(t, s)
+
+	s, err = parseFirewallSchedule("09:00-17:30", map[interface{}]interface{}{
+		"days":     []interface{}{"mon", "Tue", "fri"},
+		"timezone": "UTC",
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "days: mon,tue,fri, between: 09:00-17:30, timezone: UTC", s.String())
+
+	s, err = parseFirewallSchedule("", map[interface{}]interface{}{
+		"between":   "22:00-24:00",
+		"timezone":  "UTC",
+		"not_after": "2026-03-01T00:00:00Z",
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "between: 22:00-24:00, timezone: UTC, not_after: 2026-03-01T00:00:00Z", s.String())
+
+	for e, args := range map[string][]interface{}{
+		"only one of active_between or schedule.between should be provided":               {"09:00-10:00", map[interface{}]interface{}{"between": "10:00-11:00"}},
+		"between should be HH:MM-HH:MM; `09:00`":                                          {"09:00", nil},
+		"time should be HH:MM; `25:00`":                                                   {"25:00-26:00", nil},
+		"time should be HH:MM; `9:5`":                                                     {"9:5-10:00", nil},
+		"between start and end must differ; `10:00-10:00`":                                {"10:00-10:00", nil},
+		"days contains an unknown day `funday`, use sun, mon, tue, wed, thu, fri, or sat": {"", map[interface{}]interface{}{"days": "funday"}},
+		"unknown schedule field `hours`":                                                  {"", map[interface{}]interface{}{"hours": "1"}},
+		"schedule must set at least one of between, days, not_before, or not_after":       {"", map[interface{}]interface{}{"timezone": "UTC"}},
+		"not_before must be before not_after":                                             {"", map[interface{}]interface{}{"not_before": "2026-03-01T00:00:00Z", "not_after": "2026-01-01T00:00:00Z"}},
+	} {
+		m, _ := args[1].(map[interface{}]interface{})
+		_, err = parseFirewallSchedule(args[0].(string), m)
+		assert.EqualError(t, err, e)
+	}
+
+	_, err = parseFirewallSchedule("", map[interface{}]interface{}{"timezone": "Nowhere/Nope", "days": "mon"})
+	assert.ErrorContains(t, err, "timezone could not be loaded")
+}
+
+func TestFirewallSchedule_active(t *testing.T) {
+	// 2026-10-12 is a Monday
+	at := func(day int, clock string) time.Time {
+		ts, err := time.Parse("2006-01-02 15:04", "2026-10-"+clock)
+		require.NoError(t, err)
+		return ts.AddDate(0, 0, day)
+	}
+
+	check := func(s *firewallSchedule, now time.Time, active bool, until time.Time) {
+		t.Helper()
+		a, u := s.active(now)
+		assert.Equal(t, active, a, "active at %s", now)
+		assert.True(t, until.Equal(u), "until at %s was %s, expected %s", now, u, until)
+	}
+
+	parse := func(between string, m map[interface{}]interface{}) *firewallSchedule {
+		if m == nil {
+			m = map[interface{}]interface{}{}
+		}
+		m["timezone"] = "UTC"
+		s, err := parseFirewallSchedule(between, m)
+		require.NoError(t, err)
+		return s
+	}
+
+	// Weekday business hours
+	s := parse("09:00-17:00", map[interface{}]interface{}{"days": []interface{}{"mon", "tue", "wed", "thu", "fri"}})
+	check(s, at(0, "12 08:59"), false, time.Time{})
+	check(s, at(0, "12 09:00"), true, at(0, "12 17:00"))
+	check(s, at(0, "12 16:59"), true, at(0, "12 17:00"))
+	check(s, at(0, "12 17:00"), false, time.Time{})
+	check(s, at(0, "17 10:00"), false, time.Time{})
+
+	// Overnight, the window belongs to the day it starts on
+	s = parse("22:00-06:00", map[interface{}]interface{}{"days": "fri"})
+	check(s, at(0, "16 21:59"), false, time.Time{})
+	check(s, at(0, "16 23:00"), true, at(0, "17 06:00"))
+	check(s, at(0, "17 05:00"), true, at(0, "17 06:00"))
+	check(s, at(0, "17 23:00"), false, time.Time{})
+	check(s, at(0, "16 05:00"), false, time.Time{})
+
+	// Whole days
+	s = parse("", map[interface{}]interface{}{"days": "sat"})
+	check(s, at(0, "17 00:00"), true, at(0, "18 00:00"))
+	check(s, at(0, "18 00:00"), false, time.Time{})
+
+	// Absolute bounds, which also cut a window short
+	s = parse("", map[interface{}]interface{}{"not_before": "2026-10-12T00:00:00Z", "not_after": "2026-10-13T12:00:00Z"})
+	check(s, at(0, "11 23:59"), false, time.Time{})
+	check(s, at(0, "12 00:00"), true, at(0, "13 12:00"))
+	check(s, at(0, "13 12:00"), false, time.Time{})
+
+	s = parse("09:00-17:00", map[interface{}]interface{}{"not_after": "2026-10-12T15:00:00Z"})
+	check(s, at(0, "12 10:00"), true, at(0, "12 15:00"))
+
+	// Time zones are respected
+	s, err := parseFirewallSchedule("09:00-17:00", map[interface{}]interface{}{"timezone": "America/New_York"})
+	require.NoError(t, err)
+	check(s, at(0, "12 12:00"), false, time.Time{})
+	check(s, at(0, "12 14:00"), true, at(0, "12 21:00"))
+}
+
+func TestFirewall_DropScheduled(t *testing.T) {
+	l := test.NewLogger()
+	ob := &bytes.Buffer{}
+	l.SetOutput(ob)
+
+	ipNet := net.IPNet{IP: net.IPv4(1, 2, 3, 4), Mask: net.IPMask{255, 255, 255, 0}}
+	c := cert.NebulaCertificate{
+		Details: cert.NebulaCertificateDetails{
+			Name:           "contractor1",
+			Ips:            []*net.IPNet{&ipNet},
+			Groups:         []string{"contractors"},
+			InvertedGroups: map[string]struct{}{"contractors": {}},
+		},
+	}
+	h := HostInfo{ConnectionState: &ConnectionState{peerCert: &c}, vpnIp: iputil.Ip2VpnIp(ipNet.IP)}
+	h.CreateRemoteCIDR(&c)
+
+	p := firewall.Packet{
+		LocalIP:    iputil.Ip2VpnIp(net.IPv4(1, 2, 3, 4)),
+		RemoteIP:   iputil.Ip2VpnIp(net.IPv4(1, 2, 3, 4)),
+		LocalPort:  22,
+		RemotePort: 5000,
+		Protocol:   firewall.ProtoTCP,
+	}
+
+	conf := config.NewC(l)
+	conf.Settings["firewall"] = map[interface{}]interface{}{
+		"inbound": []interface{}{
+			map[interface{}]interface{}{
+				"port": "22", "proto": "tcp", "group": "contractors", "active_between": "09:00-17:00",
+				"schedule": map[interface{}]interface{}{"timezone": "UTC"},
+			},
+		},
+	}
+
+	fw, err := NewFirewallFromConfig(l, &c, conf)
+	require.NoError(t, err)
+	now := time.Date(2026, 10, 12, 16, 59, 0, 0, time.UTC)
+	fw.now = func() time.Time { return now }
+	cp := cert.NewCAPool()
+	ob.Reset()
+
+	// Inside the window
+	require.NoError(t, fw.Drop(p, true, &h, cp, nil, nil))
+	assert.Empty(t, ob.String())
+
+	// Conntrack keeps the flow alive until the window closes
+	now = now.Add(30 * time.Second)
+	require.NoError(t, fw.Drop(p, true, &h, cp, nil, nil))
+	now = now.Add(30 * time.Second)
+	assert.Equal(t, ErrNoMatchingRule, fw.Drop(p, true, &h, cp, nil, nil))
+	fw.Conntrack.Lock()
+	assert.Empty(t, fw.Conntrack.Conns)
+	fw.Conntrack.Unlock()
+	assert.Contains(t, ob.String(), "Firewall rule matched outside of its schedule")
+	assert.Contains(t, ob.String(), "between: 09:00-17:00, timezone: UTC")
+
+	// Stepping the clock back has an open connection checked again
+	fw.Conntrack.Lock()
+	fw.Conntrack.Conns = map[firewall.Packet]*conn{}
+	fw.Conntrack.Unlock()
+	now = time.Date(2026, 10, 12, 16, 0, 0, 0, time.UTC)
+	require.NoError(t, fw.Drop(p, true, &h, cp, nil, nil))
+	now = time.Date(2026, 10, 12, 8, 0, 0, 0, time.UTC)
+	ob.Reset()
+	assert.Equal(t, ErrNoMatchingRule, fw.Drop(p, true, &h, cp, nil, nil))
+
+	// The log is rate limited
+	ob.Reset()
+	assert.Equal(t, ErrNoMatchingRule, fw.Drop(p, true, &h, cp, nil, nil))
+	assert.Empty(t, ob.String())
+
+	// Other ports are not covered by the schedule
+	p.LocalPort = 23
+	now = time.Date(2026, 10, 13, 10, 0, 0, 0, time.UTC)
+	assert.Equal(t, ErrNoMatchingRule, fw.Drop(p, true, &h, cp, nil, nil))
+	assert.Empty(t, ob.String())
+
+	// Unscheduled rules take priority and never expire the conntrack entry
+	p.LocalPort = 22
+	require.NoError(t, fw.AddRule(true, firewall.ProtoTCP, 22, 22, []string{"contractors"}, "", nil, nil, "", ""))
+	require.NoError(t, fw.Drop(p, true, &h, cp, nil, nil))
+	now = now.Add(24 * time.Hour)
+	fw.Conntrack.Lock()
+	assert.True(t, fw.Conntrack.Conns[p].activeUntil.IsZero())
+	fw.Conntrack.Unlock()
+}
+
+func TestAddFirewallRulesFromConfig_schedule(t *testing.T) {
+	l := test.NewLogger()
+	conf := config.NewC(l)
+	mf := &mockFirewall{}
+
+	conf.Settings["firewall"] = map[interface{}]interface{}{"inbound": []interface{}{
+		map[interface{}]interface{}{"port": "22", "proto": "tcp", "host": "a", "active_between": "09:00-17:60"},
+	}}
+	assert.EqualError(t, AddFirewallRulesFromConfig(l, true, conf, mf), "firewall.inbound rule #0; schedule time should be HH:MM; `17:60`")
+
+	conf.Settings["firewall"] = map[interface{}]interface{}{"inbound": []interface{}{
+		map[interface{}]interface{}{"port": "22", "proto": "tcp", "host": "a", "schedule": "weekdays"},
+	}}
+	assert.EqualError(t, AddFirewallRulesFromConfig(l, true, conf, mf), "firewall.inbound rule #0; schedule should be a map")
+
+	// Firewalls that can't schedule rules refuse them instead of allowing the traffic all the time
+	conf.Settings["firewall"] = map[interface{}]interface{}{"inbound": []interface{}{
+		map[interface{}]interface{}{"port": "22", "proto": "tcp", "host": "a", "active_between": "09:00-17:00"},
+	}}
+	assert.EqualError(t, AddFirewallRulesFromConfig(l, true, conf, mf), "firewall.inbound rule #0; schedules are not supported here")
+	assert.Empty(t, mf.calls)
+
+	// Scheduled rules change the rule hash, unscheduled ones hash as they always have
+	c := &cert.NebulaCertificate{}
+	fw := NewFirewall(l, time.Second, time.Minute, time.Hour, c)
+	require.NoError(t, AddFirewallRulesFromConfig(l, true, conf, fw))
+	assert.Contains(t, fw.rules, ", schedule: between: 09:00-17:00")
+	assert.Len(t, fw.scheduledIn, 1)
+
+	fw2 := NewFirewall(l, time.Second, time.Minute, time.Hour, c)
+	require.NoError(t, fw2.AddRule(true, firewall.ProtoTCP, 22, 22, nil, "a", nil, nil, "", ""))
+	assert.NotContains(t, fw2.rules, "schedule")
+	assert.NotEqual(t, fw.GetRuleHash(), fw2.GetRuleHash())
+}
@@ -0,0 +1,157 @@
+package nebula
+
+import (
+	"net"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	"github.com/slackhq/nebula/cert"
+	"github.com/slackhq/nebula/firewall"
+)
+
+// firewallRuleStats is a single rule kept in its own table so traffic can be attributed to the rule that allowed it.
+// The rule tables merge rules together, so the first of these that matches a new connection is credited with it.
+type firewallRuleStats struct {
+	incoming bool
+	// index is the position of the rule among the rules for its direction
+	index    int
+	schedule *firewallSchedule
+	table    *FirewallTable
+	fields   m
+
+	// conns counts connections the rule allowed, counter every packet on them
+	conns   atomic.Uint64
+	counter firewall.Counter
+}
+
+// FirewallRuleStats is a snapshot of the traffic allowed by a rule
+type FirewallRuleStats struct {
+	Direction string `json:"direction"`
+	Index     int    `json:"index"`
+	Rule      m      `json:"rule"`
+	Conns     uint64 `json:"conns"`
+	Packets   uint64 `json:"packets"`
+	Bytes     uint64 `json:"bytes"`
+}
+
+// trackRule keeps a copy of a rule when rule stats or conntrack logging need to know which rule allowed a connection
+func (f *Firewall) trackRule(incoming bool, proto uint8, startPort int32, endPort int32, groups []string, expr *groupExpr, host string, ip *net.IPNet, set *firewallCIDRSet, localIp *net.IPNet, caName string, caSha string, schedule *firewallSchedule, fields m) error {
+	if !f.ruleStatsEnabled && (f.log == nil || !f.log.conns) {
+		return nil
+	}
+
+	ft := newFirewallTable()
+	fp, err := ft.protoPorts(proto)
+	if err != nil {
+		return err
+	}
+
+	if err := fp.addRule(f, startPort, endPort, groups, expr, host, ip, set, localIp, caName, caSha); err != nil {
+		return err
+	}
+
+	index := 0
+	for _, rs := range f.ruleStats {
+		if rs.incoming == incoming {
+			index++
+		}
+	}
+
+	f.ruleStats = append(f.ruleStats, &firewallRuleStats{
+		incoming: incoming,
+		index:    index,
+		schedule: schedule,
+		table:    ft,
+		fields:   fields,
+	})
+	return nil
+}
+
+// matchedRule returns the first rule that allows the packet, nil if rules are not tracked
+func (f *Firewall) matchedRule(fp firewall.Packet, incoming bool, c *cert.NebulaCertificate, caPool *cert.NebulaCAPool, now time.Time) *firewallRuleStats {
+	for _, rs := range f.ruleStats {
+		if rs.incoming != incoming || !rs.table.match(fp, incoming, c, caPool) {
+			continue
+		}
+
+		if rs.schedule != nil {
+			if active, _ := rs.schedule.active(now); !active {
+				continue
+			}
+		}
+
+		return rs
+	}
+
+	return nil
+}
+
+// ruleCounter returns the counter conntrack entries allowed by rs should update, nil when rule stats are disabled
+func (f *Firewall) ruleCounter(rs *firewallRuleStats) *firewall.Counter {
+	if rs == nil || !f.ruleStatsEnabled {
+		return nil
+	}
+	return &rs.counter
+}
+
+// RuleStats returns the traffic allowed by each rule, in the order the rules were added. It is empty unless
+// firewall.rule_stats is enabled.
+func (f *Firewall) RuleStats() []FirewallRuleStats {
+	if !f.ruleStatsEnabled {
+		return nil
+	}
+
+	stats := make([]FirewallRuleStats, 0, len(f.ruleStats))
+	for _, rs := range f.ruleStats {
+		stats = append(stats, FirewallRuleStats{
+			Direction: rs.direction(),
+			Index:     rs.index,
+			Rule:      rs.fields,
+			Conns:     rs.conns.Load(),
+			Packets:   rs.counter.Packets.Load(),
+			Bytes:     rs.counter.Bytes.Load(),
+		})
+	}
+
+	return stats
+}
+
+func (rs *firewallRuleStats) direction() string {
+	if rs.incoming {
+		return "incoming"
+	}
+	return "outgoing"
+}
+
+// metricName returns the name of a per rule metric, like firewall.rules.incoming.0.packets
+func (rs *firewallRuleStats) metricName(kind string) string {
+	return "firewall.rules." + rs.direction() + "." + strconv.Itoa(rs.index) + "." + kind
+}
+
+// emitRuleStats updates the per rule gauges
+func (f *Firewall) emitRuleStats() {
+	if !f.ruleStatsEnabled {
+		return
+	}
+
+	for _, rs := range f.ruleStats {
+		metrics.GetOrRegisterGauge(rs.metricName("conns"), nil).Update(int64(rs.conns.Load()))
+		metrics.GetOrRegisterGauge(rs.metricName("packets"), nil).Update(int64(rs.counter.Packets.Load()))
+		metrics.GetOrRegisterGauge(rs.metricName("bytes"), nil).Update(int64(rs.counter.Bytes.Load()))
+	}
+}
+
+// unregisterRuleStats removes the per rule gauges, the firewall that replaces this one registers its own
+func (f *Firewall) unregisterRuleStats() {
+	if !f.ruleStatsEnabled {
+		return
+	}
+
+	for _, rs := range f.ruleStats {
+		metrics.Unregister(rs.metricName("conns"))
+		metrics.Unregister(rs.metricName("packets"))
+		metrics.Unregister(rs.metricName("bytes"))
+	}
+}
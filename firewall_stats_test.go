@@ -0,0 +1,106 @@
+package nebula
+
+import (
+	"net"
+	"testing"
+
+	"github.com/rcrowley/go-metrics"
+	"github.com/slackhq/nebula/cert"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/firewall"
+	"github.com/slackhq/nebula/iputil"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFirewall_RuleStats(t *testing.T) {
+	l := test.NewLogger()
+
+	ipNet := net.IPNet{IP: net.IPv4(1, 2, 3, 4), Mask: net.IPMask{255, 255, 255, 0}}
+	c := cert.NebulaCertificate{
+		Details: cert.NebulaCertificateDetails{
+			Name:           "host1",
+			Ips:            []*net.IPNet{&ipNet},
+			Groups:         []string{"web"},
+			InvertedGroups: map[string]struct{}{"web": {}},
+		},
+	}
+	h := HostInfo{ConnectionState: &ConnectionState{peerCert: &c}, vpnIp: iputil.Ip2VpnIp(ipNet.IP)}
+	h.CreateRemoteCIDR(&c)
+
+	p := firewall.Packet{
+		LocalIP:    iputil.Ip2VpnIp(net.IPv4(1, 2, 3, 4)),
+		RemoteIP:   iputil.Ip2VpnIp(net.IPv4(1, 2, 3, 4)),
+		LocalPort:  443,
+		RemotePort: 5000,
+		Protocol:   firewall.ProtoTCP,
+	}
+
+	conf := config.NewC(l)
+	conf.Settings["firewall"] = map[interface{}]interface{}{
+		"inbound": []interface{}{
+			map[interface{}]interface{}{"port": "22", "proto": "tcp", "group": "ops"},
+			map[interface{}]interface{}{"port": "443", "proto": "tcp", "group": "web"},
+			map[interface{}]interface{}{"port": "80", "proto": "tcp", "host": "any"},
+		},
+		"outbound": []interface{}{
+			map[interface{}]interface{}{"port": "any", "proto": "any", "host": "any"},
+		},
+	}
+
+	// Disabled by default
+	fw, err := NewFirewallFromConfig(l, &c, conf)
+	require.NoError(t, err)
+	assert.Empty(t, fw.ruleStats)
+	assert.Nil(t, fw.RuleStats())
+
+	conf.Settings["firewall"].(map[interface{}]interface{})["rule_stats"] = true
+	fw, err = NewFirewallFromConfig(l, &c, conf)
+	require.NoError(t, err)
+	cp := cert.NewCAPool()
+
+	// The first matching rule gets the connection, every packet on it is counted
+	require.NoError(t, fw.Drop(p, true, &h, cp, nil, make([]byte, 100)))
+	require.NoError(t, fw.Drop(p, true, &h, cp, nil, make([]byte, 50)))
+
+	// Packets served from the local cache are counted too
+	localCache := firewall.ConntrackCache{}
+	require.NoError(t, fw.Drop(p, true, &h, cp, localCache, make([]byte, 10)))
+	require.NoError(t, fw.Drop(p, true, &h, cp, localCache, make([]byte, 10)))
+
+	p.LocalPort = 80
+	require.NoError(t, fw.Drop(p, true, &h, cp, nil, make([]byte, 5)))
+
+	p.LocalPort = 22
+	assert.Equal(t, ErrNoMatchingRule, fw.Drop(p, true, &h, cp, nil, make([]byte, 1000)))
+
+	stats := fw.RuleStats()
+	require.Len(t, stats, 4)
+
+	// Outbound rules are loaded first
+	assert.Equal(t, "outgoing", stats[0].Direction)
+	assert.Equal(t, 0, stats[0].Index)
+	assert.Zero(t, stats[0].Conns)
+
+	assert.Equal(t, FirewallRuleStats{Direction: "incoming", Index: 0, Rule: stats[1].Rule}, stats[1])
+
+	assert.Equal(t, "incoming", stats[2].Direction)
+	assert.Equal(t, 1, stats[2].Index)
+	assert.Equal(t, uint64(1), stats[2].Conns)
+	assert.Equal(t, uint64(4), stats[2].Packets)
+	assert.Equal(t, uint64(170), stats[2].Bytes)
+
+	assert.Equal(t, 2, stats[3].Index)
+	assert.Equal(t, uint64(1), stats[3].Conns)
+	assert.Equal(t, uint64(1), stats[3].Packets)
+	assert.Equal(t, uint64(5), stats[3].Bytes)
+
+	// Gauges are emitted per rule and removed when the firewall is destroyed
+	fw.EmitStats()
+	assert.Equal(t, int64(170), metrics.GetOrRegisterGauge("firewall.rules.incoming.1.bytes", nil).Value())
+	assert.Equal(t, int64(1), metrics.GetOrRegisterGauge("firewall.rules.incoming.2.conns", nil).Value())
+
+	fw.Destroy()
+	assert.Nil(t, metrics.Get("firewall.rules.incoming.1.bytes"))
+}
@@ -8,12 +8,14 @@ import (
 	"testing"
 	"time"
 
+	"github.com/rcrowley/go-metrics"
 	"github.com/slackhq/nebula/cert"
 	"github.com/slackhq/nebula/config"
 	"github.com/slackhq/nebula/firewall"
 	"github.com/slackhq/nebula/iputil"
 	"github.com/slackhq/nebula/test"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestNewFirewall(t *testing.T) {
@@ -161,44 +163,59 @@ func TestFirewall_Drop(t *testing.T) {
 	cp := cert.NewCAPool()
 
 	// Drop outbound
-	assert.Equal(t, fw.Drop(p, false, &h, cp, nil), ErrNoMatchingRule)
+	assert.Equal(t, fw.Drop(p, false, &h, cp, nil, nil), ErrNoMatchingRule)
 	// Allow inbound
 	resetConntrack(fw)
-	assert.NoError(t, fw.Drop(p, true, &h, cp, nil))
+	assert.NoError(t, fw.Drop(p, true, &h, cp, nil, nil))
 	// Allow outbound because conntrack
-	assert.NoError(t, fw.Drop(p, false, &h, cp, nil))
+	assert.NoError(t, fw.Drop(p, false, &h, cp, nil, nil))
 
 	// test remote mismatch
 	oldRemote := p.RemoteIP
 	p.RemoteIP = iputil.Ip2VpnIp(net.IPv4(1, 2, 3, 10))
-	assert.Equal(t, fw.Drop(p, false, &h, cp, nil), ErrInvalidRemoteIP)
+	assert.Equal(t, fw.Drop(p, false, &h, cp, nil, nil), ErrInvalidRemoteIP)
 	p.RemoteIP = oldRemote
 
 	// ensure signer doesn't get in the way of group checks
 	fw = NewFirewall(l, time.Second, time.Minute, time.Hour, &c)
 	assert.Nil(t, fw.AddRule(true, firewall.ProtoAny, 0, 0, []string{"nope"}, "", nil, nil, "", "signer-shasum"))
 	assert.Nil(t, fw.AddRule(true, firewall.ProtoAny, 0, 0, []string{"default-group"}, "", nil, nil, "", "signer-shasum-bad"))
-	assert.Equal(t, fw.Drop(p, true, &h, cp, nil), ErrNoMatchingRule)
+	assert.Equal(t, fw.Drop(p, true, &h, cp, nil, nil), ErrNoMatchingRule)
 
 	// test caSha doesn't drop on match
 	fw = NewFirewall(l, time.Second, time.Minute, time.Hour, &c)
 	assert.Nil(t, fw.AddRule(true, firewall.ProtoAny, 0, 0, []string{"nope"}, "", nil, nil, "", "signer-shasum-bad"))
 	assert.Nil(t, fw.AddRule(true, firewall.ProtoAny, 0, 0, []string{"default-group"}, "", nil, nil, "", "signer-shasum"))
-	assert.NoError(t, fw.Drop(p, true, &h, cp, nil))
+	assert.NoError(t, fw.Drop(p, true, &h, cp, nil, nil))
 
 	// ensure ca name doesn't get in the way of group checks
 	cp.CAs["signer-shasum"] = &cert.NebulaCertificate{Details: cert.NebulaCertificateDetails{Name: "ca-good"}}
 	fw = NewFirewall(l, time.Second, time.Minute, time.Hour, &c)
 	assert.Nil(t, fw.AddRule(true, firewall.ProtoAny, 0, 0, []string{"nope"}, "", nil, nil, "ca-good", ""))
 	assert.Nil(t, fw.AddRule(true, firewall.ProtoAny, 0, 0, []string{"default-group"}, "", nil, nil, "ca-good-bad", ""))
-	assert.Equal(t, fw.Drop(p, true, &h, cp, nil), ErrNoMatchingRule)
+	assert.Equal(t, fw.Drop(p, true, &h, cp, nil, nil), ErrNoMatchingRule)
 
 	// test caName doesn't drop on match
 	cp.CAs["signer-shasum"] = &cert.NebulaCertificate{Details: cert.NebulaCertificateDetails{Name: "ca-good"}}
 	fw = NewFirewall(l, time.Second, time.Minute, time.Hour, &c)
 	assert.Nil(t, fw.AddRule(true, firewall.ProtoAny, 0, 0, []string{"nope"}, "", nil, nil, "ca-good-bad", ""))
 	assert.Nil(t, fw.AddRule(true, firewall.ProtoAny, 0, 0, []string{"default-group"}, "", nil, nil, "ca-good", ""))
-	assert.NoError(t, fw.Drop(p, true, &h, cp, nil))
+	assert.NoError(t, fw.Drop(p, true, &h, cp, nil, nil))
+
+	// caSha pinned to the sha256 sum still matches a CA with another hash
+	caSha384 := &cert.NebulaCertificate{Details: cert.NebulaCertificateDetails{Name: "ca-384", Hash: cert.HashAlgorithm_SHA384}}
+	cp.CAs["signer-shasum"] = caSha384
+	sum, _ := caSha384.Sha256Sum()
+	fw = NewFirewall(l, time.Second, time.Minute, time.Hour, &c)
+	assert.Nil(t, fw.AddRule(true, firewall.ProtoAny, 0, 0, []string{"default-group"}, "", nil, nil, "", sum))
+	assert.NoError(t, fw.Drop(p, true, &h, cp, nil, nil))
+
+	caSha384.Details.Hash = cert.HashAlgorithm_SHA256
+	caSha384.ResetCache()
+	sum, _ = caSha384.Sha256Sum()
+	fw = NewFirewall(l, time.Second, time.Minute, time.Hour, &c)
+	assert.Nil(t, fw.AddRule(true, firewall.ProtoAny, 0, 0, []string{"default-group"}, "", nil, nil, "", sum))
+	assert.Equal(t, fw.Drop(p, true, &h, cp, nil, nil), ErrNoMatchingRule)
 }
 
 func BenchmarkFirewallTable_match(b *testing.B) {
@@ -209,8 +226,8 @@ func BenchmarkFirewallTable_match(b *testing.B) {
 
 	_, n, _ := net.ParseCIDR("172.1.1.1/32")
 	goodLocalCIDRIP := iputil.Ip2VpnIp(n.IP)
-	_ = ft.TCP.addRule(f, 10, 10, []string{"good-group"}, "good-host", n, nil, "", "")
-	_ = ft.TCP.addRule(f, 100, 100, []string{"good-group"}, "good-host", nil, n, "", "")
+	_ = ft.TCP.addRule(f, 10, 10, []string{"good-group"}, nil, "good-host", n, nil, nil, "", "")
+	_ = ft.TCP.addRule(f, 100, 100, []string{"good-group"}, nil, "good-host", nil, nil, n, "", "")
 	cp := cert.NewCAPool()
 
 	b.Run("fail on proto", func(b *testing.B) {
@@ -410,10 +427,10 @@ func TestFirewall_Drop2(t *testing.T) {
 	cp := cert.NewCAPool()
 
 	// h1/c1 lacks the proper groups
-	assert.Error(t, fw.Drop(p, true, &h1, cp, nil), ErrNoMatchingRule)
+	assert.Error(t, fw.Drop(p, true, &h1, cp, nil, nil), ErrNoMatchingRule)
 	// c has the proper groups
 	resetConntrack(fw)
-	assert.NoError(t, fw.Drop(p, true, &h, cp, nil))
+	assert.NoError(t, fw.Drop(p, true, &h, cp, nil, nil))
 }
 
 func TestFirewall_Drop3(t *testing.T) {
@@ -493,13 +510,13 @@ func TestFirewall_Drop3(t *testing.T) {
 	cp := cert.NewCAPool()
 
 	// c1 should pass because host match
-	assert.NoError(t, fw.Drop(p, true, &h1, cp, nil))
+	assert.NoError(t, fw.Drop(p, true, &h1, cp, nil, nil))
 	// c2 should pass because ca sha match
 	resetConntrack(fw)
-	assert.NoError(t, fw.Drop(p, true, &h2, cp, nil))
+	assert.NoError(t, fw.Drop(p, true, &h2, cp, nil, nil))
 	// c3 should fail because no match
 	resetConntrack(fw)
-	assert.Equal(t, fw.Drop(p, true, &h3, cp, nil), ErrNoMatchingRule)
+	assert.Equal(t, fw.Drop(p, true, &h3, cp, nil, nil), ErrNoMatchingRule)
 }
 
 func TestFirewall_DropConntrackReload(t *testing.T) {
@@ -543,12 +560,12 @@ func TestFirewall_DropConntrackReload(t *testing.T) {
 	cp := cert.NewCAPool()
 
 	// Drop outbound
-	assert.Equal(t, fw.Drop(p, false, &h, cp, nil), ErrNoMatchingRule)
+	assert.Equal(t, fw.Drop(p, false, &h, cp, nil, nil), ErrNoMatchingRule)
 	// Allow inbound
 	resetConntrack(fw)
-	assert.NoError(t, fw.Drop(p, true, &h, cp, nil))
+	assert.NoError(t, fw.Drop(p, true, &h, cp, nil, nil))
 	// Allow outbound because conntrack
-	assert.NoError(t, fw.Drop(p, false, &h, cp, nil))
+	assert.NoError(t, fw.Drop(p, false, &h, cp, nil, nil))
 
 	oldFw := fw
 	fw = NewFirewall(l, time.Second, time.Minute, time.Hour, &c)
@@ -557,7 +574,7 @@ func TestFirewall_DropConntrackReload(t *testing.T) {
 	fw.rulesVersion = oldFw.rulesVersion + 1
 
 	// Allow outbound because conntrack and new rules allow port 10
-	assert.NoError(t, fw.Drop(p, false, &h, cp, nil))
+	assert.NoError(t, fw.Drop(p, false, &h, cp, nil, nil))
 
 	oldFw = fw
 	fw = NewFirewall(l, time.Second, time.Minute, time.Hour, &c)
@@ -566,7 +583,7 @@ func TestFirewall_DropConntrackReload(t *testing.T) {
 	fw.rulesVersion = oldFw.rulesVersion + 1
 
 	// Drop outbound because conntrack doesn't match new ruleset
-	assert.Equal(t, fw.Drop(p, false, &h, cp, nil), ErrNoMatchingRule)
+	assert.Equal(t, fw.Drop(p, false, &h, cp, nil, nil), ErrNoMatchingRule)
 }
 
 func BenchmarkLookup(b *testing.B) {
@@ -644,6 +661,153 @@ func BenchmarkLookup(b *testing.B) {
 	//TODO: only way array lookup in array will help is if both are sorted, then maybe it's faster
 }
 
+func TestFirewall_inheritConntrack(t *testing.T) {
+	l := test.NewLogger()
+	p := firewall.Packet{
+		LocalIP:    iputil.Ip2VpnIp(net.IPv4(1, 2, 3, 4)),
+		RemoteIP:   iputil.Ip2VpnIp(net.IPv4(1, 2, 3, 4)),
+		LocalPort:  10,
+		RemotePort: 90,
+		Protocol:   firewall.ProtoUDP,
+	}
+
+	ipNet := net.IPNet{IP: net.IPv4(1, 2, 3, 4), Mask: net.IPMask{255, 255, 255, 0}}
+	c := cert.NebulaCertificate{
+		Details: cert.NebulaCertificateDetails{
+			Name:           "host1",
+			Ips:            []*net.IPNet{&ipNet},
+			Groups:         []string{"default-group"},
+			InvertedGroups: map[string]struct{}{"default-group": {}},
+		},
+	}
+	h := HostInfo{ConnectionState: &ConnectionState{peerCert: &c}, vpnIp: iputil.Ip2VpnIp(ipNet.IP)}
+	h.CreateRemoteCIDR(&c)
+	cp := cert.NewCAPool()
+
+	// Each reload replaces a firewall that allowed the connection with one that does not
+	reload := func(policy string) (*Firewall, int) {
+		oldFw := NewFirewall(l, time.Second, time.Minute, time.Hour, &c)
+		require.NoError(t, oldFw.AddRule(true, firewall.ProtoAny, 0, 0, []string{"any"}, "", nil, nil, "", ""))
+		require.NoError(t, oldFw.Drop(p, true, &h, cp, nil, nil))
+
+		conf := config.NewC(l)
+		conf.Settings["firewall"] = map[interface{}]interface{}{
+			"conntrack": map[interface{}]interface{}{"on_reload": policy},
+			"inbound":   []interface{}{map[interface{}]interface{}{"port": "11", "proto": "any", "host": "any"}},
+		}
+		fw, err := NewFirewallFromConfig(l, &c, conf)
+		require.NoError(t, err)
+
+		oldFw.Conntrack.Lock()
+		defer oldFw.Conntrack.Unlock()
+		fw.rulesVersion = oldFw.rulesVersion + 1
+		return fw, fw.inheritConntrack(oldFw.Conntrack)
+	}
+
+	invalidated := metrics.GetOrRegisterCounter("firewall.conntrack.invalidated", nil)
+
+	// recheck is the default, the connection is dropped on its next packet
+	fw, flushed := reload("recheck")
+	assert.Equal(t, conntrackReloadRecheck, fw.reloadPolicy)
+	assert.Equal(t, 0, flushed)
+	before := invalidated.Count()
+	assert.Equal(t, ErrNoMatchingRule, fw.Drop(p, false, &h, cp, nil, nil))
+	assert.Equal(t, before+1, invalidated.Count())
+
+	// preserve keeps the connection alive under the new rules
+	fw, flushed = reload("preserve")
+	assert.Equal(t, 0, flushed)
+	assert.NoError(t, fw.Drop(p, false, &h, cp, nil, nil))
+
+	// flush drops everything up front
+	before = invalidated.Count()
+	fw, flushed = reload("flush")
+	assert.Equal(t, 1, flushed)
+	assert.Equal(t, before+1, invalidated.Count())
+	assert.Empty(t, fw.Conntrack.Conns)
+	assert.Equal(t, ErrNoMatchingRule, fw.Drop(p, false, &h, cp, nil, nil))
+
+	conf := config.NewC(l)
+	conf.Settings["firewall"] = map[interface{}]interface{}{"conntrack": map[interface{}]interface{}{"on_reload": "keep"}}
+	_, err := NewFirewallFromConfig(l, &c, conf)
+	assert.EqualError(t, err, "firewall.conntrack.on_reload must be one of recheck, preserve, or flush; `keep`")
+}
+
+func TestFirewall_StrictOutbound(t *testing.T) {
+	l := test.NewLogger()
+	ipNet := net.IPNet{IP: net.IPv4(1, 2, 3, 4), Mask: net.IPMask{255, 255, 255, 0}}
+	me := cert.NebulaCertificate{Details: cert.NebulaCertificateDetails{Name: "me", Ips: []*net.IPNet{&ipNet}}}
+
+	// Wide open outbound rules are refused
+	conf := config.NewC(l)
+	for _, r := range []map[interface{}]interface{}{
+		{"port": "any", "proto": "any", "host": "any"},
+		{"port": "any", "proto": "any", "group": "any"},
+		{"port": "any", "proto": "any", "cidr": "0.0.0.0/0"},
+		{"port": "any", "proto": "any", "ca_name": "ca"},
+	} {
+		conf.Settings["firewall"] = map[interface{}]interface{}{"strict_outbound": true, "outbound": []interface{}{r}}
+		_, err := NewFirewallFromConfig(l, &me, conf)
+		assert.EqualError(t, err, "firewall.outbound rule #0; `outbound rules must be limited to a host, group, or cidr when strict_outbound is set`", r)
+	}
+
+	conf.Settings["firewall"] = map[interface{}]interface{}{
+		"strict_outbound": true,
+		"outbound": []interface{}{
+			map[interface{}]interface{}{"port": "5432", "proto": "tcp", "group": "db"},
+		},
+		"inbound": []interface{}{
+			map[interface{}]interface{}{"port": "443", "proto": "tcp", "host": "any"},
+		},
+	}
+	fw, err := NewFirewallFromConfig(l, &me, conf)
+	require.NoError(t, err)
+	assert.True(t, fw.StrictOutbound)
+	cp := cert.NewCAPool()
+
+	newHost := func(name string, ip net.IP, groups ...string) *HostInfo {
+		c := cert.NebulaCertificate{Details: cert.NebulaCertificateDetails{
+			Name:           name,
+			Ips:            []*net.IPNet{{IP: ip, Mask: net.IPMask{255, 255, 255, 0}}},
+			Groups:         groups,
+			InvertedGroups: map[string]struct{}{},
+		}}
+		for _, g := range groups {
+			c.Details.InvertedGroups[g] = struct{}{}
+		}
+		h := &HostInfo{ConnectionState: &ConnectionState{peerCert: &c}, vpnIp: iputil.Ip2VpnIp(ip)}
+		h.CreateRemoteCIDR(&c)
+		return h
+	}
+	db := newHost("db", net.IPv4(1, 2, 3, 5), "db")
+	web := newHost("web", net.IPv4(1, 2, 3, 6), "web")
+
+	p := firewall.Packet{
+		LocalIP:    iputil.Ip2VpnIp(net.IPv4(1, 2, 3, 4)),
+		LocalPort:  40000,
+		RemotePort: 5432,
+		Protocol:   firewall.ProtoTCP,
+	}
+
+	// Egress is only allowed to the group named by a rule
+	p.RemoteIP = db.vpnIp
+	assert.NoError(t, fw.Drop(p, false, db, cp, nil, nil))
+	p.RemoteIP = web.vpnIp
+	assert.Equal(t, ErrNoMatchingRule, fw.Drop(p, false, web, cp, nil, nil))
+
+	// Replies to an allowed inbound connection flow through conntrack
+	p = firewall.Packet{
+		LocalIP:    iputil.Ip2VpnIp(net.IPv4(1, 2, 3, 4)),
+		RemoteIP:   web.vpnIp,
+		LocalPort:  443,
+		RemotePort: 50000,
+		Protocol:   firewall.ProtoTCP,
+	}
+	assert.Equal(t, ErrNoMatchingRule, fw.Drop(p, false, web, cp, nil, nil))
+	assert.NoError(t, fw.Drop(p, true, web, cp, nil, nil))
+	assert.NoError(t, fw.Drop(p, false, web, cp, nil, nil))
+}
+
 func Test_parsePort(t *testing.T) {
 	_, _, err := parsePort("")
 	assert.EqualError(t, err, "was not a number; ``")
@@ -703,7 +867,7 @@ func TestNewFirewallFromConfig(t *testing.T) {
 	conf = config.NewC(l)
 	conf.Settings["firewall"] = map[interface{}]interface{}{"outbound": []interface{}{map[interface{}]interface{}{}}}
 	_, err = NewFirewallFromConfig(l, c, conf)
-	assert.EqualError(t, err, "firewall.outbound rule #0; at least one of host, group, cidr, local_cidr, ca_name, or ca_sha must be provided")
+	assert.EqualError(t, err, "firewall.outbound rule #0; at least one of host, group, group_expr, cidr, cidr_set, local_cidr, ca_name, or ca_sha must be provided")
 
 	// Test code/port error
 	conf = config.NewC(l)
@@ -828,6 +992,168 @@ func TestAddFirewallRulesFromConfig(t *testing.T) {
 	assert.EqualError(t, AddFirewallRulesFromConfig(l, true, conf, mf), "firewall.inbound rule #0; `test error`")
 }
 
+func TestAddFirewallRulesFromConfig_ports(t *testing.T) {
+	l := test.NewLogger()
+	ports := func(mf *mockFirewall) [][2]int32 {
+		var p [][2]int32
+		for _, c := range mf.calls {
+			p = append(p, [2]int32{c.startPort, c.endPort})
+		}
+		return p
+	}
+
+	// A list of ports and ranges is one rule per entry
+	conf := config.NewC(l)
+	mf := &mockFirewall{}
+	conf.Settings["firewall"] = map[interface{}]interface{}{"inbound": []interface{}{map[interface{}]interface{}{"port": []interface{}{80, 443, "8000-8100"}, "proto": "tcp", "host": "a"}}}
+	assert.Nil(t, AddFirewallRulesFromConfig(l, true, conf, mf))
+	assert.Equal(t, [][2]int32{{80, 80}, {443, 443}, {8000, 8100}}, ports(mf))
+
+	// Services expand where they are used, alongside plain ports
+	conf = config.NewC(l)
+	mf = &mockFirewall{}
+	conf.Settings["firewall"] = map[interface{}]interface{}{
+		"services": map[interface{}]interface{}{"web": []interface{}{80, 443}, "ssh": 22},
+		"inbound":  []interface{}{map[interface{}]interface{}{"ports": []interface{}{"web", "ssh", 9000}, "proto": "tcp", "group": "a"}},
+	}
+	assert.Nil(t, AddFirewallRulesFromConfig(l, true, conf, mf))
+	assert.Equal(t, [][2]int32{{80, 80}, {443, 443}, {22, 22}, {9000, 9000}}, ports(mf))
+	assert.Equal(t, []string{"a"}, mf.lastCall.groups)
+
+	conf.Settings["firewall"].(map[interface{}]interface{})["inbound"] = []interface{}{map[interface{}]interface{}{"port": "web", "proto": "tcp", "host": "a"}}
+	mf = &mockFirewall{}
+	assert.Nil(t, AddFirewallRulesFromConfig(l, true, conf, mf))
+	assert.Equal(t, [][2]int32{{80, 80}, {443, 443}}, ports(mf))
+
+	// Errors
+	conf.Settings["firewall"].(map[interface{}]interface{})["inbound"] = []interface{}{map[interface{}]interface{}{"port": []interface{}{80, "nope"}, "proto": "tcp", "host": "a"}}
+	assert.EqualError(t, AddFirewallRulesFromConfig(l, true, conf, &mockFirewall{}), "firewall.inbound rule #0; port was not a number; `nope`")
+
+	conf.Settings["firewall"].(map[interface{}]interface{})["inbound"] = []interface{}{map[interface{}]interface{}{"port": 80, "ports": 443, "proto": "tcp", "host": "a"}}
+	assert.EqualError(t, AddFirewallRulesFromConfig(l, true, conf, &mockFirewall{}), "firewall.inbound rule #0; only one of port or ports should be provided")
+
+	conf.Settings["firewall"].(map[interface{}]interface{})["services"] = map[interface{}]interface{}{"any": 80}
+	assert.EqualError(t, AddFirewallRulesFromConfig(l, true, conf, &mockFirewall{}), "firewall.services.any; name must not be a port")
+
+	conf.Settings["firewall"].(map[interface{}]interface{})["services"] = map[interface{}]interface{}{"web": []interface{}{"80-"}}
+	assert.EqualError(t, AddFirewallRulesFromConfig(l, true, conf, &mockFirewall{}), "firewall.services.web; port appears to be a range but could not be parsed; `80-`")
+
+	conf.Settings["firewall"].(map[interface{}]interface{})["services"] = map[interface{}]interface{}{"web": []interface{}{}}
+	assert.EqualError(t, AddFirewallRulesFromConfig(l, true, conf, &mockFirewall{}), "firewall.services.web; must have at least one port")
+}
+
+func TestAddFirewallRulesFromConfig_icmp(t *testing.T) {
+	l := test.NewLogger()
+	conf := config.NewC(l)
+	rule := func(r map[interface{}]interface{}) {
+		r["host"] = "a"
+		conf.Settings["firewall"] = map[interface{}]interface{}{"inbound": []interface{}{r}}
+	}
+
+	// A type without a code matches every code
+	mf := &mockFirewall{}
+	rule(map[interface{}]interface{}{"proto": "icmp", "icmp_type": []interface{}{"echo-request", 13}})
+	assert.Nil(t, AddFirewallRulesFromConfig(l, true, conf, mf))
+	require.Len(t, mf.calls, 2)
+	assert.Equal(t, firewall.ICMPPort(8, 0), mf.calls[0].startPort)
+	assert.Equal(t, firewall.ICMPPort(8, 255), mf.calls[0].endPort)
+	assert.Equal(t, firewall.ICMPPort(13, 0), mf.calls[1].startPort)
+
+	mf = &mockFirewall{}
+	rule(map[interface{}]interface{}{"proto": "icmp", "icmp_type": "destination-unreachable", "icmp_code": 4})
+	assert.Nil(t, AddFirewallRulesFromConfig(l, true, conf, mf))
+	assert.Equal(t, addRuleCall{incoming: true, proto: firewall.ProtoICMP, startPort: firewall.ICMPPort(3, 4), endPort: firewall.ICMPPort(3, 4), host: "a"}, mf.lastCall)
+
+	// icmpv6 has its own type names
+	mf = &mockFirewall{}
+	rule(map[interface{}]interface{}{"proto": "icmpv6", "icmp_type": []interface{}{"packet-too-big", "echo-request"}})
+	assert.Nil(t, AddFirewallRulesFromConfig(l, true, conf, mf))
+	require.Len(t, mf.calls, 2)
+	assert.Equal(t, uint8(firewall.ProtoICMPv6), mf.calls[0].proto)
+	assert.Equal(t, firewall.ICMPPort(2, 0), mf.calls[0].startPort)
+	assert.Equal(t, firewall.ICMPPort(128, 0), mf.calls[1].startPort)
+
+	// Errors
+	rule(map[interface{}]interface{}{"proto": "tcp", "icmp_type": "echo-request"})
+	assert.EqualError(t, AddFirewallRulesFromConfig(l, true, conf, &mockFirewall{}), "firewall.inbound rule #0; icmp_type and icmp_code require proto icmp or icmpv6")
+
+	rule(map[interface{}]interface{}{"proto": "icmp", "port": "any", "icmp_type": "echo-request"})
+	assert.EqualError(t, AddFirewallRulesFromConfig(l, true, conf, &mockFirewall{}), "firewall.inbound rule #0; only one of port or icmp_type should be provided")
+
+	rule(map[interface{}]interface{}{"proto": "icmp", "icmp_code": 4})
+	assert.EqualError(t, AddFirewallRulesFromConfig(l, true, conf, &mockFirewall{}), "firewall.inbound rule #0; icmp_code requires icmp_type")
+
+	rule(map[interface{}]interface{}{"proto": "icmp", "icmp_type": "ping"})
+	assert.EqualError(t, AddFirewallRulesFromConfig(l, true, conf, &mockFirewall{}), "firewall.inbound rule #0; icmp_type was not understood; `ping`")
+
+	rule(map[interface{}]interface{}{"proto": "icmp", "icmp_type": 3, "icmp_code": 256})
+	assert.EqualError(t, AddFirewallRulesFromConfig(l, true, conf, &mockFirewall{}), "firewall.inbound rule #0; icmp_code was not a number from 0 to 255; `256`")
+}
+
+func TestFirewall_DropICMP(t *testing.T) {
+	l := test.NewLogger()
+	ipNet := net.IPNet{IP: net.IPv4(1, 2, 3, 4), Mask: net.IPMask{255, 255, 255, 0}}
+	c := cert.NebulaCertificate{Details: cert.NebulaCertificateDetails{Name: "host1", Ips: []*net.IPNet{&ipNet}}}
+	h := HostInfo{ConnectionState: &ConnectionState{peerCert: &c}, vpnIp: iputil.Ip2VpnIp(ipNet.IP)}
+	h.CreateRemoteCIDR(&c)
+
+	// Allow path mtu discovery and pings out, but not pings in
+	conf := config.NewC(l)
+	conf.Settings["firewall"] = map[interface{}]interface{}{
+		"inbound": []interface{}{
+			map[interface{}]interface{}{"proto": "icmp", "icmp_type": "destination-unreachable", "icmp_code": 4, "host": "any"},
+		},
+		"outbound": []interface{}{
+			map[interface{}]interface{}{"proto": "icmp", "icmp_type": "echo-request", "host": "any"},
+		},
+	}
+	fw, err := NewFirewallFromConfig(l, &c, conf)
+	require.NoError(t, err)
+	cp := cert.NewCAPool()
+
+	p := firewall.Packet{
+		LocalIP:  iputil.Ip2VpnIp(net.IPv4(1, 2, 3, 4)),
+		RemoteIP: iputil.Ip2VpnIp(net.IPv4(1, 2, 3, 4)),
+		Protocol: firewall.ProtoICMP,
+		ICMPType: firewall.ICMPDestinationUnreachable,
+		ICMPCode: 4,
+	}
+	assert.NoError(t, fw.Drop(p, true, &h, cp, nil, nil))
+
+	p.ICMPCode = 3
+	assert.Equal(t, ErrNoMatchingRule, fw.Drop(p, true, &h, cp, nil, nil))
+
+	p.ICMPType, p.ICMPCode = firewall.ICMPEchoRequest, 0
+	assert.Equal(t, ErrNoMatchingRule, fw.Drop(p, true, &h, cp, nil, nil))
+
+	// The reply to a ping shares its conntrack entry
+	p.ICMPType = firewall.ICMPEchoReply
+	assert.Equal(t, ErrNoMatchingRule, fw.Drop(p, true, &h, cp, nil, nil))
+	p.ICMPType = firewall.ICMPEchoRequest
+	assert.NoError(t, fw.Drop(p, false, &h, cp, nil, nil))
+	p.ICMPType = firewall.ICMPEchoReply
+	assert.NoError(t, fw.Drop(p, true, &h, cp, nil, nil))
+
+	// Even after a reload, where the reply is checked as the ping
+	fw.rulesVersion++
+	assert.NoError(t, fw.Drop(p, true, &h, cp, nil, nil))
+
+	// Fragments have no type and only match port fragment
+	p.Fragment = true
+	p.ICMPType = 0
+	assert.Equal(t, ErrNoMatchingRule, fw.Drop(p, true, &h, cp, nil, nil))
+
+	// icmp rules do not match icmpv6, even where the type numbers line up
+	p = firewall.Packet{
+		LocalIP:  iputil.Ip2VpnIp(net.IPv4(1, 2, 3, 4)),
+		RemoteIP: iputil.Ip2VpnIp(net.IPv4(1, 2, 3, 4)),
+		Protocol: firewall.ProtoICMPv6,
+		ICMPType: firewall.ICMPDestinationUnreachable,
+		ICMPCode: 4,
+	}
+	assert.Equal(t, ErrNoMatchingRule, fw.Drop(p, true, &h, cp, nil, nil))
+}
+
 func TestFirewall_convertRule(t *testing.T) {
 	l := test.NewLogger()
 	ob := &bytes.Buffer{}
@@ -879,6 +1205,7 @@ type addRuleCall struct {
 
 type mockFirewall struct {
 	lastCall       addRuleCall
+	calls          []addRuleCall
 	nextCallReturn error
 }
 
@@ -895,6 +1222,7 @@ func (mf *mockFirewall) AddRule(incoming bool, proto uint8, startPort int32, end
 		caName:    caName,
 		caSha:     caSha,
 	}
+	mf.calls = append(mf.calls, mf.lastCall)
 
 	err := mf.nextCallReturn
 	mf.nextCallReturn = nil
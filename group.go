@@ -0,0 +1,232 @@
+package nebula
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"strconv"
+	"sync"
+	"syscall"
+
+	"github.com/sirupsen/logrus"
+	"github.com/slackhq/nebula/config"
+)
+
+// Group hosts several independent overlays in one process, for gateways that sit on more than one mesh. Each member
+// has its own config, certificate, tun device, udp listeners, firewall, ssh server and control api socket, and is
+// otherwise the same as running it with Main. The dns server is process wide so only one member may set
+// lighthouse.serve_dns. Metrics are registered with the process wide go-metrics registry which members share, a
+// counter counts for every member and a gauge holds the value of whichever member updated it last. The prometheus
+// series read from a member when scraped, like tunnels and the per peer series, are that member's own, each member
+// serves them on its own stats.listen.
+type Group struct {
+	l       *logrus.Logger
+	members []*groupMember
+}
+
+type groupMember struct {
+	name string
+	ctrl *Control
+	c    *config.C
+	// claims are the process wide resources this member needs exclusive use of, like a tun device or udp port
+	claims []groupClaim
+}
+
+type groupClaim struct {
+	kind string
+	host string
+	port string
+}
+
+func NewGroup(l *logrus.Logger) *Group {
+	return &Group{l: l}
+}
+
+// Add builds a new member from its config, it is not started until Start is called. Each member logs through its own
+// logger, which writes to the group logger's output with an instance field, so that members can have their own
+// logging config. c should have been created with the logger returned by MemberLogger.
+func (g *Group) Add(name string, c *config.C, configTest bool, buildVersion string) (*Control, error) {
+	if name == "" {
+		return nil, fmt.Errorf("group members must have a name")
+	}
+
+	claims := groupClaimsFromConfig(c)
+	for _, m := range g.members {
+		if m.name == name {
+			return nil, fmt.Errorf("group member %s already exists", name)
+		}
+
+		for _, mc := range m.claims {
+			for _, nc := range claims {
+				if mc.conflicts(nc) {
+					return nil, fmt.Errorf("group member %s %s conflicts with member %s", name, nc, m.name)
+				}
+			}
+		}
+	}
+
+	ctrl, err := Main(c, configTest, buildVersion, g.MemberLogger(name), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if ctrl != nil {
+		g.members = append(g.members, &groupMember{name: name, ctrl: ctrl, c: c, claims: claims})
+	}
+	return ctrl, nil
+}
+
+// MemberLogger returns a logger for the named member that tags everything it logs with the member name
+func (g *Group) MemberLogger(name string) *logrus.Logger {
+	l := logrus.New()
+	l.Out = g.l.Out
+	l.Formatter = g.l.Formatter
+	l.Level = g.l.Level
+	l.ReportCaller = g.l.ReportCaller
+	l.AddHook(instanceHook(name))
+	return l
+}
+
+// Control returns the control for the named member, or nil if there is no such member
+func (g *Group) Control(name string) *Control {
+	if m := g.member(name); m != nil {
+		return m.ctrl
+	}
+	return nil
+}
+
+func (g *Group) member(name string) *groupMember {
+	for _, m := range g.members {
+		if m.name == name {
+			return m
+		}
+	}
+	return nil
+}
+
+// Names returns the member names in the order they were added
+func (g *Group) Names() []string {
+	names := make([]string, len(g.members))
+	for i, m := range g.members {
+		names[i] = m.name
+	}
+	return names
+}
+
+// Start connects the bridges configured by members and starts every member, this is a nonblocking call. To block use
+// Group.ShutdownBlock()
+func (g *Group) Start() error {
+	if err := g.connectBridges(); err != nil {
+		return err
+	}
+
+	for _, m := range g.members {
+		m.ctrl.Start()
+	}
+	return nil
+}
+
+// Stop shuts down every member concurrently, returns after all of them are done
+func (g *Group) Stop() {
+	var wg sync.WaitGroup
+	for _, m := range g.members {
+		wg.Add(1)
+		go func(ctrl *Control) {
+			defer wg.Done()
+			ctrl.Stop()
+		}(m.ctrl)
+	}
+	wg.Wait()
+}
+
+// ShutdownBlock will listen for and block on term and interrupt signals, calling Group.Stop() once signalled
+func (g *Group) ShutdownBlock() {
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGTERM)
+	signal.Notify(sigChan, syscall.SIGINT)
+
+	rawSig := <-sigChan
+	sig := rawSig.String()
+	g.l.WithField("signal", sig).Info("Caught signal, shutting down")
+	g.Stop()
+}
+
+// groupClaimsFromConfig returns the resources a config will bind that can not be shared between members
+func groupClaimsFromConfig(c *config.C) []groupClaim {
+	var claims []groupClaim
+	if dev := c.GetString("tun.dev", ""); dev != "" && !c.GetBool("tun.disabled", false) {
+		claims = append(claims, groupClaim{kind: "tun.dev", host: dev})
+	}
+
+	if port := c.GetInt("listen.port", 0); port != 0 {
+		claims = append(claims, groupClaim{kind: "listen", host: c.GetString("listen.host", "0.0.0.0"), port: strconv.Itoa(port)})
+	}
+
+	if c.GetBool("sshd.enabled", false) {
+		if host, port, err := net.SplitHostPort(c.GetString("sshd.listen", "")); err == nil {
+			claims = append(claims, groupClaim{kind: "sshd.listen", host: host, port: port})
+		}
+	}
+
+	if c.GetString("stats.type", "") == "prometheus" {
+		if host, port, err := net.SplitHostPort(c.GetString("stats.listen", "")); err == nil {
+			claims = append(claims, groupClaim{kind: "stats.listen", host: host, port: port})
+		}
+	}
+
+	if listen := c.GetString("control_api.listen", ""); listen != "" {
+		claims = append(claims, groupClaim{kind: "control_api.listen", host: listen})
+	}
+
+	// The dns server and its records are process wide, only one member can serve dns whatever address it listens on
+	if c.GetBool("lighthouse.serve_dns", false) {
+		claims = append(claims, groupClaim{kind: "lighthouse.serve_dns"})
+	}
+
+	return claims
+}
+
+// conflicts reports if both claims can not be held at once. Listeners conflict if they share a port and either one
+// is bound to all addresses.
+func (a groupClaim) conflicts(b groupClaim) bool {
+	if a.port == "" || b.port == "" {
+		return a.kind == b.kind && a.host == b.host
+	}
+
+	if a.port != b.port {
+		return false
+	}
+
+	return a.host == b.host || isUnspecifiedHost(a.host) || isUnspecifiedHost(b.host)
+}
+
+func (a groupClaim) String() string {
+	if a.host == "" && a.port == "" {
+		return a.kind
+	}
+	if a.port == "" {
+		return a.kind + " " + a.host
+	}
+	return a.kind + " " + net.JoinHostPort(a.host, a.port)
+}
+
+func isUnspecifiedHost(host string) bool {
+	if host == "" || host == "[::]" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsUnspecified()
+}
+
+// instanceHook tags every log entry with the group member that produced it
+type instanceHook string
+
+func (h instanceHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+func (h instanceHook) Fire(e *logrus.Entry) error {
+	e.Data["instance"] = string(h)
+	return nil
+}
@@ -0,0 +1,91 @@
+package nebula
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGroupClaim_conflicts(t *testing.T) {
+	dev := groupClaim{kind: "tun.dev", host: "nebula1"}
+	assert.True(t, dev.conflicts(groupClaim{kind: "tun.dev", host: "nebula1"}))
+	assert.False(t, dev.conflicts(groupClaim{kind: "tun.dev", host: "nebula2"}))
+
+	listen := groupClaim{kind: "listen", host: "0.0.0.0", port: "4242"}
+	assert.True(t, listen.conflicts(groupClaim{kind: "listen", host: "10.0.0.1", port: "4242"}))
+	assert.True(t, listen.conflicts(groupClaim{kind: "sshd.listen", host: "127.0.0.1", port: "4242"}))
+	assert.False(t, listen.conflicts(groupClaim{kind: "listen", host: "0.0.0.0", port: "4243"}))
+
+	specific := groupClaim{kind: "listen", host: "10.0.0.1", port: "4242"}
+	assert.False(t, specific.conflicts(groupClaim{kind: "listen", host: "10.0.0.2", port: "4242"}))
+	assert.True(t, specific.conflicts(groupClaim{kind: "listen", host: "[::]", port: "4242"}))
+	assert.False(t, specific.conflicts(dev))
+}
+
+func TestGroup_Add(t *testing.T) {
+	l := test.NewLogger()
+	g := NewGroup(l)
+
+	c := config.NewC(l)
+	require.NoError(t, c.LoadString("tun:\n  dev: nebula1\nlisten:\n  port: 4242\nsshd:\n  enabled: true\n  listen: 127.0.0.1:2222\nstats:\n  type: prometheus\n  listen: 127.0.0.1:8080\n"))
+	assert.Equal(t, []groupClaim{
+		{kind: "tun.dev", host: "nebula1"},
+		{kind: "listen", host: "0.0.0.0", port: "4242"},
+		{kind: "sshd.listen", host: "127.0.0.1", port: "2222"},
+		{kind: "stats.listen", host: "127.0.0.1", port: "8080"},
+	}, groupClaimsFromConfig(c))
+
+	g.members = append(g.members, &groupMember{name: "a", claims: groupClaimsFromConfig(c)})
+
+	_, err := g.Add("", c, true, "")
+	assert.EqualError(t, err, "group members must have a name")
+
+	_, err = g.Add("a", c, true, "")
+	assert.EqualError(t, err, "group member a already exists")
+
+	_, err = g.Add("b", c, true, "")
+	assert.EqualError(t, err, "group member b tun.dev nebula1 conflicts with member a")
+
+	require.NoError(t, c.LoadString("tun:\n  dev: nebula2\nlisten:\n  host: 10.0.0.1\n  port: 4242\n"))
+	_, err = g.Add("b", c, true, "")
+	assert.EqualError(t, err, "group member b listen 10.0.0.1:4242 conflicts with member a")
+
+	require.NoError(t, c.LoadString("tun:\n  dev: nebula2\nstats:\n  type: prometheus\n  listen: :8080\n"))
+	_, err = g.Add("b", c, true, "")
+	assert.EqualError(t, err, "group member b stats.listen :8080 conflicts with member a")
+
+	require.NoError(t, c.LoadString("tun:\n  dev: nebula2\ncontrol_api:\n  listen: /run/nebula.sock\nlighthouse:\n  serve_dns: true\n  dns:\n    port: 5353\n"))
+	assert.Equal(t, []groupClaim{
+		{kind: "tun.dev", host: "nebula2"},
+		{kind: "control_api.listen", host: "/run/nebula.sock"},
+		{kind: "lighthouse.serve_dns"},
+	}, groupClaimsFromConfig(c))
+	g.members = append(g.members, &groupMember{name: "c", claims: groupClaimsFromConfig(c)})
+
+	require.NoError(t, c.LoadString("tun:\n  dev: nebula3\ncontrol_api:\n  listen: /run/nebula.sock\n"))
+	_, err = g.Add("b", c, true, "")
+	assert.EqualError(t, err, "group member b control_api.listen /run/nebula.sock conflicts with member c")
+
+	require.NoError(t, c.LoadString("tun:\n  dev: nebula3\nlighthouse:\n  serve_dns: true\n  dns:\n    port: 5354\n"))
+	_, err = g.Add("b", c, true, "")
+	assert.EqualError(t, err, "group member b lighthouse.serve_dns conflicts with member c")
+
+	assert.Equal(t, []string{"a", "c"}, g.Names())
+	assert.Nil(t, g.Control("b"))
+}
+
+func TestGroup_MemberLogger(t *testing.T) {
+	ob := &bytes.Buffer{}
+	l := logrus.New()
+	l.Out = ob
+	l.Formatter = &logrus.JSONFormatter{DisableTimestamp: true}
+
+	g := NewGroup(l)
+	g.MemberLogger("east").WithField("vpnIp", "10.0.0.1").Info("hello")
+	assert.JSONEq(t, `{"instance":"east","level":"info","msg":"hello","vpnIp":"10.0.0.1"}`, ob.String())
+}
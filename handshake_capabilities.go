@@ -0,0 +1,108 @@
+package nebula
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"sort"
+)
+
+// capabilityTranscriptBinding is advertised by every node that verifies CapabilitiesDigest
+const capabilityTranscriptBinding = "transcript_binding"
+
+var ErrCapabilitiesDowngrade = errors.New("handshake capabilities digest did not match what was advertised")
+
+// capabilitySet is a sorted, de-duplicated list of optional features a node supports.
+// The set each side advertises during a handshake is bound into the transcript so that an attacker on the underlay
+// can not strip features to force a downgrade.
+//
+// The initiators set travels in the clear in the first message but is mixed into the noise handshake hash, the
+// responders set is encrypted in the second message. The responder also echoes a digest over both sets which the
+// initiator checks against what it actually sent, making the binding explicit instead of relying solely on noise.
+type capabilitySet []string
+
+func newCapabilitySet(caps ...string) capabilitySet {
+	if len(caps) == 0 {
+		return nil
+	}
+
+	seen := make(map[string]struct{}, len(caps))
+	s := make(capabilitySet, 0, len(caps))
+	for _, c := range caps {
+		if c == "" {
+			continue
+		}
+		if _, ok := seen[c]; ok {
+			continue
+		}
+		seen[c] = struct{}{}
+		s = append(s, c)
+	}
+
+	sort.Strings(s)
+	return s
+}
+
+// defaultHandshakeCapabilities returns the capabilities this build of nebula advertises
+func defaultHandshakeCapabilities() capabilitySet {
+	return newCapabilitySet(capabilityTranscriptBinding, capabilityDiagProbe)
+}
+
+func (s capabilitySet) Has(c string) bool {
+	i := sort.SearchStrings(s, c)
+	return i < len(s) && s[i] == c
+}
+
+// Intersect returns the capabilities present in both sets, this is what a tunnel may use
+func (s capabilitySet) Intersect(o capabilitySet) capabilitySet {
+	var r capabilitySet
+	for _, c := range s {
+		if o.Has(c) {
+			r = append(r, c)
+		}
+	}
+	return r
+}
+
+// capabilitiesDigest returns the digest the responder echoes back to the initiator
+func capabilitiesDigest(initiator, responder capabilitySet) []byte {
+	h := sha256.New()
+	h.Write([]byte("nebula capabilities v1"))
+
+	var l [4]byte
+	for _, set := range []capabilitySet{initiator, responder} {
+		binary.BigEndian.PutUint32(l[:], uint32(len(set)))
+		h.Write(l[:])
+		for _, c := range set {
+			binary.BigEndian.PutUint32(l[:], uint32(len(c)))
+			h.Write(l[:])
+			h.Write([]byte(c))
+		}
+	}
+
+	return h.Sum(nil)
+}
+
+// verifyCapabilities is called by the initiator once the responders handshake message is decrypted. It returns the
+// negotiated capabilities or an error if the responder saw something different from what we sent.
+func verifyCapabilities(sent capabilitySet, details *NebulaHandshakeDetails) (capabilitySet, error) {
+	responder := newCapabilitySet(details.Capabilities...)
+
+	if len(details.CapabilitiesDigest) == 0 {
+		if responder.Has(capabilityTranscriptBinding) {
+			// The responder claims to bind the transcript but did not, something stripped it
+			return nil, ErrCapabilitiesDowngrade
+		}
+
+		// An older responder, we can't negotiate anything with it
+		return nil, nil
+	}
+
+	expected := capabilitiesDigest(sent, responder)
+	if subtle.ConstantTimeCompare(expected, details.CapabilitiesDigest) != 1 {
+		return nil, ErrCapabilitiesDowngrade
+	}
+
+	return sent.Intersect(responder), nil
+}
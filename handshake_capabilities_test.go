@@ -0,0 +1,126 @@
+package nebula
+
+import (
+	"crypto/rand"
+	"testing"
+
+	"github.com/flynn/noise"
+	"github.com/slackhq/nebula/cert"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/curve25519"
+)
+
+func newTestHandshakeCertState(t *testing.T) *CertState {
+	priv := make([]byte, 32)
+	_, err := rand.Read(priv)
+	require.NoError(t, err)
+	pub, err := curve25519.X25519(priv, curve25519.Basepoint)
+	require.NoError(t, err)
+
+	return &CertState{
+		Certificate: &cert.NebulaCertificate{},
+		PrivateKey:  priv,
+		PublicKey:   pub,
+	}
+}
+
+func TestCapabilitySet(t *testing.T) {
+	s := newCapabilitySet("b", "a", "", "b", "c")
+	assert.Equal(t, capabilitySet{"a", "b", "c"}, s)
+	assert.True(t, s.Has("a"))
+	assert.False(t, s.Has("d"))
+	assert.Equal(t, capabilitySet{"b", "c"}, s.Intersect(newCapabilitySet("c", "b", "z")))
+	assert.Nil(t, s.Intersect(nil))
+	assert.Nil(t, newCapabilitySet())
+}
+
+func TestVerifyCapabilities(t *testing.T) {
+	sent := newCapabilitySet(capabilityTranscriptBinding, "a", "b")
+	responder := newCapabilitySet(capabilityTranscriptBinding, "b")
+
+	// Happy path, we get the intersection
+	caps, err := verifyCapabilities(sent, &NebulaHandshakeDetails{
+		Capabilities:       responder,
+		CapabilitiesDigest: capabilitiesDigest(sent, responder),
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, capabilitySet{"b", capabilityTranscriptBinding}, caps)
+
+	// The responder saw a stripped version of what we sent
+	_, err = verifyCapabilities(sent, &NebulaHandshakeDetails{
+		Capabilities:       responder,
+		CapabilitiesDigest: capabilitiesDigest(newCapabilitySet(capabilityTranscriptBinding), responder),
+	})
+	assert.ErrorIs(t, err, ErrCapabilitiesDowngrade)
+
+	// The responder claims to support binding but sent no digest
+	_, err = verifyCapabilities(sent, &NebulaHandshakeDetails{Capabilities: responder})
+	assert.ErrorIs(t, err, ErrCapabilitiesDowngrade)
+
+	// An older responder knows nothing of capabilities
+	caps, err = verifyCapabilities(sent, &NebulaHandshakeDetails{})
+	assert.NoError(t, err)
+	assert.Nil(t, caps)
+}
+
+func TestCapabilities_TamperingFailsHandshake(t *testing.T) {
+	l := test.NewLogger()
+	sent := newCapabilitySet(capabilityTranscriptBinding, "multipath")
+
+	doHandshake := func(tamper func(msg []byte) []byte) error {
+		ic := NewConnectionState(l, "aes", newTestHandshakeCertState(t), true, noise.HandshakeIX, []byte{}, 0)
+		rc := NewConnectionState(l, "aes", newTestHandshakeCertState(t), false, noise.HandshakeIX, []byte{}, 0)
+
+		b, err := (&NebulaHandshake{Details: &NebulaHandshakeDetails{Capabilities: sent}}).Marshal()
+		require.NoError(t, err)
+		msg, _, _, err := ic.H.WriteMessage(nil, b)
+		require.NoError(t, err)
+
+		msg = tamper(msg)
+
+		// The first message is not encrypted so the responder happily reads whatever arrived
+		b, _, _, err = rc.H.ReadMessage(nil, msg)
+		require.NoError(t, err)
+		hs := &NebulaHandshake{}
+		require.NoError(t, hs.Unmarshal(b))
+
+		seen := newCapabilitySet(hs.Details.Capabilities...)
+		local := newCapabilitySet(capabilityTranscriptBinding, "multipath")
+		b, err = (&NebulaHandshake{Details: &NebulaHandshakeDetails{
+			Capabilities:       local,
+			CapabilitiesDigest: capabilitiesDigest(seen, local),
+		}}).Marshal()
+		require.NoError(t, err)
+		msg, _, _, err = rc.H.WriteMessage(nil, b)
+		require.NoError(t, err)
+
+		b, _, _, err = ic.H.ReadMessage(nil, msg)
+		if err != nil {
+			return err
+		}
+
+		hs = &NebulaHandshake{}
+		require.NoError(t, hs.Unmarshal(b))
+		caps, err := verifyCapabilities(sent, hs.Details)
+		if err == nil {
+			assert.Equal(t, sent, caps)
+		}
+		return err
+	}
+
+	// Untouched handshakes succeed
+	assert.NoError(t, doHandshake(func(msg []byte) []byte { return msg }))
+
+	// Stripping a capability from the first message breaks the handshake for the initiator
+	assert.Error(t, doHandshake(func(msg []byte) []byte {
+		stripped, err := (&NebulaHandshake{Details: &NebulaHandshakeDetails{
+			Capabilities: newCapabilitySet(capabilityTranscriptBinding),
+		}}).Marshal()
+		require.NoError(t, err)
+
+		// IX message 1 is the ephemeral and static keys followed by the plaintext payload
+		return append(append([]byte{}, msg[:64]...), stripped...)
+	}))
+}
@@ -0,0 +1,229 @@
+package nebula
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/flynn/noise"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/noiseutil"
+	"golang.org/x/crypto/hkdf"
+)
+
+var (
+	ErrNoCommonCipher     = errors.New("no cipher in common with the peer")
+	ErrCipherNotOffered   = errors.New("the responder chose a cipher we did not offer")
+	ErrUnsupportedCipher  = errors.New("the initiator used a handshake cipher we do not support")
+	errCipherPskMissing   = errors.New("cipher_psk must be set to use a _psk cipher")
+	errCipherPskWrongSize = errors.New("cipher_psk must be 32 bytes of base64")
+)
+
+// tunnelCipher is a cipher a tunnel can protect its packets with. Every tunnel cipher can be negotiated per tunnel,
+// those without a psk can also be used for the noise handshake itself.
+type tunnelCipher struct {
+	noise noise.CipherFunc
+	// endianness is how the message counter is written into the nonce, it matches what noise does for the cipher
+	endianness endianness
+	// psk ciphers mix cipher_psk into the tunnel keys so that both the handshake and the pre-shared key would have
+	// to be broken to read the tunnel
+	psk bool
+	// multiBuffer ciphers can have a send batch seal their packets together, see sealQueue
+	multiBuffer bool
+}
+
+var tunnelCiphers = map[string]tunnelCipher{
+	"aes":            {noise: noiseutil.CipherAESGCM, endianness: binary.BigEndian, multiBuffer: true},
+	"chachapoly":     {noise: noise.CipherChaChaPoly, endianness: binary.LittleEndian},
+	"chachapoly_psk": {noise: noise.CipherChaChaPoly, endianness: binary.LittleEndian, psk: true},
+}
+
+// cipherConfig is how this node handshakes and which tunnel ciphers it will agree to.
+//
+// The initiator runs the noise handshake with its own handshake cipher and names it in the first message so the
+// responder can follow along. It also offers its tunnel ciphers in order of preference, the responder picks the first
+// one it allows and names it in the encrypted second message. The offer is mixed into the noise handshake hash so an
+// attacker that rewrites it breaks the handshake instead of forcing a weaker choice.
+//
+// Peers that do not negotiate use the handshake cipher for the tunnel, as every node did before negotiation existed.
+type cipherConfig struct {
+	handshake string
+	ciphers   []string
+	psk       []byte
+	// pskId lets peers tell if they share a psk without revealing it
+	pskId []byte
+	// kem is set when we offer and accept a hybrid key exchange, see handshake_kem.go
+	kem bool
+}
+
+func newCipherConfigFromConfig(c *config.C) (*cipherConfig, error) {
+	cc := &cipherConfig{handshake: c.GetString("cipher", "aes")}
+	if tc, ok := tunnelCiphers[cc.handshake]; !ok || tc.psk {
+		return nil, fmt.Errorf("unknown cipher: %v", cc.handshake)
+	}
+
+	cc.ciphers = c.GetStringSlice("ciphers", []string{cc.handshake})
+	if len(cc.ciphers) == 0 {
+		return nil, errors.New("ciphers must list at least one cipher")
+	}
+
+	needPsk := false
+	for _, name := range cc.ciphers {
+		tc, ok := tunnelCiphers[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown cipher in ciphers: %v", name)
+		}
+		needPsk = needPsk || tc.psk
+	}
+
+	psk := c.GetString("cipher_psk", "")
+	if psk != "" {
+		b, err := base64.StdEncoding.DecodeString(psk)
+		if err != nil || len(b) != 32 {
+			return nil, errCipherPskWrongSize
+		}
+		cc.psk = b
+		id := sha256.Sum256(append([]byte("nebula cipher psk id"), b...))
+		cc.pskId = id[:8]
+	} else if needPsk {
+		return nil, errCipherPskMissing
+	}
+
+	cc.kem = c.GetBool("handshakes.hybrid_kem", false)
+	if cc.kem && !kemSupported {
+		return nil, errKemUnsupported
+	}
+
+	return cc, nil
+}
+
+// allows reports if we will use the named tunnel cipher with a peer that has a psk identified by pskId
+func (cc *cipherConfig) allows(name string, pskId []byte) bool {
+	tc, ok := tunnelCiphers[name]
+	if !ok || (tc.psk && !bytes.Equal(pskId, cc.pskId)) {
+		return false
+	}
+
+	for _, c := range cc.ciphers {
+		if c == name {
+			return true
+		}
+	}
+	return false
+}
+
+// offer fills in the cipher fields of the first handshake message
+func (cc *cipherConfig) offer(d *NebulaHandshakeDetails) {
+	d.HandshakeCipher = cc.handshake
+	d.Ciphers = cc.ciphers
+	d.CipherPskId = cc.pskId
+}
+
+// handshakeCipher returns the noise cipher the initiator used, older initiators are expected to use ours
+func (cc *cipherConfig) handshakeCipher(d *NebulaHandshakeDetails) (string, error) {
+	if d.HandshakeCipher == "" {
+		return cc.handshake, nil
+	}
+
+	if tc, ok := tunnelCiphers[d.HandshakeCipher]; !ok || tc.psk {
+		return "", ErrUnsupportedCipher
+	}
+	return d.HandshakeCipher, nil
+}
+
+// readCiphers lists the noise ciphers to try on the first handshake message, ours first. The message is only
+// encrypted when the handshake mixes in a pre-shared key, otherwise any cipher reads it and handshakeCipher tells us
+// which one the initiator used.
+func (cc *cipherConfig) readCiphers(encrypted bool) []string {
+	names := []string{cc.handshake}
+	if !encrypted {
+		return names
+	}
+
+	for _, name := range []string{"aes", "chachapoly"} {
+		if name != cc.handshake {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// choose picks the tunnel cipher when responding to a handshake, the first cipher offered that we allow. An initiator
+// that made no offer gets the handshake cipher.
+func (cc *cipherConfig) choose(handshake string, d *NebulaHandshakeDetails) (string, error) {
+	if len(d.Ciphers) == 0 {
+		if cc.allows(handshake, nil) {
+			return handshake, nil
+		}
+		return "", ErrNoCommonCipher
+	}
+
+	for _, name := range d.Ciphers {
+		if cc.allows(name, d.CipherPskId) {
+			return name, nil
+		}
+	}
+	return "", ErrNoCommonCipher
+}
+
+// answer fills in the cipher fields of the second handshake message
+func (cc *cipherConfig) answer(d *NebulaHandshakeDetails, chosen string) {
+	d.HandshakeCipher = ""
+	d.Ciphers = nil
+	d.Cipher = chosen
+	d.CipherPskId = nil
+	if tunnelCiphers[chosen].psk {
+		d.CipherPskId = cc.pskId
+	}
+}
+
+// accept checks the tunnel cipher the responder chose, an older responder uses the handshake cipher
+func (cc *cipherConfig) accept(d *NebulaHandshakeDetails) (string, error) {
+	if d.Cipher == "" {
+		if cc.allows(cc.handshake, nil) {
+			return cc.handshake, nil
+		}
+		return "", ErrNoCommonCipher
+	}
+
+	if !cc.allows(d.Cipher, d.CipherPskId) {
+		return "", ErrCipherNotOffered
+	}
+	return d.Cipher, nil
+}
+
+// tunnelKeys returns the packet ciphers for a tunnel given the keys the noise handshake arrived at. When the tunnel
+// uses the handshake cipher and there was no hybrid key exchange the noise keys are used as is, which keeps us
+// compatible with peers that do not negotiate. Otherwise each key is expanded into a key for the tunnel cipher, mixing
+// in the psk if it has one and the kem secret if there is one.
+func (cc *cipherConfig) tunnelKeys(handshake, name string, kemSecret []byte, eKey, dKey *noise.CipherState) (*NebulaCipherState, *NebulaCipherState) {
+	tc := tunnelCiphers[name]
+	if name == handshake && kemSecret == nil {
+		return newNebulaCipherStateFromKey(tc, eKey.UnsafeKey()), newNebulaCipherStateFromKey(tc, dKey.UnsafeKey())
+	}
+
+	var salt []byte
+	if tc.psk {
+		salt = append(salt, cc.psk...)
+	}
+	salt = append(salt, kemSecret...)
+
+	info := "nebula tunnel key " + name
+	if kemSecret != nil {
+		info += " " + hybridKemName
+	}
+
+	derive := func(s *noise.CipherState) *NebulaCipherState {
+		k := s.UnsafeKey()
+		var out [32]byte
+		// hkdf can not fail to produce 32 bytes from sha256
+		_, _ = io.ReadFull(hkdf.New(sha256.New, k[:], salt, []byte(info)), out[:])
+		return newNebulaCipherStateFromKey(tc, out)
+	}
+
+	return derive(eKey), derive(dKey)
+}
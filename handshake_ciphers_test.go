@@ -0,0 +1,167 @@
+package nebula
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"encoding/base64"
+	"testing"
+
+	"github.com/flynn/noise"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestCipherConfig(t *testing.T, settings map[interface{}]interface{}) *cipherConfig {
+	c := config.NewC(test.NewLogger())
+	for k, v := range settings {
+		c.Settings[k] = v
+	}
+	cc, err := newCipherConfigFromConfig(c)
+	require.NoError(t, err)
+	return cc
+}
+
+func TestNewCipherConfigFromConfig(t *testing.T) {
+	l := test.NewLogger()
+	psk := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, 32))
+
+	cc := newTestCipherConfig(t, nil)
+	assert.Equal(t, "aes", cc.handshake)
+	assert.Equal(t, []string{"aes"}, cc.ciphers)
+	assert.Nil(t, cc.pskId)
+
+	cc = newTestCipherConfig(t, map[interface{}]interface{}{
+		"cipher":     "chachapoly",
+		"ciphers":    []interface{}{"chachapoly_psk", "aes"},
+		"cipher_psk": psk,
+	})
+	assert.Equal(t, "chachapoly", cc.handshake)
+	assert.Equal(t, []string{"chachapoly_psk", "aes"}, cc.ciphers)
+	assert.Len(t, cc.pskId, 8)
+
+	tests := map[string]map[interface{}]interface{}{
+		"unknown cipher: des":                         {"cipher": "des"},
+		"unknown cipher: chachapoly_psk":              {"cipher": "chachapoly_psk", "cipher_psk": psk},
+		"unknown cipher in ciphers: des":              {"ciphers": []interface{}{"aes", "des"}},
+		"ciphers must list at least one cipher":       {"ciphers": []interface{}{}},
+		"cipher_psk must be set to use a _psk cipher": {"ciphers": []interface{}{"chachapoly_psk"}},
+		"cipher_psk must be 32 bytes of base64":       {"cipher_psk": "c2hvcnQ="},
+	}
+	for expected, settings := range tests {
+		c := config.NewC(l)
+		c.Settings = settings
+		_, err := newCipherConfigFromConfig(c)
+		assert.EqualError(t, err, expected)
+	}
+}
+
+func TestCipherConfig_negotiate(t *testing.T) {
+	psk := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, 32))
+	otherPsk := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{2}, 32))
+
+	initiator := newTestCipherConfig(t, map[interface{}]interface{}{
+		"cipher":     "chachapoly",
+		"ciphers":    []interface{}{"chachapoly_psk", "aes"},
+		"cipher_psk": psk,
+	})
+	d := &NebulaHandshakeDetails{}
+	initiator.offer(d)
+
+	// The responder follows the initiators handshake cipher and picks the first cipher offered that it allows
+	responder := newTestCipherConfig(t, map[interface{}]interface{}{
+		"ciphers":    []interface{}{"aes", "chachapoly_psk"},
+		"cipher_psk": psk,
+	})
+	hc, err := responder.handshakeCipher(d)
+	require.NoError(t, err)
+	assert.Equal(t, "chachapoly", hc)
+	chosen, err := responder.choose(hc, d)
+	require.NoError(t, err)
+	assert.Equal(t, "chachapoly_psk", chosen)
+
+	reply := &NebulaHandshakeDetails{}
+	responder.answer(reply, chosen)
+	accepted, err := initiator.accept(reply)
+	require.NoError(t, err)
+	assert.Equal(t, "chachapoly_psk", accepted)
+
+	// A responder with a different psk can not use a psk cipher
+	responder = newTestCipherConfig(t, map[interface{}]interface{}{
+		"ciphers":    []interface{}{"chachapoly_psk", "aes"},
+		"cipher_psk": otherPsk,
+	})
+	chosen, err = responder.choose(hc, d)
+	require.NoError(t, err)
+	assert.Equal(t, "aes", chosen)
+
+	// Nothing in common
+	responder = newTestCipherConfig(t, map[interface{}]interface{}{"ciphers": []interface{}{"chachapoly"}})
+	_, err = responder.choose(hc, d)
+	assert.ErrorIs(t, err, ErrNoCommonCipher)
+
+	// The responder may not pick something we did not offer
+	_, err = initiator.accept(&NebulaHandshakeDetails{Cipher: "chachapoly"})
+	assert.ErrorIs(t, err, ErrCipherNotOffered)
+
+	// Older peers use the handshake cipher, if we allow it
+	responder = newTestCipherConfig(t, nil)
+	hc, err = responder.handshakeCipher(&NebulaHandshakeDetails{})
+	require.NoError(t, err)
+	chosen, err = responder.choose(hc, &NebulaHandshakeDetails{})
+	require.NoError(t, err)
+	assert.Equal(t, "aes", chosen)
+	_, err = initiator.accept(&NebulaHandshakeDetails{})
+	assert.ErrorIs(t, err, ErrNoCommonCipher)
+
+	_, err = responder.handshakeCipher(&NebulaHandshakeDetails{HandshakeCipher: "chachapoly_psk"})
+	assert.ErrorIs(t, err, ErrUnsupportedCipher)
+}
+
+func TestCipherConfig_tunnelKeys(t *testing.T) {
+	l := test.NewLogger()
+	psk := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, 32))
+	cc := newTestCipherConfig(t, map[interface{}]interface{}{
+		"cipher":     "chachapoly",
+		"ciphers":    []interface{}{"chachapoly_psk", "aes", "chachapoly"},
+		"cipher_psk": psk,
+	})
+
+	ic := NewConnectionState(l, "chachapoly", newTestHandshakeCertState(t), true, noise.HandshakeIX, []byte{}, 0)
+	rc := NewConnectionState(l, "chachapoly", newTestHandshakeCertState(t), false, noise.HandshakeIX, []byte{}, 0)
+	msg, _, _, err := ic.H.WriteMessage(nil, nil)
+	require.NoError(t, err)
+	_, _, _, err = rc.H.ReadMessage(nil, msg)
+	require.NoError(t, err)
+	msg, rd, re, err := rc.H.WriteMessage(nil, nil)
+	require.NoError(t, err)
+	_, ie, id, err := ic.H.ReadMessage(nil, msg)
+	require.NoError(t, err)
+
+	nb := make([]byte, 12)
+	for _, name := range cc.ciphers {
+		eKey, _ := cc.tunnelKeys("chachapoly", name, nil, ie, id)
+		_, dKey := cc.tunnelKeys("chachapoly", name, nil, re, rd)
+
+		out, err := eKey.EncryptDanger(nil, []byte("ad"), []byte("hello"), 5, nb)
+		require.NoError(t, err)
+		b, err := dKey.DecryptDanger(nil, []byte("ad"), out, 5, nb)
+		require.NoError(t, err, name)
+		assert.Equal(t, []byte("hello"), b)
+
+		// The handshake cipher uses the noise keys as is, anything else gets keys of its own
+		ref := ie.Cipher().(cipher.AEAD).Seal(nil, nb, []byte("hello"), []byte("ad"))
+		assert.Equal(t, name == "chachapoly", bytes.Equal(ref, out), name)
+	}
+
+	// A hybrid kem secret gives even the handshake cipher keys of its own
+	secret := bytes.Repeat([]byte{3}, 32)
+	eKey, _ := cc.tunnelKeys("chachapoly", "chachapoly", secret, ie, id)
+	_, dKey := cc.tunnelKeys("chachapoly", "chachapoly", secret, re, rd)
+	out, err := eKey.EncryptDanger(nil, nil, []byte("hello"), 6, nb)
+	require.NoError(t, err)
+	_, err = dKey.DecryptDanger(nil, nil, out, 6, nb)
+	require.NoError(t, err)
+	assert.NotEqual(t, ie.Cipher().(cipher.AEAD).Seal(nil, nb, []byte("hello"), nil), out)
+}
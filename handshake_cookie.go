@@ -0,0 +1,218 @@
+package nebula
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/header"
+	"github.com/slackhq/nebula/udp"
+	"golang.org/x/time/rate"
+)
+
+const (
+	// cookieSecretLifetime is how long a cookie secret is used, cookies made with the previous secret are still accepted
+	cookieSecretLifetime = 2 * time.Minute
+	cookieReplyLen       = header.Len + 8
+
+	// handshakeGuardMaxHosts is how many source ips get a bucket of their own, see handshakeGuard.allow
+	handshakeGuardMaxHosts = 1 << 16
+)
+
+// handshakeGuard protects the responder from floods of first handshake messages, each of which would otherwise cost a
+// certificate signature verification and a round of diffie-hellman.
+//
+// Every source ip gets a token bucket, first messages over the limit are dropped before any crypto is done. A flood
+// from spoofed addresses would grow the buckets without bound, past handshakeGuardMaxHosts new addresses share a single
+// bucket until pruning makes room.
+//
+// When more first messages arrive in a second than cookieThreshold the responder stops answering those without a valid
+// cookie, it sends a cookie reply instead. The cookie is a mac over the source address with a secret only we know, the
+// initiator starts the handshake over with the cookie in the first message to prove it can receive packets at the
+// address it claims. Nothing is stored for an initiator until it does.
+type handshakeGuard struct {
+	perIp           rate.Limit
+	burst           int
+	cookieThreshold int
+
+	sync.Mutex
+	hosts     map[string]*rate.Limiter
+	maxHosts  int
+	overflow  *rate.Limiter
+	lastPrune time.Time
+
+	// window counts first messages in the second that started at windowStart
+	window      int
+	windowStart time.Time
+
+	secret, prevSecret [32]byte
+	secretTime         time.Time
+
+	metricRateLimited    metrics.Counter
+	metricCookieRequired metrics.Counter
+	metricCookieInvalid  metrics.Counter
+}
+
+// newHandshakeGuardFromConfig returns nil if neither handshakes.rate_limit nor handshakes.cookie_threshold is set
+func newHandshakeGuardFromConfig(c *config.C) (*handshakeGuard, error) {
+	perIp := c.GetInt("handshakes.rate_limit.per_ip", 0)
+	if perIp < 0 {
+		return nil, fmt.Errorf("handshakes.rate_limit.per_ip must not be negative")
+	}
+
+	burst := c.GetInt("handshakes.rate_limit.burst", perIp*2)
+	if burst < 0 || (perIp > 0 && burst == 0) {
+		return nil, fmt.Errorf("handshakes.rate_limit.burst must be positive")
+	}
+
+	threshold := c.GetInt("handshakes.cookie_threshold", 0)
+	if threshold < 0 {
+		return nil, fmt.Errorf("handshakes.cookie_threshold must not be negative")
+	}
+
+	if perIp == 0 && threshold == 0 {
+		return nil, nil
+	}
+
+	return newHandshakeGuard(perIp, burst, threshold), nil
+}
+
+func newHandshakeGuard(perIp, burst, cookieThreshold int) *handshakeGuard {
+	g := &handshakeGuard{
+		perIp:                rate.Limit(perIp),
+		burst:                burst,
+		cookieThreshold:      cookieThreshold,
+		hosts:                make(map[string]*rate.Limiter),
+		maxHosts:             handshakeGuardMaxHosts,
+		overflow:             rate.NewLimiter(rate.Limit(perIp), burst),
+		metricRateLimited:    metrics.GetOrRegisterCounter("handshakes.rejected.rate_limit", nil),
+		metricCookieRequired: metrics.GetOrRegisterCounter("handshakes.rejected.cookie_required", nil),
+		metricCookieInvalid:  metrics.GetOrRegisterCounter("handshakes.rejected.cookie_invalid", nil),
+	}
+
+	// Both secrets start out random so no cookie can be predicted before the first rotation
+	_, _ = rand.Read(g.secret[:])
+	_, _ = rand.Read(g.prevSecret[:])
+	g.secretTime = time.Now()
+	return g
+}
+
+// allow is called for every first handshake message that arrived directly from addr, it reports false if addr is over
+// its rate limit
+func (g *handshakeGuard) allow(addr *udp.Addr, now time.Time) bool {
+	if g == nil || g.perIp == 0 {
+		return true
+	}
+
+	g.Lock()
+	defer g.Unlock()
+
+	key := string(addr.IP.To16())
+	l, ok := g.hosts[key]
+	if !ok {
+		full := len(g.hosts) >= g.maxHosts
+		if now.Sub(g.lastPrune) >= time.Minute || (full && now.Sub(g.lastPrune) >= time.Second) {
+			g.prune(now)
+			full = len(g.hosts) >= g.maxHosts
+		}
+
+		if full {
+			l = g.overflow
+		} else {
+			l = rate.NewLimiter(g.perIp, g.burst)
+			g.hosts[key] = l
+		}
+	}
+
+	if !l.AllowN(now, 1) {
+		g.metricRateLimited.Inc(1)
+		return false
+	}
+	return true
+}
+
+// prune removes buckets that have filled back up, the caller must hold the lock
+func (g *handshakeGuard) prune(now time.Time) {
+	g.lastPrune = now
+	for k, l := range g.hosts {
+		if l.TokensAt(now) >= float64(g.burst) {
+			delete(g.hosts, k)
+		}
+	}
+}
+
+// checkCookie counts a first handshake message towards the load and reports if it may continue. When false is
+// returned the caller should send a cookie reply built by cookieReply.
+func (g *handshakeGuard) checkCookie(addr *udp.Addr, cookie uint64, now time.Time) bool {
+	if g == nil || g.cookieThreshold == 0 {
+		return true
+	}
+
+	g.Lock()
+	defer g.Unlock()
+
+	if now.Sub(g.windowStart) >= time.Second {
+		g.windowStart = now
+		g.window = 0
+	}
+	g.window++
+
+	if g.window <= g.cookieThreshold {
+		return true
+	}
+
+	g.rotate(now)
+	if cookie == 0 {
+		g.metricCookieRequired.Inc(1)
+		return false
+	}
+
+	if cookie == makeCookie(&g.secret, addr) || cookie == makeCookie(&g.prevSecret, addr) {
+		return true
+	}
+
+	g.metricCookieInvalid.Inc(1)
+	return false
+}
+
+// cookieReply builds the reply that tells the initiator at addr which cookie to use
+func (g *handshakeGuard) cookieReply(addr *udp.Addr, initiatorIndex uint32, now time.Time) []byte {
+	g.Lock()
+	g.rotate(now)
+	cookie := makeCookie(&g.secret, addr)
+	g.Unlock()
+
+	b := header.Encode(make([]byte, cookieReplyLen), header.Version, header.Handshake, header.HandshakeCookieReply, initiatorIndex, 0)
+	b = b[:cookieReplyLen]
+	binary.BigEndian.PutUint64(b[header.Len:], cookie)
+	return b
+}
+
+// rotate replaces the secret once it has been used for cookieSecretLifetime, the caller must hold the lock
+func (g *handshakeGuard) rotate(now time.Time) {
+	if now.Sub(g.secretTime) < cookieSecretLifetime {
+		return
+	}
+
+	g.prevSecret = g.secret
+	// crypto/rand does not fail on the platforms we support
+	_, _ = rand.Read(g.secret[:])
+	g.secretTime = now
+}
+
+func makeCookie(secret *[32]byte, addr *udp.Addr) uint64 {
+	mac := hmac.New(sha256.New, secret[:])
+	mac.Write(addr.IP.To16())
+	var port [2]byte
+	binary.BigEndian.PutUint16(port[:], addr.Port)
+	mac.Write(port[:])
+
+	// Zero means no cookie
+	return binary.BigEndian.Uint64(mac.Sum(nil)) | 1
+}
@@ -0,0 +1,137 @@
+package nebula
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/header"
+	"github.com/slackhq/nebula/test"
+	"github.com/slackhq/nebula/udp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewHandshakeGuardFromConfig(t *testing.T) {
+	l := test.NewLogger()
+	c := config.NewC(l)
+
+	g, err := newHandshakeGuardFromConfig(c)
+	require.NoError(t, err)
+	assert.Nil(t, g)
+
+	c.Settings["handshakes"] = map[interface{}]interface{}{
+		"rate_limit": map[interface{}]interface{}{"per_ip": 5},
+	}
+	g, err = newHandshakeGuardFromConfig(c)
+	require.NoError(t, err)
+	require.NotNil(t, g)
+	assert.Equal(t, 10, g.burst)
+	assert.Equal(t, 0, g.cookieThreshold)
+
+	c.Settings["handshakes"] = map[interface{}]interface{}{"cookie_threshold": 100}
+	g, err = newHandshakeGuardFromConfig(c)
+	require.NoError(t, err)
+	require.NotNil(t, g)
+	assert.Equal(t, 100, g.cookieThreshold)
+
+	tests := map[string]map[interface{}]interface{}{
+		"handshakes.rate_limit.per_ip must not be negative": {"rate_limit": map[interface{}]interface{}{"per_ip": -1}},
+		"handshakes.rate_limit.burst must be positive":      {"rate_limit": map[interface{}]interface{}{"per_ip": 1, "burst": 0}},
+		"handshakes.cookie_threshold must not be negative":  {"cookie_threshold": -1},
+	}
+	for expected, settings := range tests {
+		c.Settings["handshakes"] = settings
+		_, err = newHandshakeGuardFromConfig(c)
+		assert.EqualError(t, err, expected)
+	}
+}
+
+func TestHandshakeGuard_allow(t *testing.T) {
+	now := time.Now()
+	a := &udp.Addr{IP: net.ParseIP("1.2.3.4"), Port: 4242}
+	b := &udp.Addr{IP: net.ParseIP("1.2.3.5"), Port: 4242}
+
+	// A nil guard lets everything through
+	var g *handshakeGuard
+	assert.True(t, g.allow(a, now))
+
+	g = newHandshakeGuard(1, 2, 0)
+	g.metricRateLimited.Clear()
+	assert.True(t, g.allow(a, now))
+	assert.True(t, g.allow(a, now))
+	assert.False(t, g.allow(a, now))
+	assert.Equal(t, int64(1), g.metricRateLimited.Count())
+
+	// Other addresses have their own bucket
+	assert.True(t, g.allow(b, now))
+
+	// The bucket refills
+	assert.True(t, g.allow(a, now.Add(time.Second)))
+
+	// Full buckets are pruned
+	g.allow(&udp.Addr{IP: net.ParseIP("1.2.3.6"), Port: 4242}, now.Add(time.Hour))
+	assert.Len(t, g.hosts, 1)
+
+	// Past the limit new addresses share a bucket
+	g = newHandshakeGuard(1, 1, 0)
+	g.maxHosts = 1
+	assert.True(t, g.allow(a, now))
+	assert.True(t, g.allow(b, now))
+	assert.False(t, g.allow(&udp.Addr{IP: net.ParseIP("1.2.3.6"), Port: 4242}, now))
+	assert.Len(t, g.hosts, 1)
+
+	// Until pruning makes room
+	assert.True(t, g.allow(b, now.Add(2*time.Second)))
+	assert.Len(t, g.hosts, 1)
+	assert.Contains(t, g.hosts, string(b.IP.To16()))
+}
+
+func TestHandshakeGuard_cookies(t *testing.T) {
+	a := &udp.Addr{IP: net.ParseIP("1.2.3.4"), Port: 4242}
+	b := &udp.Addr{IP: net.ParseIP("1.2.3.4"), Port: 4243}
+
+	// A nil guard never asks for a cookie
+	var g *handshakeGuard
+	assert.True(t, g.checkCookie(a, 0, time.Now()))
+
+	g = newHandshakeGuard(0, 0, 1)
+	g.metricCookieRequired.Clear()
+	g.metricCookieInvalid.Clear()
+	now := time.Now()
+	assert.True(t, g.checkCookie(a, 0, now))
+
+	// Over the threshold a cookie is required
+	assert.False(t, g.checkCookie(a, 0, now))
+
+	reply := g.cookieReply(a, 1234, now)
+	require.Len(t, reply, cookieReplyLen)
+	h := &header.H{}
+	require.NoError(t, h.Parse(reply))
+	assert.Equal(t, header.Handshake, h.Type)
+	assert.Equal(t, header.HandshakeCookieReply, h.Subtype)
+	assert.Equal(t, uint32(1234), h.RemoteIndex)
+	cookie := binary.BigEndian.Uint64(reply[header.Len:])
+	assert.NotZero(t, cookie)
+
+	assert.True(t, g.checkCookie(a, cookie, now))
+
+	// The cookie only works from the address it was made for
+	assert.False(t, g.checkCookie(b, cookie, now))
+	assert.False(t, g.checkCookie(a, cookie+2, now))
+	assert.Equal(t, int64(1), g.metricCookieRequired.Count())
+	assert.Equal(t, int64(2), g.metricCookieInvalid.Count())
+
+	// Cookies survive one rotation but not two
+	later := now.Add(cookieSecretLifetime)
+	g.checkCookie(a, 0, later)
+	assert.True(t, g.checkCookie(a, cookie, later))
+	later = later.Add(cookieSecretLifetime)
+	g.checkCookie(a, 0, later)
+	assert.False(t, g.checkCookie(a, cookie, later))
+
+	// The count starts over every second
+	assert.True(t, g.checkCookie(a, 0, later.Add(time.Second)))
+}
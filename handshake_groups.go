@@ -0,0 +1,66 @@
+package nebula
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/slackhq/nebula/cert"
+	"github.com/slackhq/nebula/config"
+)
+
+var ErrMissingRequiredGroup = errors.New("certificate is missing a group required by handshakes.require_groups")
+
+// requiredGroups are the groups a remote certificate must carry, every one of them, before we complete a tunnel with
+// it. Hosts without them are refused during the handshake so they never reach the hostmap or the firewall.
+// A nil requiredGroups requires nothing.
+type requiredGroups struct {
+	groups []string
+}
+
+func newRequiredGroupsFromConfig(c *config.C) (*requiredGroups, error) {
+	groups := c.GetStringSlice("handshakes.require_groups", nil)
+	if len(groups) == 0 {
+		return nil, nil
+	}
+
+	for _, g := range groups {
+		if strings.TrimSpace(g) == "" {
+			return nil, errors.New("handshakes.require_groups must not contain an empty group")
+		}
+	}
+
+	return &requiredGroups{groups: groups}, nil
+}
+
+// missing returns the first required group the certificate does not carry or an empty string if it has them all
+func (r *requiredGroups) missing(c *cert.NebulaCertificate) string {
+	if r == nil {
+		return ""
+	}
+
+	for _, g := range r.groups {
+		if _, ok := c.Details.InvertedGroups[g]; !ok {
+			return g
+		}
+	}
+	return ""
+}
+
+func (f *Interface) reloadRequireGroups(c *config.C) {
+	if !c.InitialLoad() && !c.HasChanged("handshakes.require_groups") {
+		return
+	}
+
+	r, err := newRequiredGroupsFromConfig(c)
+	if err != nil {
+		f.l.WithError(err).Error("Failed to load handshakes.require_groups, keeping the previous one")
+		return
+	}
+
+	f.requireGroups.Store(r)
+	if r != nil {
+		f.l.WithField("groups", r.groups).Info("Tunnels require remote certificate groups")
+	} else if !c.InitialLoad() {
+		f.l.Info("Tunnels no longer require remote certificate groups")
+	}
+}
@@ -0,0 +1,45 @@
+package nebula
+
+import (
+	"testing"
+
+	"github.com/slackhq/nebula/cert"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewRequiredGroupsFromConfig(t *testing.T) {
+	l := test.NewLogger()
+	c := config.NewC(l)
+
+	r, err := newRequiredGroupsFromConfig(c)
+	require.NoError(t, err)
+	assert.Nil(t, r)
+
+	c.Settings["handshakes"] = map[interface{}]interface{}{"require_groups": []interface{}{"servers", "prod"}}
+	r, err = newRequiredGroupsFromConfig(c)
+	require.NoError(t, err)
+	assert.Equal(t, &requiredGroups{groups: []string{"servers", "prod"}}, r)
+
+	c.Settings["handshakes"] = map[interface{}]interface{}{"require_groups": []interface{}{"servers", " "}}
+	_, err = newRequiredGroupsFromConfig(c)
+	assert.EqualError(t, err, "handshakes.require_groups must not contain an empty group")
+}
+
+func TestRequiredGroups_missing(t *testing.T) {
+	c := &cert.NebulaCertificate{Details: cert.NebulaCertificateDetails{
+		InvertedGroups: map[string]struct{}{"servers": {}, "prod": {}},
+	}}
+
+	// Nothing is required by default
+	var r *requiredGroups
+	assert.Empty(t, r.missing(c))
+
+	r = &requiredGroups{groups: []string{"servers", "prod"}}
+	assert.Empty(t, r.missing(c))
+
+	r = &requiredGroups{groups: []string{"servers", "staging", "db"}}
+	assert.Equal(t, "staging", r.missing(c))
+}
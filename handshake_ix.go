@@ -1,10 +1,11 @@
 package nebula
 
 import (
+	"encoding/binary"
 	"time"
 
-	"github.com/flynn/noise"
 	"github.com/sirupsen/logrus"
+	"github.com/slackhq/nebula/cert"
 	"github.com/slackhq/nebula/header"
 	"github.com/slackhq/nebula/iputil"
 	"github.com/slackhq/nebula/udp"
@@ -15,21 +16,62 @@ import (
 // This function constructs a handshake packet, but does not actually send it
 // Sending is done by the handshake manager
 func ixHandshakeStage0(f *Interface, hh *HandshakeHostInfo) bool {
+	l := f.handshakeManager.l
 	err := f.handshakeManager.allocateIndex(hh)
 	if err != nil {
-		f.l.WithError(err).WithField("vpnIp", hh.hostinfo.vpnIp).
+		l.WithError(err).WithField("vpnIp", hh.hostinfo.vpnIp).
 			WithField("handshake", m{"stage": 0, "style": "ix_psk0"}).Error("Failed to generate index")
 		return false
 	}
 
+	return ixHandshakeBuildStage0(f, hh)
+}
+
+// ixHandshakeBuildStage0 creates a fresh noise state and first handshake message for hh, carrying the cookie a busy
+// responder gave us if there is one
+func ixHandshakeBuildStage0(f *Interface, hh *HandshakeHostInfo) bool {
+	l := f.handshakeManager.l
+	var err error
 	certState := f.pki.GetCertState()
-	ci := NewConnectionState(f.l, f.cipher, certState, true, noise.HandshakeIX, []byte{}, 0)
+	var peerCert *cert.NebulaCertificate
+	if existing := f.hostMap.QueryVpnIp(hh.hostinfo.vpnIp); existing != nil {
+		// Present what they trusted last time
+		peerCert = existing.GetCert()
+		certState = certState.forPeer(existing.ConnectionState.peerTrustedCAs, peerCert)
+	}
+
+	// Guess the pre-shared keys from the groups we shared last time, or all of ours, see handshake_psk.go
+	psks := f.psks.Load()
+	pskGroups := psks.groupsFor(certState.Certificate, peerCert)
+	subtype := pskSubtype(pskGroups)
+	ci := f.newConnectionState(f.ciphers.handshake, certState, true, nil, pskPlacement(subtype))
+	if subtype == header.HandshakeIXPSK2 {
+		if err = psks.use(ci, pskGroups); err != nil {
+			l.WithError(err).WithField("vpnIp", hh.hostinfo.vpnIp).
+				WithField("handshake", m{"stage": 0, "style": "ix_psk2"}).Error("Failed to set the pre-shared key")
+			return false
+		}
+	}
 	hh.hostinfo.ConnectionState = ci
 
+	ci.sentCapabilities = f.handshakeCapabilities
 	hsProto := &NebulaHandshakeDetails{
 		InitiatorIndex: hh.hostinfo.localIndexId,
 		Time:           uint64(time.Now().UnixNano()),
 		Cert:           certState.RawCertificateNoKey,
+		Capabilities:   ci.sentCapabilities,
+		Cookie:         hh.cookie,
+		TrustedCAs:     f.pki.advertisedCAs(),
+	}
+	f.ciphers.offer(hsProto)
+	if f.ciphers.kem {
+		ci.kemKey, err = newKemKey()
+		if err != nil {
+			l.WithError(err).WithField("vpnIp", hh.hostinfo.vpnIp).
+				WithField("handshake", m{"stage": 0, "style": "ix_psk0"}).Error("Failed to generate hybrid kem key")
+			return false
+		}
+		hsProto.KemPublicKey = ci.kemKey.EncapsulationKey()
 	}
 
 	hsBytes := []byte{}
@@ -40,23 +82,23 @@ func ixHandshakeStage0(f *Interface, hh *HandshakeHostInfo) bool {
 	hsBytes, err = hs.Marshal()
 
 	if err != nil {
-		f.l.WithError(err).WithField("vpnIp", hh.hostinfo.vpnIp).
+		l.WithError(err).WithField("vpnIp", hh.hostinfo.vpnIp).
 			WithField("handshake", m{"stage": 0, "style": "ix_psk0"}).Error("Failed to marshal handshake message")
 		return false
 	}
 
-	h := header.Encode(make([]byte, header.Len), header.Version, header.Handshake, header.HandshakeIXPSK0, 0, 1)
+	h := header.Encode(make([]byte, header.Len), header.Version, header.Handshake, subtype, 0, 1)
 
 	msg, _, _, err := ci.H.WriteMessage(h, hsBytes)
 	if err != nil {
-		f.l.WithError(err).WithField("vpnIp", hh.hostinfo.vpnIp).
+		l.WithError(err).WithField("vpnIp", hh.hostinfo.vpnIp).
 			WithField("handshake", m{"stage": 0, "style": "ix_psk0"}).Error("Failed to call noise.WriteMessage")
 		return false
 	}
 
 	// We are sending handshake packet 1, so we don't expect to receive
 	// handshake packet 1 from the responder
-	ci.window.Update(f.l, 1)
+	ci.window.Update(l, 1)
 
 	hh.hostinfo.HandshakePacket[0] = msg
 	hh.ready = true
@@ -64,14 +106,24 @@ func ixHandshakeStage0(f *Interface, hh *HandshakeHostInfo) bool {
 }
 
 func ixHandshakeStage1(f *Interface, addr *udp.Addr, via *ViaSender, packet []byte, h *header.H) {
+	l := f.handshakeManager.l
 	certState := f.pki.GetCertState()
-	ci := NewConnectionState(f.l, f.cipher, certState, false, noise.HandshakeIX, []byte{}, 0)
-	// Mark packet 1 as seen so it doesn't show up as missed
-	ci.window.Update(f.l, 1)
-
-	msg, _, _, err := ci.H.ReadMessage(nil, packet[header.Len:])
+	var ci *ConnectionState
+	var msg []byte
+	var err error
+	readCipher := ""
+	for _, readCipher = range f.ciphers.readCiphers(h.Subtype == header.HandshakeIXPSK2) {
+		ci = f.newConnectionState(readCipher, certState, false, nil, pskPlacement(h.Subtype))
+		// Mark packet 1 as seen so it doesn't show up as missed
+		ci.window.Update(l, 1)
+
+		msg, _, _, err = ci.H.ReadMessage(nil, packet[header.Len:])
+		if err == nil {
+			break
+		}
+	}
 	if err != nil {
-		f.l.WithError(err).WithField("udpAddr", addr).
+		l.WithError(err).WithField("udpAddr", addr).
 			WithField("handshake", m{"stage": 1, "style": "ix_psk0"}).Error("Failed to call noise.ReadMessage")
 		return
 	}
@@ -82,30 +134,79 @@ func ixHandshakeStage1(f *Interface, addr *udp.Addr, via *ViaSender, packet []by
 		l.Debugln("GOT INDEX: ", hs.Details.InitiatorIndex)
 	*/
 	if err != nil || hs.Details == nil {
-		f.l.WithError(err).WithField("udpAddr", addr).
+		l.WithError(err).WithField("udpAddr", addr).
 			WithField("handshake", m{"stage": 1, "style": "ix_psk0"}).Error("Failed unmarshal handshake message")
 		return
 	}
 
+	if addr != nil {
+		guard := f.handshakeManager.config.guard
+		if now := time.Now(); !guard.checkCookie(addr, hs.Details.Cookie, now) {
+			// We are busy, make them prove they own their address before we spend any more on them
+			f.messageMetrics.Tx(header.Handshake, header.HandshakeCookieReply, 1)
+			if err := f.outside.WriteTo(guard.cookieReply(addr, hs.Details.InitiatorIndex, now), addr); err != nil {
+				l.WithError(err).WithField("udpAddr", addr).
+					WithField("handshake", m{"stage": 1, "style": "ix_psk0"}).Debug("Failed to send handshake cookie reply")
+			}
+			return
+		}
+	}
+
+	trace := f.tracer.startHandshake(iputil.VpnIp{}, false)
+	defer trace.end()
+	if trace != nil && addr != nil {
+		trace.set("nebula.remote", addr.String())
+	}
+
+	handshakeCipher, err := f.ciphers.handshakeCipher(hs.Details)
+	if err != nil {
+		l.WithError(err).WithField("udpAddr", addr).WithField("handshakeCipher", hs.Details.HandshakeCipher).
+			WithField("handshake", m{"stage": 1, "style": "ix_psk0"}).Info("Refusing handshake")
+		return
+	}
+
+	if handshakeCipher != readCipher {
+		// The initiator handshakes with a different cipher, start over with theirs. Without a pre-shared key the first
+		// message is not encrypted so it reads the same either way.
+		ci = f.newConnectionState(handshakeCipher, certState, false, nil, pskPlacement(h.Subtype))
+		ci.window.Update(l, 1)
+		if _, _, _, err = ci.H.ReadMessage(nil, packet[header.Len:]); err != nil {
+			l.WithError(err).WithField("udpAddr", addr).
+				WithField("handshake", m{"stage": 1, "style": "ix_psk0"}).Error("Failed to call noise.ReadMessage")
+			return
+		}
+	}
+
+	verify := trace.child("cert.verify")
 	remoteCert, err := RecombineCertAndValidate(ci.H, hs.Details.Cert, f.pki.GetCAPool())
 	if err != nil {
-		e := f.l.WithError(err).WithField("udpAddr", addr).
+		verify.fail(err.Error())
+		trace.fail("invalid certificate: " + err.Error())
+	}
+	verify.end()
+	if err != nil {
+		e := l.WithError(err).WithField("udpAddr", addr).
 			WithField("handshake", m{"stage": 1, "style": "ix_psk0"})
 
-		if f.l.Level > logrus.DebugLevel {
+		if l.Level > logrus.DebugLevel {
 			e = e.WithField("cert", remoteCert)
 		}
 
 		e.Info("Invalid certificate from host")
+		f.events.emit(certRejectedEvent(addr, remoteCert, err.Error()))
 		return
 	}
 	vpnIp := iputil.Ip2VpnIp(remoteCert.Details.Ips[0].IP)
 	certName := remoteCert.Details.Name
-	fingerprint, _ := remoteCert.Sha256Sum()
+	fingerprint, _ := remoteCert.Fingerprint()
 	issuer := remoteCert.Details.Issuer
+	if trace != nil {
+		trace.set("nebula.peer.vpn_ip", vpnIp)
+		trace.set("nebula.peer.name", certName)
+	}
 
 	if vpnIp == f.myVpnIp {
-		f.l.WithField("vpnIp", vpnIp).WithField("udpAddr", addr).
+		l.WithField("vpnIp", vpnIp).WithField("udpAddr", addr).
 			WithField("certName", certName).
 			WithField("fingerprint", fingerprint).
 			WithField("issuer", issuer).
@@ -115,14 +216,94 @@ func ixHandshakeStage1(f *Interface, addr *udp.Addr, via *ViaSender, packet []by
 
 	if addr != nil {
 		if !f.lightHouse.GetRemoteAllowList().Allow(vpnIp, addr.IP) {
-			f.l.WithField("vpnIp", vpnIp).WithField("udpAddr", addr).Debug("lighthouse.remote_allow_list denied incoming handshake")
+			l.WithField("vpnIp", vpnIp).WithField("udpAddr", addr).Debug("lighthouse.remote_allow_list denied incoming handshake")
 			return
 		}
 	}
 
-	myIndex, err := generateIndex(f.l)
+	if group := f.requireGroups.Load().missing(remoteCert); group != "" {
+		l.WithError(ErrMissingRequiredGroup).WithField("vpnIp", vpnIp).WithField("udpAddr", addr).
+			WithField("certName", certName).
+			WithField("fingerprint", fingerprint).
+			WithField("issuer", issuer).
+			WithField("group", group).
+			WithField("handshake", m{"stage": 1, "style": "ix_psk0"}).Info("Refusing handshake")
+		f.events.emit(certRejectedEvent(addr, remoteCert, ErrMissingRequiredGroup.Error()+": "+group))
+		trace.fail(ErrMissingRequiredGroup.Error() + ": " + group)
+		return
+	}
+
+	if !f.pins.Load().allow(vpnIp, remoteCert) {
+		l.WithError(ErrPinMismatch).WithField("vpnIp", vpnIp).WithField("udpAddr", addr).
+			WithField("certName", certName).
+			WithField("fingerprint", fingerprint).
+			WithField("issuer", issuer).
+			WithField("handshake", m{"stage": 1, "style": "ix_psk0"}).Info("Refusing handshake")
+		f.events.emit(certRejectedEvent(addr, remoteCert, ErrPinMismatch.Error()))
+		trace.fail(ErrPinMismatch.Error())
+		return
+	}
+
+	if mine := certState.forPeer(hs.Details.TrustedCAs, remoteCert); mine != certState {
+		// Answer with the certificate they trust, the first message reads the same with any of ours
+		certState = mine
+		ci = f.newConnectionState(handshakeCipher, certState, false, nil, pskPlacement(h.Subtype))
+		ci.window.Update(l, 1)
+		if _, _, _, err = ci.H.ReadMessage(nil, packet[header.Len:]); err != nil {
+			l.WithError(err).WithField("vpnIp", vpnIp).WithField("udpAddr", addr).
+				WithField("handshake", m{"stage": 1, "style": "ix_psk0"}).Error("Failed to call noise.ReadMessage")
+			return
+		}
+	}
+	ci.peerTrustedCAs = hs.Details.TrustedCAs
+
+	// Answer with the pre-shared keys of the groups we share, a handshake without them is refused if we share any
+	psks := f.psks.Load()
+	pskGroups := psks.groupsFor(certState.Certificate, remoteCert)
+	if h.Subtype == header.HandshakeIXPSK2 {
+		if err = psks.use(ci, pskGroups); err != nil {
+			l.WithError(err).WithField("vpnIp", vpnIp).WithField("udpAddr", addr).
+				WithField("handshake", m{"stage": 1, "style": "ix_psk2"}).Error("Failed to set the pre-shared key")
+			return
+		}
+	} else if len(pskGroups) > 0 {
+		l.WithError(ErrHandshakePSKMismatch).WithField("vpnIp", vpnIp).WithField("udpAddr", addr).
+			WithField("certName", certName).
+			WithField("fingerprint", fingerprint).
+			WithField("issuer", issuer).
+			WithField("expectedGroups", pskGroups).
+			WithField("handshake", m{"stage": 1, "style": "ix_psk0"}).Info("Refusing handshake")
+		return
+	}
+
+	ci.cipher, err = f.ciphers.choose(handshakeCipher, hs.Details)
 	if err != nil {
-		f.l.WithError(err).WithField("vpnIp", vpnIp).WithField("udpAddr", addr).
+		l.WithError(err).WithField("vpnIp", vpnIp).WithField("udpAddr", addr).
+			WithField("certName", certName).
+			WithField("fingerprint", fingerprint).
+			WithField("issuer", issuer).
+			WithField("remoteCiphers", hs.Details.Ciphers).
+			WithField("handshake", m{"stage": 1, "style": "ix_psk0"}).Info("Refusing handshake")
+		return
+	}
+
+	var kemSecret, kemCiphertext []byte
+	if f.ciphers.kem && len(hs.Details.KemPublicKey) > 0 {
+		kemSecret, kemCiphertext, err = kemEncapsulate(hs.Details.KemPublicKey)
+		if err != nil {
+			l.WithError(err).WithField("vpnIp", vpnIp).WithField("udpAddr", addr).
+				WithField("certName", certName).
+				WithField("fingerprint", fingerprint).
+				WithField("issuer", issuer).
+				WithField("handshake", m{"stage": 1, "style": "ix_psk0"}).Info("Refusing handshake with an invalid hybrid kem key")
+			return
+		}
+	}
+	ci.kem = kemName(kemSecret)
+
+	myIndex, err := generateIndex(l)
+	if err != nil {
+		l.WithError(err).WithField("vpnIp", vpnIp).WithField("udpAddr", addr).
 			WithField("certName", certName).
 			WithField("fingerprint", fingerprint).
 			WithField("issuer", issuer).
@@ -144,22 +325,34 @@ func ixHandshakeStage1(f *Interface, addr *udp.Addr, via *ViaSender, packet []by
 		},
 	}
 
-	f.l.WithField("vpnIp", vpnIp).WithField("udpAddr", addr).
+	l.WithField("vpnIp", vpnIp).WithField("udpAddr", addr).
 		WithField("certName", certName).
 		WithField("fingerprint", fingerprint).
 		WithField("issuer", issuer).
 		WithField("initiatorIndex", hs.Details.InitiatorIndex).WithField("responderIndex", hs.Details.ResponderIndex).
 		WithField("remoteIndex", h.RemoteIndex).WithField("handshake", m{"stage": 1, "style": "ix_psk0"}).
+		WithField("cipher", ci.cipher).WithField("kem", ci.kem).
 		Info("Handshake message received")
 
+	// Advertise our capabilities and bind theirs into our response so they can detect tampering
+	initiatorCapabilities := newCapabilitySet(hs.Details.Capabilities...)
+	ci.sentCapabilities = f.handshakeCapabilities
+	ci.capabilities = ci.sentCapabilities.Intersect(initiatorCapabilities)
+
 	hs.Details.ResponderIndex = myIndex
 	hs.Details.Cert = certState.RawCertificateNoKey
+	hs.Details.TrustedCAs = f.pki.advertisedCAs()
+	hs.Details.Capabilities = ci.sentCapabilities
+	hs.Details.CapabilitiesDigest = capabilitiesDigest(initiatorCapabilities, ci.sentCapabilities)
+	f.ciphers.answer(hs.Details, ci.cipher)
+	hs.Details.KemPublicKey = nil
+	hs.Details.KemCiphertext = kemCiphertext
 	// Update the time in case their clock is way off from ours
 	hs.Details.Time = uint64(time.Now().UnixNano())
 
 	hsBytes, err := hs.Marshal()
 	if err != nil {
-		f.l.WithError(err).WithField("vpnIp", hostinfo.vpnIp).WithField("udpAddr", addr).
+		l.WithError(err).WithField("vpnIp", hostinfo.vpnIp).WithField("udpAddr", addr).
 			WithField("certName", certName).
 			WithField("fingerprint", fingerprint).
 			WithField("issuer", issuer).
@@ -167,17 +360,17 @@ func ixHandshakeStage1(f *Interface, addr *udp.Addr, via *ViaSender, packet []by
 		return
 	}
 
-	nh := header.Encode(make([]byte, header.Len), header.Version, header.Handshake, header.HandshakeIXPSK0, hs.Details.InitiatorIndex, 2)
+	nh := header.Encode(make([]byte, header.Len), header.Version, header.Handshake, h.Subtype, hs.Details.InitiatorIndex, 2)
 	msg, dKey, eKey, err := ci.H.WriteMessage(nh, hsBytes)
 	if err != nil {
-		f.l.WithError(err).WithField("vpnIp", hostinfo.vpnIp).WithField("udpAddr", addr).
+		l.WithError(err).WithField("vpnIp", hostinfo.vpnIp).WithField("udpAddr", addr).
 			WithField("certName", certName).
 			WithField("fingerprint", fingerprint).
 			WithField("issuer", issuer).
 			WithField("handshake", m{"stage": 1, "style": "ix_psk0"}).Error("Failed to call noise.WriteMessage")
 		return
 	} else if dKey == nil || eKey == nil {
-		f.l.WithField("vpnIp", hostinfo.vpnIp).WithField("udpAddr", addr).
+		l.WithField("vpnIp", hostinfo.vpnIp).WithField("udpAddr", addr).
 			WithField("certName", certName).
 			WithField("fingerprint", fingerprint).
 			WithField("issuer", issuer).
@@ -195,11 +388,11 @@ func ixHandshakeStage1(f *Interface, addr *udp.Addr, via *ViaSender, packet []by
 
 	// We are sending handshake packet 2, so we don't expect to receive
 	// handshake packet 2 from the initiator.
-	ci.window.Update(f.l, 2)
+	ci.window.Update(l, 2)
 
 	ci.peerCert = remoteCert
-	ci.dKey = NewNebulaCipherState(dKey)
-	ci.eKey = NewNebulaCipherState(eKey)
+	ci.eKey, ci.dKey = f.ciphers.tunnelKeys(handshakeCipher, ci.cipher, kemSecret, eKey, dKey)
+	ci.established = time.Now()
 
 	hostinfo.remotes = f.lightHouse.QueryCache(vpnIp)
 	hostinfo.SetRemote(addr)
@@ -216,35 +409,39 @@ func ixHandshakeStage1(f *Interface, addr *udp.Addr, via *ViaSender, packet []by
 				f.SendMessageToVpnIp(header.Test, header.TestRequest, vpnIp, []byte(""), make([]byte, 12, 12), make([]byte, mtu))
 			}
 
+			// A retransmit of a handshake we already answered, answer it the same way
+			trace.set("nebula.resent", true)
+			trace.ok()
+
 			msg = existing.HandshakePacket[2]
 			f.messageMetrics.Tx(header.Handshake, header.MessageSubType(msg[1]), 1)
 			if addr != nil {
 				err := f.outside.WriteTo(msg, addr)
 				if err != nil {
-					f.l.WithField("vpnIp", existing.vpnIp).WithField("udpAddr", addr).
+					l.WithField("vpnIp", existing.vpnIp).WithField("udpAddr", addr).
 						WithField("handshake", m{"stage": 2, "style": "ix_psk0"}).WithField("cached", true).
 						WithError(err).Error("Failed to send handshake message")
 				} else {
-					f.l.WithField("vpnIp", existing.vpnIp).WithField("udpAddr", addr).
+					l.WithField("vpnIp", existing.vpnIp).WithField("udpAddr", addr).
 						WithField("handshake", m{"stage": 2, "style": "ix_psk0"}).WithField("cached", true).
 						Info("Handshake message sent")
 				}
 				return
 			} else {
 				if via == nil {
-					f.l.Error("Handshake send failed: both addr and via are nil.")
+					l.Error("Handshake send failed: both addr and via are nil.")
 					return
 				}
 				hostinfo.relayState.InsertRelayTo(via.relayHI.vpnIp)
 				f.SendVia(via.relayHI, via.relay, msg, make([]byte, 12), make([]byte, mtu), false)
-				f.l.WithField("vpnIp", existing.vpnIp).WithField("relay", via.relayHI.vpnIp).
+				l.WithField("vpnIp", existing.vpnIp).WithField("relay", via.relayHI.vpnIp).
 					WithField("handshake", m{"stage": 2, "style": "ix_psk0"}).WithField("cached", true).
 					Info("Handshake message sent")
 				return
 			}
 		case ErrExistingHostInfo:
 			// This means there was an existing tunnel and this handshake was older than the one we are currently based on
-			f.l.WithField("vpnIp", vpnIp).WithField("udpAddr", addr).
+			l.WithField("vpnIp", vpnIp).WithField("udpAddr", addr).
 				WithField("certName", certName).
 				WithField("oldHandshakeTime", existing.lastHandshakeTime).
 				WithField("newHandshakeTime", hostinfo.lastHandshakeTime).
@@ -259,7 +456,7 @@ func ixHandshakeStage1(f *Interface, addr *udp.Addr, via *ViaSender, packet []by
 			return
 		case ErrLocalIndexCollision:
 			// This means we failed to insert because of collision on localIndexId. Just let the next handshake packet retry
-			f.l.WithField("vpnIp", vpnIp).WithField("udpAddr", addr).
+			l.WithField("vpnIp", vpnIp).WithField("udpAddr", addr).
 				WithField("certName", certName).
 				WithField("fingerprint", fingerprint).
 				WithField("issuer", issuer).
@@ -271,7 +468,7 @@ func ixHandshakeStage1(f *Interface, addr *udp.Addr, via *ViaSender, packet []by
 		default:
 			// Shouldn't happen, but just in case someone adds a new error type to CheckAndComplete
 			// And we forget to update it here
-			f.l.WithError(err).WithField("vpnIp", vpnIp).WithField("udpAddr", addr).
+			l.WithError(err).WithField("vpnIp", vpnIp).WithField("udpAddr", addr).
 				WithField("certName", certName).
 				WithField("fingerprint", fingerprint).
 				WithField("issuer", issuer).
@@ -287,7 +484,7 @@ func ixHandshakeStage1(f *Interface, addr *udp.Addr, via *ViaSender, packet []by
 	if addr != nil {
 		err = f.outside.WriteTo(msg, addr)
 		if err != nil {
-			f.l.WithField("vpnIp", vpnIp).WithField("udpAddr", addr).
+			l.WithField("vpnIp", vpnIp).WithField("udpAddr", addr).
 				WithField("certName", certName).
 				WithField("fingerprint", fingerprint).
 				WithField("issuer", issuer).
@@ -295,7 +492,7 @@ func ixHandshakeStage1(f *Interface, addr *udp.Addr, via *ViaSender, packet []by
 				WithField("remoteIndex", h.RemoteIndex).WithField("handshake", m{"stage": 2, "style": "ix_psk0"}).
 				WithError(err).Error("Failed to send handshake")
 		} else {
-			f.l.WithField("vpnIp", vpnIp).WithField("udpAddr", addr).
+			l.WithField("vpnIp", vpnIp).WithField("udpAddr", addr).
 				WithField("certName", certName).
 				WithField("fingerprint", fingerprint).
 				WithField("issuer", issuer).
@@ -305,12 +502,12 @@ func ixHandshakeStage1(f *Interface, addr *udp.Addr, via *ViaSender, packet []by
 		}
 	} else {
 		if via == nil {
-			f.l.Error("Handshake send failed: both addr and via are nil.")
+			l.Error("Handshake send failed: both addr and via are nil.")
 			return
 		}
 		hostinfo.relayState.InsertRelayTo(via.relayHI.vpnIp)
 		f.SendVia(via.relayHI, via.relay, msg, make([]byte, 12), make([]byte, mtu), false)
-		f.l.WithField("vpnIp", vpnIp).WithField("relay", via.relayHI.vpnIp).
+		l.WithField("vpnIp", vpnIp).WithField("relay", via.relayHI.vpnIp).
 			WithField("certName", certName).
 			WithField("fingerprint", fingerprint).
 			WithField("issuer", issuer).
@@ -320,6 +517,12 @@ func ixHandshakeStage1(f *Interface, addr *udp.Addr, via *ViaSender, packet []by
 	}
 
 	f.connectionManager.AddTrafficWatch(hostinfo.localIndexId)
+	f.events.emit(hostEvent(TunnelEventHandshakeCompleted, hostinfo, ""))
+	if trace != nil {
+		trace.set("nebula.cipher", ci.cipher)
+		trace.set("nebula.relayed", addr == nil)
+		trace.ok()
+	}
 
 	hostinfo.remotes.ResetBlockedRemotes()
 
@@ -327,6 +530,7 @@ func ixHandshakeStage1(f *Interface, addr *udp.Addr, via *ViaSender, packet []by
 }
 
 func ixHandshakeStage2(f *Interface, addr *udp.Addr, via *ViaSender, hh *HandshakeHostInfo, packet []byte, h *header.H) bool {
+	l := f.handshakeManager.l
 	if hh == nil {
 		// Nothing here to tear down, got a bogus stage 2 packet
 		return true
@@ -336,70 +540,162 @@ func ixHandshakeStage2(f *Interface, addr *udp.Addr, via *ViaSender, hh *Handsha
 	defer hh.Unlock()
 
 	hostinfo := hh.hostinfo
+	stage := hh.trace.child("handshake.stage2")
+	defer stage.end()
+	watch := hh.watch.Load()
+
+	// fail reports why the handshake is torn down
+	fail := func(reason string) bool {
+		f.events.emit(hostEvent(TunnelEventHandshakeFailed, hostinfo, reason))
+		stage.fail(reason)
+		hh.trace.fail(reason)
+		hh.trace.end()
+		watch.finish(false, "handshake failed: %s", reason)
+		return true
+	}
+
 	if addr != nil {
+		stage.set("nebula.remote", addr.String())
 		if !f.lightHouse.GetRemoteAllowList().Allow(hostinfo.vpnIp, addr.IP) {
-			f.l.WithField("vpnIp", hostinfo.vpnIp).WithField("udpAddr", addr).Debug("lighthouse.remote_allow_list denied incoming handshake")
+			l.WithField("vpnIp", hostinfo.vpnIp).WithField("udpAddr", addr).Debug("lighthouse.remote_allow_list denied incoming handshake")
+			stage.fail("denied by lighthouse.remote_allow_list")
+			watch.step("reply from %s denied by lighthouse.remote_allow_list, ignoring it", addr)
 			return false
 		}
+
+		if watch.wasSentTo(addr) {
+			watch.step("reply from %s", addr)
+		} else {
+			watch.step("reply from %s, an address we did not send to, the peer punched through or sits behind a nat", addr)
+		}
+	} else if via != nil {
+		watch.step("reply through relay %s", via.relayHI.vpnIp)
 	}
 
 	ci := hostinfo.ConnectionState
 	msg, eKey, dKey, err := ci.H.ReadMessage(nil, packet[header.Len:])
+	if err != nil && h.Subtype == header.HandshakeIXPSK2 {
+		// The responder may share other pre-shared key groups with us than we guessed
+		msg, eKey, dKey, err = f.psks.Load().retryStage2(ci, packet[header.Len:], err)
+	}
 	if err != nil {
-		f.l.WithError(err).WithField("vpnIp", hostinfo.vpnIp).WithField("udpAddr", addr).
+		l.WithError(err).WithField("vpnIp", hostinfo.vpnIp).WithField("udpAddr", addr).
 			WithField("handshake", m{"stage": 2, "style": "ix_psk0"}).WithField("header", h).
 			Error("Failed to call noise.ReadMessage")
 
 		// We don't want to tear down the connection on a bad ReadMessage because it could be an attacker trying
 		// to DOS us. Every other error condition after should to allow a possible good handshake to complete in the
 		// near future
+		stage.fail("failed to read the noise message")
+		watch.step("failed to read the reply, waiting for another: %s", err)
 		return false
 	} else if dKey == nil || eKey == nil {
-		f.l.WithField("vpnIp", hostinfo.vpnIp).WithField("udpAddr", addr).
+		l.WithField("vpnIp", hostinfo.vpnIp).WithField("udpAddr", addr).
 			WithField("handshake", m{"stage": 2, "style": "ix_psk0"}).
 			Error("Noise did not arrive at a key")
 
 		// This should be impossible in IX but just in case, if we get here then there is no chance to recover
 		// the handshake state machine. Tear it down
-		return true
+		return fail("noise did not arrive at a key")
 	}
 
 	hs := &NebulaHandshake{}
 	err = hs.Unmarshal(msg)
 	if err != nil || hs.Details == nil {
-		f.l.WithError(err).WithField("vpnIp", hostinfo.vpnIp).WithField("udpAddr", addr).
+		l.WithError(err).WithField("vpnIp", hostinfo.vpnIp).WithField("udpAddr", addr).
 			WithField("handshake", m{"stage": 2, "style": "ix_psk0"}).Error("Failed unmarshal handshake message")
 
 		// The handshake state machine is complete, if things break now there is no chance to recover. Tear down and start again
-		return true
+		return fail("failed to unmarshal the handshake response")
 	}
 
+	verify := stage.child("cert.verify")
 	remoteCert, err := RecombineCertAndValidate(ci.H, hs.Details.Cert, f.pki.GetCAPool())
 	if err != nil {
-		e := f.l.WithError(err).WithField("vpnIp", hostinfo.vpnIp).WithField("udpAddr", addr).
+		verify.fail(err.Error())
+	}
+	verify.end()
+	if err != nil {
+		e := l.WithError(err).WithField("vpnIp", hostinfo.vpnIp).WithField("udpAddr", addr).
 			WithField("handshake", m{"stage": 2, "style": "ix_psk0"})
 
-		if f.l.Level > logrus.DebugLevel {
+		if l.Level > logrus.DebugLevel {
 			e = e.WithField("cert", remoteCert)
 		}
 
 		e.Error("Invalid certificate from host")
+		f.events.emit(certRejectedEvent(addr, remoteCert, err.Error()))
 
 		// The handshake state machine is complete, if things break now there is no chance to recover. Tear down and start again
-		return true
+		return fail("invalid certificate: " + err.Error())
 	}
 
 	vpnIp := iputil.Ip2VpnIp(remoteCert.Details.Ips[0].IP)
 	certName := remoteCert.Details.Name
-	fingerprint, _ := remoteCert.Sha256Sum()
+	fingerprint, _ := remoteCert.Fingerprint()
 	issuer := remoteCert.Details.Issuer
 
-	// Ensure the right host responded
-	if vpnIp != hostinfo.vpnIp {
-		f.l.WithField("intendedVpnIp", hostinfo.vpnIp).WithField("haveVpnIp", vpnIp).
+	capabilities, err := verifyCapabilities(ci.sentCapabilities, hs.Details)
+	if err != nil {
+		l.WithError(err).WithField("vpnIp", vpnIp).WithField("udpAddr", addr).
+			WithField("certName", certName).
+			WithField("fingerprint", fingerprint).
+			WithField("issuer", issuer).
+			WithField("sentCapabilities", ci.sentCapabilities).
+			WithField("remoteCapabilities", hs.Details.Capabilities).
+			WithField("handshake", m{"stage": 2, "style": "ix_psk0"}).Error("Handshake capabilities were tampered with")
+
+		// The handshake state machine is complete, if things break now there is no chance to recover. Tear down and start again
+		return fail("handshake capabilities were tampered with")
+	}
+	ci.capabilities = capabilities
+	ci.peerTrustedCAs = hs.Details.TrustedCAs
+
+	ci.cipher, err = f.ciphers.accept(hs.Details)
+	if err != nil {
+		l.WithError(err).WithField("vpnIp", vpnIp).WithField("udpAddr", addr).
+			WithField("certName", certName).
+			WithField("fingerprint", fingerprint).
+			WithField("issuer", issuer).
+			WithField("cipher", hs.Details.Cipher).
+			WithField("handshake", m{"stage": 2, "style": "ix_psk0"}).Error("Failed to agree on a cipher")
+
+		// The handshake state machine is complete, if things break now there is no chance to recover. Tear down and start again
+		return fail("failed to agree on a cipher: " + err.Error())
+	}
+
+	var kemSecret []byte
+	if len(hs.Details.KemCiphertext) > 0 {
+		err = ErrKemNotOffered
+		if ci.kemKey != nil {
+			kemSecret, err = ci.kemKey.Decapsulate(hs.Details.KemCiphertext)
+		}
+
+		if err != nil {
+			l.WithError(err).WithField("vpnIp", vpnIp).WithField("udpAddr", addr).
+				WithField("certName", certName).
+				WithField("fingerprint", fingerprint).
+				WithField("issuer", issuer).
+				WithField("handshake", m{"stage": 2, "style": "ix_psk0"}).Error("Failed to complete the hybrid key exchange")
+
+			// The handshake state machine is complete, if things break now there is no chance to recover. Tear down and start again
+			return fail("failed to complete the hybrid key exchange: " + err.Error())
+		}
+	}
+	ci.kem = kemName(kemSecret)
+	ci.kemKey = nil
+
+	// Ensure the right host responded, we may have asked for any of the vpn ips in its certificate
+	if vpnIp != hostinfo.vpnIp && !certHasVpnIp(remoteCert, hostinfo.vpnIp) {
+		l.WithField("intendedVpnIp", hostinfo.vpnIp).WithField("haveVpnIp", vpnIp).
 			WithField("udpAddr", addr).WithField("certName", certName).
 			WithField("handshake", m{"stage": 2, "style": "ix_psk0"}).
 			Info("Incorrect host responded to handshake")
+		f.events.emit(hostEvent(TunnelEventHandshakeFailed, hostinfo, "incorrect host responded"))
+		stage.fail("incorrect host responded")
+		hh.trace.fail("incorrect host responded")
+		hh.trace.end()
+		watch.step("incorrect host %s (%s) responded from %s, starting over without that address", vpnIp, certName, addr)
 
 		// Release our old handshake from pending, it should not continue
 		f.handshakeManager.DeleteHostInfo(hostinfo)
@@ -414,14 +710,19 @@ func ixHandshakeStage2(f *Interface, addr *udp.Addr, via *ViaSender, hh *Handsha
 			// Get the correct remote list for the host we did handshake with
 			hostinfo.remotes = f.lightHouse.QueryCache(vpnIp)
 
-			f.l.WithField("blockedUdpAddrs", newHH.hostinfo.remotes.CopyBlockedRemotes()).WithField("vpnIp", vpnIp).
-				WithField("remotes", newHH.hostinfo.remotes.CopyAddrs(f.hostMap.GetPreferredRanges())).
+			l.WithField("blockedUdpAddrs", newHH.hostinfo.remotes.CopyBlockedRemotes()).WithField("vpnIp", vpnIp).
+				WithField("remotes", newHH.hostinfo.remotes.CopyAddrs(f.hostMap.GetPreferredRangesFor(newHH.hostinfo))).
 				Info("Blocked addresses for handshakes")
 
 			// Swap the packet store to benefit the original intended recipient
 			newHH.packetStore = hh.packetStore
 			hh.packetStore = []*cachedPacket{}
 
+			// Keep following the handshake with the intended vpn ip
+			if watch != nil {
+				newHH.watch.Store(watch)
+			}
+
 			// Finally, put the correct vpn ip in the host info, tell them to close the tunnel, and return true to tear down
 			hostinfo.vpnIp = vpnIp
 			f.sendCloseTunnel(hostinfo)
@@ -430,16 +731,55 @@ func ixHandshakeStage2(f *Interface, addr *udp.Addr, via *ViaSender, hh *Handsha
 		return true
 	}
 
+	if group := f.requireGroups.Load().missing(remoteCert); group != "" {
+		l.WithError(ErrMissingRequiredGroup).WithField("vpnIp", vpnIp).WithField("udpAddr", addr).
+			WithField("certName", certName).
+			WithField("fingerprint", fingerprint).
+			WithField("issuer", issuer).
+			WithField("group", group).
+			WithField("handshake", m{"stage": 2, "style": "ix_psk0"}).Info("Refusing handshake")
+		f.events.emit(certRejectedEvent(addr, remoteCert, ErrMissingRequiredGroup.Error()+": "+group))
+
+		// The handshake state machine is complete, if things break now there is no chance to recover. Tear down and start again
+		return fail(ErrMissingRequiredGroup.Error() + ": " + group)
+	}
+
+	if !f.pins.Load().allow(vpnIp, remoteCert) {
+		l.WithError(ErrPinMismatch).WithField("vpnIp", vpnIp).WithField("udpAddr", addr).
+			WithField("certName", certName).
+			WithField("fingerprint", fingerprint).
+			WithField("issuer", issuer).
+			WithField("handshake", m{"stage": 2, "style": "ix_psk0"}).Info("Refusing handshake")
+		f.events.emit(certRejectedEvent(addr, remoteCert, ErrPinMismatch.Error()))
+
+		// The handshake state machine is complete, if things break now there is no chance to recover. Tear down and start again
+		return fail(ErrPinMismatch.Error())
+	}
+
+	if expected := f.psks.Load().groupsFor(ci.myCert, remoteCert); !equalStrings(expected, ci.pskGroups) {
+		l.WithError(ErrHandshakePSKMismatch).WithField("vpnIp", vpnIp).WithField("udpAddr", addr).
+			WithField("certName", certName).
+			WithField("fingerprint", fingerprint).
+			WithField("issuer", issuer).
+			WithField("expectedGroups", expected).
+			WithField("pskGroups", ci.pskGroups).
+			WithField("handshake", m{"stage": 2, "style": "ix_psk0"}).Info("Refusing handshake")
+
+		// The handshake state machine is complete, if things break now there is no chance to recover. Tear down and start again
+		return fail(ErrHandshakePSKMismatch.Error())
+	}
+
 	// Mark packet 2 as seen so it doesn't show up as missed
-	ci.window.Update(f.l, 2)
+	ci.window.Update(l, 2)
 
 	duration := time.Since(hh.startTime).Nanoseconds()
-	f.l.WithField("vpnIp", vpnIp).WithField("udpAddr", addr).
+	l.WithField("vpnIp", vpnIp).WithField("udpAddr", addr).
 		WithField("certName", certName).
 		WithField("fingerprint", fingerprint).
 		WithField("issuer", issuer).
 		WithField("initiatorIndex", hs.Details.InitiatorIndex).WithField("responderIndex", hs.Details.ResponderIndex).
 		WithField("remoteIndex", h.RemoteIndex).WithField("handshake", m{"stage": 2, "style": "ix_psk0"}).
+		WithField("cipher", ci.cipher).WithField("kem", ci.kem).
 		WithField("durationNs", duration).
 		WithField("sentCachedPackets", len(hh.packetStore)).
 		Info("Handshake message received")
@@ -449,8 +789,8 @@ func ixHandshakeStage2(f *Interface, addr *udp.Addr, via *ViaSender, hh *Handsha
 
 	// Store their cert and our symmetric keys
 	ci.peerCert = remoteCert
-	ci.dKey = NewNebulaCipherState(dKey)
-	ci.eKey = NewNebulaCipherState(eKey)
+	ci.eKey, ci.dKey = f.ciphers.tunnelKeys(f.ciphers.handshake, ci.cipher, kemSecret, eKey, dKey)
+	ci.established = time.Now()
 
 	// Make sure the current udpAddr being used is set for responding
 	if addr != nil {
@@ -462,12 +802,14 @@ func ixHandshakeStage2(f *Interface, addr *udp.Addr, via *ViaSender, hh *Handsha
 	// Build up the radix for the firewall if we have subnets in the cert
 	hostinfo.CreateRemoteCIDR(remoteCert)
 
-	// Complete our handshake and update metrics, this will replace any existing tunnels for this vpnIp
-	f.handshakeManager.Complete(hostinfo, f)
+	// Complete our handshake and update metrics, this will replace any existing tunnels for this vpnIp. A tunnel is
+	// known by the first vpn ip in the certificate, the one we asked for becomes an alias of it.
+	f.handshakeManager.Complete(hostinfo, vpnIp, f)
 	f.connectionManager.AddTrafficWatch(hostinfo.localIndexId)
+	f.events.emit(hostEvent(TunnelEventHandshakeCompleted, hostinfo, ""))
 
-	if f.l.Level >= logrus.DebugLevel {
-		hostinfo.logger(f.l).Debugf("Sending %d stored packets", len(hh.packetStore))
+	if l.Level >= logrus.DebugLevel {
+		hostinfo.logger(l).Debugf("Sending %d stored packets", len(hh.packetStore))
 	}
 
 	if len(hh.packetStore) > 0 {
@@ -481,6 +823,62 @@ func ixHandshakeStage2(f *Interface, addr *udp.Addr, via *ViaSender, hh *Handsha
 
 	hostinfo.remotes.ResetBlockedRemotes()
 	f.metricHandshakes.Update(duration)
+	if f.promStats != nil {
+		f.promStats.handshakes.Observe(time.Duration(duration).Seconds())
+	}
+	if hh.trace != nil {
+		hh.trace.set("nebula.peer.name", certName)
+		hh.trace.set("nebula.cipher", ci.cipher)
+		hh.trace.set("nebula.relayed", addr == nil)
+		hh.trace.set("nebula.cached_packets", len(hh.packetStore))
+		stage.ok()
+		hh.trace.ok()
+		hh.trace.end()
+	}
+
+	if watch != nil {
+		path := "through relay " + via.relayHI.vpnIp.String()
+		if addr != nil {
+			path = "direct to " + addr.String()
+		}
+		watch.finish(true, "tunnel to %s (%s) is up %s after %d attempts in %s, cipher %s",
+			vpnIp, certName, path, hh.counter, time.Duration(duration).Round(time.Millisecond), ci.cipher)
+	}
 
 	return false
 }
+
+// ixHandshakeCookie handles a busy responder asking us to prove we own our address, the handshake starts over with the
+// cookie it gave us
+func ixHandshakeCookie(f *Interface, addr *udp.Addr, hh *HandshakeHostInfo, packet []byte) {
+	l := f.handshakeManager.l
+	if hh == nil || addr == nil || len(packet) < cookieReplyLen {
+		return
+	}
+
+	hh.Lock()
+	defer hh.Unlock()
+
+	cookie := binary.BigEndian.Uint64(packet[header.Len:])
+	if cookie == 0 || cookie == hh.cookie {
+		// We already started over with this cookie
+		return
+	}
+
+	hh.cookie = cookie
+	if !ixHandshakeBuildStage0(f, hh) {
+		return
+	}
+
+	l.WithField("vpnIp", hh.hostinfo.vpnIp).WithField("udpAddr", addr).
+		WithField("handshake", m{"stage": 0, "style": "ix_psk0"}).
+		Info("Responder asked for a handshake cookie, starting over")
+	hh.watch.Load().step("responder %s is busy and sent a cookie, starting over with it", addr)
+
+	msg := hh.hostinfo.HandshakePacket[0]
+	f.messageMetrics.Tx(header.Handshake, header.MessageSubType(msg[1]), 1)
+	if err := f.outside.WriteTo(msg, addr); err != nil {
+		l.WithError(err).WithField("vpnIp", hh.hostinfo.vpnIp).WithField("udpAddr", addr).
+			WithField("handshake", m{"stage": 0, "style": "ix_psk0"}).Error("Failed to send handshake message")
+	}
+}
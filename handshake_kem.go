@@ -0,0 +1,29 @@
+package nebula
+
+import "errors"
+
+// hybridKemName is logged for tunnels whose keys came from both X25519 and ML-KEM-768
+const hybridKemName = "x25519+mlkem768"
+
+var (
+	ErrKemNotOffered  = errors.New("the responder answered a hybrid key exchange we did not offer")
+	errKemUnsupported = errors.New("handshakes.hybrid_kem requires nebula to be built with go 1.24 or newer")
+)
+
+// kemKey is the initiators half of a hybrid key exchange. The initiator sends the encapsulation key in the first
+// handshake message, the responder encapsulates a secret to it and sends the ciphertext back encrypted in the second.
+// The secret is mixed into the tunnel keys alongside what noise arrived at so that recorded traffic stays safe as long
+// as either X25519 or ML-KEM holds up. Both halves are bound to the noise transcript, stripping the key from the first
+// message breaks the handshake.
+type kemKey interface {
+	EncapsulationKey() []byte
+	Decapsulate(ciphertext []byte) ([]byte, error)
+}
+
+// kemName is what handshake logs record for a tunnel
+func kemName(secret []byte) string {
+	if secret == nil {
+		return "none"
+	}
+	return hybridKemName
+}
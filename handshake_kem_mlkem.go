@@ -0,0 +1,38 @@
+//go:build go1.24
+
+package nebula
+
+import "crypto/mlkem"
+
+const kemSupported = true
+
+type mlkemKey struct {
+	dk *mlkem.DecapsulationKey768
+}
+
+func newKemKey() (kemKey, error) {
+	dk, err := mlkem.GenerateKey768()
+	if err != nil {
+		return nil, err
+	}
+	return &mlkemKey{dk: dk}, nil
+}
+
+func (k *mlkemKey) EncapsulationKey() []byte {
+	return k.dk.EncapsulationKey().Bytes()
+}
+
+func (k *mlkemKey) Decapsulate(ciphertext []byte) ([]byte, error) {
+	return k.dk.Decapsulate(ciphertext)
+}
+
+// kemEncapsulate is called by the responder, it returns the shared secret and the ciphertext to send back
+func kemEncapsulate(encapsulationKey []byte) ([]byte, []byte, error) {
+	ek, err := mlkem.NewEncapsulationKey768(encapsulationKey)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	secret, ciphertext := ek.Encapsulate()
+	return secret, ciphertext, nil
+}
@@ -0,0 +1,13 @@
+//go:build !go1.24
+
+package nebula
+
+const kemSupported = false
+
+func newKemKey() (kemKey, error) {
+	return nil, errKemUnsupported
+}
+
+func kemEncapsulate(encapsulationKey []byte) ([]byte, []byte, error) {
+	return nil, nil, errKemUnsupported
+}
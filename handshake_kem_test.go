@@ -0,0 +1,80 @@
+//go:build go1.24
+
+package nebula
+
+import (
+	"testing"
+
+	"github.com/flynn/noise"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHybridKem(t *testing.T) {
+	l := test.NewLogger()
+	cc := newTestCipherConfig(t, map[interface{}]interface{}{
+		"handshakes": map[interface{}]interface{}{"hybrid_kem": true},
+	})
+	assert.True(t, cc.kem)
+
+	doHandshake := func(tamper func(msg []byte) []byte) ([]byte, []byte, error) {
+		ic := NewConnectionState(l, "aes", newTestHandshakeCertState(t), true, noise.HandshakeIX, []byte{}, 0)
+		rc := NewConnectionState(l, "aes", newTestHandshakeCertState(t), false, noise.HandshakeIX, []byte{}, 0)
+
+		key, err := newKemKey()
+		require.NoError(t, err)
+		b, err := (&NebulaHandshake{Details: &NebulaHandshakeDetails{KemPublicKey: key.EncapsulationKey()}}).Marshal()
+		require.NoError(t, err)
+		msg, _, _, err := ic.H.WriteMessage(nil, b)
+		require.NoError(t, err)
+
+		msg = tamper(msg)
+
+		b, _, _, err = rc.H.ReadMessage(nil, msg)
+		require.NoError(t, err)
+		hs := &NebulaHandshake{}
+		require.NoError(t, hs.Unmarshal(b))
+
+		var rSecret, ct []byte
+		if len(hs.Details.KemPublicKey) > 0 {
+			rSecret, ct, err = kemEncapsulate(hs.Details.KemPublicKey)
+			require.NoError(t, err)
+		}
+
+		b, err = (&NebulaHandshake{Details: &NebulaHandshakeDetails{KemCiphertext: ct}}).Marshal()
+		require.NoError(t, err)
+		msg, _, _, err = rc.H.WriteMessage(nil, b)
+		require.NoError(t, err)
+
+		b, _, _, err = ic.H.ReadMessage(nil, msg)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		hs = &NebulaHandshake{}
+		require.NoError(t, hs.Unmarshal(b))
+		iSecret, err := key.Decapsulate(hs.Details.KemCiphertext)
+		return iSecret, rSecret, err
+	}
+
+	// Both sides arrive at the same secret
+	iSecret, rSecret, err := doHandshake(func(msg []byte) []byte { return msg })
+	require.NoError(t, err)
+	assert.Len(t, iSecret, 32)
+	assert.Equal(t, iSecret, rSecret)
+	assert.Equal(t, hybridKemName, kemName(iSecret))
+	assert.Equal(t, "none", kemName(nil))
+
+	// Stripping the key from the first message breaks the handshake instead of quietly falling back
+	_, _, err = doHandshake(func(msg []byte) []byte {
+		stripped, err := (&NebulaHandshake{Details: &NebulaHandshakeDetails{}}).Marshal()
+		require.NoError(t, err)
+		return append(append([]byte{}, msg[:64]...), stripped...)
+	})
+	assert.Error(t, err)
+
+	// A bad key is refused
+	_, _, err = kemEncapsulate([]byte("nope"))
+	assert.Error(t, err)
+}
@@ -6,8 +6,10 @@ import (
 	"crypto/rand"
 	"encoding/binary"
 	"errors"
+	"fmt"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/rcrowley/go-metrics"
@@ -38,6 +40,8 @@ type HandshakeConfig struct {
 	retries       int
 	triggerBuffer int
 	useRelays     bool
+	// guard rate limits and asks for cookies on incoming handshakes, nil when neither is configured
+	guard *handshakeGuard
 
 	messageMetrics *MessageMetrics
 }
@@ -62,6 +66,8 @@ type HandshakeManager struct {
 
 	// can be used to trigger outbound handshake for the given vpnIp
 	trigger chan iputil.VpnIp
+	// triggerHigh is the deepest the trigger queue has been
+	triggerHigh watermark
 }
 
 type HandshakeHostInfo struct {
@@ -72,6 +78,12 @@ type HandshakeHostInfo struct {
 	counter     int             // How many attempts have we made so far
 	lastRemotes []*udp.Addr     // Remotes that we sent to during the previous attempt
 	packetStore []*cachedPacket // A set of packets to be transmitted once the handshake completes
+	cookie      uint64          // The cookie a busy responder asked us to include, see handshake_cookie.go
+	trace       *span           // The root span of the handshake trace, nil unless it was sampled
+
+	// watch is set by the test-handshake ssh command to follow this handshake, it is an atomic since the command
+	// attaches it while holding the handshake manager lock
+	watch atomic.Pointer[handshakeWatch]
 
 	hostinfo *HostInfo
 }
@@ -144,9 +156,13 @@ func (hm *HandshakeManager) HandleIncoming(addr *udp.Addr, via *ViaSender, packe
 	}
 
 	switch h.Subtype {
-	case header.HandshakeIXPSK0:
+	case header.HandshakeIXPSK0, header.HandshakeIXPSK2:
 		switch h.MessageCounter {
 		case 1:
+			if addr != nil && !hm.config.guard.allow(addr, time.Now()) {
+				hm.l.WithField("udpAddr", addr).Debug("handshakes.rate_limit dropped incoming handshake")
+				return
+			}
 			ixHandshakeStage1(hm.f, addr, via, packet, h)
 
 		case 2:
@@ -156,6 +172,9 @@ func (hm *HandshakeManager) HandleIncoming(addr *udp.Addr, via *ViaSender, packe
 				hm.DeleteHostInfo(newHostinfo.hostinfo)
 			}
 		}
+
+	case header.HandshakeCookieReply:
+		ixHandshakeCookie(hm.f, addr, hm.queryIndex(h.RemoteIndex), packet)
 	}
 }
 
@@ -181,26 +200,33 @@ func (hm *HandshakeManager) handleOutbound(vpnIp iputil.VpnIp, lighthouseTrigger
 	hostinfo := hh.hostinfo
 	// If we are out of time, clean up
 	if hh.counter >= hm.config.retries {
-		hh.hostinfo.logger(hm.l).WithField("udpAddrs", hh.hostinfo.remotes.CopyAddrs(hm.mainHostMap.GetPreferredRanges())).
+		hh.hostinfo.logger(hm.l).WithField("udpAddrs", hh.hostinfo.remotes.CopyAddrs(hm.mainHostMap.GetPreferredRangesFor(hh.hostinfo))).
 			WithField("initiatorIndex", hh.hostinfo.localIndexId).
 			WithField("remoteIndex", hh.hostinfo.remoteIndexId).
 			WithField("handshake", m{"stage": 1, "style": "ix_psk0"}).
 			WithField("durationNs", time.Since(hh.startTime).Nanoseconds()).
 			Info("Handshake timed out")
 		hm.metricTimedOut.Inc(1)
+		hm.f.events.emit(hostEvent(TunnelEventHandshakeFailed, hostinfo, "timed out"))
+		hh.trace.fail("timed out")
+		hh.trace.end()
+		hh.watch.Load().finish(false, "handshake timed out after %d attempts", hh.counter)
 		hm.DeleteHostInfo(hostinfo)
 		return
 	}
 
 	// Increment the counter to increase our delay, linear backoff
 	hh.counter++
+	watch := hh.watch.Load()
 
 	// Check if we have a handshake packet to transmit yet
 	if !hh.ready {
 		if !ixHandshakeStage0(hm.f, hh) {
+			watch.step("attempt %d: failed to build the first handshake message, retrying", hh.counter)
 			hm.OutboundHandshakeTimer.Add(vpnIp, hm.config.tryInterval*time.Duration(hh.counter))
 			return
 		}
+		watch.step("built the first handshake message, %d bytes", len(hostinfo.HandshakePacket[0]))
 	}
 
 	// Get a remotes object if we don't already have one.
@@ -211,7 +237,7 @@ func (hm *HandshakeManager) handleOutbound(vpnIp iputil.VpnIp, lighthouseTrigger
 		hostinfo.remotes = hm.lightHouse.QueryCache(vpnIp)
 	}
 
-	remotes := hostinfo.remotes.CopyAddrs(hm.mainHostMap.GetPreferredRanges())
+	remotes := hostinfo.remotes.CopyAddrs(hm.mainHostMap.GetPreferredRangesFor(hostinfo))
 	remotesHaveChanged := !udp.AddrSlice(remotes).Equal(hh.lastRemotes)
 
 	// We only care about a lighthouse trigger if we have new remotes to send to.
@@ -222,6 +248,10 @@ func (hm *HandshakeManager) handleOutbound(vpnIp iputil.VpnIp, lighthouseTrigger
 	}
 
 	hh.lastRemotes = remotes
+	if lighthouseTriggered {
+		hh.trace.event("lighthouse.reply", traceAttr{"remotes", len(remotes)})
+		watch.step("lighthouse replied, candidate remotes are now %v", remotes)
+	}
 
 	// TODO: this will generate a load of queries for hosts with only 1 ip
 	// (such as ones registered to the lighthouse with only a private IP)
@@ -230,12 +260,25 @@ func (hm *HandshakeManager) handleOutbound(vpnIp iputil.VpnIp, lighthouseTrigger
 		// If we only have 1 remote it is highly likely our query raced with the other host registered within the lighthouse
 		// Our vpnIp here has a tunnel with a lighthouse but has yet to send a host update packet there so we only know about
 		// the learned public ip for them. Query again to short circuit the promotion counter
+		hh.trace.event("lighthouse.query")
+		watch.step("attempt %d: only %d candidate remotes, querying the lighthouses again", hh.counter, len(remotes))
 		hm.lightHouse.QueryServer(vpnIp)
 	}
 
+	// Udp may be blocked or throttled on the way, try the peer over the other underlay transports as well
+	skipUdp := false
+	for _, u := range hm.f.underlays {
+		if u.handshake(vpnIp, hh.counter, hostinfo.HandshakePacket[0], remotes) {
+			skipUdp = true
+		}
+	}
+
 	// Send the handshake to all known ips, stage 2 takes care of assigning the hostinfo.remote based on the first to reply
 	var sentTo []*udp.Addr
-	hostinfo.remotes.ForEach(hm.mainHostMap.GetPreferredRanges(), func(addr *udp.Addr, _ bool) {
+	hostinfo.remotes.ForEach(hm.mainHostMap.GetPreferredRangesFor(hostinfo), func(addr *udp.Addr, _ bool) {
+		if skipUdp {
+			return
+		}
 		hm.messageMetrics.Tx(header.Handshake, header.MessageSubType(hostinfo.HandshakePacket[0][1]), 1)
 		err := hm.outside.WriteTo(hostinfo.HandshakePacket[0], addr)
 		if err != nil {
@@ -249,6 +292,26 @@ func (hm *HandshakeManager) handleOutbound(vpnIp iputil.VpnIp, lighthouseTrigger
 		}
 	})
 
+	if hh.trace != nil {
+		hh.trace.event("handshake.sent",
+			traceAttr{"attempt", hh.counter},
+			traceAttr{"remotes", fmt.Sprint(sentTo)},
+			traceAttr{"underlay", skipUdp},
+		)
+	}
+
+	if watch != nil {
+		watch.sentTo(sentTo)
+		switch {
+		case skipUdp:
+			watch.step("attempt %d: sent over an underlay transport to %v", hh.counter, remotes)
+		case len(sentTo) > 0:
+			watch.step("attempt %d: sent to %v", hh.counter, sentTo)
+		default:
+			watch.step("attempt %d: no remotes to send to", hh.counter)
+		}
+	}
+
 	// Don't be too noisy or confusing if we fail to send a handshake - if we don't get through we'll eventually log a timeout,
 	// so only log when the list of remotes has changed
 	if remotesHaveChanged {
@@ -263,16 +326,28 @@ func (hm *HandshakeManager) handleOutbound(vpnIp iputil.VpnIp, lighthouseTrigger
 			Debug("Handshake message sent")
 	}
 
-	if hm.config.useRelays && len(hostinfo.remotes.relays) > 0 {
-		hostinfo.logger(hm.l).WithField("relays", hostinfo.remotes.relays).Info("Attempt to relay through hosts")
+	relays := hostinfo.remotes.relays
+	if rs := hm.f.relaySelector; rs != nil && len(relays) > 0 {
+		// Only go through the best of them
+		relays = rs.choose(relays, vpnIp)
+	}
+
+	if hm.config.useRelays && len(relays) > 0 {
+		hostinfo.logger(hm.l).WithField("relays", relays).Info("Attempt to relay through hosts")
+		if hh.trace != nil {
+			hh.trace.event("relay.request", traceAttr{"relays", fmt.Sprint(relays)})
+		}
+		watch.step("attempt %d: falling back to relays %v", hh.counter, relays)
 		// Send a RelayRequest to all known Relay IP's
-		for _, relay := range hostinfo.remotes.relays {
+		for _, relay := range relays {
 			// Don't relay to myself, and don't relay through the host I'm trying to connect to
 			if *relay == vpnIp || *relay == hm.lightHouse.myVpnIp {
+				watch.step("relay %s: skipped, it is this host or the peer", relay)
 				continue
 			}
 			relayHostInfo := hm.mainHostMap.QueryVpnIp(*relay)
 			if relayHostInfo == nil || relayHostInfo.remote == nil {
+				watch.step("relay %s: no tunnel to the relay yet, handshaking with it first", relay)
 				hostinfo.logger(hm.l).WithField("relay", relay.String()).Info("Establish tunnel to relay target")
 				hm.f.Handshake(*relay)
 				continue
@@ -281,17 +356,18 @@ func (hm *HandshakeManager) handleOutbound(vpnIp iputil.VpnIp, lighthouseTrigger
 			if existingRelay, ok := relayHostInfo.relayState.QueryRelayForByIp(vpnIp); ok {
 				switch existingRelay.State {
 				case Established:
+					watch.step("relay %s: relay is established, sent the handshake through it", relay)
 					hostinfo.logger(hm.l).WithField("relay", relay.String()).Info("Send handshake via relay")
 					hm.f.SendVia(relayHostInfo, existingRelay, hostinfo.HandshakePacket[0], make([]byte, 12), make([]byte, mtu), false)
 				case Requested:
+					watch.step("relay %s: relay was requested but not established yet, requesting it again", relay)
 					hostinfo.logger(hm.l).WithField("relay", relay.String()).Info("Re-send CreateRelay request")
 					// Re-send the CreateRelay request, in case the previous one was lost.
 					m := NebulaControl{
 						Type:                NebulaControl_CreateRelayRequest,
 						InitiatorRelayIndex: existingRelay.LocalIndex,
-						RelayFromIp:         uint32(hm.lightHouse.myVpnIp),
-						RelayToIp:           uint32(vpnIp),
 					}
+					m.setRelay(hm.lightHouse.myVpnIp, vpnIp)
 					msg, err := m.Marshal()
 					if err != nil {
 						hostinfo.logger(hm.l).
@@ -308,6 +384,7 @@ func (hm *HandshakeManager) handleOutbound(vpnIp iputil.VpnIp, lighthouseTrigger
 							Info("send CreateRelayRequest")
 					}
 				default:
+					watch.step("relay %s: relay is in unexpected state %v", relay, existingRelay.State)
 					hostinfo.logger(hm.l).
 						WithField("vpnIp", vpnIp).
 						WithField("state", existingRelay.State).
@@ -317,6 +394,7 @@ func (hm *HandshakeManager) handleOutbound(vpnIp iputil.VpnIp, lighthouseTrigger
 			} else {
 				// No relays exist or requested yet.
 				if relayHostInfo.remote != nil {
+					watch.step("relay %s: requesting a relay to the peer", relay)
 					idx, err := AddRelay(hm.l, relayHostInfo, hm.mainHostMap, vpnIp, nil, TerminalType, Requested)
 					if err != nil {
 						hostinfo.logger(hm.l).WithField("relay", relay.String()).WithError(err).Info("Failed to add relay to hostmap")
@@ -325,9 +403,8 @@ func (hm *HandshakeManager) handleOutbound(vpnIp iputil.VpnIp, lighthouseTrigger
 					m := NebulaControl{
 						Type:                NebulaControl_CreateRelayRequest,
 						InitiatorRelayIndex: idx,
-						RelayFromIp:         uint32(hm.lightHouse.myVpnIp),
-						RelayToIp:           uint32(vpnIp),
 					}
+					m.setRelay(hm.lightHouse.myVpnIp, vpnIp)
 					msg, err := m.Marshal()
 					if err != nil {
 						hostinfo.logger(hm.l).
@@ -354,16 +431,22 @@ func (hm *HandshakeManager) handleOutbound(vpnIp iputil.VpnIp, lighthouseTrigger
 }
 
 // GetOrHandshake will try to find a hostinfo with a fully formed tunnel or start a new handshake if one is not present
-// The 2nd argument will be true if the hostinfo is ready to transmit traffic
-func (hm *HandshakeManager) GetOrHandshake(vpnIp iputil.VpnIp, cacheCb func(*HandshakeHostInfo)) (*HostInfo, bool) {
-	hm.mainHostMap.RLock()
-	h, ok := hm.mainHostMap.Hosts[vpnIp]
-	hm.mainHostMap.RUnlock()
+// The 2nd argument will be true if the hostinfo is ready to transmit traffic. hosts is the calling read loop's cache of
+// the hostmap, nil if it has none.
+func (hm *HandshakeManager) GetOrHandshake(hosts *routineHosts, vpnIp iputil.VpnIp, cacheCb func(*HandshakeHostInfo)) (*HostInfo, bool) {
+	var h *HostInfo
+	if hosts != nil {
+		h = hosts.QueryVpnIp(vpnIp)
+	} else {
+		hm.mainHostMap.RLock()
+		h = hm.mainHostMap.unlockedQueryVpnIp(vpnIp)
+		hm.mainHostMap.RUnlock()
+	}
 
-	if ok {
+	if h != nil {
 		// Do not attempt promotion if you are a lighthouse
 		if !hm.lightHouse.amLighthouse {
-			h.TryPromoteBest(hm.mainHostMap.GetPreferredRanges(), hm.f)
+			h.TryPromoteBest(hm.mainHostMap, hm.f)
 		}
 		return h, true
 	}
@@ -397,9 +480,11 @@ func (hm *HandshakeManager) StartHandshake(vpnIp iputil.VpnIp, cacheCb func(*Han
 	hh := &HandshakeHostInfo{
 		hostinfo:  hostinfo,
 		startTime: time.Now(),
+		trace:     hm.f.tracer.startHandshake(vpnIp, true),
 	}
 	hm.vpnIps[vpnIp] = hh
 	hm.metricInitiated.Inc(1)
+	hm.f.events.emit(hostEvent(TunnelEventHandshakeStarted, hostinfo, ""))
 	hm.OutboundHandshakeTimer.Add(vpnIp, hm.config.tryInterval)
 
 	if cacheCb != nil {
@@ -417,11 +502,17 @@ func (hm *HandshakeManager) StartHandshake(vpnIp iputil.VpnIp, cacheCb func(*Han
 	if doTrigger {
 		select {
 		case hm.trigger <- vpnIp:
+			hm.triggerHigh.Observe(int64(len(hm.trigger)))
 		default:
 		}
 	}
 
 	hm.Unlock()
+	hh.trace.event("lighthouse.query")
+	if doTrigger {
+		hh.watch.Load().step("peer has static or calculated remotes, sending the first attempt right away")
+	}
+	hh.watch.Load().step("querying the lighthouses for the peer")
 	hm.lightHouse.QueryServer(vpnIp)
 	return hostinfo
 }
@@ -497,8 +588,9 @@ func (c *HandshakeManager) CheckAndComplete(hostinfo *HostInfo, handshakePacket
 
 // Complete is a simpler version of CheckAndComplete when we already know we
 // won't have a localIndexId collision because we already have an entry in the
-// pendingHostMap. An existing hostinfo is returned if there was one.
-func (hm *HandshakeManager) Complete(hostinfo *HostInfo, f *Interface) {
+// pendingHostMap. An existing hostinfo is returned if there was one. The hostinfo is added to the main hostmap as vpnIp,
+// which differs from the vpn ip it was pending as when we started the handshake with one of the host's other vpn ips.
+func (hm *HandshakeManager) Complete(hostinfo *HostInfo, vpnIp iputil.VpnIp, f *Interface) {
 	hm.mainHostMap.Lock()
 	defer hm.mainHostMap.Unlock()
 	hm.Lock()
@@ -515,6 +607,7 @@ func (hm *HandshakeManager) Complete(hostinfo *HostInfo, f *Interface) {
 
 	// We need to remove from the pending hostmap first to avoid undoing work when after to the main hostmap.
 	hm.unlockedDeleteHostInfo(hostinfo)
+	hostinfo.vpnIp = vpnIp
 	hm.mainHostMap.unlockedAddHostInfo(hostinfo, f)
 }
 
@@ -599,8 +692,8 @@ func (hm *HandshakeManager) queryIndex(index uint32) *HandshakeHostInfo {
 	return hm.indexes[index]
 }
 
-func (c *HandshakeManager) GetPreferredRanges() []*net.IPNet {
-	return c.mainHostMap.GetPreferredRanges()
+func (c *HandshakeManager) GetPreferredRangesFor(h *HostInfo) []*net.IPNet {
+	return c.mainHostMap.GetPreferredRangesFor(h)
 }
 
 func (c *HandshakeManager) ForEachVpnIp(f controlEach) {
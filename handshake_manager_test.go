@@ -32,7 +32,7 @@ func Test_NewHandshakeManagerVpnIp(t *testing.T) {
 	}
 
 	blah := NewHandshakeManager(l, mainHM, lh, &udp.NoopConn{}, defaultHandshakeConfig)
-	blah.f = &Interface{handshakeManager: blah, pki: &PKI{}, l: l}
+	blah.f = &Interface{handshakeManager: blah, hostMap: mainHM, pki: &PKI{}, ciphers: &cipherConfig{handshake: "aes", ciphers: []string{"aes"}}, l: l}
 	blah.f.pki.cs.Store(cs)
 
 	now := time.Now()
@@ -92,4 +92,8 @@ func (mw *mockEncWriter) SendMessageToHostInfo(t header.MessageType, st header.M
 	return
 }
 
+func (mw *mockEncWriter) SendHostUpdate(vpnIp iputil.VpnIp, p, nb, out []byte) {
+	return
+}
+
 func (mw *mockEncWriter) Handshake(vpnIP iputil.VpnIp) {}
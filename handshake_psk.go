@@ -0,0 +1,201 @@
+package nebula
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"sort"
+	"strings"
+
+	"github.com/flynn/noise"
+	"github.com/slackhq/nebula/cert"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/header"
+)
+
+// A group can require an out of band pre-shared key, handshakes.psk, for tunnels between its members on top of their
+// certificates. The keys of the groups both certificates carry are mixed into the handshake with the noise psk2
+// modifier, so the key feeds the tunnel keys and a certificate for the group, even one minted by a compromised CA, is
+// not enough to complete a tunnel. Hosts that share no such group handshake exactly as before.
+//
+// A psk2 handshake is sent with the ix_psk2 subtype. Its first message does not depend on the key, the responder reads
+// it to learn the initiators groups and then answers with the keys of the groups they share, or the public key of no
+// groups when they share none. The responder refuses an ix_psk0 handshake from a host it shares a group with.
+// The initiator only knows the responders groups from a previous tunnel, otherwise it guesses that the responder shares
+// all of its groups and when the response does not decrypt it tries the other combinations of its groups.
+
+var ErrHandshakePSKMismatch = errors.New("handshake did not use the handshakes.psk keys for the groups we share")
+
+// minHandshakePSKLen keeps keys from being guessable, `openssl rand -base64 32` is a good source
+const minHandshakePSKLen = 32
+
+type handshakePSKs struct {
+	// groups is sorted so both sides mix the keys in the same order
+	groups []string
+	keys   map[string][]byte
+}
+
+func newHandshakePSKsFromConfig(c *config.C) (*handshakePSKs, error) {
+	raw := c.GetMap("handshakes.psk", nil)
+	if len(raw) == 0 {
+		return nil, nil
+	}
+
+	p := &handshakePSKs{keys: map[string][]byte{}}
+	for k, v := range raw {
+		group := fmt.Sprintf("%v", k)
+		if strings.TrimSpace(group) == "" {
+			return nil, errors.New("handshakes.psk must not contain an empty group")
+		}
+
+		key, ok := v.(string)
+		if !ok || len(key) < minHandshakePSKLen {
+			return nil, fmt.Errorf("handshakes.psk.%s must be a key of at least %d characters", group, minHandshakePSKLen)
+		}
+
+		p.groups = append(p.groups, group)
+		p.keys[group] = []byte(key)
+	}
+
+	sort.Strings(p.groups)
+	return p, nil
+}
+
+// groupsFor returns the groups with a key that both certificates carry, theirs may be nil to guess with ours alone
+func (p *handshakePSKs) groupsFor(mine, theirs *cert.NebulaCertificate) []string {
+	if p == nil || mine == nil {
+		return nil
+	}
+
+	var groups []string
+	for _, g := range p.groups {
+		if _, ok := mine.Details.InvertedGroups[g]; !ok {
+			continue
+		}
+
+		if theirs != nil {
+			if _, ok := theirs.Details.InvertedGroups[g]; !ok {
+				continue
+			}
+		}
+
+		groups = append(groups, g)
+	}
+	return groups
+}
+
+// key derives the noise psk for groups, the key of no groups is public
+func (p *handshakePSKs) key(groups []string) []byte {
+	h := sha256.New()
+	h.Write([]byte("nebula handshakes.psk"))
+	for _, g := range groups {
+		writeLenPrefixed(h, []byte(g))
+		writeLenPrefixed(h, p.keys[g])
+	}
+	return h.Sum(nil)
+}
+
+// use mixes the keys of groups into a psk2 handshake
+func (p *handshakePSKs) use(ci *ConnectionState, groups []string) error {
+	ci.pskGroups = groups
+	return ci.H.SetPresharedKey(p.key(groups))
+}
+
+// candidates returns every combination of our groups a responder could have answered with
+func (p *handshakePSKs) candidates(mine *cert.NebulaCertificate) [][]string {
+	groups := p.groupsFor(mine, nil)
+
+	var out [][]string
+	for set := (1 << len(groups)) - 1; set >= 0; set-- {
+		var c []string
+		for i, g := range groups {
+			if set&(1<<i) != 0 {
+				c = append(c, g)
+			}
+		}
+		out = append(out, c)
+	}
+	return out
+}
+
+// retryStage2 reads the responders psk2 handshake message, which did not decrypt with the groups we guessed in stage 0,
+// with the other combinations of our groups. err is returned when none of them work.
+func (p *handshakePSKs) retryStage2(ci *ConnectionState, packet []byte, err error) ([]byte, *noise.CipherState, *noise.CipherState, error) {
+	guess := ci.pskGroups
+	for _, groups := range p.candidates(ci.myCert) {
+		if equalStrings(groups, guess) {
+			continue
+		}
+
+		if p.use(ci, groups) != nil {
+			continue
+		}
+
+		// A failed read leaves the handshake as it was so the next combination starts clean
+		msg, eKey, dKey, rerr := ci.H.ReadMessage(nil, packet)
+		if rerr == nil {
+			return msg, eKey, dKey, nil
+		}
+	}
+
+	// Put the guess back for the next response to try
+	_ = p.use(ci, guess)
+	return nil, nil, nil, err
+}
+
+// pskSubtype is the handshake subtype for a handshake with the keys of groups, without any it is a plain ix_psk0
+func pskSubtype(groups []string) header.MessageSubType {
+	if len(groups) == 0 {
+		return header.HandshakeIXPSK0
+	}
+	return header.HandshakeIXPSK2
+}
+
+// pskPlacement is where the noise psk is mixed into a handshake of subtype, ix_psk0 must not have the psk modifier
+func pskPlacement(subtype header.MessageSubType) int {
+	if subtype == header.HandshakeIXPSK2 {
+		return 2
+	}
+	return 0
+}
+
+func writeLenPrefixed(h hash.Hash, b []byte) {
+	var l [4]byte
+	binary.BigEndian.PutUint32(l[:], uint32(len(b)))
+	h.Write(l[:])
+	h.Write(b)
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func (f *Interface) reloadHandshakePSKs(c *config.C) {
+	if !c.InitialLoad() && !c.HasChanged("handshakes.psk") {
+		return
+	}
+
+	p, err := newHandshakePSKsFromConfig(c)
+	if err != nil {
+		f.l.WithError(err).Error("Failed to load handshakes.psk, keeping the previous keys")
+		return
+	}
+
+	f.psks.Store(p)
+	if p != nil {
+		f.l.WithField("groups", p.groups).Info("Tunnels within groups require pre-shared keys")
+	} else if !c.InitialLoad() {
+		f.l.Info("Tunnels no longer require pre-shared keys")
+	}
+}
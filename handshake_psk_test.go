@@ -0,0 +1,114 @@
+package nebula
+
+import (
+	"testing"
+
+	"github.com/flynn/noise"
+	"github.com/slackhq/nebula/cert"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/header"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	testPSKA = "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"
+	testPSKB = "bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb"
+)
+
+func TestNewHandshakePSKsFromConfig(t *testing.T) {
+	l := test.NewLogger()
+	c := config.NewC(l)
+
+	p, err := newHandshakePSKsFromConfig(c)
+	require.NoError(t, err)
+	assert.Nil(t, p)
+
+	c.Settings["handshakes"] = map[interface{}]interface{}{"psk": map[interface{}]interface{}{
+		"secure": testPSKA,
+		"db":     testPSKB,
+	}}
+	p, err = newHandshakePSKsFromConfig(c)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"db", "secure"}, p.groups)
+	assert.Equal(t, []byte(testPSKA), p.keys["secure"])
+
+	c.Settings["handshakes"] = map[interface{}]interface{}{"psk": map[interface{}]interface{}{"secure": "short"}}
+	_, err = newHandshakePSKsFromConfig(c)
+	assert.EqualError(t, err, "handshakes.psk.secure must be a key of at least 32 characters")
+
+	c.Settings["handshakes"] = map[interface{}]interface{}{"psk": map[interface{}]interface{}{" ": testPSKA}}
+	_, err = newHandshakePSKsFromConfig(c)
+	assert.EqualError(t, err, "handshakes.psk must not contain an empty group")
+}
+
+func TestHandshakePSKs_groupsFor(t *testing.T) {
+	p := &handshakePSKs{groups: []string{"db", "secure"}, keys: map[string][]byte{"db": []byte(testPSKB), "secure": []byte(testPSKA)}}
+	newCert := func(groups ...string) *cert.NebulaCertificate {
+		c := &cert.NebulaCertificate{Details: cert.NebulaCertificateDetails{InvertedGroups: map[string]struct{}{}}}
+		for _, g := range groups {
+			c.Details.InvertedGroups[g] = struct{}{}
+		}
+		return c
+	}
+
+	mine := newCert("secure", "db", "other")
+	assert.Equal(t, []string{"db", "secure"}, p.groupsFor(mine, nil))
+	assert.Equal(t, []string{"secure"}, p.groupsFor(mine, newCert("secure")))
+	assert.Empty(t, p.groupsFor(mine, newCert("other")))
+	assert.Empty(t, p.groupsFor(newCert("other"), nil))
+
+	var none *handshakePSKs
+	assert.Empty(t, none.groupsFor(mine, nil))
+
+	// The key of no groups is public, it has to be the same without any config
+	assert.Equal(t, p.key(nil), none.key(nil))
+	assert.Len(t, p.key([]string{"secure"}), 32)
+	assert.NotEqual(t, p.key(nil), p.key([]string{"secure"}))
+	assert.NotEqual(t, p.key([]string{"secure"}), p.key([]string{"db", "secure"}))
+
+	assert.Equal(t, [][]string{{"db", "secure"}, {"secure"}, {"db"}, nil}, p.candidates(mine))
+}
+
+func TestHandshakePSKs_retryStage2(t *testing.T) {
+	l := test.NewLogger()
+	group := func(groups ...string) *CertState {
+		cs := newTestHandshakeCertState(t)
+		cs.Certificate.Details.InvertedGroups = map[string]struct{}{}
+		for _, g := range groups {
+			cs.Certificate.Details.InvertedGroups[g] = struct{}{}
+		}
+		return cs
+	}
+
+	p := &handshakePSKs{groups: []string{"secure"}, keys: map[string][]byte{"secure": []byte(testPSKA)}}
+	initiator := group("secure")
+	responder := group()
+
+	// The initiator guesses the responder is in its group, the responder shares no group and answers with the key of
+	// no groups
+	ci := NewConnectionState(l, "chachapoly", initiator, true, noise.HandshakeIX, nil, pskPlacement(header.HandshakeIXPSK2))
+	require.NoError(t, p.use(ci, p.groupsFor(initiator.Certificate, nil)))
+	msg1, _, _, err := ci.H.WriteMessage(nil, []byte("hello"))
+	require.NoError(t, err)
+
+	r := NewConnectionState(l, "chachapoly", responder, false, noise.HandshakeIX, nil, pskPlacement(header.HandshakeIXPSK2))
+	msg, _, _, err := r.H.ReadMessage(nil, msg1)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("hello"), msg)
+	require.NoError(t, p.use(r, p.groupsFor(responder.Certificate, initiator.Certificate)))
+	msg2, _, _, err := r.H.WriteMessage(nil, []byte("hi"))
+	require.NoError(t, err)
+
+	_, _, _, err = ci.H.ReadMessage(nil, msg2)
+	require.Error(t, err)
+
+	assert.Equal(t, []string{"secure"}, ci.pskGroups)
+	msg, eKey, dKey, err := p.retryStage2(ci, msg2, assert.AnError)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("hi"), msg)
+	assert.NotNil(t, eKey)
+	assert.NotNil(t, dKey)
+	assert.Empty(t, ci.pskGroups)
+}
@@ -0,0 +1,112 @@
+package nebula
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/slackhq/nebula/udp"
+)
+
+// handshakeWatchSteps is how many steps a watch holds for a slow reader before it starts dropping them
+const handshakeWatchSteps = 256
+
+// handshakeWatch follows a handshake we initiated for the test-handshake ssh command. The handshake manager reports
+// every step to it, the ssh session reads them from steps until done is closed. Every method is a no-op on a nil watch
+// so the handshake code does not need to check for one.
+type handshakeWatch struct {
+	start time.Time
+	steps chan string
+	done  chan struct{}
+
+	lock     sync.Mutex
+	sent     map[string]struct{}
+	finished bool
+	ok       bool
+	dropped  int
+}
+
+func newHandshakeWatch() *handshakeWatch {
+	return &handshakeWatch{
+		start: time.Now(),
+		steps: make(chan string, handshakeWatchSteps),
+		done:  make(chan struct{}),
+		sent:  map[string]struct{}{},
+	}
+}
+
+// step reports a step of the handshake, prefixed with the time since the watch started
+func (w *handshakeWatch) step(format string, args ...interface{}) {
+	if w == nil {
+		return
+	}
+
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.addStep(format, args...)
+}
+
+// addStep must be called with the lock held
+func (w *handshakeWatch) addStep(format string, args ...interface{}) {
+	if w.finished {
+		return
+	}
+
+	msg := fmt.Sprintf("%8s  %s", time.Since(w.start).Round(time.Millisecond), fmt.Sprintf(format, args...))
+	select {
+	case w.steps <- msg:
+	default:
+		w.dropped++
+	}
+}
+
+// sentTo remembers the addresses a handshake attempt went to, a reply from anywhere else came through the nat of the
+// peer or was punched through
+func (w *handshakeWatch) sentTo(addrs []*udp.Addr) {
+	if w == nil {
+		return
+	}
+
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	for _, addr := range addrs {
+		w.sent[addr.String()] = struct{}{}
+	}
+}
+
+// wasSentTo reports if a handshake attempt went to addr
+func (w *handshakeWatch) wasSentTo(addr *udp.Addr) bool {
+	if w == nil || addr == nil {
+		return false
+	}
+
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	_, ok := w.sent[addr.String()]
+	return ok
+}
+
+// finish reports the last step of the handshake and wakes up the reader, only the first call does anything
+func (w *handshakeWatch) finish(ok bool, format string, args ...interface{}) {
+	if w == nil {
+		return
+	}
+
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.finished {
+		return
+	}
+
+	w.addStep(format, args...)
+	w.finished = true
+	w.ok = ok
+	close(w.done)
+}
+
+// result reports if the handshake finished and if it succeeded, along with how many steps were dropped
+func (w *handshakeWatch) result() (finished bool, ok bool, dropped int) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return w.finished, w.ok, w.dropped
+}
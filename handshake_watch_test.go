@@ -0,0 +1,141 @@
+package nebula
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/slackhq/nebula/cert"
+	"github.com/slackhq/nebula/iputil"
+	"github.com/slackhq/nebula/test"
+	"github.com/slackhq/nebula/udp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHandshakeWatch_NilSafe(t *testing.T) {
+	var w *handshakeWatch
+	w.step("nothing %d", 1)
+	w.sentTo([]*udp.Addr{udp.NewAddr(net.ParseIP("1.2.3.4"), 4242)})
+	w.finish(true, "done")
+	assert.False(t, w.wasSentTo(udp.NewAddr(net.ParseIP("1.2.3.4"), 4242)))
+}
+
+func TestHandshakeWatch(t *testing.T) {
+	w := newHandshakeWatch()
+	addr := udp.NewAddr(net.ParseIP("1.2.3.4"), 4242)
+
+	w.sentTo([]*udp.Addr{addr})
+	assert.True(t, w.wasSentTo(udp.NewAddr(net.ParseIP("1.2.3.4"), 4242)))
+	assert.False(t, w.wasSentTo(udp.NewAddr(net.ParseIP("1.2.3.4"), 4243)))
+	assert.False(t, w.wasSentTo(nil))
+
+	w.step("attempt %d", 1)
+	w.finish(false, "failed: %s", "boom")
+	w.finish(true, "ignored")
+	w.step("ignored")
+
+	select {
+	case <-w.done:
+	default:
+		t.Fatal("finish did not close done")
+	}
+
+	finished, ok, dropped := w.result()
+	assert.True(t, finished)
+	assert.False(t, ok)
+	assert.Zero(t, dropped)
+
+	require.Len(t, w.steps, 2)
+	assert.True(t, strings.HasSuffix(<-w.steps, "  attempt 1"))
+	assert.True(t, strings.HasSuffix(<-w.steps, "  failed: boom"))
+
+	// Steps are dropped instead of blocking the handshake when nobody reads them
+	w = newHandshakeWatch()
+	for i := 0; i < handshakeWatchSteps+3; i++ {
+		w.step("step %d", i)
+	}
+	_, _, dropped = w.result()
+	assert.Equal(t, 3, dropped)
+}
+
+func newTestWatchHandshakeManager() (*HandshakeManager, iputil.VpnIp) {
+	l := test.NewLogger()
+	_, vpncidr, _ := net.ParseCIDR("172.1.1.1/24")
+	mainHM := newHostMap(l, vpncidr)
+	preferredRanges := []*net.IPNet{}
+	mainHM.preferredRanges.Store(&preferredRanges)
+
+	hm := NewHandshakeManager(l, mainHM, newTestLighthouse(), &udp.NoopConn{}, defaultHandshakeConfig)
+	hm.f = &Interface{handshakeManager: hm, hostMap: mainHM, pki: &PKI{}, ciphers: &cipherConfig{handshake: "aes", ciphers: []string{"aes"}}, l: l}
+	hm.f.pki.cs.Store(&CertState{Certificate: &cert.NebulaCertificate{}})
+	hm.f.myVpnIps = []iputil.VpnIp{iputil.Ip2VpnIp(net.ParseIP("172.1.1.1"))}
+
+	return hm, iputil.Ip2VpnIp(net.ParseIP("172.1.1.2"))
+}
+
+func TestHandshakeManager_Watch(t *testing.T) {
+	hm, ip := newTestWatchHandshakeManager()
+	now := time.Now()
+	hm.NextOutboundHandshakeTimerTick(now)
+
+	w := newHandshakeWatch()
+	hm.StartHandshake(ip, func(hh *HandshakeHostInfo) {
+		hh.watch.Store(w)
+	})
+
+	for i := 1; i <= DefaultHandshakeRetries+1; i++ {
+		now = now.Add(time.Duration(i) * DefaultHandshakeTryInterval)
+		hm.NextOutboundHandshakeTimerTick(now)
+	}
+	hm.NextOutboundHandshakeTimerTick(now.Add(time.Minute))
+
+	finished, ok, _ := w.result()
+	assert.True(t, finished)
+	assert.False(t, ok)
+
+	var steps []string
+	for len(w.steps) > 0 {
+		steps = append(steps, <-w.steps)
+	}
+	require.NotEmpty(t, steps)
+	assert.Contains(t, steps[0], "querying the lighthouses for the peer")
+	assert.Contains(t, steps[len(steps)-1], "handshake timed out after 10 attempts")
+}
+
+func TestSSHTestHandshake(t *testing.T) {
+	hm, ip := newTestWatchHandshakeManager()
+	w := &testStringWriter{}
+
+	require.NoError(t, sshTestHandshake(hm.f, &sshTestHandshakeFlags{}, nil, w))
+	assert.Equal(t, "No vpn ip was provided\n", w.String())
+
+	w.Reset()
+	require.NoError(t, sshTestHandshake(hm.f, &sshTestHandshakeFlags{}, []string{"nope"}, w))
+	assert.Equal(t, "The provided vpn ip could not be parsed: nope\n", w.String())
+
+	w.Reset()
+	require.NoError(t, sshTestHandshake(hm.f, &sshTestHandshakeFlags{}, []string{"172.1.1.1"}, w))
+	assert.Equal(t, "Can not handshake with ourselves\n", w.String())
+
+	// Nothing drives the handshake forward here, the command gives up after -t
+	w.Reset()
+	require.NoError(t, sshTestHandshake(hm.f, &sshTestHandshakeFlags{Timeout: 10 * time.Millisecond}, []string{ip.String()}, w))
+	lines := strings.Split(strings.TrimSpace(w.String()), "\n")
+	require.Len(t, lines, 2)
+	assert.Contains(t, lines[0], "querying the lighthouses for the peer")
+	assert.Equal(t, "Gave up waiting for the handshake after 10ms", lines[1])
+
+	// The first session let go of the pending handshake when it gave up
+	w.Reset()
+	require.NoError(t, sshTestHandshake(hm.f, &sshTestHandshakeFlags{Timeout: 10 * time.Millisecond}, []string{ip.String()}, w))
+	assert.Equal(t, "A handshake with 172.1.1.2 is already in progress, following it\n"+
+		"Gave up waiting for the handshake after 10ms\n", w.String())
+
+	w.Reset()
+	hm.queryVpnIp(ip).watch.Store(newHandshakeWatch())
+	require.NoError(t, sshTestHandshake(hm.f, &sshTestHandshakeFlags{Timeout: 10 * time.Millisecond}, []string{ip.String()}, w))
+	assert.Equal(t, "A handshake with 172.1.1.2 is already in progress, following it\n"+
+		"The handshake with 172.1.1.2 is already being followed by another session\n", w.String())
+}
@@ -55,20 +55,28 @@ const (
 )
 
 const (
-	TestRequest MessageSubType = 0
-	TestReply   MessageSubType = 1
+	TestRequest     MessageSubType = 0
+	TestReply       MessageSubType = 1
+	TestDiagRequest MessageSubType = 2
+	TestDiagReply   MessageSubType = 3
 )
 
 const (
 	HandshakeIXPSK0 MessageSubType = 0
 	HandshakeXXPSK0 MessageSubType = 1
+	// HandshakeCookieReply asks the initiator to start over with a cookie, it is not a noise message
+	HandshakeCookieReply MessageSubType = 2
+	// HandshakeIXPSK2 is HandshakeIXPSK0 with the noise psk2 modifier, used when a handshake mixes in pre-shared keys
+	HandshakeIXPSK2 MessageSubType = 3
 )
 
 var ErrHeaderTooShort = errors.New("header is too short")
 
 var subTypeTestMap = map[MessageSubType]string{
-	TestRequest: "testRequest",
-	TestReply:   "testReply",
+	TestRequest:     "testRequest",
+	TestReply:       "testReply",
+	TestDiagRequest: "testDiagRequest",
+	TestDiagReply:   "testDiagReply",
 }
 
 var subTypeNoneMap = map[MessageSubType]string{0: "none"}
@@ -83,7 +91,9 @@ var subTypeMap = map[MessageType]*map[MessageSubType]string{
 	Test:        &subTypeTestMap,
 	CloseTunnel: &subTypeNoneMap,
 	Handshake: {
-		HandshakeIXPSK0: "ix_psk0",
+		HandshakeIXPSK0:      "ix_psk0",
+		HandshakeCookieReply: "cookie_reply",
+		HandshakeIXPSK2:      "ix_psk2",
 	},
 	Control: &subTypeNoneMap,
 }
@@ -95,7 +95,9 @@ func TestTypeMap(t *testing.T) {
 		Test:        &subTypeTestMap,
 		CloseTunnel: &subTypeNoneMap,
 		Handshake: {
-			HandshakeIXPSK0: "ix_psk0",
+			HandshakeIXPSK0:      "ix_psk0",
+			HandshakeCookieReply: "cookie_reply",
+			HandshakeIXPSK2:      "ix_psk2",
 		},
 		Control: &subTypeNoneMap,
 	}, subTypeMap)
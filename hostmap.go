@@ -53,14 +53,21 @@ type Relay struct {
 }
 
 type HostMap struct {
-	sync.RWMutex    //Because we concurrently read and write to our maps
-	Indexes         map[uint32]*HostInfo
-	Relays          map[uint32]*HostInfo // Maps a Relay IDX to a Relay HostInfo object
-	RemoteIndexes   map[uint32]*HostInfo
-	Hosts           map[iputil.VpnIp]*HostInfo
+	sync.RWMutex  //Because we concurrently read and write to our maps
+	Indexes       map[uint32]*HostInfo
+	Relays        map[uint32]*HostInfo // Maps a Relay IDX to a Relay HostInfo object
+	RemoteIndexes map[uint32]*HostInfo
+	Hosts         map[iputil.VpnIp]*HostInfo
+	// Aliases maps the other vpn ips in a host's certificate to the vpn ip it is known by in Hosts, its first
+	Aliases         map[iputil.VpnIp]iputil.VpnIp
 	preferredRanges atomic.Pointer[[]*net.IPNet]
-	vpnCIDR         *net.IPNet
-	l               *logrus.Logger
+	// preferredRangesFor are the preferred_ranges_for rules, see GetPreferredRangesFor
+	preferredRangesFor atomic.Pointer[[]preferredRangesRule]
+	vpnCIDR            *net.IPNet
+	l                  *logrus.Logger
+
+	// gen is bumped every time the write lock is released, see routineHosts
+	gen atomic.Uint64
 }
 
 // For synchronization, treat the pointed-to Relay struct as immutable. To edit the Relay
@@ -138,7 +145,7 @@ func (rs *RelayState) RemoveRelay(localIdx uint32) (iputil.VpnIp, bool) {
 	defer rs.Unlock()
 	r, ok := rs.relayForByIdx[localIdx]
 	if !ok {
-		return iputil.VpnIp(0), false
+		return iputil.VpnIp{}, false
 	}
 	delete(rs.relayForByIdx, localIdx)
 	delete(rs.relayForByIp, r.PeerIp)
@@ -205,7 +212,7 @@ type HostInfo struct {
 	localIndexId    uint32
 	vpnIp           iputil.VpnIp
 	recvError       atomic.Uint32
-	remoteCidr      *cidr.Tree4[struct{}]
+	remoteCidr      *cidr.Tree6[struct{}]
 	relayState      RelayState
 
 	// HandshakePacket records the packets used to create this hostinfo
@@ -229,6 +236,20 @@ type HostInfo struct {
 	lastRoam       time.Time
 	lastRoamRemote *udp.Addr
 
+	// rtt is measured by the connection manager's test packets and sizes its wait for a reply
+	rtt rttEstimator
+
+	// pmtu is the largest inner packet the path to this host carries, 0 until pmtud has probed it. pmtuProbed is when
+	// it was last probed in unix nanoseconds, it is cleared when the remote changes so the new path is probed.
+	pmtu       atomic.Int32
+	pmtuProbed atomic.Int64
+
+	// multipath are the paths multipath probes for this host, nil when it is disabled
+	multipath atomic.Pointer[multipathPaths]
+
+	// spraying is set while keepalives are spraying path probes to every remote, the first reply locks onto its path
+	spraying atomic.Bool
+
 	// Used to track other hostinfos for this vpn ip since only 1 can be primary
 	// Synchronised via hostmap lock and not the hostinfo lock.
 	next, prev *HostInfo
@@ -275,6 +296,7 @@ func newHostMap(l *logrus.Logger, vpnCIDR *net.IPNet) *HostMap {
 		Relays:        map[uint32]*HostInfo{},
 		RemoteIndexes: map[uint32]*HostInfo{},
 		Hosts:         map[iputil.VpnIp]*HostInfo{},
+		Aliases:       map[iputil.VpnIp]iputil.VpnIp{},
 		vpnCIDR:       vpnCIDR,
 		l:             l,
 	}
@@ -301,6 +323,8 @@ func (hm *HostMap) reload(c *config.C, initial bool) {
 			hm.l.WithField("oldPreferredRanges", *oldRanges).WithField("newPreferredRanges", preferredRanges).Info("preferred_ranges changed")
 		}
 	}
+
+	hm.reloadPreferredRangesFor(c, initial)
 }
 
 // EmitStats reports host, index, and relay counts to the stats collection system
@@ -318,6 +342,13 @@ func (hm *HostMap) EmitStats() {
 	metrics.GetOrRegisterGauge("hostmap.main.relayIndexes", nil).Update(int64(relaysLen))
 }
 
+// relayIndexCount is how many relay indexes are in use, for a relay the load it carries
+func (hm *HostMap) relayIndexCount() int {
+	hm.RLock()
+	defer hm.RUnlock()
+	return len(hm.Relays)
+}
+
 func (hm *HostMap) RemoveRelay(localIdx uint32) {
 	hm.Lock()
 	_, ok := hm.Relays[localIdx]
@@ -386,6 +417,8 @@ func (hm *HostMap) unlockedDeleteHostInfo(hostinfo *HostInfo) {
 			hm.Hosts[hostinfo.vpnIp] = hostinfo.next
 			// It is primary, there is no previous hostinfo now
 			hostinfo.next.prev = nil
+		} else {
+			hm.unlockedDeleteAliases(hostinfo)
 		}
 
 	} else {
@@ -428,6 +461,12 @@ func (hm *HostMap) unlockedDeleteHostInfo(hostinfo *HostInfo) {
 	}
 }
 
+// Unlock releases the write lock, the maps may have changed so the routine caches of them are invalidated
+func (hm *HostMap) Unlock() {
+	hm.gen.Add(1)
+	hm.RWMutex.Unlock()
+}
+
 func (hm *HostMap) QueryIndex(index uint32) *HostInfo {
 	hm.RLock()
 	if h, ok := hm.Indexes[index]; ok {
@@ -485,11 +524,11 @@ func (hm *HostMap) QueryVpnIpRelayFor(targetIp, relayHostIp iputil.VpnIp) (*Host
 
 func (hm *HostMap) queryVpnIp(vpnIp iputil.VpnIp, promoteIfce *Interface) *HostInfo {
 	hm.RLock()
-	if h, ok := hm.Hosts[vpnIp]; ok {
+	if h := hm.unlockedQueryVpnIp(vpnIp); h != nil {
 		hm.RUnlock()
 		// Do not attempt promotion if you are a lighthouse
 		if promoteIfce != nil && !promoteIfce.lightHouse.amLighthouse {
-			h.TryPromoteBest(hm.GetPreferredRanges(), promoteIfce)
+			h.TryPromoteBest(hm, promoteIfce)
 		}
 		return h
 
@@ -499,16 +538,81 @@ func (hm *HostMap) queryVpnIp(vpnIp iputil.VpnIp, promoteIfce *Interface) *HostI
 	return nil
 }
 
+// unlockedQueryVpnIp returns the primary hostinfo for vpnIp, which may be any of the vpn ips in the host's certificate
+func (hm *HostMap) unlockedQueryVpnIp(vpnIp iputil.VpnIp) *HostInfo {
+	if h, ok := hm.Hosts[vpnIp]; ok {
+		return h
+	}
+
+	if primary, ok := hm.Aliases[vpnIp]; ok {
+		return hm.Hosts[primary]
+	}
+
+	return nil
+}
+
+// primaryVpnIp returns the vpn ip the host with vpnIp in its certificate is known by, vpnIp if it is not an alias
+func (hm *HostMap) primaryVpnIp(vpnIp iputil.VpnIp) iputil.VpnIp {
+	hm.RLock()
+	defer hm.RUnlock()
+	if primary, ok := hm.Aliases[vpnIp]; ok {
+		return primary
+	}
+	return vpnIp
+}
+
+// certSubnets returns the unsafe networks in the certificate of the host with vpnIp, nil if there is no tunnel with it
+func (hm *HostMap) certSubnets(vpnIp iputil.VpnIp) []*net.IPNet {
+	hostinfo := hm.QueryVpnIp(vpnIp)
+	if hostinfo == nil {
+		return nil
+	}
+
+	crt := hostinfo.GetCert()
+	if crt == nil {
+		return nil
+	}
+	return crt.Details.Subnets
+}
+
+// unlockedAddAliases points the other vpn ips in the hostinfo's certificate at its vpn ip
+func (hm *HostMap) unlockedAddAliases(hostinfo *HostInfo) {
+	if hostinfo.ConnectionState == nil || hostinfo.ConnectionState.peerCert == nil {
+		return
+	}
+
+	for _, ip := range hostinfo.ConnectionState.peerCert.Details.Ips {
+		alias := iputil.Ip2VpnIp(ip.IP)
+		if alias != hostinfo.vpnIp {
+			hm.Aliases[alias] = hostinfo.vpnIp
+		}
+	}
+}
+
+// unlockedDeleteAliases removes the aliases of the hostinfo's certificate that still point at its vpn ip
+func (hm *HostMap) unlockedDeleteAliases(hostinfo *HostInfo) {
+	if hostinfo.ConnectionState == nil || hostinfo.ConnectionState.peerCert == nil {
+		return
+	}
+
+	for _, ip := range hostinfo.ConnectionState.peerCert.Details.Ips {
+		alias := iputil.Ip2VpnIp(ip.IP)
+		if hm.Aliases[alias] == hostinfo.vpnIp {
+			delete(hm.Aliases, alias)
+		}
+	}
+}
+
 // unlockedAddHostInfo assumes you have a write-lock and will add a hostinfo object to the hostmap Indexes and RemoteIndexes maps.
 // If an entry exists for the Hosts table (vpnIp -> hostinfo) then the provided hostinfo will be made primary
 func (hm *HostMap) unlockedAddHostInfo(hostinfo *HostInfo, f *Interface) {
 	if f.serveDns {
-		remoteCert := hostinfo.ConnectionState.peerCert
-		dnsR.Add(remoteCert.Details.Name+".", remoteCert.Details.Ips[0].IP.String())
+		dnsR.AddCert(hostinfo.ConnectionState.peerCert)
 	}
 
 	existing := hm.Hosts[hostinfo.vpnIp]
 	hm.Hosts[hostinfo.vpnIp] = hostinfo
+	hm.unlockedAddAliases(hostinfo)
 
 	if existing != nil {
 		hostinfo.next = existing
@@ -560,10 +664,11 @@ func (hm *HostMap) ForEachIndex(f controlEach) {
 
 // TryPromoteBest handles re-querying lighthouses and probing for better paths
 // NOTE: It is an error to call this if you are a lighthouse since they should not roam clients!
-func (i *HostInfo) TryPromoteBest(preferredRanges []*net.IPNet, ifce *Interface) {
+func (i *HostInfo) TryPromoteBest(hm *HostMap, ifce *Interface) {
 	c := i.promoteCounter.Add(1)
 	if c%ifce.tryPromoteEvery.Load() == 0 {
 		remote := i.remote
+		preferredRanges := hm.GetPreferredRangesFor(i)
 
 		// return early if we are already on a preferred remote
 		if remote != nil {
@@ -610,6 +715,7 @@ func (i *HostInfo) SetRemote(remote *udp.Addr) {
 	if !i.remote.Equals(remote) {
 		i.remote = remote.Copy()
 		i.remotes.LearnRemote(i.vpnIp, remote.Copy())
+		i.pmtuProbed.Store(0)
 	}
 }
 
@@ -629,7 +735,7 @@ func (i *HostInfo) SetRemoteIfPreferred(hm *HostMap, newRemote *udp.Addr) bool {
 	// NOTE: We do this loop here instead of calling `isPreferred` in
 	// remote_list.go so that we only have to loop over preferredRanges once.
 	newIsPreferred := false
-	for _, l := range hm.GetPreferredRanges() {
+	for _, l := range hm.GetPreferredRangesFor(i) {
 		// return early if we are already on a preferred remote
 		if l.Contains(currentRemote.IP) {
 			return false
@@ -666,9 +772,9 @@ func (i *HostInfo) CreateRemoteCIDR(c *cert.NebulaCertificate) {
 		return
 	}
 
-	remoteCidr := cidr.NewTree4[struct{}]()
+	remoteCidr := cidr.NewTree6[struct{}]()
 	for _, ip := range c.Details.Ips {
-		remoteCidr.AddCIDR(&net.IPNet{IP: ip.IP, Mask: net.IPMask{255, 255, 255, 255}}, struct{}{})
+		remoteCidr.AddCIDR(hostIPNet(ip.IP), struct{}{})
 	}
 
 	for _, n := range c.Details.Subnets {
@@ -677,6 +783,33 @@ func (i *HostInfo) CreateRemoteCIDR(c *cert.NebulaCertificate) {
 	i.remoteCidr = remoteCidr
 }
 
+// certVpnIps returns the vpn ips in the certificate, the first is the one the host is known by
+func certVpnIps(c *cert.NebulaCertificate) []iputil.VpnIp {
+	ips := make([]iputil.VpnIp, len(c.Details.Ips))
+	for i, ip := range c.Details.Ips {
+		ips[i] = iputil.Ip2VpnIp(ip.IP)
+	}
+	return ips
+}
+
+// certHasVpnIp is true if vpnIp is any of the vpn ips in the certificate
+func certHasVpnIp(c *cert.NebulaCertificate, vpnIp iputil.VpnIp) bool {
+	for _, ip := range c.Details.Ips {
+		if iputil.Ip2VpnIp(ip.IP) == vpnIp {
+			return true
+		}
+	}
+	return false
+}
+
+// hostIPNet returns the network of just ip, a /32 for ipv4 and a /128 for ipv6
+func hostIPNet(ip net.IP) *net.IPNet {
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}
+}
+
 func (i *HostInfo) logger(l *logrus.Logger) *logrus.Entry {
 	if i == nil {
 		return logrus.NewEntry(l)
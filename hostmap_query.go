@@ -0,0 +1,210 @@
+package nebula
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+)
+
+// HostmapQuery filters, sorts, and pages a hostmap listing. The zero value lists every established tunnel sorted by
+// vpn ip.
+type HostmapQuery struct {
+	// State is established (the default), handshaking, or all
+	State string
+	// ByIndex lists every hostinfo by local index instead of only the primary hostinfo for each vpn ip
+	ByIndex bool
+	// Group only lists hosts with a certificate in this group
+	Group string
+	// Name only lists hosts with a certificate name matching this glob, see path.Match
+	Name string
+	// Relay is direct, relayed (the host is reached through a relay), or relaying (this node relays for the host),
+	// empty lists all
+	Relay string
+	// Sort is vpnip (the default), name, or index
+	Sort string
+	// Offset skips this many matching hosts
+	Offset int
+	// Limit is the most hosts to return, 0 for no limit
+	Limit int
+}
+
+// HostmapPage is a page of hosts matching a HostmapQuery
+type HostmapPage struct {
+	Hosts []ControlHostInfo `json:"hosts"`
+	// Total is the number of hosts that matched before paging
+	Total  int `json:"total"`
+	Offset int `json:"offset"`
+}
+
+func (q *HostmapQuery) validate() error {
+	switch q.State {
+	case "", "established", "handshaking", "all":
+	default:
+		return fmt.Errorf("invalid state %q, must be established, handshaking, or all", q.State)
+	}
+
+	switch q.Relay {
+	case "", "direct", "relayed", "relaying":
+	default:
+		return fmt.Errorf("invalid relay %q, must be direct, relayed, or relaying", q.Relay)
+	}
+
+	switch q.Sort {
+	case "", "vpnip", "name", "index":
+	default:
+		return fmt.Errorf("invalid sort %q, must be vpnip, name, or index", q.Sort)
+	}
+
+	if q.Name != "" {
+		if _, err := path.Match(q.Name, ""); err != nil {
+			return fmt.Errorf("invalid name pattern %q: %s", q.Name, err)
+		}
+	}
+
+	if q.Offset < 0 || q.Limit < 0 {
+		return fmt.Errorf("offset and limit must not be negative")
+	}
+
+	return nil
+}
+
+func (q *HostmapQuery) match(h *HostInfo) bool {
+	if q.Group != "" || q.Name != "" {
+		c := h.GetCert()
+		if c == nil {
+			return false
+		}
+
+		if q.Group != "" {
+			if _, ok := c.Details.InvertedGroups[q.Group]; !ok {
+				return false
+			}
+		}
+
+		if q.Name != "" {
+			if ok, _ := path.Match(q.Name, c.Details.Name); !ok {
+				return false
+			}
+		}
+	}
+
+	switch q.Relay {
+	case "direct":
+		return len(h.relayState.CopyRelayIps()) == 0 && len(h.relayState.CopyRelayForIps()) == 0
+	case "relayed":
+		return len(h.relayState.CopyRelayIps()) > 0
+	case "relaying":
+		return len(h.relayState.CopyRelayForIps()) > 0
+	}
+
+	return true
+}
+
+// queryHostmap runs the query against the established and handshaking host lists. The hostmap locks are only held
+// while collecting hostinfo pointers, filtering, sorting, and copying happen after so a large listing does not stall
+// the data path.
+func queryHostmap(q HostmapQuery, established, handshaking controlHostLister) (*HostmapPage, error) {
+	if err := q.validate(); err != nil {
+		return nil, err
+	}
+
+	var listers []controlHostLister
+	switch q.State {
+	case "", "established":
+		listers = []controlHostLister{established}
+	case "handshaking":
+		listers = []controlHostLister{handshaking}
+	case "all":
+		listers = []controlHostLister{established, handshaking}
+	}
+
+	var hosts []*HostInfo
+	collect := func(h *HostInfo) {
+		hosts = append(hosts, h)
+	}
+
+	for _, hl := range listers {
+		if q.ByIndex {
+			hl.ForEachIndex(collect)
+		} else {
+			hl.ForEachVpnIp(collect)
+		}
+	}
+
+	matched := hosts[:0]
+	for _, h := range hosts {
+		if q.match(h) {
+			matched = append(matched, h)
+		}
+	}
+
+	sortHostInfos(matched, q.Sort)
+
+	page := &HostmapPage{Hosts: []ControlHostInfo{}, Total: len(matched), Offset: q.Offset}
+	if q.Offset >= len(matched) {
+		return page, nil
+	}
+
+	matched = matched[q.Offset:]
+	if q.Limit > 0 && q.Limit < len(matched) {
+		matched = matched[:q.Limit]
+	}
+
+	page.Hosts = make([]ControlHostInfo, len(matched))
+	for i, h := range matched {
+		page.Hosts[i] = copyHostInfo(h, established.GetPreferredRangesFor(h))
+	}
+
+	return page, nil
+}
+
+func sortHostInfos(hosts []*HostInfo, by string) {
+	byVpnIp := func(a, b *HostInfo) bool {
+		if a.vpnIp != b.vpnIp {
+			return a.vpnIp.Compare(b.vpnIp) < 0
+		}
+		return a.localIndexId < b.localIndexId
+	}
+
+	switch by {
+	case "name":
+		name := func(h *HostInfo) string {
+			if c := h.GetCert(); c != nil {
+				return c.Details.Name
+			}
+			return ""
+		}
+
+		sort.SliceStable(hosts, func(i, j int) bool {
+			ni, nj := name(hosts[i]), name(hosts[j])
+			if ni != nj {
+				return ni < nj
+			}
+			return byVpnIp(hosts[i], hosts[j])
+		})
+
+	case "index":
+		sort.Slice(hosts, func(i, j int) bool {
+			return hosts[i].localIndexId < hosts[j].localIndexId
+		})
+
+	default:
+		sort.Slice(hosts, func(i, j int) bool {
+			return byVpnIp(hosts[i], hosts[j])
+		})
+	}
+}
+
+// writeHostmapStream writes each host in the page as a single line of json, this is friendlier to tools like jq than
+// one very large array
+func writeHostmapStream(w io.Writer, page *HostmapPage) error {
+	js := json.NewEncoder(w)
+	for _, h := range page.Hosts {
+		if err := js.Encode(h); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,202 @@
+package nebula
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/slackhq/nebula/cert"
+	"github.com/slackhq/nebula/iputil"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type testStringWriter struct {
+	bytes.Buffer
+}
+
+func (w *testStringWriter) WriteLine(s string) error { return w.Write(s + "\n") }
+func (w *testStringWriter) Write(s string) error {
+	_, err := w.Buffer.WriteString(s)
+	return err
+}
+func (w *testStringWriter) WriteBytes(b []byte) error {
+	_, err := w.Buffer.Write(b)
+	return err
+}
+func (w *testStringWriter) GetWriter() io.Writer { return &w.Buffer }
+
+func newQueryTestHostMap(t *testing.T) (*HostMap, *HostMap) {
+	l := test.NewLogger()
+	established := newHostMap(l, &net.IPNet{})
+	established.preferredRanges.Store(&[]*net.IPNet{})
+	handshaking := newHostMap(l, &net.IPNet{})
+	handshaking.preferredRanges.Store(&[]*net.IPNet{})
+
+	add := func(hm *HostMap, i int, name string, groups []string, relayed, relaying bool) {
+		hi := &HostInfo{
+			remotes:       NewRemoteList(nil),
+			localIndexId:  uint32(1000 - i),
+			remoteIndexId: uint32(i),
+			vpnIp:         iputil.Ip2VpnIp(net.IPv4(10, 0, 0, byte(i))),
+			relayState: RelayState{
+				relays:        map[iputil.VpnIp]struct{}{},
+				relayForByIp:  map[iputil.VpnIp]*Relay{},
+				relayForByIdx: map[uint32]*Relay{},
+			},
+		}
+
+		if name != "" {
+			inverted := map[string]struct{}{}
+			for _, g := range groups {
+				inverted[g] = struct{}{}
+			}
+			hi.ConnectionState = &ConnectionState{peerCert: &cert.NebulaCertificate{
+				Details: cert.NebulaCertificateDetails{Name: name, Groups: groups, InvertedGroups: inverted},
+			}}
+		}
+
+		if relayed {
+			hi.relayState.relays[iputil.Ip2VpnIp(net.IPv4(10, 0, 0, 250))] = struct{}{}
+		}
+		if relaying {
+			hi.relayState.relayForByIp[iputil.Ip2VpnIp(net.IPv4(10, 0, 0, 251))] = &Relay{}
+		}
+
+		hm.unlockedAddHostInfo(hi, &Interface{})
+	}
+
+	for i := 1; i <= 20; i++ {
+		groups := []string{"team:web"}
+		if i%2 == 0 {
+			groups = []string{"team:db"}
+		}
+		add(established, i, fmt.Sprintf("host-%02d", 21-i), groups, i == 3, i == 4)
+	}
+	add(handshaking, 30, "", nil, false, false)
+
+	return established, handshaking
+}
+
+func TestQueryHostmap(t *testing.T) {
+	established, handshaking := newQueryTestHostMap(t)
+
+	vpnIps := func(p *HostmapPage) []string {
+		var ips []string
+		for _, h := range p.Hosts {
+			ips = append(ips, h.VpnIp.String())
+		}
+		return ips
+	}
+
+	page, err := queryHostmap(HostmapQuery{}, established, handshaking)
+	require.NoError(t, err)
+	assert.Equal(t, 20, page.Total)
+	assert.Len(t, page.Hosts, 20)
+	assert.Equal(t, "10.0.0.1", page.Hosts[0].VpnIp.String())
+
+	// Paging
+	page, err = queryHostmap(HostmapQuery{Offset: 5, Limit: 3}, established, handshaking)
+	require.NoError(t, err)
+	assert.Equal(t, 20, page.Total)
+	assert.Equal(t, []string{"10.0.0.6", "10.0.0.7", "10.0.0.8"}, vpnIps(page))
+
+	page, err = queryHostmap(HostmapQuery{Offset: 50}, established, handshaking)
+	require.NoError(t, err)
+	assert.Equal(t, 20, page.Total)
+	assert.Empty(t, page.Hosts)
+
+	// Filters
+	page, err = queryHostmap(HostmapQuery{Group: "team:db", Name: "host-1*", Sort: "name"}, established, handshaking)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"10.0.0.10", "10.0.0.8", "10.0.0.6", "10.0.0.4", "10.0.0.2"}, vpnIps(page))
+
+	page, err = queryHostmap(HostmapQuery{Relay: "relayed"}, established, handshaking)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"10.0.0.3"}, vpnIps(page))
+
+	page, err = queryHostmap(HostmapQuery{Relay: "relaying"}, established, handshaking)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"10.0.0.4"}, vpnIps(page))
+
+	page, err = queryHostmap(HostmapQuery{Relay: "direct"}, established, handshaking)
+	require.NoError(t, err)
+	assert.Equal(t, 18, page.Total)
+
+	// State picks the maps
+	page, err = queryHostmap(HostmapQuery{State: "handshaking"}, established, handshaking)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"10.0.0.30"}, vpnIps(page))
+
+	page, err = queryHostmap(HostmapQuery{State: "all", Sort: "index", Limit: 2}, established, handshaking)
+	require.NoError(t, err)
+	assert.Equal(t, 21, page.Total)
+	assert.Equal(t, []string{"10.0.0.30", "10.0.0.20"}, vpnIps(page))
+
+	// Hosts without a cert never match a cert filter
+	page, err = queryHostmap(HostmapQuery{State: "handshaking", Name: "*"}, established, handshaking)
+	require.NoError(t, err)
+	assert.Equal(t, 0, page.Total)
+
+	for q, e := range map[HostmapQuery]string{
+		{State: "nope"}: `invalid state "nope", must be established, handshaking, or all`,
+		{Relay: "nope"}: `invalid relay "nope", must be direct, relayed, or relaying`,
+		{Sort: "nope"}:  `invalid sort "nope", must be vpnip, name, or index`,
+		{Name: "["}:     `invalid name pattern "[": syntax error in pattern`,
+		{Limit: -1}:     "offset and limit must not be negative",
+		{Offset: -1}:    "offset and limit must not be negative",
+	} {
+		_, err = queryHostmap(q, established, handshaking)
+		assert.EqualError(t, err, e)
+	}
+}
+
+func TestSSHListHostMap(t *testing.T) {
+	established, handshaking := newQueryTestHostMap(t)
+
+	run := func(state bool, args ...string) string {
+		fl, fs := newSSHListHostMapFlags(state)
+		require.NoError(t, fl.Parse(args))
+		w := &testStringWriter{}
+		require.NoError(t, sshListHostMap(established, handshaking, fs, w))
+		return w.String()
+	}
+
+	out := run(true, "-limit", "2")
+	assert.Equal(t, "10.0.0.1: []\n10.0.0.2: []\nshowing 1-2 of 20 hosts, use -offset 2 for more\n", out)
+
+	out = run(true, "-limit", "2", "-offset", "18")
+	assert.Equal(t, "10.0.0.19: []\n10.0.0.20: []\n", out)
+
+	out = run(true, "-state", "nope")
+	assert.Equal(t, "invalid state \"nope\", must be established, handshaking, or all\n", out)
+
+	// list-pending-hostmap only sees handshaking hosts
+	out = run(false)
+	assert.Equal(t, "10.0.0.30: []\n", out)
+
+	out = run(true, "-stream", "-group", "team:web", "-limit", "0")
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	assert.Len(t, lines, 10)
+	var h map[string]interface{}
+	require.NoError(t, json.Unmarshal([]byte(lines[0]), &h))
+	assert.Equal(t, "10.0.0.1", h["vpnIp"])
+
+	// The soft limit only applies to the text output, json has no way to say it was cut short
+	defer func(limit int) { sshHostMapSoftLimit = limit }(sshHostMapSoftLimit)
+	sshHostMapSoftLimit = 5
+	out = run(true)
+	assert.Equal(t, 6, strings.Count(out, "\n"))
+	assert.Contains(t, out, "showing 1-5 of 20 hosts")
+
+	var hosts []interface{}
+	require.NoError(t, json.Unmarshal([]byte(run(true, "-json")), &hosts))
+	assert.Len(t, hosts, 20)
+	require.NoError(t, json.Unmarshal([]byte(run(true, "-json", "-limit", "3")), &hosts))
+	assert.Len(t, hosts, 3)
+}
@@ -9,7 +9,9 @@ import (
 	"github.com/slackhq/nebula/udp"
 )
 
-func (f *Interface) consumeInsidePacket(packet []byte, fwPacket *firewall.Packet, nb, out []byte, q int, localCache firewall.ConntrackCache) {
+// consumeInsidePacket sends a packet read from the tun device, w is the udp writer it goes out through and hosts the
+// read loop's cache of the hostmap, if it has one
+func (f *Interface) consumeInsidePacket(packet []byte, fwPacket *firewall.Packet, nb, out []byte, q int, w udp.Conn, hosts *routineHosts, localCache firewall.ConntrackCache) {
 	err := newPacket(packet, false, fwPacket)
 	if err != nil {
 		if f.l.Level >= logrus.DebugLevel {
@@ -17,13 +19,14 @@ func (f *Interface) consumeInsidePacket(packet []byte, fwPacket *firewall.Packet
 		}
 		return
 	}
+	f.captures.inner(captureOut, packet, fwPacket)
 
 	// Ignore local broadcast packets
 	if f.dropLocalBroadcast && fwPacket.RemoteIP == f.localBroadcast {
 		return
 	}
 
-	if fwPacket.RemoteIP == f.myVpnIp {
+	if f.isMyVpnIp(fwPacket.RemoteIP) {
 		// Immediately forward packets from self to self.
 		// This should only happen on Darwin-based and FreeBSD hosts, which
 		// routes packets from the Nebula IP to the Nebula IP through the Nebula
@@ -44,7 +47,7 @@ func (f *Interface) consumeInsidePacket(packet []byte, fwPacket *firewall.Packet
 		return
 	}
 
-	hostinfo, ready := f.getOrHandshake(fwPacket.RemoteIP, func(hh *HandshakeHostInfo) {
+	hostinfo, ready := f.getOrHandshake(hosts, fwPacket.RemoteIP, func(hh *HandshakeHostInfo) {
 		hh.cachePacket(f.l, header.Message, 0, packet, f.sendMessageNow, f.cachedPacketMetrics)
 	})
 
@@ -62,11 +65,23 @@ func (f *Interface) consumeInsidePacket(packet []byte, fwPacket *firewall.Packet
 		return
 	}
 
-	dropReason := f.firewall.Drop(*fwPacket, false, hostinfo, f.pki.GetCAPool(), localCache)
+	span := f.tracer.samplePacket("packet.outbound", hostinfo, len(packet))
+	if span != nil {
+		defer span.end()
+	}
+
+	dropReason := f.firewall.Drop(*fwPacket, false, hostinfo, f.pki.GetCAPool(), localCache, packet)
+	span.event("firewall")
 	if dropReason == nil {
-		f.sendNoMetrics(header.Message, 0, hostinfo.ConnectionState, hostinfo, nil, packet, nb, out, q)
+		if f.pmtud != nil && f.enforcePMTU(hostinfo, packet, out, q) {
+			span.fail("larger than the path mtu")
+			return
+		}
+		f.sendNoMetricsTo(w, header.Message, 0, hostinfo.ConnectionState, hostinfo, nil, packet, nb, out)
+		span.event("sent")
 
 	} else {
+		span.fail(dropReason.Error())
 		f.rejectInside(packet, out, q)
 		if f.l.Level >= logrus.DebugLevel {
 			hostinfo.logger(f.l).
@@ -117,20 +132,20 @@ func (f *Interface) rejectOutside(packet []byte, ci *ConnectionState, hostinfo *
 }
 
 func (f *Interface) Handshake(vpnIp iputil.VpnIp) {
-	f.getOrHandshake(vpnIp, nil)
+	f.getOrHandshake(nil, vpnIp, nil)
 }
 
 // getOrHandshake returns nil if the vpnIp is not routable.
 // If the 2nd return var is false then the hostinfo is not ready to be used in a tunnel
-func (f *Interface) getOrHandshake(vpnIp iputil.VpnIp, cacheCallback func(*HandshakeHostInfo)) (*HostInfo, bool) {
-	if !ipMaskContains(f.lightHouse.myVpnIp, f.lightHouse.myVpnZeros, vpnIp) {
+func (f *Interface) getOrHandshake(hosts *routineHosts, vpnIp iputil.VpnIp, cacheCallback func(*HandshakeHostInfo)) (*HostInfo, bool) {
+	if !f.lightHouse.inVpnNets(vpnIp) {
 		vpnIp = f.inside.RouteFor(vpnIp)
-		if vpnIp == 0 {
+		if !vpnIp.IsValid() {
 			return nil, false
 		}
 	}
 
-	return f.handshakeManager.GetOrHandshake(vpnIp, cacheCallback)
+	return f.handshakeManager.GetOrHandshake(hosts, vpnIp, cacheCallback)
 }
 
 func (f *Interface) sendMessageNow(t header.MessageType, st header.MessageSubType, hostinfo *HostInfo, p, nb, out []byte) {
@@ -142,7 +157,7 @@ func (f *Interface) sendMessageNow(t header.MessageType, st header.MessageSubTyp
 	}
 
 	// check if packet is in outbound fw rules
-	dropReason := f.firewall.Drop(*fp, false, hostinfo, f.pki.GetCAPool(), nil)
+	dropReason := f.firewall.Drop(*fp, false, hostinfo, f.pki.GetCAPool(), nil, p)
 	if dropReason != nil {
 		if f.l.Level >= logrus.DebugLevel {
 			f.l.WithField("fwPacket", fp).
@@ -157,7 +172,7 @@ func (f *Interface) sendMessageNow(t header.MessageType, st header.MessageSubTyp
 
 // SendMessageToVpnIp handles real ip:port lookup and sends to the current best known address for vpnIp
 func (f *Interface) SendMessageToVpnIp(t header.MessageType, st header.MessageSubType, vpnIp iputil.VpnIp, p, nb, out []byte) {
-	hostInfo, ready := f.getOrHandshake(vpnIp, func(hh *HandshakeHostInfo) {
+	hostInfo, ready := f.getOrHandshake(nil, vpnIp, func(hh *HandshakeHostInfo) {
 		hh.cachePacket(f.l, t, st, p, f.SendMessageToHostInfo, f.cachedPacketMetrics)
 	})
 
@@ -248,14 +263,42 @@ func (f *Interface) SendVia(via *HostInfo,
 		via.logger(f.l).WithError(err).Info("Failed to EncryptDanger in sendVia")
 		return
 	}
-	err = f.writers[0].WriteTo(out, via.remote)
-	if err != nil {
-		via.logger(f.l).WithError(err).Info("Failed to WriteTo in sendVia")
+	via.ConnectionState.bytesOut.Add(uint64(len(out)))
+	if via.remote == nil {
+		// A chained relay, we reach the next relay through another one
+		f.sendViaChain(via, out, nb)
+	} else {
+		err = f.writers[0].WriteTo(out, via.remote)
+		if err != nil {
+			via.logger(f.l).WithError(err).Info("Failed to WriteTo in sendVia")
+		}
 	}
 	f.connectionManager.RelayUsed(relay.LocalIndex)
 }
 
+// sendViaChain sends a relay packet for via through the relay we reach via with. Only a relay we have a direct tunnel
+// with is used, a chain never grows past two relays.
+func (f *Interface) sendViaChain(via *HostInfo, p, nb []byte) {
+	for _, relayIP := range via.relayState.CopyRelayIps() {
+		relayHostInfo, relay, err := f.hostMap.QueryVpnIpRelayFor(via.vpnIp, relayIP)
+		if err != nil || relayHostInfo.remote == nil {
+			continue
+		}
+		f.SendVia(relayHostInfo, relay, p, nb, make([]byte, 0, mtu), false)
+		return
+	}
+
+	via.logger(f.l).Info("No direct relay to chain through")
+}
+
 func (f *Interface) sendNoMetrics(t header.MessageType, st header.MessageSubType, ci *ConnectionState, hostinfo *HostInfo, remote *udp.Addr, p, nb, out []byte, q int) {
+	if ci.eKey == nil {
+		return
+	}
+	f.sendNoMetricsTo(f.writers[q], t, st, ci, hostinfo, remote, p, nb, out)
+}
+
+func (f *Interface) sendNoMetricsTo(w udp.Conn, t header.MessageType, st header.MessageSubType, ci *ConnectionState, hostinfo *HostInfo, remote *udp.Addr, p, nb, out []byte) {
 	if ci.eKey == nil {
 		//TODO: log warning
 		return
@@ -296,7 +339,11 @@ func (f *Interface) sendNoMetrics(t header.MessageType, st header.MessageSubType
 	}
 
 	var err error
-	out, err = ci.eKey.EncryptDanger(out, out, p, c, nb)
+	if q := sealQueueOf(w); q != nil && ci.eKey.mb != nil && !useRelay {
+		out = q.queue(ci.eKey, out, p, c)
+	} else {
+		out, err = ci.eKey.EncryptDanger(out, out, p, c, nb)
+	}
 	if noiseutil.EncryptLockNeeded {
 		ci.writeLock.Unlock()
 	}
@@ -307,15 +354,17 @@ func (f *Interface) sendNoMetrics(t header.MessageType, st header.MessageSubType
 			Error("Failed to encrypt outgoing packet")
 		return
 	}
+	ci.bytesOut.Add(uint64(len(out)))
 
 	if remote != nil {
-		err = f.writers[q].WriteTo(out, remote)
+		err = w.WriteTo(out, remote)
 		if err != nil {
 			hostinfo.logger(f.l).WithError(err).
 				WithField("udpAddr", remote).Error("Failed to write outgoing packet")
 		}
 	} else if hostinfo.remote != nil {
-		err = f.writers[q].WriteTo(out, hostinfo.remote)
+		remote = hostinfo.sendRemote()
+		err = w.WriteTo(out, remote)
 		if err != nil {
 			hostinfo.logger(f.l).WithError(err).
 				WithField("udpAddr", remote).Error("Failed to write outgoing packet")
@@ -336,6 +385,9 @@ func (f *Interface) sendNoMetrics(t header.MessageType, st header.MessageSubType
 }
 
 func isMulticast(ip iputil.VpnIp) bool {
-	// Class D multicast
-	return (((ip >> 24) & 0xff) & 0xf0) == 0xe0
+	if ip.Is4() {
+		// Class D multicast
+		return ((ip.Uint32() >> 24) & 0xf0) == 0xe0
+	}
+	return ip.As16()[0] == 0xff
 }
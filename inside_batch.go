@@ -0,0 +1,59 @@
+package nebula
+
+import (
+	"io"
+
+	"github.com/slackhq/nebula/overlay"
+)
+
+// insideReadBatch is the most packets taken from a device that reads in batches at once
+const insideReadBatch = 32
+
+// batchedReader hands out the packets of a batch reading device one at a time so the inside loop stays the same
+type batchedReader struct {
+	io.ReadWriteCloser
+	br overlay.BatchReadWriter
+
+	bufs  [][]byte
+	sizes []int
+	n     int
+	next  int
+}
+
+// newBatchedReader wraps reader if it can read in batches, otherwise reader is returned untouched
+func newBatchedReader(reader io.ReadWriteCloser, size int) io.ReadWriteCloser {
+	br, ok := reader.(overlay.BatchReadWriter)
+	if !ok {
+		return reader
+	}
+
+	r := &batchedReader{
+		ReadWriteCloser: reader,
+		br:              br,
+		bufs:            make([][]byte, insideReadBatch),
+		sizes:           make([]int, insideReadBatch),
+	}
+	for i := range r.bufs {
+		r.bufs[i] = make([]byte, size)
+	}
+	return r
+}
+
+func (r *batchedReader) Read(p []byte) (int, error) {
+	if r.next >= r.n {
+		n, err := r.br.ReadBatch(r.bufs, r.sizes)
+		if err != nil {
+			return 0, err
+		}
+		r.n, r.next = n, 0
+	}
+
+	n := copy(p, r.bufs[r.next][:r.sizes[r.next]])
+	r.next++
+	return n, nil
+}
+
+// Pending is true while packets from the last batch are left
+func (r *batchedReader) Pending() bool {
+	return r.next < r.n
+}
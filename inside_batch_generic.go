@@ -0,0 +1,15 @@
+//go:build !linux
+// +build !linux
+
+package nebula
+
+import "io"
+
+// readPendingFunc returns a func telling if another packet can be read from a tun reader without waiting, nil if we
+// can not tell
+func readPendingFunc(r io.Reader) func() bool {
+	if r, ok := r.(interface{ Pending() bool }); ok {
+		return r.Pending
+	}
+	return nil
+}
@@ -0,0 +1,27 @@
+package nebula
+
+import (
+	"io"
+
+	"golang.org/x/sys/unix"
+)
+
+// readPendingFunc returns a func telling if another packet can be read from a tun reader without waiting, nil if we
+// can not tell
+func readPendingFunc(r io.Reader) func() bool {
+	switch r := r.(type) {
+	case interface{ Pending() bool }:
+		return r.Pending
+	case interface{ Fd() uintptr }:
+		fd := int(r.Fd())
+		return func() bool { return readPending(fd) }
+	}
+	return nil
+}
+
+// readPending returns true if another packet can be read from fd without waiting
+func readPending(fd int) bool {
+	fds := []unix.PollFd{{Fd: int32(fd), Events: unix.POLLIN}}
+	n, err := unix.Poll(fds, 0)
+	return err == nil && n > 0
+}
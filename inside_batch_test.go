@@ -0,0 +1,65 @@
+package nebula
+
+import (
+	"io"
+	"testing"
+
+	"github.com/slackhq/nebula/overlay"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testBatchDevice returns its packets in batches of at most 2
+type testBatchDevice struct {
+	io.ReadWriteCloser
+	packets [][]byte
+}
+
+func (d *testBatchDevice) ReadBatch(bufs [][]byte, sizes []int) (int, error) {
+	if len(d.packets) == 0 {
+		return 0, io.EOF
+	}
+
+	n := 0
+	for n < len(bufs) && n < 2 && len(d.packets) > 0 {
+		sizes[n] = copy(bufs[n], d.packets[0])
+		d.packets = d.packets[1:]
+		n++
+	}
+	return n, nil
+}
+
+func (d *testBatchDevice) WriteBatch(bufs [][]byte) (int, error) {
+	return len(bufs), nil
+}
+
+func TestBatchedReader(t *testing.T) {
+	// Devices that can not read in batches are left alone
+	plain, err := overlay.NewUserDevice(nil)
+	require.NoError(t, err)
+	assert.Same(t, plain, newBatchedReader(plain, 10))
+
+	r := newBatchedReader(&testBatchDevice{packets: [][]byte{{1}, {2, 2}, {3, 3, 3}}}, 10)
+	require.IsType(t, &batchedReader{}, r)
+	pending := readPendingFunc(r)
+	require.NotNil(t, pending)
+	assert.False(t, pending())
+
+	b := make([]byte, 10)
+	n, err := r.Read(b)
+	require.NoError(t, err)
+	assert.Equal(t, []byte{1}, b[:n])
+	assert.True(t, pending())
+
+	n, err = r.Read(b)
+	require.NoError(t, err)
+	assert.Equal(t, []byte{2, 2}, b[:n])
+	assert.False(t, pending())
+
+	n, err = r.Read(b)
+	require.NoError(t, err)
+	assert.Equal(t, []byte{3, 3, 3}, b[:n])
+
+	_, err = r.Read(b)
+	assert.ErrorIs(t, err, io.EOF)
+}
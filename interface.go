@@ -2,6 +2,7 @@ package nebula
 
 import (
 	"context"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
@@ -13,12 +14,14 @@ import (
 
 	"github.com/rcrowley/go-metrics"
 	"github.com/sirupsen/logrus"
+	"github.com/slackhq/nebula/aesgcm"
 	"github.com/slackhq/nebula/config"
 	"github.com/slackhq/nebula/firewall"
 	"github.com/slackhq/nebula/header"
 	"github.com/slackhq/nebula/iputil"
 	"github.com/slackhq/nebula/overlay"
 	"github.com/slackhq/nebula/udp"
+	"github.com/slackhq/nebula/util"
 )
 
 const mtu = 9001
@@ -28,20 +31,28 @@ type InterfaceConfig struct {
 	Outside                 udp.Conn
 	Inside                  overlay.Device
 	pki                     *PKI
-	Cipher                  string
+	ciphers                 *cipherConfig
 	Firewall                *Firewall
 	ServeDns                bool
 	HandshakeManager        *HandshakeManager
 	lightHouse              *LightHouse
 	checkInterval           time.Duration
 	pendingDeletionInterval time.Duration
+	adaptivePendingDeletion *adaptiveTimeout
+	keepalive               *keepalive
 	DropLocalBroadcast      bool
 	DropMulticast           bool
 	routines                int
-	MessageMetrics          *MessageMetrics
-	version                 string
-	relayManager            *relayManager
-	punchy                  *Punchy
+	// sendBatch is how many packets read from the tun device may be sent with one syscall, see listenIn
+	sendBatch int
+	// pinRoutines pins the read loops of each routine to a cpu and gives them their own cache of the hostmap
+	pinRoutines    bool
+	MessageMetrics *MessageMetrics
+	version        string
+	relayManager   *relayManager
+	punchy         *Punchy
+	tracer         *tracer
+	captures       *packetCaptures
 
 	tryPromoteEvery uint32
 	reQueryEvery    uint32
@@ -52,25 +63,58 @@ type InterfaceConfig struct {
 }
 
 type Interface struct {
-	hostMap            *HostMap
-	outside            udp.Conn
-	inside             overlay.Device
-	pki                *PKI
-	cipher             string
-	firewall           *Firewall
-	connectionManager  *connectionManager
-	handshakeManager   *HandshakeManager
-	serveDns           bool
-	createTime         time.Time
-	lightHouse         *LightHouse
-	localBroadcast     iputil.VpnIp
-	myVpnIp            iputil.VpnIp
+	hostMap           *HostMap
+	outside           udp.Conn
+	inside            overlay.Device
+	pki               *PKI
+	ciphers           *cipherConfig
+	firewall          *Firewall
+	connectionManager *connectionManager
+	handshakeManager  *HandshakeManager
+	serveDns          bool
+	createTime        time.Time
+	lightHouse        *LightHouse
+	localBroadcast    iputil.VpnIp
+	myVpnIp           iputil.VpnIp
+	// myVpnIps are all of the vpn ips in our certificate, myVpnIp first
+	myVpnIps           []iputil.VpnIp
 	dropLocalBroadcast bool
 	dropMulticast      bool
 	routines           int
-	disconnectInvalid  atomic.Bool
-	closed             atomic.Bool
-	relayManager       *relayManager
+	sendBatch          int
+	pinRoutines        bool
+	// underlays reach peers over tcp streams or quic connections where udp does not, empty unless configured
+	underlays         []underlayTransport
+	disconnectInvalid atomic.Bool
+	closed            atomic.Bool
+	relayManager      *relayManager
+
+	// rekey is the policy the connection manager uses to refresh the keys of established tunnels
+	rekey atomic.Pointer[rekeyPolicy]
+
+	// requireGroups are the groups a remote certificate needs for us to keep a tunnel with it
+	requireGroups atomic.Pointer[requiredGroups]
+
+	// pins are the certificates we accept for specific vpn ips
+	pins atomic.Pointer[identityPins]
+
+	// psks are the pre-shared keys groups require for tunnels between their members
+	psks atomic.Pointer[handshakePSKs]
+
+	// replayWindow sizes the anti-replay window of new tunnels
+	replayWindow atomic.Pointer[replayWindowConfig]
+
+	// dscpMarking marks the packets carrying what we read from the tun device after their inner dscp, nil if it is not
+	dscpMarking atomic.Pointer[dscpMarking]
+
+	// events are delivered to handlers registered with Control.OnTunnelEvent
+	events *tunnelEvents
+
+	// handshakeCapabilities are the optional features we advertise during handshakes
+	handshakeCapabilities capabilitySet
+
+	// diag tracks the diag probes waiting on a reply
+	diag *diagProber
 
 	tryPromoteEvery atomic.Uint32
 	reQueryEvery    atomic.Uint32
@@ -84,12 +128,43 @@ type Interface struct {
 
 	conntrackCacheTimeout time.Duration
 
+	// bridges forward inbound flows to other members of a Group, they are set before the interface is started
+	bridges []*bridge
+
+	// stun takes the answers to stun requests we sent from our socket, it is set before the interface is started
+	stun *stunClient
+
+	// pmtud keeps packets within the path mtu of each tunnel when it is enabled, it is set before the interface is started
+	pmtud *pmtuDiscovery
+
+	// multipath probes the paths of every tunnel when it is enabled, it is set before the interface is started
+	multipath *multipath
+
+	// relaySelector picks the relays handshakes go through when it is enabled, it is set before the interface is started
+	relaySelector *relaySelector
+
 	writers []udp.Conn
 	readers []io.ReadWriteCloser
 
+	// listeners hold the udp sockets under writers and listenIP is where they listen, a reload can move them. rebound
+	// is only used by the reload and listenRebinds counts the moves. See listen_reload.go
+	listeners     []*listenerConn
+	listenIP      net.IP
+	rebound       *listenRebind
+	listenRebinds atomic.Uint32
+
 	metricHandshakes    metrics.Histogram
 	messageMetrics      *MessageMetrics
 	cachedPacketMetrics *cachedPacketMetrics
+	perf                pipelineStats
+	// promStats is set when stats.type is prometheus, see stats_prometheus.go
+	promStats *prometheusStats
+	// tracer exports traces of handshakes and sampled packets, nil unless tracing.endpoint is set, see tracing.go
+	tracer *tracer
+	// captures are the packet captures of the tcpdump ssh command, see capture.go
+	captures *packetCaptures
+	// restarts knows which settings changed by a reload wait for a restart, see config_restart.go
+	restarts *restartTracker
 
 	l *logrus.Logger
 }
@@ -104,6 +179,7 @@ type EncWriter interface {
 	)
 	SendMessageToVpnIp(t header.MessageType, st header.MessageSubType, vpnIp iputil.VpnIp, p, nb, out []byte)
 	SendMessageToHostInfo(t header.MessageType, st header.MessageSubType, hostinfo *HostInfo, p, nb, out []byte)
+	SendHostUpdate(vpnIp iputil.VpnIp, p, nb, out []byte)
 	Handshake(vpnIp iputil.VpnIp)
 }
 
@@ -162,21 +238,30 @@ func NewInterface(ctx context.Context, c *InterfaceConfig) (*Interface, error) {
 		hostMap:            c.HostMap,
 		outside:            c.Outside,
 		inside:             c.Inside,
-		cipher:             c.Cipher,
+		ciphers:            c.ciphers,
 		firewall:           c.Firewall,
 		serveDns:           c.ServeDns,
 		handshakeManager:   c.HandshakeManager,
 		createTime:         time.Now(),
 		lightHouse:         c.lightHouse,
-		localBroadcast:     myVpnIp | ^iputil.Ip2VpnIp(certificate.Details.Ips[0].Mask),
+		localBroadcast:     localBroadcast(certificate.Details.Ips),
 		dropLocalBroadcast: c.DropLocalBroadcast,
 		dropMulticast:      c.DropMulticast,
 		routines:           c.routines,
+		sendBatch:          c.sendBatch,
+		pinRoutines:        c.pinRoutines,
 		version:            c.version,
 		writers:            make([]udp.Conn, c.routines),
 		readers:            make([]io.ReadWriteCloser, c.routines),
 		myVpnIp:            myVpnIp,
+		myVpnIps:           certVpnIps(certificate),
 		relayManager:       c.relayManager,
+		tracer:             c.tracer,
+		captures:           c.captures,
+
+		handshakeCapabilities: defaultHandshakeCapabilities(),
+		diag:                  newDiagProber(),
+		events:                newTunnelEvents(),
 
 		conntrackCacheTimeout: c.ConntrackCacheTimeout,
 
@@ -194,7 +279,7 @@ func NewInterface(ctx context.Context, c *InterfaceConfig) (*Interface, error) {
 	ifce.reQueryEvery.Store(c.reQueryEvery)
 	ifce.reQueryWait.Store(int64(c.reQueryWait))
 
-	ifce.connectionManager = newConnectionManager(ctx, c.l, ifce, c.checkInterval, c.pendingDeletionInterval, c.punchy)
+	ifce.connectionManager = newConnectionManager(ctx, c.l, ifce, c.checkInterval, c.pendingDeletionInterval, c.adaptivePendingDeletion, c.keepalive, c.punchy)
 
 	return ifce, nil
 }
@@ -213,6 +298,7 @@ func (f *Interface) activate() {
 	f.l.WithField("interface", f.inside.Name()).WithField("network", f.inside.Cidr().String()).
 		WithField("build", f.version).WithField("udpAddr", addr).
 		WithField("boringcrypto", boringEnabled()).
+		WithField("aesgcmMultiBuffer", aesgcm.Available() && !boringEnabled()).
 		Info("Nebula interface is active")
 
 	metrics.GetOrRegisterGauge("routines", nil).Update(int64(f.routines))
@@ -249,6 +335,11 @@ func (f *Interface) run() {
 
 func (f *Interface) listenOut(i int) {
 	runtime.LockOSThread()
+	f.pinRoutine(i, "outside")
+	var hosts *routineHosts
+	if f.pinRoutines {
+		hosts = newRoutineHosts(f.hostMap)
+	}
 
 	var li udp.Conn
 	// TODO clean this up with a coherent interface for each outside connection
@@ -258,21 +349,50 @@ func (f *Interface) listenOut(i int) {
 		li = f.outside
 	}
 
+	f.perf.outsideReaders.Add(1)
+	defer f.perf.outsideReaders.Add(-1)
+
 	lhh := f.lightHouse.NewRequestHandler()
 	conntrackCache := firewall.NewConntrackCacheTicker(f.conntrackCacheTimeout)
-	li.ListenOut(readOutsidePackets(f), lhHandleRequest(lhh, f), conntrackCache, i)
+	li.ListenOut(readOutsidePackets(f, hosts), lhHandleRequest(lhh, f), conntrackCache, i)
 }
 
 func (f *Interface) listenIn(reader io.ReadWriteCloser, i int) {
 	runtime.LockOSThread()
+	f.pinRoutine(i, "inside")
+	var hosts *routineHosts
+	if f.pinRoutines {
+		hosts = newRoutineHosts(f.hostMap)
+	}
 
 	packet := make([]byte, mtu)
 	out := make([]byte, mtu)
 	fwPacket := &firewall.Packet{}
 	nb := make([]byte, 12, 12)
+	reader = newBatchedReader(reader, mtu)
 
 	conntrackCache := firewall.NewConntrackCacheTicker(f.conntrackCacheTimeout)
 
+	// Packets to send are queued while the tun device has more for us, then sent together
+	w := f.writers[i]
+	var batch *udp.SendBatch
+	pending := readPendingFunc(reader)
+	var marked *dscpWriter
+	if bc, ok := w.(udp.BatchConn); ok {
+		var seal *sealQueue
+		if f.sendBatch > 1 && pending != nil {
+			batch = udp.NewSendBatch(bc, f.sendBatch)
+			w = batch
+			if seal = newSealQueue(batch); seal != nil {
+				w = seal
+			}
+		}
+		marked = &dscpWriter{Conn: w, batch: batch, seal: seal, bc: bc}
+	}
+
+	f.perf.insideReaders.Add(1)
+	defer f.perf.insideReaders.Add(-1)
+
 	for {
 		n, err := reader.Read(packet)
 		if err != nil {
@@ -285,15 +405,52 @@ func (f *Interface) listenIn(reader io.ReadWriteCloser, i int) {
 			os.Exit(2)
 		}
 
-		f.consumeInsidePacket(packet[:n], fwPacket, nb, out, i, conntrackCache.Get(f.l))
+		f.perf.insideHigh.Observe(int64(n))
+		pw := w
+		if m := f.dscpMarking.Load(); m != nil && marked != nil {
+			marked.tos = m.outer(packet[:n])
+			pw = marked
+		}
+		// Batched packets are encrypted straight into the batch
+		po := out
+		if batch != nil {
+			po = batch.Next()
+		}
+		f.consumeInsidePacket(packet[:n], fwPacket, nb, po, i, pw, hosts, conntrackCache.Get(f.l))
+
+		if batch != nil && batch.Len() > 0 && !pending() {
+			if err := batch.Flush(); err != nil {
+				f.l.WithError(err).Error("Failed to write outgoing packets")
+			}
+		}
 	}
 }
 
+// rebindUnderlay asks the udp listeners to rebind and notifies the lighthouses of our new addresses
+func (f *Interface) rebindUnderlay() {
+	_ = f.outside.Rebind()
+
+	// Trigger a lighthouse update, useful for mobile clients that should have an update interval of 0
+	f.lightHouse.SendUpdate()
+
+	// Let the main interface know that we rebound so that underlying tunnels know to trigger punches from their remotes
+	f.rebindCount++
+}
+
 func (f *Interface) RegisterConfigChangeCallbacks(c *config.C) {
-	c.RegisterReloadCallback(f.reloadFirewall)
+	c.RegisterReloadTransaction(f.prepareFirewallReload)
+	c.RegisterReloadTransaction(f.prepareListenReload)
+	c.RegisterReloadCallback(f.finishListenReload)
 	c.RegisterReloadCallback(f.reloadSendRecvError)
 	c.RegisterReloadCallback(f.reloadDisconnectInvalid)
 	c.RegisterReloadCallback(f.reloadMisc)
+	c.RegisterReloadCallback(f.reloadRekey)
+	c.RegisterReloadCallback(f.reloadRequireGroups)
+	c.RegisterReloadCallback(f.reloadPins)
+	c.RegisterReloadCallback(f.reloadHandshakePSKs)
+	c.RegisterReloadCallback(f.reloadReplayWindow)
+	c.RegisterReloadCallback(f.reloadDSCPMarking)
+	c.RegisterReloadCallback(f.reloadOutsideFilter)
 
 	for _, udpConn := range f.writers {
 		c.RegisterReloadCallback(udpConn.ReloadConfig)
@@ -310,24 +467,41 @@ func (f *Interface) reloadDisconnectInvalid(c *config.C) {
 	}
 }
 
-func (f *Interface) reloadFirewall(c *config.C) {
+// prepareFirewallReload compiles the new firewall rules, they are installed when the reload transaction commits
+func (f *Interface) prepareFirewallReload(c *config.C) (*config.ReloadStage, error) {
 	//TODO: need to trigger/detect if the certificate changed too
 	if c.HasChanged("firewall") == false {
 		f.l.Debug("No firewall config change detected")
-		return
+		return nil, nil
 	}
 
-	fw, err := NewFirewallFromConfig(f.l, f.pki.GetCertState().Certificate, c)
+	fw, err := NewFirewallFromConfig(f.firewall.l, f.pki.getPendingCertState().Certificate, c)
 	if err != nil {
-		f.l.WithError(err).Error("Error while creating firewall during reload")
-		return
+		return nil, util.NewContextualError("Error while creating firewall during reload", nil, err)
 	}
 
 	oldFw := f.firewall
+	return &config.ReloadStage{
+		Commit: func() error {
+			f.installFirewall(oldFw, fw)
+			return nil
+		},
+		Rollback: func() {
+			if f.firewall == fw {
+				f.firewall = oldFw
+				f.l.WithField("firewallHashes", oldFw.GetRuleHashes()).Warn("Restored the previous firewall")
+			}
+			fw.Destroy()
+		},
+	}, nil
+}
+
+func (f *Interface) installFirewall(oldFw, fw *Firewall) {
 	conntrack := oldFw.Conntrack
 	conntrack.Lock()
 	defer conntrack.Unlock()
 
+	fw.inheritCIDRSets(oldFw)
 	fw.rulesVersion = oldFw.rulesVersion + 1
 	// If rulesVersion is back to zero, we have wrapped all the way around. Be
 	// safe and just reset conntrack in this case.
@@ -336,8 +510,8 @@ func (f *Interface) reloadFirewall(c *config.C) {
 			WithField("oldFirewallHashes", oldFw.GetRuleHashes()).
 			WithField("rulesVersion", fw.rulesVersion).
 			Warn("firewall rulesVersion has overflowed, resetting conntrack")
-	} else {
-		fw.Conntrack = conntrack
+	} else if flushed := fw.inheritConntrack(conntrack); flushed > 0 {
+		f.l.WithField("flushedConns", flushed).Info("Flushed conntrack for the new firewall")
 	}
 
 	f.firewall = fw
@@ -346,6 +520,7 @@ func (f *Interface) reloadFirewall(c *config.C) {
 	f.l.WithField("firewallHashes", fw.GetRuleHashes()).
 		WithField("oldFirewallHashes", oldFw.GetRuleHashes()).
 		WithField("rulesVersion", fw.rulesVersion).
+		WithField("conntrackReload", fw.reloadPolicy.String()).
 		Info("New firewall has been installed")
 }
 
@@ -397,7 +572,8 @@ func (f *Interface) emitStats(ctx context.Context, i time.Duration) {
 	ticker := time.NewTicker(i)
 	defer ticker.Stop()
 
-	udpStats := udp.NewUDPStatsEmitter(f.writers)
+	rebinds := f.listenRebinds.Load()
+	udpStats := f.newUDPStatsEmitter()
 
 	certExpirationGauge := metrics.GetOrRegisterGauge("certificate.ttl_seconds", nil)
 
@@ -408,12 +584,27 @@ func (f *Interface) emitStats(ctx context.Context, i time.Duration) {
 		case <-ticker.C:
 			f.firewall.EmitStats()
 			f.handshakeManager.EmitStats()
+			if r := f.listenRebinds.Load(); r != rebinds {
+				rebinds = r
+				udpStats = f.newUDPStatsEmitter()
+			}
 			udpStats()
+			f.emitPerfStats()
+			f.relayManager.accounting.EmitStats()
 			certExpirationGauge.Update(int64(f.pki.GetCertState().Certificate.Details.NotAfter.Sub(time.Now()) / time.Second))
 		}
 	}
 }
 
+// newUDPStatsEmitter emits the stats of the udp sockets that are open now
+func (f *Interface) newUDPStatsEmitter() func() {
+	conns := make([]udp.Conn, len(f.writers))
+	for i, w := range f.writers {
+		conns[i] = unwrapConn(w)
+	}
+	return udp.NewUDPStatsEmitter(conns)
+}
+
 func (f *Interface) Close() error {
 	f.closed.Store(true)
 
@@ -427,3 +618,34 @@ func (f *Interface) Close() error {
 	// Release the tun device
 	return f.inside.Close()
 }
+
+// unsafeRouteManager returns the tun device if its unsafe routes can be changed at runtime
+func (f *Interface) unsafeRouteManager() (overlay.UnsafeRouteManager, error) {
+	rm, ok := f.inside.(overlay.UnsafeRouteManager)
+	if !ok {
+		return nil, errors.New("the tun device does not support changing unsafe routes at runtime")
+	}
+	return rm, nil
+}
+
+// isMyVpnIp is true if ip is any of the vpn ips in our certificate
+func (f *Interface) isMyVpnIp(ip iputil.VpnIp) bool {
+	for _, my := range f.myVpnIps {
+		if my == ip {
+			return true
+		}
+	}
+	return false
+}
+
+// localBroadcast returns the broadcast address of the first ipv4 network in nets, ipv6 has no broadcast address
+func localBroadcast(nets []*net.IPNet) iputil.VpnIp {
+	for _, n := range nets {
+		ip4 := n.IP.To4()
+		if ip4 == nil || len(n.Mask) != net.IPv4len {
+			continue
+		}
+		return iputil.VpnIpFrom4(binary.BigEndian.Uint32(ip4) | ^binary.BigEndian.Uint32(n.Mask))
+	}
+	return iputil.VpnIp{}
+}
@@ -0,0 +1,3 @@
+// Package iouring is the small part of linux io_uring nebula uses to keep reads outstanding on a file descriptor and
+// collect many of them with one syscall. It only supports linux 5.6 and later, New fails everywhere else.
+package iouring
@@ -0,0 +1,262 @@
+package iouring
+
+import (
+	"fmt"
+	"sync/atomic"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	opRecvMsg = 10
+	opRead    = 22
+
+	enterGetEvents = 1 << 0
+	featSingleMmap = 1 << 0
+
+	offSQRing = 0
+	offCQRing = 0x8000000
+	offSQEs   = 0x10000000
+)
+
+type sqRingOffsets struct {
+	head        uint32
+	tail        uint32
+	ringMask    uint32
+	ringEntries uint32
+	flags       uint32
+	dropped     uint32
+	array       uint32
+	resv1       uint32
+	userAddr    uint64
+}
+
+type cqRingOffsets struct {
+	head        uint32
+	tail        uint32
+	ringMask    uint32
+	ringEntries uint32
+	overflow    uint32
+	cqes        uint32
+	flags       uint32
+	resv1       uint32
+	userAddr    uint64
+}
+
+type params struct {
+	sqEntries    uint32
+	cqEntries    uint32
+	flags        uint32
+	sqThreadCPU  uint32
+	sqThreadIdle uint32
+	features     uint32
+	wqFd         uint32
+	resv         [3]uint32
+	sqOff        sqRingOffsets
+	cqOff        cqRingOffsets
+}
+
+// sqe is a submission queue entry
+type sqe struct {
+	opcode      uint8
+	flags       uint8
+	ioprio      uint16
+	fd          int32
+	off         uint64
+	addr        uint64
+	len         uint32
+	opFlags     uint32
+	userData    uint64
+	bufIndex    uint16
+	personality uint16
+	spliceFdIn  int32
+	addr3       uint64
+	pad         uint64
+}
+
+// cqe is a completion queue entry
+type cqe struct {
+	userData uint64
+	res      int32
+	flags    uint32
+}
+
+// Ring is an io_uring instance, it is not safe for concurrent use. Buffers handed to it must stay alive until their
+// completion is returned.
+type Ring struct {
+	fd int
+
+	sqRing []byte
+	cqRing []byte
+	sqeMem []byte
+
+	sqHead  *uint32
+	sqTail  *uint32
+	sqMask  uint32
+	sqArray []uint32
+	sqes    []sqe
+	// tail is the next submission we fill, the kernel's tail is moved to it on Submit
+	tail uint32
+
+	cqHead *uint32
+	cqTail *uint32
+	cqMask uint32
+	cqes   []cqe
+}
+
+// New sets up a ring with room for entries submissions, the kernel rounds it up to a power of 2
+func New(entries uint32) (*Ring, error) {
+	var p params
+	fd, _, errno := unix.Syscall(unix.SYS_IO_URING_SETUP, uintptr(entries), uintptr(unsafe.Pointer(&p)), 0)
+	if errno != 0 {
+		return nil, fmt.Errorf("io_uring_setup: %w", errno)
+	}
+
+	r := &Ring{fd: int(fd)}
+	if err := r.mmap(&p); err != nil {
+		r.Close()
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *Ring) mmap(p *params) error {
+	sqSize := int(p.sqOff.array) + int(p.sqEntries)*4
+	cqSize := int(p.cqOff.cqes) + int(p.cqEntries)*int(unsafe.Sizeof(cqe{}))
+	single := p.features&featSingleMmap != 0
+	if single {
+		sqSize = max(sqSize, cqSize)
+	}
+
+	var err error
+	r.sqRing, err = unix.Mmap(r.fd, offSQRing, sqSize, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED|unix.MAP_POPULATE)
+	if err != nil {
+		return fmt.Errorf("mmap io_uring submission ring: %w", err)
+	}
+
+	if single {
+		r.cqRing = r.sqRing
+	} else {
+		r.cqRing, err = unix.Mmap(r.fd, offCQRing, cqSize, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED|unix.MAP_POPULATE)
+		if err != nil {
+			return fmt.Errorf("mmap io_uring completion ring: %w", err)
+		}
+	}
+
+	sqeSize := int(p.sqEntries) * int(unsafe.Sizeof(sqe{}))
+	r.sqeMem, err = unix.Mmap(r.fd, offSQEs, sqeSize, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED|unix.MAP_POPULATE)
+	if err != nil {
+		return fmt.Errorf("mmap io_uring submission entries: %w", err)
+	}
+
+	r.sqHead = (*uint32)(unsafe.Pointer(&r.sqRing[p.sqOff.head]))
+	r.sqTail = (*uint32)(unsafe.Pointer(&r.sqRing[p.sqOff.tail]))
+	r.sqMask = *(*uint32)(unsafe.Pointer(&r.sqRing[p.sqOff.ringMask]))
+	r.sqArray = unsafe.Slice((*uint32)(unsafe.Pointer(&r.sqRing[p.sqOff.array])), p.sqEntries)
+	r.sqes = unsafe.Slice((*sqe)(unsafe.Pointer(&r.sqeMem[0])), p.sqEntries)
+	r.tail = atomic.LoadUint32(r.sqTail)
+
+	r.cqHead = (*uint32)(unsafe.Pointer(&r.cqRing[p.cqOff.head]))
+	r.cqTail = (*uint32)(unsafe.Pointer(&r.cqRing[p.cqOff.tail]))
+	r.cqMask = *(*uint32)(unsafe.Pointer(&r.cqRing[p.cqOff.ringMask]))
+	r.cqes = unsafe.Slice((*cqe)(unsafe.Pointer(&r.cqRing[p.cqOff.cqes])), p.cqEntries)
+	return nil
+}
+
+// Close releases the ring, outstanding requests are cancelled
+func (r *Ring) Close() error {
+	if r.sqeMem != nil {
+		unix.Munmap(r.sqeMem)
+	}
+	if r.cqRing != nil && &r.cqRing[0] != &r.sqRing[0] {
+		unix.Munmap(r.cqRing)
+	}
+	if r.sqRing != nil {
+		unix.Munmap(r.sqRing)
+	}
+	return unix.Close(r.fd)
+}
+
+// next returns the submission entry to fill, nil if the submission queue is full
+func (r *Ring) next() *sqe {
+	if r.tail-atomic.LoadUint32(r.sqHead) > r.sqMask {
+		return nil
+	}
+
+	i := r.tail & r.sqMask
+	s := &r.sqes[i]
+	*s = sqe{}
+	r.sqArray[i] = i
+	r.tail++
+	return s
+}
+
+// PrepRead queues a read from fd into b, it returns false if the submission queue is full
+func (r *Ring) PrepRead(fd int, b []byte, userData uint64) bool {
+	s := r.next()
+	if s == nil {
+		return false
+	}
+
+	s.opcode = opRead
+	s.fd = int32(fd)
+	// Read from the current position, tun devices and sockets have none
+	s.off = ^uint64(0)
+	s.addr = uint64(uintptr(unsafe.Pointer(&b[0])))
+	s.len = uint32(len(b))
+	s.userData = userData
+	return true
+}
+
+// PrepRecvMsg queues a recvmsg on fd into the struct msghdr at msg, it returns false if the submission queue is full
+func (r *Ring) PrepRecvMsg(fd int, msg unsafe.Pointer, flags uint32, userData uint64) bool {
+	s := r.next()
+	if s == nil {
+		return false
+	}
+
+	s.opcode = opRecvMsg
+	s.fd = int32(fd)
+	s.addr = uint64(uintptr(msg))
+	s.len = 1
+	s.opFlags = flags
+	s.userData = userData
+	return true
+}
+
+// Submit hands the queued requests to the kernel and waits until at least wait of them have completed
+func (r *Ring) Submit(wait uint32) error {
+	atomic.StoreUint32(r.sqTail, r.tail)
+
+	for {
+		toSubmit := r.tail - atomic.LoadUint32(r.sqHead)
+		flags := uintptr(0)
+		if wait > 0 {
+			flags = enterGetEvents
+		}
+
+		_, _, errno := unix.Syscall6(unix.SYS_IO_URING_ENTER, uintptr(r.fd), uintptr(toSubmit), uintptr(wait), flags, 0, 0)
+		switch errno {
+		case 0:
+			return nil
+		case unix.EINTR:
+			continue
+		default:
+			return fmt.Errorf("io_uring_enter: %w", errno)
+		}
+	}
+}
+
+// Completion returns the result of the next completed request without waiting, ok is false if there is none. A
+// negative result is an errno.
+func (r *Ring) Completion() (userData uint64, res int32, ok bool) {
+	head := atomic.LoadUint32(r.cqHead)
+	if head == atomic.LoadUint32(r.cqTail) {
+		return 0, 0, false
+	}
+
+	c := r.cqes[head&r.cqMask]
+	atomic.StoreUint32(r.cqHead, head+1)
+	return c.userData, c.res, true
+}
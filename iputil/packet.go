@@ -2,6 +2,7 @@ package iputil
 
 import (
 	"encoding/binary"
+	"net/netip"
 
 	"golang.org/x/net/ipv4"
 )
@@ -23,11 +24,23 @@ func CreateRejectPacket(packet []byte, out []byte) []byte {
 	case 6: // tcp
 		return ipv4CreateRejectTCPPacket(packet, out)
 	default:
-		return ipv4CreateRejectICMPPacket(packet, out)
+		return ipv4CreateUnreachablePacket(packet, out, 3, 0)
 	}
 }
 
-func ipv4CreateRejectICMPPacket(packet []byte, out []byte) []byte {
+// CreateFragNeededPacket creates an icmp fragmentation needed reply to packet, telling the sender to keep its packets
+// to mtu bytes. It returns nil for anything but an ipv4 packet with the don't fragment bit set.
+func CreateFragNeededPacket(packet []byte, out []byte, mtu int) []byte {
+	if len(packet) < ipv4.HeaderLen || int(packet[0]>>4) != ipv4.Version || packet[6]&0x40 == 0 {
+		return nil
+	}
+
+	return ipv4CreateUnreachablePacket(packet, out, 4, uint16(mtu))
+}
+
+// ipv4CreateUnreachablePacket creates an icmp destination unreachable reply to packet with code, mtu is only sent
+// for fragmentation needed
+func ipv4CreateUnreachablePacket(packet []byte, out []byte, code byte, mtu uint16) []byte {
 	ihl := int(packet[0]&0x0f) << 2
 
 	if len(packet) < ihl {
@@ -71,14 +84,14 @@ func ipv4CreateRejectICMPPacket(packet []byte, out []byte) []byte {
 
 	// ICMP Destination Unreachable
 	icmpOut := out[ipv4.HeaderLen:]
-	icmpOut[0] = 3 // type (Destination unreachable)
-	icmpOut[1] = 3 // code (Port unreachable error)
-	icmpOut[2] = 0 // checksum
-	icmpOut[3] = 0 //  .
-	icmpOut[4] = 0 // unused
-	icmpOut[5] = 0 //  .
-	icmpOut[6] = 0 //  .
-	icmpOut[7] = 0 //  .
+	icmpOut[0] = 3                // type (Destination unreachable)
+	icmpOut[1] = code             // code (Port unreachable error or Fragmentation needed)
+	icmpOut[2] = 0                // checksum
+	icmpOut[3] = 0                //  .
+	icmpOut[4] = 0                // unused
+	icmpOut[5] = 0                //  .
+	icmpOut[6] = byte(mtu >> 8)   // next-hop mtu, only for Fragmentation needed
+	icmpOut[7] = byte(mtu & 0xff) //  .
 
 	// Copy original IP header and first 8 bytes as body
 	copy(icmpOut[8:], packet[:packetLen])
@@ -165,6 +178,70 @@ func ipv4CreateRejectTCPPacket(packet []byte, out []byte) []byte {
 	return out
 }
 
+// ClampTCPMSS lowers the maximum segment size option of an ipv4 tcp syn to mss, so neither end of the connection
+// sends segments larger than the path can carry. It returns true if packet was changed.
+func ClampTCPMSS(packet []byte, mss uint16) bool {
+	if len(packet) < ipv4.HeaderLen || int(packet[0]>>4) != ipv4.Version || packet[9] != 6 {
+		return false
+	}
+
+	// Only the first fragment has the tcp header
+	if binary.BigEndian.Uint16(packet[6:8])&0x1fff != 0 {
+		return false
+	}
+
+	ihl := int(packet[0]&0x0f) << 2
+	if len(packet) < ihl+20 {
+		return false
+	}
+
+	tcp := packet[ihl:]
+	if tcp[13]&0b00000010 == 0 {
+		// Not a syn
+		return false
+	}
+
+	dataOffset := int(tcp[12]>>4) << 2
+	if dataOffset < 20 || len(tcp) < dataOffset {
+		return false
+	}
+
+	opts := tcp[20:dataOffset]
+	for len(opts) > 0 {
+		switch opts[0] {
+		case 0: // end of options
+			return false
+		case 1: // no-op
+			opts = opts[1:]
+			continue
+		}
+
+		if len(opts) < 2 || opts[1] < 2 || int(opts[1]) > len(opts) {
+			return false
+		}
+
+		if opts[0] == 2 && opts[1] == 4 {
+			old := binary.BigEndian.Uint16(opts[2:4])
+			if old <= mss {
+				return false
+			}
+
+			binary.BigEndian.PutUint16(opts[2:4], mss)
+			// Update the checksum for the changed word as described in rfc1624
+			csum := uint32(^binary.BigEndian.Uint16(tcp[16:18])) + uint32(^old) + uint32(mss)
+			for csum > 0xffff {
+				csum = (csum >> 16) + (csum & 0xffff)
+			}
+			binary.BigEndian.PutUint16(tcp[16:18], ^uint16(csum))
+			return true
+		}
+
+		opts = opts[opts[1]:]
+	}
+
+	return false
+}
+
 func CreateICMPEchoResponse(packet, out []byte) []byte {
 	// Return early if this is not a simple ICMP Echo Request
 	//TODO: make constants out of these
@@ -199,6 +276,55 @@ func CreateICMPEchoResponse(packet, out []byte) []byte {
 	return out
 }
 
+// CreateUDPPacket returns payload in a udp packet from src to dst, with an ipv6 header if src is an ipv6 address and
+// an ipv4 header otherwise
+func CreateUDPPacket(src, dst netip.AddrPort, payload []byte) []byte {
+	ipLen := ipv4.HeaderLen
+	if src.Addr().Is6() {
+		ipLen = 40
+	}
+	udpLen := 8 + len(payload)
+	out := make([]byte, ipLen+udpLen)
+
+	// The udp checksum covers a pseudo header of the addresses, protocol and udp length
+	var csum uint32
+	if src.Addr().Is6() {
+		out[0] = 6 << 4
+		binary.BigEndian.PutUint16(out[4:], uint16(udpLen))
+		out[6] = 17
+		out[7] = 64
+		s, d := src.Addr().As16(), dst.Addr().As16()
+		copy(out[8:], s[:])
+		copy(out[24:], d[:])
+		csum = uint32(^tcpipChecksum(out[8:40], 17+uint32(udpLen)))
+	} else {
+		out[0] = 4<<4 | 5
+		binary.BigEndian.PutUint16(out[2:], uint16(ipLen+udpLen))
+		out[6] = 0x40 // Don't fragment
+		out[8] = 64
+		out[9] = 17
+		s, d := src.Addr().As4(), dst.Addr().As4()
+		copy(out[12:], s[:])
+		copy(out[16:], d[:])
+		binary.BigEndian.PutUint16(out[10:], tcpipChecksum(out[:ipLen], 0))
+		csum = ipv4PseudoheaderChecksum(s[:], d[:], 17, uint32(udpLen))
+	}
+
+	udp := out[ipLen:]
+	binary.BigEndian.PutUint16(udp[0:], src.Port())
+	binary.BigEndian.PutUint16(udp[2:], dst.Port())
+	binary.BigEndian.PutUint16(udp[4:], uint16(udpLen))
+	copy(udp[8:], payload)
+
+	// A checksum of 0 means none was computed, all ones is the same value in ones complement
+	sum := tcpipChecksum(udp, csum)
+	if sum == 0 {
+		sum = 0xffff
+	}
+	binary.BigEndian.PutUint16(udp[6:], sum)
+	return out
+}
+
 // calculates the TCP/IP checksum defined in rfc1071. The passed-in
 // csum is any initial checksum data that's already been computed.
 //
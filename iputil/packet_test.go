@@ -1,10 +1,13 @@
 package iputil
 
 import (
+	"encoding/binary"
 	"net"
+	"net/netip"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"golang.org/x/net/ipv4"
 )
 
@@ -71,3 +74,113 @@ func Test_CreateRejectPacket(t *testing.T) {
 	assert.NotNil(t, rejectPacket)
 	assert.Len(t, rejectPacket, expectedLen)
 }
+
+func Test_CreateFragNeededPacket(t *testing.T) {
+	h := ipv4.Header{
+		Version:  4,
+		Len:      20,
+		TotalLen: 1400,
+		Flags:    ipv4.DontFragment,
+		TTL:      64,
+		Src:      net.IPv4(10, 0, 0, 1),
+		Dst:      net.IPv4(10, 0, 0, 2),
+		Protocol: 17, // UDP
+	}
+
+	b, err := h.Marshal()
+	if err != nil {
+		t.Fatalf("h.Marhshal: %v", err)
+	}
+	b = append(b, make([]byte, 1380)...)
+
+	out := make([]byte, MaxRejectPacketSize)
+	p := CreateFragNeededPacket(b, out, 1200)
+	assert.Len(t, p, ipv4.HeaderLen+8+h.Len+8)
+	assert.Equal(t, []byte{10, 0, 0, 2}, p[12:16])
+	assert.Equal(t, []byte{10, 0, 0, 1}, p[16:20])
+	icmp := p[ipv4.HeaderLen:]
+	assert.Equal(t, []byte{3, 4}, icmp[0:2])
+	assert.Equal(t, uint16(1200), binary.BigEndian.Uint16(icmp[6:8]))
+	// The checksum of a valid icmp message sums to 0
+	assert.Equal(t, uint16(0), tcpipChecksum(icmp, 0))
+
+	// Packets that may be fragmented get nothing
+	b[6] = 0
+	assert.Nil(t, CreateFragNeededPacket(b, out, 1200))
+}
+
+func Test_ClampTCPMSS(t *testing.T) {
+	src, dst := []byte{10, 0, 0, 1}, []byte{10, 0, 0, 2}
+	newSyn := func(flags byte, opts ...byte) []byte {
+		h := ipv4.Header{Version: 4, Len: 20, TotalLen: 20 + 20 + len(opts), TTL: 64, Protocol: 6, Src: net.IP(src), Dst: net.IP(dst)}
+		b, err := h.Marshal()
+		if err != nil {
+			t.Fatalf("h.Marhshal: %v", err)
+		}
+
+		tcp := make([]byte, 20, 20+len(opts))
+		tcp[12] = byte((20+len(opts))/4) << 4
+		tcp[13] = flags
+		tcp = append(tcp, opts...)
+		binary.BigEndian.PutUint16(tcp[16:], tcpipChecksum(tcp, ipv4PseudoheaderChecksum(src, dst, 6, uint32(len(tcp)))))
+		return append(b, tcp...)
+	}
+
+	checksumOk := func(p []byte) bool {
+		tcp := p[20:]
+		return tcpipChecksum(tcp, ipv4PseudoheaderChecksum(src, dst, 6, uint32(len(tcp)))) == 0
+	}
+
+	// mss 1460 after a no-op and window scale
+	p := newSyn(0b10, 1, 3, 3, 7, 2, 4, 0x05, 0xb4)
+	assert.True(t, ClampTCPMSS(p, 1200))
+	assert.Equal(t, uint16(1200), binary.BigEndian.Uint16(p[20+20+6:]))
+	assert.True(t, checksumOk(p))
+
+	// Already small enough
+	assert.False(t, ClampTCPMSS(p, 1300))
+	assert.Equal(t, uint16(1200), binary.BigEndian.Uint16(p[20+20+6:]))
+
+	// Not a syn
+	p = newSyn(0b10000, 2, 4, 0x05, 0xb4)
+	assert.False(t, ClampTCPMSS(p, 1200))
+
+	// No mss option
+	p = newSyn(0b10, 1, 1, 1, 1)
+	assert.False(t, ClampTCPMSS(p, 1200))
+
+	// A truncated option
+	p = newSyn(0b10, 2, 8, 0x05, 0xb4)
+	assert.False(t, ClampTCPMSS(p, 1200))
+}
+
+func Test_CreateUDPPacket(t *testing.T) {
+	payload := []byte("nebula!")
+
+	p := CreateUDPPacket(netip.MustParseAddrPort("192.168.0.1:4242"), netip.MustParseAddrPort("10.1.2.3:1234"), payload)
+	require.Len(t, p, ipv4.HeaderLen+8+len(payload))
+	h, err := ipv4.ParseHeader(p)
+	require.NoError(t, err)
+	assert.Equal(t, len(p), h.TotalLen)
+	assert.Equal(t, 17, h.Protocol)
+	assert.Equal(t, net.IPv4(192, 168, 0, 1), h.Src)
+	assert.Equal(t, net.IPv4(10, 1, 2, 3), h.Dst)
+	// The checksum of a valid header or datagram sums to 0
+	assert.Equal(t, uint16(0), tcpipChecksum(p[:ipv4.HeaderLen], 0))
+	udp := p[ipv4.HeaderLen:]
+	assert.Equal(t, uint16(4242), binary.BigEndian.Uint16(udp[0:]))
+	assert.Equal(t, uint16(1234), binary.BigEndian.Uint16(udp[2:]))
+	assert.Equal(t, payload, udp[8:])
+	assert.Equal(t, uint16(0), tcpipChecksum(udp, ipv4PseudoheaderChecksum(p[12:16], p[16:20], 17, uint32(len(udp)))))
+
+	p = CreateUDPPacket(netip.MustParseAddrPort("[fd00::1]:4242"), netip.MustParseAddrPort("[2001:db8::2]:1234"), payload)
+	require.Len(t, p, 40+8+len(payload))
+	assert.Equal(t, byte(6), p[0]>>4)
+	assert.Equal(t, uint16(8+len(payload)), binary.BigEndian.Uint16(p[4:]))
+	assert.Equal(t, byte(17), p[6])
+	assert.Equal(t, netip.MustParseAddr("fd00::1").AsSlice(), p[8:24])
+	assert.Equal(t, netip.MustParseAddr("2001:db8::2").AsSlice(), p[24:40])
+	udp = p[40:]
+	assert.Equal(t, payload, udp[8:])
+	assert.Equal(t, uint16(0), tcpipChecksum(append(append([]byte{}, p[8:40]...), udp...), 17+uint32(len(udp))))
+}
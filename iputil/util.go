@@ -7,26 +7,138 @@ import (
 	"net/netip"
 )
 
-type VpnIp uint32
+// VpnIp is an address on the overlay, ipv4 or ipv6. An ipv4 address is held ipv4-mapped, as ::ffff:a.b.c.d, so
+// both families share one comparable value that can key a map without allocating. The zero VpnIp is no address.
+type VpnIp struct {
+	hi, lo uint64
+}
+
+// v4Mapped is the upper half of lo for an ipv4-mapped address
+const v4Mapped = 0xffff << 32
 
 const maxIPv4StringLen = len("255.255.255.255")
 
+// VpnIpFrom4 returns the ipv4 address ip, as it is carried in a uint32 on the wire
+func VpnIpFrom4(ip uint32) VpnIp {
+	return VpnIp{lo: v4Mapped | uint64(ip)}
+}
+
+// VpnIpFrom16 returns the ipv6 address ip, an ipv4-mapped ip is the ipv4 address
+func VpnIpFrom16(ip [16]byte) VpnIp {
+	return VpnIp{hi: binary.BigEndian.Uint64(ip[:8]), lo: binary.BigEndian.Uint64(ip[8:])}
+}
+
+// Ip2VpnIp returns the address in ip, which is 4 or 16 bytes. Anything else is the zero VpnIp.
+func Ip2VpnIp(ip []byte) VpnIp {
+	switch len(ip) {
+	case net.IPv4len:
+		return VpnIpFrom4(binary.BigEndian.Uint32(ip))
+	case net.IPv6len:
+		return VpnIpFrom16([16]byte(ip))
+	}
+	return VpnIp{}
+}
+
+// Addr2VpnIp returns the address in ip, a zone is dropped
+func Addr2VpnIp(ip netip.Addr) VpnIp {
+	if !ip.IsValid() {
+		return VpnIp{}
+	}
+	return VpnIpFrom16(ip.As16())
+}
+
+// Compare returns -1, 0 or 1 as ip sorts before, with or after o in the order of their 16 byte forms
+func (ip VpnIp) Compare(o VpnIp) int {
+	switch {
+	case ip.hi < o.hi:
+		return -1
+	case ip.hi > o.hi:
+		return 1
+	case ip.lo < o.lo:
+		return -1
+	case ip.lo > o.lo:
+		return 1
+	}
+	return 0
+}
+
+// IsValid is false for the zero VpnIp
+func (ip VpnIp) IsValid() bool {
+	return ip != VpnIp{}
+}
+
+// Is4 is true for an ipv4 address
+func (ip VpnIp) Is4() bool {
+	return ip.hi == 0 && ip.lo>>32 == 0xffff
+}
+
+// Is6 is true for an ipv6 address that is not ipv4-mapped
+func (ip VpnIp) Is6() bool {
+	return ip.IsValid() && !ip.Is4()
+}
+
+// Uint32 returns an ipv4 address as it is carried on the wire, it is 0 for anything else
+func (ip VpnIp) Uint32() uint32 {
+	if !ip.Is4() {
+		return 0
+	}
+	return uint32(ip.lo)
+}
+
+// As16 returns the address in its 16 byte form, ipv4 addresses are ipv4-mapped
+func (ip VpnIp) As16() (b [16]byte) {
+	binary.BigEndian.PutUint64(b[:8], ip.hi)
+	binary.BigEndian.PutUint64(b[8:], ip.lo)
+	return
+}
+
+// BitLen is 32 for an ipv4 address and 128 for anything else
+func (ip VpnIp) BitLen() int {
+	if ip.Is4() {
+		return 32
+	}
+	return 128
+}
+
+// Mask returns ip with all but the leading bits of its family cleared
+func (ip VpnIp) Mask(bits int) VpnIp {
+	if ip.Is4() {
+		bits += 96
+	}
+	switch {
+	case bits <= 0:
+		return VpnIp{lo: ip.lo & v4Mapped}
+	case bits < 64:
+		return VpnIp{hi: ip.hi &^ (1<<(64-bits) - 1), lo: 0}
+	case bits < 128:
+		return VpnIp{hi: ip.hi, lo: ip.lo &^ (1<<(128-bits) - 1)}
+	}
+	return ip
+}
+
 func (ip VpnIp) String() string {
+	if !ip.Is4() {
+		if !ip.IsValid() {
+			return "invalid IP"
+		}
+		return ip.ToNetIpAddr().String()
+	}
+
 	b := make([]byte, maxIPv4StringLen)
 
-	n := ubtoa(b, 0, byte(ip>>24))
+	n := ubtoa(b, 0, byte(ip.lo>>24))
 	b[n] = '.'
 	n++
 
-	n += ubtoa(b, n, byte(ip>>16&255))
+	n += ubtoa(b, n, byte(ip.lo>>16&255))
 	b[n] = '.'
 	n++
 
-	n += ubtoa(b, n, byte(ip>>8&255))
+	n += ubtoa(b, n, byte(ip.lo>>8&255))
 	b[n] = '.'
 	n++
 
-	n += ubtoa(b, n, byte(ip&255))
+	n += ubtoa(b, n, byte(ip.lo&255))
 	return string(b[:n])
 }
 
@@ -34,23 +146,25 @@ func (ip VpnIp) MarshalJSON() ([]byte, error) {
 	return []byte(fmt.Sprintf("\"%s\"", ip.String())), nil
 }
 
+// ToIP returns ip as a net.IP, 4 bytes long for ipv4
 func (ip VpnIp) ToIP() net.IP {
-	nip := make(net.IP, 4)
-	binary.BigEndian.PutUint32(nip, uint32(ip))
-	return nip
+	if ip.Is4() {
+		nip := make(net.IP, net.IPv4len)
+		binary.BigEndian.PutUint32(nip, uint32(ip.lo))
+		return nip
+	}
+	b := ip.As16()
+	return b[:]
 }
 
+// ToNetIpAddr returns ip as a netip.Addr, ipv4 addresses are not ipv4-mapped
 func (ip VpnIp) ToNetIpAddr() netip.Addr {
-	var nip [4]byte
-	binary.BigEndian.PutUint32(nip[:], uint32(ip))
-	return netip.AddrFrom4(nip)
-}
-
-func Ip2VpnIp(ip []byte) VpnIp {
-	if len(ip) == 16 {
-		return VpnIp(binary.BigEndian.Uint32(ip[12:16]))
+	if ip.Is4() {
+		var nip [4]byte
+		binary.BigEndian.PutUint32(nip[:], uint32(ip.lo))
+		return netip.AddrFrom4(nip)
 	}
-	return VpnIp(binary.BigEndian.Uint32(ip))
+	return netip.AddrFrom16(ip.As16())
 }
 
 func ToNetIpAddr(ip net.IP) (netip.Addr, error) {
@@ -7,6 +7,8 @@ import (
 	"fmt"
 	"net"
 	"net/netip"
+	"slices"
+	"sort"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -37,10 +39,10 @@ type LightHouse struct {
 	ctx          context.Context
 	amLighthouse bool
 	myVpnIp      iputil.VpnIp
-	myVpnZeros   iputil.VpnIp
-	myVpnNet     *net.IPNet
-	punchConn    udp.Conn
-	punchy       *Punchy
+	// myVpnNets are the networks in our certificate, the first holds myVpnIp
+	myVpnNets []netip.Prefix
+	punchConn udp.Conn
+	punchy    *Punchy
 
 	// Local cache of answers from light houses
 	// map of vpn Ip to answers
@@ -66,26 +68,75 @@ type LightHouse struct {
 
 	interval     atomic.Int64
 	updateCancel context.CancelFunc
+
+	// syncPeers are the other lighthouses we share what hosts report to us with, see lighthouse_sync.go
+	syncPeers    atomic.Pointer[map[iputil.VpnIp]struct{}]
+	syncInterval atomic.Int64
+	syncCancel   context.CancelFunc
+	syncTrigger  chan iputil.VpnIp
 	ifce         EncWriter
-	nebulaPort   uint32 // 32 bits because protobuf does not have a uint16
+	nebulaPort   atomic.Uint32 // 32 bits because protobuf does not have a uint16, it moves when a reload rebinds the listener
 
 	advertiseAddrs atomic.Pointer[[]netIpAndPort]
+	// publicAddrs are our public addresses found by port_mapping and stun, by what found them
+	publicAddrs atomic.Pointer[map[string]netIpAndPort]
+	// advertisePrivate and advertiseMax filter the discovered addresses we report, advertiseAddrs are always reported
+	advertisePrivate atomic.Bool
+	advertiseMax     atomic.Int64
 
 	// IP's of relays that can be used by peers to access me
 	relaysForMe atomic.Pointer[[]iputil.VpnIp]
+	// discoveredRelays are the relays relay.discover picked, they are reported along with relaysForMe
+	discoveredRelays atomic.Pointer[[]iputil.VpnIp]
+
+	// relayCapacity is what we advertise as a relay, 0 when we do not. relayLoad returns how many relay indexes we have
+	// in use. relayAdverts are the relays that advertised to us, or that a lighthouse told us about. See
+	// lighthouse_relays.go
+	relayCapacity    atomic.Uint32
+	relayLoad        func() int
+	relayAdvertsLock sync.Mutex
+	relayAdverts     map[iputil.VpnIp]*relayAdvert
+
+	// routeAdvertise are the unsafe networks we advertise as a gateway. routeAdverts are the networks gateways
+	// advertised to us, or that a lighthouse told us about. hostSubnets returns the unsafe networks in the certificate
+	// of a host, a gateway may only advertise those. See lighthouse_routes.go
+	routeAdvertise   atomic.Pointer[[]routeAdvert]
+	routeAdvertsLock sync.Mutex
+	routeAdverts     map[iputil.VpnIp]*gatewayAdvert
+	hostSubnets      func(iputil.VpnIp) []*net.IPNet
+
+	// hostVpnIp returns the vpn ip a host reports to us as when asked for any of the vpn ips in its certificate
+	hostVpnIp func(iputil.VpnIp) iputil.VpnIp
 
 	queryChan chan iputil.VpnIp
-
-	calculatedRemotes atomic.Pointer[cidr.Tree4[[]*calculatedRemote]] // Maps VpnIp to []*calculatedRemote
-
-	metrics           *MessageMetrics
-	metricHolepunchTx metrics.Counter
-	l                 *logrus.Logger
+	// queryHigh is the deepest the query queue has been
+	queryHigh watermark
+
+	calculatedRemotes atomic.Pointer[cidr.Tree6[[]*calculatedRemote]] // Maps VpnIp to []*calculatedRemote
+
+	// requireSignedUpdates drops host updates that are not signed, hostUpdateKey returns the key a host signs with.
+	// See lighthouse_auth.go
+	requireSignedUpdates atomic.Bool
+	hostUpdateKey        func(vpnIp iputil.VpnIp) ([]byte, error)
+
+	// hostTTL forgets hosts that have not updated us within it, staleAfter flags query replies about hosts that have
+	// not updated us within it. See lighthouse_ttl.go
+	hostTTL     atomic.Int64
+	staleAfter  atomic.Int64
+	evictCancel context.CancelFunc
+
+	metrics                  *MessageMetrics
+	metricHolepunchTx        metrics.Counter
+	metricHostUpdateRejected metrics.Counter
+	metricEvicted            metrics.Counter
+	metricStaleReplies       metrics.Counter
+	l                        *logrus.Logger
 }
 
 // NewLightHouseFromConfig will build a Lighthouse struct from the values provided in the config object
 // addrMap should be nil unless this is during a config reload
-func NewLightHouseFromConfig(ctx context.Context, l *logrus.Logger, c *config.C, myVpnNet *net.IPNet, pc udp.Conn, p *Punchy) (*LightHouse, error) {
+// myVpnNets are the networks in our certificate, the first is where our vpn ip is taken from
+func NewLightHouseFromConfig(ctx context.Context, l *logrus.Logger, c *config.C, myVpnNets []*net.IPNet, pc udp.Conn, p *Punchy) (*LightHouse, error) {
 	amLighthouse := c.GetBool("lighthouse.am_lighthouse", false)
 	nebulaPort := uint32(c.GetInt("listen.port", 0))
 	if amLighthouse && nebulaPort == 0 {
@@ -101,30 +152,52 @@ func NewLightHouseFromConfig(ctx context.Context, l *logrus.Logger, c *config.C,
 		nebulaPort = uint32(uPort.Port)
 	}
 
-	ones, _ := myVpnNet.Mask.Size()
+	nets := make([]netip.Prefix, len(myVpnNets))
+	for i, n := range myVpnNets {
+		prefix, err := iputil.ToNetIpPrefix(*n)
+		if err != nil {
+			return nil, util.NewContextualError("Invalid vpn network", m{"network": n}, err)
+		}
+		nets[i] = prefix.Masked()
+	}
+
 	h := LightHouse{
 		ctx:          ctx,
 		amLighthouse: amLighthouse,
-		myVpnIp:      iputil.Ip2VpnIp(myVpnNet.IP),
-		myVpnZeros:   iputil.VpnIp(32 - ones),
-		myVpnNet:     myVpnNet,
+		myVpnIp:      iputil.Ip2VpnIp(myVpnNets[0].IP),
+		myVpnNets:    nets,
 		addrMap:      make(map[iputil.VpnIp]*RemoteList),
-		nebulaPort:   nebulaPort,
 		punchConn:    pc,
 		punchy:       p,
 		queryChan:    make(chan iputil.VpnIp, c.GetUint32("handshakes.query_buffer", 64)),
+		syncTrigger:  make(chan iputil.VpnIp, 8),
+		relayAdverts: make(map[iputil.VpnIp]*relayAdvert),
+		routeAdverts: make(map[iputil.VpnIp]*gatewayAdvert),
 		l:            l,
 	}
+	h.nebulaPort.Store(nebulaPort)
 	lighthouses := make(map[iputil.VpnIp]struct{})
 	h.lighthouses.Store(&lighthouses)
 	staticList := make(map[iputil.VpnIp]struct{})
 	h.staticList.Store(&staticList)
+	syncPeers := make(map[iputil.VpnIp]struct{})
+	h.syncPeers.Store(&syncPeers)
+	publicAddrs := make(map[string]netIpAndPort)
+	h.publicAddrs.Store(&publicAddrs)
+	discoveredRelays := []iputil.VpnIp{}
+	h.discoveredRelays.Store(&discoveredRelays)
 
 	if c.GetBool("stats.lighthouse_metrics", false) {
 		h.metrics = newLighthouseMetrics()
 		h.metricHolepunchTx = metrics.GetOrRegisterCounter("messages.tx.holepunch", nil)
+		h.metricHostUpdateRejected = metrics.GetOrRegisterCounter("lighthouse.rx.HostUpdateNotification.rejected", nil)
+		h.metricEvicted = metrics.GetOrRegisterCounter("lighthouse.evicted", nil)
+		h.metricStaleReplies = metrics.GetOrRegisterCounter("lighthouse.tx.HostQueryReply.stale", nil)
 	} else {
 		h.metricHolepunchTx = metrics.NilCounter{}
+		h.metricHostUpdateRejected = metrics.NilCounter{}
+		h.metricEvicted = metrics.NilCounter{}
+		h.metricStaleReplies = metrics.NilCounter{}
 	}
 
 	err := h.reload(c, true)
@@ -167,11 +240,50 @@ func (lh *LightHouse) GetAdvertiseAddrs() []netIpAndPort {
 	return *lh.advertiseAddrs.Load()
 }
 
+// setPublicAddr sets the public address source found for us, nil when it found none. Returns true if it changed
+func (lh *LightHouse) setPublicAddr(source string, addr *netIpAndPort) bool {
+	lh.Lock()
+	defer lh.Unlock()
+
+	old := lh.publicAddrs.Load()
+	current, ok := (*old)[source]
+	if addr == nil && !ok || addr != nil && ok && current.ip.Equal(addr.ip) && current.port == addr.port {
+		return false
+	}
+
+	addrs := make(map[string]netIpAndPort, len(*old)+1)
+	for k, v := range *old {
+		addrs[k] = v
+	}
+
+	if addr == nil {
+		delete(addrs, source)
+	} else {
+		addrs[source] = *addr
+	}
+
+	lh.publicAddrs.Store(&addrs)
+	return true
+}
+
 func (lh *LightHouse) GetRelaysForMe() []iputil.VpnIp {
-	return *lh.relaysForMe.Load()
+	relays := *lh.relaysForMe.Load()
+	discovered := *lh.discoveredRelays.Load()
+	if len(discovered) == 0 {
+		return relays
+	}
+
+	all := make([]iputil.VpnIp, len(relays), len(relays)+len(discovered))
+	copy(all, relays)
+	for _, r := range discovered {
+		if !slices.Contains(all, r) {
+			all = append(all, r)
+		}
+	}
+	return all
 }
 
-func (lh *LightHouse) getCalculatedRemotes() *cidr.Tree4[[]*calculatedRemote] {
+func (lh *LightHouse) getCalculatedRemotes() *cidr.Tree6[[]*calculatedRemote] {
 	return lh.calculatedRemotes.Load()
 }
 
@@ -180,7 +292,8 @@ func (lh *LightHouse) GetUpdateInterval() int64 {
 }
 
 func (lh *LightHouse) reload(c *config.C, initial bool) error {
-	if initial || c.HasChanged("lighthouse.advertise_addrs") {
+	// Entries without a port use listen.port, a reload moves it when it rebinds the listener
+	if initial || c.HasChanged("lighthouse.advertise_addrs") || c.HasChanged("listen.port") {
 		rawAdvAddrs := c.GetStringSlice("lighthouse.advertise_addrs", []string{})
 		advAddrs := make([]netIpAndPort, 0)
 
@@ -191,10 +304,10 @@ func (lh *LightHouse) reload(c *config.C, initial bool) error {
 			}
 
 			if fPort == 0 {
-				fPort = uint16(lh.nebulaPort)
+				fPort = uint16(lh.nebulaPort.Load())
 			}
 
-			if ip4 := fIp.To4(); ip4 != nil && lh.myVpnNet.Contains(fIp) {
+			if lh.inVpnNets(iputil.Ip2VpnIp(fIp)) {
 				lh.l.WithField("addr", rawAddr).WithField("entry", i+1).
 					Warn("Ignoring lighthouse.advertise_addrs report because it is within the nebula network range")
 				continue
@@ -210,6 +323,34 @@ func (lh *LightHouse) reload(c *config.C, initial bool) error {
 		}
 	}
 
+	if initial || c.HasChanged("lighthouse.advertise_private") {
+		lh.advertisePrivate.Store(c.GetBool("lighthouse.advertise_private", true))
+
+		if !initial {
+			lh.l.Infof("lighthouse.advertise_private changed to %v", lh.advertisePrivate.Load())
+		}
+	}
+
+	if initial || c.HasChanged("lighthouse.advertise_max") {
+		advertiseMax := c.GetInt("lighthouse.advertise_max", 0)
+		if advertiseMax < 0 {
+			return util.NewContextualError("lighthouse.advertise_max must not be negative", m{"advertise_max": advertiseMax}, nil)
+		}
+		lh.advertiseMax.Store(int64(advertiseMax))
+
+		if !initial {
+			lh.l.Infof("lighthouse.advertise_max changed to %v", advertiseMax)
+		}
+	}
+
+	if initial || c.HasChanged("lighthouse.require_signed_updates") {
+		lh.requireSignedUpdates.Store(c.GetBool("lighthouse.require_signed_updates", false))
+
+		if !initial {
+			lh.l.Infof("lighthouse.require_signed_updates changed to %v", lh.requireSignedUpdates.Load())
+		}
+	}
+
 	if initial || c.HasChanged("lighthouse.interval") {
 		lh.interval.Store(int64(c.GetInt("lighthouse.interval", 10)))
 
@@ -225,6 +366,54 @@ func (lh *LightHouse) reload(c *config.C, initial bool) error {
 		}
 	}
 
+	if initial || c.HasChanged("lighthouse.host_ttl") || c.HasChanged("lighthouse.stale_after") {
+		hostTTL, staleAfter, err := loadHostTTL(c)
+		if err != nil {
+			return err
+		}
+
+		ttlChanged := time.Duration(lh.hostTTL.Swap(int64(hostTTL))) != hostTTL
+		lh.staleAfter.Store(int64(staleAfter))
+
+		if !initial {
+			lh.l.WithField("hostTTL", hostTTL).WithField("staleAfter", staleAfter).
+				Info("lighthouse.host_ttl and/or lighthouse.stale_after has changed")
+
+			if ttlChanged {
+				if lh.evictCancel != nil {
+					// May not always have a running routine
+					lh.evictCancel()
+				}
+
+				lh.StartEvictionWorker()
+			}
+		}
+	}
+
+	if initial || c.HasChanged("lighthouse.sync") {
+		syncPeers, syncInterval, err := lh.loadSync(c)
+		if err != nil {
+			return err
+		}
+
+		if syncPeers == nil {
+			syncPeers = make(map[iputil.VpnIp]struct{})
+		}
+		lh.syncPeers.Store(&syncPeers)
+		lh.syncInterval.Store(int64(syncInterval))
+
+		if !initial {
+			lh.l.WithField("peers", len(syncPeers)).WithField("interval", syncInterval).Info("lighthouse.sync has changed")
+
+			if lh.syncCancel != nil {
+				// May not always have a running routine
+				lh.syncCancel()
+			}
+
+			lh.StartSyncWorker()
+		}
+	}
+
 	if initial || c.HasChanged("lighthouse.remote_allow_list") || c.HasChanged("lighthouse.remote_allow_ranges") {
 		ral, err := NewRemoteAllowListFromConfig(c, "lighthouse.remote_allow_list", "lighthouse.remote_allow_ranges")
 		if err != nil {
@@ -279,7 +468,7 @@ func (lh *LightHouse) reload(c *config.C, initial bool) error {
 		}
 		// Build a new list based on current config.
 		staticList := make(map[iputil.VpnIp]struct{})
-		err := lh.loadStaticMap(c, lh.myVpnNet, staticList)
+		err := lh.loadStaticMap(c, staticList)
 		if err != nil {
 			return err
 		}
@@ -304,7 +493,7 @@ func (lh *LightHouse) reload(c *config.C, initial bool) error {
 
 	if initial || c.HasChanged("lighthouse.hosts") {
 		lhMap := make(map[iputil.VpnIp]struct{})
-		err := lh.parseLighthouses(c, lh.myVpnNet, lhMap)
+		err := lh.parseLighthouses(c, lhMap)
 		if err != nil {
 			return err
 		}
@@ -339,10 +528,33 @@ func (lh *LightHouse) reload(c *config.C, initial bool) error {
 		}
 	}
 
+	if initial || c.HasChanged("relay.advertise") || c.HasChanged("relay.capacity") {
+		capacity, err := loadRelayAdvertise(c)
+		if err != nil {
+			return err
+		}
+
+		if lh.relayCapacity.Swap(capacity) != capacity && !initial {
+			lh.l.WithField("capacity", capacity).Info("relay.advertise has changed")
+		}
+	}
+
+	if initial || c.HasChanged("routing.advertise") {
+		routes, err := loadRouteAdvertise(c)
+		if err != nil {
+			return err
+		}
+
+		lh.routeAdvertise.Store(&routes)
+		if !initial {
+			lh.l.WithField("routes", routes).Info("routing.advertise has changed")
+		}
+	}
+
 	return nil
 }
 
-func (lh *LightHouse) parseLighthouses(c *config.C, tunCidr *net.IPNet, lhMap map[iputil.VpnIp]struct{}) error {
+func (lh *LightHouse) parseLighthouses(c *config.C, lhMap map[iputil.VpnIp]struct{}) error {
 	lhs := c.GetStringSlice("lighthouse.hosts", []string{})
 	if lh.amLighthouse && len(lhs) != 0 {
 		lh.l.Warn("lighthouse.am_lighthouse enabled on node but upstream lighthouses exist in config")
@@ -353,8 +565,8 @@ func (lh *LightHouse) parseLighthouses(c *config.C, tunCidr *net.IPNet, lhMap ma
 		if ip == nil {
 			return util.NewContextualError("Unable to parse lighthouse host entry", m{"host": host, "entry": i + 1}, nil)
 		}
-		if !tunCidr.Contains(ip) {
-			return util.NewContextualError("lighthouse host is not in our subnet, invalid", m{"vpnIp": ip, "network": tunCidr.String()}, nil)
+		if !lh.inVpnNets(iputil.Ip2VpnIp(ip)) {
+			return util.NewContextualError("lighthouse host is not in our subnet, invalid", m{"vpnIp": ip, "networks": lh.myVpnNets}, nil)
 		}
 		lhMap[iputil.Ip2VpnIp(ip)] = struct{}{}
 	}
@@ -379,6 +591,9 @@ func getStaticMapCadence(c *config.C) (time.Duration, error) {
 	if err != nil {
 		return 0, err
 	}
+	if d <= 0 {
+		return 0, fmt.Errorf("static_map.cadence must be greater than 0")
+	}
 	return d, nil
 }
 
@@ -399,7 +614,7 @@ func getStaticMapNetwork(c *config.C) (string, error) {
 	return network, nil
 }
 
-func (lh *LightHouse) loadStaticMap(c *config.C, tunCidr *net.IPNet, staticList map[iputil.VpnIp]struct{}) error {
+func (lh *LightHouse) loadStaticMap(c *config.C, staticList map[iputil.VpnIp]struct{}) error {
 	d, err := getStaticMapCadence(c)
 	if err != nil {
 		return err
@@ -424,8 +639,8 @@ func (lh *LightHouse) loadStaticMap(c *config.C, tunCidr *net.IPNet, staticList
 			return util.NewContextualError("Unable to parse static_host_map entry", m{"host": k, "entry": i + 1}, nil)
 		}
 
-		if !tunCidr.Contains(rip) {
-			return util.NewContextualError("static_host_map key is not in our subnet, invalid", m{"vpnIp": rip, "network": tunCidr.String(), "entry": i + 1}, nil)
+		if !lh.inVpnNets(iputil.Ip2VpnIp(rip)) {
+			return util.NewContextualError("static_host_map key is not in our subnet, invalid", m{"vpnIp": rip, "networks": lh.myVpnNets, "entry": i + 1}, nil)
 		}
 
 		vpnIp := iputil.Ip2VpnIp(rip)
@@ -469,6 +684,7 @@ func (lh *LightHouse) QueryServer(ip iputil.VpnIp) {
 	}
 
 	lh.queryChan <- ip
+	lh.queryHigh.Observe(int64(len(lh.queryChan)))
 }
 
 func (lh *LightHouse) QueryCache(ip iputil.VpnIp) *RemoteList {
@@ -500,6 +716,10 @@ func (lh *LightHouse) queryAndPrepMessage(vpnIp iputil.VpnIp, f func(*cache) (in
 
 		// vpnIp should also be the owner here since we are a lighthouse.
 		c := v.cache[vpnIp]
+		if c == nil {
+			// The host has not reported to us, another lighthouse may have heard from it
+			c = v.unlockedNewestSynced()
+		}
 		// Make sure we have
 		if c != nil {
 			n, err := f(c)
@@ -517,6 +737,9 @@ func (lh *LightHouse) DeleteVpnIp(vpnIp iputil.VpnIp) {
 	if _, ok := lh.GetStaticHostList()[vpnIp]; ok {
 		return
 	}
+	lh.deleteRelayAdvert(vpnIp)
+	lh.deleteRouteAdvert(vpnIp)
+
 	lh.Lock()
 	//l.Debugln(lh.addrMap)
 	delete(lh.addrMap, vpnIp)
@@ -626,7 +849,7 @@ func (lh *LightHouse) shouldAdd(vpnIp iputil.VpnIp, to netip.Addr) bool {
 		if lh.l.Level >= logrus.TraceLevel {
 			lh.l.WithField("remoteIp", vpnIp).WithField("allow", allow).Trace("remoteAllowList.Allow")
 		}
-		if !allow || ipMaskContains(lh.myVpnIp, lh.myVpnZeros, ip) {
+		if !allow || lh.inVpnNets(ip) {
 			return false
 		}
 	case to.Is6():
@@ -639,8 +862,7 @@ func (lh *LightHouse) shouldAdd(vpnIp iputil.VpnIp, to netip.Addr) bool {
 			lh.l.WithField("remoteIp", to).WithField("allow", allow).Trace("remoteAllowList.Allow")
 		}
 
-		// We don't check our vpn network here because nebula does not support ipv6 on the inside
-		if !allow {
+		if !allow || lh.inVpnNets(iputil.VpnIpFrom16(ipBytes)) {
 			return false
 		}
 	}
@@ -649,12 +871,13 @@ func (lh *LightHouse) shouldAdd(vpnIp iputil.VpnIp, to netip.Addr) bool {
 
 // unlockedShouldAddV4 checks if to is allowed by our allow list
 func (lh *LightHouse) unlockedShouldAddV4(vpnIp iputil.VpnIp, to *Ip4AndPort) bool {
-	allow := lh.GetRemoteAllowList().AllowIpV4(vpnIp, iputil.VpnIp(to.Ip))
+	ip := iputil.VpnIpFrom4(to.Ip)
+	allow := lh.GetRemoteAllowList().AllowIpV4(vpnIp, ip)
 	if lh.l.Level >= logrus.TraceLevel {
 		lh.l.WithField("remoteIp", vpnIp).WithField("allow", allow).Trace("remoteAllowList.Allow")
 	}
 
-	if !allow || ipMaskContains(lh.myVpnIp, lh.myVpnZeros, iputil.VpnIp(to.Ip)) {
+	if !allow || lh.inVpnNets(ip) {
 		return false
 	}
 
@@ -668,8 +891,7 @@ func (lh *LightHouse) unlockedShouldAddV6(vpnIp iputil.VpnIp, to *Ip6AndPort) bo
 		lh.l.WithField("remoteIp", lhIp6ToIp(to)).WithField("allow", allow).Trace("remoteAllowList.Allow")
 	}
 
-	// We don't check our vpn network here because nebula does not support ipv6 on the inside
-	if !allow {
+	if !allow || lh.inVpnNets(VpnIpFromAddr(&Addr{Hi: to.Hi, Lo: to.Lo})) {
 		return false
 	}
 
@@ -691,17 +913,17 @@ func (lh *LightHouse) IsLighthouseIP(vpnIp iputil.VpnIp) bool {
 }
 
 func NewLhQueryByInt(VpnIp iputil.VpnIp) *NebulaMeta {
-	return &NebulaMeta{
-		Type: NebulaMeta_HostQuery,
-		Details: &NebulaMetaDetails{
-			VpnIp: uint32(VpnIp),
-		},
+	m := &NebulaMeta{
+		Type:    NebulaMeta_HostQuery,
+		Details: &NebulaMetaDetails{},
 	}
+	m.Details.setVpnIp(VpnIp)
+	return m
 }
 
 func NewIp4AndPort(ip net.IP, port uint32) *Ip4AndPort {
 	ipp := Ip4AndPort{Port: port}
-	ipp.Ip = uint32(iputil.Ip2VpnIp(ip))
+	ipp.Ip = binary.BigEndian.Uint32(ip.To4())
 	return &ipp
 }
 
@@ -729,6 +951,27 @@ func NewIp6AndPortFromNetIP(ip netip.Addr, port uint16) *Ip6AndPort {
 		Port: uint32(port),
 	}
 }
+
+// NewAddr returns ip for the ipv6 address fields of lighthouse and control messages
+func NewAddr(ip iputil.VpnIp) *Addr {
+	b := ip.As16()
+	return &Addr{
+		Hi: binary.BigEndian.Uint64(b[:8]),
+		Lo: binary.BigEndian.Uint64(b[8:]),
+	}
+}
+
+// VpnIpFromAddr returns the address in a, a nil a is no address
+func VpnIpFromAddr(a *Addr) iputil.VpnIp {
+	if a == nil {
+		return iputil.VpnIp{}
+	}
+	var b [16]byte
+	binary.BigEndian.PutUint64(b[:8], a.Hi)
+	binary.BigEndian.PutUint64(b[8:], a.Lo)
+	return iputil.VpnIpFrom16(b)
+}
+
 func NewUDPAddrFromLH4(ipp *Ip4AndPort) *udp.Addr {
 	ip := ipp.Ip
 	return udp.NewAddr(
@@ -819,34 +1062,36 @@ func (lh *LightHouse) SendUpdate() {
 		}
 	}
 
-	lal := lh.GetLocalAllowList()
-	for _, e := range *localIps(lh.l, lal) {
-		if ip4 := e.To4(); ip4 != nil && ipMaskContains(lh.myVpnIp, lh.myVpnZeros, iputil.Ip2VpnIp(ip4)) {
-			continue
+	for _, e := range *lh.publicAddrs.Load() {
+		if ip := e.ip.To4(); ip != nil {
+			v4 = append(v4, NewIp4AndPort(e.ip, uint32(e.port)))
+		} else {
+			v6 = append(v6, NewIp6AndPort(e.ip, uint32(e.port)))
 		}
+	}
 
-		// Only add IPs that aren't my VPN/tun IP
+	lal := lh.GetLocalAllowList()
+	for _, e := range lh.filterLocalIps(*localIps(lh.l, lal)) {
 		if ip := e.To4(); ip != nil {
-			v4 = append(v4, NewIp4AndPort(e, lh.nebulaPort))
+			v4 = append(v4, NewIp4AndPort(e, lh.nebulaPort.Load()))
 		} else {
-			v6 = append(v6, NewIp6AndPort(e, lh.nebulaPort))
+			v6 = append(v6, NewIp6AndPort(e, lh.nebulaPort.Load()))
 		}
 	}
 
-	var relays []uint32
-	for _, r := range lh.GetRelaysForMe() {
-		relays = append(relays, (uint32)(r))
-	}
-
 	m := &NebulaMeta{
 		Type: NebulaMeta_HostUpdateNotification,
 		Details: &NebulaMetaDetails{
-			VpnIp:       uint32(lh.myVpnIp),
 			Ip4AndPorts: v4,
 			Ip6AndPorts: v6,
-			RelayVpnIp:  relays,
 		},
 	}
+	m.Details.setVpnIp(lh.myVpnIp)
+	for _, r := range lh.GetRelaysForMe() {
+		m.Details.addRelay(r)
+	}
+	lh.setRelayAdvertDetails(m.Details)
+	lh.setRouteAdvertDetails(m.Details)
 
 	lighthouses := lh.GetLighthouses()
 	lh.metricTx(NebulaMeta_HostUpdateNotification, int64(len(lighthouses)))
@@ -860,8 +1105,49 @@ func (lh *LightHouse) SendUpdate() {
 	}
 
 	for vpnIp := range lighthouses {
-		lh.ifce.SendMessageToVpnIp(header.LightHouse, 0, vpnIp, mm, nb, out)
+		lh.ifce.SendHostUpdate(vpnIp, mm, nb, out)
+	}
+}
+
+// filterLocalIps returns the discovered addresses we report to the lighthouses. Our own vpn ips are never reported,
+// private addresses only with lighthouse.advertise_private, and at most lighthouse.advertise_max of them. When there
+// are too many the ones a peer would try first are kept, ipv6 then public ipv4 then private addresses.
+func (lh *LightHouse) filterLocalIps(ips []net.IP) []net.IP {
+	advertisePrivate := lh.advertisePrivate.Load()
+	filtered := make([]net.IP, 0, len(ips))
+	for _, ip := range ips {
+		if lh.inVpnNets(iputil.Ip2VpnIp(ip)) {
+			continue
+		}
+
+		if !advertisePrivate && ip.IsPrivate() {
+			continue
+		}
+
+		filtered = append(filtered, ip)
+	}
+
+	advertiseMax := int(lh.advertiseMax.Load())
+	if advertiseMax == 0 || len(filtered) <= advertiseMax {
+		return filtered
 	}
+
+	rank := func(ip net.IP) int {
+		switch {
+		case ip.IsPrivate():
+			return 2
+		case ip.To4() != nil:
+			return 1
+		default:
+			return 0
+		}
+	}
+
+	sort.SliceStable(filtered, func(i, j int) bool {
+		return rank(filtered[i]) < rank(filtered[j])
+	})
+
+	return filtered[:advertiseMax]
 }
 
 type LightHouseHandler struct {
@@ -907,6 +1193,16 @@ func (lhh *LightHouseHandler) resetMeta() *NebulaMeta {
 	details.Ip4AndPorts = details.Ip4AndPorts[:0]
 	details.Ip6AndPorts = details.Ip6AndPorts[:0]
 	details.RelayVpnIp = details.RelayVpnIp[:0]
+	details.RelayVpnAddrs = details.RelayVpnAddrs[:0]
+	details.Routes = details.Routes[:0]
+	details.VpnAddr = nil
+	// Unmarshal leaves fields that are not in the message alone, a signature or stale flag must not carry over to the
+	// next one
+	details.Time = 0
+	details.Signature = details.Signature[:0]
+	details.Stale = false
+	details.RelayCapacity = 0
+	details.RelayLoad = 0
 	lhh.meta.Details = details
 
 	return lhh.meta
@@ -953,6 +1249,24 @@ func (lhh *LightHouseHandler) HandleRequest(rAddr *udp.Addr, vpnIp iputil.VpnIp,
 
 	case NebulaMeta_HostUpdateNotificationAck:
 		// noop
+
+	case NebulaMeta_HostSyncRequest:
+		lhh.handleHostSyncRequest(vpnIp)
+
+	case NebulaMeta_HostSyncNotification:
+		lhh.handleHostSyncNotification(n, vpnIp)
+
+	case NebulaMeta_RelayQuery:
+		lhh.handleRelayQuery(vpnIp, w)
+
+	case NebulaMeta_RelayQueryReply:
+		lhh.handleRelayQueryReply(n, vpnIp)
+
+	case NebulaMeta_RouteQuery:
+		lhh.handleRouteQuery(vpnIp, w)
+
+	case NebulaMeta_RouteQueryReply:
+		lhh.handleRouteQueryReply(n, vpnIp)
 	}
 }
 
@@ -960,20 +1274,30 @@ func (lhh *LightHouseHandler) handleHostQuery(n *NebulaMeta, vpnIp iputil.VpnIp,
 	// Exit if we don't answer queries
 	if !lhh.lh.amLighthouse {
 		if lhh.l.Level >= logrus.DebugLevel {
-			lhh.l.Debugln("I don't answer queries, but received from: ", addr)
+			lhh.l.WithField("udpAddr", addr).Debugln("I don't answer queries, but received a query")
 		}
 		return
 	}
 
 	//TODO: we can DRY this further
-	reqVpnIp := n.Details.VpnIp
+	reqVpnIp := n.Details.vpnIp()
+	lookupVpnIp := reqVpnIp
+	if lhh.lh.hostVpnIp != nil {
+		// The reply is still about the vpn ip that was asked for, that is what the querier is waiting on
+		lookupVpnIp = lhh.lh.hostVpnIp(reqVpnIp)
+	}
+
 	//TODO: Maybe instead of marshalling into n we marshal into a new `r` to not nuke our current request data
-	found, ln, err := lhh.lh.queryAndPrepMessage(iputil.VpnIp(n.Details.VpnIp), func(c *cache) (int, error) {
+	found, ln, err := lhh.lh.queryAndPrepMessage(lookupVpnIp, func(c *cache) (int, error) {
 		n = lhh.resetMeta()
 		n.Type = NebulaMeta_HostQueryReply
-		n.Details.VpnIp = reqVpnIp
+		n.Details.setVpnIp(reqVpnIp)
 
-		lhh.coalesceAnswers(c, n)
+		coalesceAnswers(c, n)
+		if lhh.lh.isStale(c) {
+			n.Details.Stale = true
+			lhh.lh.metricStaleReplies.Inc(1)
+		}
 
 		return n.MarshalTo(lhh.pb)
 	})
@@ -994,9 +1318,9 @@ func (lhh *LightHouseHandler) handleHostQuery(n *NebulaMeta, vpnIp iputil.VpnIp,
 	found, ln, err = lhh.lh.queryAndPrepMessage(vpnIp, func(c *cache) (int, error) {
 		n = lhh.resetMeta()
 		n.Type = NebulaMeta_HostPunchNotification
-		n.Details.VpnIp = uint32(vpnIp)
+		n.Details.setVpnIp(vpnIp)
 
-		lhh.coalesceAnswers(c, n)
+		coalesceAnswers(c, n)
 
 		return n.MarshalTo(lhh.pb)
 	})
@@ -1011,10 +1335,10 @@ func (lhh *LightHouseHandler) handleHostQuery(n *NebulaMeta, vpnIp iputil.VpnIp,
 	}
 
 	lhh.lh.metricTx(NebulaMeta_HostPunchNotification, 1)
-	w.SendMessageToVpnIp(header.LightHouse, 0, iputil.VpnIp(reqVpnIp), lhh.pb[:ln], lhh.nb, lhh.out[:0])
+	w.SendMessageToVpnIp(header.LightHouse, 0, reqVpnIp, lhh.pb[:ln], lhh.nb, lhh.out[:0])
 }
 
-func (lhh *LightHouseHandler) coalesceAnswers(c *cache, n *NebulaMeta) {
+func coalesceAnswers(c *cache, n *NebulaMeta) {
 	if c.v4 != nil {
 		if c.v4.learned != nil {
 			n.Details.Ip4AndPorts = append(n.Details.Ip4AndPorts, c.v4.learned)
@@ -1034,7 +1358,9 @@ func (lhh *LightHouseHandler) coalesceAnswers(c *cache, n *NebulaMeta) {
 	}
 
 	if c.relay != nil {
-		n.Details.RelayVpnIp = append(n.Details.RelayVpnIp, c.relay.relay...)
+		for _, r := range c.relay.relay {
+			n.Details.addRelay(r)
+		}
 	}
 }
 
@@ -1044,19 +1370,20 @@ func (lhh *LightHouseHandler) handleHostQueryReply(n *NebulaMeta, vpnIp iputil.V
 	}
 
 	lhh.lh.Lock()
-	am := lhh.lh.unlockedGetRemoteList(iputil.VpnIp(n.Details.VpnIp))
+	am := lhh.lh.unlockedGetRemoteList(n.Details.vpnIp())
 	am.Lock()
 	lhh.lh.Unlock()
 
-	certVpnIp := iputil.VpnIp(n.Details.VpnIp)
+	certVpnIp := n.Details.vpnIp()
 	am.unlockedSetV4(vpnIp, certVpnIp, n.Details.Ip4AndPorts, lhh.lh.unlockedShouldAddV4)
 	am.unlockedSetV6(vpnIp, certVpnIp, n.Details.Ip6AndPorts, lhh.lh.unlockedShouldAddV6)
-	am.unlockedSetRelay(vpnIp, certVpnIp, n.Details.RelayVpnIp)
+	am.unlockedSetRelay(vpnIp, certVpnIp, n.Details.relays())
+	am.unlockedSetStale(vpnIp, n.Details.Stale)
 	am.Unlock()
 
 	// Non-blocking attempt to trigger, skip if it would block
 	select {
-	case lhh.lh.handshakeTrigger <- iputil.VpnIp(n.Details.VpnIp):
+	case lhh.lh.handshakeTrigger <- n.Details.vpnIp():
 	default:
 	}
 }
@@ -1070,27 +1397,35 @@ func (lhh *LightHouseHandler) handleHostUpdateNotification(n *NebulaMeta, vpnIp
 	}
 
 	//Simple check that the host sent this not someone else
-	if n.Details.VpnIp != uint32(vpnIp) {
+	if n.Details.vpnIp() != vpnIp {
 		if lhh.l.Level >= logrus.DebugLevel {
-			lhh.l.WithField("vpnIp", vpnIp).WithField("answer", iputil.VpnIp(n.Details.VpnIp)).Debugln("Host sent invalid update")
+			lhh.l.WithField("vpnIp", vpnIp).WithField("answer", n.Details.vpnIp()).Debugln("Host sent invalid update")
 		}
 		return
 	}
 
+	if err := lhh.lh.verifyHostUpdate(vpnIp, n.Details); err != nil {
+		lhh.logRejectedHostUpdate(vpnIp, err)
+		return
+	}
+
 	lhh.lh.Lock()
 	am := lhh.lh.unlockedGetRemoteList(vpnIp)
 	am.Lock()
 	lhh.lh.Unlock()
 
-	certVpnIp := iputil.VpnIp(n.Details.VpnIp)
+	certVpnIp := n.Details.vpnIp()
 	am.unlockedSetV4(vpnIp, certVpnIp, n.Details.Ip4AndPorts, lhh.lh.unlockedShouldAddV4)
 	am.unlockedSetV6(vpnIp, certVpnIp, n.Details.Ip6AndPorts, lhh.lh.unlockedShouldAddV6)
-	am.unlockedSetRelay(vpnIp, certVpnIp, n.Details.RelayVpnIp)
+	am.unlockedSetRelay(vpnIp, certVpnIp, n.Details.relays())
 	am.Unlock()
 
+	lhh.lh.setRelayAdvert(vpnIp, n.Details.RelayCapacity, n.Details.RelayLoad)
+	lhh.lh.setRouteAdvert(vpnIp, lhh.lh.allowedRouteAdverts(vpnIp, routeAdvertsFromDetails(n.Details)))
+
 	n = lhh.resetMeta()
 	n.Type = NebulaMeta_HostUpdateNotificationAck
-	n.Details.VpnIp = uint32(vpnIp)
+	n.Details.setVpnIp(vpnIp)
 	ln, err := n.MarshalTo(lhh.pb)
 
 	if err != nil {
@@ -1121,7 +1456,7 @@ func (lhh *LightHouseHandler) handleHostPunchNotification(n *NebulaMeta, vpnIp i
 
 		if lhh.l.Level >= logrus.DebugLevel {
 			//TODO: lacking the ip we are actually punching on, old: l.Debugf("Punching %s on %d for %s", IntIp(a.Ip), a.Port, IntIp(n.Details.VpnIp))
-			lhh.l.Debugf("Punching on %d for %s", vpnPeer.Port, iputil.VpnIp(n.Details.VpnIp))
+			lhh.l.Debugf("Punching on %d for %s", vpnPeer.Port, n.Details.vpnIp())
 		}
 	}
 
@@ -1137,7 +1472,7 @@ func (lhh *LightHouseHandler) handleHostPunchNotification(n *NebulaMeta, vpnIp i
 	// of a double nat or other difficult scenario, this may help establish
 	// a tunnel.
 	if lhh.lh.punchy.GetRespond() {
-		queryVpnIp := iputil.VpnIp(n.Details.VpnIp)
+		queryVpnIp := n.Details.vpnIp()
 		go func() {
 			time.Sleep(lhh.lh.punchy.GetRespondDelay())
 			if lhh.l.Level >= logrus.DebugLevel {
@@ -1151,8 +1486,13 @@ func (lhh *LightHouseHandler) handleHostPunchNotification(n *NebulaMeta, vpnIp i
 	}
 }
 
-// ipMaskContains checks if testIp is contained by ip after applying a cidr
-// zeros is 32 - bits from net.IPMask.Size()
-func ipMaskContains(ip iputil.VpnIp, zeros iputil.VpnIp, testIp iputil.VpnIp) bool {
-	return (testIp^ip)>>zeros == 0
+// inVpnNets checks if ip is in one of the networks in our certificate
+func (lh *LightHouse) inVpnNets(ip iputil.VpnIp) bool {
+	addr := ip.ToNetIpAddr()
+	for _, n := range lh.myVpnNets {
+		if n.Contains(addr) {
+			return true
+		}
+	}
+	return false
 }
@@ -0,0 +1,197 @@
+package nebula
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/flynn/noise"
+	"github.com/sirupsen/logrus"
+	"github.com/slackhq/nebula/cert"
+	"github.com/slackhq/nebula/header"
+	"github.com/slackhq/nebula/iputil"
+	"github.com/slackhq/nebula/noiseutil"
+)
+
+// Host updates are signed for the lighthouse they are sent to so a lighthouse only takes addresses for a vpn ip from
+// the holder of that vpn ips certificate key. Certificate keys are diffie-hellman keys, curve25519 ones can not make
+// signatures, so the signature is an HMAC keyed with the diffie-hellman of the senders and the lighthouses
+// certificate keys which only the two of them can compute. It is made when the update is sent on an established tunnel,
+// updates queued while the tunnel handshakes are signed once the lighthouses certificate is known.
+//
+// Lighthouses take unsigned updates from older nodes unless lighthouse.require_signed_updates is set, a signature that
+// does not verify is always refused. Updates are not ordered by the time they carry, the clock of a node can be stepped
+// back and the tunnel they arrive on already refuses replays.
+
+var (
+	ErrHostUpdateUnsigned = errors.New("host update is not signed")
+	ErrHostUpdateBadSig   = errors.New("host update signature is not valid for the senders certificate")
+)
+
+// certDHFunc returns the diffie-hellman function for the keys of cs
+func certDHFunc(cs *CertState) (noise.DHFunc, error) {
+	switch cs.Certificate.Details.Curve {
+	case cert.Curve_CURVE25519:
+		return noise.DH25519, nil
+	case cert.Curve_P256:
+		if cs.tpmBacked {
+			return cs.tpmDH, nil
+		}
+		return noiseutil.DHP256, nil
+	default:
+		return nil, fmt.Errorf("invalid curve: %s", cs.Certificate.Details.Curve)
+	}
+}
+
+// stateFor returns the certificate state for c, the primary certificate or one of the alternates
+func (cs *CertState) stateFor(c *cert.NebulaCertificate) *CertState {
+	if c == nil {
+		return nil
+	}
+
+	if bytes.Equal(c.Signature, cs.Certificate.Signature) {
+		return cs
+	}
+
+	for _, alt := range cs.alternates {
+		if bytes.Equal(c.Signature, alt.Certificate.Signature) {
+			return alt
+		}
+	}
+	return nil
+}
+
+// hostUpdateKey returns the key host updates sent over hostinfos tunnel are signed with
+func (f *Interface) hostUpdateKey(hostinfo *HostInfo) ([]byte, error) {
+	if hostinfo == nil || hostinfo.ConnectionState == nil || hostinfo.ConnectionState.peerCert == nil {
+		return nil, errors.New("no tunnel to sign for")
+	}
+
+	ci := hostinfo.ConnectionState
+	cs := f.pki.GetCertState().stateFor(ci.myCert)
+	if cs == nil {
+		return nil, errors.New("the certificate used for the tunnel is no longer loaded")
+	}
+
+	dhFunc, err := certDHFunc(cs)
+	if err != nil {
+		return nil, err
+	}
+
+	shared, err := dhFunc.DH(cs.PrivateKey, ci.peerCert.Details.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	h := sha256.New()
+	h.Write([]byte("nebula lighthouse host update"))
+	h.Write(shared)
+	return h.Sum(nil), nil
+}
+
+// hostUpdateKeyFor returns the key host updates to and from vpnIp are signed with
+func (f *Interface) hostUpdateKeyFor(vpnIp iputil.VpnIp) ([]byte, error) {
+	return f.hostUpdateKey(f.hostMap.QueryVpnIp(vpnIp))
+}
+
+// hostUpdateSignature returns the signature of d under key, ignoring any signature d already has
+func hostUpdateSignature(key []byte, d *NebulaMetaDetails) ([]byte, error) {
+	sig := d.Signature
+	d.Signature = nil
+	b, err := d.Marshal()
+	d.Signature = sig
+	if err != nil {
+		return nil, err
+	}
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write(b)
+	return mac.Sum(nil), nil
+}
+
+// SendHostUpdate sends the marshalled host update p to the lighthouse vpnIp, signed once there is a tunnel
+func (f *Interface) SendHostUpdate(vpnIp iputil.VpnIp, p, nb, out []byte) {
+	hostinfo, ready := f.getOrHandshake(nil, vpnIp, func(hh *HandshakeHostInfo) {
+		hh.cachePacket(f.l, header.LightHouse, 0, p, f.sendHostUpdate, f.cachedPacketMetrics)
+	})
+
+	if hostinfo == nil || !ready {
+		return
+	}
+
+	f.sendHostUpdate(header.LightHouse, 0, hostinfo, p, nb, out)
+}
+
+func (f *Interface) sendHostUpdate(t header.MessageType, st header.MessageSubType, hostinfo *HostInfo, p, nb, out []byte) {
+	signed, err := f.signHostUpdate(hostinfo, p)
+	if err != nil {
+		// A lighthouse that does not require signatures still takes it
+		hostinfo.logger(f.l).WithError(err).Warn("Failed to sign host update, sending it unsigned")
+		signed = p
+	}
+
+	f.SendMessageToHostInfo(t, st, hostinfo, signed, nb, out)
+}
+
+func (f *Interface) signHostUpdate(hostinfo *HostInfo, p []byte) ([]byte, error) {
+	key, err := f.hostUpdateKey(hostinfo)
+	if err != nil {
+		return nil, err
+	}
+
+	n := &NebulaMeta{}
+	if err := n.Unmarshal(p); err != nil {
+		return nil, err
+	}
+	if n.Details == nil {
+		return nil, errors.New("host update has no details")
+	}
+
+	n.Details.Time = uint64(time.Now().UnixNano())
+	n.Details.Signature, err = hostUpdateSignature(key, n.Details)
+	if err != nil {
+		return nil, err
+	}
+
+	return n.Marshal()
+}
+
+// verifyHostUpdate checks the signature of a host update from vpnIp, nil is returned for unsigned updates unless
+// lighthouse.require_signed_updates is set
+func (lh *LightHouse) verifyHostUpdate(vpnIp iputil.VpnIp, d *NebulaMetaDetails) error {
+	if len(d.Signature) == 0 {
+		if lh.requireSignedUpdates.Load() {
+			return ErrHostUpdateUnsigned
+		}
+		return nil
+	}
+
+	if lh.hostUpdateKey == nil {
+		return errors.New("unable to verify host update signatures")
+	}
+
+	key, err := lh.hostUpdateKey(vpnIp)
+	if err != nil {
+		return err
+	}
+
+	expected, err := hostUpdateSignature(key, d)
+	if err != nil {
+		return err
+	}
+
+	if !hmac.Equal(expected, d.Signature) {
+		return ErrHostUpdateBadSig
+	}
+	return nil
+}
+
+func (lhh *LightHouseHandler) logRejectedHostUpdate(vpnIp iputil.VpnIp, err error) {
+	lhh.lh.metricHostUpdateRejected.Inc(1)
+	if lhh.l.Level >= logrus.DebugLevel {
+		lhh.l.WithField("vpnIp", vpnIp).WithError(err).Debugln("Refused host update")
+	}
+}
@@ -0,0 +1,108 @@
+package nebula
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/iputil"
+	"github.com/slackhq/nebula/test"
+	"github.com/slackhq/nebula/udp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHostUpdateSignatures(t *testing.T) {
+	l := test.NewLogger()
+	newIfce := func(name string) (*Interface, *CertState) {
+		cs := newTestHandshakeCertState(t)
+		cs.Certificate.Details.PublicKey = cs.PublicKey
+		cs.Certificate.Signature = []byte(name)
+		f := &Interface{pki: &PKI{l: l}, l: l}
+		f.pki.cs.Store(cs)
+		return f, cs
+	}
+
+	node, nodeCS := newIfce("node")
+	lighthouse, lighthouseCS := newIfce("lighthouse")
+	nodeHostinfo := &HostInfo{ConnectionState: &ConnectionState{myCert: nodeCS.Certificate, peerCert: lighthouseCS.Certificate}}
+	lighthouseHostinfo := &HostInfo{ConnectionState: &ConnectionState{myCert: lighthouseCS.Certificate, peerCert: nodeCS.Certificate}}
+
+	// Both ends of the tunnel derive the same key
+	nodeKey, err := node.hostUpdateKey(nodeHostinfo)
+	require.NoError(t, err)
+	lighthouseKey, err := lighthouse.hostUpdateKey(lighthouseHostinfo)
+	require.NoError(t, err)
+	assert.Equal(t, nodeKey, lighthouseKey)
+
+	_, err = node.hostUpdateKey(&HostInfo{ConnectionState: &ConnectionState{myCert: nodeCS.Certificate}})
+	assert.Error(t, err)
+
+	c := config.NewC(l)
+	c.Settings["lighthouse"] = map[interface{}]interface{}{"am_lighthouse": true}
+	c.Settings["listen"] = map[interface{}]interface{}{"port": 4242}
+	lh, err := NewLightHouseFromConfig(context.Background(), l, c, []*net.IPNet{&net.IPNet{IP: net.IP{10, 128, 0, 1}, Mask: net.IPMask{255, 255, 255, 0}}}, nil, nil)
+	require.NoError(t, err)
+	lh.hostUpdateKey = func(vpnIp iputil.VpnIp) ([]byte, error) {
+		return lighthouse.hostUpdateKey(lighthouseHostinfo)
+	}
+	lhh := lh.NewRequestHandler()
+
+	vpnIp := iputil.Ip2VpnIp(net.IP{10, 128, 0, 2})
+	fromAddr := udp.NewAddr(net.IP{1, 1, 1, 1}, 4242)
+	newUpdate := func(port uint32) []byte {
+		b, err := (&NebulaMeta{
+			Type: NebulaMeta_HostUpdateNotification,
+			Details: &NebulaMetaDetails{
+				VpnIp:       vpnIp.Uint32(),
+				Ip4AndPorts: []*Ip4AndPort{{Ip: iputil.Ip2VpnIp(fromAddr.IP).Uint32(), Port: port}},
+			},
+		}).Marshal()
+		require.NoError(t, err)
+		return b
+	}
+	accepted := func(p []byte) bool {
+		w := &testEncWriter{}
+		lhh.HandleRequest(fromAddr, vpnIp, p, w)
+		return w.lastReply.msg != nil && w.lastReply.msg.Type == NebulaMeta_HostUpdateNotificationAck
+	}
+
+	signed, err := node.signHostUpdate(nodeHostinfo, newUpdate(4242))
+	require.NoError(t, err)
+	n := &NebulaMeta{}
+	require.NoError(t, n.Unmarshal(signed))
+	assert.NotZero(t, n.Details.Time)
+	assert.Len(t, n.Details.Signature, 32)
+
+	assert.True(t, accepted(signed))
+
+	// Updates are not ordered by their time, a node whose clock stepped back is still heard
+	earlier, err := node.signHostUpdate(nodeHostinfo, newUpdate(4242))
+	require.NoError(t, err)
+	e := &NebulaMeta{}
+	require.NoError(t, e.Unmarshal(earlier))
+	e.Details.Time -= uint64(time.Hour)
+	e.Details.Signature, err = hostUpdateSignature(nodeKey, e.Details)
+	require.NoError(t, err)
+	earlier, err = e.Marshal()
+	require.NoError(t, err)
+	assert.True(t, accepted(earlier))
+
+	// The addresses can not be changed without the key
+	n.Details.Time++
+	n.Details.Ip4AndPorts[0].Port = 4243
+	tampered, err := n.Marshal()
+	require.NoError(t, err)
+	assert.False(t, accepted(tampered))
+
+	// Updates from nodes that do not sign are taken until they are required
+	assert.True(t, accepted(newUpdate(4244)))
+	lh.requireSignedUpdates.Store(true)
+	assert.False(t, accepted(newUpdate(4244)))
+
+	signed, err = node.signHostUpdate(nodeHostinfo, newUpdate(4245))
+	require.NoError(t, err)
+	assert.True(t, accepted(signed))
+}
@@ -0,0 +1,148 @@
+package nebula
+
+import (
+	"net"
+	"sort"
+	"time"
+
+	"github.com/slackhq/nebula/cert"
+	"github.com/slackhq/nebula/iputil"
+	"github.com/slackhq/nebula/udp"
+)
+
+// LighthouseInfo is everything we know about reaching a vpn ip, for working out why a tunnel to it does not come up
+type LighthouseInfo struct {
+	VpnIp net.IP `json:"vpnIp"`
+	// Static is set when the vpn ip has a static_host_map entry
+	Static bool `json:"static"`
+	// Addrs are the deduplicated addresses a handshake tries, in order
+	Addrs []*udp.Addr `json:"addrs"`
+	// BlockedAddrs answered a handshake as a different vpn ip and are skipped
+	BlockedAddrs []*udp.Addr `json:"blockedAddrs"`
+	// Relays are the relays that can reach the vpn ip
+	Relays []LighthouseRelay `json:"relays"`
+	// Sources is what each owner told us, sorted by owner
+	Sources []LighthouseSource `json:"sources"`
+}
+
+type LighthouseRelay struct {
+	VpnIp net.IP `json:"vpnIp"`
+	// Tunnel is set when we have a tunnel to the relay, a relay we can not reach is no help
+	Tunnel bool `json:"tunnel"`
+}
+
+// LighthouseSource is what one owner told us about a vpn ip
+type LighthouseSource struct {
+	Owner net.IP `json:"owner"`
+	// Kind is how we got it: static for our own config, host when the vpn ip told us itself, lighthouse for query
+	// replies, sync for a lighthouse.sync peer and other for anything else
+	Kind    string    `json:"kind"`
+	Updated time.Time `json:"updated"`
+	// Stale is set when a lighthouse said the vpn ip had not updated it in a while
+	Stale    bool        `json:"stale"`
+	Learned  []*udp.Addr `json:"learned"`
+	Reported []*udp.Addr `json:"reported"`
+	Relays   []net.IP    `json:"relays"`
+}
+
+// lighthouseInfo returns what we know about vpnIp, nil if we know nothing. It does not query the lighthouses.
+func (f *Interface) lighthouseInfo(vpnIp iputil.VpnIp) *LighthouseInfo {
+	lh := f.lightHouse
+	lh.RLock()
+	rl := lh.addrMap[vpnIp]
+	lh.RUnlock()
+
+	if rl == nil {
+		return nil
+	}
+
+	// Group preferences need the certificate, which we only have with a tunnel
+	var c *cert.NebulaCertificate
+	if h := f.hostMap.QueryVpnIp(vpnIp); h != nil {
+		c = h.GetCert()
+	}
+
+	_, static := lh.GetStaticHostList()[vpnIp]
+	info := &LighthouseInfo{
+		VpnIp:        vpnIp.ToIP(),
+		Static:       static,
+		Addrs:        rl.CopyAddrs(f.hostMap.getPreferredRangesFor(vpnIp, c)),
+		BlockedAddrs: rl.CopyBlockedRemotes(),
+	}
+
+	relays := map[iputil.VpnIp]struct{}{}
+	rl.RLock()
+	for owner, c := range rl.cache {
+		s := LighthouseSource{
+			Owner:    owner.ToIP(),
+			Kind:     lh.sourceKind(vpnIp, owner, rl),
+			Updated:  c.updated,
+			Stale:    c.stale,
+			Learned:  []*udp.Addr{},
+			Reported: []*udp.Addr{},
+			Relays:   []net.IP{},
+		}
+
+		if c.v4 != nil {
+			if c.v4.learned != nil {
+				s.Learned = append(s.Learned, NewUDPAddrFromLH4(c.v4.learned))
+			}
+			for _, a := range c.v4.reported {
+				s.Reported = append(s.Reported, NewUDPAddrFromLH4(a))
+			}
+		}
+
+		if c.v6 != nil {
+			if c.v6.learned != nil {
+				s.Learned = append(s.Learned, NewUDPAddrFromLH6(c.v6.learned))
+			}
+			for _, a := range c.v6.reported {
+				s.Reported = append(s.Reported, NewUDPAddrFromLH6(a))
+			}
+		}
+
+		if c.relay != nil {
+			for _, r := range c.relay.relay {
+				s.Relays = append(s.Relays, r.ToIP())
+				relays[r] = struct{}{}
+			}
+		}
+
+		info.Sources = append(info.Sources, s)
+	}
+	rl.RUnlock()
+
+	sort.Slice(info.Sources, func(i, j int) bool {
+		return iputil.Ip2VpnIp(info.Sources[i].Owner).Compare(iputil.Ip2VpnIp(info.Sources[j].Owner)) < 0
+	})
+
+	info.Relays = make([]LighthouseRelay, 0, len(relays))
+	for r := range relays {
+		info.Relays = append(info.Relays, LighthouseRelay{VpnIp: r.ToIP(), Tunnel: f.hostMap.QueryVpnIp(r) != nil})
+	}
+	sort.Slice(info.Relays, func(i, j int) bool {
+		return iputil.Ip2VpnIp(info.Relays[i].VpnIp).Compare(iputil.Ip2VpnIp(info.Relays[j].VpnIp)) < 0
+	})
+
+	return info
+}
+
+// sourceKind names how owner came to tell us about vpnIp, rl must be read locked
+func (lh *LightHouse) sourceKind(vpnIp, owner iputil.VpnIp, rl *RemoteList) string {
+	switch {
+	case owner == lh.myVpnIp:
+		return "static"
+	case owner == vpnIp:
+		return "host"
+	}
+
+	if _, ok := rl.synced[owner]; ok {
+		return "sync"
+	}
+
+	if lh.IsLighthouseIP(owner) {
+		return "lighthouse"
+	}
+
+	return "other"
+}
@@ -0,0 +1,62 @@
+package nebula
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/iputil"
+	"github.com/slackhq/nebula/test"
+	"github.com/slackhq/nebula/udp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInterface_lighthouseInfo(t *testing.T) {
+	l := test.NewLogger()
+	myVpnNet := &net.IPNet{IP: net.IP{10, 128, 0, 1}, Mask: net.IPMask{255, 255, 255, 0}}
+	host := iputil.Ip2VpnIp(net.IP{10, 128, 0, 2})
+	relay := iputil.Ip2VpnIp(net.IP{10, 128, 0, 3})
+	static := iputil.Ip2VpnIp(net.IP{10, 128, 0, 4})
+
+	c := config.NewC(l)
+	c.Settings["lighthouse"] = map[interface{}]interface{}{"am_lighthouse": true}
+	c.Settings["listen"] = map[interface{}]interface{}{"port": 4242}
+	c.Settings["static_host_map"] = map[interface{}]interface{}{"10.128.0.4": []interface{}{"1.1.1.1:4242"}}
+	lh, err := NewLightHouseFromConfig(context.Background(), l, c, []*net.IPNet{myVpnNet}, nil, nil)
+	require.NoError(t, err)
+	f := &Interface{lightHouse: lh, hostMap: NewHostMapFromConfig(l, myVpnNet, c), l: l}
+
+	// Nothing is known, and nothing is asked
+	assert.Nil(t, f.lighthouseInfo(host))
+
+	hostAddr := &udp.Addr{IP: net.ParseIP("1.2.3.4"), Port: 4242}
+	b, err := (&NebulaMeta{
+		Type: NebulaMeta_HostUpdateNotification,
+		Details: &NebulaMetaDetails{
+			VpnIp:       host.Uint32(),
+			Ip4AndPorts: []*Ip4AndPort{NewIp4AndPort(hostAddr.IP, uint32(hostAddr.Port))},
+			RelayVpnIp:  []uint32{relay.Uint32()},
+		},
+	}).Marshal()
+	require.NoError(t, err)
+	lh.NewRequestHandler().HandleRequest(hostAddr, host, b, &testEncWriter{})
+
+	info := f.lighthouseInfo(host)
+	require.NotNil(t, info)
+	assert.False(t, info.Static)
+	assert.Equal(t, []*udp.Addr{hostAddr}, info.Addrs)
+	assert.Equal(t, []LighthouseRelay{{VpnIp: relay.ToIP(), Tunnel: false}}, info.Relays)
+	require.Len(t, info.Sources, 1)
+	assert.Equal(t, "host", info.Sources[0].Kind)
+	assert.Equal(t, host.ToIP(), info.Sources[0].Owner)
+	assert.False(t, info.Sources[0].Updated.IsZero())
+	assert.Equal(t, []*udp.Addr{hostAddr}, info.Sources[0].Reported)
+
+	info = f.lighthouseInfo(static)
+	require.NotNil(t, info)
+	assert.True(t, info.Static)
+	require.Len(t, info.Sources, 1)
+	assert.Equal(t, "static", info.Sources[0].Kind)
+}
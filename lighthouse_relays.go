@@ -0,0 +1,176 @@
+package nebula
+
+import (
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/header"
+	"github.com/slackhq/nebula/iputil"
+	"github.com/slackhq/nebula/util"
+)
+
+// Every host lists the relays it can be reached through in relay.relays. With relay.advertise a relay tells the
+// lighthouses it is one in its host updates, along with relay.capacity, how many relayed peers it wants to carry, and
+// how many relay indexes it has in use. A host with relay.discover enabled asks the lighthouses for these relays with a
+// RelayQuery, each advertised relay is answered with its own RelayQueryReply. See relay_discovery.go for which the host
+// picks.
+//
+// Adverts are forgotten when a relay has not repeated them within relayAdvertTTL. Lighthouses do not share adverts with
+// lighthouse.sync peers, a relay reports to every lighthouse.
+
+const (
+	defaultRelayCapacity = 100
+	relayAdvertTTL       = 5 * time.Minute
+)
+
+// relayAdvert is what a relay last advertised
+type relayAdvert struct {
+	capacity uint32
+	load     uint32
+	updated  time.Time
+}
+
+// full returns true if the relay is carrying as many peers as it wants to
+func (a *relayAdvert) full() bool {
+	return a.load >= a.capacity
+}
+
+// loadRelayAdvertise reads relay.advertise and relay.capacity, the capacity is 0 when we do not advertise
+func loadRelayAdvertise(c *config.C) (uint32, error) {
+	if !c.GetBool("relay.advertise", false) {
+		return 0, nil
+	}
+
+	if !c.GetBool("relay.am_relay", false) {
+		return 0, util.NewContextualError("relay.advertise requires relay.am_relay", nil, nil)
+	}
+
+	capacity := c.GetInt("relay.capacity", defaultRelayCapacity)
+	if capacity < 1 {
+		return 0, util.NewContextualError("relay.capacity must be at least 1", m{"capacity": capacity}, nil)
+	}
+
+	return uint32(capacity), nil
+}
+
+// setRelayAdvertDetails adds our advert to a host update when we advertise ourselves as a relay
+func (lh *LightHouse) setRelayAdvertDetails(d *NebulaMetaDetails) {
+	capacity := lh.relayCapacity.Load()
+	if capacity == 0 {
+		return
+	}
+
+	d.RelayCapacity = capacity
+	if lh.relayLoad != nil {
+		d.RelayLoad = uint32(lh.relayLoad())
+	}
+}
+
+// setRelayAdvert records or forgets what a host advertised in its host update
+func (lh *LightHouse) setRelayAdvert(vpnIp iputil.VpnIp, capacity, load uint32) {
+	lh.relayAdvertsLock.Lock()
+	defer lh.relayAdvertsLock.Unlock()
+
+	if capacity == 0 {
+		delete(lh.relayAdverts, vpnIp)
+		return
+	}
+
+	lh.relayAdverts[vpnIp] = &relayAdvert{capacity: capacity, load: load, updated: time.Now()}
+}
+
+func (lh *LightHouse) deleteRelayAdvert(vpnIp iputil.VpnIp) {
+	lh.relayAdvertsLock.Lock()
+	delete(lh.relayAdverts, vpnIp)
+	lh.relayAdvertsLock.Unlock()
+}
+
+// GetRelayAdverts returns the relays that advertised to us within relayAdvertTTL
+func (lh *LightHouse) GetRelayAdverts() map[iputil.VpnIp]relayAdvert {
+	lh.relayAdvertsLock.Lock()
+	defer lh.relayAdvertsLock.Unlock()
+
+	now := time.Now()
+	adverts := make(map[iputil.VpnIp]relayAdvert, len(lh.relayAdverts))
+	for vpnIp, a := range lh.relayAdverts {
+		if now.Sub(a.updated) > relayAdvertTTL {
+			delete(lh.relayAdverts, vpnIp)
+			continue
+		}
+		adverts[vpnIp] = *a
+	}
+	return adverts
+}
+
+// SendRelayQuery asks every lighthouse for the relays that advertised to it
+func (lh *LightHouse) SendRelayQuery() {
+	n := &NebulaMeta{Type: NebulaMeta_RelayQuery, Details: &NebulaMetaDetails{}}
+	n.Details.setVpnIp(lh.myVpnIp)
+	mm, err := n.Marshal()
+	if err != nil {
+		lh.l.WithError(err).Error("Error while marshaling for lighthouse relay query")
+		return
+	}
+
+	lighthouses := lh.GetLighthouses()
+	lh.metricTx(NebulaMeta_RelayQuery, int64(len(lighthouses)))
+	nb := make([]byte, 12, 12)
+	out := make([]byte, mtu)
+	for vpnIp := range lighthouses {
+		lh.ifce.SendMessageToVpnIp(header.LightHouse, 0, vpnIp, mm, nb, out)
+	}
+}
+
+func (lhh *LightHouseHandler) handleRelayQuery(vpnIp iputil.VpnIp, w EncWriter) {
+	if !lhh.lh.amLighthouse {
+		if lhh.l.Level >= logrus.DebugLevel {
+			lhh.l.Debugln("I am not a lighthouse, do not take relay queries: ", vpnIp)
+		}
+		return
+	}
+
+	adverts := lhh.lh.GetRelayAdverts()
+	if capacity := lhh.lh.relayCapacity.Load(); capacity > 0 {
+		a := relayAdvert{capacity: capacity}
+		if lhh.lh.relayLoad != nil {
+			a.load = uint32(lhh.lh.relayLoad())
+		}
+		adverts[lhh.lh.myVpnIp] = a
+	}
+
+	var sent int64
+	for relay, a := range adverts {
+		if relay == vpnIp {
+			continue
+		}
+
+		n := lhh.resetMeta()
+		n.Type = NebulaMeta_RelayQueryReply
+		n.Details.setVpnIp(relay)
+		n.Details.RelayCapacity = a.capacity
+		n.Details.RelayLoad = a.load
+		ln, err := n.MarshalTo(lhh.pb)
+		if err != nil {
+			lhh.l.WithError(err).WithField("vpnIp", vpnIp).Error("Failed to marshal lighthouse relay query reply")
+			return
+		}
+
+		w.SendMessageToVpnIp(header.LightHouse, 0, vpnIp, lhh.pb[:ln], lhh.nb, lhh.out[:0])
+		sent++
+	}
+	lhh.lh.metricTx(NebulaMeta_RelayQueryReply, sent)
+}
+
+func (lhh *LightHouseHandler) handleRelayQueryReply(n *NebulaMeta, vpnIp iputil.VpnIp) {
+	if !lhh.lh.IsLighthouseIP(vpnIp) {
+		return
+	}
+
+	relay := n.Details.vpnIp()
+	if relay == lhh.lh.myVpnIp || n.Details.RelayCapacity == 0 {
+		return
+	}
+
+	lhh.lh.setRelayAdvert(relay, n.Details.RelayCapacity, n.Details.RelayLoad)
+}
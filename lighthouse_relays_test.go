@@ -0,0 +1,136 @@
+package nebula
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/iputil"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadRelayAdvertise(t *testing.T) {
+	l := test.NewLogger()
+	c := config.NewC(l)
+
+	capacity, err := loadRelayAdvertise(c)
+	require.NoError(t, err)
+	assert.Zero(t, capacity)
+
+	c.Settings["relay"] = map[interface{}]interface{}{"advertise": true}
+	_, err = loadRelayAdvertise(c)
+	assert.ErrorContains(t, err, "relay.advertise requires relay.am_relay")
+
+	c.Settings["relay"] = map[interface{}]interface{}{"advertise": true, "am_relay": true}
+	capacity, err = loadRelayAdvertise(c)
+	require.NoError(t, err)
+	assert.Equal(t, uint32(defaultRelayCapacity), capacity)
+
+	c.Settings["relay"] = map[interface{}]interface{}{"advertise": true, "am_relay": true, "capacity": 0}
+	_, err = loadRelayAdvertise(c)
+	assert.ErrorContains(t, err, "relay.capacity must be at least 1")
+}
+
+func TestNebulaMetaDetails_relayAdvert(t *testing.T) {
+	in := &NebulaMeta{
+		Type:    NebulaMeta_RelayQueryReply,
+		Details: &NebulaMetaDetails{VpnIp: 1, Stale: true, RelayCapacity: 300, RelayLoad: 12},
+	}
+	b, err := in.Marshal()
+	require.NoError(t, err)
+
+	out := &NebulaMeta{}
+	require.NoError(t, out.Unmarshal(b))
+	assert.Equal(t, NebulaMeta_RelayQueryReply, out.Type)
+	assert.Equal(t, uint32(300), out.Details.GetRelayCapacity())
+	assert.Equal(t, uint32(12), out.Details.GetRelayLoad())
+	assert.True(t, out.Details.Stale)
+}
+
+func TestLighthouse_relayAdverts(t *testing.T) {
+	l := test.NewLogger()
+	myVpnNet := &net.IPNet{IP: net.IP{10, 128, 0, 1}, Mask: net.IPMask{255, 255, 255, 0}}
+	lhIp := iputil.Ip2VpnIp(net.IP{10, 128, 0, 1})
+	relay := iputil.Ip2VpnIp(net.IP{10, 128, 0, 2})
+	client := iputil.Ip2VpnIp(net.IP{10, 128, 0, 3})
+
+	c := config.NewC(l)
+	c.Settings["lighthouse"] = map[interface{}]interface{}{"am_lighthouse": true}
+	c.Settings["listen"] = map[interface{}]interface{}{"port": 4242}
+	lh, err := NewLightHouseFromConfig(context.Background(), l, c, []*net.IPNet{myVpnNet}, nil, nil)
+	require.NoError(t, err)
+	lhh := lh.NewRequestHandler()
+
+	// The relay advertises itself in its host update
+	update := &NebulaMeta{
+		Type:    NebulaMeta_HostUpdateNotification,
+		Details: &NebulaMetaDetails{VpnIp: relay.Uint32(), RelayCapacity: 10, RelayLoad: 4},
+	}
+	b, err := update.Marshal()
+	require.NoError(t, err)
+	lhh.HandleRequest(nil, relay, b, &testEncWriter{})
+	assert.Equal(t, map[iputil.VpnIp]relayAdvert{relay: {capacity: 10, load: 4}}, withoutUpdated(lh.GetRelayAdverts()))
+
+	// A client asks for relays
+	query, err := (&NebulaMeta{Type: NebulaMeta_RelayQuery, Details: &NebulaMetaDetails{VpnIp: client.Uint32()}}).Marshal()
+	require.NoError(t, err)
+	w := &collectEncWriter{}
+	lhh.HandleRequest(nil, client, query, w)
+	require.Len(t, w.sent, 1)
+
+	// The relay itself is not told about itself
+	rw := &collectEncWriter{}
+	lhh.HandleRequest(nil, relay, query, rw)
+	assert.Empty(t, rw.sent)
+
+	// The client records what the lighthouse answered, and only from a lighthouse
+	cc := config.NewC(l)
+	cc.Settings["lighthouse"] = map[interface{}]interface{}{"hosts": []interface{}{lhIp.String()}}
+	cc.Settings["static_host_map"] = map[interface{}]interface{}{lhIp.String(): []interface{}{"1.1.1.1:4242"}}
+	clientNet := &net.IPNet{IP: net.IP{10, 128, 0, 3}, Mask: net.IPMask{255, 255, 255, 0}}
+	clh, err := NewLightHouseFromConfig(context.Background(), l, cc, []*net.IPNet{clientNet}, nil, nil)
+	require.NoError(t, err)
+	clhh := clh.NewRequestHandler()
+
+	clhh.HandleRequest(nil, relay, w.sent[0], &testEncWriter{})
+	assert.Empty(t, clh.GetRelayAdverts())
+
+	clhh.HandleRequest(nil, lhIp, w.sent[0], &testEncWriter{})
+	assert.Equal(t, map[iputil.VpnIp]relayAdvert{relay: {capacity: 10, load: 4}}, withoutUpdated(clh.GetRelayAdverts()))
+
+	// An update without an advert withdraws it
+	update.Details.RelayCapacity = 0
+	b, err = update.Marshal()
+	require.NoError(t, err)
+	lhh.HandleRequest(nil, relay, b, &testEncWriter{})
+	assert.Empty(t, lh.GetRelayAdverts())
+}
+
+func TestLighthouse_GetRelaysForMe_discovered(t *testing.T) {
+	a := iputil.Ip2VpnIp(net.IP{10, 128, 0, 2})
+	b := iputil.Ip2VpnIp(net.IP{10, 128, 0, 3})
+
+	lh := &LightHouse{}
+	static := []iputil.VpnIp{a}
+	lh.relaysForMe.Store(&static)
+	discovered := []iputil.VpnIp{}
+	lh.discoveredRelays.Store(&discovered)
+	assert.Equal(t, []iputil.VpnIp{a}, lh.GetRelaysForMe())
+
+	discovered = []iputil.VpnIp{b, a}
+	lh.discoveredRelays.Store(&discovered)
+	assert.Equal(t, []iputil.VpnIp{a, b}, lh.GetRelaysForMe())
+	assert.Equal(t, []iputil.VpnIp{a}, static)
+}
+
+func withoutUpdated(adverts map[iputil.VpnIp]relayAdvert) map[iputil.VpnIp]relayAdvert {
+	for ip, a := range adverts {
+		a.updated = time.Time{}
+		adverts[ip] = a
+	}
+	return adverts
+}
@@ -0,0 +1,272 @@
+package nebula
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/header"
+	"github.com/slackhq/nebula/iputil"
+)
+
+// A gateway lists the unsafe networks it serves in routing.advertise and tells the lighthouses about them in its host
+// updates. A lighthouse only keeps the networks within the unsafe networks of the gateways certificate, and forgets
+// them when the gateway stops repeating them within routeAdvertTTL or its tunnel with the lighthouse closes. A host
+// with routing.learn enabled asks the lighthouses for the networks with a RouteQuery, each gateway is answered with its
+// own RouteQueryReply. See routing.go for which gateway the host routes a network through.
+//
+// Lighthouses do not share adverts with lighthouse.sync peers, a gateway reports to every lighthouse.
+
+const (
+	defaultRouteMetric = 100
+	maxRouteAdverts    = 32
+	routeAdvertTTL     = time.Minute
+)
+
+// routeAdvert is an unsafe network a gateway advertised
+type routeAdvert struct {
+	cidr   *net.IPNet
+	metric uint32
+}
+
+// gatewayAdvert is what a gateway last advertised
+type gatewayAdvert struct {
+	routes  []routeAdvert
+	updated time.Time
+}
+
+// loadRouteAdvertise reads routing.advertise, the unsafe networks we serve as a gateway
+func loadRouteAdvertise(c *config.C) ([]routeAdvert, error) {
+	r := c.Get("routing.advertise")
+	if r == nil {
+		return []routeAdvert{}, nil
+	}
+
+	rawRoutes, ok := r.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("routing.advertise is not an array")
+	}
+
+	if len(rawRoutes) > maxRouteAdverts {
+		return nil, fmt.Errorf("routing.advertise has more than %v entries", maxRouteAdverts)
+	}
+
+	routes := make([]routeAdvert, len(rawRoutes))
+	for i, r := range rawRoutes {
+		m, ok := r.(map[interface{}]interface{})
+		if !ok {
+			return nil, fmt.Errorf("entry %v in routing.advertise is invalid", i+1)
+		}
+
+		rRoute, ok := m["route"]
+		if !ok {
+			return nil, fmt.Errorf("entry %v.route in routing.advertise is not present", i+1)
+		}
+
+		_, cidr, err := net.ParseCIDR(fmt.Sprintf("%v", rRoute))
+		if err != nil {
+			return nil, fmt.Errorf("entry %v.route in routing.advertise failed to parse: %v", i+1, err)
+		}
+
+		metric := defaultRouteMetric
+		if rMetric, ok := m["metric"]; ok {
+			metric, err = strconv.Atoi(fmt.Sprintf("%v", rMetric))
+			if err != nil {
+				return nil, fmt.Errorf("entry %v.metric in routing.advertise is not an integer: %v", i+1, err)
+			}
+
+			if metric < 0 {
+				return nil, fmt.Errorf("entry %v.metric in routing.advertise is below 0: %v", i+1, metric)
+			}
+		}
+
+		for _, o := range routes[:i] {
+			if o.cidr.String() == cidr.String() {
+				return nil, fmt.Errorf("entry %v.route in routing.advertise is a duplicate of %v", i+1, cidr)
+			}
+		}
+
+		routes[i] = routeAdvert{cidr: cidr, metric: uint32(metric)}
+	}
+
+	return routes, nil
+}
+
+// routeAdvertsFromDetails returns the well formed routes in a host update or route query reply
+func routeAdvertsFromDetails(d *NebulaMetaDetails) []routeAdvert {
+	if len(d.Routes) == 0 {
+		return nil
+	}
+
+	routes := make([]routeAdvert, 0, len(d.Routes))
+	for _, r := range d.Routes {
+		if r == nil || (len(r.Ip) != net.IPv4len && len(r.Ip) != net.IPv6len) || int(r.Bits) > len(r.Ip)*8 {
+			continue
+		}
+
+		mask := net.CIDRMask(int(r.Bits), len(r.Ip)*8)
+		routes = append(routes, routeAdvert{
+			cidr:   &net.IPNet{IP: net.IP(r.Ip).Mask(mask), Mask: mask},
+			metric: r.Metric,
+		})
+	}
+	return routes
+}
+
+// addRouteAdverts adds routes to a host update or route query reply
+func addRouteAdverts(d *NebulaMetaDetails, routes []routeAdvert) {
+	for _, r := range routes {
+		ip := r.cidr.IP.To4()
+		if ip == nil {
+			ip = r.cidr.IP.To16()
+		}
+		bits, _ := r.cidr.Mask.Size()
+		d.Routes = append(d.Routes, &UnsafeRoute{Ip: ip, Bits: uint32(bits), Metric: r.metric})
+	}
+}
+
+// setRouteAdvertDetails adds the networks we serve to a host update
+func (lh *LightHouse) setRouteAdvertDetails(d *NebulaMetaDetails) {
+	if routes := lh.routeAdvertise.Load(); routes != nil {
+		addRouteAdverts(d, *routes)
+	}
+}
+
+// allowedRouteAdverts returns the routes that are within the unsafe networks of the gateways certificate
+func (lh *LightHouse) allowedRouteAdverts(vpnIp iputil.VpnIp, routes []routeAdvert) []routeAdvert {
+	if lh.hostSubnets == nil || len(routes) == 0 {
+		return routes
+	}
+
+	subnets := lh.hostSubnets(vpnIp)
+	allowed := routes[:0]
+	for _, r := range routes {
+		if !anySubnetContains(subnets, r.cidr) {
+			if lh.l.Level >= logrus.DebugLevel {
+				lh.l.WithField("vpnIp", vpnIp).WithField("route", r.cidr).
+					Debugln("Gateway advertised a route outside of its certificate subnets")
+			}
+			continue
+		}
+		allowed = append(allowed, r)
+	}
+	return allowed
+}
+
+// anySubnetContains returns true if cidr is entirely within one of the subnets
+func anySubnetContains(subnets []*net.IPNet, cidr *net.IPNet) bool {
+	ones, bits := cidr.Mask.Size()
+	for _, s := range subnets {
+		sOnes, sBits := s.Mask.Size()
+		if sBits == bits && sOnes <= ones && s.Contains(cidr.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// setRouteAdvert records or forgets the networks a gateway advertised
+func (lh *LightHouse) setRouteAdvert(vpnIp iputil.VpnIp, routes []routeAdvert) {
+	lh.routeAdvertsLock.Lock()
+	defer lh.routeAdvertsLock.Unlock()
+
+	if len(routes) == 0 {
+		delete(lh.routeAdverts, vpnIp)
+		return
+	}
+
+	lh.routeAdverts[vpnIp] = &gatewayAdvert{routes: routes, updated: time.Now()}
+}
+
+func (lh *LightHouse) deleteRouteAdvert(vpnIp iputil.VpnIp) {
+	lh.routeAdvertsLock.Lock()
+	delete(lh.routeAdverts, vpnIp)
+	lh.routeAdvertsLock.Unlock()
+}
+
+// GetRouteAdverts returns the networks of the gateways that advertised to us within ttl
+func (lh *LightHouse) GetRouteAdverts(ttl time.Duration) map[iputil.VpnIp][]routeAdvert {
+	lh.routeAdvertsLock.Lock()
+	defer lh.routeAdvertsLock.Unlock()
+
+	now := time.Now()
+	adverts := make(map[iputil.VpnIp][]routeAdvert, len(lh.routeAdverts))
+	for vpnIp, a := range lh.routeAdverts {
+		if now.Sub(a.updated) > ttl {
+			delete(lh.routeAdverts, vpnIp)
+			continue
+		}
+		adverts[vpnIp] = a.routes
+	}
+	return adverts
+}
+
+// SendRouteQuery asks every lighthouse for the networks gateways advertised to it
+func (lh *LightHouse) SendRouteQuery() {
+	n := &NebulaMeta{Type: NebulaMeta_RouteQuery, Details: &NebulaMetaDetails{}}
+	n.Details.setVpnIp(lh.myVpnIp)
+	mm, err := n.Marshal()
+	if err != nil {
+		lh.l.WithError(err).Error("Error while marshaling for lighthouse route query")
+		return
+	}
+
+	lighthouses := lh.GetLighthouses()
+	lh.metricTx(NebulaMeta_RouteQuery, int64(len(lighthouses)))
+	nb := make([]byte, 12, 12)
+	out := make([]byte, mtu)
+	for vpnIp := range lighthouses {
+		lh.ifce.SendMessageToVpnIp(header.LightHouse, 0, vpnIp, mm, nb, out)
+	}
+}
+
+func (lhh *LightHouseHandler) handleRouteQuery(vpnIp iputil.VpnIp, w EncWriter) {
+	if !lhh.lh.amLighthouse {
+		if lhh.l.Level >= logrus.DebugLevel {
+			lhh.l.Debugln("I am not a lighthouse, do not take route queries: ", vpnIp)
+		}
+		return
+	}
+
+	adverts := lhh.lh.GetRouteAdverts(routeAdvertTTL)
+	if routes := lhh.lh.routeAdvertise.Load(); routes != nil && len(*routes) > 0 {
+		adverts[lhh.lh.myVpnIp] = *routes
+	}
+
+	var sent int64
+	for gateway, routes := range adverts {
+		if gateway == vpnIp {
+			continue
+		}
+
+		n := lhh.resetMeta()
+		n.Type = NebulaMeta_RouteQueryReply
+		n.Details.setVpnIp(gateway)
+		addRouteAdverts(n.Details, routes)
+		ln, err := n.MarshalTo(lhh.pb)
+		if err != nil {
+			lhh.l.WithError(err).WithField("vpnIp", vpnIp).Error("Failed to marshal lighthouse route query reply")
+			return
+		}
+
+		w.SendMessageToVpnIp(header.LightHouse, 0, vpnIp, lhh.pb[:ln], lhh.nb, lhh.out[:0])
+		sent++
+	}
+	lhh.lh.metricTx(NebulaMeta_RouteQueryReply, sent)
+}
+
+func (lhh *LightHouseHandler) handleRouteQueryReply(n *NebulaMeta, vpnIp iputil.VpnIp) {
+	if !lhh.lh.IsLighthouseIP(vpnIp) {
+		return
+	}
+
+	gateway := n.Details.vpnIp()
+	if gateway == lhh.lh.myVpnIp {
+		return
+	}
+
+	lhh.lh.setRouteAdvert(gateway, routeAdvertsFromDetails(n.Details))
+}
@@ -0,0 +1,143 @@
+package nebula
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/iputil"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadRouteAdvertise(t *testing.T) {
+	l := test.NewLogger()
+	c := config.NewC(l)
+
+	routes, err := loadRouteAdvertise(c)
+	require.NoError(t, err)
+	assert.Empty(t, routes)
+
+	c.Settings["routing"] = map[interface{}]interface{}{"advertise": []interface{}{
+		map[interface{}]interface{}{"route": "10.50.0.0/16"},
+		map[interface{}]interface{}{"route": "fd00:50::1/64", "metric": "20"},
+	}}
+	routes, err = loadRouteAdvertise(c)
+	require.NoError(t, err)
+	require.Len(t, routes, 2)
+	assert.Equal(t, "10.50.0.0/16", routes[0].cidr.String())
+	assert.Equal(t, uint32(defaultRouteMetric), routes[0].metric)
+	assert.Equal(t, "fd00:50::/64", routes[1].cidr.String())
+	assert.Equal(t, uint32(20), routes[1].metric)
+
+	c.Settings["routing"] = map[interface{}]interface{}{"advertise": []interface{}{
+		map[interface{}]interface{}{"metric": 1},
+	}}
+	_, err = loadRouteAdvertise(c)
+	assert.EqualError(t, err, "entry 1.route in routing.advertise is not present")
+
+	c.Settings["routing"] = map[interface{}]interface{}{"advertise": []interface{}{
+		map[interface{}]interface{}{"route": "10.50.0.0/16", "metric": -1},
+	}}
+	_, err = loadRouteAdvertise(c)
+	assert.EqualError(t, err, "entry 1.metric in routing.advertise is below 0: -1")
+
+	c.Settings["routing"] = map[interface{}]interface{}{"advertise": []interface{}{
+		map[interface{}]interface{}{"route": "10.50.0.0/16"},
+		map[interface{}]interface{}{"route": "10.50.1.1/16"},
+	}}
+	_, err = loadRouteAdvertise(c)
+	assert.EqualError(t, err, "entry 2.route in routing.advertise is a duplicate of 10.50.0.0/16")
+}
+
+func TestNebulaMetaDetails_routeAdverts(t *testing.T) {
+	_, v4, _ := net.ParseCIDR("10.50.0.0/16")
+	_, v6, _ := net.ParseCIDR("fd00:50::/64")
+	routes := []routeAdvert{{cidr: v4, metric: 10}, {cidr: v6, metric: 20}}
+
+	in := &NebulaMeta{Type: NebulaMeta_RouteQueryReply, Details: &NebulaMetaDetails{VpnIp: 1}}
+	addRouteAdverts(in.Details, routes)
+	b, err := in.Marshal()
+	require.NoError(t, err)
+
+	out := &NebulaMeta{}
+	require.NoError(t, out.Unmarshal(b))
+	assert.Equal(t, routes, routeAdvertsFromDetails(out.Details))
+
+	// Malformed routes are skipped
+	out.Details.Routes = append(out.Details.Routes, &UnsafeRoute{Ip: []byte{1, 2, 3}, Bits: 8}, &UnsafeRoute{Ip: []byte{1, 2, 3, 4}, Bits: 33})
+	assert.Equal(t, routes, routeAdvertsFromDetails(out.Details))
+}
+
+func TestLighthouse_routeAdverts(t *testing.T) {
+	l := test.NewLogger()
+	myVpnNet := &net.IPNet{IP: net.IP{10, 128, 0, 1}, Mask: net.IPMask{255, 255, 255, 0}}
+	lhIp := iputil.Ip2VpnIp(net.IP{10, 128, 0, 1})
+	gateway := iputil.Ip2VpnIp(net.IP{10, 128, 0, 2})
+	client := iputil.Ip2VpnIp(net.IP{10, 128, 0, 3})
+	_, served, _ := net.ParseCIDR("10.50.0.0/16")
+	_, notServed, _ := net.ParseCIDR("10.60.0.0/16")
+	_, subnet, _ := net.ParseCIDR("10.50.0.0/15")
+
+	c := config.NewC(l)
+	c.Settings["lighthouse"] = map[interface{}]interface{}{"am_lighthouse": true}
+	c.Settings["listen"] = map[interface{}]interface{}{"port": 4242}
+	lh, err := NewLightHouseFromConfig(context.Background(), l, c, []*net.IPNet{myVpnNet}, nil, nil)
+	require.NoError(t, err)
+	lh.hostSubnets = func(vpnIp iputil.VpnIp) []*net.IPNet {
+		if vpnIp == gateway {
+			return []*net.IPNet{subnet}
+		}
+		return nil
+	}
+	lhh := lh.NewRequestHandler()
+
+	// The gateway advertises its networks in its host update, only those in its certificate are kept
+	update := &NebulaMeta{Type: NebulaMeta_HostUpdateNotification, Details: &NebulaMetaDetails{VpnIp: gateway.Uint32()}}
+	addRouteAdverts(update.Details, []routeAdvert{{cidr: served, metric: 5}, {cidr: notServed, metric: 5}})
+	b, err := update.Marshal()
+	require.NoError(t, err)
+	lhh.HandleRequest(nil, gateway, b, &testEncWriter{})
+	assert.Equal(t, map[iputil.VpnIp][]routeAdvert{gateway: {{cidr: served, metric: 5}}}, lh.GetRouteAdverts(routeAdvertTTL))
+
+	// A client asks for routes
+	query, err := (&NebulaMeta{Type: NebulaMeta_RouteQuery, Details: &NebulaMetaDetails{VpnIp: client.Uint32()}}).Marshal()
+	require.NoError(t, err)
+	w := &collectEncWriter{}
+	lhh.HandleRequest(nil, client, query, w)
+	require.Len(t, w.sent, 1)
+
+	// The gateway is not told about itself
+	gw := &collectEncWriter{}
+	lhh.HandleRequest(nil, gateway, query, gw)
+	assert.Empty(t, gw.sent)
+
+	// The client records what the lighthouse answered, and only from a lighthouse
+	cc := config.NewC(l)
+	cc.Settings["lighthouse"] = map[interface{}]interface{}{"hosts": []interface{}{lhIp.String()}}
+	cc.Settings["static_host_map"] = map[interface{}]interface{}{lhIp.String(): []interface{}{"1.1.1.1:4242"}}
+	clientNet := &net.IPNet{IP: net.IP{10, 128, 0, 3}, Mask: net.IPMask{255, 255, 255, 0}}
+	clh, err := NewLightHouseFromConfig(context.Background(), l, cc, []*net.IPNet{clientNet}, nil, nil)
+	require.NoError(t, err)
+	clhh := clh.NewRequestHandler()
+
+	clhh.HandleRequest(nil, gateway, w.sent[0], &testEncWriter{})
+	assert.Empty(t, clh.GetRouteAdverts(routeAdvertTTL))
+
+	clhh.HandleRequest(nil, lhIp, w.sent[0], &testEncWriter{})
+	assert.Equal(t, map[iputil.VpnIp][]routeAdvert{gateway: {{cidr: served, metric: 5}}}, clh.GetRouteAdverts(routeAdvertTTL))
+	assert.Empty(t, clh.GetRouteAdverts(0))
+
+	// An update without routes withdraws them, and so does the gateway going away
+	update.Details.Routes = nil
+	b, err = update.Marshal()
+	require.NoError(t, err)
+	lhh.HandleRequest(nil, gateway, b, &testEncWriter{})
+	assert.Empty(t, lh.GetRouteAdverts(routeAdvertTTL))
+
+	lh.setRouteAdvert(gateway, []routeAdvert{{cidr: served, metric: 5}})
+	lh.DeleteVpnIp(gateway)
+	assert.Empty(t, lh.GetRouteAdverts(routeAdvertTTL))
+}
@@ -0,0 +1,278 @@
+package nebula
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/header"
+	"github.com/slackhq/nebula/iputil"
+	"github.com/slackhq/nebula/util"
+)
+
+// Lighthouses listed in each others lighthouse.sync.peers share what hosts reported to them. Every sync interval a
+// lighthouse sends each peer a HostSyncNotification for every host that reported to it directly, what it learned from
+// other lighthouses is never passed on. A lighthouse asks its peers for all of it with a HostSyncRequest when it starts
+// so a restart does not leave it with nothing to answer until every host reports again.
+//
+// Synced addresses are kept under the peer that sent them. A query is answered with what the host reported to us and
+// only falls back to the most recently synced addresses when the host has not reported to us. Synced addresses expire
+// when a peer has not refreshed them for syncExpiryIntervals sync intervals.
+
+const syncExpiryIntervals = 3
+
+// loadSync reads lighthouse.sync, peers is nil when syncing is not configured
+func (lh *LightHouse) loadSync(c *config.C) (map[iputil.VpnIp]struct{}, time.Duration, error) {
+	rawPeers := c.GetStringSlice("lighthouse.sync.peers", []string{})
+	if len(rawPeers) == 0 {
+		return nil, 0, nil
+	}
+
+	if !lh.amLighthouse {
+		return nil, 0, fmt.Errorf("lighthouse.sync.peers is only for lighthouses")
+	}
+
+	peers := make(map[iputil.VpnIp]struct{}, len(rawPeers))
+	for i, rawPeer := range rawPeers {
+		ip := net.ParseIP(rawPeer)
+		if ip == nil {
+			return nil, 0, util.NewContextualError("Unable to parse lighthouse.sync.peers entry", m{"peer": rawPeer, "entry": i + 1}, nil)
+		}
+
+		vpnIp := iputil.Ip2VpnIp(ip)
+		if !lh.inVpnNets(vpnIp) {
+			return nil, 0, util.NewContextualError("lighthouse.sync.peers entry is not in our subnet", m{"peer": rawPeer, "networks": lh.myVpnNets, "entry": i + 1}, nil)
+		}
+
+		if vpnIp == lh.myVpnIp {
+			return nil, 0, util.NewContextualError("lighthouse.sync.peers must not contain our own vpn ip", m{"peer": rawPeer, "entry": i + 1}, nil)
+		}
+		peers[vpnIp] = struct{}{}
+	}
+
+	interval, err := time.ParseDuration(c.GetString("lighthouse.sync.interval", "30s"))
+	if err != nil {
+		return nil, 0, util.NewContextualError("Unable to parse lighthouse.sync.interval", nil, err)
+	}
+	if interval <= 0 {
+		return nil, 0, fmt.Errorf("lighthouse.sync.interval must be greater than 0")
+	}
+
+	return peers, interval, nil
+}
+
+func (lh *LightHouse) GetSyncPeers() map[iputil.VpnIp]struct{} {
+	return *lh.syncPeers.Load()
+}
+
+func (lh *LightHouse) isSyncPeer(vpnIp iputil.VpnIp) bool {
+	_, ok := lh.GetSyncPeers()[vpnIp]
+	return ok
+}
+
+func (lh *LightHouse) StartSyncWorker() {
+	interval := time.Duration(lh.syncInterval.Load())
+	if !lh.amLighthouse || len(lh.GetSyncPeers()) == 0 || interval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	syncCtx, cancel := context.WithCancel(lh.ctx)
+	lh.syncCancel = cancel
+
+	go func() {
+		defer ticker.Stop()
+
+		// We may have just restarted, the other lighthouses know what hosts have been telling them
+		lh.sendSyncRequest()
+
+		for {
+			select {
+			case <-syncCtx.Done():
+				return
+			case peer := <-lh.syncTrigger:
+				lh.sendSync(peer)
+			case <-ticker.C:
+				lh.expireSynced(interval * syncExpiryIntervals)
+				for peer := range lh.GetSyncPeers() {
+					lh.sendSync(peer)
+				}
+			}
+		}
+	}()
+}
+
+func (lh *LightHouse) sendSyncRequest() {
+	n := &NebulaMeta{Type: NebulaMeta_HostSyncRequest, Details: &NebulaMetaDetails{}}
+	n.Details.setVpnIp(lh.myVpnIp)
+	mm, err := n.Marshal()
+	if err != nil {
+		lh.l.WithError(err).Error("Error while marshaling for lighthouse sync request")
+		return
+	}
+
+	peers := lh.GetSyncPeers()
+	lh.metricTx(NebulaMeta_HostSyncRequest, int64(len(peers)))
+	nb := make([]byte, 12, 12)
+	out := make([]byte, mtu)
+	for peer := range peers {
+		lh.ifce.SendMessageToVpnIp(header.LightHouse, 0, peer, mm, nb, out)
+	}
+}
+
+// sendSync sends peer what every host that reported to us directly told us
+func (lh *LightHouse) sendSync(peer iputil.VpnIp) {
+	lh.RLock()
+	lists := make(map[iputil.VpnIp]*RemoteList, len(lh.addrMap))
+	for vpnIp, rl := range lh.addrMap {
+		lists[vpnIp] = rl
+	}
+	lh.RUnlock()
+
+	nb := make([]byte, 12, 12)
+	out := make([]byte, mtu)
+	n := &NebulaMeta{Type: NebulaMeta_HostSyncNotification}
+	var sent int64
+	for vpnIp, rl := range lists {
+		if vpnIp == peer {
+			continue
+		}
+
+		rl.RLock()
+		c := rl.cache[vpnIp]
+		if c == nil {
+			rl.RUnlock()
+			continue
+		}
+
+		n.Details = &NebulaMetaDetails{}
+		n.Details.setVpnIp(vpnIp)
+		coalesceAnswers(c, n)
+		mm, err := n.Marshal()
+		rl.RUnlock()
+
+		if err != nil {
+			lh.l.WithError(err).WithField("vpnIp", vpnIp).Error("Error while marshaling for lighthouse sync")
+			continue
+		}
+
+		lh.ifce.SendMessageToVpnIp(header.LightHouse, 0, peer, mm, nb, out)
+		sent++
+	}
+
+	lh.metricTx(NebulaMeta_HostSyncNotification, sent)
+}
+
+// expireSynced forgets what peers shared with us that they have not refreshed within maxAge, hosts we only knew about
+// from peers are dropped altogether
+func (lh *LightHouse) expireSynced(maxAge time.Duration) {
+	lh.RLock()
+	lists := make(map[iputil.VpnIp]*RemoteList, len(lh.addrMap))
+	for vpnIp, rl := range lh.addrMap {
+		lists[vpnIp] = rl
+	}
+	lh.RUnlock()
+
+	now := time.Now()
+	var empty []iputil.VpnIp
+	for vpnIp, rl := range lists {
+		rl.Lock()
+		expired := false
+		for peer, t := range rl.synced {
+			if now.Sub(t) > maxAge {
+				delete(rl.cache, peer)
+				delete(rl.synced, peer)
+				rl.shouldRebuild = true
+				expired = true
+			}
+		}
+		if expired && len(rl.cache) == 0 {
+			empty = append(empty, vpnIp)
+		}
+		rl.Unlock()
+	}
+
+	if len(empty) == 0 {
+		return
+	}
+
+	staticList := lh.GetStaticHostList()
+	lh.Lock()
+	for _, vpnIp := range empty {
+		if _, ok := staticList[vpnIp]; ok {
+			continue
+		}
+
+		rl := lists[vpnIp]
+		if lh.addrMap[vpnIp] != rl {
+			continue
+		}
+
+		// The host may have reported to us since we looked
+		rl.RLock()
+		if len(rl.cache) == 0 {
+			delete(lh.addrMap, vpnIp)
+		}
+		rl.RUnlock()
+	}
+	lh.Unlock()
+}
+
+// unlockedNewestSynced returns the addresses a peer most recently shared for this host, if any
+func (r *RemoteList) unlockedNewestSynced() *cache {
+	var newest *cache
+	var newestTime time.Time
+	for peer, t := range r.synced {
+		if c := r.cache[peer]; c != nil && t.After(newestTime) {
+			newest = c
+			newestTime = t
+		}
+	}
+	return newest
+}
+
+func (lhh *LightHouseHandler) handleHostSyncRequest(vpnIp iputil.VpnIp) {
+	if !lhh.lh.amLighthouse || !lhh.lh.isSyncPeer(vpnIp) {
+		if lhh.l.Level >= logrus.DebugLevel {
+			lhh.l.WithField("vpnIp", vpnIp).Debugln("Ignoring lighthouse sync request from a host that is not a sync peer")
+		}
+		return
+	}
+
+	select {
+	case lhh.lh.syncTrigger <- vpnIp:
+	default:
+		// A sync for someone is already waiting, the next interval covers anyone we missed
+	}
+}
+
+func (lhh *LightHouseHandler) handleHostSyncNotification(n *NebulaMeta, vpnIp iputil.VpnIp) {
+	if !lhh.lh.amLighthouse || !lhh.lh.isSyncPeer(vpnIp) {
+		if lhh.l.Level >= logrus.DebugLevel {
+			lhh.l.WithField("vpnIp", vpnIp).Debugln("Ignoring lighthouse sync from a host that is not a sync peer")
+		}
+		return
+	}
+
+	hostVpnIp := n.Details.vpnIp()
+	if hostVpnIp == lhh.lh.myVpnIp || hostVpnIp == vpnIp {
+		return
+	}
+
+	lhh.lh.Lock()
+	am := lhh.lh.unlockedGetRemoteList(hostVpnIp)
+	am.Lock()
+	lhh.lh.Unlock()
+
+	am.unlockedSetV4(vpnIp, hostVpnIp, n.Details.Ip4AndPorts, lhh.lh.unlockedShouldAddV4)
+	am.unlockedSetV6(vpnIp, hostVpnIp, n.Details.Ip6AndPorts, lhh.lh.unlockedShouldAddV6)
+	am.unlockedSetRelay(vpnIp, hostVpnIp, n.Details.relays())
+	if am.synced == nil {
+		am.synced = map[iputil.VpnIp]time.Time{}
+	}
+	am.synced[vpnIp] = time.Now()
+	am.Unlock()
+}
@@ -0,0 +1,135 @@
+package nebula
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/header"
+	"github.com/slackhq/nebula/iputil"
+	"github.com/slackhq/nebula/test"
+	"github.com/slackhq/nebula/udp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// collectEncWriter keeps every lighthouse message sent
+type collectEncWriter struct {
+	sent [][]byte
+}
+
+func (cw *collectEncWriter) SendVia(via *HostInfo, relay *Relay, ad, nb, out []byte, nocopy bool) {}
+func (cw *collectEncWriter) Handshake(vpnIp iputil.VpnIp)                                         {}
+func (cw *collectEncWriter) SendHostUpdate(vpnIp iputil.VpnIp, p, nb, out []byte) {
+	cw.SendMessageToVpnIp(header.LightHouse, 0, vpnIp, p, nb, out)
+}
+func (cw *collectEncWriter) SendMessageToHostInfo(t header.MessageType, st header.MessageSubType, hostinfo *HostInfo, p, nb, out []byte) {
+	cw.SendMessageToVpnIp(t, st, hostinfo.vpnIp, p, nb, out)
+}
+func (cw *collectEncWriter) SendMessageToVpnIp(t header.MessageType, st header.MessageSubType, vpnIp iputil.VpnIp, p, _, _ []byte) {
+	cw.sent = append(cw.sent, append([]byte{}, p...))
+}
+
+func TestLighthouse_loadSync(t *testing.T) {
+	l := test.NewLogger()
+	myVpnNet := &net.IPNet{IP: net.IP{10, 128, 0, 1}, Mask: net.IPMask{255, 255, 255, 0}}
+
+	c := config.NewC(l)
+	c.Settings["lighthouse"] = map[interface{}]interface{}{"hosts": []interface{}{"10.128.0.2"}, "sync": map[interface{}]interface{}{"peers": []interface{}{"10.128.0.3"}}}
+	c.Settings["static_host_map"] = map[interface{}]interface{}{"10.128.0.2": []interface{}{"1.1.1.1:4242"}}
+	_, err := NewLightHouseFromConfig(context.Background(), l, c, []*net.IPNet{myVpnNet}, nil, nil)
+	assert.EqualError(t, err, "lighthouse.sync.peers is only for lighthouses")
+
+	tests := map[string]map[interface{}]interface{}{
+		"Unable to parse lighthouse.sync.peers entry":           {"peers": []interface{}{"nope"}},
+		"lighthouse.sync.peers entry is not in our subnet":      {"peers": []interface{}{"10.0.0.1"}},
+		"lighthouse.sync.peers must not contain our own vpn ip": {"peers": []interface{}{"10.128.0.1"}},
+		"lighthouse.sync.interval must be greater than 0":       {"peers": []interface{}{"10.128.0.2"}, "interval": "0s"},
+	}
+	for expected, sync := range tests {
+		c := config.NewC(l)
+		c.Settings["lighthouse"] = map[interface{}]interface{}{"am_lighthouse": true, "sync": sync}
+		c.Settings["listen"] = map[interface{}]interface{}{"port": 4242}
+		_, err := NewLightHouseFromConfig(context.Background(), l, c, []*net.IPNet{myVpnNet}, nil, nil)
+		assert.ErrorContains(t, err, expected)
+	}
+
+	c = config.NewC(l)
+	c.Settings["lighthouse"] = map[interface{}]interface{}{"am_lighthouse": true, "sync": map[interface{}]interface{}{"peers": []interface{}{"10.128.0.2", "10.128.0.3"}, "interval": "5s"}}
+	c.Settings["listen"] = map[interface{}]interface{}{"port": 4242}
+	lh, err := NewLightHouseFromConfig(context.Background(), l, c, []*net.IPNet{myVpnNet}, nil, nil)
+	require.NoError(t, err)
+	assert.Len(t, lh.GetSyncPeers(), 2)
+	assert.True(t, lh.isSyncPeer(iputil.Ip2VpnIp(net.IP{10, 128, 0, 3})))
+	assert.EqualValues(t, 5*time.Second, lh.syncInterval.Load())
+}
+
+func TestLighthouse_sync(t *testing.T) {
+	l := test.NewLogger()
+	myVpnNet := &net.IPNet{IP: net.IP{10, 128, 0, 1}, Mask: net.IPMask{255, 255, 255, 0}}
+	lhA := iputil.Ip2VpnIp(net.IP{10, 128, 0, 1})
+	lhB := iputil.Ip2VpnIp(net.IP{10, 128, 0, 2})
+	host := iputil.Ip2VpnIp(net.IP{10, 128, 0, 3})
+	stranger := iputil.Ip2VpnIp(net.IP{10, 128, 0, 4})
+
+	newLighthouse := func(vpnIp, peer iputil.VpnIp) *LightHouse {
+		c := config.NewC(l)
+		c.Settings["lighthouse"] = map[interface{}]interface{}{"am_lighthouse": true, "sync": map[interface{}]interface{}{"peers": []interface{}{peer.String()}}}
+		c.Settings["listen"] = map[interface{}]interface{}{"port": 4242}
+		lh, err := NewLightHouseFromConfig(context.Background(), l, c, []*net.IPNet{&net.IPNet{IP: vpnIp.ToIP(), Mask: myVpnNet.Mask}}, nil, nil)
+		require.NoError(t, err)
+		return lh
+	}
+
+	a := newLighthouse(lhA, lhB)
+	b := newLighthouse(lhB, lhA)
+	aw := &collectEncWriter{}
+	a.ifce = aw
+	lhhA := a.NewRequestHandler()
+	lhhB := b.NewRequestHandler()
+
+	// The host only reports to A
+	hostAddr := &udp.Addr{IP: net.ParseIP("1.2.3.4"), Port: 4242}
+	newLHHostUpdate(hostAddr, host, []*udp.Addr{hostAddr}, lhhA)
+
+	// A restarted B asks A for everything
+	req, err := (&NebulaMeta{Type: NebulaMeta_HostSyncRequest, Details: &NebulaMetaDetails{VpnIp: lhB.Uint32()}}).Marshal()
+	require.NoError(t, err)
+	lhhA.HandleRequest(hostAddr, lhB, req, &testEncWriter{})
+	require.Equal(t, lhB, <-a.syncTrigger)
+
+	a.sendSync(lhB)
+	require.Len(t, aw.sent, 1)
+
+	// Only a sync peer is listened to
+	lhhB.HandleRequest(hostAddr, stranger, aw.sent[0], &testEncWriter{})
+	assert.Nil(t, newLHHostRequest(hostAddr, stranger, host, lhhB).msg)
+
+	lhhB.HandleRequest(hostAddr, lhA, aw.sent[0], &testEncWriter{})
+	r := newLHHostRequest(hostAddr, stranger, host, lhhB)
+	require.NotNil(t, r.msg)
+	assertIp4InArray(t, r.msg.Details.Ip4AndPorts, hostAddr)
+
+	// What B learned from A is not passed back
+	bw := &collectEncWriter{}
+	b.ifce = bw
+	b.sendSync(lhA)
+	assert.Empty(t, bw.sent)
+
+	// What the host reports to B directly is preferred
+	otherAddr := &udp.Addr{IP: net.ParseIP("5.6.7.8"), Port: 4242}
+	newLHHostUpdate(otherAddr, host, []*udp.Addr{otherAddr}, lhhB)
+	r = newLHHostRequest(hostAddr, stranger, host, lhhB)
+	assertIp4InArray(t, r.msg.Details.Ip4AndPorts, otherAddr)
+	b.sendSync(lhA)
+	assert.Len(t, bw.sent, 1)
+
+	// Synced addresses expire when A stops refreshing them, a host only known from A is forgotten
+	b.DeleteVpnIp(host)
+	lhhB.HandleRequest(hostAddr, lhA, aw.sent[0], &testEncWriter{})
+	b.addrMap[host].synced[lhA] = time.Now().Add(-time.Hour)
+	b.expireSynced(time.Minute)
+	assert.NotContains(t, b.addrMap, host)
+}
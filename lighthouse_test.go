@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"net"
+	"net/netip"
 	"testing"
 
 	"github.com/slackhq/nebula/config"
@@ -23,7 +24,7 @@ func TestOldIPv4Only(t *testing.T) {
 	var m Ip4AndPort
 	err := m.Unmarshal(b)
 	assert.NoError(t, err)
-	assert.Equal(t, "10.1.1.1", iputil.VpnIp(m.GetIp()).String())
+	assert.Equal(t, "10.1.1.1", iputil.VpnIpFrom4(m.GetIp()).String())
 }
 
 func TestNewLhQuery(t *testing.T) {
@@ -55,15 +56,22 @@ func Test_lhStaticMapping(t *testing.T) {
 	c := config.NewC(l)
 	c.Settings["lighthouse"] = map[interface{}]interface{}{"hosts": []interface{}{lh1}}
 	c.Settings["static_host_map"] = map[interface{}]interface{}{lh1: []interface{}{"1.1.1.1:4242"}}
-	_, err := NewLightHouseFromConfig(context.Background(), l, c, myVpnNet, nil, nil)
+	_, err := NewLightHouseFromConfig(context.Background(), l, c, []*net.IPNet{myVpnNet}, nil, nil)
 	assert.Nil(t, err)
 
 	lh2 := "10.128.0.3"
 	c = config.NewC(l)
 	c.Settings["lighthouse"] = map[interface{}]interface{}{"hosts": []interface{}{lh1, lh2}}
 	c.Settings["static_host_map"] = map[interface{}]interface{}{lh1: []interface{}{"100.1.1.1:4242"}}
-	_, err = NewLightHouseFromConfig(context.Background(), l, c, myVpnNet, nil, nil)
+	_, err = NewLightHouseFromConfig(context.Background(), l, c, []*net.IPNet{myVpnNet}, nil, nil)
 	assert.EqualError(t, err, "lighthouse 10.128.0.3 does not have a static_host_map entry")
+
+	c = config.NewC(l)
+	c.Settings["lighthouse"] = map[interface{}]interface{}{"hosts": []interface{}{lh1}}
+	c.Settings["static_host_map"] = map[interface{}]interface{}{lh1: []interface{}{"lighthouse.example.com:4242"}}
+	c.Settings["static_map"] = map[interface{}]interface{}{"cadence": "0s"}
+	_, err = NewLightHouseFromConfig(context.Background(), l, c, []*net.IPNet{myVpnNet}, nil, nil)
+	assert.EqualError(t, err, "static_map.cadence must be greater than 0")
 }
 
 func TestReloadLighthouseInterval(t *testing.T) {
@@ -78,7 +86,7 @@ func TestReloadLighthouseInterval(t *testing.T) {
 	}
 
 	c.Settings["static_host_map"] = map[interface{}]interface{}{lh1: []interface{}{"1.1.1.1:4242"}}
-	lh, err := NewLightHouseFromConfig(context.Background(), l, c, myVpnNet, nil, nil)
+	lh, err := NewLightHouseFromConfig(context.Background(), l, c, []*net.IPNet{myVpnNet}, nil, nil)
 	assert.NoError(t, err)
 	lh.ifce = &mockEncWriter{}
 
@@ -100,17 +108,17 @@ func BenchmarkLighthouseHandleRequest(b *testing.B) {
 	_, myVpnNet, _ := net.ParseCIDR("10.128.0.1/0")
 
 	c := config.NewC(l)
-	lh, err := NewLightHouseFromConfig(context.Background(), l, c, myVpnNet, nil, nil)
+	lh, err := NewLightHouseFromConfig(context.Background(), l, c, []*net.IPNet{myVpnNet}, nil, nil)
 	if !assert.NoError(b, err) {
 		b.Fatal()
 	}
 
 	hAddr := udp.NewAddrFromString("4.5.6.7:12345")
 	hAddr2 := udp.NewAddrFromString("4.5.6.7:12346")
-	lh.addrMap[3] = NewRemoteList(nil)
-	lh.addrMap[3].unlockedSetV4(
-		3,
-		3,
+	lh.addrMap[iputil.VpnIpFrom4(3)] = NewRemoteList(nil)
+	lh.addrMap[iputil.VpnIpFrom4(3)].unlockedSetV4(
+		iputil.VpnIpFrom4(3),
+		iputil.VpnIpFrom4(3),
 		[]*Ip4AndPort{
 			NewIp4AndPort(hAddr.IP, uint32(hAddr.Port)),
 			NewIp4AndPort(hAddr2.IP, uint32(hAddr2.Port)),
@@ -120,10 +128,10 @@ func BenchmarkLighthouseHandleRequest(b *testing.B) {
 
 	rAddr := udp.NewAddrFromString("1.2.2.3:12345")
 	rAddr2 := udp.NewAddrFromString("1.2.2.3:12346")
-	lh.addrMap[2] = NewRemoteList(nil)
-	lh.addrMap[2].unlockedSetV4(
-		3,
-		3,
+	lh.addrMap[iputil.VpnIpFrom4(2)] = NewRemoteList(nil)
+	lh.addrMap[iputil.VpnIpFrom4(2)].unlockedSetV4(
+		iputil.VpnIpFrom4(3),
+		iputil.VpnIpFrom4(3),
 		[]*Ip4AndPort{
 			NewIp4AndPort(rAddr.IP, uint32(rAddr.Port)),
 			NewIp4AndPort(rAddr2.IP, uint32(rAddr2.Port)),
@@ -145,7 +153,7 @@ func BenchmarkLighthouseHandleRequest(b *testing.B) {
 		p, err := req.Marshal()
 		assert.NoError(b, err)
 		for n := 0; n < b.N; n++ {
-			lhh.HandleRequest(rAddr, 2, p, mw)
+			lhh.HandleRequest(rAddr, iputil.VpnIpFrom4(2), p, mw)
 		}
 	})
 	b.Run("found", func(b *testing.B) {
@@ -161,7 +169,7 @@ func BenchmarkLighthouseHandleRequest(b *testing.B) {
 		assert.NoError(b, err)
 
 		for n := 0; n < b.N; n++ {
-			lhh.HandleRequest(rAddr, 2, p, mw)
+			lhh.HandleRequest(rAddr, iputil.VpnIpFrom4(2), p, mw)
 		}
 	})
 }
@@ -193,7 +201,7 @@ func TestLighthouse_Memory(t *testing.T) {
 	c := config.NewC(l)
 	c.Settings["lighthouse"] = map[interface{}]interface{}{"am_lighthouse": true}
 	c.Settings["listen"] = map[interface{}]interface{}{"port": 4242}
-	lh, err := NewLightHouseFromConfig(context.Background(), l, c, &net.IPNet{IP: net.IP{10, 128, 0, 1}, Mask: net.IPMask{255, 255, 255, 0}}, nil, nil)
+	lh, err := NewLightHouseFromConfig(context.Background(), l, c, []*net.IPNet{&net.IPNet{IP: net.IP{10, 128, 0, 1}, Mask: net.IPMask{255, 255, 255, 0}}}, nil, nil)
 	assert.NoError(t, err)
 	lhh := lh.NewRequestHandler()
 
@@ -269,7 +277,7 @@ func TestLighthouse_reload(t *testing.T) {
 	c := config.NewC(l)
 	c.Settings["lighthouse"] = map[interface{}]interface{}{"am_lighthouse": true}
 	c.Settings["listen"] = map[interface{}]interface{}{"port": 4242}
-	lh, err := NewLightHouseFromConfig(context.Background(), l, c, &net.IPNet{IP: net.IP{10, 128, 0, 1}, Mask: net.IPMask{255, 255, 255, 0}}, nil, nil)
+	lh, err := NewLightHouseFromConfig(context.Background(), l, c, []*net.IPNet{&net.IPNet{IP: net.IP{10, 128, 0, 1}, Mask: net.IPMask{255, 255, 255, 0}}}, nil, nil)
 	assert.NoError(t, err)
 
 	nc := map[interface{}]interface{}{
@@ -289,7 +297,7 @@ func newLHHostRequest(fromAddr *udp.Addr, myVpnIp, queryVpnIp iputil.VpnIp, lhh
 	req := &NebulaMeta{
 		Type: NebulaMeta_HostQuery,
 		Details: &NebulaMetaDetails{
-			VpnIp: uint32(queryVpnIp),
+			VpnIp: queryVpnIp.Uint32(),
 		},
 	}
 
@@ -310,13 +318,13 @@ func newLHHostUpdate(fromAddr *udp.Addr, vpnIp iputil.VpnIp, addrs []*udp.Addr,
 	req := &NebulaMeta{
 		Type: NebulaMeta_HostUpdateNotification,
 		Details: &NebulaMetaDetails{
-			VpnIp:       uint32(vpnIp),
+			VpnIp:       vpnIp.Uint32(),
 			Ip4AndPorts: make([]*Ip4AndPort, len(addrs)),
 		},
 	}
 
 	for k, v := range addrs {
-		req.Details.Ip4AndPorts[k] = &Ip4AndPort{Ip: uint32(iputil.Ip2VpnIp(v.IP)), Port: uint32(v.Port)}
+		req.Details.Ip4AndPorts[k] = &Ip4AndPort{Ip: iputil.Ip2VpnIp(v.IP).Uint32(), Port: uint32(v.Port)}
 	}
 
 	b, err := req.Marshal()
@@ -394,10 +402,13 @@ func newLHHostUpdate(fromAddr *udp.Addr, vpnIp iputil.VpnIp, addrs []*udp.Addr,
 //	)
 //}
 
-func Test_ipMaskContains(t *testing.T) {
-	assert.True(t, ipMaskContains(iputil.Ip2VpnIp(net.ParseIP("10.0.0.1")), 32-24, iputil.Ip2VpnIp(net.ParseIP("10.0.0.255"))))
-	assert.False(t, ipMaskContains(iputil.Ip2VpnIp(net.ParseIP("10.0.0.1")), 32-24, iputil.Ip2VpnIp(net.ParseIP("10.0.1.1"))))
-	assert.True(t, ipMaskContains(iputil.Ip2VpnIp(net.ParseIP("10.0.0.1")), 32, iputil.Ip2VpnIp(net.ParseIP("10.0.1.1"))))
+func TestLighthouse_inVpnNets(t *testing.T) {
+	lh := &LightHouse{myVpnNets: []netip.Prefix{netip.MustParsePrefix("10.0.0.0/24"), netip.MustParsePrefix("fd00::/64")}}
+	assert.True(t, lh.inVpnNets(iputil.Ip2VpnIp(net.ParseIP("10.0.0.255"))))
+	assert.False(t, lh.inVpnNets(iputil.Ip2VpnIp(net.ParseIP("10.0.1.1"))))
+	assert.True(t, lh.inVpnNets(iputil.Ip2VpnIp(net.ParseIP("fd00::1"))))
+	assert.False(t, lh.inVpnNets(iputil.Ip2VpnIp(net.ParseIP("fd00:0:0:1::1"))))
+	assert.False(t, lh.inVpnNets(iputil.VpnIp{}))
 }
 
 type testLhReply struct {
@@ -434,6 +445,10 @@ func (tw *testEncWriter) SendMessageToHostInfo(t header.MessageType, st header.M
 	}
 }
 
+func (tw *testEncWriter) SendHostUpdate(vpnIp iputil.VpnIp, p, nb, out []byte) {
+	tw.SendMessageToVpnIp(header.LightHouse, 0, vpnIp, p, nb, out)
+}
+
 func (tw *testEncWriter) SendMessageToVpnIp(t header.MessageType, st header.MessageSubType, vpnIp iputil.VpnIp, p, _, _ []byte) {
 	msg := &NebulaMeta{}
 	err := msg.Unmarshal(p)
@@ -458,7 +473,7 @@ func assertIp4InArray(t *testing.T, have []*Ip4AndPort, want ...*udp.Addr) {
 	}
 
 	for k, w := range want {
-		if !(have[k].Ip == uint32(iputil.Ip2VpnIp(w.IP)) && have[k].Port == uint32(w.Port)) {
+		if !(have[k].Ip == iputil.Ip2VpnIp(w.IP).Uint32() && have[k].Port == uint32(w.Port)) {
 			assert.Fail(t, fmt.Sprintf("Response did not contain: %v:%v at %v; %v", w.IP, w.Port, k, translateV4toUdpAddr(have)))
 		}
 	}
@@ -484,3 +499,33 @@ func translateV4toUdpAddr(ips []*Ip4AndPort) []*udp.Addr {
 	}
 	return addrs
 }
+
+func TestLighthouse_filterLocalIps(t *testing.T) {
+	l := test.NewLogger()
+	myVpnNet := &net.IPNet{IP: net.IP{10, 128, 0, 1}, Mask: net.IPMask{255, 255, 255, 0}}
+	c := config.NewC(l)
+	lh, err := NewLightHouseFromConfig(context.Background(), l, c, []*net.IPNet{myVpnNet}, nil, nil)
+	assert.NoError(t, err)
+
+	vpn := net.ParseIP("10.128.0.1")
+	private4 := net.ParseIP("192.168.1.10")
+	public4 := net.ParseIP("1.2.3.4")
+	ula := net.ParseIP("fd00::1")
+	public6 := net.ParseIP("2001:db8::1")
+	ips := []net.IP{vpn, private4, ula, public4, public6}
+
+	// Everything but our vpn ip by default
+	assert.Equal(t, []net.IP{private4, ula, public4, public6}, lh.filterLocalIps(ips))
+
+	c.Settings["lighthouse"] = map[interface{}]interface{}{"advertise_private": false}
+	assert.NoError(t, lh.reload(c, true))
+	assert.Equal(t, []net.IP{public4, public6}, lh.filterLocalIps(ips))
+
+	// The addresses a peer tries first are kept
+	c.Settings["lighthouse"] = map[interface{}]interface{}{"advertise_max": 3}
+	assert.NoError(t, lh.reload(c, true))
+	assert.Equal(t, []net.IP{public6, public4, private4}, lh.filterLocalIps(ips))
+
+	c.Settings["lighthouse"] = map[interface{}]interface{}{"advertise_max": -1}
+	assert.EqualError(t, lh.reload(c, true), "lighthouse.advertise_max must not be negative")
+}
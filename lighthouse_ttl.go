@@ -0,0 +1,119 @@
+package nebula
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/iputil"
+	"github.com/slackhq/nebula/util"
+)
+
+// A lighthouse keeps what a host reported until the host closes its tunnel to the lighthouse. A host that vanishes
+// without closing it, like a reclaimed spot instance, would be answered for forever. With lighthouse.host_ttl set a
+// lighthouse forgets what a host reported when the host has not updated it within the ttl. With lighthouse.stale_after
+// set query replies about hosts that have not updated us within it are flagged stale, the addresses are still sent.
+//
+// Static hosts and what lighthouse.sync peers shared are never evicted here, the latter has its own expiry.
+
+// loadHostTTL reads lighthouse.host_ttl and lighthouse.stale_after, 0 disables either
+func loadHostTTL(c *config.C) (time.Duration, time.Duration, error) {
+	hostTTL := c.GetDuration("lighthouse.host_ttl", 0)
+	if hostTTL < 0 {
+		return 0, 0, util.NewContextualError("lighthouse.host_ttl must not be negative", m{"host_ttl": hostTTL}, nil)
+	}
+
+	staleAfter := c.GetDuration("lighthouse.stale_after", 0)
+	if staleAfter < 0 {
+		return 0, 0, util.NewContextualError("lighthouse.stale_after must not be negative", m{"stale_after": staleAfter}, nil)
+	}
+
+	if hostTTL > 0 && staleAfter >= hostTTL {
+		return 0, 0, fmt.Errorf("lighthouse.stale_after must be less than lighthouse.host_ttl")
+	}
+
+	return hostTTL, staleAfter, nil
+}
+
+func (lh *LightHouse) StartEvictionWorker() {
+	hostTTL := time.Duration(lh.hostTTL.Load())
+	if !lh.amLighthouse || hostTTL <= 0 {
+		return
+	}
+
+	// Check often enough that a host is not kept much longer than the ttl
+	ticker := time.NewTicker(max(hostTTL/4, time.Second))
+	evictCtx, cancel := context.WithCancel(lh.ctx)
+	lh.evictCancel = cancel
+
+	go func() {
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-evictCtx.Done():
+				return
+			case <-ticker.C:
+				lh.evictHosts(hostTTL)
+			}
+		}
+	}()
+}
+
+// evictHosts forgets what hosts reported when they have not updated us within ttl, hosts we know nothing else about
+// are dropped altogether
+func (lh *LightHouse) evictHosts(ttl time.Duration) {
+	lh.RLock()
+	lists := make(map[iputil.VpnIp]*RemoteList, len(lh.addrMap))
+	for vpnIp, rl := range lh.addrMap {
+		lists[vpnIp] = rl
+	}
+	lh.RUnlock()
+
+	now := time.Now()
+	var empty []iputil.VpnIp
+	for vpnIp, rl := range lists {
+		rl.Lock()
+		if c := rl.cache[vpnIp]; c != nil && now.Sub(c.updated) > ttl {
+			delete(rl.cache, vpnIp)
+			rl.shouldRebuild = true
+			lh.metricEvicted.Inc(1)
+			if len(rl.cache) == 0 {
+				empty = append(empty, vpnIp)
+			}
+		}
+		rl.Unlock()
+	}
+
+	if len(empty) == 0 {
+		return
+	}
+
+	staticList := lh.GetStaticHostList()
+	lh.Lock()
+	for _, vpnIp := range empty {
+		if _, ok := staticList[vpnIp]; ok {
+			continue
+		}
+
+		rl := lists[vpnIp]
+		if lh.addrMap[vpnIp] != rl {
+			continue
+		}
+
+		// The host may have reported to us since we looked
+		rl.RLock()
+		if len(rl.cache) == 0 {
+			delete(lh.addrMap, vpnIp)
+		}
+		rl.RUnlock()
+	}
+	lh.Unlock()
+}
+
+// isStale returns true if the owner of c has not updated it within lighthouse.stale_after, c must be read locked
+func (lh *LightHouse) isStale(c *cache) bool {
+	staleAfter := time.Duration(lh.staleAfter.Load())
+	return staleAfter > 0 && !c.updated.IsZero() && time.Since(c.updated) > staleAfter
+}
@@ -0,0 +1,123 @@
+package nebula
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/iputil"
+	"github.com/slackhq/nebula/test"
+	"github.com/slackhq/nebula/udp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadHostTTL(t *testing.T) {
+	l := test.NewLogger()
+	c := config.NewC(l)
+
+	hostTTL, staleAfter, err := loadHostTTL(c)
+	require.NoError(t, err)
+	assert.Zero(t, hostTTL)
+	assert.Zero(t, staleAfter)
+
+	c.Settings["lighthouse"] = map[interface{}]interface{}{"host_ttl": "10m", "stale_after": "5m"}
+	hostTTL, staleAfter, err = loadHostTTL(c)
+	require.NoError(t, err)
+	assert.Equal(t, 10*time.Minute, hostTTL)
+	assert.Equal(t, 5*time.Minute, staleAfter)
+
+	c.Settings["lighthouse"] = map[interface{}]interface{}{"host_ttl": "5m", "stale_after": "5m"}
+	_, _, err = loadHostTTL(c)
+	assert.EqualError(t, err, "lighthouse.stale_after must be less than lighthouse.host_ttl")
+
+	c.Settings["lighthouse"] = map[interface{}]interface{}{"host_ttl": "-1s"}
+	_, _, err = loadHostTTL(c)
+	assert.EqualError(t, err, "lighthouse.host_ttl must not be negative")
+}
+
+func TestLighthouse_hostTTL(t *testing.T) {
+	l := test.NewLogger()
+	myVpnNet := &net.IPNet{IP: net.IP{10, 128, 0, 1}, Mask: net.IPMask{255, 255, 255, 0}}
+	host := iputil.Ip2VpnIp(net.IP{10, 128, 0, 2})
+	static := iputil.Ip2VpnIp(net.IP{10, 128, 0, 3})
+	querier := iputil.Ip2VpnIp(net.IP{10, 128, 0, 4})
+
+	c := config.NewC(l)
+	c.Settings["lighthouse"] = map[interface{}]interface{}{"am_lighthouse": true, "host_ttl": "10m", "stale_after": "5m"}
+	c.Settings["listen"] = map[interface{}]interface{}{"port": 4242}
+	c.Settings["static_host_map"] = map[interface{}]interface{}{"10.128.0.3": []interface{}{"1.1.1.1:4242"}}
+	lh, err := NewLightHouseFromConfig(context.Background(), l, c, []*net.IPNet{myVpnNet}, nil, nil)
+	require.NoError(t, err)
+	lhh := lh.NewRequestHandler()
+
+	hostAddr := &udp.Addr{IP: net.ParseIP("1.2.3.4"), Port: 4242}
+	newLHHostUpdate(hostAddr, host, []*udp.Addr{hostAddr}, lhh)
+	newLHHostUpdate(hostAddr, static, []*udp.Addr{hostAddr}, lhh)
+
+	r := newLHHostRequest(hostAddr, querier, host, lhh)
+	require.NotNil(t, r.msg)
+	assert.False(t, r.msg.Details.Stale)
+
+	age := func(vpnIp iputil.VpnIp, d time.Duration) {
+		rl := lh.addrMap[vpnIp]
+		rl.Lock()
+		rl.cache[vpnIp].updated = time.Now().Add(-d)
+		rl.Unlock()
+	}
+
+	// Still answered, but flagged
+	age(host, 6*time.Minute)
+	r = newLHHostRequest(hostAddr, querier, host, lhh)
+	require.NotNil(t, r.msg)
+	assert.True(t, r.msg.Details.Stale)
+	assertIp4InArray(t, r.msg.Details.Ip4AndPorts, hostAddr)
+
+	// A host that updates us is kept
+	lh.evictHosts(10 * time.Minute)
+	assert.Contains(t, lh.addrMap, host)
+
+	// A host that stopped updating us is forgotten, a static host only loses what it reported
+	age(host, 11*time.Minute)
+	age(static, 11*time.Minute)
+	lh.evictHosts(10 * time.Minute)
+	assert.NotContains(t, lh.addrMap, host)
+	require.Contains(t, lh.addrMap, static)
+	assert.NotContains(t, lh.addrMap[static].cache, static)
+	assert.Contains(t, lh.addrMap[static].cache, lh.myVpnIp)
+}
+
+func TestLighthouse_staleReply(t *testing.T) {
+	l := test.NewLogger()
+	myVpnNet := &net.IPNet{IP: net.IP{10, 128, 0, 1}, Mask: net.IPMask{255, 255, 255, 0}}
+	lighthouse := iputil.Ip2VpnIp(net.IP{10, 128, 0, 2})
+	host := iputil.Ip2VpnIp(net.IP{10, 128, 0, 3})
+
+	c := config.NewC(l)
+	c.Settings["lighthouse"] = map[interface{}]interface{}{"hosts": []interface{}{lighthouse.String()}}
+	c.Settings["static_host_map"] = map[interface{}]interface{}{lighthouse.String(): []interface{}{"1.1.1.1:4242"}}
+	lh, err := NewLightHouseFromConfig(context.Background(), l, c, []*net.IPNet{myVpnNet}, nil, nil)
+	require.NoError(t, err)
+	lhh := lh.NewRequestHandler()
+
+	reply := func(stale bool) {
+		b, err := (&NebulaMeta{
+			Type: NebulaMeta_HostQueryReply,
+			Details: &NebulaMetaDetails{
+				VpnIp:       host.Uint32(),
+				Ip4AndPorts: []*Ip4AndPort{NewIp4AndPort(net.ParseIP("1.2.3.4"), 4242)},
+				Stale:       stale,
+			},
+		}).Marshal()
+		require.NoError(t, err)
+		lhh.HandleRequest(&udp.Addr{IP: net.ParseIP("1.1.1.1"), Port: 4242}, lighthouse, b, &testEncWriter{})
+	}
+
+	reply(true)
+	assert.True(t, lh.addrMap[host].cache[lighthouse].stale)
+
+	reply(false)
+	assert.False(t, lh.addrMap[host].cache[lighthouse].stale)
+}
@@ -0,0 +1,281 @@
+package nebula
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+
+	"github.com/sirupsen/logrus"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/firewall"
+	"github.com/slackhq/nebula/udp"
+	"github.com/slackhq/nebula/util"
+)
+
+// The udp listeners are opened on listen.host and listen.port at start. Each is held by a listenerConn, the innermost of
+// the conns wrapped around it, so a reload that changes either setting can open new sockets and swap them in without
+// the wrappers, the lighthouse or the handshake manager noticing. The read loops follow once the old sockets close.
+
+// listenerConn is a udp listener that can be replaced while it is in use
+type listenerConn struct {
+	conn atomic.Pointer[udp.Conn]
+
+	lock sync.Mutex
+	// changed is closed when the listener is replaced or closed, a read loop whose socket closed waits on it
+	changed chan struct{}
+	closed  bool
+}
+
+func newListenerConn(conn udp.Conn) *listenerConn {
+	c := &listenerConn{changed: make(chan struct{})}
+	c.conn.Store(&conn)
+	return c
+}
+
+func (c *listenerConn) current() udp.Conn {
+	return *c.conn.Load()
+}
+
+// swap makes conn the listener and returns the one it replaced, which is left open
+func (c *listenerConn) swap(conn udp.Conn) udp.Conn {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	old := *c.conn.Swap(&conn)
+	close(c.changed)
+	c.changed = make(chan struct{})
+	return old
+}
+
+func (c *listenerConn) listening() (udp.Conn, chan struct{}, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.current(), c.changed, c.closed
+}
+
+// ListenOut reads from the listener, when its socket closes it moves on to the one that replaced it
+func (c *listenerConn) ListenOut(r udp.EncReader, lhf udp.LightHouseHandlerFunc, cache *firewall.ConntrackCacheTicker, q int) {
+	for {
+		conn, changed, closed := c.listening()
+		if closed {
+			return
+		}
+
+		conn.ListenOut(r, lhf, cache, q)
+		<-changed
+	}
+}
+
+func (c *listenerConn) Rebind() error {
+	return c.current().Rebind()
+}
+
+func (c *listenerConn) LocalAddr() (*udp.Addr, error) {
+	return c.current().LocalAddr()
+}
+
+func (c *listenerConn) WriteTo(b []byte, addr *udp.Addr) error {
+	return c.current().WriteTo(b, addr)
+}
+
+// WriteBatch sends the packets as a batch if the socket supports it and one by one if it does not
+func (c *listenerConn) WriteBatch(bufs [][]byte, addrs []*udp.Addr, tos []byte) error {
+	return writeBatchDiverted(c.current(), bufs, addrs, tos, func(int) bool { return false })
+}
+
+func (c *listenerConn) ReloadConfig(cfg *config.C) {
+	c.current().ReloadConfig(cfg)
+}
+
+func (c *listenerConn) Close() error {
+	c.lock.Lock()
+	c.closed = true
+	close(c.changed)
+	c.changed = make(chan struct{})
+	c.lock.Unlock()
+
+	return c.current().Close()
+}
+
+// resolveListenHost returns the ip in listen.host
+func resolveListenHost(c *config.C) (net.IP, error) {
+	rawListenHost := c.GetString("listen.host", "0.0.0.0")
+	if rawListenHost == "[::]" {
+		// Old guidance was to provide the literal `[::]` in `listen.host` but that won't resolve.
+		return net.IPv6zero, nil
+	}
+
+	listenHost, err := net.ResolveIPAddr("ip", rawListenHost)
+	if err != nil {
+		return nil, err
+	}
+	return listenHost.IP, nil
+}
+
+// openListeners opens a udp listener on ip and port for every routine and returns the port they listen on. With a port
+// of 0 the first listener picks one and the others share it.
+func openListeners(l *logrus.Logger, c *config.C, ip net.IP, port int, routines int) ([]udp.Conn, int, error) {
+	conns := make([]udp.Conn, 0, routines)
+	closeAll := func() {
+		for _, conn := range conns {
+			conn.Close()
+		}
+	}
+
+	for i := 0; i < routines; i++ {
+		l.Infof("listening %q %d", ip, port)
+		udpServer, err := udp.NewListener(l, ip, port, routines > 1, c.GetInt("listen.batch", 64))
+		if err != nil {
+			closeAll()
+			return nil, 0, util.NewContextualError("Failed to open udp listener", m{"queue": i}, err)
+		}
+		udpServer.ReloadConfig(c)
+		conns = append(conns, udpServer)
+
+		// If port is dynamic, discover it before the next pass through the for loop
+		// This way all routines will use the same port correctly
+		if port == 0 {
+			uPort, err := udpServer.LocalAddr()
+			if err != nil {
+				closeAll()
+				return nil, 0, util.NewContextualError("Failed to get listening port", nil, err)
+			}
+			port = int(uPort.Port)
+		}
+	}
+
+	return conns, port, nil
+}
+
+// listenRebind is what a committed listener rebind leaves for finishListenReload
+type listenRebind struct {
+	// retired are the replaced sockets, they are closed once the reload has succeeded
+	retired []udp.Conn
+	ip      net.IP
+	port    int
+}
+
+// prepareListenReload opens udp listeners for a changed listen.host or listen.port. They replace the running ones when
+// the reload transaction commits, the old ones are closed by finishListenReload once the whole reload has succeeded.
+func (f *Interface) prepareListenReload(c *config.C) (*config.ReloadStage, error) {
+	if len(f.listeners) == 0 || (!c.HasChanged("listen.host") && !c.HasChanged("listen.port")) {
+		return nil, nil
+	}
+
+	// The listen.ports sockets stay on the address they were opened on
+	if c.HasChanged("listen.host") && c.IsSet("listen.ports") {
+		return nil, fmt.Errorf("listen.host can not change while listen.ports is set, restart nebula to apply it")
+	}
+
+	ip, err := resolveListenHost(c)
+	if err != nil {
+		return nil, util.ContextualizeIfNeeded("Failed to resolve listen.host", err)
+	}
+
+	oldIP, oldPort := f.listenIP, int(f.lightHouse.nebulaPort.Load())
+	port := c.GetInt("listen.port", 0)
+	conns, boundPort, err := openListeners(f.l, c, ip, port, len(f.listeners))
+	if err != nil {
+		if port != 0 && port == oldPort {
+			// Only listen.host moved, our own sockets hold the port until they are closed
+			return f.stageListenReopen(c, ip, port, oldIP, oldPort), nil
+		}
+		return nil, err
+	}
+
+	var old []udp.Conn
+	return &config.ReloadStage{
+		Commit: func() error {
+			old = make([]udp.Conn, len(f.listeners))
+			for i, lc := range f.listeners {
+				old[i] = lc.swap(conns[i])
+			}
+			f.setListen(ip, boundPort)
+			f.rebound = &listenRebind{retired: old, ip: ip, port: boundPort}
+			return nil
+		},
+		Rollback: func() {
+			if old != nil {
+				for i, lc := range f.listeners {
+					lc.swap(old[i])
+				}
+				f.setListen(oldIP, oldPort)
+				f.rebound = nil
+			}
+			for _, conn := range conns {
+				conn.Close()
+			}
+		},
+	}, nil
+}
+
+// stageListenReopen moves the listeners to ip by closing them and opening new ones on the same port. The listener is
+// down for a moment and a rollback has to open the old address again.
+func (f *Interface) stageListenReopen(c *config.C, ip net.IP, port int, oldIP net.IP, oldPort int) *config.ReloadStage {
+	reopen := func(ip net.IP, port int) error {
+		for _, lc := range f.listeners {
+			lc.current().Close()
+		}
+
+		conns, _, err := openListeners(f.l, c, ip, port, len(f.listeners))
+		if err != nil {
+			return err
+		}
+		for i, lc := range f.listeners {
+			lc.swap(conns[i])
+		}
+		return nil
+	}
+
+	committed := false
+	return &config.ReloadStage{
+		Commit: func() error {
+			committed = true
+			if err := reopen(ip, port); err != nil {
+				return err
+			}
+			f.setListen(ip, port)
+			f.rebound = &listenRebind{ip: ip, port: port}
+			return nil
+		},
+		Rollback: func() {
+			if !committed {
+				return
+			}
+			if err := reopen(oldIP, oldPort); err != nil {
+				f.l.WithError(err).WithField("host", oldIP).WithField("port", oldPort).
+					Error("Failed to listen on the previous address again")
+			}
+			f.setListen(oldIP, oldPort)
+			f.rebound = nil
+		},
+	}
+}
+
+// setListen records where the listeners are
+func (f *Interface) setListen(ip net.IP, port int) {
+	f.listenIP = ip
+	f.lightHouse.nebulaPort.Store(uint32(port))
+}
+
+// finishListenReload runs once a reload that rebound the listeners has succeeded, it closes the replaced sockets and
+// sets up the new ones like the old ones were
+func (f *Interface) finishListenReload(c *config.C) {
+	rebound := f.rebound
+	if rebound == nil {
+		return
+	}
+	f.rebound = nil
+
+	for _, conn := range rebound.retired {
+		if err := conn.Close(); err != nil {
+			f.l.WithError(err).Error("Error while closing udp socket")
+		}
+	}
+
+	f.applyOutsideFilter(c, true)
+	f.listenRebinds.Add(1)
+	f.l.WithField("host", rebound.ip).WithField("port", rebound.port).Info("Moved the udp listeners")
+	f.rebindUnderlay()
+}
@@ -0,0 +1,129 @@
+package nebula
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/firewall"
+	"github.com/slackhq/nebula/test"
+	"github.com/slackhq/nebula/udp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// blockingConn reads until it is closed
+type blockingConn struct {
+	udp.NoopConn
+	closed chan struct{}
+	reads  chan struct{}
+}
+
+func newBlockingConn() *blockingConn {
+	return &blockingConn{closed: make(chan struct{}), reads: make(chan struct{}, 1)}
+}
+
+func (c *blockingConn) ListenOut(_ udp.EncReader, _ udp.LightHouseHandlerFunc, _ *firewall.ConntrackCacheTicker, _ int) {
+	c.reads <- struct{}{}
+	<-c.closed
+}
+
+func (c *blockingConn) Close() error {
+	close(c.closed)
+	return nil
+}
+
+func TestListenerConn(t *testing.T) {
+	a, b := newBlockingConn(), newBlockingConn()
+	lc := newListenerConn(a)
+
+	done := make(chan struct{})
+	go func() {
+		lc.ListenOut(nil, nil, nil, 0)
+		close(done)
+	}()
+	<-a.reads
+
+	// The read loop stays on the old socket until it closes
+	assert.Same(t, a, lc.swap(b))
+	assert.Same(t, b, unwrapConn(lc))
+	require.NoError(t, a.Close())
+
+	select {
+	case <-b.reads:
+	case <-time.After(time.Second):
+		t.Fatal("the read loop did not move to the new socket")
+	}
+
+	require.NoError(t, lc.Close())
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("the read loop did not exit")
+	}
+}
+
+func TestInterface_prepareListenReload(t *testing.T) {
+	l := test.NewLogger()
+	c := config.NewC(l)
+	require.NoError(t, c.LoadString("listen:\n  host: 0.0.0.0\n  port: 0\n"))
+
+	ip, err := resolveListenHost(c)
+	require.NoError(t, err)
+	conns, port, err := openListeners(l, c, ip, 0, 2)
+	require.NoError(t, err)
+
+	f := &Interface{l: l, listenIP: ip}
+	for _, conn := range conns {
+		lc := newListenerConn(conn)
+		f.listeners = append(f.listeners, lc)
+		f.writers = append(f.writers, lc)
+	}
+	f.outside = f.writers[0]
+	defer f.listeners[0].Close()
+	defer f.listeners[1].Close()
+
+	f.lightHouse, err = NewLightHouseFromConfig(context.Background(), l, c, []*net.IPNet{{IP: net.IP{10, 128, 0, 1}, Mask: net.IPMask{255, 255, 255, 0}}}, f.outside, nil)
+	require.NoError(t, err)
+	assert.Equal(t, uint32(port), f.lightHouse.nebulaPort.Load())
+
+	c.RegisterReloadTransaction(f.prepareListenReload)
+	c.RegisterReloadCallback(f.finishListenReload)
+	fail := false
+	c.RegisterReloadTransaction(func(*config.C) (*config.ReloadStage, error) {
+		return &config.ReloadStage{Commit: func() error {
+			if fail {
+				return errors.New("later stage failed")
+			}
+			return nil
+		}}, nil
+	})
+
+	// A later stage failing puts the old sockets back and closes the new ones
+	fail = true
+	require.Error(t, c.ReloadConfigString("listen:\n  host: 127.0.0.1\n  port: 0\n"))
+	assert.Same(t, conns[0], f.listeners[0].current())
+	assert.Same(t, conns[1], f.listeners[1].current())
+	assert.Equal(t, uint32(port), f.lightHouse.nebulaPort.Load())
+	assert.Nil(t, f.rebound)
+
+	fail = false
+	require.NoError(t, c.ReloadConfigString("listen:\n  host: 127.0.0.1\n  port: 0\n"))
+	assert.NotSame(t, conns[0], f.listeners[0].current())
+	assert.Equal(t, uint32(1), f.listenRebinds.Load())
+	assert.Nil(t, f.rebound)
+
+	addr, err := f.listeners[0].LocalAddr()
+	require.NoError(t, err)
+	assert.Equal(t, "127.0.0.1", addr.IP.String())
+	assert.Equal(t, uint32(addr.Port), f.lightHouse.nebulaPort.Load())
+	other, err := f.listeners[1].LocalAddr()
+	require.NoError(t, err)
+	assert.Equal(t, addr.Port, other.Port, "every routine shares the port")
+
+	// listen.ports sockets can not follow a new listen.host
+	require.Error(t, c.ReloadConfigString("listen:\n  host: 0.0.0.0\n  port: 0\n  ports: [4243]\n"))
+}
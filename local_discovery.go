@@ -0,0 +1,220 @@
+package nebula
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/slackhq/nebula/cert"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/iputil"
+	"github.com/slackhq/nebula/udp"
+	"github.com/slackhq/nebula/util"
+)
+
+// Nodes with local_discovery enabled announce themselves to the local network with a multicast packet carrying their
+// certificate and nebula port. A node that hears an announcement for a certificate signed by a CA it trusts learns the
+// address the announcement came from for that vpn ip, so a tunnel between two nodes on the same network goes direct
+// without asking a lighthouse first. A node solicits announcements when it starts so it does not wait an interval to
+// hear from its neighbours.
+//
+// Announcements are not signed, the certificate shows who a vpn ip belongs to but not that the sender holds its key. A
+// forged announcement can only add an address to try, the handshake still proves who is on the other end.
+
+const (
+	localDiscoveryMagic           = "NEBULA-LD1"
+	defaultLocalDiscoveryGroup    = "239.255.42.42:4243"
+	defaultLocalDiscoveryInterval = 30 * time.Second
+)
+
+const (
+	localDiscoveryAnnounce byte = iota
+	localDiscoverySolicit
+)
+
+var errLocalDiscoveryMalformed = errors.New("malformed local discovery packet")
+
+type localDiscovery struct {
+	l        *logrus.Logger
+	f        *Interface
+	group    *net.UDPAddr
+	interval time.Duration
+	conn     *net.UDPConn
+}
+
+func newLocalDiscoveryFromConfig(l *logrus.Logger, f *Interface, c *config.C) (*localDiscovery, error) {
+	if !c.GetBool("local_discovery.enabled", false) {
+		return nil, nil
+	}
+
+	rawGroup := c.GetString("local_discovery.group", defaultLocalDiscoveryGroup)
+	group, err := net.ResolveUDPAddr("udp4", rawGroup)
+	if err != nil {
+		return nil, util.NewContextualError("Unable to parse local_discovery.group", m{"group": rawGroup}, err)
+	}
+	if !group.IP.IsMulticast() || group.Port == 0 {
+		return nil, util.NewContextualError("local_discovery.group must be an ipv4 multicast address and port", m{"group": rawGroup}, nil)
+	}
+
+	interval := c.GetDuration("local_discovery.interval", defaultLocalDiscoveryInterval)
+	if interval <= 0 {
+		return nil, fmt.Errorf("local_discovery.interval must be greater than 0")
+	}
+
+	return &localDiscovery{
+		l:        l,
+		f:        f,
+		group:    group,
+		interval: interval,
+	}, nil
+}
+
+// Start joins the multicast group and announces us until ctx is done. This is a non blocking call.
+func (ld *localDiscovery) Start(ctx context.Context) {
+	conn, err := net.ListenMulticastUDP("udp4", nil, ld.group)
+	if err != nil {
+		ld.l.WithError(err).WithField("group", ld.group).Error("Failed to join the local discovery group")
+		return
+	}
+	ld.conn = conn
+
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+
+	go ld.listen()
+	go ld.run(ctx)
+}
+
+func (ld *localDiscovery) run(ctx context.Context) {
+	ticker := time.NewTicker(ld.interval)
+	defer ticker.Stop()
+
+	ld.send(localDiscoverySolicit)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			ld.send(localDiscoveryAnnounce)
+		}
+	}
+}
+
+func (ld *localDiscovery) listen() {
+	b := make([]byte, mtu)
+	for {
+		n, from, err := ld.conn.ReadFromUDP(b)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			ld.l.WithError(err).Error("Failed to read from the local discovery group")
+			continue
+		}
+
+		solicited, err := ld.handle(from, b[:n])
+		if err != nil {
+			if ld.l.Level >= logrus.DebugLevel {
+				ld.l.WithError(err).WithField("from", from).Debug("Ignoring local discovery packet")
+			}
+			continue
+		}
+
+		if solicited {
+			ld.send(localDiscoveryAnnounce)
+		}
+	}
+}
+
+func (ld *localDiscovery) send(kind byte) {
+	cs := ld.f.pki.GetCertState()
+	b := marshalLocalDiscovery(kind, uint16(ld.f.lightHouse.nebulaPort.Load()), cs.RawCertificate)
+	if _, err := ld.conn.WriteToUDP(b, ld.group); err != nil {
+		ld.l.WithError(err).WithField("group", ld.group).Warn("Failed to send to the local discovery group")
+	}
+}
+
+// handle learns the address of the neighbour that sent b, solicited is true when they want to hear from us
+func (ld *localDiscovery) handle(from *net.UDPAddr, b []byte) (solicited bool, err error) {
+	kind, port, rawCert, err := unmarshalLocalDiscovery(b)
+	if err != nil {
+		return false, err
+	}
+
+	c, err := cert.UnmarshalNebulaCertificate(rawCert)
+	if err != nil {
+		return false, err
+	}
+
+	if len(c.Details.Ips) == 0 {
+		return false, errors.New("certificate has no vpn ip")
+	}
+
+	lh := ld.f.lightHouse
+	vpnIp := iputil.Ip2VpnIp(c.Details.Ips[0].IP)
+	if vpnIp == lh.myVpnIp {
+		// Our own announcement looped back
+		return false, nil
+	}
+
+	if !lh.inVpnNets(vpnIp) {
+		return false, errors.New("vpn ip is not in our network")
+	}
+
+	if _, err := c.VerifyWithCache(time.Now(), ld.f.pki.GetCAPool()); err != nil {
+		return false, err
+	}
+
+	if !lh.GetRemoteAllowList().Allow(vpnIp, from.IP) {
+		return false, errors.New("address is not allowed by lighthouse.remote_allow_list")
+	}
+
+	addr := udp.NewAddr(from.IP, port)
+	rl := lh.QueryCache(vpnIp)
+	if !rl.hasLearned(vpnIp, addr) {
+		rl.LearnRemote(vpnIp, addr)
+		ld.l.WithField("vpnIp", vpnIp).WithField("udpAddr", addr).Info("Discovered a neighbour on the local network")
+
+		// Non-blocking attempt to trigger, skip if it would block
+		select {
+		case lh.handshakeTrigger <- vpnIp:
+		default:
+		}
+	}
+
+	return kind == localDiscoverySolicit, nil
+}
+
+func marshalLocalDiscovery(kind byte, port uint16, rawCert []byte) []byte {
+	b := make([]byte, 0, len(localDiscoveryMagic)+3+len(rawCert))
+	b = append(b, localDiscoveryMagic...)
+	b = append(b, kind)
+	b = binary.BigEndian.AppendUint16(b, port)
+	return append(b, rawCert...)
+}
+
+func unmarshalLocalDiscovery(b []byte) (kind byte, port uint16, rawCert []byte, err error) {
+	if len(b) < len(localDiscoveryMagic)+3 || !bytes.HasPrefix(b, []byte(localDiscoveryMagic)) {
+		return 0, 0, nil, errLocalDiscoveryMalformed
+	}
+
+	b = b[len(localDiscoveryMagic):]
+	kind = b[0]
+	if kind != localDiscoveryAnnounce && kind != localDiscoverySolicit {
+		return 0, 0, nil, errLocalDiscoveryMalformed
+	}
+
+	port = binary.BigEndian.Uint16(b[1:3])
+	if port == 0 {
+		return 0, 0, nil, errLocalDiscoveryMalformed
+	}
+
+	return kind, port, b[3:], nil
+}
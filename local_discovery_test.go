@@ -0,0 +1,118 @@
+package nebula
+
+import (
+	"context"
+	"crypto/rand"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/slackhq/nebula/cert"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/iputil"
+	"github.com/slackhq/nebula/test"
+	"github.com/slackhq/nebula/udp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ed25519"
+)
+
+func TestNewLocalDiscoveryFromConfig(t *testing.T) {
+	l := test.NewLogger()
+	c := config.NewC(l)
+
+	ld, err := newLocalDiscoveryFromConfig(l, nil, c)
+	require.NoError(t, err)
+	assert.Nil(t, ld)
+
+	c.Settings["local_discovery"] = map[interface{}]interface{}{"enabled": true}
+	ld, err = newLocalDiscoveryFromConfig(l, nil, c)
+	require.NoError(t, err)
+	assert.Equal(t, defaultLocalDiscoveryGroup, ld.group.String())
+	assert.Equal(t, defaultLocalDiscoveryInterval, ld.interval)
+
+	c.Settings["local_discovery"] = map[interface{}]interface{}{"enabled": true, "group": "10.0.0.1:4243"}
+	_, err = newLocalDiscoveryFromConfig(l, nil, c)
+	assert.EqualError(t, err, "local_discovery.group must be an ipv4 multicast address and port")
+
+	c.Settings["local_discovery"] = map[interface{}]interface{}{"enabled": true, "interval": "0s"}
+	_, err = newLocalDiscoveryFromConfig(l, nil, c)
+	assert.EqualError(t, err, "local_discovery.interval must be greater than 0")
+}
+
+func TestLocalDiscovery_handle(t *testing.T) {
+	l := test.NewLogger()
+	now := time.Now()
+	myVpnNet := &net.IPNet{IP: net.IP{10, 128, 0, 1}, Mask: net.IPMask{255, 255, 255, 0}}
+
+	pubCA, privCA, _ := ed25519.GenerateKey(rand.Reader)
+	caCert := cert.NebulaCertificate{
+		Details: cert.NebulaCertificateDetails{
+			Name:      "ca",
+			NotBefore: now.Add(-time.Minute),
+			NotAfter:  now.Add(time.Hour),
+			IsCA:      true,
+			PublicKey: pubCA,
+		},
+	}
+	require.NoError(t, caCert.Sign(cert.Curve_CURVE25519, privCA))
+	caPool := cert.NewCAPool()
+	caPool.CAs["ca"] = &caCert
+
+	newRawCert := func(ip net.IP, key ed25519.PrivateKey) []byte {
+		pub, _, _ := ed25519.GenerateKey(rand.Reader)
+		c := cert.NebulaCertificate{
+			Details: cert.NebulaCertificateDetails{
+				Name:      "host",
+				Ips:       []*net.IPNet{{IP: ip, Mask: myVpnNet.Mask}},
+				NotBefore: now,
+				NotAfter:  now.Add(time.Hour),
+				PublicKey: pub,
+				Issuer:    "ca",
+			},
+		}
+		require.NoError(t, c.Sign(cert.Curve_CURVE25519, key))
+		b, err := c.Marshal()
+		require.NoError(t, err)
+		return b
+	}
+
+	c := config.NewC(l)
+	lh, err := NewLightHouseFromConfig(context.Background(), l, c, []*net.IPNet{myVpnNet}, nil, nil)
+	require.NoError(t, err)
+	trigger := make(chan iputil.VpnIp, 1)
+	lh.handshakeTrigger = trigger
+	f := &Interface{lightHouse: lh, pki: &PKI{}, l: l}
+	f.pki.caPool.Store(caPool)
+	ld := &localDiscovery{l: l, f: f}
+
+	peer := iputil.Ip2VpnIp(net.IP{10, 128, 0, 2})
+	from := &net.UDPAddr{IP: net.IP{192, 168, 1, 2}, Port: 4243}
+	b := marshalLocalDiscovery(localDiscoverySolicit, 4242, newRawCert(peer.ToIP(), privCA))
+
+	solicited, err := ld.handle(from, b)
+	require.NoError(t, err)
+	assert.True(t, solicited)
+	assert.Equal(t, peer, <-trigger)
+	assert.Equal(t, []*udp.Addr{udp.NewAddr(from.IP, 4242)}, lh.QueryCache(peer).CopyAddrs(nil))
+
+	// Hearing the same thing again does not trigger another handshake
+	_, err = ld.handle(from, marshalLocalDiscovery(localDiscoveryAnnounce, 4242, newRawCert(peer.ToIP(), privCA)))
+	require.NoError(t, err)
+	assert.Empty(t, trigger)
+
+	// Our own announcement is ignored
+	_, err = ld.handle(from, marshalLocalDiscovery(localDiscoveryAnnounce, 4242, newRawCert(myVpnNet.IP, privCA)))
+	require.NoError(t, err)
+	assert.NotContains(t, lh.addrMap, iputil.Ip2VpnIp(myVpnNet.IP))
+
+	// A certificate from a CA we do not trust is refused
+	_, otherCA, _ := ed25519.GenerateKey(rand.Reader)
+	stranger := iputil.Ip2VpnIp(net.IP{10, 128, 0, 3})
+	_, err = ld.handle(from, marshalLocalDiscovery(localDiscoveryAnnounce, 4242, newRawCert(stranger.ToIP(), otherCA)))
+	assert.Error(t, err)
+	assert.NotContains(t, lh.addrMap, stranger)
+
+	_, err = ld.handle(from, []byte("NEBULA-LD1"))
+	assert.ErrorIs(t, err, errLocalDiscoveryMalformed)
+}
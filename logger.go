@@ -1,21 +1,122 @@
 package nebula
 
 import (
+	"encoding/json"
 	"fmt"
+	"net"
+	"net/netip"
+	"sort"
 	"strings"
 	"time"
 
 	"github.com/sirupsen/logrus"
 	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/udp"
 )
 
-func configLogger(l *logrus.Logger, c *config.C) error {
+// logSubsystems can log at their own level with logging.subsystems, everything else logs at logging.level
+var logSubsystems = []string{"handshake", "lighthouse", "firewall", "tun"}
+
+// redactedLogFields hold underlay addresses, packet contents or key material, with logging.redact their values are
+// replaced, along with any field holding an underlay address type, see redactLogField
+var redactedLogFields = map[string]struct{}{
+	"addr":          {},
+	"newAddr":       {},
+	"remote":        {},
+	"remoteAddress": {},
+	"remoteIp":      {},
+	"udpAddr":       {},
+	"udpAddrs":      {},
+	"packet":        {},
+	"raw":           {},
+	"cert":          {},
+	"publicKey":     {},
+	"sshKey":        {},
+	"sshKeyConfig":  {},
+}
+
+const redactedLogValue = "[redacted]"
+
+// loggers are the main logger and a logger for each of logSubsystems. A subsystem logger shares the output, formatter
+// and hooks of the main logger, only the level is its own, and it adds a subsystem field to everything it logs.
+type loggers struct {
+	l          *logrus.Logger
+	subsystems map[string]*logrus.Logger
+}
+
+func newLoggers(l *logrus.Logger) *loggers {
+	ls := &loggers{l: l, subsystems: make(map[string]*logrus.Logger, len(logSubsystems))}
+	for _, name := range logSubsystems {
+		ls.subsystems[name] = &logrus.Logger{
+			Out:          l.Out,
+			Hooks:        l.Hooks,
+			Formatter:    &subsystemFormatter{l: l, name: name},
+			ReportCaller: l.ReportCaller,
+			Level:        l.GetLevel(),
+			ExitFunc:     l.ExitFunc,
+		}
+	}
+	return ls
+}
+
+// get returns the logger for a subsystem in logSubsystems
+func (ls *loggers) get(name string) *logrus.Logger {
+	sl, ok := ls.subsystems[name]
+	if !ok {
+		panic(fmt.Sprintf("unknown logging subsystem %s", name))
+	}
+	return sl
+}
+
+// setLevel sets the level of the main logger and every subsystem
+func (ls *loggers) setLevel(level logrus.Level) {
+	ls.l.SetLevel(level)
+	for _, sl := range ls.subsystems {
+		sl.SetLevel(level)
+	}
+}
+
+// logLevels describes the level of the main logger and every subsystem, in a stable order
+func (ls *loggers) logLevels() string {
+	names := make([]string, 0, len(ls.subsystems))
+	for name := range ls.subsystems {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "Log level is: %s", ls.l.GetLevel())
+	for _, name := range names {
+		fmt.Fprintf(&b, "\n  %s: %s", name, ls.subsystems[name].GetLevel())
+	}
+	return b.String()
+}
+
+func configLogger(ls *loggers, c *config.C) error {
 	// set up our logging level
 	logLevel, err := logrus.ParseLevel(strings.ToLower(c.GetString("logging.level", "info")))
 	if err != nil {
 		return fmt.Errorf("%s; possible levels: %s", err, logrus.AllLevels)
 	}
-	l.SetLevel(logLevel)
+
+	// Parse every subsystem level before changing anything so a bad reload leaves the old levels in place
+	levels := make(map[string]logrus.Level, len(logSubsystems))
+	for _, name := range logSubsystems {
+		levels[name] = logLevel
+	}
+
+	for k, v := range c.GetMap("logging.subsystems", map[interface{}]interface{}{}) {
+		name := fmt.Sprint(k)
+		if _, ok := levels[name]; !ok {
+			return fmt.Errorf("unknown logging subsystem `%s`. possible subsystems: %s", name, logSubsystems)
+		}
+
+		level, err := logrus.ParseLevel(strings.ToLower(fmt.Sprint(v)))
+		if err != nil {
+			return fmt.Errorf("logging.subsystems.%s: %s; possible levels: %s", name, err, logrus.AllLevels)
+		}
+		levels[name] = level
+	}
 
 	disableTimestamp := c.GetBool("logging.disable_timestamp", false)
 	timestampFormat := c.GetString("logging.timestamp_format", "")
@@ -25,15 +126,16 @@ func configLogger(l *logrus.Logger, c *config.C) error {
 	}
 
 	logFormat := strings.ToLower(c.GetString("logging.format", "text"))
+	var formatter logrus.Formatter
 	switch logFormat {
 	case "text":
-		l.Formatter = &logrus.TextFormatter{
+		formatter = &logrus.TextFormatter{
 			TimestampFormat:  timestampFormat,
 			FullTimestamp:    fullTimestamp,
 			DisableTimestamp: disableTimestamp,
 		}
 	case "json":
-		l.Formatter = &logrus.JSONFormatter{
+		formatter = &logrus.JSONFormatter{
 			TimestampFormat:  timestampFormat,
 			DisableTimestamp: disableTimestamp,
 		}
@@ -41,5 +143,84 @@ func configLogger(l *logrus.Logger, c *config.C) error {
 		return fmt.Errorf("unknown log format `%s`. possible formats: %s", logFormat, []string{"text", "json"})
 	}
 
+	ls.l.SetLevel(logLevel)
+	for name, level := range levels {
+		ls.subsystems[name].SetLevel(level)
+	}
+	ls.l.Formatter = &logFormatter{Formatter: formatter, redact: c.GetBool("logging.redact", false)}
+
 	return nil
 }
+
+// logFormatter wraps the formatter picked with logging.format. It redacts fields when logging.redact is set and makes
+// sure json output stays json, a field that can not be marshalled is logged as a string instead of losing the entry.
+type logFormatter struct {
+	logrus.Formatter
+	redact bool
+}
+
+func (lf *logFormatter) Format(e *logrus.Entry) ([]byte, error) {
+	// Entries are copied before they are formatted, changing the fields does not affect the caller
+	if lf.redact {
+		for k, v := range e.Data {
+			e.Data[k] = redactLogField(k, v)
+		}
+	}
+
+	b, err := lf.Formatter.Format(e)
+	if err == nil {
+		return b, nil
+	}
+
+	if _, ok := lf.Formatter.(*logrus.JSONFormatter); !ok {
+		return nil, err
+	}
+
+	for k, v := range e.Data {
+		if _, ok := v.(error); ok {
+			continue
+		}
+		if _, err := json.Marshal(v); err != nil {
+			e.Data[k] = fmt.Sprintf("%+v", v)
+		}
+	}
+	return lf.Formatter.Format(e)
+}
+
+// redactLogField returns the value to log for the field k
+func redactLogField(k string, v interface{}) interface{} {
+	if _, ok := redactedLogFields[k]; ok {
+		return redactedLogValue
+	}
+
+	switch tv := v.(type) {
+	case *udp.Addr, udp.Addr, []*udp.Addr, []udp.Addr, netip.AddrPort, []netip.AddrPort, *net.UDPAddr, *net.TCPAddr:
+		return redactedLogValue
+	case m:
+		return redactLogMap(tv)
+	case map[string]interface{}:
+		return redactLogMap(tv)
+	}
+	return v
+}
+
+func redactLogMap(v map[string]interface{}) m {
+	r := make(m, len(v))
+	for k, mv := range v {
+		r[k] = redactLogField(k, mv)
+	}
+	return r
+}
+
+// subsystemFormatter formats the entries of a subsystem logger with the formatter of the main logger
+type subsystemFormatter struct {
+	l    *logrus.Logger
+	name string
+}
+
+func (sf *subsystemFormatter) Format(e *logrus.Entry) ([]byte, error) {
+	if _, ok := e.Data["subsystem"]; !ok {
+		e.Data["subsystem"] = sf.name
+	}
+	return sf.l.Formatter.Format(e)
+}
@@ -0,0 +1,126 @@
+package nebula
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/udp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestLoggers(t *testing.T, raw string) (*loggers, *bytes.Buffer) {
+	b := &bytes.Buffer{}
+	l := logrus.New()
+	l.SetOutput(b)
+
+	c := config.NewC(l)
+	require.NoError(t, c.LoadString(raw))
+
+	ls := newLoggers(l)
+	require.NoError(t, configLogger(ls, c))
+	return ls, b
+}
+
+func TestConfigLogger_Subsystems(t *testing.T) {
+	ls, b := newTestLoggers(t, `
+logging:
+  level: warning
+  format: json
+  subsystems:
+    handshake: debug
+    tun: error
+`)
+
+	assert.Equal(t, logrus.WarnLevel, ls.l.GetLevel())
+	assert.Equal(t, logrus.DebugLevel, ls.get("handshake").GetLevel())
+	assert.Equal(t, logrus.WarnLevel, ls.get("lighthouse").GetLevel())
+	assert.Equal(t, logrus.WarnLevel, ls.get("firewall").GetLevel())
+	assert.Equal(t, logrus.ErrorLevel, ls.get("tun").GetLevel())
+
+	ls.l.Debug("main debug")
+	ls.get("tun").Warn("tun warning")
+	ls.get("handshake").WithField("vpnIp", "10.0.0.1").Debug("handshake debug")
+
+	var e map[string]interface{}
+	require.NoError(t, json.Unmarshal(b.Bytes(), &e), "only the handshake entry is logged")
+	assert.Equal(t, "handshake debug", e["msg"])
+	assert.Equal(t, "handshake", e["subsystem"])
+	assert.Equal(t, "10.0.0.1", e["vpnIp"])
+
+	// A bad reload does not change any level
+	c := config.NewC(ls.l)
+	require.NoError(t, c.LoadString("logging: {level: info, subsystems: {handshake: info, tun: loud}}"))
+	assert.EqualError(t, configLogger(ls, c), `logging.subsystems.tun: not a valid logrus Level: "loud"; possible levels: [panic fatal error warning info debug trace]`)
+	assert.Equal(t, logrus.WarnLevel, ls.l.GetLevel())
+	assert.Equal(t, logrus.DebugLevel, ls.get("handshake").GetLevel())
+
+	require.NoError(t, c.LoadString("logging: {subsystems: {dns: debug}}"))
+	assert.EqualError(t, configLogger(ls, c), "unknown logging subsystem `dns`. possible subsystems: [handshake lighthouse firewall tun]")
+
+	// Subsystems without a level follow logging.level
+	require.NoError(t, c.LoadString("logging: {level: error}"))
+	require.NoError(t, configLogger(ls, c))
+	for _, name := range logSubsystems {
+		assert.Equal(t, logrus.ErrorLevel, ls.get(name).GetLevel(), name)
+	}
+}
+
+func TestConfigLogger_Redact(t *testing.T) {
+	ls, b := newTestLoggers(t, "logging: {format: json, redact: true}")
+
+	addr := udp.NewAddr(net.ParseIP("1.2.3.4"), 4242)
+	ls.get("lighthouse").
+		WithField("vpnIp", "10.0.0.1").
+		WithField("udpAddr", "1.2.3.4:4242").
+		WithField("to", addr).
+		WithField("handshake", m{"stage": 1, "remote": addr}).
+		WithError(errors.New("boom")).
+		Info("redacted")
+
+	var e map[string]interface{}
+	require.NoError(t, json.Unmarshal(b.Bytes(), &e))
+	assert.Equal(t, "10.0.0.1", e["vpnIp"])
+	assert.Equal(t, redactedLogValue, e["udpAddr"])
+	assert.Equal(t, redactedLogValue, e["to"])
+	assert.Equal(t, map[string]interface{}{"stage": 1.0, "remote": redactedLogValue}, e["handshake"])
+	assert.Equal(t, "boom", e["error"])
+	assert.Equal(t, "lighthouse", e["subsystem"])
+}
+
+func TestConfigLogger_JSONFallback(t *testing.T) {
+	ls, b := newTestLoggers(t, "logging: {format: json}")
+
+	ls.l.WithField("ch", make(chan int)).WithField("n", 1).Info("not marshallable")
+
+	var e map[string]interface{}
+	require.NoError(t, json.Unmarshal(b.Bytes(), &e))
+	assert.Equal(t, "not marshallable", e["msg"])
+	assert.Equal(t, 1.0, e["n"])
+	assert.IsType(t, "", e["ch"])
+}
+
+func TestSSHLogLevel(t *testing.T) {
+	ls, _ := newTestLoggers(t, "logging: {level: info}")
+	w := &testStringWriter{}
+
+	require.NoError(t, sshLogLevel(ls, nil, []string{"handshake", "debug"}, w))
+	assert.Equal(t, "Log level for handshake is: debug\n", w.String())
+	assert.Equal(t, logrus.InfoLevel, ls.l.GetLevel())
+
+	w.Reset()
+	require.NoError(t, sshLogLevel(ls, nil, nil, w))
+	assert.Equal(t, "Log level is: info\n  firewall: info\n  handshake: debug\n  lighthouse: info\n  tun: info\n", w.String())
+
+	w.Reset()
+	require.NoError(t, sshLogLevel(ls, nil, []string{"warn"}, w))
+	for _, name := range logSubsystems {
+		assert.Equal(t, logrus.WarnLevel, ls.get(name).GetLevel(), name)
+	}
+	assert.Equal(t, logrus.WarnLevel, ls.l.GetLevel())
+}
@@ -2,7 +2,6 @@ package nebula
 
 import (
 	"context"
-	"encoding/binary"
 	"fmt"
 	"net"
 	"time"
@@ -43,25 +42,26 @@ func Main(c *config.C, configTest bool, buildVersion string, logger *logrus.Logg
 		l.Println(string(b))
 	}
 
-	err := configLogger(l, c)
+	ls := newLoggers(l)
+	err := configLogger(ls, c)
 	if err != nil {
 		return nil, util.ContextualizeIfNeeded("Failed to configure the logger", err)
 	}
 
 	c.RegisterReloadCallback(func(c *config.C) {
-		err := configLogger(l, c)
+		err := configLogger(ls, c)
 		if err != nil {
 			l.WithError(err).Error("Failed to configure the logger")
 		}
 	})
 
-	pki, err := NewPKIFromConfig(l, c)
+	pki, err := NewPKIFromConfig(l, c, configTest)
 	if err != nil {
 		return nil, util.ContextualizeIfNeeded("Failed to load PKI from config", err)
 	}
 
 	certificate := pki.GetCertState().Certificate
-	fw, err := NewFirewallFromConfig(l, certificate, c)
+	fw, err := NewFirewallFromConfig(ls.get("firewall"), certificate, c)
 	if err != nil {
 		return nil, util.ContextualizeIfNeeded("Error while loading firewall rules", err)
 	}
@@ -132,7 +132,7 @@ func Main(c *config.C, configTest bool, buildVersion string, logger *logrus.Logg
 			deviceFactory = overlay.NewDeviceFromConfig
 		}
 
-		tun, err = deviceFactory(c, l, tunCidr, routines)
+		tun, err = deviceFactory(c, ls.get("tun"), certificate.Details.Ips, routines)
 		if err != nil {
 			return nil, util.ContextualizeIfNeeded("Failed to get a tun/tap device", err)
 		}
@@ -148,44 +148,74 @@ func Main(c *config.C, configTest bool, buildVersion string, logger *logrus.Logg
 	udpConns := make([]udp.Conn, routines)
 	port := c.GetInt("listen.port", 0)
 
+	portHopper, err := newPortHopperFromConfig(l, c)
+	if err != nil {
+		return nil, util.ContextualizeIfNeeded("Failed to load listen.ports", err)
+	}
+
+	var listeners []*listenerConn
+	var listenIP net.IP
 	if !configTest {
-		rawListenHost := c.GetString("listen.host", "0.0.0.0")
-		var listenHost *net.IPAddr
-		if rawListenHost == "[::]" {
-			// Old guidance was to provide the literal `[::]` in `listen.host` but that won't resolve.
-			listenHost = &net.IPAddr{IP: net.IPv6zero}
+		listenIP, err = resolveListenHost(c)
+		if err != nil {
+			return nil, util.ContextualizeIfNeeded("Failed to resolve listen.host", err)
+		}
 
-		} else {
-			listenHost, err = net.ResolveIPAddr("ip", rawListenHost)
-			if err != nil {
-				return nil, util.ContextualizeIfNeeded("Failed to resolve listen.host", err)
-			}
+		conns, _, err := openListeners(l, c, listenIP, port, routines)
+		if err != nil {
+			return nil, err
+		}
+		listeners = make([]*listenerConn, routines)
+		for i := range conns {
+			listeners[i] = newListenerConn(conns[i])
+			udpConns[i] = listeners[i]
 		}
 
-		for i := 0; i < routines; i++ {
-			l.Infof("listening %q %d", listenHost.IP, port)
-			udpServer, err := udp.NewListener(l, listenHost.IP, port, routines > 1, c.GetInt("listen.batch", 64))
-			if err != nil {
-				return nil, util.NewContextualError("Failed to open udp listener", m{"queue": i}, err)
+		if portHopper != nil {
+			if err := portHopper.open(listenIP, c); err != nil {
+				return nil, util.NewContextualError("Failed to open udp listener", nil, err)
 			}
-			udpServer.ReloadConfig(c)
-			udpConns[i] = udpServer
-
-			// If port is dynamic, discover it before the next pass through the for loop
-			// This way all routines will use the same port correctly
-			if port == 0 {
-				uPort, err := udpServer.LocalAddr()
-				if err != nil {
-					return nil, util.NewContextualError("Failed to get listening port", nil, err)
-				}
-				port = int(uPort.Port)
+			for i := range udpConns {
+				udpConns[i] = portHopper.wrap(udpConns[i])
 			}
 		}
 	}
 
+	proxy, err := newUnderlayProxyFromConfig(l, c)
+	if err != nil {
+		return nil, util.ContextualizeIfNeeded("Failed to load proxy", err)
+	}
+	if proxy != nil && proxy.udp && !configTest {
+		for i := range udpConns {
+			udpConns[i] = proxy.wrap(udpConns[i])
+		}
+	}
+
+	links := newUnderlayLinks()
+	tcpTransport, err := newTCPTransportFromConfig(l, c, links)
+	if err != nil {
+		return nil, util.ContextualizeIfNeeded("Failed to load tcp_transport", err)
+	}
+	quicTransport, err := newQUICTransportFromConfig(l, c, links)
+	if err != nil {
+		return nil, util.ContextualizeIfNeeded("Failed to load quic_transport", err)
+	}
+	if (tcpTransport != nil || quicTransport != nil) && !configTest {
+		for i := range udpConns {
+			udpConns[i] = links.wrap(udpConns[i])
+		}
+	}
+
+	captures := &packetCaptures{}
+	if !configTest {
+		for i := range udpConns {
+			udpConns[i] = captures.wrap(udpConns[i])
+		}
+	}
+
 	hostMap := NewHostMapFromConfig(l, tunCidr, c)
 	punchy := NewPunchyFromConfig(l, c)
-	lightHouse, err := NewLightHouseFromConfig(ctx, l, c, tunCidr, udpConns[0], punchy)
+	lightHouse, err := NewLightHouseFromConfig(ctx, ls.get("lighthouse"), c, certificate.Details.Ips, udpConns[0], punchy)
 	if err != nil {
 		return nil, util.ContextualizeIfNeeded("Failed to initialize lighthouse handler", err)
 	}
@@ -197,68 +227,123 @@ func Main(c *config.C, configTest bool, buildVersion string, logger *logrus.Logg
 		messageMetrics = newMessageMetricsOnlyRecvError()
 	}
 
-	useRelays := c.GetBool("relay.use_relays", DefaultUseRelays) && !c.GetBool("relay.am_relay", false)
+	// A relay only uses relays itself when it chains through them
+	useRelays := c.GetBool("relay.use_relays", DefaultUseRelays) &&
+		(!c.GetBool("relay.am_relay", false) || c.GetInt("relay.max_hops", 1) > 1)
+
+	handshakeGuard, err := newHandshakeGuardFromConfig(c)
+	if err != nil {
+		return nil, util.NewContextualError("Failed to load handshake guard config", nil, err)
+	}
 
 	handshakeConfig := HandshakeConfig{
 		tryInterval:   c.GetDuration("handshakes.try_interval", DefaultHandshakeTryInterval),
 		retries:       c.GetInt("handshakes.retries", DefaultHandshakeRetries),
 		triggerBuffer: c.GetInt("handshakes.trigger_buffer", DefaultHandshakeTriggerBuffer),
 		useRelays:     useRelays,
+		guard:         handshakeGuard,
 
 		messageMetrics: messageMetrics,
 	}
 
-	handshakeManager := NewHandshakeManager(l, hostMap, lightHouse, udpConns[0], handshakeConfig)
+	handshakeManager := NewHandshakeManager(ls.get("handshake"), hostMap, lightHouse, udpConns[0], handshakeConfig)
 	lightHouse.handshakeTrigger = handshakeManager.trigger
 
-	serveDns := false
-	if c.GetBool("lighthouse.serve_dns", false) {
-		if c.GetBool("lighthouse.am_lighthouse", false) {
-			serveDns = true
-		} else {
-			l.Warn("DNS server refusing to run because this host is not a lighthouse.")
-		}
-	}
+	serveDns := c.GetBool("lighthouse.serve_dns", false)
 
 	checkInterval := c.GetInt("timers.connection_alive_interval", 5)
 	pendingDeletionInterval := c.GetInt("timers.pending_deletion_interval", 10)
 
+	var adaptivePendingDeletion *adaptiveTimeout
+	if c.GetBool("timers.pending_deletion_adaptive", false) {
+		adaptivePendingDeletion = &adaptiveTimeout{
+			min: c.GetDuration("timers.pending_deletion_min", defaultPendingDeletionMin),
+			max: c.GetDuration("timers.pending_deletion_max", defaultPendingDeletionMax),
+		}
+		if adaptivePendingDeletion.min <= 0 || adaptivePendingDeletion.max < adaptivePendingDeletion.min {
+			return nil, util.NewContextualError("Invalid adaptive pending deletion bounds", m{
+				"min": adaptivePendingDeletion.min, "max": adaptivePendingDeletion.max,
+			}, nil)
+		}
+	}
+
+	relayManager, err := NewRelayManager(ctx, l, hostMap, c)
+	if err != nil {
+		return nil, util.NewContextualError("Failed to load relay config", nil, err)
+	}
+
+	tracer, err := newTracerFromConfig(l, c, buildVersion, pki.GetCertState())
+	if err != nil {
+		return nil, util.ContextualizeIfNeeded("Failed to load tracing", err)
+	}
+
+	keepalive, err := newKeepaliveFromConfig(c)
+	if err != nil {
+		return nil, util.NewContextualError("Failed to load keepalive config", nil, err)
+	}
+
+	ciphers, err := newCipherConfigFromConfig(c)
+	if err != nil {
+		return nil, util.NewContextualError("Failed to load cipher config", nil, err)
+	}
+
+	if _, err := newRekeyPolicyFromConfig(c); err != nil {
+		return nil, util.NewContextualError("Failed to load rekey config", nil, err)
+	}
+
+	if _, err := newRequiredGroupsFromConfig(c); err != nil {
+		return nil, util.NewContextualError("Failed to load handshakes.require_groups", nil, err)
+	}
+
+	if _, err := newIdentityPinsFromConfig(c); err != nil {
+		return nil, util.NewContextualError("Failed to load pki.pins", nil, err)
+	}
+
+	if _, err := newHandshakePSKsFromConfig(c); err != nil {
+		return nil, util.NewContextualError("Failed to load handshakes.psk", nil, err)
+	}
+
+	if _, err := newReplayWindowConfigFromConfig(c); err != nil {
+		return nil, util.NewContextualError("Failed to load replay_window", nil, err)
+	}
+
+	if _, err := newDSCPMarkingFromConfig(c); err != nil {
+		return nil, util.NewContextualError("Failed to load listen.dscp", nil, err)
+	}
+
 	ifConfig := &InterfaceConfig{
 		HostMap:                 hostMap,
 		Inside:                  tun,
 		Outside:                 udpConns[0],
 		pki:                     pki,
-		Cipher:                  c.GetString("cipher", "aes"),
+		ciphers:                 ciphers,
 		Firewall:                fw,
 		ServeDns:                serveDns,
 		HandshakeManager:        handshakeManager,
 		lightHouse:              lightHouse,
 		checkInterval:           time.Second * time.Duration(checkInterval),
 		pendingDeletionInterval: time.Second * time.Duration(pendingDeletionInterval),
+		adaptivePendingDeletion: adaptivePendingDeletion,
+		keepalive:               keepalive,
 		tryPromoteEvery:         c.GetUint32("counters.try_promote", defaultPromoteEvery),
 		reQueryEvery:            c.GetUint32("counters.requery_every_packets", defaultReQueryEvery),
 		reQueryWait:             c.GetDuration("timers.requery_wait_duration", defaultReQueryWait),
 		DropLocalBroadcast:      c.GetBool("tun.drop_local_broadcast", false),
 		DropMulticast:           c.GetBool("tun.drop_multicast", false),
 		routines:                routines,
+		sendBatch:               c.GetInt("listen.send_batch", 64),
+		pinRoutines:             c.GetBool("pin_routines", false),
 		MessageMetrics:          messageMetrics,
 		version:                 buildVersion,
-		relayManager:            NewRelayManager(ctx, l, hostMap, c),
+		relayManager:            relayManager,
 		punchy:                  punchy,
+		tracer:                  tracer,
+		captures:                captures,
 
 		ConntrackCacheTimeout: conntrackCacheTimeout,
 		l:                     l,
 	}
 
-	switch ifConfig.Cipher {
-	case "aes":
-		noiseEndianness = binary.BigEndian
-	case "chachapoly":
-		noiseEndianness = binary.LittleEndian
-	default:
-		return nil, fmt.Errorf("unknown cipher: %v", ifConfig.Cipher)
-	}
-
 	var ifce *Interface
 	if !configTest {
 		ifce, err = NewInterface(ctx, ifConfig)
@@ -269,11 +354,24 @@ func Main(c *config.C, configTest bool, buildVersion string, logger *logrus.Logg
 		// TODO: Better way to attach these, probably want a new interface in InterfaceConfig
 		// I don't want to make this initial commit too far-reaching though
 		ifce.writers = udpConns
+		ifce.listeners = listeners
+		ifce.listenIP = listenIP
 		lightHouse.ifce = ifce
+		lightHouse.hostUpdateKey = ifce.hostUpdateKeyFor
+		lightHouse.relayLoad = hostMap.relayIndexCount
+		lightHouse.hostVpnIp = hostMap.primaryVpnIp
+		lightHouse.hostSubnets = hostMap.certSubnets
 
 		ifce.RegisterConfigChangeCallbacks(c)
 		ifce.reloadDisconnectInvalid(c)
 		ifce.reloadSendRecvError(c)
+		ifce.reloadRekey(c)
+		ifce.reloadRequireGroups(c)
+		ifce.reloadPins(c)
+		ifce.reloadHandshakePSKs(c)
+		ifce.reloadReplayWindow(c)
+		ifce.reloadDSCPMarking(c)
+		ifce.reloadOutsideFilter(c)
 
 		handshakeManager.f = ifce
 		go handshakeManager.Run(ctx)
@@ -281,28 +379,190 @@ func Main(c *config.C, configTest bool, buildVersion string, logger *logrus.Logg
 
 	// TODO - stats third-party modules start uncancellable goroutines. Update those libs to accept
 	// a context so that they can exit when the context is Done.
-	statsStart, err := startStats(l, c, buildVersion, configTest)
+	statsStart, err := startStats(ctx, l, c, ifce, buildVersion, configTest)
 	if err != nil {
 		return nil, util.ContextualizeIfNeeded("Failed to start stats emitter", err)
 	}
 
+	localDiscovery, err := newLocalDiscoveryFromConfig(l, ifce, c)
+	if err != nil {
+		return nil, util.ContextualizeIfNeeded("Failed to load local_discovery", err)
+	}
+
+	portMapper, err := newPortMapperFromConfig(l, ifce, c)
+	if err != nil {
+		return nil, util.ContextualizeIfNeeded("Failed to load port_mapping", err)
+	}
+
+	stun, err := newStunClientFromConfig(l, ifce, c)
+	if err != nil {
+		return nil, util.ContextualizeIfNeeded("Failed to load stun", err)
+	}
+
+	pmtud, err := newPMTUDiscoveryFromConfig(l, ifce, c)
+	if err != nil {
+		return nil, util.ContextualizeIfNeeded("Failed to load pmtud", err)
+	}
+
+	mp, err := newMultipathFromConfig(l, ifce, c)
+	if err != nil {
+		return nil, util.ContextualizeIfNeeded("Failed to load multipath", err)
+	}
+
+	relaySelector, err := newRelaySelectorFromConfig(l, ifce, c)
+	if err != nil {
+		return nil, util.ContextualizeIfNeeded("Failed to load relay.selection", err)
+	}
+
+	relayDiscovery, err := newRelayDiscoveryFromConfig(l, ifce, c)
+	if err != nil {
+		return nil, util.ContextualizeIfNeeded("Failed to load relay.discover", err)
+	}
+
+	routeLearner, err := newRouteLearnerFromConfig(l, ifce, c)
+	if err != nil {
+		return nil, util.ContextualizeIfNeeded("Failed to load routing.learn", err)
+	}
+
+	controlAPI, err := newControlAPIFromConfig(l, c)
+	if err != nil {
+		return nil, util.ContextualizeIfNeeded("Failed to load control_api", err)
+	}
+
+	// Checked here so -test catches a bad sshd access config, attachSSHAccess loads it again
+	if _, err = newSSHAccessConfigFromConfig(c); err != nil {
+		return nil, util.ContextualizeIfNeeded("Failed to load the sshd access config", err)
+	}
+
 	if configTest {
 		return nil, nil
 	}
 
+	ifce.restarts = newRestartTracker(l, c)
+
 	//TODO: check if we _should_ be emitting stats
 	go ifce.emitStats(ctx, c.GetDuration("stats.interval", time.Second*10))
+	if tracer != nil {
+		tracer.Start(ctx)
+	}
+
+	audit, err := newAdminAuditFromConfig(l, c)
+	if err != nil {
+		return nil, util.ContextualizeIfNeeded("Failed to load audit", err)
+	}
 
-	attachCommands(l, c, ssh, ifce)
+	attachCommands(ls, c, ssh, ifce)
+	attachSSHCACommands(l, c, ssh, ifce)
+	attachSSHAccess(l, c, ssh, ifce, audit)
 
 	// Start DNS server last to allow using the nebula IP as lighthouse.dns.host
 	var dnsStart func()
-	if lightHouse.amLighthouse && serveDns {
+	if serveDns {
 		l.Debugln("Starting dns server")
-		dnsStart = dnsMain(l, hostMap, c)
+		dnsStart, err = dnsMain(l, hostMap, lightHouse, c)
+		if err != nil {
+			return nil, util.ContextualizeIfNeeded("Failed to start the dns server", err)
+		}
+	}
+
+	var underlayStart func()
+	if uw := newUnderlayWatcherFromConfig(l, ifce, c); uw != nil {
+		underlayStart = func() { uw.Start(ctx) }
 	}
 
-	return &Control{
+	var renewStart func()
+	if cr := newCertRenewerFromConfig(l, pki, c); cr != nil {
+		renewStart = func() { cr.Start(ctx) }
+	}
+
+	var remotePKIStart func()
+	rp, err := newRemotePKIFromConfig(l, pki, c)
+	if err != nil {
+		return nil, util.ContextualizeIfNeeded("Failed to load remote pki", err)
+	}
+	if rp != nil {
+		remotePKIStart = func() { rp.Start(ctx) }
+	}
+
+	var localDiscoveryStart func()
+	if localDiscovery != nil {
+		localDiscoveryStart = func() { localDiscovery.Start(ctx) }
+	}
+
+	var stunStart func()
+	if stun != nil {
+		ifce.stun = stun
+		stunStart = func() { stun.Start(ctx) }
+	}
+
+	var portMappingStart func()
+	if portMapper != nil {
+		portMappingStart = func() { portMapper.Start(ctx) }
+	}
+
+	var pmtudStart func()
+	if pmtud != nil {
+		ifce.pmtud = pmtud
+		pmtudStart = func() { pmtud.Start(ctx) }
+	}
+
+	var multipathStart func()
+	if mp != nil {
+		ifce.multipath = mp
+		multipathStart = func() { mp.Start(ctx) }
+	}
+
+	var relaySelectionStart func()
+	if relaySelector != nil {
+		ifce.relaySelector = relaySelector
+		relaySelectionStart = func() { relaySelector.Start(ctx) }
+	}
+
+	var relayDiscoveryStart func()
+	if relayDiscovery != nil {
+		relayDiscoveryStart = func() { relayDiscovery.Start(ctx) }
+	}
+
+	var routeLearnStart func()
+	if routeLearner != nil {
+		routeLearnStart = func() { routeLearner.Start(ctx) }
+	}
+
+	var tcpTransportStart func()
+	if tcpTransport != nil {
+		ifce.underlays = append(ifce.underlays, tcpTransport)
+		tcpTransport.f = ifce
+		tcpTransport.proxy = proxy
+		tcpTransportStart = func() { tcpTransport.Start(ctx) }
+	}
+
+	var quicTransportStart func()
+	if quicTransport != nil {
+		ifce.underlays = append(ifce.underlays, quicTransport)
+		quicTransport.f = ifce
+		quicTransportStart = func() { quicTransport.Start(ctx) }
+	}
+
+	var portHopStart func()
+	if portHopper != nil {
+		portHopper.f = ifce
+		portHopStart = func() { portHopper.Start(ctx) }
+	}
+
+	var proxyStart func()
+	if proxy != nil {
+		proxy.f = ifce
+		proxyStart = func() { proxy.Start(ctx) }
+	}
+
+	// The control api works through the Control we are about to return
+	var ctrl *Control
+	var controlAPIStart func()
+	if controlAPI != nil {
+		controlAPIStart = func() { controlAPI.Start(ctx, ctrl, audit) }
+	}
+
+	ctrl = &Control{
 		ifce,
 		l,
 		ctx,
@@ -311,5 +571,24 @@ func Main(c *config.C, configTest bool, buildVersion string, logger *logrus.Logg
 		statsStart,
 		dnsStart,
 		lightHouse.StartUpdateWorker,
-	}, nil
+		underlayStart,
+		renewStart,
+		remotePKIStart,
+		lightHouse.StartSyncWorker,
+		localDiscoveryStart,
+		lightHouse.StartEvictionWorker,
+		portMappingStart,
+		stunStart,
+		pmtudStart,
+		multipathStart,
+		relaySelectionStart,
+		relayDiscoveryStart,
+		routeLearnStart,
+		tcpTransportStart,
+		quicTransportStart,
+		portHopStart,
+		proxyStart,
+		controlAPIStart,
+	}
+	return ctrl, nil
 }
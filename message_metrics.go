@@ -41,6 +41,8 @@ func newMessageMetrics() *MessageMetrics {
 		return [][]metrics.Counter{
 			{
 				metrics.GetOrRegisterCounter(fmt.Sprintf("messages.%s.handshake_ixpsk0", t), nil),
+				metrics.GetOrRegisterCounter(fmt.Sprintf("messages.%s.handshake_xxpsk0", t), nil),
+				metrics.GetOrRegisterCounter(fmt.Sprintf("messages.%s.handshake_cookie_reply", t), nil),
 			},
 			nil,
 			{metrics.GetOrRegisterCounter(fmt.Sprintf("messages.%s.recv_error", t), nil)},
@@ -48,6 +50,8 @@ func newMessageMetrics() *MessageMetrics {
 			{
 				metrics.GetOrRegisterCounter(fmt.Sprintf("messages.%s.test_request", t), nil),
 				metrics.GetOrRegisterCounter(fmt.Sprintf("messages.%s.test_response", t), nil),
+				metrics.GetOrRegisterCounter(fmt.Sprintf("messages.%s.test_diag_request", t), nil),
+				metrics.GetOrRegisterCounter(fmt.Sprintf("messages.%s.test_diag_response", t), nil),
 			},
 			{metrics.GetOrRegisterCounter(fmt.Sprintf("messages.%s.close_tunnel", t), nil)},
 		}
@@ -85,6 +89,12 @@ func newLighthouseMetrics() *MessageMetrics {
 			NebulaMeta_HostUpdateNotification,
 			NebulaMeta_HostPunchNotification,
 			NebulaMeta_HostUpdateNotificationAck,
+			NebulaMeta_HostSyncRequest,
+			NebulaMeta_HostSyncNotification,
+			NebulaMeta_RelayQuery,
+			NebulaMeta_RelayQueryReply,
+			NebulaMeta_RouteQuery,
+			NebulaMeta_RouteQueryReply,
 		}
 		for _, i := range used {
 			h[i] = []metrics.Counter{metrics.GetOrRegisterCounter(fmt.Sprintf("lighthouse.%s.%s", t, i.String()), nil)}
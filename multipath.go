@@ -0,0 +1,225 @@
+package nebula
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	"github.com/sirupsen/logrus"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/header"
+	"github.com/slackhq/nebula/udp"
+)
+
+// A tunnel sends to a single remote until the connection manager decides it is dead, even when the host can be
+// reached at other addresses, like a laptop with both ethernet and LTE. With multipath enabled every tunnel probes up to
+// max_paths of the remotes it knows for the host with test packets, a path is alive while its probes are answered.
+//
+// In failover mode traffic stays on one path and moves to the next alive path as soon as the current one stops
+// answering, rather than waiting for the tunnel to be torn down. In spray mode traffic is spread over every alive path
+// in turn, which adds their bandwidth but reorders packets between paths with different latencies.
+//
+// Probes are path probes, see path_probe.go, so a path is validated no matter which of its addresses the host answers
+// from. Our own address is chosen by the routing table, multiple local interfaces are only used if it sends to the
+// host's addresses through different ones.
+
+const (
+	defaultMultipathMaxPaths      = 4
+	defaultMultipathProbeInterval = 5 * time.Second
+	defaultMultipathDeadAfter     = 15 * time.Second
+)
+
+type multipathPath struct {
+	addr *udp.Addr
+	// added is when we started probing the path, it is not dead until it has had dead_after to answer
+	added time.Time
+	// lastSeen is when a probe on the path was last answered, in unix nanoseconds
+	lastSeen atomic.Int64
+}
+
+func (p *multipathPath) alive(now time.Time, deadAfter time.Duration) bool {
+	return now.Sub(time.Unix(0, p.lastSeen.Load())) < deadAfter
+}
+
+func (p *multipathPath) dead(now time.Time, deadAfter time.Duration) bool {
+	return !p.alive(now, deadAfter) && now.Sub(p.added) >= deadAfter
+}
+
+// multipathPaths are the paths of a tunnel, it is replaced rather than modified
+type multipathPaths struct {
+	paths []*multipathPath
+	// spray are the alive remotes to spread traffic over, only in spray mode
+	spray []*udp.Addr
+	next  atomic.Uint32
+}
+
+func (mp *multipathPaths) find(addr *udp.Addr) *multipathPath {
+	for _, p := range mp.paths {
+		if p.addr.Equals(addr) {
+			return p
+		}
+	}
+	return nil
+}
+
+type multipath struct {
+	l             *logrus.Logger
+	f             *Interface
+	spray         bool
+	maxPaths      int
+	probeInterval time.Duration
+	deadAfter     time.Duration
+
+	metricFailover metrics.Counter
+}
+
+func newMultipathFromConfig(l *logrus.Logger, f *Interface, c *config.C) (*multipath, error) {
+	if !c.GetBool("multipath.enabled", false) {
+		return nil, nil
+	}
+
+	mp := &multipath{
+		l:              l,
+		f:              f,
+		maxPaths:       c.GetInt("multipath.max_paths", defaultMultipathMaxPaths),
+		probeInterval:  c.GetDuration("multipath.probe_interval", defaultMultipathProbeInterval),
+		deadAfter:      c.GetDuration("multipath.dead_after", defaultMultipathDeadAfter),
+		metricFailover: metrics.GetOrRegisterCounter("multipath.failover", nil),
+	}
+
+	switch mode := c.GetString("multipath.mode", "failover"); mode {
+	case "failover":
+	case "spray":
+		mp.spray = true
+	default:
+		return nil, fmt.Errorf("multipath.mode must be failover or spray, not %q", mode)
+	}
+
+	if mp.maxPaths < 2 {
+		return nil, errors.New("multipath.max_paths must be at least 2")
+	}
+	if mp.probeInterval <= 0 {
+		return nil, errors.New("multipath.probe_interval must be greater than 0")
+	}
+	if mp.deadAfter <= mp.probeInterval {
+		return nil, errors.New("multipath.dead_after must be greater than multipath.probe_interval")
+	}
+
+	return mp, nil
+}
+
+// Start probes the paths of every tunnel until ctx is done. This is a non blocking call.
+func (mp *multipath) Start(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(mp.probeInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				mp.probeAll()
+			}
+		}
+	}()
+}
+
+func (mp *multipath) probeAll() {
+	var hosts []*HostInfo
+	mp.f.hostMap.ForEachVpnIp(func(h *HostInfo) {
+		hosts = append(hosts, h)
+	})
+
+	now := time.Now()
+	nb := make([]byte, 12, 12)
+	out := make([]byte, mtu)
+	for _, h := range hosts {
+		mp.probe(h, now, nb, out)
+	}
+}
+
+// probe refreshes the paths of a tunnel, fails over from a dead path and sends the next round of probes
+func (mp *multipath) probe(h *HostInfo, now time.Time, nb, out []byte) {
+	remote := h.remote
+	if h.ConnectionState == nil || remote == nil || h.remotes == nil {
+		// Relayed tunnels have a single path, through the relay
+		return
+	}
+
+	paths := mp.refresh(h, remote, now)
+	mp.failover(h, remote, paths, now)
+
+	for _, p := range paths.paths {
+		mp.f.sendTo(header.Test, header.TestRequest, h.ConnectionState, h, p.addr, marshalPathProbe(p.addr), nb, out)
+	}
+}
+
+// failover moves the tunnel to the first alive path when the current one is dead
+func (mp *multipath) failover(h *HostInfo, remote *udp.Addr, paths *multipathPaths, now time.Time) {
+	current := paths.find(remote)
+	if current == nil || !current.dead(now, mp.deadAfter) {
+		return
+	}
+
+	for _, p := range paths.paths {
+		if p.alive(now, mp.deadAfter) {
+			h.logger(mp.l).WithField("udpAddr", remote).WithField("newAddr", p.addr).
+				Info("Multipath path stopped answering, failing over")
+			mp.metricFailover.Inc(1)
+			h.lastRoam = now
+			h.lastRoamRemote = remote
+			h.SetRemote(p.addr)
+			return
+		}
+	}
+}
+
+// refresh replaces the paths of a tunnel with its current remote and the best of its other remotes, keeping what we
+// know about the paths we already had
+func (mp *multipath) refresh(h *HostInfo, remote *udp.Addr, now time.Time) *multipathPaths {
+	old := h.multipath.Load()
+	if old == nil {
+		old = &multipathPaths{}
+	}
+
+	next := &multipathPaths{}
+	add := func(addr *udp.Addr) {
+		if len(next.paths) >= mp.maxPaths || next.find(addr) != nil {
+			return
+		}
+
+		p := old.find(addr)
+		if p == nil {
+			p = &multipathPath{addr: addr.Copy(), added: now}
+		}
+		next.paths = append(next.paths, p)
+	}
+
+	add(remote)
+	for _, addr := range h.remotes.CopyAddrs(mp.f.hostMap.GetPreferredRangesFor(h)) {
+		add(addr)
+	}
+
+	if mp.spray {
+		for _, p := range next.paths {
+			if p.alive(now, mp.deadAfter) {
+				next.spray = append(next.spray, p.addr)
+			}
+		}
+	}
+
+	h.multipath.Store(next)
+	return next
+}
+
+// sendRemote is where the next packet to the host goes, the current remote unless traffic is sprayed over its paths
+func (h *HostInfo) sendRemote() *udp.Addr {
+	if mp := h.multipath.Load(); mp != nil && len(mp.spray) > 1 {
+		return mp.spray[mp.next.Add(1)%uint32(len(mp.spray))]
+	}
+	return h.remote
+}
@@ -0,0 +1,106 @@
+package nebula
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/iputil"
+	"github.com/slackhq/nebula/test"
+	"github.com/slackhq/nebula/udp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewMultipathFromConfig(t *testing.T) {
+	l := test.NewLogger()
+	c := config.NewC(l)
+
+	mp, err := newMultipathFromConfig(l, nil, c)
+	require.NoError(t, err)
+	assert.Nil(t, mp)
+
+	c.Settings["multipath"] = map[interface{}]interface{}{"enabled": true}
+	mp, err = newMultipathFromConfig(l, nil, c)
+	require.NoError(t, err)
+	assert.False(t, mp.spray)
+	assert.Equal(t, defaultMultipathMaxPaths, mp.maxPaths)
+	assert.Equal(t, defaultMultipathProbeInterval, mp.probeInterval)
+	assert.Equal(t, defaultMultipathDeadAfter, mp.deadAfter)
+
+	c.Settings["multipath"] = map[interface{}]interface{}{"enabled": true, "mode": "spray"}
+	mp, err = newMultipathFromConfig(l, nil, c)
+	require.NoError(t, err)
+	assert.True(t, mp.spray)
+
+	for k, v := range map[string]interface{}{
+		"mode":           "bond",
+		"max_paths":      1,
+		"probe_interval": "0s",
+		"dead_after":     "5s",
+	} {
+		c.Settings["multipath"] = map[interface{}]interface{}{"enabled": true, k: v}
+		_, err = newMultipathFromConfig(l, nil, c)
+		assert.Error(t, err, k)
+	}
+}
+
+func TestMultipath(t *testing.T) {
+	l := test.NewLogger()
+	c := config.NewC(l)
+	vpnIp := iputil.Ip2VpnIp(net.IP{10, 128, 0, 2})
+
+	a := udp.NewAddr(net.IP{1, 0, 0, 1}, 4242)
+	b := udp.NewAddr(net.IP{2, 0, 0, 1}, 4242)
+	other := udp.NewAddr(net.IP{3, 0, 0, 1}, 4242)
+
+	remotes := NewRemoteList(nil)
+	remotes.unlockedPrependV4(vpnIp, NewIp4AndPort(a.IP, uint32(a.Port)))
+	remotes.unlockedPrependV4(vpnIp, NewIp4AndPort(b.IP, uint32(b.Port)))
+	remotes.unlockedPrependV4(vpnIp, NewIp4AndPort(other.IP, uint32(other.Port)))
+
+	h := &HostInfo{vpnIp: vpnIp, remote: a, remotes: remotes, ConnectionState: &ConnectionState{}}
+	f := &Interface{l: l, hostMap: NewHostMapFromConfig(l, &net.IPNet{IP: net.IP{10, 128, 0, 1}, Mask: net.IPMask{255, 255, 255, 0}}, c)}
+	mp := &multipath{l: l, f: f, maxPaths: 2, probeInterval: time.Second, deadAfter: 3 * time.Second, metricFailover: metrics.NilCounter{}}
+
+	// The current remote is always a path
+	now := time.Now()
+	paths := mp.refresh(h, a, now)
+	require.Len(t, paths.paths, 2)
+	assert.Equal(t, a, paths.paths[0].addr)
+	assert.Equal(t, b, paths.paths[1].addr)
+
+	// Only b answers
+	assert.False(t, f.handlePathProbeReply(h, []byte("")))
+	assert.True(t, f.handlePathProbeReply(h, marshalPathProbe(b)))
+	assert.True(t, paths.paths[1].alive(time.Now(), mp.deadAfter))
+	assert.False(t, paths.paths[0].alive(time.Now(), mp.deadAfter))
+
+	// A path that has not had dead_after to answer is not dead yet
+	mp.failover(h, a, paths, now)
+	assert.Equal(t, a, h.remote)
+
+	// What we knew is kept
+	later := now.Add(mp.deadAfter)
+	paths = mp.refresh(h, a, later)
+	assert.True(t, paths.find(b).alive(time.Now(), mp.deadAfter))
+
+	mp.failover(h, a, paths, later)
+	assert.Equal(t, b, h.remote)
+	assert.Equal(t, a, h.lastRoamRemote)
+
+	// Without spray traffic goes to the remote
+	assert.Equal(t, b, h.sendRemote())
+	assert.Equal(t, b, h.sendRemote())
+
+	// Spray alternates over the alive paths
+	mp.spray = true
+	assert.True(t, f.handlePathProbeReply(h, marshalPathProbe(a)))
+	mp.refresh(h, b, time.Now())
+	first, second := h.sendRemote(), h.sendRemote()
+	assert.NotEqual(t, first, second)
+	assert.ElementsMatch(t, []*udp.Addr{a, b}, []*udp.Addr{first, second})
+	assert.Equal(t, first, h.sendRemote())
+}
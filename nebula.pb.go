@@ -36,6 +36,18 @@ const (
 	NebulaMeta_PathCheck                 NebulaMeta_MessageType = 8
 	NebulaMeta_PathCheckReply            NebulaMeta_MessageType = 9
 	NebulaMeta_HostUpdateNotificationAck NebulaMeta_MessageType = 10
+	// HostSyncRequest asks another lighthouse for everything it learned from hosts, see lighthouse_sync.go
+	NebulaMeta_HostSyncRequest NebulaMeta_MessageType = 11
+	// HostSyncNotification shares what a lighthouse learned from one host with another lighthouse
+	NebulaMeta_HostSyncNotification NebulaMeta_MessageType = 12
+	// RelayQuery asks a lighthouse for the relays advertising themselves, see lighthouse_relays.go
+	NebulaMeta_RelayQuery NebulaMeta_MessageType = 13
+	// RelayQueryReply describes one advertised relay, a query is answered with one per relay
+	NebulaMeta_RelayQueryReply NebulaMeta_MessageType = 14
+	// RouteQuery asks a lighthouse for the unsafe networks gateways advertise, see lighthouse_routes.go
+	NebulaMeta_RouteQuery NebulaMeta_MessageType = 15
+	// RouteQueryReply describes the networks one gateway advertises, a query is answered with one per gateway
+	NebulaMeta_RouteQueryReply NebulaMeta_MessageType = 16
 )
 
 var NebulaMeta_MessageType_name = map[int32]string{
@@ -50,6 +62,12 @@ var NebulaMeta_MessageType_name = map[int32]string{
 	8:  "PathCheck",
 	9:  "PathCheckReply",
 	10: "HostUpdateNotificationAck",
+	11: "HostSyncRequest",
+	12: "HostSyncNotification",
+	13: "RelayQuery",
+	14: "RelayQueryReply",
+	15: "RouteQuery",
+	16: "RouteQueryReply",
 }
 
 var NebulaMeta_MessageType_value = map[string]int32{
@@ -64,6 +82,12 @@ var NebulaMeta_MessageType_value = map[string]int32{
 	"PathCheck":                 8,
 	"PathCheckReply":            9,
 	"HostUpdateNotificationAck": 10,
+	"HostSyncRequest":           11,
+	"HostSyncNotification":      12,
+	"RelayQuery":                13,
+	"RelayQueryReply":           14,
+	"RouteQuery":                15,
+	"RouteQueryReply":           16,
 }
 
 func (x NebulaMeta_MessageType) String() string {
@@ -96,7 +120,7 @@ func (x NebulaPing_MessageType) String() string {
 }
 
 func (NebulaPing_MessageType) EnumDescriptor() ([]byte, []int) {
-	return fileDescriptor_2d65afa7693df5ef, []int{4, 0}
+	return fileDescriptor_2d65afa7693df5ef, []int{6, 0}
 }
 
 type NebulaControl_MessageType int32
@@ -124,7 +148,7 @@ func (x NebulaControl_MessageType) String() string {
 }
 
 func (NebulaControl_MessageType) EnumDescriptor() ([]byte, []int) {
-	return fileDescriptor_2d65afa7693df5ef, []int{7, 0}
+	return fileDescriptor_2d65afa7693df5ef, []int{9, 0}
 }
 
 type NebulaMeta struct {
@@ -185,6 +209,23 @@ type NebulaMetaDetails struct {
 	Ip6AndPorts []*Ip6AndPort `protobuf:"bytes,4,rep,name=Ip6AndPorts,proto3" json:"Ip6AndPorts,omitempty"`
 	RelayVpnIp  []uint32      `protobuf:"varint,5,rep,packed,name=RelayVpnIp,proto3" json:"RelayVpnIp,omitempty"`
 	Counter     uint32        `protobuf:"varint,3,opt,name=counter,proto3" json:"counter,omitempty"`
+	// Time is when a host update was sent, in unix nanoseconds. It is only informational, updates are not ordered by it
+	Time uint64 `protobuf:"varint,6,opt,name=Time,proto3" json:"Time,omitempty"`
+	// Signature authenticates a host update for the senders certificate, see lighthouse_auth.go
+	Signature []byte `protobuf:"bytes,7,opt,name=Signature,proto3" json:"Signature,omitempty"`
+	// Stale is set on a query reply when the host has not updated the lighthouse within lighthouse.stale_after
+	Stale bool `protobuf:"varint,8,opt,name=Stale,proto3" json:"Stale,omitempty"`
+	// RelayCapacity is set by a relay advertising itself through a host update, and on relay query replies. It is a hint
+	// of how many relayed peers the relay wants to carry
+	RelayCapacity uint32 `protobuf:"varint,9,opt,name=RelayCapacity,proto3" json:"RelayCapacity,omitempty"`
+	// RelayLoad is how many relay indexes the advertising relay has in use
+	RelayLoad uint32 `protobuf:"varint,10,opt,name=RelayLoad,proto3" json:"RelayLoad,omitempty"`
+	// VpnAddr is set in place of VpnIp when the address is ipv6
+	VpnAddr *Addr `protobuf:"bytes,11,opt,name=VpnAddr,proto3" json:"VpnAddr,omitempty"`
+	// RelayVpnAddrs are the ipv6 relays, ipv4 relays stay in RelayVpnIp
+	RelayVpnAddrs []*Addr `protobuf:"bytes,12,rep,name=RelayVpnAddrs,proto3" json:"RelayVpnAddrs,omitempty"`
+	// Routes are the unsafe networks a gateway advertises through a host update, and on route query replies
+	Routes []*UnsafeRoute `protobuf:"bytes,13,rep,name=Routes,proto3" json:"Routes,omitempty"`
 }
 
 func (m *NebulaMetaDetails) Reset()         { *m = NebulaMetaDetails{} }
@@ -255,6 +296,177 @@ func (m *NebulaMetaDetails) GetCounter() uint32 {
 	return 0
 }
 
+func (m *NebulaMetaDetails) GetTime() uint64 {
+	if m != nil {
+		return m.Time
+	}
+	return 0
+}
+
+func (m *NebulaMetaDetails) GetSignature() []byte {
+	if m != nil {
+		return m.Signature
+	}
+	return nil
+}
+
+func (m *NebulaMetaDetails) GetStale() bool {
+	if m != nil {
+		return m.Stale
+	}
+	return false
+}
+
+func (m *NebulaMetaDetails) GetRelayCapacity() uint32 {
+	if m != nil {
+		return m.RelayCapacity
+	}
+	return 0
+}
+
+func (m *NebulaMetaDetails) GetRelayLoad() uint32 {
+	if m != nil {
+		return m.RelayLoad
+	}
+	return 0
+}
+
+func (m *NebulaMetaDetails) GetVpnAddr() *Addr {
+	if m != nil {
+		return m.VpnAddr
+	}
+	return nil
+}
+
+func (m *NebulaMetaDetails) GetRelayVpnAddrs() []*Addr {
+	if m != nil {
+		return m.RelayVpnAddrs
+	}
+	return nil
+}
+
+func (m *NebulaMetaDetails) GetRoutes() []*UnsafeRoute {
+	if m != nil {
+		return m.Routes
+	}
+	return nil
+}
+
+// UnsafeRoute is an unsafe network served by a gateway, Ip is 4 bytes for ipv4 and 16 for ipv6
+type UnsafeRoute struct {
+	Ip   []byte `protobuf:"bytes,1,opt,name=Ip,proto3" json:"Ip,omitempty"`
+	Bits uint32 `protobuf:"varint,2,opt,name=Bits,proto3" json:"Bits,omitempty"`
+	// Metric orders gateways serving the same network, the lowest is used
+	Metric uint32 `protobuf:"varint,3,opt,name=Metric,proto3" json:"Metric,omitempty"`
+}
+
+func (m *UnsafeRoute) Reset()         { *m = UnsafeRoute{} }
+func (m *UnsafeRoute) String() string { return proto.CompactTextString(m) }
+func (*UnsafeRoute) ProtoMessage()    {}
+func (*UnsafeRoute) Descriptor() ([]byte, []int) {
+	return fileDescriptor_2d65afa7693df5ef, []int{2}
+}
+func (m *UnsafeRoute) XXX_Unmarshal(b []byte) error {
+	return m.Unmarshal(b)
+}
+func (m *UnsafeRoute) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	if deterministic {
+		return xxx_messageInfo_UnsafeRoute.Marshal(b, m, deterministic)
+	} else {
+		b = b[:cap(b)]
+		n, err := m.MarshalToSizedBuffer(b)
+		if err != nil {
+			return nil, err
+		}
+		return b[:n], nil
+	}
+}
+func (m *UnsafeRoute) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_UnsafeRoute.Merge(m, src)
+}
+func (m *UnsafeRoute) XXX_Size() int {
+	return m.Size()
+}
+func (m *UnsafeRoute) XXX_DiscardUnknown() {
+	xxx_messageInfo_UnsafeRoute.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_UnsafeRoute proto.InternalMessageInfo
+
+func (m *UnsafeRoute) GetIp() []byte {
+	if m != nil {
+		return m.Ip
+	}
+	return nil
+}
+
+func (m *UnsafeRoute) GetBits() uint32 {
+	if m != nil {
+		return m.Bits
+	}
+	return 0
+}
+
+func (m *UnsafeRoute) GetMetric() uint32 {
+	if m != nil {
+		return m.Metric
+	}
+	return 0
+}
+
+// Addr is an ipv6 overlay address
+type Addr struct {
+	Hi uint64 `protobuf:"varint,1,opt,name=Hi,proto3" json:"Hi,omitempty"`
+	Lo uint64 `protobuf:"varint,2,opt,name=Lo,proto3" json:"Lo,omitempty"`
+}
+
+func (m *Addr) Reset()         { *m = Addr{} }
+func (m *Addr) String() string { return proto.CompactTextString(m) }
+func (*Addr) ProtoMessage()    {}
+func (*Addr) Descriptor() ([]byte, []int) {
+	return fileDescriptor_2d65afa7693df5ef, []int{3}
+}
+func (m *Addr) XXX_Unmarshal(b []byte) error {
+	return m.Unmarshal(b)
+}
+func (m *Addr) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	if deterministic {
+		return xxx_messageInfo_Addr.Marshal(b, m, deterministic)
+	} else {
+		b = b[:cap(b)]
+		n, err := m.MarshalToSizedBuffer(b)
+		if err != nil {
+			return nil, err
+		}
+		return b[:n], nil
+	}
+}
+func (m *Addr) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_Addr.Merge(m, src)
+}
+func (m *Addr) XXX_Size() int {
+	return m.Size()
+}
+func (m *Addr) XXX_DiscardUnknown() {
+	xxx_messageInfo_Addr.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_Addr proto.InternalMessageInfo
+
+func (m *Addr) GetHi() uint64 {
+	if m != nil {
+		return m.Hi
+	}
+	return 0
+}
+
+func (m *Addr) GetLo() uint64 {
+	if m != nil {
+		return m.Lo
+	}
+	return 0
+}
+
 type Ip4AndPort struct {
 	Ip   uint32 `protobuf:"varint,1,opt,name=Ip,proto3" json:"Ip,omitempty"`
 	Port uint32 `protobuf:"varint,2,opt,name=Port,proto3" json:"Port,omitempty"`
@@ -264,7 +476,7 @@ func (m *Ip4AndPort) Reset()         { *m = Ip4AndPort{} }
 func (m *Ip4AndPort) String() string { return proto.CompactTextString(m) }
 func (*Ip4AndPort) ProtoMessage()    {}
 func (*Ip4AndPort) Descriptor() ([]byte, []int) {
-	return fileDescriptor_2d65afa7693df5ef, []int{2}
+	return fileDescriptor_2d65afa7693df5ef, []int{4}
 }
 func (m *Ip4AndPort) XXX_Unmarshal(b []byte) error {
 	return m.Unmarshal(b)
@@ -317,7 +529,7 @@ func (m *Ip6AndPort) Reset()         { *m = Ip6AndPort{} }
 func (m *Ip6AndPort) String() string { return proto.CompactTextString(m) }
 func (*Ip6AndPort) ProtoMessage()    {}
 func (*Ip6AndPort) Descriptor() ([]byte, []int) {
-	return fileDescriptor_2d65afa7693df5ef, []int{3}
+	return fileDescriptor_2d65afa7693df5ef, []int{5}
 }
 func (m *Ip6AndPort) XXX_Unmarshal(b []byte) error {
 	return m.Unmarshal(b)
@@ -376,7 +588,7 @@ func (m *NebulaPing) Reset()         { *m = NebulaPing{} }
 func (m *NebulaPing) String() string { return proto.CompactTextString(m) }
 func (*NebulaPing) ProtoMessage()    {}
 func (*NebulaPing) Descriptor() ([]byte, []int) {
-	return fileDescriptor_2d65afa7693df5ef, []int{4}
+	return fileDescriptor_2d65afa7693df5ef, []int{6}
 }
 func (m *NebulaPing) XXX_Unmarshal(b []byte) error {
 	return m.Unmarshal(b)
@@ -428,7 +640,7 @@ func (m *NebulaHandshake) Reset()         { *m = NebulaHandshake{} }
 func (m *NebulaHandshake) String() string { return proto.CompactTextString(m) }
 func (*NebulaHandshake) ProtoMessage()    {}
 func (*NebulaHandshake) Descriptor() ([]byte, []int) {
-	return fileDescriptor_2d65afa7693df5ef, []int{5}
+	return fileDescriptor_2d65afa7693df5ef, []int{7}
 }
 func (m *NebulaHandshake) XXX_Unmarshal(b []byte) error {
 	return m.Unmarshal(b)
@@ -477,13 +689,31 @@ type NebulaHandshakeDetails struct {
 	ResponderIndex uint32 `protobuf:"varint,3,opt,name=ResponderIndex,proto3" json:"ResponderIndex,omitempty"`
 	Cookie         uint64 `protobuf:"varint,4,opt,name=Cookie,proto3" json:"Cookie,omitempty"`
 	Time           uint64 `protobuf:"varint,5,opt,name=Time,proto3" json:"Time,omitempty"`
+	// Capabilities is the sorted set of optional features the sender supports
+	Capabilities []string `protobuf:"bytes,8,rep,name=Capabilities,proto3" json:"Capabilities,omitempty"`
+	// CapabilitiesDigest is set by the responder and binds both advertised capability sets together, see handshake_capabilities.go
+	CapabilitiesDigest []byte `protobuf:"bytes,9,opt,name=CapabilitiesDigest,proto3" json:"CapabilitiesDigest,omitempty"`
+	// HandshakeCipher is the noise cipher the initiator used for this handshake, see handshake_ciphers.go
+	HandshakeCipher string `protobuf:"bytes,10,opt,name=HandshakeCipher,proto3" json:"HandshakeCipher,omitempty"`
+	// Ciphers are the tunnel ciphers the initiator offers, most preferred first
+	Ciphers []string `protobuf:"bytes,11,rep,name=Ciphers,proto3" json:"Ciphers,omitempty"`
+	// Cipher is the tunnel cipher the responder chose from Ciphers
+	Cipher string `protobuf:"bytes,12,opt,name=Cipher,proto3" json:"Cipher,omitempty"`
+	// CipherPskId identifies the pre-shared key the sender would use with a psk cipher
+	CipherPskId []byte `protobuf:"bytes,13,opt,name=CipherPskId,proto3" json:"CipherPskId,omitempty"`
+	// KemPublicKey is the initiators ML-KEM-768 encapsulation key when it wants a hybrid key exchange
+	KemPublicKey []byte `protobuf:"bytes,14,opt,name=KemPublicKey,proto3" json:"KemPublicKey,omitempty"`
+	// KemCiphertext is the responders encapsulation to KemPublicKey
+	KemCiphertext []byte `protobuf:"bytes,15,opt,name=KemCiphertext,proto3" json:"KemCiphertext,omitempty"`
+	// TrustedCAs are the fingerprints of the CAs the sender trusts, sent when it has more than one certificate to choose from
+	TrustedCAs []string `protobuf:"bytes,16,rep,name=TrustedCAs,proto3" json:"TrustedCAs,omitempty"`
 }
 
 func (m *NebulaHandshakeDetails) Reset()         { *m = NebulaHandshakeDetails{} }
 func (m *NebulaHandshakeDetails) String() string { return proto.CompactTextString(m) }
 func (*NebulaHandshakeDetails) ProtoMessage()    {}
 func (*NebulaHandshakeDetails) Descriptor() ([]byte, []int) {
-	return fileDescriptor_2d65afa7693df5ef, []int{6}
+	return fileDescriptor_2d65afa7693df5ef, []int{8}
 }
 func (m *NebulaHandshakeDetails) XXX_Unmarshal(b []byte) error {
 	return m.Unmarshal(b)
@@ -547,19 +777,85 @@ func (m *NebulaHandshakeDetails) GetTime() uint64 {
 	return 0
 }
 
+func (m *NebulaHandshakeDetails) GetCapabilities() []string {
+	if m != nil {
+		return m.Capabilities
+	}
+	return nil
+}
+
+func (m *NebulaHandshakeDetails) GetCapabilitiesDigest() []byte {
+	if m != nil {
+		return m.CapabilitiesDigest
+	}
+	return nil
+}
+
+func (m *NebulaHandshakeDetails) GetHandshakeCipher() string {
+	if m != nil {
+		return m.HandshakeCipher
+	}
+	return ""
+}
+
+func (m *NebulaHandshakeDetails) GetCiphers() []string {
+	if m != nil {
+		return m.Ciphers
+	}
+	return nil
+}
+
+func (m *NebulaHandshakeDetails) GetCipher() string {
+	if m != nil {
+		return m.Cipher
+	}
+	return ""
+}
+
+func (m *NebulaHandshakeDetails) GetCipherPskId() []byte {
+	if m != nil {
+		return m.CipherPskId
+	}
+	return nil
+}
+
+func (m *NebulaHandshakeDetails) GetKemPublicKey() []byte {
+	if m != nil {
+		return m.KemPublicKey
+	}
+	return nil
+}
+
+func (m *NebulaHandshakeDetails) GetKemCiphertext() []byte {
+	if m != nil {
+		return m.KemCiphertext
+	}
+	return nil
+}
+
+func (m *NebulaHandshakeDetails) GetTrustedCAs() []string {
+	if m != nil {
+		return m.TrustedCAs
+	}
+	return nil
+}
+
 type NebulaControl struct {
 	Type                NebulaControl_MessageType `protobuf:"varint,1,opt,name=Type,proto3,enum=nebula.NebulaControl_MessageType" json:"Type,omitempty"`
 	InitiatorRelayIndex uint32                    `protobuf:"varint,2,opt,name=InitiatorRelayIndex,proto3" json:"InitiatorRelayIndex,omitempty"`
 	ResponderRelayIndex uint32                    `protobuf:"varint,3,opt,name=ResponderRelayIndex,proto3" json:"ResponderRelayIndex,omitempty"`
 	RelayToIp           uint32                    `protobuf:"varint,4,opt,name=RelayToIp,proto3" json:"RelayToIp,omitempty"`
 	RelayFromIp         uint32                    `protobuf:"varint,5,opt,name=RelayFromIp,proto3" json:"RelayFromIp,omitempty"`
+	// RelayToAddr and RelayFromAddr are set in place of RelayToIp and RelayFromIp when the address is ipv6
+	RelayToAddr   *Addr `protobuf:"bytes,6,opt,name=RelayToAddr,proto3" json:"RelayToAddr,omitempty"`
+	RelayFromAddr *Addr `protobuf:"bytes,7,opt,name=RelayFromAddr,proto3" json:"RelayFromAddr,omitempty"`
 }
 
 func (m *NebulaControl) Reset()         { *m = NebulaControl{} }
 func (m *NebulaControl) String() string { return proto.CompactTextString(m) }
 func (*NebulaControl) ProtoMessage()    {}
 func (*NebulaControl) Descriptor() ([]byte, []int) {
-	return fileDescriptor_2d65afa7693df5ef, []int{7}
+	return fileDescriptor_2d65afa7693df5ef, []int{9}
 }
 func (m *NebulaControl) XXX_Unmarshal(b []byte) error {
 	return m.Unmarshal(b)
@@ -623,12 +919,28 @@ func (m *NebulaControl) GetRelayFromIp() uint32 {
 	return 0
 }
 
+func (m *NebulaControl) GetRelayToAddr() *Addr {
+	if m != nil {
+		return m.RelayToAddr
+	}
+	return nil
+}
+
+func (m *NebulaControl) GetRelayFromAddr() *Addr {
+	if m != nil {
+		return m.RelayFromAddr
+	}
+	return nil
+}
+
 func init() {
 	proto.RegisterEnum("nebula.NebulaMeta_MessageType", NebulaMeta_MessageType_name, NebulaMeta_MessageType_value)
 	proto.RegisterEnum("nebula.NebulaPing_MessageType", NebulaPing_MessageType_name, NebulaPing_MessageType_value)
 	proto.RegisterEnum("nebula.NebulaControl_MessageType", NebulaControl_MessageType_name, NebulaControl_MessageType_value)
 	proto.RegisterType((*NebulaMeta)(nil), "nebula.NebulaMeta")
 	proto.RegisterType((*NebulaMetaDetails)(nil), "nebula.NebulaMetaDetails")
+	proto.RegisterType((*UnsafeRoute)(nil), "nebula.UnsafeRoute")
+	proto.RegisterType((*Addr)(nil), "nebula.Addr")
 	proto.RegisterType((*Ip4AndPort)(nil), "nebula.Ip4AndPort")
 	proto.RegisterType((*Ip6AndPort)(nil), "nebula.Ip6AndPort")
 	proto.RegisterType((*NebulaPing)(nil), "nebula.NebulaPing")
@@ -640,52 +952,73 @@ func init() {
 func init() { proto.RegisterFile("nebula.proto", fileDescriptor_2d65afa7693df5ef) }
 
 var fileDescriptor_2d65afa7693df5ef = []byte{
-	// 707 bytes of a gzipped FileDescriptorProto
-	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x7c, 0x54, 0x4d, 0x6f, 0xda, 0x4a,
-	0x14, 0xc5, 0xc6, 0x7c, 0x5d, 0x02, 0xf1, 0xbb, 0x79, 0x8f, 0x07, 0x4f, 0xaf, 0x16, 0xf5, 0xa2,
-	0x62, 0x45, 0x22, 0x92, 0x46, 0x5d, 0x36, 0xa5, 0xaa, 0x20, 0x4a, 0x22, 0x3a, 0x4a, 0x5b, 0xa9,
-	0x9b, 0x6a, 0x62, 0xa6, 0xc1, 0x02, 0x3c, 0x8e, 0x3d, 0x54, 0xe1, 0x5f, 0xf4, 0xc7, 0xe4, 0x47,
-	0x74, 0xd7, 0x2c, 0xbb, 0xac, 0x92, 0x65, 0x97, 0xfd, 0x03, 0xd5, 0x8c, 0xc1, 0x36, 0x84, 0x76,
-	0x37, 0xe7, 0xde, 0x73, 0x66, 0xce, 0x9c, 0xb9, 0x36, 0x6c, 0x79, 0xec, 0x62, 0x36, 0xa1, 0x6d,
-	0x3f, 0xe0, 0x82, 0x63, 0x3e, 0x42, 0xf6, 0x0f, 0x1d, 0xe0, 0x4c, 0x2d, 0x4f, 0x99, 0xa0, 0xd8,
-	0x01, 0xe3, 0x7c, 0xee, 0xb3, 0xba, 0xd6, 0xd4, 0x5a, 0xd5, 0x8e, 0xd5, 0x5e, 0x68, 0x12, 0x46,
-	0xfb, 0x94, 0x85, 0x21, 0xbd, 0x64, 0x92, 0x45, 0x14, 0x17, 0xf7, 0xa1, 0xf0, 0x92, 0x09, 0xea,
-	0x4e, 0xc2, 0xba, 0xde, 0xd4, 0x5a, 0xe5, 0x4e, 0xe3, 0xa1, 0x6c, 0x41, 0x20, 0x4b, 0xa6, 0xfd,
-	0x53, 0x83, 0x72, 0x6a, 0x2b, 0x2c, 0x82, 0x71, 0xc6, 0x3d, 0x66, 0x66, 0xb0, 0x02, 0xa5, 0x1e,
-	0x0f, 0xc5, 0xeb, 0x19, 0x0b, 0xe6, 0xa6, 0x86, 0x08, 0xd5, 0x18, 0x12, 0xe6, 0x4f, 0xe6, 0xa6,
-	0x8e, 0xff, 0x41, 0x4d, 0xd6, 0xde, 0xf8, 0x43, 0x2a, 0xd8, 0x19, 0x17, 0xee, 0x47, 0xd7, 0xa1,
-	0xc2, 0xe5, 0x9e, 0x99, 0xc5, 0x06, 0xfc, 0x23, 0x7b, 0xa7, 0xfc, 0x13, 0x1b, 0xae, 0xb4, 0x8c,
-	0x65, 0x6b, 0x30, 0xf3, 0x9c, 0xd1, 0x4a, 0x2b, 0x87, 0x55, 0x00, 0xd9, 0x7a, 0x37, 0xe2, 0x74,
-	0xea, 0x9a, 0x79, 0xdc, 0x81, 0xed, 0x04, 0x47, 0xc7, 0x16, 0xa4, 0xb3, 0x01, 0x15, 0xa3, 0xee,
-	0x88, 0x39, 0x63, 0xb3, 0x28, 0x9d, 0xc5, 0x30, 0xa2, 0x94, 0xf0, 0x11, 0x34, 0x36, 0x3b, 0x3b,
-	0x72, 0xc6, 0x26, 0xd8, 0x5f, 0x35, 0xf8, 0xeb, 0x41, 0x28, 0xf8, 0x37, 0xe4, 0xde, 0xfa, 0x5e,
-	0xdf, 0x57, 0xa9, 0x57, 0x48, 0x04, 0xf0, 0x00, 0xca, 0x7d, 0xff, 0xe0, 0xc8, 0x1b, 0x0e, 0x78,
-	0x20, 0x64, 0xb4, 0xd9, 0x56, 0xb9, 0x83, 0xcb, 0x68, 0x93, 0x16, 0x49, 0xd3, 0x22, 0xd5, 0x61,
-	0xac, 0x32, 0xd6, 0x55, 0x87, 0x29, 0x55, 0x4c, 0x43, 0x0b, 0x80, 0xb0, 0x09, 0x9d, 0x47, 0x36,
-	0x72, 0xcd, 0x6c, 0xab, 0x42, 0x52, 0x15, 0xac, 0x43, 0xc1, 0xe1, 0x33, 0x4f, 0xb0, 0xa0, 0x9e,
-	0x55, 0x1e, 0x97, 0xd0, 0xde, 0x03, 0x48, 0x8e, 0xc7, 0x2a, 0xe8, 0xf1, 0x35, 0xf4, 0xbe, 0x8f,
-	0x08, 0x86, 0xac, 0xab, 0xb9, 0xa8, 0x10, 0xb5, 0xb6, 0x9f, 0x4b, 0xc5, 0x61, 0x4a, 0xd1, 0x73,
-	0x95, 0xc2, 0x20, 0x7a, 0xcf, 0x95, 0xf8, 0x84, 0x2b, 0xbe, 0x41, 0xf4, 0x13, 0x1e, 0xef, 0x90,
-	0x4d, 0xed, 0x70, 0xbd, 0x1c, 0xd9, 0x81, 0xeb, 0x5d, 0xfe, 0x79, 0x64, 0x25, 0x63, 0xc3, 0xc8,
-	0x22, 0x18, 0xe7, 0xee, 0x94, 0x2d, 0xce, 0x51, 0x6b, 0xdb, 0x7e, 0x30, 0x90, 0x52, 0x6c, 0x66,
-	0xb0, 0x04, 0xb9, 0xe8, 0x79, 0x35, 0xfb, 0x03, 0x6c, 0x47, 0xfb, 0xf6, 0xa8, 0x37, 0x0c, 0x47,
-	0x74, 0xcc, 0xf0, 0x59, 0x32, 0xfd, 0x9a, 0x9a, 0xfe, 0x35, 0x07, 0x31, 0x73, 0xfd, 0x13, 0x90,
-	0x26, 0x7a, 0x53, 0xea, 0x28, 0x13, 0x5b, 0x44, 0xad, 0xed, 0x1b, 0x0d, 0x6a, 0x9b, 0x75, 0x92,
-	0xde, 0x65, 0x81, 0x50, 0xa7, 0x6c, 0x11, 0xb5, 0xc6, 0x27, 0x50, 0xed, 0x7b, 0xae, 0x70, 0xa9,
-	0xe0, 0x41, 0xdf, 0x1b, 0xb2, 0xeb, 0x45, 0xd2, 0x6b, 0x55, 0xc9, 0x23, 0x2c, 0xf4, 0xb9, 0x37,
-	0x64, 0x0b, 0x5e, 0x94, 0xe7, 0x5a, 0x15, 0x6b, 0x90, 0xef, 0x72, 0x3e, 0x76, 0x59, 0xdd, 0x50,
-	0xc9, 0x2c, 0x50, 0x9c, 0x57, 0x2e, 0xc9, 0xeb, 0xd8, 0x28, 0xe6, 0xcd, 0xc2, 0xb1, 0x51, 0x2c,
-	0x98, 0x45, 0xfb, 0x46, 0x87, 0x4a, 0x64, 0xbb, 0xcb, 0x3d, 0x11, 0xf0, 0x09, 0x3e, 0x5d, 0x79,
-	0x95, 0xc7, 0xab, 0x99, 0x2c, 0x48, 0x1b, 0x1e, 0x66, 0x0f, 0x76, 0x62, 0xeb, 0x6a, 0xfe, 0xd2,
-	0xb7, 0xda, 0xd4, 0x92, 0x8a, 0xf8, 0x12, 0x29, 0x45, 0x74, 0xbf, 0x4d, 0x2d, 0xfc, 0x1f, 0x4a,
-	0x0a, 0x9d, 0xf3, 0xbe, 0xaf, 0xee, 0x59, 0x21, 0x49, 0x01, 0x9b, 0x50, 0x56, 0xe0, 0x55, 0xc0,
-	0xa7, 0xea, 0x5b, 0x90, 0xfd, 0x74, 0xc9, 0xee, 0xfd, 0xee, 0xcf, 0x55, 0x03, 0xec, 0x06, 0x8c,
-	0x0a, 0xa6, 0xd8, 0x84, 0x5d, 0xcd, 0x58, 0x28, 0x4c, 0x0d, 0xff, 0x85, 0x9d, 0x95, 0xba, 0xb4,
-	0x14, 0x32, 0x53, 0x7f, 0xb1, 0xff, 0xe5, 0xce, 0xd2, 0x6e, 0xef, 0x2c, 0xed, 0xfb, 0x9d, 0xa5,
-	0x7d, 0xbe, 0xb7, 0x32, 0xb7, 0xf7, 0x56, 0xe6, 0xdb, 0xbd, 0x95, 0x79, 0xdf, 0xb8, 0x74, 0xc5,
-	0x68, 0x76, 0xd1, 0x76, 0xf8, 0x74, 0x37, 0x9c, 0x50, 0x67, 0x3c, 0xba, 0xda, 0x8d, 0x22, 0xbc,
-	0xc8, 0xab, 0x1f, 0xf8, 0xfe, 0xaf, 0x00, 0x00, 0x00, 0xff, 0xff, 0x17, 0x56, 0x28, 0x74, 0xd0,
-	0x05, 0x00, 0x00,
+	// 1051 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x84, 0x56, 0x4b, 0x6f, 0x23, 0x45,
+	0x10, 0xce, 0xd8, 0x13, 0x3f, 0xca, 0x8f, 0x0c, 0x9d, 0x25, 0x74, 0x10, 0x58, 0x66, 0x84, 0x22,
+	0x4b, 0x48, 0xde, 0x55, 0xb2, 0xac, 0x38, 0x92, 0xf5, 0x0a, 0xd9, 0x9b, 0x87, 0x4c, 0x27, 0xbb,
+	0x48, 0x5c, 0x50, 0x67, 0xa6, 0x37, 0x6e, 0xd9, 0x9e, 0x9e, 0x9d, 0x69, 0xa3, 0xf8, 0x5f, 0x70,
+	0xe4, 0x27, 0x71, 0xdc, 0x23, 0x47, 0x94, 0x70, 0xe4, 0xc0, 0x4f, 0x40, 0xdd, 0x3d, 0x4f, 0xc7,
+	0xc0, 0xad, 0xeb, 0xab, 0xef, 0xeb, 0xaa, 0xee, 0xaa, 0xae, 0x19, 0x68, 0x07, 0xec, 0x66, 0xb5,
+	0xa0, 0xc3, 0x30, 0x12, 0x52, 0xa0, 0x9a, 0xb1, 0xdc, 0x3f, 0xab, 0x00, 0x97, 0x7a, 0x79, 0xc1,
+	0x24, 0x45, 0xc7, 0x60, 0x5f, 0xaf, 0x43, 0x86, 0xad, 0xbe, 0x35, 0xe8, 0x1e, 0xf7, 0x86, 0x89,
+	0x26, 0x67, 0x0c, 0x2f, 0x58, 0x1c, 0xd3, 0x5b, 0xa6, 0x58, 0x44, 0x73, 0xd1, 0x09, 0xd4, 0x5f,
+	0x31, 0x49, 0xf9, 0x22, 0xc6, 0x95, 0xbe, 0x35, 0x68, 0x1d, 0x1f, 0x3e, 0x96, 0x25, 0x04, 0x92,
+	0x32, 0xdd, 0xbf, 0x2a, 0xd0, 0x2a, 0x6c, 0x85, 0x1a, 0x60, 0x5f, 0x8a, 0x80, 0x39, 0x3b, 0xa8,
+	0x03, 0xcd, 0xb1, 0x88, 0xe5, 0xf7, 0x2b, 0x16, 0xad, 0x1d, 0x0b, 0x21, 0xe8, 0x66, 0x26, 0x61,
+	0xe1, 0x62, 0xed, 0x54, 0xd0, 0xa7, 0x70, 0xa0, 0xb0, 0x37, 0xa1, 0x4f, 0x25, 0xbb, 0x14, 0x92,
+	0xbf, 0xe3, 0x1e, 0x95, 0x5c, 0x04, 0x4e, 0x15, 0x1d, 0xc2, 0xc7, 0xca, 0x77, 0x21, 0x7e, 0x66,
+	0x7e, 0xc9, 0x65, 0xa7, 0xae, 0xe9, 0x2a, 0xf0, 0x66, 0x25, 0xd7, 0x2e, 0xea, 0x02, 0x28, 0xd7,
+	0x0f, 0x33, 0x41, 0x97, 0xdc, 0xa9, 0xa1, 0x7d, 0xd8, 0xcb, 0x6d, 0x13, 0xb6, 0xae, 0x32, 0x9b,
+	0x52, 0x39, 0x1b, 0xcd, 0x98, 0x37, 0x77, 0x1a, 0x2a, 0xb3, 0xcc, 0x34, 0x94, 0x26, 0xfa, 0x1c,
+	0x0e, 0xb7, 0x67, 0x76, 0xea, 0xcd, 0x1d, 0x48, 0xb7, 0xbd, 0x5a, 0x07, 0x1e, 0x61, 0xef, 0x57,
+	0x2c, 0x96, 0x4e, 0x0b, 0x61, 0x78, 0x92, 0x82, 0xa5, 0xac, 0xda, 0x2a, 0x2b, 0xc2, 0x16, 0x74,
+	0x6d, 0xee, 0xa2, 0xa3, 0xe4, 0xb9, 0x6d, 0x42, 0x76, 0x35, 0x49, 0xac, 0x24, 0x33, 0xa4, 0x3d,
+	0x4d, 0xca, 0x6c, 0x43, 0x72, 0x54, 0x99, 0x3f, 0x7a, 0x54, 0x0d, 0xf4, 0x04, 0x76, 0xdf, 0x86,
+	0xc1, 0x24, 0xd4, 0xe5, 0xee, 0x10, 0x63, 0xa0, 0xe7, 0xd0, 0x9a, 0x84, 0xcf, 0x4f, 0x03, 0x7f,
+	0x2a, 0x22, 0xa9, 0x6a, 0x5a, 0x1d, 0xb4, 0x8e, 0x51, 0x5a, 0xd3, 0xdc, 0x45, 0x8a, 0x34, 0xa3,
+	0x7a, 0x91, 0xa9, 0xec, 0x4d, 0xd5, 0x8b, 0x82, 0x2a, 0xa3, 0xa1, 0x5e, 0x72, 0x42, 0x93, 0xc6,
+	0x6e, 0xbf, 0x3a, 0xe8, 0x90, 0x02, 0x82, 0x30, 0xd4, 0x3d, 0xb1, 0x0a, 0x24, 0x8b, 0x70, 0x55,
+	0xe7, 0x98, 0x9a, 0x08, 0x81, 0x7d, 0xcd, 0x97, 0x0c, 0xd7, 0xfa, 0xd6, 0xc0, 0x26, 0x7a, 0x8d,
+	0x3e, 0x83, 0xe6, 0x15, 0xbf, 0x0d, 0xa8, 0x5c, 0x45, 0x0c, 0xd7, 0xfb, 0xd6, 0xa0, 0x4d, 0x72,
+	0x40, 0x9d, 0xf6, 0x4a, 0xd2, 0x05, 0xc3, 0x8d, 0xbe, 0x35, 0x68, 0x10, 0x63, 0xa0, 0x2f, 0xa1,
+	0xa3, 0xe3, 0x8d, 0x68, 0x48, 0x3d, 0x2e, 0xd7, 0xb8, 0xa9, 0xe3, 0x94, 0x41, 0xb5, 0xb3, 0x06,
+	0xce, 0x05, 0xf5, 0x31, 0x68, 0x46, 0x0e, 0xa0, 0x23, 0xa8, 0xbf, 0x0d, 0x83, 0x53, 0xdf, 0x8f,
+	0x70, 0x4b, 0xbf, 0x80, 0x76, 0x7a, 0x6e, 0x85, 0x91, 0xd4, 0x89, 0x8e, 0x93, 0x58, 0x89, 0x1d,
+	0xe3, 0x76, 0xbf, 0xfa, 0x88, 0x5d, 0xa6, 0xa0, 0xaf, 0xa0, 0xa6, 0xcb, 0x19, 0xe3, 0x8e, 0x26,
+	0xef, 0xa7, 0xe4, 0x37, 0x41, 0x4c, 0xdf, 0x31, 0xed, 0x23, 0x09, 0xc5, 0x9d, 0x40, 0xab, 0x00,
+	0xa3, 0x2e, 0x54, 0x92, 0xe2, 0xb6, 0x49, 0x65, 0x12, 0xaa, 0x3b, 0x7b, 0xc9, 0xa5, 0x79, 0xa6,
+	0x1d, 0xa2, 0xd7, 0xe8, 0x00, 0x6a, 0x17, 0x4c, 0x46, 0xdc, 0x4b, 0x2e, 0x38, 0xb1, 0xdc, 0x23,
+	0xb0, 0x75, 0xce, 0x5d, 0xa8, 0x8c, 0xb9, 0xde, 0xc3, 0x26, 0x95, 0x31, 0x57, 0xf6, 0xb9, 0xd0,
+	0x3b, 0xd8, 0xa4, 0x72, 0x2e, 0xdc, 0x67, 0x00, 0x79, 0x1b, 0x14, 0x22, 0x76, 0xd2, 0x88, 0x0a,
+	0x4f, 0x23, 0xaa, 0xb5, 0xfb, 0x2d, 0x40, 0xde, 0x02, 0xff, 0xb7, 0x7f, 0xb6, 0x43, 0xb5, 0xb0,
+	0xc3, 0x5d, 0x3a, 0xb3, 0xa6, 0x3c, 0xb8, 0xfd, 0xef, 0x99, 0xa5, 0x18, 0x5b, 0x66, 0x56, 0xda,
+	0x3d, 0x95, 0xbc, 0x7b, 0x5c, 0xf7, 0xd1, 0x44, 0x52, 0x62, 0x67, 0x07, 0x35, 0x61, 0xd7, 0xbc,
+	0x23, 0xcb, 0xfd, 0x09, 0xf6, 0xcc, 0xbe, 0x63, 0x1a, 0xf8, 0xf1, 0x8c, 0xce, 0x19, 0xfa, 0x26,
+	0x1f, 0x7f, 0x96, 0x2e, 0xfe, 0x46, 0x06, 0x19, 0x73, 0x73, 0x06, 0xaa, 0x24, 0xc6, 0x4b, 0xea,
+	0xe9, 0x24, 0xda, 0x44, 0xaf, 0xdd, 0xbf, 0xab, 0x70, 0xb0, 0x5d, 0xa7, 0xe8, 0x23, 0x16, 0xc9,
+	0xa4, 0x9e, 0x7a, 0x8d, 0x8e, 0xa0, 0x3b, 0x09, 0xb8, 0xe4, 0x54, 0x8a, 0x68, 0x12, 0xf8, 0xec,
+	0x2e, 0xb9, 0xe9, 0x0d, 0x54, 0xf1, 0x08, 0x8b, 0x43, 0x11, 0xf8, 0x2c, 0xe1, 0x99, 0xfb, 0xdc,
+	0x40, 0x55, 0x37, 0x8c, 0x84, 0x98, 0x73, 0x86, 0x6d, 0x7d, 0x33, 0x89, 0x95, 0xdd, 0xd7, 0x6e,
+	0xe1, 0xb5, 0xb9, 0xd0, 0x56, 0xef, 0xe3, 0x86, 0x2f, 0xb8, 0xe4, 0x2c, 0xc6, 0x8d, 0x7e, 0x75,
+	0xd0, 0x24, 0x25, 0x0c, 0x0d, 0x01, 0x15, 0xed, 0x57, 0xfc, 0x96, 0xc5, 0x52, 0x3f, 0xb1, 0x36,
+	0xd9, 0xe2, 0x41, 0x03, 0xd8, 0xcb, 0xce, 0x3d, 0xe2, 0xe1, 0x8c, 0x45, 0xfa, 0xb5, 0x35, 0xc9,
+	0x26, 0xac, 0x26, 0x83, 0x59, 0xc5, 0xb8, 0xa5, 0x03, 0xa7, 0xa6, 0x3e, 0x83, 0x91, 0xb6, 0xb5,
+	0x34, 0xb1, 0x50, 0x1f, 0x5a, 0x66, 0x35, 0x8d, 0xe7, 0x13, 0x1f, 0x77, 0x74, 0x12, 0x45, 0x48,
+	0x9d, 0xe8, 0x8c, 0x2d, 0xa7, 0xab, 0x9b, 0x05, 0xf7, 0xce, 0xd8, 0x1a, 0x77, 0x35, 0xa5, 0x84,
+	0xa9, 0x79, 0x71, 0xc6, 0x96, 0x46, 0x25, 0xd9, 0x9d, 0xc4, 0x7b, 0x9a, 0x54, 0x06, 0xd5, 0x5c,
+	0xbb, 0x8e, 0x56, 0xb1, 0x64, 0xfe, 0xe8, 0x34, 0xc6, 0x8e, 0x4e, 0xb0, 0x80, 0xbc, 0xb6, 0x1b,
+	0x35, 0xa7, 0xfe, 0xda, 0x6e, 0xd4, 0x9d, 0x86, 0xfb, 0x6b, 0x15, 0x3a, 0xa6, 0xe4, 0x23, 0x11,
+	0xc8, 0x48, 0x2c, 0xd0, 0xd7, 0xa5, 0x8e, 0xfe, 0xa2, 0xdc, 0x4f, 0x09, 0x69, 0x4b, 0x53, 0x3f,
+	0x83, 0xfd, 0xac, 0xec, 0x7a, 0x88, 0x14, 0x3b, 0x62, 0x9b, 0x4b, 0x29, 0xb2, 0x06, 0x28, 0x28,
+	0x4c, 0x6f, 0x6c, 0x73, 0x65, 0x83, 0xf0, 0x5a, 0x4c, 0x42, 0x6c, 0x17, 0x06, 0xa1, 0x02, 0xd4,
+	0x15, 0x6b, 0xe3, 0xbb, 0x48, 0x2c, 0xf5, 0x3c, 0x57, 0xfe, 0x22, 0x84, 0x86, 0x09, 0xe3, 0x5a,
+	0xe8, 0x71, 0x59, 0xdb, 0x32, 0x2e, 0x8b, 0x84, 0x6c, 0x64, 0x2a, 0xb9, 0x56, 0xd4, 0xb7, 0x28,
+	0xca, 0x14, 0x77, 0xfc, 0x6f, 0xbf, 0x16, 0x07, 0x80, 0x46, 0x11, 0xa3, 0x92, 0x69, 0x7e, 0xfa,
+	0x05, 0xb6, 0xd0, 0x27, 0xb0, 0x5f, 0xc2, 0xd5, 0xb1, 0x63, 0xe6, 0x54, 0x5e, 0x9e, 0xfc, 0x76,
+	0xdf, 0xb3, 0x3e, 0xdc, 0xf7, 0xac, 0x3f, 0xee, 0x7b, 0xd6, 0x2f, 0x0f, 0xbd, 0x9d, 0x0f, 0x0f,
+	0xbd, 0x9d, 0xdf, 0x1f, 0x7a, 0x3b, 0x3f, 0x1e, 0xde, 0x72, 0x39, 0x5b, 0xdd, 0x0c, 0x3d, 0xb1,
+	0x7c, 0x1a, 0x2f, 0xa8, 0x37, 0x9f, 0xbd, 0x7f, 0x6a, 0x52, 0xba, 0xa9, 0xe9, 0x3f, 0xac, 0x93,
+	0x7f, 0x06, 0x00, 0xeb, 0x79, 0x89, 0x10, 0x71, 0x09, 0x00, 0x00,
 }
 
 func (m *NebulaMeta) Marshal() (dAtA []byte, err error) {
@@ -748,21 +1081,93 @@ func (m *NebulaMetaDetails) MarshalToSizedBuffer(dAtA []byte) (int, error) {
 	_ = i
 	var l int
 	_ = l
+	if len(m.Routes) > 0 {
+		for iNdEx := len(m.Routes) - 1; iNdEx >= 0; iNdEx-- {
+			{
+				size, err := m.Routes[iNdEx].MarshalToSizedBuffer(dAtA[:i])
+				if err != nil {
+					return 0, err
+				}
+				i -= size
+				i = encodeVarintNebula(dAtA, i, uint64(size))
+			}
+			i--
+			dAtA[i] = 0x6a
+		}
+	}
+	if len(m.RelayVpnAddrs) > 0 {
+		for iNdEx := len(m.RelayVpnAddrs) - 1; iNdEx >= 0; iNdEx-- {
+			{
+				size, err := m.RelayVpnAddrs[iNdEx].MarshalToSizedBuffer(dAtA[:i])
+				if err != nil {
+					return 0, err
+				}
+				i -= size
+				i = encodeVarintNebula(dAtA, i, uint64(size))
+			}
+			i--
+			dAtA[i] = 0x62
+		}
+	}
+	if m.VpnAddr != nil {
+		{
+			size, err := m.VpnAddr.MarshalToSizedBuffer(dAtA[:i])
+			if err != nil {
+				return 0, err
+			}
+			i -= size
+			i = encodeVarintNebula(dAtA, i, uint64(size))
+		}
+		i--
+		dAtA[i] = 0x5a
+	}
+	if m.RelayLoad != 0 {
+		i = encodeVarintNebula(dAtA, i, uint64(m.RelayLoad))
+		i--
+		dAtA[i] = 0x50
+	}
+	if m.RelayCapacity != 0 {
+		i = encodeVarintNebula(dAtA, i, uint64(m.RelayCapacity))
+		i--
+		dAtA[i] = 0x48
+	}
+	if m.Stale {
+		i--
+		if m.Stale {
+			dAtA[i] = 1
+		} else {
+			dAtA[i] = 0
+		}
+		i--
+		dAtA[i] = 0x40
+	}
+	if len(m.Signature) > 0 {
+		i -= len(m.Signature)
+		copy(dAtA[i:], m.Signature)
+		i = encodeVarintNebula(dAtA, i, uint64(len(m.Signature)))
+		i--
+		dAtA[i] = 0x3a
+	}
+	if m.Time != 0 {
+		i = encodeVarintNebula(dAtA, i, uint64(m.Time))
+		i--
+		dAtA[i] = 0x30
+	}
 	if len(m.RelayVpnIp) > 0 {
-		dAtA3 := make([]byte, len(m.RelayVpnIp)*10)
-		var j2 int
+		dAtA4 := make([]byte, len(m.RelayVpnIp)*10)
+		var j3 int
 		for _, num := range m.RelayVpnIp {
 			for num >= 1<<7 {
-				dAtA3[j2] = uint8(uint64(num)&0x7f | 0x80)
+				dAtA4[j3] = uint8(uint64(num)&0x7f | 0x80)
 				num >>= 7
-				j2++
+				j3++
 			}
-			dAtA3[j2] = uint8(num)
-			j2++
+			dAtA4[j3] = uint8(num)
+			j3++
 		}
-		i -= j2
-		copy(dAtA[i:], dAtA3[:j2])
-		i = encodeVarintNebula(dAtA, i, uint64(j2))
+		i -= j3
+		copy(dAtA[i:], dAtA4[:j3])
+		i = encodeVarintNebula(dAtA, i, uint64(j3))
 		i--
 		dAtA[i] = 0x2a
 	}
@@ -807,7 +1212,7 @@ func (m *NebulaMetaDetails) MarshalToSizedBuffer(dAtA []byte) (int, error) {
 	return len(dAtA) - i, nil
 }
 
-func (m *Ip4AndPort) Marshal() (dAtA []byte, err error) {
+func (m *UnsafeRoute) Marshal() (dAtA []byte, err error) {
 	size := m.Size()
 	dAtA = make([]byte, size)
 	n, err := m.MarshalToSizedBuffer(dAtA[:size])
@@ -817,30 +1222,37 @@ func (m *Ip4AndPort) Marshal() (dAtA []byte, err error) {
 	return dAtA[:n], nil
 }
 
-func (m *Ip4AndPort) MarshalTo(dAtA []byte) (int, error) {
+func (m *UnsafeRoute) MarshalTo(dAtA []byte) (int, error) {
 	size := m.Size()
 	return m.MarshalToSizedBuffer(dAtA[:size])
 }
 
-func (m *Ip4AndPort) MarshalToSizedBuffer(dAtA []byte) (int, error) {
+func (m *UnsafeRoute) MarshalToSizedBuffer(dAtA []byte) (int, error) {
 	i := len(dAtA)
 	_ = i
 	var l int
 	_ = l
-	if m.Port != 0 {
-		i = encodeVarintNebula(dAtA, i, uint64(m.Port))
+	if m.Metric != 0 {
+		i = encodeVarintNebula(dAtA, i, uint64(m.Metric))
+		i--
+		dAtA[i] = 0x18
+	}
+	if m.Bits != 0 {
+		i = encodeVarintNebula(dAtA, i, uint64(m.Bits))
 		i--
 		dAtA[i] = 0x10
 	}
-	if m.Ip != 0 {
-		i = encodeVarintNebula(dAtA, i, uint64(m.Ip))
+	if len(m.Ip) > 0 {
+		i -= len(m.Ip)
+		copy(dAtA[i:], m.Ip)
+		i = encodeVarintNebula(dAtA, i, uint64(len(m.Ip)))
 		i--
-		dAtA[i] = 0x8
+		dAtA[i] = 0xa
 	}
 	return len(dAtA) - i, nil
 }
 
-func (m *Ip6AndPort) Marshal() (dAtA []byte, err error) {
+func (m *Addr) Marshal() (dAtA []byte, err error) {
 	size := m.Size()
 	dAtA = make([]byte, size)
 	n, err := m.MarshalToSizedBuffer(dAtA[:size])
@@ -850,21 +1262,16 @@ func (m *Ip6AndPort) Marshal() (dAtA []byte, err error) {
 	return dAtA[:n], nil
 }
 
-func (m *Ip6AndPort) MarshalTo(dAtA []byte) (int, error) {
+func (m *Addr) MarshalTo(dAtA []byte) (int, error) {
 	size := m.Size()
 	return m.MarshalToSizedBuffer(dAtA[:size])
 }
 
-func (m *Ip6AndPort) MarshalToSizedBuffer(dAtA []byte) (int, error) {
+func (m *Addr) MarshalToSizedBuffer(dAtA []byte) (int, error) {
 	i := len(dAtA)
 	_ = i
 	var l int
 	_ = l
-	if m.Port != 0 {
-		i = encodeVarintNebula(dAtA, i, uint64(m.Port))
-		i--
-		dAtA[i] = 0x18
-	}
 	if m.Lo != 0 {
 		i = encodeVarintNebula(dAtA, i, uint64(m.Lo))
 		i--
@@ -878,7 +1285,7 @@ func (m *Ip6AndPort) MarshalToSizedBuffer(dAtA []byte) (int, error) {
 	return len(dAtA) - i, nil
 }
 
-func (m *NebulaPing) Marshal() (dAtA []byte, err error) {
+func (m *Ip4AndPort) Marshal() (dAtA []byte, err error) {
 	size := m.Size()
 	dAtA = make([]byte, size)
 	n, err := m.MarshalToSizedBuffer(dAtA[:size])
@@ -888,30 +1295,30 @@ func (m *NebulaPing) Marshal() (dAtA []byte, err error) {
 	return dAtA[:n], nil
 }
 
-func (m *NebulaPing) MarshalTo(dAtA []byte) (int, error) {
+func (m *Ip4AndPort) MarshalTo(dAtA []byte) (int, error) {
 	size := m.Size()
 	return m.MarshalToSizedBuffer(dAtA[:size])
 }
 
-func (m *NebulaPing) MarshalToSizedBuffer(dAtA []byte) (int, error) {
+func (m *Ip4AndPort) MarshalToSizedBuffer(dAtA []byte) (int, error) {
 	i := len(dAtA)
 	_ = i
 	var l int
 	_ = l
-	if m.Time != 0 {
-		i = encodeVarintNebula(dAtA, i, uint64(m.Time))
+	if m.Port != 0 {
+		i = encodeVarintNebula(dAtA, i, uint64(m.Port))
 		i--
 		dAtA[i] = 0x10
 	}
-	if m.Type != 0 {
-		i = encodeVarintNebula(dAtA, i, uint64(m.Type))
+	if m.Ip != 0 {
+		i = encodeVarintNebula(dAtA, i, uint64(m.Ip))
 		i--
 		dAtA[i] = 0x8
 	}
 	return len(dAtA) - i, nil
 }
 
-func (m *NebulaHandshake) Marshal() (dAtA []byte, err error) {
+func (m *Ip6AndPort) Marshal() (dAtA []byte, err error) {
 	size := m.Size()
 	dAtA = make([]byte, size)
 	n, err := m.MarshalToSizedBuffer(dAtA[:size])
@@ -921,7 +1328,78 @@ func (m *NebulaHandshake) Marshal() (dAtA []byte, err error) {
 	return dAtA[:n], nil
 }
 
-func (m *NebulaHandshake) MarshalTo(dAtA []byte) (int, error) {
+func (m *Ip6AndPort) MarshalTo(dAtA []byte) (int, error) {
+	size := m.Size()
+	return m.MarshalToSizedBuffer(dAtA[:size])
+}
+
+func (m *Ip6AndPort) MarshalToSizedBuffer(dAtA []byte) (int, error) {
+	i := len(dAtA)
+	_ = i
+	var l int
+	_ = l
+	if m.Port != 0 {
+		i = encodeVarintNebula(dAtA, i, uint64(m.Port))
+		i--
+		dAtA[i] = 0x18
+	}
+	if m.Lo != 0 {
+		i = encodeVarintNebula(dAtA, i, uint64(m.Lo))
+		i--
+		dAtA[i] = 0x10
+	}
+	if m.Hi != 0 {
+		i = encodeVarintNebula(dAtA, i, uint64(m.Hi))
+		i--
+		dAtA[i] = 0x8
+	}
+	return len(dAtA) - i, nil
+}
+
+func (m *NebulaPing) Marshal() (dAtA []byte, err error) {
+	size := m.Size()
+	dAtA = make([]byte, size)
+	n, err := m.MarshalToSizedBuffer(dAtA[:size])
+	if err != nil {
+		return nil, err
+	}
+	return dAtA[:n], nil
+}
+
+func (m *NebulaPing) MarshalTo(dAtA []byte) (int, error) {
+	size := m.Size()
+	return m.MarshalToSizedBuffer(dAtA[:size])
+}
+
+func (m *NebulaPing) MarshalToSizedBuffer(dAtA []byte) (int, error) {
+	i := len(dAtA)
+	_ = i
+	var l int
+	_ = l
+	if m.Time != 0 {
+		i = encodeVarintNebula(dAtA, i, uint64(m.Time))
+		i--
+		dAtA[i] = 0x10
+	}
+	if m.Type != 0 {
+		i = encodeVarintNebula(dAtA, i, uint64(m.Type))
+		i--
+		dAtA[i] = 0x8
+	}
+	return len(dAtA) - i, nil
+}
+
+func (m *NebulaHandshake) Marshal() (dAtA []byte, err error) {
+	size := m.Size()
+	dAtA = make([]byte, size)
+	n, err := m.MarshalToSizedBuffer(dAtA[:size])
+	if err != nil {
+		return nil, err
+	}
+	return dAtA[:n], nil
+}
+
+func (m *NebulaHandshake) MarshalTo(dAtA []byte) (int, error) {
 	size := m.Size()
 	return m.MarshalToSizedBuffer(dAtA[:size])
 }
@@ -973,6 +1451,77 @@ func (m *NebulaHandshakeDetails) MarshalToSizedBuffer(dAtA []byte) (int, error)
 	_ = i
 	var l int
 	_ = l
+	if len(m.TrustedCAs) > 0 {
+		for iNdEx := len(m.TrustedCAs) - 1; iNdEx >= 0; iNdEx-- {
+			i -= len(m.TrustedCAs[iNdEx])
+			copy(dAtA[i:], m.TrustedCAs[iNdEx])
+			i = encodeVarintNebula(dAtA, i, uint64(len(m.TrustedCAs[iNdEx])))
+			i--
+			dAtA[i] = 0x1
+			i--
+			dAtA[i] = 0x82
+		}
+	}
+	if len(m.KemCiphertext) > 0 {
+		i -= len(m.KemCiphertext)
+		copy(dAtA[i:], m.KemCiphertext)
+		i = encodeVarintNebula(dAtA, i, uint64(len(m.KemCiphertext)))
+		i--
+		dAtA[i] = 0x7a
+	}
+	if len(m.KemPublicKey) > 0 {
+		i -= len(m.KemPublicKey)
+		copy(dAtA[i:], m.KemPublicKey)
+		i = encodeVarintNebula(dAtA, i, uint64(len(m.KemPublicKey)))
+		i--
+		dAtA[i] = 0x72
+	}
+	if len(m.CipherPskId) > 0 {
+		i -= len(m.CipherPskId)
+		copy(dAtA[i:], m.CipherPskId)
+		i = encodeVarintNebula(dAtA, i, uint64(len(m.CipherPskId)))
+		i--
+		dAtA[i] = 0x6a
+	}
+	if len(m.Cipher) > 0 {
+		i -= len(m.Cipher)
+		copy(dAtA[i:], m.Cipher)
+		i = encodeVarintNebula(dAtA, i, uint64(len(m.Cipher)))
+		i--
+		dAtA[i] = 0x62
+	}
+	if len(m.Ciphers) > 0 {
+		for iNdEx := len(m.Ciphers) - 1; iNdEx >= 0; iNdEx-- {
+			i -= len(m.Ciphers[iNdEx])
+			copy(dAtA[i:], m.Ciphers[iNdEx])
+			i = encodeVarintNebula(dAtA, i, uint64(len(m.Ciphers[iNdEx])))
+			i--
+			dAtA[i] = 0x5a
+		}
+	}
+	if len(m.HandshakeCipher) > 0 {
+		i -= len(m.HandshakeCipher)
+		copy(dAtA[i:], m.HandshakeCipher)
+		i = encodeVarintNebula(dAtA, i, uint64(len(m.HandshakeCipher)))
+		i--
+		dAtA[i] = 0x52
+	}
+	if len(m.CapabilitiesDigest) > 0 {
+		i -= len(m.CapabilitiesDigest)
+		copy(dAtA[i:], m.CapabilitiesDigest)
+		i = encodeVarintNebula(dAtA, i, uint64(len(m.CapabilitiesDigest)))
+		i--
+		dAtA[i] = 0x4a
+	}
+	if len(m.Capabilities) > 0 {
+		for iNdEx := len(m.Capabilities) - 1; iNdEx >= 0; iNdEx-- {
+			i -= len(m.Capabilities[iNdEx])
+			copy(dAtA[i:], m.Capabilities[iNdEx])
+			i = encodeVarintNebula(dAtA, i, uint64(len(m.Capabilities[iNdEx])))
+			i--
+			dAtA[i] = 0x42
+		}
+	}
 	if m.Time != 0 {
 		i = encodeVarintNebula(dAtA, i, uint64(m.Time))
 		i--
@@ -1023,6 +1572,30 @@ func (m *NebulaControl) MarshalToSizedBuffer(dAtA []byte) (int, error) {
 	_ = i
 	var l int
 	_ = l
+	if m.RelayFromAddr != nil {
+		{
+			size, err := m.RelayFromAddr.MarshalToSizedBuffer(dAtA[:i])
+			if err != nil {
+				return 0, err
+			}
+			i -= size
+			i = encodeVarintNebula(dAtA, i, uint64(size))
+		}
+		i--
+		dAtA[i] = 0x3a
+	}
+	if m.RelayToAddr != nil {
+		{
+			size, err := m.RelayToAddr.MarshalToSizedBuffer(dAtA[:i])
+			if err != nil {
+				return 0, err
+			}
+			i -= size
+			i = encodeVarintNebula(dAtA, i, uint64(size))
+		}
+		i--
+		dAtA[i] = 0x32
+	}
 	if m.RelayFromIp != 0 {
 		i = encodeVarintNebula(dAtA, i, uint64(m.RelayFromIp))
 		i--
@@ -1109,6 +1682,72 @@ func (m *NebulaMetaDetails) Size() (n int) {
 		}
 		n += 1 + sovNebula(uint64(l)) + l
 	}
+	if m.Time != 0 {
+		n += 1 + sovNebula(uint64(m.Time))
+	}
+	l = len(m.Signature)
+	if l > 0 {
+		n += 1 + l + sovNebula(uint64(l))
+	}
+	if m.Stale {
+		n += 2
+	}
+	if m.RelayCapacity != 0 {
+		n += 1 + sovNebula(uint64(m.RelayCapacity))
+	}
+	if m.RelayLoad != 0 {
+		n += 1 + sovNebula(uint64(m.RelayLoad))
+	}
+	if m.VpnAddr != nil {
+		l = m.VpnAddr.Size()
+		n += 1 + l + sovNebula(uint64(l))
+	}
+	if len(m.RelayVpnAddrs) > 0 {
+		for _, e := range m.RelayVpnAddrs {
+			l = e.Size()
+			n += 1 + l + sovNebula(uint64(l))
+		}
+	}
+	if len(m.Routes) > 0 {
+		for _, e := range m.Routes {
+			l = e.Size()
+			n += 1 + l + sovNebula(uint64(l))
+		}
+	}
+	return n
+}
+
+func (m *UnsafeRoute) Size() (n int) {
+	if m == nil {
+		return 0
+	}
+	var l int
+	_ = l
+	l = len(m.Ip)
+	if l > 0 {
+		n += 1 + l + sovNebula(uint64(l))
+	}
+	if m.Bits != 0 {
+		n += 1 + sovNebula(uint64(m.Bits))
+	}
+	if m.Metric != 0 {
+		n += 1 + sovNebula(uint64(m.Metric))
+	}
+	return n
+}
+
+func (m *Addr) Size() (n int) {
+	if m == nil {
+		return 0
+	}
+	var l int
+	_ = l
+	if m.Hi != 0 {
+		n += 1 + sovNebula(uint64(m.Hi))
+	}
+	if m.Lo != 0 {
+		n += 1 + sovNebula(uint64(m.Lo))
+	}
 	return n
 }
 
@@ -1199,6 +1838,48 @@ func (m *NebulaHandshakeDetails) Size() (n int) {
 	if m.Time != 0 {
 		n += 1 + sovNebula(uint64(m.Time))
 	}
+	if len(m.Capabilities) > 0 {
+		for _, s := range m.Capabilities {
+			l = len(s)
+			n += 1 + l + sovNebula(uint64(l))
+		}
+	}
+	l = len(m.CapabilitiesDigest)
+	if l > 0 {
+		n += 1 + l + sovNebula(uint64(l))
+	}
+	l = len(m.HandshakeCipher)
+	if l > 0 {
+		n += 1 + l + sovNebula(uint64(l))
+	}
+	if len(m.Ciphers) > 0 {
+		for _, s := range m.Ciphers {
+			l = len(s)
+			n += 1 + l + sovNebula(uint64(l))
+		}
+	}
+	l = len(m.Cipher)
+	if l > 0 {
+		n += 1 + l + sovNebula(uint64(l))
+	}
+	l = len(m.CipherPskId)
+	if l > 0 {
+		n += 1 + l + sovNebula(uint64(l))
+	}
+	l = len(m.KemPublicKey)
+	if l > 0 {
+		n += 1 + l + sovNebula(uint64(l))
+	}
+	l = len(m.KemCiphertext)
+	if l > 0 {
+		n += 1 + l + sovNebula(uint64(l))
+	}
+	if len(m.TrustedCAs) > 0 {
+		for _, s := range m.TrustedCAs {
+			l = len(s)
+			n += 2 + l + sovNebula(uint64(l))
+		}
+	}
 	return n
 }
 
@@ -1223,6 +1904,14 @@ func (m *NebulaControl) Size() (n int) {
 	if m.RelayFromIp != 0 {
 		n += 1 + sovNebula(uint64(m.RelayFromIp))
 	}
+	if m.RelayToAddr != nil {
+		l = m.RelayToAddr.Size()
+		n += 1 + l + sovNebula(uint64(l))
+	}
+	if m.RelayFromAddr != nil {
+		l = m.RelayFromAddr.Size()
+		n += 1 + l + sovNebula(uint64(l))
+	}
 	return n
 }
 
@@ -1548,61 +2237,11 @@ func (m *NebulaMetaDetails) Unmarshal(dAtA []byte) error {
 			} else {
 				return fmt.Errorf("proto: wrong wireType = %d for field RelayVpnIp", wireType)
 			}
-		default:
-			iNdEx = preIndex
-			skippy, err := skipNebula(dAtA[iNdEx:])
-			if err != nil {
-				return err
-			}
-			if (skippy < 0) || (iNdEx+skippy) < 0 {
-				return ErrInvalidLengthNebula
-			}
-			if (iNdEx + skippy) > l {
-				return io.ErrUnexpectedEOF
-			}
-			iNdEx += skippy
-		}
-	}
-
-	if iNdEx > l {
-		return io.ErrUnexpectedEOF
-	}
-	return nil
-}
-func (m *Ip4AndPort) Unmarshal(dAtA []byte) error {
-	l := len(dAtA)
-	iNdEx := 0
-	for iNdEx < l {
-		preIndex := iNdEx
-		var wire uint64
-		for shift := uint(0); ; shift += 7 {
-			if shift >= 64 {
-				return ErrIntOverflowNebula
-			}
-			if iNdEx >= l {
-				return io.ErrUnexpectedEOF
-			}
-			b := dAtA[iNdEx]
-			iNdEx++
-			wire |= uint64(b&0x7F) << shift
-			if b < 0x80 {
-				break
-			}
-		}
-		fieldNum := int32(wire >> 3)
-		wireType := int(wire & 0x7)
-		if wireType == 4 {
-			return fmt.Errorf("proto: Ip4AndPort: wiretype end group for non-group")
-		}
-		if fieldNum <= 0 {
-			return fmt.Errorf("proto: Ip4AndPort: illegal tag %d (wire type %d)", fieldNum, wire)
-		}
-		switch fieldNum {
-		case 1:
+		case 6:
 			if wireType != 0 {
-				return fmt.Errorf("proto: wrong wireType = %d for field Ip", wireType)
+				return fmt.Errorf("proto: wrong wireType = %d for field Time", wireType)
 			}
-			m.Ip = 0
+			m.Time = 0
 			for shift := uint(0); ; shift += 7 {
 				if shift >= 64 {
 					return ErrIntOverflowNebula
@@ -1612,16 +2251,16 @@ func (m *Ip4AndPort) Unmarshal(dAtA []byte) error {
 				}
 				b := dAtA[iNdEx]
 				iNdEx++
-				m.Ip |= uint32(b&0x7F) << shift
+				m.Time |= uint64(b&0x7F) << shift
 				if b < 0x80 {
 					break
 				}
 			}
-		case 2:
-			if wireType != 0 {
-				return fmt.Errorf("proto: wrong wireType = %d for field Port", wireType)
+		case 7:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Signature", wireType)
 			}
-			m.Port = 0
+			var byteLen int
 			for shift := uint(0); ; shift += 7 {
 				if shift >= 64 {
 					return ErrIntOverflowNebula
@@ -1631,15 +2270,192 @@ func (m *Ip4AndPort) Unmarshal(dAtA []byte) error {
 				}
 				b := dAtA[iNdEx]
 				iNdEx++
-				m.Port |= uint32(b&0x7F) << shift
+				byteLen |= int(b&0x7F) << shift
 				if b < 0x80 {
 					break
 				}
 			}
-		default:
-			iNdEx = preIndex
-			skippy, err := skipNebula(dAtA[iNdEx:])
-			if err != nil {
+			if byteLen < 0 {
+				return ErrInvalidLengthNebula
+			}
+			postIndex := iNdEx + byteLen
+			if postIndex < 0 {
+				return ErrInvalidLengthNebula
+			}
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.Signature = append(m.Signature[:0], dAtA[iNdEx:postIndex]...)
+			if m.Signature == nil {
+				m.Signature = []byte{}
+			}
+			iNdEx = postIndex
+		case 8:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Stale", wireType)
+			}
+			var v int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowNebula
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				v |= int(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			m.Stale = bool(v != 0)
+		case 9:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field RelayCapacity", wireType)
+			}
+			m.RelayCapacity = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowNebula
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				m.RelayCapacity |= uint32(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+		case 10:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field RelayLoad", wireType)
+			}
+			m.RelayLoad = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowNebula
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				m.RelayLoad |= uint32(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+		case 11:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field VpnAddr", wireType)
+			}
+			var msglen int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowNebula
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				msglen |= int(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			if msglen < 0 {
+				return ErrInvalidLengthNebula
+			}
+			postIndex := iNdEx + msglen
+			if postIndex < 0 {
+				return ErrInvalidLengthNebula
+			}
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			if m.VpnAddr == nil {
+				m.VpnAddr = &Addr{}
+			}
+			if err := m.VpnAddr.Unmarshal(dAtA[iNdEx:postIndex]); err != nil {
+				return err
+			}
+			iNdEx = postIndex
+		case 12:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field RelayVpnAddrs", wireType)
+			}
+			var msglen int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowNebula
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				msglen |= int(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			if msglen < 0 {
+				return ErrInvalidLengthNebula
+			}
+			postIndex := iNdEx + msglen
+			if postIndex < 0 {
+				return ErrInvalidLengthNebula
+			}
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.RelayVpnAddrs = append(m.RelayVpnAddrs, &Addr{})
+			if err := m.RelayVpnAddrs[len(m.RelayVpnAddrs)-1].Unmarshal(dAtA[iNdEx:postIndex]); err != nil {
+				return err
+			}
+			iNdEx = postIndex
+		case 13:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Routes", wireType)
+			}
+			var msglen int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowNebula
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				msglen |= int(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			if msglen < 0 {
+				return ErrInvalidLengthNebula
+			}
+			postIndex := iNdEx + msglen
+			if postIndex < 0 {
+				return ErrInvalidLengthNebula
+			}
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.Routes = append(m.Routes, &UnsafeRoute{})
+			if err := m.Routes[len(m.Routes)-1].Unmarshal(dAtA[iNdEx:postIndex]); err != nil {
+				return err
+			}
+			iNdEx = postIndex
+		default:
+			iNdEx = preIndex
+			skippy, err := skipNebula(dAtA[iNdEx:])
+			if err != nil {
 				return err
 			}
 			if (skippy < 0) || (iNdEx+skippy) < 0 {
@@ -1657,7 +2473,7 @@ func (m *Ip4AndPort) Unmarshal(dAtA []byte) error {
 	}
 	return nil
 }
-func (m *Ip6AndPort) Unmarshal(dAtA []byte) error {
+func (m *UnsafeRoute) Unmarshal(dAtA []byte) error {
 	l := len(dAtA)
 	iNdEx := 0
 	for iNdEx < l {
@@ -1680,17 +2496,17 @@ func (m *Ip6AndPort) Unmarshal(dAtA []byte) error {
 		fieldNum := int32(wire >> 3)
 		wireType := int(wire & 0x7)
 		if wireType == 4 {
-			return fmt.Errorf("proto: Ip6AndPort: wiretype end group for non-group")
+			return fmt.Errorf("proto: UnsafeRoute: wiretype end group for non-group")
 		}
 		if fieldNum <= 0 {
-			return fmt.Errorf("proto: Ip6AndPort: illegal tag %d (wire type %d)", fieldNum, wire)
+			return fmt.Errorf("proto: UnsafeRoute: illegal tag %d (wire type %d)", fieldNum, wire)
 		}
 		switch fieldNum {
 		case 1:
-			if wireType != 0 {
-				return fmt.Errorf("proto: wrong wireType = %d for field Hi", wireType)
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Ip", wireType)
 			}
-			m.Hi = 0
+			var byteLen int
 			for shift := uint(0); ; shift += 7 {
 				if shift >= 64 {
 					return ErrIntOverflowNebula
@@ -1700,16 +2516,31 @@ func (m *Ip6AndPort) Unmarshal(dAtA []byte) error {
 				}
 				b := dAtA[iNdEx]
 				iNdEx++
-				m.Hi |= uint64(b&0x7F) << shift
+				byteLen |= int(b&0x7F) << shift
 				if b < 0x80 {
 					break
 				}
 			}
+			if byteLen < 0 {
+				return ErrInvalidLengthNebula
+			}
+			postIndex := iNdEx + byteLen
+			if postIndex < 0 {
+				return ErrInvalidLengthNebula
+			}
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.Ip = append(m.Ip[:0], dAtA[iNdEx:postIndex]...)
+			if m.Ip == nil {
+				m.Ip = []byte{}
+			}
+			iNdEx = postIndex
 		case 2:
 			if wireType != 0 {
-				return fmt.Errorf("proto: wrong wireType = %d for field Lo", wireType)
+				return fmt.Errorf("proto: wrong wireType = %d for field Bits", wireType)
 			}
-			m.Lo = 0
+			m.Bits = 0
 			for shift := uint(0); ; shift += 7 {
 				if shift >= 64 {
 					return ErrIntOverflowNebula
@@ -1719,16 +2550,16 @@ func (m *Ip6AndPort) Unmarshal(dAtA []byte) error {
 				}
 				b := dAtA[iNdEx]
 				iNdEx++
-				m.Lo |= uint64(b&0x7F) << shift
+				m.Bits |= uint32(b&0x7F) << shift
 				if b < 0x80 {
 					break
 				}
 			}
 		case 3:
 			if wireType != 0 {
-				return fmt.Errorf("proto: wrong wireType = %d for field Port", wireType)
+				return fmt.Errorf("proto: wrong wireType = %d for field Metric", wireType)
 			}
-			m.Port = 0
+			m.Metric = 0
 			for shift := uint(0); ; shift += 7 {
 				if shift >= 64 {
 					return ErrIntOverflowNebula
@@ -1738,7 +2569,7 @@ func (m *Ip6AndPort) Unmarshal(dAtA []byte) error {
 				}
 				b := dAtA[iNdEx]
 				iNdEx++
-				m.Port |= uint32(b&0x7F) << shift
+				m.Metric |= uint32(b&0x7F) << shift
 				if b < 0x80 {
 					break
 				}
@@ -1764,7 +2595,7 @@ func (m *Ip6AndPort) Unmarshal(dAtA []byte) error {
 	}
 	return nil
 }
-func (m *NebulaPing) Unmarshal(dAtA []byte) error {
+func (m *Addr) Unmarshal(dAtA []byte) error {
 	l := len(dAtA)
 	iNdEx := 0
 	for iNdEx < l {
@@ -1787,17 +2618,17 @@ func (m *NebulaPing) Unmarshal(dAtA []byte) error {
 		fieldNum := int32(wire >> 3)
 		wireType := int(wire & 0x7)
 		if wireType == 4 {
-			return fmt.Errorf("proto: NebulaPing: wiretype end group for non-group")
+			return fmt.Errorf("proto: Addr: wiretype end group for non-group")
 		}
 		if fieldNum <= 0 {
-			return fmt.Errorf("proto: NebulaPing: illegal tag %d (wire type %d)", fieldNum, wire)
+			return fmt.Errorf("proto: Addr: illegal tag %d (wire type %d)", fieldNum, wire)
 		}
 		switch fieldNum {
 		case 1:
 			if wireType != 0 {
-				return fmt.Errorf("proto: wrong wireType = %d for field Type", wireType)
+				return fmt.Errorf("proto: wrong wireType = %d for field Hi", wireType)
 			}
-			m.Type = 0
+			m.Hi = 0
 			for shift := uint(0); ; shift += 7 {
 				if shift >= 64 {
 					return ErrIntOverflowNebula
@@ -1807,16 +2638,16 @@ func (m *NebulaPing) Unmarshal(dAtA []byte) error {
 				}
 				b := dAtA[iNdEx]
 				iNdEx++
-				m.Type |= NebulaPing_MessageType(b&0x7F) << shift
+				m.Hi |= uint64(b&0x7F) << shift
 				if b < 0x80 {
 					break
 				}
 			}
 		case 2:
 			if wireType != 0 {
-				return fmt.Errorf("proto: wrong wireType = %d for field Time", wireType)
+				return fmt.Errorf("proto: wrong wireType = %d for field Lo", wireType)
 			}
-			m.Time = 0
+			m.Lo = 0
 			for shift := uint(0); ; shift += 7 {
 				if shift >= 64 {
 					return ErrIntOverflowNebula
@@ -1826,7 +2657,7 @@ func (m *NebulaPing) Unmarshal(dAtA []byte) error {
 				}
 				b := dAtA[iNdEx]
 				iNdEx++
-				m.Time |= uint64(b&0x7F) << shift
+				m.Lo |= uint64(b&0x7F) << shift
 				if b < 0x80 {
 					break
 				}
@@ -1852,7 +2683,7 @@ func (m *NebulaPing) Unmarshal(dAtA []byte) error {
 	}
 	return nil
 }
-func (m *NebulaHandshake) Unmarshal(dAtA []byte) error {
+func (m *Ip4AndPort) Unmarshal(dAtA []byte) error {
 	l := len(dAtA)
 	iNdEx := 0
 	for iNdEx < l {
@@ -1875,17 +2706,17 @@ func (m *NebulaHandshake) Unmarshal(dAtA []byte) error {
 		fieldNum := int32(wire >> 3)
 		wireType := int(wire & 0x7)
 		if wireType == 4 {
-			return fmt.Errorf("proto: NebulaHandshake: wiretype end group for non-group")
+			return fmt.Errorf("proto: Ip4AndPort: wiretype end group for non-group")
 		}
 		if fieldNum <= 0 {
-			return fmt.Errorf("proto: NebulaHandshake: illegal tag %d (wire type %d)", fieldNum, wire)
+			return fmt.Errorf("proto: Ip4AndPort: illegal tag %d (wire type %d)", fieldNum, wire)
 		}
 		switch fieldNum {
 		case 1:
-			if wireType != 2 {
-				return fmt.Errorf("proto: wrong wireType = %d for field Details", wireType)
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Ip", wireType)
 			}
-			var msglen int
+			m.Ip = 0
 			for shift := uint(0); ; shift += 7 {
 				if shift >= 64 {
 					return ErrIntOverflowNebula
@@ -1895,33 +2726,16 @@ func (m *NebulaHandshake) Unmarshal(dAtA []byte) error {
 				}
 				b := dAtA[iNdEx]
 				iNdEx++
-				msglen |= int(b&0x7F) << shift
+				m.Ip |= uint32(b&0x7F) << shift
 				if b < 0x80 {
 					break
 				}
 			}
-			if msglen < 0 {
-				return ErrInvalidLengthNebula
-			}
-			postIndex := iNdEx + msglen
-			if postIndex < 0 {
-				return ErrInvalidLengthNebula
-			}
-			if postIndex > l {
-				return io.ErrUnexpectedEOF
-			}
-			if m.Details == nil {
-				m.Details = &NebulaHandshakeDetails{}
-			}
-			if err := m.Details.Unmarshal(dAtA[iNdEx:postIndex]); err != nil {
-				return err
-			}
-			iNdEx = postIndex
 		case 2:
-			if wireType != 2 {
-				return fmt.Errorf("proto: wrong wireType = %d for field Hmac", wireType)
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Port", wireType)
 			}
-			var byteLen int
+			m.Port = 0
 			for shift := uint(0); ; shift += 7 {
 				if shift >= 64 {
 					return ErrIntOverflowNebula
@@ -1931,26 +2745,11 @@ func (m *NebulaHandshake) Unmarshal(dAtA []byte) error {
 				}
 				b := dAtA[iNdEx]
 				iNdEx++
-				byteLen |= int(b&0x7F) << shift
+				m.Port |= uint32(b&0x7F) << shift
 				if b < 0x80 {
 					break
 				}
 			}
-			if byteLen < 0 {
-				return ErrInvalidLengthNebula
-			}
-			postIndex := iNdEx + byteLen
-			if postIndex < 0 {
-				return ErrInvalidLengthNebula
-			}
-			if postIndex > l {
-				return io.ErrUnexpectedEOF
-			}
-			m.Hmac = append(m.Hmac[:0], dAtA[iNdEx:postIndex]...)
-			if m.Hmac == nil {
-				m.Hmac = []byte{}
-			}
-			iNdEx = postIndex
 		default:
 			iNdEx = preIndex
 			skippy, err := skipNebula(dAtA[iNdEx:])
@@ -1972,7 +2771,7 @@ func (m *NebulaHandshake) Unmarshal(dAtA []byte) error {
 	}
 	return nil
 }
-func (m *NebulaHandshakeDetails) Unmarshal(dAtA []byte) error {
+func (m *Ip6AndPort) Unmarshal(dAtA []byte) error {
 	l := len(dAtA)
 	iNdEx := 0
 	for iNdEx < l {
@@ -1995,15 +2794,472 @@ func (m *NebulaHandshakeDetails) Unmarshal(dAtA []byte) error {
 		fieldNum := int32(wire >> 3)
 		wireType := int(wire & 0x7)
 		if wireType == 4 {
-			return fmt.Errorf("proto: NebulaHandshakeDetails: wiretype end group for non-group")
+			return fmt.Errorf("proto: Ip6AndPort: wiretype end group for non-group")
 		}
 		if fieldNum <= 0 {
-			return fmt.Errorf("proto: NebulaHandshakeDetails: illegal tag %d (wire type %d)", fieldNum, wire)
+			return fmt.Errorf("proto: Ip6AndPort: illegal tag %d (wire type %d)", fieldNum, wire)
 		}
 		switch fieldNum {
 		case 1:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Hi", wireType)
+			}
+			m.Hi = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowNebula
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				m.Hi |= uint64(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+		case 2:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Lo", wireType)
+			}
+			m.Lo = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowNebula
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				m.Lo |= uint64(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+		case 3:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Port", wireType)
+			}
+			m.Port = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowNebula
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				m.Port |= uint32(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+		default:
+			iNdEx = preIndex
+			skippy, err := skipNebula(dAtA[iNdEx:])
+			if err != nil {
+				return err
+			}
+			if (skippy < 0) || (iNdEx+skippy) < 0 {
+				return ErrInvalidLengthNebula
+			}
+			if (iNdEx + skippy) > l {
+				return io.ErrUnexpectedEOF
+			}
+			iNdEx += skippy
+		}
+	}
+
+	if iNdEx > l {
+		return io.ErrUnexpectedEOF
+	}
+	return nil
+}
+func (m *NebulaPing) Unmarshal(dAtA []byte) error {
+	l := len(dAtA)
+	iNdEx := 0
+	for iNdEx < l {
+		preIndex := iNdEx
+		var wire uint64
+		for shift := uint(0); ; shift += 7 {
+			if shift >= 64 {
+				return ErrIntOverflowNebula
+			}
+			if iNdEx >= l {
+				return io.ErrUnexpectedEOF
+			}
+			b := dAtA[iNdEx]
+			iNdEx++
+			wire |= uint64(b&0x7F) << shift
+			if b < 0x80 {
+				break
+			}
+		}
+		fieldNum := int32(wire >> 3)
+		wireType := int(wire & 0x7)
+		if wireType == 4 {
+			return fmt.Errorf("proto: NebulaPing: wiretype end group for non-group")
+		}
+		if fieldNum <= 0 {
+			return fmt.Errorf("proto: NebulaPing: illegal tag %d (wire type %d)", fieldNum, wire)
+		}
+		switch fieldNum {
+		case 1:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Type", wireType)
+			}
+			m.Type = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowNebula
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				m.Type |= NebulaPing_MessageType(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+		case 2:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Time", wireType)
+			}
+			m.Time = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowNebula
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				m.Time |= uint64(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+		default:
+			iNdEx = preIndex
+			skippy, err := skipNebula(dAtA[iNdEx:])
+			if err != nil {
+				return err
+			}
+			if (skippy < 0) || (iNdEx+skippy) < 0 {
+				return ErrInvalidLengthNebula
+			}
+			if (iNdEx + skippy) > l {
+				return io.ErrUnexpectedEOF
+			}
+			iNdEx += skippy
+		}
+	}
+
+	if iNdEx > l {
+		return io.ErrUnexpectedEOF
+	}
+	return nil
+}
+func (m *NebulaHandshake) Unmarshal(dAtA []byte) error {
+	l := len(dAtA)
+	iNdEx := 0
+	for iNdEx < l {
+		preIndex := iNdEx
+		var wire uint64
+		for shift := uint(0); ; shift += 7 {
+			if shift >= 64 {
+				return ErrIntOverflowNebula
+			}
+			if iNdEx >= l {
+				return io.ErrUnexpectedEOF
+			}
+			b := dAtA[iNdEx]
+			iNdEx++
+			wire |= uint64(b&0x7F) << shift
+			if b < 0x80 {
+				break
+			}
+		}
+		fieldNum := int32(wire >> 3)
+		wireType := int(wire & 0x7)
+		if wireType == 4 {
+			return fmt.Errorf("proto: NebulaHandshake: wiretype end group for non-group")
+		}
+		if fieldNum <= 0 {
+			return fmt.Errorf("proto: NebulaHandshake: illegal tag %d (wire type %d)", fieldNum, wire)
+		}
+		switch fieldNum {
+		case 1:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Details", wireType)
+			}
+			var msglen int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowNebula
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				msglen |= int(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			if msglen < 0 {
+				return ErrInvalidLengthNebula
+			}
+			postIndex := iNdEx + msglen
+			if postIndex < 0 {
+				return ErrInvalidLengthNebula
+			}
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			if m.Details == nil {
+				m.Details = &NebulaHandshakeDetails{}
+			}
+			if err := m.Details.Unmarshal(dAtA[iNdEx:postIndex]); err != nil {
+				return err
+			}
+			iNdEx = postIndex
+		case 2:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Hmac", wireType)
+			}
+			var byteLen int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowNebula
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				byteLen |= int(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			if byteLen < 0 {
+				return ErrInvalidLengthNebula
+			}
+			postIndex := iNdEx + byteLen
+			if postIndex < 0 {
+				return ErrInvalidLengthNebula
+			}
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.Hmac = append(m.Hmac[:0], dAtA[iNdEx:postIndex]...)
+			if m.Hmac == nil {
+				m.Hmac = []byte{}
+			}
+			iNdEx = postIndex
+		default:
+			iNdEx = preIndex
+			skippy, err := skipNebula(dAtA[iNdEx:])
+			if err != nil {
+				return err
+			}
+			if (skippy < 0) || (iNdEx+skippy) < 0 {
+				return ErrInvalidLengthNebula
+			}
+			if (iNdEx + skippy) > l {
+				return io.ErrUnexpectedEOF
+			}
+			iNdEx += skippy
+		}
+	}
+
+	if iNdEx > l {
+		return io.ErrUnexpectedEOF
+	}
+	return nil
+}
+func (m *NebulaHandshakeDetails) Unmarshal(dAtA []byte) error {
+	l := len(dAtA)
+	iNdEx := 0
+	for iNdEx < l {
+		preIndex := iNdEx
+		var wire uint64
+		for shift := uint(0); ; shift += 7 {
+			if shift >= 64 {
+				return ErrIntOverflowNebula
+			}
+			if iNdEx >= l {
+				return io.ErrUnexpectedEOF
+			}
+			b := dAtA[iNdEx]
+			iNdEx++
+			wire |= uint64(b&0x7F) << shift
+			if b < 0x80 {
+				break
+			}
+		}
+		fieldNum := int32(wire >> 3)
+		wireType := int(wire & 0x7)
+		if wireType == 4 {
+			return fmt.Errorf("proto: NebulaHandshakeDetails: wiretype end group for non-group")
+		}
+		if fieldNum <= 0 {
+			return fmt.Errorf("proto: NebulaHandshakeDetails: illegal tag %d (wire type %d)", fieldNum, wire)
+		}
+		switch fieldNum {
+		case 1:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Cert", wireType)
+			}
+			var byteLen int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowNebula
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				byteLen |= int(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			if byteLen < 0 {
+				return ErrInvalidLengthNebula
+			}
+			postIndex := iNdEx + byteLen
+			if postIndex < 0 {
+				return ErrInvalidLengthNebula
+			}
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.Cert = append(m.Cert[:0], dAtA[iNdEx:postIndex]...)
+			if m.Cert == nil {
+				m.Cert = []byte{}
+			}
+			iNdEx = postIndex
+		case 2:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field InitiatorIndex", wireType)
+			}
+			m.InitiatorIndex = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowNebula
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				m.InitiatorIndex |= uint32(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+		case 3:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field ResponderIndex", wireType)
+			}
+			m.ResponderIndex = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowNebula
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				m.ResponderIndex |= uint32(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+		case 4:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Cookie", wireType)
+			}
+			m.Cookie = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowNebula
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				m.Cookie |= uint64(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+		case 5:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Time", wireType)
+			}
+			m.Time = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowNebula
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				m.Time |= uint64(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+		case 8:
 			if wireType != 2 {
-				return fmt.Errorf("proto: wrong wireType = %d for field Cert", wireType)
+				return fmt.Errorf("proto: wrong wireType = %d for field Capabilities", wireType)
+			}
+			var stringLen uint64
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowNebula
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				stringLen |= uint64(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			intStringLen := int(stringLen)
+			if intStringLen < 0 {
+				return ErrInvalidLengthNebula
+			}
+			postIndex := iNdEx + intStringLen
+			if postIndex < 0 {
+				return ErrInvalidLengthNebula
+			}
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.Capabilities = append(m.Capabilities, string(dAtA[iNdEx:postIndex]))
+			iNdEx = postIndex
+		case 9:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field CapabilitiesDigest", wireType)
 			}
 			var byteLen int
 			for shift := uint(0); ; shift += 7 {
@@ -2030,16 +3286,16 @@ func (m *NebulaHandshakeDetails) Unmarshal(dAtA []byte) error {
 			if postIndex > l {
 				return io.ErrUnexpectedEOF
 			}
-			m.Cert = append(m.Cert[:0], dAtA[iNdEx:postIndex]...)
-			if m.Cert == nil {
-				m.Cert = []byte{}
+			m.CapabilitiesDigest = append(m.CapabilitiesDigest[:0], dAtA[iNdEx:postIndex]...)
+			if m.CapabilitiesDigest == nil {
+				m.CapabilitiesDigest = []byte{}
 			}
 			iNdEx = postIndex
-		case 2:
-			if wireType != 0 {
-				return fmt.Errorf("proto: wrong wireType = %d for field InitiatorIndex", wireType)
+		case 10:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field HandshakeCipher", wireType)
 			}
-			m.InitiatorIndex = 0
+			var stringLen uint64
 			for shift := uint(0); ; shift += 7 {
 				if shift >= 64 {
 					return ErrIntOverflowNebula
@@ -2049,16 +3305,29 @@ func (m *NebulaHandshakeDetails) Unmarshal(dAtA []byte) error {
 				}
 				b := dAtA[iNdEx]
 				iNdEx++
-				m.InitiatorIndex |= uint32(b&0x7F) << shift
+				stringLen |= uint64(b&0x7F) << shift
 				if b < 0x80 {
 					break
 				}
 			}
-		case 3:
-			if wireType != 0 {
-				return fmt.Errorf("proto: wrong wireType = %d for field ResponderIndex", wireType)
+			intStringLen := int(stringLen)
+			if intStringLen < 0 {
+				return ErrInvalidLengthNebula
 			}
-			m.ResponderIndex = 0
+			postIndex := iNdEx + intStringLen
+			if postIndex < 0 {
+				return ErrInvalidLengthNebula
+			}
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.HandshakeCipher = string(dAtA[iNdEx:postIndex])
+			iNdEx = postIndex
+		case 11:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Ciphers", wireType)
+			}
+			var stringLen uint64
 			for shift := uint(0); ; shift += 7 {
 				if shift >= 64 {
 					return ErrIntOverflowNebula
@@ -2068,16 +3337,29 @@ func (m *NebulaHandshakeDetails) Unmarshal(dAtA []byte) error {
 				}
 				b := dAtA[iNdEx]
 				iNdEx++
-				m.ResponderIndex |= uint32(b&0x7F) << shift
+				stringLen |= uint64(b&0x7F) << shift
 				if b < 0x80 {
 					break
 				}
 			}
-		case 4:
-			if wireType != 0 {
-				return fmt.Errorf("proto: wrong wireType = %d for field Cookie", wireType)
+			intStringLen := int(stringLen)
+			if intStringLen < 0 {
+				return ErrInvalidLengthNebula
 			}
-			m.Cookie = 0
+			postIndex := iNdEx + intStringLen
+			if postIndex < 0 {
+				return ErrInvalidLengthNebula
+			}
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.Ciphers = append(m.Ciphers, string(dAtA[iNdEx:postIndex]))
+			iNdEx = postIndex
+		case 12:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Cipher", wireType)
+			}
+			var stringLen uint64
 			for shift := uint(0); ; shift += 7 {
 				if shift >= 64 {
 					return ErrIntOverflowNebula
@@ -2087,16 +3369,29 @@ func (m *NebulaHandshakeDetails) Unmarshal(dAtA []byte) error {
 				}
 				b := dAtA[iNdEx]
 				iNdEx++
-				m.Cookie |= uint64(b&0x7F) << shift
+				stringLen |= uint64(b&0x7F) << shift
 				if b < 0x80 {
 					break
 				}
 			}
-		case 5:
-			if wireType != 0 {
-				return fmt.Errorf("proto: wrong wireType = %d for field Time", wireType)
+			intStringLen := int(stringLen)
+			if intStringLen < 0 {
+				return ErrInvalidLengthNebula
 			}
-			m.Time = 0
+			postIndex := iNdEx + intStringLen
+			if postIndex < 0 {
+				return ErrInvalidLengthNebula
+			}
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.Cipher = string(dAtA[iNdEx:postIndex])
+			iNdEx = postIndex
+		case 13:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field CipherPskId", wireType)
+			}
+			var byteLen int
 			for shift := uint(0); ; shift += 7 {
 				if shift >= 64 {
 					return ErrIntOverflowNebula
@@ -2106,11 +3401,126 @@ func (m *NebulaHandshakeDetails) Unmarshal(dAtA []byte) error {
 				}
 				b := dAtA[iNdEx]
 				iNdEx++
-				m.Time |= uint64(b&0x7F) << shift
+				byteLen |= int(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			if byteLen < 0 {
+				return ErrInvalidLengthNebula
+			}
+			postIndex := iNdEx + byteLen
+			if postIndex < 0 {
+				return ErrInvalidLengthNebula
+			}
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.CipherPskId = append(m.CipherPskId[:0], dAtA[iNdEx:postIndex]...)
+			if m.CipherPskId == nil {
+				m.CipherPskId = []byte{}
+			}
+			iNdEx = postIndex
+		case 14:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field KemPublicKey", wireType)
+			}
+			var byteLen int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowNebula
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				byteLen |= int(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			if byteLen < 0 {
+				return ErrInvalidLengthNebula
+			}
+			postIndex := iNdEx + byteLen
+			if postIndex < 0 {
+				return ErrInvalidLengthNebula
+			}
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.KemPublicKey = append(m.KemPublicKey[:0], dAtA[iNdEx:postIndex]...)
+			if m.KemPublicKey == nil {
+				m.KemPublicKey = []byte{}
+			}
+			iNdEx = postIndex
+		case 15:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field KemCiphertext", wireType)
+			}
+			var byteLen int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowNebula
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				byteLen |= int(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			if byteLen < 0 {
+				return ErrInvalidLengthNebula
+			}
+			postIndex := iNdEx + byteLen
+			if postIndex < 0 {
+				return ErrInvalidLengthNebula
+			}
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.KemCiphertext = append(m.KemCiphertext[:0], dAtA[iNdEx:postIndex]...)
+			if m.KemCiphertext == nil {
+				m.KemCiphertext = []byte{}
+			}
+			iNdEx = postIndex
+		case 16:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field TrustedCAs", wireType)
+			}
+			var stringLen uint64
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowNebula
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				stringLen |= uint64(b&0x7F) << shift
 				if b < 0x80 {
 					break
 				}
 			}
+			intStringLen := int(stringLen)
+			if intStringLen < 0 {
+				return ErrInvalidLengthNebula
+			}
+			postIndex := iNdEx + intStringLen
+			if postIndex < 0 {
+				return ErrInvalidLengthNebula
+			}
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.TrustedCAs = append(m.TrustedCAs, string(dAtA[iNdEx:postIndex]))
+			iNdEx = postIndex
 		default:
 			iNdEx = preIndex
 			skippy, err := skipNebula(dAtA[iNdEx:])
@@ -2256,6 +3666,78 @@ func (m *NebulaControl) Unmarshal(dAtA []byte) error {
 					break
 				}
 			}
+		case 6:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field RelayToAddr", wireType)
+			}
+			var msglen int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowNebula
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				msglen |= int(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			if msglen < 0 {
+				return ErrInvalidLengthNebula
+			}
+			postIndex := iNdEx + msglen
+			if postIndex < 0 {
+				return ErrInvalidLengthNebula
+			}
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			if m.RelayToAddr == nil {
+				m.RelayToAddr = &Addr{}
+			}
+			if err := m.RelayToAddr.Unmarshal(dAtA[iNdEx:postIndex]); err != nil {
+				return err
+			}
+			iNdEx = postIndex
+		case 7:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field RelayFromAddr", wireType)
+			}
+			var msglen int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowNebula
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				msglen |= int(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			if msglen < 0 {
+				return ErrInvalidLengthNebula
+			}
+			postIndex := iNdEx + msglen
+			if postIndex < 0 {
+				return ErrInvalidLengthNebula
+			}
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			if m.RelayFromAddr == nil {
+				m.RelayFromAddr = &Addr{}
+			}
+			if err := m.RelayFromAddr.Unmarshal(dAtA[iNdEx:postIndex]); err != nil {
+				return err
+			}
+			iNdEx = postIndex
 		default:
 			iNdEx = preIndex
 			skippy, err := skipNebula(dAtA[iNdEx:])
@@ -2,27 +2,43 @@ package nebula
 
 import (
 	"crypto/cipher"
-	"encoding/binary"
 	"errors"
 
 	"github.com/flynn/noise"
+	"github.com/slackhq/nebula/aesgcm"
 )
 
 type endianness interface {
 	PutUint64(b []byte, v uint64)
 }
 
-var noiseEndianness endianness = binary.BigEndian
-
 type NebulaCipherState struct {
 	c noise.Cipher
+	// aead is c asserted once instead of for every packet
+	aead cipher.AEAD
+	// endianness of the counter in the nonce, it depends on the cipher so tunnels with different ciphers can coexist
+	endianness endianness
+	// mb is the same key for aesgcm when this is an aes tunnel and the cpu can seal several packets at once, see
+	// sealQueue
+	mb *aesgcm.Key
 	//k [32]byte
 	//n uint64
 }
 
-func NewNebulaCipherState(s *noise.CipherState) *NebulaCipherState {
-	return &NebulaCipherState{c: s.Cipher()}
+func NewNebulaCipherState(c noise.Cipher, e endianness) *NebulaCipherState {
+	aead, _ := c.(cipher.AEAD)
+	return &NebulaCipherState{c: c, aead: aead, endianness: e}
+
+}
 
+// newNebulaCipherStateFromKey is NewNebulaCipherState for tc with the key k, aes tunnels also get k for aesgcm
+func newNebulaCipherStateFromKey(tc tunnelCipher, k [32]byte) *NebulaCipherState {
+	s := NewNebulaCipherState(tc.noise.Cipher(k), tc.endianness)
+	if tc.multiBuffer && aesgcm.Available() && !boringEnabled() {
+		// aesgcm can not fail with a 32 byte key
+		s.mb, _ = aesgcm.NewKey(k[:])
+	}
+	return s
 }
 
 // EncryptDanger encrypts and authenticates a given payload.
@@ -45,8 +61,8 @@ func (s *NebulaCipherState) EncryptDanger(out, ad, plaintext []byte, n uint64, n
 		nb[1] = 0
 		nb[2] = 0
 		nb[3] = 0
-		noiseEndianness.PutUint64(nb[4:], n)
-		out = s.c.(cipher.AEAD).Seal(out, nb, plaintext, ad)
+		s.endianness.PutUint64(nb[4:], n)
+		out = s.aead.Seal(out, nb, plaintext, ad)
 		//l.Debugf("Encryption: outlen: %d, nonce: %d, ad: %s, plainlen %d", len(out), n, ad, len(plaintext))
 		return out, nil
 	} else {
@@ -60,8 +76,8 @@ func (s *NebulaCipherState) DecryptDanger(out, ad, ciphertext []byte, n uint64,
 		nb[1] = 0
 		nb[2] = 0
 		nb[3] = 0
-		noiseEndianness.PutUint64(nb[4:], n)
-		return s.c.(cipher.AEAD).Open(out, nb, ciphertext, ad)
+		s.endianness.PutUint64(nb[4:], n)
+		return s.aead.Open(out, nb, ciphertext, ad)
 	} else {
 		return []byte{}, nil
 	}
@@ -69,7 +85,7 @@ func (s *NebulaCipherState) DecryptDanger(out, ad, ciphertext []byte, n uint64,
 
 func (s *NebulaCipherState) Overhead() int {
 	if s != nil {
-		return s.c.(cipher.AEAD).Overhead()
+		return s.aead.Overhead()
 	}
 	return 0
 }
@@ -0,0 +1,28 @@
+package noiseutil
+
+import (
+	"crypto/ecdh"
+
+	"github.com/flynn/noise"
+	"github.com/slackhq/nebula/tpmclient"
+)
+
+// NewDHP256TPM returns DHP256 with the static private key held in the TPM behind client. The static private key passed
+// to DH is the tpm url of the key, see tpmclient, ephemeral keys are still generated and used in memory. The client is
+// opened once when the key is loaded and shared by every handshake, so it must serialize calls, see tpmclient.Locked.
+func NewDHP256TPM(client tpmclient.Client) noise.DHFunc {
+	return tpmCurve{nistCurve: newNISTCurve("P256", ecdh.P256(), 32), client: client}
+}
+
+type tpmCurve struct {
+	nistCurve
+	client tpmclient.Client
+}
+
+func (c tpmCurve) DH(privkey, pubkey []byte) ([]byte, error) {
+	if !tpmclient.IsURL(string(privkey)) {
+		return c.nistCurve.DH(privkey, pubkey)
+	}
+
+	return c.client.DeriveNoise(pubkey)
+}
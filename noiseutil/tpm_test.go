@@ -0,0 +1,56 @@
+package noiseutil
+
+import (
+	"crypto/ecdh"
+	"testing"
+
+	"github.com/slackhq/nebula/tpmclient"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// softClient derives with an in memory key and counts how often it is used
+type softClient struct {
+	tpmclient.Client
+	key     *ecdh.PrivateKey
+	derives int
+}
+
+func (c *softClient) DeriveNoise(peerPubKey []byte) ([]byte, error) {
+	c.derives++
+	peer, err := ecdh.P256().NewPublicKey(peerPubKey)
+	if err != nil {
+		return nil, err
+	}
+	return c.key.ECDH(peer)
+}
+
+func TestDHP256TPM(t *testing.T) {
+	a, err := DHP256.GenerateKeypair(nil)
+	require.NoError(t, err)
+	key, err := ecdh.P256().NewPrivateKey(a.Private)
+	require.NoError(t, err)
+	client := &softClient{key: key}
+	dh := NewDHP256TPM(client)
+
+	b, err := dh.GenerateKeypair(nil)
+	require.NoError(t, err)
+
+	// Keys that are not tpm urls, like the ephemeral keys, are used in memory
+	expected, err := DHP256.DH(a.Private, b.Public)
+	require.NoError(t, err)
+	z, err := dh.DH(a.Private, b.Public)
+	require.NoError(t, err)
+	assert.Equal(t, expected, z)
+	assert.Equal(t, 0, client.derives)
+	assert.Equal(t, DHP256.DHLen(), dh.DHLen())
+	assert.Equal(t, DHP256.DHName(), dh.DHName())
+
+	// The static key goes to the client that was opened when the key loaded
+	for i := 0; i < 2; i++ {
+		z, err = dh.DH([]byte("tpm:?handle=0x81000010"), b.Public)
+		require.NoError(t, err)
+		assert.Equal(t, expected, z)
+	}
+	assert.Equal(t, 2, client.derives)
+}
@@ -14,14 +14,26 @@ import (
 	"github.com/slackhq/nebula/iputil"
 	"github.com/slackhq/nebula/udp"
 	"golang.org/x/net/ipv4"
-	"google.golang.org/protobuf/proto"
+	"golang.org/x/net/ipv6"
 )
 
 const (
 	minFwPacketLen = 4
+	// minICMPPacketLen is the type and code
+	minICMPPacketLen = 2
 )
 
-func readOutsidePackets(f *Interface) udp.EncReader {
+// The ipv6 extension headers newPacket steps over to find the upper layer protocol
+const (
+	ipv6HopByHop           = 0
+	ipv6Routing            = 43
+	ipv6Fragment           = 44
+	ipv6Authentication     = 51
+	ipv6DestinationOptions = 60
+)
+
+// readOutsidePackets returns the reader of a udp read loop, hosts is the loop's cache of the hostmap if it has one
+func readOutsidePackets(f *Interface, hosts *routineHosts) udp.EncReader {
 	return func(
 		addr *udp.Addr,
 		out []byte,
@@ -33,31 +45,39 @@ func readOutsidePackets(f *Interface) udp.EncReader {
 		q int,
 		localCache firewall.ConntrackCache,
 	) {
-		f.readOutsidePackets(addr, nil, out, packet, header, fwPacket, lhh, nb, q, localCache)
+		f.perf.outsideHigh.Observe(int64(len(packet)))
+		f.readOutsidePackets(addr, nil, out, packet, header, fwPacket, lhh, nb, q, hosts, localCache)
 	}
 }
 
-func (f *Interface) readOutsidePackets(addr *udp.Addr, via *ViaSender, out []byte, packet []byte, h *header.H, fwPacket *firewall.Packet, lhf udp.LightHouseHandlerFunc, nb []byte, q int, localCache firewall.ConntrackCache) {
+func (f *Interface) readOutsidePackets(addr *udp.Addr, via *ViaSender, out []byte, packet []byte, h *header.H, fwPacket *firewall.Packet, lhf udp.LightHouseHandlerFunc, nb []byte, q int, hosts *routineHosts, localCache firewall.ConntrackCache) {
+	if via == nil {
+		f.captures.outer(captureIn, packet, addr)
+	}
+
 	err := h.Parse(packet)
 	if err != nil {
 		// TODO: best if we return this and let caller log
 		// TODO: Might be better to send the literal []byte("holepunch") packet and ignore that?
 		// Hole punch packets are 0 or 1 byte big, so lets ignore printing those errors
 		if len(packet) > 1 {
-			f.l.WithField("packet", packet).Infof("Error while parsing inbound packet from %s: %s", addr, err)
+			f.l.WithField("packet", packet).WithField("udpAddr", addr).WithError(err).Info("Error while parsing inbound packet")
 		}
 		return
 	}
 
+	// A stun answer is not a nebula packet, it arrives here because we asked from our socket
+	if h.Version != header.Version && f.stun != nil && f.stun.handle(addr, packet) {
+		return
+	}
+
 	//l.Error("in packet ", header, packet[HeaderLen:])
 	if addr != nil {
-		if ip4 := addr.IP.To4(); ip4 != nil {
-			if ipMaskContains(f.lightHouse.myVpnIp, f.lightHouse.myVpnZeros, iputil.VpnIp(binary.BigEndian.Uint32(ip4))) {
-				if f.l.Level >= logrus.DebugLevel {
-					f.l.WithField("udpAddr", addr).Debug("Refusing to process double encrypted packet")
-				}
-				return
+		if f.lightHouse.inVpnNets(iputil.Ip2VpnIp(addr.IP)) {
+			if f.l.Level >= logrus.DebugLevel {
+				f.l.WithField("udpAddr", addr).Debug("Refusing to process double encrypted packet")
 			}
+			return
 		}
 	}
 
@@ -65,6 +85,8 @@ func (f *Interface) readOutsidePackets(addr *udp.Addr, via *ViaSender, out []byt
 	// verify if we've seen this index before, otherwise respond to the handshake initiation
 	if h.Type == header.Message && h.Subtype == header.MessageRelay {
 		hostinfo = f.hostMap.QueryRelayIndex(h.RemoteIndex)
+	} else if hosts != nil {
+		hostinfo = hosts.QueryIndex(h.RemoteIndex)
 	} else {
 		hostinfo = f.hostMap.QueryIndex(h.RemoteIndex)
 	}
@@ -118,7 +140,7 @@ func (f *Interface) readOutsidePackets(addr *udp.Addr, via *ViaSender, out []byt
 			case TerminalType:
 				// If I am the target of this relay, process the unwrapped packet
 				// From this recursive point, all these variables are 'burned'. We shouldn't rely on them again.
-				f.readOutsidePackets(nil, &ViaSender{relayHI: hostinfo, remoteIdx: relay.RemoteIndex, relay: relay}, out[:0], signedPayload, h, fwPacket, lhf, nb, q, localCache)
+				f.readOutsidePackets(nil, &ViaSender{relayHI: hostinfo, remoteIdx: relay.RemoteIndex, relay: relay}, out[:0], signedPayload, h, fwPacket, lhf, nb, q, hosts, localCache)
 				return
 			case ForwardingType:
 				// Find the target HostInfo relay object
@@ -132,6 +154,9 @@ func (f *Interface) readOutsidePackets(addr *udp.Addr, via *ViaSender, out []byt
 				if targetRelay.State == Established {
 					switch targetRelay.Type {
 					case ForwardingType:
+						if !f.relayManager.accounting.forward(hostinfo.vpnIp, relay.PeerIp, len(signedPayload)) {
+							return
+						}
 						// Forward this packet through the relay tunnel
 						// Find the target HostInfo
 						f.SendVia(targetHI, targetRelay, signedPayload, nb, out, false)
@@ -189,6 +214,14 @@ func (f *Interface) readOutsidePackets(addr *udp.Addr, via *ViaSender, out []byt
 			// to the new IP address before responding
 			f.handleHostRoaming(hostinfo, addr)
 			f.send(header.Test, header.TestReply, ci, hostinfo, d, nb, out)
+		} else if h.Subtype == header.TestReply {
+			if !f.handlePathProbeReply(hostinfo, d) {
+				hostinfo.rtt.acked(time.Now())
+			}
+		} else if h.Subtype == header.TestDiagRequest {
+			f.handleDiagRequest(hostinfo, ci, d, nb, out)
+		} else if h.Subtype == header.TestDiagReply {
+			f.handleDiagReply(hostinfo, d)
 		}
 
 		// Fallthrough to the bottom to record incoming traffic
@@ -215,7 +248,7 @@ func (f *Interface) readOutsidePackets(addr *udp.Addr, via *ViaSender, out []byt
 		hostinfo.logger(f.l).WithField("udpAddr", addr).
 			Info("Close tunnel received, tearing down.")
 
-		f.closeTunnel(hostinfo)
+		f.closeTunnel(hostinfo, "closed by the remote")
 		return
 
 	case header.Control:
@@ -241,7 +274,7 @@ func (f *Interface) readOutsidePackets(addr *udp.Addr, via *ViaSender, out []byt
 
 	default:
 		f.messageMetrics.Rx(h.Type, h.Subtype, 1)
-		hostinfo.logger(f.l).Debugf("Unexpected packet received from %s", addr)
+		hostinfo.logger(f.l).WithField("udpAddr", addr).Debug("Unexpected packet received")
 		return
 	}
 
@@ -251,7 +284,8 @@ func (f *Interface) readOutsidePackets(addr *udp.Addr, via *ViaSender, out []byt
 }
 
 // closeTunnel closes a tunnel locally, it does not send a closeTunnel packet to the remote
-func (f *Interface) closeTunnel(hostInfo *HostInfo) {
+func (f *Interface) closeTunnel(hostInfo *HostInfo, reason string) {
+	f.events.emit(hostEvent(TunnelEventTunnelClosed, hostInfo, reason))
 	final := f.hostMap.DeleteHostInfo(hostInfo)
 	if final {
 		// We no longer have any tunnels with this vpn ip, clear learned lighthouse state to lower memory usage
@@ -309,11 +343,17 @@ func newPacket(data []byte, incoming bool, fp *firewall.Packet) error {
 		return fmt.Errorf("packet is less than %v bytes", ipv4.HeaderLen)
 	}
 
-	// Is it an ipv4 packet?
-	if int((data[0]>>4)&0x0f) != 4 {
-		return fmt.Errorf("packet is not ipv4, type: %v", int((data[0]>>4)&0x0f))
+	switch int((data[0] >> 4) & 0x0f) {
+	case ipv4.Version:
+		return newPacket4(data, incoming, fp)
+	case ipv6.Version:
+		return newPacket6(data, incoming, fp)
 	}
 
+	return fmt.Errorf("packet is not ipv4 or ipv6, type: %v", int((data[0]>>4)&0x0f))
+}
+
+func newPacket4(data []byte, incoming bool, fp *firewall.Packet) error {
 	// Adjust our start position based on the advertised ip header length
 	ihl := int(data[0]&0x0f) << 2
 
@@ -329,20 +369,86 @@ func newPacket(data []byte, incoming bool, fp *firewall.Packet) error {
 	// Firewall handles protocol checks
 	fp.Protocol = data[9]
 
+	return newPacketL4(data, ihl, data[12:16], data[16:20], incoming, fp)
+}
+
+func newPacket6(data []byte, incoming bool, fp *firewall.Packet) error {
+	if len(data) < ipv6.HeaderLen {
+		return fmt.Errorf("packet is less than %v bytes", ipv6.HeaderLen)
+	}
+
+	proto, off, fragment, err := ipv6L4(data)
+	if err != nil {
+		return err
+	}
+
+	fp.Fragment = fragment
+	fp.Protocol = proto
+
+	return newPacketL4(data, off, data[8:24], data[24:40], incoming, fp)
+}
+
+// ipv6L4 walks the ipv6 extension headers to the upper layer protocol, returning it and its offset in data. fragment
+// is true for the second or further fragment of a fragmented packet, those have no upper layer header.
+func ipv6L4(data []byte) (proto uint8, off int, fragment bool, err error) {
+	proto = data[6]
+	off = ipv6.HeaderLen
+	for {
+		switch proto {
+		case ipv6HopByHop, ipv6Routing, ipv6DestinationOptions, ipv6Authentication:
+			if len(data) < off+2 {
+				return 0, 0, false, fmt.Errorf("packet is less than %v bytes, ipv6 extension header at: %v", off+2, off)
+			}
+			l := (int(data[off+1]) + 1) << 3
+			if proto == ipv6Authentication {
+				l = (int(data[off+1]) + 2) << 2
+			}
+			proto = data[off]
+			off += l
+
+		case ipv6Fragment:
+			if len(data) < off+8 {
+				return 0, 0, false, fmt.Errorf("packet is less than %v bytes, ipv6 fragment header at: %v", off+8, off)
+			}
+			fragment = fragment || binary.BigEndian.Uint16(data[off+2:off+4])&0xfff8 != 0
+			proto = data[off]
+			off += 8
+
+		default:
+			return proto, off, fragment, nil
+		}
+	}
+}
+
+// newPacketL4 fills in the addresses and the ports, or icmp type and code, of a packet whose ip header is ihl long
+func newPacketL4(data []byte, ihl int, src, dst []byte, incoming bool, fp *firewall.Packet) error {
 	// Accounting for a variable header length, do we have enough data for our src/dst tuples?
 	minLen := ihl
-	if !fp.Fragment && fp.Protocol != firewall.ProtoICMP {
-		minLen += minFwPacketLen
+	if !fp.Fragment {
+		if fp.IsICMP() {
+			minLen += minICMPPacketLen
+		} else {
+			minLen += minFwPacketLen
+		}
 	}
 	if len(data) < minLen {
 		return fmt.Errorf("packet is less than %v bytes, ip header len: %v", minLen, ihl)
 	}
 
+	// ICMP has no ports, the type and code are matched instead
+	if fp.IsICMP() && !fp.Fragment {
+		fp.ICMPType = data[ihl]
+		fp.ICMPCode = data[ihl+1]
+	} else {
+		fp.ICMPType = 0
+		fp.ICMPCode = 0
+	}
+
 	// Firewall packets are locally oriented
 	if incoming {
-		fp.RemoteIP = iputil.Ip2VpnIp(data[12:16])
-		fp.LocalIP = iputil.Ip2VpnIp(data[16:20])
-		if fp.Fragment || fp.Protocol == firewall.ProtoICMP {
+		fp.RemoteIP = iputil.Ip2VpnIp(src)
+		fp.LocalIP = iputil.Ip2VpnIp(dst)
+		if fp.Fragment || fp.IsICMP() {
 			fp.RemotePort = 0
 			fp.LocalPort = 0
 		} else {
@@ -350,9 +456,9 @@ func newPacket(data []byte, incoming bool, fp *firewall.Packet) error {
 			fp.LocalPort = binary.BigEndian.Uint16(data[ihl+2 : ihl+4])
 		}
 	} else {
-		fp.LocalIP = iputil.Ip2VpnIp(data[12:16])
-		fp.RemoteIP = iputil.Ip2VpnIp(data[16:20])
-		if fp.Fragment || fp.Protocol == firewall.ProtoICMP {
+		fp.LocalIP = iputil.Ip2VpnIp(src)
+		fp.RemoteIP = iputil.Ip2VpnIp(dst)
+		if fp.Fragment || fp.IsICMP() {
 			fp.RemotePort = 0
 			fp.LocalPort = 0
 		} else {
@@ -376,6 +482,8 @@ func (f *Interface) decrypt(hostinfo *HostInfo, mc uint64, out []byte, packet []
 			Debugln("dropping out of window packet")
 		return nil, errors.New("out of window packet")
 	}
+	hostinfo.ConnectionState.messagesIn.Add(1)
+	hostinfo.ConnectionState.bytesIn.Add(uint64(len(packet)))
 
 	return out, nil
 }
@@ -383,13 +491,20 @@ func (f *Interface) decrypt(hostinfo *HostInfo, mc uint64, out []byte, packet []
 func (f *Interface) decryptToTun(hostinfo *HostInfo, messageCounter uint64, out []byte, packet []byte, fwPacket *firewall.Packet, nb []byte, q int, localCache firewall.ConntrackCache) bool {
 	var err error
 
+	span := f.tracer.samplePacket("packet.inbound", hostinfo, len(packet))
+	if span != nil {
+		defer span.end()
+	}
+
 	out, err = hostinfo.ConnectionState.dKey.DecryptDanger(out, packet[:header.Len], packet[header.Len:], messageCounter, nb)
 	if err != nil {
 		hostinfo.logger(f.l).WithError(err).Error("Failed to decrypt packet")
 		//TODO: maybe after build 64 is out? 06/14/2018 - NB
 		//f.sendRecvError(hostinfo.remote, header.RemoteIndex)
+		span.fail("failed to decrypt")
 		return false
 	}
+	span.event("decrypted")
 
 	err = newPacket(out, true, fwPacket)
 	if err != nil {
@@ -403,9 +518,19 @@ func (f *Interface) decryptToTun(hostinfo *HostInfo, messageCounter uint64, out
 			Debugln("dropping out of window packet")
 		return false
 	}
+	hostinfo.ConnectionState.messagesIn.Add(1)
+	hostinfo.ConnectionState.bytesIn.Add(uint64(len(packet)))
+	f.captures.inner(captureIn, out, fwPacket)
 
-	dropReason := f.firewall.Drop(*fwPacket, true, hostinfo, f.pki.GetCAPool(), localCache)
+	if len(f.bridges) > 0 && f.bridge(hostinfo, *fwPacket, out) {
+		f.connectionManager.In(hostinfo.localIndexId)
+		return true
+	}
+
+	dropReason := f.firewall.Drop(*fwPacket, true, hostinfo, f.pki.GetCAPool(), localCache, out)
+	span.event("firewall")
 	if dropReason != nil {
+		span.fail(dropReason.Error())
 		// NOTE: We give `packet` as the `out` here since we already decrypted from it and we don't need it anymore
 		// This gives us a buffer to build the reject packet in
 		f.rejectOutside(out, hostinfo.ConnectionState, hostinfo, nb, packet, q)
@@ -417,11 +542,17 @@ func (f *Interface) decryptToTun(hostinfo *HostInfo, messageCounter uint64, out
 		return false
 	}
 
+	if f.pmtud != nil {
+		f.clampInboundMSS(hostinfo, out)
+	}
+
 	f.connectionManager.In(hostinfo.localIndexId)
 	_, err = f.readers[q].Write(out)
 	if err != nil {
 		f.l.WithError(err).Error("Failed to write to tun")
+		span.fail("failed to write to tun")
 	}
+	span.event("written")
 	return true
 }
 
@@ -462,11 +593,11 @@ func (f *Interface) handleRecvError(addr *udp.Addr, h *header.H) {
 	}
 
 	if hostinfo.remote != nil && !hostinfo.remote.Equals(addr) {
-		f.l.Infoln("Someone spoofing recv_errors? ", addr, hostinfo.remote)
+		f.l.WithField("udpAddr", addr).WithField("remote", hostinfo.remote).Info("Someone spoofing recv_errors?")
 		return
 	}
 
-	f.closeTunnel(hostinfo)
+	f.closeTunnel(hostinfo, "remote reported recv errors")
 	// We also delete it from pending hostmap to allow for fast reconnect.
 	f.handshakeManager.DeleteHostInfo(hostinfo)
 }
@@ -494,41 +625,10 @@ func (f *Interface) sendMeta(ci *ConnectionState, endpoint *net.UDPAddr, meta *N
 */
 
 func RecombineCertAndValidate(h *noise.HandshakeState, rawCertBytes []byte, caPool *cert.NebulaCAPool) (*cert.NebulaCertificate, error) {
-	pk := h.PeerStatic()
-
-	if pk == nil {
-		return nil, errors.New("no peer static key was present")
-	}
-
-	if rawCertBytes == nil {
-		return nil, errors.New("provided payload was empty")
-	}
-
-	r := &cert.RawNebulaCertificate{}
-	err := proto.Unmarshal(rawCertBytes, r)
-	if err != nil {
-		return nil, fmt.Errorf("error unmarshaling cert: %s", err)
-	}
-
-	// If the Details are nil, just exit to avoid crashing
-	if r.Details == nil {
-		return nil, fmt.Errorf("certificate did not contain any details")
-	}
-
-	r.Details.PublicKey = pk
-	recombined, err := proto.Marshal(r)
-	if err != nil {
-		return nil, fmt.Errorf("error while recombining certificate: %s", err)
-	}
-
-	c, _ := cert.UnmarshalNebulaCertificate(recombined)
-	isValid, err := c.Verify(time.Now(), caPool)
-	if err != nil {
-		return c, fmt.Errorf("certificate validation failed: %s", err)
-	} else if !isValid {
-		// This case should never happen but here's to defensive programming!
-		return c, errors.New("certificate validation failed but did not return an error")
+	hc, err := cert.VerifyHandshakeCertificate(rawCertBytes, h.PeerStatic(), caPool, time.Now())
+	if hc == nil {
+		return nil, err
 	}
 
-	return c, nil
+	return hc.Certificate, err
 }
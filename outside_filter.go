@@ -0,0 +1,140 @@
+package nebula
+
+import (
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/header"
+	"golang.org/x/net/bpf"
+)
+
+// Everything sent to our port wakes a reader and is parsed in userspace before we know it is garbage. With
+// listen.bpf.early_drop a classic bpf program attached to the udp sockets has the kernel drop datagrams that can not be
+// nebula before they are queued to us, only packets with a nebula header of a known type and stun answers get through.
+// Tunnels, handshakes and everything else still take the userspace path.
+//
+// With more than one routine the sockets share the port with SO_REUSEPORT and the kernel hashes each datagram to one of
+// them. listen.bpf.cpu_steering instead sends a datagram to the socket of the routine numbered after the cpu that
+// received it, so the nic's receive queues, and the flows hashed to them, stay on the same routine.
+
+// udpHeaderLen is where the payload starts for a socket filter on a udp socket
+const udpHeaderLen = 8
+
+// filterConn is a udp listener that can have classic bpf programs attached
+type filterConn interface {
+	SetFilter(prog []bpf.RawInstruction) error
+	SetReusePortSteering(prog []bpf.RawInstruction) error
+}
+
+// outsideFilter returns the program that keeps nebula packets and stun answers and drops everything else
+func outsideFilter() ([]bpf.RawInstruction, error) {
+	const (
+		keep = 0xffffffff
+		drop = 0
+	)
+
+	return bpf.Assemble([]bpf.Instruction{
+		// 0: Anything shorter than a nebula header is a hole punch at best
+		bpf.LoadExtension{Num: bpf.ExtLen},
+		bpf.JumpIf{Cond: bpf.JumpLessThan, Val: udpHeaderLen + header.Len, SkipTrue: 12},
+
+		// 2: The version is the high nibble of the first byte
+		bpf.LoadAbsolute{Off: udpHeaderLen, Size: 1},
+		bpf.ALUOpConstant{Op: bpf.ALUOpShiftRight, Val: 4},
+		bpf.JumpIf{Cond: bpf.JumpEqual, Val: uint32(header.Version), SkipFalse: 3},
+
+		// 5: Nebula, the type is the low nibble
+		bpf.LoadAbsolute{Off: udpHeaderLen, Size: 1},
+		bpf.ALUOpConstant{Op: bpf.ALUOpAnd, Val: 0x0f},
+		bpf.JumpIf{Cond: bpf.JumpGreaterThan, Val: uint32(header.Control), SkipTrue: 6, SkipFalse: 5},
+
+		// 8: A stun message starts with two zero bits and has the magic cookie after the type and length
+		bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0, SkipFalse: 5},
+		bpf.LoadExtension{Num: bpf.ExtLen},
+		bpf.JumpIf{Cond: bpf.JumpLessThan, Val: udpHeaderLen + stunHeaderLen, SkipTrue: 3},
+		bpf.LoadAbsolute{Off: udpHeaderLen + 4, Size: 4},
+		bpf.JumpIf{Cond: bpf.JumpEqual, Val: stunMagicCookie, SkipFalse: 1},
+
+		// 13
+		bpf.RetConstant{Val: keep},
+		// 14
+		bpf.RetConstant{Val: drop},
+	})
+}
+
+// cpuSteering returns the program that picks the socket of the SO_REUSEPORT group for the receiving cpu
+func cpuSteering(sockets int) ([]bpf.RawInstruction, error) {
+	return bpf.Assemble([]bpf.Instruction{
+		bpf.LoadExtension{Num: bpf.ExtCPUID},
+		bpf.ALUOpConstant{Op: bpf.ALUOpMod, Val: uint32(sockets)},
+		bpf.RetA{},
+	})
+}
+
+func (f *Interface) reloadOutsideFilter(c *config.C) {
+	f.applyOutsideFilter(c, c.InitialLoad())
+}
+
+// applyOutsideFilter attaches the programs to the udp sockets, with initial set they are attached even if the config did
+// not change as the sockets are new
+func (f *Interface) applyOutsideFilter(c *config.C, initial bool) {
+	if initial || c.HasChanged("listen.bpf.early_drop") {
+		var prog []bpf.RawInstruction
+		earlyDrop := c.GetBool("listen.bpf.early_drop", false)
+		if earlyDrop {
+			var err error
+			prog, err = outsideFilter()
+			if err != nil {
+				f.l.WithError(err).Error("Failed to assemble listen.bpf.early_drop filter")
+				return
+			}
+		}
+
+		if f.setOutsideFilters(func(fc filterConn) error { return fc.SetFilter(prog) }) {
+			if earlyDrop || !initial {
+				f.l.WithField("earlyDrop", earlyDrop).Info("listen.bpf.early_drop set")
+			}
+		} else if earlyDrop {
+			f.l.Warn("listen.bpf.early_drop is not supported on this platform")
+		}
+	}
+
+	// The sockets join the reuseport group once, the program is only attached at start
+	if initial && c.GetBool("listen.bpf.cpu_steering", false) {
+		if len(f.writers) < 2 {
+			f.l.Warn("listen.bpf.cpu_steering needs more than one routine, ignoring it")
+			return
+		}
+
+		prog, err := cpuSteering(len(f.writers))
+		if err != nil {
+			f.l.WithError(err).Error("Failed to assemble listen.bpf.cpu_steering program")
+			return
+		}
+
+		fc, ok := unwrapConn(f.writers[0]).(filterConn)
+		if !ok {
+			f.l.Warn("listen.bpf.cpu_steering is not supported on this platform")
+			return
+		}
+
+		if err := fc.SetReusePortSteering(prog); err != nil {
+			f.l.WithError(err).Error("Failed to attach listen.bpf.cpu_steering program")
+			return
+		}
+		f.l.WithField("routines", len(f.writers)).Info("Steering received packets to routines by cpu")
+	}
+}
+
+// setOutsideFilters calls set for every udp listener, it returns false if they do not support filters
+func (f *Interface) setOutsideFilters(set func(filterConn) error) bool {
+	for i, w := range f.writers {
+		fc, ok := unwrapConn(w).(filterConn)
+		if !ok {
+			return false
+		}
+
+		if err := set(fc); err != nil {
+			f.l.WithError(err).WithField("queue", i).Error("Failed to set udp listener filter")
+		}
+	}
+	return true
+}
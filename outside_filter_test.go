@@ -0,0 +1,52 @@
+package nebula
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"github.com/slackhq/nebula/header"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/bpf"
+)
+
+func TestOutsideFilter(t *testing.T) {
+	prog, err := outsideFilter()
+	require.NoError(t, err)
+
+	insts, ok := bpf.Disassemble(prog)
+	require.True(t, ok)
+	vm, err := bpf.NewVM(insts)
+	require.NoError(t, err)
+
+	// The filter sees the udp header before the payload
+	kept := func(payload []byte) bool {
+		n, err := vm.Run(append(make([]byte, udpHeaderLen), payload...))
+		require.NoError(t, err)
+		return n > 0
+	}
+
+	for _, typ := range []header.MessageType{header.Handshake, header.Message, header.LightHouse, header.Control} {
+		assert.True(t, kept(header.Encode(make([]byte, header.Len), header.Version, typ, 0, 1, 2)), typ)
+	}
+
+	assert.False(t, kept(nil), "empty hole punch")
+	assert.False(t, kept([]byte{1}), "hole punch")
+	assert.False(t, kept(header.Encode(make([]byte, header.Len), header.Version, header.Control+1, 0, 1, 2)), "unknown type")
+	assert.False(t, kept(header.Encode(make([]byte, header.Len), 2, header.Message, 0, 1, 2)), "unknown version")
+	assert.False(t, kept(make([]byte, 64)), "zeros")
+
+	stun := make([]byte, stunHeaderLen)
+	binary.BigEndian.PutUint16(stun[0:2], 0x0101)
+	binary.BigEndian.PutUint32(stun[4:8], stunMagicCookie)
+	assert.True(t, kept(stun), "stun")
+	assert.False(t, kept(stun[:header.Len+2]), "short stun")
+	stun[4] = 0
+	assert.False(t, kept(stun), "stun without the cookie")
+}
+
+func TestCpuSteering(t *testing.T) {
+	prog, err := cpuSteering(4)
+	require.NoError(t, err)
+	assert.Len(t, prog, 3)
+}
@@ -8,6 +8,7 @@ import (
 	"github.com/slackhq/nebula/iputil"
 	"github.com/stretchr/testify/assert"
 	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
 )
 
 func Test_newPacket(t *testing.T) {
@@ -31,9 +32,9 @@ func Test_newPacket(t *testing.T) {
 
 	assert.EqualError(t, err, "packet is less than 28 bytes, ip header len: 24")
 
-	// not an ipv4 packet
+	// not an ipv4 or ipv6 packet
 	err = newPacket([]byte{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}, true, p)
-	assert.EqualError(t, err, "packet is not ipv4, type: 0")
+	assert.EqualError(t, err, "packet is not ipv4 or ipv6, type: 0")
 
 	// invalid ihl
 	err = newPacket([]byte{4<<4 | (8 >> 2 & 0x0f), 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}, true, p)
@@ -80,4 +81,95 @@ func Test_newPacket(t *testing.T) {
 	assert.Equal(t, p.RemoteIP, iputil.Ip2VpnIp(net.IPv4(10, 0, 0, 2)))
 	assert.Equal(t, p.RemotePort, uint16(6))
 	assert.Equal(t, p.LocalPort, uint16(5))
+
+	// icmp needs a type and code
+	h = ipv4.Header{
+		Version:  1,
+		Protocol: firewall.ProtoICMP,
+		Len:      20,
+		Src:      net.IPv4(10, 0, 0, 1),
+		Dst:      net.IPv4(10, 0, 0, 2),
+	}
+
+	b, _ = h.Marshal()
+	err = newPacket(append(b, 3), true, p)
+	assert.EqualError(t, err, "packet is less than 22 bytes, ip header len: 20")
+
+	err = newPacket(append(b, 3, 4, 0, 0), true, p)
+	assert.Nil(t, err)
+	assert.Equal(t, uint8(firewall.ProtoICMP), p.Protocol)
+	assert.Equal(t, uint8(3), p.ICMPType)
+	assert.Equal(t, uint8(4), p.ICMPCode)
+	assert.Zero(t, p.LocalPort)
+	assert.Zero(t, p.RemotePort)
+}
+
+func Test_newPacket6(t *testing.T) {
+	p := &firewall.Packet{}
+	src := net.ParseIP("fd00::1")
+	dst := net.ParseIP("fd00::2")
+	hdr := func(next byte) []byte {
+		b := make([]byte, ipv6.HeaderLen)
+		b[0] = 6 << 4
+		b[6] = next
+		copy(b[8:24], src)
+		copy(b[24:40], dst)
+		return b
+	}
+
+	// length fail
+	b := hdr(firewall.ProtoUDP)
+	err := newPacket(b[:30], true, p)
+	assert.EqualError(t, err, "packet is less than 40 bytes")
+
+	err = newPacket(b, true, p)
+	assert.EqualError(t, err, "packet is less than 44 bytes, ip header len: 40")
+
+	// udp
+	err = newPacket(append(b, 0, 3, 0, 4), true, p)
+	assert.Nil(t, err)
+	assert.Equal(t, uint8(firewall.ProtoUDP), p.Protocol)
+	assert.Equal(t, iputil.Ip2VpnIp(src), p.RemoteIP)
+	assert.Equal(t, iputil.Ip2VpnIp(dst), p.LocalIP)
+	assert.Equal(t, uint16(3), p.RemotePort)
+	assert.Equal(t, uint16(4), p.LocalPort)
+	assert.False(t, p.Fragment)
+
+	// tcp after a hop by hop and a destination options header
+	b = hdr(ipv6HopByHop)
+	b = append(b, ipv6DestinationOptions, 0, 0, 0, 0, 0, 0, 0)
+	b = append(b, firewall.ProtoTCP, 1, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0)
+	err = newPacket(append(b, 0, 5, 0, 6), false, p)
+	assert.Nil(t, err)
+	assert.Equal(t, uint8(firewall.ProtoTCP), p.Protocol)
+	assert.Equal(t, iputil.Ip2VpnIp(src), p.LocalIP)
+	assert.Equal(t, iputil.Ip2VpnIp(dst), p.RemoteIP)
+	assert.Equal(t, uint16(5), p.LocalPort)
+	assert.Equal(t, uint16(6), p.RemotePort)
+
+	// truncated extension header
+	err = newPacket(hdr(ipv6Routing), true, p)
+	assert.EqualError(t, err, "packet is less than 42 bytes, ipv6 extension header at: 40")
+
+	// first fragment has ports, later fragments do not
+	b = append(hdr(ipv6Fragment), firewall.ProtoUDP, 0, 0, 1, 0, 0, 0, 1)
+	err = newPacket(append(b, 0, 3, 0, 4), true, p)
+	assert.Nil(t, err)
+	assert.False(t, p.Fragment)
+	assert.Equal(t, uint16(4), p.LocalPort)
+
+	b = append(hdr(ipv6Fragment), firewall.ProtoUDP, 0, 0, 8, 0, 0, 0, 1)
+	err = newPacket(b, true, p)
+	assert.Nil(t, err)
+	assert.True(t, p.Fragment)
+	assert.Zero(t, p.LocalPort)
+	assert.Zero(t, p.RemotePort)
+
+	// icmpv6 keeps its own protocol and types
+	b = append(hdr(firewall.ProtoICMPv6), 2, 0, 0, 0)
+	err = newPacket(b, true, p)
+	assert.Nil(t, err)
+	assert.Equal(t, uint8(firewall.ProtoICMPv6), p.Protocol)
+	assert.Equal(t, uint8(firewall.ICMPv6PacketTooBig), p.ICMPType)
+	assert.Zero(t, p.ICMPCode)
 }
@@ -15,3 +15,12 @@ type Device interface {
 	RouteFor(iputil.VpnIp) iputil.VpnIp
 	NewMultiQueueReader() (io.ReadWriteCloser, error)
 }
+
+// BatchReadWriter is implemented by devices that can move several packets in one call
+type BatchReadWriter interface {
+	// ReadBatch blocks until at least one packet is read, the length of each packet is stored in sizes and the number
+	// of packets read is returned
+	ReadBatch(bufs [][]byte, sizes []int) (int, error)
+	// WriteBatch writes every packet in bufs and returns the number written
+	WriteBatch(bufs [][]byte) (int, error)
+}
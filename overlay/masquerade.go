@@ -0,0 +1,148 @@
+package overlay
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/slackhq/nebula/config"
+)
+
+type MasqueradeTo int
+
+const (
+	// MasqueradeToLan rewrites the source to the address of the interface the traffic leaves through
+	MasqueradeToLan MasqueradeTo = iota
+	// MasqueradeToOverlay rewrites the source to our ipv4 vpn ip
+	MasqueradeToOverlay
+)
+
+func (m MasqueradeTo) String() string {
+	switch m {
+	case MasqueradeToLan:
+		return "lan"
+	case MasqueradeToOverlay:
+		return "overlay"
+	default:
+		return "unknown"
+	}
+}
+
+// Masquerade source NATs traffic that arrives from the overlay for an unsafe network, so hosts on that network reply
+// to the gateway without a return route for every network behind nebula
+type Masquerade struct {
+	Cidr *net.IPNet
+	To   MasqueradeTo
+}
+
+// parseMasquerade reads tun.masquerade, it only covers ipv4 networks outside of the networks in our certificate
+func parseMasquerade(c *config.C, networks []*net.IPNet) ([]Masquerade, error) {
+	r := c.Get("tun.masquerade")
+	if r == nil {
+		return []Masquerade{}, nil
+	}
+
+	rawEntries, ok := r.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("tun.masquerade is not an array")
+	}
+
+	entries := make([]Masquerade, len(rawEntries))
+	for i, r := range rawEntries {
+		m, ok := r.(map[interface{}]interface{})
+		if !ok {
+			return nil, fmt.Errorf("entry %v in tun.masquerade is invalid", i+1)
+		}
+
+		rRoute, ok := m["route"]
+		if !ok {
+			return nil, fmt.Errorf("entry %v.route in tun.masquerade is not present", i+1)
+		}
+
+		_, cidr, err := net.ParseCIDR(fmt.Sprintf("%v", rRoute))
+		if err != nil {
+			return nil, fmt.Errorf("entry %v.route in tun.masquerade failed to parse: %v", i+1, err)
+		}
+
+		if cidr.IP.To4() == nil {
+			return nil, fmt.Errorf("entry %v.route in tun.masquerade is not an ipv4 network: %v", i+1, cidr)
+		}
+
+		if anyIpWithin(networks, cidr) {
+			return nil, fmt.Errorf(
+				"entry %v.route in tun.masquerade is contained within the network attached to the certificate; route: %v, network: %v",
+				i+1,
+				cidr.String(),
+				networksString(networks),
+			)
+		}
+
+		to := MasqueradeToLan
+		if rTo, ok := m["to"]; ok {
+			switch v := strings.ToLower(fmt.Sprintf("%v", rTo)); v {
+			case "lan":
+			case "overlay":
+				if masqueradeOverlayIp(networks) == nil {
+					return nil, fmt.Errorf("entry %v.to in tun.masquerade is overlay but the certificate has no ipv4 network", i+1)
+				}
+				to = MasqueradeToOverlay
+			default:
+				return nil, fmt.Errorf("entry %v.to in tun.masquerade must be one of lan or overlay, found: %s", i+1, v)
+			}
+		}
+
+		entries[i] = Masquerade{Cidr: cidr, To: to}
+	}
+
+	return entries, nil
+}
+
+// masqueradeOverlayIp returns the vpn ip traffic is rewritten to with MasqueradeToOverlay, nil if we have no ipv4 one
+func masqueradeOverlayIp(networks []*net.IPNet) net.IP {
+	for _, n := range networks {
+		if ip := n.IP.To4(); ip != nil {
+			return ip
+		}
+	}
+	return nil
+}
+
+// masqueradeTable is the nftables table holding the masquerade rules for a device
+func masqueradeTable(device string) string {
+	return "nebula_" + strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') {
+			return r
+		}
+		return '_'
+	}, device)
+}
+
+// masqueradeRuleset returns an nft script that replaces the masquerade table for a device with entries, an empty
+// entries only removes the table. Declaring the table first keeps the delete from failing when it does not exist.
+func masqueradeRuleset(device string, networks []*net.IPNet, entries []Masquerade) string {
+	table := masqueradeTable(device)
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "table ip %s\n", table)
+	fmt.Fprintf(&b, "delete table ip %s\n", table)
+	if len(entries) == 0 {
+		return b.String()
+	}
+
+	fmt.Fprintf(&b, "table ip %s {\n", table)
+	b.WriteString("\tchain postrouting {\n")
+	b.WriteString("\t\ttype nat hook postrouting priority 100; policy accept;\n")
+	for _, e := range entries {
+		fmt.Fprintf(&b, "\t\tiifname %q ip daddr %s ", device, e.Cidr)
+		switch e.To {
+		case MasqueradeToOverlay:
+			fmt.Fprintf(&b, "snat to %s\n", masqueradeOverlayIp(networks))
+		default:
+			b.WriteString("masquerade\n")
+		}
+	}
+	b.WriteString("\t}\n")
+	b.WriteString("}\n")
+
+	return b.String()
+}
@@ -0,0 +1,54 @@
+//go:build !android && !e2e_testing
+// +build !android,!e2e_testing
+
+package overlay
+
+import (
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// applyMasquerade replaces the nftables masquerade table for the device with the current tun.masquerade entries
+func (t *tun) applyMasquerade() error {
+	t.masqueradeLock.Lock()
+	defer t.masqueradeLock.Unlock()
+
+	entries := *t.masquerade.Load()
+	if len(entries) == 0 && !t.masqueradeActive {
+		return nil
+	}
+
+	if err := runNft(masqueradeRuleset(t.Device, t.vpnNetworks, entries)); err != nil {
+		return err
+	}
+
+	t.masqueradeActive = len(entries) > 0
+	for _, e := range entries {
+		t.l.WithField("route", e.Cidr).WithField("to", e.To).Info("Masquerading traffic from the overlay")
+	}
+	return nil
+}
+
+// removeMasquerade removes the nftables masquerade table for the device, if we made one
+func (t *tun) removeMasquerade() error {
+	t.masqueradeLock.Lock()
+	defer t.masqueradeLock.Unlock()
+
+	if !t.masqueradeActive {
+		return nil
+	}
+
+	t.masqueradeActive = false
+	return runNft(masqueradeRuleset(t.Device, t.vpnNetworks, nil))
+}
+
+func runNft(script string) error {
+	cmd := exec.Command("nft", "-f", "-")
+	cmd.Stdin = strings.NewReader(script)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("failed to run nft: %w: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
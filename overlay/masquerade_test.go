@@ -0,0 +1,80 @@
+package overlay
+
+import (
+	"net"
+	"testing"
+
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_parseMasquerade(t *testing.T) {
+	l := test.NewLogger()
+	c := config.NewC(l)
+	_, v4, _ := net.ParseCIDR("10.0.0.1/24")
+	_, v6, _ := net.ParseCIDR("fd00::1/64")
+	n := []*net.IPNet{v4}
+
+	entries, err := parseMasquerade(c, n)
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+
+	c.Settings["tun"] = map[interface{}]interface{}{"masquerade": "hi"}
+	_, err = parseMasquerade(c, n)
+	assert.EqualError(t, err, "tun.masquerade is not an array")
+
+	c.Settings["tun"] = map[interface{}]interface{}{"masquerade": []interface{}{map[interface{}]interface{}{}}}
+	_, err = parseMasquerade(c, n)
+	assert.EqualError(t, err, "entry 1.route in tun.masquerade is not present")
+
+	c.Settings["tun"] = map[interface{}]interface{}{"masquerade": []interface{}{map[interface{}]interface{}{"route": "fd01::/64"}}}
+	_, err = parseMasquerade(c, n)
+	assert.EqualError(t, err, "entry 1.route in tun.masquerade is not an ipv4 network: fd01::/64")
+
+	c.Settings["tun"] = map[interface{}]interface{}{"masquerade": []interface{}{map[interface{}]interface{}{"route": "10.0.0.0/25"}}}
+	_, err = parseMasquerade(c, n)
+	assert.EqualError(t, err, "entry 1.route in tun.masquerade is contained within the network attached to the certificate; route: 10.0.0.0/25, network: 10.0.0.0/24")
+
+	c.Settings["tun"] = map[interface{}]interface{}{"masquerade": []interface{}{map[interface{}]interface{}{"route": "192.168.1.0/24", "to": "nowhere"}}}
+	_, err = parseMasquerade(c, n)
+	assert.EqualError(t, err, "entry 1.to in tun.masquerade must be one of lan or overlay, found: nowhere")
+
+	c.Settings["tun"] = map[interface{}]interface{}{"masquerade": []interface{}{map[interface{}]interface{}{"route": "192.168.1.0/24", "to": "overlay"}}}
+	_, err = parseMasquerade(c, []*net.IPNet{v6})
+	assert.EqualError(t, err, "entry 1.to in tun.masquerade is overlay but the certificate has no ipv4 network")
+
+	c.Settings["tun"] = map[interface{}]interface{}{"masquerade": []interface{}{
+		map[interface{}]interface{}{"route": "192.168.1.0/24"},
+		map[interface{}]interface{}{"route": "192.168.2.1/24", "to": "Overlay"},
+	}}
+	entries, err = parseMasquerade(c, n)
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+	assert.Equal(t, "192.168.1.0/24", entries[0].Cidr.String())
+	assert.Equal(t, MasqueradeToLan, entries[0].To)
+	assert.Equal(t, "192.168.2.0/24", entries[1].Cidr.String())
+	assert.Equal(t, MasqueradeToOverlay, entries[1].To)
+}
+
+func Test_masqueradeRuleset(t *testing.T) {
+	_, lan, _ := net.ParseCIDR("192.168.1.0/24")
+	_, site, _ := net.ParseCIDR("192.168.2.0/24")
+	n := []*net.IPNet{{IP: net.ParseIP("fd00::1"), Mask: net.CIDRMask(64, 128)}, {IP: net.IP{10, 0, 0, 1}, Mask: net.CIDRMask(24, 32)}}
+
+	assert.Equal(t, "nebula_nebula_1", masqueradeTable("nebula-1"))
+
+	assert.Equal(t, "table ip nebula_nebula1\ndelete table ip nebula_nebula1\n", masqueradeRuleset("nebula1", n, nil))
+
+	assert.Equal(t, `table ip nebula_nebula1
+delete table ip nebula_nebula1
+table ip nebula_nebula1 {
+	chain postrouting {
+		type nat hook postrouting priority 100; policy accept;
+		iifname "nebula1" ip daddr 192.168.1.0/24 masquerade
+		iifname "nebula1" ip daddr 192.168.2.0/24 snat to 10.0.0.1
+	}
+}
+`, masqueradeRuleset("nebula1", n, []Masquerade{{Cidr: lan}, {Cidr: site, To: MasqueradeToOverlay}}))
+}
@@ -0,0 +1,183 @@
+package overlay
+
+import (
+	"io"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+
+	"github.com/sirupsen/logrus"
+	"github.com/slackhq/nebula/cidr"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/iputil"
+	"github.com/slackhq/nebula/util"
+)
+
+// NewPacketDeviceFromConfig returns a DeviceFactory for a PacketDevice, emit receives the packets nebula delivers.
+// The device can be fetched with Control.Device once nebula is running to inject packets from the OS.
+func NewPacketDeviceFromConfig(emit func(packets [][]byte)) DeviceFactory {
+	return func(c *config.C, l *logrus.Logger, vpnNetworks []*net.IPNet, routines int) (Device, error) {
+		return NewPacketDevice(c, l, vpnNetworks, emit)
+	}
+}
+
+// PacketDevice is a Device for hosts that move packets between nebula and the OS themselves, like the packetFlow of
+// an apple NetworkExtension, without handing nebula a file descriptor. Packets from the OS are given to nebula with
+// InjectPackets and packets for the OS are passed to emit in batches. The host owns the configuration of the
+// interface, routes from tun.routes and tun.unsafe_routes are only used to pick the nebula host for a packet.
+type PacketDevice struct {
+	cidr        *net.IPNet
+	vpnNetworks []*net.IPNet
+	Routes      atomic.Pointer[[]Route]
+	routeTree   atomic.Pointer[cidr.Tree6[iputil.VpnIp]]
+	l           *logrus.Logger
+
+	// emit must be safe for concurrent use and must not hold on to the packets after it returns
+	emit func(packets [][]byte)
+
+	in        chan []byte
+	closed    chan struct{}
+	closeOnce sync.Once
+
+	*runtimeRoutes
+}
+
+func NewPacketDevice(c *config.C, l *logrus.Logger, vpnNetworks []*net.IPNet, emit func(packets [][]byte)) (*PacketDevice, error) {
+	d := &PacketDevice{
+		cidr:        vpnNetworks[0],
+		vpnNetworks: vpnNetworks,
+		l:           l,
+		emit:        emit,
+		in:          make(chan []byte, c.GetInt("tun.tx_queue", 500)),
+		closed:      make(chan struct{}),
+	}
+
+	d.runtimeRoutes = newRuntimeRoutes(c, d.vpnNetworks, d.reload)
+	err := d.reload(c, true)
+	if err != nil {
+		return nil, err
+	}
+
+	c.RegisterReloadCallback(func(c *config.C) {
+		err := d.reload(c, false)
+		if err != nil {
+			util.LogWithContextIfNeeded("failed to reload packet device", err, d.l)
+		}
+	})
+
+	return d, nil
+}
+
+func (d *PacketDevice) reload(c *config.C, initial bool) error {
+	change, routes, err := d.getAllRoutes(c, initial)
+	if err != nil {
+		return err
+	}
+
+	if !initial && !change {
+		return nil
+	}
+
+	routeTree, err := makeRouteTree(d.l, routes, false)
+	if err != nil {
+		return err
+	}
+
+	d.Routes.Store(&routes)
+	d.routeTree.Store(routeTree)
+	return nil
+}
+
+// InjectPackets queues packets from the OS for nebula to send, it blocks while the queue is full. The packets are
+// copied so the caller may reuse them once it returns.
+func (d *PacketDevice) InjectPackets(packets [][]byte) error {
+	for _, p := range packets {
+		select {
+		case <-d.closed:
+			return os.ErrClosed
+		default:
+		}
+
+		select {
+		case d.in <- append([]byte(nil), p...):
+		case <-d.closed:
+			return os.ErrClosed
+		}
+	}
+	return nil
+}
+
+func (d *PacketDevice) Read(to []byte) (int, error) {
+	select {
+	case <-d.closed:
+		return 0, os.ErrClosed
+	default:
+	}
+
+	select {
+	case p := <-d.in:
+		return copy(to, p), nil
+	case <-d.closed:
+		return 0, os.ErrClosed
+	}
+}
+
+// ReadBatch blocks for the first packet and then takes whatever else is already queued, up to len(bufs)
+func (d *PacketDevice) ReadBatch(bufs [][]byte, sizes []int) (int, error) {
+	if len(bufs) == 0 {
+		return 0, nil
+	}
+
+	n, err := d.Read(bufs[0])
+	if err != nil {
+		return 0, err
+	}
+	sizes[0] = n
+
+	for i := 1; i < len(bufs); i++ {
+		select {
+		case p := <-d.in:
+			sizes[i] = copy(bufs[i], p)
+		default:
+			return i, nil
+		}
+	}
+	return len(bufs), nil
+}
+
+func (d *PacketDevice) Write(p []byte) (int, error) {
+	d.emit([][]byte{p})
+	return len(p), nil
+}
+
+func (d *PacketDevice) WriteBatch(bufs [][]byte) (int, error) {
+	d.emit(bufs)
+	return len(bufs), nil
+}
+
+func (d *PacketDevice) Close() error {
+	d.closeOnce.Do(func() { close(d.closed) })
+	return nil
+}
+
+func (d *PacketDevice) Activate() error {
+	return nil
+}
+
+func (d *PacketDevice) Cidr() *net.IPNet {
+	return d.cidr
+}
+
+func (d *PacketDevice) Name() string {
+	return "packet"
+}
+
+func (d *PacketDevice) RouteFor(ip iputil.VpnIp) iputil.VpnIp {
+	_, r := d.routeTree.Load().MostSpecificContains(ip)
+	return r
+}
+
+func (d *PacketDevice) NewMultiQueueReader() (io.ReadWriteCloser, error) {
+	return d, nil
+}
@@ -0,0 +1,65 @@
+package overlay
+
+import (
+	"net"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/iputil"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPacketDevice(t *testing.T) {
+	l := test.NewLogger()
+	c := config.NewC(l)
+	c.Settings["tun"] = map[interface{}]interface{}{
+		"unsafe_routes": []interface{}{map[interface{}]interface{}{"route": "192.168.1.0/24", "via": "10.0.0.2"}},
+	}
+	_, n, _ := net.ParseCIDR("10.0.0.1/24")
+
+	var lock sync.Mutex
+	var emitted [][]byte
+	d, err := NewPacketDevice(c, l, []*net.IPNet{n}, func(packets [][]byte) {
+		lock.Lock()
+		defer lock.Unlock()
+		for _, p := range packets {
+			emitted = append(emitted, append([]byte(nil), p...))
+		}
+	})
+	require.NoError(t, err)
+	assert.Equal(t, iputil.Ip2VpnIp(net.ParseIP("10.0.0.2")), d.RouteFor(iputil.Ip2VpnIp(net.ParseIP("192.168.1.1"))))
+
+	// Injected packets are copied, the caller can reuse its buffers
+	in := [][]byte{{1}, {2, 2}, {3, 3, 3}}
+	require.NoError(t, d.InjectPackets(in))
+	in[0][0] = 9
+
+	b := make([]byte, 10)
+	n1, err := d.Read(b)
+	require.NoError(t, err)
+	assert.Equal(t, []byte{1}, b[:n1])
+
+	bufs := [][]byte{make([]byte, 10), make([]byte, 10), make([]byte, 10)}
+	sizes := make([]int, 3)
+	count, err := d.ReadBatch(bufs, sizes)
+	require.NoError(t, err)
+	assert.Equal(t, 2, count)
+	assert.Equal(t, []byte{2, 2}, bufs[0][:sizes[0]])
+	assert.Equal(t, []byte{3, 3, 3}, bufs[1][:sizes[1]])
+
+	_, err = d.Write([]byte{4})
+	require.NoError(t, err)
+	count, err = d.WriteBatch([][]byte{{5}, {6}})
+	require.NoError(t, err)
+	assert.Equal(t, 2, count)
+	assert.Equal(t, [][]byte{{4}, {5}, {6}}, emitted)
+
+	require.NoError(t, d.Close())
+	_, err = d.Read(b)
+	assert.ErrorIs(t, err, os.ErrClosed)
+	assert.ErrorIs(t, d.InjectPackets(in), os.ErrClosed)
+}
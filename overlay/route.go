@@ -7,6 +7,7 @@ import (
 	"net"
 	"runtime"
 	"strconv"
+	"strings"
 
 	"github.com/sirupsen/logrus"
 	"github.com/slackhq/nebula/cidr"
@@ -51,8 +52,8 @@ func (r Route) String() string {
 	return s
 }
 
-func makeRouteTree(l *logrus.Logger, routes []Route, allowMTU bool) (*cidr.Tree4[iputil.VpnIp], error) {
-	routeTree := cidr.NewTree4[iputil.VpnIp]()
+func makeRouteTree(l *logrus.Logger, routes []Route, allowMTU bool) (*cidr.Tree6[iputil.VpnIp], error) {
+	routeTree := cidr.NewTree6[iputil.VpnIp]()
 	for _, r := range routes {
 		if !allowMTU && r.MTU > 0 {
 			l.WithField("route", r).Warnf("route MTU is not supported in %s", runtime.GOOS)
@@ -65,7 +66,7 @@ func makeRouteTree(l *logrus.Logger, routes []Route, allowMTU bool) (*cidr.Tree4
 	return routeTree, nil
 }
 
-func parseRoutes(c *config.C, network *net.IPNet) ([]Route, error) {
+func parseRoutes(c *config.C, networks []*net.IPNet) ([]Route, error) {
 	var err error
 
 	r := c.Get("tun.routes")
@@ -121,12 +122,12 @@ func parseRoutes(c *config.C, network *net.IPNet) ([]Route, error) {
 			return nil, fmt.Errorf("entry %v.route in tun.routes failed to parse: %v", i+1, err)
 		}
 
-		if !ipWithin(network, r.Cidr) {
+		if !anyIpWithin(networks, r.Cidr) {
 			return nil, fmt.Errorf(
 				"entry %v.route in tun.routes is not contained within the network attached to the certificate; route: %v, network: %v",
 				i+1,
 				r.Cidr.String(),
-				network.String(),
+				networksString(networks),
 			)
 		}
 
@@ -136,7 +137,7 @@ func parseRoutes(c *config.C, network *net.IPNet) ([]Route, error) {
 	return routes, nil
 }
 
-func parseUnsafeRoutes(c *config.C, network *net.IPNet) ([]Route, error) {
+func parseUnsafeRoutes(c *config.C, networks []*net.IPNet) ([]Route, error) {
 	var err error
 
 	r := c.Get("tun.unsafe_routes")
@@ -235,12 +236,12 @@ func parseUnsafeRoutes(c *config.C, network *net.IPNet) ([]Route, error) {
 			return nil, fmt.Errorf("entry %v.route in tun.unsafe_routes failed to parse: %v", i+1, err)
 		}
 
-		if ipWithin(network, r.Cidr) {
+		if anyIpWithin(networks, r.Cidr) {
 			return nil, fmt.Errorf(
 				"entry %v.route in tun.unsafe_routes is contained within the network attached to the certificate; route: %v, network: %v",
 				i+1,
 				r.Cidr.String(),
-				network.String(),
+				networksString(networks),
 			)
 		}
 
@@ -250,6 +251,100 @@ func parseUnsafeRoutes(c *config.C, network *net.IPNet) ([]Route, error) {
 	return routes, nil
 }
 
+// anyIpWithin is true if i is entirely within any of networks
+func anyIpWithin(networks []*net.IPNet, i *net.IPNet) bool {
+	for _, o := range networks {
+		if ipWithin(o, i) {
+			return true
+		}
+	}
+	return false
+}
+
+// anyContains is true if ip is within any of networks
+func anyContains(networks []*net.IPNet, ip net.IP) bool {
+	for _, n := range networks {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// routeFamily is the address family flag the bsd route command expects for n
+func routeFamily(n *net.IPNet) string {
+	if n.IP.To4() == nil {
+		return "-inet6"
+	}
+	return "-inet"
+}
+
+// bsdRouteArgs returns the route(8) arguments to add, change or delete a route for n through target, which is
+// `-interface <dev>` on freebsd and a vpn ip on openbsd. The mtu and priority modifiers are left out when 0 and on delete.
+func bsdRouteArgs(action string, n *net.IPNet, target []string, mtu, priority int) []string {
+	args := append([]string{"-n", action, routeFamily(n), "-net", n.String()}, target...)
+	if action == "delete" {
+		return args
+	}
+
+	if mtu > 0 {
+		args = append(args, "-mtu", strconv.Itoa(mtu))
+	}
+	if priority > 0 {
+		args = append(args, "-priority", strconv.Itoa(priority))
+	}
+	return args
+}
+
+// isNetworkRoute is true if n is exactly one of networks, the route for it exists as soon as the network is configured
+func isNetworkRoute(networks []*net.IPNet, n *net.IPNet) bool {
+	for _, o := range networks {
+		if o.IP.Mask(o.Mask).Equal(n.IP) && bytes.Equal(o.Mask, n.Mask) {
+			return true
+		}
+	}
+	return false
+}
+
+// hasNetworkRoute is true if an installed route covers exactly the network n
+func hasNetworkRoute(routes []Route, n *net.IPNet) bool {
+	for _, r := range routes {
+		if r.Install && isNetworkRoute([]*net.IPNet{n}, r.Cidr) {
+			return true
+		}
+	}
+	return false
+}
+
+// maxRouteMTU returns the largest of mtu and the mtu of any route, the device mtu has to allow every route mtu
+func maxRouteMTU(mtu int, routes []Route) int {
+	for _, r := range routes {
+		if r.MTU > mtu {
+			mtu = r.MTU
+		}
+	}
+	return mtu
+}
+
+// routeGateway returns the vpn ip in the same address family as n, nil if there is none
+func routeGateway(networks []*net.IPNet, n *net.IPNet) net.IP {
+	v6 := n.IP.To4() == nil
+	for _, o := range networks {
+		if (o.IP.To4() == nil) == v6 {
+			return o.IP
+		}
+	}
+	return nil
+}
+
+func networksString(networks []*net.IPNet) string {
+	s := make([]string, len(networks))
+	for i, n := range networks {
+		s[i] = n.String()
+	}
+	return strings.Join(s, ", ")
+}
+
 func ipWithin(o *net.IPNet, i *net.IPNet) bool {
 	// Make sure o contains the lowest form of i
 	if !o.Contains(i.IP.Mask(i.Mask)) {
@@ -257,14 +352,17 @@ func ipWithin(o *net.IPNet, i *net.IPNet) bool {
 	}
 
 	// Find the max ip in i
-	ip4 := i.IP.To4()
-	if ip4 == nil {
+	ip := i.IP.To4()
+	if ip == nil {
+		ip = i.IP.To16()
+	}
+	if ip == nil || len(ip) != len(i.Mask) {
 		return false
 	}
 
-	last := make(net.IP, len(ip4))
-	copy(last, ip4)
-	for x := range ip4 {
+	last := make(net.IP, len(ip))
+	copy(last, ip)
+	for x := range ip {
 		last[x] |= ^i.Mask[x]
 	}
 
@@ -0,0 +1,109 @@
+package overlay
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+
+	"github.com/slackhq/nebula/config"
+)
+
+type RouteConflictMode int
+
+const (
+	// RouteConflictLog only reports conflicts
+	RouteConflictLog RouteConflictMode = iota
+	// RouteConflictRefuse will refuse to start if a conflict exists, runtime conflicts are only reported
+	RouteConflictRefuse
+	// RouteConflictPause removes conflicting routes from the system route table until the conflict clears
+	RouteConflictPause
+)
+
+func (m RouteConflictMode) String() string {
+	switch m {
+	case RouteConflictLog:
+		return "log"
+	case RouteConflictRefuse:
+		return "refuse"
+	case RouteConflictPause:
+		return "pause"
+	default:
+		return "unknown"
+	}
+}
+
+func parseRouteConflictMode(c *config.C) (RouteConflictMode, error) {
+	switch v := strings.ToLower(c.GetString("tun.route_conflicts", "log")); v {
+	case "log":
+		return RouteConflictLog, nil
+	case "refuse":
+		return RouteConflictRefuse, nil
+	case "pause":
+		return RouteConflictPause, nil
+	default:
+		return RouteConflictLog, fmt.Errorf("tun.route_conflicts must be one of log, refuse, or pause, found: %s", v)
+	}
+}
+
+// hostRoute is a route in the system route table that does not belong to the nebula device
+type hostRoute struct {
+	Cidr   *net.IPNet
+	Device string
+}
+
+// routeConflict describes a host route that will take traffic away from one of our networks. Route is the nebula side
+// of the conflict, it is nil when the conflict is with the network attached to the certificate.
+type routeConflict struct {
+	Network *net.IPNet
+	Route   *Route
+	Host    hostRoute
+}
+
+func (rc routeConflict) key() string {
+	return rc.Network.String() + "|" + rc.Host.Cidr.String() + "|" + rc.Host.Device
+}
+
+// Pausable reports whether the nebula route can be removed from the system route table to get out of the way
+func (rc routeConflict) Pausable() bool {
+	return rc.Route != nil && rc.Route.Install
+}
+
+// findRouteConflicts returns every host route that is as specific or more specific than the certificate network or an
+// unsafe route. Longest prefix match means those host routes win, traffic for them never reaches nebula. Less specific
+// host routes, like a default route, are not conflicts.
+func findRouteConflicts(network *net.IPNet, routes []Route, host []hostRoute) []routeConflict {
+	var conflicts []routeConflict
+
+	check := func(n *net.IPNet, r *Route) {
+		ones, _ := n.Mask.Size()
+		for _, h := range host {
+			if h.Cidr == nil || h.Cidr.IP.To4() == nil {
+				continue
+			}
+
+			hOnes, _ := h.Cidr.Mask.Size()
+			if hOnes >= ones && n.Contains(h.Cidr.IP) {
+				conflicts = append(conflicts, routeConflict{Network: n, Route: r, Host: h})
+			}
+		}
+	}
+
+	if network != nil {
+		check(&net.IPNet{IP: network.IP.Mask(network.Mask), Mask: network.Mask}, nil)
+	}
+
+	for i := range routes {
+		// Routes within the certificate network are MTU overrides and are already covered above
+		if routes[i].Via == nil {
+			continue
+		}
+		check(routes[i].Cidr, &routes[i])
+	}
+
+	sort.Slice(conflicts, func(i, j int) bool {
+		return conflicts[i].key() < conflicts[j].key()
+	})
+
+	return conflicts
+}
@@ -0,0 +1,189 @@
+//go:build !android && !e2e_testing
+// +build !android,!e2e_testing
+
+package overlay
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// hostRoutes returns the ipv4 routes in the main route table that do not use the nebula device
+func (t *tun) hostRoutes() ([]hostRoute, error) {
+	nrs, err := netlink.RouteList(nil, netlink.FAMILY_V4)
+	if err != nil {
+		return nil, err
+	}
+
+	names := map[int]string{}
+	var routes []hostRoute
+	for _, nr := range nrs {
+		if nr.Dst == nil || nr.LinkIndex == t.deviceIndex || nr.Type != unix.RTN_UNICAST {
+			continue
+		}
+
+		name, ok := names[nr.LinkIndex]
+		if !ok {
+			if link, err := netlink.LinkByIndex(nr.LinkIndex); err == nil {
+				name = link.Attrs().Name
+			} else {
+				name = fmt.Sprintf("%d", nr.LinkIndex)
+			}
+			names[nr.LinkIndex] = name
+		}
+
+		routes = append(routes, hostRoute{Cidr: nr.Dst, Device: name})
+	}
+
+	return routes, nil
+}
+
+// checkRouteConflicts compares the system route table against our routes, reporting any conflicts that appeared or
+// cleared since the last check. In pause mode conflicting routes are removed and restored once the conflict clears.
+func (t *tun) checkRouteConflicts(initial bool) error {
+	t.conflictLock.Lock()
+	defer t.conflictLock.Unlock()
+
+	host, err := t.hostRoutes()
+	if err != nil {
+		return fmt.Errorf("failed to list system routes: %w", err)
+	}
+
+	conflicts := findRouteConflicts(t.cidr, *t.Routes.Load(), host)
+	current := make(map[string]routeConflict, len(conflicts))
+	paused := map[string]struct{}{}
+	for _, rc := range conflicts {
+		k := rc.key()
+		current[k] = rc
+		if t.routeConflictMode == RouteConflictPause && rc.Pausable() {
+			paused[rc.Network.String()] = struct{}{}
+		}
+
+		if _, ok := t.routeConflicts[k]; !ok {
+			t.routeConflictLog(rc).Warn("Route conflict detected, traffic for this network will not reach nebula")
+		}
+	}
+
+	for k, rc := range t.routeConflicts {
+		if _, ok := current[k]; !ok {
+			t.routeConflictLog(rc).Info("Route conflict cleared")
+		}
+	}
+	t.routeConflicts = current
+
+	if initial && t.routeConflictMode == RouteConflictRefuse && len(conflicts) > 0 {
+		return fmt.Errorf("refusing to start, %d system routes conflict with nebula routes and tun.route_conflicts is refuse", len(conflicts))
+	}
+
+	// Outside of pause mode nothing is paused, any routes paused under a previous mode will be resumed
+	var pause, resume []Route
+	oldPaused := *t.pausedRoutes.Load()
+	for _, r := range *t.Routes.Load() {
+		_, was := oldPaused[r.Cidr.String()]
+		_, is := paused[r.Cidr.String()]
+		if is && !was {
+			pause = append(pause, r)
+		} else if was && !is {
+			resume = append(resume, r)
+		}
+	}
+
+	t.pausedRoutes.Store(&paused)
+	if initial {
+		// Nothing has been installed yet, addRoutes will skip the paused routes
+		for _, r := range pause {
+			t.l.WithField("route", r).Warn("Pausing route until the conflict clears")
+		}
+		return nil
+	}
+
+	if len(pause) > 0 {
+		t.l.WithField("routes", pause).Warn("Pausing routes until the conflict clears")
+		t.removeRoutes(pause)
+	}
+
+	if len(resume) > 0 {
+		t.l.WithField("routes", resume).Info("Resuming routes, the conflict has cleared")
+		if err := t.addRoutes(true); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (t *tun) routeConflictLog(rc routeConflict) *logrus.Entry {
+	return t.l.WithField("network", rc.Network).
+		WithField("hostRoute", rc.Host.Cidr).
+		WithField("hostDevice", rc.Host.Device).
+		WithField("mode", t.routeConflictMode)
+}
+
+func (t *tun) isRoutePaused(r Route) bool {
+	_, ok := (*t.pausedRoutes.Load())[r.Cidr.String()]
+	return ok
+}
+
+// routeConflictDebounce is how long route changes are collected before the route table is checked again, a busy route
+// table is checked at most once per interval
+const routeConflictDebounce = time.Second
+
+// watchRouteConflicts re-checks for conflicts when a route outside of the nebula device changes. Only pause mode acts
+// on a conflict that appears later, so the route table is only watched in it.
+func (t *tun) watchRouteConflicts() {
+	t.conflictLock.Lock()
+	defer t.conflictLock.Unlock()
+
+	watch := t.routeConflictMode == RouteConflictPause
+	if watch == (t.conflictChan != nil) {
+		return
+	}
+
+	if !watch {
+		close(t.conflictChan)
+		t.conflictChan = nil
+		return
+	}
+
+	rch := make(chan netlink.RouteUpdate)
+	doneChan := make(chan struct{})
+
+	if err := netlink.RouteSubscribe(rch, doneChan); err != nil {
+		t.l.WithError(err).Error("Failed to subscribe to system route changes, route conflicts will only be checked at startup and on reload")
+		return
+	}
+
+	t.conflictChan = doneChan
+
+	go func() {
+		var check <-chan time.Time
+		for {
+			select {
+			case r, ok := <-rch:
+				if !ok {
+					return
+				}
+
+				// A check is already pending, it will see this change too
+				if r.LinkIndex == t.deviceIndex || check != nil {
+					continue
+				}
+				check = time.After(routeConflictDebounce)
+
+			case <-check:
+				check = nil
+				if err := t.checkRouteConflicts(false); err != nil {
+					t.l.WithError(err).Error("Failed to check for route conflicts")
+				}
+
+			case <-doneChan:
+				// netlink.RouteSubscriber will close the rch for us
+				return
+			}
+		}
+	}()
+}
@@ -0,0 +1,76 @@
+package overlay
+
+import (
+	"net"
+	"testing"
+
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/iputil"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_parseRouteConflictMode(t *testing.T) {
+	l := test.NewLogger()
+	c := config.NewC(l)
+
+	m, err := parseRouteConflictMode(c)
+	assert.Nil(t, err)
+	assert.Equal(t, RouteConflictLog, m)
+
+	c.Settings["tun"] = map[interface{}]interface{}{"route_conflicts": "Pause"}
+	m, err = parseRouteConflictMode(c)
+	assert.Nil(t, err)
+	assert.Equal(t, RouteConflictPause, m)
+
+	c.Settings["tun"] = map[interface{}]interface{}{"route_conflicts": "nope"}
+	_, err = parseRouteConflictMode(c)
+	assert.EqualError(t, err, "tun.route_conflicts must be one of log, refuse, or pause, found: nope")
+}
+
+func Test_findRouteConflicts(t *testing.T) {
+	_, network, _ := net.ParseCIDR("10.0.0.1/16")
+	_, unsafeCidr, _ := net.ParseCIDR("172.16.1.0/24")
+	_, mtuCidr, _ := net.ParseCIDR("10.0.1.0/24")
+	via := iputil.Ip2VpnIp(net.ParseIP("10.0.0.2"))
+	routes := []Route{
+		{Cidr: mtuCidr, MTU: 8000, Install: true},
+		{Cidr: unsafeCidr, Via: &via, Install: true},
+	}
+
+	hr := func(s, dev string) hostRoute {
+		_, n, _ := net.ParseCIDR(s)
+		return hostRoute{Cidr: n, Device: dev}
+	}
+
+	// Less specific and unrelated host routes are not conflicts
+	assert.Empty(t, findRouteConflicts(network, routes, []hostRoute{
+		hr("0.0.0.0/0", "eth0"),
+		hr("10.0.0.0/8", "eth0"),
+		hr("192.168.1.0/24", "eth0"),
+		hr("172.16.0.0/16", "eth0"),
+	}))
+
+	conflicts := findRouteConflicts(network, routes, []hostRoute{
+		hr("10.0.0.0/16", "wg0"),
+		hr("172.16.1.128/25", "tun1"),
+		hr("0.0.0.0/0", "eth0"),
+	})
+	assert.Len(t, conflicts, 2)
+
+	// The certificate network can not be paused
+	assert.Equal(t, "10.0.0.0/16", conflicts[0].Network.String())
+	assert.Equal(t, "wg0", conflicts[0].Host.Device)
+	assert.Nil(t, conflicts[0].Route)
+	assert.False(t, conflicts[0].Pausable())
+
+	assert.Equal(t, "172.16.1.0/24", conflicts[1].Network.String())
+	assert.Equal(t, "172.16.1.128/25", conflicts[1].Host.Cidr.String())
+	assert.True(t, conflicts[1].Pausable())
+
+	// Routes that are not installed can not be paused
+	routes[1].Install = false
+	conflicts = findRouteConflicts(network, routes, []hostRoute{hr("172.16.1.0/24", "tun1")})
+	assert.Len(t, conflicts, 1)
+	assert.False(t, conflicts[0].Pausable())
+}
@@ -0,0 +1,213 @@
+package overlay
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+
+	"github.com/slackhq/nebula/config"
+)
+
+// UnsafeRouteManager is implemented by devices whose unsafe routes can be changed at runtime without a config reload
+type UnsafeRouteManager interface {
+	// AddUnsafeRoutes installs routes, replacing any existing unsafe route for the same cidr
+	AddUnsafeRoutes(routes []Route) error
+	// RemoveUnsafeRoutes removes every unsafe route for the cidrs, it is an error if a cidr has none
+	RemoveUnsafeRoutes(cidrs []*net.IPNet) error
+	// UnsafeRoutes returns the unsafe routes in use, from the config and added at runtime
+	UnsafeRoutes() []Route
+}
+
+// runtimeRoutes tracks the unsafe routes added and removed at runtime. The changes are merged over tun.unsafe_routes
+// every time the routes are read from the config so they are kept across reloads until nebula restarts.
+type runtimeRoutes struct {
+	lock        sync.Mutex
+	c           *config.C
+	networks    []*net.IPNet
+	reloadRoute func(c *config.C, initial bool) error
+
+	added   map[string]Route
+	removed map[string]struct{}
+
+	// fromConfig holds the cidrs of the unsafe routes in the config, current the unsafe routes in use, both as of the
+	// last read of the config
+	fromConfig map[string]struct{}
+	current    []Route
+
+	// changed makes the next read report a change even if the config did not have one
+	changed bool
+
+	// changeLock serializes the runtime changes and the reloads they trigger
+	changeLock sync.Mutex
+}
+
+// newRuntimeRoutes returns the runtime route state for a device, reload is the device reload that programs the routes
+func newRuntimeRoutes(c *config.C, networks []*net.IPNet, reload func(c *config.C, initial bool) error) *runtimeRoutes {
+	return &runtimeRoutes{
+		c:           c,
+		networks:    networks,
+		reloadRoute: reload,
+		added:       make(map[string]Route),
+		removed:     make(map[string]struct{}),
+		fromConfig:  make(map[string]struct{}),
+	}
+}
+
+// getAllRoutes is getAllRoutesFromConfig with the runtime changes applied over the unsafe routes
+func (rr *runtimeRoutes) getAllRoutes(c *config.C, initial bool) (bool, []Route, error) {
+	rr.lock.Lock()
+	defer rr.lock.Unlock()
+
+	change, routes, err := getAllRoutesFromConfig(c, rr.networks, initial || rr.changed)
+	if err != nil || !change {
+		return change, routes, err
+	}
+	rr.changed = false
+
+	rr.fromConfig = make(map[string]struct{})
+	merged := make([]Route, 0, len(routes)+len(rr.added))
+	for _, r := range routes {
+		if r.Via != nil {
+			k := r.Cidr.String()
+			rr.fromConfig[k] = struct{}{}
+			if _, ok := rr.removed[k]; ok {
+				continue
+			}
+			if _, ok := rr.added[k]; ok {
+				continue
+			}
+		}
+		merged = append(merged, r)
+	}
+
+	for _, r := range rr.added {
+		merged = append(merged, r)
+	}
+
+	rr.current = rr.current[:0]
+	for _, r := range merged {
+		if r.Via != nil {
+			rr.current = append(rr.current, r)
+		}
+	}
+
+	return true, merged, nil
+}
+
+// AddUnsafeRoutes installs routes, replacing any existing unsafe route for the same cidr
+func (rr *runtimeRoutes) AddUnsafeRoutes(routes []Route) error {
+	for i, r := range routes {
+		if err := rr.validate(r); err != nil {
+			return fmt.Errorf("route %v: %w", i+1, err)
+		}
+	}
+
+	return rr.change(func() {
+		for _, r := range routes {
+			k := r.Cidr.String()
+			delete(rr.removed, k)
+			rr.added[k] = r
+		}
+	})
+}
+
+// RemoveUnsafeRoutes removes every unsafe route for the cidrs, it is an error if a cidr has none
+func (rr *runtimeRoutes) RemoveUnsafeRoutes(cidrs []*net.IPNet) error {
+	rr.lock.Lock()
+	for _, n := range cidrs {
+		k := n.String()
+		_, added := rr.added[k]
+		_, configured := rr.fromConfig[k]
+		_, removed := rr.removed[k]
+		if !added && (!configured || removed) {
+			rr.lock.Unlock()
+			return fmt.Errorf("there is no unsafe route for %s", k)
+		}
+	}
+	rr.lock.Unlock()
+
+	return rr.change(func() {
+		for _, n := range cidrs {
+			k := n.String()
+			delete(rr.added, k)
+			if _, ok := rr.fromConfig[k]; ok {
+				rr.removed[k] = struct{}{}
+			}
+		}
+	})
+}
+
+// UnsafeRoutes returns the unsafe routes in use, from the config and added at runtime, sorted by cidr
+func (rr *runtimeRoutes) UnsafeRoutes() []Route {
+	rr.lock.Lock()
+	routes := make([]Route, len(rr.current))
+	copy(routes, rr.current)
+	rr.lock.Unlock()
+
+	sort.SliceStable(routes, func(i, j int) bool {
+		return routes[i].Cidr.String() < routes[j].Cidr.String()
+	})
+	return routes
+}
+
+// change applies fn to the runtime changes and reprograms the routes, fn is undone if that fails
+func (rr *runtimeRoutes) change(fn func()) error {
+	rr.changeLock.Lock()
+	defer rr.changeLock.Unlock()
+
+	rr.lock.Lock()
+	oldAdded := make(map[string]Route, len(rr.added))
+	for k, r := range rr.added {
+		oldAdded[k] = r
+	}
+	oldRemoved := make(map[string]struct{}, len(rr.removed))
+	for k := range rr.removed {
+		oldRemoved[k] = struct{}{}
+	}
+
+	fn()
+	rr.changed = true
+	rr.lock.Unlock()
+
+	err := rr.reloadRoute(rr.c, false)
+	if err != nil {
+		rr.lock.Lock()
+		rr.added = oldAdded
+		rr.removed = oldRemoved
+		rr.changed = false
+		rr.lock.Unlock()
+		return err
+	}
+
+	return nil
+}
+
+// validate holds a runtime route to the same rules as an entry in tun.unsafe_routes
+func (rr *runtimeRoutes) validate(r Route) error {
+	if r.Cidr == nil {
+		return fmt.Errorf("route is not present")
+	}
+
+	if r.Via == nil {
+		return fmt.Errorf("via is not present")
+	}
+
+	if r.MTU != 0 && r.MTU < 500 {
+		return fmt.Errorf("mtu is below 500: %v", r.MTU)
+	}
+
+	if r.Metric < 0 {
+		return fmt.Errorf("metric is below 0: %v", r.Metric)
+	}
+
+	if anyIpWithin(rr.networks, r.Cidr) {
+		return fmt.Errorf(
+			"route is contained within the network attached to the certificate; route: %v, network: %v",
+			r.Cidr.String(),
+			networksString(rr.networks),
+		)
+	}
+
+	return nil
+}
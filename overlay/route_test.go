@@ -14,7 +14,8 @@ import (
 func Test_parseRoutes(t *testing.T) {
 	l := test.NewLogger()
 	c := config.NewC(l)
-	_, n, _ := net.ParseCIDR("10.0.0.0/24")
+	_, nw, _ := net.ParseCIDR("10.0.0.0/24")
+	n := []*net.IPNet{nw}
 
 	// test no routes config
 	routes, err := parseRoutes(c, n)
@@ -107,12 +108,28 @@ func Test_parseRoutes(t *testing.T) {
 	if tested != 2 {
 		t.Fatal("Did not see both routes")
 	}
+
+	// routes may land in any of the vpn networks
+	_, nw6, _ := net.ParseCIDR("fd00::/64")
+	c.Settings["tun"] = map[interface{}]interface{}{"routes": []interface{}{
+		map[interface{}]interface{}{"mtu": "9000", "route": "10.0.0.0/29"},
+		map[interface{}]interface{}{"mtu": "8000", "route": "fd00::/96"},
+	}}
+	routes, err = parseRoutes(c, []*net.IPNet{nw, nw6})
+	assert.Nil(t, err)
+	assert.Len(t, routes, 2)
+
+	c.Settings["tun"] = map[interface{}]interface{}{"routes": []interface{}{map[interface{}]interface{}{"mtu": "500", "route": "fd01::/64"}}}
+	routes, err = parseRoutes(c, []*net.IPNet{nw, nw6})
+	assert.Nil(t, routes)
+	assert.EqualError(t, err, "entry 1.route in tun.routes is not contained within the network attached to the certificate; route: fd01::/64, network: 10.0.0.0/24, fd00::/64")
 }
 
 func Test_parseUnsafeRoutes(t *testing.T) {
 	l := test.NewLogger()
 	c := config.NewC(l)
-	_, n, _ := net.ParseCIDR("10.0.0.0/24")
+	_, nw, _ := net.ParseCIDR("10.0.0.0/24")
+	n := []*net.IPNet{nw}
 
 	// test no routes config
 	routes, err := parseUnsafeRoutes(c, n)
@@ -252,7 +269,8 @@ func Test_parseUnsafeRoutes(t *testing.T) {
 func Test_makeRouteTree(t *testing.T) {
 	l := test.NewLogger()
 	c := config.NewC(l)
-	_, n, _ := net.ParseCIDR("10.0.0.0/24")
+	_, nw, _ := net.ParseCIDR("10.0.0.0/24")
+	n := []*net.IPNet{nw}
 
 	c.Settings["tun"] = map[interface{}]interface{}{"unsafe_routes": []interface{}{
 		map[interface{}]interface{}{"via": "192.168.0.1", "route": "1.0.0.0/28"},
@@ -278,3 +296,104 @@ func Test_makeRouteTree(t *testing.T) {
 	ok, r = routeTree.MostSpecificContains(ip)
 	assert.False(t, ok)
 }
+
+func Test_runtimeRoutes(t *testing.T) {
+	l := test.NewLogger()
+	c := config.NewC(l)
+	_, nw, _ := net.ParseCIDR("10.0.0.0/24")
+	c.Settings["tun"] = map[interface{}]interface{}{"unsafe_routes": []interface{}{
+		map[interface{}]interface{}{"via": "10.0.0.1", "route": "1.0.0.0/24"},
+		map[interface{}]interface{}{"via": "10.0.0.2", "route": "2.0.0.0/24"},
+	}}
+
+	var routes []Route
+	var rr *runtimeRoutes
+	reload := func(c *config.C, initial bool) error {
+		change, r, err := rr.getAllRoutes(c, initial)
+		if change {
+			routes = r
+		}
+		return err
+	}
+	rr = newRuntimeRoutes(c, []*net.IPNet{nw}, reload)
+	assert.NoError(t, reload(c, true))
+	assert.Len(t, routes, 2)
+
+	cidrs := func(routes []Route) []string {
+		var s []string
+		for _, r := range routes {
+			s = append(s, r.Cidr.String())
+		}
+		return s
+	}
+
+	// Add a new route and replace one from the config
+	via := iputil.Ip2VpnIp(net.ParseIP("10.0.0.3"))
+	_, n3, _ := net.ParseCIDR("3.0.0.0/24")
+	_, n2, _ := net.ParseCIDR("2.0.0.0/24")
+	assert.NoError(t, rr.AddUnsafeRoutes([]Route{
+		{Cidr: n3, Via: &via, Install: true},
+		{Cidr: n2, Via: &via, Metric: 10, Install: true},
+	}))
+	assert.Equal(t, []string{"1.0.0.0/24", "2.0.0.0/24", "3.0.0.0/24"}, cidrs(rr.UnsafeRoutes()))
+	assert.Len(t, routes, 3)
+	for _, r := range routes {
+		if r.Cidr.String() == "2.0.0.0/24" {
+			assert.Equal(t, 10, r.Metric)
+			assert.Equal(t, via, *r.Via)
+		}
+	}
+
+	// Bad routes are refused without changing anything
+	_, inside, _ := net.ParseCIDR("10.0.0.128/25")
+	assert.EqualError(t, rr.AddUnsafeRoutes([]Route{{Cidr: inside, Via: &via}}), "route 1: route is contained within the network attached to the certificate; route: 10.0.0.128/25, network: 10.0.0.0/24")
+	assert.EqualError(t, rr.AddUnsafeRoutes([]Route{{Cidr: n3}}), "route 1: via is not present")
+	assert.EqualError(t, rr.AddUnsafeRoutes([]Route{{Cidr: n3, Via: &via, MTU: 100}}), "route 1: mtu is below 500: 100")
+
+	// Remove a config route and a runtime route
+	_, n1, _ := net.ParseCIDR("1.0.0.0/24")
+	assert.NoError(t, rr.RemoveUnsafeRoutes([]*net.IPNet{n1, n3}))
+	assert.Equal(t, []string{"2.0.0.0/24"}, cidrs(rr.UnsafeRoutes()))
+	assert.Len(t, routes, 1)
+	assert.EqualError(t, rr.RemoveUnsafeRoutes([]*net.IPNet{n1}), "there is no unsafe route for 1.0.0.0/24")
+
+	// The changes are kept across a reload that touches the routes
+	c.Settings["tun"] = map[interface{}]interface{}{"unsafe_routes": []interface{}{
+		map[interface{}]interface{}{"via": "10.0.0.1", "route": "1.0.0.0/24"},
+		map[interface{}]interface{}{"via": "10.0.0.2", "route": "2.0.0.0/24"},
+		map[interface{}]interface{}{"via": "10.0.0.2", "route": "4.0.0.0/24"},
+	}}
+	assert.NoError(t, reload(c, true))
+	assert.Equal(t, []string{"2.0.0.0/24", "4.0.0.0/24"}, cidrs(rr.UnsafeRoutes()))
+
+	// A failed reload undoes the change
+	c.Settings["tun"] = map[interface{}]interface{}{"unsafe_routes": "nope"}
+	assert.Error(t, rr.AddUnsafeRoutes([]Route{{Cidr: n3, Via: &via}}))
+	assert.Empty(t, rr.added[n3.String()])
+}
+
+func Test_bsdRouteArgs(t *testing.T) {
+	_, n4, _ := net.ParseCIDR("10.0.0.1/24")
+	_, n6, _ := net.ParseCIDR("fd00::1/64")
+
+	assert.Equal(t, []string{"-n", "add", "-inet", "-net", "10.0.0.0/24", "-interface", "tun0"}, bsdRouteArgs("add", n4, []string{"-interface", "tun0"}, 0, 0))
+	assert.Equal(t, []string{"-n", "add", "-inet6", "-net", "fd00::/64", "fd00::1", "-mtu", "1300", "-priority", "10"}, bsdRouteArgs("add", n6, []string{"fd00::1"}, 1300, 10))
+	assert.Equal(t, []string{"-n", "change", "-inet", "-net", "10.0.0.0/24", "10.0.0.1", "-mtu", "8800"}, bsdRouteArgs("change", n4, []string{"10.0.0.1"}, 8800, 0))
+	assert.Equal(t, []string{"-n", "delete", "-inet", "-net", "10.0.0.0/24", "10.0.0.1"}, bsdRouteArgs("delete", n4, []string{"10.0.0.1"}, 1300, 10))
+}
+
+func Test_networkRoutes(t *testing.T) {
+	network := &net.IPNet{IP: net.IP{10, 0, 0, 1}, Mask: net.CIDRMask(24, 32)}
+	_, same, _ := net.ParseCIDR("10.0.0.0/24")
+	_, inside, _ := net.ParseCIDR("10.0.0.0/25")
+
+	assert.True(t, isNetworkRoute([]*net.IPNet{network}, same))
+	assert.False(t, isNetworkRoute([]*net.IPNet{network}, inside))
+
+	assert.False(t, hasNetworkRoute([]Route{{Cidr: inside, Install: true}}, network))
+	assert.False(t, hasNetworkRoute([]Route{{Cidr: same}}, network))
+	assert.True(t, hasNetworkRoute([]Route{{Cidr: inside, Install: true}, {Cidr: same, Install: true}}, network))
+
+	assert.Equal(t, 1300, maxRouteMTU(1300, []Route{{MTU: 500}}))
+	assert.Equal(t, 8800, maxRouteMTU(1300, []Route{{MTU: 500}, {MTU: 8800}}))
+}
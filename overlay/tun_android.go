@@ -19,14 +19,17 @@ import (
 
 type tun struct {
 	io.ReadWriteCloser
-	fd        int
-	cidr      *net.IPNet
-	Routes    atomic.Pointer[[]Route]
-	routeTree atomic.Pointer[cidr.Tree4[iputil.VpnIp]]
-	l         *logrus.Logger
+	fd          int
+	cidr        *net.IPNet
+	vpnNetworks []*net.IPNet
+	Routes      atomic.Pointer[[]Route]
+	routeTree   atomic.Pointer[cidr.Tree6[iputil.VpnIp]]
+	l           *logrus.Logger
+
+	*runtimeRoutes
 }
 
-func newTunFromFd(c *config.C, l *logrus.Logger, deviceFd int, cidr *net.IPNet) (*tun, error) {
+func newTunFromFd(c *config.C, l *logrus.Logger, deviceFd int, vpnNetworks []*net.IPNet) (*tun, error) {
 	// XXX Android returns an fd in non-blocking mode which is necessary for shutdown to work properly.
 	// Be sure not to call file.Fd() as it will set the fd to blocking mode.
 	file := os.NewFile(uintptr(deviceFd), "/dev/net/tun")
@@ -34,10 +37,12 @@ func newTunFromFd(c *config.C, l *logrus.Logger, deviceFd int, cidr *net.IPNet)
 	t := &tun{
 		ReadWriteCloser: file,
 		fd:              deviceFd,
-		cidr:            cidr,
+		cidr:            vpnNetworks[0],
+		vpnNetworks:     vpnNetworks,
 		l:               l,
 	}
 
+	t.runtimeRoutes = newRuntimeRoutes(c, t.vpnNetworks, t.reload)
 	err := t.reload(c, true)
 	if err != nil {
 		return nil, err
@@ -53,7 +58,7 @@ func newTunFromFd(c *config.C, l *logrus.Logger, deviceFd int, cidr *net.IPNet)
 	return t, nil
 }
 
-func newTun(_ *config.C, _ *logrus.Logger, _ *net.IPNet, _ bool) (*tun, error) {
+func newTun(_ *config.C, _ *logrus.Logger, _ []*net.IPNet, _ bool) (*tun, error) {
 	return nil, fmt.Errorf("newTun not supported in Android")
 }
 
@@ -62,12 +67,12 @@ func (t *tun) RouteFor(ip iputil.VpnIp) iputil.VpnIp {
 	return r
 }
 
-func (t tun) Activate() error {
+func (t *tun) Activate() error {
 	return nil
 }
 
 func (t *tun) reload(c *config.C, initial bool) error {
-	change, routes, err := getAllRoutesFromConfig(c, t.cidr, initial)
+	change, routes, err := t.getAllRoutes(c, initial)
 	if err != nil {
 		return err
 	}
@@ -9,6 +9,8 @@ import (
 	"io"
 	"net"
 	"os"
+	"os/exec"
+	"strconv"
 	"sync/atomic"
 	"syscall"
 	"unsafe"
@@ -24,16 +26,25 @@ import (
 
 type tun struct {
 	io.ReadWriteCloser
-	Device     string
-	cidr       *net.IPNet
-	DefaultMTU int
-	Routes     atomic.Pointer[[]Route]
-	routeTree  atomic.Pointer[cidr.Tree4[iputil.VpnIp]]
-	linkAddr   *netroute.LinkAddr
-	l          *logrus.Logger
-
-	// cache out buffer since we need to prepend 4 bytes for tun metadata
+	Device      string
+	cidr        *net.IPNet
+	vpnNetworks []*net.IPNet
+	DefaultMTU  int
+	Routes      atomic.Pointer[[]Route]
+	routeTree   atomic.Pointer[cidr.Tree6[iputil.VpnIp]]
+	linkAddr    *netroute.LinkAddr
+	l           *logrus.Logger
+
+	// rawConn lets ReadBatch take packets off the nonblocking utun fd without parking in the poller
+	rawConn syscall.RawConn
+	// fromFd is true when the utun was handed to us, by a NetworkExtension for example, which owns its configuration
+	fromFd bool
+
+	// cache in and out buffers since we need to strip or prepend 4 bytes for tun metadata
+	in  []byte
 	out []byte
+
+	*runtimeRoutes
 }
 
 type sockaddrCtl struct {
@@ -73,7 +84,7 @@ type ifreqMTU struct {
 	pad  [8]byte
 }
 
-func newTun(c *config.C, l *logrus.Logger, cidr *net.IPNet, _ bool) (*tun, error) {
+func newTun(c *config.C, l *logrus.Logger, vpnNetworks []*net.IPNet, _ bool) (*tun, error) {
 	name := c.GetString("tun.dev", "")
 	ifIndex := -1
 	if name != "" && name != "utun" {
@@ -121,19 +132,37 @@ func newTun(c *config.C, l *logrus.Logger, cidr *net.IPNet, _ bool) (*tun, error
 		return nil, fmt.Errorf("SYS_CONNECT: %v", errno)
 	}
 
+	return newUtun(c, l, fd, vpnNetworks, false)
+}
+
+// newTunFromFd wraps a utun fd created by someone else, like the packetFlow of a NetworkExtension. The owner has
+// already configured the addresses, routes and mtu of the interface so Activate leaves them alone.
+func newTunFromFd(c *config.C, l *logrus.Logger, deviceFd int, vpnNetworks []*net.IPNet) (*tun, error) {
+	return newUtun(c, l, deviceFd, vpnNetworks, true)
+}
+
+// utunName asks the kernel for the interface name of a utun control socket
+func utunName(fd int) (string, error) {
 	var ifName struct {
 		name [16]byte
 	}
 	ifNameSize := uintptr(len(ifName.name))
-	_, _, errno = syscall.Syscall6(syscall.SYS_GETSOCKOPT, uintptr(fd),
+	_, _, errno := syscall.Syscall6(syscall.SYS_GETSOCKOPT, uintptr(fd),
 		2, // SYSPROTO_CONTROL
 		2, // UTUN_OPT_IFNAME
 		uintptr(unsafe.Pointer(&ifName)),
 		uintptr(unsafe.Pointer(&ifNameSize)), 0)
 	if errno != 0 {
-		return nil, fmt.Errorf("SYS_GETSOCKOPT: %v", errno)
+		return "", fmt.Errorf("SYS_GETSOCKOPT: %v", errno)
+	}
+	return string(ifName.name[:ifNameSize-1]), nil
+}
+
+func newUtun(c *config.C, l *logrus.Logger, fd int, vpnNetworks []*net.IPNet, fromFd bool) (*tun, error) {
+	name, err := utunName(fd)
+	if err != nil {
+		return nil, err
 	}
-	name = string(ifName.name[:ifNameSize-1])
 
 	err = syscall.SetNonblock(fd, true)
 	if err != nil {
@@ -141,15 +170,23 @@ func newTun(c *config.C, l *logrus.Logger, cidr *net.IPNet, _ bool) (*tun, error
 	}
 
 	file := os.NewFile(uintptr(fd), "")
+	rawConn, err := file.SyscallConn()
+	if err != nil {
+		return nil, fmt.Errorf("SyscallConn: %v", err)
+	}
 
 	t := &tun{
 		ReadWriteCloser: file,
 		Device:          name,
-		cidr:            cidr,
+		cidr:            vpnNetworks[0],
+		vpnNetworks:     vpnNetworks,
 		DefaultMTU:      c.GetInt("tun.mtu", DefaultMTU),
 		l:               l,
+		rawConn:         rawConn,
+		fromFd:          fromFd,
 	}
 
+	t.runtimeRoutes = newRuntimeRoutes(c, t.vpnNetworks, t.reload)
 	err = t.reload(c, true)
 	if err != nil {
 		return nil, err
@@ -172,10 +209,6 @@ func (t *tun) deviceBytes() (o [16]byte) {
 	return
 }
 
-func newTunFromFd(_ *config.C, _ *logrus.Logger, _ int, _ *net.IPNet) (*tun, error) {
-	return nil, fmt.Errorf("newTunFromFd not supported in Darwin")
-}
-
 func (t *tun) Close() error {
 	if t.ReadWriteCloser != nil {
 		return t.ReadWriteCloser.Close()
@@ -184,12 +217,12 @@ func (t *tun) Close() error {
 }
 
 func (t *tun) Activate() error {
-	devName := t.deviceBytes()
-
-	var addr, mask [4]byte
+	if t.fromFd {
+		// The owner of the fd configures the interface, we only need the routes in routeTree
+		return nil
+	}
 
-	copy(addr[:], t.cidr.IP.To4())
-	copy(mask[:], t.cidr.Mask)
+	devName := t.deviceBytes()
 
 	s, err := unix.Socket(
 		unix.AF_INET,
@@ -203,23 +236,48 @@ func (t *tun) Activate() error {
 
 	fd := uintptr(s)
 
-	ifra := ifreqAddr{
-		Name: devName,
-		Addr: unix.RawSockaddrInet4{
-			Family: unix.AF_INET,
-			Addr:   addr,
-		},
-	}
+	if ip4 := t.cidr.IP.To4(); ip4 != nil {
+		var addr, mask [4]byte
+		copy(addr[:], ip4)
+		copy(mask[:], t.cidr.Mask)
+
+		ifra := ifreqAddr{
+			Name: devName,
+			Addr: unix.RawSockaddrInet4{
+				Family: unix.AF_INET,
+				Addr:   addr,
+			},
+		}
+
+		// Set the device ip address
+		if err = ioctl(fd, unix.SIOCSIFADDR, uintptr(unsafe.Pointer(&ifra))); err != nil {
+			return fmt.Errorf("failed to set tun address: %s", err)
+		}
 
-	// Set the device ip address
-	if err = ioctl(fd, unix.SIOCSIFADDR, uintptr(unsafe.Pointer(&ifra))); err != nil {
-		return fmt.Errorf("failed to set tun address: %s", err)
+		// Set the device network
+		ifra.Addr.Addr = mask
+		if err = ioctl(fd, unix.SIOCSIFNETMASK, uintptr(unsafe.Pointer(&ifra))); err != nil {
+			return fmt.Errorf("failed to set tun netmask: %s", err)
+		}
 	}
 
-	// Set the device network
-	ifra.Addr.Addr = mask
-	if err = ioctl(fd, unix.SIOCSIFNETMASK, uintptr(unsafe.Pointer(&ifra))); err != nil {
-		return fmt.Errorf("failed to set tun netmask: %s", err)
+	// The ioctls above only cover an ipv4 primary network, leave the rest to ifconfig
+	for _, n := range t.vpnNetworks {
+		if n == t.cidr && n.IP.To4() != nil {
+			continue
+		}
+
+		var cmd *exec.Cmd
+		if n.IP.To4() != nil {
+			cmd = exec.Command("/sbin/ifconfig", t.Device, "alias", n.String(), n.IP.String())
+		} else {
+			ones, _ := n.Mask.Size()
+			cmd = exec.Command("/sbin/ifconfig", t.Device, "inet6", n.IP.String(), "prefixlen", strconv.Itoa(ones))
+		}
+		t.l.Debug("command: ", cmd.String())
+		if err = cmd.Run(); err != nil {
+			return fmt.Errorf("failed to run 'ifconfig': %s", err)
+		}
 	}
 
 	// Set the device name
@@ -261,8 +319,6 @@ func (t *tun) Activate() error {
 		}
 	}()
 
-	routeAddr := &netroute.Inet4Addr{}
-	maskAddr := &netroute.Inet4Addr{}
 	linkAddr, err := getLinkAddr(t.Device)
 	if err != nil {
 		return err
@@ -272,14 +328,15 @@ func (t *tun) Activate() error {
 	}
 	t.linkAddr = linkAddr
 
-	copy(routeAddr.IP[:], addr[:])
-	copy(maskAddr.IP[:], mask[:])
-	err = addRoute(routeSock, routeAddr, maskAddr, linkAddr)
-	if err != nil {
-		if errors.Is(err, unix.EEXIST) {
-			err = fmt.Errorf("unable to add tun route, identical route already exists: %s", t.cidr)
+	for _, n := range t.vpnNetworks {
+		routeAddr, maskAddr := routeAddrs(n)
+		err = addRoute(routeSock, routeAddr, maskAddr, linkAddr)
+		if err != nil {
+			if errors.Is(err, unix.EEXIST) {
+				err = fmt.Errorf("unable to add tun route, identical route already exists: %s", n)
+			}
+			return err
 		}
-		return err
 	}
 
 	// Run the interface
@@ -293,7 +350,7 @@ func (t *tun) Activate() error {
 }
 
 func (t *tun) reload(c *config.C, initial bool) error {
-	change, routes, err := getAllRoutesFromConfig(c, t.cidr, initial)
+	change, routes, err := t.getAllRoutes(c, initial)
 	if err != nil {
 		return err
 	}
@@ -311,7 +368,7 @@ func (t *tun) reload(c *config.C, initial bool) error {
 	oldRoutes := t.Routes.Swap(&routes)
 	t.routeTree.Store(routeTree)
 
-	if !initial {
+	if !initial && !t.fromFd {
 		// Remove first, if the system removes a wanted route hopefully it will be re-added next
 		err := t.removeRoutes(findRemovedRoutes(routes, *oldRoutes))
 		if err != nil {
@@ -335,7 +392,7 @@ func (t *tun) RouteFor(ip iputil.VpnIp) iputil.VpnIp {
 		return r
 	}
 
-	return 0
+	return iputil.VpnIp{}
 }
 
 // Get the LinkAddr for the interface of the given name
@@ -380,8 +437,6 @@ func (t *tun) addRoutes(logErrors bool) error {
 		}
 	}()
 
-	routeAddr := &netroute.Inet4Addr{}
-	maskAddr := &netroute.Inet4Addr{}
 	routes := *t.Routes.Load()
 	for _, r := range routes {
 		if r.Via == nil || !r.Install {
@@ -389,9 +444,7 @@ func (t *tun) addRoutes(logErrors bool) error {
 			continue
 		}
 
-		copy(routeAddr.IP[:], r.Cidr.IP.To4())
-		copy(maskAddr.IP[:], net.IP(r.Cidr.Mask).To4())
-
+		routeAddr, maskAddr := routeAddrs(r.Cidr)
 		err := addRoute(routeSock, routeAddr, maskAddr, t.linkAddr)
 		if err != nil {
 			if errors.Is(err, unix.EEXIST) {
@@ -427,17 +480,12 @@ func (t *tun) removeRoutes(routes []Route) error {
 		}
 	}()
 
-	routeAddr := &netroute.Inet4Addr{}
-	maskAddr := &netroute.Inet4Addr{}
-
 	for _, r := range routes {
 		if !r.Install {
 			continue
 		}
 
-		copy(routeAddr.IP[:], r.Cidr.IP.To4())
-		copy(maskAddr.IP[:], net.IP(r.Cidr.Mask).To4())
-
+		routeAddr, maskAddr := routeAddrs(r.Cidr)
 		err := delRoute(routeSock, routeAddr, maskAddr, t.linkAddr)
 		if err != nil {
 			t.l.WithError(err).WithField("route", r).Error("Failed to remove route")
@@ -448,7 +496,22 @@ func (t *tun) removeRoutes(routes []Route) error {
 	return nil
 }
 
-func addRoute(sock int, addr, mask *netroute.Inet4Addr, link *netroute.LinkAddr) error {
+// routeAddrs converts a network into the destination and netmask addresses of a route message
+func routeAddrs(n *net.IPNet) (netroute.Addr, netroute.Addr) {
+	if ip4 := n.IP.To4(); ip4 != nil {
+		addr, mask := &netroute.Inet4Addr{}, &netroute.Inet4Addr{}
+		copy(addr.IP[:], ip4)
+		copy(mask.IP[:], net.IP(n.Mask).To4())
+		return addr, mask
+	}
+
+	addr, mask := &netroute.Inet6Addr{}, &netroute.Inet6Addr{}
+	copy(addr.IP[:], n.IP.To16())
+	copy(mask.IP[:], n.Mask)
+	return addr, mask
+}
+
+func addRoute(sock int, addr, mask netroute.Addr, link *netroute.LinkAddr) error {
 	r := netroute.RouteMessage{
 		Version: unix.RTM_VERSION,
 		Type:    unix.RTM_ADD,
@@ -473,7 +536,7 @@ func addRoute(sock int, addr, mask *netroute.Inet4Addr, link *netroute.LinkAddr)
 	return nil
 }
 
-func delRoute(sock int, addr, mask *netroute.Inet4Addr, link *netroute.LinkAddr) error {
+func delRoute(sock int, addr, mask netroute.Addr, link *netroute.LinkAddr) error {
 	r := netroute.RouteMessage{
 		Version: unix.RTM_VERSION,
 		Type:    unix.RTM_DELETE,
@@ -497,14 +560,55 @@ func delRoute(sock int, addr, mask *netroute.Inet4Addr, link *netroute.LinkAddr)
 	return nil
 }
 
+// Read is only valid for single threaded use
 func (t *tun) Read(to []byte) (int, error) {
-
-	buf := make([]byte, len(to)+4)
+	buf := t.inBuf(len(to))
 
 	n, err := t.ReadWriteCloser.Read(buf)
+	if n < 4 {
+		return 0, err
+	}
 
-	copy(to, buf[4:])
-	return n - 4, err
+	return copy(to, buf[4:n]), err
+}
+
+// ReadBatch blocks for the first packet and then takes whatever else the utun already has queued, up to len(bufs).
+// It is only valid for single threaded use.
+func (t *tun) ReadBatch(bufs [][]byte, sizes []int) (int, error) {
+	if len(bufs) == 0 {
+		return 0, nil
+	}
+
+	n, err := t.Read(bufs[0])
+	if err != nil {
+		return 0, err
+	}
+	sizes[0] = n
+
+	i := 1
+	for ; i < len(bufs); i++ {
+		buf := t.inBuf(len(bufs[i]))
+		var readErr error
+		err = t.rawConn.Read(func(fd uintptr) bool {
+			n, readErr = unix.Read(int(fd), buf)
+			// Never wait, an empty queue ends the batch
+			return true
+		})
+		if err != nil || readErr != nil || n < 4 {
+			// Any real error will be seen again by the next blocking read
+			break
+		}
+		sizes[i] = copy(bufs[i], buf[4:n])
+	}
+
+	return i, nil
+}
+
+func (t *tun) inBuf(size int) []byte {
+	if cap(t.in) < size+4 {
+		t.in = make([]byte, size+4)
+	}
+	return t.in[:size+4]
 }
 
 // Write is only valid for single threaded use
@@ -536,6 +640,16 @@ func (t *tun) Write(from []byte) (int, error) {
 	return n - 4, err
 }
 
+// WriteBatch is only valid for single threaded use
+func (t *tun) WriteBatch(bufs [][]byte) (int, error) {
+	for i, b := range bufs {
+		if _, err := t.Write(b); err != nil {
+			return i, err
+		}
+	}
+	return len(bufs), nil
+}
+
 func (t *tun) Cidr() *net.IPNet {
 	return t.cidr
 }
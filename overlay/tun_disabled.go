@@ -44,7 +44,7 @@ func (*disabledTun) Activate() error {
 }
 
 func (*disabledTun) RouteFor(iputil.VpnIp) iputil.VpnIp {
-	return 0
+	return iputil.VpnIp{}
 }
 
 func (t *disabledTun) Cidr() *net.IPNet {
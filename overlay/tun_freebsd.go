@@ -47,14 +47,18 @@ type ifreqDestroy struct {
 }
 
 type tun struct {
-	Device    string
-	cidr      *net.IPNet
-	MTU       int
-	Routes    atomic.Pointer[[]Route]
-	routeTree atomic.Pointer[cidr.Tree4[iputil.VpnIp]]
-	l         *logrus.Logger
+	Device      string
+	cidr        *net.IPNet
+	vpnNetworks []*net.IPNet
+	MTU         int
+	MaxMTU      int
+	Routes      atomic.Pointer[[]Route]
+	routeTree   atomic.Pointer[cidr.Tree6[iputil.VpnIp]]
+	l           *logrus.Logger
 
 	io.ReadWriteCloser
+
+	*runtimeRoutes
 }
 
 func (t *tun) Close() error {
@@ -79,11 +83,11 @@ func (t *tun) Close() error {
 	return nil
 }
 
-func newTunFromFd(_ *config.C, _ *logrus.Logger, _ int, _ *net.IPNet) (*tun, error) {
+func newTunFromFd(_ *config.C, _ *logrus.Logger, _ int, _ []*net.IPNet) (*tun, error) {
 	return nil, fmt.Errorf("newTunFromFd not supported in FreeBSD")
 }
 
-func newTun(c *config.C, l *logrus.Logger, cidr *net.IPNet, _ bool) (*tun, error) {
+func newTun(c *config.C, l *logrus.Logger, vpnNetworks []*net.IPNet, _ bool) (*tun, error) {
 	// Try to open existing tun device
 	var file *os.File
 	var err error
@@ -151,11 +155,13 @@ func newTun(c *config.C, l *logrus.Logger, cidr *net.IPNet, _ bool) (*tun, error
 	t := &tun{
 		ReadWriteCloser: file,
 		Device:          deviceName,
-		cidr:            cidr,
+		cidr:            vpnNetworks[0],
+		vpnNetworks:     vpnNetworks,
 		MTU:             c.GetInt("tun.mtu", DefaultMTU),
 		l:               l,
 	}
 
+	t.runtimeRoutes = newRuntimeRoutes(c, t.vpnNetworks, t.reload)
 	err = t.reload(c, true)
 	if err != nil {
 		return nil, err
@@ -174,30 +180,41 @@ func newTun(c *config.C, l *logrus.Logger, cidr *net.IPNet, _ bool) (*tun, error
 func (t *tun) Activate() error {
 	var err error
 	// TODO use syscalls instead of exec.Command
-	cmd := exec.Command("/sbin/ifconfig", t.Device, t.cidr.String(), t.cidr.IP.String())
+	// The mtu goes first, a route can not have a larger mtu than the device
+	cmd := exec.Command("/sbin/ifconfig", t.Device, "mtu", strconv.Itoa(t.MaxMTU))
 	t.l.Debug("command: ", cmd.String())
 	if err = cmd.Run(); err != nil {
 		return fmt.Errorf("failed to run 'ifconfig': %s", err)
 	}
 
-	cmd = exec.Command("/sbin/route", "-n", "add", "-net", t.cidr.String(), "-interface", t.Device)
-	t.l.Debug("command: ", cmd.String())
-	if err = cmd.Run(); err != nil {
-		return fmt.Errorf("failed to run 'route add': %s", err)
-	}
+	for i, n := range t.vpnNetworks {
+		if n.IP.To4() == nil {
+			cmd = exec.Command("/sbin/ifconfig", t.Device, "inet6", n.String(), "alias")
+		} else if i == 0 {
+			cmd = exec.Command("/sbin/ifconfig", t.Device, n.String(), n.IP.String())
+		} else {
+			cmd = exec.Command("/sbin/ifconfig", t.Device, n.String(), n.IP.String(), "alias")
+		}
+		t.l.Debug("command: ", cmd.String())
+		if err = cmd.Run(); err != nil {
+			return fmt.Errorf("failed to run 'ifconfig': %s", err)
+		}
 
-	cmd = exec.Command("/sbin/ifconfig", t.Device, "mtu", strconv.Itoa(t.MTU))
-	t.l.Debug("command: ", cmd.String())
-	if err = cmd.Run(); err != nil {
-		return fmt.Errorf("failed to run 'ifconfig': %s", err)
+		cmd = exec.Command("/sbin/route", bsdRouteArgs("add", n, t.routeTarget(), t.MTU, 0)...)
+		t.l.Debug("command: ", cmd.String())
+		if err = cmd.Run(); err != nil {
+			return fmt.Errorf("failed to run 'route add': %s", err)
+		}
 	}
 
-	// Unsafe path routes
-	return t.addRoutes(false)
+	// Route mtus and unsafe path routes
+	return t.addRoutes(*t.Routes.Load(), false)
 }
 
 func (t *tun) reload(c *config.C, initial bool) error {
-	change, routes, err := getAllRoutesFromConfig(c, t.cidr, initial)
+	// Routes without an mtu get tun.mtu so they must be read again when it changes
+	mtuChange := !initial && c.HasChanged("tun.mtu")
+	change, routes, err := t.getAllRoutes(c, initial || mtuChange)
 	if err != nil {
 		return err
 	}
@@ -206,24 +223,47 @@ func (t *tun) reload(c *config.C, initial bool) error {
 		return nil
 	}
 
-	routeTree, err := makeRouteTree(t.l, routes, false)
+	routeTree, err := makeRouteTree(t.l, routes, true)
 	if err != nil {
 		return err
 	}
 
+	oldMTU := t.MTU
+	oldMaxMTU := t.MaxMTU
+	t.MTU = c.GetInt("tun.mtu", DefaultMTU)
+	for i, r := range routes {
+		if r.MTU == 0 {
+			routes[i].MTU = t.MTU
+		}
+	}
+	t.MaxMTU = maxRouteMTU(t.MTU, routes)
+
 	// Teach nebula how to handle the routes before establishing them in the system table
 	oldRoutes := t.Routes.Swap(&routes)
 	t.routeTree.Store(routeTree)
 
 	if !initial {
+		if t.MaxMTU != oldMaxMTU {
+			if err := t.setMTU(); err != nil {
+				t.l.WithError(err).Error("Failed to set the device mtu")
+			} else {
+				t.l.Infof("Set max MTU to %v was %v", t.MaxMTU, oldMaxMTU)
+			}
+		}
+
+		if t.MTU != oldMTU {
+			t.setNetworkMTU()
+			t.l.Infof("Set default MTU to %v was %v", t.MTU, oldMTU)
+		}
+
 		// Remove first, if the system removes a wanted route hopefully it will be re-added next
 		err := t.removeRoutes(findRemovedRoutes(routes, *oldRoutes))
 		if err != nil {
 			util.LogWithContextIfNeeded("Failed to remove routes", err, t.l)
 		}
 
-		// Ensure any routes we actually want are installed
-		err = t.addRoutes(true)
+		// Install the new and changed routes, the rest are already in the system table
+		err = t.addRoutes(findRemovedRoutes(*oldRoutes, routes), true)
 		if err != nil {
 			// Catch any stray logs
 			util.LogWithContextIfNeeded("Failed to add routes", err, t.l)
@@ -233,6 +273,37 @@ func (t *tun) reload(c *config.C, initial bool) error {
 	return nil
 }
 
+// setMTU sets the device mtu to the largest route mtu
+func (t *tun) setMTU() error {
+	cmd := exec.Command("/sbin/ifconfig", t.Device, "mtu", strconv.Itoa(t.MaxMTU))
+	t.l.Debug("command: ", cmd.String())
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("failed to run 'ifconfig': %s", err)
+	}
+	return nil
+}
+
+// setNetworkMTU moves the routes for our vpn networks to tun.mtu, unless tun.routes has an mtu for the whole network
+func (t *tun) setNetworkMTU() {
+	routes := *t.Routes.Load()
+	for _, n := range t.vpnNetworks {
+		if hasNetworkRoute(routes, n) {
+			continue
+		}
+
+		cmd := exec.Command("/sbin/route", bsdRouteArgs("change", n, t.routeTarget(), t.MTU, 0)...)
+		t.l.Debug("command: ", cmd.String())
+		if err := cmd.Run(); err != nil {
+			t.l.WithError(err).WithField("network", n).Error("Failed to set the route mtu")
+		}
+	}
+}
+
+// routeTarget is where the route command sends our routes, freebsd routes point straight at the device
+func (t *tun) routeTarget() []string {
+	return []string{"-interface", t.Device}
+}
+
 func (t *tun) RouteFor(ip iputil.VpnIp) iputil.VpnIp {
 	_, r := t.routeTree.Load().MostSpecificContains(ip)
 	return r
@@ -250,18 +321,26 @@ func (t *tun) NewMultiQueueReader() (io.ReadWriteCloser, error) {
 	return nil, fmt.Errorf("TODO: multiqueue not implemented for freebsd")
 }
 
-func (t *tun) addRoutes(logErrors bool) error {
-	routes := *t.Routes.Load()
+func (t *tun) addRoutes(routes []Route, logErrors bool) error {
 	for _, r := range routes {
-		if r.Via == nil || !r.Install {
-			// We don't allow route MTUs so only install routes with a via
+		if !r.Install {
 			continue
 		}
 
-		cmd := exec.Command("/sbin/route", "-n", "add", "-net", r.Cidr.String(), "-interface", t.Device)
+		if r.Metric > 0 {
+			// freebsd has no route priorities, the most specific route always wins
+			t.l.WithField("route", r).Warn("route metric is not supported in freebsd")
+		}
+
+		action := "add"
+		if isNetworkRoute(t.vpnNetworks, r.Cidr) {
+			action = "change"
+		}
+
+		cmd := exec.Command("/sbin/route", bsdRouteArgs(action, r.Cidr, t.routeTarget(), r.MTU, 0)...)
 		t.l.Debug("command: ", cmd.String())
 		if err := cmd.Run(); err != nil {
-			retErr := util.NewContextualError("failed to run 'route add' for unsafe_route", map[string]interface{}{"route": r}, err)
+			retErr := util.NewContextualError("failed to run 'route add' for route", map[string]interface{}{"route": r}, err)
 			if logErrors {
 				retErr.Log(t.l)
 			} else {
@@ -279,7 +358,13 @@ func (t *tun) removeRoutes(routes []Route) error {
 			continue
 		}
 
-		cmd := exec.Command("/sbin/route", "-n", "delete", "-net", r.Cidr.String(), "-interface", t.Device)
+		args := bsdRouteArgs("delete", r.Cidr, t.routeTarget(), 0, 0)
+		if isNetworkRoute(t.vpnNetworks, r.Cidr) {
+			// Keep the route for our network, only put its mtu back
+			args = bsdRouteArgs("change", r.Cidr, t.routeTarget(), t.MTU, 0)
+		}
+
+		cmd := exec.Command("/sbin/route", args...)
 		t.l.Debug("command: ", cmd.String())
 		if err := cmd.Run(); err != nil {
 			t.l.WithError(err).WithField("route", r).Error("Failed to remove route")
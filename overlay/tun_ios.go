@@ -22,24 +22,29 @@ import (
 
 type tun struct {
 	io.ReadWriteCloser
-	cidr      *net.IPNet
-	Routes    atomic.Pointer[[]Route]
-	routeTree atomic.Pointer[cidr.Tree4[iputil.VpnIp]]
-	l         *logrus.Logger
+	cidr        *net.IPNet
+	vpnNetworks []*net.IPNet
+	Routes      atomic.Pointer[[]Route]
+	routeTree   atomic.Pointer[cidr.Tree6[iputil.VpnIp]]
+	l           *logrus.Logger
+
+	*runtimeRoutes
 }
 
-func newTun(_ *config.C, _ *logrus.Logger, _ *net.IPNet, _ bool) (*tun, error) {
+func newTun(_ *config.C, _ *logrus.Logger, _ []*net.IPNet, _ bool) (*tun, error) {
 	return nil, fmt.Errorf("newTun not supported in iOS")
 }
 
-func newTunFromFd(c *config.C, l *logrus.Logger, deviceFd int, cidr *net.IPNet) (*tun, error) {
+func newTunFromFd(c *config.C, l *logrus.Logger, deviceFd int, vpnNetworks []*net.IPNet) (*tun, error) {
 	file := os.NewFile(uintptr(deviceFd), "/dev/tun")
 	t := &tun{
-		cidr:            cidr,
+		cidr:            vpnNetworks[0],
+		vpnNetworks:     vpnNetworks,
 		ReadWriteCloser: &tunReadCloser{f: file},
 		l:               l,
 	}
 
+	t.runtimeRoutes = newRuntimeRoutes(c, t.vpnNetworks, t.reload)
 	err := t.reload(c, true)
 	if err != nil {
 		return nil, err
@@ -60,7 +65,7 @@ func (t *tun) Activate() error {
 }
 
 func (t *tun) reload(c *config.C, initial bool) error {
-	change, routes, err := getAllRoutesFromConfig(c, t.cidr, initial)
+	change, routes, err := t.getAllRoutes(c, initial)
 	if err != nil {
 		return err
 	}
@@ -10,6 +10,7 @@ import (
 	"net"
 	"os"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"unsafe"
 
@@ -27,18 +28,34 @@ type tun struct {
 	fd          int
 	Device      string
 	cidr        *net.IPNet
+	vpnNetworks []*net.IPNet
 	MaxMTU      int
 	DefaultMTU  int
 	TXQueueLen  int
 	deviceIndex int
 	ioctlFd     uintptr
+	// uring reads the tun queues through io_uring, see newTunQueue
+	uring bool
 
 	Routes          atomic.Pointer[[]Route]
-	routeTree       atomic.Pointer[cidr.Tree4[iputil.VpnIp]]
+	routeTree       atomic.Pointer[cidr.Tree6[iputil.VpnIp]]
 	routeChan       chan struct{}
 	useSystemRoutes bool
 
+	routeConflictMode RouteConflictMode
+	routeConflicts    map[string]routeConflict
+	pausedRoutes      atomic.Pointer[map[string]struct{}]
+	conflictLock      sync.Mutex
+	conflictChan      chan struct{}
+
+	// masquerade are the tun.masquerade entries, masqueradeActive is true while the nftables table for them exists
+	masquerade       atomic.Pointer[[]Masquerade]
+	masqueradeLock   sync.Mutex
+	masqueradeActive bool
+
 	l *logrus.Logger
+
+	*runtimeRoutes
 }
 
 type ifReq struct {
@@ -65,10 +82,10 @@ type ifreqQLEN struct {
 	pad   [8]byte
 }
 
-func newTunFromFd(c *config.C, l *logrus.Logger, deviceFd int, cidr *net.IPNet) (*tun, error) {
+func newTunFromFd(c *config.C, l *logrus.Logger, deviceFd int, vpnNetworks []*net.IPNet) (*tun, error) {
 	file := os.NewFile(uintptr(deviceFd), "/dev/net/tun")
 
-	t, err := newTunGeneric(c, l, file, cidr)
+	t, err := newTunGeneric(c, l, file, vpnNetworks)
 	if err != nil {
 		return nil, err
 	}
@@ -78,7 +95,7 @@ func newTunFromFd(c *config.C, l *logrus.Logger, deviceFd int, cidr *net.IPNet)
 	return t, nil
 }
 
-func newTun(c *config.C, l *logrus.Logger, cidr *net.IPNet, multiqueue bool) (*tun, error) {
+func newTun(c *config.C, l *logrus.Logger, vpnNetworks []*net.IPNet, multiqueue bool) (*tun, error) {
 	fd, err := unix.Open("/dev/net/tun", os.O_RDWR, 0)
 	if err != nil {
 		// If /dev/net/tun doesn't exist, try to create it (will happen in docker)
@@ -113,7 +130,7 @@ func newTun(c *config.C, l *logrus.Logger, cidr *net.IPNet, multiqueue bool) (*t
 	name := strings.Trim(string(req.Name[:]), "\x00")
 
 	file := os.NewFile(uintptr(fd), "/dev/net/tun")
-	t, err := newTunGeneric(c, l, file, cidr)
+	t, err := newTunGeneric(c, l, file, vpnNetworks)
 	if err != nil {
 		return nil, err
 	}
@@ -123,16 +140,21 @@ func newTun(c *config.C, l *logrus.Logger, cidr *net.IPNet, multiqueue bool) (*t
 	return t, nil
 }
 
-func newTunGeneric(c *config.C, l *logrus.Logger, file *os.File, cidr *net.IPNet) (*tun, error) {
+func newTunGeneric(c *config.C, l *logrus.Logger, file *os.File, vpnNetworks []*net.IPNet) (*tun, error) {
+	uring := c.GetBool("tun.io_uring", false)
 	t := &tun{
-		ReadWriteCloser: file,
+		ReadWriteCloser: newTunQueue(l, file, uring),
 		fd:              int(file.Fd()),
-		cidr:            cidr,
+		uring:           uring,
+		cidr:            vpnNetworks[0],
+		vpnNetworks:     vpnNetworks,
 		TXQueueLen:      c.GetInt("tun.tx_queue", 500),
 		useSystemRoutes: c.GetBool("tun.use_system_route_table", false),
 		l:               l,
 	}
+	t.pausedRoutes.Store(&map[string]struct{}{})
 
+	t.runtimeRoutes = newRuntimeRoutes(c, t.vpnNetworks, t.reload)
 	err := t.reload(c, true)
 	if err != nil {
 		return nil, err
@@ -149,13 +171,53 @@ func newTunGeneric(c *config.C, l *logrus.Logger, file *os.File, cidr *net.IPNet
 }
 
 func (t *tun) reload(c *config.C, initial bool) error {
-	routeChange, routes, err := getAllRoutesFromConfig(c, t.cidr, initial)
+	routeChange, routes, err := t.getAllRoutes(c, initial)
+	if err != nil {
+		return err
+	}
+
+	conflictMode, err := parseRouteConflictMode(c)
 	if err != nil {
 		return err
 	}
 
-	if !initial && !routeChange && !c.HasChanged("tun.mtu") {
-		return nil
+	if initial || c.HasChanged("tun.route_conflicts") {
+		t.conflictLock.Lock()
+		t.routeConflictMode = conflictMode
+		t.conflictLock.Unlock()
+
+		// Activate starts watching the first time
+		if !initial {
+			t.watchRouteConflicts()
+		}
+	}
+
+	if initial || c.HasChanged("tun.masquerade") {
+		masquerade, err := parseMasquerade(c, t.vpnNetworks)
+		if err != nil {
+			return err
+		}
+
+		t.masquerade.Store(&masquerade)
+		if !initial {
+			// The device exists after the initial load, Activate applies the entries the first time
+			if err := t.applyMasquerade(); err != nil {
+				return err
+			}
+		}
+	}
+
+	if !initial && !routeChange {
+		if c.HasChanged("tun.route_conflicts") {
+			// Re-evaluate with the new mode, this may pause or resume routes
+			if err := t.checkRouteConflicts(false); err != nil {
+				util.LogWithContextIfNeeded("Failed to check for route conflicts", err, t.l)
+			}
+		}
+
+		if !c.HasChanged("tun.mtu") {
+			return nil
+		}
 	}
 
 	routeTree, err := makeRouteTree(t.l, routes, true)
@@ -208,6 +270,12 @@ func (t *tun) reload(c *config.C, initial bool) error {
 			// This should never be called since addRoutes should log its own errors in a reload condition
 			util.LogWithContextIfNeeded("Failed to refresh routes", err, t.l)
 		}
+
+		if routeChange {
+			if err := t.checkRouteConflicts(false); err != nil {
+				util.LogWithContextIfNeeded("Failed to check for route conflicts", err, t.l)
+			}
+		}
 	}
 
 	return nil
@@ -228,7 +296,7 @@ func (t *tun) NewMultiQueueReader() (io.ReadWriteCloser, error) {
 
 	file := os.NewFile(uintptr(fd), "/dev/net/tun")
 
-	return file, nil
+	return newTunQueue(t.l, file, t.uring), nil
 }
 
 func (t *tun) RouteFor(ip iputil.VpnIp) iputil.VpnIp {
@@ -273,11 +341,6 @@ func (t *tun) Activate() error {
 		t.watchRoutes()
 	}
 
-	var addr, mask [4]byte
-
-	copy(addr[:], t.cidr.IP.To4())
-	copy(mask[:], t.cidr.Mask)
-
 	s, err := unix.Socket(
 		unix.AF_INET,
 		unix.SOCK_DGRAM,
@@ -288,23 +351,29 @@ func (t *tun) Activate() error {
 	}
 	t.ioctlFd = uintptr(s)
 
-	ifra := ifreqAddr{
-		Name: devName,
-		Addr: unix.RawSockaddrInet4{
-			Family: unix.AF_INET,
-			Addr:   addr,
-		},
-	}
+	if ip4 := t.cidr.IP.To4(); ip4 != nil {
+		var addr, mask [4]byte
+		copy(addr[:], ip4)
+		copy(mask[:], t.cidr.Mask)
+
+		ifra := ifreqAddr{
+			Name: devName,
+			Addr: unix.RawSockaddrInet4{
+				Family: unix.AF_INET,
+				Addr:   addr,
+			},
+		}
 
-	// Set the device ip address
-	if err = ioctl(t.ioctlFd, unix.SIOCSIFADDR, uintptr(unsafe.Pointer(&ifra))); err != nil {
-		return fmt.Errorf("failed to set tun address: %s", err)
-	}
+		// Set the device ip address
+		if err = ioctl(t.ioctlFd, unix.SIOCSIFADDR, uintptr(unsafe.Pointer(&ifra))); err != nil {
+			return fmt.Errorf("failed to set tun address: %s", err)
+		}
 
-	// Set the device network
-	ifra.Addr.Addr = mask
-	if err = ioctl(t.ioctlFd, unix.SIOCSIFNETMASK, uintptr(unsafe.Pointer(&ifra))); err != nil {
-		return fmt.Errorf("failed to set tun netmask: %s", err)
+		// Set the device network
+		ifra.Addr.Addr = mask
+		if err = ioctl(t.ioctlFd, unix.SIOCSIFNETMASK, uintptr(unsafe.Pointer(&ifra))); err != nil {
+			return fmt.Errorf("failed to set tun netmask: %s", err)
+		}
 	}
 
 	// Set the device name
@@ -335,6 +404,24 @@ func (t *tun) Activate() error {
 	}
 	t.deviceIndex = link.Attrs().Index
 
+	// The ioctls above only cover an ipv4 primary network, everything else goes through netlink
+	for _, n := range t.vpnNetworks {
+		if n == t.cidr && n.IP.To4() != nil {
+			continue
+		}
+		// There is nobody else on the overlay to collide with, skip duplicate address detection
+		err = netlink.AddrReplace(link, &netlink.Addr{IPNet: n, Flags: unix.IFA_F_NODAD})
+		if err != nil {
+			return fmt.Errorf("failed to add tun address %v: %s", n, err)
+		}
+	}
+
+	// Look for conflicts before installing anything, in pause mode the conflicting routes will be skipped
+	if err = t.checkRouteConflicts(true); err != nil {
+		return err
+	}
+	t.watchRouteConflicts()
+
 	if err = t.setDefaultRoute(); err != nil {
 		return err
 	}
@@ -344,6 +431,10 @@ func (t *tun) Activate() error {
 		return err
 	}
 
+	if err = t.applyMasquerade(); err != nil {
+		return err
+	}
+
 	// Run the interface
 	ifrf.Flags = ifrf.Flags | unix.IFF_UP | unix.IFF_RUNNING
 	if err = ioctl(t.ioctlFd, unix.SIOCSIFFLAGS, uintptr(unsafe.Pointer(&ifrf))); err != nil {
@@ -363,22 +454,24 @@ func (t *tun) setMTU() {
 }
 
 func (t *tun) setDefaultRoute() error {
-	// Default route
-	dr := &net.IPNet{IP: t.cidr.IP.Mask(t.cidr.Mask), Mask: t.cidr.Mask}
-	nr := netlink.Route{
-		LinkIndex: t.deviceIndex,
-		Dst:       dr,
-		MTU:       t.DefaultMTU,
-		AdvMSS:    t.advMSS(Route{}),
-		Scope:     unix.RT_SCOPE_LINK,
-		Src:       t.cidr.IP,
-		Protocol:  unix.RTPROT_KERNEL,
-		Table:     unix.RT_TABLE_MAIN,
-		Type:      unix.RTN_UNICAST,
-	}
-	err := netlink.RouteReplace(&nr)
-	if err != nil {
-		return fmt.Errorf("failed to set mtu %v on the default route %v; %v", t.DefaultMTU, dr, err)
+	// Default route for each vpn network
+	for _, n := range t.vpnNetworks {
+		dr := &net.IPNet{IP: n.IP.Mask(n.Mask), Mask: n.Mask}
+		nr := netlink.Route{
+			LinkIndex: t.deviceIndex,
+			Dst:       dr,
+			MTU:       t.DefaultMTU,
+			AdvMSS:    t.advMSS(Route{}),
+			Scope:     unix.RT_SCOPE_LINK,
+			Src:       n.IP,
+			Protocol:  unix.RTPROT_KERNEL,
+			Table:     unix.RT_TABLE_MAIN,
+			Type:      unix.RTN_UNICAST,
+		}
+		err := netlink.RouteReplace(&nr)
+		if err != nil {
+			return fmt.Errorf("failed to set mtu %v on the default route %v; %v", t.DefaultMTU, dr, err)
+		}
 	}
 
 	return nil
@@ -388,7 +481,7 @@ func (t *tun) addRoutes(logErrors bool) error {
 	// Path routes
 	routes := *t.Routes.Load()
 	for _, r := range routes {
-		if !r.Install {
+		if !r.Install || t.isRoutePaused(r) {
 			continue
 		}
 
@@ -499,19 +592,13 @@ func (t *tun) updateRoutes(r netlink.RouteUpdate) {
 		return
 	}
 
-	if !t.cidr.Contains(r.Gw) {
+	if !anyContains(t.vpnNetworks, r.Gw) {
 		// Gateway isn't in our overlay network, ignore
 		t.l.WithField("route", r).Debug("Ignoring route update, not in our network")
 		return
 	}
 
-	if x := r.Dst.IP.To4(); x == nil {
-		// Nebula only handles ipv4 on the overlay currently
-		t.l.WithField("route", r).Debug("Ignoring route update, destination is not ipv4")
-		return
-	}
-
-	newTree := cidr.NewTree4[iputil.VpnIp]()
+	newTree := cidr.NewTree6[iputil.VpnIp]()
 	if r.Type == unix.RTM_NEWROUTE {
 		for _, oldR := range t.routeTree.Load().List() {
 			newTree.AddCIDR(oldR.CIDR, oldR.Value)
@@ -541,6 +628,17 @@ func (t *tun) Close() error {
 		close(t.routeChan)
 	}
 
+	t.conflictLock.Lock()
+	if t.conflictChan != nil {
+		close(t.conflictChan)
+		t.conflictChan = nil
+	}
+	t.conflictLock.Unlock()
+
+	if err := t.removeMasquerade(); err != nil {
+		t.l.WithError(err).Error("Failed to remove the tun.masquerade rules")
+	}
+
 	if t.ReadWriteCloser != nil {
 		t.ReadWriteCloser.Close()
 	}
@@ -551,3 +649,8 @@ func (t *tun) Close() error {
 
 	return nil
 }
+
+// Pending returns true if a packet can be read from the first queue of the tun device without waiting
+func (t *tun) Pending() bool {
+	return t.ReadWriteCloser.(interface{ Pending() bool }).Pending()
+}
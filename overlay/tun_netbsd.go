@@ -28,14 +28,17 @@ type ifreqDestroy struct {
 }
 
 type tun struct {
-	Device    string
-	cidr      *net.IPNet
-	MTU       int
-	Routes    atomic.Pointer[[]Route]
-	routeTree atomic.Pointer[cidr.Tree4[iputil.VpnIp]]
-	l         *logrus.Logger
+	Device      string
+	cidr        *net.IPNet
+	vpnNetworks []*net.IPNet
+	MTU         int
+	Routes      atomic.Pointer[[]Route]
+	routeTree   atomic.Pointer[cidr.Tree6[iputil.VpnIp]]
+	l           *logrus.Logger
 
 	io.ReadWriteCloser
+
+	*runtimeRoutes
 }
 
 func (t *tun) Close() error {
@@ -59,13 +62,13 @@ func (t *tun) Close() error {
 	return nil
 }
 
-func newTunFromFd(_ *config.C, _ *logrus.Logger, _ int, _ *net.IPNet) (*tun, error) {
+func newTunFromFd(_ *config.C, _ *logrus.Logger, _ int, _ []*net.IPNet) (*tun, error) {
 	return nil, fmt.Errorf("newTunFromFd not supported in NetBSD")
 }
 
 var deviceNameRE = regexp.MustCompile(`^tun[0-9]+$`)
 
-func newTun(c *config.C, l *logrus.Logger, cidr *net.IPNet, _ bool) (*tun, error) {
+func newTun(c *config.C, l *logrus.Logger, vpnNetworks []*net.IPNet, _ bool) (*tun, error) {
 	// Try to open tun device
 	var file *os.File
 	var err error
@@ -85,11 +88,13 @@ func newTun(c *config.C, l *logrus.Logger, cidr *net.IPNet, _ bool) (*tun, error
 	t := &tun{
 		ReadWriteCloser: file,
 		Device:          deviceName,
-		cidr:            cidr,
+		cidr:            vpnNetworks[0],
+		vpnNetworks:     vpnNetworks,
 		MTU:             c.GetInt("tun.mtu", DefaultMTU),
 		l:               l,
 	}
 
+	t.runtimeRoutes = newRuntimeRoutes(c, t.vpnNetworks, t.reload)
 	err = t.reload(c, true)
 	if err != nil {
 		return nil, err
@@ -109,19 +114,28 @@ func (t *tun) Activate() error {
 	var err error
 
 	// TODO use syscalls instead of exec.Command
-	cmd := exec.Command("/sbin/ifconfig", t.Device, t.cidr.String(), t.cidr.IP.String())
-	t.l.Debug("command: ", cmd.String())
-	if err = cmd.Run(); err != nil {
-		return fmt.Errorf("failed to run 'ifconfig': %s", err)
-	}
+	for i, n := range t.vpnNetworks {
+		var cmd *exec.Cmd
+		if n.IP.To4() == nil {
+			cmd = exec.Command("/sbin/ifconfig", t.Device, "inet6", n.String(), "alias")
+		} else if i == 0 {
+			cmd = exec.Command("/sbin/ifconfig", t.Device, n.String(), n.IP.String())
+		} else {
+			cmd = exec.Command("/sbin/ifconfig", t.Device, n.String(), n.IP.String(), "alias")
+		}
+		t.l.Debug("command: ", cmd.String())
+		if err = cmd.Run(); err != nil {
+			return fmt.Errorf("failed to run 'ifconfig': %s", err)
+		}
 
-	cmd = exec.Command("/sbin/route", "-n", "add", "-net", t.cidr.String(), t.cidr.IP.String())
-	t.l.Debug("command: ", cmd.String())
-	if err = cmd.Run(); err != nil {
-		return fmt.Errorf("failed to run 'route add': %s", err)
+		cmd = exec.Command("/sbin/route", "-n", "add", routeFamily(n), "-net", n.String(), n.IP.String())
+		t.l.Debug("command: ", cmd.String())
+		if err = cmd.Run(); err != nil {
+			return fmt.Errorf("failed to run 'route add': %s", err)
+		}
 	}
 
-	cmd = exec.Command("/sbin/ifconfig", t.Device, "mtu", strconv.Itoa(t.MTU))
+	cmd := exec.Command("/sbin/ifconfig", t.Device, "mtu", strconv.Itoa(t.MTU))
 	t.l.Debug("command: ", cmd.String())
 	if err = cmd.Run(); err != nil {
 		return fmt.Errorf("failed to run 'ifconfig': %s", err)
@@ -132,7 +146,7 @@ func (t *tun) Activate() error {
 }
 
 func (t *tun) reload(c *config.C, initial bool) error {
-	change, routes, err := getAllRoutesFromConfig(c, t.cidr, initial)
+	change, routes, err := t.getAllRoutes(c, initial)
 	if err != nil {
 		return err
 	}
@@ -193,7 +207,17 @@ func (t *tun) addRoutes(logErrors bool) error {
 			continue
 		}
 
-		cmd := exec.Command("/sbin/route", "-n", "add", "-net", r.Cidr.String(), t.cidr.IP.String())
+		gw := routeGateway(t.vpnNetworks, r.Cidr)
+		if gw == nil {
+			retErr := util.NewContextualError("no vpn network of the same address family for unsafe_route", map[string]interface{}{"route": r}, nil)
+			if logErrors {
+				retErr.Log(t.l)
+				continue
+			}
+			return retErr
+		}
+
+		cmd := exec.Command("/sbin/route", "-n", "add", routeFamily(r.Cidr), "-net", r.Cidr.String(), gw.String())
 		t.l.Debug("command: ", cmd.String())
 		if err := cmd.Run(); err != nil {
 			retErr := util.NewContextualError("failed to run 'route add' for unsafe_route", map[string]interface{}{"route": r}, err)
@@ -214,7 +238,12 @@ func (t *tun) removeRoutes(routes []Route) error {
 			continue
 		}
 
-		cmd := exec.Command("/sbin/route", "-n", "delete", "-net", r.Cidr.String(), t.cidr.IP.String())
+		gw := routeGateway(t.vpnNetworks, r.Cidr)
+		if gw == nil {
+			continue
+		}
+
+		cmd := exec.Command("/sbin/route", "-n", "delete", routeFamily(r.Cidr), "-net", r.Cidr.String(), gw.String())
 		t.l.Debug("command: ", cmd.String())
 		if err := cmd.Run(); err != nil {
 			t.l.WithError(err).WithField("route", r).Error("Failed to remove route")
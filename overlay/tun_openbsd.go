@@ -22,17 +22,22 @@ import (
 )
 
 type tun struct {
-	Device    string
-	cidr      *net.IPNet
-	MTU       int
-	Routes    atomic.Pointer[[]Route]
-	routeTree atomic.Pointer[cidr.Tree4[iputil.VpnIp]]
-	l         *logrus.Logger
+	Device      string
+	cidr        *net.IPNet
+	vpnNetworks []*net.IPNet
+	MTU         int
+	MaxMTU      int
+	Routes      atomic.Pointer[[]Route]
+	routeTree   atomic.Pointer[cidr.Tree6[iputil.VpnIp]]
+	l           *logrus.Logger
 
 	io.ReadWriteCloser
 
-	// cache out buffer since we need to prepend 4 bytes for tun metadata
+	// cache in and out buffers since we need to strip or prepend 4 bytes for tun metadata
+	in  []byte
 	out []byte
+
+	*runtimeRoutes
 }
 
 func (t *tun) Close() error {
@@ -43,13 +48,16 @@ func (t *tun) Close() error {
 	return nil
 }
 
-func newTunFromFd(_ *config.C, _ *logrus.Logger, _ int, _ *net.IPNet) (*tun, error) {
+func newTunFromFd(_ *config.C, _ *logrus.Logger, _ int, _ []*net.IPNet) (*tun, error) {
 	return nil, fmt.Errorf("newTunFromFd not supported in OpenBSD")
 }
 
 var deviceNameRE = regexp.MustCompile(`^tun[0-9]+$`)
 
-func newTun(c *config.C, l *logrus.Logger, cidr *net.IPNet, _ bool) (*tun, error) {
+// openbsdMaxRoutePriority is RTP_MAX, the highest route priority openbsd accepts
+const openbsdMaxRoutePriority = 63
+
+func newTun(c *config.C, l *logrus.Logger, vpnNetworks []*net.IPNet, _ bool) (*tun, error) {
 	deviceName := c.GetString("tun.dev", "")
 	if deviceName == "" {
 		return nil, fmt.Errorf("a device name in the format of tunN must be specified")
@@ -67,11 +75,13 @@ func newTun(c *config.C, l *logrus.Logger, cidr *net.IPNet, _ bool) (*tun, error
 	t := &tun{
 		ReadWriteCloser: file,
 		Device:          deviceName,
-		cidr:            cidr,
+		cidr:            vpnNetworks[0],
+		vpnNetworks:     vpnNetworks,
 		MTU:             c.GetInt("tun.mtu", DefaultMTU),
 		l:               l,
 	}
 
+	t.runtimeRoutes = newRuntimeRoutes(c, t.vpnNetworks, t.reload)
 	err = t.reload(c, true)
 	if err != nil {
 		return nil, err
@@ -88,7 +98,9 @@ func newTun(c *config.C, l *logrus.Logger, cidr *net.IPNet, _ bool) (*tun, error
 }
 
 func (t *tun) reload(c *config.C, initial bool) error {
-	change, routes, err := getAllRoutesFromConfig(c, t.cidr, initial)
+	// Routes without an mtu get tun.mtu so they must be read again when it changes
+	mtuChange := !initial && c.HasChanged("tun.mtu")
+	change, routes, err := t.getAllRoutes(c, initial || mtuChange)
 	if err != nil {
 		return err
 	}
@@ -97,24 +109,47 @@ func (t *tun) reload(c *config.C, initial bool) error {
 		return nil
 	}
 
-	routeTree, err := makeRouteTree(t.l, routes, false)
+	routeTree, err := makeRouteTree(t.l, routes, true)
 	if err != nil {
 		return err
 	}
 
+	oldMTU := t.MTU
+	oldMaxMTU := t.MaxMTU
+	t.MTU = c.GetInt("tun.mtu", DefaultMTU)
+	for i, r := range routes {
+		if r.MTU == 0 {
+			routes[i].MTU = t.MTU
+		}
+	}
+	t.MaxMTU = maxRouteMTU(t.MTU, routes)
+
 	// Teach nebula how to handle the routes before establishing them in the system table
 	oldRoutes := t.Routes.Swap(&routes)
 	t.routeTree.Store(routeTree)
 
 	if !initial {
+		if t.MaxMTU != oldMaxMTU {
+			if err := t.setMTU(); err != nil {
+				t.l.WithError(err).Error("Failed to set the device mtu")
+			} else {
+				t.l.Infof("Set max MTU to %v was %v", t.MaxMTU, oldMaxMTU)
+			}
+		}
+
+		if t.MTU != oldMTU {
+			t.setNetworkMTU()
+			t.l.Infof("Set default MTU to %v was %v", t.MTU, oldMTU)
+		}
+
 		// Remove first, if the system removes a wanted route hopefully it will be re-added next
 		err := t.removeRoutes(findRemovedRoutes(routes, *oldRoutes))
 		if err != nil {
 			util.LogWithContextIfNeeded("Failed to remove routes", err, t.l)
 		}
 
-		// Ensure any routes we actually want are installed
-		err = t.addRoutes(true)
+		// Install the new and changed routes, the rest are already in the system table
+		err = t.addRoutes(findRemovedRoutes(*oldRoutes, routes), true)
 		if err != nil {
 			// Catch any stray logs
 			util.LogWithContextIfNeeded("Failed to add routes", err, t.l)
@@ -124,29 +159,64 @@ func (t *tun) reload(c *config.C, initial bool) error {
 	return nil
 }
 
-func (t *tun) Activate() error {
-	var err error
-	// TODO use syscalls instead of exec.Command
-	cmd := exec.Command("/sbin/ifconfig", t.Device, t.cidr.String(), t.cidr.IP.String())
+// setMTU sets the device mtu to the largest route mtu
+func (t *tun) setMTU() error {
+	cmd := exec.Command("/sbin/ifconfig", t.Device, "mtu", strconv.Itoa(t.MaxMTU))
 	t.l.Debug("command: ", cmd.String())
-	if err = cmd.Run(); err != nil {
+	if err := cmd.Run(); err != nil {
 		return fmt.Errorf("failed to run 'ifconfig': %s", err)
 	}
+	return nil
+}
+
+// setNetworkMTU moves the routes for our vpn networks to tun.mtu, unless tun.routes has an mtu for the whole network
+func (t *tun) setNetworkMTU() {
+	routes := *t.Routes.Load()
+	for _, n := range t.vpnNetworks {
+		if hasNetworkRoute(routes, n) {
+			continue
+		}
 
-	cmd = exec.Command("/sbin/ifconfig", t.Device, "mtu", strconv.Itoa(t.MTU))
+		cmd := exec.Command("/sbin/route", bsdRouteArgs("change", n, []string{n.IP.String()}, t.MTU, 0)...)
+		t.l.Debug("command: ", cmd.String())
+		if err := cmd.Run(); err != nil {
+			t.l.WithError(err).WithField("network", n).Error("Failed to set the route mtu")
+		}
+	}
+}
+
+func (t *tun) Activate() error {
+	var err error
+	// TODO use syscalls instead of exec.Command
+	// The mtu goes first, a route can not have a larger mtu than the device
+	cmd := exec.Command("/sbin/ifconfig", t.Device, "mtu", strconv.Itoa(t.MaxMTU))
 	t.l.Debug("command: ", cmd.String())
 	if err = cmd.Run(); err != nil {
 		return fmt.Errorf("failed to run 'ifconfig': %s", err)
 	}
 
-	cmd = exec.Command("/sbin/route", "-n", "add", "-inet", t.cidr.String(), t.cidr.IP.String())
-	t.l.Debug("command: ", cmd.String())
-	if err = cmd.Run(); err != nil {
-		return fmt.Errorf("failed to run 'route add': %s", err)
+	for i, n := range t.vpnNetworks {
+		if n.IP.To4() == nil {
+			cmd = exec.Command("/sbin/ifconfig", t.Device, "inet6", n.String(), "alias")
+		} else if i == 0 {
+			cmd = exec.Command("/sbin/ifconfig", t.Device, n.String(), n.IP.String())
+		} else {
+			cmd = exec.Command("/sbin/ifconfig", t.Device, n.String(), n.IP.String(), "alias")
+		}
+		t.l.Debug("command: ", cmd.String())
+		if err = cmd.Run(); err != nil {
+			return fmt.Errorf("failed to run 'ifconfig': %s", err)
+		}
+
+		cmd = exec.Command("/sbin/route", bsdRouteArgs("add", n, []string{n.IP.String()}, t.MTU, 0)...)
+		t.l.Debug("command: ", cmd.String())
+		if err = cmd.Run(); err != nil {
+			return fmt.Errorf("failed to run 'route add': %s", err)
+		}
 	}
 
-	// Unsafe path routes
-	return t.addRoutes(false)
+	// Route mtus and unsafe path routes
+	return t.addRoutes(*t.Routes.Load(), false)
 }
 
 func (t *tun) RouteFor(ip iputil.VpnIp) iputil.VpnIp {
@@ -154,18 +224,41 @@ func (t *tun) RouteFor(ip iputil.VpnIp) iputil.VpnIp {
 	return r
 }
 
-func (t *tun) addRoutes(logErrors bool) error {
-	routes := *t.Routes.Load()
+func (t *tun) addRoutes(routes []Route, logErrors bool) error {
 	for _, r := range routes {
-		if r.Via == nil || !r.Install {
-			// We don't allow route MTUs so only install routes with a via
+		if !r.Install {
 			continue
 		}
 
-		cmd := exec.Command("/sbin/route", "-n", "add", "-inet", r.Cidr.String(), t.cidr.IP.String())
+		gw := routeGateway(t.vpnNetworks, r.Cidr)
+		if gw == nil {
+			retErr := util.NewContextualError("no vpn network of the same address family for route", map[string]interface{}{"route": r}, nil)
+			if logErrors {
+				retErr.Log(t.l)
+				continue
+			}
+			return retErr
+		}
+
+		// The metric is the route priority, lower is preferred like on linux
+		if r.Metric > openbsdMaxRoutePriority {
+			retErr := util.NewContextualError("route metric is above the openbsd maximum route priority", map[string]interface{}{"route": r, "max": openbsdMaxRoutePriority}, nil)
+			if logErrors {
+				retErr.Log(t.l)
+				continue
+			}
+			return retErr
+		}
+
+		action := "add"
+		if isNetworkRoute(t.vpnNetworks, r.Cidr) {
+			action = "change"
+		}
+
+		cmd := exec.Command("/sbin/route", bsdRouteArgs(action, r.Cidr, []string{gw.String()}, r.MTU, r.Metric)...)
 		t.l.Debug("command: ", cmd.String())
 		if err := cmd.Run(); err != nil {
-			retErr := util.NewContextualError("failed to run 'route add' for unsafe_route", map[string]interface{}{"route": r}, err)
+			retErr := util.NewContextualError("failed to run 'route add' for route", map[string]interface{}{"route": r}, err)
 			if logErrors {
 				retErr.Log(t.l)
 			} else {
@@ -183,7 +276,18 @@ func (t *tun) removeRoutes(routes []Route) error {
 			continue
 		}
 
-		cmd := exec.Command("/sbin/route", "-n", "delete", "-inet", r.Cidr.String(), t.cidr.IP.String())
+		gw := routeGateway(t.vpnNetworks, r.Cidr)
+		if gw == nil {
+			continue
+		}
+
+		args := bsdRouteArgs("delete", r.Cidr, []string{gw.String()}, 0, 0)
+		if isNetworkRoute(t.vpnNetworks, r.Cidr) {
+			// Keep the route for our network, only put its mtu back
+			args = bsdRouteArgs("change", r.Cidr, []string{gw.String()}, t.MTU, 0)
+		}
+
+		cmd := exec.Command("/sbin/route", args...)
 		t.l.Debug("command: ", cmd.String())
 		if err := cmd.Run(); err != nil {
 			t.l.WithError(err).WithField("route", r).Error("Failed to remove route")
@@ -203,16 +307,22 @@ func (t *tun) Name() string {
 }
 
 func (t *tun) NewMultiQueueReader() (io.ReadWriteCloser, error) {
-	return nil, fmt.Errorf("TODO: multiqueue not implemented for freebsd")
+	return nil, fmt.Errorf("TODO: multiqueue not implemented for openbsd")
 }
 
+// Read is only valid for single threaded use
 func (t *tun) Read(to []byte) (int, error) {
-	buf := make([]byte, len(to)+4)
+	if cap(t.in) < len(to)+4 {
+		t.in = make([]byte, len(to)+4)
+	}
+	buf := t.in[:len(to)+4]
 
 	n, err := t.ReadWriteCloser.Read(buf)
+	if n < 4 {
+		return 0, err
+	}
 
-	copy(to, buf[4:])
-	return n - 4, err
+	return copy(to, buf[4:n]), err
 }
 
 // Write is only valid for single threaded use
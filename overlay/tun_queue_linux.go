@@ -0,0 +1,125 @@
+//go:build !android && !e2e_testing
+// +build !android,!e2e_testing
+
+package overlay
+
+import (
+	"io"
+	"os"
+
+	"github.com/sirupsen/logrus"
+	"github.com/slackhq/nebula/iouring"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// tunUringDepth is how many reads are kept outstanding on a tun queue read through io_uring
+	tunUringDepth = 64
+	// tunReadSize is the largest packet read from the tun device, the reader's buffer is no bigger
+	tunReadSize = 9001
+)
+
+// tunQueue is a tun queue read with read(2)
+type tunQueue struct {
+	*os.File
+	fd int
+}
+
+// Pending returns true if a packet can be read without waiting
+func (q *tunQueue) Pending() bool {
+	return pollReadable(q.fd)
+}
+
+// uringQueue is a tun queue with reads kept outstanding in an io_uring, packets the kernel hands us in one round are
+// returned by the following calls to Read without another syscall. Writes go through the file.
+type uringQueue struct {
+	*os.File
+	ring *iouring.Ring
+	bufs [][]byte
+	// ready holds the completions not yet returned by Read, in the order they arrived
+	ready []uringRead
+}
+
+type uringRead struct {
+	buf int
+	res int32
+}
+
+// newTunQueue wraps a tun queue file, reading it through io_uring if asked to and the kernel allows it
+func newTunQueue(l *logrus.Logger, file *os.File, uring bool) io.ReadWriteCloser {
+	if !uring {
+		return &tunQueue{File: file, fd: int(file.Fd())}
+	}
+
+	ring, err := iouring.New(tunUringDepth)
+	if err != nil {
+		l.WithError(err).Warn("Failed to set up io_uring for the tun device, falling back to read")
+		return &tunQueue{File: file, fd: int(file.Fd())}
+	}
+
+	q := &uringQueue{File: file, ring: ring, bufs: make([][]byte, tunUringDepth)}
+	for i := range q.bufs {
+		q.bufs[i] = make([]byte, tunReadSize)
+		ring.PrepRead(int(file.Fd()), q.bufs[i], uint64(i))
+	}
+	return q
+}
+
+func (q *uringQueue) Read(b []byte) (int, error) {
+	for len(q.ready) == 0 {
+		if err := q.ring.Submit(1); err != nil {
+			return 0, err
+		}
+		q.reap()
+	}
+
+	r := q.ready[0]
+	q.ready = q.ready[1:]
+
+	var n int
+	var err error
+	switch {
+	case r.res >= 0:
+		n = copy(b, q.bufs[r.buf][:r.res])
+	case unix.Errno(-r.res) == unix.EBADF:
+		return 0, os.ErrClosed
+	default:
+		err = &os.PathError{Op: "read", Path: q.Name(), Err: unix.Errno(-r.res)}
+	}
+
+	// The buffer is ours again, hand it back to the kernel with the next submit
+	q.ring.PrepRead(int(q.Fd()), q.bufs[r.buf], uint64(r.buf))
+	return n, err
+}
+
+// Pending returns true if a packet can be returned by Read without waiting
+func (q *uringQueue) Pending() bool {
+	if len(q.ready) == 0 {
+		q.reap()
+	}
+	return len(q.ready) > 0
+}
+
+// reap moves everything that has completed to ready
+func (q *uringQueue) reap() {
+	for {
+		userData, res, ok := q.ring.Completion()
+		if !ok {
+			return
+		}
+		q.ready = append(q.ready, uringRead{buf: int(userData), res: res})
+	}
+}
+
+// Close closes the file, like a blocking read(2) a reader waiting on the ring is not woken up so the ring stays mapped
+// for it
+func (q *uringQueue) Close() error {
+	return q.File.Close()
+}
+
+// pollReadable returns true if fd can be read without waiting
+func pollReadable(fd int) bool {
+	fds := []unix.PollFd{{Fd: int32(fd), Events: unix.POLLIN}}
+	n, err := unix.Poll(fds, 0)
+	return err == nil && n > 0
+}
@@ -17,24 +17,33 @@ import (
 )
 
 type waterTun struct {
-	Device    string
-	cidr      *net.IPNet
-	MTU       int
-	Routes    atomic.Pointer[[]Route]
-	routeTree atomic.Pointer[cidr.Tree4[iputil.VpnIp]]
-	l         *logrus.Logger
-	f         *net.Interface
+	Device      string
+	cidr        *net.IPNet
+	vpnNetworks []*net.IPNet
+	MTU         int
+	Routes      atomic.Pointer[[]Route]
+	routeTree   atomic.Pointer[cidr.Tree6[iputil.VpnIp]]
+	l           *logrus.Logger
+	f           *net.Interface
 	*water.Interface
+
+	*runtimeRoutes
 }
 
-func newWaterTun(c *config.C, l *logrus.Logger, cidr *net.IPNet, _ bool) (*waterTun, error) {
+func newWaterTun(c *config.C, l *logrus.Logger, vpnNetworks []*net.IPNet, _ bool) (*waterTun, error) {
+	if vpnNetworks[0].IP.To4() == nil {
+		return nil, fmt.Errorf("the wintap driver requires an ipv4 network in the certificate")
+	}
+
 	// NOTE: You cannot set the deviceName under Windows, so you must check tun.Device after calling .Activate()
 	t := &waterTun{
-		cidr: cidr,
-		MTU:  c.GetInt("tun.mtu", DefaultMTU),
-		l:    l,
+		cidr:        vpnNetworks[0],
+		vpnNetworks: vpnNetworks,
+		MTU:         c.GetInt("tun.mtu", DefaultMTU),
+		l:           l,
 	}
 
+	t.runtimeRoutes = newRuntimeRoutes(c, t.vpnNetworks, t.reload)
 	err := t.reload(c, true)
 	if err != nil {
 		return nil, err
@@ -77,6 +86,27 @@ func (t *waterTun) Activate() error {
 	if err != nil {
 		return fmt.Errorf("failed to run 'netsh' to set address: %s", err)
 	}
+
+	for _, n := range t.vpnNetworks[1:] {
+		var cmd *exec.Cmd
+		if n.IP.To4() != nil {
+			cmd = exec.Command(
+				`C:\Windows\System32\netsh.exe`, "interface", "ipv4", "add", "address",
+				fmt.Sprintf("name=%s", t.Device),
+				fmt.Sprintf("addr=%s", n.IP),
+				fmt.Sprintf("mask=%s", net.IP(n.Mask)),
+			)
+		} else {
+			cmd = exec.Command(
+				`C:\Windows\System32\netsh.exe`, "interface", "ipv6", "add", "address",
+				fmt.Sprintf("interface=%s", t.Device),
+				fmt.Sprintf("address=%s", n),
+			)
+		}
+		if err = cmd.Run(); err != nil {
+			return fmt.Errorf("failed to run 'netsh' to add address %s: %s", n, err)
+		}
+	}
 	err = exec.Command(
 		`C:\Windows\System32\netsh.exe`, "interface", "ipv4", "set", "interface",
 		t.Device,
@@ -100,7 +130,7 @@ func (t *waterTun) Activate() error {
 }
 
 func (t *waterTun) reload(c *config.C, initial bool) error {
-	change, routes, err := getAllRoutesFromConfig(c, t.cidr, initial)
+	change, routes, err := t.getAllRoutes(c, initial)
 	if err != nil {
 		return err
 	}
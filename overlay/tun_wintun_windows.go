@@ -2,10 +2,12 @@ package overlay
 
 import (
 	"crypto"
+	"errors"
 	"fmt"
 	"io"
 	"net"
 	"net/netip"
+	"sync"
 	"sync/atomic"
 	"unsafe"
 
@@ -22,15 +24,28 @@ import (
 const tunGUIDLabel = "Fixed Nebula Windows GUID v1"
 
 type winTun struct {
-	Device    string
-	cidr      *net.IPNet
-	prefix    netip.Prefix
-	MTU       int
-	Routes    atomic.Pointer[[]Route]
-	routeTree atomic.Pointer[cidr.Tree4[iputil.VpnIp]]
-	l         *logrus.Logger
+	Device      string
+	cidr        *net.IPNet
+	vpnNetworks []*net.IPNet
+	prefixes    []netip.Prefix
+	MTU         int
+	Routes      atomic.Pointer[[]Route]
+	routeTree   atomic.Pointer[cidr.Tree6[iputil.VpnIp]]
+	l           *logrus.Logger
+
+	// metric is the interface metric from tun.metric, 0 leaves it to windows unless we carry a default route
+	metric uint32
+	dns    winDNS
+	// ifLock serializes changes to the interface settings
+	ifLock sync.Mutex
+
+	// routeWatcher tells us when routes on our interface are deleted so another agent can not take them away for good
+	routeWatcher *winipcfg.RouteChangeCallback
+	routeRestore chan struct{}
 
 	tun *wintun.NativeTun
+
+	*runtimeRoutes
 }
 
 func generateGUIDByDeviceName(name string) (*windows.GUID, error) {
@@ -52,26 +67,35 @@ func generateGUIDByDeviceName(name string) (*windows.GUID, error) {
 	return (*windows.GUID)(unsafe.Pointer(&sum[0])), nil
 }
 
-func newWinTun(c *config.C, l *logrus.Logger, cidr *net.IPNet, _ bool) (*winTun, error) {
+func newWinTun(c *config.C, l *logrus.Logger, vpnNetworks []*net.IPNet, _ bool) (*winTun, error) {
 	deviceName := c.GetString("tun.dev", "")
 	guid, err := generateGUIDByDeviceName(deviceName)
 	if err != nil {
 		return nil, fmt.Errorf("generate GUID failed: %w", err)
 	}
 
-	prefix, err := iputil.ToNetIpPrefix(*cidr)
-	if err != nil {
-		return nil, err
+	prefixes := make([]netip.Prefix, len(vpnNetworks))
+	for i, n := range vpnNetworks {
+		prefixes[i], err = iputil.ToNetIpPrefix(*n)
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	t := &winTun{
-		Device: deviceName,
-		cidr:   cidr,
-		prefix: prefix,
-		MTU:    c.GetInt("tun.mtu", DefaultMTU),
-		l:      l,
+		Device:      deviceName,
+		cidr:        vpnNetworks[0],
+		vpnNetworks: vpnNetworks,
+		prefixes:    prefixes,
+		MTU:         c.GetInt("tun.mtu", DefaultMTU),
+		l:           l,
+	}
+
+	if err = t.reloadInterface(c, true); err != nil {
+		return nil, err
 	}
 
+	t.runtimeRoutes = newRuntimeRoutes(c, t.vpnNetworks, t.reload)
 	err = t.reload(c, true)
 	if err != nil {
 		return nil, err
@@ -100,8 +124,82 @@ func newWinTun(c *config.C, l *logrus.Logger, cidr *net.IPNet, _ bool) (*winTun,
 	return t, nil
 }
 
+// winDNS is tun.dns, the dns settings of the interface
+type winDNS struct {
+	servers []netip.Addr
+	domains []string
+	// register is nil when tun.dns.register is not set, windows decides whether our addresses are registered then
+	register *bool
+}
+
+func parseWinDNS(c *config.C) (winDNS, error) {
+	var d winDNS
+	for i, s := range c.GetStringSlice("tun.dns.servers", nil) {
+		addr, err := netip.ParseAddr(s)
+		if err != nil {
+			return d, fmt.Errorf("entry %v in tun.dns.servers is not an ip address: %v", i+1, s)
+		}
+		d.servers = append(d.servers, addr)
+	}
+
+	d.domains = c.GetStringSlice("tun.dns.domains", nil)
+	if c.Get("tun.dns.register") != nil {
+		register := c.GetBool("tun.dns.register", false)
+		d.register = &register
+	}
+
+	return d, nil
+}
+
+// reloadInterface reads tun.mtu, tun.metric and tun.dns, applying them to the interface on a reload
+func (t *winTun) reloadInterface(c *config.C, initial bool) error {
+	if initial || c.HasChanged("tun.mtu") || c.HasChanged("tun.metric") {
+		metric := c.GetInt("tun.metric", 0)
+		if metric < 0 {
+			return fmt.Errorf("tun.metric must not be negative: %v", metric)
+		}
+
+		t.ifLock.Lock()
+		t.MTU = c.GetInt("tun.mtu", DefaultMTU)
+		t.metric = uint32(metric)
+		t.ifLock.Unlock()
+
+		if !initial {
+			if err := t.setInterface(); err != nil {
+				return err
+			}
+			t.l.WithField("mtu", t.MTU).WithField("metric", metric).Info("Updated the tun interface")
+		}
+	}
+
+	if initial || c.HasChanged("tun.dns") {
+		dns, err := parseWinDNS(c)
+		if err != nil {
+			return err
+		}
+
+		t.ifLock.Lock()
+		t.dns = dns
+		t.ifLock.Unlock()
+
+		if !initial {
+			if err := t.setDNS(true); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
 func (t *winTun) reload(c *config.C, initial bool) error {
-	change, routes, err := getAllRoutesFromConfig(c, t.cidr, initial)
+	if !initial {
+		if err := t.reloadInterface(c, false); err != nil {
+			util.LogWithContextIfNeeded("Failed to update the tun interface", err, t.l)
+		}
+	}
+
+	change, routes, err := t.getAllRoutes(c, initial)
 	if err != nil {
 		return err
 	}
@@ -140,7 +238,7 @@ func (t *winTun) reload(c *config.C, initial bool) error {
 func (t *winTun) Activate() error {
 	luid := winipcfg.LUID(t.tun.LUID())
 
-	err := luid.SetIPAddresses([]netip.Prefix{t.prefix})
+	err := luid.SetIPAddresses(t.prefixes)
 	if err != nil {
 		return fmt.Errorf("failed to set address: %w", err)
 	}
@@ -150,13 +248,103 @@ func (t *winTun) Activate() error {
 		return err
 	}
 
+	if err = t.setDNS(false); err != nil {
+		return err
+	}
+
+	t.routeRestore = make(chan struct{}, 1)
+	t.routeWatcher, err = winipcfg.RegisterRouteChangeCallback(func(n winipcfg.MibNotificationType, route *winipcfg.MibIPforwardRow2) {
+		if n != winipcfg.MibDeleteInstance || route.InterfaceLUID != luid {
+			return
+		}
+
+		select {
+		case t.routeRestore <- struct{}{}:
+		default:
+		}
+	})
+	if err != nil {
+		return fmt.Errorf("failed to watch for route changes: %w", err)
+	}
+	go t.restoreRoutes()
+
+	return nil
+}
+
+// restoreRoutes puts back any of our routes that were deleted behind our back, like by a vpn client that takes over
+// the route table when it connects
+func (t *winTun) restoreRoutes() {
+	luid := winipcfg.LUID(t.tun.LUID())
+	for range t.routeRestore {
+		for _, r := range *t.Routes.Load() {
+			if r.Via == nil || !r.Install {
+				continue
+			}
+
+			prefix, err := iputil.ToNetIpPrefix(*r.Cidr)
+			if err != nil {
+				continue
+			}
+
+			if _, err := luid.Route(prefix, r.Via.ToNetIpAddr()); err == nil {
+				continue
+			}
+
+			if err := luid.AddRoute(prefix, r.Via.ToNetIpAddr(), uint32(r.Metric)); err != nil {
+				t.l.WithError(err).WithField("route", r).Error("Failed to restore a removed route")
+			} else {
+				t.l.WithField("route", r).Warn("Restored a route that was removed outside of nebula")
+			}
+		}
+	}
+}
+
+// setDNS applies tun.dns to the interface, servers and domains are only touched when configured unless force is set so
+// the previous ones are cleared on a reload
+func (t *winTun) setDNS(force bool) error {
+	t.ifLock.Lock()
+	defer t.ifLock.Unlock()
+
+	luid := winipcfg.LUID(t.tun.LUID())
+	if force || len(t.dns.servers) > 0 || len(t.dns.domains) > 0 {
+		for _, family := range []winipcfg.AddressFamily{windows.AF_INET, windows.AF_INET6} {
+			if err := luid.SetDNS(family, t.dns.servers, t.dns.domains); err != nil {
+				return fmt.Errorf("failed to set dns servers: %w", err)
+			}
+		}
+	}
+
+	if t.dns.register == nil {
+		return nil
+	}
+
+	guid, err := luid.GUID()
+	if err != nil {
+		return fmt.Errorf("failed to get the interface guid: %w", err)
+	}
+
+	settings := &winipcfg.DnsInterfaceSettings{
+		Version: winipcfg.DnsInterfaceSettingsVersion1,
+		Flags:   winipcfg.DnsInterfaceSettingsFlagRegistrationEnabled,
+	}
+	if *t.dns.register {
+		settings.RegistrationEnabled = 1
+	}
+
+	err = winipcfg.SetInterfaceDnsSettings(*guid, settings)
+	if errors.Is(err, windows.ERROR_PROC_NOT_FOUND) {
+		t.l.Warn("tun.dns.register requires Windows 10 1809 or later, it is ignored")
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("failed to set dns registration: %w", err)
+	}
+
 	return nil
 }
 
 func (t *winTun) addRoutes(logErrors bool) error {
 	luid := winipcfg.LUID(t.tun.LUID())
 	routes := *t.Routes.Load()
-	foundDefault4 := false
 
 	for _, r := range routes {
 		if r.Via == nil || !r.Install {
@@ -188,31 +376,69 @@ func (t *winTun) addRoutes(logErrors bool) error {
 		} else {
 			t.l.WithField("route", r).Info("Added route")
 		}
+	}
 
-		if !foundDefault4 {
-			if ones, bits := r.Cidr.Mask.Size(); ones == 0 && bits != 0 {
-				foundDefault4 = true
-			}
+	return t.setInterface()
+}
+
+// setInterface applies the mtu and metric to each address family we have addresses in. Without tun.metric a default
+// route through us gets metric 0 so it wins over the physical interfaces.
+func (t *winTun) setInterface() error {
+	t.ifLock.Lock()
+	defer t.ifLock.Unlock()
+
+	luid := winipcfg.LUID(t.tun.LUID())
+	routes := *t.Routes.Load()
+
+	families := []winipcfg.AddressFamily{windows.AF_INET}
+	for _, p := range t.prefixes {
+		if p.Addr().Is6() {
+			// The mtu is tracked per address family, make sure our ipv6 networks get it as well
+			families = append(families, windows.AF_INET6)
+			break
 		}
 	}
 
-	ipif, err := luid.IPInterface(windows.AF_INET)
-	if err != nil {
-		return fmt.Errorf("failed to get ip interface: %w", err)
-	}
+	for _, family := range families {
+		ipif, err := luid.IPInterface(family)
+		if err != nil {
+			return fmt.Errorf("failed to get ip interface: %w", err)
+		}
 
-	ipif.NLMTU = uint32(t.MTU)
-	if foundDefault4 {
-		ipif.UseAutomaticMetric = false
-		ipif.Metric = 0
-	}
+		ipif.NLMTU = uint32(t.MTU)
+		switch {
+		case t.metric > 0:
+			ipif.UseAutomaticMetric = false
+			ipif.Metric = t.metric
+		case hasDefaultRoute(routes, family == windows.AF_INET6):
+			ipif.UseAutomaticMetric = false
+			ipif.Metric = 0
+		default:
+			ipif.UseAutomaticMetric = true
+		}
 
-	if err := ipif.Set(); err != nil {
-		return fmt.Errorf("failed to set ip interface: %w", err)
+		if err := ipif.Set(); err != nil {
+			return fmt.Errorf("failed to set ip interface: %w", err)
+		}
 	}
+
 	return nil
 }
 
+// hasDefaultRoute returns true if an installed unsafe route of the address family is a default route
+func hasDefaultRoute(routes []Route, v6 bool) bool {
+	for _, r := range routes {
+		if r.Via == nil || !r.Install {
+			continue
+		}
+
+		if ones, bits := r.Cidr.Mask.Size(); ones == 0 && (bits == 128) == v6 && bits != 0 {
+			return true
+		}
+	}
+	return false
+}
+
 func (t *winTun) removeRoutes(routes []Route) error {
 	luid := winipcfg.LUID(t.tun.LUID())
 
@@ -265,14 +491,18 @@ func (t *winTun) NewMultiQueueReader() (io.ReadWriteCloser, error) {
 func (t *winTun) Close() error {
 	// It seems that the Windows networking stack doesn't like it when we destroy interfaces that have active routes,
 	// so to be certain, just remove everything before destroying.
+	if t.routeWatcher != nil {
+		_ = t.routeWatcher.Unregister()
+		close(t.routeRestore)
+	}
+
 	luid := winipcfg.LUID(t.tun.LUID())
 	_ = luid.FlushRoutes(windows.AF_INET)
 	_ = luid.FlushIPAddresses(windows.AF_INET)
-	/* We don't support IPV6 yet
 	_ = luid.FlushRoutes(windows.AF_INET6)
 	_ = luid.FlushIPAddresses(windows.AF_INET6)
-	*/
 	_ = luid.FlushDNS(windows.AF_INET)
+	_ = luid.FlushDNS(windows.AF_INET6)
 
 	return t.tun.Close()
 }
@@ -3,14 +3,20 @@ package overlay
 import (
 	"io"
 	"net"
+	"os"
 
 	"github.com/sirupsen/logrus"
 	"github.com/slackhq/nebula/config"
 	"github.com/slackhq/nebula/iputil"
 )
 
-func NewUserDeviceFromConfig(c *config.C, l *logrus.Logger, tunCidr *net.IPNet, routines int) (Device, error) {
-	return NewUserDevice(tunCidr)
+func NewUserDeviceFromConfig(c *config.C, l *logrus.Logger, vpnNetworks []*net.IPNet, routines int) (Device, error) {
+	d, err := NewUserDevice(vpnNetworks[0])
+	if err != nil {
+		return nil, err
+	}
+	d.(*UserDevice).vpnNetworks = vpnNetworks
+	return d, nil
 }
 
 func NewUserDevice(tunCidr *net.IPNet) (Device, error) {
@@ -19,6 +25,7 @@ func NewUserDevice(tunCidr *net.IPNet) (Device, error) {
 	ir, iw := io.Pipe()
 	return &UserDevice{
 		tunCidr:        tunCidr,
+		vpnNetworks:    []*net.IPNet{tunCidr},
 		outboundReader: or,
 		outboundWriter: ow,
 		inboundReader:  ir,
@@ -27,7 +34,8 @@ func NewUserDevice(tunCidr *net.IPNet) (Device, error) {
 }
 
 type UserDevice struct {
-	tunCidr *net.IPNet
+	tunCidr     *net.IPNet
+	vpnNetworks []*net.IPNet
 
 	outboundReader *io.PipeReader
 	outboundWriter *io.PipeWriter
@@ -40,6 +48,7 @@ func (d *UserDevice) Activate() error {
 	return nil
 }
 func (d *UserDevice) Cidr() *net.IPNet                      { return d.tunCidr }
+func (d *UserDevice) Networks() []*net.IPNet                { return d.vpnNetworks }
 func (d *UserDevice) Name() string                          { return "faketun0" }
 func (d *UserDevice) RouteFor(ip iputil.VpnIp) iputil.VpnIp { return ip }
 func (d *UserDevice) NewMultiQueueReader() (io.ReadWriteCloser, error) {
@@ -58,6 +67,7 @@ func (d *UserDevice) Write(p []byte) (n int, err error) {
 }
 func (d *UserDevice) Close() error {
 	d.inboundWriter.Close()
-	d.outboundWriter.Close()
+	// nebula treats os.ErrClosed from a read of its device as a clean shutdown
+	d.outboundWriter.CloseWithError(os.ErrClosed)
 	return nil
 }
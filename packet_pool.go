@@ -0,0 +1,27 @@
+package nebula
+
+import "sync"
+
+// Packets read from the tun device and the udp sockets live in buffers their read loop owns and are encrypted straight
+// into the buffer they are sent from, with listen.send_batch the slot of the batch. Only packets handed to another
+// goroutine, queued for a tcp stream, a quic connection or the proxy relay, need a buffer of their own and those come
+// from packetPool so a burst on one link reuses what another freed.
+
+// packetHeadroom is room past mtu for the framing an underlay puts in front of a packet
+const packetHeadroom = 32
+
+var packetPool = sync.Pool{New: func() any {
+	b := make([]byte, 0, mtu+packetHeadroom)
+	return &b
+}}
+
+// getPacketBuffer returns an empty buffer from packetPool, it goes back with putPacketBuffer once the packet is sent
+func getPacketBuffer() *[]byte {
+	b := packetPool.Get().(*[]byte)
+	*b = (*b)[:0]
+	return b
+}
+
+func putPacketBuffer(b *[]byte) {
+	packetPool.Put(b)
+}
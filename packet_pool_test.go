@@ -0,0 +1,231 @@
+package nebula
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/slackhq/nebula/cert"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/firewall"
+	"github.com/slackhq/nebula/header"
+	"github.com/slackhq/nebula/iputil"
+	"github.com/slackhq/nebula/test"
+	"github.com/slackhq/nebula/udp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// discardConn is a udp socket that sends nowhere, it remembers the last packet written to it
+type discardConn struct {
+	udp.NoopConn
+	last []byte
+}
+
+func (c *discardConn) WriteTo(b []byte, _ *udp.Addr) error {
+	c.last = append(c.last[:0], b...)
+	return nil
+}
+
+func (c *discardConn) WriteBatch(bufs [][]byte, _ []*udp.Addr, _ []byte) error {
+	c.last = append(c.last[:0], bufs[len(bufs)-1]...)
+	return nil
+}
+
+// discardTun is a tun device that drops everything written to it
+type discardTun struct {
+	test.NoopTun
+}
+
+func (discardTun) Write(b []byte) (int, error) {
+	return len(b), nil
+}
+
+// newLoopbackTunnel returns an interface for 10.0.0.1 with an established tunnel to 10.0.0.2 whose packets, once
+// encrypted, can be read back by the same interface as if they came from the peer
+func newLoopbackTunnel(tb testing.TB) (*Interface, *HostInfo) {
+	l := test.NewLogger()
+	_, vpnNet, _ := net.ParseCIDR("10.0.0.1/24")
+	vpnNet.IP = net.IP{10, 0, 0, 1}
+
+	myCert := &cert.NebulaCertificate{Details: cert.NebulaCertificateDetails{Name: "me", Ips: []*net.IPNet{vpnNet}}}
+	peerCert := &cert.NebulaCertificate{Details: cert.NebulaCertificateDetails{
+		Name: "peer",
+		Ips:  []*net.IPNet{{IP: net.IP{10, 0, 0, 2}, Mask: vpnNet.Mask}},
+	}}
+
+	fw := NewFirewall(l, time.Minute, time.Minute, time.Minute, myCert)
+	require.NoError(tb, fw.AddRule(false, firewall.ProtoAny, 0, 0, []string{}, "any", nil, nil, "", ""))
+	require.NoError(tb, fw.AddRule(true, firewall.ProtoAny, 0, 0, []string{}, "any", nil, nil, "", ""))
+
+	hostMap := newHostMap(l, vpnNet)
+	lh := newTestLighthouse()
+	lh.myVpnIp = iputil.Ip2VpnIp(vpnNet.IP)
+	lh.myVpnNets = []netip.Prefix{netip.MustParsePrefix("10.0.0.0/24")}
+	lh.amLighthouse = true
+
+	f := &Interface{
+		hostMap:    hostMap,
+		inside:     discardTun{},
+		outside:    &discardConn{},
+		firewall:   fw,
+		lightHouse: lh,
+		pki:        &PKI{},
+		myVpnIp:    lh.myVpnIp,
+		readers:    []io.ReadWriteCloser{discardTun{}},
+		writers:    []udp.Conn{&discardConn{}},
+		l:          l,
+	}
+	f.pki.cs.Store(&CertState{Certificate: myCert})
+	f.handshakeManager = NewHandshakeManager(l, hostMap, lh, &udp.NoopConn{}, defaultHandshakeConfig)
+	f.handshakeManager.f = f
+	ctx, cancel := context.WithCancel(context.Background())
+	tb.Cleanup(cancel)
+	f.connectionManager = newConnectionManager(ctx, l, f, time.Minute, time.Minute, nil, nil, NewPunchyFromConfig(l, config.NewC(l)))
+
+	tc := tunnelCiphers["aes"]
+	var key [32]byte
+	ci := &ConnectionState{
+		eKey:     newNebulaCipherStateFromKey(tc, key),
+		dKey:     newNebulaCipherStateFromKey(tc, key),
+		myCert:   myCert,
+		peerCert: peerCert,
+		window:   NewBits(ReplayWindow),
+	}
+	ci.messageCounter.Add(2)
+
+	hostinfo := &HostInfo{
+		remote:          udp.NewAddr(net.IP{192, 168, 0, 2}, 4242),
+		ConnectionState: ci,
+		localIndexId:    1000,
+		remoteIndexId:   1000,
+		vpnIp:           iputil.Ip2VpnIp(net.IP{10, 0, 0, 2}),
+		relayState:      RelayState{relays: map[iputil.VpnIp]struct{}{}, relayForByIp: map[iputil.VpnIp]*Relay{}, relayForByIdx: map[uint32]*Relay{}},
+	}
+	hostMap.unlockedAddHostInfo(hostinfo, f)
+	return f, hostinfo
+}
+
+// newUDPPacket returns an ipv4 udp packet from src:80 to dst:80 with a payload of size bytes
+func newUDPPacket(src, dst net.IP, size int) []byte {
+	p := make([]byte, 28+size)
+	p[0] = 0x45
+	binary.BigEndian.PutUint16(p[2:], uint16(len(p)))
+	p[8] = 64
+	p[9] = firewall.ProtoUDP
+	copy(p[12:], src.To4())
+	copy(p[16:], dst.To4())
+	binary.BigEndian.PutUint16(p[20:], 80)
+	binary.BigEndian.PutUint16(p[22:], 80)
+	binary.BigEndian.PutUint16(p[24:], uint16(8+size))
+	return p
+}
+
+func BenchmarkInsidePacket(b *testing.B) {
+	f, _ := newLoopbackTunnel(b)
+	packet := newUDPPacket(net.IP{10, 0, 0, 1}, net.IP{10, 0, 0, 2}, 1300)
+	fwPacket := &firewall.Packet{}
+	nb := make([]byte, 12, 12)
+	out := make([]byte, mtu)
+	w := f.writers[0]
+	cache := firewall.NewConntrackCacheTicker(0)
+
+	b.SetBytes(int64(len(packet)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		f.consumeInsidePacket(packet, fwPacket, nb, out, 0, w, nil, cache.Get(f.l))
+	}
+}
+
+// BenchmarkRoundTrip encrypts a packet from the peer and reads it back in like a udp read loop would
+func BenchmarkRoundTrip(b *testing.B) {
+	f, hostinfo := newLoopbackTunnel(b)
+	// The outbound flow lets the replies in through conntrack
+	f.consumeInsidePacket(newUDPPacket(net.IP{10, 0, 0, 1}, net.IP{10, 0, 0, 2}, 0), &firewall.Packet{}, make([]byte, 12), make([]byte, mtu), 0, f.writers[0], nil, nil)
+
+	reply := newUDPPacket(net.IP{10, 0, 0, 2}, net.IP{10, 0, 0, 1}, 1300)
+	conn := &discardConn{}
+	nb := make([]byte, 12, 12)
+	enc := make([]byte, mtu)
+	out := make([]byte, mtu)
+	h := &header.H{}
+	fwPacket := &firewall.Packet{}
+	lhf := lhHandleRequest(f.lightHouse.NewRequestHandler(), f)
+	cache := firewall.NewConntrackCacheTicker(0)
+
+	b.SetBytes(int64(len(reply)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		f.sendNoMetricsTo(conn, header.Message, 0, hostinfo.ConnectionState, hostinfo, nil, reply, nb, enc)
+		f.readOutsidePackets(hostinfo.remote, nil, out[:0], conn.last, h, fwPacket, lhf, nb, 0, nil, cache.Get(f.l))
+	}
+	require.Equal(b, uint64(b.N), hostinfo.ConnectionState.messagesIn.Load())
+}
+
+// BenchmarkInsidePacketBatch is BenchmarkInsidePacket with the packets encrypted into a send batch like listenIn does
+func BenchmarkInsidePacketBatch(b *testing.B) {
+	f, _ := newLoopbackTunnel(b)
+	packet := newUDPPacket(net.IP{10, 0, 0, 1}, net.IP{10, 0, 0, 2}, 1300)
+	fwPacket := &firewall.Packet{}
+	nb := make([]byte, 12, 12)
+	batch := udp.NewSendBatch(f.writers[0].(udp.BatchConn), 64)
+	cache := firewall.NewConntrackCacheTicker(0)
+
+	b.SetBytes(int64(len(packet)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		f.consumeInsidePacket(packet, fwPacket, nb, batch.Next(), 0, batch, nil, cache.Get(f.l))
+	}
+	require.NoError(b, batch.Flush())
+}
+
+// sliceConn keeps the buffers it was asked to send
+type sliceConn struct {
+	udp.NoopConn
+	bufs [][]byte
+}
+
+func (c *sliceConn) WriteBatch(bufs [][]byte, _ []*udp.Addr, _ []byte) error {
+	c.bufs = append(c.bufs[:0], bufs...)
+	return nil
+}
+
+func TestSendBatch_Next(t *testing.T) {
+	sc := &sliceConn{}
+	batch := udp.NewSendBatch(sc, 4)
+	to := udp.NewAddr(net.IP{1, 2, 3, 4}, 4242)
+
+	// A packet built in Next is queued where it is
+	next := batch.Next()
+	p := append(next[:0], 1, 2, 3)
+	require.NoError(t, batch.WriteTo(p, to))
+
+	// Anything else is copied in
+	other := []byte{4, 5}
+	require.NoError(t, batch.WriteTo(other, to))
+	require.NoError(t, batch.Flush())
+
+	require.Len(t, sc.bufs, 2)
+	assert.Same(t, &next[0], &sc.bufs[0][0])
+	assert.Equal(t, []byte{1, 2, 3}, sc.bufs[0])
+	assert.NotSame(t, &other[0], &sc.bufs[1][0])
+	assert.Equal(t, []byte{4, 5}, sc.bufs[1])
+}
+
+func TestPacketBuffer(t *testing.T) {
+	b := getPacketBuffer()
+	assert.Empty(t, *b)
+	assert.GreaterOrEqual(t, cap(*b), mtu+socksUDPHeaderMax)
+	*b = append(*b, 1, 2, 3)
+	putPacketBuffer(b)
+
+	// Whatever comes back out of the pool is empty
+	assert.Empty(t, *getPacketBuffer())
+}
@@ -0,0 +1,66 @@
+package nebula
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"time"
+
+	"github.com/slackhq/nebula/udp"
+)
+
+// A path probe is a test request sent to one of a host's addresses, it carries that address and the reply echoes it
+// back. The reply can come from whichever of its addresses the host sends from, the echo tells us which path worked.
+// Any version of nebula answers them, test replies have always echoed the request.
+
+// pathProbeMagic starts every path probe payload, the udp address it was sent to follows
+var pathProbeMagic = []byte("NEBULA-MP1")
+
+func marshalPathProbe(addr *udp.Addr) []byte {
+	b := make([]byte, len(pathProbeMagic), len(pathProbeMagic)+18)
+	copy(b, pathProbeMagic)
+	b = append(b, addr.IP.To16()...)
+	return binary.BigEndian.AppendUint16(b, addr.Port)
+}
+
+func unmarshalPathProbe(d []byte) (*udp.Addr, bool) {
+	if !bytes.HasPrefix(d, pathProbeMagic) {
+		return nil, false
+	}
+
+	d = d[len(pathProbeMagic):]
+	if len(d) != 18 {
+		return nil, true
+	}
+
+	return udp.NewAddr(net.IP(d[:16]), binary.BigEndian.Uint16(d[16:18])), true
+}
+
+// handlePathProbeReply marks the multipath path a probe reply was for alive and locks a spraying tunnel onto it, it
+// returns false if the reply was not to a path probe
+func (f *Interface) handlePathProbeReply(hostinfo *HostInfo, d []byte) bool {
+	addr, ok := unmarshalPathProbe(d)
+	if !ok {
+		return false
+	}
+	if addr == nil {
+		return true
+	}
+
+	if mp := hostinfo.multipath.Load(); mp != nil {
+		if p := mp.find(addr); p != nil {
+			p.lastSeen.Store(time.Now().UnixNano())
+		}
+	}
+
+	// The first path to answer a spray wins
+	if hostinfo.spraying.CompareAndSwap(true, false) && !hostinfo.remote.Equals(addr) {
+		hostinfo.logger(f.l).WithField("udpAddr", hostinfo.remote).WithField("newAddr", addr).
+			Info("Locked onto the first remote to answer")
+		hostinfo.lastRoam = time.Now()
+		hostinfo.lastRoamRemote = hostinfo.remote
+		hostinfo.SetRemote(addr)
+	}
+
+	return true
+}
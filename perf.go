@@ -0,0 +1,121 @@
+package nebula
+
+import (
+	"fmt"
+	"runtime"
+	"sync/atomic"
+
+	"github.com/rcrowley/go-metrics"
+)
+
+// watermark tracks the highest value observed since the last reset
+type watermark struct {
+	v atomic.Int64
+}
+
+// Observe records v if it is higher than anything seen so far. The common case is a single load so this is cheap
+// enough to call for every packet.
+func (w *watermark) Observe(v int64) {
+	for {
+		cur := w.v.Load()
+		if v <= cur || w.v.CompareAndSwap(cur, v) {
+			return
+		}
+	}
+}
+
+func (w *watermark) Load() int64 {
+	return w.v.Load()
+}
+
+// Reset clears the watermark and returns the value it held
+func (w *watermark) Reset() int64 {
+	return w.v.Swap(0)
+}
+
+// pipelineStats tracks the reader goroutines and how full the packet buffers get for each stage of the pipeline
+type pipelineStats struct {
+	insideReaders  atomic.Int64
+	outsideReaders atomic.Int64
+
+	// insideHigh and outsideHigh are the largest packets read from the tun device and udp sockets, they are compared
+	// against the buffer size to see how close we are to truncating
+	insideHigh  watermark
+	outsideHigh watermark
+}
+
+// PerfQueue describes a buffered channel between two stages of the pipeline
+type PerfQueue struct {
+	Name string `json:"name"`
+	Len  int    `json:"len"`
+	Cap  int    `json:"cap"`
+	High int64  `json:"high"`
+}
+
+// PerfStats is a point in time view of the packet pipeline
+type PerfStats struct {
+	Goroutines      int         `json:"goroutines"`
+	Routines        int         `json:"routines"`
+	InsideReaders   int64       `json:"insideReaders"`
+	OutsideReaders  int64       `json:"outsideReaders"`
+	BufferSize      int         `json:"bufferSize"`
+	InsideReadHigh  int64       `json:"insideReadHigh"`
+	OutsideReadHigh int64       `json:"outsideReadHigh"`
+	Queues          []PerfQueue `json:"queues"`
+}
+
+// perfStats collects the current pipeline state. If reset is true the watermarks are cleared after being read so the
+// next call only reflects what happened in between.
+func (f *Interface) perfStats(reset bool) PerfStats {
+	load := (*watermark).Load
+	if reset {
+		load = (*watermark).Reset
+	}
+
+	s := PerfStats{
+		Goroutines:      runtime.NumGoroutine(),
+		Routines:        f.routines,
+		InsideReaders:   f.perf.insideReaders.Load(),
+		OutsideReaders:  f.perf.outsideReaders.Load(),
+		BufferSize:      mtu,
+		InsideReadHigh:  load(&f.perf.insideHigh),
+		OutsideReadHigh: load(&f.perf.outsideHigh),
+		Queues:          []PerfQueue{},
+	}
+
+	if hm := f.handshakeManager; hm != nil {
+		s.Queues = append(s.Queues, PerfQueue{
+			Name: "handshake_trigger",
+			Len:  len(hm.trigger),
+			Cap:  cap(hm.trigger),
+			High: load(&hm.triggerHigh),
+		})
+	}
+
+	if lh := f.lightHouse; lh != nil {
+		s.Queues = append(s.Queues, PerfQueue{
+			Name: "lighthouse_query",
+			Len:  len(lh.queryChan),
+			Cap:  cap(lh.queryChan),
+			High: load(&lh.queryHigh),
+		})
+	}
+
+	return s
+}
+
+func (f *Interface) emitPerfStats() {
+	s := f.perfStats(false)
+	metrics.GetOrRegisterGauge("perf.goroutines", nil).Update(int64(s.Goroutines))
+	metrics.GetOrRegisterGauge("perf.readers.inside", nil).Update(s.InsideReaders)
+	metrics.GetOrRegisterGauge("perf.readers.outside", nil).Update(s.OutsideReaders)
+	metrics.GetOrRegisterGauge("perf.buffers.size", nil).Update(int64(s.BufferSize))
+	metrics.GetOrRegisterGauge("perf.buffers.inside.high", nil).Update(s.InsideReadHigh)
+	metrics.GetOrRegisterGauge("perf.buffers.outside.high", nil).Update(s.OutsideReadHigh)
+
+	for _, q := range s.Queues {
+		metrics.GetOrRegisterGauge(fmt.Sprintf("perf.queues.%s.len", q.Name), nil).Update(int64(q.Len))
+		metrics.GetOrRegisterGauge(fmt.Sprintf("perf.queues.%s.cap", q.Name), nil).Update(int64(q.Cap))
+		metrics.GetOrRegisterGauge(fmt.Sprintf("perf.queues.%s.high", q.Name), nil).Update(q.High)
+	}
+}
@@ -0,0 +1,42 @@
+package nebula
+
+import (
+	"testing"
+
+	"github.com/slackhq/nebula/iputil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWatermark(t *testing.T) {
+	var w watermark
+	w.Observe(10)
+	w.Observe(5)
+	assert.Equal(t, int64(10), w.Load())
+
+	w.Observe(20)
+	assert.Equal(t, int64(20), w.Reset())
+	assert.Equal(t, int64(0), w.Load())
+}
+
+func TestInterface_perfStats(t *testing.T) {
+	hm := &HandshakeManager{trigger: make(chan iputil.VpnIp, 4)}
+	f := &Interface{routines: 2, handshakeManager: hm}
+
+	f.perf.insideReaders.Add(2)
+	f.perf.insideHigh.Observe(1400)
+	hm.trigger <- iputil.VpnIpFrom4(1)
+	hm.triggerHigh.Observe(int64(len(hm.trigger)))
+
+	s := f.perfStats(true)
+	assert.Equal(t, 2, s.Routines)
+	assert.Equal(t, int64(2), s.InsideReaders)
+	assert.Equal(t, int64(0), s.OutsideReaders)
+	assert.Equal(t, mtu, s.BufferSize)
+	assert.Equal(t, int64(1400), s.InsideReadHigh)
+	assert.Equal(t, []PerfQueue{{Name: "handshake_trigger", Len: 1, Cap: 4, High: 1}}, s.Queues)
+
+	// The reset should have cleared the watermarks but not the current queue depth
+	s = f.perfStats(false)
+	assert.Equal(t, int64(0), s.InsideReadHigh)
+	assert.Equal(t, []PerfQueue{{Name: "handshake_trigger", Len: 1, Cap: 4, High: 0}}, s.Queues)
+}
@@ -1,22 +1,35 @@
 package nebula
 
 import (
+	"bytes"
+	"context"
 	"errors"
 	"fmt"
+	"net/url"
 	"os"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 
+	"github.com/flynn/noise"
 	"github.com/sirupsen/logrus"
 	"github.com/slackhq/nebula/cert"
 	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/noiseutil"
+	"github.com/slackhq/nebula/tpmclient"
 	"github.com/slackhq/nebula/util"
 )
 
+const defaultPKIStoreTimeout = 30 * time.Second
+
 type PKI struct {
 	cs     atomic.Pointer[CertState]
 	caPool atomic.Pointer[cert.NebulaCAPool]
+	// staged holds the cert state of an in progress reload transaction
+	staged atomic.Pointer[CertState]
+	// remote holds what was last accepted from pki.ca_url and pki.blocklist_url
+	remote atomic.Pointer[remotePKIState]
 	l      *logrus.Logger
 }
 
@@ -26,22 +39,42 @@ type CertState struct {
 	RawCertificateNoKey []byte
 	PublicKey           []byte
 	PrivateKey          []byte
+
+	// tpmBacked is set when PrivateKey is the url of a key held in a TPM rather than the key itself, see tpmclient
+	tpmBacked bool
+	// tpmDH is the diffie-hellman function bound to the TPM client of a tpmBacked key
+	tpmDH noise.DHFunc
+
+	// alternates are the certificates from pki.additional_certs, presented instead of this one to peers that trust
+	// their CA, see pki_select.go
+	alternates []*CertState
 }
 
-func NewPKIFromConfig(l *logrus.Logger, c *config.C) (*PKI, error) {
+func NewPKIFromConfig(l *logrus.Logger, c *config.C, configTest bool) (*PKI, error) {
 	pki := &PKI{l: l}
-	err := pki.reload(c, true)
+	if err := enrollIfNeeded(l, c, configTest); err != nil {
+		return nil, util.NewContextualError("Failed to enroll", nil, err)
+	}
+
+	cs, err := newCertStateFromConfig(c)
 	if err != nil {
-		return nil, err
+		return nil, util.NewContextualError("Could not load client cert", nil, err)
 	}
 
-	c.RegisterReloadCallback(func(c *config.C) {
-		rErr := pki.reload(c, false)
-		if rErr != nil {
-			util.LogWithContextIfNeeded("Failed to reload PKI from config", rErr, l)
-		}
-	})
+	caPool, err := loadCAPoolFromConfig(l, c)
+	if err != nil {
+		return nil, util.NewContextualError("Failed to load ca from config", nil, err)
+	}
+
+	pki.cs.Store(cs)
+	pki.caPool.Store(caPool)
+	l.WithField("cert", cs.Certificate).Debug("Client nebula certificate")
+	for _, alt := range cs.alternates {
+		l.WithField("cert", alt.Certificate).Debug("Additional client nebula certificate")
+	}
+	l.WithField("fingerprints", caPool.GetFingerprints()).Debug("Trusted CA fingerprints")
 
+	c.RegisterReloadTransaction(pki.prepareReload)
 	return pki, nil
 }
 
@@ -53,64 +86,107 @@ func (p *PKI) GetCAPool() *cert.NebulaCAPool {
 	return p.caPool.Load()
 }
 
-func (p *PKI) reload(c *config.C, initial bool) error {
-	err := p.reloadCert(c, initial)
-	if err != nil {
-		if initial {
-			return err
-		}
-		err.Log(p.l)
-	}
-
-	err = p.reloadCAPool(c)
-	if err != nil {
-		if initial {
-			return err
-		}
-		err.Log(p.l)
+// getPendingCertState returns the cert state that is being staged by a reload, or the current one if there is no
+// reload in progress. Other reload stages should use this to build their new state.
+func (p *PKI) getPendingCertState() *CertState {
+	if cs := p.staged.Load(); cs != nil {
+		return cs
 	}
-
-	return nil
+	return p.cs.Load()
 }
 
-func (p *PKI) reloadCert(c *config.C, initial bool) *util.ContextualError {
+// prepareReload loads the cert and ca pool from the new config, nothing is installed until the reload commits
+func (p *PKI) prepareReload(c *config.C) (*config.ReloadStage, error) {
 	cs, err := newCertStateFromConfig(c)
 	if err != nil {
-		return util.NewContextualError("Could not load client cert", nil, err)
+		return nil, util.NewContextualError("Could not load client cert", nil, err)
 	}
 
-	if !initial {
-		// did IP in cert change? if so, don't set
-		currentCert := p.cs.Load().Certificate
-		oldIPs := currentCert.Details.Ips
-		newIPs := cs.Certificate.Details.Ips
-		if len(oldIPs) > 0 && len(newIPs) > 0 && oldIPs[0].String() != newIPs[0].String() {
-			return util.NewContextualError(
-				"IP in new cert was different from old",
-				m{"new_ip": newIPs[0], "old_ip": oldIPs[0]},
-				nil,
-			)
-		}
+	// did IP in cert change? if so, don't set
+	oldCs := p.cs.Load()
+	oldIPs := oldCs.Certificate.Details.Ips
+	newIPs := cs.Certificate.Details.Ips
+	if len(oldIPs) > 0 && len(newIPs) > 0 && oldIPs[0].String() != newIPs[0].String() {
+		return nil, util.NewContextualError(
+			"IP in new cert was different from old",
+			m{"new_ip": newIPs[0], "old_ip": oldIPs[0]},
+			nil,
+		)
 	}
 
-	p.cs.Store(cs)
-	if initial {
-		p.l.WithField("cert", cs.Certificate).Debug("Client nebula certificate")
-	} else {
-		p.l.WithField("cert", cs.Certificate).Info("Client cert refreshed from disk")
+	caPool, err := loadCAPoolFromConfig(p.l, c)
+	if err != nil {
+		return nil, util.NewContextualError("Failed to load ca from config", nil, err)
 	}
-	return nil
+	caPool = p.applyRemote(caPool)
+
+	oldCaPool := p.caPool.Load()
+	p.staged.Store(cs)
+
+	return &config.ReloadStage{
+		Commit: func() error {
+			p.cs.Store(cs)
+			p.caPool.Store(caPool)
+			p.staged.Store(nil)
+			p.l.WithField("cert", cs.Certificate).Info("Client cert refreshed from disk")
+			p.l.WithField("fingerprints", caPool.GetFingerprints()).Debug("Trusted CA fingerprints")
+			return nil
+		},
+		Rollback: func() {
+			p.staged.Store(nil)
+			p.cs.Store(oldCs)
+			p.caPool.Store(oldCaPool)
+		},
+	}, nil
 }
 
-func (p *PKI) reloadCAPool(c *config.C) *util.ContextualError {
+// prepareRemote installs what was fetched from pki.ca_url and pki.blocklist_url, the ca pool is rebuilt from the
+// config with it. remotePKI runs this with config.C.Transact so it is never interleaved with a reload.
+func (p *PKI) prepareRemote(c *config.C, rs *remotePKIState) (*config.ReloadStage, error) {
 	caPool, err := loadCAPoolFromConfig(p.l, c)
 	if err != nil {
-		return util.NewContextualError("Failed to load ca from config", nil, err)
+		return nil, util.NewContextualError("Failed to load ca from config", nil, err)
 	}
+	caPool = applyRemotePKIState(caPool, rs)
+
+	oldRemote, oldCaPool := p.remote.Load(), p.caPool.Load()
+	return &config.ReloadStage{
+		Commit: func() error {
+			p.remote.Store(rs)
+			p.caPool.Store(caPool)
+			return nil
+		},
+		Rollback: func() {
+			p.remote.Store(oldRemote)
+			p.caPool.Store(oldCaPool)
+		},
+	}, nil
+}
 
-	p.caPool.Store(caPool)
-	p.l.WithField("fingerprints", caPool.GetFingerprints()).Debug("Trusted CA fingerprints")
-	return nil
+// applyRemote adds the CAs and blocklist last fetched from pki.ca_url and pki.blocklist_url to a pool built from config
+func (p *PKI) applyRemote(caPool *cert.NebulaCAPool) *cert.NebulaCAPool {
+	return applyRemotePKIState(caPool, p.remote.Load())
+}
+
+func applyRemotePKIState(caPool *cert.NebulaCAPool, rs *remotePKIState) *cert.NebulaCAPool {
+	if rs == nil {
+		return caPool
+	}
+
+	if len(rs.caPEM) > 0 {
+		// The bundle was validated when it was fetched, expired CAs are kept so they are reported the same as local ones
+		if remotePool, _ := cert.NewCAPoolFromBytes(rs.caPEM); remotePool != nil {
+			for fp, ca := range remotePool.CAs {
+				caPool.CAs[fp] = ca
+			}
+		}
+	}
+
+	for _, fp := range rs.blocklist {
+		caPool.BlocklistFingerprint(fp)
+	}
+
+	return caPool
 }
 
 func newCertState(certificate *cert.NebulaCertificate, privateKey []byte) (*CertState, error) {
@@ -120,68 +196,63 @@ func newCertState(certificate *cert.NebulaCertificate, privateKey []byte) (*Cert
 		return nil, fmt.Errorf("invalid nebula certificate on interface: %s", err)
 	}
 
-	publicKey := certificate.Details.PublicKey
-	cs := &CertState{
-		RawCertificate: rawCertificate,
-		Certificate:    certificate,
-		PrivateKey:     privateKey,
-		PublicKey:      publicKey,
-	}
-
-	cs.Certificate.Details.PublicKey = nil
-	rawCertNoKey, err := cs.Certificate.Marshal()
+	rawCertNoKey, err := certificate.MarshalForHandshakes()
 	if err != nil {
 		return nil, fmt.Errorf("error marshalling certificate no key: %s", err)
 	}
-	cs.RawCertificateNoKey = rawCertNoKey
-	// put public key back
-	cs.Certificate.Details.PublicKey = cs.PublicKey
-	return cs, nil
+
+	return &CertState{
+		RawCertificate:      rawCertificate,
+		RawCertificateNoKey: rawCertNoKey,
+		Certificate:         certificate,
+		PrivateKey:          privateKey,
+		PublicKey:           certificate.Details.PublicKey,
+	}, nil
 }
 
 func newCertStateFromConfig(c *config.C) (*CertState, error) {
-	var pemPrivateKey []byte
-	var err error
-
-	privPathOrPEM := c.GetString("pki.key", "")
-	if privPathOrPEM == "" {
-		return nil, errors.New("no pki.key path or PEM data provided")
-	}
-
-	if strings.Contains(privPathOrPEM, "-----BEGIN") {
-		pemPrivateKey = []byte(privPathOrPEM)
-		privPathOrPEM = "<inline>"
-
-	} else {
-		pemPrivateKey, err = os.ReadFile(privPathOrPEM)
-		if err != nil {
-			return nil, fmt.Errorf("unable to read pki.key file %s: %s", privPathOrPEM, err)
-		}
+	cs, err := newPrimaryCertStateFromConfig(c)
+	if err != nil {
+		return nil, err
 	}
 
-	rawKey, _, curve, err := cert.UnmarshalPrivateKey(pemPrivateKey)
+	cs.alternates, err = newAdditionalCertStatesFromConfig(c, cs)
 	if err != nil {
-		return nil, fmt.Errorf("error while unmarshaling pki.key %s: %s", privPathOrPEM, err)
+		return nil, err
 	}
 
-	var rawCert []byte
+	return cs, nil
+}
 
-	pubPathOrPEM := c.GetString("pki.cert", "")
-	if pubPathOrPEM == "" {
-		return nil, errors.New("no pki.cert path or PEM data provided")
-	}
+// newPrimaryCertStateFromConfig loads pki.cert and pki.key
+func newPrimaryCertStateFromConfig(c *config.C) (*CertState, error) {
+	var rawKey []byte
+	var curve cert.Curve
 
-	if strings.Contains(pubPathOrPEM, "-----BEGIN") {
-		rawCert = []byte(pubPathOrPEM)
-		pubPathOrPEM = "<inline>"
+	tpmURL := c.GetString("pki.key", "")
+	if !tpmclient.IsURL(tpmURL) {
+		tpmURL = ""
+		pemPrivateKey, privPathOrPEM, err := readPKIItem(c, "key", cert.StoreItemKey)
+		if err != nil {
+			return nil, err
+		}
+
+		pemPrivateKey, err = unwrapPKIKey(c, pemPrivateKey)
+		if err != nil {
+			return nil, fmt.Errorf("error while unwrapping pki.key %s: %s", privPathOrPEM, err)
+		}
 
-	} else {
-		rawCert, err = os.ReadFile(pubPathOrPEM)
+		rawKey, _, curve, err = cert.UnmarshalPrivateKey(pemPrivateKey)
 		if err != nil {
-			return nil, fmt.Errorf("unable to read pki.cert file %s: %s", pubPathOrPEM, err)
+			return nil, fmt.Errorf("error while unmarshaling pki.key %s: %s", privPathOrPEM, err)
 		}
 	}
 
+	rawCert, pubPathOrPEM, err := readPKIItem(c, "cert", cert.StoreItemCert)
+	if err != nil {
+		return nil, err
+	}
+
 	nebulaCert, _, err := cert.UnmarshalNebulaCertificateFromPEM(rawCert)
 	if err != nil {
 		return nil, fmt.Errorf("error while unmarshaling pki.cert %s: %s", pubPathOrPEM, err)
@@ -195,6 +266,21 @@ func newCertStateFromConfig(c *config.C) (*CertState, error) {
 		return nil, fmt.Errorf("no IPs encoded in certificate")
 	}
 
+	if tpmURL != "" {
+		client, err := loadTPMKey(tpmURL, nebulaCert)
+		if err != nil {
+			return nil, err
+		}
+
+		cs, err := newCertState(nebulaCert, []byte(tpmURL))
+		if err != nil {
+			return nil, err
+		}
+		cs.tpmBacked = true
+		cs.tpmDH = noiseutil.NewDHP256TPM(client)
+		return cs, nil
+	}
+
 	if err = nebulaCert.VerifyPrivateKey(curve, rawKey); err != nil {
 		return nil, fmt.Errorf("private key is not a pair with public key in nebula cert")
 	}
@@ -202,23 +288,100 @@ func newCertStateFromConfig(c *config.C) (*CertState, error) {
 	return newCertState(nebulaCert, rawKey)
 }
 
-func loadCAPoolFromConfig(l *logrus.Logger, c *config.C) (*cert.NebulaCAPool, error) {
-	var rawCA []byte
-	var err error
+// unwrapPKIKey returns the key unchanged unless it was wrapped by nebula-cert -wrap, in which case it is decrypted
+// with pki.key_unwrap
+func unwrapPKIKey(c *config.C, b []byte) ([]byte, error) {
+	if !cert.IsWrappedPrivateKey(b) {
+		return b, nil
+	}
 
-	caPathOrPEM := c.GetString("pki.ca", "")
-	if caPathOrPEM == "" {
-		return nil, errors.New("no pki.ca path or PEM data provided")
+	spec := c.GetString("pki.key_unwrap", "")
+	if spec == "" {
+		return nil, errors.New("key is wrapped and pki.key_unwrap is not set")
 	}
 
-	if strings.Contains(caPathOrPEM, "-----BEGIN") {
-		rawCA = []byte(caPathOrPEM)
+	ctx, cancel := context.WithTimeout(context.Background(), c.GetDuration("pki.store_timeout", defaultPKIStoreTimeout))
+	defer cancel()
+	return cert.UnwrapPrivateKey(ctx, spec, b)
+}
 
-	} else {
-		rawCA, err = os.ReadFile(caPathOrPEM)
-		if err != nil {
-			return nil, fmt.Errorf("unable to read pki.ca file %s: %s", caPathOrPEM, err)
+// wrapPKIKey wraps a key nebula generated with pki.key_wrap before it is written to disk, without pki.key_wrap the key
+// is returned unchanged
+func wrapPKIKey(c *config.C, b []byte) ([]byte, error) {
+	spec := c.GetString("pki.key_wrap", "")
+	if spec == "" {
+		return b, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), c.GetDuration("pki.store_timeout", defaultPKIStoreTimeout))
+	defer cancel()
+	return cert.WrapPrivateKey(ctx, spec, b)
+}
+
+// openTPMKey is swapped out by tests that have no TPM
+var openTPMKey = tpmclient.FromURL
+
+var (
+	tpmKeysLock sync.Mutex
+	// tpmKeys are the clients opened for the tpm keys in pki.key, by url. A client is opened when its key is first
+	// loaded and kept for the life of the process, every handshake with the key shares it.
+	tpmKeys = map[string]tpmclient.Client{}
+)
+
+// loadTPMKey returns the client for the TPM key at url once it is checked against the certificate it was issued for
+func loadTPMKey(url string, nc *cert.NebulaCertificate) (tpmclient.Client, error) {
+	if nc.Details.Curve != cert.Curve_P256 {
+		return nil, fmt.Errorf("pki.key is a tpm key which requires a P256 nebula cert")
+	}
+
+	tpmKeysLock.Lock()
+	defer tpmKeysLock.Unlock()
+
+	if client, ok := tpmKeys[url]; ok {
+		if err := verifyTPMKey(url, client, nc); err == nil {
+			return client, nil
 		}
+		// The key at the handle may have been replaced, open it again. The old client is left open, the running cert
+		// state still uses it until this one is committed, or for good if the reload fails.
+	}
+
+	client, err := openTPMKey(url)
+	if err != nil {
+		return nil, fmt.Errorf("error while opening pki.key %s: %s", url, err)
+	}
+	client = tpmclient.Locked(client)
+
+	if err = verifyTPMKey(url, client, nc); err != nil {
+		client.Close()
+		return nil, err
+	}
+
+	tpmKeys[url] = client
+	return client, nil
+}
+
+// verifyTPMKey checks that the TPM key is usable and is the key the certificate was issued for
+func verifyTPMKey(url string, client tpmclient.Client, nc *cert.NebulaCertificate) error {
+	pub, err := client.GetPubKey()
+	if err != nil {
+		return fmt.Errorf("error while reading pki.key %s: %s", url, err)
+	}
+
+	if !bytes.Equal(pub, nc.Details.PublicKey) {
+		return fmt.Errorf("private key is not a pair with public key in nebula cert")
+	}
+
+	if err = client.Test(); err != nil {
+		return fmt.Errorf("pki.key %s failed its self test: %s", url, err)
+	}
+
+	return nil
+}
+
+func loadCAPoolFromConfig(l *logrus.Logger, c *config.C) (*cert.NebulaCAPool, error) {
+	rawCA, _, err := readPKIItem(c, "ca", cert.StoreItemCA)
+	if err != nil {
+		return nil, err
 	}
 
 	caPool, err := cert.NewCAPoolFromBytes(rawCA)
@@ -244,5 +407,90 @@ func loadCAPoolFromConfig(l *logrus.Logger, c *config.C) (*cert.NebulaCAPool, er
 		caPool.BlocklistFingerprint(fp)
 	}
 
+	if err := loadTransparencyLogsFromConfig(l, c, caPool); err != nil {
+		return nil, err
+	}
+
 	return caPool, nil
 }
+
+// loadTransparencyLogsFromConfig adds the logs in pki.transparency.logs, a path or inline PEM of log public keys, to
+// the pool and turns on pki.transparency.require_inclusion_proof
+func loadTransparencyLogsFromConfig(l *logrus.Logger, c *config.C, caPool *cert.NebulaCAPool) error {
+	pathOrPEM := c.GetString("pki.transparency.logs", "")
+	if pathOrPEM != "" {
+		b := []byte(pathOrPEM)
+		if !strings.Contains(pathOrPEM, "-----BEGIN") {
+			var err error
+			b, err = os.ReadFile(pathOrPEM)
+			if err != nil {
+				return fmt.Errorf("unable to read pki.transparency.logs file %s: %s", pathOrPEM, err)
+			}
+		}
+
+		for len(strings.TrimSpace(string(b))) > 0 {
+			var err error
+			b, err = caPool.AddTransparencyLog(b)
+			if err != nil {
+				return fmt.Errorf("error while adding pki.transparency.logs: %s", err)
+			}
+		}
+	}
+
+	if c.GetBool("pki.transparency.require_inclusion_proof", false) {
+		if len(caPool.GetTransparencyLogs()) == 0 {
+			return errors.New("pki.transparency.require_inclusion_proof is set but pki.transparency.logs is empty")
+		}
+		caPool.RequireInclusionProof(true)
+		l.WithField("logs", caPool.GetTransparencyLogs()).Info("Requiring certificate inclusion proofs")
+	}
+
+	return nil
+}
+
+// readPKIItem returns pki.<key>, which is either inline PEM or a file path. When it is not set the item is read from
+// pki.store instead. The second return value describes where the item came from for error messages.
+func readPKIItem(c *config.C, key string, item cert.StoreItem) ([]byte, string, error) {
+	pathOrPEM := c.GetString("pki."+key, "")
+	if pathOrPEM == "" {
+		storeURL := c.GetString("pki.store", "")
+		if storeURL == "" {
+			return nil, "", fmt.Errorf("no pki.%s path or PEM data provided", key)
+		}
+
+		if u, err := url.Parse(storeURL); err == nil {
+			// Do not leak any credentials in the url to logs
+			storeURL = u.Redacted()
+		}
+
+		store, err := cert.OpenStore(c.GetString("pki.store", ""))
+		if err != nil {
+			return nil, storeURL, fmt.Errorf("unable to open pki.store %s: %s", storeURL, err)
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), c.GetDuration("pki.store_timeout", defaultPKIStoreTimeout))
+		defer cancel()
+
+		b, err := store.Get(ctx, item)
+		if err != nil {
+			return nil, storeURL, fmt.Errorf("unable to read pki.%s from pki.store %s: %s", key, storeURL, err)
+		}
+		return b, storeURL, nil
+	}
+
+	return readPathOrPEM("pki."+key, pathOrPEM)
+}
+
+// readPathOrPEM returns pathOrPEM if it is inline PEM, otherwise the contents of the file it names. The second return
+// value describes where the item came from for error messages.
+func readPathOrPEM(name, pathOrPEM string) ([]byte, string, error) {
+	if strings.Contains(pathOrPEM, "-----BEGIN") {
+		return []byte(pathOrPEM), "<inline>", nil
+	}
+
+	b, err := os.ReadFile(pathOrPEM)
+	if err != nil {
+		return nil, pathOrPEM, fmt.Errorf("unable to read %s file %s: %s", name, pathOrPEM, err)
+	}
+	return b, pathOrPEM, nil
+}
@@ -0,0 +1,99 @@
+package nebula
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/slackhq/nebula/cert"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/iputil"
+	"github.com/slackhq/nebula/util"
+)
+
+var ErrPinMismatch = errors.New("certificate does not match pki.pins for its vpn ip")
+
+// identityPins are the certificates we accept for specific vpn ips, on top of the certificate being signed by a trusted
+// CA. Each pin is a certificate fingerprint or a certificate name, a fingerprint pin holds even if a CA is compromised
+// while a name pin only protects against mistakes made with a trusted CA.
+// Vpn ips without pins accept any valid certificate. A nil identityPins pins nothing.
+type identityPins struct {
+	pins map[iputil.VpnIp][]string
+}
+
+func newIdentityPinsFromConfig(c *config.C) (*identityPins, error) {
+	raw := c.GetMap("pki.pins", nil)
+	if len(raw) == 0 {
+		return nil, nil
+	}
+
+	p := &identityPins{pins: map[iputil.VpnIp][]string{}}
+	for k, v := range raw {
+		ip := net.ParseIP(fmt.Sprintf("%v", k)).To4()
+		if ip == nil {
+			return nil, util.NewContextualError("Unable to parse pki.pins entry", m{"vpnIp": k}, nil)
+		}
+
+		vals, ok := v.([]interface{})
+		if !ok {
+			vals = []interface{}{v}
+		}
+
+		var pins []string
+		for _, val := range vals {
+			pin := fmt.Sprintf("%v", val)
+			if strings.TrimSpace(pin) == "" {
+				return nil, util.NewContextualError("pki.pins entry has an empty pin", m{"vpnIp": k}, nil)
+			}
+			pins = append(pins, pin)
+		}
+
+		if len(pins) == 0 {
+			return nil, util.NewContextualError("pki.pins entry has no pins", m{"vpnIp": k}, nil)
+		}
+
+		p.pins[iputil.Ip2VpnIp(ip)] = pins
+	}
+
+	return p, nil
+}
+
+// allow reports if c is acceptable for vpnIp, the certificate must match one of the pins for its vpn ip if it has any
+func (p *identityPins) allow(vpnIp iputil.VpnIp, c *cert.NebulaCertificate) bool {
+	if p == nil {
+		return true
+	}
+
+	pins, ok := p.pins[vpnIp]
+	if !ok {
+		return true
+	}
+
+	fingerprint, _ := c.Fingerprint()
+	for _, pin := range pins {
+		if pin == c.Details.Name || strings.ToLower(pin) == fingerprint {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *Interface) reloadPins(c *config.C) {
+	if !c.InitialLoad() && !c.HasChanged("pki.pins") {
+		return
+	}
+
+	p, err := newIdentityPinsFromConfig(c)
+	if err != nil {
+		f.l.WithError(err).Error("Failed to load pki.pins, keeping the previous ones")
+		return
+	}
+
+	f.pins.Store(p)
+	if p != nil {
+		f.l.WithField("vpnIps", len(p.pins)).Info("Pinned remote certificates")
+	} else if !c.InitialLoad() {
+		f.l.Info("Remote certificates are no longer pinned")
+	}
+}
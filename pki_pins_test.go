@@ -0,0 +1,70 @@
+package nebula
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/slackhq/nebula/cert"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/iputil"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewIdentityPinsFromConfig(t *testing.T) {
+	l := test.NewLogger()
+	c := config.NewC(l)
+
+	p, err := newIdentityPinsFromConfig(c)
+	require.NoError(t, err)
+	assert.Nil(t, p)
+
+	c.Settings["pki"] = map[interface{}]interface{}{"pins": map[interface{}]interface{}{
+		"10.1.0.1": []interface{}{"AAAA", "lighthouse"},
+		"10.1.0.2": "relay",
+	}}
+	p, err = newIdentityPinsFromConfig(c)
+	require.NoError(t, err)
+	assert.Equal(t, &identityPins{pins: map[iputil.VpnIp][]string{
+		iputil.Ip2VpnIp(net.IP{10, 1, 0, 1}): {"AAAA", "lighthouse"},
+		iputil.Ip2VpnIp(net.IP{10, 1, 0, 2}): {"relay"},
+	}}, p)
+
+	tests := map[string]interface{}{
+		"Unable to parse pki.pins entry":  map[interface{}]interface{}{"nope": "relay"},
+		"pki.pins entry has an empty pin": map[interface{}]interface{}{"10.1.0.1": []interface{}{"relay", " "}},
+		"pki.pins entry has no pins":      map[interface{}]interface{}{"10.1.0.1": []interface{}{}},
+	}
+	for expected, v := range tests {
+		c.Settings["pki"] = map[interface{}]interface{}{"pins": v}
+		_, err = newIdentityPinsFromConfig(c)
+		assert.ErrorContains(t, err, expected)
+	}
+}
+
+func TestIdentityPins_allow(t *testing.T) {
+	c := &cert.NebulaCertificate{Details: cert.NebulaCertificateDetails{Name: "lighthouse"}, Signature: []byte("sig")}
+	fingerprint, err := c.Fingerprint()
+	require.NoError(t, err)
+
+	pinned := iputil.Ip2VpnIp(net.IP{10, 1, 0, 1})
+	other := iputil.Ip2VpnIp(net.IP{10, 1, 0, 2})
+
+	// Nothing is pinned by default
+	var p *identityPins
+	assert.True(t, p.allow(pinned, c))
+
+	p = &identityPins{pins: map[iputil.VpnIp][]string{pinned: {"not-it", "lighthouse"}}}
+	assert.True(t, p.allow(pinned, c))
+	assert.True(t, p.allow(other, c), "ips without pins accept any certificate")
+
+	p.pins[pinned] = []string{fingerprint}
+	assert.True(t, p.allow(pinned, c))
+	p.pins[pinned] = []string{strings.ToUpper(fingerprint)}
+	assert.True(t, p.allow(pinned, c))
+
+	p.pins[pinned] = []string{"not-it"}
+	assert.False(t, p.allow(pinned, c))
+}
@@ -0,0 +1,175 @@
+package nebula
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/slackhq/nebula/cert"
+	"github.com/slackhq/nebula/config"
+)
+
+// A node can hold more than one certificate, for example while the mesh moves from one CA to another. pki.cert is the
+// primary certificate and pki.additional_certs are alternates for the same vpn ip. Each handshake presents one of them,
+// picked by forPeer from what the peer told us it trusts.
+//
+// Nodes with alternates advertise the fingerprints of the CAs they trust in their handshakes. A responder uses the
+// initiators advertisement, or the CA of the initiators certificate when there is none, to pick what to answer with.
+// An initiator only learns what a peer trusts from a previous tunnel, the first handshake with a peer presents the
+// primary certificate.
+
+// newAdditionalCertStatesFromConfig loads pki.additional_certs, each must be for the same vpn ip and curve as primary
+func newAdditionalCertStatesFromConfig(c *config.C, primary *CertState) ([]*CertState, error) {
+	raw := c.Get("pki.additional_certs")
+	if raw == nil {
+		return nil, nil
+	}
+
+	list, ok := raw.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("pki.additional_certs must be a list")
+	}
+
+	var alternates []*CertState
+	for i, v := range list {
+		name := fmt.Sprintf("pki.additional_certs[%d]", i)
+		entry, ok := v.(map[interface{}]interface{})
+		if !ok {
+			return nil, fmt.Errorf("%s must be a map with a cert and key", name)
+		}
+
+		certPathOrPEM, _ := entry["cert"].(string)
+		keyPathOrPEM, _ := entry["key"].(string)
+		if certPathOrPEM == "" || keyPathOrPEM == "" {
+			return nil, fmt.Errorf("%s must have a cert and key", name)
+		}
+
+		cs, err := newAdditionalCertState(c, name, certPathOrPEM, keyPathOrPEM)
+		if err != nil {
+			return nil, err
+		}
+
+		if cs.Certificate.Details.Ips[0].String() != primary.Certificate.Details.Ips[0].String() {
+			return nil, fmt.Errorf("%s must have the same ip as pki.cert", name)
+		}
+
+		// The responder reads the first handshake message before it knows who sent it, so every certificate has to
+		// handshake with the same curve
+		if cs.Certificate.Details.Curve != primary.Certificate.Details.Curve {
+			return nil, fmt.Errorf("%s must use the same curve as pki.cert", name)
+		}
+
+		alternates = append(alternates, cs)
+	}
+
+	return alternates, nil
+}
+
+func newAdditionalCertState(c *config.C, name, certPathOrPEM, keyPathOrPEM string) (*CertState, error) {
+	pemPrivateKey, keyFrom, err := readPathOrPEM(name+".key", keyPathOrPEM)
+	if err != nil {
+		return nil, err
+	}
+
+	pemPrivateKey, err = unwrapPKIKey(c, pemPrivateKey)
+	if err != nil {
+		return nil, fmt.Errorf("error while unwrapping %s.key %s: %s", name, keyFrom, err)
+	}
+
+	rawKey, _, curve, err := cert.UnmarshalPrivateKey(pemPrivateKey)
+	if err != nil {
+		return nil, fmt.Errorf("error while unmarshaling %s.key %s: %s", name, keyFrom, err)
+	}
+
+	rawCert, certFrom, err := readPathOrPEM(name+".cert", certPathOrPEM)
+	if err != nil {
+		return nil, err
+	}
+
+	nebulaCert, _, err := cert.UnmarshalNebulaCertificateFromPEM(rawCert)
+	if err != nil {
+		return nil, fmt.Errorf("error while unmarshaling %s.cert %s: %s", name, certFrom, err)
+	}
+
+	if nebulaCert.Expired(time.Now()) {
+		return nil, fmt.Errorf("%s.cert is expired", name)
+	}
+
+	if len(nebulaCert.Details.Ips) == 0 {
+		return nil, fmt.Errorf("no IPs encoded in %s.cert", name)
+	}
+
+	if err = nebulaCert.VerifyPrivateKey(curve, rawKey); err != nil {
+		return nil, fmt.Errorf("%s.key is not a pair with the public key in %s.cert", name, name)
+	}
+
+	return newCertState(nebulaCert, rawKey)
+}
+
+// forPeer returns the certificate to present to a peer. trusted are the CA fingerprints the peer advertised and peer
+// is its certificate if we have one, a peer that did not advertise is assumed to trust the CA of its own certificate.
+// The primary certificate is preferred and is returned when nothing better is known.
+func (cs *CertState) forPeer(trusted []string, peer *cert.NebulaCertificate) *CertState {
+	if len(cs.alternates) == 0 {
+		return cs
+	}
+
+	if len(trusted) == 0 {
+		if peer == nil {
+			return cs
+		}
+		trusted = []string{peer.Details.Issuer}
+	}
+
+	if containsString(trusted, cs.Certificate.Details.Issuer) {
+		return cs
+	}
+
+	for _, alt := range cs.alternates {
+		if containsString(trusted, alt.Certificate.Details.Issuer) {
+			return alt
+		}
+	}
+
+	return cs
+}
+
+// owns reports if c is the primary certificate or one of the alternates
+func (cs *CertState) owns(c *cert.NebulaCertificate) bool {
+	if c == nil {
+		return false
+	}
+
+	if bytes.Equal(c.Signature, cs.Certificate.Signature) {
+		return true
+	}
+
+	for _, alt := range cs.alternates {
+		if bytes.Equal(c.Signature, alt.Certificate.Signature) {
+			return true
+		}
+	}
+	return false
+}
+
+// advertisedCAs returns the fingerprints of the CAs we trust, sorted, for the TrustedCAs handshake field. Nothing is
+// advertised without alternates since peers have no choice to make.
+func (p *PKI) advertisedCAs() []string {
+	if len(p.GetCertState().alternates) == 0 {
+		return nil
+	}
+
+	fps := p.GetCAPool().GetFingerprints()
+	sort.Strings(fps)
+	return fps
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
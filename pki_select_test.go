@@ -0,0 +1,123 @@
+package nebula
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/slackhq/nebula/cert"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/enroll"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ed25519"
+)
+
+// newTestHostCertPEM returns a host certificate for ip claiming to be issued by issuer, a hex fingerprint, and its
+// private key, both as PEM
+func newTestHostCertPEM(t *testing.T, issuer string, ip string, curve cert.Curve) ([]byte, []byte) {
+	pub, priv, err := enroll.NewKeypair(curve)
+	require.NoError(t, err)
+
+	var caKey []byte
+	if curve == cert.Curve_P256 {
+		ca, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		require.NoError(t, err)
+		caKey = ca.D.FillBytes(make([]byte, 32))
+	} else {
+		_, caKey, _ = ed25519.GenerateKey(rand.Reader)
+	}
+
+	_, ipNet, _ := net.ParseCIDR(ip + "/16")
+	ipNet.IP = net.ParseIP(ip).To4()
+	nc := &cert.NebulaCertificate{
+		Details: cert.NebulaCertificateDetails{
+			Name:      "host",
+			Ips:       []*net.IPNet{ipNet},
+			NotBefore: time.Now().Add(-time.Minute),
+			NotAfter:  time.Now().Add(time.Minute * 30),
+			PublicKey: pub,
+			Issuer:    issuer,
+			Curve:     curve,
+		},
+	}
+	require.NoError(t, nc.Sign(curve, caKey))
+	certPEM, err := nc.MarshalToPEM()
+	require.NoError(t, err)
+	return certPEM, cert.MarshalPrivateKey(curve, priv)
+}
+
+func TestNewCertStateFromConfig_additionalCerts(t *testing.T) {
+	l := test.NewLogger()
+	certA, keyA := newTestHostCertPEM(t, "aaaa", "10.1.0.5", cert.Curve_CURVE25519)
+	certB, keyB := newTestHostCertPEM(t, "bbbb", "10.1.0.5", cert.Curve_CURVE25519)
+
+	c := config.NewC(l)
+	c.Settings["pki"] = map[interface{}]interface{}{
+		"cert": string(certA),
+		"key":  string(keyA),
+		"additional_certs": []interface{}{
+			map[interface{}]interface{}{"cert": string(certB), "key": string(keyB)},
+		},
+	}
+	cs, err := newCertStateFromConfig(c)
+	require.NoError(t, err)
+	assert.Equal(t, "aaaa", cs.Certificate.Details.Issuer)
+	require.Len(t, cs.alternates, 1)
+	assert.Equal(t, "bbbb", cs.alternates[0].Certificate.Details.Issuer)
+
+	otherIp, otherIpKey := newTestHostCertPEM(t, "bbbb", "10.1.0.6", cert.Curve_CURVE25519)
+	otherCurve, otherCurveKey := newTestHostCertPEM(t, "bbbb", "10.1.0.5", cert.Curve_P256)
+	tests := map[string]interface{}{
+		"pki.additional_certs must be a list":                       "nope",
+		"pki.additional_certs[0] must be a map with a cert and key": []interface{}{"nope"},
+		"pki.additional_certs[0] must have a cert and key": []interface{}{
+			map[interface{}]interface{}{"cert": string(certB)},
+		},
+		"pki.additional_certs[0].key is not a pair with the public key in pki.additional_certs[0].cert": []interface{}{
+			map[interface{}]interface{}{"cert": string(certB), "key": string(keyA)},
+		},
+		"pki.additional_certs[0] must have the same ip as pki.cert": []interface{}{
+			map[interface{}]interface{}{"cert": string(otherIp), "key": string(otherIpKey)},
+		},
+		"pki.additional_certs[0] must use the same curve as pki.cert": []interface{}{
+			map[interface{}]interface{}{"cert": string(otherCurve), "key": string(otherCurveKey)},
+		},
+	}
+	for expected, v := range tests {
+		c.Settings["pki"].(map[interface{}]interface{})["additional_certs"] = v
+		_, err = newCertStateFromConfig(c)
+		assert.EqualError(t, err, expected)
+	}
+}
+
+func TestCertState_forPeer(t *testing.T) {
+	primary := &CertState{Certificate: &cert.NebulaCertificate{Details: cert.NebulaCertificateDetails{Issuer: "a"}, Signature: []byte("a")}}
+	alt := &CertState{Certificate: &cert.NebulaCertificate{Details: cert.NebulaCertificateDetails{Issuer: "b"}, Signature: []byte("b")}}
+	peerB := &cert.NebulaCertificate{Details: cert.NebulaCertificateDetails{Issuer: "b"}}
+
+	// Without alternates there is no choice
+	assert.Same(t, primary, primary.forPeer([]string{"b"}, peerB))
+
+	primary.alternates = []*CertState{alt}
+
+	// Nothing is known about the peer
+	assert.Same(t, primary, primary.forPeer(nil, nil))
+
+	// The peer advertised what it trusts, the primary wins when it is trusted
+	assert.Same(t, alt, primary.forPeer([]string{"b", "c"}, nil))
+	assert.Same(t, primary, primary.forPeer([]string{"a", "b"}, peerB))
+	assert.Same(t, primary, primary.forPeer([]string{"c"}, peerB))
+
+	// A peer that did not advertise trusts its own CA
+	assert.Same(t, alt, primary.forPeer(nil, peerB))
+
+	assert.True(t, primary.owns(primary.Certificate))
+	assert.True(t, primary.owns(alt.Certificate))
+	assert.False(t, primary.owns(&cert.NebulaCertificate{Signature: []byte("c")}))
+	assert.False(t, primary.owns(nil))
+}
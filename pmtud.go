@@ -0,0 +1,185 @@
+package nebula
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	"github.com/sirupsen/logrus"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/iputil"
+	"github.com/slackhq/nebula/overlay"
+)
+
+// tun.mtu is a single value for every tunnel but some underlay paths carry less than others, packets larger than the
+// path are fragmented by the underlay or dropped when it will not. With pmtud enabled each tunnel is probed with diag
+// probes of increasing size to find the largest inner packet that gets through. Packets larger than that are answered
+// with an icmp fragmentation needed so the sender lowers its path mtu for that host, and the mss of tcp syns through
+// the tunnel is clamped so tcp never sends segments that large.
+//
+// A probe only measures the path if the underlay can not fragment it. With pmtud enabled the listen sockets send
+// everything with the don't fragment bit set and the kernel never fragments what they send, see
+// udp.StdConn.setDontFragment. That is only done on linux, pmtud is refused elsewhere. Packets larger than the path
+// mtu that can not be refused with an icmp are dropped, the underlay would have dropped them anyway.
+//
+// Only peers that answer diag probes can be probed, tunnels with older peers keep using tun.mtu.
+
+const (
+	defaultPMTUDInterval = 10 * time.Minute
+	defaultPMTUDMin      = 1280
+
+	// pmtudCheckEvery is how often tunnels are looked at for one that needs probing
+	pmtudCheckEvery = 10 * time.Second
+	pmtudTimeout    = time.Second
+	pmtudTries      = 2
+
+	// tcpipOverhead is the ipv4 and tcp headers without options, mss is the path mtu less these
+	tcpipOverhead = 40
+)
+
+type pmtuDiscovery struct {
+	l        *logrus.Logger
+	f        *Interface
+	interval time.Duration
+	min      int
+	max      int
+	clampMSS bool
+
+	metricFragNeeded metrics.Counter
+	metricDropped    metrics.Counter
+}
+
+func newPMTUDiscoveryFromConfig(l *logrus.Logger, f *Interface, c *config.C) (*pmtuDiscovery, error) {
+	if !c.GetBool("pmtud.enabled", false) {
+		return nil, nil
+	}
+
+	if runtime.GOOS != "linux" {
+		return nil, fmt.Errorf("pmtud is not supported on %s, the underlay would fragment probes", runtime.GOOS)
+	}
+
+	p := &pmtuDiscovery{
+		l:                l,
+		f:                f,
+		interval:         c.GetDuration("pmtud.interval", defaultPMTUDInterval),
+		min:              c.GetInt("pmtud.min", defaultPMTUDMin),
+		max:              c.GetInt("pmtud.max", c.GetInt("tun.mtu", overlay.DefaultMTU)),
+		clampMSS:         c.GetBool("pmtud.clamp_mss", true),
+		metricFragNeeded: metrics.GetOrRegisterCounter("pmtud.frag_needed", nil),
+		metricDropped:    metrics.GetOrRegisterCounter("pmtud.dropped", nil),
+	}
+
+	if p.interval <= 0 {
+		return nil, errors.New("pmtud.interval must be greater than 0")
+	}
+	if p.min < 576 {
+		return nil, errors.New("pmtud.min must be at least 576")
+	}
+	if p.max < p.min || p.max > diagMaxPayload {
+		return nil, fmt.Errorf("pmtud.max must be between pmtud.min and %d", diagMaxPayload)
+	}
+
+	return p, nil
+}
+
+// Start probes tunnels for their path mtu until ctx is done. This is a non blocking call.
+func (p *pmtuDiscovery) Start(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(pmtudCheckEvery)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				p.probeDue(ctx)
+			}
+		}
+	}()
+}
+
+// probeDue probes every tunnel that has not been probed within interval, one at a time
+func (p *pmtuDiscovery) probeDue(ctx context.Context) {
+	now := time.Now()
+
+	var due []*HostInfo
+	p.f.hostMap.ForEachVpnIp(func(h *HostInfo) {
+		if h.ConnectionState == nil || !h.ConnectionState.capabilities.Has(capabilityDiagProbe) {
+			return
+		}
+
+		if now.Sub(time.Unix(0, h.pmtuProbed.Load())) >= p.interval {
+			due = append(due, h)
+		}
+	})
+
+	for _, h := range due {
+		if ctx.Err() != nil {
+			return
+		}
+		p.probe(h)
+	}
+}
+
+// probe finds the path mtu of a tunnel and stores it on the hostinfo
+func (p *pmtuDiscovery) probe(h *HostInfo) {
+	h.pmtuProbed.Store(time.Now().UnixNano())
+
+	rep, err := runDiag(func(size int) (*diagReply, error) {
+		return p.f.sendDiagProbe(h, size, pmtudTimeout)
+	}, DiagOptions{MaxSize: p.max, Timeout: pmtudTimeout, Tries: pmtudTries})
+	if err != nil {
+		// The tunnel is not answering at all, the connection manager deals with that
+		if p.l.Level >= logrus.DebugLevel {
+			h.logger(p.l).WithError(err).Debug("Failed to probe the path mtu")
+		}
+		return
+	}
+
+	pmtu := max(rep.MaxPayload, p.min)
+	if old := int(h.pmtu.Swap(int32(pmtu))); old != pmtu {
+		h.logger(p.l).WithField("pathMtu", pmtu).WithField("previousPathMtu", old).
+			WithField("remote", h.remote).Info("Path mtu changed")
+	}
+}
+
+// enforcePMTU keeps an outbound packet within the path mtu of the tunnel. It returns true if the packet was too large
+// to send, an icmp fragmentation needed was written to the tun instead if the packet has the don't fragment bit set.
+func (f *Interface) enforcePMTU(hostinfo *HostInfo, packet, out []byte, q int) bool {
+	pmtu := int(hostinfo.pmtu.Load())
+	if pmtu == 0 {
+		return false
+	}
+
+	if f.pmtud.clampMSS {
+		iputil.ClampTCPMSS(packet, uint16(pmtu-tcpipOverhead))
+	}
+
+	if len(packet) <= pmtu {
+		return false
+	}
+
+	out = iputil.CreateFragNeededPacket(packet, out, pmtu)
+	if len(out) == 0 {
+		// The sender allows fragmenting it but the underlay sockets never fragment with pmtud enabled
+		f.pmtud.metricDropped.Inc(1)
+		return true
+	}
+
+	f.pmtud.metricFragNeeded.Inc(1)
+	if _, err := f.readers[q].Write(out); err != nil {
+		f.l.WithError(err).Error("Failed to write to tun")
+	}
+	return true
+}
+
+// clampInboundMSS clamps the mss of a tcp syn from the tunnel, so replies fit the path mtu as well
+func (f *Interface) clampInboundMSS(hostinfo *HostInfo, packet []byte) {
+	if pmtu := int(hostinfo.pmtu.Load()); pmtu > 0 && f.pmtud.clampMSS {
+		iputil.ClampTCPMSS(packet, uint16(pmtu-tcpipOverhead))
+	}
+}
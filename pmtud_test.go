@@ -0,0 +1,115 @@
+package nebula
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/rcrowley/go-metrics"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/ipv4"
+)
+
+type testTun struct {
+	bytes.Buffer
+}
+
+func (t *testTun) Close() error {
+	return nil
+}
+
+func TestNewPMTUDiscoveryFromConfig(t *testing.T) {
+	l := test.NewLogger()
+	c := config.NewC(l)
+
+	p, err := newPMTUDiscoveryFromConfig(l, nil, c)
+	require.NoError(t, err)
+	assert.Nil(t, p)
+
+	c.Settings["tun"] = map[interface{}]interface{}{"mtu": 1420}
+	c.Settings["pmtud"] = map[interface{}]interface{}{"enabled": true}
+	p, err = newPMTUDiscoveryFromConfig(l, nil, c)
+	require.NoError(t, err)
+	assert.Equal(t, defaultPMTUDInterval, p.interval)
+	assert.Equal(t, defaultPMTUDMin, p.min)
+	assert.Equal(t, 1420, p.max)
+	assert.True(t, p.clampMSS)
+
+	for k, v := range map[string]interface{}{
+		"interval": "0s",
+		"min":      500,
+		"max":      1000,
+	} {
+		c.Settings["pmtud"] = map[interface{}]interface{}{"enabled": true, k: v}
+		_, err = newPMTUDiscoveryFromConfig(l, nil, c)
+		assert.Error(t, err, k)
+	}
+}
+
+func TestInterface_enforcePMTU(t *testing.T) {
+	tun := &testTun{}
+	f := &Interface{
+		l:       test.NewLogger(),
+		readers: []io.ReadWriteCloser{tun},
+		pmtud:   &pmtuDiscovery{clampMSS: true, metricFragNeeded: metrics.NilCounter{}, metricDropped: metrics.NilCounter{}},
+	}
+	h := &HostInfo{}
+
+	newPacket := func(size int, flags ipv4.HeaderFlags) []byte {
+		hdr := ipv4.Header{Version: 4, Len: 20, TotalLen: size, Flags: flags, TTL: 64, Protocol: 17, Src: net.IP{10, 0, 0, 1}, Dst: net.IP{10, 0, 0, 2}}
+		b, err := hdr.Marshal()
+		require.NoError(t, err)
+		return append(b, make([]byte, size-20)...)
+	}
+
+	out := make([]byte, mtu)
+
+	// Nothing is known about the path yet
+	assert.False(t, f.enforcePMTU(h, newPacket(1400, ipv4.DontFragment), out, 0))
+
+	h.pmtu.Store(1300)
+	assert.False(t, f.enforcePMTU(h, newPacket(1300, ipv4.DontFragment), out, 0))
+	assert.Zero(t, tun.Len())
+
+	// Too large to send unfragmented
+	assert.True(t, f.enforcePMTU(h, newPacket(1400, ipv4.DontFragment), out, 0))
+	reply := tun.Bytes()
+	require.Greater(t, len(reply), 28)
+	assert.Equal(t, []byte{3, 4}, reply[20:22])
+	assert.Equal(t, uint16(1300), binary.BigEndian.Uint16(reply[26:28]))
+
+	// The underlay does not fragment either, this one is dropped without an icmp
+	tun.Reset()
+	assert.True(t, f.enforcePMTU(h, newPacket(1400, 0), out, 0))
+	assert.Zero(t, tun.Len())
+
+	// A tcp syn has its mss clamped, in both directions
+	syn := func() []byte {
+		hdr := ipv4.Header{Version: 4, Len: 20, TotalLen: 44, TTL: 64, Protocol: 6, Src: net.IP{10, 0, 0, 1}, Dst: net.IP{10, 0, 0, 2}}
+		b, err := hdr.Marshal()
+		require.NoError(t, err)
+		tcp := make([]byte, 24)
+		tcp[12] = 6 << 4
+		tcp[13] = 0b10
+		copy(tcp[20:], []byte{2, 4, 0x23, 0x28})
+		return append(b, tcp...)
+	}
+
+	p := syn()
+	assert.False(t, f.enforcePMTU(h, p, out, 0))
+	assert.Equal(t, uint16(1300-tcpipOverhead), binary.BigEndian.Uint16(p[42:44]))
+
+	p = syn()
+	f.clampInboundMSS(h, p)
+	assert.Equal(t, uint16(1300-tcpipOverhead), binary.BigEndian.Uint16(p[42:44]))
+
+	f.pmtud.clampMSS = false
+	p = syn()
+	f.clampInboundMSS(h, p)
+	assert.Equal(t, uint16(9000), binary.BigEndian.Uint16(p[42:44]))
+}
@@ -0,0 +1,197 @@
+package nebula
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/netip"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/firewall"
+	"github.com/slackhq/nebula/udp"
+)
+
+// Some isps throttle udp by port and ecmp routers hash every flow onto a single path. With listen.ports we also listen
+// on those ports, and with listen.port_hop_interval every tunnel moves to a random one of our ports each interval.
+// Peers roam their side of the tunnel to the new source port on the first packet from it like they would for a nat
+// rebinding, so nothing is negotiated and peers running older versions follow along. Peers can reach us on any port.
+
+type portHopper struct {
+	l *logrus.Logger
+	f *Interface
+
+	ports    []int
+	interval time.Duration
+	// conns are the sockets for ports, index 0 stands for the listen.port sockets and is nil
+	conns []udp.Conn
+	// assigned maps the remote ip of a tunnel to the index in conns we send to it from, ips that are not in it are sent
+	// to from listen.port. It is keyed by ip alone so the assignment holds while the peer hops ports itself.
+	assigned atomic.Pointer[map[netip.Addr]int]
+}
+
+func newPortHopperFromConfig(l *logrus.Logger, c *config.C) (*portHopper, error) {
+	raw := c.Get("listen.ports")
+	if raw == nil {
+		return nil, nil
+	}
+
+	rs, ok := raw.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("listen.ports must be a list of ports")
+	}
+
+	h := &portHopper{
+		l:        l,
+		interval: c.GetDuration("listen.port_hop_interval", 0),
+	}
+
+	listenPort := c.GetInt("listen.port", 0)
+	for _, r := range rs {
+		port, err := strconv.Atoi(fmt.Sprint(r))
+		if err != nil || port < 1 || port > 65535 {
+			return nil, fmt.Errorf("listen.ports entry %v is not a port", r)
+		}
+		if port == listenPort {
+			return nil, fmt.Errorf("listen.ports entry %v is already listen.port", r)
+		}
+		h.ports = append(h.ports, port)
+	}
+
+	if len(h.ports) == 0 {
+		return nil, nil
+	}
+
+	// A hop back to the port a peer saw us on last is suppressed as a roam back for a while
+	if h.interval < 0 || (h.interval > 0 && h.interval < RoamingSuppressSeconds*time.Second) {
+		return nil, fmt.Errorf("listen.port_hop_interval must be 0 or at least %ds: %v", RoamingSuppressSeconds, h.interval)
+	}
+
+	assigned := map[netip.Addr]int{}
+	h.assigned.Store(&assigned)
+	return h, nil
+}
+
+// open listens on every port
+func (h *portHopper) open(ip net.IP, c *config.C) error {
+	h.conns = make([]udp.Conn, len(h.ports)+1)
+	for i, port := range h.ports {
+		conn, err := udp.NewListener(h.l, ip, port, false, c.GetInt("listen.batch", 64))
+		if err != nil {
+			for _, opened := range h.conns[1 : i+1] {
+				opened.Close()
+			}
+			return fmt.Errorf("failed to listen on listen.ports entry %v: %w", port, err)
+		}
+		conn.ReloadConfig(c)
+		h.conns[i+1] = conn
+	}
+	return nil
+}
+
+// Start reads from every port and moves tunnels between them every interval until ctx is done
+func (h *portHopper) Start(ctx context.Context) {
+	for _, conn := range h.conns[1:] {
+		go conn.ListenOut(readOutsidePackets(h.f, nil), lhHandleRequest(h.f.lightHouse.NewRequestHandler(), h.f),
+			firewall.NewConntrackCacheTicker(h.f.conntrackCacheTimeout), 0)
+	}
+	h.l.WithField("ports", h.ports).WithField("interval", h.interval).Info("Listening on listen.ports")
+
+	var tick <-chan time.Time
+	if h.interval > 0 {
+		ticker := time.NewTicker(h.interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			for _, conn := range h.conns[1:] {
+				conn.Close()
+			}
+			return
+		case <-tick:
+			h.hop()
+		}
+	}
+}
+
+// hop moves every remote ip to a port other than the one it is on
+func (h *portHopper) hop() {
+	old := *h.assigned.Load()
+
+	h.f.hostMap.RLock()
+	assigned := make(map[netip.Addr]int, len(h.f.hostMap.Hosts))
+	for _, hostinfo := range h.f.hostMap.Hosts {
+		remote := hostinfo.remote
+		if remote == nil {
+			continue
+		}
+		ip, ok := netip.AddrFromSlice(remote.IP)
+		if !ok {
+			continue
+		}
+
+		ip = ip.Unmap()
+		if _, ok := assigned[ip]; ok {
+			continue
+		}
+
+		i := rand.Intn(len(h.conns) - 1)
+		if i >= old[ip] {
+			i++
+		}
+		assigned[ip] = i
+	}
+	h.f.hostMap.RUnlock()
+
+	h.assigned.Store(&assigned)
+}
+
+// conn returns the socket to send to addr from, nil for listen.port
+func (h *portHopper) conn(addr *udp.Addr) udp.Conn {
+	assigned := *h.assigned.Load()
+	if len(assigned) == 0 {
+		return nil
+	}
+
+	ip, ok := netip.AddrFromSlice(addr.IP)
+	if !ok {
+		return nil
+	}
+	return h.conns[assigned[ip.Unmap()]]
+}
+
+// wrap returns a udp.Conn that sends to every remote from the port it is assigned and everything else through c
+func (h *portHopper) wrap(c udp.Conn) udp.Conn {
+	return &portHopConn{Conn: c, h: h}
+}
+
+type portHopConn struct {
+	udp.Conn
+	h *portHopper
+}
+
+func (c *portHopConn) WriteTo(b []byte, addr *udp.Addr) error {
+	if conn := c.h.conn(addr); conn != nil {
+		return conn.WriteTo(b, addr)
+	}
+	return c.Conn.WriteTo(b, addr)
+}
+
+// WriteBatch sends the packets for remotes assigned another port from it and the rest as a batch through the
+// listen.port socket, bufs, addrs and tos are reordered
+func (c *portHopConn) WriteBatch(bufs [][]byte, addrs []*udp.Addr, tos []byte) error {
+	return writeBatchDiverted(c.Conn, bufs, addrs, tos, func(i int) bool {
+		if conn := c.h.conn(addrs[i]); conn != nil {
+			writeOne(conn, bufs, addrs, tos, i)
+			return true
+		}
+		return false
+	})
+}
@@ -0,0 +1,87 @@
+package nebula
+
+import (
+	"net"
+	"testing"
+
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/iputil"
+	"github.com/slackhq/nebula/test"
+	"github.com/slackhq/nebula/udp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewPortHopperFromConfig(t *testing.T) {
+	l := test.NewLogger()
+	c := config.NewC(l)
+
+	h, err := newPortHopperFromConfig(l, c)
+	require.NoError(t, err)
+	assert.Nil(t, h)
+
+	c.Settings["listen"] = map[interface{}]interface{}{"port": 4242, "ports": []interface{}{4243, "4244"}, "port_hop_interval": "30s"}
+	h, err = newPortHopperFromConfig(l, c)
+	require.NoError(t, err)
+	assert.Equal(t, []int{4243, 4244}, h.ports)
+
+	for name, listen := range map[string]map[interface{}]interface{}{
+		"not a list":  {"ports": 4243},
+		"not a port":  {"ports": []interface{}{70000}},
+		"listen.port": {"port": 4242, "ports": []interface{}{4242}},
+		"short":       {"ports": []interface{}{4243}, "port_hop_interval": "1s"},
+		"negative":    {"ports": []interface{}{4243}, "port_hop_interval": "-1s"},
+	} {
+		c.Settings["listen"] = listen
+		_, err = newPortHopperFromConfig(l, c)
+		assert.Error(t, err, name)
+	}
+}
+
+func TestPortHopper_hop(t *testing.T) {
+	l := test.NewLogger()
+	c := config.NewC(l)
+	c.Settings["listen"] = map[interface{}]interface{}{"ports": []interface{}{4243, 4244}, "port_hop_interval": "30s"}
+	h, err := newPortHopperFromConfig(l, c)
+	require.NoError(t, err)
+
+	primary, a, b := &recordConn{}, &recordConn{}, &recordConn{}
+	h.conns = []udp.Conn{nil, a, b}
+
+	hm := newHostMap(l, &net.IPNet{IP: net.IP{10, 128, 0, 0}, Mask: net.IPMask{255, 255, 0, 0}})
+	remote := udp.NewAddr(net.IP{1, 1, 1, 1}, 4242)
+	hm.Hosts[iputil.Ip2VpnIp(net.IP{10, 128, 0, 2})] = &HostInfo{remote: remote}
+	hm.Hosts[iputil.Ip2VpnIp(net.IP{10, 128, 0, 3})] = &HostInfo{}
+	h.f = &Interface{hostMap: hm}
+
+	c2 := h.wrap(primary)
+	other := udp.NewAddr(net.IP{2, 2, 2, 2}, 4242)
+
+	// Nothing has hopped yet, everything goes out of listen.port
+	require.NoError(t, c2.WriteTo([]byte{1}, remote))
+	assert.Equal(t, []string{"1.1.1.1:4242"}, primary.sent)
+
+	// Every hop moves the tunnel to another port
+	last := 0
+	for i := 0; i < 10; i++ {
+		h.hop()
+		assigned := *h.assigned.Load()
+		require.Len(t, assigned, 1)
+		for _, got := range assigned {
+			assert.NotEqual(t, last, got)
+			last = got
+		}
+	}
+
+	primary.sent, a.sent, b.sent = nil, nil, nil
+	require.NoError(t, c2.(udp.BatchConn).WriteBatch([][]byte{{1}, {2}}, []*udp.Addr{remote, other}, nil))
+	require.NoError(t, c2.WriteTo([]byte{3}, remote))
+	if last == 0 {
+		// Back on listen.port
+		assert.Equal(t, []string{"1.1.1.1:4242", "2.2.2.2:4242", "1.1.1.1:4242"}, primary.sent)
+	} else {
+		assert.Equal(t, []string{"2.2.2.2:4242"}, primary.sent)
+		assert.Equal(t, []string{"1.1.1.1:4242", "1.1.1.1:4242"}, h.conns[last].(*recordConn).sent)
+	}
+	assert.Same(t, primary, unwrapConn(c2))
+}
@@ -0,0 +1,178 @@
+package nebula
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/portmap"
+	"github.com/slackhq/nebula/util"
+)
+
+const (
+	defaultPortMappingLifetime = time.Hour
+	defaultPortMappingRetry    = time.Minute
+	portMappingTimeout         = 10 * time.Second
+)
+
+var defaultPortMappingProtocols = []string{"natpmp", "upnp"}
+
+// portMapper asks the local gateway to forward a public port to our listen port and advertises the mapped address to
+// the lighthouses, so peers can reach us when hole punching through our NAT fails. The mapping is renewed at half its
+// lifetime and removed when we shut down.
+type portMapper struct {
+	l         *logrus.Logger
+	f         *Interface
+	protocols []string
+	// gateway is the NAT-PMP server, found from the default route when it is not configured
+	gateway  netip.Addr
+	lifetime time.Duration
+	retry    time.Duration
+}
+
+func newPortMapperFromConfig(l *logrus.Logger, f *Interface, c *config.C) (*portMapper, error) {
+	if !c.GetBool("port_mapping.enabled", false) {
+		return nil, nil
+	}
+
+	pm := &portMapper{
+		l:         l,
+		f:         f,
+		protocols: c.GetStringSlice("port_mapping.protocols", defaultPortMappingProtocols),
+		lifetime:  c.GetDuration("port_mapping.lifetime", defaultPortMappingLifetime),
+		retry:     c.GetDuration("port_mapping.retry", defaultPortMappingRetry),
+	}
+
+	if len(pm.protocols) == 0 {
+		return nil, fmt.Errorf("port_mapping.protocols must not be empty")
+	}
+	for _, p := range pm.protocols {
+		if p != "natpmp" && p != "upnp" {
+			return nil, util.NewContextualError("Unknown port_mapping.protocols entry, expected natpmp or upnp", m{"protocol": p}, nil)
+		}
+	}
+
+	if rawGateway := c.GetString("port_mapping.gateway", ""); rawGateway != "" {
+		gateway, err := netip.ParseAddr(rawGateway)
+		if err != nil || !gateway.Is4() {
+			return nil, util.NewContextualError("port_mapping.gateway must be an ipv4 address", m{"gateway": rawGateway}, err)
+		}
+		pm.gateway = gateway
+	}
+
+	if pm.lifetime < time.Minute {
+		return nil, fmt.Errorf("port_mapping.lifetime must be at least 1m")
+	}
+	if pm.retry <= 0 {
+		return nil, fmt.Errorf("port_mapping.retry must be greater than 0")
+	}
+
+	return pm, nil
+}
+
+// Start maps our listen port until ctx is done. This is a non blocking call.
+func (pm *portMapper) Start(ctx context.Context) {
+	go pm.run(ctx)
+}
+
+func (pm *portMapper) run(ctx context.Context) {
+	port := uint16(pm.f.lightHouse.nebulaPort.Load())
+	var client portmap.Client
+	var current netip.AddrPort
+
+	for {
+		var wait time.Duration
+		mapping, err := pm.mapPort(ctx, &client, port)
+		if err != nil {
+			pm.l.WithError(err).WithField("port", port).Warn("Failed to map our listen port on the gateway")
+			client = nil
+			wait = pm.retry
+
+			current = netip.AddrPort{}
+			if pm.f.lightHouse.setPublicAddr("port_mapping", nil) {
+				pm.f.lightHouse.SendUpdate()
+			}
+
+		} else {
+			wait = mapping.Lifetime / 2
+			if mapping.Lifetime == 0 {
+				// A permanent mapping, check on it as often as any other
+				wait = pm.lifetime / 2
+			}
+
+			if mapping.External != current {
+				current = mapping.External
+				pm.l.WithField("protocol", client.Name()).WithField("udpAddr", current).WithField("lifetime", mapping.Lifetime).
+					Info("Mapped our listen port on the gateway")
+				if pm.f.lightHouse.setPublicAddr("port_mapping", &netIpAndPort{ip: net.IP(current.Addr().AsSlice()), port: current.Port()}) {
+					pm.f.lightHouse.SendUpdate()
+				}
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			if client != nil {
+				// ctx is done, the gateway gets its own time to hear about it
+				unmapCtx, cancel := context.WithTimeout(context.Background(), portMappingTimeout)
+				if err := client.Unmap(unmapCtx, port); err != nil {
+					pm.l.WithError(err).Warn("Failed to remove our port mapping from the gateway")
+				}
+				cancel()
+			}
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+// mapPort maps port with client, or the first protocol that works when client is nil
+func (pm *portMapper) mapPort(ctx context.Context, client *portmap.Client, port uint16) (portmap.Mapping, error) {
+	ctx, cancel := context.WithTimeout(ctx, portMappingTimeout)
+	defer cancel()
+
+	if *client != nil {
+		return (*client).Map(ctx, port, pm.lifetime)
+	}
+
+	var errs []error
+	for _, p := range pm.protocols {
+		c, err := pm.newClient(ctx, p)
+		if err == nil {
+			var mapping portmap.Mapping
+			mapping, err = c.Map(ctx, port, pm.lifetime)
+			if err == nil {
+				*client = c
+				return mapping, nil
+			}
+		}
+		errs = append(errs, fmt.Errorf("%s: %w", p, err))
+	}
+
+	return portmap.Mapping{}, errors.Join(errs...)
+}
+
+func (pm *portMapper) newClient(ctx context.Context, protocol string) (portmap.Client, error) {
+	switch protocol {
+	case "natpmp":
+		gateway := pm.gateway
+		if !gateway.IsValid() {
+			var err error
+			if gateway, err = portmap.DefaultGateway(); err != nil {
+				return nil, fmt.Errorf("%w, set port_mapping.gateway", err)
+			}
+		}
+		return portmap.NewNATPMP(gateway), nil
+
+	case "upnp":
+		return portmap.DiscoverUPnP(ctx)
+
+	default:
+		return nil, fmt.Errorf("unknown protocol")
+	}
+}
@@ -0,0 +1,78 @@
+package nebula
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/iputil"
+	"github.com/slackhq/nebula/test"
+	"github.com/slackhq/nebula/udp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewPortMapperFromConfig(t *testing.T) {
+	l := test.NewLogger()
+	c := config.NewC(l)
+
+	pm, err := newPortMapperFromConfig(l, nil, c)
+	require.NoError(t, err)
+	assert.Nil(t, pm)
+
+	c.Settings["port_mapping"] = map[interface{}]interface{}{"enabled": true}
+	pm, err = newPortMapperFromConfig(l, nil, c)
+	require.NoError(t, err)
+	assert.Equal(t, defaultPortMappingProtocols, pm.protocols)
+	assert.Equal(t, defaultPortMappingLifetime, pm.lifetime)
+	assert.False(t, pm.gateway.IsValid())
+
+	tests := map[string]map[interface{}]interface{}{
+		"Unknown port_mapping.protocols entry, expected natpmp or upnp": {"protocols": []interface{}{"pcp"}},
+		"port_mapping.gateway must be an ipv4 address":                  {"gateway": "::1"},
+		"port_mapping.lifetime must be at least 1m":                     {"lifetime": "10s"},
+		"port_mapping.retry must be greater than 0":                     {"retry": "0s"},
+	}
+	for expected, settings := range tests {
+		settings["enabled"] = true
+		c.Settings["port_mapping"] = settings
+		_, err := newPortMapperFromConfig(l, nil, c)
+		assert.ErrorContains(t, err, expected)
+	}
+}
+
+func TestLighthouse_SendUpdate_publicAddrs(t *testing.T) {
+	l := test.NewLogger()
+	lighthouse := iputil.Ip2VpnIp(net.IP{10, 128, 0, 2})
+	c := config.NewC(l)
+	c.Settings["lighthouse"] = map[interface{}]interface{}{
+		"hosts":            []interface{}{lighthouse.String()},
+		"local_allow_list": map[interface{}]interface{}{"interfaces": map[interface{}]interface{}{".*": false}},
+	}
+	c.Settings["static_host_map"] = map[interface{}]interface{}{lighthouse.String(): []interface{}{"1.1.1.1:4242"}}
+	c.Settings["listen"] = map[interface{}]interface{}{"port": 4242}
+	lh, err := NewLightHouseFromConfig(context.Background(), l, c, []*net.IPNet{&net.IPNet{IP: net.IP{10, 128, 0, 1}, Mask: net.IPMask{255, 255, 255, 0}}}, nil, nil)
+	require.NoError(t, err)
+	w := &collectEncWriter{}
+	lh.ifce = w
+
+	lastUpdate := func() *NebulaMeta {
+		require.NotEmpty(t, w.sent)
+		n := &NebulaMeta{}
+		require.NoError(t, n.Unmarshal(w.sent[len(w.sent)-1]))
+		return n
+	}
+
+	lh.SendUpdate()
+	assert.Empty(t, lastUpdate().Details.Ip4AndPorts)
+
+	assert.True(t, lh.setPublicAddr("port_mapping", &netIpAndPort{ip: net.IP{203, 0, 113, 1}, port: 4243}))
+	assert.False(t, lh.setPublicAddr("port_mapping", &netIpAndPort{ip: net.IP{203, 0, 113, 1}, port: 4243}))
+	lh.SendUpdate()
+	assertIp4InArray(t, lastUpdate().Details.Ip4AndPorts, &udp.Addr{IP: net.IP{203, 0, 113, 1}, Port: 4243})
+
+	assert.True(t, lh.setPublicAddr("port_mapping", nil))
+	lh.SendUpdate()
+	assert.Empty(t, lastUpdate().Details.Ip4AndPorts)
+}
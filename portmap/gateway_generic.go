@@ -0,0 +1,13 @@
+//go:build !linux || android
+// +build !linux android
+
+package portmap
+
+import (
+	"net/netip"
+)
+
+// DefaultGateway can not find the gateway on this platform, it must be configured
+func DefaultGateway() (netip.Addr, error) {
+	return netip.Addr{}, ErrNoGateway
+}
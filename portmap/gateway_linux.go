@@ -0,0 +1,37 @@
+//go:build !android
+// +build !android
+
+package portmap
+
+import (
+	"net/netip"
+
+	"github.com/vishvananda/netlink"
+)
+
+// DefaultGateway returns the ipv4 gateway of the default route
+func DefaultGateway() (netip.Addr, error) {
+	routes, err := netlink.RouteList(nil, netlink.FAMILY_V4)
+	if err != nil {
+		return netip.Addr{}, err
+	}
+
+	for _, r := range routes {
+		if r.Gw == nil {
+			continue
+		}
+
+		// The default route has no destination or 0.0.0.0/0
+		if r.Dst != nil {
+			if ones, _ := r.Dst.Mask.Size(); ones != 0 {
+				continue
+			}
+		}
+
+		if gw, ok := netip.AddrFromSlice(r.Gw.To4()); ok {
+			return gw, nil
+		}
+	}
+
+	return netip.Addr{}, ErrNoGateway
+}
@@ -0,0 +1,158 @@
+package portmap
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"time"
+)
+
+// NAT-PMP is described in RFC 6886
+
+const (
+	natPMPPort    = 5351
+	natPMPVersion = 0
+
+	natPMPOpExternalAddr = 0
+	natPMPOpMapUDP       = 1
+	natPMPOpReply        = 128
+
+	// natPMPTries with the timeout doubling from natPMPInitialTimeout waits about 4 seconds in total, the RFC allows
+	// for a minute but a gateway that has not answered by then is unlikely to
+	natPMPTries          = 5
+	natPMPInitialTimeout = 250 * time.Millisecond
+)
+
+var natPMPResults = map[uint16]string{
+	1: "unsupported version",
+	2: "not authorized or refused",
+	3: "network failure",
+	4: "out of resources",
+	5: "unsupported opcode",
+}
+
+// NATPMP is a NAT-PMP client
+type NATPMP struct {
+	gateway netip.AddrPort
+}
+
+// NewNATPMP returns a client for the NAT-PMP server on gateway
+func NewNATPMP(gateway netip.Addr) *NATPMP {
+	return &NATPMP{gateway: netip.AddrPortFrom(gateway, natPMPPort)}
+}
+
+func (n *NATPMP) Name() string {
+	return "natpmp"
+}
+
+func (n *NATPMP) Map(ctx context.Context, internalPort uint16, lifetime time.Duration) (Mapping, error) {
+	addr, err := n.externalAddr(ctx)
+	if err != nil {
+		return Mapping{}, err
+	}
+
+	port, lifetime, err := n.mapUDP(ctx, internalPort, internalPort, lifetime)
+	if err != nil {
+		return Mapping{}, err
+	}
+
+	return Mapping{External: netip.AddrPortFrom(addr, port), Lifetime: lifetime}, nil
+}
+
+func (n *NATPMP) Unmap(ctx context.Context, internalPort uint16) error {
+	// A lifetime and suggested port of 0 deletes the mapping
+	_, _, err := n.mapUDP(ctx, internalPort, 0, 0)
+	return err
+}
+
+func (n *NATPMP) externalAddr(ctx context.Context) (netip.Addr, error) {
+	resp, err := n.call(ctx, []byte{natPMPVersion, natPMPOpExternalAddr}, 12)
+	if err != nil {
+		return netip.Addr{}, err
+	}
+
+	addr := netip.AddrFrom4([4]byte(resp[8:12]))
+	if addr.IsUnspecified() {
+		return netip.Addr{}, errors.New("the gateway does not have an external address")
+	}
+	return addr, nil
+}
+
+func (n *NATPMP) mapUDP(ctx context.Context, internalPort, externalPort uint16, lifetime time.Duration) (uint16, time.Duration, error) {
+	req := make([]byte, 12)
+	req[0] = natPMPVersion
+	req[1] = natPMPOpMapUDP
+	binary.BigEndian.PutUint16(req[4:6], internalPort)
+	binary.BigEndian.PutUint16(req[6:8], externalPort)
+	binary.BigEndian.PutUint32(req[8:12], uint32(lifetime/time.Second))
+
+	resp, err := n.call(ctx, req, 16)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	if got := binary.BigEndian.Uint16(resp[8:10]); got != internalPort {
+		return 0, 0, fmt.Errorf("gateway answered for internal port %d, wanted %d", got, internalPort)
+	}
+
+	return binary.BigEndian.Uint16(resp[10:12]), time.Duration(binary.BigEndian.Uint32(resp[12:16])) * time.Second, nil
+}
+
+// call sends req to the gateway until it answers, retrying as the RFC describes, and returns a response of at least
+// size bytes with a successful result code
+func (n *NATPMP) call(ctx context.Context, req []byte, size int) ([]byte, error) {
+	conn, err := net.DialUDP("udp4", nil, net.UDPAddrFromAddrPort(n.gateway))
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	resp := make([]byte, 16)
+	timeout := natPMPInitialTimeout
+	for i := 0; i < natPMPTries; i++ {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		if _, err := conn.Write(req); err != nil {
+			return nil, err
+		}
+
+		deadline := time.Now().Add(timeout)
+		if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+			deadline = d
+		}
+		_ = conn.SetReadDeadline(deadline)
+		timeout *= 2
+
+		for {
+			l, err := conn.Read(resp)
+			if err != nil {
+				var netErr net.Error
+				if errors.As(err, &netErr) && netErr.Timeout() {
+					break
+				}
+				return nil, err
+			}
+
+			// Skip anything that is not the answer to what we asked, like an address change announcement
+			if l < size || resp[0] != natPMPVersion || resp[1] != natPMPOpReply|req[1] {
+				continue
+			}
+
+			if result := binary.BigEndian.Uint16(resp[2:4]); result != 0 {
+				if msg, ok := natPMPResults[result]; ok {
+					return nil, fmt.Errorf("nat-pmp gateway refused: %s", msg)
+				}
+				return nil, fmt.Errorf("nat-pmp gateway refused with result %d", result)
+			}
+
+			return resp[:l], nil
+		}
+	}
+
+	return nil, fmt.Errorf("no nat-pmp answer from %s", n.gateway)
+}
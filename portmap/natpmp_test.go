@@ -0,0 +1,80 @@
+package portmap
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeNATPMP answers like a gateway with external address 203.0.113.1, result is returned for mapping requests
+func fakeNATPMP(t *testing.T, result uint16) *NATPMP {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IP{127, 0, 0, 1}})
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+
+	go func() {
+		b := make([]byte, 16)
+		for {
+			n, from, err := conn.ReadFromUDP(b)
+			if err != nil {
+				return
+			}
+
+			resp := make([]byte, 16)
+			resp[1] = natPMPOpReply | b[1]
+			switch {
+			case n == 2 && b[1] == natPMPOpExternalAddr:
+				copy(resp[8:12], net.IP{203, 0, 113, 1}.To4())
+				resp = resp[:12]
+			case n == 12 && b[1] == natPMPOpMapUDP:
+				binary.BigEndian.PutUint16(resp[2:4], result)
+				copy(resp[8:10], b[4:6])
+				// The gateway picks the next port up and halves the lifetime
+				binary.BigEndian.PutUint16(resp[10:12], binary.BigEndian.Uint16(b[6:8])+1)
+				binary.BigEndian.PutUint32(resp[12:16], binary.BigEndian.Uint32(b[8:12])/2)
+			default:
+				continue
+			}
+
+			_, _ = conn.WriteToUDP(resp, from)
+		}
+	}()
+
+	return &NATPMP{gateway: conn.LocalAddr().(*net.UDPAddr).AddrPort()}
+}
+
+func TestNATPMP_Map(t *testing.T) {
+	n := fakeNATPMP(t, 0)
+
+	m, err := n.Map(context.Background(), 4242, time.Hour)
+	require.NoError(t, err)
+	assert.Equal(t, netip.MustParseAddrPort("203.0.113.1:4243"), m.External)
+	assert.Equal(t, 30*time.Minute, m.Lifetime)
+
+	assert.NoError(t, n.Unmap(context.Background(), 4242))
+}
+
+func TestNATPMP_refused(t *testing.T) {
+	n := fakeNATPMP(t, 2)
+	_, err := n.Map(context.Background(), 4242, time.Hour)
+	assert.EqualError(t, err, "nat-pmp gateway refused: not authorized or refused")
+}
+
+func TestNATPMP_noAnswer(t *testing.T) {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IP{127, 0, 0, 1}})
+	require.NoError(t, err)
+	defer conn.Close()
+
+	n := &NATPMP{gateway: conn.LocalAddr().(*net.UDPAddr).AddrPort()}
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+
+	_, err = n.Map(ctx, 4242, time.Hour)
+	assert.Error(t, err)
+}
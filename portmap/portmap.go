@@ -0,0 +1,32 @@
+// Package portmap asks the local gateway to forward a public port to us with NAT-PMP or UPnP IGD, so peers can reach
+// hosts behind NATs that defeat hole punching.
+package portmap
+
+import (
+	"context"
+	"errors"
+	"net/netip"
+	"time"
+)
+
+// ErrNoGateway is returned when the default gateway can not be found
+var ErrNoGateway = errors.New("could not find the default gateway")
+
+// Mapping is a port the gateway forwards to us
+type Mapping struct {
+	// External is the public address and port peers can reach us at
+	External netip.AddrPort
+	// Lifetime is how long the gateway keeps the mapping, it must be renewed before then
+	Lifetime time.Duration
+}
+
+// Client maps a udp port on a gateway
+type Client interface {
+	// Name is the protocol the client speaks
+	Name() string
+	// Map asks the gateway to forward udp traffic for a public port to internalPort for lifetime, the gateway may
+	// choose a different public port or lifetime. Calling Map again renews the mapping.
+	Map(ctx context.Context, internalPort uint16, lifetime time.Duration) (Mapping, error)
+	// Unmap removes the mapping for internalPort
+	Unmap(ctx context.Context, internalPort uint16) error
+}
@@ -0,0 +1,330 @@
+package portmap
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// UPnP IGD is described in the UPnP Device Architecture and the InternetGatewayDevice:1 and :2 specifications
+
+const (
+	ssdpAddr      = "239.255.255.250:1900"
+	ssdpSearchFor = "urn:schemas-upnp-org:device:InternetGatewayDevice:1"
+	ssdpWait      = 2 * time.Second
+
+	upnpDescription = "nebula"
+	// upnpMaxBody limits how much of a gateway response is read
+	upnpMaxBody = 1 << 20
+)
+
+// upnpServices are the services that can map ports, in the order we prefer them
+var upnpServices = []string{
+	"urn:schemas-upnp-org:service:WANIPConnection:2",
+	"urn:schemas-upnp-org:service:WANIPConnection:1",
+	"urn:schemas-upnp-org:service:WANPPPConnection:1",
+}
+
+// UPnP is a UPnP IGD client
+type UPnP struct {
+	client      *http.Client
+	controlURL  string
+	serviceType string
+	// internalClient is our address as the gateway sees it, which mappings forward to
+	internalClient string
+	// permanentOnly is set when the gateway refused a lease duration, some only take permanent mappings
+	permanentOnly bool
+}
+
+// DiscoverUPnP searches the local network for an internet gateway device
+func DiscoverUPnP(ctx context.Context) (*UPnP, error) {
+	location, err := ssdpSearch(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return NewUPnP(ctx, location)
+}
+
+// NewUPnP returns a client for the gateway described at location
+func NewUPnP(ctx context.Context, location string) (*UPnP, error) {
+	u := &UPnP{client: &http.Client{}}
+
+	base, err := url.Parse(location)
+	if err != nil {
+		return nil, fmt.Errorf("invalid gateway location: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, location, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := u.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("gateway description returned %s", resp.Status)
+	}
+
+	var desc upnpRoot
+	if err := xml.NewDecoder(io.LimitReader(resp.Body, upnpMaxBody)).Decode(&desc); err != nil {
+		return nil, fmt.Errorf("invalid gateway description: %w", err)
+	}
+
+	if desc.URLBase != "" {
+		if b, err := url.Parse(desc.URLBase); err == nil {
+			base = b
+		}
+	}
+
+	services := desc.Device.services()
+	for _, st := range upnpServices {
+		for _, s := range services {
+			if s.ServiceType != st {
+				continue
+			}
+
+			control, err := base.Parse(s.ControlURL)
+			if err != nil {
+				return nil, fmt.Errorf("invalid control url: %w", err)
+			}
+
+			u.controlURL = control.String()
+			u.serviceType = s.ServiceType
+
+			// The gateway forwards to whichever of our addresses we reach it from
+			conn, err := net.Dial("udp", control.Host)
+			if err != nil {
+				return nil, err
+			}
+			u.internalClient = conn.LocalAddr().(*net.UDPAddr).IP.String()
+			conn.Close()
+
+			return u, nil
+		}
+	}
+
+	return nil, errors.New("gateway does not offer a port mapping service")
+}
+
+func (u *UPnP) Name() string {
+	return "upnp"
+}
+
+func (u *UPnP) Map(ctx context.Context, internalPort uint16, lifetime time.Duration) (Mapping, error) {
+	var ext struct {
+		IP string `xml:"NewExternalIPAddress"`
+	}
+	if err := u.call(ctx, "GetExternalIPAddress", nil, &ext); err != nil {
+		return Mapping{}, err
+	}
+
+	addr, err := netip.ParseAddr(strings.TrimSpace(ext.IP))
+	if err != nil || addr.IsUnspecified() {
+		return Mapping{}, fmt.Errorf("gateway does not have a valid external address: %q", ext.IP)
+	}
+
+	if !u.permanentOnly {
+		err = u.addPortMapping(ctx, internalPort, lifetime)
+		var soapErr *upnpError
+		if errors.As(err, &soapErr) && soapErr.Code == upnpOnlyPermanentLeasesSupported {
+			u.permanentOnly = true
+		}
+	}
+
+	if u.permanentOnly {
+		// The mapping outlives us if we do not remove it, it is renewed the same as any other
+		lifetime = 0
+		err = u.addPortMapping(ctx, internalPort, 0)
+	}
+
+	if err != nil {
+		return Mapping{}, err
+	}
+
+	return Mapping{External: netip.AddrPortFrom(addr, internalPort), Lifetime: lifetime}, nil
+}
+
+func (u *UPnP) Unmap(ctx context.Context, internalPort uint16) error {
+	return u.call(ctx, "DeletePortMapping", []upnpArg{
+		{"NewRemoteHost", ""},
+		{"NewExternalPort", strconv.Itoa(int(internalPort))},
+		{"NewProtocol", "UDP"},
+	}, nil)
+}
+
+func (u *UPnP) addPortMapping(ctx context.Context, port uint16, lifetime time.Duration) error {
+	return u.call(ctx, "AddPortMapping", []upnpArg{
+		{"NewRemoteHost", ""},
+		{"NewExternalPort", strconv.Itoa(int(port))},
+		{"NewProtocol", "UDP"},
+		{"NewInternalPort", strconv.Itoa(int(port))},
+		{"NewInternalClient", u.internalClient},
+		{"NewEnabled", "1"},
+		{"NewPortMappingDescription", upnpDescription},
+		{"NewLeaseDuration", strconv.Itoa(int(lifetime / time.Second))},
+	}, nil)
+}
+
+// upnpOnlyPermanentLeasesSupported is the soap error a gateway returns when it refuses a lease duration
+const upnpOnlyPermanentLeasesSupported = 725
+
+type upnpArg struct {
+	name  string
+	value string
+}
+
+type upnpError struct {
+	Code        int    `xml:"Body>Fault>detail>UPnPError>errorCode"`
+	Description string `xml:"Body>Fault>detail>UPnPError>errorDescription"`
+}
+
+func (e *upnpError) Error() string {
+	return fmt.Sprintf("upnp gateway refused: %d %s", e.Code, e.Description)
+}
+
+// call invokes action on the gateway, the response arguments are decoded into out if it is not nil
+func (u *UPnP) call(ctx context.Context, action string, args []upnpArg, out interface{}) error {
+	var body bytes.Buffer
+	body.WriteString(`<?xml version="1.0"?><s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/"><s:Body>`)
+	fmt.Fprintf(&body, `<u:%s xmlns:u="%s">`, action, u.serviceType)
+	for _, a := range args {
+		fmt.Fprintf(&body, "<%s>", a.name)
+		_ = xml.EscapeText(&body, []byte(a.value))
+		fmt.Fprintf(&body, "</%s>", a.name)
+	}
+	fmt.Fprintf(&body, `</u:%s></s:Body></s:Envelope>`, action)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u.controlURL, &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", `text/xml; charset="utf-8"`)
+	req.Header.Set("SOAPAction", fmt.Sprintf(`"%s#%s"`, u.serviceType, action))
+
+	resp, err := u.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	b, err := io.ReadAll(io.LimitReader(resp.Body, upnpMaxBody))
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		soapErr := &upnpError{}
+		if xml.Unmarshal(b, soapErr) == nil && soapErr.Code != 0 {
+			return soapErr
+		}
+		return fmt.Errorf("upnp %s returned %s", action, resp.Status)
+	}
+
+	if out == nil {
+		return nil
+	}
+
+	// The response arguments are the children of the one element in the body
+	var envelope struct {
+		Body struct {
+			Response struct {
+				Inner []byte `xml:",innerxml"`
+			} `xml:",any"`
+		}
+	}
+	if err := xml.Unmarshal(b, &envelope); err != nil {
+		return fmt.Errorf("invalid upnp %s response: %w", action, err)
+	}
+
+	return xml.Unmarshal(append(append([]byte("<r>"), envelope.Body.Response.Inner...), "</r>"...), out)
+}
+
+type upnpRoot struct {
+	URLBase string     `xml:"URLBase"`
+	Device  upnpDevice `xml:"device"`
+}
+
+type upnpDevice struct {
+	Services []upnpService `xml:"serviceList>service"`
+	Devices  []upnpDevice  `xml:"deviceList>device"`
+}
+
+type upnpService struct {
+	ServiceType string `xml:"serviceType"`
+	ControlURL  string `xml:"controlURL"`
+}
+
+// services returns every service of the device and its embedded devices
+func (d upnpDevice) services() []upnpService {
+	s := d.Services
+	for _, child := range d.Devices {
+		s = append(s, child.services()...)
+	}
+	return s
+}
+
+// ssdpSearch multicasts a search for an internet gateway device and returns the location of the first to answer
+func ssdpSearch(ctx context.Context) (string, error) {
+	conn, err := net.ListenUDP("udp4", nil)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	dst, err := net.ResolveUDPAddr("udp4", ssdpAddr)
+	if err != nil {
+		return "", err
+	}
+
+	req := "M-SEARCH * HTTP/1.1\r\n" +
+		"HOST: " + ssdpAddr + "\r\n" +
+		"MAN: \"ssdp:discover\"\r\n" +
+		"MX: " + strconv.Itoa(int(ssdpWait/time.Second)) + "\r\n" +
+		"ST: " + ssdpSearchFor + "\r\n\r\n"
+	if _, err := conn.WriteTo([]byte(req), dst); err != nil {
+		return "", err
+	}
+
+	deadline := time.Now().Add(ssdpWait)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	_ = conn.SetReadDeadline(deadline)
+
+	b := make([]byte, 2048)
+	for {
+		n, _, err := conn.ReadFrom(b)
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				return "", errors.New("no upnp gateway answered")
+			}
+			return "", err
+		}
+
+		resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(b[:n])), nil)
+		if err != nil {
+			continue
+		}
+		resp.Body.Close()
+
+		if location := resp.Header.Get("Location"); resp.StatusCode == http.StatusOK && location != "" {
+			return location, nil
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package portmap
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testUPnPDescription = `<?xml version="1.0"?>
+<root xmlns="urn:schemas-upnp-org:device-1-0">
+  <device>
+    <deviceType>urn:schemas-upnp-org:device:InternetGatewayDevice:1</deviceType>
+    <deviceList>
+      <device>
+        <deviceType>urn:schemas-upnp-org:device:WANDevice:1</deviceType>
+        <deviceList>
+          <device>
+            <deviceType>urn:schemas-upnp-org:device:WANConnectionDevice:1</deviceType>
+            <serviceList>
+              <service>
+                <serviceType>urn:schemas-upnp-org:service:WANIPConnection:1</serviceType>
+                <controlURL>/ctl/IPConn</controlURL>
+              </service>
+            </serviceList>
+          </device>
+        </deviceList>
+      </device>
+    </deviceList>
+  </device>
+</root>`
+
+// fakeUPnP serves a gateway that only takes permanent mappings when permanentOnly is set, actions are recorded
+func fakeUPnP(t *testing.T, permanentOnly bool) (*httptest.Server, *[]string) {
+	var actions []string
+	mux := http.NewServeMux()
+	mux.HandleFunc("/desc.xml", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, testUPnPDescription)
+	})
+	mux.HandleFunc("/ctl/IPConn", func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		action := strings.TrimSuffix(strings.SplitN(r.Header.Get("SOAPAction"), "#", 2)[1], `"`)
+		actions = append(actions, action)
+
+		var inner string
+		switch {
+		case action == "GetExternalIPAddress":
+			inner = "<NewExternalIPAddress>203.0.113.1</NewExternalIPAddress>"
+		case action == "AddPortMapping" && permanentOnly && !strings.Contains(string(b), "<NewLeaseDuration>0<"):
+			w.WriteHeader(http.StatusInternalServerError)
+			_, _ = io.WriteString(w, `<?xml version="1.0"?><s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/"><s:Body><s:Fault><detail><UPnPError xmlns="urn:schemas-upnp-org:control-1-0"><errorCode>725</errorCode><errorDescription>OnlyPermanentLeasesSupported</errorDescription></UPnPError></detail></s:Fault></s:Body></s:Envelope>`)
+			return
+		}
+
+		fmt.Fprintf(w, `<?xml version="1.0"?><s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/"><s:Body><u:%sResponse xmlns:u="urn:schemas-upnp-org:service:WANIPConnection:1">%s</u:%sResponse></s:Body></s:Envelope>`, action, inner, action)
+	})
+
+	s := httptest.NewServer(mux)
+	t.Cleanup(s.Close)
+	return s, &actions
+}
+
+func TestUPnP_Map(t *testing.T) {
+	s, actions := fakeUPnP(t, false)
+
+	u, err := NewUPnP(context.Background(), s.URL+"/desc.xml")
+	require.NoError(t, err)
+	assert.Equal(t, s.URL+"/ctl/IPConn", u.controlURL)
+	assert.Equal(t, "127.0.0.1", u.internalClient)
+
+	m, err := u.Map(context.Background(), 4242, time.Hour)
+	require.NoError(t, err)
+	assert.Equal(t, netip.MustParseAddrPort("203.0.113.1:4242"), m.External)
+	assert.Equal(t, time.Hour, m.Lifetime)
+
+	require.NoError(t, u.Unmap(context.Background(), 4242))
+	assert.Equal(t, []string{"GetExternalIPAddress", "AddPortMapping", "DeletePortMapping"}, *actions)
+}
+
+func TestUPnP_permanentOnly(t *testing.T) {
+	s, actions := fakeUPnP(t, true)
+
+	u, err := NewUPnP(context.Background(), s.URL+"/desc.xml")
+	require.NoError(t, err)
+
+	m, err := u.Map(context.Background(), 4242, time.Hour)
+	require.NoError(t, err)
+	assert.Zero(t, m.Lifetime)
+	assert.Equal(t, []string{"GetExternalIPAddress", "AddPortMapping", "AddPortMapping"}, *actions)
+
+	// The gateway is not asked for a lease again
+	_, err = u.Map(context.Background(), 4242, time.Hour)
+	require.NoError(t, err)
+	assert.Len(t, *actions, 5)
+}
+
+func TestUPnP_noService(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, `<root><device><serviceList></serviceList></device></root>`)
+	}))
+	defer s.Close()
+
+	_, err := NewUPnP(context.Background(), s.URL)
+	assert.EqualError(t, err, "gateway does not offer a port mapping service")
+}
@@ -0,0 +1,144 @@
+package nebula
+
+import (
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/slackhq/nebula/cert"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/iputil"
+)
+
+// preferred_ranges applies to every remote host. preferred_ranges_for adds ranges for some of them, keyed by the groups
+// in their certificate or a cidr their vpn ip is in, so a path such as a backbone network is only preferred for the
+// hosts that can be reached over it. A rule with both groups and cidr requires both to match.
+//
+// Groups are only known once we have the hosts certificate, so a group rule does not apply to the first handshake with
+// a host but does to roaming and path promotion once the tunnel is up. A cidr rule applies from the first handshake.
+
+type preferredRangesRule struct {
+	// groups must all be in the remote certificate
+	groups []string
+	// cidr must contain the remote vpn ip
+	cidr   *net.IPNet
+	ranges []*net.IPNet
+}
+
+func (r preferredRangesRule) matches(vpnIp iputil.VpnIp, c *cert.NebulaCertificate) bool {
+	if r.cidr != nil && !r.cidr.Contains(vpnIp.ToIP()) {
+		return false
+	}
+
+	if len(r.groups) > 0 {
+		if c == nil {
+			return false
+		}
+
+		for _, g := range r.groups {
+			if _, ok := c.Details.InvertedGroups[g]; !ok {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+func newPreferredRangesRulesFromConfig(c *config.C) ([]preferredRangesRule, error) {
+	raw := c.Get("preferred_ranges_for")
+	if raw == nil {
+		return nil, nil
+	}
+
+	rs, ok := raw.([]interface{})
+	if !ok {
+		return nil, errors.New("preferred_ranges_for must be a list of rules")
+	}
+
+	rules := make([]preferredRangesRule, len(rs))
+	for i, v := range rs {
+		m, ok := v.(map[interface{}]interface{})
+		if !ok {
+			return nil, fmt.Errorf("preferred_ranges_for rule #%d must be a map", i)
+		}
+
+		r := &rules[i]
+		r.groups = toStringSlice(m["groups"])
+
+		if rawCidr, ok := m["cidr"]; ok && rawCidr != nil {
+			_, cidr, err := net.ParseCIDR(fmt.Sprintf("%v", rawCidr))
+			if err != nil {
+				return nil, fmt.Errorf("preferred_ranges_for rule #%d has an invalid cidr: %w", i, err)
+			}
+			r.cidr = cidr
+		}
+
+		if len(r.groups) == 0 && r.cidr == nil {
+			return nil, fmt.Errorf("preferred_ranges_for rule #%d needs groups or a cidr to match", i)
+		}
+
+		for _, rawRange := range toStringSlice(m["ranges"]) {
+			_, preferredRange, err := net.ParseCIDR(rawRange)
+			if err != nil {
+				return nil, fmt.Errorf("preferred_ranges_for rule #%d has an invalid range: %w", i, err)
+			}
+			r.ranges = append(r.ranges, preferredRange)
+		}
+
+		if len(r.ranges) == 0 {
+			return nil, fmt.Errorf("preferred_ranges_for rule #%d must have ranges", i)
+		}
+	}
+
+	return rules, nil
+}
+
+func (hm *HostMap) reloadPreferredRangesFor(c *config.C, initial bool) {
+	if !initial && !c.HasChanged("preferred_ranges_for") {
+		return
+	}
+
+	rules, err := newPreferredRangesRulesFromConfig(c)
+	if err != nil {
+		hm.l.WithError(err).Error("Failed to load preferred_ranges_for, keeping the previous rules")
+		return
+	}
+
+	hm.preferredRangesFor.Store(&rules)
+	if !initial {
+		hm.l.WithField("rules", len(rules)).Info("preferred_ranges_for changed")
+	}
+}
+
+// GetPreferredRangesFor returns preferred_ranges and the ranges of every preferred_ranges_for rule that matches the host
+func (hm *HostMap) GetPreferredRangesFor(h *HostInfo) []*net.IPNet {
+	return hm.getPreferredRangesFor(h.vpnIp, h.GetCert())
+}
+
+// getPreferredRangesFor is GetPreferredRangesFor for a host we may not have a tunnel with, c may be nil when we do not
+// have its certificate
+func (hm *HostMap) getPreferredRangesFor(vpnIp iputil.VpnIp, c *cert.NebulaCertificate) []*net.IPNet {
+	preferredRanges := hm.GetPreferredRanges()
+
+	rules := hm.preferredRangesFor.Load()
+	if rules == nil {
+		return preferredRanges
+	}
+
+	matched := false
+	for _, r := range *rules {
+		if !r.matches(vpnIp, c) {
+			continue
+		}
+
+		if !matched {
+			// Copy before appending, preferredRanges is shared
+			preferredRanges = append([]*net.IPNet{}, preferredRanges...)
+			matched = true
+		}
+		preferredRanges = append(preferredRanges, r.ranges...)
+	}
+
+	return preferredRanges
+}
@@ -0,0 +1,89 @@
+package nebula
+
+import (
+	"net"
+	"testing"
+
+	"github.com/slackhq/nebula/cert"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/iputil"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewPreferredRangesRulesFromConfig(t *testing.T) {
+	l := test.NewLogger()
+	c := config.NewC(l)
+
+	rules, err := newPreferredRangesRulesFromConfig(c)
+	require.NoError(t, err)
+	assert.Nil(t, rules)
+
+	require.NoError(t, c.LoadString("preferred_ranges_for: [{groups: [dc:west, backbone], cidr: 10.128.0.0/16, ranges: [10.20.0.0/16]}]"))
+	rules, err = newPreferredRangesRulesFromConfig(c)
+	require.NoError(t, err)
+	require.Len(t, rules, 1)
+	assert.Equal(t, []string{"dc:west", "backbone"}, rules[0].groups)
+	assert.Equal(t, "10.128.0.0/16", rules[0].cidr.String())
+	assert.Equal(t, "10.20.0.0/16", rules[0].ranges[0].String())
+
+	for raw, expected := range map[string]string{
+		"preferred_ranges_for: {groups: [a]}":                "preferred_ranges_for must be a list of rules",
+		"preferred_ranges_for: [a]":                          "preferred_ranges_for rule #0 must be a map",
+		"preferred_ranges_for: [{ranges: [10.20.0.0/16]}]":   "preferred_ranges_for rule #0 needs groups or a cidr to match",
+		"preferred_ranges_for: [{groups: [a]}]":              "preferred_ranges_for rule #0 must have ranges",
+		"preferred_ranges_for: [{cidr: nope, ranges: [a]}]":  "preferred_ranges_for rule #0 has an invalid cidr: invalid CIDR address: nope",
+		"preferred_ranges_for: [{groups: [a], ranges: [b]}]": "preferred_ranges_for rule #0 has an invalid range: invalid CIDR address: b",
+	} {
+		c := config.NewC(l)
+		require.NoError(t, c.LoadString(raw))
+		_, err := newPreferredRangesRulesFromConfig(c)
+		assert.EqualError(t, err, expected, raw)
+	}
+}
+
+func TestHostMap_GetPreferredRangesFor(t *testing.T) {
+	l := test.NewLogger()
+	c := config.NewC(l)
+	require.NoError(t, c.LoadString(`
+preferred_ranges: [192.168.0.0/24]
+preferred_ranges_for:
+  - groups: [dc:west]
+    ranges: [10.20.0.0/16]
+  - cidr: 10.0.1.0/24
+    ranges: [172.16.0.0/12]
+`))
+	hm := NewHostMapFromConfig(l, &net.IPNet{IP: net.IP{10, 0, 0, 1}, Mask: net.IPMask{255, 255, 0, 0}}, c)
+
+	toS := func(ipn []*net.IPNet) []string {
+		var s []string
+		for _, n := range ipn {
+			s = append(s, n.String())
+		}
+		return s
+	}
+
+	west := &cert.NebulaCertificate{Details: cert.NebulaCertificateDetails{InvertedGroups: map[string]struct{}{"dc:west": {}}}}
+	east := &cert.NebulaCertificate{Details: cert.NebulaCertificateDetails{InvertedGroups: map[string]struct{}{"dc:east": {}}}}
+	inCidr := iputil.Ip2VpnIp(net.IP{10, 0, 1, 5})
+	outCidr := iputil.Ip2VpnIp(net.IP{10, 0, 2, 5})
+
+	assert.Equal(t, []string{"192.168.0.0/24"}, toS(hm.getPreferredRangesFor(outCidr, east)))
+	assert.Equal(t, []string{"192.168.0.0/24", "10.20.0.0/16"}, toS(hm.getPreferredRangesFor(outCidr, west)))
+	assert.Equal(t, []string{"192.168.0.0/24", "10.20.0.0/16", "172.16.0.0/12"}, toS(hm.getPreferredRangesFor(inCidr, west)))
+
+	// Without a certificate only the cidr rules can match
+	assert.Equal(t, []string{"192.168.0.0/24", "172.16.0.0/12"}, toS(hm.getPreferredRangesFor(inCidr, nil)))
+	assert.Equal(t, []string{"192.168.0.0/24", "172.16.0.0/12"}, toS(hm.GetPreferredRangesFor(&HostInfo{vpnIp: inCidr})))
+
+	// The global ranges are not modified
+	assert.Equal(t, []string{"192.168.0.0/24"}, toS(hm.GetPreferredRanges()))
+
+	// A bad reload keeps the previous rules
+	c.ReloadConfigString("preferred_ranges: [192.168.0.0/24]\npreferred_ranges_for: [{groups: [a]}]")
+	assert.Equal(t, []string{"192.168.0.0/24", "10.20.0.0/16"}, toS(hm.getPreferredRangesFor(outCidr, west)))
+
+	c.ReloadConfigString("preferred_ranges: [192.168.0.0/24]")
+	assert.Equal(t, []string{"192.168.0.0/24"}, toS(hm.getPreferredRangesFor(inCidr, west)))
+}
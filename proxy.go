@@ -0,0 +1,435 @@
+package nebula
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/udp"
+)
+
+// Some networks only let traffic out through a proxy. With proxy.url set every udp packet we send goes through a socks5
+// proxy's udp relay (rfc 1928 udp associate) and what the relay sends back is handled as if it arrived on our socket.
+// tcp_transport streams are dialed through the proxy as well, with socks5 connect or http connect. An http proxy can not
+// relay udp so it is only used for tcp_transport, which has to be configured to fall back to.
+
+const (
+	proxyDialTimeout = 10 * time.Second
+	// proxyRetryInterval is how long to wait before associating again after the udp relay went away
+	proxyRetryInterval = 5 * time.Second
+
+	socksVersion      = 0x05
+	socksAuthNone     = 0x00
+	socksAuthPassword = 0x02
+	socksCmdConnect   = 0x01
+	socksCmdAssociate = 0x03
+	socksAtypIPv4     = 0x01
+	socksAtypDomain   = 0x03
+	socksAtypIPv6     = 0x04
+	// socksUDPHeaderMax is the largest header the relay puts in front of a datagram with an ip address
+	socksUDPHeaderMax = 4 + 16 + 2
+)
+
+var errProxyRelayDown = errors.New("proxy udp relay is not associated")
+
+type underlayProxy struct {
+	l *logrus.Logger
+	f *Interface
+
+	url   *url.URL
+	socks bool
+	// udp sends udp packets through the relay of a socks5 proxy
+	udp bool
+
+	assoc atomic.Pointer[socksAssociation]
+}
+
+// socksAssociation is a udp relay granted by a socks5 proxy, it lasts as long as ctrl stays open
+type socksAssociation struct {
+	ctrl  net.Conn
+	conn  *net.UDPConn
+	relay netip.AddrPort
+}
+
+func (a *socksAssociation) close() {
+	a.ctrl.Close()
+	a.conn.Close()
+}
+
+func newUnderlayProxyFromConfig(l *logrus.Logger, c *config.C) (*underlayProxy, error) {
+	raw := c.GetString("proxy.url", "")
+	if raw == "" {
+		return nil, nil
+	}
+
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, fmt.Errorf("proxy.url did not parse; %s", err)
+	}
+	if u.Port() == "" {
+		return nil, fmt.Errorf("proxy.url must have a port: %s", u.Redacted())
+	}
+
+	p := &underlayProxy{l: l, url: u}
+	switch u.Scheme {
+	case "socks5":
+		p.socks = true
+		p.udp = c.GetBool("proxy.udp", true)
+	case "http":
+		if c.GetBool("proxy.udp", false) {
+			return nil, errors.New("proxy.udp needs a socks5 proxy, an http proxy can not relay udp")
+		}
+	default:
+		return nil, fmt.Errorf("proxy.url scheme must be socks5 or http: %s", u.Scheme)
+	}
+
+	if !p.udp && c.GetInt("tcp_transport.fallback_after", 0) == 0 {
+		return nil, errors.New("only tcp_transport streams go through the proxy without proxy.udp, tcp_transport.fallback_after must be set")
+	}
+
+	return p, nil
+}
+
+// Start associates with the udp relay and keeps doing so whenever it goes away until ctx is done. The first association
+// is made before returning so the first handshakes have somewhere to go.
+func (p *underlayProxy) Start(ctx context.Context) {
+	if !p.udp {
+		return
+	}
+
+	a, err := p.associate(ctx)
+	go func() {
+		for {
+			if err != nil {
+				p.l.WithError(err).WithField("proxy", p.url.Redacted()).Error("Failed to associate with the proxy udp relay")
+			} else {
+				p.l.WithField("proxy", p.url.Redacted()).WithField("relay", a.relay).Info("Sending udp through the proxy relay")
+				p.assoc.Store(a)
+				p.serve(ctx, a)
+				p.assoc.CompareAndSwap(a, nil)
+				a.close()
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(proxyRetryInterval):
+			}
+			a, err = p.associate(ctx)
+		}
+	}()
+}
+
+// associate asks the proxy for a udp relay
+func (p *underlayProxy) associate(ctx context.Context) (*socksAssociation, error) {
+	ctrl, err := p.dialProxy(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	ctrl.SetDeadline(time.Now().Add(proxyDialTimeout))
+	relay, err := p.socksRequest(ctrl, socksCmdAssociate, netip.AddrPortFrom(netip.IPv4Unspecified(), 0))
+	if err != nil {
+		ctrl.Close()
+		return nil, err
+	}
+	ctrl.SetDeadline(time.Time{})
+
+	// A relay on the unspecified address is on the proxy itself
+	if relay.Addr().IsUnspecified() {
+		relay = netip.AddrPortFrom(ctrl.RemoteAddr().(*net.TCPAddr).AddrPort().Addr().Unmap(), relay.Port())
+	}
+
+	conn, err := net.DialUDP("udp", nil, net.UDPAddrFromAddrPort(relay))
+	if err != nil {
+		ctrl.Close()
+		return nil, err
+	}
+
+	return &socksAssociation{ctrl: ctrl, conn: conn, relay: relay}, nil
+}
+
+// serve handles what the relay sends us until the association ends
+func (p *underlayProxy) serve(ctx context.Context, a *socksAssociation) {
+	// The association lasts as long as the control connection, the proxy sends nothing on it
+	go func() {
+		io.Copy(io.Discard, a.ctrl)
+		a.conn.Close()
+	}()
+	stop := context.AfterFunc(ctx, a.close)
+	defer stop()
+
+	r := newUnderlayReader(p.f, netip.AddrPortFrom(netip.IPv4Unspecified(), 0))
+	buf := make([]byte, mtu+socksUDPHeaderMax)
+	for {
+		n, err := a.conn.Read(buf)
+		if err != nil {
+			if ctx.Err() == nil {
+				p.l.WithError(err).WithField("relay", a.relay).Info("Proxy udp relay went away")
+			}
+			return
+		}
+
+		from, packet, err := unmarshalSocksUDP(buf[:n])
+		if err != nil {
+			p.l.WithError(err).WithField("relay", a.relay).Debug("Dropping invalid datagram from the proxy udp relay")
+			continue
+		}
+
+		r.addr.IP = from.Addr().AsSlice()
+		r.addr.Port = from.Port()
+		r.handle(packet)
+	}
+}
+
+// writeTo sends b to addr through the relay
+func (p *underlayProxy) writeTo(b []byte, addr *udp.Addr) error {
+	a := p.assoc.Load()
+	if a == nil {
+		return errProxyRelayDown
+	}
+
+	ip, ok := netip.AddrFromSlice(addr.IP)
+	if !ok {
+		return fmt.Errorf("invalid address: %v", addr)
+	}
+
+	buf := getPacketBuffer()
+	*buf = marshalSocksUDP(*buf, netip.AddrPortFrom(ip.Unmap(), addr.Port), b)
+	_, err := a.conn.Write(*buf)
+	putPacketBuffer(buf)
+	return err
+}
+
+// dial connects to ap through the proxy
+func (p *underlayProxy) dial(ctx context.Context, ap netip.AddrPort) (net.Conn, error) {
+	conn, err := p.dialProxy(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	conn.SetDeadline(time.Now().Add(proxyDialTimeout))
+	if p.socks {
+		_, err = p.socksRequest(conn, socksCmdConnect, ap)
+	} else {
+		conn, err = p.httpConnect(conn, ap)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+func (p *underlayProxy) dialProxy(ctx context.Context) (net.Conn, error) {
+	d := net.Dialer{Timeout: proxyDialTimeout}
+	return d.DialContext(ctx, "tcp", p.url.Host)
+}
+
+// socksRequest authenticates with the proxy and makes a request, returning the address the proxy bound for it
+func (p *underlayProxy) socksRequest(conn net.Conn, cmd byte, ap netip.AddrPort) (netip.AddrPort, error) {
+	method := byte(socksAuthNone)
+	if p.url.User != nil {
+		method = socksAuthPassword
+	}
+
+	if _, err := conn.Write([]byte{socksVersion, 1, method}); err != nil {
+		return netip.AddrPort{}, err
+	}
+
+	var reply [2]byte
+	if _, err := io.ReadFull(conn, reply[:]); err != nil {
+		return netip.AddrPort{}, err
+	}
+	if reply[0] != socksVersion || reply[1] != method {
+		return netip.AddrPort{}, errors.New("socks5 proxy refused our authentication method")
+	}
+
+	if method == socksAuthPassword {
+		user := p.url.User.Username()
+		pass, _ := p.url.User.Password()
+		if len(user) > 255 || len(pass) > 255 {
+			return netip.AddrPort{}, errors.New("socks5 username and password can be at most 255 bytes")
+		}
+
+		req := []byte{0x01, byte(len(user))}
+		req = append(req, user...)
+		req = append(req, byte(len(pass)))
+		req = append(req, pass...)
+		if _, err := conn.Write(req); err != nil {
+			return netip.AddrPort{}, err
+		}
+		if _, err := io.ReadFull(conn, reply[:]); err != nil {
+			return netip.AddrPort{}, err
+		}
+		if reply[1] != 0 {
+			return netip.AddrPort{}, errors.New("socks5 proxy refused our username and password")
+		}
+	}
+
+	req := appendSocksAddr([]byte{socksVersion, cmd, 0}, ap)
+	if _, err := conn.Write(req); err != nil {
+		return netip.AddrPort{}, err
+	}
+
+	var hdr [3]byte
+	if _, err := io.ReadFull(conn, hdr[:]); err != nil {
+		return netip.AddrPort{}, err
+	}
+	if hdr[0] != socksVersion {
+		return netip.AddrPort{}, errors.New("not a socks5 proxy")
+	}
+	if hdr[1] != 0 {
+		return netip.AddrPort{}, fmt.Errorf("socks5 proxy refused the request: code %d", hdr[1])
+	}
+
+	return readSocksAddr(conn)
+}
+
+// httpConnect asks an http proxy to connect us to ap
+func (p *underlayProxy) httpConnect(conn net.Conn, ap netip.AddrPort) (net.Conn, error) {
+	req := fmt.Sprintf("CONNECT %s HTTP/1.1\r\nHost: %s\r\n", ap, ap)
+	if p.url.User != nil {
+		pass, _ := p.url.User.Password()
+		creds := base64.StdEncoding.EncodeToString([]byte(p.url.User.Username() + ":" + pass))
+		req += "Proxy-Authorization: Basic " + creds + "\r\n"
+	}
+	if _, err := io.WriteString(conn, req+"\r\n"); err != nil {
+		return conn, err
+	}
+
+	r := bufio.NewReader(conn)
+	res, err := http.ReadResponse(r, &http.Request{Method: http.MethodConnect})
+	if err != nil {
+		return conn, err
+	}
+	if res.StatusCode != http.StatusOK {
+		return conn, fmt.Errorf("http proxy refused to connect: %s", res.Status)
+	}
+
+	if r.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, r: r}, nil
+	}
+	return conn, nil
+}
+
+func appendSocksAddr(b []byte, ap netip.AddrPort) []byte {
+	if ap.Addr().Is4() {
+		b = append(b, socksAtypIPv4)
+	} else {
+		b = append(b, socksAtypIPv6)
+	}
+	b = append(b, ap.Addr().AsSlice()...)
+	return binary.BigEndian.AppendUint16(b, ap.Port())
+}
+
+func readSocksAddr(r io.Reader) (netip.AddrPort, error) {
+	var atyp [1]byte
+	if _, err := io.ReadFull(r, atyp[:]); err != nil {
+		return netip.AddrPort{}, err
+	}
+
+	var ip []byte
+	switch atyp[0] {
+	case socksAtypIPv4:
+		ip = make([]byte, 4)
+	case socksAtypIPv6:
+		ip = make([]byte, 16)
+	case socksAtypDomain:
+		// We only ever ask for addresses, the bound name is not of use to us
+		var n [1]byte
+		if _, err := io.ReadFull(r, n[:]); err != nil {
+			return netip.AddrPort{}, err
+		}
+		name := make([]byte, int(n[0])+2)
+		if _, err := io.ReadFull(r, name); err != nil {
+			return netip.AddrPort{}, err
+		}
+		return netip.AddrPort{}, errors.New("socks5 proxy answered with a name instead of an address")
+	default:
+		return netip.AddrPort{}, fmt.Errorf("unknown socks5 address type %d", atyp[0])
+	}
+
+	var port [2]byte
+	if _, err := io.ReadFull(r, ip); err != nil {
+		return netip.AddrPort{}, err
+	}
+	if _, err := io.ReadFull(r, port[:]); err != nil {
+		return netip.AddrPort{}, err
+	}
+
+	addr, _ := netip.AddrFromSlice(ip)
+	return netip.AddrPortFrom(addr.Unmap(), binary.BigEndian.Uint16(port[:])), nil
+}
+
+// marshalSocksUDP appends the relay header for a datagram to ap and the datagram to b
+func marshalSocksUDP(b []byte, ap netip.AddrPort, packet []byte) []byte {
+	b = appendSocksAddr(append(b, 0, 0, 0), ap)
+	return append(b, packet...)
+}
+
+// unmarshalSocksUDP returns who sent a datagram the relay passed on and the datagram
+func unmarshalSocksUDP(b []byte) (netip.AddrPort, []byte, error) {
+	if len(b) < 4 || b[0] != 0 || b[1] != 0 {
+		return netip.AddrPort{}, nil, errors.New("invalid socks5 udp header")
+	}
+	// Fragments are optional for a relay to support and we never send them
+	if b[2] != 0 {
+		return netip.AddrPort{}, nil, errors.New("fragmented socks5 datagram")
+	}
+
+	var n int
+	switch b[3] {
+	case socksAtypIPv4:
+		n = 4
+	case socksAtypIPv6:
+		n = 16
+	default:
+		return netip.AddrPort{}, nil, fmt.Errorf("unknown socks5 address type %d", b[3])
+	}
+	if len(b) < 4+n+2 {
+		return netip.AddrPort{}, nil, errors.New("short socks5 udp header")
+	}
+
+	addr, _ := netip.AddrFromSlice(b[4 : 4+n])
+	port := binary.BigEndian.Uint16(b[4+n:])
+	return netip.AddrPortFrom(addr.Unmap(), port), b[4+n+2:], nil
+}
+
+// wrap returns a udp.Conn that sends everything through the relay
+func (p *underlayProxy) wrap(c udp.Conn) udp.Conn {
+	return &proxyConn{Conn: c, p: p}
+}
+
+type proxyConn struct {
+	udp.Conn
+	p *underlayProxy
+}
+
+func (c *proxyConn) WriteTo(b []byte, addr *udp.Addr) error {
+	return c.p.writeTo(b, addr)
+}
+
+// WriteBatch sends every packet through the relay, the relay marks what it forwards so tos is not used
+func (c *proxyConn) WriteBatch(bufs [][]byte, addrs []*udp.Addr, _ []byte) error {
+	for i := range bufs {
+		if err := c.p.writeTo(bufs[i], addrs[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
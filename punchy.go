@@ -29,7 +29,8 @@ func NewPunchyFromConfig(l *logrus.Logger, c *config.C) *Punchy {
 }
 
 func (p *Punchy) reload(c *config.C, initial bool) {
-	if initial {
+	//NOTE: the connection manager checks this before every punch so a change applies on its next pass
+	if initial || c.HasChanged("punchy.punch") || c.HasChanged("punchy") {
 		var yes bool
 		if c.IsSet("punchy.punch") {
 			yes = c.GetBool("punchy.punch", false)
@@ -39,15 +40,15 @@ func (p *Punchy) reload(c *config.C, initial bool) {
 		}
 
 		p.punch.Store(yes)
-		if yes {
-			p.l.Info("punchy enabled")
+		if initial {
+			if yes {
+				p.l.Info("punchy enabled")
+			} else {
+				p.l.Info("punchy disabled")
+			}
 		} else {
-			p.l.Info("punchy disabled")
+			p.l.Infof("punchy.punch changed to %v", p.GetPunch())
 		}
-
-	} else if c.HasChanged("punchy.punch") || c.HasChanged("punchy") {
-		//TODO: it should be relatively easy to support this, just need to be able to cancel the goroutine and boot it up from here
-		p.l.Warn("Changing punchy.punch with reload is not supported, ignoring.")
 	}
 
 	if initial || c.HasChanged("punchy.respond") || c.HasChanged("punch_back") {
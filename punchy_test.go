@@ -64,14 +64,17 @@ punchy:
 	p := NewPunchyFromConfig(l, c)
 	assert.Equal(t, delay, p.GetDelay())
 	assert.Equal(t, false, p.GetRespond())
+	assert.Equal(t, false, p.GetPunch())
 
 	newDelay, _ := time.ParseDuration("10m")
 	assert.NoError(t, c.ReloadConfigString(`
 punchy:
+  punch: true
   delay: 10m
   respond: true
 `))
 	p.reload(c, false)
 	assert.Equal(t, newDelay, p.GetDelay())
 	assert.Equal(t, true, p.GetRespond())
+	assert.Equal(t, true, p.GetPunch())
 }
@@ -0,0 +1,394 @@
+package nebula
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/sirupsen/logrus"
+	"github.com/slackhq/nebula/cidr"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/iputil"
+	"github.com/slackhq/nebula/udp"
+)
+
+// Some networks throttle or drop udp unless it is quic. quic_transport carries nebula packets as quic datagrams
+// (rfc 9221) instead, to every peer in peers from the first handshake attempt or to any peer whose handshakes over udp
+// go unanswered. quic keeps the connection through address changes of either side and finds the path mtu on its own,
+// the few packets that do not fit a datagram on the path go over a stream. Connections are underlay links, see
+// underlay.go.
+
+const (
+	defaultQUICTransportRemotePort = 443
+	defaultQUICTransportALPN       = "h3"
+	quicTransportDialTimeout       = 5 * time.Second
+	// quicTransportIdleTimeout closes connections nothing was read from for this long
+	quicTransportIdleTimeout = 5 * time.Minute
+	quicTransportKeepAlive   = 15 * time.Second
+	// quicLinkQueue is how many packets may wait to be sent over a connection before more are dropped
+	quicLinkQueue = 256
+)
+
+type quicTransport struct {
+	l *logrus.Logger
+	f *Interface
+
+	listenHost string
+	listenPort int
+	// fallbackAfter is how many handshake attempts over udp go unanswered before we dial, 0 never falls back
+	fallbackAfter int
+	remotePort    int
+	// peers are reached over quic only, nil if there are none
+	peers      *cidr.Tree6[struct{}]
+	alpn       string
+	serverName string
+
+	links *underlayLinks
+	// lock serializes changes to dialing and guards transport
+	lock      sync.Mutex
+	dialing   map[netip.AddrPort]struct{}
+	ctx       context.Context
+	transport *quic.Transport
+
+	tlsConfig *tls.Config
+}
+
+func newQUICTransportFromConfig(l *logrus.Logger, c *config.C, links *underlayLinks) (*quicTransport, error) {
+	t := &quicTransport{
+		l:             l,
+		links:         links,
+		listenHost:    c.GetString("listen.host", "0.0.0.0"),
+		listenPort:    c.GetInt("quic_transport.listen_port", 0),
+		fallbackAfter: c.GetInt("quic_transport.fallback_after", 0),
+		remotePort:    c.GetInt("quic_transport.remote_port", defaultQUICTransportRemotePort),
+		alpn:          c.GetString("quic_transport.alpn", defaultQUICTransportALPN),
+		serverName:    c.GetString("quic_transport.server_name", ""),
+		dialing:       map[netip.AddrPort]struct{}{},
+	}
+
+	peers := c.GetStringSlice("quic_transport.peers", nil)
+	if t.listenPort == 0 && t.fallbackAfter == 0 && len(peers) == 0 {
+		return nil, nil
+	}
+
+	if t.listenPort < 0 || t.listenPort > 65535 {
+		return nil, fmt.Errorf("quic_transport.listen_port must be a port: %v", t.listenPort)
+	}
+	if t.fallbackAfter < 0 {
+		return nil, fmt.Errorf("quic_transport.fallback_after can not be negative: %v", t.fallbackAfter)
+	}
+	if t.remotePort < 1 || t.remotePort > 65535 {
+		return nil, fmt.Errorf("quic_transport.remote_port must be a port: %v", t.remotePort)
+	}
+	if t.alpn == "" {
+		return nil, errors.New("quic_transport.alpn can not be empty")
+	}
+	if t.listenHost == "[::]" {
+		t.listenHost = "::"
+	}
+
+	if len(peers) > 0 {
+		t.peers = cidr.NewTree6[struct{}]()
+		for _, p := range peers {
+			_, n, err := net.ParseCIDR(p)
+			if err != nil {
+				return nil, fmt.Errorf("quic_transport.peers entry %v did not parse; %s", p, err)
+			}
+			t.peers.AddCIDR(n, struct{}{})
+		}
+	}
+
+	if t.listenPort > 0 {
+		// The tls layer is what quic requires, the nebula handshake inside of it is what authenticates the peer
+		cfg, err := newSelfSignedTLSConfig()
+		if err != nil {
+			return nil, err
+		}
+		cfg.MinVersion = tls.VersionTLS13
+		cfg.NextProtos = []string{t.alpn}
+		t.tlsConfig = cfg
+	}
+
+	return t, nil
+}
+
+func (t *quicTransport) quicConfig() *quic.Config {
+	return &quic.Config{
+		EnableDatagrams:      true,
+		KeepAlivePeriod:      quicTransportKeepAlive,
+		MaxIdleTimeout:       quicTransportIdleTimeout,
+		HandshakeIdleTimeout: quicTransportDialTimeout,
+	}
+}
+
+// Start opens the socket connections are dialed from and accepted on, everything is closed when ctx is done
+func (t *quicTransport) Start(ctx context.Context) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP(t.listenHost), Port: t.listenPort})
+	if err != nil {
+		t.l.WithError(err).WithField("port", t.listenPort).Error("Failed to open the quic_transport socket")
+		return
+	}
+
+	tr := &quic.Transport{Conn: conn}
+	var ln *quic.Listener
+	if t.listenPort > 0 {
+		ln, err = tr.Listen(t.tlsConfig, t.quicConfig())
+		if err != nil {
+			t.l.WithError(err).WithField("port", t.listenPort).Error("Failed to listen for quic_transport connections")
+		} else {
+			t.l.WithField("addr", conn.LocalAddr()).Info("Listening for quic_transport connections")
+			go t.acceptLoop(ctx, ln)
+		}
+	}
+
+	t.lock.Lock()
+	t.ctx = ctx
+	t.transport = tr
+	t.lock.Unlock()
+
+	go func() {
+		<-ctx.Done()
+		if ln != nil {
+			ln.Close()
+		}
+		tr.Close()
+		conn.Close()
+	}()
+}
+
+func (t *quicTransport) acceptLoop(ctx context.Context, ln *quic.Listener) {
+	for {
+		conn, err := ln.Accept(ctx)
+		if err != nil {
+			if ctx.Err() == nil {
+				t.l.WithError(err).Error("Failed to accept quic_transport connection")
+			}
+			return
+		}
+
+		ap := conn.RemoteAddr().(*net.UDPAddr).AddrPort()
+		go t.serve(conn, ap)
+	}
+}
+
+// dial connects to the listener at ap
+func (t *quicTransport) dial(ctx context.Context, tr *quic.Transport, ap netip.AddrPort) (quic.Connection, error) {
+	ctx, cancel := context.WithTimeout(ctx, quicTransportDialTimeout)
+	defer cancel()
+
+	// The nebula handshake authenticates the peer, there is no certificate worth verifying here
+	cfg := &tls.Config{
+		InsecureSkipVerify: true, //nolint:gosec
+		NextProtos:         []string{t.alpn},
+		ServerName:         t.serverName,
+		MinVersion:         tls.VersionTLS13,
+	}
+	return tr.Dial(ctx, net.UDPAddrFromAddrPort(ap), cfg, t.quicConfig())
+}
+
+// handshake sends the handshake packet over a connection to every ip in remotes if vpnIp is one of peers or once
+// fallbackAfter attempts over udp went unanswered, dialing the ones we do not have a connection with yet. Peers are
+// not tried over udp at all.
+func (t *quicTransport) handshake(vpnIp iputil.VpnIp, attempt int, packet []byte, remotes []*udp.Addr) bool {
+	selected := false
+	if t.peers != nil {
+		selected, _ = t.peers.Contains(vpnIp)
+	}
+	if !selected && (t.fallbackAfter == 0 || attempt < t.fallbackAfter) {
+		return false
+	}
+
+	for _, ap := range handshakeAddrs(remotes, uint16(t.remotePort)) {
+		if link := t.links.get(ap); link != nil {
+			link.send(packet)
+			continue
+		}
+
+		t.lock.Lock()
+		ctx, tr := t.ctx, t.transport
+		if _, ok := t.dialing[ap]; ok || tr == nil {
+			t.lock.Unlock()
+			continue
+		}
+		t.dialing[ap] = struct{}{}
+		t.lock.Unlock()
+
+		p := append([]byte(nil), packet...)
+		go func() {
+			conn, err := t.dial(ctx, tr, ap)
+
+			t.lock.Lock()
+			delete(t.dialing, ap)
+			t.lock.Unlock()
+
+			if err != nil {
+				t.l.WithError(err).WithField("remote", ap).Info("Failed to dial quic_transport connection")
+				return
+			}
+
+			t.l.WithField("remote", ap).WithField("peer", selected).Info("Reaching peer over a quic_transport connection")
+			t.serve(conn, ap, p)
+		}()
+	}
+
+	return selected
+}
+
+// serve makes the connection the way to reach ap, sends first and handles what is read from it until it closes
+func (t *quicTransport) serve(conn quic.Connection, ap netip.AddrPort, first ...[]byte) {
+	ap = linkAddr(ap)
+	link := newQUICLink(conn)
+	t.links.add(ap, link)
+	defer t.links.remove(ap, link)
+	defer link.close()
+
+	for _, p := range first {
+		link.send(p)
+	}
+
+	go func() {
+		if err := link.writeLoop(); err != nil {
+			t.l.WithError(err).WithField("remote", ap).Debug("Failed to write to quic_transport connection")
+		}
+		link.close()
+	}()
+
+	go t.acceptStreams(link, ap)
+
+	r := newUnderlayReader(t.f, ap)
+	for {
+		b, err := conn.ReceiveDatagram(conn.Context())
+		if err != nil {
+			t.l.WithError(err).WithField("remote", ap).Debug("quic_transport connection closed")
+			return
+		}
+		r.handle(b)
+	}
+}
+
+// acceptStreams handles the packets the peer could not fit in a datagram
+func (t *quicTransport) acceptStreams(link *quicLink, ap netip.AddrPort) {
+	for {
+		s, err := link.conn.AcceptUniStream(link.conn.Context())
+		if err != nil {
+			return
+		}
+
+		go func() {
+			r := newUnderlayReader(t.f, ap)
+			br := bufio.NewReader(s)
+			buf := make([]byte, mtu)
+			for {
+				packet, err := readQUICStreamPacket(br, buf)
+				if err != nil {
+					if !errors.Is(err, io.EOF) {
+						t.l.WithError(err).WithField("remote", ap).Debug("Failed to read from quic_transport stream")
+					}
+					s.CancelRead(0)
+					return
+				}
+				r.handle(packet)
+			}
+		}()
+	}
+}
+
+// readQUICStreamPacket returns the next packet of a stream read into buf, packets are prefixed with their length as 2
+// big endian bytes
+func readQUICStreamPacket(r io.Reader, buf []byte) ([]byte, error) {
+	var hdr [2]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, err
+	}
+
+	n := int(binary.BigEndian.Uint16(hdr[:]))
+	if n > len(buf) {
+		return nil, errTCPStreamFrame
+	}
+	_, err := io.ReadFull(r, buf[:n])
+	return buf[:n], err
+}
+
+// quicLink sends packets over a connection as datagrams, a packet too large for a datagram on the current path goes
+// over a stream. SendDatagram blocks while quic-go's own queue is full so packets are queued here to be dropped instead.
+type quicLink struct {
+	conn      quic.Connection
+	sendq     chan *[]byte
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newQUICLink(conn quic.Connection) *quicLink {
+	return &quicLink{
+		conn:  conn,
+		sendq: make(chan *[]byte, quicLinkQueue),
+		done:  make(chan struct{}),
+	}
+}
+
+func (q *quicLink) send(b []byte) bool {
+	select {
+	case <-q.done:
+		return false
+	default:
+	}
+
+	p := getPacketBuffer()
+	*p = append(*p, b...)
+
+	select {
+	case q.sendq <- p:
+		return true
+	default:
+	}
+	putPacketBuffer(p)
+	return false
+}
+
+func (q *quicLink) close() {
+	q.closeOnce.Do(func() {
+		close(q.done)
+		q.conn.CloseWithError(0, "")
+	})
+}
+
+// writeLoop sends queued packets until the link is closed
+func (q *quicLink) writeLoop() error {
+	var stream quic.SendStream
+	var scratch []byte
+	for {
+		select {
+		case p := <-q.sendq:
+			err := q.conn.SendDatagram(*p)
+
+			var tooLarge *quic.DatagramTooLargeError
+			if errors.As(err, &tooLarge) {
+				if stream == nil {
+					stream, err = q.conn.OpenUniStream()
+				}
+				if stream != nil {
+					scratch = binary.BigEndian.AppendUint16(scratch[:0], uint16(len(*p)))
+					scratch = append(scratch, *p...)
+					_, err = stream.Write(scratch)
+				}
+			}
+
+			putPacketBuffer(p)
+			if err != nil {
+				return err
+			}
+
+		case <-q.done:
+			return nil
+		}
+	}
+}
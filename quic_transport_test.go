@@ -0,0 +1,118 @@
+package nebula
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/iputil"
+	"github.com/slackhq/nebula/test"
+	"github.com/slackhq/nebula/udp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewQUICTransportFromConfig(t *testing.T) {
+	l := test.NewLogger()
+	c := config.NewC(l)
+
+	qt, err := newQUICTransportFromConfig(l, c, nil)
+	require.NoError(t, err)
+	assert.Nil(t, qt)
+
+	c.Settings["quic_transport"] = map[interface{}]interface{}{"peers": []interface{}{"10.1.0.0/16"}}
+	qt, err = newQUICTransportFromConfig(l, c, nil)
+	require.NoError(t, err)
+	assert.Equal(t, defaultQUICTransportRemotePort, qt.remotePort)
+	assert.Equal(t, defaultQUICTransportALPN, qt.alpn)
+	assert.Nil(t, qt.tlsConfig)
+
+	c.Settings["quic_transport"] = map[interface{}]interface{}{"listen_port": 4243}
+	qt, err = newQUICTransportFromConfig(l, c, nil)
+	require.NoError(t, err)
+	assert.Equal(t, []string{defaultQUICTransportALPN}, qt.tlsConfig.NextProtos)
+
+	for k, v := range map[string]interface{}{
+		"listen_port":    70000,
+		"fallback_after": -1,
+		"remote_port":    0,
+		"alpn":           "",
+		"peers":          []interface{}{"10.1.0.1"},
+	} {
+		c.Settings["quic_transport"] = map[interface{}]interface{}{"listen_port": 4243, k: v}
+		_, err = newQUICTransportFromConfig(l, c, nil)
+		assert.Error(t, err, k)
+	}
+}
+
+func TestQUICTransport_handshake(t *testing.T) {
+	l := test.NewLogger()
+	c := config.NewC(l)
+	c.Settings["quic_transport"] = map[interface{}]interface{}{"peers": []interface{}{"10.1.0.0/16"}, "fallback_after": 3}
+	qt, err := newQUICTransportFromConfig(l, c, newUnderlayLinks())
+	require.NoError(t, err)
+
+	// Without a link or a started transport nothing is dialed, only whether udp is skipped matters here
+	remotes := []*udp.Addr{udp.NewAddr(net.IP{1, 1, 1, 1}, 4242)}
+	assert.True(t, qt.handshake(iputil.Ip2VpnIp(net.IP{10, 1, 0, 1}), 0, []byte{1}, remotes))
+	assert.False(t, qt.handshake(iputil.Ip2VpnIp(net.IP{10, 2, 0, 1}), 0, []byte{1}, remotes))
+	assert.False(t, qt.handshake(iputil.Ip2VpnIp(net.IP{10, 2, 0, 1}), 3, []byte{1}, remotes))
+
+	// An existing link gets the handshake
+	s := newTCPStream(nil, nil, false, false)
+	qt.links.add(netip.MustParseAddrPort("1.1.1.1:443"), s)
+	qt.handshake(iputil.Ip2VpnIp(net.IP{10, 2, 0, 1}), 3, []byte{1}, remotes)
+	assert.Len(t, s.sendq, 1)
+	qt.handshake(iputil.Ip2VpnIp(net.IP{10, 2, 0, 1}), 2, []byte{1}, remotes)
+	assert.Len(t, s.sendq, 1)
+}
+
+func TestQUICLink(t *testing.T) {
+	l := test.NewLogger()
+	c := config.NewC(l)
+	c.Settings["quic_transport"] = map[interface{}]interface{}{"listen_port": 4243}
+	qt, err := newQUICTransportFromConfig(l, c, nil)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	ln, err := quic.ListenAddr("127.0.0.1:0", qt.tlsConfig, qt.quicConfig())
+	require.NoError(t, err)
+	defer ln.Close()
+
+	cfg := &tls.Config{InsecureSkipVerify: true, NextProtos: []string{qt.alpn}}
+	cc, err := quic.DialAddr(ctx, ln.Addr().String(), cfg, qt.quicConfig())
+	require.NoError(t, err)
+	link := newQUICLink(cc)
+	defer link.close()
+	go link.writeLoop()
+
+	sc, err := ln.Accept(ctx)
+	require.NoError(t, err)
+
+	// Small packets go as datagrams
+	assert.True(t, link.send([]byte{1, 2, 3}))
+	got, err := sc.ReceiveDatagram(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []byte{1, 2, 3}, got)
+
+	// Packets that do not fit a datagram go over a stream
+	big := make([]byte, 3000)
+	big[2999] = 7
+	assert.True(t, link.send(big))
+	s, err := sc.AcceptUniStream(ctx)
+	require.NoError(t, err)
+	got, err = readQUICStreamPacket(bufio.NewReader(s), make([]byte, mtu))
+	require.NoError(t, err)
+	assert.Equal(t, big, got)
+
+	link.close()
+	assert.False(t, link.send([]byte{1}))
+}
@@ -0,0 +1,87 @@
+package nebula
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/slackhq/nebula/config"
+)
+
+// rekeyPolicy decides when an established tunnel should handshake again for fresh keys. The new tunnel replaces the old
+// one as the primary while the old one stays around to decrypt whatever was already in flight, it is torn down by the
+// connection manager once traffic stops arriving on it. A zero value never rekeys.
+type rekeyPolicy struct {
+	interval time.Duration
+	bytes    uint64
+	packets  uint64
+}
+
+func newRekeyPolicyFromConfig(c *config.C) (*rekeyPolicy, error) {
+	p := &rekeyPolicy{interval: c.GetDuration("rekey.interval", 0)}
+	if p.interval < 0 {
+		return nil, fmt.Errorf("rekey.interval must not be negative")
+	}
+
+	bytes := c.GetInt("rekey.bytes", 0)
+	if bytes < 0 {
+		return nil, fmt.Errorf("rekey.bytes must not be negative")
+	}
+	p.bytes = uint64(bytes)
+
+	packets := c.GetInt("rekey.packets", 0)
+	if packets < 0 {
+		return nil, fmt.Errorf("rekey.packets must not be negative")
+	}
+	p.packets = uint64(packets)
+
+	return p, nil
+}
+
+// due returns why the tunnel should be rekeyed or an empty string if it should not. Both sides of a tunnel keep time,
+// the responder waits an extra grace period so the initiator usually rekeys first and the two do not race.
+// Packets and bytes are what we sent with our key, the remote side watches its own.
+func (p *rekeyPolicy) due(ci *ConnectionState, now time.Time, grace time.Duration) string {
+	if p.interval > 0 && !ci.established.IsZero() {
+		deadline := p.interval
+		if !ci.initiator {
+			deadline += grace
+		}
+		if now.Sub(ci.established) >= deadline {
+			return "tunnel is older than rekey.interval"
+		}
+	}
+
+	if p.packets > 0 && ci.messageCounter.Load() >= p.packets {
+		return "tunnel has sent rekey.packets"
+	}
+
+	if p.bytes > 0 && ci.bytesOut.Load() >= p.bytes {
+		return "tunnel has sent rekey.bytes"
+	}
+
+	return ""
+}
+
+func (f *Interface) reloadRekey(c *config.C) {
+	if !c.InitialLoad() && !c.HasChanged("rekey") {
+		return
+	}
+
+	p, err := newRekeyPolicyFromConfig(c)
+	if err != nil {
+		f.l.WithError(err).Error("Failed to load rekey config, keeping the previous one")
+		return
+	}
+
+	old := f.rekey.Swap(p)
+	if old == nil {
+		old = &rekeyPolicy{}
+	}
+
+	// Stay quiet about the default of never rekeying unless it was just turned off
+	if *p != *old || *p != (rekeyPolicy{}) {
+		f.l.WithFields(logrus.Fields{"interval": p.interval, "bytes": p.bytes, "packets": p.packets}).
+			Info("Loaded rekey config")
+	}
+}
@@ -0,0 +1,91 @@
+package nebula
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewRekeyPolicyFromConfig(t *testing.T) {
+	l := test.NewLogger()
+	c := config.NewC(l)
+
+	p, err := newRekeyPolicyFromConfig(c)
+	require.NoError(t, err)
+	assert.Equal(t, &rekeyPolicy{}, p)
+
+	c.Settings["rekey"] = map[interface{}]interface{}{"interval": "1h", "bytes": 1000, "packets": 10}
+	p, err = newRekeyPolicyFromConfig(c)
+	require.NoError(t, err)
+	assert.Equal(t, &rekeyPolicy{interval: time.Hour, bytes: 1000, packets: 10}, p)
+
+	tests := map[string]map[interface{}]interface{}{
+		"rekey.interval must not be negative": {"interval": "-1s"},
+		"rekey.bytes must not be negative":    {"bytes": -1},
+		"rekey.packets must not be negative":  {"packets": -1},
+	}
+	for expected, settings := range tests {
+		c.Settings["rekey"] = settings
+		_, err = newRekeyPolicyFromConfig(c)
+		assert.EqualError(t, err, expected)
+	}
+}
+
+func TestInterface_reloadRekey(t *testing.T) {
+	l := test.NewLogger()
+	ob := &bytes.Buffer{}
+	l.SetOutput(ob)
+	c := config.NewC(l)
+	f := &Interface{l: l}
+
+	// Never rekeying is the default, nothing to say about it
+	f.reloadRekey(c)
+	assert.Equal(t, &rekeyPolicy{}, f.rekey.Load())
+	assert.Empty(t, ob.String())
+
+	require.NoError(t, c.ReloadConfigString("rekey:\n  interval: 1h\n"))
+	f.reloadRekey(c)
+	assert.Equal(t, &rekeyPolicy{interval: time.Hour}, f.rekey.Load())
+	assert.Contains(t, ob.String(), "Loaded rekey config")
+
+	ob.Reset()
+	require.NoError(t, c.ReloadConfigString("rekey:\n  interval: 0s\n"))
+	f.reloadRekey(c)
+	assert.Equal(t, &rekeyPolicy{}, f.rekey.Load())
+	assert.Contains(t, ob.String(), "Loaded rekey config")
+
+	ob.Reset()
+	require.NoError(t, c.ReloadConfigString("rekey:\n  interval: 0m\n"))
+	f.reloadRekey(c)
+	assert.Empty(t, ob.String())
+}
+
+func TestRekeyPolicy_due(t *testing.T) {
+	now := time.Now()
+	ci := &ConnectionState{initiator: true, established: now}
+	ci.messageCounter.Add(2)
+
+	// Nothing is due with the zero policy
+	assert.Empty(t, (&rekeyPolicy{}).due(ci, now.Add(24*time.Hour), 0))
+
+	p := &rekeyPolicy{interval: time.Hour, bytes: 1000, packets: 10}
+	assert.Empty(t, p.due(ci, now, 0))
+	assert.Equal(t, "tunnel is older than rekey.interval", p.due(ci, now.Add(time.Hour), 0))
+
+	// The responder waits out the grace period
+	ci.initiator = false
+	assert.Empty(t, p.due(ci, now.Add(time.Hour), time.Minute))
+	assert.Equal(t, "tunnel is older than rekey.interval", p.due(ci, now.Add(time.Hour+time.Minute), time.Minute))
+
+	ci.messageCounter.Add(8)
+	assert.Equal(t, "tunnel has sent rekey.packets", p.due(ci, now, 0))
+
+	ci = &ConnectionState{established: now}
+	ci.bytesOut.Add(1000)
+	assert.Equal(t, "tunnel has sent rekey.bytes", p.due(ci, now, 0))
+}
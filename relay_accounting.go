@@ -0,0 +1,158 @@
+package nebula
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/iputil"
+)
+
+// A relay forwards whatever its clients send through it. Every forwarded packet is counted against the peer that sent
+// it and the peer it is forwarded to, so the operator of a shared relay can see who is using it. relay.limits can cap
+// what each client may send through the relay per second and what the relay forwards in total, packets over either
+// limit are dropped.
+
+// relayTotalLimitKey is the single bucket of the total limit, it is never a client
+var relayTotalLimitKey = iputil.VpnIp{}
+
+// relayUsage is what a relayed peer has sent through us and had forwarded to it
+type relayUsage struct {
+	inPackets  atomic.Uint64
+	inBytes    atomic.Uint64
+	outPackets atomic.Uint64
+	outBytes   atomic.Uint64
+	// dropped is the packets from the peer dropped by a limit
+	dropped atomic.Uint64
+}
+
+// RelayUsage is the accounting of a relayed peer
+type RelayUsage struct {
+	VpnIp      iputil.VpnIp `json:"vpnIp"`
+	InPackets  uint64       `json:"inPackets"`
+	InBytes    uint64       `json:"inBytes"`
+	OutPackets uint64       `json:"outPackets"`
+	OutBytes   uint64       `json:"outBytes"`
+	Dropped    uint64       `json:"dropped"`
+}
+
+type relayLimits struct {
+	client *firewallRuleLimit
+	total  *firewallRuleLimit
+}
+
+type relayAccounting struct {
+	sync.RWMutex
+	usage map[iputil.VpnIp]*relayUsage
+
+	limits atomic.Pointer[relayLimits]
+
+	droppedClient metrics.Counter
+	droppedTotal  metrics.Counter
+}
+
+func newRelayAccounting() *relayAccounting {
+	ra := &relayAccounting{
+		usage:         map[iputil.VpnIp]*relayUsage{},
+		droppedClient: metrics.GetOrRegisterCounter("relay.dropped.client_limit", nil),
+		droppedTotal:  metrics.GetOrRegisterCounter("relay.dropped.total_limit", nil),
+	}
+	ra.limits.Store(&relayLimits{})
+	return ra
+}
+
+func newRelayLimitsFromConfig(c *config.C) (*relayLimits, error) {
+	client, err := parseFirewallRuleLimit(c.Get("relay.limits.client"))
+	if err != nil {
+		return nil, fmt.Errorf("relay.limits.client: %w", err)
+	}
+
+	total, err := parseFirewallRuleLimit(c.Get("relay.limits.total"))
+	if err != nil {
+		return nil, fmt.Errorf("relay.limits.total: %w", err)
+	}
+
+	return &relayLimits{client: client, total: total}, nil
+}
+
+// peer returns the usage of a relayed peer, creating it if needed
+func (ra *relayAccounting) peer(vpnIp iputil.VpnIp) *relayUsage {
+	ra.RLock()
+	u, ok := ra.usage[vpnIp]
+	ra.RUnlock()
+	if ok {
+		return u
+	}
+
+	ra.Lock()
+	defer ra.Unlock()
+	if u, ok = ra.usage[vpnIp]; !ok {
+		u = &relayUsage{}
+		ra.usage[vpnIp] = u
+	}
+	return u
+}
+
+// forward accounts for a packet of size bytes relayed from one peer to another, it returns false if a limit dropped it
+func (ra *relayAccounting) forward(from, to iputil.VpnIp, size int) bool {
+	in := ra.peer(from)
+	in.inPackets.Add(1)
+	in.inBytes.Add(uint64(size))
+
+	limits := ra.limits.Load()
+	if limits.client != nil || limits.total != nil {
+		now := time.Now()
+		if limits.client != nil && !limits.client.allow(from, size, now) {
+			in.dropped.Add(1)
+			ra.droppedClient.Inc(1)
+			return false
+		}
+		if limits.total != nil && !limits.total.allow(relayTotalLimitKey, size, now) {
+			in.dropped.Add(1)
+			ra.droppedTotal.Inc(1)
+			return false
+		}
+	}
+
+	out := ra.peer(to)
+	out.outPackets.Add(1)
+	out.outBytes.Add(uint64(size))
+	return true
+}
+
+// Usage returns the accounting of every peer that has been relayed, ordered by vpn ip
+func (ra *relayAccounting) Usage() []RelayUsage {
+	ra.RLock()
+	r := make([]RelayUsage, 0, len(ra.usage))
+	for vpnIp, u := range ra.usage {
+		r = append(r, RelayUsage{
+			VpnIp:      vpnIp,
+			InPackets:  u.inPackets.Load(),
+			InBytes:    u.inBytes.Load(),
+			OutPackets: u.outPackets.Load(),
+			OutBytes:   u.outBytes.Load(),
+			Dropped:    u.dropped.Load(),
+		})
+	}
+	ra.RUnlock()
+
+	sort.Slice(r, func(i, j int) bool { return r[i].VpnIp.Compare(r[j].VpnIp) < 0 })
+	return r
+}
+
+// EmitStats reports the accounting of every relayed peer to the stats collection system
+func (ra *relayAccounting) EmitStats() {
+	for _, u := range ra.Usage() {
+		name := "relay.usage." + strings.ReplaceAll(u.VpnIp.String(), ".", "_")
+		metrics.GetOrRegisterGauge(name+".in_packets", nil).Update(int64(u.InPackets))
+		metrics.GetOrRegisterGauge(name+".in_bytes", nil).Update(int64(u.InBytes))
+		metrics.GetOrRegisterGauge(name+".out_packets", nil).Update(int64(u.OutPackets))
+		metrics.GetOrRegisterGauge(name+".out_bytes", nil).Update(int64(u.OutBytes))
+		metrics.GetOrRegisterGauge(name+".dropped", nil).Update(int64(u.Dropped))
+	}
+}
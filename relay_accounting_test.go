@@ -0,0 +1,76 @@
+package nebula
+
+import (
+	"net"
+	"testing"
+
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/iputil"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewRelayLimitsFromConfig(t *testing.T) {
+	l := test.NewLogger()
+	c := config.NewC(l)
+
+	limits, err := newRelayLimitsFromConfig(c)
+	require.NoError(t, err)
+	assert.Nil(t, limits.client)
+	assert.Nil(t, limits.total)
+
+	c.Settings["relay"] = map[interface{}]interface{}{"limits": map[interface{}]interface{}{
+		"client": map[interface{}]interface{}{"packets": 100},
+		"total":  map[interface{}]interface{}{"bytes": 1000000},
+	}}
+	limits, err = newRelayLimitsFromConfig(c)
+	require.NoError(t, err)
+	assert.Equal(t, 100, limits.client.packets)
+	assert.Equal(t, 1000000, limits.total.bytes)
+
+	c.Settings["relay"] = map[interface{}]interface{}{"limits": map[interface{}]interface{}{
+		"client": map[interface{}]interface{}{"frames": 100},
+	}}
+	_, err = newRelayLimitsFromConfig(c)
+	assert.EqualError(t, err, "relay.limits.client: limit frames was not understood, must be packets or bytes")
+}
+
+func TestRelayAccounting_forward(t *testing.T) {
+	a := iputil.Ip2VpnIp(net.IP{10, 0, 0, 1})
+	b := iputil.Ip2VpnIp(net.IP{10, 0, 0, 2})
+	c := iputil.Ip2VpnIp(net.IP{10, 0, 0, 3})
+
+	ra := newRelayAccounting()
+	assert.True(t, ra.forward(a, b, 100))
+	assert.True(t, ra.forward(b, a, 50))
+	assert.True(t, ra.forward(a, b, 100))
+
+	assert.Equal(t, []RelayUsage{
+		{VpnIp: a, InPackets: 2, InBytes: 200, OutPackets: 1, OutBytes: 50},
+		{VpnIp: b, InPackets: 1, InBytes: 50, OutPackets: 2, OutBytes: 200},
+	}, ra.Usage())
+
+	// Each client gets its own bucket
+	client, err := parseFirewallRuleLimit(map[interface{}]interface{}{"packets": 2})
+	require.NoError(t, err)
+	ra = newRelayAccounting()
+	ra.limits.Store(&relayLimits{client: client})
+	assert.True(t, ra.forward(a, b, 100))
+	assert.True(t, ra.forward(a, b, 100))
+	assert.False(t, ra.forward(a, b, 100))
+	assert.True(t, ra.forward(c, b, 100))
+
+	usage := ra.Usage()
+	assert.Equal(t, RelayUsage{VpnIp: a, InPackets: 3, InBytes: 300, Dropped: 1}, usage[0])
+	assert.Equal(t, RelayUsage{VpnIp: b, OutPackets: 3, OutBytes: 300}, usage[1])
+
+	// The total bucket is shared by every client
+	total, err := parseFirewallRuleLimit(map[interface{}]interface{}{"packets": 2})
+	require.NoError(t, err)
+	ra = newRelayAccounting()
+	ra.limits.Store(&relayLimits{total: total})
+	assert.True(t, ra.forward(a, b, 100))
+	assert.True(t, ra.forward(c, b, 100))
+	assert.False(t, ra.forward(b, a, 100))
+}
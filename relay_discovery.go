@@ -0,0 +1,163 @@
+package nebula
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/iputil"
+)
+
+// With relay.discover enabled a host does not need relay.relays, every interval it asks the lighthouses which relays
+// advertised themselves and reports the least loaded max of them in its host updates as relays it can be reached
+// through. Only relays we have a direct tunnel with and whose certificate carries every one of relay.discover.groups
+// are used, we handshake the others so they can be used next time. Full relays are skipped.
+//
+// Discovered relays are reported along with relay.relays, a host that is a relay does not use other relays.
+
+const (
+	defaultRelayDiscoveryInterval = 30 * time.Second
+	defaultRelayDiscoveryMax      = 2
+)
+
+type relayDiscovery struct {
+	l        *logrus.Logger
+	f        *Interface
+	groups   *requiredGroups
+	max      int
+	interval time.Duration
+}
+
+func newRelayDiscoveryFromConfig(l *logrus.Logger, f *Interface, c *config.C) (*relayDiscovery, error) {
+	if !c.GetBool("relay.discover.enabled", false) {
+		return nil, nil
+	}
+
+	if c.GetBool("relay.am_relay", false) {
+		return nil, errors.New("relay.discover can not be used with relay.am_relay")
+	}
+
+	rd := &relayDiscovery{
+		l:        l,
+		f:        f,
+		max:      c.GetInt("relay.discover.max", defaultRelayDiscoveryMax),
+		interval: c.GetDuration("relay.discover.interval", defaultRelayDiscoveryInterval),
+	}
+
+	if rd.max < 1 {
+		return nil, errors.New("relay.discover.max must be at least 1")
+	}
+	if rd.interval <= 0 {
+		return nil, errors.New("relay.discover.interval must be greater than 0")
+	}
+
+	groups := c.GetStringSlice("relay.discover.groups", nil)
+	for _, g := range groups {
+		if strings.TrimSpace(g) == "" {
+			return nil, errors.New("relay.discover.groups must not contain an empty group")
+		}
+	}
+	if len(groups) > 0 {
+		rd.groups = &requiredGroups{groups: groups}
+	}
+
+	return rd, nil
+}
+
+// Start asks the lighthouses for relays every interval until ctx is done. This is a non blocking call.
+func (rd *relayDiscovery) Start(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(rd.interval)
+		defer ticker.Stop()
+
+		rd.f.lightHouse.SendRelayQuery()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				rd.update()
+				rd.f.lightHouse.SendRelayQuery()
+			}
+		}
+	}()
+}
+
+// update picks the relays from what the lighthouses told us and reports them if they changed
+func (rd *relayDiscovery) update() {
+	lh := rd.f.lightHouse
+	relays := rd.pick(lh.GetRelayAdverts())
+	if slices.Equal(relays, *lh.discoveredRelays.Load()) {
+		return
+	}
+
+	lh.discoveredRelays.Store(&relays)
+	rd.l.WithField("relays", relays).Info("Discovered relays changed")
+	if !lh.amLighthouse {
+		lh.SendUpdate()
+	}
+}
+
+// pick returns the least loaded usable relays, at most max of them
+func (rd *relayDiscovery) pick(adverts map[iputil.VpnIp]relayAdvert) []iputil.VpnIp {
+	relays := []iputil.VpnIp{}
+	for _, ip := range rankRelayAdverts(adverts, rd.f.lightHouse.myVpnIp) {
+		if len(relays) == rd.max {
+			break
+		}
+
+		h := rd.f.hostMap.QueryVpnIp(ip)
+		if h == nil || h.ConnectionState == nil {
+			rd.f.Handshake(ip)
+			continue
+		}
+
+		if h.remote == nil {
+			// Peers can only reach us through a relay we have a direct tunnel with
+			continue
+		}
+
+		if g := rd.groups.missing(h.GetCert()); g != "" {
+			if rd.l.Level >= logrus.DebugLevel {
+				rd.l.WithField("relay", ip).WithField("group", g).Debug("Discovered relay is missing a required group")
+			}
+			continue
+		}
+
+		relays = append(relays, ip)
+	}
+
+	sort.Slice(relays, func(i, j int) bool { return relays[i].Compare(relays[j]) < 0 })
+	return relays
+}
+
+// rankRelayAdverts orders advertised relays by how much of their capacity is in use, full relays and ourselves are
+// left out
+func rankRelayAdverts(adverts map[iputil.VpnIp]relayAdvert, me iputil.VpnIp) []iputil.VpnIp {
+	var ips []iputil.VpnIp
+	for ip, a := range adverts {
+		if ip == me || a.full() {
+			continue
+		}
+		ips = append(ips, ip)
+	}
+
+	used := func(ip iputil.VpnIp) float64 {
+		a := adverts[ip]
+		return float64(a.load) / float64(a.capacity)
+	}
+
+	sort.Slice(ips, func(i, j int) bool {
+		ui, uj := used(ips[i]), used(ips[j])
+		if ui != uj {
+			return ui < uj
+		}
+		return ips[i].Compare(ips[j]) < 0
+	})
+	return ips
+}
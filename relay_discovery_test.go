@@ -0,0 +1,105 @@
+package nebula
+
+import (
+	"net"
+	"testing"
+
+	"github.com/slackhq/nebula/cert"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/iputil"
+	"github.com/slackhq/nebula/test"
+	"github.com/slackhq/nebula/udp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewRelayDiscoveryFromConfig(t *testing.T) {
+	l := test.NewLogger()
+	c := config.NewC(l)
+
+	rd, err := newRelayDiscoveryFromConfig(l, nil, c)
+	require.NoError(t, err)
+	assert.Nil(t, rd)
+
+	c.Settings["relay"] = map[interface{}]interface{}{"discover": map[interface{}]interface{}{"enabled": true, "groups": []interface{}{"relays"}}}
+	rd, err = newRelayDiscoveryFromConfig(l, nil, c)
+	require.NoError(t, err)
+	assert.Equal(t, defaultRelayDiscoveryMax, rd.max)
+	assert.Equal(t, defaultRelayDiscoveryInterval, rd.interval)
+	assert.Equal(t, []string{"relays"}, rd.groups.groups)
+
+	for k, v := range map[string]interface{}{
+		"max":      0,
+		"interval": "0s",
+		"groups":   []interface{}{" "},
+	} {
+		c.Settings["relay"] = map[interface{}]interface{}{"discover": map[interface{}]interface{}{"enabled": true, k: v}}
+		_, err = newRelayDiscoveryFromConfig(l, nil, c)
+		assert.Error(t, err, k)
+	}
+
+	c.Settings["relay"] = map[interface{}]interface{}{"am_relay": true, "discover": map[interface{}]interface{}{"enabled": true}}
+	_, err = newRelayDiscoveryFromConfig(l, nil, c)
+	assert.EqualError(t, err, "relay.discover can not be used with relay.am_relay")
+}
+
+func TestRankRelayAdverts(t *testing.T) {
+	me := iputil.Ip2VpnIp(net.IP{10, 0, 0, 1})
+	a := iputil.Ip2VpnIp(net.IP{10, 0, 0, 2})
+	b := iputil.Ip2VpnIp(net.IP{10, 0, 0, 3})
+	c := iputil.Ip2VpnIp(net.IP{10, 0, 0, 4})
+	full := iputil.Ip2VpnIp(net.IP{10, 0, 0, 5})
+
+	adverts := map[iputil.VpnIp]relayAdvert{
+		me:   {capacity: 10},
+		a:    {capacity: 10, load: 5},
+		b:    {capacity: 100, load: 5},
+		c:    {capacity: 20, load: 1},
+		full: {capacity: 10, load: 10},
+	}
+	assert.Equal(t, []iputil.VpnIp{b, c, a}, rankRelayAdverts(adverts, me))
+}
+
+func TestRelayDiscovery_pick(t *testing.T) {
+	l := test.NewLogger()
+	_, vpncidr, _ := net.ParseCIDR("10.0.0.1/24")
+	me := iputil.Ip2VpnIp(net.IP{10, 0, 0, 1})
+	trusted := iputil.Ip2VpnIp(net.IP{10, 0, 0, 2})
+	untrusted := iputil.Ip2VpnIp(net.IP{10, 0, 0, 3})
+	relayed := iputil.Ip2VpnIp(net.IP{10, 0, 0, 4})
+	second := iputil.Ip2VpnIp(net.IP{10, 0, 0, 6})
+
+	hm := newHostMap(l, vpncidr)
+	addHost := func(vpnIp iputil.VpnIp, remote *udp.Addr, groups ...string) {
+		h := newTestRelayHostInfo(vpnIp, remote)
+		inverted := map[string]struct{}{}
+		for _, g := range groups {
+			inverted[g] = struct{}{}
+		}
+		h.ConnectionState = &ConnectionState{
+			peerCert: &cert.NebulaCertificate{Details: cert.NebulaCertificateDetails{InvertedGroups: inverted}},
+		}
+		hm.Hosts[vpnIp] = h
+	}
+	addHost(trusted, udp.NewAddr(net.IP{1, 1, 1, 2}, 4242), "relays")
+	addHost(untrusted, udp.NewAddr(net.IP{1, 1, 1, 3}, 4242))
+	addHost(relayed, nil, "relays")
+	addHost(second, udp.NewAddr(net.IP{1, 1, 1, 6}, 4242), "relays")
+
+	f := &Interface{l: l, hostMap: hm, lightHouse: &LightHouse{myVpnIp: me}}
+	rd := &relayDiscovery{l: l, f: f, max: 1, groups: &requiredGroups{groups: []string{"relays"}}}
+
+	adverts := map[iputil.VpnIp]relayAdvert{
+		untrusted: {capacity: 100},
+		relayed:   {capacity: 100, load: 1},
+		trusted:   {capacity: 100, load: 2},
+		second:    {capacity: 100, load: 3},
+	}
+	assert.Equal(t, []iputil.VpnIp{trusted}, rd.pick(adverts))
+
+	rd.max = 2
+	assert.Equal(t, []iputil.VpnIp{trusted, second}, rd.pick(adverts))
+
+	rd.groups = nil
+	assert.Equal(t, []iputil.VpnIp{trusted, untrusted}, rd.pick(adverts))
+}
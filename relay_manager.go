@@ -16,27 +16,51 @@ type relayManager struct {
 	l       *logrus.Logger
 	hostmap *HostMap
 	amRelay atomic.Bool
+	// maxHops is the most relays a chain through us may use, 1 only forwards to peers we have a direct tunnel with
+	maxHops atomic.Int32
+	// accounting counts and limits what we forward for each relayed peer
+	accounting *relayAccounting
 }
 
-func NewRelayManager(ctx context.Context, l *logrus.Logger, hostmap *HostMap, c *config.C) *relayManager {
+func NewRelayManager(ctx context.Context, l *logrus.Logger, hostmap *HostMap, c *config.C) (*relayManager, error) {
 	rm := &relayManager{
-		l:       l,
-		hostmap: hostmap,
+		l:          l,
+		hostmap:    hostmap,
+		accounting: newRelayAccounting(),
+	}
+	if err := rm.reload(c, true); err != nil {
+		return nil, err
 	}
-	rm.reload(c, true)
 	c.RegisterReloadCallback(func(c *config.C) {
 		err := rm.reload(c, false)
 		if err != nil {
 			l.WithError(err).Error("Failed to reload relay_manager")
 		}
 	})
-	return rm
+	return rm, nil
 }
 
 func (rm *relayManager) reload(c *config.C, initial bool) error {
 	if initial || c.HasChanged("relay.am_relay") {
 		rm.setAmRelay(c.GetBool("relay.am_relay", false))
 	}
+
+	// relay.use_relays depends on max_hops and is not reloadable either
+	if initial {
+		maxHops := c.GetInt("relay.max_hops", 1)
+		if maxHops < 1 || maxHops > 2 {
+			return fmt.Errorf("relay.max_hops must be 1 or 2, not %d", maxHops)
+		}
+		rm.maxHops.Store(int32(maxHops))
+	}
+
+	if initial || c.HasChanged("relay.limits") {
+		limits, err := newRelayLimitsFromConfig(c)
+		if err != nil {
+			return err
+		}
+		rm.accounting.limits.Store(limits)
+	}
 	return nil
 }
 
@@ -92,8 +116,8 @@ func (rm *relayManager) EstablishRelay(relayHostInfo *HostInfo, m *NebulaControl
 	if !ok {
 		rm.l.WithFields(logrus.Fields{"relay": relayHostInfo.vpnIp,
 			"initiatorRelayIndex": m.InitiatorRelayIndex,
-			"relayFrom":           m.RelayFromIp,
-			"relayTo":             m.RelayToIp}).Info("relayManager failed to update relay")
+			"relayFrom":           m.relayFrom(),
+			"relayTo":             m.relayTo()}).Info("relayManager failed to update relay")
 		return nil, fmt.Errorf("unknown relay")
 	}
 
@@ -113,13 +137,13 @@ func (rm *relayManager) HandleControlMsg(h *HostInfo, m *NebulaControl, f *Inter
 
 func (rm *relayManager) handleCreateRelayResponse(h *HostInfo, f *Interface, m *NebulaControl) {
 	rm.l.WithFields(logrus.Fields{
-		"relayFrom":           iputil.VpnIp(m.RelayFromIp),
-		"relayTo":             iputil.VpnIp(m.RelayToIp),
+		"relayFrom":           m.relayFrom(),
+		"relayTo":             m.relayTo(),
 		"initiatorRelayIndex": m.InitiatorRelayIndex,
 		"responderRelayIndex": m.ResponderRelayIndex,
 		"vpnIp":               h.vpnIp}).
 		Info("handleCreateRelayResponse")
-	target := iputil.VpnIp(m.RelayToIp)
+	target := m.relayTo()
 
 	relay, err := rm.EstablishRelay(h, m)
 	if err != nil {
@@ -147,9 +171,8 @@ func (rm *relayManager) handleCreateRelayResponse(h *HostInfo, f *Interface, m *
 			Type:                NebulaControl_CreateRelayResponse,
 			ResponderRelayIndex: peerRelay.LocalIndex,
 			InitiatorRelayIndex: peerRelay.RemoteIndex,
-			RelayFromIp:         uint32(peerHostInfo.vpnIp),
-			RelayToIp:           uint32(target),
 		}
+		resp.setRelay(peerHostInfo.vpnIp, target)
 		msg, err := resp.Marshal()
 		if err != nil {
 			rm.l.
@@ -157,8 +180,8 @@ func (rm *relayManager) handleCreateRelayResponse(h *HostInfo, f *Interface, m *
 		} else {
 			f.SendMessageToHostInfo(header.Control, 0, peerHostInfo, msg, make([]byte, 12), make([]byte, mtu))
 			rm.l.WithFields(logrus.Fields{
-				"relayFrom":           iputil.VpnIp(resp.RelayFromIp),
-				"relayTo":             iputil.VpnIp(resp.RelayToIp),
+				"relayFrom":           resp.relayFrom(),
+				"relayTo":             resp.relayTo(),
 				"initiatorRelayIndex": resp.InitiatorRelayIndex,
 				"responderRelayIndex": resp.ResponderRelayIndex,
 				"vpnIp":               peerHostInfo.vpnIp}).
@@ -169,8 +192,8 @@ func (rm *relayManager) handleCreateRelayResponse(h *HostInfo, f *Interface, m *
 
 func (rm *relayManager) handleCreateRelayRequest(h *HostInfo, f *Interface, m *NebulaControl) {
 
-	from := iputil.VpnIp(m.RelayFromIp)
-	target := iputil.VpnIp(m.RelayToIp)
+	from := m.relayFrom()
+	target := m.relayTo()
 
 	logMsg := rm.l.WithFields(logrus.Fields{
 		"relayFrom":           from,
@@ -223,9 +246,8 @@ func (rm *relayManager) handleCreateRelayRequest(h *HostInfo, f *Interface, m *N
 			Type:                NebulaControl_CreateRelayResponse,
 			ResponderRelayIndex: relay.LocalIndex,
 			InitiatorRelayIndex: relay.RemoteIndex,
-			RelayFromIp:         uint32(from),
-			RelayToIp:           uint32(target),
 		}
+		resp.setRelay(from, target)
 		msg, err := resp.Marshal()
 		if err != nil {
 			logMsg.
@@ -233,8 +255,8 @@ func (rm *relayManager) handleCreateRelayRequest(h *HostInfo, f *Interface, m *N
 		} else {
 			f.SendMessageToHostInfo(header.Control, 0, h, msg, make([]byte, 12), make([]byte, mtu))
 			rm.l.WithFields(logrus.Fields{
-				"relayFrom":           iputil.VpnIp(resp.RelayFromIp),
-				"relayTo":             iputil.VpnIp(resp.RelayToIp),
+				"relayFrom":           resp.relayFrom(),
+				"relayTo":             resp.relayTo(),
 				"initiatorRelayIndex": resp.InitiatorRelayIndex,
 				"responderRelayIndex": resp.ResponderRelayIndex,
 				"vpnIp":               h.vpnIp}).
@@ -253,8 +275,8 @@ func (rm *relayManager) handleCreateRelayRequest(h *HostInfo, f *Interface, m *N
 			f.Handshake(target)
 			return
 		}
-		if peer.remote == nil {
-			// Only create relays to peers for whom I have a direct connection
+		if peer.remote == nil && !rm.canChain(h, peer) {
+			// Only create relays to peers for whom I have a direct connection, or can chain to through another relay
 			return
 		}
 		sendCreateRequest := false
@@ -279,9 +301,8 @@ func (rm *relayManager) handleCreateRelayRequest(h *HostInfo, f *Interface, m *N
 			req := NebulaControl{
 				Type:                NebulaControl_CreateRelayRequest,
 				InitiatorRelayIndex: index,
-				RelayFromIp:         uint32(h.vpnIp),
-				RelayToIp:           uint32(target),
 			}
+			req.setRelay(h.vpnIp, target)
 			msg, err := req.Marshal()
 			if err != nil {
 				logMsg.
@@ -289,8 +310,8 @@ func (rm *relayManager) handleCreateRelayRequest(h *HostInfo, f *Interface, m *N
 			} else {
 				f.SendMessageToHostInfo(header.Control, 0, peer, msg, make([]byte, 12), make([]byte, mtu))
 				rm.l.WithFields(logrus.Fields{
-					"relayFrom":           iputil.VpnIp(req.RelayFromIp),
-					"relayTo":             iputil.VpnIp(req.RelayToIp),
+					"relayFrom":           req.relayFrom(),
+					"relayTo":             req.relayTo(),
 					"initiatorRelayIndex": req.InitiatorRelayIndex,
 					"responderRelayIndex": req.ResponderRelayIndex,
 					"vpnIp":               target}).
@@ -325,9 +346,8 @@ func (rm *relayManager) handleCreateRelayRequest(h *HostInfo, f *Interface, m *N
 					Type:                NebulaControl_CreateRelayResponse,
 					ResponderRelayIndex: relay.LocalIndex,
 					InitiatorRelayIndex: relay.RemoteIndex,
-					RelayFromIp:         uint32(h.vpnIp),
-					RelayToIp:           uint32(target),
 				}
+				resp.setRelay(h.vpnIp, target)
 				msg, err := resp.Marshal()
 				if err != nil {
 					rm.l.
@@ -335,8 +355,8 @@ func (rm *relayManager) handleCreateRelayRequest(h *HostInfo, f *Interface, m *N
 				} else {
 					f.SendMessageToHostInfo(header.Control, 0, h, msg, make([]byte, 12), make([]byte, mtu))
 					rm.l.WithFields(logrus.Fields{
-						"relayFrom":           iputil.VpnIp(resp.RelayFromIp),
-						"relayTo":             iputil.VpnIp(resp.RelayToIp),
+						"relayFrom":           resp.relayFrom(),
+						"relayTo":             resp.relayTo(),
 						"initiatorRelayIndex": resp.InitiatorRelayIndex,
 						"responderRelayIndex": resp.ResponderRelayIndex,
 						"vpnIp":               h.vpnIp}).
@@ -350,6 +370,26 @@ func (rm *relayManager) handleCreateRelayRequest(h *HostInfo, f *Interface, m *N
 	}
 }
 
+// canChain reports if we may relay from h to peer when we only reach peer through a relay ourselves. We must be the
+// first hop, so h must be direct, and the relay we reach peer through must be direct and not h, which keeps chains to
+// two relays and stops two relays from chaining through each other.
+func (rm *relayManager) canChain(h, peer *HostInfo) bool {
+	if rm.maxHops.Load() < 2 || h.remote == nil {
+		return false
+	}
+
+	for _, relayIp := range peer.relayState.CopyRelayIps() {
+		if relayIp == h.vpnIp {
+			continue
+		}
+		relayHostInfo := rm.hostmap.QueryVpnIp(relayIp)
+		if relayHostInfo != nil && relayHostInfo.remote != nil {
+			return true
+		}
+	}
+	return false
+}
+
 func (rm *relayManager) RemoveRelay(localIdx uint32) {
 	rm.hostmap.RemoveRelay(localIdx)
 }
@@ -0,0 +1,86 @@
+package nebula
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/iputil"
+	"github.com/slackhq/nebula/test"
+	"github.com/slackhq/nebula/udp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestRelayHostInfo(vpnIp iputil.VpnIp, remote *udp.Addr, relays ...iputil.VpnIp) *HostInfo {
+	h := &HostInfo{
+		vpnIp:  vpnIp,
+		remote: remote,
+		relayState: RelayState{
+			relays:        map[iputil.VpnIp]struct{}{},
+			relayForByIp:  map[iputil.VpnIp]*Relay{},
+			relayForByIdx: map[uint32]*Relay{},
+		},
+	}
+	for _, relay := range relays {
+		h.relayState.InsertRelayTo(relay)
+	}
+	return h
+}
+
+func TestNewRelayManager_maxHops(t *testing.T) {
+	l := test.NewLogger()
+	c := config.NewC(l)
+	_, vpncidr, _ := net.ParseCIDR("10.128.0.1/24")
+	hm := newHostMap(l, vpncidr)
+
+	rm, err := NewRelayManager(context.Background(), l, hm, c)
+	require.NoError(t, err)
+	assert.Equal(t, int32(1), rm.maxHops.Load())
+
+	c.Settings["relay"] = map[interface{}]interface{}{"max_hops": 2}
+	rm, err = NewRelayManager(context.Background(), l, hm, c)
+	require.NoError(t, err)
+	assert.Equal(t, int32(2), rm.maxHops.Load())
+
+	c.Settings["relay"] = map[interface{}]interface{}{"max_hops": 3}
+	_, err = NewRelayManager(context.Background(), l, hm, c)
+	assert.EqualError(t, err, "relay.max_hops must be 1 or 2, not 3")
+}
+
+func TestRelayManager_canChain(t *testing.T) {
+	l := test.NewLogger()
+	_, vpncidr, _ := net.ParseCIDR("10.128.0.1/24")
+	hm := newHostMap(l, vpncidr)
+	rm := &relayManager{l: l, hostmap: hm}
+	rm.maxHops.Store(2)
+
+	remote := udp.NewAddr(net.IP{1, 0, 0, 1}, 4242)
+	a := iputil.Ip2VpnIp(net.IP{10, 128, 0, 2})
+	r2 := iputil.Ip2VpnIp(net.IP{10, 128, 0, 3})
+	b := iputil.Ip2VpnIp(net.IP{10, 128, 0, 4})
+
+	direct := newTestRelayHostInfo(a, remote)
+	relay2 := newTestRelayHostInfo(r2, remote)
+	hm.unlockedAddHostInfo(relay2, &Interface{})
+
+	// We reach b through relay2, which we have a direct tunnel with
+	peer := newTestRelayHostInfo(b, nil, r2)
+	assert.True(t, rm.canChain(direct, peer))
+
+	// We must be the first hop
+	assert.False(t, rm.canChain(newTestRelayHostInfo(a, nil, r2), peer))
+
+	// Never back through the host that asked
+	assert.False(t, rm.canChain(relay2, peer))
+
+	// The relay we chain through must be direct
+	relay2.remote = nil
+	assert.False(t, rm.canChain(direct, peer))
+	relay2.remote = remote
+
+	// Chaining must be enabled
+	rm.maxHops.Store(1)
+	assert.False(t, rm.canChain(direct, peer))
+}
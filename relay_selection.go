@@ -0,0 +1,273 @@
+package nebula
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	"github.com/sirupsen/logrus"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/iputil"
+)
+
+// A handshake that needs a relay asks every relay the host lists, whichever answers first carries the tunnel no matter
+// how far away or busy it is. With relay selection enabled the relays we have been asked to use are probed every
+// interval with diag probes, measuring their round trip time and loss, and relays report how many relay indexes they
+// have in use as their load. Handshakes then go through the best count relays, unmeasured relays are only used to make
+// up the count.
+//
+// Relays too old to answer diag probes are never measured and are used as if unmeasured.
+
+const (
+	defaultRelaySelectionInterval = 30 * time.Second
+	defaultRelaySelectionProbes   = 5
+	defaultRelaySelectionCount    = 2
+	defaultRelaySelectionLoadCost = time.Millisecond
+
+	relaySelectionTimeout = time.Second
+	// relaySelectionForget is how many intervals a relay stays a candidate after a handshake last wanted it
+	relaySelectionForget = 10
+)
+
+// relayStats is what the last probe round measured for a relay
+type relayStats struct {
+	rtt  time.Duration
+	loss float64
+	// load is the relay indexes the relay has in use, -1 if it did not say
+	load int
+}
+
+// score is the latency a relay is worth, lower is better. A relay that lost every probe is never better than another.
+func (s *relayStats) score(loadCost time.Duration) float64 {
+	if s.loss >= 1 {
+		return math.Inf(1)
+	}
+
+	score := float64(s.rtt) / (1 - s.loss)
+	if s.load > 0 {
+		score += float64(s.load) * float64(loadCost)
+	}
+	return score
+}
+
+type relaySelector struct {
+	l        *logrus.Logger
+	f        *Interface
+	interval time.Duration
+	probes   int
+	count    int
+	loadCost time.Duration
+
+	sync.Mutex
+	// candidates are the relays handshakes have wanted, with when they last did
+	candidates map[iputil.VpnIp]time.Time
+	stats      map[iputil.VpnIp]*relayStats
+	best       iputil.VpnIp
+
+	metricChanged metrics.Counter
+}
+
+func newRelaySelectorFromConfig(l *logrus.Logger, f *Interface, c *config.C) (*relaySelector, error) {
+	if !c.GetBool("relay.selection.enabled", false) {
+		return nil, nil
+	}
+
+	rs := &relaySelector{
+		l:             l,
+		f:             f,
+		interval:      c.GetDuration("relay.selection.interval", defaultRelaySelectionInterval),
+		probes:        c.GetInt("relay.selection.probes", defaultRelaySelectionProbes),
+		count:         c.GetInt("relay.selection.count", defaultRelaySelectionCount),
+		loadCost:      c.GetDuration("relay.selection.load_cost", defaultRelaySelectionLoadCost),
+		candidates:    map[iputil.VpnIp]time.Time{},
+		stats:         map[iputil.VpnIp]*relayStats{},
+		metricChanged: metrics.GetOrRegisterCounter("relay.selection.changed", nil),
+	}
+
+	if rs.interval <= 0 {
+		return nil, errors.New("relay.selection.interval must be greater than 0")
+	}
+	if rs.probes < 1 {
+		return nil, errors.New("relay.selection.probes must be at least 1")
+	}
+	if rs.count < 1 {
+		return nil, errors.New("relay.selection.count must be at least 1")
+	}
+	if rs.loadCost < 0 {
+		return nil, errors.New("relay.selection.load_cost must not be negative")
+	}
+
+	return rs, nil
+}
+
+// Start probes the candidate relays every interval until ctx is done. This is a non blocking call.
+func (rs *relaySelector) Start(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(rs.interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				rs.probeAll(ctx)
+			}
+		}
+	}()
+}
+
+// choose orders the relays a host lists best first and keeps the best count of them, target and ourselves are skipped
+func (rs *relaySelector) choose(relays []*iputil.VpnIp, target iputil.VpnIp) []*iputil.VpnIp {
+	rs.Lock()
+	defer rs.Unlock()
+
+	now := time.Now()
+	var ips []iputil.VpnIp
+	for _, relay := range relays {
+		if *relay == target || *relay == rs.f.lightHouse.myVpnIp {
+			continue
+		}
+		rs.candidates[*relay] = now
+		ips = append(ips, *relay)
+	}
+
+	ips = rs.rank(ips)
+	if len(ips) > rs.count {
+		ips = ips[:rs.count]
+	}
+
+	chosen := make([]*iputil.VpnIp, len(ips))
+	for i := range ips {
+		chosen[i] = &ips[i]
+	}
+	return chosen
+}
+
+// rank sorts relays by score, unmeasured relays keep their order after the measured ones and relays that lost every
+// probe go last. The lock must be held.
+func (rs *relaySelector) rank(ips []iputil.VpnIp) []iputil.VpnIp {
+	class := func(ip iputil.VpnIp) int {
+		s, ok := rs.stats[ip]
+		switch {
+		case !ok:
+			return 1
+		case s.loss >= 1:
+			return 2
+		default:
+			return 0
+		}
+	}
+
+	sort.SliceStable(ips, func(i, j int) bool {
+		ci, cj := class(ips[i]), class(ips[j])
+		if ci != cj {
+			return ci < cj
+		}
+		if ci != 0 {
+			return false
+		}
+		return rs.stats[ips[i]].score(rs.loadCost) < rs.stats[ips[j]].score(rs.loadCost)
+	})
+	return ips
+}
+
+// probeAll measures every candidate relay one at a time and re-evaluates which is best
+func (rs *relaySelector) probeAll(ctx context.Context) {
+	now := time.Now()
+
+	rs.Lock()
+	var ips []iputil.VpnIp
+	for ip, wanted := range rs.candidates {
+		if now.Sub(wanted) > relaySelectionForget*rs.interval {
+			delete(rs.candidates, ip)
+			delete(rs.stats, ip)
+			continue
+		}
+		ips = append(ips, ip)
+	}
+	rs.Unlock()
+
+	for _, ip := range ips {
+		if ctx.Err() != nil {
+			return
+		}
+
+		s := rs.probe(ip)
+
+		rs.Lock()
+		if s == nil {
+			delete(rs.stats, ip)
+		} else {
+			rs.stats[ip] = s
+		}
+		rs.Unlock()
+	}
+
+	rs.Lock()
+	ranked := rs.rank(ips)
+	var best iputil.VpnIp
+	var stats *relayStats
+	if len(ranked) > 0 {
+		best, stats = ranked[0], rs.stats[ranked[0]]
+	}
+	changed := best != rs.best && stats != nil
+	if changed {
+		rs.best = best
+	}
+	rs.Unlock()
+
+	if changed {
+		rs.l.WithField("relay", best).WithField("rtt", stats.rtt).WithField("loss", stats.loss).
+			WithField("load", stats.load).Info("Best relay changed")
+		rs.metricChanged.Inc(1)
+	}
+}
+
+// probe sends probes diag probes to a relay, it returns nil if the relay can not be measured. A relay we have no
+// tunnel with is handshaked so the next round can measure it.
+func (rs *relaySelector) probe(ip iputil.VpnIp) *relayStats {
+	h := rs.f.hostMap.QueryVpnIp(ip)
+	if h == nil || h.ConnectionState == nil {
+		rs.f.Handshake(ip)
+		return nil
+	}
+	if !h.ConnectionState.capabilities.Has(capabilityDiagProbe) {
+		return nil
+	}
+
+	s := &relayStats{load: -1}
+	var total time.Duration
+	received := 0
+	for i := 0; i < rs.probes; i++ {
+		rep, err := rs.f.sendDiagProbe(h, diagRequestLen, relaySelectionTimeout)
+		if err != nil {
+			continue
+		}
+		received++
+		total += rep.received.Sub(rep.sent)
+		s.load = rep.relayLoad
+	}
+
+	s.loss = float64(rs.probes-received) / float64(rs.probes)
+	if received > 0 {
+		s.rtt = total / time.Duration(received)
+	}
+
+	name := strings.ReplaceAll(ip.String(), ".", "_")
+	metrics.GetOrRegisterGauge(fmt.Sprintf("relay.selection.%s.rtt_us", name), nil).Update(s.rtt.Microseconds())
+	metrics.GetOrRegisterGauge(fmt.Sprintf("relay.selection.%s.loss_pct", name), nil).Update(int64(s.loss * 100))
+	metrics.GetOrRegisterGauge(fmt.Sprintf("relay.selection.%s.load", name), nil).Update(int64(s.load))
+
+	if rs.l.Level >= logrus.DebugLevel {
+		rs.l.WithField("relay", ip).WithField("rtt", s.rtt).WithField("loss", s.loss).WithField("load", s.load).
+			Debug("Probed relay")
+	}
+	return s
+}
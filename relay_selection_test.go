@@ -0,0 +1,97 @@
+package nebula
+
+import (
+	"math"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/iputil"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewRelaySelectorFromConfig(t *testing.T) {
+	l := test.NewLogger()
+	c := config.NewC(l)
+
+	rs, err := newRelaySelectorFromConfig(l, nil, c)
+	require.NoError(t, err)
+	assert.Nil(t, rs)
+
+	c.Settings["relay"] = map[interface{}]interface{}{"selection": map[interface{}]interface{}{"enabled": true}}
+	rs, err = newRelaySelectorFromConfig(l, nil, c)
+	require.NoError(t, err)
+	assert.Equal(t, defaultRelaySelectionInterval, rs.interval)
+	assert.Equal(t, defaultRelaySelectionProbes, rs.probes)
+	assert.Equal(t, defaultRelaySelectionCount, rs.count)
+	assert.Equal(t, defaultRelaySelectionLoadCost, rs.loadCost)
+
+	for k, v := range map[string]interface{}{
+		"interval":  "0s",
+		"probes":    0,
+		"count":     0,
+		"load_cost": "-1ms",
+	} {
+		c.Settings["relay"] = map[interface{}]interface{}{"selection": map[interface{}]interface{}{"enabled": true, k: v}}
+		_, err = newRelaySelectorFromConfig(l, nil, c)
+		assert.Error(t, err, k)
+	}
+}
+
+func TestRelayStats_score(t *testing.T) {
+	fast := &relayStats{rtt: 10 * time.Millisecond, load: -1}
+	lossy := &relayStats{rtt: 10 * time.Millisecond, loss: 0.5, load: -1}
+	busy := &relayStats{rtt: 10 * time.Millisecond, load: 20}
+	dead := &relayStats{loss: 1}
+
+	assert.Equal(t, float64(10*time.Millisecond), fast.score(time.Millisecond))
+	assert.Equal(t, float64(20*time.Millisecond), lossy.score(time.Millisecond))
+	assert.Equal(t, float64(30*time.Millisecond), busy.score(time.Millisecond))
+	assert.Equal(t, float64(10*time.Millisecond), busy.score(0))
+	assert.True(t, math.IsInf(dead.score(time.Millisecond), 1))
+}
+
+func TestRelaySelector_choose(t *testing.T) {
+	l := test.NewLogger()
+	me := iputil.Ip2VpnIp(net.IP{10, 0, 0, 1})
+	target := iputil.Ip2VpnIp(net.IP{10, 0, 0, 2})
+	a := iputil.Ip2VpnIp(net.IP{10, 0, 0, 3})
+	b := iputil.Ip2VpnIp(net.IP{10, 0, 0, 4})
+	c := iputil.Ip2VpnIp(net.IP{10, 0, 0, 5})
+	d := iputil.Ip2VpnIp(net.IP{10, 0, 0, 6})
+
+	f := &Interface{l: l, lightHouse: &LightHouse{myVpnIp: me}}
+	rs := &relaySelector{
+		l:          l,
+		f:          f,
+		count:      3,
+		loadCost:   time.Millisecond,
+		candidates: map[iputil.VpnIp]time.Time{},
+		stats:      map[iputil.VpnIp]*relayStats{},
+	}
+
+	deref := func(ips []*iputil.VpnIp) []iputil.VpnIp {
+		r := make([]iputil.VpnIp, len(ips))
+		for i, ip := range ips {
+			r[i] = *ip
+		}
+		return r
+	}
+
+	// Nothing measured keeps the order, ourselves and the target are skipped
+	relays := []*iputil.VpnIp{&me, &a, &target, &b, &c, &d}
+	assert.Equal(t, []iputil.VpnIp{a, b, c}, deref(rs.choose(relays, target)))
+	assert.Len(t, rs.candidates, 4)
+
+	// Measured relays go first by score, then unmeasured, then the ones that lost everything
+	rs.stats[a] = &relayStats{loss: 1}
+	rs.stats[c] = &relayStats{rtt: 30 * time.Millisecond, load: -1}
+	rs.stats[d] = &relayStats{rtt: 10 * time.Millisecond, load: 5}
+	assert.Equal(t, []iputil.VpnIp{d, c, b}, deref(rs.choose(relays, target)))
+
+	rs.count = 10
+	assert.Equal(t, []iputil.VpnIp{d, c, b, a}, deref(rs.choose(relays, target)))
+}
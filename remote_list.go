@@ -43,10 +43,15 @@ type cache struct {
 	v4    *cacheV4
 	v6    *cacheV6
 	relay *cacheRelay
+
+	// updated is when the owner last changed anything in here
+	updated time.Time
+	// stale is set when the owner, a lighthouse, said the host had not updated it in a while
+	stale bool
 }
 
 type cacheRelay struct {
-	relay []uint32
+	relay []iputil.VpnIp
 }
 
 // cacheV4 stores learned and reported ipv4 records under cache
@@ -73,6 +78,11 @@ type hostnamesResults struct {
 	cancelFn      func()
 	l             *logrus.Logger
 	ips           atomic.Pointer[map[netip.AddrPort]struct{}]
+
+	// lookup resolves a hostname, it is net.DefaultResolver.LookupNetIP outside of tests
+	lookup func(ctx context.Context, network, host string) ([]netip.Addr, error)
+	// last holds the most recent successful answer for each hostname, only the lookup goroutine touches it
+	last map[hostnamePort][]netip.AddrPort
 }
 
 func NewHostnameResults(ctx context.Context, l *logrus.Logger, d time.Duration, network string, timeout time.Duration, hostPorts []string, onUpdate func()) (*hostnamesResults, error) {
@@ -81,6 +91,8 @@ func NewHostnameResults(ctx context.Context, l *logrus.Logger, d time.Duration,
 		network:       network,
 		lookupTimeout: timeout,
 		l:             l,
+		lookup:        net.DefaultResolver.LookupNetIP,
+		last:          map[hostnamePort][]netip.AddrPort{},
 	}
 
 	// Fastrack IP addresses to ensure they're immediately available for use.
@@ -108,7 +120,7 @@ func NewHostnameResults(ctx context.Context, l *logrus.Logger, d time.Duration,
 		}
 
 		// Save the IP address immediately
-		ips[netip.AddrPortFrom(addr, uint16(iPort))] = struct{}{}
+		ips[netip.AddrPortFrom(addr.Unmap(), uint16(iPort))] = struct{}{}
 	}
 	r.ips.Store(&ips)
 
@@ -120,19 +132,7 @@ func NewHostnameResults(ctx context.Context, l *logrus.Logger, d time.Duration,
 		go func() {
 			defer ticker.Stop()
 			for {
-				netipAddrs := map[netip.AddrPort]struct{}{}
-				for _, hostPort := range r.hostnames {
-					timeoutCtx, timeoutCancel := context.WithTimeout(ctx, r.lookupTimeout)
-					addrs, err := net.DefaultResolver.LookupNetIP(timeoutCtx, r.network, hostPort.name)
-					timeoutCancel()
-					if err != nil {
-						l.WithFields(logrus.Fields{"hostname": hostPort.name, "network": r.network}).WithError(err).Error("DNS resolution failed for static_map host")
-						continue
-					}
-					for _, a := range addrs {
-						netipAddrs[netip.AddrPortFrom(a, hostPort.port)] = struct{}{}
-					}
-				}
+				netipAddrs := r.resolve(newCtx)
 				origSet := r.ips.Load()
 				different := false
 				for a := range *origSet {
@@ -167,6 +167,39 @@ func NewHostnameResults(ctx context.Context, l *logrus.Logger, d time.Duration,
 	return r, nil
 }
 
+// resolve looks up every hostname and returns the full set of addresses. IP addresses are used as they are and a
+// hostname that fails to resolve keeps the addresses of its last successful lookup, a DNS outage should not make us
+// forget how to reach a lighthouse.
+func (r *hostnamesResults) resolve(ctx context.Context) map[netip.AddrPort]struct{} {
+	netipAddrs := map[netip.AddrPort]struct{}{}
+	for _, hostPort := range r.hostnames {
+		if addr, err := netip.ParseAddr(hostPort.name); err == nil {
+			netipAddrs[netip.AddrPortFrom(addr.Unmap(), hostPort.port)] = struct{}{}
+			continue
+		}
+
+		timeoutCtx, timeoutCancel := context.WithTimeout(ctx, r.lookupTimeout)
+		addrs, err := r.lookup(timeoutCtx, r.network, hostPort.name)
+		timeoutCancel()
+		if err != nil {
+			r.l.WithFields(logrus.Fields{"hostname": hostPort.name, "network": r.network, "lastResults": r.last[hostPort]}).
+				WithError(err).Error("DNS resolution failed for static_map host")
+		} else {
+			results := make([]netip.AddrPort, 0, len(addrs))
+			for _, a := range addrs {
+				// A and AAAA answers are all used, v4 answers can come back mapped into v6
+				results = append(results, netip.AddrPortFrom(a.Unmap(), hostPort.port))
+			}
+			r.last[hostPort] = results
+		}
+
+		for _, a := range r.last[hostPort] {
+			netipAddrs[a] = struct{}{}
+		}
+	}
+	return netipAddrs
+}
+
 func (hr *hostnamesResults) Cancel() {
 	if hr != nil && hr.cancelFn != nil {
 		hr.cancelFn()
@@ -212,6 +245,9 @@ type RemoteList struct {
 
 	// A flag that the cache may have changed and addrs needs to be rebuilt
 	shouldRebuild bool
+
+	// synced is when each lighthouse.sync peer last shared this host with us, their addresses are cached under them
+	synced map[iputil.VpnIp]time.Time
 }
 
 // NewRemoteList creates a new empty RemoteList
@@ -282,6 +318,22 @@ func (r *RemoteList) LearnRemote(ownerVpnIp iputil.VpnIp, addr *udp.Addr) {
 	}
 }
 
+// hasLearned locks and returns true if addr is already the learned address for the owner vpn ip
+func (r *RemoteList) hasLearned(ownerVpnIp iputil.VpnIp, addr *udp.Addr) bool {
+	r.RLock()
+	defer r.RUnlock()
+
+	c := r.cache[ownerVpnIp]
+	if c == nil {
+		return false
+	}
+
+	if addr.IP.To4() != nil {
+		return c.v4 != nil && c.v4.learned != nil && NewUDPAddrFromLH4(c.v4.learned).Equals(addr)
+	}
+	return c.v6 != nil && c.v6.learned != nil && NewUDPAddrFromLH6(c.v6.learned).Equals(addr)
+}
+
 // CopyCache locks and creates a more human friendly form of the internal address cache.
 // This may contain duplicates and blocked addresses
 func (r *RemoteList) CopyCache() *CacheMap {
@@ -327,7 +379,7 @@ func (r *RemoteList) CopyCache() *CacheMap {
 
 		if mc.relay != nil {
 			for _, a := range mc.relay.relay {
-				nip := iputil.VpnIp(a).ToIP()
+				nip := a.ToIP()
 				c.Relay = append(c.Relay, &nip)
 			}
 		}
@@ -427,7 +479,7 @@ func (r *RemoteList) unlockedSetV4(ownerVpnIp iputil.VpnIp, vpnIp iputil.VpnIp,
 	}
 }
 
-func (r *RemoteList) unlockedSetRelay(ownerVpnIp iputil.VpnIp, vpnIp iputil.VpnIp, to []uint32) {
+func (r *RemoteList) unlockedSetRelay(ownerVpnIp iputil.VpnIp, vpnIp iputil.VpnIp, to []iputil.VpnIp) {
 	r.shouldRebuild = true
 	c := r.unlockedGetOrMakeRelay(ownerVpnIp)
 
@@ -438,6 +490,13 @@ func (r *RemoteList) unlockedSetRelay(ownerVpnIp iputil.VpnIp, vpnIp iputil.VpnI
 	c.relay = append(c.relay, to[:minInt(len(to), MaxRemotes)]...)
 }
 
+// unlockedSetStale assumes you have the write lock and records whether the owners last answer was stale
+func (r *RemoteList) unlockedSetStale(ownerVpnIp iputil.VpnIp, stale bool) {
+	if c := r.cache[ownerVpnIp]; c != nil {
+		c.stale = stale
+	}
+}
+
 // unlockedPrependV4 assumes you have the write lock and prepends the address in the reported list for this owner
 // This is only useful for establishing static hosts
 func (r *RemoteList) unlockedPrependV4(ownerVpnIp iputil.VpnIp, to *Ip4AndPort) {
@@ -494,6 +553,7 @@ func (r *RemoteList) unlockedGetOrMakeRelay(ownerVpnIp iputil.VpnIp) *cacheRelay
 		am = &cache{}
 		r.cache[ownerVpnIp] = am
 	}
+	am.updated = time.Now()
 	// Avoid occupying memory for relay if we never have any
 	if am.relay == nil {
 		am.relay = &cacheRelay{}
@@ -509,6 +569,7 @@ func (r *RemoteList) unlockedGetOrMakeV4(ownerVpnIp iputil.VpnIp) *cacheV4 {
 		am = &cache{}
 		r.cache[ownerVpnIp] = am
 	}
+	am.updated = time.Now()
 	// Avoid occupying memory for v6 addresses if we never have any
 	if am.v4 == nil {
 		am.v4 = &cacheV4{}
@@ -524,6 +585,7 @@ func (r *RemoteList) unlockedGetOrMakeV6(ownerVpnIp iputil.VpnIp) *cacheV6 {
 		am = &cache{}
 		r.cache[ownerVpnIp] = am
 	}
+	am.updated = time.Now()
 	// Avoid occupying memory for v4 addresses if we never have any
 	if am.v6 == nil {
 		am.v6 = &cacheV6{}
@@ -572,7 +634,7 @@ func (r *RemoteList) unlockedCollect() {
 
 		if c.relay != nil {
 			for _, v := range c.relay.relay {
-				ip := iputil.VpnIp(v)
+				ip := v
 				relays = append(relays, &ip)
 			}
 		}
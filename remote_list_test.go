@@ -1,36 +1,84 @@
 package nebula
 
 import (
+	"context"
+	"errors"
 	"net"
+	"net/netip"
 	"testing"
+	"time"
 
 	"github.com/slackhq/nebula/iputil"
+	"github.com/slackhq/nebula/test"
 	"github.com/stretchr/testify/assert"
 )
 
+func TestHostnamesResults_resolve(t *testing.T) {
+	answers := map[string][]netip.Addr{
+		"lh.example.com": {netip.MustParseAddr("1.1.1.1"), netip.MustParseAddr("::ffff:2.2.2.2"), netip.MustParseAddr("fd00::1")},
+	}
+	hr := &hostnamesResults{
+		hostnames: []hostnamePort{
+			{name: "lh.example.com", port: 4242},
+			{name: "fd00::2", port: 4243},
+		},
+		network:       "ip",
+		lookupTimeout: time.Second,
+		l:             test.NewLogger(),
+		lookup: func(ctx context.Context, network, host string) ([]netip.Addr, error) {
+			assert.Equal(t, "ip", network)
+			if a, ok := answers[host]; ok {
+				return a, nil
+			}
+			return nil, errors.New("no such host")
+		},
+		last: map[hostnamePort][]netip.AddrPort{},
+	}
+
+	// Every A and AAAA answer is used, IP addresses are never looked up
+	expected := map[netip.AddrPort]struct{}{
+		netip.MustParseAddrPort("1.1.1.1:4242"):   {},
+		netip.MustParseAddrPort("2.2.2.2:4242"):   {},
+		netip.MustParseAddrPort("[fd00::1]:4242"): {},
+		netip.MustParseAddrPort("[fd00::2]:4243"): {},
+	}
+	assert.Equal(t, expected, hr.resolve(context.Background()))
+
+	// A failed lookup keeps the last answer
+	delete(answers, "lh.example.com")
+	assert.Equal(t, expected, hr.resolve(context.Background()))
+
+	// A new answer replaces the old one
+	answers["lh.example.com"] = []netip.Addr{netip.MustParseAddr("3.3.3.3")}
+	assert.Equal(t, map[netip.AddrPort]struct{}{
+		netip.MustParseAddrPort("3.3.3.3:4242"):   {},
+		netip.MustParseAddrPort("[fd00::2]:4243"): {},
+	}, hr.resolve(context.Background()))
+}
+
 func TestRemoteList_Rebuild(t *testing.T) {
 	rl := NewRemoteList(nil)
 	rl.unlockedSetV4(
-		0,
-		0,
+		iputil.VpnIpFrom4(0),
+		iputil.VpnIpFrom4(0),
 		[]*Ip4AndPort{
-			{Ip: uint32(iputil.Ip2VpnIp(net.ParseIP("70.199.182.92"))), Port: 1475}, // this is duped
-			{Ip: uint32(iputil.Ip2VpnIp(net.ParseIP("172.17.0.182"))), Port: 10101},
-			{Ip: uint32(iputil.Ip2VpnIp(net.ParseIP("172.17.1.1"))), Port: 10101}, // this is duped
-			{Ip: uint32(iputil.Ip2VpnIp(net.ParseIP("172.18.0.1"))), Port: 10101}, // this is duped
-			{Ip: uint32(iputil.Ip2VpnIp(net.ParseIP("172.18.0.1"))), Port: 10101}, // this is a dupe
-			{Ip: uint32(iputil.Ip2VpnIp(net.ParseIP("172.19.0.1"))), Port: 10101},
-			{Ip: uint32(iputil.Ip2VpnIp(net.ParseIP("172.31.0.1"))), Port: 10101},
-			{Ip: uint32(iputil.Ip2VpnIp(net.ParseIP("172.17.1.1"))), Port: 10101},   // this is a dupe
-			{Ip: uint32(iputil.Ip2VpnIp(net.ParseIP("70.199.182.92"))), Port: 1476}, // almost dupe of 0 with a diff port
-			{Ip: uint32(iputil.Ip2VpnIp(net.ParseIP("70.199.182.92"))), Port: 1475}, // this is a dupe
+			{Ip: iputil.Ip2VpnIp(net.ParseIP("70.199.182.92")).Uint32(), Port: 1475}, // this is duped
+			{Ip: iputil.Ip2VpnIp(net.ParseIP("172.17.0.182")).Uint32(), Port: 10101},
+			{Ip: iputil.Ip2VpnIp(net.ParseIP("172.17.1.1")).Uint32(), Port: 10101}, // this is duped
+			{Ip: iputil.Ip2VpnIp(net.ParseIP("172.18.0.1")).Uint32(), Port: 10101}, // this is duped
+			{Ip: iputil.Ip2VpnIp(net.ParseIP("172.18.0.1")).Uint32(), Port: 10101}, // this is a dupe
+			{Ip: iputil.Ip2VpnIp(net.ParseIP("172.19.0.1")).Uint32(), Port: 10101},
+			{Ip: iputil.Ip2VpnIp(net.ParseIP("172.31.0.1")).Uint32(), Port: 10101},
+			{Ip: iputil.Ip2VpnIp(net.ParseIP("172.17.1.1")).Uint32(), Port: 10101},   // this is a dupe
+			{Ip: iputil.Ip2VpnIp(net.ParseIP("70.199.182.92")).Uint32(), Port: 1476}, // almost dupe of 0 with a diff port
+			{Ip: iputil.Ip2VpnIp(net.ParseIP("70.199.182.92")).Uint32(), Port: 1475}, // this is a dupe
 		},
 		func(iputil.VpnIp, *Ip4AndPort) bool { return true },
 	)
 
 	rl.unlockedSetV6(
-		1,
-		1,
+		iputil.VpnIpFrom4(1),
+		iputil.VpnIpFrom4(1),
 		[]*Ip6AndPort{
 			NewIp6AndPort(net.ParseIP("1::1"), 1), // this is duped
 			NewIp6AndPort(net.ParseIP("1::1"), 2), // almost dupe of 0 with a diff port, also gets duped
@@ -104,24 +152,24 @@ func TestRemoteList_Rebuild(t *testing.T) {
 func BenchmarkFullRebuild(b *testing.B) {
 	rl := NewRemoteList(nil)
 	rl.unlockedSetV4(
-		0,
-		0,
+		iputil.VpnIpFrom4(0),
+		iputil.VpnIpFrom4(0),
 		[]*Ip4AndPort{
-			{Ip: uint32(iputil.Ip2VpnIp(net.ParseIP("70.199.182.92"))), Port: 1475},
-			{Ip: uint32(iputil.Ip2VpnIp(net.ParseIP("172.17.0.182"))), Port: 10101},
-			{Ip: uint32(iputil.Ip2VpnIp(net.ParseIP("172.17.1.1"))), Port: 10101},
-			{Ip: uint32(iputil.Ip2VpnIp(net.ParseIP("172.18.0.1"))), Port: 10101},
-			{Ip: uint32(iputil.Ip2VpnIp(net.ParseIP("172.19.0.1"))), Port: 10101},
-			{Ip: uint32(iputil.Ip2VpnIp(net.ParseIP("172.31.0.1"))), Port: 10101},
-			{Ip: uint32(iputil.Ip2VpnIp(net.ParseIP("172.17.1.1"))), Port: 10101},   // this is a dupe
-			{Ip: uint32(iputil.Ip2VpnIp(net.ParseIP("70.199.182.92"))), Port: 1476}, // dupe of 0 with a diff port
+			{Ip: iputil.Ip2VpnIp(net.ParseIP("70.199.182.92")).Uint32(), Port: 1475},
+			{Ip: iputil.Ip2VpnIp(net.ParseIP("172.17.0.182")).Uint32(), Port: 10101},
+			{Ip: iputil.Ip2VpnIp(net.ParseIP("172.17.1.1")).Uint32(), Port: 10101},
+			{Ip: iputil.Ip2VpnIp(net.ParseIP("172.18.0.1")).Uint32(), Port: 10101},
+			{Ip: iputil.Ip2VpnIp(net.ParseIP("172.19.0.1")).Uint32(), Port: 10101},
+			{Ip: iputil.Ip2VpnIp(net.ParseIP("172.31.0.1")).Uint32(), Port: 10101},
+			{Ip: iputil.Ip2VpnIp(net.ParseIP("172.17.1.1")).Uint32(), Port: 10101},   // this is a dupe
+			{Ip: iputil.Ip2VpnIp(net.ParseIP("70.199.182.92")).Uint32(), Port: 1476}, // dupe of 0 with a diff port
 		},
 		func(iputil.VpnIp, *Ip4AndPort) bool { return true },
 	)
 
 	rl.unlockedSetV6(
-		0,
-		0,
+		iputil.VpnIpFrom4(0),
+		iputil.VpnIpFrom4(0),
 		[]*Ip6AndPort{
 			NewIp6AndPort(net.ParseIP("1::1"), 1),
 			NewIp6AndPort(net.ParseIP("1::1"), 2), // dupe of 0 with a diff port
@@ -169,24 +217,24 @@ func BenchmarkFullRebuild(b *testing.B) {
 func BenchmarkSortRebuild(b *testing.B) {
 	rl := NewRemoteList(nil)
 	rl.unlockedSetV4(
-		0,
-		0,
+		iputil.VpnIpFrom4(0),
+		iputil.VpnIpFrom4(0),
 		[]*Ip4AndPort{
-			{Ip: uint32(iputil.Ip2VpnIp(net.ParseIP("70.199.182.92"))), Port: 1475},
-			{Ip: uint32(iputil.Ip2VpnIp(net.ParseIP("172.17.0.182"))), Port: 10101},
-			{Ip: uint32(iputil.Ip2VpnIp(net.ParseIP("172.17.1.1"))), Port: 10101},
-			{Ip: uint32(iputil.Ip2VpnIp(net.ParseIP("172.18.0.1"))), Port: 10101},
-			{Ip: uint32(iputil.Ip2VpnIp(net.ParseIP("172.19.0.1"))), Port: 10101},
-			{Ip: uint32(iputil.Ip2VpnIp(net.ParseIP("172.31.0.1"))), Port: 10101},
-			{Ip: uint32(iputil.Ip2VpnIp(net.ParseIP("172.17.1.1"))), Port: 10101},   // this is a dupe
-			{Ip: uint32(iputil.Ip2VpnIp(net.ParseIP("70.199.182.92"))), Port: 1476}, // dupe of 0 with a diff port
+			{Ip: iputil.Ip2VpnIp(net.ParseIP("70.199.182.92")).Uint32(), Port: 1475},
+			{Ip: iputil.Ip2VpnIp(net.ParseIP("172.17.0.182")).Uint32(), Port: 10101},
+			{Ip: iputil.Ip2VpnIp(net.ParseIP("172.17.1.1")).Uint32(), Port: 10101},
+			{Ip: iputil.Ip2VpnIp(net.ParseIP("172.18.0.1")).Uint32(), Port: 10101},
+			{Ip: iputil.Ip2VpnIp(net.ParseIP("172.19.0.1")).Uint32(), Port: 10101},
+			{Ip: iputil.Ip2VpnIp(net.ParseIP("172.31.0.1")).Uint32(), Port: 10101},
+			{Ip: iputil.Ip2VpnIp(net.ParseIP("172.17.1.1")).Uint32(), Port: 10101},   // this is a dupe
+			{Ip: iputil.Ip2VpnIp(net.ParseIP("70.199.182.92")).Uint32(), Port: 1476}, // dupe of 0 with a diff port
 		},
 		func(iputil.VpnIp, *Ip4AndPort) bool { return true },
 	)
 
 	rl.unlockedSetV6(
-		0,
-		0,
+		iputil.VpnIpFrom4(0),
+		iputil.VpnIpFrom4(0),
 		[]*Ip6AndPort{
 			NewIp6AndPort(net.ParseIP("1::1"), 1),
 			NewIp6AndPort(net.ParseIP("1::1"), 2), // dupe of 0 with a diff port
@@ -0,0 +1,349 @@
+package nebula
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/slackhq/nebula/cert"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/util"
+)
+
+const (
+	defaultRemotePKIInterval = 5 * time.Minute
+	// maxRemotePKISize bounds what we will read from a remote source, a large ca bundle or blocklist is still well under
+	maxRemotePKISize = 4 * 1024 * 1024
+)
+
+// remotePKIState is what was last accepted from pki.ca_url and pki.blocklist_url, it is merged into every ca pool
+// built from config.
+type remotePKIState struct {
+	caPEM     []byte
+	blocklist []string
+}
+
+// remotePKI polls pki.ca_url and pki.blocklist_url so that new CAs and revocations reach every node without config
+// management pushing files. Payloads must be signed by a CA in pki.ca, see cert.SignedPayload, and are refused if they
+// are expired or older than the last accepted payload from the same url. The last accepted timestamps are kept in
+// pki.url_state so a restart can not be rolled back either.
+type remotePKI struct {
+	l      *logrus.Logger
+	pki    *PKI
+	c      *config.C
+	client *http.Client
+
+	// conf is replaced by the reload transaction, the poll goroutine only ever reads this snapshot
+	conf atomic.Pointer[remotePKIConfig]
+
+	ca        remotePKISource
+	blocklist remotePKISource
+	// saved is what was read from pki.url_state at start, keyed by the source config key
+	saved map[string]remotePKISaved
+}
+
+// remotePKIConfig is the part of the config the poller uses
+type remotePKIConfig struct {
+	caURL        string
+	blocklistURL string
+	interval     time.Duration
+	statePath    string
+	// anchors are the CAs from pki.ca, remote payloads are only trusted if signed by one of them and never by one we
+	// fetched
+	anchors *cert.NebulaCAPool
+}
+
+type remotePKISource struct {
+	key       string
+	url       string
+	etag      string
+	timestamp time.Time
+	notAfter  time.Time
+	payload   []byte
+}
+
+// remotePKISaved is what pki.url_state keeps for a source
+type remotePKISaved struct {
+	URL       string `json:"url"`
+	Timestamp int64  `json:"timestamp"`
+}
+
+func newRemotePKIFromConfig(l *logrus.Logger, pki *PKI, c *config.C) (*remotePKI, error) {
+	if c.GetString("pki.ca_url", "") == "" && c.GetString("pki.blocklist_url", "") == "" {
+		return nil, nil
+	}
+
+	r := &remotePKI{
+		l:         l,
+		pki:       pki,
+		c:         c,
+		client:    http.DefaultClient,
+		ca:        remotePKISource{key: "pki.ca_url"},
+		blocklist: remotePKISource{key: "pki.blocklist_url"},
+		saved:     map[string]remotePKISaved{},
+	}
+
+	conf, err := newRemotePKIConfig(l, c)
+	if err != nil {
+		return nil, err
+	}
+	r.conf.Store(conf)
+
+	if conf.statePath == "" {
+		l.Warn("pki.url_state is not set, a restart accepts remote pki payloads older than the last accepted")
+	} else if b, err := os.ReadFile(conf.statePath); err == nil {
+		if err := json.Unmarshal(b, &r.saved); err != nil {
+			return nil, util.NewContextualError("Failed to parse pki.url_state", m{"path": conf.statePath}, err)
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, util.NewContextualError("Failed to read pki.url_state", m{"path": conf.statePath}, err)
+	}
+
+	c.RegisterReloadTransaction(r.prepareReload)
+	return r, nil
+}
+
+func newRemotePKIConfig(l *logrus.Logger, c *config.C) (*remotePKIConfig, error) {
+	anchors, err := loadCAPoolFromConfig(l, c)
+	if err != nil {
+		return nil, util.NewContextualError("Failed to load ca from config", nil, err)
+	}
+
+	interval := c.GetDuration("pki.url_interval", defaultRemotePKIInterval)
+	if interval <= 0 {
+		interval = defaultRemotePKIInterval
+	}
+
+	return &remotePKIConfig{
+		caURL:        c.GetString("pki.ca_url", ""),
+		blocklistURL: c.GetString("pki.blocklist_url", ""),
+		interval:     interval,
+		statePath:    c.GetString("pki.url_state", ""),
+		anchors:      anchors,
+	}, nil
+}
+
+// prepareReload snapshots the new config for the poller
+func (r *remotePKI) prepareReload(c *config.C) (*config.ReloadStage, error) {
+	conf, err := newRemotePKIConfig(r.l, c)
+	if err != nil {
+		return nil, err
+	}
+
+	old := r.conf.Load()
+	return &config.ReloadStage{
+		Commit: func() error {
+			r.conf.Store(conf)
+			return nil
+		},
+		Rollback: func() {
+			r.conf.Store(old)
+		},
+	}, nil
+}
+
+// Start polls now and then every pki.url_interval until ctx is done. This is a non blocking call.
+func (r *remotePKI) Start(ctx context.Context) {
+	go func() {
+		for {
+			r.poll(ctx)
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(r.conf.Load().interval):
+			}
+		}
+	}()
+}
+
+// poll fetches both sources and installs a new ca pool if either changed
+func (r *remotePKI) poll(ctx context.Context) {
+	conf := r.conf.Load()
+	caTimestamp, blocklistTimestamp := r.ca.timestamp, r.blocklist.timestamp
+	caChanged := r.fetch(ctx, &r.ca, conf.caURL, conf.anchors)
+	blocklistChanged := r.fetch(ctx, &r.blocklist, conf.blocklistURL, conf.anchors)
+
+	if !r.ca.timestamp.Equal(caTimestamp) || !r.blocklist.timestamp.Equal(blocklistTimestamp) {
+		r.saveState(conf.statePath)
+	}
+
+	if !caChanged && !blocklistChanged {
+		return
+	}
+
+	state := &remotePKIState{caPEM: r.ca.payload}
+	if r.blocklist.payload != nil {
+		state.blocklist = parseRemoteBlocklist(r.blocklist.payload)
+	}
+
+	if len(state.caPEM) > 0 {
+		if _, err := cert.NewCAPoolFromBytes(state.caPEM); err != nil && !errors.Is(err, cert.ErrExpired) {
+			r.l.WithError(err).WithField("url", r.ca.url).Error("Remote ca bundle is invalid, ignoring it")
+			state.caPEM = nil
+		}
+	}
+
+	// The pool is rebuilt from the config under the reload lock, a reload can not drop the update or install a pool
+	// built from the previous remote state after it
+	err := r.c.Transact(func(c *config.C) (*config.ReloadStage, error) {
+		return r.pki.prepareRemote(c, state)
+	})
+	if err != nil {
+		r.l.WithError(err).Error("Failed to install the remote pki update")
+		return
+	}
+
+	r.l.WithField("fingerprints", r.pki.GetCAPool().GetFingerprints()).WithField("blocklisted", len(state.blocklist)).
+		Info("Trusted CAs refreshed from remote")
+}
+
+// fetch requests url and returns true if a new payload was accepted
+func (r *remotePKI) fetch(ctx context.Context, s *remotePKISource, url string, anchors *cert.NebulaCAPool) bool {
+	if url != s.url {
+		// Changed by a reload, forget everything about the old url
+		changed := s.payload != nil
+		*s = remotePKISource{key: s.key, url: url}
+		if saved, ok := r.saved[s.key]; ok && saved.URL == url {
+			s.timestamp = time.Unix(saved.Timestamp, 0)
+		}
+		if url == "" {
+			return changed
+		}
+	}
+
+	if url == "" {
+		return false
+	}
+
+	now := time.Now()
+	if s.payload != nil && now.After(s.notAfter) {
+		r.l.WithField("url", url).WithField("notAfter", s.notAfter).
+			Warnf("The accepted %s payload has expired and was not replaced", s.key)
+	}
+
+	sp, etag, err := r.get(ctx, url, s.etag)
+	if err != nil {
+		r.l.WithError(err).WithField("url", url).Warnf("Failed to fetch %s", s.key)
+		return false
+	}
+
+	if sp == nil {
+		// Not modified
+		return false
+	}
+
+	if err := anchors.VerifySignedPayload(now, sp); err != nil {
+		r.l.WithError(err).WithField("url", url).WithField("issuer", sp.Issuer).Warnf("Refusing unverified %s payload", s.key)
+		return false
+	}
+
+	if sp.Timestamp.Before(s.timestamp) {
+		r.l.WithField("url", url).WithField("timestamp", sp.Timestamp).WithField("accepted", s.timestamp).
+			Warnf("Refusing %s payload older than the last accepted", s.key)
+		return false
+	}
+
+	s.etag = etag
+	s.timestamp = sp.Timestamp
+	s.notAfter = sp.NotAfter
+	if bytes.Equal(s.payload, sp.Payload) && s.payload != nil {
+		return false
+	}
+
+	s.payload = sp.Payload
+	return true
+}
+
+// saveState writes the last accepted timestamps to pki.url_state
+func (r *remotePKI) saveState(path string) {
+	if path == "" {
+		return
+	}
+
+	for _, s := range []*remotePKISource{&r.ca, &r.blocklist} {
+		if s.url != "" && !s.timestamp.IsZero() {
+			r.saved[s.key] = remotePKISaved{URL: s.url, Timestamp: s.timestamp.Unix()}
+		}
+	}
+
+	b, err := json.Marshal(r.saved)
+	if err != nil {
+		r.l.WithError(err).Error("Failed to marshal pki.url_state")
+		return
+	}
+
+	// Replace the file in one step so a crash can not leave it empty
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0600); err != nil {
+		r.l.WithError(err).WithField("path", path).Error("Failed to write pki.url_state")
+		return
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		r.l.WithError(err).WithField("path", path).Error("Failed to write pki.url_state")
+	}
+}
+
+// get returns the signed payload at url, or nil if it has not changed since etag
+func (r *remotePKI) get(ctx context.Context, url, etag string) (*cert.SignedPayload, string, error) {
+	ctx, cancel := context.WithTimeout(ctx, time.Minute)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if etag != "" {
+		req.Header.Set("If-None-Match", etag)
+	}
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotModified {
+		return nil, etag, nil
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", fmt.Errorf("unexpected response: %s", resp.Status)
+	}
+
+	b, err := io.ReadAll(io.LimitReader(resp.Body, maxRemotePKISize))
+	if err != nil {
+		return nil, "", err
+	}
+
+	sp, _, err := cert.UnmarshalSignedPayloadFromPEM(b)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return sp, resp.Header.Get("ETag"), nil
+}
+
+// parseRemoteBlocklist reads one fingerprint per line, blank lines and lines starting with # are ignored
+func parseRemoteBlocklist(b []byte) []string {
+	var fps []string
+	s := bufio.NewScanner(bytes.NewReader(b))
+	for s.Scan() {
+		line := bytes.TrimSpace(s.Bytes())
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+		fps = append(fps, string(line))
+	}
+	return fps
+}
@@ -0,0 +1,180 @@
+package nebula
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/slackhq/nebula/cert"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ed25519"
+)
+
+func newRemotePKITestCA(t *testing.T, name string) (*cert.NebulaCertificate, []byte, string) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	ca := &cert.NebulaCertificate{
+		Details: cert.NebulaCertificateDetails{
+			Name:      name,
+			NotBefore: time.Now().Add(-time.Minute),
+			NotAfter:  time.Now().Add(time.Hour),
+			PublicKey: pub,
+			IsCA:      true,
+		},
+	}
+	require.NoError(t, ca.Sign(cert.Curve_CURVE25519, priv))
+	fp, err := ca.Sha256Sum()
+	require.NoError(t, err)
+	return ca, priv, fp
+}
+
+// remotePKITestServer serves whatever payload is set for a path with etag support
+type remotePKITestServer struct {
+	sync.Mutex
+	payloads map[string][]byte
+	notMod   map[string]int
+}
+
+func (s *remotePKITestServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.Lock()
+	defer s.Unlock()
+
+	b, ok := s.payloads[r.URL.Path]
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	sum := sha256.Sum256(b)
+	etag := `"` + hex.EncodeToString(sum[:]) + `"`
+	if r.Header.Get("If-None-Match") == etag {
+		s.notMod[r.URL.Path]++
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	w.Header().Set("ETag", etag)
+	_, _ = w.Write(b)
+}
+
+func (s *remotePKITestServer) set(path string, b []byte) {
+	s.Lock()
+	s.payloads[path] = b
+	s.Unlock()
+}
+
+func TestRemotePKI(t *testing.T) {
+	l := test.NewLogger()
+	ca, caKey, caFp := newRemotePKITestCA(t, "ca")
+	newCA, _, newCAFp := newRemotePKITestCA(t, "new-ca")
+	rogueCA, rogueKey, _ := newRemotePKITestCA(t, "rogue")
+
+	caPEM, _ := ca.MarshalToPEM()
+	newCAPEM, _ := newCA.MarshalToPEM()
+	roguePEM, _ := rogueCA.MarshalToPEM()
+
+	s := &remotePKITestServer{payloads: map[string][]byte{}, notMod: map[string]int{}}
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	c := config.NewC(l)
+	c.Settings["pki"] = map[interface{}]interface{}{"ca": string(caPEM)}
+
+	pki := &PKI{l: l}
+	pool, err := loadCAPoolFromConfig(l, c)
+	require.NoError(t, err)
+	pki.caPool.Store(pool)
+
+	// Nothing to do without a url
+	r, err := newRemotePKIFromConfig(l, pki, c)
+	require.NoError(t, err)
+	assert.Nil(t, r)
+
+	statePath := filepath.Join(t.TempDir(), "url_state")
+	c.Settings["pki"].(map[interface{}]interface{})["ca_url"] = ts.URL + "/ca"
+	c.Settings["pki"].(map[interface{}]interface{})["blocklist_url"] = ts.URL + "/blocklist"
+	c.Settings["pki"].(map[interface{}]interface{})["url_state"] = statePath
+	r, err = newRemotePKIFromConfig(l, pki, c)
+	require.NoError(t, err)
+	require.NotNil(t, r)
+	r.client = ts.Client()
+
+	now := time.Now()
+	sign := func(signer *cert.NebulaCertificate, key []byte, payload []byte, ts time.Time) []byte {
+		sp, err := cert.SignPayload(signer, key, payload, ts, ts.Add(time.Hour))
+		require.NoError(t, err)
+		return sp.MarshalToPEM()
+	}
+
+	// Payloads from unknown signers are ignored
+	s.set("/ca", sign(rogueCA, rogueKey, roguePEM, now))
+	r.poll(context.Background())
+	assert.Same(t, pool, pki.GetCAPool())
+
+	s.set("/ca", sign(ca, caKey, newCAPEM, now))
+	s.set("/blocklist", sign(ca, caKey, []byte("# revoked\nabc123\n\ndef456\n"), now))
+	r.poll(context.Background())
+	pool = pki.GetCAPool()
+	assert.ElementsMatch(t, []string{caFp, newCAFp}, pool.GetFingerprints())
+	rs := pki.remote.Load()
+	require.NotNil(t, rs)
+	assert.Equal(t, []string{"abc123", "def456"}, rs.blocklist)
+
+	// Unchanged sources are served from the etag and do not rebuild the pool
+	r.poll(context.Background())
+	assert.Same(t, pool, pki.GetCAPool())
+	assert.Equal(t, 1, s.notMod["/ca"])
+	assert.Equal(t, 1, s.notMod["/blocklist"])
+
+	// Older payloads are refused so a stale blocklist can not be replayed
+	s.set("/blocklist", sign(ca, caKey, []byte("abc123\n"), now.Add(-time.Minute)))
+	r.poll(context.Background())
+	assert.Same(t, pool, pki.GetCAPool())
+	assert.Equal(t, []string{"abc123", "def456"}, pki.remote.Load().blocklist)
+
+	// Even after a restart, the last accepted timestamps are kept in pki.url_state
+	restarted, err := newRemotePKIFromConfig(l, &PKI{l: l}, c)
+	require.NoError(t, err)
+	restarted.client = ts.Client()
+	restarted.poll(context.Background())
+	assert.Nil(t, restarted.blocklist.payload)
+	assert.Equal(t, now.Unix(), restarted.blocklist.timestamp.Unix())
+
+	// Expired payloads are refused
+	s.set("/blocklist", sign(ca, caKey, []byte("abc123\n"), now.Add(-time.Hour*2)))
+	restarted.saved = map[string]remotePKISaved{}
+	restarted.blocklist = remotePKISource{key: "pki.blocklist_url"}
+	restarted.poll(context.Background())
+	assert.Nil(t, restarted.blocklist.payload)
+
+	// A config reload keeps the remote state
+	reloaded, err := loadCAPoolFromConfig(l, c)
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{caFp, newCAFp}, pki.applyRemote(reloaded).GetFingerprints())
+
+	// Removing the url drops what it provided once the reload commits
+	delete(c.Settings["pki"].(map[interface{}]interface{}), "ca_url")
+	r.poll(context.Background())
+	assert.ElementsMatch(t, []string{caFp, newCAFp}, pki.GetCAPool().GetFingerprints())
+	stage, err := r.prepareReload(c)
+	require.NoError(t, err)
+	require.NoError(t, stage.Commit())
+	r.poll(context.Background())
+	assert.Equal(t, []string{caFp}, pki.GetCAPool().GetFingerprints())
+	assert.Equal(t, []string{"abc123", "def456"}, pki.remote.Load().blocklist)
+}
+
+func TestParseRemoteBlocklist(t *testing.T) {
+	assert.Nil(t, parseRemoteBlocklist(nil))
+	assert.Equal(t, []string{"a", "b"}, parseRemoteBlocklist([]byte(" a \n#c\n\r\nb")))
+}
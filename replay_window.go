@@ -0,0 +1,78 @@
+package nebula
+
+import (
+	"fmt"
+
+	"github.com/flynn/noise"
+	"github.com/slackhq/nebula/config"
+)
+
+const (
+	// minReplayWindow keeps the window wide enough for ordinary reordering
+	minReplayWindow = 64
+	// maxReplayWindow bounds the memory a tunnel can use for its window, one byte per packet
+	maxReplayWindow = 1 << 16
+)
+
+// replayWindowConfig is the size of the anti-replay window of new tunnels. With maxSize set each tunnel starts at size
+// and doubles its window, up to maxSize, whenever an authenticated packet arrives just behind it. A nil
+// replayWindowConfig is a fixed window of ReplayWindow packets.
+type replayWindowConfig struct {
+	size    uint64
+	maxSize uint64
+}
+
+func newReplayWindowConfigFromConfig(c *config.C) (*replayWindowConfig, error) {
+	size := c.GetInt("replay_window.size", ReplayWindow)
+	if size < minReplayWindow || size > maxReplayWindow {
+		return nil, fmt.Errorf("replay_window.size must be between %d and %d", minReplayWindow, maxReplayWindow)
+	}
+
+	maxSize := c.GetInt("replay_window.max_size", 0)
+	if maxSize != 0 && (maxSize < size || maxSize > maxReplayWindow) {
+		return nil, fmt.Errorf("replay_window.max_size must be 0 or between replay_window.size and %d", maxReplayWindow)
+	}
+
+	if size == ReplayWindow && maxSize == 0 {
+		return nil, nil
+	}
+
+	return &replayWindowConfig{size: uint64(size), maxSize: uint64(maxSize)}, nil
+}
+
+func (r *replayWindowConfig) newBits() *Bits {
+	if r == nil {
+		return NewBits(ReplayWindow)
+	}
+	return NewAdaptiveBits(r.size, r.maxSize)
+}
+
+// newConnectionState is NewConnectionState for an IX handshake with the replay window from our config
+func (f *Interface) newConnectionState(cipher string, certState *CertState, initiator bool, psk []byte, pskStage int) *ConnectionState {
+	ci := NewConnectionState(f.l, cipher, certState, initiator, noise.HandshakeIX, psk, pskStage)
+	if ci != nil {
+		ci.window = f.replayWindow.Load().newBits()
+		// Clear out bit 0, we never transmit it and we don't want it showing as packet loss
+		ci.window.Update(f.l, 0)
+	}
+	return ci
+}
+
+func (f *Interface) reloadReplayWindow(c *config.C) {
+	if !c.InitialLoad() && !c.HasChanged("replay_window") {
+		return
+	}
+
+	r, err := newReplayWindowConfigFromConfig(c)
+	if err != nil {
+		f.l.WithError(err).Error("Failed to load replay_window, keeping the previous one")
+		return
+	}
+
+	f.replayWindow.Store(r)
+	if r != nil {
+		f.l.WithField("size", r.size).WithField("maxSize", r.maxSize).Info("New tunnels use a custom replay window")
+	} else if !c.InitialLoad() {
+		f.l.Info("New tunnels use the default replay window")
+	}
+}
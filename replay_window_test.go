@@ -0,0 +1,38 @@
+package nebula
+
+import (
+	"testing"
+
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewReplayWindowConfigFromConfig(t *testing.T) {
+	l := test.NewLogger()
+	c := config.NewC(l)
+
+	r, err := newReplayWindowConfigFromConfig(c)
+	require.NoError(t, err)
+	assert.Nil(t, r)
+	assert.EqualValues(t, ReplayWindow, r.newBits().length)
+
+	c.Settings["replay_window"] = map[interface{}]interface{}{"size": 4096, "max_size": 16384}
+	r, err = newReplayWindowConfigFromConfig(c)
+	require.NoError(t, err)
+	assert.Equal(t, &replayWindowConfig{size: 4096, maxSize: 16384}, r)
+	b := r.newBits()
+	assert.EqualValues(t, 4096, b.length)
+	assert.EqualValues(t, 16384, b.maxLength)
+
+	tests := map[string]map[interface{}]interface{}{
+		"replay_window.size must be between 64 and 65536":                          {"size": 10},
+		"replay_window.max_size must be 0 or between replay_window.size and 65536": {"size": 4096, "max_size": 1024},
+	}
+	for expected, v := range tests {
+		c.Settings["replay_window"] = v
+		_, err = newReplayWindowConfigFromConfig(c)
+		assert.EqualError(t, err, expected)
+	}
+}
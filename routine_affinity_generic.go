@@ -0,0 +1,11 @@
+//go:build !linux
+// +build !linux
+
+package nebula
+
+import "errors"
+
+// pinThread is not supported, only the hostmap caches of pin_routines are used
+func pinThread(_ int) (int, error) {
+	return -1, errors.New("pinning threads to a cpu is not supported on this platform")
+}
@@ -0,0 +1,28 @@
+package nebula
+
+import "golang.org/x/sys/unix"
+
+// pinThread pins the calling thread to cpu i, wrapping around the cpus we may run on. The caller must have locked the
+// goroutine to its thread.
+func pinThread(i int) (int, error) {
+	var set unix.CPUSet
+	if err := unix.SchedGetaffinity(0, &set); err != nil {
+		return -1, err
+	}
+
+	// Find the i'th cpu of the set
+	want := i % set.Count()
+	cpu, seen := 0, -1
+	for ; ; cpu++ {
+		if set.IsSet(cpu) {
+			seen++
+			if seen == want {
+				break
+			}
+		}
+	}
+
+	set.Zero()
+	set.Set(cpu)
+	return cpu, unix.SchedSetaffinity(0, &set)
+}
@@ -0,0 +1,90 @@
+package nebula
+
+import "github.com/slackhq/nebula/iputil"
+
+// Every routine reads its own tun queue and udp socket, the kernel keeps a flow on the same queue and the same socket
+// so the routine that handles a flow does not change. What the routines still share is the hostmap, whose lock every
+// packet takes to find its tunnel. With pin_routines each read loop keeps its own copy of the hostmap entries it has
+// used, it is thrown away whenever the hostmap changes and otherwise lets a packet find its tunnel without touching
+// memory another core writes. The loops of routine i are also pinned to cpu i so the flows the kernel steers to a
+// routine stay on one core, listen.bpf.cpu_steering does the same for the udp sockets.
+
+// routineHosts is one read loop's cache of the hostmap, it is not safe for concurrent use
+type routineHosts struct {
+	hostMap *HostMap
+	// gen is the hostmap generation the entries were read in
+	gen     uint64
+	vpnIps  map[iputil.VpnIp]*HostInfo
+	indexes map[uint32]*HostInfo
+}
+
+func newRoutineHosts(hm *HostMap) *routineHosts {
+	return &routineHosts{
+		hostMap: hm,
+		vpnIps:  map[iputil.VpnIp]*HostInfo{},
+		indexes: map[uint32]*HostInfo{},
+	}
+}
+
+// validate drops every entry if the hostmap has changed since they were read
+func (rh *routineHosts) validate() {
+	gen := rh.hostMap.gen.Load()
+	if gen == rh.gen {
+		return
+	}
+
+	clear(rh.vpnIps)
+	clear(rh.indexes)
+	rh.gen = gen
+}
+
+// QueryVpnIp returns the primary hostinfo for vpnIp like HostMap.QueryVpnIp
+func (rh *routineHosts) QueryVpnIp(vpnIp iputil.VpnIp) *HostInfo {
+	rh.validate()
+	if h, ok := rh.vpnIps[vpnIp]; ok {
+		return h
+	}
+
+	rh.hostMap.RLock()
+	h := rh.hostMap.unlockedQueryVpnIp(vpnIp)
+	gen := rh.hostMap.gen.Load()
+	rh.hostMap.RUnlock()
+
+	// Misses are not kept, a handshake is about to add the host. A change since validate means h may already be stale.
+	if h != nil && gen == rh.gen {
+		rh.vpnIps[vpnIp] = h
+	}
+	return h
+}
+
+// QueryIndex returns the hostinfo for our local index like HostMap.QueryIndex
+func (rh *routineHosts) QueryIndex(index uint32) *HostInfo {
+	rh.validate()
+	if h, ok := rh.indexes[index]; ok {
+		return h
+	}
+
+	rh.hostMap.RLock()
+	h := rh.hostMap.Indexes[index]
+	gen := rh.hostMap.gen.Load()
+	rh.hostMap.RUnlock()
+
+	if h != nil && gen == rh.gen {
+		rh.indexes[index] = h
+	}
+	return h
+}
+
+// pinRoutine pins the calling read loop of routine i to its cpu if routines are pinned
+func (f *Interface) pinRoutine(i int, loop string) {
+	if !f.pinRoutines {
+		return
+	}
+
+	cpu, err := pinThread(i)
+	if err != nil {
+		f.l.WithError(err).WithField("routine", i).WithField("loop", loop).Warn("Failed to pin routine to a cpu")
+		return
+	}
+	f.l.WithField("routine", i).WithField("loop", loop).WithField("cpu", cpu).Debug("Pinned routine to a cpu")
+}
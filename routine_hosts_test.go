@@ -0,0 +1,51 @@
+package nebula
+
+import (
+	"net"
+	"testing"
+
+	"github.com/slackhq/nebula/iputil"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRoutineHosts(t *testing.T) {
+	l := test.NewLogger()
+	hm := newHostMap(l, &net.IPNet{IP: net.IP{10, 0, 0, 1}, Mask: net.IPMask{255, 255, 255, 0}})
+	f := &Interface{}
+	rh := newRoutineHosts(hm)
+
+	// Misses are not kept
+	assert.Nil(t, rh.QueryVpnIp(iputil.VpnIpFrom4(1)))
+	assert.Nil(t, rh.QueryIndex(1))
+	assert.Empty(t, rh.vpnIps)
+
+	h1 := &HostInfo{vpnIp: iputil.VpnIpFrom4(1), localIndexId: 1}
+	hm.Lock()
+	hm.unlockedAddHostInfo(h1, f)
+	hm.Unlock()
+
+	assert.Equal(t, h1, rh.QueryVpnIp(iputil.VpnIpFrom4(1)))
+	assert.Equal(t, h1, rh.QueryIndex(1))
+	assert.Len(t, rh.vpnIps, 1)
+	assert.Len(t, rh.indexes, 1)
+
+	// Hits do not need the hostmap
+	delete(hm.Hosts, iputil.VpnIpFrom4(1))
+	delete(hm.Indexes, 1)
+	assert.Equal(t, h1, rh.QueryVpnIp(iputil.VpnIpFrom4(1)))
+	assert.Equal(t, h1, rh.QueryIndex(1))
+
+	// A new primary invalidates the cache
+	h2 := &HostInfo{vpnIp: iputil.VpnIpFrom4(1), localIndexId: 2}
+	hm.Lock()
+	hm.unlockedAddHostInfo(h2, f)
+	hm.Unlock()
+	assert.Equal(t, h2, rh.QueryVpnIp(iputil.VpnIpFrom4(1)))
+	assert.Nil(t, rh.QueryIndex(1))
+	assert.Equal(t, h2, rh.QueryIndex(2))
+
+	hm.DeleteHostInfo(h2)
+	assert.Nil(t, rh.QueryVpnIp(iputil.VpnIpFrom4(1)))
+	assert.Nil(t, rh.QueryIndex(2))
+}
@@ -0,0 +1,199 @@
+package nebula
+
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/iputil"
+	"github.com/slackhq/nebula/overlay"
+)
+
+// With routing.learn enabled a host does not need tun.unsafe_routes for the networks gateways advertise, every interval
+// it asks the lighthouses which gateways serve which networks and routes each network through the gateway with the
+// lowest metric, the lowest vpn ip breaks a tie. A gateway the lighthouses stop reporting for 3 intervals is dropped and
+// its networks fail over to the next best gateway, or are removed if there is none.
+//
+// Learned routes are installed as runtime unsafe routes. A network that has an unsafe route we did not learn, from
+// tun.unsafe_routes or added over ssh, is left alone. Networks we advertise ourselves are never learned.
+
+const (
+	defaultRouteLearnInterval = 15 * time.Second
+)
+
+type routeLearner struct {
+	l        *logrus.Logger
+	f        *Interface
+	interval time.Duration
+	mtu      int
+
+	// learned are the routes we installed, by cidr
+	learned map[string]overlay.Route
+}
+
+func newRouteLearnerFromConfig(l *logrus.Logger, f *Interface, c *config.C) (*routeLearner, error) {
+	if !c.GetBool("routing.learn.enabled", false) {
+		return nil, nil
+	}
+
+	rl := &routeLearner{
+		l:        l,
+		f:        f,
+		interval: c.GetDuration("routing.learn.interval", defaultRouteLearnInterval),
+		mtu:      c.GetInt("routing.learn.mtu", 0),
+		learned:  make(map[string]overlay.Route),
+	}
+
+	if rl.interval <= 0 {
+		return nil, errors.New("routing.learn.interval must be greater than 0")
+	}
+	if rl.mtu != 0 && rl.mtu < 500 {
+		return nil, errors.New("routing.learn.mtu must be at least 500")
+	}
+
+	return rl, nil
+}
+
+// Start asks the lighthouses for routes every interval until ctx is done. This is a non blocking call.
+func (rl *routeLearner) Start(ctx context.Context) {
+	rm, err := rl.f.unsafeRouteManager()
+	if err != nil {
+		rl.l.WithError(err).Error("routing.learn is enabled but routes can not be installed")
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(rl.interval)
+		defer ticker.Stop()
+
+		rl.f.lightHouse.SendRouteQuery()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				rl.update(rm)
+				rl.f.lightHouse.SendRouteQuery()
+			}
+		}
+	}()
+}
+
+// update installs, moves and removes learned routes to match what the lighthouses told us
+func (rl *routeLearner) update(rm overlay.UnsafeRouteManager) {
+	lh := rl.f.lightHouse
+	ttl := 3 * rl.interval
+	if lh.amLighthouse {
+		ttl = routeAdvertTTL
+	}
+
+	best := rl.pick(lh.GetRouteAdverts(ttl))
+
+	others := map[string]struct{}{}
+	for _, r := range rm.UnsafeRoutes() {
+		k := r.Cidr.String()
+		if l, ok := rl.learned[k]; !ok || *l.Via != *r.Via {
+			others[k] = struct{}{}
+		}
+	}
+
+	// Withdrawn networks, a network that moved to another gateway is replaced below
+	for k, r := range rl.learned {
+		if _, ok := best[k]; ok {
+			continue
+		}
+
+		delete(rl.learned, k)
+		if _, ok := others[k]; ok {
+			// Someone else replaced our route, it is theirs now
+			continue
+		}
+
+		if err := rm.RemoveUnsafeRoutes([]*net.IPNet{r.Cidr}); err != nil {
+			rl.l.WithError(err).WithField("route", k).Error("Failed to remove a learned route")
+			continue
+		}
+		rl.l.WithField("route", k).WithField("gateway", *r.Via).Info("Learned route was withdrawn")
+	}
+
+	for k, r := range best {
+		if l, ok := rl.learned[k]; ok && *l.Via == *r.Via {
+			continue
+		}
+
+		if _, ok := others[k]; ok {
+			delete(rl.learned, k)
+			if rl.l.Level >= logrus.DebugLevel {
+				rl.l.WithField("route", k).Debug("Not installing a learned route over an existing unsafe route")
+			}
+			continue
+		}
+
+		if err := rm.AddUnsafeRoutes([]overlay.Route{r}); err != nil {
+			rl.l.WithError(err).WithField("route", k).WithField("gateway", *r.Via).Error("Failed to install a learned route")
+			continue
+		}
+
+		rl.learned[k] = r
+		rl.l.WithField("route", k).WithField("gateway", *r.Via).Info("Learned route through gateway")
+	}
+}
+
+// pick returns the route through the best gateway for each advertised network, by cidr
+func (rl *routeLearner) pick(adverts map[iputil.VpnIp][]routeAdvert) map[string]overlay.Route {
+	myRoutes := map[string]struct{}{}
+	if routes := rl.f.lightHouse.routeAdvertise.Load(); routes != nil {
+		for _, r := range *routes {
+			myRoutes[r.cidr.String()] = struct{}{}
+		}
+	}
+
+	type candidate struct {
+		gateway iputil.VpnIp
+		advert  routeAdvert
+	}
+
+	best := map[string]candidate{}
+	for gateway, routes := range adverts {
+		if rl.f.isMyVpnIp(gateway) {
+			continue
+		}
+
+		for _, r := range routes {
+			k := r.cidr.String()
+			if _, ok := myRoutes[k]; ok || rl.overlapsMyNetworks(r.cidr) {
+				continue
+			}
+
+			b, ok := best[k]
+			if !ok || r.metric < b.advert.metric || (r.metric == b.advert.metric && gateway.Compare(b.gateway) < 0) {
+				best[k] = candidate{gateway: gateway, advert: r}
+			}
+		}
+	}
+
+	picked := make(map[string]overlay.Route, len(best))
+	for k, b := range best {
+		via := b.gateway
+		picked[k] = overlay.Route{Cidr: b.advert.cidr, Via: &via, MTU: rl.mtu, Install: true}
+	}
+	return picked
+}
+
+// overlapsMyNetworks returns true if cidr overlaps a network in our certificate, an unsafe route can not
+func (rl *routeLearner) overlapsMyNetworks(cidr *net.IPNet) bool {
+	p, err := iputil.ToNetIpPrefix(*cidr)
+	if err != nil {
+		return true
+	}
+
+	for _, n := range rl.f.lightHouse.myVpnNets {
+		if n.Overlaps(p) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,129 @@
+package nebula
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/iputil"
+	"github.com/slackhq/nebula/overlay"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testRouteManager keeps unsafe routes in a map like a device with runtime unsafe routes
+type testRouteManager struct {
+	routes map[string]overlay.Route
+}
+
+func (rm *testRouteManager) AddUnsafeRoutes(routes []overlay.Route) error {
+	for _, r := range routes {
+		rm.routes[r.Cidr.String()] = r
+	}
+	return nil
+}
+
+func (rm *testRouteManager) RemoveUnsafeRoutes(cidrs []*net.IPNet) error {
+	for _, n := range cidrs {
+		if _, ok := rm.routes[n.String()]; !ok {
+			return fmt.Errorf("there is no unsafe route for %s", n)
+		}
+		delete(rm.routes, n.String())
+	}
+	return nil
+}
+
+func (rm *testRouteManager) UnsafeRoutes() []overlay.Route {
+	routes := make([]overlay.Route, 0, len(rm.routes))
+	for _, r := range rm.routes {
+		routes = append(routes, r)
+	}
+	sort.Slice(routes, func(i, j int) bool { return routes[i].Cidr.String() < routes[j].Cidr.String() })
+	return routes
+}
+
+// via returns the gateway of each route by cidr
+func (rm *testRouteManager) via() map[string]iputil.VpnIp {
+	vias := map[string]iputil.VpnIp{}
+	for k, r := range rm.routes {
+		vias[k] = *r.Via
+	}
+	return vias
+}
+
+func TestNewRouteLearnerFromConfig(t *testing.T) {
+	l := test.NewLogger()
+	c := config.NewC(l)
+
+	rl, err := newRouteLearnerFromConfig(l, nil, c)
+	require.NoError(t, err)
+	assert.Nil(t, rl)
+
+	c.Settings["routing"] = map[interface{}]interface{}{"learn": map[interface{}]interface{}{"enabled": true}}
+	rl, err = newRouteLearnerFromConfig(l, nil, c)
+	require.NoError(t, err)
+	assert.Equal(t, defaultRouteLearnInterval, rl.interval)
+
+	c.Settings["routing"] = map[interface{}]interface{}{"learn": map[interface{}]interface{}{"enabled": true, "interval": "0s"}}
+	_, err = newRouteLearnerFromConfig(l, nil, c)
+	assert.EqualError(t, err, "routing.learn.interval must be greater than 0")
+
+	c.Settings["routing"] = map[interface{}]interface{}{"learn": map[interface{}]interface{}{"enabled": true, "mtu": 100}}
+	_, err = newRouteLearnerFromConfig(l, nil, c)
+	assert.EqualError(t, err, "routing.learn.mtu must be at least 500")
+}
+
+func TestRouteLearner_update(t *testing.T) {
+	l := test.NewLogger()
+	myVpnNet := &net.IPNet{IP: net.IP{10, 128, 0, 3}, Mask: net.IPMask{255, 255, 255, 0}}
+	me := iputil.Ip2VpnIp(myVpnNet.IP)
+	gw1 := iputil.Ip2VpnIp(net.IP{10, 128, 0, 1})
+	gw2 := iputil.Ip2VpnIp(net.IP{10, 128, 0, 2})
+	_, served, _ := net.ParseCIDR("10.50.0.0/16")
+	_, other, _ := net.ParseCIDR("10.60.0.0/16")
+	_, mine, _ := net.ParseCIDR("10.128.0.0/16")
+
+	c := config.NewC(l)
+	lh, err := NewLightHouseFromConfig(context.Background(), l, c, []*net.IPNet{myVpnNet}, nil, nil)
+	require.NoError(t, err)
+
+	rl := &routeLearner{
+		l:        l,
+		f:        &Interface{lightHouse: lh, myVpnIps: []iputil.VpnIp{me}},
+		interval: time.Minute,
+		learned:  map[string]overlay.Route{},
+	}
+	rm := &testRouteManager{routes: map[string]overlay.Route{}}
+
+	// The lowest metric wins, then the lowest vpn ip. Networks overlapping ours and our own adverts are ignored
+	lh.setRouteAdvert(gw1, []routeAdvert{{cidr: served, metric: 10}, {cidr: mine, metric: 1}})
+	lh.setRouteAdvert(gw2, []routeAdvert{{cidr: served, metric: 5}, {cidr: other, metric: 10}})
+	lh.setRouteAdvert(me, []routeAdvert{{cidr: other, metric: 1}})
+	rl.update(rm)
+	assert.Equal(t, map[string]iputil.VpnIp{"10.50.0.0/16": gw2, "10.60.0.0/16": gw2}, rm.via())
+
+	// gw2 goes away, its networks fail over to gw1 or are withdrawn
+	lh.deleteRouteAdvert(gw2)
+	rl.update(rm)
+	assert.Equal(t, map[string]iputil.VpnIp{"10.50.0.0/16": gw1}, rm.via())
+
+	// A route we did not learn is left alone
+	lh.setRouteAdvert(gw2, []routeAdvert{{cidr: other, metric: 10}})
+	rm.routes["10.60.0.0/16"] = overlay.Route{Cidr: other, Via: &gw1, Install: true}
+	rl.update(rm)
+	assert.Equal(t, map[string]iputil.VpnIp{"10.50.0.0/16": gw1, "10.60.0.0/16": gw1}, rm.via())
+
+	lh.deleteRouteAdvert(gw2)
+	rl.update(rm)
+	assert.Equal(t, map[string]iputil.VpnIp{"10.50.0.0/16": gw1, "10.60.0.0/16": gw1}, rm.via())
+
+	// Everything we learned is removed once nothing is advertised
+	lh.deleteRouteAdvert(gw1)
+	rl.update(rm)
+	assert.Equal(t, map[string]iputil.VpnIp{"10.60.0.0/16": gw1}, rm.via())
+}
@@ -0,0 +1,98 @@
+package nebula
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	defaultPendingDeletionMin = time.Second
+	defaultPendingDeletionMax = 30 * time.Second
+)
+
+// adaptiveTimeout bounds how long the connection manager waits for a test packet reply when the wait is derived from
+// the measured round trip time of a tunnel. The floor keeps a single slow reply on a fast link from tearing the
+// tunnel down, the ceiling keeps a dead tunnel on a slow link from lingering.
+type adaptiveTimeout struct {
+	min time.Duration
+	max time.Duration
+}
+
+// rttEstimator tracks the smoothed round trip time and its variation for a tunnel as described in RFC 6298. Samples
+// come from the test packets the connection manager sends when probing a tunnel.
+type rttEstimator struct {
+	sync.Mutex
+	srtt      time.Duration
+	rttvar    time.Duration
+	samples   uint32
+	probeSent time.Time
+}
+
+// sent records that a probe went out at now, only the reply to the most recent probe is measured
+func (r *rttEstimator) sent(now time.Time) {
+	r.Lock()
+	r.probeSent = now
+	r.Unlock()
+}
+
+// acked records the reply to an outstanding probe. Replies without an outstanding probe, like those to the test
+// packets sent while roaming, are ignored.
+func (r *rttEstimator) acked(now time.Time) {
+	r.Lock()
+	defer r.Unlock()
+
+	if r.probeSent.IsZero() {
+		return
+	}
+
+	sample := now.Sub(r.probeSent)
+	r.probeSent = time.Time{}
+	if sample < 0 {
+		return
+	}
+
+	r.observe(sample)
+}
+
+// observe folds a sample into the estimate, the lock must be held
+func (r *rttEstimator) observe(sample time.Duration) {
+	if r.samples == 0 {
+		r.srtt = sample
+		r.rttvar = sample / 2
+
+	} else {
+		delta := r.srtt - sample
+		if delta < 0 {
+			delta = -delta
+		}
+		// rttvar = 3/4 rttvar + 1/4 |srtt - sample|, srtt = 7/8 srtt + 1/8 sample
+		r.rttvar = (3*r.rttvar + delta) / 4
+		r.srtt = (7*r.srtt + sample) / 8
+	}
+
+	r.samples++
+}
+
+// get returns the smoothed round trip time, its variation, and how many samples it was built from
+func (r *rttEstimator) get() (time.Duration, time.Duration, uint32) {
+	r.Lock()
+	defer r.Unlock()
+	return r.srtt, r.rttvar, r.samples
+}
+
+// timeout returns how long to wait for a probe reply, fallback is used until there is at least one sample
+func (r *rttEstimator) timeout(bounds *adaptiveTimeout, fallback time.Duration) time.Duration {
+	srtt, rttvar, samples := r.get()
+	if bounds == nil || samples == 0 {
+		return fallback
+	}
+
+	t := srtt + 4*rttvar
+	if t < bounds.min {
+		return bounds.min
+	}
+	if t > bounds.max {
+		return bounds.max
+	}
+	return t
+}
@@ -0,0 +1,59 @@
+package nebula
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRttEstimator(t *testing.T) {
+	r := &rttEstimator{}
+	bounds := &adaptiveTimeout{min: time.Second, max: 30 * time.Second}
+
+	// No samples uses the fallback
+	assert.Equal(t, 10*time.Second, r.timeout(bounds, 10*time.Second))
+
+	// Replies without an outstanding probe are ignored
+	now := time.Now()
+	r.acked(now)
+	_, _, samples := r.get()
+	assert.Equal(t, uint32(0), samples)
+
+	r.sent(now)
+	r.acked(now.Add(2 * time.Second))
+	srtt, rttvar, samples := r.get()
+	assert.Equal(t, 2*time.Second, srtt)
+	assert.Equal(t, time.Second, rttvar)
+	assert.Equal(t, uint32(1), samples)
+	assert.Equal(t, 6*time.Second, r.timeout(bounds, 10*time.Second))
+
+	// Only one reply is measured per probe
+	r.acked(now.Add(5 * time.Second))
+	_, _, samples = r.get()
+	assert.Equal(t, uint32(1), samples)
+
+	r.sent(now)
+	r.acked(now.Add(time.Second))
+	srtt, rttvar, _ = r.get()
+	assert.Equal(t, 1875*time.Millisecond, srtt)
+	assert.Equal(t, time.Second, rttvar)
+
+	// Without bounds the fallback is always used
+	assert.Equal(t, 10*time.Second, r.timeout(nil, 10*time.Second))
+
+	// A fast link is held to the floor
+	lan := &rttEstimator{}
+	lan.Lock()
+	lan.observe(time.Millisecond)
+	lan.Unlock()
+	assert.Equal(t, time.Second, lan.timeout(bounds, 10*time.Second))
+
+	// A slow and jittery link is held to the ceiling
+	sat := &rttEstimator{}
+	sat.Lock()
+	sat.observe(5 * time.Second)
+	sat.observe(30 * time.Second)
+	sat.Unlock()
+	assert.Equal(t, 30*time.Second, sat.timeout(bounds, 10*time.Second))
+}
@@ -0,0 +1,69 @@
+package nebula
+
+import (
+	"github.com/slackhq/nebula/aesgcm"
+	"github.com/slackhq/nebula/header"
+	"github.com/slackhq/nebula/udp"
+)
+
+// sealQueue is a send batch whose aes packets are sealed together by aesgcm just before the batch is sent instead of
+// one at a time as they are written. It is not safe for concurrent use, like the batch.
+type sealQueue struct {
+	*udp.SendBatch
+	jobs []aesgcm.Job
+}
+
+// newSealQueue returns batch with a sealQueue in front of it, or nil when aesgcm can not seal several packets at once
+// on this cpu
+func newSealQueue(batch *udp.SendBatch) *sealQueue {
+	if !aesgcm.Available() || boringEnabled() {
+		return nil
+	}
+
+	q := &sealQueue{SendBatch: batch}
+	batch.Prepare = q.seal
+	return q
+}
+
+// sealQueuer is a writer that may have its packets sealed by a sealQueue
+type sealQueuer interface {
+	sealQueue() *sealQueue
+}
+
+// sealQueueOf returns the sealQueue behind w, if it has one
+func sealQueueOf(w udp.Conn) *sealQueue {
+	if s, ok := w.(sealQueuer); ok {
+		return s.sealQueue()
+	}
+	return nil
+}
+
+func (q *sealQueue) sealQueue() *sealQueue {
+	return q
+}
+
+// queue builds the packet for p in the slot of the batch it is sent from and leaves it to be sealed with the rest of
+// the batch. h is the encoded header, the packet is returned with room for the tag and must be written to the batch
+// before anything else is.
+func (q *sealQueue) queue(k *NebulaCipherState, h, p []byte, n uint64) []byte {
+	out := q.Next()
+	copy(out, h)
+	copy(out[header.Len:], p)
+
+	q.jobs = append(q.jobs, aesgcm.Job{
+		Key:  k.mb,
+		AD:   out[:header.Len],
+		Text: out[header.Len : header.Len+len(p)],
+	})
+	// The same nonce EncryptDanger would use
+	k.endianness.PutUint64(q.jobs[len(q.jobs)-1].Nonce[4:], n)
+	return out[:header.Len+len(p)+aesgcm.TagSize]
+}
+
+// seal seals every queued packet, it is the Prepare of the batch
+func (q *sealQueue) seal() {
+	aesgcm.Seal(q.jobs)
+	// Drop the references to the keys, they may belong to tunnels that are gone by the next batch
+	clear(q.jobs)
+	q.jobs = q.jobs[:0]
+}
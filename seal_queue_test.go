@@ -0,0 +1,92 @@
+package nebula
+
+import (
+	"net"
+	"strconv"
+	"testing"
+
+	"github.com/slackhq/nebula/aesgcm"
+	"github.com/slackhq/nebula/firewall"
+	"github.com/slackhq/nebula/header"
+	"github.com/slackhq/nebula/udp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// copyConn keeps a copy of every packet sent through it
+type copyConn struct {
+	udp.NoopConn
+	sent [][]byte
+}
+
+func (c *copyConn) WriteBatch(bufs [][]byte, _ []*udp.Addr, _ []byte) error {
+	for _, b := range bufs {
+		c.sent = append(c.sent, append([]byte(nil), b...))
+	}
+	return nil
+}
+
+func TestSealQueue(t *testing.T) {
+	if !aesgcm.Available() {
+		t.Skip("aesgcm can not seal several packets at once on this cpu")
+	}
+
+	f, hostinfo := newLoopbackTunnel(t)
+	ci := hostinfo.ConnectionState
+	require.NotNil(t, ci.eKey.mb)
+
+	cc := &copyConn{}
+	q := newSealQueue(udp.NewSendBatch(cc, 4))
+	require.NotNil(t, q)
+	nb := make([]byte, 12, 12)
+
+	// Enough packets that the batch fills and is sent once before the final flush
+	var payloads [][]byte
+	for i, size := range []int{0, 1, 15, 16, 100, 1300, 33} {
+		p := make([]byte, size)
+		for j := range p {
+			p[j] = byte(i + j)
+		}
+		payloads = append(payloads, p)
+		f.sendNoMetricsTo(q, header.Message, 0, ci, hostinfo, nil, p, nb, q.Next())
+	}
+	assert.Len(t, cc.sent, 4)
+	require.NoError(t, q.Flush())
+	require.Len(t, cc.sent, len(payloads))
+
+	h := &header.H{}
+	for i, b := range cc.sent {
+		require.NoError(t, h.Parse(b))
+		assert.Equal(t, uint32(1000), h.RemoteIndex)
+		plain, err := ci.dKey.DecryptDanger(nil, b[:header.Len], b[header.Len:], h.MessageCounter, nb)
+		require.NoError(t, err, "packet %d", i)
+		assert.Equal(t, string(payloads[i]), string(plain))
+	}
+	assert.Empty(t, q.jobs)
+}
+
+// BenchmarkInsidePacketSealQueue is BenchmarkInsidePacketBatch with the packets sealed together when the batch is sent
+func BenchmarkInsidePacketSealQueue(b *testing.B) {
+	if !aesgcm.Available() {
+		b.Skip("aesgcm can not seal several packets at once on this cpu")
+	}
+
+	for _, size := range []int{64, 1300} {
+		b.Run(strconv.Itoa(size), func(b *testing.B) {
+			f, _ := newLoopbackTunnel(b)
+			packet := newUDPPacket(net.IP{10, 0, 0, 1}, net.IP{10, 0, 0, 2}, size)
+			fwPacket := &firewall.Packet{}
+			nb := make([]byte, 12, 12)
+			q := newSealQueue(udp.NewSendBatch(f.writers[0].(udp.BatchConn), 64))
+			cache := firewall.NewConntrackCacheTicker(0)
+
+			b.SetBytes(int64(len(packet)))
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				f.consumeInsidePacket(packet, fwPacket, nb, q.Next(), 0, q, nil, cache.Get(f.l))
+			}
+			require.NoError(b, q.Flush())
+		})
+	}
+}
@@ -3,6 +3,8 @@ package service
 import (
 	"io"
 	"net"
+
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
 )
 
 type tcpListener struct {
@@ -30,7 +32,26 @@ func (l *tcpListener) Close() error {
 	return nil
 }
 
+// accepts is true if a connection to ip is for this listener
+func (l *tcpListener) accepts(ip net.IP) bool {
+	return l.addr.IP == nil || l.addr.IP.IsUnspecified() || l.addr.IP.Equal(ip)
+}
+
 // Addr returns the listener's network address.
 func (l *tcpListener) Addr() net.Addr {
 	return l.addr
 }
+
+// udpConn fixes up the addresses given to WriteTo, netstack wants ipv4 addresses in their 4 byte form
+type udpConn struct {
+	*gonet.UDPConn
+}
+
+func (c *udpConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	if ua, ok := addr.(*net.UDPAddr); ok {
+		if ip4 := ua.IP.To4(); ip4 != nil && len(ua.IP) != net.IPv4len {
+			addr = &net.UDPAddr{IP: ip4, Port: ua.Port, Zone: ua.Zone}
+		}
+	}
+	return c.UDPConn.WriteTo(b, addr)
+}
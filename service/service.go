@@ -5,6 +5,7 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"io"
 	"log"
 	"math"
 	"net"
@@ -38,6 +39,11 @@ type Service struct {
 	control *nebula.Control
 	ipstack *stack.Stack
 
+	// networks are the vpn networks in our certificate, each of their ips is an address in ipstack
+	networks []*net.IPNet
+	// writer hands packets to nebula, one packet per write
+	writer *io.PipeWriter
+
 	mu struct {
 		sync.Mutex
 
@@ -45,14 +51,62 @@ type Service struct {
 	}
 }
 
-func New(config *config.C) (*Service, error) {
+// Options changes how a Service runs, the zero value gives the same service as New
+type Options struct {
+	// Logger receives the logs from nebula, one writing to stdout is made when nil
+	Logger *logrus.Logger
+	// BuildVersion is the version nebula reports, "custom-app" when empty
+	BuildVersion string
+
+	// OnTunnelEvent is called for handshake and tunnel lifecycle events, see nebula.Control.OnTunnelEvent
+	OnTunnelEvent func(nebula.TunnelEvent)
+	// OnPacket sees every packet nebula delivers to us before the network stack does, returning true keeps the packet
+	// from the stack. The packet is only valid until OnPacket returns.
+	OnPacket func(packet []byte) bool
+	// OnStop is called once after the service stopped, err is nil when it was stopped with Close
+	OnStop func(err error)
+}
+
+func (o Options) logger() *logrus.Logger {
+	if o.Logger != nil {
+		return o.Logger
+	}
+
 	logger := logrus.New()
 	logger.Out = os.Stdout
+	return logger
+}
+
+// New starts nebula with a user space network stack in place of a tun device, no privileges are needed. Connections
+// over nebula are made with DialContext, Listen and ListenPacket.
+func New(config *config.C) (*Service, error) {
+	return NewWithOptions(config, Options{})
+}
 
-	control, err := nebula.Main(config, false, "custom-app", logger, overlay.NewUserDeviceFromConfig)
+// NewFromBytes is NewWithOptions for a yaml config
+func NewFromBytes(b []byte, o Options) (*Service, error) {
+	o.Logger = o.logger()
+	c := config.NewC(o.Logger)
+	if err := c.LoadString(string(b)); err != nil {
+		return nil, err
+	}
+	return NewWithOptions(c, o)
+}
+
+// NewWithOptions is New with Options
+func NewWithOptions(config *config.C, o Options) (*Service, error) {
+	buildVersion := o.BuildVersion
+	if buildVersion == "" {
+		buildVersion = "custom-app"
+	}
+
+	control, err := nebula.Main(config, false, buildVersion, o.logger(), overlay.NewUserDeviceFromConfig)
 	if err != nil {
 		return nil, err
 	}
+	if o.OnTunnelEvent != nil {
+		control.OnTunnelEvent(o.OnTunnelEvent)
+	}
 	control.Start()
 
 	ctx := control.Context()
@@ -61,6 +115,7 @@ func New(config *config.C) (*Service, error) {
 		eg:      eg,
 		control: control,
 	}
+
 	s.mu.listeners = map[uint16]*tcpListener{}
 
 	device, ok := control.Device().(*overlay.UserDevice)
@@ -77,28 +132,36 @@ func New(config *config.C) (*Service, error) {
 	if tcpipErr != nil {
 		return nil, fmt.Errorf("could not enable TCP SACK: %v", tcpipErr)
 	}
-	linkEP := channel.New( /*size*/ 512 /*mtu*/, 1280, "")
+	linkEP := channel.New( /*size*/ 512, uint32(config.GetInt("tun.mtu", overlay.DefaultMTU)), "")
 	if tcpipProblem := s.ipstack.CreateNIC(nicID, linkEP); tcpipProblem != nil {
 		return nil, fmt.Errorf("could not create netstack NIC: %v", tcpipProblem)
 	}
+	// Everything goes to nebula, it picks the tunnel
 	ipv4Subnet, _ := tcpip.NewSubnet(tcpip.AddrFrom4([4]byte{0x00, 0x00, 0x00, 0x00}), tcpip.MaskFrom(strings.Repeat("\x00", 4)))
+	ipv6Subnet, _ := tcpip.NewSubnet(tcpip.AddrFrom16([16]byte{}), tcpip.MaskFrom(strings.Repeat("\x00", 16)))
 	s.ipstack.SetRouteTable([]tcpip.Route{
 		{
 			Destination: ipv4Subnet,
 			NIC:         nicID,
 		},
+		{
+			Destination: ipv6Subnet,
+			NIC:         nicID,
+		},
 	})
 
-	ipNet := device.Cidr()
-	pa := tcpip.ProtocolAddress{
-		AddressWithPrefix: tcpip.AddrFromSlice(ipNet.IP).WithPrefix(),
-		Protocol:          ipv4.ProtocolNumber,
-	}
-	if err := s.ipstack.AddProtocolAddress(nicID, pa, stack.AddressProperties{
-		PEB:        stack.CanBePrimaryEndpoint, // zero value default
-		ConfigType: stack.AddressConfigStatic,  // zero value default
-	}); err != nil {
-		return nil, fmt.Errorf("error creating IP: %s", err)
+	s.networks = device.Networks()
+	for _, ipNet := range s.networks {
+		pa := tcpip.ProtocolAddress{
+			AddressWithPrefix: stackAddr(ipNet.IP).WithPrefix(),
+			Protocol:          ipProtocol(ipNet.IP),
+		}
+		if err := s.ipstack.AddProtocolAddress(nicID, pa, stack.AddressProperties{
+			PEB:        stack.CanBePrimaryEndpoint, // zero value default
+			ConfigType: stack.AddressConfigStatic,  // zero value default
+		}); err != nil {
+			return nil, fmt.Errorf("error creating IP: %s", err)
+		}
 	}
 
 	const tcpReceiveBufferSize = 0
@@ -107,11 +170,13 @@ func New(config *config.C) (*Service, error) {
 	s.ipstack.SetTransportProtocolHandler(tcp.ProtocolNumber, tcpFwd.HandlePacket)
 
 	reader, writer := device.Pipe()
+	s.writer = writer
 
+	// Only unblock our reader, the writer belongs to the device and nebula closes it on shutdown. An EOF from it before
+	// nebula is marked closed would be taken as a device failure.
 	go func() {
 		<-ctx.Done()
 		reader.Close()
-		writer.Close()
 	}()
 
 	// create Goroutines to forward packets between Nebula and Gvisor
@@ -123,10 +188,20 @@ func New(config *config.C) (*Service, error) {
 			if err != nil {
 				return err
 			}
+			if n == 0 {
+				continue
+			}
+			if o.OnPacket != nil && o.OnPacket(buf[:n]) {
+				continue
+			}
+			proto := header.IPv4ProtocolNumber
+			if buf[0]>>4 == 6 {
+				proto = header.IPv6ProtocolNumber
+			}
 			packetBuf := stack.NewPacketBuffer(stack.PacketBufferOptions{
 				Payload: buffer.MakeWithData(bytes.Clone(buf[:n])),
 			})
-			linkEP.InjectInbound(header.IPv4ProtocolNumber, packetBuf)
+			linkEP.InjectInbound(proto, packetBuf)
 
 			if err := ctx.Err(); err != nil {
 				return err
@@ -150,41 +225,60 @@ func New(config *config.C) (*Service, error) {
 		}
 	})
 
+	if o.OnStop != nil {
+		go func() {
+			o.OnStop(stopErr(s.Wait()))
+		}()
+	}
+
 	return &s, nil
 }
 
-// DialContext dials the provided address. Currently only TCP is supported.
+// DialContext dials the provided address over tcp or udp, ipv4 or ipv6.
 func (s *Service) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
-	if network != "tcp" && network != "tcp4" {
-		return nil, errors.New("only tcp is supported")
-	}
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+		addr, err := net.ResolveTCPAddr(network, address)
+		if err != nil {
+			return nil, err
+		}
 
-	addr, err := net.ResolveTCPAddr(network, address)
-	if err != nil {
-		return nil, err
-	}
+		c, err := gonet.DialContextTCP(ctx, s.ipstack, fullAddr(addr.IP, addr.Port), ipProtocol(addr.IP))
+		if err != nil {
+			return nil, err
+		}
+		return c, nil
 
-	fullAddr := tcpip.FullAddress{
-		NIC:  nicID,
-		Addr: tcpip.AddrFromSlice(addr.IP),
-		Port: uint16(addr.Port),
-	}
+	case "udp", "udp4", "udp6":
+		addr, err := net.ResolveUDPAddr(network, address)
+		if err != nil {
+			return nil, err
+		}
+
+		raddr := fullAddr(addr.IP, addr.Port)
+		c, err := gonet.DialUDP(s.ipstack, nil, &raddr, ipProtocol(addr.IP))
+		if err != nil {
+			return nil, err
+		}
+		return c, nil
 
-	return gonet.DialContextTCP(ctx, s.ipstack, fullAddr, ipv4.ProtocolNumber)
+	default:
+		return nil, fmt.Errorf("unsupported network %q, only tcp and udp are supported", network)
+	}
 }
 
-// Listen listens on the provided address. Currently only TCP with wildcard
-// addresses are supported.
+// Listen listens on the provided address. Currently only TCP is supported, the address must be a wildcard or one of
+// our vpn ips.
 func (s *Service) Listen(network, address string) (net.Listener, error) {
-	if network != "tcp" && network != "tcp4" {
+	if network != "tcp" && network != "tcp4" && network != "tcp6" {
 		return nil, errors.New("only tcp is supported")
 	}
 	addr, err := net.ResolveTCPAddr(network, address)
 	if err != nil {
 		return nil, err
 	}
-	if addr.IP != nil && !bytes.Equal(addr.IP, []byte{0, 0, 0, 0}) {
-		return nil, fmt.Errorf("only wildcard address supported, got %q %v", address, addr.IP)
+	if !s.isLocal(addr.IP) {
+		return nil, fmt.Errorf("only wildcard or vpn addresses supported, got %q %v", address, addr.IP)
 	}
 	if addr.Port == 0 {
 		return nil, errors.New("specific port required, got 0")
@@ -212,6 +306,98 @@ func (s *Service) Listen(network, address string) (net.Listener, error) {
 	return l, nil
 }
 
+// ListenPacket listens for udp packets on the provided address, which must be a wildcard or one of our vpn ips. A
+// wildcard address listens on the family of the network, udp is the family of the first network in our certificate.
+func (s *Service) ListenPacket(network, address string) (net.PacketConn, error) {
+	if network != "udp" && network != "udp4" && network != "udp6" {
+		return nil, errors.New("only udp is supported")
+	}
+	addr, err := net.ResolveUDPAddr(network, address)
+	if err != nil {
+		return nil, err
+	}
+	if !s.isLocal(addr.IP) {
+		return nil, fmt.Errorf("only wildcard or vpn addresses supported, got %q %v", address, addr.IP)
+	}
+
+	proto := ipProtocol(s.networks[0].IP)
+	switch {
+	case addr.IP != nil && !addr.IP.IsUnspecified():
+		proto = ipProtocol(addr.IP)
+	case network == "udp4":
+		proto = ipv4.ProtocolNumber
+	case network == "udp6":
+		proto = ipv6.ProtocolNumber
+	}
+
+	laddr := fullAddr(addr.IP, addr.Port)
+	c, err := gonet.DialUDP(s.ipstack, &laddr, nil, proto)
+	if err != nil {
+		return nil, err
+	}
+	return &udpConn{UDPConn: c}, nil
+}
+
+// isLocal is true if ip is a wildcard or one of our vpn ips
+func (s *Service) isLocal(ip net.IP) bool {
+	if ip == nil || ip.IsUnspecified() {
+		return true
+	}
+	for _, n := range s.networks {
+		if n.IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// stackAddr converts ip to a netstack address, ipv4 addresses must be in their 4 byte form
+func stackAddr(ip net.IP) tcpip.Address {
+	if ip4 := ip.To4(); ip4 != nil {
+		return tcpip.AddrFrom4Slice(ip4)
+	}
+	return tcpip.AddrFromSlice(ip)
+}
+
+// fullAddr is the netstack address for ip and port on our nic, a wildcard ip is left empty
+func fullAddr(ip net.IP, port int) tcpip.FullAddress {
+	a := tcpip.FullAddress{NIC: nicID, Port: uint16(port)}
+	if ip != nil && !ip.IsUnspecified() {
+		a.Addr = stackAddr(ip)
+	}
+	return a
+}
+
+// ipProtocol is the netstack network protocol for the family of ip, ipv4 when ip is nil
+func ipProtocol(ip net.IP) tcpip.NetworkProtocolNumber {
+	if ip != nil && ip.To4() == nil {
+		return ipv6.ProtocolNumber
+	}
+	return ipv4.ProtocolNumber
+}
+
+// InjectPacket hands nebula a raw ip packet to send over the overlay as if the network stack had sent it
+func (s *Service) InjectPacket(packet []byte) error {
+	if len(packet) == 0 {
+		return errors.New("packet is empty")
+	}
+	_, err := s.writer.Write(packet)
+	return err
+}
+
+// Control returns the nebula Control for the service, to inspect or change the running node
+func (s *Service) Control() *nebula.Control {
+	return s.control
+}
+
+// stopErr is nil for the errors every service stopped with Close returns
+func stopErr(err error) error {
+	if errors.Is(err, context.Canceled) || errors.Is(err, io.ErrClosedPipe) || errors.Is(err, io.EOF) {
+		return nil
+	}
+	return err
+}
+
 func (s *Service) Wait() error {
 	return s.eg.Wait()
 }
@@ -228,7 +414,7 @@ func (s *Service) tcpHandler(r *tcp.ForwarderRequest) {
 	defer s.mu.Unlock()
 
 	l, ok := s.mu.listeners[endpointID.LocalPort]
-	if !ok {
+	if !ok || !l.accepts(net.IP(endpointID.LocalAddress.AsSlice())) {
 		r.Complete(true)
 		return
 	}
@@ -9,16 +9,32 @@ import (
 	"time"
 
 	"dario.cat/mergo"
+	"github.com/slackhq/nebula"
 	"github.com/slackhq/nebula/cert"
 	"github.com/slackhq/nebula/config"
 	"github.com/slackhq/nebula/e2e"
 	"golang.org/x/sync/errgroup"
 	"gopkg.in/yaml.v2"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
 )
 
 type m map[string]interface{}
 
 func newSimpleService(caCrt *cert.NebulaCertificate, caKey []byte, name string, udpIp net.IP, overrides m) *Service {
+	var c config.C
+	if err := c.LoadString(string(simpleServiceConfig(caCrt, caKey, udpIp, overrides))); err != nil {
+		panic(err)
+	}
+
+	s, err := New(&c)
+	if err != nil {
+		panic(err)
+	}
+	return s
+}
+
+func simpleServiceConfig(caCrt *cert.NebulaCertificate, caKey []byte, udpIp net.IP, overrides m) []byte {
 
 	vpnIpNet := &net.IPNet{IP: make([]byte, len(udpIp)), Mask: net.IPMask{255, 255, 255, 0}}
 	copy(vpnIpNet.IP, udpIp)
@@ -69,17 +85,7 @@ func newSimpleService(caCrt *cert.NebulaCertificate, caKey []byte, name string,
 	if err != nil {
 		panic(err)
 	}
-
-	var c config.C
-	if err := c.LoadString(string(cb)); err != nil {
-		panic(err)
-	}
-
-	s, err := New(&c)
-	if err != nil {
-		panic(err)
-	}
-	return s
+	return cb
 }
 
 func TestService(t *testing.T) {
@@ -163,3 +169,185 @@ func TestService(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestServiceUDP(t *testing.T) {
+	ca, _, caKey, _ := e2e.NewTestCaCert(time.Now(), time.Now().Add(10*time.Minute), []*net.IPNet{}, []*net.IPNet{}, []string{})
+	a := newSimpleService(ca, caKey, "a", net.IP{10, 0, 1, 1}, m{
+		"static_host_map": m{},
+		"lighthouse": m{
+			"am_lighthouse": true,
+		},
+		"listen": m{
+			"host": "0.0.0.0",
+			"port": 4244,
+		},
+	})
+	b := newSimpleService(ca, caKey, "b", net.IP{10, 0, 1, 2}, m{
+		"static_host_map": m{
+			"10.0.1.1": []string{"localhost:4244"},
+		},
+		"lighthouse": m{
+			"hosts":    []string{"10.0.1.1"},
+			"interval": 1,
+		},
+	})
+	defer a.Close()
+	defer b.Close()
+
+	_, err := a.ListenPacket("udp", "10.0.1.2:1234")
+	if err == nil {
+		t.Fatal("listened on an address that is not ours")
+	}
+
+	pc, err := a.ListenPacket("udp", "10.0.1.1:1234")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+
+	// Echo every packet back to the sender
+	go func() {
+		data := make([]byte, 100)
+		for {
+			n, addr, err := pc.ReadFrom(data)
+			if err != nil {
+				return
+			}
+			if _, err := pc.WriteTo(data[:n], addr); err != nil {
+				return
+			}
+		}
+	}()
+
+	c, err := b.DialContext(context.Background(), "udp", "10.0.1.1:1234")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// The first packets may be lost while the tunnel comes up
+	data := make([]byte, 100)
+	for i := 0; i < 50; i++ {
+		if _, err := c.Write([]byte("client msg")); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := c.SetReadDeadline(time.Now().Add(200 * time.Millisecond)); err != nil {
+			t.Fatal(err)
+		}
+		n, err := c.Read(data)
+		if err != nil {
+			continue
+		}
+
+		if !bytes.Equal(data[:n], []byte("client msg")) {
+			t.Fatal("got invalid message from server")
+		}
+		return
+	}
+
+	t.Fatal("never got a reply from the server")
+}
+
+// icmpEcho builds an ipv4 icmp echo request from src to dst
+func icmpEcho(src, dst net.IP) []byte {
+	b := make([]byte, header.IPv4MinimumSize+header.ICMPv4MinimumSize)
+	ip := header.IPv4(b)
+	ip.Encode(&header.IPv4Fields{
+		TotalLength: uint16(len(b)),
+		TTL:         64,
+		Protocol:    uint8(header.ICMPv4ProtocolNumber),
+		SrcAddr:     tcpip.AddrFrom4Slice(src.To4()),
+		DstAddr:     tcpip.AddrFrom4Slice(dst.To4()),
+	})
+	ip.SetChecksum(^ip.CalculateChecksum())
+
+	icmp := header.ICMPv4(ip.Payload())
+	icmp.SetType(header.ICMPv4Echo)
+	icmp.SetChecksum(header.ICMPv4Checksum(icmp, 0))
+	return b
+}
+
+func TestServiceOptions(t *testing.T) {
+	ca, _, caKey, _ := e2e.NewTestCaCert(time.Now(), time.Now().Add(10*time.Minute), []*net.IPNet{}, []*net.IPNet{}, []string{})
+	aIp, bIp := net.IP{10, 0, 2, 1}, net.IP{10, 0, 2, 2}
+
+	// a keeps the icmp packets from b for itself
+	packets := make(chan []byte, 100)
+	a, err := NewFromBytes(simpleServiceConfig(ca, caKey, aIp, m{
+		"static_host_map": m{},
+		"lighthouse": m{
+			"am_lighthouse": true,
+		},
+		"listen": m{
+			"host": "0.0.0.0",
+			"port": 4245,
+		},
+	}), Options{OnPacket: func(packet []byte) bool {
+		if header.IPv4(packet).Protocol() != uint8(header.ICMPv4ProtocolNumber) {
+			return false
+		}
+		packets <- bytes.Clone(packet)
+		return true
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+
+	events := make(chan nebula.TunnelEvent, 100)
+	stopped := make(chan error, 1)
+	b, err := NewFromBytes(simpleServiceConfig(ca, caKey, bIp, m{
+		"static_host_map": m{
+			"10.0.2.1": []string{"localhost:4245"},
+		},
+		"lighthouse": m{
+			"hosts":    []string{"10.0.2.1"},
+			"interval": 1,
+		},
+	}), Options{
+		OnTunnelEvent: func(e nebula.TunnelEvent) { events <- e },
+		OnStop:        func(err error) { stopped <- err },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The first packets may be lost while the tunnel comes up
+	echo := icmpEcho(bIp, aIp)
+	var got []byte
+	for i := 0; i < 50 && got == nil; i++ {
+		if err := b.InjectPacket(echo); err != nil {
+			t.Fatal(err)
+		}
+
+		select {
+		case got = <-packets:
+		case <-time.After(200 * time.Millisecond):
+		}
+	}
+	if !bytes.Equal(echo, got) {
+		t.Fatal("the injected packet never reached the other side")
+	}
+
+	select {
+	case e := <-events:
+		if e.Type != nebula.TunnelEventHandshakeStarted || !e.VpnIp.Equal(aIp) {
+			t.Fatalf("unexpected first tunnel event %v for %v", e.Type, e.VpnIp)
+		}
+	default:
+		t.Fatal("no tunnel events")
+	}
+
+	if err := b.Close(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-stopped:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("OnStop was not called")
+	}
+}
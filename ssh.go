@@ -7,6 +7,7 @@ import (
 	"flag"
 	"fmt"
 	"net"
+	"net/netip"
 	"os"
 	"reflect"
 	"runtime"
@@ -14,19 +15,54 @@ import (
 	"sort"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/sirupsen/logrus"
 	"github.com/slackhq/nebula/config"
 	"github.com/slackhq/nebula/header"
 	"github.com/slackhq/nebula/iputil"
+	"github.com/slackhq/nebula/overlay"
 	"github.com/slackhq/nebula/sshd"
 	"github.com/slackhq/nebula/udp"
+	"golang.org/x/crypto/ssh"
 )
 
 type sshListHostMapFlags struct {
 	Json    bool
 	Pretty  bool
 	ByIndex bool
+	Stream  bool
+	State   string
+	Group   string
+	Name    string
+	Relay   string
+	Sort    string
+	Offset  int
+	Limit   int
+}
+
+// sshHostMapSoftLimit keeps the text output of list-hostmap usable on nodes with a very large number of tunnels. The
+// json output is read by scripts which can not see the text hint that more hosts were left out, it has no default limit.
+// Tests lower it.
+var sshHostMapSoftLimit = 1000
+
+func newSSHListHostMapFlags(state bool) (*flag.FlagSet, interface{}) {
+	fl := flag.NewFlagSet("", flag.ContinueOnError)
+	s := sshListHostMapFlags{State: "handshaking"}
+	fl.BoolVar(&s.Json, "json", false, "outputs as json with more information")
+	fl.BoolVar(&s.Pretty, "pretty", false, "pretty prints json, assumes -json")
+	fl.BoolVar(&s.ByIndex, "by-index", false, "gets all hosts in the hostmap from the index table")
+	fl.BoolVar(&s.Stream, "stream", false, "outputs one json object per line")
+	if state {
+		fl.StringVar(&s.State, "state", "established", "only list established, handshaking, or all hosts")
+	}
+	fl.StringVar(&s.Group, "group", "", "only list hosts with a certificate in this group")
+	fl.StringVar(&s.Name, "name", "", "only list hosts with a certificate name matching this glob")
+	fl.StringVar(&s.Relay, "relay", "", "only list direct, relayed, or relaying hosts")
+	fl.StringVar(&s.Sort, "sort", "vpnip", "sort by vpnip, name, or index")
+	fl.IntVar(&s.Offset, "offset", 0, "skip this many hosts")
+	fl.IntVar(&s.Limit, "limit", -1, fmt.Sprintf("list at most this many hosts, 0 for no limit. The default is %d, or no limit with -json, -pretty, or -stream", sshHostMapSoftLimit))
+	return fl, &s
 }
 
 type sshPrintCertFlags struct {
@@ -51,11 +87,84 @@ type sshCreateTunnelFlags struct {
 	Address string
 }
 
+type sshDiagFlags struct {
+	Json    bool
+	Pretty  bool
+	Max     int
+	Timeout time.Duration
+}
+
+type sshTcpdumpFlags struct {
+	Outer    bool
+	Pcap     bool
+	Count    int
+	Duration time.Duration
+	Snaplen  int
+	MaxBytes int
+}
+
+type sshTestHandshakeFlags struct {
+	Timeout time.Duration
+}
+
+type sshLighthouseInfoFlags struct {
+	Json   bool
+	Pretty bool
+}
+
 type sshDeviceInfoFlags struct {
 	Json   bool
 	Pretty bool
 }
 
+type sshPerfFlags struct {
+	Json   bool
+	Pretty bool
+	Reset  bool
+}
+
+type sshPrintFirewallStatsFlags struct {
+	Json   bool
+	Pretty bool
+}
+
+type sshPrintRelayUsageFlags struct {
+	Json   bool
+	Pretty bool
+}
+
+type sshPrintCIDRSetsFlags struct {
+	Json   bool
+	Pretty bool
+}
+
+type sshChangeCIDRSetFlags struct {
+	Remove  bool
+	Replace bool
+}
+
+type sshPrintUnsafeRoutesFlags struct {
+	Json   bool
+	Pretty bool
+}
+
+type sshChangeUnsafeRouteFlags struct {
+	Remove    bool
+	Via       string
+	MTU       int
+	Metric    int
+	NoInstall bool
+}
+
+// sshUnsafeRoute is how print-unsafe-routes shows a route as json
+type sshUnsafeRoute struct {
+	Route   string       `json:"route"`
+	Via     iputil.VpnIp `json:"via"`
+	MTU     int          `json:"mtu"`
+	Metric  int          `json:"metric"`
+	Install bool         `json:"install"`
+}
+
 func wireSSHReload(l *logrus.Logger, ssh *sshd.SSHServer, c *config.C) {
 	c.RegisterReloadCallback(func(c *config.C) {
 		if c.GetBool("sshd.enabled", false) {
@@ -191,20 +300,16 @@ func configSSH(l *logrus.Logger, ssh *sshd.SSHServer, c *config.C) (func(), erro
 	return runner, nil
 }
 
-func attachCommands(l *logrus.Logger, c *config.C, ssh *sshd.SSHServer, f *Interface) {
+func attachCommands(ls *loggers, c *config.C, ssh *sshd.SSHServer, f *Interface) {
+	l := ls.l
 	ssh.RegisterCommand(&sshd.Command{
 		Name:             "list-hostmap",
 		ShortDescription: "List all known previously connected hosts",
 		Flags: func() (*flag.FlagSet, interface{}) {
-			fl := flag.NewFlagSet("", flag.ContinueOnError)
-			s := sshListHostMapFlags{}
-			fl.BoolVar(&s.Json, "json", false, "outputs as json with more information")
-			fl.BoolVar(&s.Pretty, "pretty", false, "pretty prints json, assumes -json")
-			fl.BoolVar(&s.ByIndex, "by-index", false, "gets all hosts in the hostmap from the index table")
-			return fl, &s
+			return newSSHListHostMapFlags(true)
 		},
 		Callback: func(fs interface{}, a []string, w sshd.StringWriter) error {
-			return sshListHostMap(f.hostMap, fs, w)
+			return sshListHostMap(f.hostMap, f.handshakeManager, fs, w)
 		},
 	})
 
@@ -212,15 +317,10 @@ func attachCommands(l *logrus.Logger, c *config.C, ssh *sshd.SSHServer, f *Inter
 		Name:             "list-pending-hostmap",
 		ShortDescription: "List all handshaking hosts",
 		Flags: func() (*flag.FlagSet, interface{}) {
-			fl := flag.NewFlagSet("", flag.ContinueOnError)
-			s := sshListHostMapFlags{}
-			fl.BoolVar(&s.Json, "json", false, "outputs as json with more information")
-			fl.BoolVar(&s.Pretty, "pretty", false, "pretty prints json, assumes -json")
-			fl.BoolVar(&s.ByIndex, "by-index", false, "gets all hosts in the hostmap from the index table")
-			return fl, &s
+			return newSSHListHostMapFlags(false)
 		},
 		Callback: func(fs interface{}, a []string, w sshd.StringWriter) error {
-			return sshListHostMap(f.handshakeManager, fs, w)
+			return sshListHostMap(f.hostMap, f.handshakeManager, fs, w)
 		},
 	})
 
@@ -282,9 +382,9 @@ func attachCommands(l *logrus.Logger, c *config.C, ssh *sshd.SSHServer, f *Inter
 
 	ssh.RegisterCommand(&sshd.Command{
 		Name:             "log-level",
-		ShortDescription: "Gets or sets the current log level",
+		ShortDescription: "Gets or sets the current log level, ex: `log-level debug` or `log-level handshake debug`",
 		Callback: func(fs interface{}, a []string, w sshd.StringWriter) error {
-			return sshLogLevel(l, fs, a, w)
+			return sshLogLevel(ls, fs, a, w)
 		},
 	})
 
@@ -319,6 +419,22 @@ func attachCommands(l *logrus.Logger, c *config.C, ssh *sshd.SSHServer, f *Inter
 		},
 	})
 
+	ssh.RegisterCommand(&sshd.Command{
+		Name:             "perf",
+		ShortDescription: "Prints reader goroutines, queue depths, and buffer watermarks for the packet pipeline",
+		Flags: func() (*flag.FlagSet, interface{}) {
+			fl := flag.NewFlagSet("", flag.ContinueOnError)
+			s := sshPerfFlags{}
+			fl.BoolVar(&s.Json, "json", false, "outputs as json")
+			fl.BoolVar(&s.Pretty, "pretty", false, "pretty prints json, assumes -json")
+			fl.BoolVar(&s.Reset, "reset", false, "resets the watermarks after printing them")
+			return fl, &s
+		},
+		Callback: func(fs interface{}, a []string, w sshd.StringWriter) error {
+			return sshPerf(f, fs, w)
+		},
+	})
+
 	ssh.RegisterCommand(&sshd.Command{
 		Name:             "print-cert",
 		ShortDescription: "Prints the current certificate being used or the certificate for the provided vpn ip",
@@ -363,6 +479,105 @@ func attachCommands(l *logrus.Logger, c *config.C, ssh *sshd.SSHServer, f *Inter
 		},
 	})
 
+	ssh.RegisterCommand(&sshd.Command{
+		Name:             "print-relay-usage",
+		ShortDescription: "Prints the packets and bytes relayed for each peer",
+		Help:             "In is what a peer sent through this relay, out is what was forwarded to it. Dropped is what relay.limits dropped.",
+		Flags: func() (*flag.FlagSet, interface{}) {
+			fl := flag.NewFlagSet("", flag.ContinueOnError)
+			s := sshPrintRelayUsageFlags{}
+			fl.BoolVar(&s.Json, "json", false, "outputs as json")
+			fl.BoolVar(&s.Pretty, "pretty", false, "pretty prints json, assumes -json")
+			return fl, &s
+		},
+		Callback: func(fs interface{}, a []string, w sshd.StringWriter) error {
+			return sshPrintRelayUsage(f, fs, w)
+		},
+	})
+
+	ssh.RegisterCommand(&sshd.Command{
+		Name:             "print-firewall-stats",
+		ShortDescription: "Prints the connections, packets, and bytes allowed by each firewall rule",
+		Help:             "Requires firewall.rule_stats to be enabled. Traffic is credited to the first rule that allowed the connection.",
+		Flags: func() (*flag.FlagSet, interface{}) {
+			fl := flag.NewFlagSet("", flag.ContinueOnError)
+			s := sshPrintFirewallStatsFlags{}
+			fl.BoolVar(&s.Json, "json", false, "outputs as json")
+			fl.BoolVar(&s.Pretty, "pretty", false, "pretty prints json, assumes -json")
+			return fl, &s
+		},
+		Callback: func(fs interface{}, a []string, w sshd.StringWriter) error {
+			return sshPrintFirewallStats(f, fs, w)
+		},
+	})
+
+	ssh.RegisterCommand(&sshd.Command{
+		Name:             "print-cidr-sets",
+		ShortDescription: "Prints the entries of the firewall cidr sets",
+		Help:             "Prints every set or only the sets named as arguments.",
+		Flags: func() (*flag.FlagSet, interface{}) {
+			fl := flag.NewFlagSet("", flag.ContinueOnError)
+			s := sshPrintCIDRSetsFlags{}
+			fl.BoolVar(&s.Json, "json", false, "outputs as json")
+			fl.BoolVar(&s.Pretty, "pretty", false, "pretty prints json, assumes -json")
+			return fl, &s
+		},
+		Callback: func(fs interface{}, a []string, w sshd.StringWriter) error {
+			return sshPrintCIDRSets(f, fs, a, w)
+		},
+	})
+
+	ssh.RegisterCommand(&sshd.Command{
+		Name:             "change-cidr-set",
+		ShortDescription: "Adds ipv4 cidrs or ips to a firewall cidr set, or removes or replaces them",
+		Help:             "The first argument is the set, the rest are the entries. Changes are kept across config reloads until nebula restarts.",
+		Flags: func() (*flag.FlagSet, interface{}) {
+			fl := flag.NewFlagSet("", flag.ContinueOnError)
+			s := sshChangeCIDRSetFlags{}
+			fl.BoolVar(&s.Remove, "remove", false, "removes the entries instead of adding them")
+			fl.BoolVar(&s.Replace, "replace", false, "makes the entries the only ones in the set, no entries empties it")
+			return fl, &s
+		},
+		Callback: func(fs interface{}, a []string, w sshd.StringWriter) error {
+			return sshChangeCIDRSet(f, fs, a, w)
+		},
+	})
+
+	ssh.RegisterCommand(&sshd.Command{
+		Name:             "print-unsafe-routes",
+		ShortDescription: "Prints the unsafe routes in use",
+		Help:             "Prints the routes from tun.unsafe_routes with the changes made by change-unsafe-route applied.",
+		Flags: func() (*flag.FlagSet, interface{}) {
+			fl := flag.NewFlagSet("", flag.ContinueOnError)
+			s := sshPrintUnsafeRoutesFlags{}
+			fl.BoolVar(&s.Json, "json", false, "outputs as json")
+			fl.BoolVar(&s.Pretty, "pretty", false, "pretty prints json, assumes -json")
+			return fl, &s
+		},
+		Callback: func(fs interface{}, a []string, w sshd.StringWriter) error {
+			return sshPrintUnsafeRoutes(f, fs, w)
+		},
+	})
+
+	ssh.RegisterCommand(&sshd.Command{
+		Name:             "change-unsafe-route",
+		ShortDescription: "Adds or removes unsafe routes without a config reload",
+		Help:             "The arguments are the routes. An added route replaces any unsafe route for the same cidr. Changes are kept across config reloads until nebula restarts.",
+		Flags: func() (*flag.FlagSet, interface{}) {
+			fl := flag.NewFlagSet("", flag.ContinueOnError)
+			s := sshChangeUnsafeRouteFlags{}
+			fl.BoolVar(&s.Remove, "remove", false, "removes the routes instead of adding them")
+			fl.StringVar(&s.Via, "via", "", "the vpn ip to route through, required when adding")
+			fl.IntVar(&s.MTU, "mtu", 0, "the route mtu, defaults to tun.mtu")
+			fl.IntVar(&s.Metric, "metric", 0, "the route metric")
+			fl.BoolVar(&s.NoInstall, "no-install", false, "keeps the route out of the system route table")
+			return fl, &s
+		},
+		Callback: func(fs interface{}, a []string, w sshd.StringWriter) error {
+			return sshChangeUnsafeRoute(f, fs, a, w)
+		},
+	})
+
 	ssh.RegisterCommand(&sshd.Command{
 		Name:             "change-remote",
 		ShortDescription: "Changes the remote address used in the tunnel for the provided vpn ip",
@@ -414,25 +629,113 @@ func attachCommands(l *logrus.Logger, c *config.C, ssh *sshd.SSHServer, f *Inter
 			return sshQueryLighthouse(f, fs, a, w)
 		},
 	})
+
+	ssh.RegisterCommand(&sshd.Command{
+		Name:             "lighthouse-info",
+		ShortDescription: "Prints what is known about reaching the provided vpn ip",
+		Help:             "Shows the addresses a handshake would try, who told us about each and when, and the relays that can reach the vpn ip. Does not query the lighthouses, see query-lighthouse.",
+		Flags: func() (*flag.FlagSet, interface{}) {
+			fl := flag.NewFlagSet("", flag.ContinueOnError)
+			s := sshLighthouseInfoFlags{}
+			fl.BoolVar(&s.Json, "json", false, "outputs as json")
+			fl.BoolVar(&s.Pretty, "pretty", false, "pretty prints json, assumes -json")
+			return fl, &s
+		},
+		Callback: func(fs interface{}, a []string, w sshd.StringWriter) error {
+			return sshLighthouseInfo(f, fs, a, w)
+		},
+	})
+
+	ssh.RegisterCommand(&sshd.Command{
+		Name:             "diag",
+		ShortDescription: "Probes the tunnel for the provided vpn ip to find the path mtu, peer version, and clock offset",
+		Help:             "Sends diag probes of increasing size through the tunnel, the largest that gets a reply is the most tun.mtu should be set to. Peers running a version of nebula without diag_probe will not reply.",
+		Flags: func() (*flag.FlagSet, interface{}) {
+			fl := flag.NewFlagSet("", flag.ContinueOnError)
+			s := sshDiagFlags{}
+			fl.BoolVar(&s.Json, "json", false, "outputs as json")
+			fl.BoolVar(&s.Pretty, "pretty", false, "pretty prints json, assumes -json")
+			fl.IntVar(&s.Max, "max", diagMaxPayload, "the largest probe payload to try, the path mtu is only probed with pmtud enabled")
+			fl.DurationVar(&s.Timeout, "timeout", time.Second, "how long to wait for each probe reply")
+			return fl, &s
+		},
+		Callback: func(fs interface{}, a []string, w sshd.StringWriter) error {
+			return sshDiag(f, fs, a, w)
+		},
+	})
+
+	ssh.RegisterCommand(&sshd.Command{
+		Name:             "tcpdump",
+		ShortDescription: "Captures the packets matching a filter, ex: `tcpdump -c 10 host 10.1.0.2 and port 443`",
+		Help: "Prints a line for each decrypted packet read from or written to the tun device, or with -outer each encrypted packet read from or written to the underlay. " +
+			"The filter is a subset of the tcpdump syntax: [src|dst] host <ip>, [src|dst] net <cidr>, [src|dst] port <port>, tcp, udp, icmp, icmp6, proto <number>, inbound and outbound, combined with and, or, not and parentheses. " +
+			"With -w a pcap stream is written instead, it can only be used with ssh exec, ex: `ssh -p 2222 host tcpdump -w port 53 > dns.pcap` or piped to `wireshark -k -i -`. " +
+			"The capture stops at the first of the -c, -t and -max-bytes limits, packets are dropped from the capture when the client can not keep up.",
+		Flags: func() (*flag.FlagSet, interface{}) {
+			fl := flag.NewFlagSet("", flag.ContinueOnError)
+			s := sshTcpdumpFlags{}
+			fl.BoolVar(&s.Outer, "outer", false, "captures the encrypted underlay packets instead of the decrypted ones")
+			fl.BoolVar(&s.Pcap, "w", false, "writes a pcap stream instead of a line per packet")
+			fl.IntVar(&s.Count, "c", 0, "stops after this many packets, 0 for no limit")
+			fl.DurationVar(&s.Duration, "t", 30*time.Second, "stops after this long, at most 1h")
+			fl.IntVar(&s.Snaplen, "s", captureMaxSnaplen, "captures at most this many bytes of each packet")
+			fl.IntVar(&s.MaxBytes, "max-bytes", 64<<20, "stops after capturing this many bytes")
+			return fl, &s
+		},
+		Callback: func(fs interface{}, a []string, w sshd.StringWriter) error {
+			return sshTcpdump(f, fs, a, w)
+		},
+	})
+
+	ssh.RegisterCommand(&sshd.Command{
+		Name:             "test-handshake",
+		ShortDescription: "Starts a fresh handshake with a host and prints each step, ex: `test-handshake 10.1.0.2`",
+		Help: "Prints the lighthouse queries, the remotes each attempt is sent to, where the reply came from, relay fallback decisions and the path the tunnel ends up on, with the time since the start. " +
+			"An existing tunnel stays up until the new handshake replaces it, a handshake already in progress is followed instead of started.",
+		Flags: func() (*flag.FlagSet, interface{}) {
+			fl := flag.NewFlagSet("", flag.ContinueOnError)
+			s := sshTestHandshakeFlags{}
+			fl.DurationVar(&s.Timeout, "t", 0, "stops waiting after this long, defaults to a little over the handshake timeout")
+			return fl, &s
+		},
+		Callback: func(fs interface{}, a []string, w sshd.StringWriter) error {
+			return sshTestHandshake(f, fs, a, w)
+		},
+	})
 }
 
-func sshListHostMap(hl controlHostLister, a interface{}, w sshd.StringWriter) error {
+func sshListHostMap(established, handshaking controlHostLister, a interface{}, w sshd.StringWriter) error {
 	fs, ok := a.(*sshListHostMapFlags)
 	if !ok {
 		//TODO: error
 		return nil
 	}
 
-	var hm []ControlHostInfo
-	if fs.ByIndex {
-		hm = listHostMapIndexes(hl)
-	} else {
-		hm = listHostMapHosts(hl)
+	limit := fs.Limit
+	if limit < 0 {
+		limit = sshHostMapSoftLimit
+		if fs.Json || fs.Pretty || fs.Stream {
+			limit = 0
+		}
 	}
 
-	sort.Slice(hm, func(i, j int) bool {
-		return bytes.Compare(hm[i].VpnIp, hm[j].VpnIp) < 0
-	})
+	page, err := queryHostmap(HostmapQuery{
+		State:   fs.State,
+		ByIndex: fs.ByIndex,
+		Group:   fs.Group,
+		Name:    fs.Name,
+		Relay:   fs.Relay,
+		Sort:    fs.Sort,
+		Offset:  fs.Offset,
+		Limit:   limit,
+	}, established, handshaking)
+	if err != nil {
+		return w.WriteLine(err.Error())
+	}
+
+	if fs.Stream {
+		return writeHostmapStream(w.GetWriter(), page)
+	}
 
 	if fs.Json || fs.Pretty {
 		js := json.NewEncoder(w.GetWriter())
@@ -440,19 +743,23 @@ func sshListHostMap(hl controlHostLister, a interface{}, w sshd.StringWriter) er
 			js.SetIndent("", "    ")
 		}
 
-		err := js.Encode(hm)
+		err := js.Encode(page.Hosts)
 		if err != nil {
 			//TODO
 			return nil
 		}
 
 	} else {
-		for _, v := range hm {
+		for _, v := range page.Hosts {
 			err := w.WriteLine(fmt.Sprintf("%s: %s", v.VpnIp, v.RemoteAddrs))
 			if err != nil {
 				return err
 			}
 		}
+
+		if next := page.Offset + len(page.Hosts); next < page.Total {
+			return w.WriteLine(fmt.Sprintf("showing %d-%d of %d hosts, use -offset %d for more", page.Offset+1, next, page.Total, next))
+		}
 	}
 
 	return nil
@@ -551,7 +858,7 @@ func sshQueryLighthouse(ifce *Interface, fs interface{}, a []string, w sshd.Stri
 	}
 
 	vpnIp := iputil.Ip2VpnIp(parsedIp)
-	if vpnIp == 0 {
+	if !vpnIp.IsValid() {
 		return w.WriteLine(fmt.Sprintf("The provided vpn ip could not be parsed: %s", a[0]))
 	}
 
@@ -563,6 +870,91 @@ func sshQueryLighthouse(ifce *Interface, fs interface{}, a []string, w sshd.Stri
 	return json.NewEncoder(w.GetWriter()).Encode(cm)
 }
 
+func sshLighthouseInfo(ifce *Interface, fs interface{}, a []string, w sshd.StringWriter) error {
+	flags, ok := fs.(*sshLighthouseInfoFlags)
+	if !ok {
+		//TODO: error
+		return nil
+	}
+
+	if len(a) == 0 {
+		return w.WriteLine("No vpn ip was provided")
+	}
+
+	parsedIp := net.ParseIP(a[0])
+	if parsedIp == nil {
+		return w.WriteLine(fmt.Sprintf("The provided vpn ip could not be parsed: %s", a[0]))
+	}
+
+	vpnIp := iputil.Ip2VpnIp(parsedIp)
+	if !vpnIp.IsValid() {
+		return w.WriteLine(fmt.Sprintf("The provided vpn ip could not be parsed: %s", a[0]))
+	}
+
+	info := ifce.lighthouseInfo(vpnIp)
+	if info == nil {
+		return w.WriteLine(fmt.Sprintf("Nothing is known about vpn ip: %v, try query-lighthouse", a[0]))
+	}
+
+	if flags.Json || flags.Pretty {
+		js := json.NewEncoder(w.GetWriter())
+		if flags.Pretty {
+			js.SetIndent("", "    ")
+		}
+		return js.Encode(info)
+	}
+
+	lines := []string{
+		fmt.Sprintf("vpn ip: %s, static: %v", info.VpnIp, info.Static),
+		fmt.Sprintf("handshake addrs: %s", joinAddrs(info.Addrs)),
+		fmt.Sprintf("blocked addrs: %s", joinAddrs(info.BlockedAddrs)),
+	}
+
+	relays := make([]string, len(info.Relays))
+	for i, r := range info.Relays {
+		if r.Tunnel {
+			relays[i] = r.VpnIp.String()
+		} else {
+			relays[i] = fmt.Sprintf("%s (no tunnel)", r.VpnIp)
+		}
+	}
+	lines = append(lines, fmt.Sprintf("relays: %s", strings.Join(relays, ", ")))
+
+	for _, src := range info.Sources {
+		kind := src.Kind
+		if src.Stale {
+			kind += ", stale"
+		}
+		lines = append(lines, fmt.Sprintf(
+			"from %s (%s) %s ago: learned %s; reported %s; relays %s",
+			src.Owner, kind, time.Since(src.Updated).Round(time.Second), joinAddrs(src.Learned), joinAddrs(src.Reported), joinIPs(src.Relays),
+		))
+	}
+
+	for _, line := range lines {
+		if err := w.WriteLine(line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func joinAddrs(addrs []*udp.Addr) string {
+	s := make([]string, len(addrs))
+	for i, a := range addrs {
+		s[i] = a.String()
+	}
+	return strings.Join(s, ", ")
+}
+
+func joinIPs(ips []net.IP) string {
+	s := make([]string, len(ips))
+	for i, ip := range ips {
+		s[i] = ip.String()
+	}
+	return strings.Join(s, ", ")
+}
+
 func sshCloseTunnel(ifce *Interface, fs interface{}, a []string, w sshd.StringWriter) error {
 	flags, ok := fs.(*sshCloseTunnelFlags)
 	if !ok {
@@ -580,7 +972,7 @@ func sshCloseTunnel(ifce *Interface, fs interface{}, a []string, w sshd.StringWr
 	}
 
 	vpnIp := iputil.Ip2VpnIp(parsedIp)
-	if vpnIp == 0 {
+	if !vpnIp.IsValid() {
 		return w.WriteLine(fmt.Sprintf("The provided vpn ip could not be parsed: %s", a[0]))
 	}
 
@@ -601,7 +993,7 @@ func sshCloseTunnel(ifce *Interface, fs interface{}, a []string, w sshd.StringWr
 		)
 	}
 
-	ifce.closeTunnel(hostInfo)
+	ifce.closeTunnel(hostInfo, "closed by ssh")
 	return w.WriteLine("Closed")
 }
 
@@ -622,7 +1014,7 @@ func sshCreateTunnel(ifce *Interface, fs interface{}, a []string, w sshd.StringW
 	}
 
 	vpnIp := iputil.Ip2VpnIp(parsedIp)
-	if vpnIp == 0 {
+	if !vpnIp.IsValid() {
 		return w.WriteLine(fmt.Sprintf("The provided vpn ip could not be parsed: %s", a[0]))
 	}
 
@@ -678,7 +1070,7 @@ func sshChangeRemote(ifce *Interface, fs interface{}, a []string, w sshd.StringW
 	}
 
 	vpnIp := iputil.Ip2VpnIp(parsedIp)
-	if vpnIp == 0 {
+	if !vpnIp.IsValid() {
 		return w.WriteLine(fmt.Sprintf("The provided vpn ip could not be parsed: %s", a[0]))
 	}
 
@@ -751,36 +1143,58 @@ func sshGetMutexProfile(fs interface{}, a []string, w sshd.StringWriter) error {
 	return w.WriteLine(fmt.Sprintf("Mutex profile created at %s", a))
 }
 
-func sshLogLevel(l *logrus.Logger, fs interface{}, a []string, w sshd.StringWriter) error {
+// sshLogLevel sets the level of every logger, or of one subsystem when its name comes first
+func sshLogLevel(ls *loggers, fs interface{}, a []string, w sshd.StringWriter) error {
 	if len(a) == 0 {
-		return w.WriteLine(fmt.Sprintf("Log level is: %s", l.Level))
+		return w.WriteLine(ls.logLevels())
 	}
 
-	level, err := logrus.ParseLevel(a[0])
-	if err != nil {
-		return w.WriteLine(fmt.Sprintf("Unknown log level %s. Possible log levels: %s", a, logrus.AllLevels))
+	sl, ok := ls.subsystems[a[0]]
+	if !ok {
+		level, err := logrus.ParseLevel(a[0])
+		if err != nil {
+			return w.WriteLine(fmt.Sprintf("Unknown log level %s. Possible log levels: %s, or one of the subsystems %s", a, logrus.AllLevels, logSubsystems))
+		}
+
+		ls.setLevel(level)
+		return w.WriteLine(ls.logLevels())
 	}
 
-	l.SetLevel(level)
-	return w.WriteLine(fmt.Sprintf("Log level is: %s", l.Level))
+	if len(a) > 1 {
+		level, err := logrus.ParseLevel(a[1])
+		if err != nil {
+			return w.WriteLine(fmt.Sprintf("Unknown log level %s. Possible log levels: %s", a[1:], logrus.AllLevels))
+		}
+		sl.SetLevel(level)
+	}
+
+	return w.WriteLine(fmt.Sprintf("Log level for %s is: %s", a[0], sl.GetLevel()))
 }
 
 func sshLogFormat(l *logrus.Logger, fs interface{}, a []string, w sshd.StringWriter) error {
+	// Keep redacting when logging.redact is set
+	lf, ok := l.Formatter.(*logFormatter)
+	if !ok {
+		lf = &logFormatter{Formatter: l.Formatter}
+	}
+
 	if len(a) == 0 {
-		return w.WriteLine(fmt.Sprintf("Log format is: %s", reflect.TypeOf(l.Formatter)))
+		return w.WriteLine(fmt.Sprintf("Log format is: %s", reflect.TypeOf(lf.Formatter)))
 	}
 
+	var formatter logrus.Formatter
 	logFormat := strings.ToLower(a[0])
 	switch logFormat {
 	case "text":
-		l.Formatter = &logrus.TextFormatter{}
+		formatter = &logrus.TextFormatter{}
 	case "json":
-		l.Formatter = &logrus.JSONFormatter{}
+		formatter = &logrus.JSONFormatter{}
 	default:
 		return fmt.Errorf("unknown log format `%s`. possible formats: %s", logFormat, []string{"text", "json"})
 	}
 
-	return w.WriteLine(fmt.Sprintf("Log format is: %s", reflect.TypeOf(l.Formatter)))
+	l.Formatter = &logFormatter{Formatter: formatter, redact: lf.redact}
+	return w.WriteLine(fmt.Sprintf("Log format is: %s", reflect.TypeOf(formatter)))
 }
 
 func sshPrintCert(ifce *Interface, fs interface{}, a []string, w sshd.StringWriter) error {
@@ -798,7 +1212,7 @@ func sshPrintCert(ifce *Interface, fs interface{}, a []string, w sshd.StringWrit
 		}
 
 		vpnIp := iputil.Ip2VpnIp(parsedIp)
-		if vpnIp == 0 {
+		if !vpnIp.IsValid() {
 			return w.WriteLine(fmt.Sprintf("The provided vpn ip could not be parsed: %s", a[0]))
 		}
 
@@ -958,7 +1372,7 @@ func sshPrintTunnel(ifce *Interface, fs interface{}, a []string, w sshd.StringWr
 	}
 
 	vpnIp := iputil.Ip2VpnIp(parsedIp)
-	if vpnIp == 0 {
+	if !vpnIp.IsValid() {
 		return w.WriteLine(fmt.Sprintf("The provided vpn ip could not be parsed: %s", a[0]))
 	}
 
@@ -972,29 +1386,105 @@ func sshPrintTunnel(ifce *Interface, fs interface{}, a []string, w sshd.StringWr
 		enc.SetIndent("", "    ")
 	}
 
-	return enc.Encode(copyHostInfo(hostInfo, ifce.hostMap.GetPreferredRanges()))
+	return enc.Encode(copyHostInfo(hostInfo, ifce.hostMap.GetPreferredRangesFor(hostInfo)))
 }
 
-func sshDeviceInfo(ifce *Interface, fs interface{}, w sshd.StringWriter) error {
-
-	data := struct {
-		Name string `json:"name"`
-		Cidr string `json:"cidr"`
-	}{
-		Name: ifce.inside.Name(),
-		Cidr: ifce.inside.Cidr().String(),
+func sshDiag(ifce *Interface, fs interface{}, a []string, w sshd.StringWriter) error {
+	flags, ok := fs.(*sshDiagFlags)
+	if !ok {
+		//TODO: error
+		return nil
 	}
 
-	flags, ok := fs.(*sshDeviceInfoFlags)
-	if !ok {
-		return fmt.Errorf("internal error: expected flags to be sshDeviceInfoFlags but was %+v", fs)
+	if len(a) == 0 {
+		return w.WriteLine("No vpn ip was provided")
 	}
 
-	if flags.Json || flags.Pretty {
-		js := json.NewEncoder(w.GetWriter())
-		if flags.Pretty {
-			js.SetIndent("", "    ")
-		}
+	parsedIp := net.ParseIP(a[0])
+	if parsedIp == nil {
+		return w.WriteLine(fmt.Sprintf("The provided vpn ip could not be parsed: %s", a[0]))
+	}
+
+	vpnIp := iputil.Ip2VpnIp(parsedIp)
+	if !vpnIp.IsValid() {
+		return w.WriteLine(fmt.Sprintf("The provided vpn ip could not be parsed: %s", a[0]))
+	}
+
+	hostInfo := ifce.hostMap.QueryVpnIp(vpnIp)
+	if hostInfo == nil {
+		return w.WriteLine(fmt.Sprintf("Could not find tunnel for vpn ip: %v", a[0]))
+	}
+
+	rep, err := ifce.diagnose(hostInfo, DiagOptions{MaxSize: flags.Max, Timeout: flags.Timeout})
+	if errors.Is(err, ErrDiagTimeout) {
+		if !hostInfo.ConnectionState.capabilities.Has(capabilityDiagProbe) {
+			return w.WriteLine("No reply to diag probes, the peer did not negotiate diag_probe and is likely running an older version of nebula")
+		}
+		return w.WriteLine("No reply to diag probes")
+	} else if err != nil {
+		return w.WriteLine(err.Error())
+	}
+
+	return writeDiagReport(rep, flags, w)
+}
+
+func writeDiagReport(rep *DiagReport, flags *sshDiagFlags, w sshd.StringWriter) error {
+	if flags.Json || flags.Pretty {
+		js := json.NewEncoder(w.GetWriter())
+		if flags.Pretty {
+			js.SetIndent("", "    ")
+		}
+		return js.Encode(rep)
+	}
+
+	lines := []string{
+		fmt.Sprintf("peer version: %s", rep.PeerVersion),
+		fmt.Sprintf("peer capabilities: %s", strings.Join(rep.PeerCapabilities, ", ")),
+		fmt.Sprintf("local capabilities: %s", strings.Join(rep.LocalCapabilities, ", ")),
+		fmt.Sprintf("negotiated capabilities: %s", strings.Join(rep.NegotiatedCapabilities, ", ")),
+		fmt.Sprintf("rtt: %s", rep.Rtt),
+		fmt.Sprintf("clock offset: %s", rep.ClockOffset),
+	}
+
+	if rep.MaxProbed == 0 {
+		lines = append(lines, "max payload: not probed, the underlay may fragment probes unless pmtud is enabled")
+	} else {
+		lines = append(lines, fmt.Sprintf("max payload: %d bytes (%d byte udp payload), tun.mtu should be at most %d", rep.MaxPayload, rep.MaxPayload+diagOverhead, rep.MaxPayload))
+	}
+	if rep.MaxProbed != 0 && rep.MaxPayload == rep.MaxProbed {
+		lines = append(lines, fmt.Sprintf("every probe up to the -max of %d bytes got a reply", rep.MaxProbed))
+	}
+	lines = append(lines, fmt.Sprintf("probes sent: %d", rep.Probes))
+
+	for _, line := range lines {
+		if err := w.WriteLine(line); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func sshDeviceInfo(ifce *Interface, fs interface{}, w sshd.StringWriter) error {
+
+	data := struct {
+		Name string `json:"name"`
+		Cidr string `json:"cidr"`
+	}{
+		Name: ifce.inside.Name(),
+		Cidr: ifce.inside.Cidr().String(),
+	}
+
+	flags, ok := fs.(*sshDeviceInfoFlags)
+	if !ok {
+		return fmt.Errorf("internal error: expected flags to be sshDeviceInfoFlags but was %+v", fs)
+	}
+
+	if flags.Json || flags.Pretty {
+		js := json.NewEncoder(w.GetWriter())
+		if flags.Pretty {
+			js.SetIndent("", "    ")
+		}
 
 		return js.Encode(data)
 	} else {
@@ -1002,8 +1492,467 @@ func sshDeviceInfo(ifce *Interface, fs interface{}, w sshd.StringWriter) error {
 	}
 }
 
+func sshPerf(ifce *Interface, fs interface{}, w sshd.StringWriter) error {
+	flags, ok := fs.(*sshPerfFlags)
+	if !ok {
+		return fmt.Errorf("internal error: expected flags to be sshPerfFlags but was %+v", fs)
+	}
+
+	data := ifce.perfStats(flags.Reset)
+
+	if flags.Json || flags.Pretty {
+		js := json.NewEncoder(w.GetWriter())
+		if flags.Pretty {
+			js.SetIndent("", "    ")
+		}
+
+		return js.Encode(data)
+	}
+
+	err := w.WriteLine(fmt.Sprintf("goroutines=%v routines=%v", data.Goroutines, data.Routines))
+	if err != nil {
+		return err
+	}
+
+	err = w.WriteLine(fmt.Sprintf("readers: inside=%v outside=%v", data.InsideReaders, data.OutsideReaders))
+	if err != nil {
+		return err
+	}
+
+	err = w.WriteLine(fmt.Sprintf("buffers: size=%v inside_high=%v outside_high=%v", data.BufferSize, data.InsideReadHigh, data.OutsideReadHigh))
+	if err != nil {
+		return err
+	}
+
+	for _, q := range data.Queues {
+		err = w.WriteLine(fmt.Sprintf("queue %s: len=%v cap=%v high=%v", q.Name, q.Len, q.Cap, q.High))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func sshPrintFirewallStats(ifce *Interface, fs interface{}, w sshd.StringWriter) error {
+	flags, ok := fs.(*sshPrintFirewallStatsFlags)
+	if !ok {
+		return fmt.Errorf("internal error: expected flags to be sshPrintFirewallStatsFlags but was %+v", fs)
+	}
+
+	fw := ifce.firewall
+	if !fw.ruleStatsEnabled {
+		return w.WriteLine("Firewall rule stats are disabled, set firewall.rule_stats to enable them")
+	}
+
+	stats := fw.RuleStats()
+
+	if flags.Json || flags.Pretty {
+		js := json.NewEncoder(w.GetWriter())
+		if flags.Pretty {
+			js.SetIndent("", "    ")
+		}
+
+		return js.Encode(stats)
+	}
+
+	for _, rs := range stats {
+		err := w.WriteLine(fmt.Sprintf("%s %v: conns=%v packets=%v bytes=%v rule=%v", rs.Direction, rs.Index, rs.Conns, rs.Packets, rs.Bytes, rs.Rule))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func sshPrintRelayUsage(ifce *Interface, fs interface{}, w sshd.StringWriter) error {
+	flags, ok := fs.(*sshPrintRelayUsageFlags)
+	if !ok {
+		return fmt.Errorf("internal error: expected flags to be sshPrintRelayUsageFlags but was %+v", fs)
+	}
+
+	usage := ifce.relayManager.accounting.Usage()
+
+	if flags.Json || flags.Pretty {
+		js := json.NewEncoder(w.GetWriter())
+		if flags.Pretty {
+			js.SetIndent("", "    ")
+		}
+
+		return js.Encode(usage)
+	}
+
+	for _, u := range usage {
+		err := w.WriteLine(fmt.Sprintf("%s: in_packets=%v in_bytes=%v out_packets=%v out_bytes=%v dropped=%v", u.VpnIp, u.InPackets, u.InBytes, u.OutPackets, u.OutBytes, u.Dropped))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func sshPrintCIDRSets(ifce *Interface, fs interface{}, a []string, w sshd.StringWriter) error {
+	flags, ok := fs.(*sshPrintCIDRSetsFlags)
+	if !ok {
+		return fmt.Errorf("internal error: expected flags to be sshPrintCIDRSetsFlags but was %+v", fs)
+	}
+
+	sets := ifce.firewall.CIDRSets()
+	if len(a) > 0 {
+		var filtered []FirewallCIDRSet
+		for _, s := range sets {
+			for _, name := range a {
+				if s.Name == name {
+					filtered = append(filtered, s)
+					break
+				}
+			}
+		}
+		sets = filtered
+	}
+
+	if flags.Json || flags.Pretty {
+		js := json.NewEncoder(w.GetWriter())
+		if flags.Pretty {
+			js.SetIndent("", "    ")
+		}
+
+		return js.Encode(sets)
+	}
+
+	if len(sets) == 0 {
+		return w.WriteLine("No cidr sets, they are defined in firewall.cidr_sets")
+	}
+
+	for _, s := range sets {
+		name := s.Name
+		if s.Blocked {
+			name += " (blocked)"
+		}
+
+		err := w.WriteLine(fmt.Sprintf("%s: %s", name, strings.Join(s.CIDRs, " ")))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func sshChangeCIDRSet(ifce *Interface, fs interface{}, a []string, w sshd.StringWriter) error {
+	flags, ok := fs.(*sshChangeCIDRSetFlags)
+	if !ok {
+		return fmt.Errorf("internal error: expected flags to be sshChangeCIDRSetFlags but was %+v", fs)
+	}
+
+	if flags.Remove && flags.Replace {
+		return w.WriteLine("Only one of -remove or -replace can be set")
+	}
+
+	if len(a) == 0 {
+		return w.WriteLine("No cidr set was provided")
+	}
+
+	if len(a) == 1 && !flags.Replace {
+		return w.WriteLine("No entries were provided")
+	}
+
+	cidrs, err := parseCIDRSetEntries(a[1:])
+	if err != nil {
+		return w.WriteLine(fmt.Sprintf("The provided entries could not be parsed: %s", err))
+	}
+
+	fw := ifce.firewall
+	switch {
+	case flags.Remove:
+		err = fw.RemoveFromCIDRSet(a[0], cidrs)
+	case flags.Replace:
+		err = fw.ReplaceCIDRSet(a[0], cidrs)
+	default:
+		err = fw.AddToCIDRSet(a[0], cidrs)
+	}
+	if err != nil {
+		return w.WriteLine(err.Error())
+	}
+
+	return w.WriteLine("Changed")
+}
+
+func sshPrintUnsafeRoutes(ifce *Interface, fs interface{}, w sshd.StringWriter) error {
+	flags, ok := fs.(*sshPrintUnsafeRoutesFlags)
+	if !ok {
+		return fmt.Errorf("internal error: expected flags to be sshPrintUnsafeRoutesFlags but was %+v", fs)
+	}
+
+	rm, err := ifce.unsafeRouteManager()
+	if err != nil {
+		return w.WriteLine(err.Error())
+	}
+
+	routes := rm.UnsafeRoutes()
+	if flags.Json || flags.Pretty {
+		out := make([]sshUnsafeRoute, len(routes))
+		for i, r := range routes {
+			out[i] = sshUnsafeRoute{Route: r.Cidr.String(), Via: *r.Via, MTU: r.MTU, Metric: r.Metric, Install: r.Install}
+		}
+
+		js := json.NewEncoder(w.GetWriter())
+		if flags.Pretty {
+			js.SetIndent("", "    ")
+		}
+
+		return js.Encode(out)
+	}
+
+	if len(routes) == 0 {
+		return w.WriteLine("No unsafe routes")
+	}
+
+	for _, r := range routes {
+		line := fmt.Sprintf("%s via %s", r.Cidr, r.Via)
+		if r.MTU != 0 {
+			line += fmt.Sprintf(" mtu: %v", r.MTU)
+		}
+		if r.Metric != 0 {
+			line += fmt.Sprintf(" metric: %v", r.Metric)
+		}
+		if !r.Install {
+			line += " (not installed)"
+		}
+
+		if err := w.WriteLine(line); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func sshChangeUnsafeRoute(ifce *Interface, fs interface{}, a []string, w sshd.StringWriter) error {
+	flags, ok := fs.(*sshChangeUnsafeRouteFlags)
+	if !ok {
+		return fmt.Errorf("internal error: expected flags to be sshChangeUnsafeRouteFlags but was %+v", fs)
+	}
+
+	if len(a) == 0 {
+		return w.WriteLine("No routes were provided")
+	}
+
+	rm, err := ifce.unsafeRouteManager()
+	if err != nil {
+		return w.WriteLine(err.Error())
+	}
+
+	cidrs := make([]*net.IPNet, len(a))
+	for i, s := range a {
+		_, cidrs[i], err = net.ParseCIDR(s)
+		if err != nil {
+			return w.WriteLine(fmt.Sprintf("The provided route could not be parsed: %s", err))
+		}
+	}
+
+	if flags.Remove {
+		err = rm.RemoveUnsafeRoutes(cidrs)
+	} else {
+		via := net.ParseIP(flags.Via)
+		if via == nil {
+			return w.WriteLine("A valid -via vpn ip is required to add routes")
+		}
+		vpnIp := iputil.Ip2VpnIp(via)
+
+		routes := make([]overlay.Route, len(cidrs))
+		for i, n := range cidrs {
+			routes[i] = overlay.Route{Cidr: n, Via: &vpnIp, MTU: flags.MTU, Metric: flags.Metric, Install: !flags.NoInstall}
+		}
+		err = rm.AddUnsafeRoutes(routes)
+	}
+	if err != nil {
+		return w.WriteLine(err.Error())
+	}
+
+	return w.WriteLine("Changed")
+}
+
 func sshReload(c *config.C, w sshd.StringWriter) error {
 	err := w.WriteLine("Reloading config")
 	c.ReloadConfig()
 	return err
 }
+
+func sshTcpdump(ifce *Interface, fs interface{}, a []string, w sshd.StringWriter) error {
+	flags, ok := fs.(*sshTcpdumpFlags)
+	if !ok {
+		//TODO: error
+		return nil
+	}
+
+	filter, err := parseCaptureFilter(strings.Join(a, " "))
+	if err != nil {
+		return w.WriteLine(err.Error())
+	}
+
+	if flags.Duration <= 0 || flags.Duration > captureMaxDuration {
+		return w.WriteLine(fmt.Sprintf("-t must be greater than 0 and at most %s", captureMaxDuration))
+	}
+	if flags.Snaplen <= 0 || flags.Snaplen > captureMaxSnaplen {
+		return w.WriteLine(fmt.Sprintf("-s must be between 1 and %d", captureMaxSnaplen))
+	}
+	if flags.MaxBytes <= 0 {
+		return w.WriteLine("-max-bytes must be greater than 0")
+	}
+
+	// A pcap stream is binary, it can only be written to the channel of an exec session and not an interactive shell
+	ch, isExec := w.GetWriter().(ssh.Channel)
+	if flags.Pcap && !isExec {
+		return w.WriteLine("-w writes a binary pcap stream and needs an ssh exec session, ex: `ssh -p 2222 host tcpdump -w > capture.pcap`")
+	}
+
+	var local netip.AddrPort
+	if ua, err := ifce.outside.LocalAddr(); err == nil && ua != nil {
+		if ip, ok := netip.AddrFromSlice(ua.IP); ok {
+			local = netip.AddrPortFrom(ip.Unmap(), ua.Port)
+		}
+	}
+
+	pc := newPacketCapture(flags.Outer, filter, flags.Snaplen, local)
+	stop := ifce.captures.start(pc)
+	defer stop()
+
+	if flags.Pcap {
+		if err := writePcapHeader(ch, flags.Snaplen); err != nil {
+			return nil
+		}
+	}
+
+	timer := time.NewTimer(flags.Duration)
+	defer timer.Stop()
+
+	count, size := 0, 0
+capture:
+	for (flags.Count == 0 || count < flags.Count) && size < flags.MaxBytes {
+		select {
+		case <-timer.C:
+			break capture
+		case p := <-pc.packets:
+			if flags.Pcap {
+				err = writePcapRecord(ch, p)
+			} else {
+				err = w.WriteLine(p.String())
+			}
+			if err != nil {
+				// The client went away
+				return nil
+			}
+			count++
+			size += len(p.data)
+		}
+	}
+
+	summary := fmt.Sprintf("%d packets captured, %d dropped", count, pc.dropped.Load())
+	if flags.Pcap {
+		_, err = fmt.Fprintln(ch.Stderr(), summary)
+		return err
+	}
+	return w.WriteLine(summary)
+}
+
+func sshTestHandshake(ifce *Interface, fs interface{}, a []string, w sshd.StringWriter) error {
+	flags, ok := fs.(*sshTestHandshakeFlags)
+	if !ok {
+		//TODO: error
+		return nil
+	}
+
+	if len(a) == 0 {
+		return w.WriteLine("No vpn ip was provided")
+	}
+
+	parsedIp := net.ParseIP(a[0])
+	if parsedIp == nil {
+		return w.WriteLine(fmt.Sprintf("The provided vpn ip could not be parsed: %s", a[0]))
+	}
+
+	vpnIp := iputil.Ip2VpnIp(parsedIp)
+	if !vpnIp.IsValid() {
+		return w.WriteLine(fmt.Sprintf("The provided vpn ip could not be parsed: %s", a[0]))
+	}
+
+	if ifce.isMyVpnIp(vpnIp) {
+		return w.WriteLine("Can not handshake with ourselves")
+	}
+
+	timeout := flags.Timeout
+	if timeout <= 0 {
+		timeout = hsTimeout(ifce.handshakeManager.config.retries, ifce.handshakeManager.config.tryInterval) + time.Second
+	}
+
+	if hostinfo := ifce.hostMap.QueryVpnIp(vpnIp); hostinfo != nil {
+		path := "with no remote"
+		if remote := hostinfo.remote; remote != nil {
+			path = "direct to " + remote.String()
+		} else if relays := hostinfo.relayState.CopyRelayIps(); len(relays) > 0 {
+			path = fmt.Sprintf("through relays %v", relays)
+		}
+		err := w.WriteLine(fmt.Sprintf("A tunnel to %s exists %s, it stays up until the new handshake replaces it", vpnIp, path))
+		if err != nil {
+			return err
+		}
+	}
+
+	if ifce.handshakeManager.QueryVpnIp(vpnIp) != nil {
+		if err := w.WriteLine(fmt.Sprintf("A handshake with %s is already in progress, following it", vpnIp)); err != nil {
+			return err
+		}
+	}
+
+	watch := newHandshakeWatch()
+	var followed *HandshakeHostInfo
+	ifce.handshakeManager.StartHandshake(vpnIp, func(hh *HandshakeHostInfo) {
+		if hh.watch.CompareAndSwap(nil, watch) {
+			followed = hh
+		}
+	})
+	if followed == nil {
+		return w.WriteLine(fmt.Sprintf("The handshake with %s is already being followed by another session", vpnIp))
+	}
+	// Let another session follow the handshake if we stop before it is done
+	defer followed.watch.CompareAndSwap(watch, nil)
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+follow:
+	for {
+		select {
+		case step := <-watch.steps:
+			if err := w.WriteLine(step); err != nil {
+				// The client went away
+				return nil
+			}
+		case <-watch.done:
+			break follow
+		case <-timer.C:
+			break follow
+		}
+	}
+
+	// Everything reported before the handshake finished is already in the channel
+	for len(watch.steps) > 0 {
+		if err := w.WriteLine(<-watch.steps); err != nil {
+			return nil
+		}
+	}
+
+	finished, _, dropped := watch.result()
+	if dropped > 0 {
+		if err := w.WriteLine(fmt.Sprintf("%d steps were dropped, the client could not keep up", dropped)); err != nil {
+			return err
+		}
+	}
+	if !finished {
+		return w.WriteLine(fmt.Sprintf("Gave up waiting for the handshake after %s", timeout))
+	}
+	return nil
+}
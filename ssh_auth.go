@@ -0,0 +1,320 @@
+package nebula
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/slackhq/nebula/cert"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/iputil"
+	"github.com/slackhq/nebula/sshd"
+	"golang.org/x/crypto/ssh"
+)
+
+// The permission extensions holding what a host that logged in over the overlay may do, see sshAccess.authenticate
+const (
+	sshLevelExtension    = "nebula-level"
+	sshCommandsExtension = "nebula-commands"
+)
+
+// sshAuthorizedGroup lets hosts with a nebula certificate in group log in to the sshd over the overlay
+type sshAuthorizedGroup struct {
+	group string
+	level adminLevel
+	// commands the group may run beyond what level allows
+	commands []string
+}
+
+// sshAccessConfig is who may log in to the sshd without a key and what everyone may run once they are in
+type sshAccessConfig struct {
+	groups       []sshAuthorizedGroup
+	users        map[string]adminLevel
+	defaultLevel adminLevel
+}
+
+// sshAccess decides what an ssh connection may run and records what it did. It also logs in ssh clients connecting
+// over a tunnel based on the nebula certificate of the tunnel instead of an ssh key, the handshake already proved the
+// peer holds the key of its certificate.
+type sshAccess struct {
+	f      *Interface
+	audit  *adminAudit
+	config atomic.Pointer[sshAccessConfig]
+}
+
+// newSSHAccessConfigFromConfig reads sshd.authorized_groups, the level of each of sshd.authorized_users and
+// sshd.default_level
+func newSSHAccessConfigFromConfig(c *config.C) (*sshAccessConfig, error) {
+	ac := &sshAccessConfig{users: map[string]adminLevel{}}
+
+	var err error
+	ac.defaultLevel, err = parseAdminLevel(c.GetString("sshd.default_level", adminLevelReload.String()))
+	if err != nil {
+		return nil, fmt.Errorf("sshd.default_level: %s", err)
+	}
+
+	// configSSH warns about anything else wrong with the users, only the level matters here
+	if rawUsers, ok := c.Get("sshd.authorized_users").([]interface{}); ok {
+		for i, ru := range rawUsers {
+			m, ok := ru.(map[interface{}]interface{})
+			if !ok {
+				continue
+			}
+			user, ok := m["user"].(string)
+			if !ok {
+				continue
+			}
+
+			level := ac.defaultLevel
+			if rl, ok := m["level"]; ok {
+				level, err = parseAdminLevel(fmt.Sprint(rl))
+				if err != nil {
+					return nil, fmt.Errorf("sshd.authorized_users[%d].level: %s", i, err)
+				}
+			}
+			ac.users[user] = level
+		}
+	}
+
+	raw := c.Get("sshd.authorized_groups")
+	if raw == nil {
+		return ac, nil
+	}
+
+	rawGroups, ok := raw.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("sshd.authorized_groups must be a list, got %T", raw)
+	}
+
+	for i, rg := range rawGroups {
+		m, ok := rg.(map[interface{}]interface{})
+		if !ok {
+			return nil, fmt.Errorf("sshd.authorized_groups[%d] must be a map, got %T", i, rg)
+		}
+
+		group, ok := m["group"].(string)
+		if !ok || group == "" {
+			return nil, fmt.Errorf("sshd.authorized_groups[%d].group must be provided", i)
+		}
+
+		ag := sshAuthorizedGroup{group: group}
+		rc, hasCommands := m["commands"]
+		if hasCommands {
+			rcs, ok := rc.([]interface{})
+			if !ok {
+				return nil, fmt.Errorf("sshd.authorized_groups[%d].commands must be a list, got %T", i, rc)
+			}
+
+			for _, cmd := range rcs {
+				name, ok := cmd.(string)
+				if !ok || name == "" || strings.Contains(name, ",") {
+					return nil, fmt.Errorf("sshd.authorized_groups[%d].commands has an invalid command: %v", i, cmd)
+				}
+				ag.commands = append(ag.commands, name)
+			}
+		}
+
+		// A group with neither a level nor commands may run everything
+		if rl, ok := m["level"]; ok {
+			ag.level, err = parseAdminLevel(fmt.Sprint(rl))
+			if err != nil {
+				return nil, fmt.Errorf("sshd.authorized_groups[%d].level: %s", i, err)
+			}
+		} else if !hasCommands {
+			ag.level = adminLevelReload
+		}
+
+		ac.groups = append(ac.groups, ag)
+	}
+
+	return ac, nil
+}
+
+// sshGrantForCert returns the highest level and every command nc may run because of its groups. false is returned if
+// none of the groups of nc are authorized.
+func sshGrantForCert(groups []sshAuthorizedGroup, nc *cert.NebulaCertificate) (adminLevel, []string, bool) {
+	has := make(map[string]struct{}, len(nc.Details.Groups))
+	for _, g := range nc.Details.Groups {
+		has[g] = struct{}{}
+	}
+
+	authorized := false
+	level := adminLevelNone
+	commands := map[string]struct{}{}
+	for _, ag := range groups {
+		if _, ok := has[ag.group]; !ok {
+			continue
+		}
+
+		authorized = true
+		if ag.level > level {
+			level = ag.level
+		}
+		for _, cmd := range ag.commands {
+			commands[cmd] = struct{}{}
+		}
+	}
+
+	if !authorized {
+		return adminLevelNone, nil, false
+	}
+
+	r := make([]string, 0, len(commands))
+	for cmd := range commands {
+		r = append(r, cmd)
+	}
+	sort.Strings(r)
+	return level, r, true
+}
+
+// authenticate is the sshd.PeerAuthenticator, the client must connect to one of our vpn ips from the vpn ip of a host
+// we have a tunnel with, and the certificate of that tunnel must be in one of sshd.authorized_groups
+func (a *sshAccess) authenticate(c ssh.ConnMetadata) (*ssh.Permissions, error) {
+	ac := a.config.Load()
+	if ac == nil || len(ac.groups) == 0 {
+		return nil, errors.New("sshd.authorized_groups is not configured")
+	}
+
+	local, ok := c.LocalAddr().(*net.TCPAddr)
+	if !ok {
+		return nil, fmt.Errorf("unexpected local address %v", c.LocalAddr())
+	}
+	remote, ok := c.RemoteAddr().(*net.TCPAddr)
+	if !ok {
+		return nil, fmt.Errorf("unexpected remote address %v", c.RemoteAddr())
+	}
+
+	if !a.f.isMyVpnIp(iputil.Ip2VpnIp(local.IP)) {
+		return nil, fmt.Errorf("the client connected to %s and not to a vpn ip", local.IP)
+	}
+
+	vpnIp := iputil.Ip2VpnIp(remote.IP)
+	hostinfo := a.f.hostMap.QueryVpnIp(vpnIp)
+	if hostinfo == nil {
+		return nil, fmt.Errorf("no tunnel with %s", vpnIp)
+	}
+
+	nc := hostinfo.GetCert()
+	if nc == nil {
+		return nil, fmt.Errorf("no certificate for the tunnel with %s", vpnIp)
+	}
+
+	// The certificate may have expired or been blocked since the handshake
+	if _, err := nc.Verify(time.Now(), a.f.pki.GetCAPool()); err != nil {
+		return nil, fmt.Errorf("the certificate of %s is no longer valid: %s", vpnIp, err)
+	}
+
+	level, commands, ok := sshGrantForCert(ac.groups, nc)
+	if !ok {
+		return nil, fmt.Errorf("the certificate %s of %s is not in any of sshd.authorized_groups", nc.Details.Name, vpnIp)
+	}
+
+	fp, err := nc.Fingerprint()
+	if err != nil {
+		return nil, err
+	}
+
+	p := &ssh.Permissions{
+		Extensions: map[string]string{
+			"fp":              fp,
+			"user":            c.User(),
+			sshLevelExtension: level.String(),
+		},
+	}
+	if len(commands) > 0 {
+		p.Extensions[sshCommandsExtension] = strings.Join(commands, ",")
+	}
+
+	return p, nil
+}
+
+// grant returns the level and the extra commands of a connection. A host that logged in over the overlay carries them
+// in its permissions, everyone else gets the level of their user.
+func (a *sshAccess) grant(user string, p *ssh.Permissions) (adminLevel, []string) {
+	if p != nil {
+		if rl, ok := p.Extensions[sshLevelExtension]; ok {
+			level, err := parseAdminLevel(rl)
+			if err != nil {
+				return adminLevelNone, nil
+			}
+
+			var commands []string
+			if rc := p.Extensions[sshCommandsExtension]; rc != "" {
+				commands = strings.Split(rc, ",")
+			}
+			return level, commands
+		}
+	}
+
+	ac := a.config.Load()
+	if ac == nil {
+		return adminLevelNone, nil
+	}
+
+	if level, ok := ac.users[user]; ok {
+		return level, nil
+	}
+	return ac.defaultLevel, nil
+}
+
+// Allowed is part of sshd.CommandPolicy
+func (a *sshAccess) Allowed(c *ssh.ServerConn, name string) bool {
+	level, commands := a.grant(c.User(), c.Permissions)
+	if sshCommandLevel(name) <= level {
+		return true
+	}
+
+	for _, cmd := range commands {
+		if cmd == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Audit is part of sshd.CommandPolicy
+func (a *sshAccess) Audit(c *ssh.ServerConn, name string, args []string, err error) {
+	e := adminAuditEntry{
+		Interface: "ssh",
+		User:      c.User(),
+		Remote:    c.RemoteAddr().String(),
+		Action:    name,
+		Args:      args,
+		Allowed:   !errors.Is(err, sshd.ErrCommandDenied),
+	}
+	if c.Permissions != nil {
+		e.Fingerprint = c.Permissions.Extensions["fp"]
+	}
+	if err != nil {
+		e.Error = err.Error()
+	}
+
+	a.audit.record(e)
+}
+
+func attachSSHAccess(l *logrus.Logger, c *config.C, ssh *sshd.SSHServer, f *Interface, audit *adminAudit) {
+	a := &sshAccess{f: f, audit: audit}
+
+	load := func(c *config.C) {
+		if !c.InitialLoad() && !c.HasChanged("sshd") {
+			return
+		}
+
+		ac, err := newSSHAccessConfigFromConfig(c)
+		if err != nil {
+			l.WithError(err).Error("Failed to load the sshd access config")
+			return
+		}
+		a.config.Store(ac)
+	}
+
+	load(c)
+	c.RegisterReloadCallback(load)
+	ssh.SetPeerAuthenticator(a.authenticate)
+	ssh.SetCommandPolicy(a)
+}
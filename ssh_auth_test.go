@@ -0,0 +1,279 @@
+package nebula
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/slackhq/nebula/cert"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/iputil"
+	"github.com/slackhq/nebula/sshd"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+)
+
+type testSSHConnMetadata struct {
+	user          string
+	local, remote net.Addr
+}
+
+func (c *testSSHConnMetadata) User() string          { return c.user }
+func (c *testSSHConnMetadata) SessionID() []byte     { return nil }
+func (c *testSSHConnMetadata) ClientVersion() []byte { return nil }
+func (c *testSSHConnMetadata) ServerVersion() []byte { return nil }
+func (c *testSSHConnMetadata) RemoteAddr() net.Addr  { return c.remote }
+func (c *testSSHConnMetadata) LocalAddr() net.Addr   { return c.local }
+
+func TestNewSSHAccessConfigFromConfig(t *testing.T) {
+	l := test.NewLogger()
+	c := config.NewC(l)
+
+	ac, err := newSSHAccessConfigFromConfig(c)
+	require.NoError(t, err)
+	assert.Equal(t, &sshAccessConfig{users: map[string]adminLevel{}, defaultLevel: adminLevelReload}, ac)
+
+	require.NoError(t, c.LoadString(`
+sshd:
+  default_level: read
+  authorized_users:
+    - user: steeeeve
+      keys: "ssh public key string"
+    - user: root
+      level: reload
+  authorized_groups:
+    - group: ops
+    - group: support
+      commands: [list-hostmap, print-tunnel]
+    - group: net
+      level: tunnel
+      commands: [reload]
+`))
+	ac, err = newSSHAccessConfigFromConfig(c)
+	require.NoError(t, err)
+	assert.Equal(t, &sshAccessConfig{
+		groups: []sshAuthorizedGroup{
+			{group: "ops", level: adminLevelReload},
+			{group: "support", commands: []string{"list-hostmap", "print-tunnel"}},
+			{group: "net", level: adminLevelTunnel, commands: []string{"reload"}},
+		},
+		users:        map[string]adminLevel{"steeeeve": adminLevelRead, "root": adminLevelReload},
+		defaultLevel: adminLevelRead,
+	}, ac)
+
+	for raw, expected := range map[string]string{
+		"sshd: {default_level: all}":                                           "sshd.default_level: unknown level `all`. possible levels: [none read tunnel reload]",
+		"sshd: {authorized_users: [{user: a, level: root}]}":                   "sshd.authorized_users[0].level: unknown level `root`. possible levels: [none read tunnel reload]",
+		"sshd: {authorized_groups: ops}":                                       "sshd.authorized_groups must be a list, got string",
+		"sshd: {authorized_groups: [ops]}":                                     "sshd.authorized_groups[0] must be a map, got string",
+		"sshd: {authorized_groups: [{commands: [help]}]}":                      "sshd.authorized_groups[0].group must be provided",
+		"sshd: {authorized_groups: [{group: ops, commands: help}]}":            "sshd.authorized_groups[0].commands must be a list, got string",
+		"sshd: {authorized_groups: [{group: ops}, {group: b, commands: [1]}]}": "sshd.authorized_groups[1].commands has an invalid command: 1",
+		"sshd: {authorized_groups: [{group: ops, level: write}]}":              "sshd.authorized_groups[0].level: unknown level `write`. possible levels: [none read tunnel reload]",
+	} {
+		require.NoError(t, c.LoadString(raw))
+		_, err = newSSHAccessConfigFromConfig(c)
+		assert.EqualError(t, err, expected, raw)
+	}
+}
+
+func TestSSHGrantForCert(t *testing.T) {
+	groups := []sshAuthorizedGroup{
+		{group: "support", commands: []string{"print-tunnel", "list-hostmap"}},
+		{group: "net", level: adminLevelTunnel, commands: []string{"close-tunnel", "list-hostmap"}},
+		{group: "ops", level: adminLevelReload},
+	}
+	nc := func(groups ...string) *cert.NebulaCertificate {
+		return &cert.NebulaCertificate{Details: cert.NebulaCertificateDetails{Groups: groups}}
+	}
+
+	level, commands, ok := sshGrantForCert(groups, nc("support", "net"))
+	assert.True(t, ok)
+	assert.Equal(t, adminLevelTunnel, level)
+	assert.Equal(t, []string{"close-tunnel", "list-hostmap", "print-tunnel"}, commands)
+
+	level, _, ok = sshGrantForCert(groups, nc("support", "ops"))
+	assert.True(t, ok)
+	assert.Equal(t, adminLevelReload, level)
+
+	_, _, ok = sshGrantForCert(groups, nc("dev"))
+	assert.False(t, ok)
+}
+
+func TestSSHAccess_Authenticate(t *testing.T) {
+	l := test.NewLogger()
+	now := time.Now()
+	myIp := iputil.Ip2VpnIp(net.ParseIP("10.1.0.1"))
+	peerIp := iputil.Ip2VpnIp(net.ParseIP("10.1.0.2"))
+	_, vpncidr, _ := net.ParseCIDR("10.1.0.0/16")
+
+	pubCA, privCA, _ := ed25519.GenerateKey(rand.Reader)
+	caCert := cert.NebulaCertificate{
+		Details: cert.NebulaCertificateDetails{
+			Name:      "ca",
+			NotBefore: now.Add(-time.Hour),
+			NotAfter:  now.Add(time.Hour),
+			IsCA:      true,
+			PublicKey: pubCA,
+		},
+	}
+	require.NoError(t, caCert.Sign(cert.Curve_CURVE25519, privCA))
+	ncp := cert.NewCAPool()
+	ncp.CAs["ca"] = &caCert
+
+	pub, _, _ := ed25519.GenerateKey(rand.Reader)
+	peerCert := cert.NebulaCertificate{
+		Details: cert.NebulaCertificateDetails{
+			Name:      "peer",
+			Ips:       []*net.IPNet{{IP: net.ParseIP("10.1.0.2"), Mask: vpncidr.Mask}},
+			Groups:    []string{"support"},
+			NotBefore: now.Add(-time.Hour),
+			NotAfter:  now.Add(time.Hour),
+			PublicKey: pub,
+			Issuer:    "ca",
+		},
+	}
+	require.NoError(t, peerCert.Sign(cert.Curve_CURVE25519, privCA))
+
+	f := &Interface{hostMap: newHostMap(l, vpncidr), pki: &PKI{}, myVpnIps: []iputil.VpnIp{myIp}, l: l}
+	f.pki.caPool.Store(ncp)
+	f.hostMap.unlockedAddHostInfo(&HostInfo{vpnIp: peerIp, ConnectionState: &ConnectionState{peerCert: &peerCert}}, f)
+
+	a := &sshAccess{f: f}
+	cm := &testSSHConnMetadata{
+		user:   "admin",
+		local:  &net.TCPAddr{IP: net.ParseIP("10.1.0.1"), Port: 2222},
+		remote: &net.TCPAddr{IP: net.ParseIP("10.1.0.2"), Port: 50000},
+	}
+
+	_, err := a.authenticate(cm)
+	assert.EqualError(t, err, "sshd.authorized_groups is not configured")
+
+	a.config.Store(&sshAccessConfig{groups: []sshAuthorizedGroup{{group: "support", level: adminLevelRead, commands: []string{"close-tunnel"}}}})
+	p, err := a.authenticate(cm)
+	require.NoError(t, err)
+	fp, _ := peerCert.Fingerprint()
+	assert.Equal(t, map[string]string{"fp": fp, "user": "admin", sshLevelExtension: "read", sshCommandsExtension: "close-tunnel"}, p.Extensions)
+
+	a.config.Store(&sshAccessConfig{groups: []sshAuthorizedGroup{{group: "support", level: adminLevelReload}}})
+	p, err = a.authenticate(cm)
+	require.NoError(t, err)
+	assert.Equal(t, "reload", p.Extensions[sshLevelExtension])
+	assert.NotContains(t, p.Extensions, sshCommandsExtension)
+
+	a.config.Store(&sshAccessConfig{groups: []sshAuthorizedGroup{{group: "ops", level: adminLevelReload}}})
+	_, err = a.authenticate(cm)
+	assert.EqualError(t, err, "the certificate peer of 10.1.0.2 is not in any of sshd.authorized_groups")
+
+	// Only clients connecting over the overlay are accepted
+	cm.local = &net.TCPAddr{IP: net.ParseIP("192.168.0.1"), Port: 2222}
+	_, err = a.authenticate(cm)
+	assert.EqualError(t, err, "the client connected to 192.168.0.1 and not to a vpn ip")
+
+	cm.local = &net.TCPAddr{IP: net.ParseIP("10.1.0.1"), Port: 2222}
+	cm.remote = &net.TCPAddr{IP: net.ParseIP("10.1.0.3"), Port: 50000}
+	_, err = a.authenticate(cm)
+	assert.EqualError(t, err, "no tunnel with 10.1.0.3")
+
+	// A certificate blocked after the handshake is refused
+	cm.remote = &net.TCPAddr{IP: net.ParseIP("10.1.0.2"), Port: 50000}
+	ncp.BlocklistFingerprint(fp)
+	_, err = a.authenticate(cm)
+	assert.EqualError(t, err, "the certificate of 10.1.0.2 is no longer valid: certificate is in the block list")
+}
+
+// testSSHConn is enough of an ssh.Conn for sshAccess
+type testSSHConn struct {
+	testSSHConnMetadata
+}
+
+func (c *testSSHConn) SendRequest(string, bool, []byte) (bool, []byte, error) { return false, nil, nil }
+func (c *testSSHConn) OpenChannel(string, []byte) (ssh.Channel, <-chan *ssh.Request, error) {
+	return nil, nil, nil
+}
+func (c *testSSHConn) Close() error { return nil }
+func (c *testSSHConn) Wait() error  { return nil }
+
+func newTestSSHServerConn(user string, extensions map[string]string) *ssh.ServerConn {
+	return &ssh.ServerConn{
+		Conn: &testSSHConn{testSSHConnMetadata{
+			user:   user,
+			local:  &net.TCPAddr{IP: net.ParseIP("10.1.0.1"), Port: 2222},
+			remote: &net.TCPAddr{IP: net.ParseIP("10.1.0.2"), Port: 50000},
+		}},
+		Permissions: &ssh.Permissions{Extensions: extensions},
+	}
+}
+
+func TestSSHAccess_Allowed(t *testing.T) {
+	a := &sshAccess{}
+
+	// Nothing is allowed until the config is loaded
+	assert.False(t, a.Allowed(newTestSSHServerConn("root", nil), "list-hostmap"))
+
+	a.config.Store(&sshAccessConfig{
+		users:        map[string]adminLevel{"steeeeve": adminLevelRead, "root": adminLevelReload},
+		defaultLevel: adminLevelTunnel,
+	})
+
+	steeeeve := newTestSSHServerConn("steeeeve", map[string]string{"fp": "abc"})
+	assert.True(t, a.Allowed(steeeeve, "help"))
+	assert.True(t, a.Allowed(steeeeve, "list-hostmap"))
+	assert.False(t, a.Allowed(steeeeve, "close-tunnel"))
+	assert.False(t, a.Allowed(steeeeve, "reload"))
+
+	other := newTestSSHServerConn("other", nil)
+	assert.True(t, a.Allowed(other, "close-tunnel"))
+	assert.False(t, a.Allowed(other, "reload"))
+	assert.False(t, a.Allowed(other, "some-new-command"), "commands without a level need reload")
+
+	root := newTestSSHServerConn("root", nil)
+	assert.True(t, a.Allowed(root, "reload"))
+	assert.True(t, a.Allowed(root, "some-new-command"))
+
+	// A host that logged in over the overlay gets what its groups allow, whatever user name it picked
+	peer := newTestSSHServerConn("root", map[string]string{sshLevelExtension: "read", sshCommandsExtension: "close-tunnel,reload"})
+	assert.True(t, a.Allowed(peer, "print-tunnel"))
+	assert.True(t, a.Allowed(peer, "close-tunnel"))
+	assert.True(t, a.Allowed(peer, "reload"))
+	assert.False(t, a.Allowed(peer, "create-tunnel"))
+
+	peer = newTestSSHServerConn("root", map[string]string{sshLevelExtension: "bogus"})
+	assert.False(t, a.Allowed(peer, "list-hostmap"))
+	assert.True(t, a.Allowed(peer, "help"))
+}
+
+func TestSSHAccess_Audit(t *testing.T) {
+	l := test.NewLogger()
+	path := filepath.Join(t.TempDir(), "audit.log")
+	c := config.NewC(l)
+	require.NoError(t, c.LoadString("audit: {path: "+path+"}"))
+	audit, err := newAdminAuditFromConfig(l, c)
+	require.NoError(t, err)
+
+	a := &sshAccess{audit: audit}
+	conn := newTestSSHServerConn("steeeeve", map[string]string{"fp": "abc"})
+	a.Audit(conn, "close-tunnel", []string{"10.1.0.3"}, sshd.ErrCommandDenied)
+	a.Audit(conn, "list-hostmap", nil, nil)
+
+	entries := readTestAuditLog(t, path)
+	require.Len(t, entries, 2)
+	assert.Equal(t, adminAuditEntry{
+		Time:        entries[0].Time,
+		Interface:   "ssh",
+		User:        "steeeeve",
+		Fingerprint: "abc",
+		Remote:      "10.1.0.2:50000",
+		Action:      "close-tunnel",
+		Args:        []string{"10.1.0.3"},
+		Error:       "permission denied",
+	}, entries[0])
+	assert.Equal(t, "list-hostmap", entries[1].Action)
+	assert.True(t, entries[1].Allowed)
+	assert.Empty(t, entries[1].Error)
+}
@@ -0,0 +1,230 @@
+package nebula
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/slackhq/nebula/cert"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/sshd"
+	"golang.org/x/crypto/ssh"
+)
+
+const defaultSSHCertDuration = time.Hour
+
+// sshCertIssuer mints OpenSSH certificates whose identity is taken from a nebula certificate. The signer is any
+// ssh.Signer so the CA key can live in a local file or be backed by a remote signing service.
+type sshCertIssuer struct {
+	signer   ssh.Signer
+	duration time.Duration
+}
+
+type sshSignKeyFlags struct {
+	Host       bool
+	Duration   time.Duration
+	Principals string
+}
+
+func newSSHCertIssuer(signer ssh.Signer, duration time.Duration) *sshCertIssuer {
+	if duration <= 0 {
+		duration = defaultSSHCertDuration
+	}
+
+	return &sshCertIssuer{signer: signer, duration: duration}
+}
+
+// newSSHCertIssuerFromConfig loads the ssh ca key from sshd.ca.key, nil is returned if one is not configured
+func newSSHCertIssuerFromConfig(c *config.C) (*sshCertIssuer, error) {
+	keyPathOrKey := c.GetString("sshd.ca.key", "")
+	if keyPathOrKey == "" {
+		return nil, nil
+	}
+
+	var keyBytes []byte
+	if strings.Contains(keyPathOrKey, "-----BEGIN") {
+		keyBytes = []byte(keyPathOrKey)
+	} else {
+		var err error
+		keyBytes, err = os.ReadFile(keyPathOrKey)
+		if err != nil {
+			return nil, fmt.Errorf("error while loading sshd.ca.key file: %s", err)
+		}
+	}
+
+	signer, err := ssh.ParsePrivateKey(keyBytes)
+	if err != nil {
+		return nil, fmt.Errorf("error while parsing sshd.ca.key: %s", err)
+	}
+
+	return newSSHCertIssuer(signer, c.GetDuration("sshd.ca.duration", defaultSSHCertDuration)), nil
+}
+
+// sshPrincipalsForCert returns the principals an ssh certificate bound to nc should carry. User certificates get the
+// nebula name followed by the groups, host certificates get the name followed by the vpn ips.
+func sshPrincipalsForCert(nc *cert.NebulaCertificate, host bool) []string {
+	principals := []string{nc.Details.Name}
+	if host {
+		for _, ip := range nc.Details.Ips {
+			principals = append(principals, ip.IP.String())
+		}
+	} else {
+		principals = append(principals, nc.Details.Groups...)
+	}
+
+	return principals
+}
+
+// Issue signs pub with the ssh ca key, binding it to the identity in nc. The certificate will never outlive nc.
+// If principals is not empty it must be a subset of what nc grants and the certificate will be restricted to them.
+func (s *sshCertIssuer) Issue(nc *cert.NebulaCertificate, pub ssh.PublicKey, host bool, principals []string, duration time.Duration, now time.Time) (*ssh.Certificate, error) {
+	if nc == nil {
+		return nil, errors.New("no nebula certificate to bind to")
+	}
+
+	granted := sshPrincipalsForCert(nc, host)
+	if len(principals) == 0 {
+		principals = granted
+	} else {
+		allowed := map[string]struct{}{}
+		for _, p := range granted {
+			allowed[p] = struct{}{}
+		}
+
+		for _, p := range principals {
+			if _, ok := allowed[p]; !ok {
+				return nil, fmt.Errorf("principal %s is not granted by the nebula certificate", p)
+			}
+		}
+	}
+
+	if nc.Expired(now) {
+		return nil, cert.ErrExpired
+	}
+
+	if duration <= 0 {
+		duration = s.duration
+	}
+
+	validBefore := now.Add(duration)
+	if validBefore.After(nc.Details.NotAfter) {
+		validBefore = nc.Details.NotAfter
+	}
+
+	var serial [8]byte
+	if _, err := rand.Read(serial[:]); err != nil {
+		return nil, err
+	}
+
+	fp, err := nc.Fingerprint()
+	if err != nil {
+		return nil, err
+	}
+
+	sc := &ssh.Certificate{
+		Key:             pub,
+		Serial:          binary.BigEndian.Uint64(serial[:]),
+		CertType:        ssh.UserCert,
+		KeyId:           fmt.Sprintf("nebula:%s:%s", nc.Details.Name, fp),
+		ValidPrincipals: principals,
+		// Allow for a little clock skew between us and the host checking the certificate
+		ValidAfter:  uint64(now.Add(-time.Minute).Unix()),
+		ValidBefore: uint64(validBefore.Unix()),
+	}
+
+	if host {
+		sc.CertType = ssh.HostCert
+	} else {
+		sc.Permissions.Extensions = map[string]string{
+			"permit-pty":              "",
+			"permit-port-forwarding":  "",
+			"permit-agent-forwarding": "",
+		}
+	}
+
+	err = sc.SignCert(rand.Reader, s.signer)
+	if err != nil {
+		return nil, err
+	}
+
+	return sc, nil
+}
+
+func attachSSHCACommands(l *logrus.Logger, c *config.C, ssh *sshd.SSHServer, f *Interface) {
+	var issuer atomic.Pointer[sshCertIssuer]
+
+	load := func(c *config.C) {
+		if !c.InitialLoad() && !c.HasChanged("sshd.ca") {
+			return
+		}
+
+		i, err := newSSHCertIssuerFromConfig(c)
+		if err != nil {
+			l.WithError(err).Error("Failed to load the ssh ca")
+			return
+		}
+		issuer.Store(i)
+	}
+
+	load(c)
+	c.RegisterReloadCallback(load)
+
+	ssh.RegisterCommand(&sshd.Command{
+		Name:             "sign-ssh-key",
+		ShortDescription: "Issues an OpenSSH certificate for the provided public key bound to this hosts nebula certificate",
+		Help:             "Requires sshd.ca.key to be configured. The certificate will never be valid beyond the nebula certificate.",
+		Flags: func() (*flag.FlagSet, interface{}) {
+			fl := flag.NewFlagSet("", flag.ContinueOnError)
+			s := sshSignKeyFlags{}
+			fl.BoolVar(&s.Host, "host", false, "Issue a host certificate instead of a user certificate")
+			fl.DurationVar(&s.Duration, "duration", 0, "How long the certificate is valid for, defaults to sshd.ca.duration")
+			fl.StringVar(&s.Principals, "principals", "", "Optional comma separated list of principals to restrict the certificate to")
+			return fl, &s
+		},
+		Callback: func(fs interface{}, a []string, w sshd.StringWriter) error {
+			return sshSignKey(issuer.Load(), f, fs, a, w)
+		},
+	})
+}
+
+func sshSignKey(issuer *sshCertIssuer, ifce *Interface, fs interface{}, a []string, w sshd.StringWriter) error {
+	flags, ok := fs.(*sshSignKeyFlags)
+	if !ok {
+		return fmt.Errorf("internal error: expected flags to be sshSignKeyFlags but was %+v", fs)
+	}
+
+	if issuer == nil {
+		return w.WriteLine("No ssh ca is configured, set sshd.ca.key")
+	}
+
+	if len(a) == 0 {
+		return w.WriteLine("No ssh public key was provided")
+	}
+
+	pub, _, _, _, err := ssh.ParseAuthorizedKey([]byte(strings.Join(a, " ")))
+	if err != nil {
+		return w.WriteLine(fmt.Sprintf("The provided public key could not be parsed: %s", err))
+	}
+
+	var principals []string
+	if flags.Principals != "" {
+		for _, p := range strings.Split(flags.Principals, ",") {
+			principals = append(principals, strings.TrimSpace(p))
+		}
+	}
+
+	nc := ifce.pki.GetCertState().Certificate
+	sc, err := issuer.Issue(nc, pub, flags.Host, principals, flags.Duration, time.Now())
+	if err != nil {
+		return w.WriteLine(fmt.Sprintf("Failed to issue certificate: %s", err))
+	}
+
+	return w.WriteBytes(ssh.MarshalAuthorizedKey(sc))
+}
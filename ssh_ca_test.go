@@ -0,0 +1,76 @@
+package nebula
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/slackhq/nebula/cert"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+)
+
+func newTestSSHIssuer(t *testing.T) (*sshCertIssuer, ssh.PublicKey) {
+	_, caPriv, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	signer, err := ssh.NewSignerFromKey(caPriv)
+	require.NoError(t, err)
+
+	userPub, _, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	pub, err := ssh.NewPublicKey(userPub)
+	require.NoError(t, err)
+
+	return newSSHCertIssuer(signer, 0), pub
+}
+
+func TestSSHCertIssuer_Issue(t *testing.T) {
+	issuer, pub := newTestSSHIssuer(t)
+	now := time.Now()
+	nc := &cert.NebulaCertificate{
+		Details: cert.NebulaCertificateDetails{
+			Name:      "host1",
+			Ips:       []*net.IPNet{{IP: net.IPv4(10, 1, 0, 1), Mask: net.IPv4Mask(255, 255, 0, 0)}},
+			Groups:    []string{"admins", "ops"},
+			NotBefore: now.Add(-time.Hour),
+			NotAfter:  now.Add(30 * time.Minute),
+		},
+	}
+
+	// User certificates get the name and groups, bounded by the nebula cert lifetime
+	sc, err := issuer.Issue(nc, pub, false, nil, 0, now)
+	require.NoError(t, err)
+	assert.Equal(t, uint32(ssh.UserCert), sc.CertType)
+	assert.Equal(t, []string{"host1", "admins", "ops"}, sc.ValidPrincipals)
+	assert.Equal(t, uint64(nc.Details.NotAfter.Unix()), sc.ValidBefore)
+
+	checker := ssh.CertChecker{
+		IsUserAuthority: func(auth ssh.PublicKey) bool {
+			return string(auth.Marshal()) == string(issuer.signer.PublicKey().Marshal())
+		},
+	}
+	assert.NoError(t, checker.CheckCert("ops", sc))
+	assert.Error(t, checker.CheckCert("root", sc))
+
+	// Host certificates get the name and vpn ips
+	sc, err = issuer.Issue(nc, pub, true, nil, time.Minute, now)
+	require.NoError(t, err)
+	assert.Equal(t, uint32(ssh.HostCert), sc.CertType)
+	assert.Equal(t, []string{"host1", "10.1.0.1"}, sc.ValidPrincipals)
+	assert.Equal(t, uint64(now.Add(time.Minute).Unix()), sc.ValidBefore)
+
+	// Principals can be narrowed but not widened
+	sc, err = issuer.Issue(nc, pub, false, []string{"ops"}, 0, now)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"ops"}, sc.ValidPrincipals)
+
+	_, err = issuer.Issue(nc, pub, false, []string{"root"}, 0, now)
+	assert.EqualError(t, err, "principal root is not granted by the nebula certificate")
+
+	// Expired nebula certs can not be used
+	_, err = issuer.Issue(nc, pub, false, nil, 0, now.Add(time.Hour))
+	assert.ErrorIs(t, err, cert.ErrExpired)
+}
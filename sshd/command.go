@@ -8,6 +8,7 @@ import (
 	"strings"
 
 	"github.com/armon/go-radix"
+	"golang.org/x/crypto/ssh"
 )
 
 // CommandFlags is a function called before help or command execution to parse command line flags
@@ -23,6 +24,18 @@ type CommandFlags func() (*flag.FlagSet, interface{})
 // where appropriate
 type CommandCallback func(fs interface{}, a []string, w StringWriter) error
 
+// ErrCommandDenied is given to CommandPolicy.Audit for a command the policy did not allow
+var ErrCommandDenied = errors.New("permission denied")
+
+// CommandPolicy decides which commands a connection may run and is told about every command a session was asked to
+// run, see SSHServer.SetCommandPolicy
+type CommandPolicy interface {
+	// Allowed reports if c may run the command name, a session only knows about the commands it is allowed to run
+	Allowed(c *ssh.ServerConn, name string) bool
+	// Audit is called after a command ran with what it returned, or with ErrCommandDenied if it was not allowed
+	Audit(c *ssh.ServerConn, name string, args []string, err error)
+}
+
 type Command struct {
 	Name             string
 	ShortDescription string
@@ -109,6 +122,29 @@ func allCommands(c *radix.Tree) []*Command {
 	return cmds
 }
 
+// restrictCommands returns a tree with only the allowed commands, along with a help command that only knows about them
+func restrictCommands(commands *radix.Tree, allowed func(name string) bool) *radix.Tree {
+	r := radix.New()
+	commands.Walk(func(name string, c interface{}) bool {
+		// help is replaced below
+		if name != "help" && allowed(name) {
+			r.Insert(name, c)
+		}
+		return false
+	})
+
+	help := &Command{Name: "help"}
+	if c, ok := commands.Get("help"); ok {
+		help.ShortDescription = c.(*Command).ShortDescription
+	}
+	help.Callback = func(a interface{}, args []string, w StringWriter) error {
+		return helpCallback(r, args, w)
+	}
+	r.Insert(help.Name, help)
+
+	return r
+}
+
 func helpCallback(commands *radix.Tree, a []string, w StringWriter) (err error) {
 	// Just typed help
 	if len(a) == 0 {
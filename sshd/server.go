@@ -12,6 +12,11 @@ import (
 	"golang.org/x/crypto/ssh"
 )
 
+// PeerAuthenticator decides if a client that did not offer a key or password may log in, for example because of who
+// it is connecting from. The extensions of the returned permissions are kept on the connection for the commands to
+// check, nebula uses them to limit the admin level and commands of the session.
+type PeerAuthenticator func(c ssh.ConnMetadata) (*ssh.Permissions, error)
+
 type SSHServer struct {
 	config *ssh.ServerConfig
 	l      *logrus.Entry
@@ -21,6 +26,8 @@ type SSHServer struct {
 	// Map of user -> authorized keys
 	trustedKeys map[string]map[string]bool
 	trustedCAs  []ssh.PublicKey
+	peerAuth    PeerAuthenticator
+	policy      CommandPolicy
 
 	// List of available commands
 	helpCommand *Command
@@ -80,6 +87,14 @@ func NewSSHServer(l *logrus.Entry) (*SSHServer, error) {
 
 	s.config = &ssh.ServerConfig{
 		PublicKeyCallback: cc.Authenticate,
+		// Clients try without credentials first, this is only accepted if the peer authenticator allows it
+		NoClientAuth: true,
+		NoClientAuthCallback: func(c ssh.ConnMetadata) (*ssh.Permissions, error) {
+			if s.peerAuth == nil {
+				return nil, errors.New("no credentials were provided")
+			}
+			return s.peerAuth(c)
+		},
 		//TODO: AuthLogCallback: s.authAttempt,
 		//TODO: version string
 		ServerVersion: fmt.Sprintf("SSH-2.0-Nebula???"),
@@ -106,6 +121,16 @@ func (s *SSHServer) SetHostKey(hostPrivateKey []byte) error {
 	return nil
 }
 
+// SetPeerAuthenticator sets the authenticator for clients that do not offer credentials, nil turns this off
+func (s *SSHServer) SetPeerAuthenticator(pa PeerAuthenticator) {
+	s.peerAuth = pa
+}
+
+// SetCommandPolicy sets the policy deciding which commands a connection may run, every command is allowed without one
+func (s *SSHServer) SetCommandPolicy(p CommandPolicy) {
+	s.policy = p
+}
+
 func (s *SSHServer) ClearTrustedCAs() {
 	s.trustedCAs = []ssh.PublicKey{}
 }
@@ -200,7 +225,7 @@ func (s *SSHServer) run() {
 		l := s.l.WithField("sshUser", conn.User())
 		l.WithField("remoteAddress", c.RemoteAddr()).WithField("sshFingerprint", fp).Info("ssh user logged in")
 
-		session := NewSession(s.commands, conn, chans, l.WithField("subsystem", "sshd.session"))
+		session := NewSession(s.commands, conn, chans, l.WithField("subsystem", "sshd.session"), s.policy)
 		s.connsLock.Lock()
 		s.counter++
 		counter := s.counter
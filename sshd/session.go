@@ -17,17 +17,33 @@ type session struct {
 	c        *ssh.ServerConn
 	term     *terminal.Terminal
 	commands *radix.Tree
+	// denied are the commands the policy did not allow
+	denied   map[string]struct{}
+	policy   CommandPolicy
 	exitChan chan bool
 }
 
-func NewSession(commands *radix.Tree, conn *ssh.ServerConn, chans <-chan ssh.NewChannel, l *logrus.Entry) *session {
+func NewSession(commands *radix.Tree, conn *ssh.ServerConn, chans <-chan ssh.NewChannel, l *logrus.Entry, policy CommandPolicy) *session {
 	s := &session{
 		commands: radix.NewFromMap(commands.ToMap()),
 		l:        l,
 		c:        conn,
+		policy:   policy,
 		exitChan: make(chan bool),
 	}
 
+	// The session only knows about the commands it may run, they are decided once when it starts
+	if policy != nil {
+		s.denied = map[string]struct{}{}
+		s.commands = restrictCommands(s.commands, func(name string) bool {
+			if policy.Allowed(conn, name) {
+				return true
+			}
+			s.denied[name] = struct{}{}
+			return false
+		})
+	}
+
 	s.commands.Insert("logout", &Command{
 		Name:             "logout",
 		ShortDescription: "Ends the current session",
@@ -163,6 +179,14 @@ func (s *session) dispatchCommand(line string, w StringWriter) {
 		return
 	}
 
+	if _, ok := s.denied[args[0]]; ok {
+		s.policy.Audit(s.c, args[0], args[1:], ErrCommandDenied)
+		err := w.WriteLine(fmt.Sprintf("%s: %s", ErrCommandDenied, args[0]))
+		//TODO: log error
+		_ = err
+		return
+	}
+
 	if c == nil {
 		err := w.WriteLine(fmt.Sprintf("did not understand: %s", line))
 		//TODO: log error
@@ -178,6 +202,9 @@ func (s *session) dispatchCommand(line string, w StringWriter) {
 	}
 
 	err = execCommand(c, args[1:], w)
+	if s.policy != nil {
+		s.policy.Audit(s.c, c.Name, args[1:], err)
+	}
 	if err != nil {
 		//TODO: log the error
 	}
@@ -1,9 +1,9 @@
 package nebula
 
 import (
+	"context"
 	"errors"
 	"fmt"
-	"log"
 	"net"
 	"net/http"
 	"runtime"
@@ -22,7 +22,7 @@ import (
 // startStats initializes stats from config. On success, if any further work
 // is needed to serve stats, it returns a func to handle that work. If no
 // work is needed, it'll return nil. On failure, it returns nil, error.
-func startStats(l *logrus.Logger, c *config.C, buildVersion string, configTest bool) (func(), error) {
+func startStats(ctx context.Context, l *logrus.Logger, c *config.C, f *Interface, buildVersion string, configTest bool) (func(), error) {
 	mType := c.GetString("stats.type", "")
 	if mType == "" || mType == "none" {
 		return nil, nil
@@ -42,7 +42,7 @@ func startStats(l *logrus.Logger, c *config.C, buildVersion string, configTest b
 		}
 	case "prometheus":
 		var err error
-		startFn, err = startPrometheusStats(l, interval, c, buildVersion, configTest)
+		startFn, err = startPrometheusStats(ctx, l, interval, c, f, buildVersion, configTest)
 		if err != nil {
 			return nil, err
 		}
@@ -79,7 +79,7 @@ func startGraphiteStats(l *logrus.Logger, i time.Duration, c *config.C, configTe
 	return nil
 }
 
-func startPrometheusStats(l *logrus.Logger, i time.Duration, c *config.C, buildVersion string, configTest bool) (func(), error) {
+func startPrometheusStats(ctx context.Context, l *logrus.Logger, i time.Duration, c *config.C, f *Interface, buildVersion string, configTest bool) (func(), error) {
 	namespace := c.GetString("stats.namespace", "")
 	subsystem := c.GetString("stats.subsystem", "")
 
@@ -114,12 +114,37 @@ func startPrometheusStats(l *logrus.Logger, i time.Duration, c *config.C, buildV
 	pr.MustRegister(g)
 	g.Set(1)
 
-	var startFn func()
-	if !configTest {
-		startFn = func() {
-			l.Infof("Prometheus stats listening on %s at %s", listen, path)
-			http.Handle(path, promhttp.HandlerFor(pr, promhttp.HandlerOpts{ErrorLog: l}))
-			log.Fatal(http.ListenAndServe(listen, nil))
+	ps, err := newPrometheusStatsFromConfig(f, c, namespace, subsystem)
+	if err != nil {
+		return nil, err
+	}
+	if f != nil {
+		pr.MustRegister(ps)
+		f.promStats = ps
+	}
+
+	if configTest {
+		return nil, nil
+	}
+
+	// Each nebula gets its own mux and server, a Group runs several in one process
+	mux := http.NewServeMux()
+	mux.Handle(path, promhttp.HandlerFor(pr, promhttp.HandlerOpts{ErrorLog: l}))
+	hs := &http.Server{Addr: listen, Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+
+	ln, err := net.Listen("tcp", listen)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on stats.listen %s: %s", listen, err)
+	}
+	go func() {
+		<-ctx.Done()
+		hs.Close()
+	}()
+
+	startFn := func() {
+		l.Infof("Prometheus stats listening on %s at %s", listen, path)
+		if err := hs.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			l.WithError(err).Error("Prometheus stats listener stopped")
 		}
 	}
 
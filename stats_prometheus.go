@@ -0,0 +1,211 @@
+package nebula
+
+import (
+	"errors"
+	"sort"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/iputil"
+)
+
+// With stats.type prometheus nebula also exports native series the go-metrics bridge can not express: a handshake
+// latency histogram, firewall drops and conntrack occupancy by label, and traffic and relay usage for each peer. They
+// are read from the hostmap, firewall and relay accounting when scraped so nothing extra happens on the packet path.
+//
+// A series for every peer does not scale to large networks, stats.peers.top picks how many peers get their own series.
+// The peers with the most traffic are exported, the rest only count towards the totals.
+
+const (
+	defaultStatsPeersTop = 0
+)
+
+type prometheusStats struct {
+	f   *Interface
+	top int
+
+	handshakes prometheus.Histogram
+
+	tunnels          *prometheus.Desc
+	peerTxBytes      *prometheus.Desc
+	peerRxBytes      *prometheus.Desc
+	peerTxPackets    *prometheus.Desc
+	peerRxPackets    *prometheus.Desc
+	peerRelayed      *prometheus.Desc
+	peerRelaying     *prometheus.Desc
+	relayInBytes     *prometheus.Desc
+	relayOutBytes    *prometheus.Desc
+	relayDropped     *prometheus.Desc
+	firewallDropped  *prometheus.Desc
+	conntrackConns   *prometheus.Desc
+	conntrackMaxSize *prometheus.Desc
+}
+
+// peerStats is a snapshot of the traffic with a peer, taken when scraped
+type peerStats struct {
+	vpnIp     iputil.VpnIp
+	name      string
+	txBytes   uint64
+	rxBytes   uint64
+	txPackets uint64
+	rxPackets uint64
+	relayed   bool
+	relaying  int
+}
+
+func newPrometheusStatsFromConfig(f *Interface, c *config.C, namespace, subsystem string) (*prometheusStats, error) {
+	top := c.GetInt("stats.peers.top", defaultStatsPeersTop)
+	if top < 0 {
+		return nil, errors.New("stats.peers.top must not be negative")
+	}
+
+	desc := func(name, help string, labels ...string) *prometheus.Desc {
+		return prometheus.NewDesc(prometheus.BuildFQName(namespace, subsystem, name), help, labels, nil)
+	}
+
+	return &prometheusStats{
+		f:   f,
+		top: top,
+		handshakes: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "handshake_duration_seconds",
+			Help:      "Time from sending the first handshake packet to completing the handshake, for handshakes we initiated",
+			Buckets:   prometheus.ExponentialBuckets(0.005, 2, 12),
+		}),
+		tunnels:          desc("tunnels", "Established tunnels, including the peers without their own series"),
+		peerTxBytes:      desc("peer_tx_bytes_total", "Bytes encrypted for the peer since the tunnel keys were set", "vpn_ip", "name"),
+		peerRxBytes:      desc("peer_rx_bytes_total", "Bytes of authenticated packets from the peer since the tunnel keys were set", "vpn_ip", "name"),
+		peerTxPackets:    desc("peer_tx_packets_total", "Packets sent to the peer since the tunnel keys were set", "vpn_ip", "name"),
+		peerRxPackets:    desc("peer_rx_packets_total", "Authenticated packets from the peer since the tunnel keys were set", "vpn_ip", "name"),
+		peerRelayed:      desc("peer_relayed", "1 if the peer is reached through a relay", "vpn_ip", "name"),
+		peerRelaying:     desc("peer_relaying", "Relays this host serves for the peer", "vpn_ip", "name"),
+		relayInBytes:     desc("relay_in_bytes_total", "Bytes the peer sent through this relay", "vpn_ip"),
+		relayOutBytes:    desc("relay_out_bytes_total", "Bytes this relay forwarded to the peer", "vpn_ip"),
+		relayDropped:     desc("relay_dropped_total", "Packets from the peer dropped by a relay limit", "vpn_ip"),
+		firewallDropped:  desc("firewall_dropped_total", "Packets dropped by the firewall", "direction", "reason"),
+		conntrackConns:   desc("firewall_conntrack_connections", "Connections tracked by the firewall"),
+		conntrackMaxSize: desc("firewall_conntrack_max_connections", "The most connections the firewall tracks, 0 is unlimited"),
+	}, nil
+}
+
+func (ps *prometheusStats) Describe(ch chan<- *prometheus.Desc) {
+	ps.handshakes.Describe(ch)
+	for _, d := range []*prometheus.Desc{
+		ps.tunnels, ps.peerTxBytes, ps.peerRxBytes, ps.peerTxPackets, ps.peerRxPackets, ps.peerRelayed, ps.peerRelaying,
+		ps.relayInBytes, ps.relayOutBytes, ps.relayDropped, ps.firewallDropped, ps.conntrackConns, ps.conntrackMaxSize,
+	} {
+		ch <- d
+	}
+}
+
+func (ps *prometheusStats) Collect(ch chan<- prometheus.Metric) {
+	ps.handshakes.Collect(ch)
+	ps.collectFirewall(ch)
+
+	peers := ps.peers()
+	ch <- prometheus.MustNewConstMetric(ps.tunnels, prometheus.GaugeValue, float64(len(peers)))
+	if len(peers) > ps.top {
+		peers = peers[:ps.top]
+	}
+
+	for _, p := range peers {
+		labels := []string{p.vpnIp.String(), p.name}
+		ch <- prometheus.MustNewConstMetric(ps.peerTxBytes, prometheus.CounterValue, float64(p.txBytes), labels...)
+		ch <- prometheus.MustNewConstMetric(ps.peerRxBytes, prometheus.CounterValue, float64(p.rxBytes), labels...)
+		ch <- prometheus.MustNewConstMetric(ps.peerTxPackets, prometheus.CounterValue, float64(p.txPackets), labels...)
+		ch <- prometheus.MustNewConstMetric(ps.peerRxPackets, prometheus.CounterValue, float64(p.rxPackets), labels...)
+
+		relayed := 0.0
+		if p.relayed {
+			relayed = 1
+		}
+		ch <- prometheus.MustNewConstMetric(ps.peerRelayed, prometheus.GaugeValue, relayed, labels...)
+		ch <- prometheus.MustNewConstMetric(ps.peerRelaying, prometheus.GaugeValue, float64(p.relaying), labels...)
+	}
+
+	if ps.top == 0 {
+		return
+	}
+
+	usage := ps.f.relayManager.accounting.Usage()
+	sort.SliceStable(usage, func(i, j int) bool {
+		return usage[i].InBytes+usage[i].OutBytes > usage[j].InBytes+usage[j].OutBytes
+	})
+	if len(usage) > ps.top {
+		usage = usage[:ps.top]
+	}
+
+	for _, u := range usage {
+		vpnIp := u.VpnIp.String()
+		ch <- prometheus.MustNewConstMetric(ps.relayInBytes, prometheus.CounterValue, float64(u.InBytes), vpnIp)
+		ch <- prometheus.MustNewConstMetric(ps.relayOutBytes, prometheus.CounterValue, float64(u.OutBytes), vpnIp)
+		ch <- prometheus.MustNewConstMetric(ps.relayDropped, prometheus.CounterValue, float64(u.Dropped), vpnIp)
+	}
+}
+
+func (ps *prometheusStats) collectFirewall(ch chan<- prometheus.Metric) {
+	fw := ps.f.firewall
+
+	for direction, m := range map[string]*firewallMetrics{"incoming": &fw.incomingMetrics, "outgoing": &fw.outgoingMetrics} {
+		for reason, counter := range map[string]int64{
+			"local_ip":   m.droppedLocalIP.Count(),
+			"remote_ip":  m.droppedRemoteIP.Count(),
+			"no_rule":    m.droppedNoRule.Count(),
+			"blocked":    m.droppedBlocked.Count(),
+			"inspection": m.droppedInspection.Count(),
+			"rate_limit": m.droppedRateLimit.Count(),
+		} {
+			ch <- prometheus.MustNewConstMetric(ps.firewallDropped, prometheus.CounterValue, float64(counter), direction, reason)
+		}
+	}
+
+	fw.Conntrack.Lock()
+	conns := len(fw.Conntrack.Conns)
+	fw.Conntrack.Unlock()
+	ch <- prometheus.MustNewConstMetric(ps.conntrackConns, prometheus.GaugeValue, float64(conns))
+	ch <- prometheus.MustNewConstMetric(ps.conntrackMaxSize, prometheus.GaugeValue, float64(fw.MaxConns))
+}
+
+// peers returns the traffic with every established peer, the most traffic first. The hostmap lock is only held while
+// collecting the hostinfos.
+func (ps *prometheusStats) peers() []peerStats {
+	hm := ps.f.hostMap
+	hm.RLock()
+	hosts := make([]*HostInfo, 0, len(hm.Hosts))
+	for _, h := range hm.Hosts {
+		hosts = append(hosts, h)
+	}
+	hm.RUnlock()
+
+	peers := make([]peerStats, 0, len(hosts))
+	for _, h := range hosts {
+		ci := h.ConnectionState
+		if ci == nil {
+			continue
+		}
+
+		p := peerStats{
+			vpnIp:     h.vpnIp,
+			txBytes:   ci.bytesOut.Load(),
+			rxBytes:   ci.bytesIn.Load(),
+			txPackets: ci.messageCounter.Load(),
+			rxPackets: ci.messagesIn.Load(),
+			relayed:   len(h.relayState.CopyRelayIps()) > 0,
+			relaying:  len(h.relayState.CopyRelayForIps()),
+		}
+		if ci.peerCert != nil {
+			p.name = ci.peerCert.Details.Name
+		}
+		peers = append(peers, p)
+	}
+
+	sort.Slice(peers, func(i, j int) bool {
+		ti, tj := peers[i].txBytes+peers[i].rxBytes, peers[j].txBytes+peers[j].rxBytes
+		if ti != tj {
+			return ti > tj
+		}
+		return peers[i].vpnIp.Compare(peers[j].vpnIp) < 0
+	})
+	return peers
+}
@@ -0,0 +1,103 @@
+package nebula
+
+import (
+	"io"
+	"net"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/slackhq/nebula/cert"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/iputil"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPrometheusStats(t *testing.T) {
+	l := test.NewLogger()
+	hm := newHostMap(l, &net.IPNet{})
+	hm.preferredRanges.Store(&[]*net.IPNet{})
+
+	add := func(i byte, name string, tx, rx uint64, relayed bool) {
+		ci := &ConnectionState{peerCert: &cert.NebulaCertificate{Details: cert.NebulaCertificateDetails{Name: name}}}
+		ci.bytesOut.Store(tx)
+		ci.bytesIn.Store(rx)
+		ci.messageCounter.Store(tx / 100)
+		ci.messagesIn.Store(rx / 100)
+
+		hi := &HostInfo{
+			ConnectionState: ci,
+			remotes:         NewRemoteList(nil),
+			localIndexId:    uint32(i),
+			vpnIp:           iputil.Ip2VpnIp(net.IPv4(10, 0, 0, i)),
+			relayState: RelayState{
+				relays:        map[iputil.VpnIp]struct{}{},
+				relayForByIp:  map[iputil.VpnIp]*Relay{},
+				relayForByIdx: map[uint32]*Relay{},
+			},
+		}
+		if relayed {
+			hi.relayState.relays[iputil.Ip2VpnIp(net.IPv4(10, 0, 0, 250))] = struct{}{}
+		}
+		hm.unlockedAddHostInfo(hi, &Interface{})
+	}
+	add(1, "quiet", 100, 100, false)
+	add(2, "busy", 5000, 1000, true)
+	add(3, "medium", 1000, 300, false)
+
+	ra := newRelayAccounting()
+	ra.forward(iputil.Ip2VpnIp(net.IPv4(10, 0, 0, 2)), iputil.Ip2VpnIp(net.IPv4(10, 0, 0, 3)), 1400)
+
+	fw := NewFirewall(l, time.Minute, time.Minute, time.Minute, &cert.NebulaCertificate{})
+	fw.MaxConns = 1000
+	f := &Interface{hostMap: hm, firewall: fw, relayManager: &relayManager{accounting: ra}}
+
+	scrape := func(top int) string {
+		c := config.NewC(l)
+		c.Settings["stats"] = map[interface{}]interface{}{"peers": map[interface{}]interface{}{"top": top}}
+		ps, err := newPrometheusStatsFromConfig(f, c, "nebula", "")
+		require.NoError(t, err)
+		ps.handshakes.Observe(0.02)
+
+		pr := prometheus.NewRegistry()
+		pr.MustRegister(ps)
+		rec := httptest.NewRecorder()
+		promhttp.HandlerFor(pr, promhttp.HandlerOpts{}).ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+		b, err := io.ReadAll(rec.Body)
+		require.NoError(t, err)
+		return string(b)
+	}
+
+	// The busiest peers get their own series
+	out := scrape(2)
+	assert.Contains(t, out, "nebula_tunnels 3\n")
+	assert.Contains(t, out, `nebula_peer_tx_bytes_total{name="busy",vpn_ip="10.0.0.2"} 5000`)
+	assert.Contains(t, out, `nebula_peer_rx_bytes_total{name="medium",vpn_ip="10.0.0.3"} 300`)
+	assert.Contains(t, out, `nebula_peer_tx_packets_total{name="busy",vpn_ip="10.0.0.2"} 50`)
+	assert.Contains(t, out, `nebula_peer_relayed{name="busy",vpn_ip="10.0.0.2"} 1`)
+	assert.Contains(t, out, `nebula_peer_relayed{name="medium",vpn_ip="10.0.0.3"} 0`)
+	assert.NotContains(t, out, `name="quiet"`)
+	assert.Contains(t, out, `nebula_relay_in_bytes_total{vpn_ip="10.0.0.2"} 1400`)
+	assert.Contains(t, out, `nebula_relay_out_bytes_total{vpn_ip="10.0.0.3"} 1400`)
+
+	assert.Contains(t, out, "nebula_handshake_duration_seconds_count 1\n")
+	assert.Contains(t, out, `nebula_handshake_duration_seconds_bucket{le="0.02"} 1`)
+	assert.Contains(t, out, `nebula_firewall_dropped_total{direction="incoming",reason="no_rule"}`)
+	assert.Contains(t, out, "nebula_firewall_conntrack_connections 0\n")
+	assert.Contains(t, out, "nebula_firewall_conntrack_max_connections 1000\n")
+
+	// No peer series by default
+	out = scrape(0)
+	assert.Contains(t, out, "nebula_tunnels 3\n")
+	assert.NotContains(t, out, "nebula_peer_")
+	assert.NotContains(t, out, "nebula_relay_")
+
+	c := config.NewC(l)
+	c.Settings["stats"] = map[interface{}]interface{}{"peers": map[interface{}]interface{}{"top": -1}}
+	_, err := newPrometheusStatsFromConfig(f, c, "nebula", "")
+	assert.EqualError(t, err, "stats.peers.top must not be negative")
+}
@@ -0,0 +1,308 @@
+package nebula
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/udp"
+	"github.com/slackhq/nebula/util"
+)
+
+// A lighthouse learns our public address from the packets we send it, unless it sits behind the same NAT we do and
+// only sees our private address. With stun.servers configured we ask STUN servers (RFC 5389) what address our nebula
+// socket appears as and advertise it to the lighthouses. The requests are sent from the nebula socket so the answer
+// is the NAT mapping peers would use, the answers are picked out of the packets arriving on it.
+//
+// When the servers see different addresses the NAT maps each destination to a different port, the address one server
+// sees is no use to a peer and nothing is advertised.
+
+const (
+	defaultStunInterval = 5 * time.Minute
+	stunTimeout         = 3 * time.Second
+
+	stunHeaderLen        = 20
+	stunMagicCookie      = 0x2112A442
+	stunBindingRequest   = 0x0001
+	stunBindingSuccess   = 0x0101
+	stunMappedAddress    = 0x0001
+	stunXorMappedAddress = 0x0020
+)
+
+var errStunMalformed = errors.New("malformed stun message")
+
+type stunPending struct {
+	server  netip.AddrPort
+	results chan<- netip.AddrPort
+}
+
+type stunClient struct {
+	l        *logrus.Logger
+	f        *Interface
+	servers  []string
+	interval time.Duration
+
+	sync.Mutex
+	// pending are the requests waiting for an answer, by transaction id
+	pending map[[12]byte]stunPending
+}
+
+func newStunClientFromConfig(l *logrus.Logger, f *Interface, c *config.C) (*stunClient, error) {
+	servers := c.GetStringSlice("stun.servers", []string{})
+	if len(servers) == 0 {
+		return nil, nil
+	}
+
+	for i, s := range servers {
+		if _, _, err := net.SplitHostPort(s); err != nil {
+			return nil, util.NewContextualError("Invalid stun.servers entry, expected host:port", m{"server": s, "entry": i + 1}, err)
+		}
+	}
+
+	interval := c.GetDuration("stun.interval", defaultStunInterval)
+	if interval <= 0 {
+		return nil, fmt.Errorf("stun.interval must be greater than 0")
+	}
+
+	return &stunClient{
+		l:        l,
+		f:        f,
+		servers:  servers,
+		interval: interval,
+		pending:  map[[12]byte]stunPending{},
+	}, nil
+}
+
+// Start asks the stun servers for our public address every interval until ctx is done. This is a non blocking call.
+func (sc *stunClient) Start(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(sc.interval)
+		defer ticker.Stop()
+
+		for {
+			sc.update(ctx)
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// update asks every stun server for our address and advertises it if they agree
+func (sc *stunClient) update(ctx context.Context) {
+	answers := sc.query(ctx)
+
+	var public netip.AddrPort
+	for _, a := range answers {
+		if public.IsValid() && a != public {
+			sc.l.WithField("answers", answers).
+				Warn("STUN servers see different public addresses, our NAT maps each destination differently so none are advertised")
+			public = netip.AddrPort{}
+			break
+		}
+		public = a
+	}
+
+	if len(answers) == 0 {
+		sc.l.WithField("servers", sc.servers).Warn("No STUN server answered")
+	}
+
+	var addr *netIpAndPort
+	if public.IsValid() {
+		addr = &netIpAndPort{ip: net.IP(public.Addr().AsSlice()), port: public.Port()}
+	}
+
+	if sc.f.lightHouse.setPublicAddr("stun", addr) {
+		sc.l.WithField("udpAddr", public).Info("STUN public address changed")
+		sc.f.lightHouse.SendUpdate()
+	}
+}
+
+// query sends a binding request to every server and returns the answers that arrive within stunTimeout
+func (sc *stunClient) query(ctx context.Context) []netip.AddrPort {
+	results := make(chan netip.AddrPort, len(sc.servers))
+	var sent [][12]byte
+	defer func() {
+		sc.Lock()
+		for _, txID := range sent {
+			delete(sc.pending, txID)
+		}
+		sc.Unlock()
+	}()
+
+	for _, server := range sc.servers {
+		ua, err := net.ResolveUDPAddr("udp", server)
+		if err != nil {
+			sc.l.WithError(err).WithField("server", server).Warn("Failed to resolve STUN server")
+			continue
+		}
+
+		var txID [12]byte
+		if _, err := rand.Read(txID[:]); err != nil {
+			sc.l.WithError(err).Error("Failed to create a STUN transaction id")
+			continue
+		}
+
+		serverAddr := ua.AddrPort()
+		sc.Lock()
+		sc.pending[txID] = stunPending{server: netip.AddrPortFrom(serverAddr.Addr().Unmap(), serverAddr.Port()), results: results}
+		sc.Unlock()
+		sent = append(sent, txID)
+
+		if err := sc.f.outside.WriteTo(marshalStunRequest(txID), udp.NewAddr(ua.IP, uint16(ua.Port))); err != nil {
+			sc.l.WithError(err).WithField("server", server).Warn("Failed to send STUN request")
+		}
+	}
+
+	var answers []netip.AddrPort
+	timeout := time.NewTimer(stunTimeout)
+	defer timeout.Stop()
+
+	for len(answers) < len(sent) {
+		select {
+		case <-ctx.Done():
+			return answers
+		case <-timeout.C:
+			return answers
+		case a := <-results:
+			answers = append(answers, a)
+		}
+	}
+
+	return answers
+}
+
+// handle takes a stun answer that arrived on our socket, it returns false if the packet was not stun
+func (sc *stunClient) handle(addr *udp.Addr, b []byte) bool {
+	if !isStunMessage(b) {
+		return false
+	}
+
+	txID, mapped, err := unmarshalStunResponse(b)
+	if err != nil {
+		if sc.l.Level >= logrus.DebugLevel {
+			sc.l.WithError(err).WithField("udpAddr", addr).Debug("Ignoring STUN message")
+		}
+		return true
+	}
+
+	sc.Lock()
+	p, ok := sc.pending[txID]
+	if ok {
+		delete(sc.pending, txID)
+	}
+	sc.Unlock()
+
+	from, _ := netip.AddrFromSlice(addr.IP)
+	if !ok || netip.AddrPortFrom(from.Unmap(), addr.Port) != p.server {
+		if sc.l.Level >= logrus.DebugLevel {
+			sc.l.WithField("udpAddr", addr).Debug("Ignoring STUN answer we did not ask for")
+		}
+		return true
+	}
+
+	// results has room for an answer from every server
+	p.results <- mapped
+	return true
+}
+
+// isStunMessage checks the parts of the stun header no nebula packet has
+func isStunMessage(b []byte) bool {
+	return len(b) >= stunHeaderLen && b[0]&0xc0 == 0 &&
+		binary.BigEndian.Uint32(b[4:8]) == stunMagicCookie &&
+		int(binary.BigEndian.Uint16(b[2:4]))+stunHeaderLen == len(b)
+}
+
+func marshalStunRequest(txID [12]byte) []byte {
+	b := make([]byte, stunHeaderLen)
+	binary.BigEndian.PutUint16(b[0:2], stunBindingRequest)
+	binary.BigEndian.PutUint32(b[4:8], stunMagicCookie)
+	copy(b[8:20], txID[:])
+	return b
+}
+
+// unmarshalStunResponse returns the address a binding success response says we have, preferring XOR-MAPPED-ADDRESS
+func unmarshalStunResponse(b []byte) ([12]byte, netip.AddrPort, error) {
+	var txID [12]byte
+	if binary.BigEndian.Uint16(b[0:2]) != stunBindingSuccess {
+		return txID, netip.AddrPort{}, errors.New("not a binding success response")
+	}
+	copy(txID[:], b[8:20])
+
+	var mapped, xorMapped netip.AddrPort
+	attrs := b[stunHeaderLen:]
+	for len(attrs) >= 4 {
+		t := binary.BigEndian.Uint16(attrs[0:2])
+		l := int(binary.BigEndian.Uint16(attrs[2:4]))
+		if len(attrs) < 4+l {
+			return txID, netip.AddrPort{}, errStunMalformed
+		}
+		v := attrs[4 : 4+l]
+
+		switch t {
+		case stunMappedAddress:
+			mapped, _ = parseStunAddress(v, nil)
+		case stunXorMappedAddress:
+			xorMapped, _ = parseStunAddress(v, b[4:20])
+		}
+
+		// Attributes are padded to 4 bytes
+		l = (l + 3) &^ 3
+		if len(attrs) < 4+l {
+			break
+		}
+		attrs = attrs[4+l:]
+	}
+
+	if xorMapped.IsValid() {
+		return txID, xorMapped, nil
+	}
+	if mapped.IsValid() {
+		return txID, mapped, nil
+	}
+	return txID, netip.AddrPort{}, errors.New("no mapped address in response")
+}
+
+// parseStunAddress reads a (XOR-)MAPPED-ADDRESS value, xor is the magic cookie and transaction id for the latter
+func parseStunAddress(v []byte, xor []byte) (netip.AddrPort, error) {
+	if len(v) < 4 {
+		return netip.AddrPort{}, errStunMalformed
+	}
+
+	port := binary.BigEndian.Uint16(v[2:4])
+	var ip []byte
+	switch v[1] {
+	case 0x01:
+		ip = make([]byte, 4)
+	case 0x02:
+		ip = make([]byte, 16)
+	default:
+		return netip.AddrPort{}, errStunMalformed
+	}
+
+	if len(v) < 4+len(ip) {
+		return netip.AddrPort{}, errStunMalformed
+	}
+	copy(ip, v[4:])
+
+	if xor != nil {
+		port ^= uint16(stunMagicCookie >> 16)
+		for i := range ip {
+			ip[i] ^= xor[i]
+		}
+	}
+
+	addr, _ := netip.AddrFromSlice(ip)
+	return netip.AddrPortFrom(addr, port), nil
+}
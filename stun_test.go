@@ -0,0 +1,142 @@
+package nebula
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"net/netip"
+	"testing"
+
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/firewall"
+	"github.com/slackhq/nebula/header"
+	"github.com/slackhq/nebula/test"
+	"github.com/slackhq/nebula/udp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newStunResponse answers request as a stun server that sees us at mapped
+func newStunResponse(request []byte, mapped netip.AddrPort, xor bool) []byte {
+	var v []byte
+	ip := mapped.Addr().AsSlice()
+	port := mapped.Port()
+	attr := uint16(stunMappedAddress)
+	if xor {
+		attr = stunXorMappedAddress
+		port ^= uint16(stunMagicCookie >> 16)
+		for i := range ip {
+			ip[i] ^= request[4+i]
+		}
+	}
+
+	family := byte(0x01)
+	if mapped.Addr().Is6() {
+		family = 0x02
+	}
+	v = append(v, 0, family)
+	v = binary.BigEndian.AppendUint16(v, port)
+	v = append(v, ip...)
+
+	b := make([]byte, stunHeaderLen, stunHeaderLen+4+len(v))
+	binary.BigEndian.PutUint16(b[0:2], stunBindingSuccess)
+	binary.BigEndian.PutUint16(b[2:4], uint16(4+len(v)))
+	copy(b[4:20], request[4:20])
+	b = binary.BigEndian.AppendUint16(b, attr)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(v)))
+	return append(b, v...)
+}
+
+func TestStunMessages(t *testing.T) {
+	var txID [12]byte
+	copy(txID[:], "abcdefghijkl")
+	req := marshalStunRequest(txID)
+	assert.True(t, isStunMessage(req))
+
+	// A nebula packet is never mistaken for stun
+	assert.False(t, isStunMessage(header.Encode(make([]byte, stunHeaderLen), header.Version, header.Message, 0, stunMagicCookie, 0)))
+
+	for _, mapped := range []netip.AddrPort{netip.MustParseAddrPort("203.0.113.1:4242"), netip.MustParseAddrPort("[2001:db8::1]:4242")} {
+		for _, xor := range []bool{true, false} {
+			resp := newStunResponse(req, mapped, xor)
+			require.True(t, isStunMessage(resp))
+			gotID, got, err := unmarshalStunResponse(resp)
+			require.NoError(t, err)
+			assert.Equal(t, txID, gotID)
+			assert.Equal(t, mapped, got)
+		}
+	}
+
+	_, _, err := unmarshalStunResponse(req)
+	assert.EqualError(t, err, "not a binding success response")
+}
+
+// stunConn answers stun requests as though each server sees us at the address in mapped
+type stunConn struct {
+	udp.NoopConn
+	sc     *stunClient
+	mapped map[string]netip.AddrPort
+}
+
+func (c *stunConn) WriteTo(b []byte, addr *udp.Addr) error {
+	if mapped, ok := c.mapped[addr.String()]; ok {
+		go c.sc.handle(addr, newStunResponse(b, mapped, true))
+	}
+	return nil
+}
+
+func TestStunClient_update(t *testing.T) {
+	l := test.NewLogger()
+	c := config.NewC(l)
+	c.Settings["lighthouse"] = map[interface{}]interface{}{"local_allow_list": map[interface{}]interface{}{"interfaces": map[interface{}]interface{}{".*": false}}}
+	c.Settings["stun"] = map[interface{}]interface{}{"servers": []interface{}{"127.0.0.1:3478", "127.0.0.2:3478"}}
+	lh, err := NewLightHouseFromConfig(context.Background(), l, c, []*net.IPNet{&net.IPNet{IP: net.IP{10, 128, 0, 1}, Mask: net.IPMask{255, 255, 255, 0}}}, nil, nil)
+	require.NoError(t, err)
+	lh.ifce = &collectEncWriter{}
+
+	conn := &stunConn{}
+	f := &Interface{lightHouse: lh, outside: conn, l: l}
+	sc, err := newStunClientFromConfig(l, f, c)
+	require.NoError(t, err)
+	conn.sc = sc
+	f.stun = sc
+
+	public := netip.MustParseAddrPort("203.0.113.1:4242")
+	conn.mapped = map[string]netip.AddrPort{"127.0.0.1:3478": public, "127.0.0.2:3478": public}
+	sc.update(context.Background())
+	assert.Equal(t, map[string]netIpAndPort{"stun": {ip: net.IP{203, 0, 113, 1}, port: 4242}}, *lh.publicAddrs.Load())
+	assert.Empty(t, sc.pending)
+
+	// The servers disagree, nothing we could advertise would help a peer
+	conn.mapped["127.0.0.2:3478"] = netip.MustParseAddrPort("203.0.113.1:4243")
+	sc.update(context.Background())
+	assert.Empty(t, *lh.publicAddrs.Load())
+
+	// Answers that arrive through the outside path are taken too
+	outside := &stunConn{sc: sc}
+	f.outside = outside
+	assert.True(t, sc.handle(udp.NewAddr(net.IP{127, 0, 0, 9}, 3478), newStunResponse(marshalStunRequest([12]byte{}), public, true)))
+	f.readOutsidePackets(udp.NewAddr(net.IP{127, 0, 0, 1}, 3478), nil, nil, newStunResponse(marshalStunRequest([12]byte{}), public, true), &header.H{}, &firewall.Packet{}, nil, nil, 0, nil, nil)
+}
+
+func TestNewStunClientFromConfig(t *testing.T) {
+	l := test.NewLogger()
+	c := config.NewC(l)
+
+	sc, err := newStunClientFromConfig(l, nil, c)
+	require.NoError(t, err)
+	assert.Nil(t, sc)
+
+	c.Settings["stun"] = map[interface{}]interface{}{"servers": []interface{}{"stun.example.com"}}
+	_, err = newStunClientFromConfig(l, nil, c)
+	assert.ErrorContains(t, err, "Invalid stun.servers entry, expected host:port")
+
+	c.Settings["stun"] = map[interface{}]interface{}{"servers": []interface{}{"stun.example.com:3478"}, "interval": "0s"}
+	_, err = newStunClientFromConfig(l, nil, c)
+	assert.EqualError(t, err, "stun.interval must be greater than 0")
+
+	c.Settings["stun"] = map[interface{}]interface{}{"servers": []interface{}{"stun.example.com:3478"}}
+	sc, err = newStunClientFromConfig(l, nil, c)
+	require.NoError(t, err)
+	assert.Equal(t, defaultStunInterval, sc.interval)
+}
@@ -0,0 +1,309 @@
+package nebula
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	mathrand "math/rand"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A stream carries one nebula packet per frame. A raw stream starts with tcpStreamMagic and then prefixes every
+// packet with its length as 2 big endian bytes. A websocket stream starts with the http upgrade and carries every
+// packet in a binary frame, masked by the dialing side as the rfc requires. Either can be wrapped in tls, the
+// listener tells them apart by their first byte.
+
+const (
+	tcpStreamMagic     = "NEB\x01"
+	tlsRecordHandshake = 0x16
+	websocketGUID      = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+	wsOpBinary = 0x2
+	wsOpClose  = 0x8
+	wsOpPing   = 0x9
+	wsOpPong   = 0xa
+
+	// tcpStreamQueue is how many packets may wait to be written to a stream before more are dropped
+	tcpStreamQueue = 256
+	// tcpStreamNegotiateTimeout bounds the tls and websocket handshakes
+	tcpStreamNegotiateTimeout = 10 * time.Second
+)
+
+var errTCPStreamFrame = errors.New("invalid stream frame")
+
+// tcpFrame is a packet waiting to be written to a stream, op is only used by websocket streams
+type tcpFrame struct {
+	op byte
+	b  *[]byte
+}
+
+// bufferedConn reads what was buffered while the stream was negotiated before reading from the conn
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+type tcpStream struct {
+	conn net.Conn
+	r    *bufio.Reader
+	// websocket streams frame packets as websocket binary frames, mask is set on the dialing side
+	websocket bool
+	mask      bool
+
+	sendq     chan tcpFrame
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newTCPStream(conn net.Conn, r *bufio.Reader, websocket, mask bool) *tcpStream {
+	return &tcpStream{
+		conn:      conn,
+		r:         r,
+		websocket: websocket,
+		mask:      mask,
+		sendq:     make(chan tcpFrame, tcpStreamQueue),
+		done:      make(chan struct{}),
+	}
+}
+
+// send queues a copy of the packet, it is dropped if the stream can not keep up like it would be by a full socket
+func (s *tcpStream) send(b []byte) bool {
+	return s.queue(wsOpBinary, b)
+}
+
+func (s *tcpStream) queue(op byte, b []byte) bool {
+	p := getPacketBuffer()
+	*p = append(*p, b...)
+
+	select {
+	case s.sendq <- tcpFrame{op: op, b: p}:
+		return true
+	case <-s.done:
+	default:
+	}
+	putPacketBuffer(p)
+	return false
+}
+
+func (s *tcpStream) close() {
+	s.closeOnce.Do(func() {
+		close(s.done)
+		s.conn.Close()
+	})
+}
+
+// writeLoop writes queued packets until the stream is closed, it flushes once the queue is empty
+func (s *tcpStream) writeLoop() error {
+	w := bufio.NewWriterSize(s.conn, 64*1024)
+	var scratch []byte
+	for {
+		select {
+		case fr := <-s.sendq:
+			var err error
+			scratch, err = s.writeFrame(w, fr.op, *fr.b, scratch)
+			putPacketBuffer(fr.b)
+			if err != nil {
+				return err
+			}
+
+			if len(s.sendq) == 0 {
+				if err := w.Flush(); err != nil {
+					return err
+				}
+			}
+
+		case <-s.done:
+			return nil
+		}
+	}
+}
+
+func (s *tcpStream) writeFrame(w *bufio.Writer, op byte, b, scratch []byte) ([]byte, error) {
+	if !s.websocket {
+		var hdr [2]byte
+		binary.BigEndian.PutUint16(hdr[:], uint16(len(b)))
+		w.Write(hdr[:])
+		_, err := w.Write(b)
+		return scratch, err
+	}
+
+	hdr := make([]byte, 0, 14)
+	hdr = append(hdr, 0x80|op)
+
+	var maskBit byte
+	if s.mask {
+		maskBit = 0x80
+	}
+
+	switch {
+	case len(b) < 126:
+		hdr = append(hdr, maskBit|byte(len(b)))
+	case len(b) <= 0xffff:
+		hdr = append(hdr, maskBit|126)
+		hdr = binary.BigEndian.AppendUint16(hdr, uint16(len(b)))
+	default:
+		hdr = append(hdr, maskBit|127)
+		hdr = binary.BigEndian.AppendUint64(hdr, uint64(len(b)))
+	}
+
+	if s.mask {
+		var key [4]byte
+		binary.BigEndian.PutUint32(key[:], mathrand.Uint32())
+		hdr = append(hdr, key[:]...)
+		scratch = append(scratch[:0], b...)
+		maskBytes(key, scratch)
+		b = scratch
+	}
+
+	w.Write(hdr)
+	_, err := w.Write(b)
+	return scratch, err
+}
+
+// readPacket returns the next packet of the stream read into buf
+func (s *tcpStream) readPacket(buf []byte) ([]byte, error) {
+	if !s.websocket {
+		var hdr [2]byte
+		if _, err := io.ReadFull(s.r, hdr[:]); err != nil {
+			return nil, err
+		}
+
+		n := int(binary.BigEndian.Uint16(hdr[:]))
+		if n > len(buf) {
+			return nil, errTCPStreamFrame
+		}
+		_, err := io.ReadFull(s.r, buf[:n])
+		return buf[:n], err
+	}
+
+	for {
+		var hdr [2]byte
+		if _, err := io.ReadFull(s.r, hdr[:]); err != nil {
+			return nil, err
+		}
+
+		fin, op := hdr[0]&0x80 != 0, hdr[0]&0x0f
+		masked := hdr[1]&0x80 != 0
+		n := uint64(hdr[1] & 0x7f)
+		switch n {
+		case 126:
+			var ext [2]byte
+			if _, err := io.ReadFull(s.r, ext[:]); err != nil {
+				return nil, err
+			}
+			n = uint64(binary.BigEndian.Uint16(ext[:]))
+		case 127:
+			var ext [8]byte
+			if _, err := io.ReadFull(s.r, ext[:]); err != nil {
+				return nil, err
+			}
+			n = binary.BigEndian.Uint64(ext[:])
+		}
+
+		// We never fragment and only the dialing side masks, anything else is not our peer
+		if !fin || masked == s.mask || n > uint64(len(buf)) {
+			return nil, errTCPStreamFrame
+		}
+
+		var key [4]byte
+		if masked {
+			if _, err := io.ReadFull(s.r, key[:]); err != nil {
+				return nil, err
+			}
+		}
+
+		b := buf[:n]
+		if _, err := io.ReadFull(s.r, b); err != nil {
+			return nil, err
+		}
+		if masked {
+			maskBytes(key, b)
+		}
+
+		switch op {
+		case wsOpBinary:
+			return b, nil
+		case wsOpClose:
+			return nil, io.EOF
+		case wsOpPing:
+			s.queue(wsOpPong, b)
+		case wsOpPong:
+		default:
+			return nil, errTCPStreamFrame
+		}
+	}
+}
+
+func maskBytes(key [4]byte, b []byte) {
+	for i := range b {
+		b[i] ^= key[i&3]
+	}
+}
+
+// websocketAccept returns the Sec-WebSocket-Accept answer to key
+func websocketAccept(key string) string {
+	h := sha1.Sum([]byte(key + websocketGUID))
+	return base64.StdEncoding.EncodeToString(h[:])
+}
+
+// dialWebsocket asks the listener to upgrade the connection to a websocket
+func dialWebsocket(conn net.Conn, r *bufio.Reader, host, path string) error {
+	var nonce [16]byte
+	if _, err := rand.Read(nonce[:]); err != nil {
+		return err
+	}
+	key := base64.StdEncoding.EncodeToString(nonce[:])
+
+	req := fmt.Sprintf("GET %s HTTP/1.1\r\nHost: %s\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n"+
+		"Sec-WebSocket-Key: %s\r\nSec-WebSocket-Version: 13\r\n\r\n", path, host, key)
+	if _, err := io.WriteString(conn, req); err != nil {
+		return err
+	}
+
+	res, err := http.ReadResponse(r, nil)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+
+	if res.StatusCode != http.StatusSwitchingProtocols {
+		return fmt.Errorf("websocket upgrade refused: %s", res.Status)
+	}
+	if res.Header.Get("Sec-WebSocket-Accept") != websocketAccept(key) {
+		return errors.New("websocket upgrade answered with the wrong key")
+	}
+	return nil
+}
+
+// acceptWebsocket answers the upgrade request of a dialing peer, anything else gets what a web server would answer
+func acceptWebsocket(conn net.Conn, r *bufio.Reader, path string) error {
+	req, err := http.ReadRequest(r)
+	if err != nil {
+		return err
+	}
+	req.Body.Close()
+
+	key := req.Header.Get("Sec-WebSocket-Key")
+	if req.Method != http.MethodGet || req.URL.Path != path || key == "" ||
+		!strings.EqualFold(req.Header.Get("Upgrade"), "websocket") {
+		io.WriteString(conn, "HTTP/1.1 404 Not Found\r\nContent-Length: 0\r\nConnection: close\r\n\r\n")
+		return errors.New("not a websocket upgrade")
+	}
+
+	_, err = fmt.Fprintf(conn, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n"+
+		"Sec-WebSocket-Accept: %s\r\n\r\n", websocketAccept(key))
+	return err
+}
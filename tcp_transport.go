@@ -0,0 +1,358 @@
+package nebula
+
+import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/netip"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/iputil"
+	"github.com/slackhq/nebula/udp"
+)
+
+// Some networks block udp entirely. tcp_transport carries nebula packets over tcp streams instead, a listener accepts
+// them and a host whose handshakes over udp go unanswered dials its peer's listener. Streams are underlay links, see
+// underlay.go.
+
+const (
+	defaultTCPTransportRemotePort = 443
+	defaultTCPTransportPath       = "/"
+	tcpTransportDialTimeout       = 5 * time.Second
+	// tcpTransportIdleTimeout closes streams nothing was read from for this long
+	tcpTransportIdleTimeout = 5 * time.Minute
+)
+
+type tcpTransport struct {
+	l *logrus.Logger
+	f *Interface
+
+	listenHost string
+	listenPort int
+	// fallbackAfter is how many handshake attempts over udp go unanswered before we dial, 0 never dials
+	fallbackAfter int
+	remotePort    int
+	websocket     bool
+	tls           bool
+	path          string
+
+	links *underlayLinks
+	// proxy dials streams through a proxy when set
+	proxy *underlayProxy
+	// lock serializes changes to dialing
+	lock    sync.Mutex
+	dialing map[netip.AddrPort]struct{}
+
+	ctx      context.Context
+	listener net.Listener
+
+	tlsOnce   sync.Once
+	tlsConfig *tls.Config
+	tlsErr    error
+}
+
+func newTCPTransportFromConfig(l *logrus.Logger, c *config.C, links *underlayLinks) (*tcpTransport, error) {
+	t := &tcpTransport{
+		l:             l,
+		links:         links,
+		listenHost:    c.GetString("listen.host", "0.0.0.0"),
+		listenPort:    c.GetInt("tcp_transport.listen_port", 0),
+		fallbackAfter: c.GetInt("tcp_transport.fallback_after", 0),
+		remotePort:    c.GetInt("tcp_transport.remote_port", defaultTCPTransportRemotePort),
+		websocket:     c.GetBool("tcp_transport.websocket", false),
+		tls:           c.GetBool("tcp_transport.tls", false),
+		path:          c.GetString("tcp_transport.path", defaultTCPTransportPath),
+		dialing:       map[netip.AddrPort]struct{}{},
+	}
+
+	if t.listenPort == 0 && t.fallbackAfter == 0 {
+		return nil, nil
+	}
+
+	if t.listenPort < 0 || t.listenPort > 65535 {
+		return nil, fmt.Errorf("tcp_transport.listen_port must be a port: %v", t.listenPort)
+	}
+	if t.fallbackAfter < 0 {
+		return nil, fmt.Errorf("tcp_transport.fallback_after can not be negative: %v", t.fallbackAfter)
+	}
+	if t.remotePort < 1 || t.remotePort > 65535 {
+		return nil, fmt.Errorf("tcp_transport.remote_port must be a port: %v", t.remotePort)
+	}
+	if len(t.path) == 0 || t.path[0] != '/' {
+		return nil, fmt.Errorf("tcp_transport.path must start with /: %q", t.path)
+	}
+	if t.listenHost == "[::]" {
+		t.listenHost = "::"
+	}
+
+	return t, nil
+}
+
+// Start listens for streams if asked to, everything is closed when ctx is done
+func (t *tcpTransport) Start(ctx context.Context) {
+	t.ctx = ctx
+
+	if t.listenPort > 0 {
+		ln, err := net.Listen("tcp", net.JoinHostPort(t.listenHost, strconv.Itoa(t.listenPort)))
+		if err != nil {
+			t.l.WithError(err).WithField("port", t.listenPort).Error("Failed to listen for tcp_transport streams")
+		} else {
+			t.listener = ln
+			t.l.WithField("addr", ln.Addr()).Info("Listening for tcp_transport streams")
+			go t.acceptLoop(ln)
+		}
+	}
+
+	go func() {
+		<-ctx.Done()
+		if t.listener != nil {
+			t.listener.Close()
+		}
+	}()
+}
+
+func (t *tcpTransport) acceptLoop(ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if t.ctx.Err() == nil {
+				t.l.WithError(err).Error("Failed to accept tcp_transport stream")
+			}
+			return
+		}
+
+		go func() {
+			s, err := t.accept(conn)
+			if err != nil {
+				t.l.WithError(err).WithField("remote", conn.RemoteAddr()).Debug("Refused tcp_transport stream")
+				conn.Close()
+				return
+			}
+
+			ap := conn.RemoteAddr().(*net.TCPAddr).AddrPort()
+			t.serve(s, ap)
+		}()
+	}
+}
+
+// accept works out what the peer speaks from its first byte and negotiates the stream
+func (t *tcpTransport) accept(conn net.Conn) (*tcpStream, error) {
+	conn.SetDeadline(time.Now().Add(tcpStreamNegotiateTimeout))
+	r := bufio.NewReader(conn)
+
+	first, err := r.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+
+	if first[0] == tlsRecordHandshake {
+		cfg, err := t.serverTLSConfig()
+		if err != nil {
+			return nil, err
+		}
+
+		tc := tls.Server(&bufferedConn{Conn: conn, r: r}, cfg)
+		if err := tc.Handshake(); err != nil {
+			return nil, err
+		}
+		conn = tc
+		r = bufio.NewReader(conn)
+
+		if first, err = r.Peek(1); err != nil {
+			return nil, err
+		}
+	}
+
+	var s *tcpStream
+	switch first[0] {
+	case tcpStreamMagic[0]:
+		var magic [len(tcpStreamMagic)]byte
+		if _, err := io.ReadFull(r, magic[:]); err != nil {
+			return nil, err
+		}
+		if string(magic[:]) != tcpStreamMagic {
+			return nil, errTCPStreamFrame
+		}
+		s = newTCPStream(conn, r, false, false)
+
+	case 'G':
+		if err := acceptWebsocket(conn, r, t.path); err != nil {
+			return nil, err
+		}
+		s = newTCPStream(conn, r, true, false)
+
+	default:
+		return nil, errTCPStreamFrame
+	}
+
+	conn.SetDeadline(time.Time{})
+	return s, nil
+}
+
+// serverTLSConfig returns a config with a throw away self signed certificate. The tls layer only makes the stream
+// look like https, the nebula handshake inside of it is what authenticates the peer.
+func (t *tcpTransport) serverTLSConfig() (*tls.Config, error) {
+	t.tlsOnce.Do(func() {
+		t.tlsConfig, t.tlsErr = newSelfSignedTLSConfig()
+	})
+	return t.tlsConfig, t.tlsErr
+}
+
+func newSelfSignedTLSConfig() (*tls.Config, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
+
+// dial connects to the listener at ap and negotiates the stream we are configured to speak
+func (t *tcpTransport) dial(ap netip.AddrPort) (*tcpStream, error) {
+	var conn net.Conn
+	var err error
+	if t.proxy != nil {
+		conn, err = t.proxy.dial(t.ctx, ap)
+	} else {
+		d := net.Dialer{Timeout: tcpTransportDialTimeout}
+		conn, err = d.DialContext(t.ctx, "tcp", ap.String())
+	}
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(tcpStreamNegotiateTimeout))
+
+	if t.tls {
+		// The nebula handshake authenticates the peer, there is no certificate worth verifying here
+		tc := tls.Client(conn, &tls.Config{InsecureSkipVerify: true, MinVersion: tls.VersionTLS12}) //nolint:gosec
+		if err := tc.Handshake(); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = tc
+	}
+
+	r := bufio.NewReader(conn)
+	if t.websocket {
+		err = dialWebsocket(conn, r, ap.String(), t.path)
+	} else {
+		_, err = io.WriteString(conn, tcpStreamMagic)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	conn.SetDeadline(time.Time{})
+	return newTCPStream(conn, r, t.websocket, t.websocket), nil
+}
+
+// handshake sends the handshake packet over a stream to every ip in remotes once fallbackAfter attempts over udp went
+// unanswered, dialing the ones we do not have a stream with yet. Udp is always tried as well.
+func (t *tcpTransport) handshake(_ iputil.VpnIp, attempt int, packet []byte, remotes []*udp.Addr) bool {
+	if t.fallbackAfter == 0 || attempt < t.fallbackAfter {
+		return false
+	}
+
+	for _, ap := range handshakeAddrs(remotes, uint16(t.remotePort)) {
+		if s := t.links.get(ap); s != nil {
+			s.send(packet)
+			continue
+		}
+
+		t.lock.Lock()
+		if _, ok := t.dialing[ap]; ok || t.ctx == nil {
+			t.lock.Unlock()
+			continue
+		}
+		t.dialing[ap] = struct{}{}
+		t.lock.Unlock()
+
+		p := append([]byte(nil), packet...)
+		go func() {
+			s, err := t.dial(ap)
+
+			t.lock.Lock()
+			delete(t.dialing, ap)
+			t.lock.Unlock()
+
+			if err != nil {
+				t.l.WithError(err).WithField("remote", ap).Info("Failed to dial tcp_transport stream")
+				return
+			}
+
+			t.l.WithField("remote", ap).WithField("websocket", t.websocket).WithField("tls", t.tls).
+				Info("Falling back to a tcp_transport stream")
+			s.send(p)
+			t.serve(s, ap)
+		}()
+	}
+	return false
+}
+
+// serve makes the stream the way to reach ap and handles what is read from it until it closes
+func (t *tcpTransport) serve(s *tcpStream, ap netip.AddrPort) {
+	ap = linkAddr(ap)
+	t.links.add(ap, s)
+	defer t.links.remove(ap, s)
+	defer s.close()
+
+	go func() {
+		if err := s.writeLoop(); err != nil {
+			t.l.WithError(err).WithField("remote", ap).Debug("Failed to write to tcp_transport stream")
+		}
+		s.close()
+	}()
+
+	go func() {
+		select {
+		case <-t.ctx.Done():
+			s.close()
+		case <-s.done:
+		}
+	}()
+
+	buf := make([]byte, mtu)
+	r := newUnderlayReader(t.f, ap)
+
+	for {
+		s.conn.SetReadDeadline(time.Now().Add(tcpTransportIdleTimeout))
+		packet, err := s.readPacket(buf)
+		if err != nil {
+			if !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+				t.l.WithError(err).WithField("remote", ap).Debug("Failed to read from tcp_transport stream")
+			}
+			return
+		}
+
+		r.handle(packet)
+	}
+}
@@ -0,0 +1,127 @@
+package nebula
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewTCPTransportFromConfig(t *testing.T) {
+	l := test.NewLogger()
+	c := config.NewC(l)
+
+	tt, err := newTCPTransportFromConfig(l, c, nil)
+	require.NoError(t, err)
+	assert.Nil(t, tt)
+
+	c.Settings["tcp_transport"] = map[interface{}]interface{}{"fallback_after": 3}
+	tt, err = newTCPTransportFromConfig(l, c, nil)
+	require.NoError(t, err)
+	assert.Equal(t, defaultTCPTransportRemotePort, tt.remotePort)
+	assert.Equal(t, defaultTCPTransportPath, tt.path)
+
+	for k, v := range map[string]interface{}{
+		"listen_port":    70000,
+		"fallback_after": -1,
+		"remote_port":    0,
+		"path":           "nebula",
+	} {
+		c.Settings["tcp_transport"] = map[interface{}]interface{}{"listen_port": 4242, k: v}
+		_, err = newTCPTransportFromConfig(l, c, nil)
+		assert.Error(t, err, k)
+	}
+}
+
+func TestTCPTransport_negotiate(t *testing.T) {
+	l := test.NewLogger()
+
+	for _, tc := range []struct {
+		name      string
+		websocket bool
+		tls       bool
+	}{
+		{name: "raw"},
+		{name: "websocket", websocket: true},
+		{name: "tls", tls: true},
+		{name: "websocket over tls", websocket: true, tls: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ln, err := net.Listen("tcp", "127.0.0.1:0")
+			require.NoError(t, err)
+			defer ln.Close()
+
+			server := &tcpTransport{l: l, path: "/nebula"}
+			client := &tcpTransport{l: l, path: "/nebula", websocket: tc.websocket, tls: tc.tls, ctx: context.Background()}
+
+			accepted := make(chan *tcpStream, 1)
+			go func() {
+				conn, err := ln.Accept()
+				if err != nil {
+					return
+				}
+				s, err := server.accept(conn)
+				assert.NoError(t, err)
+				accepted <- s
+			}()
+
+			cs, err := client.dial(ln.Addr().(*net.TCPAddr).AddrPort())
+			require.NoError(t, err)
+			defer cs.close()
+			ss := <-accepted
+			require.NotNil(t, ss)
+			defer ss.close()
+			assert.Equal(t, tc.websocket, ss.websocket)
+
+			go cs.writeLoop()
+			go ss.writeLoop()
+
+			buf := make([]byte, mtu)
+			big := make([]byte, 1400)
+			big[1399] = 7
+			for _, p := range [][]byte{{1, 2, 3}, big} {
+				assert.True(t, cs.send(p))
+				got, err := ss.readPacket(buf)
+				require.NoError(t, err)
+				assert.Equal(t, p, got)
+
+				assert.True(t, ss.send(p))
+				got, err = cs.readPacket(buf)
+				require.NoError(t, err)
+				assert.Equal(t, p, got)
+			}
+		})
+	}
+}
+
+func TestTCPTransport_refuses(t *testing.T) {
+	l := test.NewLogger()
+	server := &tcpTransport{l: l, path: "/nebula"}
+
+	for name, hello := range map[string]string{
+		"garbage":        "hello",
+		"wrong magic":    "NEB\x02",
+		"not an upgrade": "GET /nebula HTTP/1.1\r\nHost: a\r\n\r\n",
+		"wrong path":     "GET / HTTP/1.1\r\nHost: a\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Key: a\r\n\r\n",
+	} {
+		c, s := net.Pipe()
+		go func() {
+			c.Write([]byte(hello))
+			buf := make([]byte, 512)
+			for {
+				if _, err := c.Read(buf); err != nil {
+					return
+				}
+			}
+		}()
+
+		_, err := server.accept(s)
+		assert.Error(t, err, name)
+		c.Close()
+		s.Close()
+	}
+}
@@ -11,7 +11,7 @@ import (
 type NoopTun struct{}
 
 func (NoopTun) RouteFor(iputil.VpnIp) iputil.VpnIp {
-	return 0
+	return iputil.VpnIp{}
 }
 
 func (NoopTun) Activate() error {
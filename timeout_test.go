@@ -5,6 +5,7 @@ import (
 	"time"
 
 	"github.com/slackhq/nebula/firewall"
+	"github.com/slackhq/nebula/iputil"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -115,10 +116,10 @@ func TestTimerWheel_Purge(t *testing.T) {
 	assert.Equal(t, 0, tw.current)
 
 	fps := []firewall.Packet{
-		{LocalIP: 1},
-		{LocalIP: 2},
-		{LocalIP: 3},
-		{LocalIP: 4},
+		{LocalIP: iputil.VpnIpFrom4(1)},
+		{LocalIP: iputil.VpnIpFrom4(2)},
+		{LocalIP: iputil.VpnIpFrom4(3)},
+		{LocalIP: iputil.VpnIpFrom4(4)},
 	}
 
 	tw.Add(fps[0], time.Second*1)
@@ -0,0 +1,13 @@
+//go:build tpm && !windows
+// +build tpm,!windows
+
+package tpmclient
+
+import (
+	"github.com/google/go-tpm/tpm2/transport"
+	"github.com/google/go-tpm/tpm2/transport/linuxtpm"
+)
+
+func openTransport(path string) (transport.TPMCloser, error) {
+	return linuxtpm.Open(path)
+}
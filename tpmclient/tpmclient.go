@@ -0,0 +1,207 @@
+// Package tpmclient keeps a node's P256 identity key in a TPM 2.0 so it can not be copied off the host. The key is
+// created inside the TPM and persisted at an owner handle, nebula only ever sees the public key and asks the TPM to do
+// the ECDH for the noise handshake.
+//
+// TPM support needs the tpm build tag, `go build -tags tpm`, without it FromURL and Generate return ErrNotSupported.
+//
+// Keys are named with a url, tpm:///dev/tpmrm0?handle=0x81000010, the path is the TPM device and the handle is where
+// the key is persisted. On windows the path is ignored.
+package tpmclient
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	Scheme      = "tpm"
+	DefaultPath = "/dev/tpmrm0"
+
+	// NoiseKeySize is the length of the shared secret returned by DeriveNoise
+	NoiseKeySize = 32
+
+	// Owner persistent handles are 0x81000000 to 0x817FFFFF
+	minPersistentHandle = 0x81000000
+	maxPersistentHandle = 0x817FFFFF
+)
+
+var ErrNotSupported = errors.New("nebula was built without TPM support, rebuild with -tags tpm")
+
+// Client performs operations with a key held in a TPM
+type Client interface {
+	io.Closer
+	// GetPubKey returns the uncompressed P256 public key, the same encoding nebula certificates use
+	GetPubKey() ([]byte, error)
+	// DeriveNoise returns the ECDH shared secret with peerPubKey
+	DeriveNoise(peerPubKey []byte) ([]byte, error)
+	// SignASN1 returns an ASN.1 encoded ECDSA signature over a sha256 digest
+	SignASN1(digest []byte) ([]byte, error)
+	// Test checks that the TPM can sign and derive with the key and that the results match its public key
+	Test() error
+}
+
+// URL identifies a persisted TPM key
+type URL struct {
+	Path   string
+	Handle uint32
+}
+
+// IsURL reports if s names a TPM key rather than a file path or PEM
+func IsURL(s string) bool {
+	return strings.HasPrefix(s, Scheme+":")
+}
+
+// ParseURL parses a tpm key url, the path defaults to DefaultPath
+func ParseURL(s string) (*URL, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid tpm url: %w", err)
+	}
+
+	if u.Scheme != Scheme {
+		return nil, fmt.Errorf("invalid tpm url: scheme must be %s", Scheme)
+	}
+
+	rawHandle := u.Query().Get("handle")
+	if rawHandle == "" {
+		return nil, fmt.Errorf("invalid tpm url: handle is required")
+	}
+
+	handle, err := strconv.ParseUint(rawHandle, 0, 32)
+	if err != nil || handle < minPersistentHandle || handle > maxPersistentHandle {
+		return nil, fmt.Errorf("invalid tpm url: handle %s is not an owner persistent handle", rawHandle)
+	}
+
+	tu := &URL{Path: u.Path, Handle: uint32(handle)}
+	if tu.Path == "" {
+		tu.Path = DefaultPath
+	}
+	return tu, nil
+}
+
+func (u *URL) String() string {
+	return fmt.Sprintf("%s://%s?handle=%#x", Scheme, u.Path, u.Handle)
+}
+
+// FromURL opens the TPM and key named by the url, the client must be closed
+func FromURL(s string) (Client, error) {
+	u, err := ParseURL(s)
+	if err != nil {
+		return nil, err
+	}
+	return open(u)
+}
+
+// Generate creates a new P256 key in the TPM, persists it at the url handle, and returns the public key. It refuses to
+// replace a key that is already at the handle.
+func Generate(s string) ([]byte, error) {
+	u, err := ParseURL(s)
+	if err != nil {
+		return nil, err
+	}
+	return generate(u)
+}
+
+// Locked returns a client that serializes calls into c, a TPM runs one command at a time and a client opened for a
+// node's key is shared by every handshake
+func Locked(c Client) Client {
+	return &lockedClient{c: c}
+}
+
+type lockedClient struct {
+	sync.Mutex
+	c Client
+}
+
+func (l *lockedClient) Close() error {
+	l.Lock()
+	defer l.Unlock()
+	return l.c.Close()
+}
+
+func (l *lockedClient) GetPubKey() ([]byte, error) {
+	l.Lock()
+	defer l.Unlock()
+	return l.c.GetPubKey()
+}
+
+func (l *lockedClient) DeriveNoise(peerPubKey []byte) ([]byte, error) {
+	l.Lock()
+	defer l.Unlock()
+	return l.c.DeriveNoise(peerPubKey)
+}
+
+func (l *lockedClient) SignASN1(digest []byte) ([]byte, error) {
+	l.Lock()
+	defer l.Unlock()
+	return l.c.SignASN1(digest)
+}
+
+// Test runs the self test with the lock held for each call, not for the whole test, so handshakes are not stalled
+func (l *lockedClient) Test() error {
+	return testClient(l)
+}
+
+// testClient is the Test implementation shared by clients, it signs and derives with the key and checks the results
+// against the public key
+func testClient(c Client) error {
+	pub, err := c.GetPubKey()
+	if err != nil {
+		return err
+	}
+
+	x, y := elliptic.Unmarshal(elliptic.P256(), pub)
+	if x == nil {
+		return fmt.Errorf("tpm key is not a P256 key")
+	}
+
+	digest := sha256.Sum256([]byte("nebula tpm test"))
+	sig, err := c.SignASN1(digest[:])
+	if err != nil {
+		return fmt.Errorf("tpm key failed to sign: %w", err)
+	}
+
+	if !ecdsa.VerifyASN1(&ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}, digest[:], sig) {
+		return fmt.Errorf("tpm signature did not verify with the tpm public key")
+	}
+
+	peer, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+
+	peerECDH, err := peer.ECDH()
+	if err != nil {
+		return err
+	}
+
+	z, err := c.DeriveNoise(peerECDH.PublicKey().Bytes())
+	if err != nil {
+		return fmt.Errorf("tpm key failed to derive: %w", err)
+	}
+
+	ourPub, err := peerECDH.Curve().NewPublicKey(pub)
+	if err != nil {
+		return err
+	}
+
+	expected, err := peerECDH.ECDH(ourPub)
+	if err != nil {
+		return err
+	}
+
+	if string(expected) != string(z) {
+		return fmt.Errorf("tpm ecdh did not match the tpm public key")
+	}
+
+	return nil
+}
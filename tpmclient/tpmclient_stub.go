@@ -0,0 +1,12 @@
+//go:build !tpm
+// +build !tpm
+
+package tpmclient
+
+func open(_ *URL) (Client, error) {
+	return nil, ErrNotSupported
+}
+
+func generate(_ *URL) ([]byte, error) {
+	return nil, ErrNotSupported
+}
@@ -0,0 +1,135 @@
+package tpmclient
+
+import (
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseURL(t *testing.T) {
+	u, err := ParseURL("tpm:///dev/tpm0?handle=0x81000010")
+	require.NoError(t, err)
+	assert.Equal(t, &URL{Path: "/dev/tpm0", Handle: 0x81000010}, u)
+	assert.Equal(t, "tpm:///dev/tpm0?handle=0x81000010", u.String())
+
+	u, err = ParseURL("tpm:?handle=2164260880")
+	require.NoError(t, err)
+	assert.Equal(t, &URL{Path: DefaultPath, Handle: 0x81000010}, u)
+
+	_, err = ParseURL("file:///dev/tpm0?handle=0x81000010")
+	assert.EqualError(t, err, "invalid tpm url: scheme must be tpm")
+
+	_, err = ParseURL("tpm:///dev/tpm0")
+	assert.EqualError(t, err, "invalid tpm url: handle is required")
+
+	_, err = ParseURL("tpm:///dev/tpm0?handle=0x80000000")
+	assert.EqualError(t, err, "invalid tpm url: handle 0x80000000 is not an owner persistent handle")
+
+	_, err = ParseURL("tpm:///dev/tpm0?handle=nope")
+	assert.EqualError(t, err, "invalid tpm url: handle nope is not an owner persistent handle")
+
+	assert.True(t, IsURL("tpm:?handle=0x81000010"))
+	assert.False(t, IsURL("/etc/nebula/host.key"))
+	assert.False(t, IsURL("-----BEGIN NEBULA X25519 PRIVATE KEY-----"))
+}
+
+// softClient is a Client backed by an in memory key
+type softClient struct {
+	key       *ecdsa.PrivateKey
+	breakECDH bool
+}
+
+func (c *softClient) Close() error { return nil }
+
+func (c *softClient) GetPubKey() ([]byte, error) {
+	return elliptic.Marshal(elliptic.P256(), c.key.X, c.key.Y), nil
+}
+
+func (c *softClient) DeriveNoise(peerPubKey []byte) ([]byte, error) {
+	if c.breakECDH {
+		return make([]byte, NoiseKeySize), nil
+	}
+
+	k, err := c.key.ECDH()
+	if err != nil {
+		return nil, err
+	}
+	peer, err := ecdh.P256().NewPublicKey(peerPubKey)
+	if err != nil {
+		return nil, err
+	}
+	return k.ECDH(peer)
+}
+
+func (c *softClient) SignASN1(digest []byte) ([]byte, error) {
+	return ecdsa.SignASN1(rand.Reader, c.key, digest)
+}
+
+func (c *softClient) Test() error { return testClient(c) }
+
+func Test_testClient(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	other, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	c := &softClient{key: key}
+	assert.NoError(t, c.Test())
+
+	c.breakECDH = true
+	assert.EqualError(t, c.Test(), "tpm ecdh did not match the tpm public key")
+
+	// A signature from a different key than the public key claims
+	assert.EqualError(t, testClient(&mismatchedClient{softClient: c, signer: other}), "tpm signature did not verify with the tpm public key")
+}
+
+func TestLocked(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	c := Locked(&softClient{key: key})
+	peer, err := ecdh.P256().GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	// Handshakes share the client
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := c.DeriveNoise(peer.PublicKey().Bytes())
+			assert.NoError(t, err)
+		}()
+	}
+	assert.NoError(t, c.Test())
+	wg.Wait()
+	assert.NoError(t, c.Close())
+}
+
+type mismatchedClient struct {
+	*softClient
+	signer *ecdsa.PrivateKey
+}
+
+func (c *mismatchedClient) SignASN1(digest []byte) ([]byte, error) {
+	return ecdsa.SignASN1(rand.Reader, c.signer, digest)
+}
+
+func TestFromURL(t *testing.T) {
+	_, err := FromURL("tpm:?handle=1")
+	assert.EqualError(t, err, "invalid tpm url: handle 1 is not an owner persistent handle")
+
+	_, err = Generate("nope")
+	assert.EqualError(t, err, "invalid tpm url: scheme must be tpm")
+
+	if _, err = FromURL("tpm:?handle=0x81000010"); errors.Is(err, ErrNotSupported) {
+		_, err = Generate("tpm:?handle=0x81000010")
+		assert.ErrorIs(t, err, ErrNotSupported)
+	}
+}
@@ -0,0 +1,226 @@
+//go:build tpm
+// +build tpm
+
+package tpmclient
+
+import (
+	"crypto/ecdh"
+	"encoding/asn1"
+	"fmt"
+	"math/big"
+
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpm2/transport"
+)
+
+// keyTemplate is an unrestricted P256 key that can both sign and do ECDH. The private part is generated by the TPM and
+// can never be duplicated out of it.
+var keyTemplate = tpm2.TPMTPublic{
+	Type:    tpm2.TPMAlgECC,
+	NameAlg: tpm2.TPMAlgSHA256,
+	ObjectAttributes: tpm2.TPMAObject{
+		FixedTPM:            true,
+		FixedParent:         true,
+		SensitiveDataOrigin: true,
+		UserWithAuth:        true,
+		Decrypt:             true,
+		SignEncrypt:         true,
+	},
+	Parameters: tpm2.NewTPMUPublicParms(
+		tpm2.TPMAlgECC,
+		&tpm2.TPMSECCParms{
+			CurveID: tpm2.TPMECCNistP256,
+		},
+	),
+}
+
+type tpmClient struct {
+	tpm    transport.TPMCloser
+	handle tpm2.AuthHandle
+	pub    []byte
+}
+
+func open(u *URL) (Client, error) {
+	t, err := openTransport(u.Path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open tpm %s: %w", u.Path, err)
+	}
+
+	rsp, err := tpm2.ReadPublic{ObjectHandle: tpm2.TPMHandle(u.Handle)}.Execute(t)
+	if err != nil {
+		t.Close()
+		return nil, fmt.Errorf("unable to read tpm key at %#x: %w", u.Handle, err)
+	}
+
+	pub, err := publicKey(rsp.OutPublic)
+	if err != nil {
+		t.Close()
+		return nil, err
+	}
+
+	return &tpmClient{
+		tpm: t,
+		handle: tpm2.AuthHandle{
+			Handle: tpm2.TPMHandle(u.Handle),
+			Name:   rsp.Name,
+			Auth:   tpm2.PasswordAuth(nil),
+		},
+		pub: pub,
+	}, nil
+}
+
+func generate(u *URL) ([]byte, error) {
+	t, err := openTransport(u.Path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open tpm %s: %w", u.Path, err)
+	}
+	defer t.Close()
+
+	if _, err := (tpm2.ReadPublic{ObjectHandle: tpm2.TPMHandle(u.Handle)}).Execute(t); err == nil {
+		return nil, fmt.Errorf("refusing to overwrite existing tpm key at %#x", u.Handle)
+	}
+
+	srk, err := tpm2.CreatePrimary{
+		PrimaryHandle: tpm2.TPMRHOwner,
+		InPublic:      tpm2.New2B(tpm2.ECCSRKTemplate),
+	}.Execute(t)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create tpm storage key: %w", err)
+	}
+	defer flush(t, srk.ObjectHandle)
+
+	parent := tpm2.NamedHandle{Handle: srk.ObjectHandle, Name: srk.Name}
+	created, err := tpm2.Create{
+		ParentHandle: parent,
+		InPublic:     tpm2.New2B(keyTemplate),
+	}.Execute(t)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create tpm key: %w", err)
+	}
+
+	loaded, err := tpm2.Load{
+		ParentHandle: parent,
+		InPrivate:    created.OutPrivate,
+		InPublic:     created.OutPublic,
+	}.Execute(t)
+	if err != nil {
+		return nil, fmt.Errorf("unable to load tpm key: %w", err)
+	}
+	defer flush(t, loaded.ObjectHandle)
+
+	_, err = tpm2.EvictControl{
+		Auth:             tpm2.TPMRHOwner,
+		ObjectHandle:     tpm2.NamedHandle{Handle: loaded.ObjectHandle, Name: loaded.Name},
+		PersistentHandle: tpm2.TPMHandle(u.Handle),
+	}.Execute(t)
+	if err != nil {
+		return nil, fmt.Errorf("unable to persist tpm key at %#x: %w", u.Handle, err)
+	}
+
+	return publicKey(created.OutPublic)
+}
+
+func (c *tpmClient) Close() error {
+	return c.tpm.Close()
+}
+
+func (c *tpmClient) GetPubKey() ([]byte, error) {
+	return c.pub, nil
+}
+
+func (c *tpmClient) DeriveNoise(peerPubKey []byte) ([]byte, error) {
+	peer, err := ecdh.P256().NewPublicKey(peerPubKey)
+	if err != nil {
+		return nil, fmt.Errorf("unable to unmarshal pubkey: %w", err)
+	}
+
+	x, y, err := tpm2.ECCPoint(peer)
+	if err != nil {
+		return nil, err
+	}
+
+	rsp, err := tpm2.ECDHZGen{
+		KeyHandle: c.handle,
+		InPoint: tpm2.New2B(tpm2.TPMSECCPoint{
+			X: tpm2.TPM2BECCParameter{Buffer: x.FillBytes(make([]byte, NoiseKeySize))},
+			Y: tpm2.TPM2BECCParameter{Buffer: y.FillBytes(make([]byte, NoiseKeySize))},
+		}),
+	}.Execute(c.tpm)
+	if err != nil {
+		return nil, err
+	}
+
+	z, err := rsp.OutPoint.Contents()
+	if err != nil {
+		return nil, err
+	}
+
+	// Pad to the same length crypto/ecdh returns
+	return new(big.Int).SetBytes(z.X.Buffer).FillBytes(make([]byte, NoiseKeySize)), nil
+}
+
+func (c *tpmClient) SignASN1(digest []byte) ([]byte, error) {
+	rsp, err := tpm2.Sign{
+		KeyHandle: c.handle,
+		Digest:    tpm2.TPM2BDigest{Buffer: digest},
+		InScheme: tpm2.TPMTSigScheme{
+			Scheme:  tpm2.TPMAlgECDSA,
+			Details: tpm2.NewTPMUSigScheme(tpm2.TPMAlgECDSA, &tpm2.TPMSSchemeHash{HashAlg: tpm2.TPMAlgSHA256}),
+		},
+		Validation: tpm2.TPMTTKHashCheck{Tag: tpm2.TPMSTHashCheck},
+	}.Execute(c.tpm)
+	if err != nil {
+		return nil, err
+	}
+
+	sig, err := rsp.Signature.Signature.ECDSA()
+	if err != nil {
+		return nil, err
+	}
+
+	return asn1.Marshal(struct{ R, S *big.Int }{
+		new(big.Int).SetBytes(sig.SignatureR.Buffer),
+		new(big.Int).SetBytes(sig.SignatureS.Buffer),
+	})
+}
+
+func (c *tpmClient) Test() error {
+	return testClient(c)
+}
+
+// publicKey returns the uncompressed P256 point from a tpm public area
+func publicKey(b tpm2.TPM2BPublic) ([]byte, error) {
+	pub, err := b.Contents()
+	if err != nil {
+		return nil, err
+	}
+
+	if pub.Type != tpm2.TPMAlgECC {
+		return nil, fmt.Errorf("tpm key is not an ecc key")
+	}
+
+	parms, err := pub.Parameters.ECCDetail()
+	if err != nil {
+		return nil, err
+	}
+
+	if parms.CurveID != tpm2.TPMECCNistP256 {
+		return nil, fmt.Errorf("tpm key is not a P256 key")
+	}
+
+	point, err := pub.Unique.ECC()
+	if err != nil {
+		return nil, err
+	}
+
+	k, err := tpm2.ECDHPub(parms, point)
+	if err != nil {
+		return nil, err
+	}
+
+	return k.Bytes(), nil
+}
+
+func flush(t transport.TPM, h tpm2.TPMHandle) {
+	_, _ = tpm2.FlushContext{FlushHandle: h}.Execute(t)
+}
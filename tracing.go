@@ -0,0 +1,452 @@
+package nebula
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	"github.com/sirupsen/logrus"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/iputil"
+)
+
+// tracing.endpoint exports OpenTelemetry spans to a collector over OTLP/HTTP with the json encoding, so nebula does not
+// need an sdk to be traced. A handshake we initiate is a trace: its root span lasts until the tunnel is up or the
+// handshake is given up, with an event for every lighthouse query and reply and every round of handshake packets sent
+// to the remotes we know, and a child span for processing the reply that holds the certificate verification. A
+// handshake we answer is a trace of its own.
+//
+// tracing.packets.sample_rate traces a fraction of the packets we send and receive, each is a span with events for the
+// firewall, crypto and write steps so the latency of the data path can be broken down.
+//
+// Spans are queued and exported in batches every flush_interval, when the queue is full new spans are dropped and
+// counted in tracing.dropped.
+
+const (
+	defaultTracingFlushInterval = 5 * time.Second
+	defaultTracingQueueLen      = 2048
+	tracingMaxBatch             = 512
+	tracingExportTimeout        = 10 * time.Second
+)
+
+// OTLP status codes
+const (
+	tracingStatusUnset = 0
+	tracingStatusOk    = 1
+	tracingStatusError = 2
+)
+
+type tracer struct {
+	l             *logrus.Logger
+	endpoint      string
+	headers       map[string]string
+	resource      []traceAttr
+	handshakeRate float64
+	packetRate    float64
+	flushInterval time.Duration
+
+	client  *http.Client
+	queue   chan *span
+	dropped metrics.Counter
+}
+
+type traceAttr struct {
+	key   string
+	value interface{}
+}
+
+type traceEvent struct {
+	name  string
+	time  time.Time
+	attrs []traceAttr
+}
+
+// span is an OpenTelemetry span, every method is a no-op on a nil span so callers do not need to check if they were
+// sampled
+type span struct {
+	t        *tracer
+	traceID  [16]byte
+	spanID   [8]byte
+	parentID [8]byte
+	name     string
+
+	sync.Mutex
+	start   time.Time
+	stop    time.Time
+	attrs   []traceAttr
+	events  []traceEvent
+	status  int
+	message string
+	ended   bool
+}
+
+func newTracerFromConfig(l *logrus.Logger, c *config.C, buildVersion string, certState *CertState) (*tracer, error) {
+	endpoint := c.GetString("tracing.endpoint", "")
+	if endpoint == "" {
+		return nil, nil
+	}
+
+	u, err := url.Parse(endpoint)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("tracing.endpoint must be an http or https url, got %q", endpoint)
+	}
+	if u.Path == "" || u.Path == "/" {
+		// A collector base url, like OTEL_EXPORTER_OTLP_ENDPOINT
+		u.Path = "/v1/traces"
+	}
+
+	t := &tracer{
+		l:             l,
+		endpoint:      u.String(),
+		headers:       map[string]string{},
+		handshakeRate: c.GetFloat("tracing.handshakes.sample_rate", 1),
+		packetRate:    c.GetFloat("tracing.packets.sample_rate", 0),
+		flushInterval: c.GetDuration("tracing.flush_interval", defaultTracingFlushInterval),
+		client:        &http.Client{Timeout: tracingExportTimeout},
+		dropped:       metrics.GetOrRegisterCounter("tracing.dropped", nil),
+	}
+
+	if t.handshakeRate < 0 || t.handshakeRate > 1 {
+		return nil, errors.New("tracing.handshakes.sample_rate must be between 0 and 1")
+	}
+	if t.packetRate < 0 || t.packetRate > 1 {
+		return nil, errors.New("tracing.packets.sample_rate must be between 0 and 1")
+	}
+	if t.flushInterval <= 0 {
+		return nil, errors.New("tracing.flush_interval must be greater than 0")
+	}
+
+	queueLen := c.GetInt("tracing.queue", defaultTracingQueueLen)
+	if queueLen <= 0 {
+		return nil, errors.New("tracing.queue must be greater than 0")
+	}
+	t.queue = make(chan *span, queueLen)
+
+	for k, v := range c.GetMap("tracing.headers", map[interface{}]interface{}{}) {
+		t.headers[fmt.Sprint(k)] = fmt.Sprint(v)
+	}
+
+	t.resource = []traceAttr{
+		{"service.name", c.GetString("tracing.service_name", "nebula")},
+		{"service.version", buildVersion},
+	}
+	if crt := certState.Certificate; crt != nil {
+		t.resource = append(t.resource, traceAttr{"host.name", crt.Details.Name})
+		if len(crt.Details.Ips) > 0 {
+			t.resource = append(t.resource, traceAttr{"nebula.vpn_ip", crt.Details.Ips[0].IP.String()})
+		}
+	}
+
+	return t, nil
+}
+
+// startHandshake starts the root span of a handshake trace, nil if the handshake was not sampled
+func (t *tracer) startHandshake(vpnIp iputil.VpnIp, initiator bool) *span {
+	if t == nil || !sampled(t.handshakeRate) {
+		return nil
+	}
+
+	s := t.newSpan("handshake", nil)
+	s.set("nebula.initiator", initiator)
+	if vpnIp.IsValid() {
+		s.set("nebula.peer.vpn_ip", vpnIp)
+	}
+	return s
+}
+
+// samplePacket starts the span of a packet to or from hostinfo, nil if the packet was not sampled
+func (t *tracer) samplePacket(name string, hostinfo *HostInfo, size int) *span {
+	if t == nil || t.packetRate == 0 || !sampled(t.packetRate) {
+		return nil
+	}
+
+	s := t.newSpan(name, nil)
+	s.set("nebula.peer.vpn_ip", hostinfo.vpnIp)
+	s.set("nebula.packet.size", size)
+	return s
+}
+
+func sampled(rate float64) bool {
+	return rate >= 1 || rand.Float64() < rate
+}
+
+func (t *tracer) newSpan(name string, parent *span) *span {
+	s := &span{t: t, name: name, start: time.Now()}
+	binary.BigEndian.PutUint64(s.spanID[:], rand.Uint64())
+	if parent != nil {
+		s.traceID = parent.traceID
+		s.parentID = parent.spanID
+	} else {
+		binary.BigEndian.PutUint64(s.traceID[:8], rand.Uint64())
+		binary.BigEndian.PutUint64(s.traceID[8:], rand.Uint64())
+	}
+	return s
+}
+
+// child starts a span under s
+func (s *span) child(name string) *span {
+	if s == nil {
+		return nil
+	}
+	return s.t.newSpan(name, s)
+}
+
+func (s *span) set(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.Lock()
+	s.attrs = append(s.attrs, traceAttr{key, value})
+	s.Unlock()
+}
+
+func (s *span) event(name string, attrs ...traceAttr) {
+	if s == nil {
+		return
+	}
+	s.Lock()
+	s.events = append(s.events, traceEvent{name: name, time: time.Now(), attrs: attrs})
+	s.Unlock()
+}
+
+// ok marks the span as succeeded, a span that is neither ok nor failed ends with an unset status
+func (s *span) ok() {
+	if s == nil {
+		return
+	}
+	s.Lock()
+	s.status = tracingStatusOk
+	s.Unlock()
+}
+
+func (s *span) fail(reason string) {
+	if s == nil {
+		return
+	}
+	s.Lock()
+	s.status = tracingStatusError
+	s.message = reason
+	s.Unlock()
+}
+
+// end finishes the span and queues it for export, only the first end counts
+func (s *span) end() {
+	if s == nil {
+		return
+	}
+	s.Lock()
+	if s.ended {
+		s.Unlock()
+		return
+	}
+	s.ended = true
+	s.stop = time.Now()
+	s.Unlock()
+
+	select {
+	case s.t.queue <- s:
+	default:
+		s.t.dropped.Inc(1)
+	}
+}
+
+// Start exports the queued spans every flush_interval until ctx is done. This is a non blocking call.
+func (t *tracer) Start(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(t.flushInterval)
+		defer ticker.Stop()
+
+		var batch []*span
+		flush := func(ctx context.Context) {
+			if len(batch) == 0 {
+				return
+			}
+			if err := t.export(ctx, batch); err != nil {
+				t.l.WithError(err).WithField("spans", len(batch)).Warn("Failed to export traces")
+			}
+			batch = nil
+		}
+
+		for {
+			select {
+			case <-ctx.Done():
+				// Whatever is queued is still worth having, give it a moment to get out
+				for len(t.queue) > 0 && len(batch) < tracingMaxBatch {
+					batch = append(batch, <-t.queue)
+				}
+				fctx, cancel := context.WithTimeout(context.Background(), time.Second)
+				flush(fctx)
+				cancel()
+				return
+			case s := <-t.queue:
+				batch = append(batch, s)
+				if len(batch) >= tracingMaxBatch {
+					flush(ctx)
+				}
+			case <-ticker.C:
+				flush(ctx)
+			}
+		}
+	}()
+}
+
+func (t *tracer) export(ctx context.Context, spans []*span) error {
+	b, err := json.Marshal(t.marshal(spans))
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, t.endpoint, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range t.headers {
+		req.Header.Set(k, v)
+	}
+
+	res, err := t.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	_, _ = io.Copy(io.Discard, res.Body)
+
+	if res.StatusCode/100 != 2 {
+		return fmt.Errorf("collector responded with %s", res.Status)
+	}
+	return nil
+}
+
+// The OTLP json encoding, see https://opentelemetry.io/docs/specs/otlp/#json-protobuf-encoding
+type otlpTraces struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttr `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID           string      `json:"traceId"`
+	SpanID            string      `json:"spanId"`
+	ParentSpanID      string      `json:"parentSpanId,omitempty"`
+	Name              string      `json:"name"`
+	Kind              int         `json:"kind"`
+	StartTimeUnixNano string      `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string      `json:"endTimeUnixNano"`
+	Attributes        []otlpAttr  `json:"attributes,omitempty"`
+	Events            []otlpEvent `json:"events,omitempty"`
+	Status            otlpStatus  `json:"status"`
+}
+
+type otlpEvent struct {
+	TimeUnixNano string     `json:"timeUnixNano"`
+	Name         string     `json:"name"`
+	Attributes   []otlpAttr `json:"attributes,omitempty"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpAttr struct {
+	Key   string                 `json:"key"`
+	Value map[string]interface{} `json:"value"`
+}
+
+func (t *tracer) marshal(spans []*span) otlpTraces {
+	out := make([]otlpSpan, 0, len(spans))
+	for _, s := range spans {
+		s.Lock()
+		o := otlpSpan{
+			TraceID:           hex.EncodeToString(s.traceID[:]),
+			SpanID:            hex.EncodeToString(s.spanID[:]),
+			Name:              s.name,
+			Kind:              1, // SPAN_KIND_INTERNAL
+			StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.stop.UnixNano(), 10),
+			Attributes:        otlpAttrs(s.attrs),
+			Status:            otlpStatus{Code: s.status, Message: s.message},
+		}
+		if s.parentID != [8]byte{} {
+			o.ParentSpanID = hex.EncodeToString(s.parentID[:])
+		}
+		for _, e := range s.events {
+			o.Events = append(o.Events, otlpEvent{
+				TimeUnixNano: strconv.FormatInt(e.time.UnixNano(), 10),
+				Name:         e.name,
+				Attributes:   otlpAttrs(e.attrs),
+			})
+		}
+		s.Unlock()
+		out = append(out, o)
+	}
+
+	return otlpTraces{ResourceSpans: []otlpResourceSpans{{
+		Resource: otlpResource{Attributes: otlpAttrs(t.resource)},
+		ScopeSpans: []otlpScopeSpans{{
+			Scope: otlpScope{Name: "github.com/slackhq/nebula"},
+			Spans: out,
+		}},
+	}}}
+}
+
+// otlpAttrs converts attributes to OTLP AnyValues, 64 bit integers are strings in the json encoding
+func otlpAttrs(attrs []traceAttr) []otlpAttr {
+	if len(attrs) == 0 {
+		return nil
+	}
+
+	out := make([]otlpAttr, len(attrs))
+	for i, a := range attrs {
+		var v map[string]interface{}
+		switch x := a.value.(type) {
+		case string:
+			v = map[string]interface{}{"stringValue": x}
+		case bool:
+			v = map[string]interface{}{"boolValue": x}
+		case int:
+			v = map[string]interface{}{"intValue": strconv.FormatInt(int64(x), 10)}
+		case int64:
+			v = map[string]interface{}{"intValue": strconv.FormatInt(x, 10)}
+		case uint32:
+			v = map[string]interface{}{"intValue": strconv.FormatUint(uint64(x), 10)}
+		case uint64:
+			v = map[string]interface{}{"intValue": strconv.FormatUint(x, 10)}
+		case float64:
+			v = map[string]interface{}{"doubleValue": x}
+		default:
+			v = map[string]interface{}{"stringValue": fmt.Sprint(x)}
+		}
+		out[i] = otlpAttr{Key: a.key, Value: v}
+	}
+	return out
+}
@@ -0,0 +1,169 @@
+package nebula
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/slackhq/nebula/cert"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/iputil"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewTracerFromConfig(t *testing.T) {
+	l := test.NewLogger()
+	cs := &CertState{Certificate: &cert.NebulaCertificate{}}
+
+	tr, err := newTracerFromConfig(l, config.NewC(l), "1.2.3", cs)
+	require.NoError(t, err)
+	assert.Nil(t, tr)
+
+	load := func(tracing map[interface{}]interface{}) (*tracer, error) {
+		c := config.NewC(l)
+		c.Settings["tracing"] = tracing
+		return newTracerFromConfig(l, c, "1.2.3", cs)
+	}
+
+	tr, err = load(map[interface{}]interface{}{"endpoint": "http://collector:4318"})
+	require.NoError(t, err)
+	assert.Equal(t, "http://collector:4318/v1/traces", tr.endpoint)
+	assert.Equal(t, 1.0, tr.handshakeRate)
+	assert.Equal(t, 0.0, tr.packetRate)
+
+	tr, err = load(map[interface{}]interface{}{"endpoint": "https://collector/custom/traces"})
+	require.NoError(t, err)
+	assert.Equal(t, "https://collector/custom/traces", tr.endpoint)
+
+	_, err = load(map[interface{}]interface{}{"endpoint": "collector:4318"})
+	assert.EqualError(t, err, `tracing.endpoint must be an http or https url, got "collector:4318"`)
+
+	_, err = load(map[interface{}]interface{}{
+		"endpoint": "http://collector:4318",
+		"packets":  map[interface{}]interface{}{"sample_rate": 2},
+	})
+	assert.EqualError(t, err, "tracing.packets.sample_rate must be between 0 and 1")
+
+	// Nothing is traced when sampling is off
+	tr, err = load(map[interface{}]interface{}{
+		"endpoint":   "http://collector:4318",
+		"handshakes": map[interface{}]interface{}{"sample_rate": 0},
+	})
+	require.NoError(t, err)
+	assert.Nil(t, tr.startHandshake(iputil.VpnIp{}, true))
+	assert.Nil(t, tr.samplePacket("packet.inbound", &HostInfo{}, 100))
+}
+
+func TestTracer_NilSafe(t *testing.T) {
+	var tr *tracer
+	s := tr.startHandshake(iputil.Ip2VpnIp(net.IPv4(10, 0, 0, 1)), true)
+	assert.Nil(t, s)
+
+	c := s.child("cert.verify")
+	c.set("k", "v")
+	c.event("e", traceAttr{"attempt", 1})
+	c.fail("nope")
+	c.ok()
+	c.end()
+	s.end()
+}
+
+func TestTracer_Export(t *testing.T) {
+	l := test.NewLogger()
+	received := make(chan *http.Request, 1)
+	bodies := make(chan otlpTraces, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var b otlpTraces
+		if err := json.NewDecoder(r.Body).Decode(&b); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		received <- r
+		bodies <- b
+	}))
+	defer srv.Close()
+
+	c := config.NewC(l)
+	c.Settings["tracing"] = map[interface{}]interface{}{
+		"endpoint":       srv.URL,
+		"service_name":   "edge",
+		"flush_interval": "10ms",
+		"headers":        map[interface{}]interface{}{"authorization": "Bearer token"},
+	}
+	_, ipNet, _ := net.ParseCIDR("10.0.0.2/24")
+	ipNet.IP = net.IPv4(10, 0, 0, 2)
+	cs := &CertState{Certificate: &cert.NebulaCertificate{
+		Details: cert.NebulaCertificateDetails{Name: "me", Ips: []*net.IPNet{ipNet}},
+	}}
+	tr, err := newTracerFromConfig(l, c, "1.2.3", cs)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	tr.Start(ctx)
+
+	root := tr.startHandshake(iputil.Ip2VpnIp(net.IPv4(10, 0, 0, 1)), true)
+	root.event("handshake.sent", traceAttr{"attempt", 1}, traceAttr{"underlay", false})
+	verify := root.child("cert.verify")
+	verify.fail("certificate is expired")
+	verify.end()
+	root.fail("timed out")
+	root.end()
+	root.end()
+
+	var r *http.Request
+	var body otlpTraces
+	select {
+	case r = <-received:
+		body = <-bodies
+	case <-time.After(5 * time.Second):
+		t.Fatal("no traces were exported")
+	}
+
+	assert.Equal(t, "/v1/traces", r.URL.Path)
+	assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+	assert.Equal(t, "Bearer token", r.Header.Get("Authorization"))
+
+	require.Len(t, body.ResourceSpans, 1)
+	rs := body.ResourceSpans[0]
+	assert.Equal(t, []otlpAttr{
+		{Key: "service.name", Value: map[string]interface{}{"stringValue": "edge"}},
+		{Key: "service.version", Value: map[string]interface{}{"stringValue": "1.2.3"}},
+		{Key: "host.name", Value: map[string]interface{}{"stringValue": "me"}},
+		{Key: "nebula.vpn_ip", Value: map[string]interface{}{"stringValue": "10.0.0.2"}},
+	}, rs.Resource.Attributes)
+
+	// The root span was ended once, after its child
+	require.Len(t, rs.ScopeSpans, 1)
+	spans := rs.ScopeSpans[0].Spans
+	require.Len(t, spans, 2)
+	child, parent := spans[0], spans[1]
+
+	assert.Equal(t, "handshake", parent.Name)
+	assert.Len(t, parent.TraceID, 32)
+	assert.Len(t, parent.SpanID, 16)
+	assert.Empty(t, parent.ParentSpanID)
+	assert.Equal(t, otlpStatus{Code: tracingStatusError, Message: "timed out"}, parent.Status)
+	assert.Equal(t, []otlpAttr{
+		{Key: "nebula.initiator", Value: map[string]interface{}{"boolValue": true}},
+		{Key: "nebula.peer.vpn_ip", Value: map[string]interface{}{"stringValue": "10.0.0.1"}},
+	}, parent.Attributes)
+	require.Len(t, parent.Events, 1)
+	assert.Equal(t, "handshake.sent", parent.Events[0].Name)
+	assert.Equal(t, []otlpAttr{
+		{Key: "attempt", Value: map[string]interface{}{"intValue": "1"}},
+		{Key: "underlay", Value: map[string]interface{}{"boolValue": false}},
+	}, parent.Events[0].Attributes)
+
+	assert.Equal(t, "cert.verify", child.Name)
+	assert.Equal(t, parent.TraceID, child.TraceID)
+	assert.Equal(t, parent.SpanID, child.ParentSpanID)
+	assert.Equal(t, otlpStatus{Code: tracingStatusError, Message: "certificate is expired"}, child.Status)
+	assert.LessOrEqual(t, parent.StartTimeUnixNano, child.StartTimeUnixNano)
+}
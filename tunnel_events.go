@@ -0,0 +1,177 @@
+package nebula
+
+import (
+	"context"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	"github.com/slackhq/nebula/cert"
+	"github.com/slackhq/nebula/iputil"
+	"github.com/slackhq/nebula/udp"
+)
+
+// tunnelEventQueueLen is how many events can wait for slow handlers before new ones are dropped
+const tunnelEventQueueLen = 1024
+
+// TunnelEventType is what happened in a TunnelEvent
+type TunnelEventType int
+
+const (
+	// TunnelEventHandshakeStarted is sent when we start a handshake with a host, there is one per handshake in flight
+	TunnelEventHandshakeStarted TunnelEventType = iota
+	// TunnelEventHandshakeCompleted is sent when a tunnel is up, on the initiator and the responder
+	TunnelEventHandshakeCompleted
+	// TunnelEventHandshakeFailed is sent when a handshake we started timed out or its response was refused
+	TunnelEventHandshakeFailed
+	// TunnelEventTunnelClosed is sent when an established tunnel is removed, including old tunnels replaced by a
+	// newer handshake
+	TunnelEventTunnelClosed
+	// TunnelEventCertRejected is sent when a remote certificate is refused during a handshake or an established
+	// tunnel's certificate is no longer acceptable
+	TunnelEventCertRejected
+)
+
+var tunnelEventTypeNames = map[TunnelEventType]string{
+	TunnelEventHandshakeStarted:   "handshake_started",
+	TunnelEventHandshakeCompleted: "handshake_completed",
+	TunnelEventHandshakeFailed:    "handshake_failed",
+	TunnelEventTunnelClosed:       "tunnel_closed",
+	TunnelEventCertRejected:       "cert_rejected",
+}
+
+func (t TunnelEventType) String() string {
+	if n, ok := tunnelEventTypeNames[t]; ok {
+		return n
+	}
+	return "unknown"
+}
+
+// TunnelEvent describes something that happened to a tunnel, fields that do not apply are left zero. Everything in an
+// event is a copy and safe to keep.
+type TunnelEvent struct {
+	Type TunnelEventType
+	Time time.Time
+
+	// VpnIp is the remote host, it is nil when a certificate was rejected before we could tell who sent it
+	VpnIp       net.IP
+	LocalIndex  uint32
+	RemoteIndex uint32
+	// Remote is the underlay address of the host, nil for relayed handshakes or when it is not known yet
+	Remote    *udp.Addr
+	Initiator bool
+	// Cert is the remote certificate when we have one
+	Cert *cert.NebulaCertificate
+	// Reason is why a handshake failed, a tunnel closed, or a certificate was rejected
+	Reason string
+}
+
+// tunnelEvents delivers TunnelEvents to the handlers registered with Control.OnTunnelEvent. Events are queued and
+// handled in order on a single goroutine so a slow handler never holds up a handshake or packet, events are dropped
+// and counted when the queue is full. Nothing is queued until the first handler is registered.
+type tunnelEvents struct {
+	sync.Mutex
+	handlers []func(TunnelEvent)
+	queue    chan TunnelEvent
+	active   atomic.Bool
+
+	metricDropped metrics.Counter
+}
+
+func newTunnelEvents() *tunnelEvents {
+	return &tunnelEvents{
+		queue:         make(chan TunnelEvent, tunnelEventQueueLen),
+		metricDropped: metrics.GetOrRegisterCounter("tunnel_events.dropped", nil),
+	}
+}
+
+// register adds a handler, the first one starts delivery which stops when ctx is done
+func (te *tunnelEvents) register(ctx context.Context, fn func(TunnelEvent)) {
+	te.Lock()
+	defer te.Unlock()
+
+	// Copy on write so run can use the slice without holding the lock
+	handlers := make([]func(TunnelEvent), len(te.handlers), len(te.handlers)+1)
+	copy(handlers, te.handlers)
+	te.handlers = append(handlers, fn)
+
+	if !te.active.Load() {
+		te.active.Store(true)
+		go te.run(ctx)
+	}
+}
+
+func (te *tunnelEvents) run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case e := <-te.queue:
+			te.Lock()
+			handlers := te.handlers
+			te.Unlock()
+
+			for _, fn := range handlers {
+				fn(e)
+			}
+		}
+	}
+}
+
+func (te *tunnelEvents) emit(e TunnelEvent) {
+	if te == nil || !te.active.Load() {
+		return
+	}
+
+	e.Time = time.Now()
+	select {
+	case te.queue <- e:
+	default:
+		te.metricDropped.Inc(1)
+	}
+}
+
+// hostEvent describes an event for a tunnel or handshake
+func hostEvent(t TunnelEventType, h *HostInfo, reason string) TunnelEvent {
+	e := TunnelEvent{
+		Type:        t,
+		VpnIp:       h.vpnIp.ToIP(),
+		LocalIndex:  h.localIndexId,
+		RemoteIndex: h.remoteIndexId,
+		Reason:      reason,
+	}
+
+	if h.remote != nil {
+		e.Remote = h.remote.Copy()
+	}
+
+	if h.ConnectionState != nil {
+		e.Initiator = h.ConnectionState.initiator
+	}
+
+	if c := h.GetCert(); c != nil {
+		e.Cert = c.Copy()
+	}
+
+	return e
+}
+
+// certRejectedEvent describes a remote certificate we refused during a handshake, c may be nil if it could not be
+// parsed and addr is nil for relayed handshakes
+func certRejectedEvent(addr *udp.Addr, c *cert.NebulaCertificate, reason string) TunnelEvent {
+	e := TunnelEvent{Type: TunnelEventCertRejected, Reason: reason}
+	if addr != nil {
+		e.Remote = addr.Copy()
+	}
+
+	if c != nil {
+		e.Cert = c.Copy()
+		if len(c.Details.Ips) > 0 {
+			e.VpnIp = iputil.Ip2VpnIp(c.Details.Ips[0].IP).ToIP()
+		}
+	}
+
+	return e
+}
@@ -0,0 +1,61 @@
+package nebula
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTunnelEvents(t *testing.T) {
+	// Nothing to deliver to without an Interface or a handler
+	var te *tunnelEvents
+	te.emit(TunnelEvent{})
+
+	te = newTunnelEvents()
+	te.metricDropped.Clear()
+	te.emit(TunnelEvent{Type: TunnelEventHandshakeStarted})
+	assert.Len(t, te.queue, 0)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	got := make(chan TunnelEvent, 10)
+	te.register(ctx, func(e TunnelEvent) { got <- e })
+	te.register(ctx, func(e TunnelEvent) { got <- e })
+
+	te.emit(TunnelEvent{Type: TunnelEventHandshakeStarted})
+	te.emit(TunnelEvent{Type: TunnelEventHandshakeCompleted})
+
+	// Every handler sees every event, in order
+	for _, expected := range []TunnelEventType{
+		TunnelEventHandshakeStarted, TunnelEventHandshakeStarted,
+		TunnelEventHandshakeCompleted, TunnelEventHandshakeCompleted,
+	} {
+		select {
+		case e := <-got:
+			assert.Equal(t, expected, e.Type)
+			assert.False(t, e.Time.IsZero())
+		case <-time.After(time.Second):
+			t.Fatal("Timed out waiting for an event")
+		}
+	}
+
+	// A handler that falls behind causes drops instead of blocking
+	block := make(chan struct{})
+	te.register(ctx, func(e TunnelEvent) { <-block })
+	for i := 0; i < tunnelEventQueueLen+10; i++ {
+		te.emit(TunnelEvent{Type: TunnelEventTunnelClosed})
+	}
+	close(block)
+	assert.NotZero(t, te.metricDropped.Count())
+}
+
+func TestTunnelEventType_String(t *testing.T) {
+	assert.Equal(t, "handshake_started", TunnelEventHandshakeStarted.String())
+	assert.Equal(t, "cert_rejected", TunnelEventCertRejected.String())
+	assert.Equal(t, "unknown", TunnelEventType(99).String())
+	require.Len(t, tunnelEventTypeNames, 5)
+}
@@ -29,6 +29,14 @@ type Conn interface {
 	Close() error
 }
 
+// BatchConn is a Conn that can send many packets in one syscall, see SendBatch
+type BatchConn interface {
+	Conn
+	// WriteBatch sends every packet in bufs to the address at the same index in addrs, with tos set each packet is
+	// sent with the traffic class at its index instead of the one of the socket
+	WriteBatch(bufs [][]byte, addrs []*Addr, tos []byte) error
+}
+
 type NoopConn struct{}
 
 func (NoopConn) Rebind() error {
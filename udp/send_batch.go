@@ -0,0 +1,111 @@
+package udp
+
+import "net"
+
+// SendBatch is a Conn that queues what is written to it and sends it all with one WriteBatch when it is flushed or
+// full. It is not safe for concurrent use, each goroutine batching sends through a BatchConn needs its own.
+type SendBatch struct {
+	BatchConn
+
+	bufs  [][]byte
+	addrs []*Addr
+	tos   []byte
+	// marked is whether the queued packets were written with WriteToTOS, a batch is either all marked or not at all
+	marked bool
+	// slots and slotAddrs own the memory of the queued packets, writers reuse theirs
+	slots     [][]byte
+	slotAddrs []Addr
+
+	// Prepare is called before the queued packets are sent, it is for finishing packets that were queued before they
+	// were complete
+	Prepare func()
+}
+
+func NewSendBatch(c BatchConn, size int) *SendBatch {
+	b := &SendBatch{
+		BatchConn: c,
+		bufs:      make([][]byte, 0, size),
+		addrs:     make([]*Addr, 0, size),
+		tos:       make([]byte, 0, size),
+		slots:     make([][]byte, size),
+		slotAddrs: make([]Addr, size),
+	}
+
+	for i := range b.slots {
+		b.slots[i] = make([]byte, MTU)
+		b.slotAddrs[i].IP = make(net.IP, net.IPv6len)
+	}
+	return b
+}
+
+// WriteTo queues a copy of the packet, the batch is sent when it is full
+func (b *SendBatch) WriteTo(p []byte, addr *Addr) error {
+	return b.write(p, addr, 0, false)
+}
+
+// WriteToTOS queues a copy of the packet to be sent with the traffic class tos, the batch is sent when it is full
+func (b *SendBatch) WriteToTOS(p []byte, addr *Addr, tos byte) error {
+	return b.write(p, addr, tos, true)
+}
+
+func (b *SendBatch) write(p []byte, addr *Addr, tos byte, marked bool) error {
+	if marked != b.marked {
+		err := b.Flush()
+		b.marked = marked
+		if err != nil {
+			return err
+		}
+	}
+
+	i := len(b.bufs)
+	a := &b.slotAddrs[i]
+	a.IP = a.IP[:net.IPv6len]
+	copy(a.IP, addr.IP.To16())
+	a.Port = addr.Port
+
+	// A packet built in Next is already where it needs to be
+	if len(p) == 0 || &p[0] != &b.slots[i][0] {
+		p = b.slots[i][:copy(b.slots[i], p)]
+	}
+	b.bufs = append(b.bufs, p)
+	b.addrs = append(b.addrs, a)
+	b.tos = append(b.tos, tos)
+
+	if len(b.bufs) == cap(b.bufs) {
+		return b.Flush()
+	}
+	return nil
+}
+
+// Next returns the buffer the next packet is queued in, a packet built at its start is queued without a copy. It is
+// only valid until the next write.
+func (b *SendBatch) Next() []byte {
+	return b.slots[len(b.bufs)]
+}
+
+// Len returns how many packets are queued
+func (b *SendBatch) Len() int {
+	return len(b.bufs)
+}
+
+// Flush sends every queued packet
+func (b *SendBatch) Flush() error {
+	if len(b.bufs) == 0 {
+		return nil
+	}
+
+	if b.Prepare != nil {
+		b.Prepare()
+	}
+
+	var tos []byte
+	if b.marked {
+		tos = b.tos
+	}
+
+	err := b.WriteBatch(b.bufs, b.addrs, tos)
+	b.bufs = b.bufs[:0]
+	b.addrs = b.addrs[:0]
+	b.tos = b.tos[:0]
+	return err
+}
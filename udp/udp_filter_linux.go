@@ -0,0 +1,39 @@
+//go:build !android && !e2e_testing
+// +build !android,!e2e_testing
+
+package udp
+
+import (
+	"errors"
+
+	"golang.org/x/net/bpf"
+	"golang.org/x/sys/unix"
+)
+
+// SetFilter attaches a classic bpf program that decides which datagrams are queued to the socket, nil detaches it
+func (u *StdConn) SetFilter(prog []bpf.RawInstruction) error {
+	if len(prog) == 0 {
+		err := unix.SetsockoptInt(u.sysFd, unix.SOL_SOCKET, unix.SO_DETACH_FILTER, 0)
+		if errors.Is(err, unix.ENOENT) {
+			// Nothing was attached
+			return nil
+		}
+		return err
+	}
+
+	return unix.SetsockoptSockFprog(u.sysFd, unix.SOL_SOCKET, unix.SO_ATTACH_FILTER, sockFprog(prog))
+}
+
+// SetReusePortSteering attaches a classic bpf program that returns which socket of the SO_REUSEPORT group, in the
+// order they were bound, receives each datagram
+func (u *StdConn) SetReusePortSteering(prog []bpf.RawInstruction) error {
+	return unix.SetsockoptSockFprog(u.sysFd, unix.SOL_SOCKET, unix.SO_ATTACH_REUSEPORT_CBPF, sockFprog(prog))
+}
+
+func sockFprog(prog []bpf.RawInstruction) *unix.SockFprog {
+	filter := make([]unix.SockFilter, len(prog))
+	for i, ins := range prog {
+		filter[i] = unix.SockFilter{Code: ins.Op, Jt: ins.Jt, Jf: ins.Jf, K: ins.K}
+	}
+	return &unix.SockFprog{Len: uint16(len(filter)), Filter: &filter[0]}
+}
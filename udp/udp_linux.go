@@ -7,6 +7,8 @@ import (
 	"encoding/binary"
 	"fmt"
 	"net"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"unsafe"
 
@@ -25,10 +27,32 @@ type StdConn struct {
 	isV4  bool
 	l     *logrus.Logger
 	batch int
+
+	// gro and uring are decided before the read loop starts, its buffers are sized for them. listening is set once it
+	// has started.
+	gro       bool
+	uring     bool
+	listening atomic.Bool
+	// readState is where the read loop is, Close leaves closing the fd to a running loop so it is not reused under it
+	readState atomic.Int32
+	// gso sends runs of equally sized packets to the same address as one message, see WriteBatch
+	gso atomic.Bool
+	// dscp is the listen.dscp the socket marks what it sends with
+	dscp int
+
+	// sendLock guards the send scratch space of WriteBatch
+	sendLock sync.Mutex
+	send     *sendScratch
 }
 
 var x int
 
+const (
+	readIdle int32 = iota
+	readActive
+	readClosed
+)
+
 // From linux/sock_diag.h
 const (
 	_SK_MEMINFO_RMEM_ALLOC = iota
@@ -147,34 +171,101 @@ func (u *StdConn) ListenOut(r EncReader, lhf LightHouseHandlerFunc, cache *firew
 	udpAddr := &Addr{}
 	nb := make([]byte, 12, 12)
 
+	if !u.readState.CompareAndSwap(readIdle, readActive) {
+		return
+	}
+	defer u.finishRead()
+
+	u.listening.Store(true)
+	size, oobSize := MTU, 0
+	if u.gro {
+		size, oobSize = groBufferSize, unix.CmsgSpace(4)
+	}
+
 	//TODO: should we track this?
 	//metric := metrics.GetOrRegisterHistogram("test.batch_read", nil, metrics.NewExpDecaySample(1028, 0.015))
-	msgs, buffers, names := u.PrepareRawMessages(u.batch)
+	msgs, buffers, names, oobs := u.PrepareRawMessages(u.batch, size, oobSize)
 	read := u.ReadMulti
 	if u.batch == 1 {
 		read = u.ReadSingle
 	}
 
+	handle := func(i int) {
+		if u.isV4 {
+			udpAddr.IP = names[i][4:8]
+		} else {
+			udpAddr.IP = names[i][8:24]
+		}
+		udpAddr.Port = binary.BigEndian.Uint16(names[i][2:4])
+
+		b := buffers[i][:msgs[i].Len]
+		segment := 0
+		if u.gro {
+			segment = groSegmentSize(oobs[i][:msgs[i].Hdr.controlLen()])
+			// The kernel shortened the control buffer to what it wrote, the next read needs all of it
+			msgs[i].Hdr.setControl(oobs[i])
+		}
+
+		if segment <= 0 || segment >= len(b) {
+			r(udpAddr, plaintext[:0], b, h, fwPacket, lhf, nb, q, cache.Get(u.l))
+			return
+		}
+
+		// GRO coalesced several datagrams from the same sender, every one but the last is segment bytes long
+		for len(b) > 0 {
+			s := min(segment, len(b))
+			r(udpAddr, plaintext[:0], b[:s], h, fwPacket, lhf, nb, q, cache.Get(u.l))
+			b = b[s:]
+		}
+	}
+
+	if u.uring {
+		err := u.readUring(msgs, handle)
+		if err == nil {
+			return
+		}
+		u.l.WithError(err).Warn("Failed to set up io_uring, falling back to recvmmsg")
+	}
+
 	for {
 		n, err := read(msgs)
-		if err != nil {
+		if err != nil || u.readState.Load() == readClosed {
 			u.l.WithError(err).Debug("udp socket is closed, exiting read loop")
 			return
 		}
 
 		//metric.Update(int64(n))
 		for i := 0; i < n; i++ {
-			if u.isV4 {
-				udpAddr.IP = names[i][4:8]
-			} else {
-				udpAddr.IP = names[i][8:24]
-			}
-			udpAddr.Port = binary.BigEndian.Uint16(names[i][2:4])
-			r(udpAddr, plaintext[:0], buffers[i][:msgs[i].Len], h, fwPacket, lhf, nb, q, cache.Get(u.l))
+			handle(i)
 		}
 	}
 }
 
+// PrepareRawMessages returns n messages to read into, each with a buffer of size bytes, room for a socket address and
+// a control buffer of oobSize bytes
+func (u *StdConn) PrepareRawMessages(n, size, oobSize int) ([]rawMessage, [][]byte, [][]byte, [][]byte) {
+	msgs := make([]rawMessage, n)
+	buffers := make([][]byte, n)
+	names := make([][]byte, n)
+	oobs := make([][]byte, n)
+	iovs := make([]iovec, n)
+
+	for i := range msgs {
+		buffers[i] = make([]byte, size)
+		names[i] = make([]byte, unix.SizeofSockaddrInet6)
+		oobs[i] = make([]byte, oobSize)
+
+		iovs[i].set(buffers[i])
+		msgs[i].Hdr.setIov(iovs[i : i+1])
+		msgs[i].Hdr.setControl(oobs[i])
+
+		msgs[i].Hdr.Name = &names[i][0]
+		msgs[i].Hdr.Namelen = uint32(len(names[i]))
+	}
+
+	return msgs, buffers, names, oobs
+}
+
 func (u *StdConn) ReadSingle(msgs []rawMessage) (int, error) {
 	for {
 		n, _, err := unix.Syscall6(
@@ -285,6 +376,32 @@ func (u *StdConn) writeTo4(b []byte, addr *Addr) error {
 }
 
 func (u *StdConn) ReloadConfig(c *config.C) {
+	if !u.listening.Load() {
+		u.gro = c.GetBool("listen.gro", true) && u.batch > 1 && u.enableGRO()
+		u.uring = c.GetBool("listen.io_uring", false)
+
+		if c.GetBool("pmtud.enabled", false) {
+			if err := u.setDontFragment(); err != nil {
+				u.l.WithError(err).Error("Failed to stop the kernel fragmenting sends for pmtud")
+			}
+		}
+	}
+
+	gso := c.GetBool("listen.gso", true)
+	if u.gso.Swap(gso) != gso && u.listening.Load() {
+		u.l.WithField("gso", gso).Info("listen.gso has changed")
+	}
+
+	dscp := c.GetInt("listen.dscp", 0)
+	if dscp != u.dscp {
+		if err := u.setDSCP(dscp); err != nil {
+			u.l.WithError(err).Error("Failed to set listen.dscp")
+		} else {
+			u.dscp = dscp
+			u.l.WithField("dscp", dscp).Info("listen.dscp was set")
+		}
+	}
+
 	b := c.GetInt("listen.read_buffer", 0)
 	if b > 0 {
 		err := u.SetRecvBuffer(b)
@@ -316,6 +433,34 @@ func (u *StdConn) ReloadConfig(c *config.C) {
 	}
 }
 
+// setDSCP marks everything the socket sends with dscp, an ipv6 socket marks what it sends to ipv4 addresses too
+func (u *StdConn) setDSCP(dscp int) error {
+	if dscp < 0 || dscp > 63 {
+		return fmt.Errorf("dscp must be between 0 and 63: %v", dscp)
+	}
+
+	if err := unix.SetsockoptInt(u.sysFd, unix.IPPROTO_IP, unix.IP_TOS, dscp<<2); err != nil {
+		return err
+	}
+	if !u.isV4 {
+		return unix.SetsockoptInt(u.sysFd, unix.IPPROTO_IPV6, unix.IPV6_TCLASS, dscp<<2)
+	}
+	return nil
+}
+
+// setDontFragment sends everything with the don't fragment bit set and without the kernel fragmenting it to the path
+// mtu it has learned, so pmtud probes larger than the path are lost instead of getting through in fragments. Like
+// setDSCP an ipv6 socket is set for what it sends to ipv4 addresses too.
+func (u *StdConn) setDontFragment() error {
+	if err := unix.SetsockoptInt(u.sysFd, unix.IPPROTO_IP, unix.IP_MTU_DISCOVER, unix.IP_PMTUDISC_PROBE); err != nil {
+		return err
+	}
+	if !u.isV4 {
+		return unix.SetsockoptInt(u.sysFd, unix.IPPROTO_IPV6, unix.IPV6_MTU_DISCOVER, unix.IPV6_PMTUDISC_PROBE)
+	}
+	return nil
+}
+
 func (u *StdConn) getMemInfo(meminfo *_SK_MEMINFO) error {
 	var vallen uint32 = 4 * _SK_MEMINFO_VARS
 	_, _, err := unix.Syscall6(unix.SYS_GETSOCKOPT, uintptr(u.sysFd), uintptr(unix.SOL_SOCKET), uintptr(unix.SO_MEMINFO), uintptr(unsafe.Pointer(meminfo)), uintptr(unsafe.Pointer(&vallen)), 0)
@@ -325,9 +470,26 @@ func (u *StdConn) getMemInfo(meminfo *_SK_MEMINFO) error {
 	return nil
 }
 
+// Close closes the socket. A read loop blocked on it is woken by shutting the socket down, the loop closes the fd once
+// it has stopped reading.
 func (u *StdConn) Close() error {
-	//TODO: this will not interrupt the read loop
-	return syscall.Close(u.sysFd)
+	switch u.readState.Swap(readClosed) {
+	case readClosed:
+		return nil
+	case readActive:
+		// A udp socket is never connected, shutdown reports ENOTCONN but still wakes the readers
+		_ = unix.Shutdown(u.sysFd, unix.SHUT_RDWR)
+		return nil
+	default:
+		return syscall.Close(u.sysFd)
+	}
+}
+
+// finishRead is deferred by the read loop, it closes the fd if Close was called while the loop was running
+func (u *StdConn) finishRead() {
+	if !u.readState.CompareAndSwap(readActive, readIdle) {
+		syscall.Close(u.sysFd)
+	}
 }
 
 func NewUDPStatsEmitter(udpConns []Conn) func() {
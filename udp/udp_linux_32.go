@@ -6,10 +6,6 @@
 
 package udp
 
-import (
-	"golang.org/x/sys/unix"
-)
-
 type iovec struct {
 	Base *byte
 	Len  uint32
@@ -30,26 +26,26 @@ type rawMessage struct {
 	Len uint32
 }
 
-func (u *StdConn) PrepareRawMessages(n int) ([]rawMessage, [][]byte, [][]byte) {
-	msgs := make([]rawMessage, n)
-	buffers := make([][]byte, n)
-	names := make([][]byte, n)
-
-	for i := range msgs {
-		buffers[i] = make([]byte, MTU)
-		names[i] = make([]byte, unix.SizeofSockaddrInet6)
-
-		//TODO: this is still silly, no need for an array
-		vs := []iovec{
-			{Base: &buffers[i][0], Len: uint32(len(buffers[i]))},
-		}
+func (v *iovec) set(b []byte) {
+	v.Base = &b[0]
+	v.Len = uint32(len(b))
+}
 
-		msgs[i].Hdr.Iov = &vs[0]
-		msgs[i].Hdr.Iovlen = uint32(len(vs))
+func (h *msghdr) setIov(iovs []iovec) {
+	h.Iov = &iovs[0]
+	h.Iovlen = uint32(len(iovs))
+}
 
-		msgs[i].Hdr.Name = &names[i][0]
-		msgs[i].Hdr.Namelen = uint32(len(names[i]))
+func (h *msghdr) setControl(b []byte) {
+	if len(b) == 0 {
+		h.Control = nil
+		h.Controllen = 0
+		return
 	}
+	h.Control = &b[0]
+	h.Controllen = uint32(len(b))
+}
 
-	return msgs, buffers, names
+func (h *msghdr) controlLen() int {
+	return int(h.Controllen)
 }
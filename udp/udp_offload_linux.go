@@ -0,0 +1,233 @@
+//go:build !android && !e2e_testing
+// +build !android,!e2e_testing
+
+package udp
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// A syscall per packet caps a single tunnel well below what a 10GbE link carries. Reads already take up to
+// listen.batch packets per recvmmsg, with listen.gro the kernel also coalesces datagrams from the same sender into one
+// buffer that we split again. WriteBatch sends a batch of packets with sendmmsg, with listen.gso runs of equally sized
+// packets to the same address go out as one message the kernel or the nic segments.
+//
+// Kernels before 4.18 (GSO) and 5.0 (GRO) do not support the offloads, they are then left off.
+
+const (
+	// groBufferSize fits the largest datagram GRO coalesces
+	groBufferSize = 65535
+	// gsoMaxSegments is the most segments the kernel accepts in one message
+	gsoMaxSegments = 64
+	// gsoMaxSize is the most payload one message can carry
+	gsoMaxSize = 65000
+)
+
+// sendOOBSize fits the control messages of one sent message, the gso segment size and the traffic class
+var sendOOBSize = unix.CmsgSpace(2) + unix.CmsgSpace(4)
+
+// enableGRO asks the kernel to coalesce received datagrams, it returns false if the kernel can not
+func (u *StdConn) enableGRO() bool {
+	if err := unix.SetsockoptInt(u.sysFd, unix.SOL_UDP, unix.UDP_GRO, 1); err != nil {
+		u.l.WithError(err).Info("UDP GRO is not supported, reading datagrams one at a time")
+		return false
+	}
+	return true
+}
+
+// groSegmentSize returns the size of the datagrams GRO coalesced into a read, 0 if it did not
+func groSegmentSize(oob []byte) int {
+	for len(oob) >= unix.SizeofCmsghdr {
+		h := (*unix.Cmsghdr)(unsafe.Pointer(&oob[0]))
+		l := int(h.Len)
+		if l < unix.SizeofCmsghdr || l > len(oob) {
+			return 0
+		}
+
+		if h.Level == unix.SOL_UDP && h.Type == unix.UDP_GRO {
+			data := oob[unix.CmsgLen(0):l]
+			switch {
+			case len(data) >= 4:
+				return int(binary.NativeEndian.Uint32(data))
+			case len(data) >= 2:
+				return int(binary.NativeEndian.Uint16(data))
+			}
+			return 0
+		}
+
+		oob = oob[min(unix.CmsgSpace(l-unix.CmsgLen(0)), len(oob)):]
+	}
+	return 0
+}
+
+// sendScratch is what WriteBatch builds its messages in, it grows to the largest batch sent
+type sendScratch struct {
+	msgs  []rawMessage
+	iovs  []iovec
+	names []unix.RawSockaddrInet6
+	oobs  []byte
+	// first is the index of the first packet of each message
+	first []int
+}
+
+func (s *sendScratch) grow(n int) {
+	if len(s.msgs) >= n {
+		return
+	}
+
+	s.msgs = make([]rawMessage, n)
+	s.iovs = make([]iovec, n)
+	s.names = make([]unix.RawSockaddrInet6, n)
+	s.oobs = make([]byte, n*sendOOBSize)
+	s.first = make([]int, n+1)
+}
+
+// WriteBatch sends every packet in bufs to the address at the same index in addrs, with tos set each packet is sent
+// with the traffic class at its index instead of the one of the socket
+func (u *StdConn) WriteBatch(bufs [][]byte, addrs []*Addr, tos []byte) error {
+	u.sendLock.Lock()
+	if u.send == nil {
+		u.send = &sendScratch{}
+	}
+	s := u.send
+	s.grow(len(bufs))
+
+	var badAddr error
+	gso := u.gso.Load()
+	msgs, iovs := 0, 0
+	for i := 0; i < len(bufs); {
+		if err := u.putSockaddr(&s.names[msgs], addrs[i]); err != nil {
+			badAddr = err
+			i++
+			continue
+		}
+
+		// Gather the packets that can share a message, every one but the last must be as large as the first
+		j := i + 1
+		if gso {
+			size := len(bufs[i])
+			for j < len(bufs) && j-i < gsoMaxSegments && (j-i+1)*size <= gsoMaxSize &&
+				len(bufs[j]) <= size && len(bufs[j-1]) == size && addrs[j].Equals(addrs[i]) && (tos == nil || tos[j] == tos[i]) {
+				j++
+			}
+		}
+
+		m := &s.msgs[msgs]
+		m.Hdr = msghdr{}
+		for k := i; k < j; k++ {
+			s.iovs[iovs+k-i].set(bufs[k])
+		}
+		m.Hdr.setIov(s.iovs[iovs : iovs+j-i])
+		m.Hdr.Name = (*byte)(unsafe.Pointer(&s.names[msgs]))
+		m.Hdr.Namelen = uint32(unix.SizeofSockaddrInet6)
+		if u.isV4 {
+			m.Hdr.Namelen = uint32(unix.SizeofSockaddrInet4)
+		}
+
+		oob := s.oobs[msgs*sendOOBSize : (msgs+1)*sendOOBSize]
+		oobLen := 0
+		if j-i > 1 {
+			h := (*unix.Cmsghdr)(unsafe.Pointer(&oob[0]))
+			h.Level = unix.SOL_UDP
+			h.Type = unix.UDP_SEGMENT
+			h.SetLen(unix.CmsgLen(2))
+			binary.NativeEndian.PutUint16(oob[unix.CmsgLen(0):], uint16(len(bufs[i])))
+			oobLen = unix.CmsgSpace(2)
+		}
+		if tos != nil {
+			oobLen += u.putTOS(oob[oobLen:], addrs[i], tos[i])
+		}
+		if oobLen > 0 {
+			m.Hdr.setControl(oob[:oobLen])
+		}
+
+		s.first[msgs] = i
+		msgs++
+		iovs += j - i
+		i = j
+	}
+	s.first[msgs] = len(bufs)
+
+	sent := 0
+	var err error
+	for sent < msgs {
+		n, _, errno := unix.Syscall6(
+			unix.SYS_SENDMMSG,
+			uintptr(u.sysFd),
+			uintptr(unsafe.Pointer(&s.msgs[sent])),
+			uintptr(msgs-sent),
+			0,
+			0,
+			0,
+		)
+
+		if errno != 0 {
+			err = &net.OpError{Op: "sendmmsg", Err: errno}
+			break
+		}
+		sent += int(n)
+	}
+
+	if err != nil && gso && (errors.Is(err, unix.EIO) || errors.Is(err, unix.EINVAL)) {
+		// The kernel is too old for GSO or the nic can not checksum segmented packets, send the rest one by one from
+		// now on
+		u.gso.Store(false)
+		u.l.WithError(err).Warn("UDP GSO failed, sending packets one at a time")
+		rest := s.first[sent]
+		u.sendLock.Unlock()
+		if tos != nil {
+			tos = tos[rest:]
+		}
+		return u.WriteBatch(bufs[rest:], addrs[rest:], tos)
+	}
+	u.sendLock.Unlock()
+
+	if err != nil {
+		return err
+	}
+	return badAddr
+}
+
+// putTOS writes the control message that sends a packet to addr with the traffic class tos, ipv4 destinations take
+// IP_TOS even from an ipv6 socket. It returns the space used.
+func (u *StdConn) putTOS(oob []byte, addr *Addr, tos byte) int {
+	h := (*unix.Cmsghdr)(unsafe.Pointer(&oob[0]))
+	if _, isAddrV4 := maybeIPV4(addr.IP); u.isV4 || isAddrV4 {
+		h.Level = unix.IPPROTO_IP
+		h.Type = unix.IP_TOS
+	} else {
+		h.Level = unix.IPPROTO_IPV6
+		h.Type = unix.IPV6_TCLASS
+	}
+	h.SetLen(unix.CmsgLen(4))
+	binary.NativeEndian.PutUint32(oob[unix.CmsgLen(0):], uint32(tos))
+	return unix.CmsgSpace(4)
+}
+
+// putSockaddr writes addr as the raw socket address our socket family expects
+func (u *StdConn) putSockaddr(rsa *unix.RawSockaddrInet6, addr *Addr) error {
+	// Little Endian -> Network Endian
+	port := (addr.Port >> 8) | ((addr.Port & 0xff) << 8)
+
+	if !u.isV4 {
+		*rsa = unix.RawSockaddrInet6{Family: unix.AF_INET6, Port: port}
+		copy(rsa.Addr[:], addr.IP.To16())
+		return nil
+	}
+
+	addrV4, isAddrV4 := maybeIPV4(addr.IP)
+	if !isAddrV4 {
+		return fmt.Errorf("Listener is IPv4, but writing to IPv6 remote")
+	}
+
+	rsa4 := (*unix.RawSockaddrInet4)(unsafe.Pointer(rsa))
+	*rsa4 = unix.RawSockaddrInet4{Family: unix.AF_INET, Port: port}
+	copy(rsa4.Addr[:], addrV4)
+	return nil
+}
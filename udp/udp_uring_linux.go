@@ -0,0 +1,60 @@
+//go:build !android && !e2e_testing
+// +build !android,!e2e_testing
+
+package udp
+
+import (
+	"unsafe"
+
+	"github.com/slackhq/nebula/iouring"
+	"golang.org/x/sys/unix"
+)
+
+// readUring keeps a recvmsg outstanding for every message and calls handle with the index of each one that completes,
+// so a busy socket is drained with one syscall per round of completions instead of one per recvmmsg. It only returns
+// an error if the ring could not be set up, the caller is expected to fall back to recvmmsg.
+func (u *StdConn) readUring(msgs []rawMessage, handle func(i int)) error {
+	ring, err := iouring.New(uint32(len(msgs)))
+	if err != nil {
+		return err
+	}
+	defer ring.Close()
+
+	for i := range msgs {
+		ring.PrepRecvMsg(u.sysFd, unsafe.Pointer(&msgs[i].Hdr), 0, uint64(i))
+	}
+
+	u.l.WithField("depth", len(msgs)).Info("Reading the udp socket with io_uring")
+	for {
+		if err := ring.Submit(1); err != nil {
+			u.l.WithError(err).Debug("udp socket is closed, exiting read loop")
+			return nil
+		}
+
+		for {
+			userData, res, ok := ring.Completion()
+			if !ok {
+				break
+			}
+
+			i := int(userData)
+			if u.readState.Load() == readClosed {
+				u.l.Debug("udp socket is closed, exiting read loop")
+				return nil
+			}
+
+			switch {
+			case res >= 0:
+				msgs[i].Len = uint32(res)
+				handle(i)
+			case unix.Errno(-res) == unix.EBADF:
+				u.l.Debug("udp socket is closed, exiting read loop")
+				return nil
+			default:
+				u.l.WithError(unix.Errno(-res)).Debug("udp socket read failed")
+			}
+
+			ring.PrepRecvMsg(u.sysFd, unsafe.Pointer(&msgs[i].Hdr), 0, uint64(i))
+		}
+	}
+}
@@ -0,0 +1,245 @@
+package nebula
+
+import (
+	"net/netip"
+	"sync"
+	"sync/atomic"
+
+	"github.com/slackhq/nebula/firewall"
+	"github.com/slackhq/nebula/header"
+	"github.com/slackhq/nebula/iputil"
+	"github.com/slackhq/nebula/udp"
+)
+
+// Besides the udp sockets a peer can be reached over a link of another underlay transport, a tcp stream or a quic
+// connection. A link stands in for the address it was dialed to or accepted from, everything we send to that address
+// goes over the link and everything read from it is handled as if it came from a udp socket, so tunnels, roaming and
+// relays work the same over all of them.
+
+// underlayLink is a connection to one peer
+type underlayLink interface {
+	// send queues a copy of the packet, it is dropped if the link can not keep up like it would be by a full socket
+	send(b []byte) bool
+	close()
+}
+
+// underlayTransport reaches peers over links
+type underlayTransport interface {
+	// handshake is called for every attempt at a handshake with vpnIp, it returns true if the attempt should not be
+	// sent over udp
+	handshake(vpnIp iputil.VpnIp, attempt int, packet []byte, remotes []*udp.Addr) bool
+}
+
+// underlayLinks maps the address a link stands in for to the link. It is replaced on every change so the send path
+// looks it up without a lock.
+type underlayLinks struct {
+	lock  sync.Mutex
+	links atomic.Pointer[map[netip.AddrPort]underlayLink]
+}
+
+func newUnderlayLinks() *underlayLinks {
+	u := &underlayLinks{}
+	links := map[netip.AddrPort]underlayLink{}
+	u.links.Store(&links)
+	return u
+}
+
+// add makes link the way to reach ap, closing the link that was
+func (u *underlayLinks) add(ap netip.AddrPort, link underlayLink) {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+
+	old := *u.links.Load()
+	links := make(map[netip.AddrPort]underlayLink, len(old)+1)
+	for k, v := range old {
+		links[k] = v
+	}
+	if prev := links[ap]; prev != nil {
+		prev.close()
+	}
+	links[ap] = link
+	u.links.Store(&links)
+}
+
+// remove forgets link if it is still the way to reach ap
+func (u *underlayLinks) remove(ap netip.AddrPort, link underlayLink) {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+
+	old := *u.links.Load()
+	if old[ap] != link {
+		return
+	}
+
+	links := make(map[netip.AddrPort]underlayLink, len(old))
+	for k, v := range old {
+		if k != ap {
+			links[k] = v
+		}
+	}
+	u.links.Store(&links)
+}
+
+// get returns the link to ap, nil if there is none
+func (u *underlayLinks) get(ap netip.AddrPort) underlayLink {
+	return (*u.links.Load())[ap]
+}
+
+// lookup returns the link standing in for addr, nil if we reach it over udp
+func (u *underlayLinks) lookup(addr *udp.Addr) underlayLink {
+	links := *u.links.Load()
+	if len(links) == 0 {
+		return nil
+	}
+
+	ip, ok := netip.AddrFromSlice(addr.IP)
+	if !ok {
+		return nil
+	}
+	return links[netip.AddrPortFrom(ip.Unmap(), addr.Port)]
+}
+
+// wrap returns a udp.Conn that sends to link addresses over their link and everything else through c
+func (u *underlayLinks) wrap(c udp.Conn) udp.Conn {
+	return &underlayConn{Conn: c, links: u}
+}
+
+type underlayConn struct {
+	udp.Conn
+	links *underlayLinks
+}
+
+func (c *underlayConn) WriteTo(b []byte, addr *udp.Addr) error {
+	if link := c.links.lookup(addr); link != nil {
+		link.send(b)
+		return nil
+	}
+	return c.Conn.WriteTo(b, addr)
+}
+
+// WriteBatch sends the packets for links over them and the rest as a batch through the udp conn, bufs, addrs and tos
+// are reordered
+func (c *underlayConn) WriteBatch(bufs [][]byte, addrs []*udp.Addr, tos []byte) error {
+	return writeBatchDiverted(c.Conn, bufs, addrs, tos, func(i int) bool {
+		if link := c.links.lookup(addrs[i]); link != nil {
+			link.send(bufs[i])
+			return true
+		}
+		return false
+	})
+}
+
+// writeBatchDiverted sends every packet divert does not take, by its index, as a batch through c. bufs, addrs and tos
+// are reordered
+func writeBatchDiverted(c udp.Conn, bufs [][]byte, addrs []*udp.Addr, tos []byte, divert func(i int) bool) error {
+	n := 0
+	for i := range bufs {
+		if divert(i) {
+			continue
+		}
+		bufs[n], addrs[n] = bufs[i], addrs[i]
+		if tos != nil {
+			tos[n] = tos[i]
+		}
+		n++
+	}
+
+	if n == 0 {
+		return nil
+	}
+	bufs, addrs = bufs[:n], addrs[:n]
+	if tos != nil {
+		tos = tos[:n]
+	}
+
+	if bc, ok := c.(udp.BatchConn); ok {
+		return bc.WriteBatch(bufs, addrs, tos)
+	}
+
+	for i := range bufs {
+		if err := c.WriteTo(bufs[i], addrs[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeOne sends the packet at i through c, with the traffic class at i if tos is set
+func writeOne(c udp.Conn, bufs [][]byte, addrs []*udp.Addr, tos []byte, i int) error {
+	if bc, ok := c.(udp.BatchConn); ok && tos != nil {
+		return bc.WriteBatch(bufs[i:i+1], addrs[i:i+1], tos[i:i+1])
+	}
+	return c.WriteTo(bufs[i], addrs[i])
+}
+
+// unwrapConn returns the udp socket under the underlay, port hop, proxy, capture and listener conns
+func unwrapConn(c udp.Conn) udp.Conn {
+	for {
+		switch wc := c.(type) {
+		case *underlayConn:
+			c = wc.Conn
+		case *portHopConn:
+			c = wc.Conn
+		case *proxyConn:
+			c = wc.Conn
+		case *captureConn:
+			c = wc.Conn
+		case *listenerConn:
+			c = wc.current()
+		default:
+			return c
+		}
+	}
+}
+
+// underlayReader handles packets read from a link like a udp read loop would, it is not safe for concurrent use
+type underlayReader struct {
+	f        *Interface
+	addr     *udp.Addr
+	out      []byte
+	h        *header.H
+	fwPacket *firewall.Packet
+	nb       []byte
+	lhf      udp.LightHouseHandlerFunc
+}
+
+func newUnderlayReader(f *Interface, ap netip.AddrPort) *underlayReader {
+	return &underlayReader{
+		f:        f,
+		addr:     udp.NewAddr(ap.Addr().AsSlice(), ap.Port()),
+		out:      make([]byte, mtu),
+		h:        &header.H{},
+		fwPacket: &firewall.Packet{},
+		nb:       make([]byte, 12, 12),
+		lhf:      lhHandleRequest(f.lightHouse.NewRequestHandler(), f),
+	}
+}
+
+func (r *underlayReader) handle(packet []byte) {
+	r.f.readOutsidePackets(r.addr, nil, r.out[:0], packet, r.h, r.fwPacket, r.lhf, r.nb, 0, nil, nil)
+}
+
+// linkAddr returns the address a link to ap stands in for, listening on :: has ipv4 peers show up mapped while they
+// are known by their ipv4 address everywhere else
+func linkAddr(ap netip.AddrPort) netip.AddrPort {
+	return netip.AddrPortFrom(ap.Addr().Unmap(), ap.Port())
+}
+
+// handshakeAddrs returns the distinct ips of remotes with port
+func handshakeAddrs(remotes []*udp.Addr, port uint16) []netip.AddrPort {
+	var out []netip.AddrPort
+	seen := map[netip.Addr]struct{}{}
+	for _, addr := range remotes {
+		ip, ok := netip.AddrFromSlice(addr.IP)
+		if !ok {
+			continue
+		}
+		ip = ip.Unmap()
+		if _, ok := seen[ip]; ok {
+			continue
+		}
+		seen[ip] = struct{}{}
+		out = append(out, netip.AddrPortFrom(ip, port))
+	}
+	return out
+}
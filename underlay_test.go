@@ -0,0 +1,68 @@
+package nebula
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+
+	"github.com/slackhq/nebula/udp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// recordConn records what is written to it as though it were a udp socket
+type recordConn struct {
+	udp.NoopConn
+	sent []string
+}
+
+func (c *recordConn) WriteTo(b []byte, addr *udp.Addr) error {
+	c.sent = append(c.sent, addr.String())
+	return nil
+}
+
+func TestUnderlayConn(t *testing.T) {
+	links := newUnderlayLinks()
+
+	rc := &recordConn{}
+	c := links.wrap(rc)
+	viaLink := udp.NewAddr(net.IP{1, 1, 1, 1}, 443)
+	udpAddr := udp.NewAddr(net.IP{1, 1, 1, 1}, 4242)
+
+	// Without links everything goes over udp
+	require.NoError(t, c.WriteTo([]byte{1}, viaLink))
+	assert.Equal(t, []string{"1.1.1.1:443"}, rc.sent)
+
+	s := newTCPStream(nil, nil, false, false)
+	links.add(netip.MustParseAddrPort("1.1.1.1:443"), s)
+	rc.sent = nil
+
+	require.NoError(t, c.WriteTo([]byte{1}, viaLink))
+	require.NoError(t, c.WriteTo([]byte{2}, udpAddr))
+	assert.Equal(t, []string{"1.1.1.1:4242"}, rc.sent)
+	assert.Len(t, s.sendq, 1)
+
+	rc.sent = nil
+	require.NoError(t, c.(udp.BatchConn).WriteBatch([][]byte{{3}, {4}, {5}}, []*udp.Addr{udpAddr, viaLink, udp.NewAddr(net.IP{2, 2, 2, 2}, 4242)}, nil))
+	assert.Equal(t, []string{"1.1.1.1:4242", "2.2.2.2:4242"}, rc.sent)
+	assert.Len(t, s.sendq, 2)
+
+	// A link that went away no longer takes its packets
+	links.remove(netip.MustParseAddrPort("1.1.1.1:443"), s)
+	rc.sent = nil
+	require.NoError(t, c.WriteTo([]byte{1}, viaLink))
+	assert.Equal(t, []string{"1.1.1.1:443"}, rc.sent)
+	assert.Same(t, rc, unwrapConn(c))
+}
+
+func TestHandshakeAddrs(t *testing.T) {
+	remotes := []*udp.Addr{
+		udp.NewAddr(net.IP{1, 1, 1, 1}, 4242),
+		udp.NewAddr(net.ParseIP("::ffff:1.1.1.1"), 4243),
+		udp.NewAddr(net.ParseIP("2001:db8::1"), 4242),
+	}
+	assert.Equal(t, []netip.AddrPort{
+		netip.MustParseAddrPort("1.1.1.1:443"),
+		netip.MustParseAddrPort("[2001:db8::1]:443"),
+	}, handshakeAddrs(remotes, 443))
+}
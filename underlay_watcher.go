@@ -0,0 +1,136 @@
+package nebula
+
+import (
+	"context"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/slackhq/nebula/config"
+)
+
+const (
+	defaultUnderlayWatchDebounce = time.Second
+	defaultUnderlayWatchInterval = 5 * time.Second
+)
+
+// underlayWatcher notices when the local interfaces or addresses change (a vpn coming up, docking, tethering, etc)
+// and causes the udp listeners to be rebound and the lighthouses to be updated. Without this we would only notice the
+// underlay changed after traffic started failing.
+type underlayWatcher struct {
+	l        *logrus.Logger
+	f        *Interface
+	debounce time.Duration
+	interval time.Duration
+
+	// notify is poked by the platform specific watcher whenever something may have changed
+	notify chan struct{}
+}
+
+func newUnderlayWatcherFromConfig(l *logrus.Logger, f *Interface, c *config.C) *underlayWatcher {
+	if !c.GetBool("listen.watch_interfaces", false) {
+		return nil
+	}
+
+	debounce := c.GetDuration("listen.watch_debounce", defaultUnderlayWatchDebounce)
+	if debounce < 0 {
+		debounce = defaultUnderlayWatchDebounce
+	}
+
+	interval := c.GetDuration("listen.watch_interval", defaultUnderlayWatchInterval)
+	if interval <= 0 {
+		interval = defaultUnderlayWatchInterval
+	}
+
+	return &underlayWatcher{
+		l:        l,
+		f:        f,
+		debounce: debounce,
+		interval: interval,
+		notify:   make(chan struct{}, 1),
+	}
+}
+
+// Start begins watching for underlay changes until ctx is done. This is a non blocking call.
+func (w *underlayWatcher) Start(ctx context.Context) {
+	if err := w.watch(ctx); err != nil {
+		w.l.WithError(err).Warn("Failed to subscribe to interface changes, falling back to polling")
+		go w.poll(ctx)
+	}
+
+	go w.run(ctx)
+}
+
+// poke signals the run loop that something changed, it never blocks
+func (w *underlayWatcher) poke() {
+	select {
+	case w.notify <- struct{}{}:
+	default:
+	}
+}
+
+func (w *underlayWatcher) run(ctx context.Context) {
+	var debounce <-chan time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-w.notify:
+			// Changes tend to arrive in bursts (link up, then one or more addresses), wait for things to settle
+			debounce = time.After(w.debounce)
+		case <-debounce:
+			debounce = nil
+			w.l.Info("Underlay interfaces changed, rebinding listeners and updating lighthouses")
+			w.f.rebindUnderlay()
+		}
+	}
+}
+
+// poll is used on platforms without a change subscription mechanism, or if subscribing failed
+func (w *underlayWatcher) poll(ctx context.Context) {
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+
+	last := interfaceAddrsFingerprint()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			current := interfaceAddrsFingerprint()
+			if current != last {
+				last = current
+				w.poke()
+			}
+		}
+	}
+}
+
+// interfaceAddrsFingerprint returns a stable string representing every address on every up interface
+func interfaceAddrsFingerprint() string {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return ""
+	}
+
+	var parts []string
+	for _, i := range ifaces {
+		if i.Flags&net.FlagUp == 0 {
+			continue
+		}
+
+		addrs, err := i.Addrs()
+		if err != nil {
+			continue
+		}
+
+		for _, a := range addrs {
+			parts = append(parts, i.Name+"="+a.String())
+		}
+	}
+
+	sort.Strings(parts)
+	return strings.Join(parts, ",")
+}
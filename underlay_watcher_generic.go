@@ -0,0 +1,14 @@
+//go:build !linux || android || e2e_testing
+// +build !linux android e2e_testing
+
+package nebula
+
+import (
+	"context"
+)
+
+// watch has no change notification mechanism to use on this platform so we poll the interface list instead
+func (w *underlayWatcher) watch(ctx context.Context) error {
+	go w.poll(ctx)
+	return nil
+}
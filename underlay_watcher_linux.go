@@ -0,0 +1,79 @@
+//go:build !android && !e2e_testing
+// +build !android,!e2e_testing
+
+package nebula
+
+import (
+	"context"
+
+	"github.com/vishvananda/netlink"
+)
+
+// watch subscribes to netlink link and address updates
+func (w *underlayWatcher) watch(ctx context.Context) error {
+	done := make(chan struct{})
+	addrCh := make(chan netlink.AddrUpdate)
+	linkCh := make(chan netlink.LinkUpdate)
+
+	if err := netlink.AddrSubscribe(addrCh, done); err != nil {
+		close(done)
+		return err
+	}
+
+	if err := netlink.LinkSubscribe(linkCh, done); err != nil {
+		close(done)
+		return err
+	}
+
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				// netlink will close the update channels for us
+				close(done)
+				return
+			case u, ok := <-addrCh:
+				if !ok {
+					w.lostSubscription(ctx, done)
+					return
+				}
+				if w.f.inside != nil && u.LinkIndex == w.insideIndex() {
+					// Our own tun device changing doesn't affect the underlay
+					continue
+				}
+				w.poke()
+			case _, ok := <-linkCh:
+				if !ok {
+					w.lostSubscription(ctx, done)
+					return
+				}
+				w.poke()
+			}
+		}
+	}()
+
+	return nil
+}
+
+// lostSubscription switches to polling when netlink closes an update channel on us, usually because reading from the
+// netlink socket failed
+func (w *underlayWatcher) lostSubscription(ctx context.Context, done chan struct{}) {
+	// Tear down the other subscription too
+	close(done)
+	if ctx.Err() != nil {
+		return
+	}
+
+	w.l.Error("Lost the subscription to interface changes, falling back to polling")
+	go w.poll(ctx)
+	// Whatever we missed while the subscription was failing is only noticed by polling once it changes again
+	w.poke()
+}
+
+func (w *underlayWatcher) insideIndex() int {
+	link, err := netlink.LinkByName(w.f.inside.Name())
+	if err != nil {
+		return -1
+	}
+	return link.Attrs().Index
+}
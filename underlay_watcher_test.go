@@ -0,0 +1,43 @@
+package nebula
+
+import (
+	"testing"
+	"time"
+
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewUnderlayWatcherFromConfig(t *testing.T) {
+	l := test.NewLogger()
+	c := config.NewC(l)
+
+	// Disabled by default
+	assert.Nil(t, newUnderlayWatcherFromConfig(l, nil, c))
+
+	c.Settings["listen"] = map[interface{}]interface{}{"watch_interfaces": true}
+	w := newUnderlayWatcherFromConfig(l, nil, c)
+	assert.NotNil(t, w)
+	assert.Equal(t, defaultUnderlayWatchDebounce, w.debounce)
+	assert.Equal(t, defaultUnderlayWatchInterval, w.interval)
+
+	c.Settings["listen"] = map[interface{}]interface{}{
+		"watch_interfaces": true,
+		"watch_debounce":   "250ms",
+		"watch_interval":   "-1s",
+	}
+	w = newUnderlayWatcherFromConfig(l, nil, c)
+	assert.Equal(t, 250*time.Millisecond, w.debounce)
+	assert.Equal(t, defaultUnderlayWatchInterval, w.interval)
+}
+
+func TestUnderlayWatcher_poke(t *testing.T) {
+	w := &underlayWatcher{notify: make(chan struct{}, 1)}
+
+	// Multiple pokes must never block and should coalesce
+	w.poke()
+	w.poke()
+	w.poke()
+	assert.Len(t, w.notify, 1)
+}
@@ -0,0 +1,68 @@
+package nebula
+
+import "github.com/slackhq/nebula/iputil"
+
+// Lighthouse and control messages carry an ipv4 overlay address in its uint32 field, which every version of nebula
+// understands, and an ipv6 address in the Addr field next to it.
+
+// vpnIp returns the address the message is about
+func (d *NebulaMetaDetails) vpnIp() iputil.VpnIp {
+	if d.VpnAddr != nil {
+		return VpnIpFromAddr(d.VpnAddr)
+	}
+	return iputil.VpnIpFrom4(d.VpnIp)
+}
+
+func (d *NebulaMetaDetails) setVpnIp(ip iputil.VpnIp) {
+	d.VpnIp, d.VpnAddr = splitVpnIp(ip)
+}
+
+// relays returns the relays in the message, ipv4 first
+func (d *NebulaMetaDetails) relays() []iputil.VpnIp {
+	if len(d.RelayVpnIp)+len(d.RelayVpnAddrs) == 0 {
+		return nil
+	}
+	relays := make([]iputil.VpnIp, 0, len(d.RelayVpnIp)+len(d.RelayVpnAddrs))
+	for _, r := range d.RelayVpnIp {
+		relays = append(relays, iputil.VpnIpFrom4(r))
+	}
+	for _, r := range d.RelayVpnAddrs {
+		relays = append(relays, VpnIpFromAddr(r))
+	}
+	return relays
+}
+
+func (d *NebulaMetaDetails) addRelay(ip iputil.VpnIp) {
+	if ip.Is4() {
+		d.RelayVpnIp = append(d.RelayVpnIp, ip.Uint32())
+	} else {
+		d.RelayVpnAddrs = append(d.RelayVpnAddrs, NewAddr(ip))
+	}
+}
+
+func (m *NebulaControl) relayFrom() iputil.VpnIp {
+	if m.RelayFromAddr != nil {
+		return VpnIpFromAddr(m.RelayFromAddr)
+	}
+	return iputil.VpnIpFrom4(m.RelayFromIp)
+}
+
+func (m *NebulaControl) relayTo() iputil.VpnIp {
+	if m.RelayToAddr != nil {
+		return VpnIpFromAddr(m.RelayToAddr)
+	}
+	return iputil.VpnIpFrom4(m.RelayToIp)
+}
+
+// setRelay sets who a relay is from and to
+func (m *NebulaControl) setRelay(from, to iputil.VpnIp) {
+	m.RelayFromIp, m.RelayFromAddr = splitVpnIp(from)
+	m.RelayToIp, m.RelayToAddr = splitVpnIp(to)
+}
+
+func splitVpnIp(ip iputil.VpnIp) (uint32, *Addr) {
+	if ip.Is4() || !ip.IsValid() {
+		return ip.Uint32(), nil
+	}
+	return 0, NewAddr(ip)
+}